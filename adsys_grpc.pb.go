@@ -24,13 +24,18 @@ const (
 	Service_Status_FullMethodName                  = "/service/Status"
 	Service_Stop_FullMethodName                    = "/service/Stop"
 	Service_UpdatePolicy_FullMethodName            = "/service/UpdatePolicy"
+	Service_DownloadPolicy_FullMethodName          = "/service/DownloadPolicy"
+	Service_ApplyPolicy_FullMethodName             = "/service/ApplyPolicy"
 	Service_DumpPolicies_FullMethodName            = "/service/DumpPolicies"
 	Service_DumpPoliciesDefinitions_FullMethodName = "/service/DumpPoliciesDefinitions"
 	Service_GetDoc_FullMethodName                  = "/service/GetDoc"
 	Service_ListDoc_FullMethodName                 = "/service/ListDoc"
 	Service_ListUsers_FullMethodName               = "/service/ListUsers"
 	Service_GPOListScript_FullMethodName           = "/service/GPOListScript"
-	Service_CertAutoEnrollScript_FullMethodName    = "/service/CertAutoEnrollScript"
+	Service_AptDryRun_FullMethodName               = "/service/AptDryRun"
+	Service_CompareSSSDGPOs_FullMethodName         = "/service/CompareSSSDGPOs"
+	Service_Metrics_FullMethodName                 = "/service/Metrics"
+	Service_Telemetry_FullMethodName               = "/service/Telemetry"
 )
 
 // ServiceClient is the client API for Service service.
@@ -42,13 +47,18 @@ type ServiceClient interface {
 	Status(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_StatusClient, error)
 	Stop(ctx context.Context, in *StopRequest, opts ...grpc.CallOption) (Service_StopClient, error)
 	UpdatePolicy(ctx context.Context, in *UpdatePolicyRequest, opts ...grpc.CallOption) (Service_UpdatePolicyClient, error)
+	DownloadPolicy(ctx context.Context, in *DownloadPolicyRequest, opts ...grpc.CallOption) (Service_DownloadPolicyClient, error)
+	ApplyPolicy(ctx context.Context, in *ApplyPolicyRequest, opts ...grpc.CallOption) (Service_ApplyPolicyClient, error)
 	DumpPolicies(ctx context.Context, in *DumpPoliciesRequest, opts ...grpc.CallOption) (Service_DumpPoliciesClient, error)
 	DumpPoliciesDefinitions(ctx context.Context, in *DumpPolicyDefinitionsRequest, opts ...grpc.CallOption) (Service_DumpPoliciesDefinitionsClient, error)
 	GetDoc(ctx context.Context, in *GetDocRequest, opts ...grpc.CallOption) (Service_GetDocClient, error)
 	ListDoc(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_ListDocClient, error)
 	ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (Service_ListUsersClient, error)
 	GPOListScript(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_GPOListScriptClient, error)
-	CertAutoEnrollScript(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_CertAutoEnrollScriptClient, error)
+	AptDryRun(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_AptDryRunClient, error)
+	CompareSSSDGPOs(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_CompareSSSDGPOsClient, error)
+	Metrics(ctx context.Context, in *MetricsRequest, opts ...grpc.CallOption) (Service_MetricsClient, error)
+	Telemetry(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_TelemetryClient, error)
 }
 
 type serviceClient struct {
@@ -203,7 +213,7 @@ func (c *serviceClient) UpdatePolicy(ctx context.Context, in *UpdatePolicyReques
 }
 
 type Service_UpdatePolicyClient interface {
-	Recv() (*Empty, error)
+	Recv() (*PolicyReport, error)
 	grpc.ClientStream
 }
 
@@ -211,7 +221,39 @@ type serviceUpdatePolicyClient struct {
 	grpc.ClientStream
 }
 
-func (x *serviceUpdatePolicyClient) Recv() (*Empty, error) {
+func (x *serviceUpdatePolicyClient) Recv() (*PolicyReport, error) {
+	m := new(PolicyReport)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *serviceClient) DownloadPolicy(ctx context.Context, in *DownloadPolicyRequest, opts ...grpc.CallOption) (Service_DownloadPolicyClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[5], Service_DownloadPolicy_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &serviceDownloadPolicyClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Service_DownloadPolicyClient interface {
+	Recv() (*Empty, error)
+	grpc.ClientStream
+}
+
+type serviceDownloadPolicyClient struct {
+	grpc.ClientStream
+}
+
+func (x *serviceDownloadPolicyClient) Recv() (*Empty, error) {
 	m := new(Empty)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
@@ -219,8 +261,40 @@ func (x *serviceUpdatePolicyClient) Recv() (*Empty, error) {
 	return m, nil
 }
 
+func (c *serviceClient) ApplyPolicy(ctx context.Context, in *ApplyPolicyRequest, opts ...grpc.CallOption) (Service_ApplyPolicyClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[6], Service_ApplyPolicy_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &serviceApplyPolicyClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Service_ApplyPolicyClient interface {
+	Recv() (*PolicyReport, error)
+	grpc.ClientStream
+}
+
+type serviceApplyPolicyClient struct {
+	grpc.ClientStream
+}
+
+func (x *serviceApplyPolicyClient) Recv() (*PolicyReport, error) {
+	m := new(PolicyReport)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *serviceClient) DumpPolicies(ctx context.Context, in *DumpPoliciesRequest, opts ...grpc.CallOption) (Service_DumpPoliciesClient, error) {
-	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[5], Service_DumpPolicies_FullMethodName, opts...)
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[7], Service_DumpPolicies_FullMethodName, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -252,7 +326,7 @@ func (x *serviceDumpPoliciesClient) Recv() (*StringResponse, error) {
 }
 
 func (c *serviceClient) DumpPoliciesDefinitions(ctx context.Context, in *DumpPolicyDefinitionsRequest, opts ...grpc.CallOption) (Service_DumpPoliciesDefinitionsClient, error) {
-	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[6], Service_DumpPoliciesDefinitions_FullMethodName, opts...)
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[8], Service_DumpPoliciesDefinitions_FullMethodName, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -284,7 +358,7 @@ func (x *serviceDumpPoliciesDefinitionsClient) Recv() (*DumpPolicyDefinitionsRes
 }
 
 func (c *serviceClient) GetDoc(ctx context.Context, in *GetDocRequest, opts ...grpc.CallOption) (Service_GetDocClient, error) {
-	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[7], Service_GetDoc_FullMethodName, opts...)
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[9], Service_GetDoc_FullMethodName, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -316,7 +390,7 @@ func (x *serviceGetDocClient) Recv() (*StringResponse, error) {
 }
 
 func (c *serviceClient) ListDoc(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_ListDocClient, error) {
-	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[8], Service_ListDoc_FullMethodName, opts...)
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[10], Service_ListDoc_FullMethodName, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -348,7 +422,7 @@ func (x *serviceListDocClient) Recv() (*ListDocReponse, error) {
 }
 
 func (c *serviceClient) ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (Service_ListUsersClient, error) {
-	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[9], Service_ListUsers_FullMethodName, opts...)
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[11], Service_ListUsers_FullMethodName, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -380,7 +454,7 @@ func (x *serviceListUsersClient) Recv() (*StringResponse, error) {
 }
 
 func (c *serviceClient) GPOListScript(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_GPOListScriptClient, error) {
-	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[10], Service_GPOListScript_FullMethodName, opts...)
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[12], Service_GPOListScript_FullMethodName, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -411,12 +485,12 @@ func (x *serviceGPOListScriptClient) Recv() (*StringResponse, error) {
 	return m, nil
 }
 
-func (c *serviceClient) CertAutoEnrollScript(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_CertAutoEnrollScriptClient, error) {
-	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[11], Service_CertAutoEnrollScript_FullMethodName, opts...)
+func (c *serviceClient) AptDryRun(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_AptDryRunClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[13], Service_AptDryRun_FullMethodName, opts...)
 	if err != nil {
 		return nil, err
 	}
-	x := &serviceCertAutoEnrollScriptClient{stream}
+	x := &serviceAptDryRunClient{stream}
 	if err := x.ClientStream.SendMsg(in); err != nil {
 		return nil, err
 	}
@@ -426,16 +500,112 @@ func (c *serviceClient) CertAutoEnrollScript(ctx context.Context, in *Empty, opt
 	return x, nil
 }
 
-type Service_CertAutoEnrollScriptClient interface {
+type Service_AptDryRunClient interface {
 	Recv() (*StringResponse, error)
 	grpc.ClientStream
 }
 
-type serviceCertAutoEnrollScriptClient struct {
+type serviceAptDryRunClient struct {
 	grpc.ClientStream
 }
 
-func (x *serviceCertAutoEnrollScriptClient) Recv() (*StringResponse, error) {
+func (x *serviceAptDryRunClient) Recv() (*StringResponse, error) {
+	m := new(StringResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *serviceClient) CompareSSSDGPOs(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_CompareSSSDGPOsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[14], Service_CompareSSSDGPOs_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &serviceCompareSSSDGPOsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Service_CompareSSSDGPOsClient interface {
+	Recv() (*StringResponse, error)
+	grpc.ClientStream
+}
+
+type serviceCompareSSSDGPOsClient struct {
+	grpc.ClientStream
+}
+
+func (x *serviceCompareSSSDGPOsClient) Recv() (*StringResponse, error) {
+	m := new(StringResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *serviceClient) Metrics(ctx context.Context, in *MetricsRequest, opts ...grpc.CallOption) (Service_MetricsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[15], Service_Metrics_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &serviceMetricsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Service_MetricsClient interface {
+	Recv() (*StringResponse, error)
+	grpc.ClientStream
+}
+
+type serviceMetricsClient struct {
+	grpc.ClientStream
+}
+
+func (x *serviceMetricsClient) Recv() (*StringResponse, error) {
+	m := new(StringResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *serviceClient) Telemetry(ctx context.Context, in *Empty, opts ...grpc.CallOption) (Service_TelemetryClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[16], Service_Telemetry_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &serviceTelemetryClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Service_TelemetryClient interface {
+	Recv() (*StringResponse, error)
+	grpc.ClientStream
+}
+
+type serviceTelemetryClient struct {
+	grpc.ClientStream
+}
+
+func (x *serviceTelemetryClient) Recv() (*StringResponse, error) {
 	m := new(StringResponse)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
@@ -452,13 +622,18 @@ type ServiceServer interface {
 	Status(*Empty, Service_StatusServer) error
 	Stop(*StopRequest, Service_StopServer) error
 	UpdatePolicy(*UpdatePolicyRequest, Service_UpdatePolicyServer) error
+	DownloadPolicy(*DownloadPolicyRequest, Service_DownloadPolicyServer) error
+	ApplyPolicy(*ApplyPolicyRequest, Service_ApplyPolicyServer) error
 	DumpPolicies(*DumpPoliciesRequest, Service_DumpPoliciesServer) error
 	DumpPoliciesDefinitions(*DumpPolicyDefinitionsRequest, Service_DumpPoliciesDefinitionsServer) error
 	GetDoc(*GetDocRequest, Service_GetDocServer) error
 	ListDoc(*Empty, Service_ListDocServer) error
 	ListUsers(*ListUsersRequest, Service_ListUsersServer) error
 	GPOListScript(*Empty, Service_GPOListScriptServer) error
-	CertAutoEnrollScript(*Empty, Service_CertAutoEnrollScriptServer) error
+	AptDryRun(*Empty, Service_AptDryRunServer) error
+	CompareSSSDGPOs(*Empty, Service_CompareSSSDGPOsServer) error
+	Metrics(*MetricsRequest, Service_MetricsServer) error
+	Telemetry(*Empty, Service_TelemetryServer) error
 	mustEmbedUnimplementedServiceServer()
 }
 
@@ -481,6 +656,12 @@ func (UnimplementedServiceServer) Stop(*StopRequest, Service_StopServer) error {
 func (UnimplementedServiceServer) UpdatePolicy(*UpdatePolicyRequest, Service_UpdatePolicyServer) error {
 	return status.Errorf(codes.Unimplemented, "method UpdatePolicy not implemented")
 }
+func (UnimplementedServiceServer) DownloadPolicy(*DownloadPolicyRequest, Service_DownloadPolicyServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadPolicy not implemented")
+}
+func (UnimplementedServiceServer) ApplyPolicy(*ApplyPolicyRequest, Service_ApplyPolicyServer) error {
+	return status.Errorf(codes.Unimplemented, "method ApplyPolicy not implemented")
+}
 func (UnimplementedServiceServer) DumpPolicies(*DumpPoliciesRequest, Service_DumpPoliciesServer) error {
 	return status.Errorf(codes.Unimplemented, "method DumpPolicies not implemented")
 }
@@ -499,8 +680,17 @@ func (UnimplementedServiceServer) ListUsers(*ListUsersRequest, Service_ListUsers
 func (UnimplementedServiceServer) GPOListScript(*Empty, Service_GPOListScriptServer) error {
 	return status.Errorf(codes.Unimplemented, "method GPOListScript not implemented")
 }
-func (UnimplementedServiceServer) CertAutoEnrollScript(*Empty, Service_CertAutoEnrollScriptServer) error {
-	return status.Errorf(codes.Unimplemented, "method CertAutoEnrollScript not implemented")
+func (UnimplementedServiceServer) AptDryRun(*Empty, Service_AptDryRunServer) error {
+	return status.Errorf(codes.Unimplemented, "method AptDryRun not implemented")
+}
+func (UnimplementedServiceServer) CompareSSSDGPOs(*Empty, Service_CompareSSSDGPOsServer) error {
+	return status.Errorf(codes.Unimplemented, "method CompareSSSDGPOs not implemented")
+}
+func (UnimplementedServiceServer) Metrics(*MetricsRequest, Service_MetricsServer) error {
+	return status.Errorf(codes.Unimplemented, "method Metrics not implemented")
+}
+func (UnimplementedServiceServer) Telemetry(*Empty, Service_TelemetryServer) error {
+	return status.Errorf(codes.Unimplemented, "method Telemetry not implemented")
 }
 func (UnimplementedServiceServer) mustEmbedUnimplementedServiceServer() {}
 
@@ -608,7 +798,7 @@ func _Service_UpdatePolicy_Handler(srv interface{}, stream grpc.ServerStream) er
 }
 
 type Service_UpdatePolicyServer interface {
-	Send(*Empty) error
+	Send(*PolicyReport) error
 	grpc.ServerStream
 }
 
@@ -616,7 +806,49 @@ type serviceUpdatePolicyServer struct {
 	grpc.ServerStream
 }
 
-func (x *serviceUpdatePolicyServer) Send(m *Empty) error {
+func (x *serviceUpdatePolicyServer) Send(m *PolicyReport) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Service_DownloadPolicy_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadPolicyRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ServiceServer).DownloadPolicy(m, &serviceDownloadPolicyServer{stream})
+}
+
+type Service_DownloadPolicyServer interface {
+	Send(*Empty) error
+	grpc.ServerStream
+}
+
+type serviceDownloadPolicyServer struct {
+	grpc.ServerStream
+}
+
+func (x *serviceDownloadPolicyServer) Send(m *Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Service_ApplyPolicy_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ApplyPolicyRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ServiceServer).ApplyPolicy(m, &serviceApplyPolicyServer{stream})
+}
+
+type Service_ApplyPolicyServer interface {
+	Send(*PolicyReport) error
+	grpc.ServerStream
+}
+
+type serviceApplyPolicyServer struct {
+	grpc.ServerStream
+}
+
+func (x *serviceApplyPolicyServer) Send(m *PolicyReport) error {
 	return x.ServerStream.SendMsg(m)
 }
 
@@ -746,24 +978,87 @@ func (x *serviceGPOListScriptServer) Send(m *StringResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
-func _Service_CertAutoEnrollScript_Handler(srv interface{}, stream grpc.ServerStream) error {
+func _Service_AptDryRun_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ServiceServer).AptDryRun(m, &serviceAptDryRunServer{stream})
+}
+
+type Service_AptDryRunServer interface {
+	Send(*StringResponse) error
+	grpc.ServerStream
+}
+
+type serviceAptDryRunServer struct {
+	grpc.ServerStream
+}
+
+func (x *serviceAptDryRunServer) Send(m *StringResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Service_CompareSSSDGPOs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ServiceServer).CompareSSSDGPOs(m, &serviceCompareSSSDGPOsServer{stream})
+}
+
+type Service_CompareSSSDGPOsServer interface {
+	Send(*StringResponse) error
+	grpc.ServerStream
+}
+
+type serviceCompareSSSDGPOsServer struct {
+	grpc.ServerStream
+}
+
+func (x *serviceCompareSSSDGPOsServer) Send(m *StringResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Service_Metrics_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(MetricsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ServiceServer).Metrics(m, &serviceMetricsServer{stream})
+}
+
+type Service_MetricsServer interface {
+	Send(*StringResponse) error
+	grpc.ServerStream
+}
+
+type serviceMetricsServer struct {
+	grpc.ServerStream
+}
+
+func (x *serviceMetricsServer) Send(m *StringResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Service_Telemetry_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(Empty)
 	if err := stream.RecvMsg(m); err != nil {
 		return err
 	}
-	return srv.(ServiceServer).CertAutoEnrollScript(m, &serviceCertAutoEnrollScriptServer{stream})
+	return srv.(ServiceServer).Telemetry(m, &serviceTelemetryServer{stream})
 }
 
-type Service_CertAutoEnrollScriptServer interface {
+type Service_TelemetryServer interface {
 	Send(*StringResponse) error
 	grpc.ServerStream
 }
 
-type serviceCertAutoEnrollScriptServer struct {
+type serviceTelemetryServer struct {
 	grpc.ServerStream
 }
 
-func (x *serviceCertAutoEnrollScriptServer) Send(m *StringResponse) error {
+func (x *serviceTelemetryServer) Send(m *StringResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
@@ -800,6 +1095,16 @@ var Service_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _Service_UpdatePolicy_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "DownloadPolicy",
+			Handler:       _Service_DownloadPolicy_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ApplyPolicy",
+			Handler:       _Service_ApplyPolicy_Handler,
+			ServerStreams: true,
+		},
 		{
 			StreamName:    "DumpPolicies",
 			Handler:       _Service_DumpPolicies_Handler,
@@ -831,8 +1136,23 @@ var Service_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 		},
 		{
-			StreamName:    "CertAutoEnrollScript",
-			Handler:       _Service_CertAutoEnrollScript_Handler,
+			StreamName:    "AptDryRun",
+			Handler:       _Service_AptDryRun_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "CompareSSSDGPOs",
+			Handler:       _Service_CompareSSSDGPOs_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Metrics",
+			Handler:       _Service_Metrics_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Telemetry",
+			Handler:       _Service_Telemetry_Handler,
 			ServerStreams: true,
 		},
 	},
@@ -28,13 +28,17 @@ type App struct {
 	cancel context.CancelFunc
 
 	config daemonConfig
+
+	// partialFailure is set when only some policy managers failed during a policy refresh.
+	partialFailure bool
 }
 
 type daemonConfig struct {
 	Verbose            int
 	Socket             string
-	ClientTimeout      int  `mapstructure:"client_timeout"`
-	DetectCachedTicket bool `mapstructure:"detect_cached_ticket"`
+	ClientTimeout      int           `mapstructure:"client_timeout"`
+	DetectCachedTicket bool          `mapstructure:"detect_cached_ticket"`
+	RefreshOnUnlock    time.Duration `mapstructure:"refresh_on_unlock"`
 }
 
 // New registers commands and return a new App.
@@ -106,9 +110,11 @@ func New() *App {
 
 	// subcommands
 	a.installDoc()
+	a.installInit()
 	a.installPolicy()
 	a.installService()
 	a.installVersion()
+	a.installCompletion()
 
 	return &a
 }
@@ -124,12 +130,22 @@ func (a App) UsageError() bool {
 	return !a.rootCmd.SilenceUsage
 }
 
+// PartialFailure returns if the error is due to some policy managers failing to apply their rules.
+func (a App) PartialFailure() bool {
+	return a.partialFailure
+}
+
 // Hup call Quit() and return true to signal quitting.
 func (a *App) Hup() (shouldQuit bool) {
 	a.Quit()
 	return true
 }
 
+// Upgrade does nothing for the client and return false to signal you shouldn't quit.
+func (a *App) Upgrade() (shouldQuit bool) {
+	return false
+}
+
 // Quit exits and send an cancellation request to the service.
 func (a *App) Quit() {
 	a.cancel()
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/spf13/cobra"
+	"github.com/ubuntu/adsys/cmd/adsysd/daemon"
+	"github.com/ubuntu/adsys/internal/completion"
+	"github.com/ubuntu/decorate"
+)
+
+const adwatchdCmdName = "adwatchd"
+
+func (a *App) installCompletion() {
+	// Create the default completion command now to attach our own subcommand to it.
+	a.rootCmd.InitDefaultCompletionCmd()
+	var completionCmd *cobra.Command
+	for _, cmd := range a.rootCmd.Commands() {
+		if cmd.Name() == "completion" {
+			completionCmd = cmd
+			break
+		}
+	}
+	if completionCmd == nil {
+		return
+	}
+
+	var shell *string
+	cmd := &cobra.Command{
+		Use:   "install [COMMAND...]",
+		Short: gotext.Get("Install the completion scripts"),
+		Long: gotext.Get(`Install the completion scripts of the given commands for your shell.
+
+By default, the completion of %[1]s is installed. The completion of %[2]s and %[3]s can be installed too.
+The shell is detected from your login shell, unless --shell is used.
+
+When run as root, the scripts are installed in the completion directories of the system, for all users.
+Otherwise, they are installed for the current user only. As zsh doesn't load the completion scripts of
+users from a directory, instructions to enable the completion are printed instead.`, CmdName, daemon.CmdName, adwatchdCmdName),
+		Args:      cobra.OnlyValidArgs,
+		ValidArgs: []string{CmdName, daemon.CmdName, adwatchdCmdName},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				args = []string{CmdName}
+			}
+			return a.installCompletionScripts(cmd.OutOrStdout(), *shell, args)
+		},
+	}
+	shell = cmd.Flags().String("shell", "", gotext.Get("shell to install the completion for, among %s. Defaults to your login shell.", strings.Join(completion.Shells, ", ")))
+	decorate.LogOnError(cmd.RegisterFlagCompletionFunc("shell", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+		return completion.Shells, cobra.ShellCompDirectiveNoFileComp
+	}))
+	completionCmd.AddCommand(cmd)
+}
+
+// installCompletionScripts installs the completion scripts of cmds for shell, printing the results to w.
+func (a *App) installCompletionScripts(w io.Writer, shell string, cmds []string) (err error) {
+	i := completion.New()
+	shell, err = i.Shell(shell)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range cmds {
+		var gen completion.Generator
+		switch name {
+		case CmdName:
+			gen = cobraGenerator(&a.rootCmd)
+		case daemon.CmdName:
+			rootCmd := daemon.New().RootCmd()
+			gen = cobraGenerator(&rootCmd)
+		case adwatchdCmdName:
+			gen = a.execGenerator(adwatchdCmdName)
+		}
+
+		msg, err := i.Install(name, shell, gen)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(w, msg)
+	}
+
+	return nil
+}
+
+// cobraGenerator returns a generator of the completion scripts of the command cmd.
+func cobraGenerator(cmd *cobra.Command) completion.Generator {
+	return func(w io.Writer, shell string) error {
+		switch shell {
+		case completion.Bash:
+			return cmd.GenBashCompletionV2(w, true)
+		case completion.Zsh:
+			return cmd.GenZshCompletion(w)
+		case completion.Fish:
+			return cmd.GenFishCompletion(w, true)
+		}
+		return errors.New(gotext.Get("unsupported shell %q", shell))
+	}
+}
+
+// execGenerator returns a generator running the completion command of the installed program name.
+func (a *App) execGenerator(name string) completion.Generator {
+	return func(w io.Writer, shell string) error {
+		p, err := exec.LookPath(name)
+		if err != nil {
+			return errors.New(gotext.Get("%s is not installed", name))
+		}
+
+		var errBuf bytes.Buffer
+		// #nosec G204 - the program and shell are validated
+		c := exec.CommandContext(a.ctx, p, "completion", shell)
+		c.Stdout = w
+		c.Stderr = &errBuf
+		if err := c.Run(); err != nil {
+			if stderr := strings.TrimSpace(errBuf.String()); stderr != "" {
+				return fmt.Errorf("%w: %s", err, stderr)
+			}
+			return err
+		}
+		return nil
+	}
+}
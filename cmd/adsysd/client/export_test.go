@@ -20,3 +20,6 @@ func (a *App) AddWaitCommand() {
 		},
 	})
 }
+
+// LockedHint exposes lockedHint for tests.
+var LockedHint = lockedHint
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/spf13/cobra"
+	"github.com/ubuntu/adsys/internal/cmdhandler"
+	"github.com/ubuntu/adsys/internal/consts"
+	"github.com/ubuntu/adsys/internal/setup"
+)
+
+func (a *App) installInit() {
+	var assumeYes, force, refresh *bool
+	var output *string
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: gotext.Get("Detects how the machine is joined to Active Directory and writes the matching configuration"),
+		Long: gotext.Get(`Detects how the machine is joined to Active Directory (realm, sssd or winbind), proposes the matching
+adsys settings, checks the connectivity to Active Directory and the polkit actions, then writes the configuration.
+A first refresh of the machine policies can be triggered once the configuration is written.`),
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: cmdhandler.NoValidArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			w := setup.NewWizard(cmd.InOrStdin(), cmd.OutOrStdout())
+			w.AssumeYes = *assumeYes
+			w.Force = *force
+			w.RefreshNow = *refresh
+			w.Refresh = func(context.Context) error {
+				// The daemon only reads its backend settings on startup: stop it so that the
+				// refresh request starts it again with the new configuration.
+				if err := a.serviceStop(false); err != nil {
+					return err
+				}
+				return a.update(downloadAndApply, true, false, "", "", 0)
+			}
+			return w.Run(a.ctx, *output)
+		},
+	}
+	assumeYes = cmd.Flags().BoolP("yes", "y", false, gotext.Get("accept the proposed settings and the default answers without prompting."))
+	force = cmd.Flags().BoolP("force", "", false, gotext.Get("write the configuration even if some checks failed, and overwrite an existing configuration file."))
+	refresh = cmd.Flags().BoolP("refresh", "", false, gotext.Get("refresh the machine policies once the configuration is written. This is the default answer when prompted."))
+	output = cmd.Flags().StringP("output", "o", consts.DefaultConfigPath, gotext.Get("path of the configuration file to write."))
+	a.rootCmd.AddCommand(cmd)
+}
@@ -7,8 +7,11 @@ import (
 	"io"
 	"os"
 	"os/user"
+	"slices"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/leonelquinteros/gotext"
@@ -19,6 +22,7 @@ import (
 	"github.com/ubuntu/adsys/internal/cmdhandler"
 	"github.com/ubuntu/adsys/internal/consts"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies"
 	"github.com/ubuntu/decorate"
 	"golang.org/x/sys/unix"
 )
@@ -47,11 +51,18 @@ func (a *App) installPolicy() {
 	distro = mainCmd.Flags().StringP("distro", "", consts.DistroID, gotext.Get("distro for which to retrieve policy definition."))
 	policyCmd.AddCommand(mainCmd)
 
-	var details, all, nocolor, isMachine *bool
+	var details, all, nocolor, isMachine, raw *bool
+	var since *time.Duration
+	var manager *string
 	appliedCmd := &cobra.Command{
 		Use:   "applied [USER_NAME]",
 		Short: gotext.Get("Print last applied GPOs for current or given user/machine"),
-		Args:  cmdhandler.ZeroOrNArgs(1),
+		Long: gotext.Get(`Print last applied GPOs for current or given user/machine.
+
+With --manager and --raw, the state applied by this policy manager is printed instead, like the content of the files it
+generated or what it loaded in the system, for debugging. All the managers support it, except
+the scripts, mount, gdm, session, proxy, certificate, encryption, network and vpn ones.`),
+		Args: cmdhandler.ZeroOrNArgs(1),
 		ValidArgsFunction: func(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
 			if len(args) != 0 {
 				return nil, cobra.ShellCompDirectiveNoFileComp
@@ -64,16 +75,48 @@ func (a *App) installPolicy() {
 			if len(args) > 0 {
 				target = args[0]
 			}
-			return a.dumpPolicies(target, *details, *all, *nocolor, *isMachine)
+			if *raw {
+				return a.dumpState(target, *manager, *isMachine)
+			}
+			return a.dumpPolicies(target, *details, *all, *nocolor, *isMachine, *since)
 		},
 	}
 	details = appliedCmd.Flags().BoolP("details", "", false, gotext.Get("show applied rules in addition to GPOs."))
 	all = appliedCmd.Flags().BoolP("all", "a", false, gotext.Get("show overridden rules in each GPOs."))
 	nocolor = appliedCmd.Flags().BoolP("no-color", "", false, gotext.Get("don't display colorized version."))
 	isMachine = appliedCmd.Flags().BoolP("machine", "m", false, gotext.Get("show applied rules to the machine."))
+	since = appliedCmd.Flags().DurationP("since", "", 0, gotext.Get("only show rules changed within this duration (e.g. 24h), with the time of their last change."))
+	manager = appliedCmd.Flags().StringP("manager", "", "", gotext.Get("policy manager to show the raw applied state of, with --raw."))
+	raw = appliedCmd.Flags().BoolP("raw", "", false, gotext.Get("show the raw state applied by the policy manager instead of the GPOs."))
+	appliedCmd.MarkFlagsRequiredTogether("manager", "raw")
+	appliedCmd.MarkFlagsMutuallyExclusive("raw", "details")
+	appliedCmd.MarkFlagsMutuallyExclusive("raw", "all")
+	appliedCmd.MarkFlagsMutuallyExclusive("raw", "since")
 	policyCmd.AddCommand(appliedCmd)
 	cmdhandler.RegisterAlias(appliedCmd, &a.rootCmd)
 
+	aptDryRunCmd := &cobra.Command{
+		Use:               "apt-dry-run",
+		Short:             gotext.Get("Print the apt package changes the machine policies would apply"),
+		Long:              gotext.Get("Print the packages the last applied machine policies would install, remove, pin or block, without applying any change."),
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: cmdhandler.NoValidArgs,
+		RunE:              func(_ *cobra.Command, _ []string) error { return a.aptDryRun() },
+	}
+	policyCmd.AddCommand(aptDryRunCmd)
+
+	compareSSSDCmd := &cobra.Command{
+		Use:   "compare-sssd",
+		Short: gotext.Get("Compare the GPOs applied by adsys with the ones SSSD evaluated"),
+		Long: gotext.Get(`Compare the GPOs of the last applied machine policies with the ones SSSD evaluated for its GPO based access control, as stored in its cache.
+Only the machine GPOs are compared, as SSSD doesn't evaluate the GPOs of the users.
+Differences usually come from the ad_gpo_* settings of SSSD or from GPOs filtered out by adsys.`),
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: cmdhandler.NoValidArgs,
+		RunE:              func(_ *cobra.Command, _ []string) error { return a.compareSSSDGPOs() },
+	}
+	policyCmd.AddCommand(compareSSSDCmd)
+
 	debugCmd := &cobra.Command{
 		Use:    "debug",
 		Short:  gotext.Get("Debug various policy infos"),
@@ -90,14 +133,6 @@ func (a *App) installPolicy() {
 		RunE:              func(_ *cobra.Command, _ []string) error { return a.dumpGPOListScript() },
 	}
 	debugCmd.AddCommand(gpoListCmd)
-	certEnrollCmd := &cobra.Command{
-		Use:               "cert-autoenroll-script",
-		Short:             gotext.Get("Write certificate autoenrollment python embedded script in current directory"),
-		Args:              cobra.NoArgs,
-		ValidArgsFunction: cmdhandler.NoValidArgs,
-		RunE:              func(_ *cobra.Command, _ []string) error { return a.dumpCertEnrollScript() },
-	}
-	debugCmd.AddCommand(certEnrollCmd)
 	ticketPathCmd := &cobra.Command{
 		Use:   "ticket-path",
 		Short: gotext.Get("Print the path of the current (or given) user's Kerberos ticket"),
@@ -116,10 +151,15 @@ The command is a no-op if the ticket is not present on disk or the detect_cached
 	debugCmd.AddCommand(ticketPathCmd)
 
 	var updateMachine, updateAll *bool
+	var updateMaxAge *time.Duration
 	updateCmd := &cobra.Command{
 		Use:   "update [USER_NAME KERBEROS_TICKET_PATH]",
 		Short: gotext.Get("Updates/Create a policy for current user or given user with its kerberos ticket"),
-		Args:  cmdhandler.ZeroOrNArgs(2),
+		Long: gotext.Get(`Updates/Create a policy for current user or given user with its kerberos ticket.
+The outcome of each policy manager is summarized on stderr once the policies are applied.
+
+Exit status is 0 if all policies were applied, 3 if only some policy managers failed to apply their rules, and 1 on any other failure.`),
+		Args: cmdhandler.ZeroOrNArgs(2),
 		ValidArgsFunction: func(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
 			// All and machine options don’t take arguments
 			if *updateAll || *updateMachine {
@@ -142,14 +182,80 @@ The command is a no-op if the ticket is not present on disk or the detect_cached
 			if len(args) > 0 {
 				user, krb5cc = args[0], args[1]
 			}
-			return a.update(*updateMachine, *updateAll, user, krb5cc)
+			return a.update(downloadAndApply, *updateMachine, *updateAll, user, krb5cc, *updateMaxAge)
 		},
 	}
 	updateMachine = updateCmd.Flags().BoolP("machine", "m", false, gotext.Get("machine updates the policy of the computer."))
 	updateAll = updateCmd.Flags().BoolP("all", "a", false, gotext.Get("all updates the policy of the computer and all the logged in users. -m or USER_NAME/TICKET cannot be used with this option."))
+	updateMaxAge = updateCmd.Flags().DurationP("max-age", "", 0, gotext.Get("only update the policy of the user if it was not updated within this duration (e.g. 4h). -m or -a cannot be used with this option."))
 	policyCmd.AddCommand(updateCmd)
 	cmdhandler.RegisterAlias(updateCmd, &a.rootCmd)
 
+	var downloadMachine, downloadAll *bool
+	downloadCmd := &cobra.Command{
+		Use:   "download [USER_NAME KERBEROS_TICKET_PATH]",
+		Short: gotext.Get("Downloads the policies of current user or given user with its kerberos ticket, without applying them"),
+		Long: gotext.Get(`Download and cache the policies of current user or given user with its kerberos ticket, without applying them.
+The downloaded policies are applied later on with "adsysctl policy apply", without contacting Active Directory.`),
+		Args: cmdhandler.ZeroOrNArgs(2),
+		ValidArgsFunction: func(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+			// All and machine options don’t take arguments
+			if *downloadAll || *downloadMachine {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			switch len(args) {
+			case 0:
+				// Get all connected users
+				return a.users(true), cobra.ShellCompDirectiveNoFileComp
+			case 1:
+				// The user has already been process, let then specifying the ticket path
+				return nil, cobra.ShellCompDirectiveDefault
+			}
+
+			// We already have our 2 args: no more arg completion
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(_ *cobra.Command, args []string) error {
+			var user, krb5cc string
+			if len(args) > 0 {
+				user, krb5cc = args[0], args[1]
+			}
+			return a.update(downloadOnly, *downloadMachine, *downloadAll, user, krb5cc, 0)
+		},
+	}
+	downloadMachine = downloadCmd.Flags().BoolP("machine", "m", false, gotext.Get("machine downloads the policy of the computer."))
+	downloadAll = downloadCmd.Flags().BoolP("all", "a", false, gotext.Get("all downloads the policy of the computer and all the logged in users. -m or USER_NAME/TICKET cannot be used with this option."))
+	policyCmd.AddCommand(downloadCmd)
+
+	var applyMachine, applyAll *bool
+	applyCmd := &cobra.Command{
+		Use:   "apply [USER_NAME]",
+		Short: gotext.Get("Applies the policies previously downloaded for current user or a specified one"),
+		Long: gotext.Get(`Apply the policies previously downloaded with "adsysctl policy download" for current user or a specified one.
+Active Directory is not contacted. The downloaded policies are discarded once applied.
+The outcome of each policy manager is summarized on stderr, with the same exit status as "adsysctl policy update".`),
+		Args: cmdhandler.ZeroOrNArgs(1),
+		ValidArgsFunction: func(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+			// All and machine options don’t take arguments
+			if *applyAll || *applyMachine || len(args) != 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+
+			// Get all connected users
+			return a.users(true), cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(_ *cobra.Command, args []string) error {
+			var user string
+			if len(args) > 0 {
+				user = args[0]
+			}
+			return a.update(applyOnly, *applyMachine, *applyAll, user, "", 0)
+		},
+	}
+	applyMachine = applyCmd.Flags().BoolP("machine", "m", false, gotext.Get("machine applies the downloaded policy of the computer."))
+	applyAll = applyCmd.Flags().BoolP("all", "a", false, gotext.Get("all applies the downloaded policy of the computer and all the users. -m or USER_NAME cannot be used with this option."))
+	policyCmd.AddCommand(applyCmd)
+
 	var purgeMachine, purgeAll *bool
 	purgeCmd := &cobra.Command{
 		Use:   "purge [USER_NAME]",
@@ -177,6 +283,18 @@ The command is a no-op if the ticket is not present on disk or the detect_cached
 	purgeCmd.MarkFlagsMutuallyExclusive("machine", "all")
 	policyCmd.AddCommand(purgeCmd)
 
+	refreshOnUnlockCmd := &cobra.Command{
+		Use:   "refresh-on-unlock",
+		Short: gotext.Get("Refresh the policies of the current user when their session is unlocked"),
+		Long: gotext.Get(`Refresh the policies of the current user each time their graphical session is unlocked, until the command is stopped.
+The policies are only downloaded if they were not updated within the "refresh_on_unlock" duration of the configuration, so that users who never log out still get policy changes.
+Nothing is done if "refresh_on_unlock" is not set.`),
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: cmdhandler.NoValidArgs,
+		RunE:              func(_ *cobra.Command, _ []string) error { return a.refreshOnUnlock() },
+	}
+	policyCmd.AddCommand(refreshOnUnlockCmd)
+
 	a.rootCmd.AddCommand(policyCmd)
 }
 
@@ -223,11 +341,14 @@ func (a App) getPolicyDefinitions(format, distroID string) (err error) {
 	return nil
 }
 
-func (a *App) dumpPolicies(target string, showDetails, showOverridden, nocolor, isMachine bool) error {
+func (a *App) dumpPolicies(target string, showDetails, showOverridden, nocolor, isMachine bool, since time.Duration) error {
 	// incompatible options
 	if showOverridden && !showDetails {
 		showDetails = true
 	}
+	if since < 0 {
+		return errors.New(gotext.Get("since duration must be positive, got %v", since))
+	}
 
 	client, err := adsysservice.NewClient(a.config.Socket, a.getTimeout())
 	if err != nil {
@@ -257,6 +378,7 @@ func (a *App) dumpPolicies(target string, showDetails, showOverridden, nocolor,
 		IsComputer: isMachine,
 		Details:    showDetails,
 		All:        showOverridden,
+		Since:      int64(since.Seconds()),
 	})
 	if err != nil {
 		return err
@@ -279,34 +401,98 @@ func (a *App) dumpPolicies(target string, showDetails, showOverridden, nocolor,
 	return nil
 }
 
-func (a *App) dumpGPOListScript() error {
+func (a *App) dumpState(target, manager string, isMachine bool) error {
 	client, err := adsysservice.NewClient(a.config.Socket, a.getTimeout())
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	stream, err := client.GPOListScript(a.ctx, &adsys.Empty{})
+	// Dump for current user
+	if target == "" {
+		if isMachine {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return fmt.Errorf("failed to retrieve client hostname: %w", err)
+			}
+			target = hostname
+		} else {
+			u, err := user.Current()
+			if err != nil {
+				return fmt.Errorf("failed to retrieve current user: %w", err)
+			}
+			target = u.Username
+		}
+	}
+
+	stream, err := client.DumpPolicies(a.ctx, &adsys.DumpPoliciesRequest{
+		Target:     target,
+		IsComputer: isMachine,
+		Manager:    manager,
+	})
 	if err != nil {
 		return err
 	}
 
-	script, err := singleMsg(stream)
+	state, err := singleMsg(stream)
 	if err != nil {
 		return err
 	}
+	fmt.Print(state)
 
-	return os.WriteFile("adsys-gpolist", []byte(script), 0600)
+	return nil
+}
+
+func (a *App) aptDryRun() error {
+	client, err := adsysservice.NewClient(a.config.Socket, a.getTimeout())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stream, err := client.AptDryRun(a.ctx, &adsys.Empty{})
+	if err != nil {
+		return err
+	}
+
+	report, err := singleMsg(stream)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+
+	return nil
+}
+
+func (a *App) compareSSSDGPOs() error {
+	client, err := adsysservice.NewClient(a.config.Socket, a.getTimeout())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stream, err := client.CompareSSSDGPOs(a.ctx, &adsys.Empty{})
+	if err != nil {
+		return err
+	}
+
+	comparison, err := singleMsg(stream)
+	if err != nil {
+		return err
+	}
+	fmt.Print(comparison)
+
+	return nil
 }
 
-func (a *App) dumpCertEnrollScript() error {
+func (a *App) dumpGPOListScript() error {
 	client, err := adsysservice.NewClient(a.config.Socket, a.getTimeout())
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	stream, err := client.CertAutoEnrollScript(a.ctx, &adsys.Empty{})
+	stream, err := client.GPOListScript(a.ctx, &adsys.Empty{})
 	if err != nil {
 		return err
 	}
@@ -316,7 +502,7 @@ func (a *App) dumpCertEnrollScript() error {
 		return err
 	}
 
-	return os.WriteFile("cert-autoenroll", []byte(script), 0600)
+	return os.WriteFile("adsys-gpolist", []byte(script), 0600)
 }
 
 // printTicketPath prints the path to the Kerberos ccache of the given (or current) user to stdout.
@@ -426,9 +612,18 @@ func colorizePolicies(policies string) (string, error) {
 		} else if e := strings.TrimPrefix(l, "*"); e != l {
 			// GPO
 			e = strings.TrimSpace(e)
+			// The container the GPO is linked to is optionally appended between brackets.
+			var gpoLink string
+			if i := strings.LastIndex(e, " ["); i > 0 && strings.HasSuffix(e, "]") {
+				gpoLink = e[i+2 : len(e)-1]
+				e = e[:i]
+			}
 			i := strings.LastIndex(e, " ")
 			gpoName := e[:i]
 			gpoID := e[i:]
+			if gpoLink != "" {
+				gpoID = gotext.Get("%s, linked to %s", gpoID, color.CyanString(gpoLink))
+			}
 			out.Println(fmt.Sprintf("- %s%s", color.MagentaString(gpoName), gpoID))
 
 		} else {
@@ -459,7 +654,19 @@ func (s *stringsBuilderWithError) Println(l string) {
 	_, s.err = s.Builder.WriteString(l)
 }
 
-func (a *App) update(isComputer, updateAll bool, target, krb5cc string) error {
+// updatePhase is the part of the policy update requested by the client.
+type updatePhase int
+
+const (
+	// downloadAndApply downloads the policies and applies them right away.
+	downloadAndApply updatePhase = iota
+	// downloadOnly downloads and caches the policies, without applying them.
+	downloadOnly
+	// applyOnly applies the previously downloaded policies.
+	applyOnly
+)
+
+func (a *App) update(phase updatePhase, isComputer, updateAll bool, target, krb5cc string, maxAge time.Duration) error {
 	// incompatible options
 	if updateAll && (isComputer || target != "" || krb5cc != "") {
 		return errors.New(gotext.Get("machine or user arguments cannot be used with update all"))
@@ -467,6 +674,12 @@ func (a *App) update(isComputer, updateAll bool, target, krb5cc string) error {
 	if isComputer && (target != "" || krb5cc != "") {
 		return errors.New(gotext.Get("user arguments cannot be used with machine update"))
 	}
+	if maxAge < 0 {
+		return errors.New(gotext.Get("max age must be positive, got %v", maxAge))
+	}
+	if maxAge > 0 && (isComputer || updateAll) {
+		return errors.New(gotext.Get("max age can only be used with user update"))
+	}
 
 	client, err := adsysservice.NewClient(a.config.Socket, a.getTimeout())
 	if err != nil {
@@ -492,7 +705,8 @@ func (a *App) update(isComputer, updateAll bool, target, krb5cc string) error {
 		}
 		target = u.Username
 		krb5cc = strings.TrimPrefix(os.Getenv("KRB5CCNAME"), "FILE:")
-		if krb5cc == "" && a.config.DetectCachedTicket {
+		// Applying downloaded policies doesn't contact AD, so no ticket is needed.
+		if krb5cc == "" && a.config.DetectCachedTicket && phase != applyOnly {
 			krb5cc, err = ad.TicketPath()
 			// Don't return an error as we might still have a cached ticket
 			// under /run/adsys/krb5cc
@@ -502,22 +716,79 @@ func (a *App) update(isComputer, updateAll bool, target, krb5cc string) error {
 		}
 	}
 
-	stream, err := client.UpdatePolicy(a.ctx, &adsys.UpdatePolicyRequest{
-		IsComputer: isComputer,
-		All:        updateAll,
-		Target:     target,
-		Krb5Cc:     krb5cc})
+	if phase == downloadOnly {
+		stream, err := client.DownloadPolicy(a.ctx, &adsys.DownloadPolicyRequest{
+			IsComputer: isComputer,
+			All:        updateAll,
+			Target:     target,
+			Krb5Cc:     krb5cc})
+		if err != nil {
+			return err
+		}
+		if _, err := stream.Recv(); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+	}
+
+	var stream interface {
+		Recv() (*adsys.PolicyReport, error)
+	}
+	if phase == applyOnly {
+		stream, err = client.ApplyPolicy(a.ctx, &adsys.ApplyPolicyRequest{
+			IsComputer: isComputer,
+			All:        updateAll,
+			Target:     target})
+	} else {
+		stream, err = client.UpdatePolicy(a.ctx, &adsys.UpdatePolicyRequest{
+			IsComputer: isComputer,
+			All:        updateAll,
+			Target:     target,
+			Krb5Cc:     krb5cc,
+			MaxAge:     int64(maxAge.Seconds())})
+	}
 	if err != nil {
 		return err
 	}
 
-	if _, err := stream.Recv(); err != nil && !errors.Is(err, io.EOF) {
-		return err
+	// The outcome of the policy managers is sent before the refresh status, even if it failed.
+	var results []*adsys.ManagerResult
+	for {
+		r, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			printManagerResults(os.Stderr, results)
+			// Only some managers failed: the other policies are applied.
+			a.partialFailure = slices.ContainsFunc(results, func(r *adsys.ManagerResult) bool {
+				return r.GetStatus() == string(policies.ManagerFailed)
+			})
+			return err
+		}
+		results = append(results, r.GetManagers()...)
 	}
+	printManagerResults(os.Stderr, results)
 
 	return nil
 }
 
+// printManagerResults prints to w the summary of the outcome of each policy manager, per refreshed object.
+func printManagerResults(w io.Writer, results []*adsys.ManagerResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, gotext.Get("TARGET\tMANAGER\tSTATUS\tREASON"))
+	for _, r := range results {
+		// Only print the first line of multi-lines errors to keep the summary readable.
+		reason, _, _ := strings.Cut(r.GetReason(), "\n")
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.GetTarget(), r.GetManager(), strings.ToUpper(r.GetStatus()), reason)
+	}
+	decorate.LogOnError(tw.Flush())
+}
+
 func (a *App) purge(isComputer, purgeAll bool, target string) error {
 	// incompatible options
 	if purgeAll && target != "" {
@@ -562,8 +833,13 @@ func (a *App) purge(isComputer, purgeAll bool, target string) error {
 		return err
 	}
 
-	if _, err := stream.Recv(); err != nil && !errors.Is(err, io.EOF) {
-		return err
+	// Only the refresh status matters when purging: skip the outcome of the policy managers.
+	for {
+		if _, err := stream.Recv(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -22,7 +22,7 @@ func TestColorizePolicies(t *testing.T) {
 ** dconf:
 *** path/to/keyGpo2-1: ValueOfKeyGpo2-1
 Policies from user configuration:
-* GPOName3 ({GPOId2})
+* GPOName3 ({GPOId2}) [OU=IT Dept,DC=domain,DC=com]
 ** dconf:
 ***- path/to/key1: ValueOfKey1\nOn\nMultilines
 ***- path/to/key2: ValueOfKey2
@@ -10,6 +10,8 @@ import (
 	"github.com/ubuntu/adsys"
 	"github.com/ubuntu/adsys/internal/adsysservice"
 	"github.com/ubuntu/adsys/internal/cmdhandler"
+	"github.com/ubuntu/adsys/internal/config"
+	"github.com/ubuntu/adsys/internal/consts"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -41,6 +43,29 @@ func (a *App) installService() {
 	}
 	mainCmd.AddCommand(cmd)
 
+	var history, jsonOutput *bool
+	cmd = &cobra.Command{
+		Use:               "metrics",
+		Short:             gotext.Get("Print the duration and failures of the machine policy refreshes"),
+		Long:              gotext.Get(`Print the duration and failures of the last machine policy refreshes, and whether their duration is degrading over time.`),
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: cmdhandler.NoValidArgs,
+		RunE:              func(_ *cobra.Command, _ []string) error { return a.getMetrics(*history, *jsonOutput) },
+	}
+	history = cmd.Flags().BoolP("history", "", false, gotext.Get("plot the duration and failures of every recorded refresh."))
+	jsonOutput = cmd.Flags().BoolP("json", "", false, gotext.Get("print the metrics as JSON."))
+	mainCmd.AddCommand(cmd)
+
+	cmd = &cobra.Command{
+		Use:               "telemetry",
+		Short:             gotext.Get("Print the usage telemetry collected on this machine"),
+		Long:              gotext.Get(`Print the usage telemetry collected on this machine since its last submission, as it would be submitted if the administrator opted in.`),
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: cmdhandler.NoValidArgs,
+		RunE:              func(_ *cobra.Command, _ []string) error { return a.getTelemetry() },
+	}
+	mainCmd.AddCommand(cmd)
+
 	var stopForce *bool
 	cmd = &cobra.Command{
 		Use:               "stop",
@@ -51,6 +76,37 @@ func (a *App) installService() {
 	}
 	stopForce = cmd.Flags().BoolP("force", "f", false, gotext.Get("force will shut it down immediately and drop existing connections."))
 	mainCmd.AddCommand(cmd)
+
+	configCmd := &cobra.Command{
+		Use:   "config COMMAND",
+		Short: gotext.Get("Configuration management"),
+		Args:  cmdhandler.SubcommandsRequiredWithSuggestions,
+		RunE:  cmdhandler.NoCmd,
+	}
+	mainCmd.AddCommand(configCmd)
+
+	cmd = &cobra.Command{
+		Use:   "validate [FILE]",
+		Short: gotext.Get("Validate the configuration file"),
+		Long: gotext.Get(`Validate the configuration file against the keys, types and values supported by adsys.
+Unknown keys and values, like misspelled backend names, are rejected with suggestions and deprecated keys are reported.
+If no file is given, the configuration file currently used is validated, or the default one if there is none.`),
+		Args: cobra.MaximumNArgs(1),
+		ValidArgsFunction: func(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+			if len(args) != 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			return []string{"yaml"}, cobra.ShellCompDirectiveFilterFileExt
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var path string
+			if len(args) > 0 {
+				path = args[0]
+			}
+			return a.configValidate(cmd.OutOrStdout(), path)
+		},
+	}
+	configCmd.AddCommand(cmd)
 }
 
 func (a *App) serviceCat() error {
@@ -103,6 +159,72 @@ func (a App) getStatus() (err error) {
 	return nil
 }
 
+// getMetrics prints the metrics of the machine policy refreshes.
+func (a App) getMetrics(history, jsonOutput bool) (err error) {
+	client, err := adsysservice.NewClient(a.config.Socket, a.getTimeout())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stream, err := client.Metrics(a.ctx, &adsys.MetricsRequest{History: history, Json: jsonOutput})
+	if err != nil {
+		return err
+	}
+
+	msg, err := singleMsg(stream)
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+
+	return nil
+}
+
+// configValidate validates the configuration file at path against the adsys configuration schema.
+// If path is empty, the configuration file used by the client, or the default one, is validated.
+func (a App) configValidate(w io.Writer, path string) error {
+	if path == "" {
+		path = a.viper.ConfigFileUsed()
+	}
+	if path == "" {
+		path = consts.DefaultConfigPath
+	}
+
+	warnings, err := config.ValidateFile(path)
+	for _, warning := range warnings {
+		fmt.Fprintln(w, gotext.Get("Warning: %s", warning))
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, gotext.Get("Configuration file %s is valid", path))
+	return nil
+}
+
+// getTelemetry prints the usage telemetry collected on the machine.
+func (a App) getTelemetry() (err error) {
+	client, err := adsysservice.NewClient(a.config.Socket, a.getTimeout())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stream, err := client.Telemetry(a.ctx, &adsys.Empty{})
+	if err != nil {
+		return err
+	}
+
+	msg, err := singleMsg(stream)
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+
+	return nil
+}
+
 func (a *App) serviceStop(force bool) error {
 	client, err := adsysservice.NewClient(a.config.Socket, a.getTimeout())
 	if err != nil {
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+)
+
+// refreshOnUnlock refreshes the policies of the current user each time their graphical session is unlocked, until the
+// app quits. The daemon only downloads them if they were not updated within the configured duration.
+func (a *App) refreshOnUnlock() (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't refresh policies on unlock"))
+
+	if a.config.RefreshOnUnlock <= 0 {
+		log.Debug(a.ctx, "Refresh on unlock is not enabled")
+		return nil
+	}
+
+	// Don’t call dbus.SystemBus which caches globally system dbus
+	bus, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return err
+	}
+	defer decorate.LogFuncOnError(bus.Close)
+	if err = bus.Auth(nil); err != nil {
+		return err
+	}
+	if err = bus.Hello(); err != nil {
+		return err
+	}
+
+	session, err := displaySession(bus, uint32(os.Getuid()))
+	if err != nil {
+		return err
+	}
+
+	if err := bus.AddMatchSignal(
+		dbus.WithMatchObjectPath(session),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+	); err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 10)
+	bus.Signal(signals)
+
+	var locked bool
+	v, err := bus.Object(consts.LogindDbusRegisteredName, session).GetProperty(consts.LogindDbusSessionInterface + ".LockedHint")
+	if err != nil {
+		return err
+	}
+	if err := v.Store(&locked); err != nil {
+		return err
+	}
+
+	log.Debugf(a.ctx, "Watching unlocks of session %s", session)
+	for {
+		select {
+		case <-a.ctx.Done():
+			return nil
+		case s, ok := <-signals:
+			if !ok {
+				return errors.New(gotext.Get("connection to the system bus was closed"))
+			}
+			if s.Path != session {
+				continue
+			}
+			hint, ok := lockedHint(s)
+			if !ok {
+				continue
+			}
+			wasLocked := locked
+			locked = hint
+			if !wasLocked || locked {
+				continue
+			}
+
+			log.Debug(a.ctx, "Session unlocked, refreshing policies")
+			if err := a.update(downloadAndApply, false, false, "", "", a.config.RefreshOnUnlock); err != nil {
+				log.Warningf(a.ctx, "Failed to refresh policies on unlock: %v", err)
+			}
+		}
+	}
+}
+
+// displaySession returns the logind object path of the graphical session of the user uid.
+func displaySession(bus *dbus.Conn, uid uint32) (session dbus.ObjectPath, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't get graphical session of user %d", uid))
+
+	var userPath dbus.ObjectPath
+	if err := bus.Object(consts.LogindDbusRegisteredName, consts.LogindDbusObjectPath).Call(
+		consts.LogindDbusManagerInterface+".GetUser", 0, uid).Store(&userPath); err != nil {
+		return "", err
+	}
+
+	v, err := bus.Object(consts.LogindDbusRegisteredName, userPath).GetProperty(consts.LogindDbusUserInterface + ".Display")
+	if err != nil {
+		return "", err
+	}
+	// Display is a (session id, object path) structure, with an empty id if the user has no graphical session.
+	display, ok := v.Value().([]interface{})
+	if !ok || len(display) != 2 {
+		return "", fmt.Errorf("unexpected Display property: %v", v)
+	}
+	if id, _ := display[0].(string); id == "" {
+		return "", errors.New(gotext.Get("user has no graphical session"))
+	}
+	session, ok = display[1].(dbus.ObjectPath)
+	if !ok {
+		return "", fmt.Errorf("unexpected Display property: %v", v)
+	}
+
+	return session, nil
+}
+
+// lockedHint returns the LockedHint property of the logind session from the PropertiesChanged signal s.
+// ok is false if the property isn't part of the change.
+func lockedHint(s *dbus.Signal) (locked, ok bool) {
+	if s.Name != "org.freedesktop.DBus.Properties.PropertiesChanged" || len(s.Body) < 2 {
+		return false, false
+	}
+	if iface, _ := s.Body[0].(string); iface != consts.LogindDbusSessionInterface {
+		return false, false
+	}
+	changed, _ := s.Body[1].(map[string]dbus.Variant)
+	v, found := changed["LockedHint"]
+	if !found {
+		return false, false
+	}
+	locked, ok = v.Value().(bool)
+	return locked, ok
+}
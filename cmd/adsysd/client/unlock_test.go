@@ -0,0 +1,49 @@
+package client_test
+
+import (
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/cmd/adsysd/client"
+)
+
+func TestLockedHint(t *testing.T) {
+	t.Parallel()
+
+	const propertiesChanged = "org.freedesktop.DBus.Properties.PropertiesChanged"
+	const sessionInterface = "org.freedesktop.login1.Session"
+
+	tests := map[string]struct {
+		name string
+		body []interface{}
+
+		wantLocked bool
+		wantOk     bool
+	}{
+		"Session unlocked": {body: []interface{}{sessionInterface, map[string]dbus.Variant{"LockedHint": dbus.MakeVariant(false)}, []string{}}, wantOk: true},
+		"Session locked":   {body: []interface{}{sessionInterface, map[string]dbus.Variant{"LockedHint": dbus.MakeVariant(true)}, []string{}}, wantLocked: true, wantOk: true},
+		"Other changed properties are ignored": {body: []interface{}{sessionInterface, map[string]dbus.Variant{
+			"LockedHint": dbus.MakeVariant(false), "IdleHint": dbus.MakeVariant(true)}, []string{}}, wantOk: true},
+
+		"No LockedHint in changed properties": {body: []interface{}{sessionInterface, map[string]dbus.Variant{"IdleHint": dbus.MakeVariant(true)}, []string{}}},
+		"Invalidated LockedHint":              {body: []interface{}{sessionInterface, map[string]dbus.Variant{}, []string{"LockedHint"}}},
+		"Other interface":                     {body: []interface{}{"org.freedesktop.login1.User", map[string]dbus.Variant{"LockedHint": dbus.MakeVariant(false)}, []string{}}},
+		"Other signal":                        {name: "org.freedesktop.login1.Session.Unlock"},
+		"Invalid LockedHint type":             {body: []interface{}{sessionInterface, map[string]dbus.Variant{"LockedHint": dbus.MakeVariant("false")}, []string{}}},
+		"Invalid body":                        {body: []interface{}{sessionInterface}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.name == "" {
+				tc.name = propertiesChanged
+			}
+
+			locked, ok := client.LockedHint(&dbus.Signal{Name: tc.name, Body: tc.body})
+			require.Equal(t, tc.wantOk, ok, "LockedHint should report if the property changed")
+			require.Equal(t, tc.wantLocked, locked, "LockedHint should return the expected lock state")
+		})
+	}
+}
@@ -4,12 +4,17 @@ package daemon
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
 	"time"
 
 	"github.com/leonelquinteros/gotext"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/ubuntu/adsys/internal/ad/backends/keytab"
 	"github.com/ubuntu/adsys/internal/ad/backends/sss"
 	"github.com/ubuntu/adsys/internal/ad/backends/winbind"
 	"github.com/ubuntu/adsys/internal/adsysservice"
@@ -29,8 +34,9 @@ type App struct {
 	rootCmd cobra.Command
 	viper   *viper.Viper
 
-	config daemonConfig
-	daemon *daemon.Daemon
+	config         daemonConfig
+	daemon         *daemon.Daemon
+	validateServer *http.Server
 
 	ready chan struct{}
 }
@@ -54,8 +60,25 @@ type daemonConfig struct {
 	AdBackend     string         `mapstructure:"ad_backend"`
 	SSSdConfig    sss.Config     `mapstructure:"sssd"`
 	WinbindConfig winbind.Config `mapstructure:"winbind"`
+	KeytabConfig  keytab.Config  `mapstructure:"keytab"`
 
-	ServiceTimeout int `mapstructure:"service_timeout"`
+	ServiceTimeout int                   `mapstructure:"service_timeout"`
+	Timeouts       adsysservice.Timeouts `mapstructure:"timeouts"`
+
+	SysvolBandwidth adsysservice.SysvolBandwidth `mapstructure:"sysvol_bandwidth"`
+
+	RolloutRing string `mapstructure:"rollout_ring"`
+
+	ConnectivityCheckURL string `mapstructure:"connectivity_check_url"`
+
+	SecurityModule string `mapstructure:"security_module"`
+
+	Telemetry bool `mapstructure:"telemetry"`
+
+	PolicyHistory bool `mapstructure:"policy_history"`
+
+	ReadOnly   bool   `mapstructure:"read_only"`
+	StagingDir string `mapstructure:"staging_dir"`
 }
 
 // New registers commands and return a new App.
@@ -83,7 +106,7 @@ func New() *App {
 				// Config reload
 
 				// No change in config file: skip.
-				if a.config == newConfig {
+				if reflect.DeepEqual(a.config, newConfig) {
 					return nil
 				}
 
@@ -111,6 +134,15 @@ func New() *App {
 		},
 
 		RunE: func(_ *cobra.Command, _ []string) error {
+			// Staging directory is only used in read-only mode.
+			var stagingDir string
+			if a.config.ReadOnly {
+				stagingDir = a.config.StagingDir
+				if stagingDir == "" {
+					stagingDir = consts.DefaultStagingDir
+				}
+			}
+
 			adsys, err := adsysservice.New(context.Background(),
 				adsysservice.WithCacheDir(a.config.CacheDir),
 				adsysservice.WithStateDir(a.config.StateDir),
@@ -122,9 +154,18 @@ func New() *App {
 				adsysservice.WithApparmorFsDir(a.config.ApparmorFsDir),
 				adsysservice.WithSystemUnitDir(a.config.SystemUnitDir),
 				adsysservice.WithGlobalTrustDir(a.config.GlobalTrustDir),
+				adsysservice.WithRolloutRing(a.config.RolloutRing),
+				adsysservice.WithConnectivityCheckURL(a.config.ConnectivityCheckURL),
+				adsysservice.WithSecurityModule(a.config.SecurityModule),
+				adsysservice.WithTelemetry(a.config.Telemetry),
+				adsysservice.WithPolicyHistory(a.config.PolicyHistory),
+				adsysservice.WithReadOnly(stagingDir),
+				adsysservice.WithTimeouts(a.config.Timeouts),
+				adsysservice.WithSysvolBandwidth(a.config.SysvolBandwidth),
 				adsysservice.WithADBackend(a.config.AdBackend),
 				adsysservice.WithSSSConfig(a.config.SSSdConfig),
 				adsysservice.WithWinbindConfig(a.config.WinbindConfig),
+				adsysservice.WithKeytabConfig(a.config.KeytabConfig),
 			)
 			if err != nil {
 				close(a.ready)
@@ -134,7 +175,9 @@ func New() *App {
 			timeout := time.Duration(a.config.ServiceTimeout) * time.Second
 			d, err := daemon.New(adsys.RegisterGRPCServer, a.config.Socket,
 				daemon.WithTimeout(timeout),
-				daemon.WithServerQuit(adsys.Quit))
+				daemon.WithServerQuit(adsys.Quit),
+				daemon.WithHandoffStateFile(filepath.Join(a.config.RunDir, "handoff.json")),
+				daemon.WithRunState(adsys.RunningRefreshes))
 			if err != nil {
 				close(a.ready)
 				return err
@@ -171,6 +214,7 @@ func New() *App {
 	a.installVersion()
 	a.installRunScripts()
 	a.installMount()
+	a.installValidateServer()
 	return &a
 }
 
@@ -200,6 +244,11 @@ func (a App) UsageError() bool {
 	return !a.rootCmd.SilenceUsage
 }
 
+// PartialFailure always returns false: the daemon doesn't report the outcome of policy managers.
+func (a App) PartialFailure() bool {
+	return false
+}
+
 // Hup prints all goroutine stack traces and return false to signal you shouldn't quit.
 func (a App) Hup() (shouldQuit bool) {
 	buf := make([]byte, 1<<16)
@@ -208,9 +257,29 @@ func (a App) Hup() (shouldQuit bool) {
 	return false
 }
 
+// Upgrade hands off the socket and the refreshes in progress to the new daemon binary.
+// It returns true once the new daemon is serving, to signal that we should gracefully quit.
+func (a *App) Upgrade() (shouldQuit bool) {
+	a.WaitReady()
+	if a.daemon == nil {
+		return false
+	}
+	if err := a.daemon.Handoff(os.Args[0], os.Args[1:]...); err != nil {
+		log.Warning(context.Background(), gotext.Get("Keep serving after failed upgrade: %v", err))
+		return false
+	}
+	return true
+}
+
 // Quit gracefully shutdown the service.
 func (a *App) Quit() {
 	a.WaitReady()
+	if a.validateServer != nil {
+		if err := a.validateServer.Shutdown(context.Background()); err != nil {
+			log.Warning(context.Background(), gotext.Get("Couldn't gracefully stop the validation service: %v", err))
+		}
+		return
+	}
 	if a.daemon == nil {
 		return
 	}
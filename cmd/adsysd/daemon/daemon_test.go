@@ -134,6 +134,23 @@ func TestAppRunFailsOnServiceCreationAndQuit(t *testing.T) {
 	a.Quit()
 }
 
+func TestValidateServerCanQuit(t *testing.T) {
+	a, wait := startDaemon(t, true, "validate-server", "--listen", "localhost:0")
+	defer wait()
+
+	a.Quit()
+}
+
+func TestValidateServerFailsOnInvalidAddressAndQuit(t *testing.T) {
+	prepareEnv(t)
+
+	a := daemon.New()
+	a.SetArgs("validate-server", "--listen", "invalid address")
+	err := a.Run()
+	require.Error(t, err, "Run should exit with an error")
+	a.Quit()
+}
+
 func TestAppCanSigHupWhenExecute(t *testing.T) {
 	r, w, err := os.Pipe()
 	require.NoError(t, err, "Setup: pipe shouldn’t fail")
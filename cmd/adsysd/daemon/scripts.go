@@ -25,16 +25,20 @@ func (a *App) installRunScripts() {
 }
 
 func runScripts(orderFile string, allowOrderMissing bool) error {
-	if err := scripts.RunScripts(context.Background(), orderFile, allowOrderMissing); err != nil {
-		return err
+	// The unit is ready once the scripts blocking the session completed, while the asynchronous ones still run.
+	var notifyErr error
+	notifyReady := func() {
+		// TODO: mock this for tests
+		if sent, err := systemd.SdNotify(false, "READY=1"); err != nil {
+			notifyErr = errors.New(gotext.Get("couldn't send ready notification to systemd: %v", err))
+		} else if sent {
+			log.Debug(context.Background(), gotext.Get("Ready state sent to systemd"))
+		}
 	}
 
-	// TODO: mock this for tests
-	if sent, err := systemd.SdNotify(false, "READY=1"); err != nil {
-		return errors.New(gotext.Get("couldn't send ready notification to systemd: %v", err))
-	} else if sent {
-		log.Debug(context.Background(), gotext.Get("Ready state sent to systemd"))
+	if err := scripts.RunScripts(context.Background(), orderFile, allowOrderMissing, notifyReady); err != nil {
+		return err
 	}
 
-	return nil
+	return notifyErr
 }
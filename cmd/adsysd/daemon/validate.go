@@ -0,0 +1,54 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/spf13/cobra"
+	"github.com/ubuntu/adsys/internal/ad/validate"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+)
+
+// validateReadHeaderTimeout is the maximum time to read the headers of a validation request.
+const validateReadHeaderTimeout = 10 * time.Second
+
+func (a *App) installValidateServer() {
+	var listen *string
+	cmd := &cobra.Command{
+		Use:   "validate-server",
+		Short: gotext.Get("Serve the validation of GPO exports over HTTP"),
+		Long: gotext.Get(`Serve the validation of GPO exports over HTTP, so that change management pipelines can check the GPO edits affecting Ubuntu clients before deploying them.
+
+GPO exports are posted as zip archives to the /validate endpoint, which responds with the validation result in JSON.
+The GPO policies are decoded with the same parser as the clients.`),
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error { return a.serveValidation(*listen) },
+	}
+	listen = cmd.Flags().StringP("listen", "l", "localhost:8080", gotext.Get("address the validation service listens on."))
+	a.rootCmd.AddCommand(cmd)
+}
+
+// serveValidation serves the GPO validation on addr until the app quits.
+func (a *App) serveValidation(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		close(a.ready)
+		return errors.New(gotext.Get("can't listen on %s: %v", addr, err))
+	}
+
+	a.validateServer = &http.Server{
+		Handler:           validate.Handler(),
+		ReadHeaderTimeout: validateReadHeaderTimeout,
+	}
+	close(a.ready)
+
+	log.Info(context.Background(), gotext.Get("Serving GPO validation on http://%s/validate", l.Addr()))
+	if err := a.validateServer.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
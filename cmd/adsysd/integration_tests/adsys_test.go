@@ -108,8 +108,12 @@ socket: %s`, socket)), 0600)
 		"doc chapter":                 {args: []string{"doc", "chapter"}},
 		"policy admx all":             {args: []string{"policy", "admx", "all"}},
 		"policy applied":              {args: []string{"policy", "applied"}},
+		"policy apt-dry-run":          {args: []string{"policy", "apt-dry-run"}},
+		"policy compare-sssd":         {args: []string{"policy", "compare-sssd"}},
 		"policy debug gpolist-script": {args: []string{"policy", "debug", "gpolist-script"}},
 		"policy update":               {args: []string{"policy", "update"}},
+		"policy download":             {args: []string{"policy", "download"}},
+		"policy apply":                {args: []string{"policy", "apply"}},
 		"policy purge":                {args: []string{"policy", "purge"}},
 		"service cat":                 {args: []string{"service", "cat"}},
 		"service status":              {args: []string{"service", "status"}},
@@ -104,6 +104,7 @@ func TestPolicyApplied(t *testing.T) {
 		"Detailed policy with overrides (all)":           {args: []string{"--all"}},
 		"Current user gpos no color":                     {args: []string{"--no-color"}},
 		"Detailed policy with overrides (all), no color": {args: []string{"--no-color", "--all"}},
+		"Policy changed since duration, no color":        {args: []string{"--no-color", "--since", "24h"}},
 
 		// User options
 		`Current user with domain\username`:           {args: []string{`example.com\adsystestuser`}},
@@ -115,6 +116,7 @@ func TestPolicyApplied(t *testing.T) {
 		"Error on user cache not available":                         {userGPORules: "-", wantErr: true},
 		"Error on unexisting user":                                  {args: []string{"doesnotexists@example.com"}, wantErr: true},
 		"Error on user name without domain and no default domain":   {args: []string{"doesnotexists"}, wantErr: true},
+		"Error on negative since duration":                          {args: []string{"--since", "-24h"}, wantErr: true},
 		"Error on applied denied":                                   {systemAnswer: "polkit_no", wantErr: true},
 		"Error on daemon not responding":                            {daemonNotStarted: true, wantErr: true},
 	}
@@ -980,6 +982,28 @@ func TestPolicyUpdate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		"Error on max age and computer requested": {
+			args:       []string{"--max-age", "4h", "-m"},
+			krb5ccname: "-",
+			krb5ccNamesState: []krb5ccNamesWithState{
+				{
+					src:          "ccache_EXAMPLE.COM",
+					adsysSymlink: hostname,
+					machine:      true,
+				},
+			},
+			wantErr: true,
+		},
+		"Error on max age and all requested": {
+			args:      []string{"--max-age", "4h", "--all"},
+			initState: "localhost-uptodate",
+			wantErr:   true,
+		},
+		"Error on negative max age": {
+			args:      []string{"--max-age", "-4h"},
+			initState: "localhost-uptodate",
+			wantErr:   true,
+		},
 		"Error on unexisting user": {
 			initState: "localhost-uptodate",
 			args:      []string{"doesnotexists@example.com", "adsystestuser@example.com.krb5"},
@@ -1203,13 +1227,10 @@ func TestPolicyDebugScriptDump(t *testing.T) {
 
 		wantErr bool
 	}{
-		"Get adsys-gpolist script":             {script: "adsys-gpolist", cmdName: "gpolist-script", path: "internal/ad", systemAnswer: "polkit_yes"},
-		"Get cert-autoenroll script":           {script: "cert-autoenroll", cmdName: "cert-autoenroll-script", path: "internal/policies/certificate", systemAnswer: "polkit_yes"},
-		"adsys-gpolist is always authorized":   {script: "adsys-gpolist", cmdName: "gpolist-script", path: "internal/ad", systemAnswer: "polkit_no"},
-		"cert-autoenroll is always authorized": {script: "cert-autoenroll", cmdName: "cert-autoenroll-script", path: "internal/policies/certificate", systemAnswer: "polkit_no"},
+		"Get adsys-gpolist script":           {script: "adsys-gpolist", cmdName: "gpolist-script", path: "internal/ad", systemAnswer: "polkit_yes"},
+		"adsys-gpolist is always authorized": {script: "adsys-gpolist", cmdName: "gpolist-script", path: "internal/ad", systemAnswer: "polkit_no"},
 
-		"Error on daemon not responding for adsys-gpolist":   {script: "adsys-gpolist", cmdName: "gpolist-script", path: "internal/ad", daemonNotStarted: true, wantErr: true},
-		"Error on daemon not responding for cert-autoenroll": {script: "cert-autoenroll", cmdName: "cert-autoenroll-script", path: "internal/policies/certificate", daemonNotStarted: true, wantErr: true},
+		"Error on daemon not responding for adsys-gpolist": {script: "adsys-gpolist", cmdName: "gpolist-script", path: "internal/ad", daemonNotStarted: true, wantErr: true},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
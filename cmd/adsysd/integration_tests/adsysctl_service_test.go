@@ -373,3 +373,43 @@ func TestServiceStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestServiceConfigValidate(t *testing.T) {
+	tests := map[string]struct {
+		content     string
+		noFileArg   bool
+		missingFile bool
+
+		wantErrContains string
+	}{
+		"Validate current configuration": {noFileArg: true},
+		"Validate given file":            {content: "verbose: 2\nad_backend: winbind\n"},
+
+		// Error cases
+		"Error on unknown key":        {content: "verbos: 2\n", wantErrContains: `unknown key "verbos", did you mean "verbose"?`},
+		"Error on misspelled backend": {content: "ad_backend: windbind\n", wantErrContains: `did you mean "winbind"?`},
+		"Error on missing file":       {missingFile: true, wantErrContains: "no such file or directory"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			conf := createConf(t)
+
+			args := []string{"service", "config", "validate"}
+			if !tc.noFileArg {
+				p := filepath.Join(t.TempDir(), "adsys.yaml")
+				if !tc.missingFile {
+					require.NoError(t, os.WriteFile(p, []byte(tc.content), 0600), "Setup: can't write configuration file to validate")
+				}
+				args = append(args, p)
+			}
+
+			got, err := runClient(t, conf, args...)
+			if tc.wantErrContains != "" {
+				require.ErrorContains(t, err, tc.wantErrContains, "client should exit with the expected error")
+				return
+			}
+			require.NoError(t, err, "client should exit with no error")
+			assert.Contains(t, got, "is valid", "Configuration file is reported as valid")
+		})
+	}
+}
@@ -35,7 +35,9 @@ func main() {
 type app interface {
 	Run() error
 	UsageError() bool
+	PartialFailure() bool
 	Hup() bool
+	Upgrade() bool
 	Quit()
 }
 
@@ -54,6 +56,10 @@ func run(a app) int {
 		if a.UsageError() {
 			return 2
 		}
+		// Some policies were applied: distinguish it from a complete failure for health checks.
+		if a.PartialFailure() {
+			return 3
+		}
 		return 1
 	}
 
@@ -62,7 +68,7 @@ func run(a app) int {
 
 func installSignalHandler(a app) func() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -80,6 +86,11 @@ func installSignalHandler(a app) func() {
 					a.Quit()
 					return
 				}
+			case syscall.SIGUSR2:
+				if a.Upgrade() {
+					a.Quit()
+					return
+				}
 			default:
 				// channel was closed: we exited
 				if !ok {
@@ -14,7 +14,9 @@ type myApp struct {
 
 	runError         bool
 	usageErrorReturn bool
+	partialFailure   bool
 	hupReturn        bool
+	upgradeReturn    bool
 }
 
 func (a *myApp) Run() error {
@@ -29,10 +31,18 @@ func (a myApp) UsageError() bool {
 	return a.usageErrorReturn
 }
 
+func (a myApp) PartialFailure() bool {
+	return a.partialFailure
+}
+
 func (a myApp) Hup() bool {
 	return a.hupReturn
 }
 
+func (a myApp) Upgrade() bool {
+	return a.upgradeReturn
+}
+
 func (a *myApp) Quit() {
 	close(a.done)
 }
@@ -41,21 +51,27 @@ func TestRun(t *testing.T) {
 	tests := map[string]struct {
 		runError         bool
 		usageErrorReturn bool
+		partialFailure   bool
 		hupReturn        bool
+		upgradeReturn    bool
 		sendSig          syscall.Signal
 
 		wantReturnCode int
 	}{
-		"Run and exit successfully":              {},
-		"Run and return error":                   {runError: true, wantReturnCode: 1},
-		"Run and return usage error":             {usageErrorReturn: true, runError: true, wantReturnCode: 2},
-		"Run and usage error only does not fail": {usageErrorReturn: true, runError: false, wantReturnCode: 0},
+		"Run and exit successfully":                  {},
+		"Run and return error":                       {runError: true, wantReturnCode: 1},
+		"Run and return usage error":                 {usageErrorReturn: true, runError: true, wantReturnCode: 2},
+		"Run and usage error only does not fail":     {usageErrorReturn: true, runError: false, wantReturnCode: 0},
+		"Run and return partial failure":             {partialFailure: true, runError: true, wantReturnCode: 3},
+		"Run and partial failure only does not fail": {partialFailure: true, runError: false, wantReturnCode: 0},
 
 		// Signals handling
-		"Send SIGINT exits":           {sendSig: syscall.SIGINT},
-		"Send SIGTERM exits":          {sendSig: syscall.SIGTERM},
-		"Send SIGHUP without exiting": {sendSig: syscall.SIGHUP},
-		"Send SIGHUP with exit":       {sendSig: syscall.SIGHUP, hupReturn: true},
+		"Send SIGINT exits":            {sendSig: syscall.SIGINT},
+		"Send SIGTERM exits":           {sendSig: syscall.SIGTERM},
+		"Send SIGHUP without exiting":  {sendSig: syscall.SIGHUP},
+		"Send SIGHUP with exit":        {sendSig: syscall.SIGHUP, hupReturn: true},
+		"Send SIGUSR2 without exiting": {sendSig: syscall.SIGUSR2},
+		"Send SIGUSR2 with exit":       {sendSig: syscall.SIGUSR2, upgradeReturn: true},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -65,7 +81,9 @@ func TestRun(t *testing.T) {
 				done:             make(chan struct{}),
 				runError:         tc.runError,
 				usageErrorReturn: tc.usageErrorReturn,
+				partialFailure:   tc.partialFailure,
 				hupReturn:        tc.hupReturn,
+				upgradeReturn:    tc.upgradeReturn,
 			}
 
 			var rc int
@@ -103,6 +121,17 @@ func TestRun(t *testing.T) {
 				// if SIGHUP returns false: do nothing and still wait.
 				// Otherwise, it means that we wanted to stop
 				require.Equal(t, tc.hupReturn, exited, "Expect to exit only on SIGHUP returning True")
+			case syscall.SIGUSR2:
+				err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR2)
+				require.NoError(t, err, "Teardown: kill should return no error")
+				select {
+				case <-time.After(50 * time.Millisecond):
+					exited = false
+				case <-wait:
+					exited = true
+				}
+				// Only quit once the new daemon took over.
+				require.Equal(t, tc.upgradeReturn, exited, "Expect to exit only on SIGUSR2 returning True")
 			}
 
 			if !exited {
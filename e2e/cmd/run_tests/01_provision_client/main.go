@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
@@ -22,6 +24,8 @@ import (
 
 var keep bool
 var sshKey, adPassword string
+var latency, jitter, loss string
+var networkShaping *inventory.NetworkShaping
 
 func main() {
 	os.Exit(run())
@@ -44,15 +48,24 @@ environment variable.
 Options:
  --ssh-key           SSH private key to use for authentication (default: ~/.ssh/id_rsa)
  -k, --keep          Don't destroy VM if provisioning fails (default: false)
+ --latency           Delay added to the packets sent to the domain controller, like 150ms (default: none)
+ --jitter            Variation of the latency, like 20ms (default: none)
+ --loss              Percentage of the packets sent to the domain controller to drop, like 0.5 (default: none)
 
 This script will:
  - create a VM from the specified codename
  - join the VM to the E2E tests domain
- - install the previously built adsys package on the VM`, filepath.Base(os.Args[0]))
+ - install the previously built adsys package on the VM
+ - store the keytab of the VM, encrypted, in the inventory
+ - simulate a branch-office link to the domain controller, if any of the
+   latency, jitter or loss options is set`, filepath.Base(os.Args[0]))
 
 	cmd.AddStringFlag(&sshKey, "ssh-key", "", "")
 	cmd.AddBoolFlag(&keep, "k", false, "")
 	cmd.AddBoolFlag(&keep, "keep", false, "")
+	cmd.AddStringFlag(&latency, "latency", "", "")
+	cmd.AddStringFlag(&jitter, "jitter", "", "")
+	cmd.AddStringFlag(&loss, "loss", "", "")
 
 	return cmd.Execute(context.Background())
 }
@@ -68,6 +81,29 @@ func validate(_ context.Context, _ *command.Command) (err error) {
 		return fmt.Errorf("AD_PASSWORD environment variable must be set")
 	}
 
+	if latency == "" && jitter == "" && loss == "" {
+		return nil
+	}
+	networkShaping = &inventory.NetworkShaping{}
+	if latency != "" {
+		if networkShaping.Latency, err = time.ParseDuration(latency); err != nil || networkShaping.Latency < 0 {
+			return fmt.Errorf("invalid latency %q: expected a positive duration like 150ms", latency)
+		}
+	}
+	if jitter != "" {
+		if networkShaping.Jitter, err = time.ParseDuration(jitter); err != nil || networkShaping.Jitter < 0 {
+			return fmt.Errorf("invalid jitter %q: expected a positive duration like 20ms", jitter)
+		}
+		if networkShaping.Jitter > networkShaping.Latency {
+			return fmt.Errorf("jitter %s can't be greater than latency %s", networkShaping.Jitter, networkShaping.Latency)
+		}
+	}
+	if loss != "" {
+		if networkShaping.Loss, err = strconv.ParseFloat(loss, 64); err != nil || networkShaping.Loss < 0 || networkShaping.Loss > 100 {
+			return fmt.Errorf("invalid loss %q: expected a percentage between 0 and 100", loss)
+		}
+	}
+
 	return nil
 }
 
@@ -201,12 +237,25 @@ func action(ctx context.Context, cmd *command.Command) error {
 		return fmt.Errorf("failed to join VM to domain: %w", err)
 	}
 
+	// Share the machine credentials with the next scripts, to authenticate to the DC as the client.
+	if err := client.ExportSecret(&cmd.Inventory, inventory.ClientKeytabSecret, "/etc/krb5.keytab"); err != nil {
+		return fmt.Errorf("failed to export client keytab: %w", err)
+	}
+
+	// Shape the network last, so that it doesn't slow down the provisioning.
+	if networkShaping != nil {
+		if err := client.ShapeNetwork(ctx, *networkShaping); err != nil {
+			return err
+		}
+	}
+
 	cmd.Inventory.IP = ipAddress
 	cmd.Inventory.VMID = id
 	cmd.Inventory.UUID = uuid
 	cmd.Inventory.VMName = vmName
 	cmd.Inventory.SSHKeyPath = sshKey
 	cmd.Inventory.Hostname = hostname
+	cmd.Inventory.NetworkShaping = networkShaping
 
 	return nil
 }
@@ -68,20 +68,32 @@ func action(ctx context.Context, cmd *command.Command) (err error) {
 		return err
 	}
 
+	// Policies are refreshed periodically
+	if err := rootClient.RequireUnitActive(ctx, "adsys-gpo-refresh.timer"); err != nil {
+		return err
+	}
+
 	// Assert machine policies were applied
-	if err := rootClient.RequireEqual(ctx, "DCONF_PROFILE=gdm dconf read /org/gnome/desktop/interface/clock-format", "'12h'"); err != nil {
+	if err := rootClient.RequireDconfKeyEqual(ctx, "gdm", "/org/gnome/desktop/interface/clock-format", "'12h'"); err != nil {
 		return err
 	}
-	if err := rootClient.RequireEqual(ctx, "DCONF_PROFILE=gdm dconf read /org/gnome/desktop/interface/clock-show-weekday", "false"); err != nil {
+	if err := rootClient.RequireDconfKeyEqual(ctx, "gdm", "/org/gnome/desktop/interface/clock-show-weekday", "false"); err != nil {
 		return err
 	}
-	if err := rootClient.RequireEqual(ctx, "DCONF_PROFILE=gdm dconf read /org/gnome/login-screen/banner-message-enable", "true"); err != nil {
+	if err := rootClient.RequireDconfKeyEqual(ctx, "gdm", "/org/gnome/login-screen/banner-message-enable", "true"); err != nil {
 		return err
 	}
-	if err := rootClient.RequireEqual(ctx, "DCONF_PROFILE=gdm dconf read /org/gnome/login-screen/banner-message-text", "'Sample banner text'"); err != nil {
+	if err := rootClient.RequireDconfKeyEqual(ctx, "gdm", "/org/gnome/login-screen/banner-message-text", "'Sample banner text'"); err != nil {
 		return err
 	}
 
+	// Refreshing over the simulated branch-office link must not time out
+	if cmd.Inventory.NetworkShaping != nil {
+		if _, err := rootClient.Run(ctx, "adsysctl update -m -v"); err != nil {
+			return fmt.Errorf("failed to refresh machine policies with network shaping: %w", err)
+		}
+	}
+
 	// Pro policies should not be applied yet
 	if err := rootClient.RequireEqual(ctx, "gsettings get org.gnome.system.proxy.ftp host", "''"); err != nil {
 		return err
@@ -92,7 +104,7 @@ func action(ctx context.Context, cmd *command.Command) (err error) {
 	if err != nil {
 		return fmt.Errorf("failed to connect to VM: %w", err)
 	}
-	if err := client.RequireEqual(ctx, "dconf read /org/gnome/desktop/background/picture-uri", ""); err != nil {
+	if err := client.RequireDconfKeyEqual(ctx, "", "/org/gnome/desktop/background/picture-uri", ""); err != nil {
 		return err
 	}
 
@@ -100,10 +112,10 @@ func action(ctx context.Context, cmd *command.Command) (err error) {
 	if cmd.Inventory.Codename == "jammy" {
 		expectedPictureURIDark = "'file:///usr/share/backgrounds/ubuntu-default-greyscale-wallpaper.png'"
 	}
-	if err := client.RequireEqual(ctx, "dconf read /org/gnome/desktop/background/picture-uri-dark", expectedPictureURIDark); err != nil {
+	if err := client.RequireDconfKeyEqual(ctx, "", "/org/gnome/desktop/background/picture-uri-dark", expectedPictureURIDark); err != nil {
 		return err
 	}
-	if err := client.RequireEqual(ctx, "dconf read /org/gnome/shell/favorite-apps", "['firefox.desktop', 'thunderbird.desktop', 'org.gnome.Nautilus.desktop']"); err != nil {
+	if err := client.RequireDconfKeyEqual(ctx, "", "/org/gnome/shell/favorite-apps", "['firefox.desktop', 'thunderbird.desktop', 'org.gnome.Nautilus.desktop']"); err != nil {
 		return err
 	}
 
@@ -112,7 +124,7 @@ func action(ctx context.Context, cmd *command.Command) (err error) {
 	if err != nil {
 		return fmt.Errorf("failed to connect to VM: %w", err)
 	}
-	if err := client.RequireEqual(ctx, "dconf read /org/gnome/shell/favorite-apps", "['rhythmbox.desktop']"); err != nil {
+	if err := client.RequireDconfKeyEqual(ctx, "", "/org/gnome/shell/favorite-apps", "['rhythmbox.desktop']"); err != nil {
 		return err
 	}
 
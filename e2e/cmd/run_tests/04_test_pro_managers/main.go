@@ -123,6 +123,12 @@ func action(ctx context.Context, cmd *command.Command) (err error) {
 	// Assert machine policies were applied
 	/// Mounts
 	if cmd.Inventory.Codename != "focal" { // mount behavior is spotty on focal so avoid asserting it
+		if err := rootClient.RequireMountPresent(ctx, "/adsys/nfs/warthogs.biz/system-mount-nfs", "nfs"); err != nil {
+			return err
+		}
+		if err := rootClient.RequireMountPresent(ctx, "/adsys/cifs/warthogs.biz/system-mount-smb", "cifs"); err != nil {
+			return err
+		}
 		if err := rootClient.RequireEqual(ctx, "cat /adsys/nfs/warthogs.biz/system-mount-nfs/file.txt", expectedMountedFileContents); err != nil {
 			return err
 		}
@@ -139,8 +145,11 @@ func action(ctx context.Context, cmd *command.Command) (err error) {
 "adminuser@warthogs.biz"	ALL=(ALL:ALL) ALL`); err != nil {
 		return err
 	}
+	if err := rootClient.RequireSudoersGrant(ctx, "adminuser@warthogs.biz", "(ALL : ALL) ALL"); err != nil {
+		return err
+	}
 	// Only partly assert the polkit file contents as there are differences in polkit configurations between Ubuntu versions
-	if err := rootClient.RequireContains(ctx, "cat /etc/polkit-1/localauthority.conf.d/99-adsys-privilege-enforcement.conf", "unix-user:adminuser@warthogs.biz"); err != nil {
+	if err := rootClient.RequireFileContains(ctx, "/etc/polkit-1/localauthority.conf.d/99-adsys-privilege-enforcement.conf", "unix-user:adminuser@warthogs.biz"); err != nil {
 		return err
 	}
 
@@ -4,6 +4,7 @@ package inventory
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -27,6 +28,22 @@ type Inventory struct {
 	State       State
 	SSHKeyPath  string
 	Hostname    string
+
+	// NetworkShaping is the degraded link simulated between the client and the domain controller, if any.
+	NetworkShaping *NetworkShaping `yaml:",omitempty"`
+
+	// Secrets are materials shared between the scripts, like Kerberos tickets, keytabs or TLS certificates.
+	// They are encrypted: use SetSecret and Secret to access them.
+	Secrets map[string]string `yaml:",omitempty"`
+}
+
+// NetworkShaping describes the latency and packet loss applied to the traffic sent from the client to the
+// domain controller, to simulate a branch-office link.
+type NetworkShaping struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	// Loss is the percentage of packets dropped.
+	Loss float64
 }
 
 // Write writes the inventory file to the given path.
@@ -0,0 +1,96 @@
+package inventory
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretsKeyEnv is the environment variable holding the passphrase the secrets of the inventory are encrypted with.
+// It is shared by all the scripts of the E2E tests.
+const SecretsKeyEnv = "AD_PASSWORD"
+
+// ClientKeytabSecret is the name of the secret holding the keytab of the client, exported once it joined the domain.
+const ClientKeytabSecret = "client-keytab"
+
+const saltSize = 16
+
+// SetSecret encrypts data and stores it in the inventory under name, replacing any previous value.
+// The secret is written to disk with the inventory.
+func (inv *Inventory) SetSecret(name string, data []byte) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	gcm, err := secretsCipher(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	// The secret name is authenticated, so that secrets can't be swapped.
+	sealed := gcm.Seal(nil, nonce, data, []byte(name))
+
+	if inv.Secrets == nil {
+		inv.Secrets = make(map[string]string)
+	}
+	inv.Secrets[name] = base64.StdEncoding.EncodeToString(append(append(salt, nonce...), sealed...))
+	return nil
+}
+
+// Secret decrypts and returns the secret stored in the inventory under name.
+func (inv Inventory) Secret(name string) ([]byte, error) {
+	encoded, ok := inv.Secrets[name]
+	if !ok {
+		return nil, fmt.Errorf("secret %q not found in inventory, please refer to the previous scripts in the series", name)
+	}
+	d, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret %q: %w", name, err)
+	}
+	if len(d) < saltSize {
+		return nil, fmt.Errorf("secret %q is too short", name)
+	}
+
+	gcm, err := secretsCipher(d[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	d = d[saltSize:]
+	if len(d) < gcm.NonceSize() {
+		return nil, fmt.Errorf("secret %q is too short", name)
+	}
+
+	data, err := gcm.Open(nil, d[:gcm.NonceSize()], d[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret %q, check the %s environment variable: %w", name, SecretsKeyEnv, err)
+	}
+	return data, nil
+}
+
+// secretsCipher returns the cipher encrypting the secrets, with a key derived from the passphrase and salt.
+func secretsCipher(salt []byte) (cipher.AEAD, error) {
+	passphrase := os.Getenv(SecretsKeyEnv)
+	if passphrase == "" {
+		return nil, errors.New(SecretsKeyEnv + " environment variable must be set to access the secrets of the inventory")
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive secrets key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
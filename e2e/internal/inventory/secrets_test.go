@@ -0,0 +1,90 @@
+package inventory_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/e2e/internal/inventory"
+)
+
+func TestSecrets(t *testing.T) {
+	tests := map[string]struct {
+		passphrase     string
+		readPassphrase string
+		readName       string
+		tamper         bool
+
+		wantSetErr  bool
+		wantReadErr bool
+	}{
+		"Secret is stored encrypted and read back": {},
+
+		// Error cases
+		"Error on storing without passphrase":        {passphrase: "-", wantSetErr: true},
+		"Error on reading with a wrong passphrase":   {readPassphrase: "wrong", wantReadErr: true},
+		"Error on reading without passphrase":        {readPassphrase: "-", wantReadErr: true},
+		"Error on reading an unknown secret":         {readName: "unknown", wantReadErr: true},
+		"Error on reading a tampered secret":         {tamper: true, wantReadErr: true},
+		"Error on reading a secret under other name": {readName: "renamed", wantReadErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			setPassphrase(t, tc.passphrase)
+
+			want := []byte("some ticket\x00with binary data")
+			inv := inventory.Inventory{Hostname: "client"}
+			err := inv.SetSecret("ticket", want)
+			if tc.wantSetErr {
+				require.Error(t, err, "SetSecret should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "SetSecret failed but shouldn't have")
+			require.NotContains(t, inv.Secrets["ticket"], "ticket", "Secret should be encrypted in the inventory")
+
+			// Secrets persist with the inventory.
+			p := filepath.Join(t.TempDir(), "inventory.yaml")
+			require.NoError(t, inventory.Write(p, inv), "Setup: Write should not fail")
+			inv, err = inventory.Read(p)
+			require.NoError(t, err, "Setup: Read should not fail")
+
+			if tc.readName == "renamed" {
+				inv.Secrets["renamed"] = inv.Secrets["ticket"]
+			}
+			if tc.tamper {
+				s := []byte(inv.Secrets["ticket"])
+				s[len(s)/2] ^= 1
+				inv.Secrets["ticket"] = string(s)
+			}
+			if tc.readPassphrase != "" {
+				setPassphrase(t, tc.readPassphrase)
+			}
+			readName := "ticket"
+			if tc.readName != "" {
+				readName = tc.readName
+			}
+
+			got, err := inv.Secret(readName)
+			if tc.wantReadErr {
+				require.Error(t, err, "Secret should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Secret failed but shouldn't have")
+			require.Equal(t, want, got, "Secret should return the stored data")
+		})
+	}
+}
+
+// setPassphrase sets the passphrase of the secrets for the test. "-" unsets it, and an empty value sets a default one.
+func setPassphrase(t *testing.T, passphrase string) {
+	t.Helper()
+
+	switch passphrase {
+	case "-":
+		passphrase = ""
+	case "":
+		passphrase = "supersecret"
+	}
+	t.Setenv(inventory.SecretsKeyEnv, passphrase)
+}
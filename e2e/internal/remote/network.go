@@ -0,0 +1,89 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/adsys/e2e/internal/inventory"
+)
+
+const (
+	networkShapingScript = "/usr/local/sbin/adsys-e2e-shape-network"
+	networkShapingUnit   = "adsys-e2e-shape-network.service"
+)
+
+// ShapeNetwork simulates a degraded link between the remote host and the domain controller, by delaying and
+// dropping the packets sent to it with tc. Only the traffic to the domain controller is shaped, so that the SSH
+// connections of the scenarios are not affected.
+// The shaping is installed as a systemd service, so that it persists across reboots.
+func (c Client) ShapeNetwork(ctx context.Context, s inventory.NetworkShaping) error {
+	log.Infof("Shaping network of host %q: latency %s, jitter %s, loss %s%%", c.client.RemoteAddr().String(), s.Latency, s.Jitter, strconv.FormatFloat(s.Loss, 'f', -1, 64))
+
+	script := fmt.Sprintf(`#!/bin/sh
+set -eu
+iface=$(ip -o route get %[1]s | sed -n 's/.* dev \([^ ]*\).*/\1/p')
+tc qdisc del dev "$iface" root 2>/dev/null || true
+[ "${1:-}" = "stop" ] && exit 0
+# Traffic goes to the first bands by default: only the one to the domain controller is sent to the shaped band.
+tc qdisc add dev "$iface" root handle 1: prio bands 4
+tc qdisc add dev "$iface" parent 1:4 handle 40: netem %[2]s
+tc filter add dev "$iface" parent 1: protocol ip prio 1 u32 match ip dst %[1]s/32 flowid 1:4
+`, inventory.DomainControllerIP, netemArgs(s))
+
+	unit := fmt.Sprintf(`[Unit]
+Description=Simulate a degraded link to the domain controller for the adsys E2E tests
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=%[1]s
+ExecStop=%[1]s stop
+
+[Install]
+WantedBy=multi-user.target
+`, networkShapingScript)
+
+	cmd := fmt.Sprintf(`cat > %[1]s <<'EOF'
+%[2]sEOF
+chmod 0755 %[1]s
+cat > /etc/systemd/system/%[3]s <<'EOF'
+%[4]sEOF
+systemctl daemon-reload
+systemctl enable %[3]s
+systemctl restart %[3]s`, networkShapingScript, script, networkShapingUnit, unit)
+
+	if _, err := c.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to shape network: %w", err)
+	}
+	return nil
+}
+
+// ClearNetworkShaping removes the network shaping installed by ShapeNetwork, if any.
+func (c Client) ClearNetworkShaping(ctx context.Context) error {
+	log.Infof("Clearing network shaping of host %q", c.client.RemoteAddr().String())
+
+	cmd := fmt.Sprintf(`systemctl disable --now %[1]s 2>/dev/null || true
+rm -f /etc/systemd/system/%[1]s %[2]s
+systemctl daemon-reload`, networkShapingUnit, networkShapingScript)
+
+	if _, err := c.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to clear network shaping: %w", err)
+	}
+	return nil
+}
+
+// netemArgs returns the arguments of the netem queueing discipline applying s.
+func netemArgs(s inventory.NetworkShaping) string {
+	args := fmt.Sprintf("delay %dms", s.Latency.Milliseconds())
+	if s.Jitter > 0 {
+		args += fmt.Sprintf(" %dms distribution normal", s.Jitter.Milliseconds())
+	}
+	if s.Loss > 0 {
+		args += fmt.Sprintf(" loss %s%%", strconv.FormatFloat(s.Loss, 'f', -1, 64))
+	}
+	return args
+}
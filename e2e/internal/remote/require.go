@@ -1,10 +1,16 @@
 package remote
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"unicode"
+
+	"github.com/pkg/sftp"
 )
 
 // RequireEqual runs the given command and compares its output to the expected value.
@@ -76,3 +82,160 @@ func (c Client) RequireNoFileExists(ctx context.Context, filepath string) error
 
 	return nil
 }
+
+// RequireFileContains returns an error if the given file does not exist or does not contain the expected value.
+func (c Client) RequireFileContains(ctx context.Context, path, expected string) error {
+	content, err := c.readFile(path)
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(string(content), expected) {
+		return fmt.Errorf("expected file %q to contain %q, got %q", path, expected, string(content))
+	}
+
+	return nil
+}
+
+// RequireDconfKeyEqual returns an error if the value of the given dconf key is not the expected one, in GVariant
+// format like 'value'. The key is read from the given dconf profile, like gdm, or from the one of the connected
+// user if profile is empty.
+func (c Client) RequireDconfKeyEqual(ctx context.Context, profile, key, expected string) error {
+	cmd := "dconf read " + shellQuote(key)
+	if profile != "" {
+		cmd = fmt.Sprintf("DCONF_PROFILE=%s %s", shellQuote(profile), cmd)
+	}
+
+	out, err := c.Run(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to read dconf key %q: %w", key, err)
+	}
+
+	if got := strings.TrimSpace(string(out)); got != expected {
+		return fmt.Errorf("expected dconf key %q to be %q, got %q", key, expected, got)
+	}
+
+	return nil
+}
+
+// RequireUnitActive returns an error if the given systemd unit is not active.
+func (c Client) RequireUnitActive(ctx context.Context, unit string) error {
+	// is-active exits with an error if the unit is not active, but still prints its state.
+	out, _ := c.Run(ctx, "systemctl is-active "+shellQuote(unit))
+
+	if state := strings.TrimSpace(string(out)); state != "active" {
+		return fmt.Errorf("expected unit %q to be active, got %q", unit, state)
+	}
+
+	return nil
+}
+
+// RequireMountPresent returns an error if nothing is mounted on the given mount point. If fsType is not empty,
+// the filesystem type of the mount must start with it, so that nfs matches both nfs and nfs4 mounts.
+func (c Client) RequireMountPresent(ctx context.Context, mountPoint, fsType string) error {
+	out, err := c.Run(ctx, "cat /proc/self/mounts")
+	if err != nil {
+		return fmt.Errorf("failed to list mounts: %w", err)
+	}
+
+	var types []string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		// Each line is of the form <source> <mount point> <type> <options> <dump> <pass>.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || unescapeMountField(fields[1]) != mountPoint {
+			continue
+		}
+		if strings.HasPrefix(fields[2], fsType) {
+			return nil
+		}
+		types = append(types, fields[2])
+	}
+
+	if len(types) > 0 {
+		return fmt.Errorf("expected %q to be mounted with type %q, got %s", mountPoint, fsType, strings.Join(types, ", "))
+	}
+	return fmt.Errorf("expected %q to be mounted", mountPoint)
+}
+
+// RequireSudoersGrant returns an error if the given user is not granted the expected rule by sudo, as listed by
+// sudo -l, like (ALL : ALL) ALL. Whitespaces are ignored when comparing the rules.
+func (c Client) RequireSudoersGrant(ctx context.Context, user, rule string) error {
+	out, err := c.Run(ctx, "sudo -l -U "+shellQuote(user))
+	if err != nil {
+		return fmt.Errorf("failed to list sudo rules of %q: %w", user, err)
+	}
+
+	var rules []string
+	var inRules bool
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		l := scanner.Text()
+		// The rules are listed, indented, after the header of the user.
+		if strings.Contains(l, "may run the following commands") {
+			inRules = true
+			continue
+		}
+		if !inRules || strings.TrimSpace(l) == "" {
+			continue
+		}
+		if removeSpaces(l) == removeSpaces(rule) {
+			return nil
+		}
+		rules = append(rules, strings.TrimSpace(l))
+	}
+
+	return fmt.Errorf("expected %q to be granted %q by sudo, got %q", user, rule, rules)
+}
+
+// readFile returns the content of the given remote file.
+func (c Client) readFile(path string) ([]byte, error) {
+	ftp, err := sftp.NewClient(c.client)
+	if err != nil {
+		return nil, err
+	}
+	defer ftp.Close()
+
+	f, err := ftp.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q on remote host: %w", path, err)
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q on remote host: %w", path, err)
+	}
+	return content, nil
+}
+
+// shellQuote quotes s to be used as a single argument of a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// unescapeMountField decodes the octal escapes, like \040 for spaces, of a field of /proc/self/mounts.
+func unescapeMountField(f string) string {
+	var b strings.Builder
+	for i := 0; i < len(f); i++ {
+		if f[i] == '\\' && i+3 < len(f) {
+			if c, err := strconv.ParseUint(f[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(f[i])
+	}
+	return b.String()
+}
+
+// removeSpaces returns s without any whitespace.
+func removeSpaces(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,106 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"github.com/ubuntu/adsys/e2e/internal/inventory"
+)
+
+// ExportSecret reads the given remote file and stores it encrypted in the inventory under name, so that later
+// scripts can inject it with InjectSecret.
+func (c Client) ExportSecret(inv *inventory.Inventory, name, remotePath string) error {
+	log.Infof("Exporting %q from host %q to inventory secret %q", remotePath, c.client.RemoteAddr().String(), name)
+
+	ftp, err := sftp.NewClient(c.client)
+	if err != nil {
+		return err
+	}
+	defer ftp.Close()
+
+	remote, err := ftp.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %q on remote host: %w", remotePath, err)
+	}
+	defer remote.Close()
+
+	data, err := io.ReadAll(remote)
+	if err != nil {
+		return fmt.Errorf("failed to read %q on remote host: %w", remotePath, err)
+	}
+
+	return inv.SetSecret(name, data)
+}
+
+// InjectSecret writes the inventory secret name to the given remote file, with the given permissions.
+// The parent directories are created if needed.
+func (c Client) InjectSecret(inv inventory.Inventory, name, remotePath string, perm os.FileMode) error {
+	log.Infof("Injecting inventory secret %q to %q on host %q", name, remotePath, c.client.RemoteAddr().String())
+
+	data, err := inv.Secret(name)
+	if err != nil {
+		return err
+	}
+
+	ftp, err := sftp.NewClient(c.client)
+	if err != nil {
+		return err
+	}
+	defer ftp.Close()
+
+	if err := ftp.MkdirAll(filepath.Dir(remotePath)); err != nil {
+		return fmt.Errorf("failed to create directory %q on remote host: %w", filepath.Dir(remotePath), err)
+	}
+
+	// Restrict the permissions before writing the secret.
+	remote, err := ftp.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("failed to create %q on remote host: %w", remotePath, err)
+	}
+	defer remote.Close()
+	if err := remote.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to set permissions of %q on remote host: %w", remotePath, err)
+	}
+	if _, err := remote.Write(data); err != nil {
+		return fmt.Errorf("failed to write %q on remote host: %w", remotePath, err)
+	}
+
+	return nil
+}
+
+// ExportKerberosTicket requests a Kerberos ticket for principal on the remote host and stores the resulting
+// credential cache in the inventory under name. The remote host must have the krb5-user package installed.
+func (c Client) ExportKerberosTicket(ctx context.Context, inv *inventory.Inventory, name, principal, password string) (err error) {
+	ccache := fmt.Sprintf("/tmp/adsys-e2e-%s.ccache", name)
+	defer func() {
+		if _, rmErr := c.Run(ctx, fmt.Sprintf("rm -f %q", ccache)); rmErr != nil {
+			log.Warningf("Failed to remove temporary credential cache %q: %v", ccache, rmErr)
+		}
+	}()
+
+	if _, err := c.Run(ctx, fmt.Sprintf("kinit -c %q %q <<<'%s'", ccache, principal, password)); err != nil {
+		return fmt.Errorf("failed to get Kerberos ticket for %q: %w", principal, err)
+	}
+
+	return c.ExportSecret(inv, name, ccache)
+}
+
+// InjectKerberosTicket writes the credential cache stored in the inventory under name to the given remote path,
+// owned by owner if not empty. The ticket can then be used by setting KRB5CCNAME to FILE:<remotePath>.
+func (c Client) InjectKerberosTicket(ctx context.Context, inv inventory.Inventory, name, remotePath, owner string) error {
+	if err := c.InjectSecret(inv, name, remotePath, 0600); err != nil {
+		return err
+	}
+	if owner == "" {
+		return nil
+	}
+	if _, err := c.Run(ctx, fmt.Sprintf("chown %q %q", owner, remotePath)); err != nil {
+		return fmt.Errorf("failed to change owner of %q: %w", remotePath, err)
+	}
+	return nil
+}
@@ -7,11 +7,13 @@ package ad
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	_ "embed" // embed gpolist python binary.
 	"errors"
 	"fmt"
 	"io/fs"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
@@ -23,8 +25,10 @@ import (
 	"github.com/leonelquinteros/gotext"
 	"github.com/ubuntu/adsys/internal/ad/backends"
 	adcommon "github.com/ubuntu/adsys/internal/ad/common"
+	"github.com/ubuntu/adsys/internal/ad/gpp"
 	"github.com/ubuntu/adsys/internal/ad/registry"
 	"github.com/ubuntu/adsys/internal/consts"
+	"github.com/ubuntu/adsys/internal/faultinject"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
 	"github.com/ubuntu/adsys/internal/policies"
 	"github.com/ubuntu/adsys/internal/policies/entry"
@@ -55,6 +59,7 @@ type gpo downloadable
 type downloadable struct {
 	name     string
 	url      string
+	link     string
 	mu       *sync.RWMutex
 	isAssets bool
 
@@ -77,9 +82,25 @@ type AD struct {
 	sync.RWMutex
 	fetchMu sync.Mutex
 
-	withoutKerberos bool
-	gpoListCmd      []string
-	gpoListTimeout  time.Duration
+	withoutKerberos       bool
+	gpoListCmd            []string
+	gpoListTimeout        time.Duration
+	gpoListRetries        int
+	sysvolDownloadTimeout time.Duration
+	bandwidthLimiter      *bandwidthLimiter
+
+	negativeCache       map[string]negativeCacheEntry
+	negativeCacheMu     sync.Mutex
+	negativeCacheTTL    time.Duration
+	negativeCacheMaxTTL time.Duration
+
+	detectCaptivePortals bool
+	connectivityCheckURL string
+	lookupHost           func(ctx context.Context, host string) ([]string, error)
+	captivePortal        captivePortalState
+	captivePortalMu      sync.Mutex
+
+	now func() time.Time
 }
 
 type options struct {
@@ -87,9 +108,19 @@ type options struct {
 	runDir    string
 	cacheDir  string
 
-	withoutKerberos bool
-	gpoListCmd      []string
-	gpoListTimeout  time.Duration
+	withoutKerberos       bool
+	gpoListCmd            []string
+	gpoListTimeout        time.Duration
+	gpoListRetries        int
+	sysvolDownloadTimeout time.Duration
+	sysvolBandwidthLimit  int
+	sysvolOffPeakWindow   *offPeakWindow
+	negativeCacheTTL      time.Duration
+	negativeCacheMaxTTL   time.Duration
+	detectCaptivePortals  bool
+	connectivityCheckURL  string
+	lookupHost            func(ctx context.Context, host string) ([]string, error)
+	now                   func() time.Time
 }
 
 // Option reprents an optional function to change AD behavior.
@@ -119,6 +150,61 @@ func WithGpoListTimeout(timeout time.Duration) Option {
 	}
 }
 
+// WithGpoListRetries specifies how many times the adsys-gpolist command is retried on failure.
+func WithGpoListRetries(retries int) Option {
+	return func(o *options) error {
+		o.gpoListRetries = retries
+		return nil
+	}
+}
+
+// WithSysvolDownloadTimeout specifies a custom timeout for downloading GPOs and assets from SYSVOL.
+func WithSysvolDownloadTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		o.sysvolDownloadTimeout = timeout
+		return nil
+	}
+}
+
+// WithSysvolBandwidthLimit caps the throughput of the GPOs and assets downloads from SYSVOL, in bytes per second.
+// The cap is lifted during offPeak, a daily window in local time of the form HH:MM-HH:MM, if not empty.
+// A zero limit disables the cap.
+func WithSysvolBandwidthLimit(bytesPerSecond int, offPeak string) Option {
+	return func(o *options) error {
+		if bytesPerSecond < 0 {
+			return errors.New(gotext.Get("invalid SYSVOL bandwidth limit %d: it can't be negative", bytesPerSecond))
+		}
+		w, err := parseOffPeakWindow(offPeak)
+		if err != nil {
+			return err
+		}
+		o.sysvolBandwidthLimit = bytesPerSecond
+		o.sysvolOffPeakWindow = w
+		return nil
+	}
+}
+
+// WithNegativeCacheTTL specifies how long a user without applicable GPOs, or whose GPO lookup failed,
+// is not looked up again in AD. This duration doubles on each consecutive negative lookup, up to maxTTL.
+// A zero ttl disables the negative cache.
+func WithNegativeCacheTTL(ttl, maxTTL time.Duration) Option {
+	return func(o *options) error {
+		o.negativeCacheTTL = ttl
+		o.negativeCacheMaxTTL = maxTTL
+		return nil
+	}
+}
+
+// WithCaptivePortalDetection enables the detection of captive portals and hijacked DNS when AD can't be reached.
+// connectivityCheckURL must answer with an empty HTTP 204 response. If empty, only the DNS answers are checked.
+func WithCaptivePortalDetection(connectivityCheckURL string) Option {
+	return func(o *options) error {
+		o.detectCaptivePortals = true
+		o.connectivityCheckURL = connectivityCheckURL
+		return nil
+	}
+}
+
 // AdsysGpoListCode is the embedded script which request
 // Samba to get our GPO list for the given object.
 //
@@ -141,6 +227,12 @@ func New(ctx context.Context, configBackend backends.Backend, hostname string, o
 		gpoListCmd:     []string{"python3", "-c", AdsysGpoListCode},
 		versionID:      versionID,
 		gpoListTimeout: 30 * time.Second, // this is used in tests and set to consts.DefaultGpoListTimeout in production
+
+		sysvolDownloadTimeout: consts.DefaultSysvolDownloadTimeout,
+		negativeCacheTTL:      consts.DefaultNegativeCacheTTL,
+		negativeCacheMaxTTL:   consts.DefaultNegativeCacheMaxTTL,
+		lookupHost:            net.DefaultResolver.LookupHost,
+		now:                   time.Now,
 	}
 	// applied options
 	for _, o := range opts {
@@ -178,9 +270,22 @@ func New(ctx context.Context, configBackend backends.Backend, hostname string, o
 		policiesCacheDir: policiesCacheDir,
 		krb5CacheDir:     krb5CacheDir,
 
-		downloadables:  make(map[string]*downloadable),
-		gpoListCmd:     args.gpoListCmd,
-		gpoListTimeout: args.gpoListTimeout,
+		downloadables:         make(map[string]*downloadable),
+		gpoListCmd:            args.gpoListCmd,
+		gpoListTimeout:        args.gpoListTimeout,
+		gpoListRetries:        args.gpoListRetries,
+		sysvolDownloadTimeout: args.sysvolDownloadTimeout,
+		bandwidthLimiter:      newBandwidthLimiter(args.sysvolBandwidthLimit, args.sysvolOffPeakWindow, args.now),
+
+		negativeCache:       make(map[string]negativeCacheEntry),
+		negativeCacheTTL:    args.negativeCacheTTL,
+		negativeCacheMaxTTL: args.negativeCacheMaxTTL,
+
+		detectCaptivePortals: args.detectCaptivePortals,
+		connectivityCheckURL: args.connectivityCheckURL,
+		lookupHost:           args.lookupHost,
+
+		now: args.now,
 	}, nil
 }
 
@@ -244,43 +349,62 @@ func (ad *AD) GetPolicies(ctx context.Context, objectName string, objectClass Ob
 		return cachedPolicies, nil
 	}
 
+	// Don't contact AD again while a captive portal is suspected, until its backoff expires.
+	if reason, until, suspected := ad.checkCaptivePortal(); suspected {
+		log.Debugf(ctx, "Skipping AD lookup for %q until %s: captive portal suspected (%s)", objectName, until.Format(time.TimeOnly), reason)
+		return ad.cachedPoliciesBehindCaptivePortal(ctx, objectName, reason)
+	}
+
+	// Users without applicable GPOs or whose lookup recently failed are not looked up again until their backoff expires.
+	if objectClass == UserObject {
+		cached, err := ad.checkNegativeCache(ctx, objectName)
+		if err != nil {
+			return pols, err
+		}
+		if cached {
+			return policies.New(ctx, nil, "")
+		}
+	}
+
 	// We need an AD DC to connect to
 	adServerFQDN, err := ad.configBackend.ServerFQDN(ctx)
 	if err != nil {
+		if reason, suspected := ad.detectCaptivePortal(ctx); suspected {
+			return ad.cachedPoliciesBehindCaptivePortal(ctx, objectName, reason)
+		}
 		return policies.Policies{}, errors.New(gotext.Get("can't get current Server FQDN: %v", err))
 	}
 
 	// Otherwise, try fetching the GPO list from LDAP
-	args := append([]string{}, ad.gpoListCmd...) // Copy gpoListCmd to prevent data race
-	scriptArgs := []string{"--objectclass", string(objectClass), adServerFQDN, objectName}
-	cmdArgs := append(args, scriptArgs...)
-	cmdCtx, cancel := context.WithTimeout(ctx, time.Second*10)
-	defer cancel()
-	log.Debugf(ctx, "Getting gpo list with arguments: %q", strings.Join(scriptArgs, " "))
-	// #nosec G204 - cmdArgs is under our control (python embedded script or mock for tests)
-	cmd := exec.CommandContext(cmdCtx, cmdArgs[0], cmdArgs[1:]...)
-	cmd.Env = append(os.Environ(), fmt.Sprintf("KRB5CCNAME=%s", krb5CCPath))
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	smbsafe.WaitExec()
-	err = cmd.Run()
-	smbsafe.DoneExec()
+	stdout, err := ad.listGPOs(ctx, krb5CCPath, adServerFQDN, objectName, objectClass)
 	if err != nil {
-		return pols, errors.New(gotext.Get("failed to retrieve the list of GPO (exited with %d): %v\n%s", cmd.ProcessState.ExitCode(), err, stderr.String()))
+		// Kerberos and LDAP errors are misleading when the network is intercepted.
+		if reason, suspected := ad.detectCaptivePortal(ctx); suspected {
+			return ad.cachedPoliciesBehindCaptivePortal(ctx, objectName, reason)
+		}
+		if objectClass == UserObject {
+			ad.addToNegativeCache(ctx, objectName, err)
+		}
+		return pols, err
 	}
+	// AD answered: we are not behind a captive portal anymore.
+	ad.clearCaptivePortal(ctx)
 
 	downloadables := make(map[string]string)
 	var orderedGPOs []gpo
-	scanner := bufio.NewScanner(&stdout)
+	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
 		t := scanner.Text()
-		res := strings.SplitN(t, "\t", 2)
+		res := strings.SplitN(t, "\t", 3)
 		gpoName, gpoURL := res[0], res[1]
-		log.Debugf(ctx, "GPO %q for %q available at %q", gpoName, objectName, gpoURL)
+		// The container the GPO is linked to is optional.
+		var gpoLink string
+		if len(res) > 2 {
+			gpoLink = res[2]
+		}
+		log.Debugf(ctx, "GPO %q for %q available at %q (linked to %q)", gpoName, objectName, gpoURL, gpoLink)
 		downloadables[gpoName] = gpoURL
-		orderedGPOs = append(orderedGPOs, gpo{name: gpoName, url: gpoURL})
+		orderedGPOs = append(orderedGPOs, gpo{name: gpoName, url: gpoURL, link: gpoLink})
 
 		if _, ok := downloadables["assets"]; ok {
 			continue
@@ -296,6 +420,13 @@ func (ad *AD) GetPolicies(ctx context.Context, objectName string, objectClass Ob
 	if err := scanner.Err(); err != nil {
 		return pols, err
 	}
+	if objectClass == UserObject {
+		if len(orderedGPOs) == 0 {
+			ad.addToNegativeCache(ctx, objectName, nil)
+		} else {
+			ad.removeFromNegativeCache(objectName)
+		}
+	}
 
 	ad.Lock()
 	defer ad.Unlock()
@@ -346,7 +477,7 @@ func (ad *AD) GetPolicies(ctx context.Context, objectName string, objectClass Ob
 
 		assetsDbPath = filepath.Join(assetsSrc + ".db")
 
-		return nil
+		return faultinject.CorruptAssets(assetsDbPath)
 	})
 
 	if err := errg.Wait(); err != nil {
@@ -356,6 +487,43 @@ func (ad *AD) GetPolicies(ctx context.Context, objectName string, objectClass Ob
 	return policies.New(ctx, gposRules, assetsDbPath)
 }
 
+// listGPOs runs the adsys-gpolist command requesting the GPOs applicable to objectName from LDAP and returns its output.
+// Each attempt is bound to the GPO list timeout, and the command is retried up to the configured number of times on failure.
+func (ad *AD) listGPOs(ctx context.Context, krb5CCPath, adServerFQDN, objectName string, objectClass ObjectClass) (stdout *bytes.Buffer, err error) {
+	args := append([]string{}, ad.gpoListCmd...) // Copy gpoListCmd to prevent data race
+	scriptArgs := []string{"--objectclass", string(objectClass), adServerFQDN, objectName}
+	cmdArgs := append(args, scriptArgs...)
+	log.Debugf(ctx, "Getting gpo list with arguments: %q", strings.Join(scriptArgs, " "))
+
+	for attempt := 0; ; attempt++ {
+		stdout, err = ad.runGpoListCmd(ctx, krb5CCPath, cmdArgs)
+		if err == nil || attempt >= ad.gpoListRetries || ctx.Err() != nil {
+			return stdout, err
+		}
+		log.Warningf(ctx, "Retrying to get the GPO list for %q (%d/%d): %v", objectName, attempt+1, ad.gpoListRetries, err)
+	}
+}
+
+// runGpoListCmd runs once the GPO list command cmdArgs, authenticated with the krb5CCPath ticket, within the GPO list timeout.
+func (ad *AD) runGpoListCmd(ctx context.Context, krb5CCPath string, cmdArgs []string) (*bytes.Buffer, error) {
+	cmdCtx, cancel := context.WithTimeout(ctx, ad.gpoListTimeout)
+	defer cancel()
+	// #nosec G204 - cmdArgs is under our control (python embedded script or mock for tests)
+	cmd := exec.CommandContext(cmdCtx, cmdArgs[0], cmdArgs[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("KRB5CCNAME=%s", krb5CCPath))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	smbsafe.WaitExec()
+	err := cmd.Run()
+	smbsafe.DoneExec()
+	if err != nil {
+		return nil, errors.New(gotext.Get("failed to retrieve the list of GPO (exited with %d): %v\n%s", cmd.ProcessState.ExitCode(), err, stderr.String()))
+	}
+	return &stdout, nil
+}
+
 // ListUsers returns the list of users on the system based on their cached policy information.
 // If active is true, the list of users is retrieved from the cached Kerberos ticket information.
 func (ad *AD) ListUsers(ctx context.Context, active bool) (users []string, err error) {
@@ -488,6 +656,7 @@ func (ad *AD) parseGPOs(ctx context.Context, gpos []gpo, objectClass ObjectClass
 		gpoWithRules := policies.GPO{
 			ID:    filepath.Base(url),
 			Name:  name,
+			Link:  g.link,
 			Rules: make(map[string][]entry.Entry),
 		}
 		r = append(r, gpoWithRules)
@@ -498,19 +667,64 @@ func (ad *AD) parseGPOs(ctx context.Context, gpos []gpo, objectClass ObjectClass
 
 			log.Debugf(ctx, "Parsing GPO %q", name)
 
+			gpoDir := filepath.Join(ad.sysvolCacheDir, "Policies", filepath.Base(url))
+
 			// We need to consider the uppercase version of the name as well,
 			// which could occur in some of the default GPOs such as Default
 			// Domain Policy.
 			classes := []string{"User", "USER"}
+			printersKey := "printers/user-connections"
 			if objectClass == ComputerObject {
 				classes = []string{"Machine", "MACHINE"}
+				printersKey = "printers/connections"
+
+				e, err := ad.parseGPPFiles(ctx, gpoDir, classes)
+				if err != nil {
+					return err
+				}
+				if e.Value != "" {
+					gpoWithRules.Rules["files"] = append(gpoWithRules.Rules["files"], e)
+				}
+
+				e, err = parseGPPIniFiles(ctx, gpoDir, classes)
+				if err != nil {
+					return err
+				}
+				if e.Value != "" {
+					gpoWithRules.Rules["ini"] = append(gpoWithRules.Rules["ini"], e)
+				}
+
+				users, groups, err := ad.parseGPPLocalUsersAndGroups(ctx, gpoDir, classes)
+				if err != nil {
+					return err
+				}
+				for _, e := range []entry.Entry{users, groups} {
+					if e.Value != "" {
+						gpoWithRules.Rules["localusers"] = append(gpoWithRules.Rules["localusers"], e)
+					}
+				}
+			}
+
+			printers, err := parseGPPPrinters(ctx, gpoDir, classes, printersKey)
+			if err != nil {
+				return err
+			}
+			if printers.Value != "" {
+				gpoWithRules.Rules["printers"] = append(gpoWithRules.Rules["printers"], printers)
+			}
+
+			shortcuts, err := parseGPPShortcuts(ctx, gpoDir, classes, objectClass == ComputerObject)
+			if err != nil {
+				return err
+			}
+			if shortcuts.Value != "" {
+				gpoWithRules.Rules["shortcuts"] = append(gpoWithRules.Rules["shortcuts"], shortcuts)
 			}
 
-			var err error
 			var f *os.File
 			for _, class := range classes {
 				var e error
-				f, e = os.Open(filepath.Join(ad.sysvolCacheDir, "Policies", filepath.Base(url), class, "Registry.pol"))
+				f, e = os.Open(filepath.Join(gpoDir, class, "Registry.pol"))
 
 				// We only care about the first error which is caused by opening
 				// the capitalized version of the class, instead of the
@@ -578,6 +792,33 @@ func (ad *AD) parseGPOs(ctx context.Context, gpos []gpo, objectClass ObjectClass
 					continue
 				}
 
+				// The value is locked, unless the policy sets it as a default only
+				if releaseID == adcommon.LockValueName {
+					if !pol.Disabled && pol.Value == "false" {
+						iLast := len(gpoWithRules.Rules[keyType]) - 1
+						gpoWithRules.Rules[keyType][iLast].Unlocked = true
+					}
+					continue
+				}
+
+				// Lists can be combined with the default value of the system
+				if releaseID == adcommon.ListModeValueName {
+					if !pol.Disabled && (pol.Value == entry.ListModeMerge || pol.Value == entry.ListModeAppend) {
+						iLast := len(gpoWithRules.Rules[keyType]) - 1
+						gpoWithRules.Rules[keyType][iLast].ListMode = pol.Value
+					}
+					continue
+				}
+
+				// The changes of the policy are only reported in audit mode
+				if releaseID == adcommon.AuditValueName {
+					if !pol.Disabled && pol.Value == "true" {
+						iLast := len(gpoWithRules.Rules[keyType]) - 1
+						gpoWithRules.Rules[keyType][iLast].Mode = entry.ModeAudit
+					}
+					continue
+				}
+
 				if strings.HasPrefix(releaseID, "Override"+ad.versionID) && pol.Value == "true" {
 					overrideEnabled = true
 					continue
@@ -603,6 +844,411 @@ func (ad *AD) parseGPOs(ctx context.Context, gpos []gpo, objectClass ObjectClass
 	return r, nil
 }
 
+// parseGPPFiles converts the Group Policy Preferences "Files" items of the GPO in gpoDir to a files deployment entry.
+// Only the items deployed from the files directory of the assets share, or deleting files, are supported, others are skipped.
+func (ad *AD) parseGPPFiles(ctx context.Context, gpoDir string, classes []string) (e entry.Entry, err error) {
+	var f *os.File
+	for _, class := range classes {
+		f, err = os.Open(filepath.Join(gpoDir, class, "Preferences", "Files", "Files.xml"))
+		if err == nil {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return e, nil
+	} else if err != nil {
+		return e, err
+	}
+	defer decorate.LogFuncOnErrorContext(ctx, f.Close)
+
+	items, err := gpp.ParseFiles(f)
+	if err != nil {
+		return e, errors.New(gotext.Get("%s: %v", f.Name(), err))
+	}
+
+	var lines []string
+	for _, item := range items {
+		if item.Disabled {
+			continue
+		}
+		if item.Action == gpp.ActionDelete {
+			if strings.ContainsAny(item.TargetPath, ",\n") {
+				log.Warning(ctx, gotext.Get("Group Policy Preferences file %q: paths can't contain commas or new lines, skipping it", item.Name))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("target=%s, action=%s", item.TargetPath, gpp.ApplyMode(item.Action)))
+			continue
+		}
+		source, ok := gpp.AssetsPath(item.FromPath, consts.DistroID, "files")
+		if !ok {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences file %q: %q is not in the files directory of the assets share, skipping it", item.Name, item.FromPath))
+			continue
+		}
+		if strings.ContainsAny(source+item.TargetPath, ",\n") {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences file %q: paths can't contain commas or new lines, skipping it", item.Name))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("source=%s, target=%s, action=%s", source, item.TargetPath, gpp.ApplyMode(item.Action)))
+	}
+
+	if len(lines) == 0 {
+		return e, nil
+	}
+	return entry.Entry{Key: "files/deploy", Value: strings.Join(lines, "\n"), Strategy: entry.StrategyAppend}, nil
+}
+
+// parseGPPIniFiles converts the Group Policy Preferences "Ini Files" items of the GPO in gpoDir to an ini settings entry.
+// The Windows paths are kept as is: they are matched against the ini mappings when applying the policy.
+func parseGPPIniFiles(ctx context.Context, gpoDir string, classes []string) (e entry.Entry, err error) {
+	var f *os.File
+	for _, class := range classes {
+		f, err = os.Open(filepath.Join(gpoDir, class, "Preferences", "IniFiles", "IniFiles.xml"))
+		if err == nil {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return e, nil
+	} else if err != nil {
+		return e, err
+	}
+	defer decorate.LogFuncOnErrorContext(ctx, f.Close)
+
+	items, err := gpp.ParseIniFiles(f)
+	if err != nil {
+		return e, errors.New(gotext.Get("%s: %v", f.Name(), err))
+	}
+
+	var lines []string
+	for _, item := range items {
+		if item.Disabled {
+			continue
+		}
+		if item.Path == "" || strings.ContainsAny(item.Path+item.Section+item.Property, ",\n") || strings.Contains(item.Value, "\n") ||
+			strings.ContainsAny(item.Section+item.Property, "[]=") {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences ini file %q: unsupported path, section or property, skipping it", item.Name))
+			continue
+		}
+
+		line := fmt.Sprintf("path=%s", item.Path)
+		if item.Section != "" {
+			line += fmt.Sprintf(", section=%s", item.Section)
+		}
+		if item.Property != "" {
+			line += fmt.Sprintf(", property=%s", item.Property)
+		}
+		if item.Action == gpp.ActionDelete {
+			if item.Section == "" && item.Property == "" {
+				log.Warning(ctx, gotext.Get("Group Policy Preferences ini file %q: deleting whole files is not supported, skipping it", item.Name))
+				continue
+			}
+			lines = append(lines, line+", action=delete")
+			continue
+		}
+		if item.Property == "" {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences ini file %q: a property is required, skipping it", item.Name))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s, action=%s, value=%s", line, gpp.ApplyMode(item.Action), item.Value))
+	}
+
+	if len(lines) == 0 {
+		return e, nil
+	}
+	return entry.Entry{Key: "ini/settings", Value: strings.Join(lines, "\n"), Strategy: entry.StrategyAppend}, nil
+}
+
+// parseGPPPrinters converts the Group Policy Preferences "Printers" items of the GPO in gpoDir to a printer
+// connections entry with key.
+// Only shared and TCP/IP printers are supported, others are skipped.
+func parseGPPPrinters(ctx context.Context, gpoDir string, classes []string, key string) (e entry.Entry, err error) {
+	var f *os.File
+	for _, class := range classes {
+		f, err = os.Open(filepath.Join(gpoDir, class, "Preferences", "Printers", "Printers.xml"))
+		if err == nil {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return e, nil
+	} else if err != nil {
+		return e, err
+	}
+	defer decorate.LogFuncOnErrorContext(ctx, f.Close)
+
+	items, err := gpp.ParsePrinters(f)
+	if err != nil {
+		return e, errors.New(gotext.Get("%s: %v", f.Name(), err))
+	}
+
+	// Fields of a connection are separated by commas and connections by new lines.
+	sanitize := strings.NewReplacer(",", " ", "\n", " ")
+	var lines []string
+	for _, item := range items {
+		if item.Disabled {
+			continue
+		}
+		if item.Action == gpp.ActionDelete {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences printer %q: delete action is not supported, skipping it", item.Name))
+			continue
+		}
+		uri, ok := item.URI()
+		name := item.QueueName()
+		if !ok || name == "" {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences printer %q: only shared and TCP/IP printers are supported, skipping it", item.Name))
+			continue
+		}
+		if strings.ContainsAny(uri, ",\n") {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences printer %q: printer address can't contain commas or new lines, skipping it", item.Name))
+			continue
+		}
+		l := fmt.Sprintf("name=%s, uri=%s", name, uri)
+		if v := strings.TrimSpace(sanitize.Replace(item.Location)); v != "" {
+			l += ", location=" + v
+		}
+		if v := strings.TrimSpace(sanitize.Replace(item.Comment)); v != "" {
+			l += ", description=" + v
+		}
+		if item.Default {
+			l += ", default=yes"
+		}
+		lines = append(lines, l)
+	}
+
+	if len(lines) == 0 {
+		return e, nil
+	}
+	return entry.Entry{Key: key, Value: strings.Join(lines, "\n"), Strategy: entry.StrategyAppend}, nil
+}
+
+// parseGPPShortcuts converts the Group Policy Preferences "Shortcuts" items of the GPO in gpoDir to a shortcuts entry.
+// Only URL and Linux file system targets on the desktop or in the start menu are supported, others are skipped.
+// Machine shortcuts are created in the applications menu, as there is no desktop shared by all users.
+func parseGPPShortcuts(ctx context.Context, gpoDir string, classes []string, isComputer bool) (e entry.Entry, err error) {
+	var f *os.File
+	for _, class := range classes {
+		f, err = os.Open(filepath.Join(gpoDir, class, "Preferences", "Shortcuts", "Shortcuts.xml"))
+		if err == nil {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return e, nil
+	} else if err != nil {
+		return e, err
+	}
+	defer decorate.LogFuncOnErrorContext(ctx, f.Close)
+
+	items, err := gpp.ParseShortcuts(f)
+	if err != nil {
+		return e, errors.New(gotext.Get("%s: %v", f.Name(), err))
+	}
+
+	// Fields of a shortcut are separated by commas and shortcuts by new lines.
+	sanitize := strings.NewReplacer(",", " ", "\n", " ")
+	var lines []string
+	for _, item := range items {
+		if item.Disabled {
+			continue
+		}
+		if item.Action == gpp.ActionDelete {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences shortcut %q: delete action is not supported, skipping it", item.Name))
+			continue
+		}
+		location, name, ok := item.Location()
+		if !ok {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences shortcut %q: only desktop, start menu and startup shortcuts are supported, skipping it", item.Name))
+			continue
+		}
+		if isComputer && location == gpp.LocationAutostart {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences shortcut %q: startup shortcuts are only supported for users, skipping it", item.Name))
+			continue
+		}
+		if isComputer && location == gpp.LocationDesktop {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences shortcut %q: desktop shortcuts of the machine are added to the applications menu", item.Name))
+			location = gpp.LocationMenu
+		}
+
+		var typ string
+		target := item.TargetPath
+		switch {
+		case item.TargetType == gpp.ShortcutURL:
+			typ = "link"
+		case item.TargetType == gpp.ShortcutFileSystem && strings.HasPrefix(target, "/"):
+			typ = "application"
+		case item.TargetType == gpp.ShortcutFileSystem && strings.HasPrefix(target, `\\`):
+			// Windows shares are opened with the file manager.
+			typ, target = "link", "smb:"+strings.ReplaceAll(target, `\`, "/")
+		default:
+			log.Warning(ctx, gotext.Get("Group Policy Preferences shortcut %q: only URL and Linux or network file system targets are supported, skipping it", item.Name))
+			continue
+		}
+		if strings.ContainsAny(target+item.Arguments+item.StartIn, ",\n") {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences shortcut %q: target, arguments and start directory can't contain commas or new lines, skipping it", item.Name))
+			continue
+		}
+
+		l := fmt.Sprintf("name=%s, target=%s, type=%s, location=%s", strings.TrimSpace(sanitize.Replace(name)), target, typ, location)
+		if v := strings.TrimSpace(item.Arguments); v != "" && typ == "application" {
+			l += ", arguments=" + v
+		}
+		if v := strings.TrimSpace(item.StartIn); strings.HasPrefix(v, "/") {
+			l += ", workdir=" + v
+		}
+		if icon, ok := gpp.AssetsPath(item.IconPath, consts.DistroID, "shortcuts"); ok && !strings.ContainsAny(icon, ",\n") {
+			l += ", iconfile=" + icon
+		} else if strings.HasPrefix(item.IconPath, "/") && !strings.ContainsAny(item.IconPath, ",\n") {
+			l += ", icon=" + item.IconPath
+		}
+		if v := strings.TrimSpace(sanitize.Replace(item.Comment)); v != "" {
+			l += ", comment=" + v
+		}
+		lines = append(lines, l)
+	}
+
+	if len(lines) == 0 {
+		return e, nil
+	}
+	key := "shortcuts/user-deploy"
+	if isComputer {
+		key = "shortcuts/deploy"
+	}
+	return entry.Entry{Key: key, Value: strings.Join(lines, "\n"), Strategy: entry.StrategyAppend}, nil
+}
+
+// parseGPPLocalUsersAndGroups converts the Group Policy Preferences "Local Users and Groups" items of the GPO in
+// gpoDir to local users and local groups entries.
+// Domain members, of the form DOMAIN\name, are converted to name@domain. Built-in Windows accounts are skipped.
+func (ad *AD) parseGPPLocalUsersAndGroups(ctx context.Context, gpoDir string, classes []string) (users, groups entry.Entry, err error) {
+	var f *os.File
+	for _, class := range classes {
+		f, err = os.Open(filepath.Join(gpoDir, class, "Preferences", "Groups", "Groups.xml"))
+		if err == nil {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return users, groups, nil
+	} else if err != nil {
+		return users, groups, err
+	}
+	defer decorate.LogFuncOnErrorContext(ctx, f.Close)
+
+	userItems, groupItems, err := gpp.ParseLocalUsersAndGroups(f)
+	if err != nil {
+		return users, groups, errors.New(gotext.Get("%s: %v", f.Name(), err))
+	}
+
+	// Fields of an account are separated by commas and accounts by new lines.
+	sanitize := strings.NewReplacer(",", " ", "\n", " ")
+	var userLines []string
+	for _, item := range userItems {
+		if item.Disabled {
+			continue
+		}
+		name := cmp.Or(item.UserName, item.Name)
+		if !isLocalAccountName(name) {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences local user %q: built-in Windows accounts and names with spaces, commas or semicolons are not supported, skipping it", item.Name))
+			continue
+		}
+		if item.Action == gpp.ActionDelete {
+			userLines = append(userLines, fmt.Sprintf("name=%s, action=delete", name))
+			continue
+		}
+		if item.HasPassword {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences local user %q: passwords are not supported, the password is not set", item.Name))
+		}
+		l := "name=" + name
+		if v := strings.TrimSpace(sanitize.Replace(item.FullName)); v != "" {
+			l += ", fullname=" + v
+		}
+		if item.AccountDisabled {
+			l += ", disabled=yes"
+		}
+		userLines = append(userLines, fmt.Sprintf("%s, action=%s", l, gpp.ApplyMode(item.Action)))
+	}
+
+	var groupLines []string
+	for _, item := range groupItems {
+		if item.Disabled {
+			continue
+		}
+		name := cmp.Or(item.GroupName, item.Name)
+		if !isLocalAccountName(name) {
+			log.Warning(ctx, gotext.Get("Group Policy Preferences local group %q: built-in Windows groups and names with spaces, commas or semicolons are not supported, skipping it", item.Name))
+			continue
+		}
+		if item.Action == gpp.ActionDelete {
+			groupLines = append(groupLines, fmt.Sprintf("name=%s, action=delete", name))
+			continue
+		}
+
+		var add, remove []string
+		for _, m := range item.Members {
+			member, ok := ad.gppMemberName(m.Name)
+			if !ok {
+				log.Warning(ctx, gotext.Get("Group Policy Preferences local group %q: member %q is not supported, skipping it", item.Name, m.Name))
+				continue
+			}
+			if m.Action == gpp.MemberRemove {
+				remove = append(remove, member)
+				continue
+			}
+			add = append(add, member)
+		}
+		l := "name=" + name
+		if len(add) > 0 {
+			l += ", add=" + strings.Join(add, ";")
+		}
+		if len(remove) > 0 {
+			l += ", remove=" + strings.Join(remove, ";")
+		}
+		if item.DeleteAllUsers {
+			l += ", removeall=yes"
+		}
+		groupLines = append(groupLines, fmt.Sprintf("%s, action=%s", l, gpp.ApplyMode(item.Action)))
+	}
+
+	if len(userLines) > 0 {
+		users = entry.Entry{Key: "localusers/users", Value: strings.Join(userLines, "\n"), Strategy: entry.StrategyAppend}
+	}
+	if len(groupLines) > 0 {
+		groups = entry.Entry{Key: "localusers/groups", Value: strings.Join(groupLines, "\n"), Strategy: entry.StrategyAppend}
+	}
+	return users, groups, nil
+}
+
+// isLocalAccountName returns true if name can be the name of a local account on the client.
+func isLocalAccountName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\n,;\\")
+}
+
+// gppMemberName converts the member name of a Group Policy Preferences local group to the name of the account
+// on the client: domain accounts, of the form DOMAIN\name, are converted to name@domain, and accounts of the
+// machine, of the form HOSTNAME\name, to name.
+// It returns false for built-in Windows accounts and names which can't be listed as members.
+func (ad *AD) gppMemberName(name string) (string, bool) {
+	if strings.ContainsAny(name, ",;\n") {
+		return "", false
+	}
+	domain, account, found := strings.Cut(name, `\`)
+	if !found {
+		return name, isLocalAccountName(name)
+	}
+	switch strings.ToUpper(domain) {
+	case "", "BUILTIN", "NT AUTHORITY", "NT SERVICE":
+		return "", false
+	}
+	if account == "" || strings.Contains(account, `\`) {
+		return "", false
+	}
+	// Local accounts of the machine.
+	if strings.EqualFold(domain, ad.hostname) {
+		return account, isLocalAccountName(account)
+	}
+	return strings.ToLower(fmt.Sprintf("%s@%s", account, ad.configBackend.Domain())), true
+}
+
 // GetInfo returns all information from the selected backend: static and dynamic part.
 func (ad *AD) GetInfo(ctx context.Context) (msg string) {
 	// static part
@@ -615,6 +1261,8 @@ func (ad *AD) GetInfo(ctx context.Context) (msg string) {
 		online = fmt.Sprint(gotext.Get("**Can't check if we have an active connection**\n"))
 	} else if !isOnline {
 		online = fmt.Sprint(gotext.Get("**Offline mode** using cached policies\n"))
+	} else if reason, until, suspected := ad.checkCaptivePortal(); suspected {
+		online = fmt.Sprint(gotext.Get("**Captive portal suspected** (%s), using cached policies until %s\n", reason, until.Format(time.TimeOnly)))
 	}
 	domain := ad.configBackend.Domain()
 	server, err := ad.configBackend.ServerFQDN(ctx)
@@ -622,7 +1270,11 @@ func (ad *AD) GetInfo(ctx context.Context) (msg string) {
 		server = "Unknown"
 	}
 
-	return gotext.Get("%s\n%sDomain: %s\nServer FQDN: %s", config, online, domain, server)
+	msg = gotext.Get("%s\n%sDomain: %s\nServer FQDN: %s", config, online, domain, server)
+	if negativeCache := ad.negativeCacheInfo(); negativeCache != "" {
+		msg = fmt.Sprintf("%s\n%s", msg, negativeCache)
+	}
+	return msg
 }
 
 // NormalizeTargetName transforms the specified target to values adsys knows.
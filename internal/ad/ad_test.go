@@ -5,12 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -33,16 +37,22 @@ func TestNew(t *testing.T) {
 		cacheDirRO             bool
 		runDirRO               bool
 		backendServerFQDNError error
+		bandwidthLimit         int
+		offPeakWindow          string
 
 		wantErr bool
 	}{
 		"create KRB5 and Sysvol cache directory":                {},
 		"no active server in backend does not fail ad creation": {backendServerFQDNError: backends.ErrNoActiveServer},
+		"with bandwidth limit and off-peak window":              {bandwidthLimit: 512 * 1024, offPeakWindow: "22:00-06:00"},
 
 		"failed to create KRB5 cache directory":      {runDirRO: true, wantErr: true},
 		"failed to create Sysvol cache directory":    {cacheDirRO: true, wantErr: true},
 		"failed to create Policies cache directory":  {sysvolCacheDirExists: true, cacheDirRO: true, wantErr: true},
 		"error on backend ServerFQDN random failure": {backendServerFQDNError: errors.New("Some failure on ServerFQDN"), wantErr: true},
+		"error on negative bandwidth limit":          {bandwidthLimit: -1, wantErr: true},
+		"error on invalid off-peak window":           {offPeakWindow: "22h-6h", wantErr: true},
+		"error on empty off-peak window":             {offPeakWindow: "06:00-06:00", wantErr: true},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -62,7 +72,8 @@ func TestNew(t *testing.T) {
 
 			adc, err := ad.New(context.Background(), mock.Backend{ErrServerFQDN: tc.backendServerFQDNError}, hostname,
 				ad.WithRunDir(runDir),
-				ad.WithCacheDir(cacheDir))
+				ad.WithCacheDir(cacheDir),
+				ad.WithSysvolBandwidthLimit(tc.bandwidthLimit, tc.offPeakWindow))
 			if tc.wantErr {
 				require.NotNil(t, err, "AD creation should have failed")
 				return
@@ -115,6 +126,10 @@ func TestGetPolicies(t *testing.T) {
 		versionID   string
 		gpoListArgs []string
 
+		gpoListFailsOnce bool
+		gpoListRetries   int
+		gpoListTimeout   time.Duration
+
 		turnKrb5CCCacheRO bool
 		existing          map[string]string
 
@@ -260,6 +275,42 @@ func TestGetPolicies(t *testing.T) {
 
 		// No override option for this release
 
+		// Lock cases
+		"Values are locked unless unlocked by the policy": {
+			gpoListArgs: []string{"gpoonly.com", "bob:dconf-lock"},
+			want: policies.Policies{GPOs: []policies.GPO{{ID: "dconf-lock", Name: "dconf-lock-name", Rules: map[string][]entry.Entry{
+				"dconf": {
+					{Key: "A", Value: "AValue", Unlocked: true},
+					{Key: "B", Value: "BValue"},
+					{Key: "C", Value: "CValue"},
+				}}}},
+			},
+		},
+
+		// Audit mode cases
+		"Values are enforced unless audited by the policy": {
+			gpoListArgs: []string{"gpoonly.com", "bob:dconf-audit"},
+			want: policies.Policies{GPOs: []policies.GPO{{ID: "dconf-audit", Name: "dconf-audit-name", Rules: map[string][]entry.Entry{
+				"dconf": {
+					{Key: "A", Value: "AValue", Mode: entry.ModeAudit},
+					{Key: "B", Value: "BValue"},
+					{Key: "C", Value: "CValue"},
+				}}}},
+			},
+		},
+
+		// List mode cases
+		"Lists replace the default value unless combined by the policy": {
+			gpoListArgs: []string{"gpoonly.com", "bob:dconf-list-mode"},
+			want: policies.Policies{GPOs: []policies.GPO{{ID: "dconf-list-mode", Name: "dconf-list-mode-name", Rules: map[string][]entry.Entry{
+				"dconf": {
+					{Key: "A", Value: "AValue", ListMode: entry.ListModeMerge},
+					{Key: "B", Value: "BValue", ListMode: entry.ListModeAppend},
+					{Key: "C", Value: "CValue"},
+				}}}},
+			},
+		},
+
 		// Multi domain cases
 		"Multiple domains, same GPO": {
 			gpoListArgs: []string{"gpoonly.com", "bob:multiple-domains"},
@@ -536,6 +587,24 @@ func TestGetPolicies(t *testing.T) {
 			gpoListArgs: []string{"gpoonly.com", "bob:empty-value"},
 			wantErr:     true,
 		},
+
+		// GPO list timeout and retries
+		"GPO list is retried on failure": {
+			gpoListArgs:      []string{"gpoonly.com", "bob:standard"},
+			gpoListFailsOnce: true,
+			gpoListRetries:   1,
+			want:             policies.Policies{GPOs: []policies.GPO{standardUserGPO("standard")}},
+		},
+		"Error on GPO list failing more than retries": {
+			gpoListArgs:      []string{"gpoonly.com", "bob:standard"},
+			gpoListFailsOnce: true,
+			wantErr:          true,
+		},
+		"Error on GPO list timeout": {
+			gpoListArgs:    []string{"-Slow-", "gpoonly.com", "bob:standard"},
+			gpoListTimeout: 100 * time.Millisecond,
+			wantErr:        true,
+		},
 	}
 
 	for name, tc := range tests {
@@ -581,11 +650,21 @@ func TestGetPolicies(t *testing.T) {
 				}
 			}
 
+			if tc.gpoListFailsOnce {
+				tc.gpoListArgs = append([]string{"-FailOnce-" + filepath.Join(t.TempDir(), "failed")}, tc.gpoListArgs...)
+			}
+
 			cachedir, rundir := t.TempDir(), t.TempDir()
-			adc, err := ad.New(context.Background(), tc.backend, hostname,
+			opts := []ad.Option{
 				ad.WithCacheDir(cachedir), ad.WithRunDir(rundir), ad.WithoutKerberos(),
 				ad.WithGPOListCmd(mockGPOListCmd(t, tc.gpoListArgs...)),
-				ad.WithVersionID(tc.versionID))
+				ad.WithVersionID(tc.versionID),
+				ad.WithGpoListRetries(tc.gpoListRetries),
+			}
+			if tc.gpoListTimeout != 0 {
+				opts = append(opts, ad.WithGpoListTimeout(tc.gpoListTimeout))
+			}
+			adc, err := ad.New(context.Background(), tc.backend, hostname, opts...)
 			require.NoError(t, err, "Setup: cannot create ad object")
 
 			if tc.turnKrb5CCCacheRO {
@@ -921,6 +1000,262 @@ func TestGetPoliciesWorkflows(t *testing.T) {
 	}
 }
 
+func TestGetPoliciesNegativeCache(t *testing.T) {
+	t.Parallel() // libsmbclient overrides SIGCHILD, but we have one global lock
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err, "Setup: failed to get hostname")
+
+	type step struct {
+		advance time.Duration
+		gpoList string // "none", "fail" or "gpos"
+
+		want string // "empty", "error" or "gpos"
+	}
+
+	tests := map[string]struct {
+		isComputer bool
+		disableTTL bool
+		maxTTL     time.Duration
+		steps      []step
+		wantInInfo bool
+	}{
+		"User without applicable GPOs is not looked up again before expiration": {
+			steps:      []step{{gpoList: "none", want: "empty"}, {gpoList: "gpos", want: "empty"}},
+			wantInInfo: true,
+		},
+		"User without applicable GPOs is looked up again after expiration": {
+			steps: []step{{gpoList: "none", want: "empty"}, {advance: 30 * time.Second, gpoList: "gpos", want: "gpos"}},
+		},
+		"Failed lookup is not retried before expiration": {
+			steps:      []step{{gpoList: "fail", want: "error"}, {advance: 29 * time.Second, gpoList: "gpos", want: "error"}},
+			wantInInfo: true,
+		},
+		"Failed lookup is retried after expiration": {
+			steps: []step{{gpoList: "fail", want: "error"}, {advance: 30 * time.Second, gpoList: "gpos", want: "gpos"}},
+		},
+		"Backoff doubles on consecutive negative lookups": {
+			steps: []step{
+				{gpoList: "fail", want: "error"},
+				{advance: 30 * time.Second, gpoList: "none", want: "empty"},
+				{advance: 30 * time.Second, gpoList: "gpos", want: "empty"},
+				{advance: 30 * time.Second, gpoList: "gpos", want: "gpos"},
+			},
+		},
+		"Backoff is capped": {
+			maxTTL: 45 * time.Second,
+			steps: []step{
+				{gpoList: "fail", want: "error"},
+				{advance: 30 * time.Second, gpoList: "fail", want: "error"},
+				{advance: 45 * time.Second, gpoList: "gpos", want: "gpos"},
+			},
+		},
+		"Successful lookup resets the backoff": {
+			steps: []step{
+				{gpoList: "fail", want: "error"},
+				{advance: 30 * time.Second, gpoList: "gpos", want: "gpos"},
+				{gpoList: "none", want: "empty"},
+				{advance: 30 * time.Second, gpoList: "gpos", want: "gpos"},
+			},
+		},
+		"Computer lookups are not cached": {
+			isComputer: true,
+			steps:      []step{{gpoList: "fail", want: "error"}, {gpoList: "gpos", want: "gpos"}},
+		},
+		"Disabled negative cache always looks up users": {
+			disableTTL: true,
+			steps:      []step{{gpoList: "none", want: "empty"}, {gpoList: "fail", want: "error"}, {gpoList: "gpos", want: "gpos"}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel() // libsmbclient overrides SIGCHILD, but we have one global lock
+
+			objectName, objectClass := "bob@ASSETSANDGPO.COM", ad.UserObject
+			krb5CCName := setKrb5CC(t, "bob")
+			if tc.isComputer {
+				objectName, objectClass, krb5CCName = hostname, ad.ComputerObject, ""
+			}
+
+			gpoListCmds := map[string][]string{
+				"none": mockGPOListCmd(t, "assetsandgpo.com", "sponge:standard"),
+				"fail": mockGPOListCmd(t, "-Exit2-"),
+				"gpos": mockGPOListCmd(t, "assetsandgpo.com", fmt.Sprintf("bob:standard::%s:standard", hostname)),
+			}
+
+			backend := mock.Backend{
+				Dom:                "assetsandgpo.com",
+				ServURL:            "UNUSED:1636",
+				HostKrb5CCNamePath: filepath.Join(t.TempDir(), "host_ccache"),
+				Online:             true,
+			}
+			testutils.CreatePath(t, backend.HostKrb5CCNamePath)
+
+			now := time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC)
+			opts := []ad.Option{
+				ad.WithCacheDir(t.TempDir()), ad.WithRunDir(t.TempDir()), ad.WithoutKerberos(),
+				ad.WithGPOListCmd(gpoListCmds[tc.steps[0].gpoList]),
+				ad.WithNow(func() time.Time { return now }),
+			}
+			if tc.disableTTL {
+				opts = append(opts, ad.WithNegativeCacheTTL(0, 0))
+			} else if tc.maxTTL != 0 {
+				opts = append(opts, ad.WithNegativeCacheTTL(30*time.Second, tc.maxTTL))
+			}
+			adc, err := ad.New(context.Background(), backend, hostname, opts...)
+			require.NoError(t, err, "Setup: cannot create ad object")
+
+			for i, s := range tc.steps {
+				now = now.Add(s.advance)
+				adc.SetGPOListCmd(gpoListCmds[s.gpoList])
+
+				pols, err := adc.GetPolicies(context.Background(), objectName, objectClass, krb5CCName)
+				if s.want == "error" {
+					require.Error(t, err, "GetPolicies should have failed at step %d", i)
+					continue
+				}
+				require.NoError(t, err, "GetPolicies should not have failed at step %d", i)
+				if s.want == "empty" {
+					require.Empty(t, pols.GPOs, "GetPolicies should return no GPO at step %d", i)
+					continue
+				}
+				require.NotEmpty(t, pols.GPOs, "GetPolicies should return GPOs at step %d", i)
+			}
+
+			info := adc.GetInfo(context.Background())
+			if tc.wantInInfo {
+				require.Contains(t, info, objectName, "GetInfo should list the users in the negative cache")
+				return
+			}
+			require.NotContains(t, info, objectName, "GetInfo should only list the users in the negative cache")
+		})
+	}
+}
+
+func TestGetPoliciesCaptivePortal(t *testing.T) {
+	t.Parallel() // libsmbclient overrides SIGCHILD, but we have one global lock
+
+	tests := map[string]struct {
+		hijackedDNS         bool
+		portalStatus        int
+		noConnectivityCheck bool
+		noCache             bool
+		noDetection         bool
+
+		wantCached bool
+		wantErr    bool
+	}{
+		"Redirected connectivity check uses cached policies":  {portalStatus: http.StatusFound, wantCached: true},
+		"Web page on connectivity check uses cached policies": {portalStatus: http.StatusOK, wantCached: true},
+		"Hijacked DNS uses cached policies":                   {hijackedDNS: true, portalStatus: http.StatusNoContent, wantCached: true},
+		"Hijacked DNS is detected without connectivity check": {hijackedDNS: true, noConnectivityCheck: true, wantCached: true},
+
+		"Error on captive portal without cache":                     {portalStatus: http.StatusFound, noCache: true, wantErr: true},
+		"Error on successful connectivity check":                    {portalStatus: http.StatusNoContent, wantErr: true},
+		"Error on connectivity check refused by a proxy":            {portalStatus: http.StatusForbidden, wantErr: true},
+		"Error on unreachable connectivity check":                   {wantErr: true},
+		"Error on captive portal when detection is disabled":        {hijackedDNS: true, portalStatus: http.StatusFound, noDetection: true, wantErr: true},
+		"Error on unreachable connectivity check without DNS check": {noConnectivityCheck: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel() // libsmbclient overrides SIGCHILD, but we have one global lock
+
+			hostname, err := os.Hostname()
+			require.NoError(t, err, "Setup: failed to get hostname")
+
+			objectName := "bob@ASSETSANDGPO.COM"
+			krb5CCName := setKrb5CC(t, "bob")
+
+			portalStatus, hijackedDNS := tc.portalStatus, tc.hijackedDNS
+			portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if portalStatus == http.StatusFound {
+					http.Redirect(w, r, "http://portal.hotel.example/login", portalStatus)
+					return
+				}
+				w.WriteHeader(portalStatus)
+				if portalStatus == http.StatusOK {
+					fmt.Fprint(w, "<html>Welcome to the hotel Wi-Fi</html>")
+				}
+			}))
+			defer portal.Close()
+			connectivityCheckURL := portal.URL
+			if tc.portalStatus == 0 {
+				// Nothing listens on this address anymore.
+				portal.Close()
+			}
+			if tc.noConnectivityCheck {
+				connectivityCheckURL = ""
+			}
+
+			gpoListCmds := map[string][]string{
+				"fail": mockGPOListCmd(t, "-Exit2-"),
+				"gpos": mockGPOListCmd(t, "assetsandgpo.com", fmt.Sprintf("bob:standard::%s:standard", hostname)),
+			}
+
+			backend := mock.Backend{
+				Dom:                "assetsandgpo.com",
+				ServURL:            "UNUSED:1636",
+				HostKrb5CCNamePath: filepath.Join(t.TempDir(), "host_ccache"),
+				Online:             true,
+			}
+			testutils.CreatePath(t, backend.HostKrb5CCNamePath)
+
+			now := time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC)
+			opts := []ad.Option{
+				ad.WithCacheDir(t.TempDir()), ad.WithRunDir(t.TempDir()), ad.WithoutKerberos(),
+				ad.WithGPOListCmd(gpoListCmds["gpos"]),
+				ad.WithNow(func() time.Time { return now }),
+				ad.WithNegativeCacheTTL(0, 0),
+				ad.WithLookupHost(func(_ context.Context, host string) ([]string, error) {
+					if hijackedDNS {
+						return []string{"10.0.0.1"}, nil
+					}
+					return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+				}),
+			}
+			if !tc.noDetection {
+				opts = append(opts, ad.WithCaptivePortalDetection(connectivityCheckURL))
+			}
+			adc, err := ad.New(context.Background(), backend, hostname, opts...)
+			require.NoError(t, err, "Setup: cannot create ad object")
+
+			initialPolicies, err := adc.GetPolicies(context.Background(), objectName, ad.UserObject, krb5CCName)
+			require.NoError(t, err, "Setup: initial GetPolicies failed")
+			if !tc.noCache {
+				err = initialPolicies.Save(filepath.Join(adc.PoliciesCacheDir(), objectName))
+				require.NoError(t, err, "Setup: cannot create policy cache file")
+			}
+
+			// We are now behind the captive portal.
+			adc.SetGPOListCmd(gpoListCmds["fail"])
+			pols, err := adc.GetPolicies(context.Background(), objectName, ad.UserObject, krb5CCName)
+			if tc.wantErr {
+				require.Error(t, err, "GetPolicies should have failed")
+				require.NotContains(t, adc.GetInfo(context.Background()), "Captive portal suspected", "GetInfo should not report a captive portal")
+				return
+			}
+			require.NoError(t, err, "GetPolicies should use the cached policies")
+			require.Equal(t, initialPolicies.GPOs, pols.GPOs, "GetPolicies should return the cached GPOs")
+			require.Contains(t, adc.GetInfo(context.Background()), "Captive portal suspected", "GetInfo should report the captive portal")
+
+			// AD is not contacted again, nor the network checked, before the backoff expires.
+			portalStatus, hijackedDNS = http.StatusNoContent, false
+			now = now.Add(59 * time.Second)
+			_, err = adc.GetPolicies(context.Background(), objectName, ad.UserObject, krb5CCName)
+			require.NoError(t, err, "GetPolicies should defer the AD lookup before the backoff expires")
+
+			// AD is contacted again once the backoff expires.
+			now = now.Add(time.Second)
+			_, err = adc.GetPolicies(context.Background(), objectName, ad.UserObject, krb5CCName)
+			require.Error(t, err, "GetPolicies should contact AD once the backoff expires")
+			require.NotContains(t, adc.GetInfo(context.Background()), "Captive portal suspected", "GetInfo should not report a captive portal anymore")
+		})
+	}
+}
+
 func TestGetPoliciesConcurrently(t *testing.T) {
 	t.Parallel() // libsmbclient overrides SIGCHILD, but we have one global lock
 
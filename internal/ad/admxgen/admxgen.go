@@ -44,6 +44,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"text/template"
@@ -60,6 +61,12 @@ import (
 
 const dconfPolicyType = "dconf"
 
+// gdmPolicyType is the policy type of the login screen, which is available without Ubuntu Pro like dconf.
+const gdmPolicyType = "gdm"
+
+// enrollmentPolicyType is the policy type enrolling the client to Ubuntu Pro, which can't require it.
+const enrollmentPolicyType = "enrollment"
+
 // expandedCategories generation
 
 type expandedCategory struct {
@@ -88,6 +95,13 @@ type mergedPolicy struct {
 	MetaDisabled string
 	// Single class convenience (all ExpandedPolicy should match)
 	Class string
+	// Flavors and desktop environments the policy is restricted to (all ExpandedPolicy should match)
+	Flavors  []string `yaml:",omitempty"`
+	Desktops []string `yaml:",omitempty"`
+	// Lockable is true if the value can be set as a default only, which users can override, instead of being locked
+	Lockable bool `yaml:",omitempty"`
+	// ListMergeable is true if the value is a list which can be merged with or appended to the default value
+	ListMergeable bool `yaml:",omitempty"`
 
 	ReleasesElements map[string]common.ExpandedPolicy
 }
@@ -149,7 +163,7 @@ func (g generator) generateExpandedCategories(categories []category, policies []
 		// supportedReleases is ordered with latest being newest.
 
 		var supportedOn, class, highestRelease, defaultString, typePol string
-		var defaults []string
+		var flavors, desktops, defaults []string
 		var differentDefaultsBetweenReleases bool
 		metasEnabled := make(map[string]map[string]string)
 		metasDisabled := make(map[string]map[string]string)
@@ -179,9 +193,23 @@ func (g generator) generateExpandedCategories(categories []category, policies []
 				if typePol != p.Type {
 					return nil, fmt.Errorf("%s is of different policy type between releases. Got %q and %q", key, typePol, p.Type)
 				}
+				if !slices.Equal(flavors, p.Flavors) {
+					return nil, fmt.Errorf("%s is targeting different flavors between releases. Got %q and %q", key, flavors, p.Flavors)
+				}
+				if !slices.Equal(desktops, p.Desktops) {
+					return nil, fmt.Errorf("%s is targeting different desktops between releases. Got %q and %q", key, desktops, p.Desktops)
+				}
 			}
 			class = p.Class
 			typePol = p.Type
+			flavors = p.Flavors
+			desktops = p.Desktops
+
+			for _, f := range p.Flavors {
+				if _, ok := adcommon.Flavors[f]; !ok {
+					return nil, fmt.Errorf("%s is targeting unknown flavor %q", key, f)
+				}
+			}
 
 			// Handle metas
 
@@ -200,6 +228,11 @@ func (g generator) generateExpandedCategories(categories []category, policies []
 			if metasDisabled[release] == nil {
 				metasDisabled[release] = make(map[string]string)
 			}
+			// the client filters out the entries targeting other flavors or desktop environments
+			if len(p.Flavors) > 0 || len(p.Desktops) > 0 {
+				metasEnabled[release] = withTargets(metasEnabled[release], p.Flavors, p.Desktops)
+				metasDisabled[release] = withTargets(metasDisabled[release], p.Flavors, p.Desktops)
+			}
 
 			if supportedOn == "" {
 				if release != "all" {
@@ -276,10 +309,13 @@ func (g generator) generateExpandedCategories(categories []category, policies []
 		if supportedOn != "" {
 			explainText = fmt.Sprintf("%s\n\n%s.", explainText, supportedOn)
 		}
+		if len(flavors) > 0 || len(desktops) > 0 {
+			explainText = fmt.Sprintf("%s\n\n%s", explainText, gotext.Get("This policy is only applied on %s.", g.targetsDisplayName(flavors, desktops)))
+		}
 
 		// Mention if any of the policies require Ubuntu Pro
-		// Currently this only applies to non-dconf policies
-		if typePol != dconfPolicyType {
+		// Currently this only applies to non-dconf policies, except the login screen and the ones enrolling to Ubuntu Pro
+		if typePol != dconfPolicyType && typePol != gdmPolicyType && typePol != enrollmentPolicyType {
 			explainText = fmt.Sprintf("%s\n\n%s", explainText, gotext.Get("An Ubuntu Pro subscription on the client is required to apply this policy."))
 		}
 
@@ -299,9 +335,21 @@ func (g generator) generateExpandedCategories(categories []category, policies []
 			return nil, errors.New(gotext.Get("failed to marshal disabled meta data"))
 		}
 
+		// Only dconf lists of strings or integers can be combined with the default value on the client.
+		listMergeable := typePol == dconfPolicyType
+		for _, m := range metasEnabled {
+			if m["meta"] != "as" && m["meta"] != "ai" {
+				listMergeable = false
+			}
+		}
+
 		mergedPolicies[key] = mergedPolicy{
 			Key:              fmt.Sprintf(`%s\%s\%s`, keyPrefix, typePol, strings.ReplaceAll(strings.TrimPrefix(key, "/"), "/", `\`)),
 			Class:            class,
+			Flavors:          flavors,
+			Desktops:         desktops,
+			Lockable:         typePol == dconfPolicyType,
+			ListMergeable:    listMergeable,
 			MetaEnabled:      string(metaEnabled),
 			MetaDisabled:     string(metaDisabled),
 			ExplainText:      explainText,
@@ -392,8 +440,42 @@ func (g generator) generateExpandedCategories(categories []category, policies []
 	return expandedCategories, nil
 }
 
+// withTargets returns a copy of metas with the flavors and desktop environments the policy is restricted to.
+func withTargets(metas map[string]string, flavors, desktops []string) map[string]string {
+	r := make(map[string]string)
+	for k, v := range metas {
+		r[k] = v
+	}
+	if len(flavors) > 0 {
+		r["flavors"] = strings.Join(flavors, ",")
+	}
+	if len(desktops) > 0 {
+		r["desktops"] = strings.Join(desktops, ",")
+	}
+	return r
+}
+
+// targetsDisplayName returns the human readable list of flavors and desktop environments a policy is restricted to.
+func (g generator) targetsDisplayName(flavors, desktops []string) string {
+	var names []string
+	for _, f := range flavors {
+		names = append(names, adcommon.Flavors[f].DisplayName)
+	}
+	target := strings.Join(names, ", ")
+	if target == "" {
+		target = g.distroID
+	}
+	if len(desktops) > 0 {
+		target = gotext.Get("%s with the %s desktop", target, strings.Join(desktops, " or "))
+	}
+	return target
+}
+
 // ADMX/ADML Generation
 
+// defaultSupportedOn is the supportedOn reference of the policies without any flavor or desktop restriction.
+const defaultSupportedOn = "Ubuntu"
+
 type categoryForADMX struct {
 	DisplayName string
 	Parent      string
@@ -402,6 +484,12 @@ type categoryForADMX struct {
 type policyForADMX struct {
 	mergedPolicy
 	ParentCategory string
+	SupportedOn    string
+}
+
+type supportedOnForADMX struct {
+	Name        string
+	DisplayName string
 }
 
 // HasOptions returns if any policy element has an element type, and so, we need to show an option.
@@ -469,11 +557,25 @@ func (g generator) expandedCategoriesToADMX(expandedCategories []expandedCategor
 		inputPolicies = append(inputPolicies, pol...)
 	}
 
+	// Define the flavors and desktop environments the policies are restricted to
+	var inputSupportedOn []supportedOnForADMX
+	for _, p := range inputPolicies {
+		if p.SupportedOn == defaultSupportedOn || slices.ContainsFunc(inputSupportedOn, func(s supportedOnForADMX) bool { return s.Name == p.SupportedOn }) {
+			continue
+		}
+		inputSupportedOn = append(inputSupportedOn, supportedOnForADMX{
+			Name:        p.SupportedOn,
+			DisplayName: g.targetsDisplayName(p.Flavors, p.Desktops),
+		})
+	}
+	sort.Slice(inputSupportedOn, func(i, j int) bool { return inputSupportedOn[i].Name < inputSupportedOn[j].Name })
+
 	input := struct {
-		DistroID   string
-		Categories []categoryForADMX
-		Policies   []policyForADMX
-	}{g.distroID, inputCategories, inputPolicies}
+		DistroID    string
+		Categories  []categoryForADMX
+		Policies    []policyForADMX
+		SupportedOn []supportedOnForADMX
+	}{g.distroID, inputCategories, inputPolicies, inputSupportedOn}
 
 	if err := os.MkdirAll(dest, 0750); err != nil {
 		return errors.New(gotext.Get("can't create destination directory for AD policies: %v", err))
@@ -639,9 +741,18 @@ func (g generator) collectCategoriesPolicies(category expandedCategory, parent s
 	var policies []policyForADMX
 	// Collect now directly attached policies
 	for _, p := range category.Policies {
+		supportedOn := defaultSupportedOn
+		if len(p.Flavors) > 0 || len(p.Desktops) > 0 {
+			ids := append([]string{"SupportedOn"}, p.Flavors...)
+			if len(p.Desktops) > 0 {
+				ids = append(append(ids, "With"), p.Desktops...)
+			}
+			supportedOn = g.toID("", ids...)
+		}
 		policies = append(policies, policyForADMX{
 			mergedPolicy:   p,
 			ParentCategory: catID,
+			SupportedOn:    supportedOn,
 		})
 	}
 
@@ -54,6 +54,10 @@ type ExpandedPolicy struct {
 	// decimal
 	RangeValues DecimalRange `yaml:",omitempty"`
 
+	// optional restriction to some Ubuntu flavors (kubuntu, xubuntu…) or desktop environments (KDE, XFCE…)
+	Flavors  []string `yaml:",omitempty"`
+	Desktops []string `yaml:",omitempty"`
+
 	Release string `yaml:",omitempty"`
 	Type    string `yaml:",omitempty"` // dconf, install…
 }
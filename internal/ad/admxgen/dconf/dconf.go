@@ -129,7 +129,7 @@ func inflateToExpandedPolicies(policies []Policy, release, currentSessions strin
 			Class:       class,
 			Release:     release,
 			Default:     defaultVal,
-			Note:        gotext.Get(`default system value is used for "Not Configured" and enforced if "Disabled".`),
+			Note:        gotext.Get(`default system value is used for "Not Configured" and enforced if "Disabled". If "Enabled" with the value unlocked, the value is only a default that users can change.`),
 			Type:        "dconf",
 			RangeValues: s.RangeValues,
 			Choices:     s.Choices,
@@ -49,8 +49,12 @@ func TestGenerateExpandedCategories(t *testing.T) {
 		"range":                   {},
 		"choices":                 {},
 
-		"default policy class is capitalized": {},
-		"requires ubuntu pro":                 {},
+		"default policy class is capitalized":      {},
+		"requires ubuntu pro":                      {},
+		"enrollment does not require ubuntu pro":   {},
+		"login screen does not require ubuntu pro": {},
+		"targeting flavors and desktops":           {},
+		"list of strings":                          {},
 
 		// Optional content and options varies
 		"different element type": {},
@@ -73,6 +77,8 @@ func TestGenerateExpandedCategories(t *testing.T) {
 		"error on unexisting policy referenced":                                      {allowMissingKeys: false, wantErr: true},
 		"error on different policy type":                                             {wantErr: true},
 		"error on different class":                                                   {wantErr: true},
+		"error on different flavors":                                                 {wantErr: true},
+		"error on unknown flavor":                                                    {wantErr: true},
 		"error on missing release":                                                   {wantErr: true},
 		"error on nested category":                                                   {wantErr: true},
 		"error on invalid default policy class":                                      {wantErr: true},
@@ -159,6 +165,8 @@ func TestExpandedCategoriesToADMX(t *testing.T) {
 		"no meta disabled": {},
 		"no meta at all":   {},
 
+		"targeting flavors and desktops": {},
+
 		// Error Cases
 		"error on destination creation": {destIsFile: true, wantErr: true},
 	}
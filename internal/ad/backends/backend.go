@@ -27,6 +27,21 @@ type Backend interface {
 	Config() string
 }
 
+// GPOEvaluator is implemented by the backends evaluating the GPOs of the machine on their own, like SSSD for its
+// GPO based access control.
+type GPOEvaluator interface {
+	// EvaluatedGPOs returns the GPOs the backend last evaluated for the machine.
+	EvaluatedGPOs(context.Context) ([]EvaluatedGPO, error)
+}
+
+// EvaluatedGPO is a GPO evaluated by the backend.
+type EvaluatedGPO struct {
+	// ID is the GUID of the GPO, like {31B2F340-016D-11D2-945F-00C04FB984F9}.
+	ID string
+	// Version is the version of the GPO the backend evaluated.
+	Version int
+}
+
 var (
 	// ErrNoActiveServer is an error receive when there is no active server and no static configuration
 	// This is received in ServerFQDN.
@@ -0,0 +1,41 @@
+package keytab
+
+import (
+	"context"
+	"net"
+)
+
+// WithKinitCmd specifies a personalized kinit command for the backend to use.
+func WithKinitCmd(cmd []string) Option {
+	return func(o *options) {
+		o.kinitCmd = cmd
+	}
+}
+
+// WithKlistCmd specifies a personalized klist command for the backend to use.
+func WithKlistCmd(cmd []string) Option {
+	return func(o *options) {
+		o.klistCmd = cmd
+	}
+}
+
+// WithKrb5CCName specifies a personalized path for the machine ticket.
+func WithKrb5CCName(p string) Option {
+	return func(o *options) {
+		o.krb5CCName = p
+	}
+}
+
+// WithLDAPPort specifies a personalized LDAP port to check if the domain controller is online.
+func WithLDAPPort(port string) Option {
+	return func(o *options) {
+		o.ldapPort = port
+	}
+}
+
+// WithLookupSRV specifies a personalized DNS SRV lookup function.
+func WithLookupSRV(f func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)) Option {
+	return func(o *options) {
+		o.lookupSRV = f
+	}
+}
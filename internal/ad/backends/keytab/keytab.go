@@ -0,0 +1,228 @@
+// Package keytab is the minimal backend refreshing the machine policies with only the machine keytab.
+//
+// It doesn't rely on sssd nor winbind, for servers which don't need AD user logins but still apply
+// the machine policies, like the certificates or the sudo rules. The machine ticket is requested with
+// kinit from the keytab, and the domain controller is looked up in DNS, unless configured.
+package keytab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/ad/backends"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/decorate"
+)
+
+// onlineCheckTimeout is the maximum time to wait for the domain controller to accept a connection.
+const onlineCheckTimeout = 5 * time.Second
+
+// machinePrincipalRe matches the machine principal of the keytab, of the form HOSTNAME$@REALM.
+var machinePrincipalRe = regexp.MustCompile(`^[^/@\s]+\$@\S+$`)
+
+// Keytab is the backend object with domain and DC information.
+type Keytab struct {
+	domain           string
+	staticServerFQDN string
+	principal        string
+	krb5CCName       string
+
+	kinitCmd  []string
+	ldapPort  string
+	lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
+	config Config
+}
+
+// Config for keytab backend.
+type Config struct {
+	Keytab    string `mapstructure:"keytab"`    // machine keytab, /etc/krb5.keytab by default
+	Principal string `mapstructure:"principal"` // bypass the machine principal detection from the keytab
+	ADDomain  string `mapstructure:"ad_domain"` // bypass the domain detection from the principal realm
+	ADServer  string `mapstructure:"ad_server"` // bypass the DNS lookup and use this server
+}
+
+// Option represents an optional function to change the keytab backend.
+type Option func(*options)
+
+type options struct {
+	kinitCmd   []string
+	klistCmd   []string
+	krb5CCName string
+	ldapPort   string
+	lookupSRV  func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// New returns a keytab backend loaded from Config.
+func New(ctx context.Context, c Config, opts ...Option) (k Keytab, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't get domain configuration from %+v", c))
+
+	// defaults
+	args := options{
+		kinitCmd:   []string{"kinit"},
+		klistCmd:   []string{"klist"},
+		krb5CCName: consts.DefaultKeytabKrb5CCName,
+		ldapPort:   "389",
+		lookupSRV:  net.DefaultResolver.LookupSRV,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	log.Debug(ctx, "Loading keytab configuration for AD backend")
+
+	if c.Keytab == "" {
+		c.Keytab = consts.DefaultKeytab
+	}
+
+	principal := c.Principal
+	if principal == "" {
+		if principal, err = machinePrincipal(ctx, args.klistCmd, c.Keytab); err != nil {
+			return Keytab{}, err
+		}
+	}
+
+	domain := c.ADDomain
+	if domain == "" {
+		_, realm, found := strings.Cut(principal, "@")
+		if !found || realm == "" {
+			return Keytab{}, errors.New(gotext.Get("can't get domain from principal %q: set ad_domain", principal))
+		}
+		domain = strings.ToLower(realm)
+	}
+
+	return Keytab{
+		domain:           domain,
+		staticServerFQDN: strings.TrimPrefix(c.ADServer, "ldap://"),
+		principal:        principal,
+		krb5CCName:       args.krb5CCName,
+		kinitCmd:         args.kinitCmd,
+		ldapPort:         args.ldapPort,
+		lookupSRV:        args.lookupSRV,
+		config:           c,
+	}, nil
+}
+
+// Domain returns current server domain.
+func (k Keytab) Domain() string {
+	return k.domain
+}
+
+// ServerFQDN returns current server FQDN.
+// It returns first any static configuration. If nothing is found, it looks up the domain controllers
+// of the domain in DNS and returns the first one.
+// If there is no domain controller in DNS, the error raised is of type ErrorNoActiveServer.
+func (k Keytab) ServerFQDN(ctx context.Context) (serverFQDN string, err error) {
+	defer decorate.OnError(&err, gotext.Get("error while trying to look up AD server address in DNS for %q", k.domain))
+
+	if k.staticServerFQDN != "" {
+		return k.staticServerFQDN, nil
+	}
+
+	log.Debugf(ctx, "Looking up AD server in DNS because the keytab configuration does not provide an ad_server for %q", k.domain)
+	_, srvs, err := k.lookupSRV(ctx, "ldap", "tcp", "dc._msdcs."+k.domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", backends.ErrNoActiveServer
+		}
+		return "", err
+	}
+	// The records are sorted by priority and randomized by weight.
+	for _, srv := range srvs {
+		if target := strings.TrimSuffix(srv.Target, "."); target != "" {
+			return target, nil
+		}
+	}
+	return "", backends.ErrNoActiveServer
+}
+
+// HostKrb5CCName requests a machine ticket from the keytab and returns the absolute path of its cache.
+func (k Keytab) HostKrb5CCName() (string, error) {
+	if os.Getenv("ADSYS_SKIP_ROOT_CALLS") != "" {
+		return k.krb5CCName, nil
+	}
+
+	cmdArgs := append(slices.Clone(k.kinitCmd), "-k", "-t", k.config.Keytab, "-c", k.krb5CCName, k.principal)
+	smbsafe.WaitExec()
+	defer smbsafe.DoneExec()
+	// #nosec G204 - cmd is under our control (default system command or mock for tests)
+	if out, err := exec.Command(cmdArgs[0], cmdArgs[1:]...).CombinedOutput(); err != nil {
+		return "", errors.New(gotext.Get(`could not get krb5 cached ticket for %q from %s: %v:
+%s`, k.principal, k.config.Keytab, err, string(out)))
+	}
+
+	return k.krb5CCName, nil
+}
+
+// DefaultDomainSuffix returns current default domain suffix.
+func (k Keytab) DefaultDomainSuffix() string {
+	return k.domain
+}
+
+// IsOnline returns if the domain controller accepts LDAP connections.
+func (k Keytab) IsOnline() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), onlineCheckTimeout)
+	defer cancel()
+
+	serverFQDN, err := k.ServerFQDN(ctx)
+	if errors.Is(err, backends.ErrNoActiveServer) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(serverFQDN, k.ldapPort))
+	if err != nil {
+		log.Debugf(ctx, "Can't connect to %s: %v", serverFQDN, err)
+		return false, nil
+	}
+	_ = conn.Close()
+	return true, nil
+}
+
+// Config returns a stringified configuration for keytab backend.
+func (k Keytab) Config() string {
+	return fmt.Sprintf(`Current backend is keytab (machine policies only)
+Keytab: %s
+Principal: %s`, k.config.Keytab, k.principal)
+}
+
+// machinePrincipal returns the machine principal of keytab, listed with klist.
+func machinePrincipal(ctx context.Context, klistCmd []string, keytab string) (principal string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't get machine principal from %s", keytab))
+
+	cmdArgs := append(slices.Clone(klistCmd), "-k", keytab)
+	smbsafe.WaitExec()
+	// #nosec G204 - cmd is under our control (default system command or mock for tests)
+	out, err := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...).CombinedOutput()
+	smbsafe.DoneExec()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// Each entry is listed as <kvno> <principal>.
+	for _, l := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			continue
+		}
+		if machinePrincipalRe.MatchString(fields[1]) {
+			return fields[1], nil
+		}
+	}
+	return "", errors.New(gotext.Get("no machine principal of the form HOSTNAME$@REALM: set principal"))
+}
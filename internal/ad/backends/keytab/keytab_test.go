@@ -0,0 +1,196 @@
+package keytab_test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/ad/backends/keytab"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestKeytab(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		klistBehavior   string
+		dnsBehavior     string
+		staticPrincipal string
+		staticADDomain  string
+		staticADServer  string
+		offline         bool
+
+		wantKinitErr bool
+		wantErr      bool
+	}{
+		"Lookup is successful": {},
+
+		// Override cases
+		"Lookup with overridden principal does not read the keytab": {klistBehavior: "error", staticPrincipal: "SERVER$@OVERRIDDEN.COM"},
+		"Lookup with overridden ad_domain":                          {staticADDomain: "overridden.com"},
+		"Lookup with overridden ad_server":                          {staticADServer: "localhost"},
+		"Lookup with overridden ad_server with LDAP prefix":         {staticADServer: "ldap://localhost"},
+
+		// Offline cases
+		"Domain controller is not accepting connections": {offline: true},
+		"No domain controller in DNS":                    {dnsBehavior: "not_found"},
+		"No domain controller target in DNS":             {dnsBehavior: "no_target"},
+		"Error when looking up domain controller":        {dnsBehavior: "error"},
+
+		// Error cases
+		"Error when listing keytab":              {klistBehavior: "error", wantErr: true},
+		"Error when keytab has no machine entry": {klistBehavior: "no_machine_principal", wantErr: true},
+		"Error when principal has no realm":      {staticPrincipal: "SERVER$", wantErr: true},
+		"Error when requesting krb5cc":           {wantKinitErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err, "Setup: can't listen for LDAP connections")
+			_, port, err := net.SplitHostPort(l.Addr().String())
+			require.NoError(t, err, "Setup: can't get LDAP port")
+			if tc.offline {
+				l.Close()
+			} else {
+				defer l.Close()
+			}
+
+			klistCmd := []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockKlist", "--", tc.klistBehavior}
+			kinitCmdOutputFile := filepath.Join(t.TempDir(), "kinit-output")
+			kinitCmd := []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockKinit", "--", kinitCmdOutputFile}
+			if tc.wantKinitErr {
+				kinitCmd = append(kinitCmd, "-Exit1-")
+			}
+
+			lookupSRV := func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+				if service != "ldap" || proto != "tcp" {
+					return "", nil, fmt.Errorf("unexpected SRV lookup: %s %s", service, proto)
+				}
+				switch tc.dnsBehavior {
+				case "not_found":
+					return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+				case "no_target":
+					return "", []*net.SRV{{Target: "."}}, nil
+				case "error":
+					return "", nil, errors.New("DNS server unreachable")
+				}
+				return "", []*net.SRV{{Target: "localhost.", Port: 389}, {Target: "dc2.example.com.", Port: 389}}, nil
+			}
+
+			config := keytab.Config{
+				Keytab:    "/etc/krb5.keytab",
+				Principal: tc.staticPrincipal,
+				ADDomain:  tc.staticADDomain,
+				ADServer:  tc.staticADServer,
+			}
+			backend, err := keytab.New(context.Background(), config,
+				keytab.WithKlistCmd(klistCmd),
+				keytab.WithKinitCmd(kinitCmd),
+				keytab.WithKrb5CCName("/run/adsys/krb5cc_keytab"),
+				keytab.WithLDAPPort(port),
+				keytab.WithLookupSRV(lookupSRV),
+			)
+			if tc.wantErr {
+				require.Error(t, err, "New should have errored out")
+				return
+			}
+			require.NoError(t, err, "New should not have errored out")
+
+			got := testutils.FormatBackendCalls(t, backend)
+
+			// Check kinit command
+			if !tc.wantKinitErr {
+				gotKinitArgs, err := os.ReadFile(kinitCmdOutputFile)
+				require.NoError(t, err, "Setup: failed to read kinit command output")
+				got += "\nKinit args: " + string(gotKinitArgs)
+			}
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "Got expected loaded values in keytab config object")
+		})
+	}
+}
+
+func TestMockKlist(_ *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		args = args[1:]
+	}
+
+	switch args[0] {
+	case "error":
+		fmt.Fprintln(os.Stderr, "klist: Key table file '/etc/krb5.keytab' not found while starting keytab scan")
+		os.Exit(1)
+	case "no_machine_principal":
+		fmt.Println(`Keytab name: FILE:/etc/krb5.keytab
+KVNO Principal
+---- --------------------------------------------------------------------------
+   2 host/server.example.com@EXAMPLE.COM`)
+	default:
+		fmt.Println(`Keytab name: FILE:/etc/krb5.keytab
+KVNO Principal
+---- --------------------------------------------------------------------------
+   2 host/server.example.com@EXAMPLE.COM
+   2 SERVER$@EXAMPLE.COM
+   2 SERVER$@EXAMPLE.COM`)
+	}
+}
+
+func TestMockKinit(_ *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	var goldPath string
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] == "--" {
+			goldPath = args[1]
+			args = args[2:]
+			break
+		}
+		args = args[1:]
+	}
+
+	if args[0] == "-Exit1-" {
+		fmt.Fprintf(os.Stderr, "EXIT 1 requested in mock")
+		os.Exit(1)
+	}
+
+	err := os.WriteFile(goldPath, []byte(fmt.Sprintf("%q", strings.Join(args, " "))+"\n"), 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Setup: failed to write kinit command output: %v", err)
+		os.Exit(1)
+	}
+}
+
+func TestMain(m *testing.M) {
+	debug := flag.Bool("verbose", false, "Print debug log level information within the test")
+	flag.Parse()
+	if *debug {
+		logrus.StandardLogger().SetLevel(logrus.DebugLevel)
+	}
+
+	m.Run()
+	testutils.MergeCoverages()
+}
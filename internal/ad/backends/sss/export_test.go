@@ -0,0 +1,8 @@
+package sss
+
+// WithLDBSearchCmd specifies a personalized ldbsearch command for the backend to use.
+func WithLDBSearchCmd(cmd []string) Option {
+	return func(o *options) {
+		o.ldbSearchCmd = cmd
+	}
+}
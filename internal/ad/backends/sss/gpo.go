@@ -0,0 +1,106 @@
+package sss
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/ad/backends"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+)
+
+// EvaluatedGPOs returns the GPOs SSSD last evaluated for its GPO based access control, as stored in its cache.
+// SSSD only evaluates the GPOs of the machine: they apply to the logon rights of all users.
+func (sss SSS) EvaluatedGPOs(ctx context.Context) (gpos []backends.EvaluatedGPO, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read the GPOs evaluated by SSSD"))
+
+	if sss.gpoAccessControl == "disabled" {
+		return nil, errors.New(gotext.Get("the GPO based access control of SSSD is disabled in %s (ad_gpo_access_control)", sss.config.Conf))
+	}
+
+	cache := filepath.Join(sss.config.CacheDir, fmt.Sprintf("cache_%s.ldb", sss.sssdDomain))
+	if _, err := os.Stat(cache); errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.New(gotext.Get("SSSD cache %s doesn't exist: no user logged in through SSSD yet", cache))
+	}
+
+	base := fmt.Sprintf("cn=gpos,cn=ad,cn=custom,cn=%s,cn=sysdb", sss.sssdDomain)
+	log.Debugf(ctx, "Listing GPOs evaluated by SSSD in %s", cache)
+
+	// #nosec G204 - the command is set by the daemon and the cache path by its configuration.
+	cmd := exec.CommandContext(ctx, sss.ldbSearchCmd[0], append(sss.ldbSearchCmd[1:],
+		"-H", cache, "-b", base, "-s", "one", "(objectClass=gpo)", "gpoGUID", "gpoVersion")...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, errors.New(gotext.Get("%s is not installed: install the ldb-tools package", sss.ldbSearchCmd[0]))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	for _, record := range parseLDIF(out) {
+		id := record["gpoguid"]
+		if id == "" {
+			continue
+		}
+		version, err := strconv.Atoi(record["gpoversion"])
+		if err != nil {
+			log.Warningf(ctx, "Invalid version %q of GPO %s in SSSD cache", record["gpoversion"], id)
+		}
+		gpos = append(gpos, backends.EvaluatedGPO{ID: id, Version: version})
+	}
+	sort.Slice(gpos, func(i, j int) bool { return gpos[i].ID < gpos[j].ID })
+
+	return gpos, nil
+}
+
+// parseLDIF returns the records of the LDIF content, as their attributes in lower case and their first value.
+func parseLDIF(content []byte) (records []map[string]string) {
+	// Long lines are folded on the next lines, starting with a space.
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		l := scanner.Text()
+		if strings.HasPrefix(l, " ") && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		lines = append(lines, l)
+	}
+
+	var record map[string]string
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			record = nil
+			continue
+		}
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		if record == nil {
+			record = make(map[string]string)
+			records = append(records, record)
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		if _, exists := record[k]; !exists {
+			record[k] = strings.TrimSpace(v)
+		}
+	}
+	return records
+}
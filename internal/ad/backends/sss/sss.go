@@ -20,13 +20,16 @@ import (
 // SSS is the backend object with domain and DC information.
 type SSS struct {
 	domain              string
+	sssdDomain          string
+	gpoAccessControl    string
 	domainDbus          dbus.BusObject
 	serverFQDN          string
 	staticServerFQDN    string
 	hostKrb5CCName      string
 	defaultDomainSuffix string
 
-	config Config
+	config       Config
+	ldbSearchCmd []string
 }
 
 // Config for sss backend.
@@ -35,10 +38,26 @@ type Config struct {
 	CacheDir string `mapstructure:"cache_dir"`
 }
 
+// Option represents an optional function to change the sss backend.
+type Option func(*options)
+
+type options struct {
+	ldbSearchCmd []string
+}
+
 // New returns a sss backend loaded from Config.
-func New(ctx context.Context, c Config, bus *dbus.Conn) (s SSS, err error) {
+func New(ctx context.Context, c Config, bus *dbus.Conn, opts ...Option) (s SSS, err error) {
 	defer decorate.OnError(&err, gotext.Get("can't get domain configuration from %+v", c))
 
+	// defaults
+	args := options{
+		ldbSearchCmd: []string{"ldbsearch"},
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
 	log.Debug(ctx, "Loading SSS configuration for AD backend")
 
 	if c.Conf == "" {
@@ -82,18 +101,24 @@ func New(ctx context.Context, c Config, bus *dbus.Conn) (s SSS, err error) {
 		staticServerFQDN = strings.TrimPrefix(staticServerFQDN, "ldap://")
 	}
 
+	// SSSD enforces the GPO based access control by default.
+	gpoAccessControl := domainSection.Key("ad_gpo_access_control").MustString("enforcing")
+
 	// local machine sssd krb5 cache
 	hostKrb5CCName := filepath.Join(c.CacheDir, "ccache_"+strings.ToUpper(domain))
 
 	return SSS{
 		domain:              domain,
+		sssdDomain:          sssdDomain,
+		gpoAccessControl:    gpoAccessControl,
 		domainDbus:          domainDbus,
 		serverFQDN:          staticServerFQDN,
 		staticServerFQDN:    staticServerFQDN,
 		hostKrb5CCName:      hostKrb5CCName,
 		defaultDomainSuffix: defaultDomainSuffix,
 
-		config: c,
+		config:       c,
+		ldbSearchCmd: args.ldbSearchCmd,
 	}, nil
 }
 
@@ -110,6 +110,74 @@ func TestSSSD(t *testing.T) {
 	}
 }
 
+func TestEvaluatedGPOs(t *testing.T) {
+	t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+
+	tests := map[string]struct {
+		sssdConf   string
+		ldbSearch  string
+		ldbCmdFail bool
+		noLDBCmd   bool
+
+		wantErr bool
+	}{
+		"GPOs evaluated by SSSD, sorted by ID":       {},
+		"No GPO evaluated by SSSD":                   {ldbSearch: "no-gpo"},
+		"Permissive GPO access control is evaluated": {sssdConf: "gpo-access-control-permissive"},
+		"Invalid version is reported as 0":           {ldbSearch: "invalid-version"},
+
+		// Error cases
+		"Error on GPO access control disabled": {sssdConf: "gpo-access-control-disabled", wantErr: true},
+		"Error on no SSSD cache":               {sssdConf: "no-cache", wantErr: true},
+		"Error on ldbsearch failing":           {ldbCmdFail: true, wantErr: true},
+		"Error on ldbsearch not installed":     {noLDBCmd: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.sssdConf == "" {
+				tc.sssdConf = "example.com"
+			}
+			if tc.ldbSearch == "" {
+				tc.ldbSearch = "gpos"
+			}
+
+			config := sss.Config{
+				Conf:     filepath.Join(testutils.TestFamilyPath(t), "configs", tc.sssdConf),
+				CacheDir: filepath.Join(testutils.TestFamilyPath(t), "cache"),
+			}
+			ldbSearchCmd := []string{"sh", "-c", `cat "$0"`, filepath.Join(testutils.TestFamilyPath(t), "ldbsearch", tc.ldbSearch)}
+			if tc.ldbCmdFail {
+				ldbSearchCmd = []string{"sh", "-c", "echo 'Failed to connect' >&2; exit 1"}
+			}
+			if tc.noLDBCmd {
+				ldbSearchCmd = []string{"doesnotexist"}
+			}
+
+			sssd, err := sss.New(context.Background(), config, bus, sss.WithLDBSearchCmd(ldbSearchCmd))
+			require.NoError(t, err, "Setup: New should return no error")
+
+			gpos, err := sssd.EvaluatedGPOs(context.Background())
+			if tc.wantErr {
+				require.Error(t, err, "EvaluatedGPOs should have errored out")
+				return
+			}
+			require.NoError(t, err, "EvaluatedGPOs should return no error")
+
+			var got strings.Builder
+			for _, g := range gpos {
+				fmt.Fprintf(&got, "%s: %d\n", g.ID, g.Version)
+			}
+			want := testutils.LoadWithUpdateFromGolden(t, got.String())
+			require.Equal(t, want, got.String(), "EvaluatedGPOs returns expected GPOs")
+		})
+	}
+}
+
 type sssdbus struct {
 	endpoint       string
 	offline        bool
@@ -0,0 +1,153 @@
+package ad
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+)
+
+// offPeakWindow is a daily time window, in local time, during which downloads are not limited.
+// The window can span midnight, like 22:00-06:00.
+type offPeakWindow struct {
+	start, end time.Duration
+}
+
+// parseOffPeakWindow parses a window of the form HH:MM-HH:MM. An empty window is never active.
+func parseOffPeakWindow(s string) (w *offPeakWindow, err error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return nil, nil
+	}
+
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, errors.New(gotext.Get("invalid off-peak window %q: HH:MM-HH:MM is expected", s))
+	}
+	w = &offPeakWindow{}
+	for _, b := range []struct {
+		v string
+		d *time.Duration
+	}{{start, &w.start}, {end, &w.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(b.v))
+		if err != nil {
+			return nil, errors.New(gotext.Get("invalid off-peak window %q: HH:MM-HH:MM is expected", s))
+		}
+		*b.d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.start == w.end {
+		return nil, errors.New(gotext.Get("invalid off-peak window %q: start and end are the same", s))
+	}
+	return w, nil
+}
+
+// contains returns true if t is in the window.
+func (w *offPeakWindow) contains(t time.Time) bool {
+	if w == nil {
+		return false
+	}
+	h, m, _ := t.Clock()
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute
+	if w.start < w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+// bandwidthLimiter caps the throughput of all the SYSVOL downloads together, outside of the off-peak window.
+// It is a token bucket allowing bursts of one second of transfer.
+type bandwidthLimiter struct {
+	rate    int
+	offPeak *offPeakWindow
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newBandwidthLimiter returns a limiter to rate bytes per second, lifted during offPeak.
+// A limiter to 0 byte per second doesn't limit anything.
+func newBandwidthLimiter(rate int, offPeak *offPeakWindow, now func() time.Time) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		rate:    rate,
+		offPeak: offPeak,
+		now:     now,
+		sleep:   sleepContext,
+		tokens:  float64(rate),
+	}
+}
+
+// active returns true if the downloads are currently limited.
+func (l *bandwidthLimiter) active() bool {
+	return l != nil && l.rate > 0 && !l.offPeak.contains(l.now())
+}
+
+// wait blocks until n bytes can be transferred.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	if !l.active() {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = min(float64(l.rate), l.tokens+now.Sub(l.last).Seconds()*float64(l.rate))
+	}
+	l.last = now
+	// Reserve the bytes right away, so that concurrent downloads queue after each other.
+	l.tokens -= float64(n)
+	missing := -l.tokens
+	l.mu.Unlock()
+
+	if missing <= 0 {
+		return nil
+	}
+	return l.sleep(ctx, time.Duration(missing/float64(l.rate)*float64(time.Second)))
+}
+
+// reader returns a reader of r limited by l.
+func (l *bandwidthLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil || l.rate <= 0 {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+// limitedReader is a reader whose throughput is capped by a bandwidth limiter.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *bandwidthLimiter
+}
+
+// Read reads at most one second of transfer, then waits for the limiter.
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.l.active() && len(p) > r.l.rate {
+		p = p[:r.l.rate]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if err := r.l.wait(r.ctx, n); err != nil {
+			return n, errors.New(gotext.Get("download interrupted: %v", err))
+		}
+	}
+	return n, err
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,150 @@
+package ad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies"
+)
+
+// connectivityCheckTimeout is the maximum time to wait for the connectivity check URL to answer.
+const connectivityCheckTimeout = 5 * time.Second
+
+// captivePortalState is the last captive portal detection, while AD could not be reached.
+type captivePortalState struct {
+	// reason is why a captive portal is suspected. It is empty if none is.
+	reason string
+	// detections is the number of consecutive detections, used to compute the backoff.
+	detections int
+	// until is the time after which AD is contacted again.
+	until time.Time
+}
+
+// checkCaptivePortal returns true if a captive portal was detected and AD shouldn't be contacted yet,
+// with the reason why it is suspected and until when.
+func (ad *AD) checkCaptivePortal() (reason string, until time.Time, suspected bool) {
+	ad.captivePortalMu.Lock()
+	defer ad.captivePortalMu.Unlock()
+
+	s := ad.captivePortal
+	if s.reason == "" || !ad.now().Before(s.until) {
+		return "", time.Time{}, false
+	}
+	return s.reason, s.until, true
+}
+
+// detectCaptivePortal checks, once AD could not be reached, if the network is intercepted by a captive portal or
+// a DNS server answering for names which don't exist, like on hotel Wi-Fi.
+// If one is suspected, AD is not contacted again until its backoff expires. This duration doubles on each
+// consecutive detection, up to the maximum captive portal backoff.
+func (ad *AD) detectCaptivePortal(ctx context.Context) (reason string, suspected bool) {
+	if !ad.detectCaptivePortals {
+		return "", false
+	}
+
+	reason = ad.hijackedDNS(ctx)
+	if reason == "" {
+		reason = ad.interceptedHTTP(ctx)
+	}
+	if reason == "" {
+		return "", false
+	}
+
+	ad.captivePortalMu.Lock()
+	defer ad.captivePortalMu.Unlock()
+
+	s := ad.captivePortal
+	s.reason = reason
+	s.detections++
+
+	backoff := consts.DefaultCaptivePortalBackoff
+	for i := 1; i < s.detections && backoff < consts.DefaultCaptivePortalMaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, consts.DefaultCaptivePortalMaxBackoff)
+	s.until = ad.now().Add(backoff)
+
+	log.Warningf(ctx, "Captive portal suspected (%s): deferring AD lookups for %s", reason, backoff)
+	ad.captivePortal = s
+	return reason, true
+}
+
+// clearCaptivePortal forgets any previous captive portal detection.
+func (ad *AD) clearCaptivePortal(ctx context.Context) {
+	ad.captivePortalMu.Lock()
+	defer ad.captivePortalMu.Unlock()
+
+	if ad.captivePortal.reason != "" {
+		log.Info(ctx, "AD is reachable again, captive portal is not suspected anymore")
+	}
+	ad.captivePortal = captivePortalState{}
+}
+
+// hijackedDNS returns why the DNS answers are suspicious, if a name which can't exist in the domain is resolved.
+func (ad *AD) hijackedDNS(ctx context.Context) (reason string) {
+	name := fmt.Sprintf("adsys-nxdomain-check-%016x.%s", rand.Uint64(), ad.configBackend.Domain())
+	addrs, err := ad.lookupHost(ctx, name)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	log.Debugf(ctx, "Non existent name %q resolved to %v", name, addrs)
+	return gotext.Get("DNS resolves non existent names to %s", addrs[0])
+}
+
+// interceptedHTTP returns why the HTTP requests are suspicious, if the connectivity check URL is redirected or
+// answered with some content, like a login page.
+// Failing to contact this URL is not suspicious, as internet access may not be allowed from the AD network.
+func (ad *AD) interceptedHTTP(ctx context.Context) (reason string) {
+	if ad.connectivityCheckURL == "" {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, connectivityCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ad.connectivityCheckURL, nil)
+	if err != nil {
+		log.Warningf(ctx, "Invalid connectivity check URL %q: %v", ad.connectivityCheckURL, err)
+		return ""
+	}
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debugf(ctx, "Can't contact connectivity check URL %q: %v", ad.connectivityCheckURL, err)
+		return ""
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return ""
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		return gotext.Get("connectivity check redirected to %q", resp.Header.Get("Location"))
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return gotext.Get("connectivity check answered with a web page")
+	}
+	// Other errors are likely a proxy refusing the request: it doesn't mean we have to log in anywhere.
+	return ""
+}
+
+// cachedPoliciesBehindCaptivePortal returns the policies from the previous online update of objectName,
+// while a captive portal is suspected.
+func (ad *AD) cachedPoliciesBehindCaptivePortal(ctx context.Context, objectName, reason string) (policies.Policies, error) {
+	cachedPolicies, err := policies.NewFromCache(ctx, filepath.Join(ad.policiesCacheDir, objectName))
+	if err != nil {
+		return cachedPolicies, errors.New(gotext.Get("captive portal suspected (%s) and policies cache is unavailable: %v", reason, err))
+	}
+
+	log.Infof(ctx, "Can't reach AD: captive portal suspected (%s) and %q policies are applied using previous online update", reason, objectName)
+	return cachedPolicies, nil
+}
@@ -3,9 +3,13 @@ package adcommon
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 
 	"github.com/leonelquinteros/gotext"
@@ -15,6 +19,18 @@ import (
 // KeyPrefix is the prefix for all our policies in the GPO.
 const KeyPrefix = "Software/Policies"
 
+// LockValueName is the value of a policy set to "false" when its value is only a default the users can override,
+// instead of being locked.
+const LockValueName = "Lock"
+
+// AuditValueName is the value of a policy set to "true" when its changes are only reported by the clients,
+// without being applied.
+const AuditValueName = "Audit"
+
+// ListModeValueName is the value of a list policy set to how its value is combined with the default value
+// of the system: replace, merge or append.
+const ListModeValueName = "ListMode"
+
 // GetVersionID returns from root a the VERSION_ID field of os-release.
 func GetVersionID(root string) (versionID string, err error) {
 	defer decorate.OnError(&err, gotext.Get("cannot get versionID"))
@@ -44,3 +60,87 @@ func GetVersionID(root string) (versionID string, err error) {
 
 	return versionID, nil
 }
+
+// Flavor is an Ubuntu flavor policies can target.
+type Flavor struct {
+	DisplayName string
+	// MetaPackage is the package installed on the clients running the flavor.
+	MetaPackage string
+}
+
+// Flavors are the Ubuntu flavors policies can target, by identifier.
+var Flavors = map[string]Flavor{
+	"ubuntu":         {DisplayName: "Ubuntu", MetaPackage: "ubuntu-desktop"},
+	"kubuntu":        {DisplayName: "Kubuntu", MetaPackage: "kubuntu-desktop"},
+	"xubuntu":        {DisplayName: "Xubuntu", MetaPackage: "xubuntu-desktop"},
+	"lubuntu":        {DisplayName: "Lubuntu", MetaPackage: "lubuntu-desktop"},
+	"ubuntu-mate":    {DisplayName: "Ubuntu MATE", MetaPackage: "ubuntu-mate-desktop"},
+	"ubuntu-budgie":  {DisplayName: "Ubuntu Budgie", MetaPackage: "ubuntu-budgie-desktop"},
+	"ubuntucinnamon": {DisplayName: "Ubuntu Cinnamon", MetaPackage: "ubuntucinnamon-desktop"},
+	"ubuntustudio":   {DisplayName: "Ubuntu Studio", MetaPackage: "ubuntustudio-desktop"},
+	"ubuntukylin":    {DisplayName: "Ubuntu Kylin", MetaPackage: "ubuntukylin-desktop"},
+	"edubuntu":       {DisplayName: "Edubuntu", MetaPackage: "edubuntu-desktop"},
+}
+
+// GetFlavor returns from root the Ubuntu flavor installed, detected from its meta package.
+// Other flavors take precedence over ubuntu, as their meta package can be installed alongside ubuntu-desktop.
+// An empty string is returned if no flavor is installed, like on servers.
+func GetFlavor(root string) (flavor string, err error) {
+	defer decorate.OnError(&err, gotext.Get("cannot get flavor"))
+
+	var flavors []string
+	for f := range Flavors {
+		flavors = append(flavors, f)
+	}
+	sort.Slice(flavors, func(i, j int) bool {
+		if (flavors[i] == "ubuntu") != (flavors[j] == "ubuntu") {
+			return flavors[j] == "ubuntu"
+		}
+		return flavors[i] < flavors[j]
+	})
+
+	for _, f := range flavors {
+		_, err := os.Stat(filepath.Join(root, "var/lib/dpkg/info", Flavors[f].MetaPackage+".list"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return f, nil
+	}
+
+	return "", nil
+}
+
+// GetDesktops returns from root the sorted list of desktop environments of the installed X11 and Wayland sessions,
+// as declared in the DesktopNames field of their session files.
+func GetDesktops(root string) (desktops []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("cannot get desktops"))
+
+	for _, dir := range []string{"usr/share/xsessions", "usr/share/wayland-sessions"} {
+		sessions, err := filepath.Glob(filepath.Join(root, dir, "*.desktop"))
+		if err != nil {
+			return nil, err
+		}
+		for _, session := range sessions {
+			d, err := os.ReadFile(session)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range strings.Split(string(d), "\n") {
+				v, ok := strings.CutPrefix(strings.TrimSpace(l), "DesktopNames=")
+				if !ok {
+					continue
+				}
+				for _, desktop := range strings.FieldsFunc(v, func(r rune) bool { return r == ':' || r == ';' }) {
+					if desktop = strings.TrimSpace(desktop); desktop != "" && !slices.Contains(desktops, desktop) {
+						desktops = append(desktops, desktop)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(desktops)
+
+	return desktops, nil
+}
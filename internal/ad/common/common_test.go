@@ -43,3 +43,51 @@ func TestGetVersionID(t *testing.T) {
 		})
 	}
 }
+
+func TestGetFlavor(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		want string
+	}{
+		"Ubuntu flavor":                     {want: "ubuntu"},
+		"Kubuntu flavor":                    {want: "kubuntu"},
+		"Flavor installed alongside ubuntu": {want: "xubuntu"},
+		"No flavor installed":               {want: ""},
+		"No dpkg database":                  {want: ""},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			flavor, err := adcommon.GetFlavor(filepath.Join("testdata", name))
+			require.NoError(t, err, "GetFlavor returned an error when expecting none")
+
+			require.Equal(t, tc.want, flavor, "expected value from GetFlavor doesn't match")
+		})
+	}
+}
+
+func TestGetDesktops(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		want []string
+	}{
+		"Multiple sessions":             {want: []string{"GNOME", "KDE", "ubuntu"}},
+		"Session without desktop names": {want: nil},
+		"No sessions":                   {want: nil},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			desktops, err := adcommon.GetDesktops(filepath.Join("testdata", name))
+			require.NoError(t, err, "GetDesktops returned an error when expecting none")
+
+			require.Equal(t, tc.want, desktops, "expected value from GetDesktops doesn't match")
+		})
+	}
+}
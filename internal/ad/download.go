@@ -45,6 +45,7 @@ import (
 
 	"github.com/leonelquinteros/gotext"
 	"github.com/mvo5/libsmbclient-go"
+	"github.com/ubuntu/adsys/internal/faultinject"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
 	"github.com/ubuntu/adsys/internal/smbsafe"
 	"github.com/ubuntu/decorate"
@@ -80,6 +81,14 @@ func (ad *AD) fetch(ctx context.Context, krb5Ticket string, downloadables map[st
 		}
 	}()
 
+	// The SMB library calls can't be interrupted: the download deadline is checked before each transfer.
+	ctx, cancel := context.WithTimeout(ctx, ad.sysvolDownloadTimeout)
+	defer cancel()
+
+	if ad.bandwidthLimiter.active() {
+		log.Infof(ctx, "SYSVOL downloads are limited to %d KiB/s", ad.bandwidthLimiter.rate/1024)
+	}
+
 	client := libsmbclient.New()
 	defer client.Close()
 	// When testing we cannot use kerberos without a real kerberos server
@@ -111,6 +120,13 @@ func (ad *AD) fetch(ctx context.Context, krb5Ticket string, downloadables map[st
 
 			log.Debugf(ctx, "Analyzing %q", g.name)
 
+			if err := faultinject.DownloadError(); err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return errors.New(gotext.Get("download interrupted: %v", err))
+			}
+
 			dest := filepath.Join(ad.sysvolCacheDir, "Policies", filepath.Base(g.url))
 			if g.isAssets {
 				dest = filepath.Join(ad.sysvolCacheDir, "assets")
@@ -151,7 +167,7 @@ func (ad *AD) fetch(ctx context.Context, krb5Ticket string, downloadables map[st
 				assetsWereRefreshed = true
 			}
 
-			return downloadDir(ctx, client, g.url, dest)
+			return downloadDir(ctx, client, ad.bandwidthLimiter, g.url, dest)
 		})
 	}
 
@@ -231,7 +247,8 @@ func getGPOVersion(ctx context.Context, r io.Reader, downloadableName string) (v
 }
 
 // downloadDir will dl in a temporary directory and only commit it if fully downloaded without any errors.
-func downloadDir(ctx context.Context, client *libsmbclient.Client, url, dest string) (err error) {
+// The transfer is capped by limiter.
+func downloadDir(ctx context.Context, client *libsmbclient.Client, limiter *bandwidthLimiter, url, dest string) (err error) {
 	defer decorate.OnError(&err, gotext.Get("download %q failed", url))
 
 	smbsafe.WaitSmb()
@@ -258,7 +275,7 @@ func downloadDir(ctx context.Context, client *libsmbclient.Client, url, dest str
 			log.Info(ctx, gotext.Get("Could not clean up temporary directory:"), err)
 		}
 	}()
-	if err := downloadRecursive(ctx, client, url, tmpdest); err != nil {
+	if err := downloadRecursive(ctx, client, limiter, url, tmpdest); err != nil {
 		return err
 	}
 	// Remove previous download content
@@ -272,7 +289,7 @@ func downloadDir(ctx context.Context, client *libsmbclient.Client, url, dest str
 	return nil
 }
 
-func downloadRecursive(ctx context.Context, client *libsmbclient.Client, url, dest string) error {
+func downloadRecursive(ctx context.Context, client *libsmbclient.Client, limiter *bandwidthLimiter, url, dest string) error {
 	d, err := client.Opendir(url)
 	if err != nil {
 		return err
@@ -299,6 +316,9 @@ func downloadRecursive(ctx context.Context, client *libsmbclient.Client, url, de
 		if dirent.Name == "." || dirent.Name == ".." {
 			continue
 		}
+		if err := ctx.Err(); err != nil {
+			return errors.New(gotext.Get("download interrupted: %v", err))
+		}
 
 		entityURL := url + "/" + dirent.Name
 		entityDest := filepath.Join(dest, dirent.Name)
@@ -313,7 +333,7 @@ func downloadRecursive(ctx context.Context, client *libsmbclient.Client, url, de
 			defer f.Close()
 			// Read() is on *libsmbclient.File, not libsmbclient.File
 			pf := &f
-			data, err := io.ReadAll(pf)
+			data, err := io.ReadAll(limiter.reader(ctx, pf))
 			if err != nil {
 				return err
 			}
@@ -322,7 +342,7 @@ func downloadRecursive(ctx context.Context, client *libsmbclient.Client, url, de
 				return err
 			}
 		case libsmbclient.SmbcDir:
-			err := downloadRecursive(ctx, client, entityURL, entityDest)
+			err := downloadRecursive(ctx, client, limiter, entityURL, entityDest)
 			if err != nil {
 				return err
 			}
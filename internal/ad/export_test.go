@@ -3,6 +3,8 @@ package ad
 var (
 	WithoutKerberos = withoutKerberos
 	WithGPOListCmd  = withGPOListCmd
+	WithNow         = withNow
+	WithLookupHost  = withLookupHost
 )
 
 func (ad *AD) SysvolCacheDir() string {
@@ -14,3 +16,8 @@ func (ad *AD) PoliciesCacheDir() string {
 func (ad *AD) Krb5CacheDir() string {
 	return ad.krb5CacheDir
 }
+
+// SetGPOListCmd changes the command listing the GPOs after the AD object is created.
+func (ad *AD) SetGPOListCmd(cmd []string) {
+	ad.gpoListCmd = cmd
+}
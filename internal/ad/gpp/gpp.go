@@ -0,0 +1,590 @@
+// Package gpp handles parsing Group Policy Preferences items stored in the GPOs
+// to convert them to entries adsys can consume.
+package gpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+)
+
+// File is an item of the Group Policy Preferences "Files" extension.
+type File struct {
+	Name       string
+	Action     string
+	FromPath   string
+	TargetPath string
+	Disabled   bool
+}
+
+// Actions of the Group Policy Preferences items.
+const (
+	ActionCreate  = "C"
+	ActionReplace = "R"
+	ActionUpdate  = "U"
+	ActionDelete  = "D"
+)
+
+// ApplyMode returns the name of the action, as used by the managers supporting the apply modes.
+func ApplyMode(action string) string {
+	switch action {
+	case ActionCreate:
+		return "create"
+	case ActionReplace:
+		return "replace"
+	case ActionDelete:
+		return "delete"
+	}
+	return "update"
+}
+
+type filesXML struct {
+	XMLName xml.Name `xml:"Files"`
+	Files   []struct {
+		Name       string `xml:"name,attr"`
+		Disabled   string `xml:"disabled,attr"`
+		Properties struct {
+			Action     string `xml:"action,attr"`
+			FromPath   string `xml:"fromPath,attr"`
+			TargetPath string `xml:"targetPath,attr"`
+		} `xml:"Properties"`
+	} `xml:"File"`
+}
+
+// ParseFiles parses the Files.xml content of the Group Policy Preferences "Files" extension from r.
+// Items without an action are considered as updates, which is the default of the extension.
+func ParseFiles(r io.Reader) (files []File, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse Group Policy Preferences files"))
+
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Files written by the Windows tools start with a byte order mark.
+	d = bytes.TrimPrefix(d, []byte("\xef\xbb\xbf"))
+
+	var x filesXML
+	if err := xml.Unmarshal(d, &x); err != nil {
+		return nil, err
+	}
+
+	for _, f := range x.Files {
+		action := strings.ToUpper(f.Properties.Action)
+		if action == "" {
+			action = ActionUpdate
+		}
+		switch action {
+		case ActionCreate, ActionReplace, ActionUpdate, ActionDelete:
+		default:
+			return nil, errors.New(gotext.Get("unknown action %q for item %q", f.Properties.Action, f.Name))
+		}
+		files = append(files, File{
+			Name:       f.Name,
+			Action:     action,
+			FromPath:   f.Properties.FromPath,
+			TargetPath: f.Properties.TargetPath,
+			Disabled:   f.Disabled == "1",
+		})
+	}
+
+	return files, nil
+}
+
+// Types of the Group Policy Preferences "Printers" items.
+const (
+	PrinterShared = "SharedPrinter"
+	PrinterPort   = "PortPrinter"
+	PrinterLocal  = "LocalPrinter"
+)
+
+// lprProtocol is the protocol of TCP/IP printers using LPR instead of raw sockets.
+const lprProtocol = "PROTOCOL_LPR_TYPE"
+
+// invalidQueueCharsRe matches the characters which are not supported in queue names.
+var invalidQueueCharsRe = regexp.MustCompile(`[^A-Za-z0-9_.@+-]`)
+
+// Printer is an item of the Group Policy Preferences "Printers" extension.
+type Printer struct {
+	Name   string
+	Type   string
+	Action string
+	// Path is the UNC path of shared printers.
+	Path string
+	// IPAddress, Port, Protocol and LPRQueue define TCP/IP printers.
+	IPAddress string
+	Port      string
+	Protocol  string
+	LPRQueue  string
+	LocalName string
+	Location  string
+	Comment   string
+	Default   bool
+	Disabled  bool
+}
+
+type printersXML struct {
+	XMLName  xml.Name `xml:"Printers"`
+	Printers []struct {
+		XMLName    xml.Name
+		Name       string `xml:"name,attr"`
+		Disabled   string `xml:"disabled,attr"`
+		Properties struct {
+			Action    string `xml:"action,attr"`
+			Path      string `xml:"path,attr"`
+			IPAddress string `xml:"ipAddress,attr"`
+			Port      string `xml:"portNumber,attr"`
+			Protocol  string `xml:"protocol,attr"`
+			LPRQueue  string `xml:"lprQueue,attr"`
+			LocalName string `xml:"localName,attr"`
+			Location  string `xml:"location,attr"`
+			Comment   string `xml:"comment,attr"`
+			Default   string `xml:"default,attr"`
+		} `xml:"Properties"`
+	} `xml:",any"`
+}
+
+// ParsePrinters parses the Printers.xml content of the Group Policy Preferences "Printers" extension from r.
+// Items without an action are considered as updates, which is the default of the extension.
+func ParsePrinters(r io.Reader) (printers []Printer, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse Group Policy Preferences printers"))
+
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Files written by the Windows tools start with a byte order mark.
+	d = bytes.TrimPrefix(d, []byte("\xef\xbb\xbf"))
+
+	var x printersXML
+	if err := xml.Unmarshal(d, &x); err != nil {
+		return nil, err
+	}
+
+	for _, p := range x.Printers {
+		action := strings.ToUpper(p.Properties.Action)
+		if action == "" {
+			action = ActionUpdate
+		}
+		switch action {
+		case ActionCreate, ActionReplace, ActionUpdate, ActionDelete:
+		default:
+			return nil, errors.New(gotext.Get("unknown action %q for item %q", p.Properties.Action, p.Name))
+		}
+		printers = append(printers, Printer{
+			Name:      p.Name,
+			Type:      p.XMLName.Local,
+			Action:    action,
+			Path:      p.Properties.Path,
+			IPAddress: p.Properties.IPAddress,
+			Port:      p.Properties.Port,
+			Protocol:  p.Properties.Protocol,
+			LPRQueue:  p.Properties.LPRQueue,
+			LocalName: p.Properties.LocalName,
+			Location:  p.Properties.Location,
+			Comment:   p.Properties.Comment,
+			Default:   p.Properties.Default == "1",
+			Disabled:  p.Disabled == "1",
+		})
+	}
+
+	return printers, nil
+}
+
+// URI returns the CUPS device URI of the printer p.
+// It returns false if the printer type is not supported or if the printer is incomplete.
+func (p Printer) URI() (string, bool) {
+	switch p.Type {
+	case PrinterShared:
+		// \\<server>\<share>
+		parts := strings.Split(strings.ReplaceAll(p.Path, `\`, "/"), "/")
+		if len(parts) != 4 || parts[0] != "" || parts[1] != "" || parts[2] == "" || parts[3] == "" {
+			return "", false
+		}
+		return (&url.URL{Scheme: "smb", Host: parts[2], Path: "/" + parts[3]}).String(), true
+	case PrinterPort:
+		if p.IPAddress == "" {
+			return "", false
+		}
+		if p.Protocol == lprProtocol {
+			if p.LPRQueue == "" {
+				return "", false
+			}
+			return (&url.URL{Scheme: "lpd", Host: p.IPAddress, Path: "/" + p.LPRQueue}).String(), true
+		}
+		port := p.Port
+		if port == "" {
+			port = "9100"
+		}
+		return fmt.Sprintf("socket://%s:%s", p.IPAddress, port), true
+	}
+	return "", false
+}
+
+// QueueName returns the name of the CUPS queue for the printer p: the share name of shared printers,
+// and the local name, or the item name, of TCP/IP printers.
+// Unsupported characters are replaced by underscores.
+func (p Printer) QueueName() string {
+	name := p.Name
+	switch {
+	case p.Type == PrinterShared:
+		name = p.Path[strings.LastIndexAny(p.Path, `\/`)+1:]
+	case p.LocalName != "":
+		name = p.LocalName
+	}
+	name = invalidQueueCharsRe.ReplaceAllString(name, "_")
+	if len(name) > 127 {
+		name = name[:127]
+	}
+	return name
+}
+
+// Types of the targets of the Group Policy Preferences "Shortcuts" items.
+const (
+	ShortcutFileSystem = "FILESYSTEM"
+	ShortcutURL        = "URL"
+	ShortcutShell      = "SHELL"
+)
+
+// Locations of the shortcuts, as returned by Shortcut.Location.
+const (
+	LocationDesktop   = "desktop"
+	LocationMenu      = "menu"
+	LocationAutostart = "autostart"
+)
+
+// shortcutLocations are the folder variables of the shortcut paths and their matching location.
+var shortcutLocations = map[string]string{
+	"%DESKTOPDIR%":         LocationDesktop,
+	"%COMMONDESKTOPDIR%":   LocationDesktop,
+	"%STARTMENUDIR%":       LocationMenu,
+	"%COMMONSTARTMENUDIR%": LocationMenu,
+	"%PROGRAMSDIR%":        LocationMenu,
+	"%COMMONPROGRAMSDIR%":  LocationMenu,
+	"%STARTUPDIR%":         LocationAutostart,
+	"%COMMONSTARTUPDIR%":   LocationAutostart,
+}
+
+// Shortcut is an item of the Group Policy Preferences "Shortcuts" extension.
+type Shortcut struct {
+	Name   string
+	Action string
+	// TargetType is one of the Shortcut target types constants.
+	TargetType string
+	TargetPath string
+	Arguments  string
+	StartIn    string
+	IconPath   string
+	Comment    string
+	// ShortcutPath is the path of the shortcut, starting with a folder variable like %DesktopDir%.
+	ShortcutPath string
+	Disabled     bool
+}
+
+type shortcutsXML struct {
+	XMLName   xml.Name `xml:"Shortcuts"`
+	Shortcuts []struct {
+		Name       string `xml:"name,attr"`
+		Disabled   string `xml:"disabled,attr"`
+		Properties struct {
+			Action       string `xml:"action,attr"`
+			TargetType   string `xml:"targetType,attr"`
+			TargetPath   string `xml:"targetPath,attr"`
+			Arguments    string `xml:"arguments,attr"`
+			StartIn      string `xml:"startIn,attr"`
+			IconPath     string `xml:"iconPath,attr"`
+			Comment      string `xml:"comment,attr"`
+			ShortcutPath string `xml:"shortcutPath,attr"`
+		} `xml:"Properties"`
+	} `xml:"Shortcut"`
+}
+
+// ParseShortcuts parses the Shortcuts.xml content of the Group Policy Preferences "Shortcuts" extension from r.
+// Items without an action are considered as updates, which is the default of the extension, and items without
+// target type are file system shortcuts.
+func ParseShortcuts(r io.Reader) (shortcuts []Shortcut, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse Group Policy Preferences shortcuts"))
+
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Files written by the Windows tools start with a byte order mark.
+	d = bytes.TrimPrefix(d, []byte("\xef\xbb\xbf"))
+
+	var x shortcutsXML
+	if err := xml.Unmarshal(d, &x); err != nil {
+		return nil, err
+	}
+
+	for _, s := range x.Shortcuts {
+		action := strings.ToUpper(s.Properties.Action)
+		if action == "" {
+			action = ActionUpdate
+		}
+		switch action {
+		case ActionCreate, ActionReplace, ActionUpdate, ActionDelete:
+		default:
+			return nil, errors.New(gotext.Get("unknown action %q for item %q", s.Properties.Action, s.Name))
+		}
+		targetType := strings.ToUpper(s.Properties.TargetType)
+		if targetType == "" {
+			targetType = ShortcutFileSystem
+		}
+		shortcuts = append(shortcuts, Shortcut{
+			Name:         s.Name,
+			Action:       action,
+			TargetType:   targetType,
+			TargetPath:   s.Properties.TargetPath,
+			Arguments:    s.Properties.Arguments,
+			StartIn:      s.Properties.StartIn,
+			IconPath:     s.Properties.IconPath,
+			Comment:      s.Properties.Comment,
+			ShortcutPath: s.Properties.ShortcutPath,
+			Disabled:     s.Disabled == "1",
+		})
+	}
+
+	return shortcuts, nil
+}
+
+// Location returns where the shortcut s is created, among the Location constants, and its name,
+// which is the last component of its path.
+// It returns false if the shortcut is not on the desktop, in the start menu or in the startup folder.
+func (s Shortcut) Location() (location, name string, ok bool) {
+	p := strings.ReplaceAll(s.ShortcutPath, "/", `\`)
+	folder, rest, _ := strings.Cut(p, `\`)
+	location, ok = shortcutLocations[strings.ToUpper(folder)]
+	if !ok {
+		return "", "", false
+	}
+	name = strings.TrimSpace(rest[strings.LastIndex(rest, `\`)+1:])
+	if name == "" {
+		name = strings.TrimSpace(s.Name)
+	}
+	if name == "" {
+		return "", "", false
+	}
+	return location, name, true
+}
+
+// IniFile is an item of the Group Policy Preferences "Ini Files" extension.
+type IniFile struct {
+	Name     string
+	Action   string
+	Path     string
+	Section  string
+	Property string
+	Value    string
+	Disabled bool
+}
+
+type iniFilesXML struct {
+	XMLName  xml.Name `xml:"IniFiles"`
+	IniFiles []struct {
+		Name       string `xml:"name,attr"`
+		Disabled   string `xml:"disabled,attr"`
+		Properties struct {
+			Action   string `xml:"action,attr"`
+			Path     string `xml:"path,attr"`
+			Section  string `xml:"section,attr"`
+			Property string `xml:"property,attr"`
+			Value    string `xml:"value,attr"`
+		} `xml:"Properties"`
+	} `xml:"Ini"`
+}
+
+// ParseIniFiles parses the IniFiles.xml content of the Group Policy Preferences "Ini Files" extension from r.
+// Items without an action are considered as updates, which is the default of the extension.
+func ParseIniFiles(r io.Reader) (iniFiles []IniFile, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse Group Policy Preferences ini files"))
+
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Files written by the Windows tools start with a byte order mark.
+	d = bytes.TrimPrefix(d, []byte("\xef\xbb\xbf"))
+
+	var x iniFilesXML
+	if err := xml.Unmarshal(d, &x); err != nil {
+		return nil, err
+	}
+
+	for _, i := range x.IniFiles {
+		action := strings.ToUpper(i.Properties.Action)
+		if action == "" {
+			action = ActionUpdate
+		}
+		switch action {
+		case ActionCreate, ActionReplace, ActionUpdate, ActionDelete:
+		default:
+			return nil, errors.New(gotext.Get("unknown action %q for item %q", i.Properties.Action, i.Name))
+		}
+		iniFiles = append(iniFiles, IniFile{
+			Name:     i.Name,
+			Action:   action,
+			Path:     i.Properties.Path,
+			Section:  i.Properties.Section,
+			Property: i.Properties.Property,
+			Value:    i.Properties.Value,
+			Disabled: i.Disabled == "1",
+		})
+	}
+
+	return iniFiles, nil
+}
+
+// Actions of the members of the Group Policy Preferences "Local Users and Groups" group items.
+const (
+	MemberAdd    = "ADD"
+	MemberRemove = "REMOVE"
+)
+
+// LocalUser is a user item of the Group Policy Preferences "Local Users and Groups" extension.
+type LocalUser struct {
+	Name     string
+	Action   string
+	UserName string
+	FullName string
+	// HasPassword is true if the item sets a password, which is not supported.
+	HasPassword     bool
+	AccountDisabled bool
+	Disabled        bool
+}
+
+// GroupMember is a member of a Group Policy Preferences "Local Users and Groups" group item.
+type GroupMember struct {
+	// Name is the name of the member, in the DOMAIN\name form for domain accounts.
+	Name   string
+	Action string
+}
+
+// LocalGroup is a group item of the Group Policy Preferences "Local Users and Groups" extension.
+type LocalGroup struct {
+	Name      string
+	Action    string
+	GroupName string
+	// DeleteAllUsers is true if the members not listed in the item are removed from the group.
+	DeleteAllUsers bool
+	Members        []GroupMember
+	Disabled       bool
+}
+
+type localUsersAndGroupsXML struct {
+	XMLName xml.Name `xml:"Groups"`
+	Items   []struct {
+		XMLName    xml.Name
+		Name       string `xml:"name,attr"`
+		Disabled   string `xml:"disabled,attr"`
+		Properties struct {
+			Action         string `xml:"action,attr"`
+			UserName       string `xml:"userName,attr"`
+			FullName       string `xml:"fullName,attr"`
+			CPassword      string `xml:"cpassword,attr"`
+			AcctDisabled   string `xml:"acctDisabled,attr"`
+			GroupName      string `xml:"groupName,attr"`
+			DeleteAllUsers string `xml:"deleteAllUsers,attr"`
+			Members        []struct {
+				Name   string `xml:"name,attr"`
+				Action string `xml:"action,attr"`
+			} `xml:"Members>Member"`
+		} `xml:"Properties"`
+	} `xml:",any"`
+}
+
+// ParseLocalUsersAndGroups parses the Groups.xml content of the Group Policy Preferences "Local Users and Groups"
+// extension from r, returning the user and group items, in order.
+// Items without an action are considered as updates, which is the default of the extension, and members without
+// an action are added to the group.
+func ParseLocalUsersAndGroups(r io.Reader) (users []LocalUser, groups []LocalGroup, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't parse Group Policy Preferences local users and groups"))
+
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Files written by the Windows tools start with a byte order mark.
+	d = bytes.TrimPrefix(d, []byte("\xef\xbb\xbf"))
+
+	var x localUsersAndGroupsXML
+	if err := xml.Unmarshal(d, &x); err != nil {
+		return nil, nil, err
+	}
+
+	for _, i := range x.Items {
+		action := strings.ToUpper(i.Properties.Action)
+		if action == "" {
+			action = ActionUpdate
+		}
+		switch action {
+		case ActionCreate, ActionReplace, ActionUpdate, ActionDelete:
+		default:
+			return nil, nil, errors.New(gotext.Get("unknown action %q for item %q", i.Properties.Action, i.Name))
+		}
+
+		switch i.XMLName.Local {
+		case "User":
+			users = append(users, LocalUser{
+				Name:            i.Name,
+				Action:          action,
+				UserName:        i.Properties.UserName,
+				FullName:        i.Properties.FullName,
+				HasPassword:     i.Properties.CPassword != "",
+				AccountDisabled: i.Properties.AcctDisabled == "1",
+				Disabled:        i.Disabled == "1",
+			})
+		case "Group":
+			g := LocalGroup{
+				Name:           i.Name,
+				Action:         action,
+				GroupName:      i.Properties.GroupName,
+				DeleteAllUsers: i.Properties.DeleteAllUsers == "1",
+				Disabled:       i.Disabled == "1",
+			}
+			for _, m := range i.Properties.Members {
+				memberAction := strings.ToUpper(m.Action)
+				if memberAction == "" {
+					memberAction = MemberAdd
+				}
+				if memberAction != MemberAdd && memberAction != MemberRemove {
+					return nil, nil, errors.New(gotext.Get("unknown action %q for member %q of item %q", m.Action, m.Name, i.Name))
+				}
+				g.Members = append(g.Members, GroupMember{Name: m.Name, Action: memberAction})
+			}
+			groups = append(groups, g)
+		default:
+			return nil, nil, errors.New(gotext.Get("unknown item type %q", i.XMLName.Local))
+		}
+	}
+
+	return users, groups, nil
+}
+
+// AssetsPath returns the path of the UNC path p relative to the dir directory of the distroID assets
+// share on SYSVOL, in slash-separated form.
+// It returns false if p is not in this directory.
+func AssetsPath(p, distroID, dir string) (string, bool) {
+	// \\<server>\SYSVOL\<domain>\<distroID>\<dir>\<path>
+	parts := strings.Split(strings.ReplaceAll(p, `\`, "/"), "/")
+	if len(parts) < 8 || parts[0] != "" || parts[1] != "" || parts[2] == "" || parts[4] == "" {
+		return "", false
+	}
+	if !strings.EqualFold(parts[3], "SYSVOL") || !strings.EqualFold(parts[5], distroID) || !strings.EqualFold(parts[6], dir) {
+		return "", false
+	}
+
+	rel := path.Join(parts[7:]...)
+	if rel == "" || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
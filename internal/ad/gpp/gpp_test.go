@@ -0,0 +1,450 @@
+package gpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/ad/gpp"
+)
+
+func TestParseFiles(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		content string
+
+		want    []gpp.File
+		wantErr bool
+	}{
+		"One item": {
+			content: `<Files><File name="app.conf"><Properties action="U" fromPath="\\example.com\SYSVOL\example.com\Ubuntu\files\app.conf" targetPath="/etc/app.conf"/></File></Files>`,
+			want:    []gpp.File{{Name: "app.conf", Action: gpp.ActionUpdate, FromPath: `\\example.com\SYSVOL\example.com\Ubuntu\files\app.conf`, TargetPath: "/etc/app.conf"}},
+		},
+		"Multiple items, in order": {
+			content: `<?xml version="1.0" encoding="utf-8"?>
+<Files clsid="{215B2E53-57CE-475c-80FE-9EEC14635851}">
+	<File clsid="{50BE44C8-567A-4ed1-B1D0-9234FE1F38AF}" name="b.conf" image="1"><Properties action="R" fromPath="\\dc\SYSVOL\example.com\Ubuntu\files\b.conf" targetPath="/etc/b.conf" readOnly="0"/></File>
+	<File clsid="{50BE44C8-567A-4ed1-B1D0-9234FE1F38AF}" name="a.conf" image="0"><Properties action="C" fromPath="\\dc\SYSVOL\example.com\Ubuntu\files\a.conf" targetPath="/etc/a.conf"/></File>
+</Files>`,
+			want: []gpp.File{
+				{Name: "b.conf", Action: gpp.ActionReplace, FromPath: `\\dc\SYSVOL\example.com\Ubuntu\files\b.conf`, TargetPath: "/etc/b.conf"},
+				{Name: "a.conf", Action: gpp.ActionCreate, FromPath: `\\dc\SYSVOL\example.com\Ubuntu\files\a.conf`, TargetPath: "/etc/a.conf"},
+			},
+		},
+		"Byte order mark is ignored": {
+			content: "\xef\xbb\xbf" + `<Files><File name="app.conf"><Properties action="U" fromPath="src" targetPath="/etc/app.conf"/></File></Files>`,
+			want:    []gpp.File{{Name: "app.conf", Action: gpp.ActionUpdate, FromPath: "src", TargetPath: "/etc/app.conf"}},
+		},
+		"Disabled item": {
+			content: `<Files><File name="app.conf" disabled="1"><Properties action="U" fromPath="src" targetPath="/etc/app.conf"/></File></Files>`,
+			want:    []gpp.File{{Name: "app.conf", Action: gpp.ActionUpdate, FromPath: "src", TargetPath: "/etc/app.conf", Disabled: true}},
+		},
+		"Delete item": {
+			content: `<Files><File name="app.conf"><Properties action="D" targetPath="/etc/app.conf"/></File></Files>`,
+			want:    []gpp.File{{Name: "app.conf", Action: gpp.ActionDelete, TargetPath: "/etc/app.conf"}},
+		},
+		"Action is case insensitive": {
+			content: `<Files><File name="app.conf"><Properties action="r" fromPath="src" targetPath="/etc/app.conf"/></File></Files>`,
+			want:    []gpp.File{{Name: "app.conf", Action: gpp.ActionReplace, FromPath: "src", TargetPath: "/etc/app.conf"}},
+		},
+		"Missing action defaults to update": {
+			content: `<Files><File name="app.conf"><Properties fromPath="src" targetPath="/etc/app.conf"/></File></Files>`,
+			want:    []gpp.File{{Name: "app.conf", Action: gpp.ActionUpdate, FromPath: "src", TargetPath: "/etc/app.conf"}},
+		},
+		"No items": {content: `<Files></Files>`},
+
+		// Error cases
+		"Error on unknown action": {content: `<Files><File name="app.conf"><Properties action="X" fromPath="src" targetPath="/etc/app.conf"/></File></Files>`, wantErr: true},
+		"Error on invalid XML":    {content: `<Files><File>`, wantErr: true},
+		"Error on other root":     {content: `<Shortcuts></Shortcuts>`, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := gpp.ParseFiles(strings.NewReader(tc.content))
+			if tc.wantErr {
+				require.Error(t, err, "ParseFiles should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ParseFiles failed but shouldn't have")
+			require.Equal(t, tc.want, got, "ParseFiles returned unexpected items")
+		})
+	}
+}
+
+func TestAssetsPath(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		path string
+
+		want   string
+		wantOk bool
+	}{
+		"File in assets directory":        {path: `\\example.com\SYSVOL\example.com\Ubuntu\files\app.conf`, want: "app.conf", wantOk: true},
+		"File in assets subdirectory":     {path: `\\dc.example.com\SYSVOL\example.com\Ubuntu\files\sub\banner.txt`, want: "sub/banner.txt", wantOk: true},
+		"Path components are insensitive": {path: `\\example.com\sysvol\example.com\UBUNTU\Files\app.conf`, want: "app.conf", wantOk: true},
+		"Path with slashes":               {path: `//example.com/SYSVOL/example.com/Ubuntu/files/app.conf`, want: "app.conf", wantOk: true},
+		"Not in the distribution assets":  {path: `\\example.com\SYSVOL\example.com\Other\files\app.conf`},
+		"Not in the assets directory":     {path: `\\example.com\SYSVOL\example.com\Ubuntu\scripts\app.conf`},
+		"Not on SYSVOL":                   {path: `\\example.com\share\example.com\Ubuntu\files\app.conf`},
+		"Not a UNC path":                  {path: `C:\Ubuntu\files\app.conf`},
+		"Assets directory itself":         {path: `\\example.com\SYSVOL\example.com\Ubuntu\files\`},
+		"Escaping the assets directory":   {path: `\\example.com\SYSVOL\example.com\Ubuntu\files\..\scripts\script.sh`},
+		"Missing server":                  {path: `\\\SYSVOL\example.com\Ubuntu\files\app.conf`},
+		"Empty path":                      {},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := gpp.AssetsPath(tc.path, "Ubuntu", "files")
+			require.Equal(t, tc.wantOk, ok, "AssetsPath should report if the path is in the assets directory")
+			require.Equal(t, tc.want, got, "AssetsPath returned unexpected path")
+		})
+	}
+}
+
+func TestParsePrinters(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		content string
+
+		want    []gpp.Printer
+		wantErr bool
+	}{
+		"Shared printer": {
+			content: `<Printers><SharedPrinter name="Office"><Properties action="U" path="\\print.example.com\Office" location="Floor 1" comment="Office printer" default="1"/></SharedPrinter></Printers>`,
+			want:    []gpp.Printer{{Name: "Office", Type: gpp.PrinterShared, Action: gpp.ActionUpdate, Path: `\\print.example.com\Office`, Location: "Floor 1", Comment: "Office printer", Default: true}},
+		},
+		"TCP/IP printer": {
+			content: `<Printers><PortPrinter name="Hall"><Properties action="C" ipAddress="10.0.0.12" portNumber="9100" protocol="PROTOCOL_RAWTCP_TYPE" localName="Hall printer" default="0"/></PortPrinter></Printers>`,
+			want:    []gpp.Printer{{Name: "Hall", Type: gpp.PrinterPort, Action: gpp.ActionCreate, IPAddress: "10.0.0.12", Port: "9100", Protocol: "PROTOCOL_RAWTCP_TYPE", LocalName: "Hall printer"}},
+		},
+		"Multiple items, in order": {
+			content: "\xef\xbb\xbf" + `<?xml version="1.0" encoding="utf-8"?>
+<Printers clsid="{1F577D12-3D1B-471e-A1B7-060317597B9C}">
+	<PortPrinter clsid="{C3A739D2-4A44-401e-9F9D-88E5E77DFB3E}" name="Hall" disabled="1"><Properties action="R" ipAddress="10.0.0.12" protocol="PROTOCOL_LPR_TYPE" lprQueue="hall"/></PortPrinter>
+	<LocalPrinter clsid="{F08996C6-F5D8-4c3c-9A2E-4E0C8E1C1B1D}" name="Local"><Properties action="U" port="LPT1:"/></LocalPrinter>
+	<SharedPrinter clsid="{9A5E9697-9095-436d-A0EE-4D128FDFBCE5}" name="Office"><Properties action="D" path="\\print.example.com\Office"/></SharedPrinter>
+</Printers>`,
+			want: []gpp.Printer{
+				{Name: "Hall", Type: gpp.PrinterPort, Action: gpp.ActionReplace, IPAddress: "10.0.0.12", Protocol: "PROTOCOL_LPR_TYPE", LPRQueue: "hall", Disabled: true},
+				{Name: "Local", Type: gpp.PrinterLocal, Action: gpp.ActionUpdate},
+				{Name: "Office", Type: gpp.PrinterShared, Action: gpp.ActionDelete, Path: `\\print.example.com\Office`},
+			},
+		},
+		"Missing action defaults to update": {
+			content: `<Printers><SharedPrinter name="Office"><Properties path="\\print.example.com\Office"/></SharedPrinter></Printers>`,
+			want:    []gpp.Printer{{Name: "Office", Type: gpp.PrinterShared, Action: gpp.ActionUpdate, Path: `\\print.example.com\Office`}},
+		},
+		"No items": {content: `<Printers></Printers>`},
+
+		// Error cases
+		"Error on unknown action": {content: `<Printers><SharedPrinter name="Office"><Properties action="X"/></SharedPrinter></Printers>`, wantErr: true},
+		"Error on invalid XML":    {content: `<Printers><SharedPrinter>`, wantErr: true},
+		"Error on other root":     {content: `<Files></Files>`, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := gpp.ParsePrinters(strings.NewReader(tc.content))
+			if tc.wantErr {
+				require.Error(t, err, "ParsePrinters should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ParsePrinters failed but shouldn't have")
+			require.Equal(t, tc.want, got, "ParsePrinters returned unexpected items")
+		})
+	}
+}
+
+func TestPrinterURIAndQueueName(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		printer gpp.Printer
+
+		wantURI   string
+		wantOk    bool
+		wantQueue string
+	}{
+		"Shared printer":                 {printer: gpp.Printer{Name: "Office", Type: gpp.PrinterShared, Path: `\\print.example.com\Office`}, wantURI: "smb://print.example.com/Office", wantOk: true, wantQueue: "Office"},
+		"Shared printer with spaces":     {printer: gpp.Printer{Name: "Main office", Type: gpp.PrinterShared, Path: `\\print.example.com\Main office`}, wantURI: "smb://print.example.com/Main%20office", wantOk: true, wantQueue: "Main_office"},
+		"TCP/IP printer":                 {printer: gpp.Printer{Name: "Hall", Type: gpp.PrinterPort, IPAddress: "10.0.0.12", Port: "9101"}, wantURI: "socket://10.0.0.12:9101", wantOk: true, wantQueue: "Hall"},
+		"TCP/IP printer on default port": {printer: gpp.Printer{Name: "Hall", Type: gpp.PrinterPort, IPAddress: "10.0.0.12"}, wantURI: "socket://10.0.0.12:9100", wantOk: true, wantQueue: "Hall"},
+		"TCP/IP printer with local name": {printer: gpp.Printer{Name: "Hall", Type: gpp.PrinterPort, IPAddress: "10.0.0.12", LocalName: "Hall #2"}, wantURI: "socket://10.0.0.12:9100", wantOk: true, wantQueue: "Hall__2"},
+		"LPR printer":                    {printer: gpp.Printer{Name: "Hall", Type: gpp.PrinterPort, IPAddress: "10.0.0.12", Protocol: "PROTOCOL_LPR_TYPE", LPRQueue: "hall"}, wantURI: "lpd://10.0.0.12/hall", wantOk: true, wantQueue: "Hall"},
+
+		"Shared printer without share":   {printer: gpp.Printer{Name: "Office", Type: gpp.PrinterShared, Path: `\\print.example.com\`}, wantQueue: ""},
+		"Shared printer not on a server": {printer: gpp.Printer{Name: "Office", Type: gpp.PrinterShared, Path: `C:\Office`}, wantQueue: "Office"},
+		"TCP/IP printer without address": {printer: gpp.Printer{Name: "Hall", Type: gpp.PrinterPort}, wantQueue: "Hall"},
+		"LPR printer without queue":      {printer: gpp.Printer{Name: "Hall", Type: gpp.PrinterPort, IPAddress: "10.0.0.12", Protocol: "PROTOCOL_LPR_TYPE"}, wantQueue: "Hall"},
+		"Local printer":                  {printer: gpp.Printer{Name: "Local", Type: gpp.PrinterLocal}, wantQueue: "Local"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			uri, ok := tc.printer.URI()
+			require.Equal(t, tc.wantOk, ok, "URI should report if the printer is supported")
+			require.Equal(t, tc.wantURI, uri, "URI returned unexpected device URI")
+			require.Equal(t, tc.wantQueue, tc.printer.QueueName(), "QueueName returned unexpected name")
+		})
+	}
+}
+
+func TestParseShortcuts(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		content string
+
+		want    []gpp.Shortcut
+		wantErr bool
+	}{
+		"URL shortcut": {
+			content: `<Shortcuts><Shortcut name="Intranet"><Properties action="U" targetType="URL" targetPath="https://intranet.example.com" iconPath="\\example.com\SYSVOL\example.com\Ubuntu\shortcuts\intranet.png" comment="Company intranet" shortcutPath="%DesktopDir%\Intranet"/></Shortcut></Shortcuts>`,
+			want: []gpp.Shortcut{{Name: "Intranet", Action: gpp.ActionUpdate, TargetType: gpp.ShortcutURL, TargetPath: "https://intranet.example.com",
+				IconPath: `\\example.com\SYSVOL\example.com\Ubuntu\shortcuts\intranet.png`, Comment: "Company intranet", ShortcutPath: `%DesktopDir%\Intranet`}},
+		},
+		"File system shortcut": {
+			content: `<Shortcuts><Shortcut name="Terminal"><Properties action="C" targetType="FILESYSTEM" targetPath="/usr/bin/gnome-terminal" arguments="--maximize" startIn="/tmp" shortcutPath="%ProgramsDir%\Tools\Terminal"/></Shortcut></Shortcuts>`,
+			want: []gpp.Shortcut{{Name: "Terminal", Action: gpp.ActionCreate, TargetType: gpp.ShortcutFileSystem, TargetPath: "/usr/bin/gnome-terminal",
+				Arguments: "--maximize", StartIn: "/tmp", ShortcutPath: `%ProgramsDir%\Tools\Terminal`}},
+		},
+		"Multiple items, in order": {
+			content: "\xef\xbb\xbf" + `<?xml version="1.0" encoding="utf-8"?>
+<Shortcuts clsid="{872ECB34-B2EC-401b-A585-D32574AA90EE}">
+	<Shortcut clsid="{4F2F7C55-2790-433e-8127-0739D1CFA327}" name="Wiki" disabled="1"><Properties action="R" targetType="URL" targetPath="https://wiki.example.com" shortcutPath="%StartMenuDir%\Wiki"/></Shortcut>
+	<Shortcut clsid="{4F2F7C55-2790-433e-8127-0739D1CFA327}" name="Computer"><Properties action="D" targetType="SHELL" targetPath="::{20D04FE0-3AEA-1069-A2D8-08002B30309D}" shortcutPath="%DesktopDir%\Computer"/></Shortcut>
+</Shortcuts>`,
+			want: []gpp.Shortcut{
+				{Name: "Wiki", Action: gpp.ActionReplace, TargetType: gpp.ShortcutURL, TargetPath: "https://wiki.example.com", ShortcutPath: `%StartMenuDir%\Wiki`, Disabled: true},
+				{Name: "Computer", Action: gpp.ActionDelete, TargetType: gpp.ShortcutShell, TargetPath: "::{20D04FE0-3AEA-1069-A2D8-08002B30309D}", ShortcutPath: `%DesktopDir%\Computer`},
+			},
+		},
+		"Missing action and target type default to file system update": {
+			content: `<Shortcuts><Shortcut name="Docs"><Properties targetPath="/srv/docs" shortcutPath="%DesktopDir%\Docs"/></Shortcut></Shortcuts>`,
+			want:    []gpp.Shortcut{{Name: "Docs", Action: gpp.ActionUpdate, TargetType: gpp.ShortcutFileSystem, TargetPath: "/srv/docs", ShortcutPath: `%DesktopDir%\Docs`}},
+		},
+		"Target type is case insensitive": {
+			content: `<Shortcuts><Shortcut name="Intranet"><Properties targetType="url" targetPath="https://intranet.example.com" shortcutPath="%DesktopDir%\Intranet"/></Shortcut></Shortcuts>`,
+			want:    []gpp.Shortcut{{Name: "Intranet", Action: gpp.ActionUpdate, TargetType: gpp.ShortcutURL, TargetPath: "https://intranet.example.com", ShortcutPath: `%DesktopDir%\Intranet`}},
+		},
+		"No items": {content: `<Shortcuts></Shortcuts>`},
+
+		// Error cases
+		"Error on unknown action": {content: `<Shortcuts><Shortcut name="Intranet"><Properties action="X"/></Shortcut></Shortcuts>`, wantErr: true},
+		"Error on invalid XML":    {content: `<Shortcuts><Shortcut>`, wantErr: true},
+		"Error on other root":     {content: `<Files></Files>`, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := gpp.ParseShortcuts(strings.NewReader(tc.content))
+			if tc.wantErr {
+				require.Error(t, err, "ParseShortcuts should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ParseShortcuts failed but shouldn't have")
+			require.Equal(t, tc.want, got, "ParseShortcuts returned unexpected items")
+		})
+	}
+}
+
+func TestShortcutLocation(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		shortcut gpp.Shortcut
+
+		wantLocation string
+		wantName     string
+		wantOk       bool
+	}{
+		"Desktop":                        {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%DesktopDir%\Intranet`}, wantLocation: gpp.LocationDesktop, wantName: "Intranet", wantOk: true},
+		"Common desktop":                 {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%CommonDesktopDir%\Intranet`}, wantLocation: gpp.LocationDesktop, wantName: "Intranet", wantOk: true},
+		"Start menu":                     {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%StartMenuDir%\Intranet`}, wantLocation: gpp.LocationMenu, wantName: "Intranet", wantOk: true},
+		"Programs in a subfolder":        {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%CommonProgramsDir%\Company\Tools\Terminal`}, wantLocation: gpp.LocationMenu, wantName: "Terminal", wantOk: true},
+		"Folder variable is insensitive": {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%desktopdir%\Intranet`}, wantLocation: gpp.LocationDesktop, wantName: "Intranet", wantOk: true},
+		"Path with slashes":              {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%ProgramsDir%/Company/Wiki`}, wantLocation: gpp.LocationMenu, wantName: "Wiki", wantOk: true},
+		"Name defaults to the item name": {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%DesktopDir%`}, wantLocation: gpp.LocationDesktop, wantName: "Item", wantOk: true},
+		"Startup folder":                 {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%StartupDir%\Chat`}, wantLocation: gpp.LocationAutostart, wantName: "Chat", wantOk: true},
+		"Common startup folder":          {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%CommonStartupDir%\Chat`}, wantLocation: gpp.LocationAutostart, wantName: "Chat", wantOk: true},
+
+		"Unsupported folder": {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `%FavoritesDir%\Intranet`}},
+		"Absolute path":      {shortcut: gpp.Shortcut{Name: "Item", ShortcutPath: `C:\Users\Public\Desktop\Intranet`}},
+		"No name":            {shortcut: gpp.Shortcut{ShortcutPath: `%DesktopDir%\`}},
+		"Empty path":         {shortcut: gpp.Shortcut{Name: "Item"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			location, shortcutName, ok := tc.shortcut.Location()
+			require.Equal(t, tc.wantOk, ok, "Location should report if the shortcut location is supported")
+			require.Equal(t, tc.wantLocation, location, "Location returned unexpected location")
+			require.Equal(t, tc.wantName, shortcutName, "Location returned unexpected name")
+		})
+	}
+}
+
+func TestParseIniFiles(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		content string
+
+		want    []gpp.IniFile
+		wantErr bool
+	}{
+		"One item": {
+			content: `<IniFiles><Ini name="Enabled"><Properties action="U" path="C:\ProgramData\App\app.ini" section="Main" property="Enabled" value="1"/></Ini></IniFiles>`,
+			want:    []gpp.IniFile{{Name: "Enabled", Action: gpp.ActionUpdate, Path: `C:\ProgramData\App\app.ini`, Section: "Main", Property: "Enabled", Value: "1"}},
+		},
+		"Multiple items, in order": {
+			content: "\xef\xbb\xbf" + `<?xml version="1.0" encoding="utf-8"?>
+<IniFiles clsid="{694C651A-08F2-47fa-A427-34C4F62BA207}">
+	<Ini clsid="{EEFACE84-D3D8-4680-8D4B-BF103E759448}" name="Server" disabled="1"><Properties action="C" path="%ProgramDataDir%\App\app.ini" section="Network" property="Server" value="srv.example.com, backup.example.com"/></Ini>
+	<Ini clsid="{EEFACE84-D3D8-4680-8D4B-BF103E759448}" name="Legacy"><Properties action="D" path="%ProgramDataDir%\App\app.ini" section="Legacy" property="" value=""/></Ini>
+</IniFiles>`,
+			want: []gpp.IniFile{
+				{Name: "Server", Action: gpp.ActionCreate, Path: `%ProgramDataDir%\App\app.ini`, Section: "Network", Property: "Server", Value: "srv.example.com, backup.example.com", Disabled: true},
+				{Name: "Legacy", Action: gpp.ActionDelete, Path: `%ProgramDataDir%\App\app.ini`, Section: "Legacy"},
+			},
+		},
+		"Missing action defaults to update": {
+			content: `<IniFiles><Ini name="Enabled"><Properties path="/etc/app.conf" section="Main" property="Enabled" value="1"/></Ini></IniFiles>`,
+			want:    []gpp.IniFile{{Name: "Enabled", Action: gpp.ActionUpdate, Path: "/etc/app.conf", Section: "Main", Property: "Enabled", Value: "1"}},
+		},
+		"No items": {content: `<IniFiles></IniFiles>`},
+
+		// Error cases
+		"Error on unknown action": {content: `<IniFiles><Ini name="Enabled"><Properties action="X"/></Ini></IniFiles>`, wantErr: true},
+		"Error on invalid XML":    {content: `<IniFiles><Ini>`, wantErr: true},
+		"Error on other root":     {content: `<Files></Files>`, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := gpp.ParseIniFiles(strings.NewReader(tc.content))
+			if tc.wantErr {
+				require.Error(t, err, "ParseIniFiles should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ParseIniFiles failed but shouldn't have")
+			require.Equal(t, tc.want, got, "ParseIniFiles returned unexpected items")
+		})
+	}
+}
+
+func TestParseLocalUsersAndGroups(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		content string
+
+		wantUsers  []gpp.LocalUser
+		wantGroups []gpp.LocalGroup
+		wantErr    bool
+	}{
+		"One user": {
+			content:   `<Groups><User name="alice"><Properties action="C" userName="alice" fullName="Alice Smith"/></User></Groups>`,
+			wantUsers: []gpp.LocalUser{{Name: "alice", Action: gpp.ActionCreate, UserName: "alice", FullName: "Alice Smith"}},
+		},
+		"One group": {
+			content:    `<Groups><Group name="docker"><Properties action="U" groupName="docker"><Members><Member name="EXAMPLE\devs" action="ADD" sid="S-1-5-21-1-2-3-1105"/></Members></Properties></Group></Groups>`,
+			wantGroups: []gpp.LocalGroup{{Name: "docker", Action: gpp.ActionUpdate, GroupName: "docker", Members: []gpp.GroupMember{{Name: `EXAMPLE\devs`, Action: gpp.MemberAdd}}}},
+		},
+		"Multiple items, in order": {
+			content: "\xef\xbb\xbf" + `<?xml version="1.0" encoding="utf-8"?>
+<Groups clsid="{3125E937-EB16-4b4c-9934-544FC6D24D26}">
+	<User clsid="{DF5F1855-51E5-4d24-8B1A-D9BDE98BA1D1}" name="kiosk" image="2"><Properties action="U" newName="" fullName="" description="" cpassword="secret" changeLogon="0" noChange="0" neverExpires="1" acctDisabled="1" userName="kiosk"/></User>
+	<Group clsid="{6D4A79E4-529C-4481-ABD0-F5BD7EA93BA7}" name="lpadmin" disabled="1"><Properties action="R" newName="" description="" deleteAllUsers="1" deleteAllGroups="0" removeAccounts="0" groupName="lpadmin">
+		<Members>
+			<Member name="EXAMPLE\helpdesk" action="ADD" sid=""/>
+			<Member name="bob" action="remove" sid=""/>
+		</Members>
+	</Properties></Group>
+	<User clsid="{DF5F1855-51E5-4d24-8B1A-D9BDE98BA1D1}" name="guest"><Properties action="D" userName="guest"/></User>
+	<Group clsid="{6D4A79E4-529C-4481-ABD0-F5BD7EA93BA7}" name="legacy"><Properties action="D" groupName="legacy"/></Group>
+</Groups>`,
+			wantUsers: []gpp.LocalUser{
+				{Name: "kiosk", Action: gpp.ActionUpdate, UserName: "kiosk", HasPassword: true, AccountDisabled: true},
+				{Name: "guest", Action: gpp.ActionDelete, UserName: "guest"},
+			},
+			wantGroups: []gpp.LocalGroup{
+				{Name: "lpadmin", Action: gpp.ActionReplace, GroupName: "lpadmin", DeleteAllUsers: true, Disabled: true, Members: []gpp.GroupMember{
+					{Name: `EXAMPLE\helpdesk`, Action: gpp.MemberAdd},
+					{Name: "bob", Action: gpp.MemberRemove},
+				}},
+				{Name: "legacy", Action: gpp.ActionDelete, GroupName: "legacy"},
+			},
+		},
+		"Missing actions default to update and add": {
+			content:    `<Groups><Group name="docker"><Properties groupName="docker"><Members><Member name="alice"/></Members></Properties></Group></Groups>`,
+			wantGroups: []gpp.LocalGroup{{Name: "docker", Action: gpp.ActionUpdate, GroupName: "docker", Members: []gpp.GroupMember{{Name: "alice", Action: gpp.MemberAdd}}}},
+		},
+		"No items": {content: `<Groups></Groups>`},
+
+		// Error cases
+		"Error on unknown action":        {content: `<Groups><User name="alice"><Properties action="X" userName="alice"/></User></Groups>`, wantErr: true},
+		"Error on unknown member action": {content: `<Groups><Group name="docker"><Properties groupName="docker"><Members><Member name="alice" action="KEEP"/></Members></Properties></Group></Groups>`, wantErr: true},
+		"Error on unknown item type":     {content: `<Groups><Computer name="alice"><Properties/></Computer></Groups>`, wantErr: true},
+		"Error on invalid XML":           {content: `<Groups><User>`, wantErr: true},
+		"Error on other root":            {content: `<Files></Files>`, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			users, groups, err := gpp.ParseLocalUsersAndGroups(strings.NewReader(tc.content))
+			if tc.wantErr {
+				require.Error(t, err, "ParseLocalUsersAndGroups should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ParseLocalUsersAndGroups failed but shouldn't have")
+			require.Equal(t, tc.wantUsers, users, "ParseLocalUsersAndGroups returned unexpected users")
+			require.Equal(t, tc.wantGroups, groups, "ParseLocalUsersAndGroups returned unexpected groups")
+		})
+	}
+}
+
+func TestApplyMode(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		action string
+
+		want string
+	}{
+		"Create":                   {action: gpp.ActionCreate, want: "create"},
+		"Replace":                  {action: gpp.ActionReplace, want: "replace"},
+		"Update":                   {action: gpp.ActionUpdate, want: "update"},
+		"Delete":                   {action: gpp.ActionDelete, want: "delete"},
+		"Unknown action is update": {action: "X", want: "update"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.want, gpp.ApplyMode(tc.action), "ApplyMode returned unexpected mode")
+		})
+	}
+}
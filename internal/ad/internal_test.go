@@ -1,15 +1,18 @@
 package ad
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -578,6 +581,62 @@ func TestParseGPOConcurrent(t *testing.T) {
 
 const SmbPort = 1445
 
+func TestBandwidthLimiter(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		rate    int
+		offPeak string
+		at      string
+		size    int
+
+		wantSlept time.Duration
+	}{
+		"Download within the first second burst is not delayed":    {rate: 1000, at: "12:00", size: 1000},
+		"Download exceeding the rate is delayed":                   {rate: 1000, at: "12:00", size: 3500, wantSlept: 2500 * time.Millisecond},
+		"Download is not limited without any rate":                 {at: "12:00", size: 3500},
+		"Download is not limited during off-peak window":           {rate: 1000, offPeak: "11:00-13:00", at: "12:00", size: 3500},
+		"Download is not limited in off-peak window over midnight": {rate: 1000, offPeak: "22:00-06:00", at: "01:30", size: 3500},
+		"Download is limited outside of off-peak window":           {rate: 1000, offPeak: "22:00-06:00", at: "06:00", size: 3500, wantSlept: 2500 * time.Millisecond},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			at, err := time.ParseInLocation("15:04", tc.at, time.Local)
+			require.NoError(t, err, "Setup: invalid time")
+			offPeak, err := parseOffPeakWindow(tc.offPeak)
+			require.NoError(t, err, "Setup: invalid off-peak window")
+
+			// Time only moves forward when the limiter sleeps.
+			now := at
+			var slept time.Duration
+			l := newBandwidthLimiter(tc.rate, offPeak, func() time.Time { return now })
+			l.sleep = func(_ context.Context, d time.Duration) error {
+				slept += d
+				now = now.Add(d)
+				return nil
+			}
+
+			data, err := io.ReadAll(l.reader(context.Background(), bytes.NewReader(make([]byte, tc.size))))
+			require.NoError(t, err, "ReadAll should not have failed")
+			require.Len(t, data, tc.size, "All the data should have been read")
+			require.InDelta(t, tc.wantSlept, slept, float64(10*time.Millisecond), "Download should have been delayed by the limiter")
+		})
+	}
+}
+
+func TestBandwidthLimiterInterrupted(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	l := newBandwidthLimiter(1000, nil, time.Now)
+	_, err := io.ReadAll(l.reader(ctx, bytes.NewReader(make([]byte, 3000))))
+	require.Error(t, err, "ReadAll should have failed on cancelled context")
+}
+
 func TestMain(m *testing.M) {
 	// Don’t setup samba or sssd for mock helpers
 	if strings.Contains(strings.Join(os.Args, " "), "TestMock") {
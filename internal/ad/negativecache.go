@@ -0,0 +1,104 @@
+package ad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+)
+
+// negativeCacheEntry is a user whose last policy lookup failed or returned no applicable GPO.
+type negativeCacheEntry struct {
+	// err is the error of the last lookup, nil if the user has no applicable GPOs.
+	err error
+	// failures is the number of consecutive negative lookups, used to compute the backoff.
+	failures int
+	// until is the time after which the user is looked up again.
+	until time.Time
+}
+
+// reason returns a human readable description of why e is cached.
+func (e negativeCacheEntry) reason() string {
+	if e.err == nil {
+		return gotext.Get("no applicable GPOs")
+	}
+	return gotext.Get("lookup failed: %v", e.err)
+}
+
+// checkNegativeCache returns true if objectName is in the negative cache and shouldn't be looked up in AD yet.
+// The returned error is the one of the cached failed lookup, if any.
+func (ad *AD) checkNegativeCache(ctx context.Context, objectName string) (cached bool, err error) {
+	ad.negativeCacheMu.Lock()
+	defer ad.negativeCacheMu.Unlock()
+
+	e, ok := ad.negativeCache[objectName]
+	if !ok || !ad.now().Before(e.until) {
+		return false, nil
+	}
+
+	log.Debugf(ctx, "Skipping AD lookup for %q until %s: %s", objectName, e.until.Format(time.TimeOnly), e.reason())
+	if e.err != nil {
+		return true, errors.New(gotext.Get("%v (cached until %s)", e.err, e.until.Format(time.TimeOnly)))
+	}
+	return true, nil
+}
+
+// addToNegativeCache records a negative lookup for objectName, with err being nil if it has no applicable GPOs.
+// The time before the next lookup doubles on each consecutive negative lookup, up to the maximum negative cache duration.
+func (ad *AD) addToNegativeCache(ctx context.Context, objectName string, err error) {
+	if ad.negativeCacheTTL <= 0 {
+		return
+	}
+
+	ad.negativeCacheMu.Lock()
+	defer ad.negativeCacheMu.Unlock()
+
+	e := ad.negativeCache[objectName]
+	e.err = err
+	e.failures++
+
+	ttl := ad.negativeCacheTTL
+	for i := 1; i < e.failures && ttl < ad.negativeCacheMaxTTL; i++ {
+		ttl *= 2
+	}
+	ttl = min(ttl, ad.negativeCacheMaxTTL)
+	e.until = ad.now().Add(ttl)
+
+	log.Debugf(ctx, "Caching negative lookup for %q for %s: %s", objectName, ttl, e.reason())
+	ad.negativeCache[objectName] = e
+}
+
+// removeFromNegativeCache forgets any previous negative lookup of objectName.
+func (ad *AD) removeFromNegativeCache(objectName string) {
+	ad.negativeCacheMu.Lock()
+	defer ad.negativeCacheMu.Unlock()
+
+	delete(ad.negativeCache, objectName)
+}
+
+// negativeCacheInfo returns a description of the users currently in the negative cache, sorted by name.
+// It is empty if no user is cached.
+func (ad *AD) negativeCacheInfo() string {
+	ad.negativeCacheMu.Lock()
+	defer ad.negativeCacheMu.Unlock()
+
+	now := ad.now()
+	var users []string
+	for name, e := range ad.negativeCache {
+		if !now.Before(e.until) {
+			continue
+		}
+		users = append(users, fmt.Sprintf("  %s: %s, next lookup at %s (%d negative lookups)", name, e.reason(), e.until.Format(time.TimeOnly), e.failures))
+	}
+	if len(users) == 0 {
+		return ""
+	}
+	slices.Sort(users)
+
+	return gotext.Get("Users skipped from AD lookups:\n%s", strings.Join(users, "\n"))
+}
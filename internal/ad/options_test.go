@@ -1,5 +1,10 @@
 package ad
 
+import (
+	"context"
+	"time"
+)
+
 func withoutKerberos() Option {
 	return func(o *options) error {
 		o.withoutKerberos = true
@@ -21,3 +26,17 @@ func WithVersionID(versionID string) Option {
 		return nil
 	}
 }
+
+func withNow(now func() time.Time) Option {
+	return func(o *options) error {
+		o.now = now
+		return nil
+	}
+}
+
+func withLookupHost(lookupHost func(ctx context.Context, host string) ([]string, error)) Option {
+	return func(o *options) error {
+		o.lookupHost = lookupHost
+		return nil
+	}
+}
@@ -48,6 +48,8 @@ type meta struct {
 	Empty    string
 	Meta     string
 	Strategy string
+	Flavors  string
+	Desktops string
 }
 
 // DecodePolicy parses a policy stream in registry file format and returns a slice of entries.
@@ -159,6 +161,8 @@ func DecodePolicy(r io.Reader) (entries []entry.Entry, err error) {
 			Disabled: disabled,
 			Meta:     metaValues[e.key].Meta,
 			Strategy: metaValues[e.key].Strategy,
+			Flavors:  metaValues[e.key].Flavors,
+			Desktops: metaValues[e.key].Desktops,
 			Err:      e.err,
 		})
 	}
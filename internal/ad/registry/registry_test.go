@@ -156,6 +156,15 @@ func TestDecodePolicy(t *testing.T) {
 					Strategy: "override",
 				},
 			}},
+		"container flavors and desktops are reflected on child": {
+			want: []entry.Entry{
+				{
+					Key:      `Software/Container/Child`,
+					Value:    "MyValue",
+					Flavors:  "kubuntu,xubuntu",
+					Desktops: "KDE,XFCE",
+				},
+			}},
 		// This ignores child value because container is disabled
 		"disabled container with disabled option values": {
 			want: []entry.Entry{
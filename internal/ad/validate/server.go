@@ -0,0 +1,57 @@
+package validate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+)
+
+// maxArchiveSize is the maximum size of a GPO export sent to the validation endpoint.
+const maxArchiveSize = 64 << 20
+
+// Handler returns the HTTP handler of the validation service.
+// GPO exports are posted as zip archives to /validate, which responds with the JSON encoded Result. The response
+// status is 200 if the GPO could be validated, whether it is valid or not, so that callers check the valid field.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", validateHandler)
+	return mux
+}
+
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, gotext.Get("only POST requests are supported"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	d, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxArchiveSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, gotext.Get("GPO export is larger than %d bytes", maxArchiveSize), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, gotext.Get("can't read GPO export: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	res, err := Archive(r.Context(), bytes.NewReader(d), int64(len(d)))
+	if err != nil {
+		log.Infof(r.Context(), "Rejected GPO export from %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof(r.Context(), "Validated GPO export from %s: valid=%t, %d error(s), %d warning(s)", r.RemoteAddr, res.Valid, len(res.Errors), len(res.Warnings))
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		log.Warningf(r.Context(), "Can't send validation result to %s: %v", r.RemoteAddr, err)
+	}
+}
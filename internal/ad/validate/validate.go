@@ -0,0 +1,203 @@
+// Package validate checks GPO exports against the policies supported by adsys, so that changes to the GPOs
+// applying to Ubuntu clients can be validated before being deployed.
+//
+// A GPO export is a zip archive of a GPO directory, either copied from SYSVOL or created by a GPMC backup. The
+// Registry.pol files of its Machine and User classes are decoded with the parser used by the clients, and the
+// following is reported:
+//   - errors: the policy files or entries which can't be decoded, the policies of unknown types and the invalid
+//     hardware targeting expressions. The clients fail or skip those policies;
+//   - warnings: the policies whose key doesn't match the format of the administrative templates, which the
+//     clients ignore;
+//   - rules: the rules applied by the clients, per class and rule type, with the values which are only defaults
+//     that users can override flagged as unlocked, the rules whose changes are only reported flagged as audit and
+//     the list mode of the lists combined with the default value of the clients.
+//
+// The values of the rules are only validated by the managers when the clients apply them.
+package validate
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	adcommon "github.com/ubuntu/adsys/internal/ad/common"
+	"github.com/ubuntu/adsys/internal/ad/registry"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/hardware"
+	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+// Classes of the GPO, as named in the results.
+const (
+	machineClass = "machine"
+	userClass    = "user"
+)
+
+// maxPolicyFileSize is the maximum size of an uncompressed Registry.pol file.
+const maxPolicyFileSize = 16 << 20
+
+// Result is the validation result of a GPO export.
+type Result struct {
+	// Valid is true if the GPO doesn't contain any error.
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	// Rules are the rules applied by the clients, indexed by class and rule type.
+	Rules map[string]map[string][]Rule `json:"rules,omitempty"`
+}
+
+// Rule is a rule of the GPO, as applied by the clients.
+type Rule struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// Unlocked is true if the value is only a default that users can override.
+	Unlocked bool `json:"unlocked,omitempty"`
+	// Audit is true if the changes of the rule are only reported by the clients, without being applied.
+	Audit bool `json:"audit,omitempty"`
+	// ListMode is how a list value is combined with the default value of the clients, if not replacing it.
+	ListMode string `json:"listMode,omitempty"`
+}
+
+// Archive validates the GPO export in the zip archive r of size bytes.
+// An error is returned if the archive can't be read: the validation errors of the GPO are part of the result.
+func Archive(ctx context.Context, r io.ReaderAt, size int64) (res Result, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't validate GPO export"))
+
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return res, err
+	}
+
+	// Find the policy file of each class, wherever the GPO directory is in the archive.
+	files := make(map[string]*zip.File)
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() || !strings.EqualFold(path.Base(f.Name), "Registry.pol") {
+			continue
+		}
+		class := strings.ToLower(path.Base(path.Dir(f.Name)))
+		if class != machineClass && class != userClass {
+			continue
+		}
+		if prev, ok := files[class]; ok {
+			return res, errors.New(gotext.Get("archive contains several GPOs: %s and %s", prev.Name, f.Name))
+		}
+		files[class] = f
+	}
+
+	res.Rules = make(map[string]map[string][]Rule)
+	if len(files) == 0 {
+		res.Warnings = append(res.Warnings, gotext.Get("no Registry.pol file found: the GPO doesn't contain any policy applied by the clients"))
+	}
+	for _, class := range []string{machineClass, userClass} {
+		f, ok := files[class]
+		if !ok {
+			continue
+		}
+		log.Debugf(ctx, "Validating %s policies from %s", class, f.Name)
+		rules, err := validateFile(f, &res)
+		if err != nil {
+			res.Errors = append(res.Errors, gotext.Get("%s: %v", f.Name, err))
+			continue
+		}
+		if len(rules) > 0 {
+			res.Rules[class] = rules
+		}
+	}
+
+	res.Valid = len(res.Errors) == 0
+	return res, nil
+}
+
+// validateFile decodes the policy file f and returns its rules, indexed by rule type.
+// The validation errors and warnings of the rules are added to res.
+func validateFile(f *zip.File, res *Result) (rules map[string][]Rule, err error) {
+	if f.UncompressedSize64 > maxPolicyFileSize {
+		return nil, errors.New(gotext.Get("file is larger than %d bytes", maxPolicyFileSize))
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer decorate.LogFuncOnError(r.Close)
+
+	pols, err := registry.DecodePolicy(io.LimitReader(r, maxPolicyFileSize))
+	if err != nil {
+		return nil, err
+	}
+
+	keyPrefix := fmt.Sprintf("%s/%s/", adcommon.KeyPrefix, consts.DistroID)
+	rules = make(map[string][]Rule)
+	for _, pol := range pols {
+		// Only consider supported policies for this distro, like the clients.
+		if !strings.HasPrefix(pol.Key, keyPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(pol.Key, keyPrefix)
+		if pol.Err != nil {
+			res.Errors = append(res.Errors, gotext.Get("%s: %s: %v", f.Name, key, pol.Err))
+			continue
+		}
+
+		// Keys are made of the rule type, the key of the rule and the release it applies to.
+		parts := strings.Split(key, "/")
+		if len(parts) < 3 {
+			res.Warnings = append(res.Warnings, gotext.Get("%s: %s: key doesn't match any administrative template policy, it is ignored by the clients", f.Name, key))
+			continue
+		}
+		keyType, ruleKey, releaseID := parts[0], strings.Join(parts[1:len(parts)-1], "/"), parts[len(parts)-1]
+		if !slices.Contains(policies.RuleTypes, keyType) {
+			res.Errors = append(res.Errors, gotext.Get("%s: %s: unknown policy type %q", f.Name, key, keyType))
+			continue
+		}
+		// Unlocked values are only defaults that users can override.
+		if releaseID == adcommon.LockValueName {
+			if i := len(rules[keyType]) - 1; i >= 0 && rules[keyType][i].Key == ruleKey && !pol.Disabled && pol.Value == "false" {
+				rules[keyType][i].Unlocked = true
+			}
+			continue
+		}
+		// Lists can be combined with the default value of the clients.
+		if releaseID == adcommon.ListModeValueName {
+			if i := len(rules[keyType]) - 1; i >= 0 && rules[keyType][i].Key == ruleKey && !pol.Disabled && (pol.Value == entry.ListModeMerge || pol.Value == entry.ListModeAppend) {
+				rules[keyType][i].ListMode = pol.Value
+			}
+			continue
+		}
+		// Rules in audit mode are only reported.
+		if releaseID == adcommon.AuditValueName {
+			if i := len(rules[keyType]) - 1; i >= 0 && rules[keyType][i].Key == ruleKey && !pol.Disabled && pol.Value == "true" {
+				rules[keyType][i].Audit = true
+			}
+			continue
+		}
+		// Release overrides only replace the value of the rule on the matching releases.
+		if releaseID != "all" {
+			continue
+		}
+
+		if keyType == policies.TargetingRuleType && ruleKey == "hardware" && !pol.Disabled {
+			for _, expr := range strings.Split(pol.Value, "\n") {
+				if expr = strings.TrimSpace(expr); expr == "" {
+					continue
+				}
+				if _, err := (hardware.Facts{}).Match(expr); err != nil {
+					res.Errors = append(res.Errors, gotext.Get("%s: %s: %v", f.Name, key, err))
+				}
+			}
+		}
+
+		rules[keyType] = append(rules[keyType], Rule{Key: ruleKey, Value: pol.Value, Disabled: pol.Disabled})
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,157 @@
+package validate_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/ad/validate"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestArchive(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		gpo        string
+		notArchive bool
+
+		wantValid bool
+		wantErr   bool
+	}{
+		"Valid GPO from SYSVOL":                    {gpo: "sysvol", wantValid: true},
+		"Valid GPO from GPMC backup":               {gpo: "gpmc-backup", wantValid: true},
+		"GPO without policy file is valid":         {gpo: "no-policy-file", wantValid: true},
+		"Key without release is a warning":         {gpo: "key-without-release", wantValid: true},
+		"Unlocked value is reported":               {gpo: "unlocked-value", wantValid: true},
+		"Audit mode is reported":                   {gpo: "audit-mode", wantValid: true},
+		"List mode is reported":                    {gpo: "list-mode", wantValid: true},
+		"Unknown policy type is invalid":           {gpo: "unknown-type"},
+		"Invalid targeting expression is an error": {gpo: "invalid-targeting"},
+		"Unsupported data type is invalid":         {gpo: "unsupported-data-type"},
+		"Corrupted policy file is invalid":         {gpo: "corrupted"},
+
+		// Error cases
+		"Error on several GPOs":    {gpo: "several-gpos", wantErr: true},
+		"Error on invalid archive": {notArchive: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			d := []byte("this is not a zip archive")
+			if !tc.notArchive {
+				d = zipDir(t, filepath.Join("testdata", "gpos", tc.gpo))
+			}
+
+			res, err := validate.Archive(context.Background(), bytes.NewReader(d), int64(len(d)))
+			if tc.wantErr {
+				require.Error(t, err, "Archive should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Archive failed but shouldn't have")
+			require.Equal(t, tc.wantValid, res.Valid, "Archive should return the expected validity")
+
+			got, err := json.MarshalIndent(res, "", "  ")
+			require.NoError(t, err, "Setup: can't marshal result")
+			want := testutils.LoadWithUpdateFromGolden(t, string(got))
+			require.Equal(t, want, string(got), "Archive should return the expected result")
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		method     string
+		path       string
+		gpo        string
+		notArchive bool
+
+		wantStatus int
+	}{
+		"Validate GPO export":         {gpo: "sysvol", wantStatus: http.StatusOK},
+		"Validate invalid GPO export": {gpo: "unknown-type", wantStatus: http.StatusOK},
+
+		// Error cases
+		"Error on invalid archive":    {notArchive: true, wantStatus: http.StatusBadRequest},
+		"Error on method not allowed": {method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+		"Error on unknown path":       {path: "/apply", gpo: "sysvol", wantStatus: http.StatusNotFound},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.method == "" {
+				tc.method = http.MethodPost
+			}
+			if tc.path == "" {
+				tc.path = "/validate"
+			}
+			var body io.Reader
+			if tc.notArchive {
+				body = bytes.NewReader([]byte("this is not a zip archive"))
+			} else if tc.gpo != "" {
+				body = bytes.NewReader(zipDir(t, filepath.Join("testdata", "gpos", tc.gpo)))
+			}
+
+			rec := httptest.NewRecorder()
+			validate.Handler().ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, body))
+
+			require.Equal(t, tc.wantStatus, rec.Code, "Handler should return the expected status")
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			require.Equal(t, "application/json", rec.Header().Get("Content-Type"), "Result should be sent as JSON")
+			var res validate.Result
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res), "Result should be valid JSON")
+			d := zipDir(t, filepath.Join("testdata", "gpos", tc.gpo))
+			want, err := validate.Archive(context.Background(), bytes.NewReader(d), int64(len(d)))
+			require.NoError(t, err, "Setup: can't validate GPO export")
+			require.Equal(t, want, res, "Handler should return the validation result")
+		})
+	}
+}
+
+// zipDir returns a zip archive of the content of dir.
+func zipDir(t *testing.T, dir string) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := w.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(content)
+		return err
+	})
+	require.NoError(t, err, "Setup: can't create archive of %s", dir)
+	require.NoError(t, w.Close(), "Setup: can't close archive of %s", dir)
+	return b.Bytes()
+}
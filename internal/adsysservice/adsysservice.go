@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/godbus/dbus/v5"
@@ -15,6 +17,7 @@ import (
 	"github.com/ubuntu/adsys"
 	"github.com/ubuntu/adsys/internal/ad"
 	"github.com/ubuntu/adsys/internal/ad/backends"
+	"github.com/ubuntu/adsys/internal/ad/backends/keytab"
 	"github.com/ubuntu/adsys/internal/ad/backends/sss"
 	"github.com/ubuntu/adsys/internal/ad/backends/winbind"
 	"github.com/ubuntu/adsys/internal/authorizer"
@@ -24,7 +27,9 @@ import (
 	"github.com/ubuntu/adsys/internal/grpc/interceptorschain"
 	"github.com/ubuntu/adsys/internal/grpc/logconnections"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/metrics"
 	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/telemetry"
 	"github.com/ubuntu/decorate"
 	"google.golang.org/grpc"
 )
@@ -36,14 +41,22 @@ type Service struct {
 
 	adc           *ad.AD
 	policyManager *policies.Manager
+	metrics       *metrics.DB
+	telemetry     *telemetry.Store
 
 	authorizer authorizerer
 
+	// machineOnly is true when the AD backend can only refresh the machine policies.
+	machineOnly bool
+
 	state          state
 	initSystemTime *time.Time
 
 	bus    *dbus.Conn
 	daemon *daemon.Daemon
+
+	runs   map[string]int
+	runsMu sync.Mutex
 }
 
 type state struct {
@@ -56,6 +69,8 @@ type state struct {
 	apparmorDir    string
 	systemUnitDir  string
 	globalTrustDir string
+	rolloutRing    string
+	stagingDir     string
 }
 
 type options struct {
@@ -69,13 +84,56 @@ type options struct {
 	apparmorFsDir  string
 	systemUnitDir  string
 	globalTrustDir string
-	adBackend      string
-	sssConfig      sss.Config
-	winbindConfig  winbind.Config
-	authorizer     authorizerer
+	rolloutRing    string
+	securityModule string
+	stagingDir     string
+	telemetry      bool
+	policyHistory  bool
+
+	connectivityCheckURL string
+
+	adBackend     string
+	sssConfig     sss.Config
+	winbindConfig winbind.Config
+	keytabConfig  keytab.Config
+	timeouts      Timeouts
+	bandwidth     SysvolBandwidth
+	authorizer    authorizerer
 }
 type option func(*options) error
 
+// Timeouts are the maximum durations of the calls to external services and helpers.
+// A zero value keeps the default of the corresponding call.
+type Timeouts struct {
+	// GpoList is the maximum time of each LDAP request listing the GPOs of an object.
+	GpoList time.Duration `mapstructure:"gpo_list"`
+	// GpoListRetries is the number of times the LDAP request listing the GPOs is retried on failure.
+	GpoListRetries int `mapstructure:"gpo_list_retries"`
+	// SysvolDownload is the maximum time of downloading the GPOs and assets from the SYSVOL share.
+	SysvolDownload time.Duration `mapstructure:"sysvol_download"`
+	// EnrollmentHTTP is the maximum time of each HTTP request during certificate enrollment.
+	EnrollmentHTTP time.Duration `mapstructure:"enrollment_http"`
+	// HelperExec is the maximum time of the external helper commands run by the policy managers.
+	HelperExec time.Duration `mapstructure:"helper_exec"`
+	// HelperExecOverrides are the maximum times of the external helper commands of some policy managers, indexed
+	// by rule type, like "apt" or "grub". They take precedence over HelperExec.
+	HelperExecOverrides map[string]time.Duration `mapstructure:"helper_exec_overrides"`
+	// Ldap is the maximum time of each LDAP request of the policy managers to the directory.
+	Ldap time.Duration `mapstructure:"ldap"`
+	// PackageLock is the maximum time to wait for the package manager transactions to complete before installing
+	// packages or restarting services.
+	PackageLock time.Duration `mapstructure:"package_lock"`
+}
+
+// SysvolBandwidth caps the throughput of the GPOs and assets downloads from the SYSVOL share, so that many
+// clients refreshing over a thin link don't saturate it.
+type SysvolBandwidth struct {
+	// Limit is the maximum throughput of the downloads, in KiB per second. 0 doesn't limit them.
+	Limit int `mapstructure:"limit"`
+	// OffPeak is a daily window in local time, of the form HH:MM-HH:MM, during which the downloads are not limited.
+	OffPeak string `mapstructure:"off_peak"`
+}
+
 type authorizerer interface {
 	IsAllowedFromContext(context.Context, authorizer.Action) error
 }
@@ -162,6 +220,56 @@ func WithGlobalTrustDir(p string) func(o *options) error {
 	}
 }
 
+// WithRolloutRing specifies the rollout ring the machine is assigned to.
+func WithRolloutRing(ring string) func(o *options) error {
+	return func(o *options) error {
+		o.rolloutRing = ring
+		return nil
+	}
+}
+
+// WithConnectivityCheckURL specifies the URL used to detect captive portals when AD can't be reached.
+// "none" only checks the DNS answers.
+func WithConnectivityCheckURL(url string) func(o *options) error {
+	return func(o *options) error {
+		o.connectivityCheckURL = url
+		return nil
+	}
+}
+
+// WithSecurityModule specifies the security module the mandatory access control policy is applied with.
+func WithSecurityModule(name string) func(o *options) error {
+	return func(o *options) error {
+		o.securityModule = name
+		return nil
+	}
+}
+
+// WithReadOnly enables the read-only mode, staging system changes in stagingDir.
+// An empty stagingDir keeps the read-only mode disabled.
+func WithReadOnly(stagingDir string) func(o *options) error {
+	return func(o *options) error {
+		o.stagingDir = stagingDir
+		return nil
+	}
+}
+
+// WithTelemetry enables the collection and submission of the usage telemetry.
+func WithTelemetry(enabled bool) func(o *options) error {
+	return func(o *options) error {
+		o.telemetry = enabled
+		return nil
+	}
+}
+
+// WithPolicyHistory enables the git history of the policy artifacts rendered on the machine.
+func WithPolicyHistory(enabled bool) func(o *options) error {
+	return func(o *options) error {
+		o.policyHistory = enabled
+		return nil
+	}
+}
+
 // WithADBackend specifies our specific backend to select.
 func WithADBackend(backend string) func(o *options) error {
 	return func(o *options) error {
@@ -186,6 +294,30 @@ func WithWinbindConfig(c winbind.Config) func(o *options) error {
 	}
 }
 
+// WithKeytabConfig specifies our specific keytab options to override.
+func WithKeytabConfig(c keytab.Config) func(o *options) error {
+	return func(o *options) error {
+		o.keytabConfig = c
+		return nil
+	}
+}
+
+// WithTimeouts specifies personalized timeouts for the calls to external services and helpers.
+func WithTimeouts(t Timeouts) func(o *options) error {
+	return func(o *options) error {
+		o.timeouts = t
+		return nil
+	}
+}
+
+// WithSysvolBandwidth specifies a cap on the throughput of the downloads from the SYSVOL share.
+func WithSysvolBandwidth(b SysvolBandwidth) func(o *options) error {
+	return func(o *options) error {
+		o.bandwidth = b
+		return nil
+	}
+}
+
 // New returns a new instance of an AD service.
 // If url or domain is empty, we load the missing parameters from sssd.conf, taking first
 // domain in the list if not provided.
@@ -240,7 +372,28 @@ func New(ctx context.Context, opts ...option) (s *Service, err error) {
 	if args.runDir != "" {
 		adOptions = append(adOptions, ad.WithRunDir(args.runDir))
 	}
-	adOptions = append(adOptions, ad.WithGpoListTimeout(consts.DefaultGpoListTimeout))
+	gpoListTimeout := consts.DefaultGpoListTimeout
+	if args.timeouts.GpoList > 0 {
+		gpoListTimeout = args.timeouts.GpoList
+	}
+	adOptions = append(adOptions, ad.WithGpoListTimeout(gpoListTimeout))
+	if args.timeouts.GpoListRetries > 0 {
+		adOptions = append(adOptions, ad.WithGpoListRetries(args.timeouts.GpoListRetries))
+	}
+	if args.timeouts.SysvolDownload > 0 {
+		adOptions = append(adOptions, ad.WithSysvolDownloadTimeout(args.timeouts.SysvolDownload))
+	}
+	if args.bandwidth.Limit != 0 || args.bandwidth.OffPeak != "" {
+		adOptions = append(adOptions, ad.WithSysvolBandwidthLimit(args.bandwidth.Limit*1024, args.bandwidth.OffPeak))
+	}
+	connectivityCheckURL := args.connectivityCheckURL
+	switch connectivityCheckURL {
+	case "":
+		connectivityCheckURL = consts.DefaultConnectivityCheckURL
+	case "none":
+		connectivityCheckURL = ""
+	}
+	adOptions = append(adOptions, ad.WithCaptivePortalDetection(connectivityCheckURL))
 
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -261,6 +414,8 @@ func New(ctx context.Context, opts ...option) (s *Service, err error) {
 		adBackend, err = sss.New(ctx, args.sssConfig, bus)
 	case "winbind":
 		adBackend, err = winbind.New(ctx, args.winbindConfig, hostname)
+	case "keytab":
+		adBackend, err = keytab.New(ctx, args.keytabConfig)
 	}
 	if err != nil {
 		return nil, errors.New(gotext.Get("could not initialize AD backend: %v", err))
@@ -310,6 +465,51 @@ func New(ctx context.Context, opts ...option) (s *Service, err error) {
 	if args.globalTrustDir != "" {
 		policyOptions = append(policyOptions, policies.WithGlobalTrustDir(args.globalTrustDir))
 	}
+	if args.rolloutRing != "" {
+		policyOptions = append(policyOptions, policies.WithRolloutRing(args.rolloutRing))
+	}
+	if args.securityModule != "" {
+		policyOptions = append(policyOptions, policies.WithSecurityModule(args.securityModule))
+	}
+	if args.stagingDir != "" {
+		policyOptions = append(policyOptions, policies.WithReadOnly(args.stagingDir))
+	}
+	if args.policyHistory {
+		policyOptions = append(policyOptions, policies.WithHistory())
+	}
+	if args.timeouts.EnrollmentHTTP > 0 {
+		policyOptions = append(policyOptions, policies.WithEnrollmentHTTPTimeout(args.timeouts.EnrollmentHTTP))
+	}
+	if args.timeouts.HelperExec > 0 {
+		policyOptions = append(policyOptions, policies.WithHelperExecTimeout(args.timeouts.HelperExec))
+	}
+	if len(args.timeouts.HelperExecOverrides) > 0 {
+		policyOptions = append(policyOptions, policies.WithHelperExecTimeoutOverrides(args.timeouts.HelperExecOverrides))
+	}
+	if args.timeouts.Ldap > 0 {
+		policyOptions = append(policyOptions, policies.WithLdapTimeout(args.timeouts.Ldap))
+	}
+	if args.timeouts.PackageLock > 0 {
+		policyOptions = append(policyOptions, policies.WithPackageLockTimeout(args.timeouts.PackageLock))
+	}
+
+	stateDir := args.stateDir
+	if stateDir == "" {
+		stateDir = consts.DefaultStateDir
+	}
+	metricsDB := metrics.New(filepath.Join(stateDir, "metrics", "machine.json"))
+	telemetryStore := telemetry.New(filepath.Join(stateDir, "telemetry", "usage.json"), args.telemetry)
+	if args.telemetry {
+		policyOptions = append(policyOptions, policies.WithFailureHook(func(manager string) {
+			if err := telemetryStore.RecordManagerFailure(manager); err != nil {
+				log.Warning(context.Background(), err)
+			}
+		}))
+	} else if err := telemetryStore.Purge(); err != nil {
+		// Any data collected before opting out is removed.
+		log.Warning(ctx, err)
+	}
+
 	m, err := policies.NewManager(bus, hostname, adBackend, policyOptions...)
 	if err != nil {
 		return nil, err
@@ -321,7 +521,10 @@ func New(ctx context.Context, opts ...option) (s *Service, err error) {
 	return &Service{
 		adc:           adc,
 		policyManager: m,
+		metrics:       metricsDB,
+		telemetry:     telemetryStore,
 		authorizer:    args.authorizer,
+		machineOnly:   args.adBackend == "keytab",
 		state: state{
 			cacheDir:       args.cacheDir,
 			stateDir:       args.stateDir,
@@ -332,9 +535,12 @@ func New(ctx context.Context, opts ...option) (s *Service, err error) {
 			apparmorDir:    args.apparmorDir,
 			systemUnitDir:  args.systemUnitDir,
 			globalTrustDir: args.globalTrustDir,
+			rolloutRing:    args.rolloutRing,
+			stagingDir:     args.stagingDir,
 		},
 		initSystemTime: initSysTime,
 		bus:            bus,
+		runs:           make(map[string]int),
 	}, nil
 }
 
@@ -347,6 +553,7 @@ func (s *Service) RegisterGRPCServer(d *daemon.Daemon) *grpc.Server {
 			log.StreamServerInterceptor(s.logger),
 			connectionnotify.StreamServerInterceptor(d),
 			logconnections.StreamServerInterceptor(),
+			s.telemetryStreamInterceptor(),
 		)), authorizer.WithUnixPeerCreds())
 	adsys.RegisterServiceServer(srv, s)
 	s.daemon = d
@@ -0,0 +1,51 @@
+package adsysservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys"
+	"github.com/ubuntu/adsys/internal/authorizer"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/metrics"
+	"github.com/ubuntu/decorate"
+)
+
+// Metrics displays the duration and failures of the last machine policy refreshes, and their trend.
+func (s *Service) Metrics(r *adsys.MetricsRequest, stream adsys.Service_MetricsServer) (err error) {
+	defer decorate.OnError(&err, gotext.Get("error while getting refresh metrics"))
+
+	// Like the service status, the metrics are available to all users.
+	if err := s.authorizer.IsAllowedFromContext(stream.Context(), authorizer.ActionAlwaysAllowed); err != nil {
+		return err
+	}
+
+	runs, err := s.metrics.Runs()
+	if err != nil {
+		return err
+	}
+
+	msg := metrics.Format(runs, r.GetHistory())
+	if r.GetJson() {
+		if msg, err = metrics.FormatJSON(runs, r.GetHistory()); err != nil {
+			return err
+		}
+	}
+	if err := stream.Send(&adsys.StringResponse{
+		Msg: msg,
+	}); err != nil {
+		log.Warningf(stream.Context(), "couldn't send refresh metrics to client: %v", err)
+	}
+
+	return nil
+}
+
+// recordRefresh records the metrics of a machine refresh started at start.
+// Failing to record them doesn't fail the refresh.
+func (s *Service) recordRefresh(ctx context.Context, start time.Time, failures int) {
+	run := metrics.Run{Time: start, Duration: time.Since(start), Failures: failures}
+	if err := s.metrics.Record(run); err != nil {
+		log.Warning(ctx, err)
+	}
+}
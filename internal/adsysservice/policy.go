@@ -2,7 +2,13 @@ package adsysservice
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/leonelquinteros/gotext"
 	"github.com/ubuntu/adsys"
@@ -11,53 +17,136 @@ import (
 	"github.com/ubuntu/adsys/internal/authorizer"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
 	"github.com/ubuntu/adsys/internal/policies"
-	"github.com/ubuntu/adsys/internal/policies/certificate"
 	"github.com/ubuntu/decorate"
 	"golang.org/x/sync/errgroup"
 )
 
+// refreshMode is what a policy refresh does for each object.
+type refreshMode int
+
+const (
+	// updateMode downloads the policies and applies them right away.
+	updateMode refreshMode = iota
+	// purgeMode removes all the applied policies.
+	purgeMode
+	// downloadMode only downloads and caches the policies, to apply them later with applyMode.
+	downloadMode
+	// applyMode applies the policies previously downloaded with downloadMode.
+	applyMode
+)
+
 // UpdatePolicy refreshes or creates a policy for current user or user given as argument.
 // It can purge the policy instead of updating it if requested.
 func (s *Service) UpdatePolicy(r *adsys.UpdatePolicyRequest, stream adsys.Service_UpdatePolicyServer) (err error) {
 	defer decorate.OnError(&err, gotext.Get("error while updating policy"))
 
+	mode := updateMode
+	if r.GetPurge() {
+		mode = purgeMode
+	}
+	var report policyReport
+	err = s.refreshPolicies(stream.Context(), r.GetIsComputer(), r.GetAll(), r.GetTarget(), r.GetKrb5Cc(), mode,
+		time.Duration(r.GetMaxAge())*time.Second, &report)
+	report.send(stream)
+	return err
+}
+
+// DownloadPolicy downloads and caches the policies for current user or user given as argument, without applying them.
+// They are applied later on with ApplyPolicy.
+func (s *Service) DownloadPolicy(r *adsys.DownloadPolicyRequest, stream adsys.Service_DownloadPolicyServer) (err error) {
+	defer decorate.OnError(&err, gotext.Get("error while downloading policy"))
+
+	return s.refreshPolicies(stream.Context(), r.GetIsComputer(), r.GetAll(), r.GetTarget(), r.GetKrb5Cc(), downloadMode, 0, nil)
+}
+
+// ApplyPolicy applies the policies previously downloaded by DownloadPolicy for current user or user given as argument.
+// It doesn't contact AD.
+func (s *Service) ApplyPolicy(r *adsys.ApplyPolicyRequest, stream adsys.Service_ApplyPolicyServer) (err error) {
+	defer decorate.OnError(&err, gotext.Get("error while applying downloaded policy"))
+
+	var report policyReport
+	err = s.refreshPolicies(stream.Context(), r.GetIsComputer(), r.GetAll(), r.GetTarget(), "", applyMode, 0, &report)
+	report.send(stream)
+	return err
+}
+
+// refreshPolicies refreshes the policies of the target, or of the machine and all the users, according to mode.
+// If maxAge is not zero, the policies of a single user are only updated if they were not updated within maxAge.
+// The outcome of the policy managers is added to report, if any.
+func (s *Service) refreshPolicies(ctx context.Context, isComputer, all bool, target, krb5cc string, mode refreshMode, maxAge time.Duration, report *policyReport) (err error) {
+	defer s.releaseMemory()
+
+	if s.machineOnly && !isComputer && !all && mode != purgeMode {
+		return errors.New(gotext.Get("user policies are not supported by the keytab backend: only the machine policies are refreshed"))
+	}
+
 	objectClass := ad.UserObject
-	if r.GetIsComputer() || r.GetAll() {
+	if isComputer || all {
 		objectClass = ad.ComputerObject
 	}
-	target, err := s.adc.NormalizeTargetName(stream.Context(), r.GetTarget(), objectClass)
+	target, err = s.adc.NormalizeTargetName(ctx, target, objectClass)
 	if err != nil {
 		return err
 	}
 
 	targetForAuthorizer := target
 	// prevent case of username == machine name to allow updating machine or anyone abusing the API passing an user.
-	if r.GetIsComputer() || r.GetAll() {
+	if isComputer || all {
 		targetForAuthorizer = "root"
 	}
 
-	if err := s.authorizer.IsAllowedFromContext(context.WithValue(stream.Context(), authorizer.OnUserKey, targetForAuthorizer),
+	if err := s.authorizer.IsAllowedFromContext(context.WithValue(ctx, authorizer.OnUserKey, targetForAuthorizer),
 		actions.ActionPolicyUpdate); err != nil {
 		return err
 	}
 
-	if r.GetIsComputer() || r.GetAll() {
+	if isComputer || all {
 		hostname := s.adc.Hostname()
 
-		err = s.updatePolicyFor(stream.Context(), true, hostname, ad.ComputerObject, "", r.GetPurge())
+		// Record the duration and failures of the machine refresh, whatever its outcome.
+		var failures atomic.Int64
+		if mode == updateMode || mode == applyMode {
+			start := time.Now()
+			defer func() { s.recordRefresh(ctx, start, int(failures.Load())) }()
+		}
+		// The periodic refresh of the machine and its users submits the usage telemetry once due.
+		if all && mode == updateMode {
+			defer s.submitTelemetry(ctx)
+		}
+
+		err = s.updatePolicyFor(ctx, true, hostname, ad.ComputerObject, "", mode, report)
+		if err != nil {
+			failures.Add(1)
+		}
 
-		if r.GetAll() {
-			users, err := s.adc.ListUsers(stream.Context(), !r.GetPurge())
+		// The users don't log in through AD when only the machine policies are refreshed.
+		if all && !s.machineOnly {
+			var users []string
+			var err error
+			if mode == applyMode {
+				users, err = s.policyManager.DownloadedUsers()
+			} else {
+				users, err = s.adc.ListUsers(ctx, mode != purgeMode)
+			}
 			if err != nil {
+				failures.Add(1)
 				return err
 			}
 			errg := new(errgroup.Group)
 			for _, user := range users {
 				errg.Go(func() (err error) {
-					return s.updatePolicyFor(stream.Context(), false, user, ad.UserObject, "", r.GetPurge())
+					if err := s.updatePolicyFor(ctx, false, user, ad.UserObject, "", mode, report); err != nil {
+						failures.Add(1)
+						return err
+					}
+					return nil
 				})
 			}
-			if err := errg.Wait(); err != nil {
+			err = errg.Wait()
+			if mode != purgeMode {
+				s.policyManager.ReportUserFailures(ctx)
+			}
+			if err != nil {
 				return fmt.Errorf("one or more error for updating all users: %w", err)
 			}
 		}
@@ -65,20 +154,150 @@ func (s *Service) UpdatePolicy(r *adsys.UpdatePolicyRequest, stream adsys.Servic
 		return err
 	}
 	// Update a single user
-	return s.updatePolicyFor(stream.Context(), r.GetIsComputer(), target, objectClass, r.Krb5Cc, r.GetPurge())
+	// Recently updated policies are kept, without contacting AD, for the frequent refreshes like on screen unlock.
+	if maxAge > 0 && mode == updateMode {
+		if t, err := s.policyManager.LastUpdateFor(ctx, target, false); err == nil && time.Since(t) < maxAge {
+			log.Infof(ctx, "Policies of %s were updated %s ago, skipping update", target, time.Since(t).Truncate(time.Second))
+			return nil
+		}
+	}
+	err = s.updatePolicyFor(ctx, isComputer, target, objectClass, krb5cc, mode, report)
+	if mode != purgeMode {
+		s.policyManager.ReportUserFailures(ctx)
+	}
+	return err
 }
 
 // updatePolicyFor updates the policy for a given object.
-func (s *Service) updatePolicyFor(ctx context.Context, isComputer bool, target string, objectClass ad.ObjectClass, krb5cc string, purge bool) (err error) {
+// Depending on mode, the policies are only downloaded or applied from the previous download.
+func (s *Service) updatePolicyFor(ctx context.Context, isComputer bool, target string, objectClass ad.ObjectClass, krb5cc string, mode refreshMode, report *policyReport) (err error) {
+	// Record the outcome of user refreshes to report the persistent failures.
+	if !isComputer && mode != purgeMode {
+		defer func() { s.policyManager.RecordUserRefresh(ctx, target, err) }()
+	}
+
+	// Don't apply concurrently with the daemon we took over from on upgrade.
+	if s.daemon != nil {
+		if err := s.daemon.WaitPreviousRun(ctx, target); err != nil {
+			return err
+		}
+	}
+	s.runsMu.Lock()
+	s.runs[target]++
+	s.runsMu.Unlock()
+	defer func() {
+		s.runsMu.Lock()
+		defer s.runsMu.Unlock()
+		s.runs[target]--
+		if s.runs[target] == 0 {
+			delete(s.runs, target)
+		}
+	}()
+
 	var pols policies.Policies
-	if !purge {
+	switch mode {
+	case purgeMode:
+	case applyMode:
+		pols, err = s.policyManager.DownloadedPolicies(ctx, target)
+		if err != nil {
+			return err
+		}
+	default:
 		pols, err = s.adc.GetPolicies(ctx, target, objectClass, krb5cc)
 		if err != nil {
 			return err
 		}
+		if isComputer {
+			s.recordDomainSize(ctx, len(pols.GPOs))
+		}
+	}
+
+	if mode == downloadMode {
+		err = s.policyManager.SaveDownloadedPolicies(ctx, target, &pols)
+		return errors.Join(err, pols.Close())
+	}
+	// Release the assets once applied: they are read back from the cache when needed.
+	defer func() { err = errors.Join(err, pols.Close()) }()
+
+	results, err := s.policyManager.ApplyPolicies(ctx, target, isComputer, &pols)
+	report.add(target, results)
+	if err != nil {
+		return err
+	}
+
+	// Any downloaded policies are now either applied or superseded by this refresh.
+	return s.policyManager.RemoveDownloadedPolicies(target)
+}
+
+// policyReport collects the outcome of the policy managers of each refreshed object, to be sent to the client.
+type policyReport struct {
+	mu       sync.Mutex
+	managers []*adsys.ManagerResult
+}
+
+// add records the outcome of the policy managers for target.
+func (r *policyReport) add(target string, results map[string]policies.ManagerResult) {
+	if r == nil || len(results) == 0 {
+		return
 	}
 
-	return s.policyManager.ApplyPolicies(ctx, target, isComputer, &pols)
+	var managers []string
+	for manager := range results {
+		managers = append(managers, manager)
+	}
+	sort.Strings(managers)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, manager := range managers {
+		r.managers = append(r.managers, &adsys.ManagerResult{
+			Target:  target,
+			Manager: manager,
+			Status:  string(results[manager].Status),
+			Reason:  results[manager].Reason,
+		})
+	}
+}
+
+// send sends the report to the client, even if the refresh failed, so that it can summarize it.
+func (r *policyReport) send(stream interface {
+	Context() context.Context
+	Send(*adsys.PolicyReport) error
+}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.managers) == 0 {
+		return
+	}
+	if err := stream.Send(&adsys.PolicyReport{Managers: r.managers}); err != nil {
+		log.Warningf(stream.Context(), "Couldn't send policy report to client: %v", err)
+	}
+}
+
+// releaseMemory returns the memory used during the refreshes to the system once none is running anymore,
+// to keep the footprint of the idling daemon low until the next refresh.
+func (s *Service) releaseMemory() {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+
+	if len(s.runs) > 0 {
+		return
+	}
+	debug.FreeOSMemory()
+}
+
+// RunningRefreshes returns the objects whose policies are being refreshed, to hand them off to a new daemon on upgrade.
+func (s *Service) RunningRefreshes() []string {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+
+	var targets []string
+	for target := range s.runs {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
 }
 
 // DumpPolicies displays all applied policies for a given user.
@@ -103,7 +322,19 @@ func (s *Service) DumpPolicies(r *adsys.DumpPoliciesRequest, stream adsys.Servic
 		}
 	}
 
-	msg, err := s.policyManager.DumpPolicies(stream.Context(), target, r.GetIsComputer(), r.GetDetails(), r.GetAll())
+	var msg string
+	if r.GetManager() != "" {
+		// The raw state of the machine can contain files only readable by root.
+		if r.GetIsComputer() {
+			if err := s.authorizer.IsAllowedFromContext(context.WithValue(stream.Context(), authorizer.OnUserKey, "root"),
+				actions.ActionPolicyDump); err != nil {
+				return err
+			}
+		}
+		msg, err = s.policyManager.DumpState(stream.Context(), r.GetManager(), target, r.GetIsComputer())
+	} else {
+		msg, err = s.policyManager.DumpPolicies(stream.Context(), target, r.GetIsComputer(), r.GetDetails(), r.GetAll(), time.Duration(r.GetSince())*time.Second)
+	}
 	if err != nil {
 		return err
 	}
@@ -139,35 +370,63 @@ func (s *Service) DumpPoliciesDefinitions(r *adsys.DumpPolicyDefinitionsRequest,
 	return nil
 }
 
-// GPOListScript returns the embedded GPO python list script.
-func (s *Service) GPOListScript(_ *adsys.Empty, stream adsys.Service_GPOListScriptServer) (err error) {
-	defer decorate.OnError(&err, gotext.Get("error while getting gpo list script"))
+// AptDryRun displays the apt package changes the machine policies would apply.
+func (s *Service) AptDryRun(_ *adsys.Empty, stream adsys.Service_AptDryRunServer) (err error) {
+	defer decorate.OnError(&err, gotext.Get("error while computing apt package changes"))
 
+	// Like the machine applied policies, the report is available to all users.
 	if err := s.authorizer.IsAllowedFromContext(stream.Context(), authorizer.ActionAlwaysAllowed); err != nil {
 		return err
 	}
 
+	msg, err := s.policyManager.AptDryRun(stream.Context())
+	if err != nil {
+		return err
+	}
 	if err := stream.Send(&adsys.StringResponse{
-		Msg: ad.AdsysGpoListCode,
+		Msg: msg,
 	}); err != nil {
-		log.Warningf(stream.Context(), "couldn't send gpo list to client: %v", err)
+		log.Warningf(stream.Context(), "couldn't send apt package changes to client: %v", err)
+	}
+
+	return nil
+}
+
+// CompareSSSDGPOs displays the differences between the GPOs applied by adsys on the machine and the ones SSSD
+// evaluated for its GPO based access control.
+func (s *Service) CompareSSSDGPOs(_ *adsys.Empty, stream adsys.Service_CompareSSSDGPOsServer) (err error) {
+	defer decorate.OnError(&err, gotext.Get("error while comparing GPOs with SSSD"))
+
+	// Like the machine applied policies, the comparison is available to all users.
+	if err := s.authorizer.IsAllowedFromContext(stream.Context(), authorizer.ActionAlwaysAllowed); err != nil {
+		return err
+	}
+
+	msg, err := s.policyManager.CompareSSSDGPOs(stream.Context())
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&adsys.StringResponse{
+		Msg: msg,
+	}); err != nil {
+		log.Warningf(stream.Context(), "couldn't send GPOs comparison to client: %v", err)
 	}
 
 	return nil
 }
 
-// CertAutoEnrollScript returns the embedded certificate autoenrollment python script.
-func (s *Service) CertAutoEnrollScript(_ *adsys.Empty, stream adsys.Service_CertAutoEnrollScriptServer) (err error) {
-	defer decorate.OnError(&err, gotext.Get("error while getting certificate autoenrollment script"))
+// GPOListScript returns the embedded GPO python list script.
+func (s *Service) GPOListScript(_ *adsys.Empty, stream adsys.Service_GPOListScriptServer) (err error) {
+	defer decorate.OnError(&err, gotext.Get("error while getting gpo list script"))
 
 	if err := s.authorizer.IsAllowedFromContext(stream.Context(), authorizer.ActionAlwaysAllowed); err != nil {
 		return err
 	}
 
 	if err := stream.Send(&adsys.StringResponse{
-		Msg: certificate.CertEnrollCode,
+		Msg: ad.AdsysGpoListCode,
 	}); err != nil {
-		log.Warningf(stream.Context(), "couldn't send certificate autoenrollment script to client: %v", err)
+		log.Warningf(stream.Context(), "couldn't send gpo list to client: %v", err)
 	}
 
 	return nil
@@ -160,6 +160,19 @@ Daemon:
 		timeout, socket, state.cacheDir, state.runDir, state.dconfDir,
 		state.sudoersDir, state.policyKitDir, state.apparmorDir)
 
+	if state.rolloutRing != "" {
+		status = status + "\n" + gotext.Get("  Rollout ring: %s", state.rolloutRing)
+	}
+	if len(policies.SupportedRules) > 0 {
+		status = status + "\n" + gotext.Get("  Restricted build, supported policy types: %s", strings.Join(policies.SupportedRules, ", "))
+	}
+	if stats := s.policyManager.UserScriptsUnitsStats(); stats.Stuck > 0 || stats.Failed > 0 {
+		status = status + "\n" + gotext.Get("  Cleaned up user script units: %d stuck, %d failed", stats.Stuck, stats.Failed)
+	}
+	if state.stagingDir != "" {
+		status = status + "\n" + gotext.Get("  Read-only mode: system changes are staged in %s", state.stagingDir)
+	}
+
 	if err := stream.Send(&adsys.StringResponse{
 		Msg: status,
 	}); err != nil {
@@ -0,0 +1,64 @@
+package adsysservice
+
+import (
+	"context"
+	"path"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys"
+	"github.com/ubuntu/adsys/internal/authorizer"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/telemetry"
+	"github.com/ubuntu/decorate"
+	"google.golang.org/grpc"
+)
+
+// Telemetry displays the usage data collected on this machine, as it would be submitted.
+func (s *Service) Telemetry(_ *adsys.Empty, stream adsys.Service_TelemetryServer) (err error) {
+	defer decorate.OnError(&err, gotext.Get("error while getting usage telemetry"))
+
+	// Like the service status, the collected data is available to all users.
+	if err := s.authorizer.IsAllowedFromContext(stream.Context(), authorizer.ActionAlwaysAllowed); err != nil {
+		return err
+	}
+
+	r, err := s.telemetry.Report()
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&adsys.StringResponse{
+		Msg: telemetry.Format(r, s.telemetry.Enabled()),
+	}); err != nil {
+		log.Warningf(stream.Context(), "couldn't send usage telemetry to client: %v", err)
+	}
+
+	return nil
+}
+
+// telemetryStreamInterceptor counts each command called on the service in the usage telemetry.
+func (s *Service) telemetryStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if info != nil {
+			if err := s.telemetry.RecordCommand(path.Base(info.FullMethod)); err != nil {
+				log.Warning(context.Background(), err)
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// recordDomainSize records the bucket of the number of GPOs applying to the machine in the usage telemetry.
+func (s *Service) recordDomainSize(ctx context.Context, gpos int) {
+	if err := s.telemetry.SetDomainSize(gpos); err != nil {
+		log.Warning(ctx, err)
+	}
+}
+
+// submitTelemetry submits the usage telemetry, if it is due.
+// Failing to submit it doesn't fail the refresh: it is submitted on a later one.
+func (s *Service) submitTelemetry(ctx context.Context) {
+	if err := s.telemetry.Submit(ctx, consts.Version); err != nil {
+		log.Warning(ctx, err)
+	}
+}
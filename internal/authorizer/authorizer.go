@@ -1,6 +1,7 @@
 // Package authorizer deals client authorization based on a definite set of polkit actions.
 // The client uid and pid are obtained via the unix socket (SO_PEERCRED) information,
 // that are attached to the grpc request by the server.
+// The polkit decisions are cached per uid and action for a short time, until polkit signals a change.
 package authorizer
 
 import (
@@ -13,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/leonelquinteros/gotext"
@@ -29,8 +31,10 @@ type caller interface {
 type Authorizer struct {
 	authority  caller
 	userLookup func(string) (*user.User, error)
+	cache      *decisionCache
 
-	root string
+	root     string
+	cacheTTL time.Duration
 }
 
 func withAuthority(c caller) func(*Authorizer) {
@@ -51,23 +55,36 @@ func withRoot(root string) func(*Authorizer) {
 	}
 }
 
+func withCacheTTL(ttl time.Duration) func(*Authorizer) {
+	return func(a *Authorizer) {
+		a.cacheTTL = ttl
+	}
+}
+
 // New returns a new authorizer.
 func New(bus *dbus.Conn, options ...func(*Authorizer)) (auth *Authorizer, err error) {
 	defer decorate.OnError(&err, gotext.Get("can't create new authorizer"))
 
-	authority := bus.Object("org.freedesktop.PolicyKit1",
-		"/org/freedesktop/PolicyKit1/Authority")
+	authority := bus.Object("org.freedesktop.PolicyKit1", polkitObjectPath)
 
 	a := Authorizer{
 		authority:  authority,
 		root:       "/",
 		userLookup: user.Lookup,
+		cacheTTL:   defaultCacheTTL,
 	}
 
 	for _, option := range options {
 		option(&a)
 	}
 
+	if a.cacheTTL > 0 {
+		a.cache = newDecisionCache(a.cacheTTL)
+		if err := a.cache.subscribe(bus); err != nil {
+			return nil, err
+		}
+	}
+
 	return &a, nil
 }
 
@@ -159,6 +176,16 @@ func (a Authorizer) isAllowed(ctx context.Context, action Action, pid int32, uid
 		}
 	}
 
+	if a.cache != nil {
+		if authorized, ok := a.cache.get(uid, action.ID); ok {
+			log.Debug(ctx, gotext.Get("Cached polkit result, authorized: %t", authorized))
+			if !authorized {
+				return errors.New(gotext.Get("polkit denied access"))
+			}
+			return nil
+		}
+	}
+
 	f, err := os.Open(filepath.Join(a.root, fmt.Sprintf("proc/%d/stat", pid)))
 	if err != nil {
 		return errors.New(gotext.Get("couldn't open stat file for process: %v", err))
@@ -190,6 +217,11 @@ func (a Authorizer) isAllowed(ctx context.Context, action Action, pid int32, uid
 
 	log.Debug(ctx, gotext.Get("Polkit call result, authorized: %t", result.IsAuthorized))
 
+	// Don't keep a denial resulting from a dismissed or failed challenge, so that the user can try again.
+	if a.cache != nil && (result.IsAuthorized || !result.IsChallenge) {
+		a.cache.set(uid, action.ID, result.IsAuthorized)
+	}
+
 	if !result.IsAuthorized {
 		return errors.New(gotext.Get("polkit denied access"))
 	}
@@ -0,0 +1,102 @@
+package authorizer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// defaultCacheTTL is how long a polkit decision is reused for the same user and action.
+const defaultCacheTTL = 10 * time.Second
+
+const (
+	polkitObjectPath = "/org/freedesktop/PolicyKit1/Authority"
+	polkitInterface  = "org.freedesktop.PolicyKit1.Authority"
+)
+
+type cacheKey struct {
+	uid      uint32
+	actionID string
+}
+
+type decision struct {
+	authorized bool
+	expires    time.Time
+}
+
+// decisionCache keeps the polkit decisions per user and action for a short time, to spare a polkit round-trip
+// to each call of a burst of requests.
+// All decisions are dropped as soon as polkit signals its actions or authorizations changed.
+type decisionCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	decisions map[cacheKey]decision
+}
+
+func newDecisionCache(ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		ttl:       ttl,
+		decisions: make(map[cacheKey]decision),
+	}
+}
+
+// get returns the decision cached for uid and actionID, and if there is one which is still valid.
+func (c *decisionCache) get(uid uint32, actionID string) (authorized, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.decisions[cacheKey{uid: uid, actionID: actionID}]
+	if !ok || !time.Now().Before(d.expires) {
+		return false, false
+	}
+	return d.authorized, true
+}
+
+// set caches the decision for uid and actionID, and drops the expired ones.
+func (c *decisionCache) set(uid uint32, actionID string, authorized bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, d := range c.decisions {
+		if !now.Before(d.expires) {
+			delete(c.decisions, k)
+		}
+	}
+	c.decisions[cacheKey{uid: uid, actionID: actionID}] = decision{authorized: authorized, expires: now.Add(c.ttl)}
+}
+
+// clear drops all the cached decisions.
+func (c *decisionCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.decisions)
+}
+
+// subscribe drops all the cached decisions each time polkit emits its Changed signal on bus.
+// It stops once bus is closed.
+func (c *decisionCache) subscribe(bus *dbus.Conn) error {
+	// Any peer could emit this signal, but it can only make us call polkit again.
+	if err := bus.AddMatchSignal(
+		dbus.WithMatchObjectPath(polkitObjectPath),
+		dbus.WithMatchInterface(polkitInterface),
+		dbus.WithMatchMember("Changed"),
+	); err != nil {
+		return err
+	}
+
+	signals := make(chan *dbus.Signal, 10)
+	bus.Signal(signals)
+	go func() {
+		for s := range signals {
+			if s.Path != polkitObjectPath || s.Name != polkitInterface+".Changed" {
+				continue
+			}
+			c.clear()
+		}
+	}()
+	return nil
+}
@@ -10,6 +10,7 @@ var (
 	WithAuthority  = withAuthority
 	WithRoot       = withRoot
 	WithUserLookup = withUserLookup
+	WithCacheTTL   = withCacheTTL
 )
 
 type PeerCredsInfo = peerCredsInfo
@@ -21,9 +22,11 @@ func NewTestPeerCredsInfo(uid uint32, pid int32) PeerCredsInfo {
 
 type DbusMock struct {
 	IsAuthorized    bool
+	IsChallenge     bool
 	WantPolkitError bool
 
 	actionRequested Action
+	calls           int
 }
 
 func (d *DbusMock) Call(_ string, _ dbus.Flags, args ...interface{}) *dbus.Call {
@@ -35,6 +38,7 @@ func (d *DbusMock) Call(_ string, _ dbus.Flags, args ...interface{}) *dbus.Call
 	}
 
 	d.actionRequested = Action{ID: content}
+	d.calls++
 
 	if d.WantPolkitError {
 		errPolkit = errors.New("Polkit error")
@@ -45,7 +49,7 @@ func (d *DbusMock) Call(_ string, _ dbus.Flags, args ...interface{}) *dbus.Call
 		Body: []interface{}{
 			[]interface{}{
 				d.IsAuthorized,
-				true,
+				d.IsChallenge,
 				map[string]string{
 					"polkit.retains_authorization_after_challenge": "true",
 					"polkit.dismissed": "true",
@@ -10,8 +10,10 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/ubuntu/adsys/internal/testutils"
 )
 
@@ -170,3 +172,102 @@ func TestMain(m *testing.M) {
 	defer testutils.StartLocalSystemBus()()
 	m.Run()
 }
+
+func TestIsAllowedCachesDecisions(t *testing.T) {
+	t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+
+	simpleAction := Action{ID: "simpleAction"}
+	otherAction := Action{ID: "otherAction"}
+
+	tests := map[string]struct {
+		secondAction Action
+		secondUID    uint32
+		expired      bool
+		noCache      bool
+
+		polkitAuthorize bool
+		polkitChallenge bool
+		wantPolkitError bool
+
+		wantPolkitCalls int
+	}{
+		"Authorization is cached":                 {polkitAuthorize: true, wantPolkitCalls: 1},
+		"Authorization after a challenge is kept": {polkitAuthorize: true, polkitChallenge: true, wantPolkitCalls: 1},
+		"Denial is cached":                        {polkitAuthorize: false, wantPolkitCalls: 1},
+
+		"Decisions are cached per action":        {secondAction: otherAction, polkitAuthorize: true, wantPolkitCalls: 2},
+		"Decisions are cached per user":          {secondUID: 1001, polkitAuthorize: true, wantPolkitCalls: 2},
+		"Denial after a challenge is not cached": {polkitAuthorize: false, polkitChallenge: true, wantPolkitCalls: 2},
+		"Expired decisions are not used":         {expired: true, polkitAuthorize: true, wantPolkitCalls: 2},
+		"Disabled cache always calls polkit":     {noCache: true, polkitAuthorize: true, wantPolkitCalls: 2},
+		"Polkit errors are not cached":           {wantPolkitError: true, polkitAuthorize: true, wantPolkitCalls: 2},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.secondAction.ID == "" {
+				tc.secondAction = simpleAction
+			}
+			if tc.secondUID == 0 {
+				tc.secondUID = 1000
+			}
+			ttl := time.Hour
+			if tc.expired {
+				ttl = time.Nanosecond
+			}
+			if tc.noCache {
+				ttl = 0
+			}
+
+			d := &DbusMock{
+				IsAuthorized:    tc.polkitAuthorize,
+				IsChallenge:     tc.polkitChallenge,
+				WantPolkitError: tc.wantPolkitError,
+			}
+			a, err := New(bus, WithAuthority(d), WithRoot("testdata"), WithCacheTTL(ttl))
+			require.NoError(t, err, "Setup: failed to create authorizer")
+
+			firstErr := a.isAllowed(context.Background(), simpleAction, 10000, 1000, 0)
+			if tc.expired {
+				time.Sleep(time.Millisecond)
+			}
+			secondErr := a.isAllowed(context.Background(), tc.secondAction, 10000, tc.secondUID, 0)
+
+			assert.Equal(t, tc.wantPolkitCalls, d.calls, "Polkit should have been called the expected number of times")
+			assert.Equal(t, firstErr == nil, secondErr == nil, "Both calls should have the same outcome")
+		})
+	}
+}
+
+func TestCacheIsClearedOnPolkitChange(t *testing.T) {
+	// t.Parallel() Emitting the polkit signal clears the cache of the authorizers of the other tests.
+
+	bus := testutils.NewDbusConn(t)
+
+	d := &DbusMock{IsAuthorized: true}
+	a, err := New(bus, WithAuthority(d), WithRoot("testdata"), WithCacheTTL(time.Hour))
+	require.NoError(t, err, "Setup: failed to create authorizer")
+
+	action := Action{ID: "simpleAction"}
+	require.NoError(t, a.isAllowed(context.Background(), action, 10000, 1000, 0), "Setup: first call should be authorized")
+	_, ok := a.cache.get(1000, action.ID)
+	require.True(t, ok, "Setup: decision should have been cached")
+
+	// Unrelated signals from the same object don't clear the cache.
+	err = bus.Emit(polkitObjectPath, polkitInterface+".Other")
+	require.NoError(t, err, "Setup: can't emit unrelated signal")
+
+	err = bus.Emit(polkitObjectPath, polkitInterface+".Changed")
+	require.NoError(t, err, "Setup: can't emit polkit Changed signal")
+
+	require.Eventually(t, func() bool {
+		_, ok := a.cache.get(1000, action.ID)
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond, "Cache should have been cleared on polkit change")
+
+	require.NoError(t, a.isAllowed(context.Background(), action, 10000, 1000, 0), "Second call should be authorized")
+	require.Equal(t, 2, d.calls, "Polkit should have been called again once the cache was cleared")
+}
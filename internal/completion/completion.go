@@ -0,0 +1,208 @@
+// Package completion installs the shell completion scripts of the adsys commands.
+//
+// When run as root, the scripts are installed in the vendor completion directories of the system, which are loaded
+// for every user. Otherwise, they are installed in the user completion directories, when the shell supports them,
+// or instructions to enable them are returned.
+package completion
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+)
+
+// Supported shells.
+const (
+	Bash = "bash"
+	Zsh  = "zsh"
+	Fish = "fish"
+)
+
+// Shells are the shells the completion scripts can be installed for.
+var Shells = []string{Bash, Zsh, Fish}
+
+// Generator writes to w the completion script of a command for shell.
+type Generator func(w io.Writer, shell string) error
+
+// Installer installs the completion scripts for the system or for the current user.
+type Installer struct {
+	system     bool
+	rootDir    string
+	dataHome   string
+	configHome string
+	shellEnv   string
+}
+
+type options struct {
+	system     bool
+	rootDir    string
+	dataHome   string
+	configHome string
+	shellEnv   string
+}
+
+// Option reprents an optional function to change the completion installer.
+type Option func(*options)
+
+// WithSystem overrides whether the scripts are installed for the whole system, instead of for the current user.
+func WithSystem(system bool) func(*options) {
+	return func(a *options) {
+		a.system = system
+	}
+}
+
+// WithRootDir overrides the root directory the system completion directories are relative to.
+func WithRootDir(p string) func(*options) {
+	return func(a *options) {
+		a.rootDir = p
+	}
+}
+
+// WithDataHome overrides the data directory of the current user.
+func WithDataHome(p string) func(*options) {
+	return func(a *options) {
+		a.dataHome = p
+	}
+}
+
+// WithConfigHome overrides the configuration directory of the current user.
+func WithConfigHome(p string) func(*options) {
+	return func(a *options) {
+		a.configHome = p
+	}
+}
+
+// WithShellEnv overrides the login shell of the current user, used when no shell is requested.
+func WithShellEnv(shell string) func(*options) {
+	return func(a *options) {
+		a.shellEnv = shell
+	}
+}
+
+// New returns a new completion installer.
+// The scripts are installed for the whole system when running as root, and for the current user otherwise.
+func New(opts ...Option) *Installer {
+	// defaults
+	args := options{
+		system:     os.Geteuid() == 0,
+		rootDir:    "/",
+		dataHome:   os.Getenv("XDG_DATA_HOME"),
+		configHome: os.Getenv("XDG_CONFIG_HOME"),
+		shellEnv:   os.Getenv("SHELL"),
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		if args.dataHome == "" {
+			args.dataHome = filepath.Join(home, ".local", "share")
+		}
+		if args.configHome == "" {
+			args.configHome = filepath.Join(home, ".config")
+		}
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Installer{
+		system:     args.system,
+		rootDir:    args.rootDir,
+		dataHome:   args.dataHome,
+		configHome: args.configHome,
+		shellEnv:   args.shellEnv,
+	}
+}
+
+// Shell returns shell if set, or the login shell of the current user otherwise.
+// An error is returned if the shell is not supported.
+func (i Installer) Shell(shell string) (string, error) {
+	if shell == "" {
+		if i.shellEnv == "" {
+			return "", errors.New(gotext.Get("can't detect your shell: please specify it among %s", strings.Join(Shells, ", ")))
+		}
+		shell = filepath.Base(i.shellEnv)
+	}
+	if !slices.Contains(Shells, shell) {
+		return "", errors.New(gotext.Get("unsupported shell %q: expected one of %s", shell, strings.Join(Shells, ", ")))
+	}
+	return shell, nil
+}
+
+// Install writes the completion script of the command name for shell, generated by gen.
+// It returns a message telling where the script was installed, or how to enable the completion when there is no
+// completion directory to install it to.
+func (i Installer) Install(name, shell string, gen Generator) (msg string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't install %s completion for %s", shell, name))
+
+	if !slices.Contains(Shells, shell) {
+		return "", errors.New(gotext.Get("unsupported shell %q: expected one of %s", shell, strings.Join(Shells, ", ")))
+	}
+
+	dest, err := i.dest(name, shell)
+	if err != nil {
+		return "", err
+	}
+	if dest == "" {
+		return gotext.Get(`zsh doesn't load the completion scripts of users from a directory. To enable the completion of %[1]s,
+add the following line to your ~/.zshrc, after compinit:
+  source <(%[1]s completion zsh)
+`, name), nil
+	}
+
+	var script bytes.Buffer
+	if err := gen(&script, shell); err != nil {
+		return "", err
+	}
+
+	// nolint:gosec // G301 completion directories are world readable
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	// nolint:gosec // G306 completion scripts are world readable
+	if err := os.WriteFile(dest+".new", script.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(dest+".new", dest); err != nil {
+		return "", err
+	}
+
+	return gotext.Get("Installed %s completion for %s in %s. It is loaded by new shells.\n", shell, name, dest), nil
+}
+
+// dest returns the path the completion script of the command name for shell is installed to, or an empty string if
+// the shell doesn't load scripts of users from any directory.
+func (i Installer) dest(name, shell string) (string, error) {
+	if i.system {
+		switch shell {
+		case Bash:
+			return filepath.Join(i.rootDir, "usr", "share", "bash-completion", "completions", name), nil
+		case Zsh:
+			return filepath.Join(i.rootDir, "usr", "share", "zsh", "vendor-completions", "_"+name), nil
+		case Fish:
+			return filepath.Join(i.rootDir, "usr", "share", "fish", "vendor_completions.d", name+".fish"), nil
+		}
+	}
+
+	var dir string
+	switch shell {
+	case Bash:
+		dir = filepath.Join(i.dataHome, "bash-completion", "completions")
+	case Fish:
+		dir = filepath.Join(i.configHome, "fish", "completions")
+	default:
+		return "", nil
+	}
+	if !filepath.IsAbs(dir) {
+		return "", errors.New(gotext.Get("can't find the completion directory of the current user: no home directory"))
+	}
+	if shell == Fish {
+		return filepath.Join(dir, name+".fish"), nil
+	}
+	return filepath.Join(dir, name), nil
+}
@@ -0,0 +1,132 @@
+package completion_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/completion"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestShell(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		shell    string
+		shellEnv string
+
+		want    string
+		wantErr bool
+	}{
+		"Requested shell":                     {shell: "fish", shellEnv: "/bin/bash", want: "fish"},
+		"Detected shell":                      {shellEnv: "/usr/bin/zsh", want: "zsh"},
+		"Detected shell without path":         {shellEnv: "bash", want: "bash"},
+		"Requested shell without login shell": {shell: "bash", want: "bash"},
+
+		// Error cases
+		"Error on unsupported requested shell": {shell: "powershell", shellEnv: "/bin/bash", wantErr: true},
+		"Error on unsupported detected shell":  {shellEnv: "/bin/tcsh", wantErr: true},
+		"Error on undetectable shell":          {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			i := completion.New(completion.WithShellEnv(tc.shellEnv))
+			got, err := i.Shell(tc.shell)
+			if tc.wantErr {
+				require.Error(t, err, "Shell should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Shell failed but shouldn't have")
+			require.Equal(t, tc.want, got, "Shell returned an unexpected shell")
+		})
+	}
+}
+
+func TestInstall(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		shell      string
+		system     bool
+		noHome     bool
+		existing   bool
+		genErr     bool
+		readOnlyIn string
+
+		wantErr bool
+	}{
+		"System bash completion":                  {shell: "bash", system: true},
+		"System zsh completion":                   {shell: "zsh", system: true},
+		"System fish completion":                  {shell: "fish", system: true},
+		"User bash completion":                    {shell: "bash"},
+		"User fish completion":                    {shell: "fish"},
+		"User zsh completion prints instructions": {shell: "zsh"},
+		"User zsh completion doesn't need a home": {shell: "zsh", noHome: true},
+		"Existing completion is replaced":         {shell: "bash", system: true, existing: true},
+
+		// Error cases
+		"Error on unsupported shell":            {shell: "powershell", system: true, wantErr: true},
+		"Error on user completion without home": {shell: "bash", noHome: true, wantErr: true},
+		"Error on failing generator":            {shell: "bash", system: true, genErr: true, wantErr: true},
+		"Error on unwritable directory":         {shell: "bash", system: true, readOnlyIn: "usr/share", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			dataHome := filepath.Join(root, "home", "user", ".local", "share")
+			configHome := filepath.Join(root, "home", "user", ".config")
+			if tc.noHome {
+				dataHome, configHome = "", ""
+			}
+
+			if tc.existing {
+				p := filepath.Join(root, "usr", "share", "bash-completion", "completions", "adsysctl")
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create completion directory")
+				require.NoError(t, os.WriteFile(p, []byte("old completion\n"), 0600), "Setup: can't create existing completion")
+			}
+			if tc.readOnlyIn != "" {
+				require.NoError(t, os.MkdirAll(filepath.Join(root, tc.readOnlyIn), 0750), "Setup: can't create directory")
+				testutils.MakeReadOnly(t, filepath.Join(root, tc.readOnlyIn))
+			}
+
+			gen := func(w io.Writer, shell string) error {
+				if tc.genErr {
+					return errors.New("generator error")
+				}
+				_, err := fmt.Fprintf(w, "%s completion of adsysctl\n", shell)
+				return err
+			}
+
+			i := completion.New(
+				completion.WithSystem(tc.system),
+				completion.WithRootDir(root),
+				completion.WithDataHome(dataHome),
+				completion.WithConfigHome(configHome),
+			)
+			msg, err := i.Install("adsysctl", tc.shell, gen)
+			if tc.wantErr {
+				require.Error(t, err, "Install should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Install failed but shouldn't have")
+
+			// The message references the temporary directory.
+			msg = strings.ReplaceAll(msg, root, "#ROOT#")
+			require.NoError(t, os.WriteFile(filepath.Join(root, "message"), []byte(msg), 0600), "Setup: can't write message")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
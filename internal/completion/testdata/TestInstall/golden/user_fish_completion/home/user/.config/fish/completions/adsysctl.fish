@@ -0,0 +1 @@
+fish completion of adsysctl
@@ -0,0 +1,18 @@
+package config
+
+import "testing"
+
+// SetSchemaKey adds or replaces the top level key name in the schema for the duration of the test.
+func SetSchemaKey(t *testing.T, name string, k Key) {
+	t.Helper()
+
+	orig, existed := schema[name]
+	schema[name] = k
+	t.Cleanup(func() {
+		if existed {
+			schema[name] = orig
+			return
+		}
+		delete(schema, name)
+	})
+}
@@ -0,0 +1,274 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+	"gopkg.in/yaml.v3"
+)
+
+// Kind is the type of the value of a configuration key.
+type Kind int
+
+// Supported configuration value kinds.
+const (
+	KindString Kind = iota
+	KindInt
+	KindBool
+	KindDuration
+	KindSection
+)
+
+// String returns the name of the kind, as displayed to the user.
+func (k Kind) String() string {
+	switch k {
+	case KindInt:
+		return "integer"
+	case KindBool:
+		return "boolean"
+	case KindDuration:
+		return "duration"
+	case KindSection:
+		return "section"
+	default:
+		return "string"
+	}
+}
+
+// Key is the definition of a configuration key.
+type Key struct {
+	// Kind is the type of the value.
+	Kind Kind
+	// Values is the list of allowed values, if restricted.
+	Values []string
+	// Deprecated explains what to use instead of this key, if it is deprecated.
+	Deprecated string
+	// Keys are the keys of a section.
+	Keys map[string]Key
+}
+
+// schema is the definition of the keys of adsys.yaml, shared by adsysd and adsysctl.
+var schema = map[string]Key{
+	"verbose": {Kind: KindInt},
+	"socket":  {Kind: KindString},
+
+	// Service only configuration
+	"service_timeout":        {Kind: KindInt},
+	"cache_dir":              {Kind: KindString},
+	"state_dir":              {Kind: KindString},
+	"run_dir":                {Kind: KindString},
+	"dconf_dir":              {Kind: KindString},
+	"sudoers_dir":            {Kind: KindString},
+	"policykit_dir":          {Kind: KindString},
+	"apparmor_dir":           {Kind: KindString},
+	"apparmorfs_dir":         {Kind: KindString},
+	"systemunit_dir":         {Kind: KindString},
+	"global_trust_dir":       {Kind: KindString},
+	"rollout_ring":           {Kind: KindString},
+	"connectivity_check_url": {Kind: KindString},
+	"security_module":        {Kind: KindString, Values: []string{"apparmor", "selinux"}},
+	"telemetry":              {Kind: KindBool},
+	"policy_history":         {Kind: KindBool},
+	"read_only":              {Kind: KindBool},
+	"staging_dir":            {Kind: KindString},
+	"timeouts": {Kind: KindSection, Keys: map[string]Key{
+		"gpo_list":         {Kind: KindDuration},
+		"gpo_list_retries": {Kind: KindInt},
+		"sysvol_download":  {Kind: KindDuration},
+		"enrollment_http":  {Kind: KindDuration},
+		"helper_exec":      {Kind: KindDuration},
+		"ldap":             {Kind: KindDuration},
+		"package_lock":     {Kind: KindDuration},
+		"helper_exec_overrides": {Kind: KindSection, Keys: durations(
+			"accounts", "audit", "broadcast", "certificate", "compliance", "dns", "encryption", "enrollment",
+			"firewall", "flatpak", "grub", "localusers", "network", "power", "printers", "privilege", "quota",
+			"selinux", "snap", "sshd", "sysctl", "timesync", "vpn")},
+	}},
+	"sysvol_bandwidth": {Kind: KindSection, Keys: map[string]Key{
+		"limit":    {Kind: KindInt},
+		"off_peak": {Kind: KindString},
+	}},
+	"ad_backend": {Kind: KindString, Values: []string{"sssd", "winbind", "keytab"}},
+	"sssd": {Kind: KindSection, Keys: map[string]Key{
+		"config":    {Kind: KindString},
+		"cache_dir": {Kind: KindString},
+	}},
+	"winbind": {Kind: KindSection, Keys: map[string]Key{
+		"ad_domain": {Kind: KindString},
+		"ad_server": {Kind: KindString},
+	}},
+	"keytab": {Kind: KindSection, Keys: map[string]Key{
+		"keytab":    {Kind: KindString},
+		"principal": {Kind: KindString},
+		"ad_domain": {Kind: KindString},
+		"ad_server": {Kind: KindString},
+	}},
+	"detect_cached_ticket": {Kind: KindBool},
+
+	// Client only configuration
+	"client_timeout": {Kind: KindInt},
+}
+
+// durations returns the keys of a section whose values are all durations.
+func durations(names ...string) map[string]Key {
+	keys := make(map[string]Key, len(names))
+	for _, n := range names {
+		keys[n] = Key{Kind: KindDuration}
+	}
+	return keys
+}
+
+// ValidateFile checks the configuration file at path against the schema.
+// It returns the warnings about deprecated keys, and an error listing all the invalid keys and values.
+func ValidateFile(path string) (warnings []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid configuration file %s", path))
+
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Validate(d)
+}
+
+// Validate checks the YAML configuration content against the schema.
+// It returns the warnings about deprecated keys, and an error listing all the invalid keys and values.
+func Validate(content []byte) (warnings []string, err error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	// Empty file
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	var errs []error
+	validateSection(doc.Content[0], "", schema, &warnings, &errs)
+	return warnings, errors.Join(errs...)
+}
+
+// validateSection checks the mapping node against the keys of the section named prefix.
+// Warnings and errors are appended to the given lists.
+func validateSection(n *yaml.Node, prefix string, keys map[string]Key, warnings *[]string, errs *[]error) {
+	if n.Kind != yaml.MappingNode {
+		*errs = append(*errs, errors.New(gotext.Get("line %d: %s should be a section", n.Line, sectionName(prefix))))
+		return
+	}
+
+	var names []string
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		kn, vn := n.Content[i], n.Content[i+1]
+		name := prefix + kn.Value
+
+		k, ok := keys[kn.Value]
+		if !ok {
+			msg := gotext.Get("line %d: unknown key %q", kn.Line, name)
+			if s := suggest(kn.Value, names); s != "" {
+				msg = gotext.Get("line %d: unknown key %q, did you mean %q?", kn.Line, name, prefix+s)
+			}
+			*errs = append(*errs, errors.New(msg))
+			continue
+		}
+		if k.Deprecated != "" {
+			*warnings = append(*warnings, gotext.Get("line %d: %q is deprecated: %s", kn.Line, name, k.Deprecated))
+		}
+
+		if k.Kind == KindSection {
+			// An empty section, with all its keys commented out, is valid.
+			if vn.Tag == "!!null" {
+				continue
+			}
+			validateSection(vn, name+".", k.Keys, warnings, errs)
+			continue
+		}
+		if err := validateValue(vn, k); err != nil {
+			*errs = append(*errs, errors.New(gotext.Get("line %d: invalid value for %q: %v", vn.Line, name, err)))
+		}
+	}
+}
+
+// validateValue checks that the value node matches the kind and the allowed values of k.
+func validateValue(n *yaml.Node, k Key) error {
+	if n.Kind != yaml.ScalarNode {
+		return errors.New(gotext.Get("expected a %s", k.Kind))
+	}
+
+	switch k.Kind {
+	case KindInt:
+		if n.Tag != "!!int" {
+			return errors.New(gotext.Get("expected an integer, got %q", n.Value))
+		}
+	case KindBool:
+		if n.Tag != "!!bool" {
+			return errors.New(gotext.Get("expected true or false, got %q", n.Value))
+		}
+	case KindDuration:
+		if _, err := time.ParseDuration(n.Value); err != nil {
+			return errors.New(gotext.Get("expected a duration like 30s or 5m, got %q", n.Value))
+		}
+	}
+
+	if len(k.Values) > 0 && !slices.Contains(k.Values, n.Value) {
+		msg := gotext.Get("%q is not one of %s", n.Value, strings.Join(k.Values, ", "))
+		if s := suggest(n.Value, k.Values); s != "" {
+			msg = gotext.Get("%q is not one of %s, did you mean %q?", n.Value, strings.Join(k.Values, ", "), s)
+		}
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// sectionName returns the name of the section from its key prefix.
+func sectionName(prefix string) string {
+	if prefix == "" {
+		return gotext.Get("the configuration")
+	}
+	return fmt.Sprintf("%q", strings.TrimSuffix(prefix, "."))
+}
+
+// suggest returns the closest candidate to s, if it is close enough to be a misspelling.
+func suggest(s string, candidates []string) string {
+	var best string
+	// Allow one edit every three characters.
+	bestDistance := len(s)/3 + 1
+	for _, c := range candidates {
+		if d := levenshtein(strings.ToLower(s), c); d < bestDistance || (d == bestDistance && best == "") {
+			best, bestDistance = c, d
+		}
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
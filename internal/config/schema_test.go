@@ -0,0 +1,124 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/config"
+)
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		content    string
+		deprecated string
+
+		wantWarnings []string
+		wantErrs     []string
+	}{
+		"Valid configuration": {content: `
+verbose: 2
+socket: /run/adsysd.sock
+service_timeout: 3600
+read_only: true
+ad_backend: winbind
+timeouts:
+  gpo_list: 10s
+  gpo_list_retries: 2
+  helper_exec_overrides:
+    grub: 5m
+  ldap: 1m
+sysvol_bandwidth:
+  limit: 512
+  off_peak: 22:00-06:00
+winbind:
+  ad_domain: domain.com
+sssd:
+  config: /etc/sssd/sssd.conf
+client_timeout: 60
+`},
+		"Empty file is valid":                 {content: ""},
+		"Only comments is valid":              {content: "# verbose: 2\n"},
+		"Empty section is valid":              {content: "timeouts:\n#  gpo_list: 10s\n"},
+		"Deprecated keys are warned about":    {content: "verbose: 1\nold_key: value\n", deprecated: "old_key", wantWarnings: []string{`line 2: "old_key" is deprecated: use new_key instead`}},
+		"Example configuration file is valid": {content: "example"},
+
+		// Error cases
+		"Error on unknown key":                    {content: "unknown: value", wantErrs: []string{`line 1: unknown key "unknown"`}},
+		"Error on misspelled key with suggestion": {content: "ad_backed: sssd", wantErrs: []string{`line 1: unknown key "ad_backed", did you mean "ad_backend"?`}},
+		"Error on key with wrong case":            {content: "Verbose: 2", wantErrs: []string{`line 1: unknown key "Verbose", did you mean "verbose"?`}},
+		"Error on misspelled key in section":      {content: "sssd:\n  cache-dir: /var/lib/sss/db", wantErrs: []string{`line 2: unknown key "sssd.cache-dir", did you mean "sssd.cache_dir"?`}},
+		"Error on misspelled backend":             {content: "ad_backend: windbind", wantErrs: []string{`line 1: invalid value for "ad_backend": "windbind" is not one of sssd, winbind, keytab, did you mean "winbind"?`}},
+		"Error on unknown backend":                {content: "ad_backend: kerberos", wantErrs: []string{`line 1: invalid value for "ad_backend": "kerberos" is not one of sssd, winbind, keytab`}},
+		"Error on invalid integer":                {content: "service_timeout: 1h", wantErrs: []string{`line 1: invalid value for "service_timeout": expected an integer, got "1h"`}},
+		"Error on invalid boolean":                {content: "read_only: enabled", wantErrs: []string{`line 1: invalid value for "read_only": expected true or false, got "enabled"`}},
+		"Error on invalid duration":               {content: "timeouts:\n  helper_exec: 30", wantErrs: []string{`line 2: invalid value for "timeouts.helper_exec": expected a duration like 30s or 5m, got "30"`}},
+		"Error on unknown helper override":        {content: "timeouts:\n  helper_exec_overrides:\n    grubs: 5m", wantErrs: []string{`line 3: unknown key "timeouts.helper_exec_overrides.grubs", did you mean "timeouts.helper_exec_overrides.grub"?`}},
+		"Error on section as a value":             {content: "winbind: domain.com", wantErrs: []string{`line 1: "winbind" should be a section`}},
+		"Error on list as a value":                {content: "socket:\n  - /run/adsysd.sock", wantErrs: []string{`line 2: invalid value for "socket": expected a string`}},
+		"Error on configuration not a section":    {content: "- verbose", wantErrs: []string{`line 1: the configuration should be a section`}},
+		"Error on invalid YAML":                   {content: "verbose: [", wantErrs: []string{"yaml"}},
+		"All errors are reported": {content: "verbos: 2\nad_backend: sss\nread_only: 1", wantErrs: []string{
+			`line 1: unknown key "verbos", did you mean "verbose"?`,
+			`line 2: invalid value for "ad_backend": "sss" is not one of sssd, winbind, keytab, did you mean "sssd"?`,
+			`line 3: invalid value for "read_only": expected true or false, got "1"`,
+		}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if tc.deprecated != "" {
+				config.SetSchemaKey(t, tc.deprecated, config.Key{Kind: config.KindString, Deprecated: "use new_key instead"})
+			}
+
+			content := []byte(tc.content)
+			if tc.content == "example" {
+				var err error
+				content, err = os.ReadFile(filepath.Join("..", "..", "conf.example", "adsys.yaml"))
+				require.NoError(t, err, "Setup: can't read example configuration")
+			}
+
+			warnings, err := config.Validate(content)
+			if tc.wantErrs != nil {
+				require.Error(t, err, "Validate should have failed but didn't")
+				for _, want := range tc.wantErrs {
+					require.ErrorContains(t, err, want, "Validate should report the error")
+				}
+				return
+			}
+			require.NoError(t, err, "Validate failed but shouldn't have")
+			require.Equal(t, tc.wantWarnings, warnings, "Validate should return the expected warnings")
+		})
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		noFile  bool
+
+		wantErr bool
+	}{
+		"Valid file": {content: "verbose: 2"},
+
+		// Error cases
+		"Error on invalid file": {content: "verbos: 2", wantErr: true},
+		"Error on missing file": {noFile: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "adsys.yaml")
+			if !tc.noFile {
+				require.NoError(t, os.WriteFile(p, []byte(tc.content), 0600), "Setup: can't write configuration file")
+			}
+
+			_, err := config.ValidateFile(p)
+			if tc.wantErr {
+				require.Error(t, err, "ValidateFile should have failed but didn't")
+				require.ErrorContains(t, err, p, "ValidateFile error should contain the file path")
+				return
+			}
+			require.NoError(t, err, "ValidateFile failed but shouldn't have")
+		})
+	}
+}
@@ -28,6 +28,9 @@ const (
 	// DefaultStateDir is the default path for adsys system state directory.
 	DefaultStateDir = "/var/lib/adsys"
 
+	// DefaultStagingDir is the default path where changes are staged in read-only mode.
+	DefaultStagingDir = "/var/lib/adsys/staging"
+
 	// DefaultRunDir is the default path for adsys run directory.
 	DefaultRunDir = "/run/adsys"
 
@@ -43,6 +46,37 @@ const (
 	// DefaultGpoListTimeout is the default time to wait for the GPO list subcommand to finish.
 	DefaultGpoListTimeout = 10 * time.Second
 
+	// DefaultNegativeCacheTTL is the default time a user without applicable GPOs, or whose GPO lookup failed,
+	// is not looked up again in AD.
+	DefaultNegativeCacheTTL = 30 * time.Second
+
+	// DefaultNegativeCacheMaxTTL is the maximum time a user is not looked up again in AD after consecutive negative lookups.
+	DefaultNegativeCacheMaxTTL = 10 * time.Minute
+
+	// DefaultCaptivePortalBackoff is the default time AD is not contacted again once a captive portal is suspected.
+	// This duration doubles on each consecutive detection, up to DefaultCaptivePortalMaxBackoff.
+	DefaultCaptivePortalBackoff = time.Minute
+	// DefaultCaptivePortalMaxBackoff is the maximum time AD is not contacted again while a captive portal is suspected.
+	DefaultCaptivePortalMaxBackoff = 15 * time.Minute
+	// DefaultConnectivityCheckURL is the URL answering with an empty HTTP 204 response used to detect captive portals.
+	DefaultConnectivityCheckURL = "http://connectivity-check.ubuntu.com/"
+
+	// DefaultSysvolDownloadTimeout is the default time to wait for the GPOs and assets to be downloaded from SYSVOL.
+	DefaultSysvolDownloadTimeout = 5 * time.Minute
+
+	// DefaultEnrollmentHTTPTimeout is the default time to wait for each HTTP request during certificate enrollment.
+	DefaultEnrollmentHTTPTimeout = 10 * time.Second
+
+	// DefaultHelperExecTimeout is the default time to wait for an external helper command to finish.
+	DefaultHelperExecTimeout = 30 * time.Second
+
+	// DefaultLdapTimeout is the default time to wait for each LDAP request of the policy managers to the directory.
+	DefaultLdapTimeout = 30 * time.Second
+
+	// DefaultPackageLockTimeout is the default time to wait for the package manager transactions to complete
+	// before installing packages or restarting services.
+	DefaultPackageLockTimeout = 10 * time.Minute
+
 	// DistroID is the distro ID which can be overridden at build time.
 	DistroID = "Ubuntu"
 )
@@ -54,6 +88,14 @@ const (
 
 	// AdysMachineScriptsServiceName is the machine script systemd service.
 	AdysMachineScriptsServiceName = "adsys-machine-scripts.service"
+	// AdsysUserScriptsServiceName is the user script systemd user service.
+	AdsysUserScriptsServiceName = "adsys-user-scripts.service"
+	// DefaultStuckUserUnitTimeout is the time after which a user script unit still activating is considered stuck.
+	DefaultStuckUserUnitTimeout = time.Hour
+	// AdsysMachinePolicyAppliedTargetName is the systemd target reached once machine policies are applied.
+	AdsysMachinePolicyAppliedTargetName = "adsys-machine-policy-applied.target"
+	// MachinePolicyAppliedFlag is the flag, relative to the machine run directory, created after a successful machine refresh.
+	MachinePolicyAppliedFlag = ".policies-applied"
 
 	// DefaultDconfDir is the default dconf directory.
 	DefaultDconfDir = "/etc/dconf"
@@ -67,6 +109,76 @@ const (
 	DefaultSystemUnitDir = "/etc/systemd/system"
 	// DefaultGlobalTrustDir is the default directory for the global trust store.
 	DefaultGlobalTrustDir = "/usr/local/share/ca-certificates"
+	// DefaultEvolutionSourcesDir is the default directory for evolution-data-server read-only system sources.
+	DefaultEvolutionSourcesDir = "/usr/share/evolution-data-server/ro-sources"
+	// DefaultThunderbirdPoliciesDir is the default directory for Thunderbird enterprise policies.
+	DefaultThunderbirdPoliciesDir = "/etc/thunderbird/policies"
+	// DefaultFirefoxPoliciesDir is the default directory for Firefox enterprise policies.
+	DefaultFirefoxPoliciesDir = "/etc/firefox/policies"
+	// DefaultFirefoxInstallDir is the default installation directory of the Firefox deb package.
+	DefaultFirefoxInstallDir = "/usr/lib/firefox"
+	// DefaultChromePoliciesDir is the default directory for Google Chrome policies.
+	DefaultChromePoliciesDir = "/etc/opt/chrome/policies"
+	// DefaultChromiumPoliciesDir is the default directory for Chromium policies.
+	DefaultChromiumPoliciesDir = "/etc/chromium/policies"
+	// DefaultShortcutsApplicationsDir is the default directory of the machine shortcuts in the applications menu.
+	DefaultShortcutsApplicationsDir = "/usr/local/share/applications"
+	// DefaultShortcutsIconsDir is the default icons base directory of the machine shortcuts.
+	DefaultShortcutsIconsDir = "/usr/local/share/icons"
+	// DefaultGDMCustomConf is the default GDM custom configuration file.
+	DefaultGDMCustomConf = "/etc/gdm3/custom.conf"
+	// DefaultGreeterAssetsDir is the default directory of the login screen logo and background deployed from the assets.
+	DefaultGreeterAssetsDir = "/usr/local/share/adsys/gdm"
+	// DefaultPortalsConfDir is the default directory for xdg-desktop-portal system configuration.
+	DefaultPortalsConfDir = "/etc/xdg/xdg-desktop-portal"
+	// DefaultPortalsDataDir is the default directory for xdg-desktop-portal configuration shipped by the distribution.
+	DefaultPortalsDataDir = "/usr/share/xdg-desktop-portal"
+	// DefaultSessionsDataDir is the default directory containing the wayland-sessions and xsessions directories.
+	DefaultSessionsDataDir = "/usr/share"
+	// DefaultUserUnitDir is the default directory for systemd user unit files.
+	DefaultUserUnitDir = "/etc/systemd/user"
+	// DefaultAptPreferencesDir is the default directory for apt preferences.
+	DefaultAptPreferencesDir = "/etc/apt/preferences.d"
+	// DefaultAptSourcesDir is the default directory for apt sources files.
+	DefaultAptSourcesDir = "/etc/apt/sources.list.d"
+	// DefaultAptKeyringsDir is the default directory for the signing keys of the apt repositories.
+	DefaultAptKeyringsDir = "/etc/apt/keyrings"
+	// DefaultAptConfDir is the default directory for apt configuration files.
+	DefaultAptConfDir = "/etc/apt/apt.conf.d"
+	// DefaultSysctlDir is the default directory for kernel parameters configuration files.
+	DefaultSysctlDir = "/etc/sysctl.d"
+	// DefaultAuditRulesDir is the default directory for audit rules files.
+	DefaultAuditRulesDir = "/etc/audit/rules.d"
+	// DefaultUSBGuardRulesDir is the default directory for USBGuard rules files.
+	DefaultUSBGuardRulesDir = "/etc/usbguard/rules.d"
+	// DefaultNetworkConnectionsDir is the default directory for NetworkManager system connections.
+	DefaultNetworkConnectionsDir = "/etc/NetworkManager/system-connections"
+	// DefaultChronySourcesDir is the default directory for chrony time sources files.
+	DefaultChronySourcesDir = "/etc/chrony/sources.d"
+	// DefaultTimesyncdConfDir is the default directory for systemd-timesyncd configuration files.
+	DefaultTimesyncdConfDir = "/etc/systemd/timesyncd.conf.d"
+	// DefaultLogindConfDir is the default directory for systemd-logind configuration files.
+	DefaultLogindConfDir = "/etc/systemd/logind.conf.d"
+	// DefaultModprobeDir is the default directory for modprobe configuration files.
+	DefaultModprobeDir = "/etc/modprobe.d"
+	// DefaultSSHDConfigDir is the default directory for sshd configuration drop-in files.
+	DefaultSSHDConfigDir = "/etc/ssh/sshd_config.d"
+	// DefaultEncryptionUnlockKeyFile is the default path of the key file provisioned to unlock the encrypted root device.
+	DefaultEncryptionUnlockKeyFile = "/etc/adsys/luks-unlock.key"
+	// DefaultConfigPath is the default path of the adsys configuration file written by adsysctl init.
+	DefaultConfigPath = "/etc/adsys.yaml"
+	// DefaultPolkitActionsDir is the default directory of the polkit actions definitions.
+	DefaultPolkitActionsDir = "/usr/share/polkit-1/actions"
+	// DefaultSmbConf is the default smb.conf location, used by winbind.
+	DefaultSmbConf = "/etc/samba/smb.conf"
+)
+
+// Keytab backend related properties.
+const (
+	// DefaultKeytab is the default machine keytab location.
+	DefaultKeytab = "/etc/krb5.keytab"
+	// DefaultKeytabKrb5CCName is the default path of the machine ticket requested from the keytab.
+	DefaultKeytabKrb5CCName = "/run/adsys/krb5cc_keytab"
 )
 
 // SSSD related properties.
@@ -99,6 +211,20 @@ const (
 	SystemdDbusServiceInterface = "org.freedesktop.systemd1.Service"
 )
 
+// logind related properties.
+const (
+	// LogindDbusRegisteredName is the well-known name of logind on dbus.
+	LogindDbusRegisteredName = "org.freedesktop.login1"
+	// LogindDbusObjectPath is the logind path for dbus.
+	LogindDbusObjectPath = "/org/freedesktop/login1"
+	// LogindDbusManagerInterface is the interface we are using to access dbus methods.
+	LogindDbusManagerInterface = "org.freedesktop.login1.Manager"
+	// LogindDbusUserInterface is the interface we are using to access user objects.
+	LogindDbusUserInterface = "org.freedesktop.login1.User"
+	// LogindDbusSessionInterface is the interface we are using to access session objects.
+	LogindDbusSessionInterface = "org.freedesktop.login1.Session"
+)
+
 // Ubuntu Advantage related properties.
 const (
 	// SubscriptionDbusRegisteredName is the well-known name of UA on dbus.
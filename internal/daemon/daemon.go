@@ -8,12 +8,14 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/coreos/go-systemd/v22/activation"
 	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
 	"github.com/ubuntu/decorate"
 	"google.golang.org/grpc"
@@ -30,17 +32,26 @@ type Daemon struct {
 	shutdown sync.Once
 
 	lis        chan net.Listener
+	listener   net.Listener
 	socketAddr string
 	socketMu   sync.RWMutex
 
 	systemdSdNotifier   func(unsetEnvironment bool, state string) (bool, error)
 	useSocketActivation bool
+
+	handoffStateFile string
+	runState         func() []string
+	previous         *handoffState
+	handoffReady     *os.File
 }
 
 type options struct {
 	idlingTimeout time.Duration
 	serverQuit    func(context.Context)
 
+	handoffStateFile string
+	runState         func() []string
+
 	// private member that we export for tests.
 	systemdActivationListener func() ([]net.Listener, error)
 	systemdSdNotifier         func(unsetEnvironment bool, state string) (bool, error)
@@ -67,14 +78,33 @@ func WithServerQuit(f func(context.Context)) func(o *options) error {
 	}
 }
 
+// WithHandoffStateFile specifies the file where the state is handed off to a new daemon on upgrade.
+func WithHandoffStateFile(p string) func(o *options) error {
+	return func(o *options) error {
+		o.handoffStateFile = p
+		return nil
+	}
+}
+
+// WithRunState adds a function listing the refreshes in progress, to hand them off to a new daemon on upgrade.
+func WithRunState(f func() []string) func(o *options) error {
+	return func(o *options) error {
+		o.runState = f
+		return nil
+	}
+}
+
 // New returns an new, initialized daemon server, which handles systemd activation.
 // If systemd activation is used, it will override any socket passed here.
+// If we are started by a previous daemon handing off, we take over its socket.
 func New(registerGRPCServer GRPCServerRegisterer, socket string, opts ...option) (d *Daemon, err error) {
 	defer decorate.OnError(&err, gotext.Get("can't create daemon"))
 
 	// defaults
 	args := options{
 		serverQuit:                func(context.Context) {},
+		handoffStateFile:          filepath.Join(consts.DefaultRunDir, "handoff.json"),
+		runState:                  func() []string { return nil },
 		systemdActivationListener: activation.Listeners,
 		systemdSdNotifier:         daemon.SdNotify,
 	}
@@ -93,25 +123,20 @@ func New(registerGRPCServer GRPCServerRegisterer, socket string, opts ...option)
 
 		lis:               make(chan net.Listener, 1),
 		systemdSdNotifier: args.systemdSdNotifier,
-	}
 
-	// systemd socket activation or local creation
-	listeners, err := args.systemdActivationListener()
-	if err != nil {
-		return nil, err
+		handoffStateFile: args.handoffStateFile,
+		runState:         args.runState,
 	}
 
-	switch len(listeners) {
-	case 0:
-		if err = d.UseSocket(socket); err != nil {
+	// handoff from previous daemon, systemd socket activation or local creation
+	if stateFile := os.Getenv(handoffEnv); stateFile != "" {
+		lis, err := d.takeOver(stateFile)
+		if err != nil {
 			return nil, err
 		}
-
-	case 1:
-		d.useSocketActivation = true
-		d.lis <- listeners[0]
-	default:
-		return nil, errors.New(gotext.Get("unexpected number of systemd socket activation (%d != 1)", len(listeners)))
+		d.lis <- lis
+	} else if err := d.listenFromSystemd(args.systemdActivationListener, socket); err != nil {
+		return nil, err
 	}
 
 	d.grpcserver = d.registerGRPCServer(d)
@@ -121,6 +146,25 @@ func New(registerGRPCServer GRPCServerRegisterer, socket string, opts ...option)
 	return d, nil
 }
 
+// listenFromSystemd listens on the systemd activated socket if any, or on socket otherwise.
+func (d *Daemon) listenFromSystemd(systemdActivationListener func() ([]net.Listener, error), socket string) error {
+	listeners, err := systemdActivationListener()
+	if err != nil {
+		return err
+	}
+
+	switch len(listeners) {
+	case 0:
+		return d.UseSocket(socket)
+	case 1:
+		d.useSocketActivation = true
+		d.lis <- listeners[0]
+		return nil
+	default:
+		return errors.New(gotext.Get("unexpected number of systemd socket activation (%d != 1)", len(listeners)))
+	}
+}
+
 // UseSocket listens on new given socket. If we were listening on another socket first, the connection will be teared down.
 // Note that this has no effect if we were using socket activation.
 func (d *Daemon) UseSocket(socket string) (err error) {
@@ -157,17 +201,26 @@ func (d *Daemon) UseSocket(socket string) (err error) {
 func (d *Daemon) Listen() (err error) {
 	defer decorate.OnError(&err, gotext.Get("can't serve"))
 
-	if sent, err := d.systemdSdNotifier(false, "READY=1"); err != nil {
-		return errors.New(gotext.Get("couldn't send ready notification to systemd: %v", err))
-	} else if sent {
-		log.Debug(context.Background(), gotext.Get("Ready state sent to systemd"))
+	// When taking over, the service is already ready: the previous daemon, still its main process,
+	// notifies systemd that we are the new one.
+	if d.previous == nil {
+		if sent, err := d.systemdSdNotifier(false, "READY=1"); err != nil {
+			return errors.New(gotext.Get("couldn't send ready notification to systemd: %v", err))
+		} else if sent {
+			log.Debug(context.Background(), gotext.Get("Ready state sent to systemd"))
+		}
 	}
 
 	lis := <-d.lis
 	d.socketMu.Lock()
+	d.listener = lis
 	d.socketAddr = lis.Addr().String()
 	d.socketMu.Unlock()
 
+	if err := d.notifyHandoffReady(); err != nil {
+		return err
+	}
+
 	// handle socket configuration reloading
 	for {
 		log.Info(context.Background(), gotext.Get("Serving on %s", lis.Addr().String()))
@@ -184,6 +237,7 @@ func (d *Daemon) Listen() (err error) {
 			break
 		}
 		d.socketMu.Lock()
+		d.listener = lis
 		d.socketAddr = lis.Addr().String()
 		d.socketMu.Unlock()
 		d.grpcserver = d.registerGRPCServer(d)
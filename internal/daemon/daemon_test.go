@@ -3,8 +3,11 @@ package daemon_test
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"net"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -279,6 +282,161 @@ func TestCannotCreateSocket(t *testing.T) {
 	require.NotNil(t, err, "Expected New to fail as can't create socket")
 }
 
+func TestHandoff(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		newDaemonFail bool
+
+		wantErr bool
+	}{
+		"New daemon takes over socket and refreshes in progress": {},
+
+		"Error when new daemon fails to start": {newDaemonFail: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			sock := filepath.Join(dir, "test.sock")
+			stateFile := filepath.Join(dir, "handoff.json")
+			grpcRegister := &grpcServiceRegister{}
+
+			var notified []string
+			d, err := daemon.New(grpcRegister.registerGRPCServer, sock,
+				daemon.WithHandoffStateFile(stateFile),
+				daemon.WithRunState(func() []string { return []string{"ubuntu"} }),
+				daemon.WithSystemdSdNotifier(func(_ bool, state string) (bool, error) {
+					notified = append(notified, state)
+					return true, nil
+				}))
+			require.NoError(t, err, "New should return the daemon handler")
+
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			go func() {
+				err = d.Listen()
+				wg.Done()
+			}()
+			// make sure Serve() is called. Even std golang grpc has this timeout in tests
+			time.Sleep(time.Millisecond * 10)
+
+			behaviour := ""
+			if tc.newDaemonFail {
+				behaviour = "fail"
+			}
+			handoffErr := d.Handoff("env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockNewDaemon", "--", dir, behaviour)
+			require.NoFileExists(t, stateFile, "Handoff state file should have been removed")
+			if tc.wantErr {
+				require.Error(t, handoffErr, "Handoff should have failed but didn't")
+				conn, err := net.Dial("unix", sock)
+				require.NoError(t, err, "Previous daemon should still serve the socket")
+				conn.Close()
+				d.Quit(false)
+				wg.Wait()
+				require.NoError(t, err, "Listen should return no error when stopped after failed handoff")
+				require.Equal(t, []string{"READY=1"}, notified, "Main process should not have changed")
+				return
+			}
+			require.NoError(t, handoffErr, "Handoff should succeed")
+			require.Len(t, notified, 2, "Previous daemon should notify systemd of the new main process")
+			require.Regexp(t, `^MAINPID=\d+$`, notified[1], "Previous daemon should notify systemd of the new main process")
+
+			d.Quit(false)
+			wg.Wait()
+			require.NoError(t, err, "Listen should return no error when stopped after handoff")
+
+			conn, err := net.Dial("unix", sock)
+			require.NoError(t, err, "New daemon should serve the socket once the previous one quit")
+			conn.Close()
+
+			var got []byte
+			for range 50 {
+				if got, err = os.ReadFile(filepath.Join(dir, "new-daemon.log")); err == nil {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			require.NoError(t, err, "New daemon should have logged its state")
+			want := fmt.Sprintf("serving on %s\nwaiting for ubuntu: context deadline exceeded\nwaiting for other: <nil>\n", sock)
+			require.Equal(t, want, string(got), "New daemon should have taken over the socket and refreshes in progress")
+		})
+	}
+}
+
+func TestHandoffBeforeServe(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	grpcRegister := &grpcServiceRegister{}
+
+	d, err := daemon.New(grpcRegister.registerGRPCServer, filepath.Join(dir, "test.sock"),
+		daemon.WithHandoffStateFile(filepath.Join(dir, "handoff.json")))
+	require.NoError(t, err, "New should return the daemon handler")
+	defer d.Quit(false)
+
+	err = d.Handoff("true")
+	require.Error(t, err, "Handoff should fail when not serving yet")
+}
+
+// TestMockNewDaemon is the new daemon we hand off to, logging its state in dir/new-daemon.log.
+// behaviour allows to make it fail before taking over.
+func TestMockNewDaemon(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		args = args[1:]
+	}
+	dir, behaviour := args[0], args[1]
+
+	if behaviour == "fail" {
+		fmt.Fprintln(os.Stderr, "new daemon: requested failure")
+		os.Exit(1)
+	}
+
+	grpcRegister := &grpcServiceRegister{}
+	d, err := daemon.New(grpcRegister.registerGRPCServer, "/tmp/this/is/ignored",
+		daemon.WithSystemdSdNotifier(func(_ bool, _ string) (bool, error) { return false, nil }))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't take over: %v", err)
+		os.Exit(1)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+
+		var out strings.Builder
+		fmt.Fprintf(&out, "serving on %s\n", d.GetSocketAddr())
+		// The previous daemon, our test, is still running.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		fmt.Fprintf(&out, "waiting for ubuntu: %v\n", d.WaitPreviousRun(ctx, "ubuntu"))
+		fmt.Fprintf(&out, "waiting for other: %v\n", d.WaitPreviousRun(ctx, "other"))
+
+		// Let the test check we are serving once the previous daemon quit.
+		time.Sleep(time.Second)
+		if err := os.WriteFile(filepath.Join(dir, "new-daemon.log"), []byte(out.String()), 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "Can't write log file: %v", err)
+		}
+		d.Quit(false)
+	}()
+
+	if err := d.Listen(); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't serve: %v", err)
+		os.Exit(1)
+	}
+}
+
 type grpcServiceRegister struct {
 	daemonsCalled []*daemon.Daemon
 }
@@ -0,0 +1,225 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// handoffEnv is the environment variable pointing the new daemon to the state file of the previous one.
+	handoffEnv = "ADSYSD_HANDOFF_STATE"
+
+	// handoffListenerFd is the file descriptor of the listener passed to the new daemon.
+	handoffListenerFd = 3
+	// handoffReadyFd is the file descriptor the new daemon writes to once it is serving.
+	handoffReadyFd = 4
+
+	// handoffTimeout is the maximum time the new daemon has to be ready before we keep serving ourself.
+	handoffTimeout = 30 * time.Second
+)
+
+// handoffState is the state passed from the previous daemon to the new one.
+type handoffState struct {
+	PID              int      `json:"pid"`
+	Socket           string   `json:"socket"`
+	SocketActivation bool     `json:"socket_activation"`
+	Runs             []string `json:"runs"`
+}
+
+// Handoff starts executable with args as the new daemon, handing it over the socket we are listening on and
+// the refreshes in progress.
+// It returns once the new daemon is serving: the caller can then gracefully quit, letting the refreshes
+// in progress finish while the new daemon accepts the new connections.
+// If the new daemon fails to start, we keep serving and an error is returned.
+func (d *Daemon) Handoff(executable string, args ...string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't hand off to new daemon"))
+
+	d.socketMu.RLock()
+	lis := d.listener
+	d.socketMu.RUnlock()
+	if lis == nil {
+		return errors.New(gotext.Get("daemon is not serving yet"))
+	}
+	ul, ok := lis.(*net.UnixListener)
+	if !ok {
+		return errors.New(gotext.Get("can only hand off unix socket listeners"))
+	}
+	f, err := ul.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	state := handoffState{
+		PID:              os.Getpid(),
+		Socket:           lis.Addr().String(),
+		SocketActivation: d.useSocketActivation,
+		Runs:             d.runState(),
+	}
+	if err := writeHandoffState(d.handoffStateFile, state); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := os.Remove(d.handoffStateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warning(context.Background(), gotext.Get("Can't remove handoff state file: %v", err))
+		}
+	}()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// #nosec G204 - the executable is our own binary
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", handoffEnv, d.handoffStateFile))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f, w}
+	smbsafe.WaitExec()
+	err = cmd.Start()
+	smbsafe.DoneExec()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Info(context.Background(), gotext.Get("Handing off %s to new daemon (pid %d)", state.Socket, cmd.Process.Pid))
+	if len(state.Runs) > 0 {
+		log.Info(context.Background(), gotext.Get("Refreshes in progress will finish before quitting: %s", strings.Join(state.Runs, ", ")))
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		if _, err := r.Read(make([]byte, 1)); err != nil {
+			ready <- errors.New(gotext.Get("new daemon exited before being ready"))
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(handoffTimeout):
+		err = errors.New(gotext.Get("new daemon not ready after %s", handoffTimeout))
+		decorate.LogFuncOnError(cmd.Process.Kill)
+	}
+	if err != nil {
+		_ = cmd.Wait()
+		return err
+	}
+
+	// The socket is now served by the new daemon: don't remove it once we stop listening.
+	ul.SetUnlinkOnClose(false)
+
+	// Only the main process can notify systemd: make the new daemon the main process before we quit.
+	if _, err := d.systemdSdNotifier(false, fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		log.Warning(context.Background(), gotext.Get("Couldn't notify systemd of the new main process: %v", err))
+	}
+
+	return cmd.Process.Release()
+}
+
+// WaitPreviousRun blocks until the daemon we took over from is done refreshing target, if it was.
+func (d *Daemon) WaitPreviousRun(ctx context.Context, target string) error {
+	if d.previous == nil || !slices.Contains(d.previous.Runs, target) {
+		return nil
+	}
+
+	log.Info(ctx, gotext.Get("Waiting for previous daemon to finish refreshing %s", target))
+	for {
+		// Signal 0 only checks that the previous daemon is still running.
+		if err := syscall.Kill(d.previous.PID, 0); err != nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// takeOver loads the state handed off by the previous daemon and returns the listener it was serving on.
+func (d *Daemon) takeOver(stateFile string) (lis net.Listener, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't take over from previous daemon"))
+
+	// Don't pass the handoff to our own child processes.
+	if err := os.Unsetenv(handoffEnv); err != nil {
+		return nil, err
+	}
+	d.handoffReady = os.NewFile(handoffReadyFd, "handoff-ready")
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var state handoffState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(stateFile); err != nil {
+		return nil, err
+	}
+
+	f := os.NewFile(handoffListenerFd, state.Socket)
+	defer f.Close()
+	lis, err = net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	// Only remove the socket on exit if we created it ourself, like net.Listen.
+	if ul, ok := lis.(*net.UnixListener); ok && !state.SocketActivation {
+		ul.SetUnlinkOnClose(true)
+	}
+
+	d.useSocketActivation = state.SocketActivation
+	d.previous = &state
+
+	log.Info(context.Background(), gotext.Get("Taking over %s from previous daemon (pid %d)", state.Socket, state.PID))
+	return lis, nil
+}
+
+// notifyHandoffReady signals the previous daemon that we are now serving.
+func (d *Daemon) notifyHandoffReady() (err error) {
+	if d.handoffReady == nil {
+		return nil
+	}
+	defer decorate.OnError(&err, gotext.Get("can't notify previous daemon"))
+
+	defer func() {
+		decorate.LogFuncOnError(d.handoffReady.Close)
+		d.handoffReady = nil
+	}()
+	_, err = d.handoffReady.Write([]byte{1})
+	return err
+}
+
+// writeHandoffState atomically writes the handoff state to path, only readable by root.
+func writeHandoffState(path string, state handoffState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".new", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
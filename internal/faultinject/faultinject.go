@@ -0,0 +1,78 @@
+// Package faultinject allows tests to inject failures at specific points of the policy pipeline.
+//
+// It is only active when the ADSYS_TESTS_INJECT_FAILURES environment variable is set. This variable
+// contains a comma separated list of failure points to trigger, for instance:
+//
+//	ADSYS_TESTS_INJECT_FAILURES=download-timeout,manager:privilege
+//
+// This is meant for integration and end to end tests to exercise the rollback and reporting paths
+// deterministically and should never be set on a production system.
+package faultinject
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvVar is the environment variable listing the failure points to trigger.
+const EnvVar = "ADSYS_TESTS_INJECT_FAILURES"
+
+const (
+	// DownloadTimeout makes every GPO and assets download fail as if it timed out.
+	DownloadTimeout = "download-timeout"
+	// AssetsCorruption truncates the compressed assets database once it is generated.
+	AssetsCorruption = "assets-corruption"
+
+	// managerPrefix is followed by the name of the policy manager to make fail, e.g. manager:dconf.
+	managerPrefix = "manager:"
+)
+
+// ErrInjected is the error returned by any injected failure.
+var ErrInjected = errors.New("injected failure")
+
+// Enabled returns true if the failure point was requested.
+func Enabled(point string) bool {
+	v := os.Getenv(EnvVar)
+	if v == "" {
+		return false
+	}
+
+	for _, p := range strings.Split(v, ",") {
+		if strings.TrimSpace(p) == point {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadError returns a timeout error if download failures were requested.
+func DownloadError() error {
+	if !Enabled(DownloadTimeout) {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrInjected, context.DeadlineExceeded)
+}
+
+// ManagerError returns an error if the policy manager called name was requested to fail.
+func ManagerError(name string) error {
+	if !Enabled(managerPrefix + name) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s manager failed", ErrInjected, name)
+}
+
+// CorruptAssets truncates the assets database at path to half of its size if assets corruption was requested.
+func CorruptAssets(path string) error {
+	if !Enabled(AssetsCorruption) {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.Truncate(path, info.Size()/2)
+}
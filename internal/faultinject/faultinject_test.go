@@ -0,0 +1,88 @@
+package faultinject_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/faultinject"
+)
+
+func TestEnabled(t *testing.T) {
+	tests := map[string]struct {
+		env   string
+		point string
+
+		want bool
+	}{
+		"Point is enabled when alone":           {env: "download-timeout", point: faultinject.DownloadTimeout, want: true},
+		"Point is enabled when part of a list":  {env: "manager:dconf,download-timeout", point: faultinject.DownloadTimeout, want: true},
+		"Point is enabled with spaces in list":  {env: "manager:dconf, assets-corruption", point: faultinject.AssetsCorruption, want: true},
+		"Point is disabled when env is not set": {point: faultinject.DownloadTimeout, want: false},
+		"Point is disabled when not in list":    {env: "manager:dconf", point: faultinject.DownloadTimeout, want: false},
+		"Point is disabled on partial match":    {env: "download-timeout-later", point: faultinject.DownloadTimeout, want: false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(faultinject.EnvVar, tc.env)
+
+			got := faultinject.Enabled(tc.point)
+			require.Equal(t, tc.want, got, "Enabled should return expected value")
+		})
+	}
+}
+
+func TestDownloadError(t *testing.T) {
+	t.Setenv(faultinject.EnvVar, "")
+	require.NoError(t, faultinject.DownloadError(), "DownloadError should return no error when not requested")
+
+	t.Setenv(faultinject.EnvVar, faultinject.DownloadTimeout)
+	err := faultinject.DownloadError()
+	require.ErrorIs(t, err, faultinject.ErrInjected, "DownloadError should return an injected error")
+	require.ErrorIs(t, err, context.DeadlineExceeded, "DownloadError should return a timeout error")
+}
+
+func TestManagerError(t *testing.T) {
+	t.Setenv(faultinject.EnvVar, "manager:privilege")
+
+	require.NoError(t, faultinject.ManagerError("dconf"), "ManagerError should return no error for other managers")
+	require.ErrorIs(t, faultinject.ManagerError("privilege"), faultinject.ErrInjected, "ManagerError should return an injected error for requested manager")
+}
+
+func TestCorruptAssets(t *testing.T) {
+	tests := map[string]struct {
+		env         string
+		missingFile bool
+
+		wantSize int64
+		wantErr  bool
+	}{
+		"File is truncated when requested":     {env: faultinject.AssetsCorruption, wantSize: 5},
+		"File is untouched when not requested": {wantSize: 10},
+
+		"Error on missing file when requested": {env: faultinject.AssetsCorruption, missingFile: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(faultinject.EnvVar, tc.env)
+
+			p := filepath.Join(t.TempDir(), "assets.db")
+			if !tc.missingFile {
+				require.NoError(t, os.WriteFile(p, []byte("0123456789"), 0600), "Setup: could not create assets db")
+			}
+
+			err := faultinject.CorruptAssets(p)
+			if tc.wantErr {
+				require.Error(t, err, "CorruptAssets should return an error but got none")
+				return
+			}
+			require.NoError(t, err, "CorruptAssets should return no error but got one")
+
+			info, err := os.Stat(p)
+			require.NoError(t, err, "Setup: could not stat assets db")
+			require.Equal(t, tc.wantSize, info.Size(), "CorruptAssets should leave file with expected size")
+		})
+	}
+}
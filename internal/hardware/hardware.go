@@ -0,0 +1,366 @@
+// Package hardware collects the hardware facts of the machine, which GPOs can target and which are reported in the
+// compliance summary.
+//
+// The following facts are collected:
+//   - chassis: the chassis type declared by the firmware, one of desktop, laptop, tablet, server, other or
+//     unknown;
+//   - tpm: yes if a TPM device is present, no otherwise;
+//   - secure-boot: enabled or disabled on UEFI machines, unsupported on legacy BIOS ones;
+//   - disk-encryption: yes if the root filesystem is on a dm-crypt device, no if it isn't, unknown if it can't be
+//     checked.
+//
+// The facts are collected on each refresh of the machine policy and cached: changes since the previous refresh,
+// like secure boot being disabled, are logged, and the refreshes of the user policies use the cached facts.
+package hardware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+// cacheFile stores the facts of the last collection.
+const cacheFile = "hardware.json"
+
+// Names of the facts.
+const (
+	Chassis        = "chassis"
+	TPM            = "tpm"
+	SecureBoot     = "secure-boot"
+	DiskEncryption = "disk-encryption"
+)
+
+// Names are the names of the facts, in the order they are reported.
+var Names = []string{Chassis, TPM, SecureBoot, DiskEncryption}
+
+// Unknown is the value of the facts which can't be collected.
+const Unknown = "unknown"
+
+// secureBootVar is the EFI variable holding the secure boot state.
+const secureBootVar = "SecureBoot-8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+// chassisTypes maps the SMBIOS chassis types to the chassis fact. Other types are reported as other.
+var chassisTypes = map[int]string{
+	3: "desktop", 4: "desktop", 5: "desktop", 6: "desktop", 7: "desktop", 13: "desktop", 15: "desktop", 16: "desktop",
+	24: "desktop", 35: "desktop", 36: "desktop",
+	8: "laptop", 9: "laptop", 10: "laptop", 14: "laptop", 31: "laptop", 32: "laptop",
+	11: "tablet", 30: "tablet",
+	17: "server", 23: "server", 25: "server", 28: "server", 29: "server",
+}
+
+// Facts are the hardware facts of the machine, by name.
+type Facts map[string]string
+
+// Get returns the value of the fact name, or unknown if it wasn't collected.
+func (f Facts) Get(name string) string {
+	if v, ok := f[name]; ok && v != "" {
+		return v
+	}
+	return Unknown
+}
+
+// String returns the facts in the form <name>=<value>; <name>=<value>...
+func (f Facts) String() string {
+	var facts []string
+	for _, n := range Names {
+		facts = append(facts, fmt.Sprintf("%s=%s", n, f.Get(n)))
+	}
+	return strings.Join(facts, "; ")
+}
+
+// Match returns true if the facts match the targeting expression expr, of the form <name>=<value>[,<value>...]
+// or <name>!=<value>[,<value>...]. Values are case insensitive.
+func (f Facts) Match(expr string) (match bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid hardware targeting expression %q", expr))
+
+	name, values, found := strings.Cut(expr, "=")
+	negate := strings.HasSuffix(name, "!")
+	name = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(name, "!")))
+	if !found || name == "" {
+		return false, errors.New(gotext.Get("expected <fact>=<value> or <fact>!=<value>"))
+	}
+	if !slices.Contains(Names, name) {
+		return false, errors.New(gotext.Get("unknown fact %q, expected one of %s", name, strings.Join(Names, ", ")))
+	}
+
+	var hasValue bool
+	for _, v := range strings.Split(values, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		hasValue = true
+		if strings.EqualFold(v, f.Get(name)) {
+			match = true
+		}
+	}
+	if !hasValue {
+		return false, errors.New(gotext.Get("no value for fact %q", name))
+	}
+
+	return match != negate, nil
+}
+
+// Collector collects the hardware facts of the machine.
+type Collector struct {
+	sysDir     string
+	cacheDir   string
+	findmntCmd []string
+	lsblkCmd   []string
+	cmdTimeout time.Duration
+
+	mu sync.Mutex // Prevents concurrent collections
+}
+
+type options struct {
+	sysDir     string
+	cacheDir   string
+	findmntCmd []string
+	lsblkCmd   []string
+	cmdTimeout time.Duration
+}
+
+// Option reprents an optional function to change the hardware collector.
+type Option func(*options)
+
+// WithSysDir overrides the default sysfs directory.
+func WithSysDir(p string) func(*options) {
+	return func(a *options) {
+		a.sysDir = p
+	}
+}
+
+// WithCacheDir overrides the default cache directory.
+func WithCacheDir(p string) func(*options) {
+	return func(a *options) {
+		a.cacheDir = p
+	}
+}
+
+// WithFindmntCmd overrides the default findmnt command.
+func WithFindmntCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.findmntCmd = cmd
+	}
+}
+
+// WithLsblkCmd overrides the default lsblk command.
+func WithLsblkCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.lsblkCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new collector of the hardware facts.
+func New(opts ...Option) *Collector {
+	// defaults
+	args := options{
+		sysDir:     "/sys",
+		cacheDir:   consts.DefaultCacheDir,
+		findmntCmd: []string{"findmnt"},
+		lsblkCmd:   []string{"lsblk"},
+		cmdTimeout: consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Collector{
+		sysDir:     args.sysDir,
+		cacheDir:   args.cacheDir,
+		findmntCmd: args.findmntCmd,
+		lsblkCmd:   args.lsblkCmd,
+		cmdTimeout: args.cmdTimeout,
+	}
+}
+
+// Collect collects the hardware facts of the machine and caches them, logging the facts which changed since the
+// previous collection.
+// The facts which can't be collected are unknown: the facts are always returned, even if caching them failed.
+func (c *Collector) Collect(ctx context.Context) (facts Facts, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	facts = Facts{
+		Chassis:        c.chassis(ctx),
+		TPM:            c.tpm(ctx),
+		SecureBoot:     c.secureBoot(ctx),
+		DiskEncryption: c.diskEncryption(ctx),
+	}
+
+	prev, err := c.load()
+	if err != nil {
+		// The cache is rewritten with the new facts.
+		log.Warning(ctx, err)
+	}
+	if maps.Equal(prev, facts) {
+		return facts, nil
+	}
+
+	if prev == nil {
+		log.Infof(ctx, "Hardware facts: %s", facts)
+	}
+	for _, n := range Names {
+		if prev != nil && prev.Get(n) != facts.Get(n) {
+			log.Infof(ctx, "Hardware fact %s changed from %s to %s", n, prev.Get(n), facts.Get(n))
+		}
+	}
+
+	return facts, c.save(facts)
+}
+
+// Cached returns the hardware facts of the previous collection, or collects them if they were never collected.
+func (c *Collector) Cached(ctx context.Context) (facts Facts, err error) {
+	c.mu.Lock()
+	facts, err = c.load()
+	c.mu.Unlock()
+	if err != nil {
+		log.Warning(ctx, err)
+	}
+	if facts != nil {
+		return facts, nil
+	}
+	return c.Collect(ctx)
+}
+
+// chassis returns the chassis type declared by the firmware.
+func (c *Collector) chassis(ctx context.Context) string {
+	d, err := os.ReadFile(filepath.Join(c.sysDir, "class", "dmi", "id", "chassis_type"))
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Debug(ctx, "No chassis type declared by the firmware")
+		return Unknown
+	} else if err != nil {
+		log.Warning(ctx, gotext.Get("Can't read the chassis type: %v", err))
+		return Unknown
+	}
+
+	t, err := strconv.Atoi(strings.TrimSpace(string(d)))
+	if err != nil {
+		log.Warning(ctx, gotext.Get("Invalid chassis type %q: %v", strings.TrimSpace(string(d)), err))
+		return Unknown
+	}
+	if chassis, ok := chassisTypes[t]; ok {
+		return chassis
+	}
+	return "other"
+}
+
+// tpm returns yes if a TPM device is present.
+func (c *Collector) tpm(ctx context.Context) string {
+	devices, err := filepath.Glob(filepath.Join(c.sysDir, "class", "tpm", "tpm*"))
+	if err != nil {
+		log.Warning(ctx, gotext.Get("Can't list TPM devices: %v", err))
+		return Unknown
+	}
+	if len(devices) > 0 {
+		return "yes"
+	}
+	return "no"
+}
+
+// secureBoot returns the secure boot state, or unsupported if the machine didn't boot with UEFI.
+func (c *Collector) secureBoot(ctx context.Context) string {
+	efiDir := filepath.Join(c.sysDir, "firmware", "efi")
+	if _, err := os.Stat(efiDir); errors.Is(err, fs.ErrNotExist) {
+		return "unsupported"
+	}
+
+	// The variable content is its 4 bytes of attributes, followed by its value.
+	d, err := os.ReadFile(filepath.Join(efiDir, "efivars", secureBootVar))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "disabled"
+	} else if err != nil {
+		log.Warning(ctx, gotext.Get("Can't read the secure boot state: %v", err))
+		return Unknown
+	}
+	if len(d) < 5 {
+		log.Warning(ctx, gotext.Get("Invalid secure boot state %q", d))
+		return Unknown
+	}
+	if d[4] == 1 {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// diskEncryption returns yes if the root filesystem is on a dm-crypt device, no if it isn't, and unknown if it
+// can't be checked.
+func (c *Collector) diskEncryption(ctx context.Context) string {
+	out, err := syshelpers.Run(ctx, c.cmdTimeout, c.findmntCmd, "-n", "-o", "SOURCE", "/")
+	source := strings.TrimSpace(out)
+	if err == nil && source == "" {
+		err = errors.New(gotext.Get("no device found"))
+	}
+	if err != nil {
+		log.Warning(ctx, gotext.Get("Can't find the device of the root filesystem: %v", err))
+		return Unknown
+	}
+
+	// Lists the device and all the devices it is built on.
+	out, err = syshelpers.Run(ctx, c.cmdTimeout, c.lsblkCmd, "-n", "-s", "-o", "TYPE", source)
+	if err != nil {
+		log.Warning(ctx, gotext.Get("Can't list the devices of %s: %v", source, err))
+		return Unknown
+	}
+	if slices.Contains(strings.Fields(out), "crypt") {
+		return "yes"
+	}
+	return "no"
+}
+
+// load returns the cached facts, or nil if there are none.
+func (c *Collector) load() (facts Facts, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load cached hardware facts"))
+
+	d, err := os.ReadFile(filepath.Join(c.cacheDir, cacheFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(d, &facts); err != nil {
+		return nil, err
+	}
+	return facts, nil
+}
+
+// save caches the facts.
+func (c *Collector) save(facts Facts) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't cache hardware facts"))
+
+	d, err := json.MarshalIndent(facts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.cacheDir, 0700); err != nil {
+		return err
+	}
+	p := filepath.Join(c.cacheDir, cacheFile)
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
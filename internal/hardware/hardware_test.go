@@ -0,0 +1,219 @@
+package hardware_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/hardware"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestCollect(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		sys           string
+		existingCache string
+		mockBehaviour string
+		cacheIsFile   bool
+
+		wantErr bool
+	}{
+		"Collect laptop facts":                        {sys: "laptop", mockBehaviour: "encrypted"},
+		"Collect legacy BIOS facts":                   {sys: "legacy-bios"},
+		"Collect disabled secure boot":                {sys: "secure-boot-disabled"},
+		"Secure boot is disabled without variable":    {sys: "uefi-without-secure-boot"},
+		"Collect other chassis":                       {sys: "other-chassis"},
+		"Invalid firmware values are unknown":         {sys: "invalid"},
+		"Missing sysfs entries are unknown or absent": {sys: "nonexistent"},
+		"Unchanged facts keep the cache":              {sys: "laptop", existingCache: "laptop", mockBehaviour: "encrypted"},
+		"Changed facts update the cache":              {sys: "secure-boot-disabled", existingCache: "laptop"},
+		"Corrupted cache is replaced":                 {sys: "laptop", existingCache: "corrupted"},
+		"Disk encryption is unknown on findmnt error": {sys: "laptop", mockBehaviour: "fail-findmnt"},
+		"Disk encryption is unknown without device":   {sys: "laptop", mockBehaviour: "no-device"},
+		"Disk encryption is unknown on lsblk error":   {sys: "laptop", mockBehaviour: "fail-lsblk"},
+
+		// Error cases
+		"Error on caching facts": {sys: "laptop", cacheIsFile: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			cacheDir := filepath.Join(root, "cache")
+			if tc.existingCache != "" {
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "caches", tc.existingCache), cacheDir, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial cache")
+			}
+			if tc.cacheIsFile {
+				require.NoError(t, os.WriteFile(cacheDir, nil, 0600), "Setup: can't create cache directory as a file")
+			}
+
+			c := hardware.New(
+				hardware.WithSysDir(filepath.Join("testdata", "sys", tc.sys)),
+				hardware.WithCacheDir(cacheDir),
+				hardware.WithFindmntCmd(testutils.MockCommand(root, "findmnt", tc.mockBehaviour)),
+				hardware.WithLsblkCmd(testutils.MockCommand(root, "lsblk", tc.mockBehaviour)),
+			)
+			facts, err := c.Collect(context.Background())
+			require.Len(t, facts, len(hardware.Names), "Collect should always return all the facts")
+			if tc.wantErr {
+				require.Error(t, err, "Collect should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Collect failed but shouldn't have")
+
+			requireCached(t, cacheDir, facts)
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestCached(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		existingCache string
+
+		wantCollected bool
+	}{
+		"Return cached facts":                {existingCache: "laptop"},
+		"Collect facts without cache":        {wantCollected: true},
+		"Collect facts with corrupted cache": {existingCache: "corrupted", wantCollected: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			cacheDir := filepath.Join(root, "cache")
+			if tc.existingCache != "" {
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "caches", tc.existingCache), cacheDir, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial cache")
+			}
+
+			c := hardware.New(
+				hardware.WithSysDir(filepath.Join("testdata", "sys", "legacy-bios")),
+				hardware.WithCacheDir(cacheDir),
+				hardware.WithFindmntCmd(testutils.MockCommand(root, "findmnt", "")),
+				hardware.WithLsblkCmd(testutils.MockCommand(root, "lsblk", "")),
+			)
+			facts, err := c.Cached(context.Background())
+			require.NoError(t, err, "Cached failed but shouldn't have")
+
+			requireCached(t, cacheDir, facts)
+			_, err = os.Stat(filepath.Join(root, "commands.log"))
+			require.Equal(t, tc.wantCollected, err == nil, "Facts should only be collected without valid cache")
+			if !tc.wantCollected {
+				require.Equal(t, "laptop", facts.Get(hardware.Chassis), "Cached facts should be returned")
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+
+	facts := hardware.Facts{hardware.Chassis: "laptop", hardware.TPM: "yes", hardware.SecureBoot: "enabled"}
+
+	tests := map[string]struct {
+		expr string
+
+		want    bool
+		wantErr bool
+	}{
+		"Fact matches value":                    {expr: "chassis=laptop", want: true},
+		"Fact does not match value":             {expr: "chassis=desktop", want: false},
+		"Fact matches one of the values":        {expr: "chassis=desktop, laptop", want: true},
+		"Negated fact matches other values":     {expr: "secure-boot!=disabled", want: true},
+		"Negated fact does not match value":     {expr: "tpm!=yes,no", want: false},
+		"Names and values are case insensitive": {expr: " Chassis = LAPTOP ", want: true},
+		"Missing fact is unknown":               {expr: "disk-encryption=unknown", want: true},
+
+		// Error cases
+		"Error on missing operator": {expr: "chassis", wantErr: true},
+		"Error on missing name":     {expr: "=laptop", wantErr: true},
+		"Error on unknown fact":     {expr: "ram=16G", wantErr: true},
+		"Error on missing value":    {expr: "chassis= , ", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := facts.Match(tc.expr)
+			if tc.wantErr {
+				require.Error(t, err, "Match should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Match failed but shouldn't have")
+			require.Equal(t, tc.want, got, "Match should return the expected result")
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	t.Parallel()
+
+	facts := hardware.Facts{hardware.DiskEncryption: "no", hardware.Chassis: "desktop", hardware.TPM: "yes"}
+	require.Equal(t, "chassis=desktop; tpm=yes; secure-boot=unknown; disk-encryption=no", facts.String(), "String should list all the facts in order")
+}
+
+// requireCached checks that facts are the ones cached in cacheDir.
+func requireCached(t *testing.T, cacheDir string, facts hardware.Facts) {
+	t.Helper()
+
+	d, err := os.ReadFile(filepath.Join(cacheDir, "hardware.json"))
+	require.NoError(t, err, "Facts should be cached")
+	var cached hardware.Facts
+	require.NoError(t, json.Unmarshal(d, &cached), "Cached facts should be valid")
+	require.Equal(t, cached, facts, "Returned facts should be the cached ones")
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, behaviours, args := c.Name, strings.Split(c.Behaviour, ","), c.Args
+
+	c.Log(fmt.Sprintf("%s %q", name, args))
+
+	if slices.Contains(behaviours, "fail-"+name) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+
+	switch name {
+	case "findmnt":
+		if slices.Contains(behaviours, "no-device") {
+			return
+		}
+		if slices.Contains(behaviours, "encrypted") {
+			fmt.Println("/dev/mapper/vgubuntu-root")
+			return
+		}
+		fmt.Println("/dev/nvme0n1p2")
+	case "lsblk":
+		if slices.Contains(behaviours, "encrypted") {
+			fmt.Print("lvm\ncrypt\npart\ndisk\n")
+			return
+		}
+		fmt.Print("part\ndisk\n")
+	}
+}
@@ -0,0 +1,218 @@
+// Package ldaphelpers provides the helpers shared by the policy managers querying and updating the directory,
+// authenticated over SASL GSSAPI with a Kerberos ticket.
+package ldaphelpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/go-ldap/ldap/v3/gssapi"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+)
+
+// krb5ConfPath is the Kerberos configuration used to find the KDC delivering the service tickets.
+const krb5ConfPath = "/etc/krb5.conf"
+
+// Conn is an authenticated connection to the directory.
+type Conn interface {
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Modify(req *ldap.ModifyRequest) error
+	Close() error
+}
+
+// Dialer opens a connection to the server at addr, authenticated with the Kerberos ticket krb5CCName.
+type Dialer func(ctx context.Context, addr, krb5CCName string, timeout time.Duration) (Conn, error)
+
+// Client queries and updates the directory of a server.
+type Client struct {
+	// URL is the address of the server, like ldaps://dc.example.com.
+	URL string
+	// Krb5CCName is the path of the Kerberos ticket to authenticate with.
+	Krb5CCName string
+	// Timeout is the maximum time of each request. There is no limit if 0.
+	Timeout time.Duration
+
+	// Dial opens the connections to the server. DialGSSAPI is used if nil.
+	Dial Dialer
+}
+
+// Entry is an entry returned by a search, mapping lowercase attribute names to their values.
+// The distinguished name of the entry is stored in the dn attribute.
+type Entry map[string][]string
+
+// First returns the first value of the attribute attr, or an empty string if the attribute is not set.
+func (e Entry) First(attr string) string {
+	if v := e[strings.ToLower(attr)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Search searches the directory for entries matching filter under base, with the scope base, one or sub,
+// returning the requested attributes. No entry is returned if base doesn't exist.
+func (c Client) Search(ctx context.Context, base, scope, filter string, attrs ...string) ([]Entry, error) {
+	var s int
+	switch scope {
+	case "base":
+		s = ldap.ScopeBaseObject
+	case "one":
+		s = ldap.ScopeSingleLevel
+	case "sub":
+		s = ldap.ScopeWholeSubtree
+	default:
+		return nil, errors.New(gotext.Get("invalid search scope %q", scope))
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, errors.New(gotext.Get("failed to query the directory: %v", err))
+	}
+	defer conn.Close()
+
+	log.Debugf(ctx, "Searching %q for %q in directory", base, filter)
+	res, err := conn.Search(ldap.NewSearchRequest(base, s, ldap.NeverDerefAliases, 0, int(c.Timeout.Seconds()), false, filter, attrs, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New(gotext.Get("failed to query the directory: %v", err))
+	}
+
+	var entries []Entry
+	for _, r := range res.Entries {
+		e := Entry{"dn": {r.DN}}
+		for _, a := range r.Attributes {
+			// Keep binary values, like objectGUID, untouched.
+			for _, v := range a.ByteValues {
+				e[strings.ToLower(a.Name)] = append(e[strings.ToLower(a.Name)], string(v))
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// ComputerDN returns the distinguished name of the computer object objectName in the domain.
+func (c Client) ComputerDN(ctx context.Context, domain, objectName string) (string, error) {
+	filter := fmt.Sprintf("(&(objectClass=computer)(sAMAccountName=%s$))", Escape(strings.ToUpper(objectName)))
+	entries, err := c.Search(ctx, DomainDN(domain), "sub", filter, "dn")
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if dn := e.First("dn"); dn != "" {
+			return dn, nil
+		}
+	}
+	return "", errors.New(gotext.Get("computer object of %s not found in the directory", objectName))
+}
+
+// Replace replaces the values of the attribute attr of the entry dn with value.
+func (c Client) Replace(ctx context.Context, dn, attr, value string) error {
+	req := ldap.NewModifyRequest(dn, nil)
+	req.Replace(attr, []string{value})
+	return c.modify(ctx, req)
+}
+
+// Delete deletes the attribute attr of the entry dn.
+func (c Client) Delete(ctx context.Context, dn, attr string) error {
+	req := ldap.NewModifyRequest(dn, nil)
+	req.Delete(attr, nil)
+	return c.modify(ctx, req)
+}
+
+// modify applies the changes of req to the directory.
+func (c Client) modify(ctx context.Context, req *ldap.ModifyRequest) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return errors.New(gotext.Get("failed to update the directory: %v", err))
+	}
+	defer conn.Close()
+
+	log.Debugf(ctx, "Updating %q in directory", req.DN)
+	if err := conn.Modify(req); err != nil {
+		return errors.New(gotext.Get("failed to update the directory: %v", err))
+	}
+	return nil
+}
+
+// dial opens an authenticated connection with the dialer of the client.
+func (c Client) dial(ctx context.Context) (Conn, error) {
+	dial := c.Dial
+	if dial == nil {
+		dial = DialGSSAPI
+	}
+	return dial(ctx, c.URL, c.Krb5CCName, c.Timeout)
+}
+
+// DialGSSAPI opens a connection to the server at addr and binds over SASL GSSAPI with the Kerberos ticket krb5CCName.
+// The service ticket of the server is requested to the KDC listed in /etc/krb5.conf, or found in DNS without it.
+func DialGSSAPI(ctx context.Context, addr, krb5CCName string, timeout time.Duration) (Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	krb5conf, err := config.Load(krb5ConfPath)
+	if errors.Is(err, os.ErrNotExist) {
+		krb5conf = config.New()
+		krb5conf.LibDefaults.DNSLookupKDC = true
+	} else if err != nil {
+		return nil, errors.New(gotext.Get("failed to load Kerberos configuration: %v", err))
+	}
+	ccache, err := credentials.LoadCCache(krb5CCName)
+	if err != nil {
+		return nil, errors.New(gotext.Get("failed to load Kerberos ticket %s: %v", krb5CCName, err))
+	}
+	krb5Client, err := client.NewFromCCache(ccache, krb5conf)
+	if err != nil {
+		return nil, errors.New(gotext.Get("invalid Kerberos ticket %s: %v", krb5CCName, err))
+	}
+	gssapiClient := &gssapi.Client{Client: krb5Client}
+	defer gssapiClient.Close()
+
+	conn, err := ldap.DialURL(addr, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetTimeout(timeout)
+	}
+
+	log.Debugf(ctx, "Binding to %q with Kerberos ticket %q", addr, krb5CCName)
+	if err := conn.GSSAPIBind(gssapiClient, "ldap/"+u.Hostname(), ""); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DomainDN returns the distinguished name of the domain, like DC=example,DC=com for example.com.
+func DomainDN(domain string) string {
+	return "DC=" + strings.Join(strings.Split(domain, "."), ",DC=")
+}
+
+// Escape escapes the special characters of value to be used in a search filter, as described in RFC 4515.
+func Escape(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		switch c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, `\%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
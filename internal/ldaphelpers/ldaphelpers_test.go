@@ -0,0 +1,215 @@
+package ldaphelpers_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/ldaphelpers"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestSearch(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		ldif       string
+		noBase     bool
+		scope      string
+		failBind   bool
+		failSearch bool
+
+		want    []ldaphelpers.Entry
+		wantLog string
+		wantErr bool
+	}{
+		"Returns entries with lowercase attributes": {ldif: "dn: CN=a\ncn: a\nDNSHostName: a.example.com\n\ndn: CN=b\ncn: b\n",
+			want: []ldaphelpers.Entry{{"dn": {"CN=a"}, "cn": {"a"}, "dnshostname": {"a.example.com"}}, {"dn": {"CN=b"}, "cn": {"b"}}}},
+		"Returns multi-valued attributes": {ldif: "dn: CN=a\nmember: x\nmember: y\n",
+			want: []ldaphelpers.Entry{{"dn": {"CN=a"}, "member": {"x", "y"}}}},
+		"Returns binary values":    {ldif: "dn: CN=a\nobjectGUID:: AAEC\n", want: []ldaphelpers.Entry{{"dn": {"CN=a"}, "objectguid": {"\x00\x01\x02"}}}},
+		"No entry on empty result": {},
+		"No entry on missing base": {noBase: true},
+		"Passes server, ticket, scope and query": {scope: "sub",
+			wantLog: "KRB5CCNAME=/run/krb5cc/host ldap bind \"ldaps://dc.example.com\"\nldap search \"DC=example,DC=com\" sub \"(cn=a)\" \"cn\"\n"},
+
+		// Error cases
+		"Error on invalid scope":  {scope: "invalid", wantErr: true},
+		"Error on failing bind":   {failBind: true, wantErr: true},
+		"Error on failing search": {failSearch: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.scope == "" {
+				tc.scope = "one"
+			}
+			d := testutils.MockDirectory{
+				Root:       root,
+				LDIF:       func(*ldap.SearchRequest) (string, bool) { return tc.ldif, !tc.noBase },
+				FailBind:   tc.failBind,
+				FailSearch: tc.failSearch,
+			}
+			c := ldaphelpers.Client{
+				URL:        "ldaps://dc.example.com",
+				Krb5CCName: "/run/krb5cc/host",
+				Timeout:    time.Minute,
+				Dial:       d.Dial,
+			}
+			got, err := c.Search(context.Background(), "DC=example,DC=com", tc.scope, "(cn=a)", "cn")
+			if tc.wantErr {
+				require.Error(t, err, "Search should return an error")
+				return
+			}
+			require.NoError(t, err, "Search should not return an error")
+			require.Equal(t, tc.want, got, "Search should return the expected entries")
+
+			if tc.wantLog != "" {
+				log, err := os.ReadFile(filepath.Join(root, "commands.log"))
+				require.NoError(t, err, "Setup: can't read the requests")
+				require.Equal(t, tc.wantLog, string(log), "Search should send the expected requests")
+			}
+		})
+	}
+}
+
+func TestComputerDN(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		ldif       string
+		failSearch bool
+
+		want    string
+		wantErr bool
+	}{
+		"Returns the distinguished name of the computer": {ldif: "dn: CN=HOST,OU=Computers,DC=example,DC=com\n", want: "CN=HOST,OU=Computers,DC=example,DC=com"},
+
+		// Error cases
+		"Error on computer not found": {wantErr: true},
+		"Error on failing search":     {failSearch: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var base, filter string
+			d := testutils.MockDirectory{
+				Root: t.TempDir(),
+				LDIF: func(req *ldap.SearchRequest) (string, bool) {
+					base, filter = req.BaseDN, req.Filter
+					return tc.ldif, true
+				},
+				FailSearch: tc.failSearch,
+			}
+			c := ldaphelpers.Client{URL: "ldaps://dc.example.com", Dial: d.Dial}
+			got, err := c.ComputerDN(context.Background(), "example.com", "host*")
+			if tc.wantErr {
+				require.Error(t, err, "ComputerDN should return an error")
+				return
+			}
+			require.NoError(t, err, "ComputerDN should not return an error")
+			require.Equal(t, tc.want, got, "ComputerDN should return the expected distinguished name")
+			require.Equal(t, "DC=example,DC=com", base, "ComputerDN should search the domain")
+			require.Equal(t, `(&(objectClass=computer)(sAMAccountName=HOST\2a$))`, filter, "ComputerDN should search the computer account")
+		})
+	}
+}
+
+func TestModify(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		del        bool
+		failBind   bool
+		failModify bool
+
+		want    string
+		wantErr bool
+	}{
+		"Replaces attribute": {want: "KRB5CCNAME= ldap bind \"ldaps://dc.example.com\"\nldap modify \"CN=HOST\"\nreplace: info\ninfo: value\n-\n"},
+		"Deletes attribute":  {del: true, want: "KRB5CCNAME= ldap bind \"ldaps://dc.example.com\"\nldap modify \"CN=HOST\"\ndelete: info\n-\n"},
+
+		// Error cases
+		"Error on failing bind":   {failBind: true, wantErr: true},
+		"Error on failing update": {failModify: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			d := testutils.MockDirectory{Root: root, FailBind: tc.failBind, FailModify: tc.failModify}
+			c := ldaphelpers.Client{URL: "ldaps://dc.example.com", Dial: d.Dial}
+
+			var err error
+			if tc.del {
+				err = c.Delete(context.Background(), "CN=HOST", "info")
+			} else {
+				err = c.Replace(context.Background(), "CN=HOST", "info", "value")
+			}
+			if tc.wantErr {
+				require.Error(t, err, "Modification should return an error")
+				return
+			}
+			require.NoError(t, err, "Modification should not return an error")
+
+			got, err := os.ReadFile(filepath.Join(root, "commands.log"))
+			require.NoError(t, err, "Setup: can't read the changes")
+			require.Equal(t, tc.want, string(got), "Modification should send the expected changes")
+		})
+	}
+}
+
+func TestDialGSSAPI(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		addr       string
+		krb5CCName string
+	}{
+		"Error on invalid address":        {addr: "ldaps://dc.example.com:invalid", krb5CCName: "/dev/null"},
+		"Error on missing Kerberos ticket": {addr: "ldaps://dc.example.com", krb5CCName: "/nonexistent/krb5cc"},
+		"Error on invalid Kerberos ticket": {addr: "ldaps://dc.example.com", krb5CCName: "ldaphelpers_test.go"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := ldaphelpers.DialGSSAPI(context.Background(), tc.addr, tc.krb5CCName, time.Second)
+			require.Error(t, err, "DialGSSAPI should return an error")
+		})
+	}
+}
+
+func TestDomainDN(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "DC=example,DC=com", ldaphelpers.DomainDN("example.com"), "DomainDN should return a component per label")
+	require.Equal(t, "DC=example", ldaphelpers.DomainDN("example"), "DomainDN should handle single label domains")
+}
+
+func TestEscape(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		value string
+		want  string
+	}{
+		"Keeps regular characters":   {value: "HOST-01$", want: "HOST-01$"},
+		"Escapes special characters": {value: `a*b(c)d\e` + "\x00", want: `a\2ab\28c\29d\5ce\00`},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.want, ldaphelpers.Escape(tc.value), "Escape should return the escaped value")
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Package metrics records the duration and failures of the machine policy refreshes in a small
+// local ring database, and detects trends in those metrics.
+//
+// Only the last runs are kept, so that the database size is bounded while still allowing to
+// detect gradually degrading refreshes on a host.
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+)
+
+// DefaultSize is the default number of runs kept in the database.
+const DefaultSize = 100
+
+// errCorrupted is returned when the database can't be decoded.
+var errCorrupted = errors.New(gotext.Get("corrupted metrics database"))
+
+// Run is a machine policy refresh.
+type Run struct {
+	// Time is when the refresh started.
+	Time time.Time
+	// Duration is the time taken by the whole refresh.
+	Duration time.Duration
+	// Failures is the number of objects, the machine or its users, whose policies failed to be applied.
+	Failures int
+}
+
+// jsonRun is the serialized form of a run, with a human readable duration.
+type jsonRun struct {
+	Time            time.Time `json:"time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Failures        int       `json:"failures"`
+}
+
+// MarshalJSON serializes the run with its duration in seconds.
+func (r Run) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonRun{Time: r.Time, DurationSeconds: r.Duration.Seconds(), Failures: r.Failures})
+}
+
+// UnmarshalJSON deserializes a run with its duration in seconds.
+func (r *Run) UnmarshalJSON(data []byte) error {
+	var jr jsonRun
+	if err := json.Unmarshal(data, &jr); err != nil {
+		return err
+	}
+	*r = Run{
+		Time:     jr.Time,
+		Duration: time.Duration(jr.DurationSeconds * float64(time.Second)).Round(time.Millisecond),
+		Failures: jr.Failures,
+	}
+	return nil
+}
+
+// DB is the ring database of the last machine policy refreshes.
+type DB struct {
+	path string
+	size int
+
+	mu sync.Mutex
+}
+
+type options struct {
+	size int
+}
+
+// Option reprents an optional function to change the metrics database.
+type Option func(*options)
+
+// WithSize overrides the default number of runs kept in the database.
+func WithSize(n int) func(*options) {
+	return func(o *options) {
+		o.size = n
+	}
+}
+
+// New returns a ring database of the machine policy refreshes stored at path.
+// The file is only created once a first run is recorded.
+func New(path string, opts ...Option) *DB {
+	// defaults
+	args := options{
+		size: DefaultSize,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &DB{
+		path: path,
+		size: max(args.size, 1),
+	}
+}
+
+// Record appends r to the database, dropping the oldest runs once the database is full.
+func (db *DB) Record(r Run) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't record refresh metrics"))
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	runs, err := db.load()
+	if errors.Is(err, errCorrupted) {
+		// Metrics are not worth blocking the refreshes: start a new history instead.
+		runs = nil
+	} else if err != nil {
+		return err
+	}
+	runs = append(runs, r)
+	if len(runs) > db.size {
+		runs = runs[len(runs)-db.size:]
+	}
+
+	d, err := json.Marshal(runs)
+	if err != nil {
+		return err
+	}
+	// nolint:gosec // G301 the metrics are not sensitive and are readable by all users.
+	if err := os.MkdirAll(filepath.Dir(db.path), 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 the metrics are not sensitive and are readable by all users.
+	if err := os.WriteFile(db.path+".new", d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(db.path+".new", db.path)
+}
+
+// Runs returns the recorded runs, from the oldest to the newest.
+func (db *DB) Runs() (runs []Run, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read refresh metrics"))
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.load()
+}
+
+// load returns the runs stored in the database, sorted by time.
+// A missing database has no run.
+func (db *DB) load() (runs []Run, err error) {
+	d, err := os.ReadFile(db.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(d, &runs); err != nil {
+		return nil, fmt.Errorf("%w %s: %v", errCorrupted, db.path, err)
+	}
+	slices.SortStableFunc(runs, func(a, b Run) int { return a.Time.Compare(b.Time) })
+	return runs, nil
+}
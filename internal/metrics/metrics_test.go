@@ -0,0 +1,125 @@
+package metrics_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/metrics"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestRecord(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC)
+	newRuns := func(n int) []metrics.Run {
+		var runs []metrics.Run
+		for i := range n {
+			runs = append(runs, metrics.Run{Time: start.Add(time.Duration(i) * time.Hour), Duration: time.Duration(i+1) * time.Second, Failures: i % 2})
+		}
+		return runs
+	}
+
+	tests := map[string]struct {
+		existing  string
+		size      int
+		record    int
+		dirIsFile bool
+
+		wantRuns []metrics.Run
+		wantErr  bool
+	}{
+		"Record first run":                                  {record: 1, wantRuns: newRuns(1)},
+		"Record multiple runs":                              {record: 3, wantRuns: newRuns(3)},
+		"Oldest runs are dropped when full":                 {size: 2, record: 3, wantRuns: newRuns(3)[1:]},
+		"Append to existing database":                       {existing: "two_runs.json", record: 1, wantRuns: append(existingRuns(), newRuns(1)...)},
+		"Shrinking the database size drops the oldest runs": {existing: "two_runs.json", size: 2, record: 1, wantRuns: append(existingRuns()[1:], newRuns(1)...)},
+		"Corrupted database starts a new history":           {existing: "corrupted.json", record: 1, wantRuns: newRuns(1)},
+
+		// Error cases
+		"Error when the database directory is a file": {record: 1, dirIsFile: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			p := filepath.Join(dir, "metrics", "machine.json")
+			if tc.existing != "" {
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create database directory")
+				testutils.Copy(t, filepath.Join("testdata", tc.existing), p)
+			}
+			if tc.dirIsFile {
+				require.NoError(t, os.WriteFile(filepath.Dir(p), nil, 0600), "Setup: can't create file in place of the database directory")
+			}
+
+			var opts []metrics.Option
+			if tc.size != 0 {
+				opts = append(opts, metrics.WithSize(tc.size))
+			}
+			db := metrics.New(p, opts...)
+
+			for _, r := range newRuns(tc.record) {
+				err := db.Record(r)
+				if tc.wantErr {
+					require.Error(t, err, "Record should have failed but didn't")
+					return
+				}
+				require.NoError(t, err, "Record should not have failed")
+			}
+
+			got, err := db.Runs()
+			require.NoError(t, err, "Runs should not have failed")
+			require.Equal(t, tc.wantRuns, got, "Runs should return the recorded runs, from the oldest to the newest")
+
+			// The database can be reopened.
+			got, err = metrics.New(p).Runs()
+			require.NoError(t, err, "Runs should not have failed on a new database instance")
+			require.Equal(t, tc.wantRuns, got, "Runs should return the persisted runs")
+		})
+	}
+}
+
+func TestRuns(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		existing string
+
+		wantRuns []metrics.Run
+		wantErr  bool
+	}{
+		"Missing database has no runs": {},
+		"Runs are sorted by time":      {existing: "unsorted.json", wantRuns: existingRuns()},
+		"Error on corrupted database":  {existing: "corrupted.json", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := filepath.Join(t.TempDir(), "machine.json")
+			if tc.existing != "" {
+				testutils.Copy(t, filepath.Join("testdata", tc.existing), p)
+			}
+
+			got, err := metrics.New(p).Runs()
+			if tc.wantErr {
+				require.Error(t, err, "Runs should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Runs should not have failed")
+			require.Equal(t, tc.wantRuns, got, "Runs should return the recorded runs, from the oldest to the newest")
+		})
+	}
+}
+
+// existingRuns are the runs stored in testdata/two_runs.json.
+func existingRuns() []metrics.Run {
+	return []metrics.Run{
+		{Time: time.Date(2023, time.February, 1, 10, 0, 0, 0, time.UTC), Duration: 1500 * time.Millisecond},
+		{Time: time.Date(2023, time.February, 1, 11, 0, 0, 0, time.UTC), Duration: 2 * time.Second, Failures: 1},
+	}
+}
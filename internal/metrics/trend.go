@@ -0,0 +1,244 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+)
+
+// Trend states of the refresh durations.
+const (
+	TrendUnknown   = "unknown"
+	TrendStable    = "stable"
+	TrendDegrading = "degrading"
+	TrendImproving = "improving"
+)
+
+const (
+	// minRunsForTrend is the minimum number of successful runs needed to detect a trend.
+	minRunsForTrend = 6
+	// trendThreshold is the relative change of the mean duration between the older and the recent
+	// runs above which the refreshes are considered to degrade or improve.
+	trendThreshold = 0.2
+)
+
+// timeLayout is the layout used to print the time of the runs, like in the service status.
+const timeLayout = "Mon Jan 2 15:04"
+
+// sparkTicks are the characters of the durations sparkline, from the shortest to the longest.
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// Summary describes the recorded runs and the trend of their durations.
+type Summary struct {
+	// Runs is the number of recorded runs.
+	Runs int `json:"runs"`
+	// FailedRuns is the number of runs with at least one failure.
+	FailedRuns int `json:"failed_runs"`
+	// Failures is the total number of failures of the recorded runs.
+	Failures int `json:"failures"`
+
+	// Last is the most recent run, if any.
+	Last *Run `json:"last,omitempty"`
+
+	// Mean, Median, Min and Max are computed over the successful runs.
+	Mean   time.Duration `json:"-"`
+	Median time.Duration `json:"-"`
+	Min    time.Duration `json:"-"`
+	Max    time.Duration `json:"-"`
+
+	// Trend is the trend of the durations of the successful runs, among the Trend constants.
+	Trend string `json:"trend"`
+	// Change is the relative change of the mean duration between the older and the recent half of the successful runs.
+	Change float64 `json:"change"`
+}
+
+// MarshalJSON serializes the summary with its durations in seconds.
+func (s Summary) MarshalJSON() ([]byte, error) {
+	type summary Summary
+	return json.Marshal(struct {
+		summary
+		MeanSeconds   float64 `json:"mean_seconds"`
+		MedianSeconds float64 `json:"median_seconds"`
+		MinSeconds    float64 `json:"min_seconds"`
+		MaxSeconds    float64 `json:"max_seconds"`
+	}{summary(s), s.Mean.Seconds(), s.Median.Seconds(), s.Min.Seconds(), s.Max.Seconds()})
+}
+
+// Summarize returns the summary of runs, which are sorted from the oldest to the newest.
+// The trend compares the mean duration of the recent half of the successful runs to the older half.
+func Summarize(runs []Run) Summary {
+	s := Summary{Runs: len(runs), Trend: TrendUnknown}
+	if len(runs) == 0 {
+		return s
+	}
+	last := runs[len(runs)-1]
+	s.Last = &last
+
+	var durations []time.Duration
+	for _, r := range runs {
+		s.Failures += r.Failures
+		if r.Failures > 0 {
+			s.FailedRuns++
+			continue
+		}
+		durations = append(durations, r.Duration)
+	}
+	if len(durations) == 0 {
+		return s
+	}
+
+	s.Mean = mean(durations)
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+	s.Min, s.Max = sorted[0], sorted[len(sorted)-1]
+	s.Median = sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		s.Median = (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	}
+
+	if len(durations) < minRunsForTrend {
+		return s
+	}
+	older, recent := mean(durations[:len(durations)/2]), mean(durations[len(durations)-len(durations)/2:])
+	if older <= 0 {
+		return s
+	}
+	s.Change = math.Round(float64(recent-older)/float64(older)*100) / 100
+	switch {
+	case s.Change >= trendThreshold:
+		s.Trend = TrendDegrading
+	case s.Change <= -trendThreshold:
+		s.Trend = TrendImproving
+	default:
+		s.Trend = TrendStable
+	}
+	return s
+}
+
+// mean returns the mean of durations, which is not empty.
+func mean(durations []time.Duration) time.Duration {
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	return total / time.Duration(len(durations))
+}
+
+// Format returns the human readable summary of runs.
+// If history is true, the durations and failures of every run are plotted as sparklines.
+func Format(runs []Run, history bool) string {
+	s := Summarize(runs)
+	if s.Runs == 0 {
+		return gotext.Get("No machine policy refresh recorded yet.")
+	}
+
+	var out strings.Builder
+	fmt.Fprintln(&out, gotext.Get("Machine policy refreshes: %d recorded since %s", s.Runs, runs[0].Time.Format(timeLayout)))
+	if s.Last.Failures > 0 {
+		fmt.Fprintln(&out, gotext.Get("Last refresh: %s, took %s, %d failure(s)", s.Last.Time.Format(timeLayout), roundDuration(s.Last.Duration), s.Last.Failures))
+	} else {
+		fmt.Fprintln(&out, gotext.Get("Last refresh: %s, took %s, succeeded", s.Last.Time.Format(timeLayout), roundDuration(s.Last.Duration)))
+	}
+	if s.Failures > 0 {
+		fmt.Fprintln(&out, gotext.Get("Failures: %d in %d of %d refreshes", s.Failures, s.FailedRuns, s.Runs))
+	} else {
+		fmt.Fprintln(&out, gotext.Get("Failures: none"))
+	}
+	if s.Runs > s.FailedRuns {
+		fmt.Fprintln(&out, gotext.Get("Duration of successful refreshes: mean %s, median %s, min %s, max %s",
+			roundDuration(s.Mean), roundDuration(s.Median), roundDuration(s.Min), roundDuration(s.Max)))
+	}
+
+	switch s.Trend {
+	case TrendDegrading:
+		fmt.Fprint(&out, gotext.Get("Trend: degrading, recent refreshes are %.0f%% slower than older ones", s.Change*100))
+	case TrendImproving:
+		fmt.Fprint(&out, gotext.Get("Trend: improving, recent refreshes are %.0f%% faster than older ones", -s.Change*100))
+	case TrendStable:
+		fmt.Fprint(&out, gotext.Get("Trend: stable"))
+	default:
+		fmt.Fprint(&out, gotext.Get("Trend: unknown, at least %d successful refreshes are needed", minRunsForTrend))
+	}
+
+	if !history {
+		return out.String()
+	}
+
+	fmt.Fprintf(&out, "\n\n%s\n", gotext.Get("History, from the oldest to the newest refresh:"))
+	fmt.Fprintf(&out, "  %s %s\n", gotext.Get("Duration:"), sparkline(runs))
+	fmt.Fprintf(&out, "  %s %s", gotext.Get("Failures:"), failuresLine(runs))
+	return out.String()
+}
+
+// FormatJSON returns the summary of runs as JSON. The runs are included if history is true.
+func FormatJSON(runs []Run, history bool) (string, error) {
+	report := struct {
+		Summary Summary `json:"summary"`
+		Runs    []Run   `json:"runs,omitempty"`
+	}{Summary: Summarize(runs)}
+	if history {
+		report.Runs = runs
+	}
+
+	d, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(d), nil
+}
+
+// sparkline returns one character per run, whose height is relative to the duration of the run.
+// Runs with failures are left blank, so that their duration doesn't flatten the scale.
+func sparkline(runs []Run) string {
+	var lowest, highest time.Duration
+	first := true
+	for _, r := range runs {
+		if r.Failures > 0 {
+			continue
+		}
+		if first {
+			lowest, highest, first = r.Duration, r.Duration, false
+		}
+		lowest, highest = min(lowest, r.Duration), max(highest, r.Duration)
+	}
+
+	var b strings.Builder
+	for _, r := range runs {
+		if r.Failures > 0 {
+			b.WriteRune(' ')
+			continue
+		}
+		i := len(sparkTicks) / 2
+		if highest > lowest {
+			i = int(math.Round(float64(r.Duration-lowest) / float64(highest-lowest) * float64(len(sparkTicks)-1)))
+		}
+		b.WriteRune(sparkTicks[i])
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// failuresLine returns one character per run, marking the runs with failures.
+func failuresLine(runs []Run) string {
+	var b strings.Builder
+	for _, r := range runs {
+		if r.Failures > 0 {
+			b.WriteRune('✗')
+			continue
+		}
+		b.WriteRune('·')
+	}
+	return b.String()
+}
+
+// roundDuration rounds d for display.
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(100 * time.Millisecond)
+}
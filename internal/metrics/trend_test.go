@@ -0,0 +1,99 @@
+package metrics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/metrics"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestSummarize(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		durations []float64
+		failures  []int
+
+		wantTrend  string
+		wantChange float64
+	}{
+		"No runs":                                   {wantTrend: metrics.TrendUnknown},
+		"Not enough runs to detect a trend":         {durations: []float64{1, 2, 3, 4, 5}, wantTrend: metrics.TrendUnknown},
+		"Stable durations":                          {durations: []float64{2, 2.1, 1.9, 2, 2.2, 1.9, 2, 2.1}, wantTrend: metrics.TrendStable, wantChange: 0.03},
+		"Degrading durations":                       {durations: []float64{1, 1, 1, 1, 1.5, 2, 2, 2.5}, wantTrend: metrics.TrendDegrading, wantChange: 1},
+		"Improving durations":                       {durations: []float64{4, 4, 4, 4, 2, 2, 2, 2}, wantTrend: metrics.TrendImproving, wantChange: -0.5},
+		"Failed runs are ignored to detect a trend": {durations: []float64{1, 1, 1, 9, 9, 1, 1, 1}, failures: []int{0, 0, 0, 1, 2, 0, 0, 0}, wantTrend: metrics.TrendStable},
+		"Only failed runs":                          {durations: []float64{1, 2}, failures: []int{1, 3}, wantTrend: metrics.TrendUnknown},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			runs := newRuns(tc.durations, tc.failures)
+
+			got := metrics.Summarize(runs)
+			require.Equal(t, tc.wantTrend, got.Trend, "Summarize should detect the expected trend")
+			require.Equal(t, tc.wantChange, got.Change, "Summarize should compute the expected change")
+			require.Equal(t, len(runs), got.Runs, "Summarize should count all runs")
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		durations []float64
+		failures  []int
+		history   bool
+		json      bool
+	}{
+		"No runs":                          {},
+		"No runs in JSON":                  {json: true},
+		"Single run":                       {durations: []float64{2.345}},
+		"Stable refreshes":                 {durations: []float64{2, 2.1, 1.9, 2, 2.2, 1.9, 2, 2.1}},
+		"Degrading refreshes":              {durations: []float64{1, 1, 1, 1, 1.5, 2, 2, 2.5}},
+		"Improving refreshes":              {durations: []float64{4, 4, 4, 4, 2, 2, 2, 2}},
+		"Refreshes with failures":          {durations: []float64{1, 1, 30, 1, 1, 1, 1.2}, failures: []int{0, 0, 2, 0, 0, 0, 1}},
+		"Only failed refreshes":            {durations: []float64{0.2, 0.3}, failures: []int{1, 1}},
+		"Refreshes with history":           {durations: []float64{1, 1, 30, 1, 1.5, 2, 2, 2.5}, failures: []int{0, 0, 2, 0, 0, 0, 0, 0}, history: true},
+		"Identical refreshes with history": {durations: []float64{1, 1, 1}, history: true},
+		"Refreshes in JSON":                {durations: []float64{1, 1, 30, 1, 1.5, 2, 2, 2.5}, failures: []int{0, 0, 2, 0, 0, 0, 0, 0}, json: true},
+		"Refreshes with history in JSON":   {durations: []float64{1, 1, 30}, failures: []int{0, 0, 2}, history: true, json: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			runs := newRuns(tc.durations, tc.failures)
+
+			var got string
+			if tc.json {
+				var err error
+				got, err = metrics.FormatJSON(runs, tc.history)
+				require.NoError(t, err, "FormatJSON should not have failed")
+			} else {
+				got = metrics.Format(runs, tc.history)
+			}
+
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "Format should return the expected output")
+		})
+	}
+}
+
+// newRuns returns one hourly run per duration, in seconds, with the matching number of failures if any.
+func newRuns(durations []float64, failures []int) []metrics.Run {
+	start := time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC)
+	var runs []metrics.Run
+	for i, d := range durations {
+		r := metrics.Run{Time: start.Add(time.Duration(i) * time.Hour), Duration: time.Duration(d * float64(time.Second))}
+		if i < len(failures) {
+			r.Failures = failures[i]
+		}
+		runs = append(runs, r)
+	}
+	return runs
+}
@@ -0,0 +1,255 @@
+// Package pkglock orders the operations of adsys installing packages or restarting services against the
+// transactions of the package managers of the machine.
+//
+// Scheduled refreshes often run while unattended-upgrades, apt or snapd are installing packages. Running our
+// operations at the same time fails on the dpkg lock, or restarts services in the middle of their upgrade.
+// Operations are thus run one at a time, and only once no package manager transaction is active:
+//   - an apt or dpkg transaction is detected by the lock it holds on the dpkg and apt lock files;
+//   - a snapd transaction is detected by the changes in progress reported by the snapd API.
+//
+// Active transactions are waited for until a timeout, after which the operation fails.
+package pkglock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/sys/unix"
+)
+
+// lockFiles are the lock files held by apt and dpkg during their transactions, relative to the root directory.
+var lockFiles = []string{
+	"var/lib/dpkg/lock-frontend",
+	"var/lib/dpkg/lock",
+	"var/lib/apt/lists/lock",
+	"var/cache/apt/archives/lock",
+}
+
+// snapdSocket is the socket of the snapd API, relative to the root directory.
+const snapdSocket = "run/snapd.socket"
+
+// Waiter runs operations once the package managers of the machine are idle.
+type Waiter struct {
+	rootDir      string
+	timeout      time.Duration
+	pollInterval time.Duration
+
+	// mu prevents running several operations concurrently.
+	mu sync.Mutex
+}
+
+type options struct {
+	rootDir      string
+	timeout      time.Duration
+	pollInterval time.Duration
+}
+
+// Option reprents an optional function to change the waiter behavior.
+type Option func(*options)
+
+// WithRootDir overrides the default root directory of the lock files and the snapd socket.
+func WithRootDir(p string) func(*options) {
+	return func(a *options) {
+		a.rootDir = p
+	}
+}
+
+// WithTimeout overrides the default maximum time to wait for the active transactions to complete.
+func WithTimeout(d time.Duration) func(*options) {
+	return func(a *options) {
+		a.timeout = d
+	}
+}
+
+// WithPollInterval overrides the default interval between two checks of the active transactions.
+func WithPollInterval(d time.Duration) func(*options) {
+	return func(a *options) {
+		a.pollInterval = d
+	}
+}
+
+// New returns a new waiter.
+func New(opts ...Option) *Waiter {
+	// defaults
+	args := options{
+		rootDir:      "/",
+		timeout:      consts.DefaultPackageLockTimeout,
+		pollInterval: 5 * time.Second,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Waiter{
+		rootDir:      args.rootDir,
+		timeout:      args.timeout,
+		pollInterval: args.pollInterval,
+	}
+}
+
+// Run runs f once the previous operations completed and no package manager transaction is active.
+// It fails without running f if the transactions are still active after the timeout.
+func (w *Waiter) Run(ctx context.Context, f func() error) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.wait(ctx); err != nil {
+		return err
+	}
+	return f()
+}
+
+// wait blocks until no package manager transaction is active, ctx is cancelled or the timeout is reached.
+func (w *Waiter) wait(ctx context.Context) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't wait for the package managers to be idle"))
+
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	var waiting bool
+	for {
+		active, err := w.activeTransactions(ctx)
+		if err != nil {
+			return err
+		}
+		if len(active) == 0 {
+			if waiting {
+				log.Info(ctx, gotext.Get("Package managers are idle, resuming"))
+			}
+			return nil
+		}
+
+		if !waiting {
+			log.Info(ctx, gotext.Get("Waiting for active package manager transactions to complete: %s", strings.Join(active, ", ")))
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return errors.New(gotext.Get("package manager transactions still active after %s: %s", w.timeout, strings.Join(active, ", ")))
+			}
+			return ctx.Err()
+		case <-time.After(w.pollInterval):
+		}
+	}
+}
+
+// activeTransactions returns a description of the package manager transactions currently active.
+func (w *Waiter) activeTransactions(ctx context.Context) (active []string, err error) {
+	for _, p := range lockFiles {
+		p = filepath.Join(w.rootDir, p)
+		pid, held, err := lockHolder(p)
+		if err != nil {
+			return nil, err
+		}
+		if !held {
+			continue
+		}
+		// Open file description locks are not owned by any process.
+		if pid <= 0 {
+			active = append(active, gotext.Get("%s locked", p))
+			continue
+		}
+		active = append(active, gotext.Get("%s held by process %d", p, pid))
+	}
+
+	changes, err := w.snapdChanges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range changes {
+		active = append(active, gotext.Get("snapd change %s (%s)", c.ID, c.Summary))
+	}
+
+	return active, nil
+}
+
+// lockHolder returns the process holding a lock on the file at path, if any.
+// The lock is tested without being taken, so that package managers never fail because of us.
+func lockHolder(path string) (pid int32, held bool, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	// The lock files are only readable by root, who runs the daemon: we can't tell otherwise.
+	if errors.Is(err, fs.ErrPermission) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	lk := unix.Flock_t{Type: unix.F_WRLCK}
+	if err := unix.FcntlFlock(f.Fd(), unix.F_GETLK, &lk); err != nil {
+		return 0, false, errors.New(gotext.Get("can't test lock on %s: %v", path, err))
+	}
+	if lk.Type == unix.F_UNLCK {
+		return 0, false, nil
+	}
+	return lk.Pid, true, nil
+}
+
+// snapdChange is a snapd change, as returned by the snapd API.
+type snapdChange struct {
+	ID      string `json:"id"`
+	Summary string `json:"summary"`
+}
+
+// snapdChanges returns the snapd changes in progress.
+// No change is returned if snapd is not installed or not running.
+func (w *Waiter) snapdChanges(ctx context.Context) (changes []snapdChange, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't list snapd changes in progress"))
+
+	socket := filepath.Join(w.rootDir, snapdSocket)
+	if _, err := os.Stat(socket); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/v2/changes?select=in-progress", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if errors.Is(err, unix.ECONNREFUSED) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(gotext.Get("unexpected status from snapd: %s", resp.Status))
+	}
+	var r struct {
+		Result []snapdChange `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return r.Result, nil
+}
@@ -0,0 +1,208 @@
+package pkglock_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/pkglock"
+	"golang.org/x/sys/unix"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		lockFiles      []string
+		heldLockFile   string
+		releaseAfter   time.Duration
+		snapdChanges   string
+		snapdStatus    int
+		snapdNotListen bool
+		cancelledCtx   bool
+
+		wantErr bool
+	}{
+		"Run without any package manager":      {},
+		"Run with free lock files":             {lockFiles: []string{"var/lib/dpkg/lock-frontend", "var/lib/dpkg/lock", "var/lib/apt/lists/lock", "var/cache/apt/archives/lock"}},
+		"Run without snapd change in progress": {snapdChanges: `{"result": []}`},
+		"Run with snapd not listening":         {snapdNotListen: true},
+		"Run once dpkg lock is released":       {heldLockFile: "var/lib/dpkg/lock-frontend", releaseAfter: 200 * time.Millisecond},
+		"Run once apt lock is released":        {heldLockFile: "var/cache/apt/archives/lock", releaseAfter: 200 * time.Millisecond},
+		"Run once snapd change is completed":   {snapdChanges: `{"result": [{"id": "42", "summary": "Install \"hello\" snap"}]}`, releaseAfter: 200 * time.Millisecond},
+
+		// Error cases
+		"Error on dpkg lock held after timeout":           {heldLockFile: "var/lib/dpkg/lock", wantErr: true},
+		"Error on snapd change in progress after timeout": {snapdChanges: `{"result": [{"id": "42", "summary": "Refresh snaps"}]}`, wantErr: true},
+		"Error on snapd error status":                     {snapdChanges: `{"result": {"message": "boom"}}`, snapdStatus: http.StatusInternalServerError, wantErr: true},
+		"Error on invalid snapd response":                 {snapdChanges: `{"result": [`, wantErr: true},
+		"Error on cancelled context":                      {heldLockFile: "var/lib/dpkg/lock", cancelledCtx: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			// The snapd socket path needs to fit in the maximum length of a unix socket path.
+			rootDir, err := os.MkdirTemp("", "pkglock")
+			require.NoError(t, err, "Setup: can't create root directory")
+			t.Cleanup(func() { _ = os.RemoveAll(rootDir) })
+
+			for _, p := range tc.lockFiles {
+				p = filepath.Join(rootDir, p)
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create lock file directory")
+				require.NoError(t, os.WriteFile(p, nil, 0600), "Setup: can't create lock file")
+			}
+
+			var release func()
+			if tc.heldLockFile != "" {
+				release = holdLock(t, filepath.Join(rootDir, tc.heldLockFile))
+			}
+			if tc.snapdChanges != "" || tc.snapdNotListen {
+				release = serveSnapd(t, rootDir, tc.snapdChanges, tc.snapdStatus, tc.snapdNotListen)
+			}
+
+			timeout := 100 * time.Millisecond
+			if tc.releaseAfter > 0 {
+				timeout = 10 * time.Second
+				time.AfterFunc(tc.releaseAfter, release)
+			}
+			w := pkglock.New(pkglock.WithRootDir(rootDir), pkglock.WithTimeout(timeout), pkglock.WithPollInterval(10*time.Millisecond))
+
+			ctx := context.Background()
+			if tc.cancelledCtx {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				cancel()
+			}
+
+			var ran bool
+			err = w.Run(ctx, func() error {
+				ran = true
+				return nil
+			})
+			if tc.wantErr {
+				require.Error(t, err, "Run should have failed but didn't")
+				require.False(t, ran, "Run should not have run the operation")
+				return
+			}
+			require.NoError(t, err, "Run should not have failed")
+			require.True(t, ran, "Run should have run the operation")
+		})
+	}
+}
+
+func TestRunReturnsOperationError(t *testing.T) {
+	t.Parallel()
+
+	w := pkglock.New(pkglock.WithRootDir(t.TempDir()))
+	err := w.Run(context.Background(), func() error { return fmt.Errorf("operation failed") })
+	require.EqualError(t, err, "operation failed", "Run should return the error of the operation")
+}
+
+func TestRunIsSerialized(t *testing.T) {
+	t.Parallel()
+
+	w := pkglock.New(pkglock.WithRootDir(t.TempDir()))
+
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- w.Run(context.Background(), func() error {
+				n := running.Add(1)
+				defer running.Add(-1)
+				if n > maxRunning.Load() {
+					maxRunning.Store(n)
+				}
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err, "Run should not have failed")
+	}
+
+	require.Equal(t, int32(1), maxRunning.Load(), "Operations should have run one at a time")
+}
+
+// holdLock creates the lock file at path and holds a lock on it, as dpkg and apt do, until release is called.
+func holdLock(t *testing.T, path string) (release func()) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750), "Setup: can't create lock file directory")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	require.NoError(t, err, "Setup: can't create lock file")
+
+	// An open file description lock conflicts with the locks tested from any other file description,
+	// even from the same process.
+	lk := unix.Flock_t{Type: unix.F_WRLCK}
+	require.NoError(t, unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &lk), "Setup: can't lock file")
+
+	var once sync.Once
+	release = func() { once.Do(func() { _ = f.Close() }) }
+	t.Cleanup(release)
+	return release
+}
+
+// serveSnapd serves the snapd API on the snapd socket under rootDir, answering changes in progress with
+// changes and status until release is called. Without any status, the API answers with 200 OK.
+// If notListen is true, the socket exists but nothing listens on it.
+func serveSnapd(t *testing.T, rootDir, changes string, status int, notListen bool) (release func()) {
+	t.Helper()
+
+	socket := filepath.Join(rootDir, "run", "snapd.socket")
+	require.NoError(t, os.MkdirAll(filepath.Dir(socket), 0750), "Setup: can't create snapd socket directory")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err, "Setup: can't listen on snapd socket")
+	if notListen {
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		require.NoError(t, l.Close(), "Setup: can't close snapd socket")
+		return func() {}
+	}
+
+	var mu sync.Mutex
+	released := false
+	srv := &http.Server{
+		ReadHeaderTimeout: time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v2/changes" || r.URL.Query().Get("select") != "in-progress" {
+				http.NotFound(w, r)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if released {
+				fmt.Fprint(w, `{"result": []}`)
+				return
+			}
+			if status != 0 {
+				w.WriteHeader(status)
+			}
+			fmt.Fprint(w, changes)
+		}),
+	}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		released = true
+	}
+}
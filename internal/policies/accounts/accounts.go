@@ -0,0 +1,363 @@
+// Package accounts provides a manager that enforces password quality and account lockout policies
+// on the machine, mapping the Windows account policies onto pam_pwquality and pam_faillock.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - accounts/password-min-length: minimum length of new passwords (pam_pwquality minlen).
+//   - accounts/password-complexity: true to require characters from 3 classes among lowercase,
+//     uppercase, digits and symbols in new passwords (pam_pwquality minclass).
+//   - accounts/lockout-threshold: number of consecutive failed authentications before the account is
+//     locked (pam_faillock deny). 0 disables the account lockout.
+//   - accounts/lockout-duration: number of minutes an account stays locked (pam_faillock unlock_time).
+//     0 keeps the account locked until an administrator unlocks it with faillock.
+//   - accounts/lockout-reset: number of minutes after which the failed authentications counter is
+//     reset (pam_faillock fail_interval).
+//
+// The password quality settings are written to a drop-in of the pwquality configuration directory.
+//
+// The lockout settings are written to a dedicated faillock configuration file, and pam_faillock is
+// added to the PAM stack with pam-auth-update profiles referencing it, instead of editing common-auth
+// directly. The profiles are removed, and the PAM stack regenerated, once the lockout is not
+// configured anymore.
+package accounts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	pwqualityConf    = "/etc/security/pwquality.conf.d/50-adsys.conf"
+	faillockConf     = "/etc/security/faillock-adsys.conf"
+	pamConfigsDir    = "/usr/share/pam-configs"
+	pwqualityProfile = "pwquality"
+
+	// Minimum length enforced by pam_pwquality, whatever the configuration.
+	minPasswordLength = 6
+	// Number of character classes required by the Windows password complexity policy.
+	complexityClasses = 3
+)
+
+// pamProfiles are the pam-auth-update profiles adding pam_faillock to the PAM stack.
+// The notify profile checks whether the account is locked before the authentication and resets the
+// counter on success, the other one records the failed authentications.
+var pamProfiles = []struct {
+	name    string
+	content string
+}{
+	{name: "adsys-faillock", content: `Name: Lock accounts after failed authentications (managed by adsys)
+Default: yes
+Priority: 0
+Auth-Type: Primary
+Auth:
+	[default=die]	pam_faillock.so authfail conf=` + faillockConf + `
+`},
+	{name: "adsys-faillock-notify", content: `Name: Deny access to locked accounts and reset the failed authentications counter (managed by adsys)
+Default: yes
+Priority: 1024
+Auth-Type: Primary
+Auth:
+	requisite	pam_faillock.so preauth conf=` + faillockConf + `
+Account-Type: Primary
+Account:
+	required	pam_faillock.so conf=` + faillockConf + `
+`},
+}
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// setting is a pam module setting set to a value.
+type setting struct {
+	name  string
+	value string
+}
+
+// Manager applies the accounts policy on the machine.
+type Manager struct {
+	rootDir          string
+	pamAuthUpdateCmd []string
+	cmdTimeout       time.Duration
+}
+
+type options struct {
+	rootDir          string
+	pamAuthUpdateCmd []string
+	cmdTimeout       time.Duration
+}
+
+// Option reprents an optional function to change the accounts manager.
+type Option func(*options)
+
+// WithRootDir overrides the root directory the configuration files are written to.
+func WithRootDir(p string) func(*options) {
+	return func(a *options) {
+		a.rootDir = p
+	}
+}
+
+// WithPamAuthUpdateCmd overrides the default pam-auth-update command.
+func WithPamAuthUpdateCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.pamAuthUpdateCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the accounts policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		rootDir:          "/",
+		pamAuthUpdateCmd: []string{"pam-auth-update"},
+		cmdTimeout:       consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		rootDir:          args.rootDir,
+		pamAuthUpdateCmd: args.pamAuthUpdateCmd,
+		cmdTimeout:       args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy configures the password quality and the account lockout from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply accounts policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Accounts policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying accounts policy to %s", objectName)
+
+	pwquality, faillock, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	if len(pwquality) > 0 {
+		if _, err := os.Stat(m.path(filepath.Join(pamConfigsDir, pwqualityProfile))); errors.Is(err, fs.ErrNotExist) {
+			log.Warning(ctx, gotext.Get("libpam-pwquality is not installed, password quality settings will not be enforced"))
+		}
+	}
+	if err := m.writeConf(pwqualityConf, pwquality); err != nil {
+		return err
+	}
+
+	return m.applyLockout(ctx, faillock)
+}
+
+// DumpState returns the password quality and account lockout configuration written during the last refresh of
+// the machine, with the PAM profiles.
+// The state is empty for users or if no accounts policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump accounts state of %s", objectName))
+
+	// Accounts policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	paths := []string{m.path(pwqualityConf), m.path(faillockConf)}
+	for _, p := range pamProfiles {
+		paths = append(paths, m.path(filepath.Join(pamConfigsDir, p.name)))
+	}
+	return syshelpers.DumpFiles(paths...)
+}
+
+// parseEntries validates the entries and returns the pam_pwquality and pam_faillock settings to write.
+func parseEntries(ctx context.Context, entries []entry.Entry) (pwquality, faillock []setting, err error) {
+	var lockoutEnabled bool
+	var lockoutOptions []setting
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+
+		switch e.Key {
+		case "accounts/password-min-length":
+			n, err := parseNumber(e.Value, minPasswordLength)
+			if err != nil {
+				return nil, nil, errors.New(gotext.Get("invalid minimum password length: %v", err))
+			}
+			pwquality = append(pwquality, setting{name: "minlen", value: strconv.Itoa(n)})
+		case "accounts/password-complexity":
+			switch e.Value {
+			case "true":
+				pwquality = append(pwquality, setting{name: "minclass", value: strconv.Itoa(complexityClasses)})
+			case "false":
+			default:
+				return nil, nil, errors.New(gotext.Get("invalid password complexity value %q: true or false is expected", e.Value))
+			}
+		case "accounts/lockout-threshold":
+			n, err := parseNumber(e.Value, 0)
+			if err != nil {
+				return nil, nil, errors.New(gotext.Get("invalid lockout threshold: %v", err))
+			}
+			// Like on Windows, a threshold of 0 never locks the accounts.
+			if n == 0 {
+				continue
+			}
+			lockoutEnabled = true
+			faillock = append(faillock, setting{name: "deny", value: strconv.Itoa(n)})
+		case "accounts/lockout-duration":
+			n, err := parseNumber(e.Value, 0)
+			if err != nil {
+				return nil, nil, errors.New(gotext.Get("invalid lockout duration: %v", err))
+			}
+			// Durations are in minutes on Windows and in seconds for faillock, where 0 never unlocks either.
+			lockoutOptions = append(lockoutOptions, setting{name: "unlock_time", value: strconv.Itoa(n * 60)})
+		case "accounts/lockout-reset":
+			n, err := parseNumber(e.Value, 1)
+			if err != nil {
+				return nil, nil, errors.New(gotext.Get("invalid lockout counter reset: %v", err))
+			}
+			lockoutOptions = append(lockoutOptions, setting{name: "fail_interval", value: strconv.Itoa(n * 60)})
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing accounts entries, skipping it", e.Key))
+		}
+	}
+
+	if !lockoutEnabled {
+		if len(lockoutOptions) > 0 {
+			log.Debug(ctx, "Lockout duration and counter reset are ignored without a lockout threshold")
+		}
+		return pwquality, nil, nil
+	}
+
+	return pwquality, append(faillock, lockoutOptions...), nil
+}
+
+// parseNumber returns the number in value, checking it is at least minimum.
+func parseNumber(value string, minimum int) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, errors.New(gotext.Get("%q is not a number", value))
+	}
+	if n < minimum {
+		return 0, errors.New(gotext.Get("%d is lower than %d", n, minimum))
+	}
+	return n, nil
+}
+
+// applyLockout writes the faillock configuration and adds pam_faillock to the PAM stack if needed.
+// pam_faillock is removed from the PAM stack if there is no setting.
+func (m *Manager) applyLockout(ctx context.Context, faillock []setting) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't configure account lockout"))
+
+	var profiles []string
+	for _, p := range pamProfiles {
+		profiles = append(profiles, p.name)
+	}
+
+	enabled := true
+	for _, p := range pamProfiles {
+		if _, err := os.Stat(m.path(filepath.Join(pamConfigsDir, p.name))); errors.Is(err, fs.ErrNotExist) {
+			enabled = false
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if len(faillock) == 0 {
+		if enabled {
+			log.Info(ctx, "Removing account lockout from the PAM configuration")
+			if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.pamAuthUpdateCmd, append([]string{"--package", "--remove"}, profiles...)...); err != nil {
+				return err
+			}
+		}
+		for _, p := range pamProfiles {
+			if err := os.Remove(m.path(filepath.Join(pamConfigsDir, p.name))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return m.writeConf(faillockConf, nil)
+	}
+
+	// The configuration file must exist before pam_faillock is added to the PAM stack.
+	if err := m.writeConf(faillockConf, faillock); err != nil {
+		return err
+	}
+	if enabled {
+		return nil
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(m.path(pamConfigsDir), 0755); err != nil {
+		return err
+	}
+	for _, p := range pamProfiles {
+		// nolint:gosec // G306 pam-auth-update profiles are world readable
+		if err := os.WriteFile(m.path(filepath.Join(pamConfigsDir, p.name)), []byte(p.content), 0644); err != nil {
+			return err
+		}
+	}
+	log.Info(ctx, "Adding account lockout to the PAM configuration")
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.pamAuthUpdateCmd, append([]string{"--package", "--enable"}, profiles...)...); err != nil {
+		return err
+	}
+	return nil
+}
+
+// path returns the path of p under the root directory.
+func (m *Manager) path(p string) string {
+	return filepath.Join(m.rootDir, p)
+}
+
+// writeConf writes the settings to the configuration file p, relative to the root directory.
+// The file is removed if there is none.
+func (m *Manager) writeConf(p string, settings []setting) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write %s", p))
+
+	p = m.path(p)
+	if len(settings) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	var out strings.Builder
+	out.WriteString(header)
+	for _, s := range settings {
+		fmt.Fprintf(&out, "%s = %s\n", s.name, s.value)
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 PAM modules configuration files are world readable
+	if err := os.WriteFile(p+".new", []byte(out.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
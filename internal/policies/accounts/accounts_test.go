@@ -0,0 +1,104 @@
+package accounts_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/accounts"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	password := []entry.Entry{{Key: "accounts/password-min-length", Value: "12"}, {Key: "accounts/password-complexity", Value: "true"}}
+	lockout := []entry.Entry{{Key: "accounts/lockout-threshold", Value: "5"}, {Key: "accounts/lockout-duration", Value: "30"}, {Key: "accounts/lockout-reset", Value: "15"}}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existing      string
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Set password quality":                          {existing: "states/pwquality-installed", entries: password},
+		"Set password quality without pwquality":        {entries: password},
+		"Password complexity disabled":                  {existing: "states/pwquality-installed", entries: []entry.Entry{{Key: "accounts/password-complexity", Value: "false"}}},
+		"Lock accounts":                                 {entries: lockout},
+		"Lock accounts until unlocked":                  {entries: []entry.Entry{{Key: "accounts/lockout-threshold", Value: "5"}, {Key: "accounts/lockout-duration", Value: "0"}}},
+		"Set password quality and lock accounts":        {existing: "states/pwquality-installed", entries: slices.Concat(password, lockout)},
+		"Lockout settings are updated":                  {existing: "states/lockout-enabled", entries: lockout, mockBehaviour: "fail"},
+		"Lockout threshold of 0 removes the lockout":    {existing: "states/lockout-enabled", entries: []entry.Entry{{Key: "accounts/lockout-threshold", Value: "0"}, {Key: "accounts/lockout-duration", Value: "30"}}},
+		"Lockout options without threshold are ignored": {entries: []entry.Entry{{Key: "accounts/lockout-duration", Value: "30"}, {Key: "accounts/lockout-reset", Value: "15"}}, mockBehaviour: "fail"},
+		"No entries removes everything":                 {existing: "states/lockout-enabled"},
+		"Disabled entries remove everything":            {existing: "states/lockout-enabled", entries: []entry.Entry{{Key: "accounts/lockout-threshold", Value: "5", Disabled: true}}},
+		"Disabled entries are ignored":                  {entries: []entry.Entry{{Key: "accounts/lockout-threshold", Value: "5", Disabled: true}}, mockBehaviour: "fail"},
+		"Unsupported keys are ignored":                  {entries: []entry.Entry{{Key: "accounts/password-min-length", Value: "12"}, {Key: "accounts/unsupported", Value: "12"}}},
+		"No entries is a no-op":                         {mockBehaviour: "fail"},
+		"Not a computer is a no-op":                     {entries: lockout, isNotComputer: true, mockBehaviour: "fail"},
+
+		// Error cases
+		"Error on minimum length not a number":     {entries: []entry.Entry{{Key: "accounts/password-min-length", Value: "twelve"}}, wantErr: true},
+		"Error on minimum length too low":          {entries: []entry.Entry{{Key: "accounts/password-min-length", Value: "4"}}, wantErr: true},
+		"Error on invalid password complexity":     {entries: []entry.Entry{{Key: "accounts/password-complexity", Value: "yes"}}, wantErr: true},
+		"Error on negative lockout threshold":      {entries: []entry.Entry{{Key: "accounts/lockout-threshold", Value: "-1"}}, wantErr: true},
+		"Error on invalid lockout duration":        {entries: []entry.Entry{{Key: "accounts/lockout-duration", Value: "30m"}}, wantErr: true},
+		"Error on lockout reset of 0":              {entries: []entry.Entry{{Key: "accounts/lockout-reset", Value: "0"}}, wantErr: true},
+		"Error on unwritable PAM profiles":         {existing: "states/pam-configs-is-a-file", entries: lockout, wantErr: true},
+		"Error on adding lockout to PAM stack":     {entries: lockout, mockBehaviour: "fail", wantErr: true},
+		"Error on removing lockout from PAM stack": {existing: "states/lockout-enabled", mockBehaviour: "fail", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+
+			m := accounts.New(
+				accounts.WithRootDir(root),
+				accounts.WithPamAuthUpdateCmd(testutils.MockCommand(root, "pam-auth-update", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	behaviour, args := c.Behaviour, c.Args
+
+	if behaviour == "fail" {
+		fmt.Fprintln(os.Stderr, "pam-auth-update: requested failure")
+		os.Exit(1)
+	}
+
+	c.Log(fmt.Sprintf("pam-auth-update %s", strings.Join(args, " ")))
+}
@@ -158,6 +158,47 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 	return err
 }
 
+// DumpState returns the policies of the adsys machine profiles which are currently loaded in the system, with their mode.
+// For users, only the policies of their own hats are returned. The state is empty if no apparmor policy is applied.
+func (m *Manager) DumpState(ctx context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump apparmor state of %s", objectName))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	machinePoliciesPath := filepath.Join(m.apparmorDir, "machine")
+	if _, err := os.Stat(machinePoliciesPath); errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	profiles, err := filesInDir(machinePoliciesPath)
+	if err != nil {
+		return "", err
+	}
+	policies, err := m.policiesFromFiles(ctx, profiles)
+	if err != nil {
+		return "", err
+	}
+
+	loaded, err := os.ReadFile(m.loadedPoliciesFile)
+	if err != nil {
+		return "", errors.New(gotext.Get("failed to open %q: %v", m.loadedPoliciesFile, err))
+	}
+	var out strings.Builder
+	// Each line is of the form: policy_name (mode)
+	for _, l := range strings.Split(string(loaded), "\n") {
+		l = strings.TrimSpace(l)
+		policy, _, _ := strings.Cut(l, " ")
+		if !slices.Contains(policies, policy) {
+			continue
+		}
+		if !isComputer && !strings.HasSuffix(policy, "//"+objectName) {
+			continue
+		}
+		fmt.Fprintln(&out, l)
+	}
+	return out.String(), nil
+}
+
 // applyUserPolicy applies apparmor policies for the machine object.
 func (m *Manager) applyMachinePolicy(ctx context.Context, e entry.Entry, apparmorPath string, assetsDumper AssetsDumper) (err error) {
 	defer decorate.OnError(&err, gotext.Get("can't apply machine policy"))
@@ -190,6 +190,69 @@ func TestApplyPolicy(t *testing.T) {
 	}
 }
 
+func TestDumpState(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		user                   bool
+		destsAlreadyExist      map[string]string
+		existingLoadedPolicies []string
+		apparmorParserError    string
+
+		wantErr bool
+	}{
+		"Computer state": {destsAlreadyExist: map[string]string{"only-machine": "machine"}, existingLoadedPolicies: []string{"/usr/bin/foo", "/usr/bin/other", "/usr/bin/bar"}},
+		"Computer state with user hats": {destsAlreadyExist: map[string]string{"machine-with-users": "machine", "users": "users"},
+			existingLoadedPolicies: []string{"/usr/bin/pam_binary", "/usr/bin/pam_binary//ubuntu", "/usr/bin/pam_binary//DEFAULT"}},
+		"User state only lists its hats": {user: true, destsAlreadyExist: map[string]string{"machine-with-users": "machine", "users": "users"},
+			existingLoadedPolicies: []string{"/usr/bin/pam_binary", "/usr/bin/pam_binary//ubuntu", "/usr/bin/pam_binary//DEFAULT"}},
+		"No state when profiles are not loaded": {destsAlreadyExist: map[string]string{"only-machine": "machine"}, existingLoadedPolicies: []string{"/usr/bin/other"}},
+		"No state without machine profiles":     {existingLoadedPolicies: []string{"/usr/bin/foo"}},
+
+		// Error cases
+		"Error on absent loaded policies file": {destsAlreadyExist: map[string]string{"only-machine": "machine"}, existingLoadedPolicies: []string{"parseError"}, wantErr: true},
+		"Error on apparmor_parser failing":     {destsAlreadyExist: map[string]string{"only-machine": "machine"}, apparmorParserError: "-N", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			apparmorDir := t.TempDir()
+			loadedPoliciesFile := mockLoadedPoliciesFile(t, tc.existingLoadedPolicies)
+			if slices.Contains(tc.existingLoadedPolicies, "parseError") {
+				loadedPoliciesFile = "not-a-file"
+			}
+			apparmorParserCmd := mockApparmorParserCmd(t, filepath.Join(t.TempDir(), "parser-output"))
+			if tc.apparmorParserError != "" {
+				apparmorParserCmd = append(apparmorParserCmd, fmt.Sprintf("-Exit1%s", tc.apparmorParserError))
+			}
+
+			for source, dest := range tc.destsAlreadyExist {
+				require.NoError(t,
+					shutil.CopyTree(
+						filepath.Join("testdata", "TestApplyPolicy", "apparmor_dir", source), filepath.Join(apparmorDir, dest),
+						&shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial apparmor dir machine profiles content")
+			}
+
+			m := apparmor.New(apparmorDir,
+				apparmor.WithApparmorParserCmd(apparmorParserCmd),
+				apparmor.WithApparmorFsDir(filepath.Dir(loadedPoliciesFile)))
+
+			got, err := m.DumpState(context.Background(), "ubuntu", !tc.user)
+			if tc.wantErr {
+				require.Error(t, err, "DumpState should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "DumpState failed but shouldn't have")
+
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "DumpState returned unexpected state")
+		})
+	}
+}
+
 func appendToFile(t *testing.T, path string, data []byte) {
 	t.Helper()
 
@@ -0,0 +1,486 @@
+// Package apt provides a manager that configures apt repositories and installs, pins and removes apt packages.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported, with one package or pattern per line:
+//   - apt/install: packages to install if they are not already;
+//   - apt/remove: packages to remove if they are installed;
+//   - apt/pin: packages pinned to a version, of the form <package> <version>;
+//   - apt/allowlist: patterns of the packages which can be installed or pinned by
+//     the policy. If empty, any package is allowed;
+//   - apt/blocklist: patterns of the packages which can never be installed on the
+//     machine. They take precedence over the allowlist;
+//   - apt/repositories: repositories to add to the apt sources, of the form
+//     name=<name>, uri=<uri>, suites=<suite> <suite>[, components=<component> <component>][, architectures=<arch> <arch>][, key=<path>].
+//
+// Each repository is written as a deb822 sources file, adsys-<name>.sources, in
+// the apt sources directory. Its optional signing key is copied from the apt
+// directory of the assets share to the apt keyrings directory and referenced by
+// the Signed-By field. Sources and keys created by adsys are removed once their
+// repository is not configured anymore. Package indexes are updated whenever
+// the repositories change, before installing packages.
+//
+// Pins and blocked packages are written to an apt preferences file, with a
+// priority of 1001 for pins (allowing downgrades) and -1 for blocked packages,
+// which prevents apt from installing them. This file is removed once no pin or
+// blocklist is configured anymore.
+//
+// Installed packages are not removed once the policy is not configured anymore:
+// apt/remove needs to be used explicitly for this.
+//
+// DryRun reports the changes the policy would apply, without applying them, so
+// that administrators can review them.
+package apt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	preferencesFile = "adsys"
+
+	pinPriority     = 1001
+	blockedPriority = -1
+)
+
+// packageNameRe matches a valid Debian package name.
+var packageNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+
+// patternRe matches a package name which can contain glob characters.
+var patternRe = regexp.MustCompile(`^[a-z0-9*?\[][a-z0-9+.\-*?\[\]]*$`)
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// pin is a package pinned to a version.
+type pin struct {
+	name    string
+	version string
+}
+
+// plan is the list of changes the policy applies on the machine.
+type plan struct {
+	install []string
+	remove  []string
+	pins    []pin
+	blocked []string
+
+	repositories []repository
+
+	// skippedNotAllowed are the packages to install or pin which are not part of the allowlist.
+	skippedNotAllowed []string
+	// skippedBlocked are the packages to install or pin which are part of the blocklist.
+	skippedBlocked []string
+}
+
+// Manager applies the apt packages policy on the machine.
+type Manager struct {
+	preferencesDir string
+	sourcesDir     string
+	keyringsDir    string
+	stateDir       string
+	aptGetCmd      []string
+	dpkgQueryCmd   []string
+}
+
+type options struct {
+	preferencesDir string
+	sourcesDir     string
+	keyringsDir    string
+	stateDir       string
+	aptGetCmd      []string
+	dpkgQueryCmd   []string
+}
+
+// Option reprents an optional function to change the apt manager.
+type Option func(*options)
+
+// WithPreferencesDir overrides the default apt preferences directory.
+func WithPreferencesDir(p string) func(*options) {
+	return func(a *options) {
+		a.preferencesDir = p
+	}
+}
+
+// WithSourcesDir overrides the default apt sources directory.
+func WithSourcesDir(p string) func(*options) {
+	return func(a *options) {
+		a.sourcesDir = p
+	}
+}
+
+// WithKeyringsDir overrides the default directory of the repositories signing keys.
+func WithKeyringsDir(p string) func(*options) {
+	return func(a *options) {
+		a.keyringsDir = p
+	}
+}
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithAptGetCmd overrides the default apt-get command.
+func WithAptGetCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.aptGetCmd = cmd
+	}
+}
+
+// WithDpkgQueryCmd overrides the default dpkg-query command.
+func WithDpkgQueryCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.dpkgQueryCmd = cmd
+	}
+}
+
+// New returns a new manager for the apt packages policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		preferencesDir: consts.DefaultAptPreferencesDir,
+		sourcesDir:     consts.DefaultAptSourcesDir,
+		keyringsDir:    consts.DefaultAptKeyringsDir,
+		stateDir:       consts.DefaultStateDir,
+		aptGetCmd:      []string{"apt-get"},
+		dpkgQueryCmd:   []string{"dpkg-query"},
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		preferencesDir: args.preferencesDir,
+		sourcesDir:     args.sourcesDir,
+		keyringsDir:    args.keyringsDir,
+		stateDir:       filepath.Join(args.stateDir, "apt"),
+		aptGetCmd:      args.aptGetCmd,
+		dpkgQueryCmd:   args.dpkgQueryCmd,
+	}
+}
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// ApplyPolicy configures the repositories and installs, pins and removes the packages from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply apt policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Apt policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying apt policy to %s", objectName)
+
+	p, err := m.plan(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range p.skippedNotAllowed {
+		log.Warning(ctx, gotext.Get("Package %q is not part of the allowlist, skipping it", n))
+	}
+	for _, n := range p.skippedBlocked {
+		log.Warning(ctx, gotext.Get("Package %q is part of the blocklist, skipping it", n))
+	}
+
+	// Repositories and preferences are written first so that installations respect them.
+	sourcesChanged, err := m.applyRepositories(ctx, p.repositories, assetsDumper)
+	if err != nil {
+		return err
+	}
+	if err := m.writePreferences(p); err != nil {
+		return err
+	}
+
+	opts := syshelpers.CmdOptions{Env: []string{"DEBIAN_FRONTEND=noninteractive"}}
+	aptArgs := []string{"-y", "-q", "-o", "DPkg::Lock::Timeout=300"}
+	if len(p.remove) > 0 {
+		log.Infof(ctx, "Removing packages: %s", strings.Join(p.remove, ", "))
+		if _, err := syshelpers.RunWithOptions(ctx, 0, m.aptGetCmd, opts, slices.Concat([]string{"remove"}, aptArgs, p.remove)...); err != nil {
+			return err
+		}
+	}
+	if sourcesChanged || len(p.install) > 0 {
+		if _, err := syshelpers.RunWithOptions(ctx, 0, m.aptGetCmd, opts, slices.Concat([]string{"update"}, aptArgs)...); err != nil {
+			// Installing from outdated indexes may still succeed.
+			log.Warning(ctx, gotext.Get("Couldn't update apt package indexes: %v", err))
+		}
+	}
+	if len(p.install) > 0 {
+		log.Infof(ctx, "Installing packages: %s", strings.Join(p.install, ", "))
+		if _, err := syshelpers.RunWithOptions(ctx, 0, m.aptGetCmd, opts, slices.Concat([]string{"install"}, aptArgs, p.install)...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DumpState returns the apt preferences and sources written during the last refresh of the machine.
+// The state is empty for users or if no apt policy is applied.
+// The signing keys of the sources are not part of the state.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump apt state of %s", objectName))
+
+	// Apt policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	// Glob only fails on invalid patterns.
+	sources, _ := filepath.Glob(filepath.Join(m.sourcesDir, filePrefix+"*.sources"))
+	return syshelpers.DumpFiles(append([]string{filepath.Join(m.preferencesDir, preferencesFile)}, sources...)...)
+}
+
+// DryRun returns a report of the changes the list of entries would apply on the machine.
+func (m *Manager) DryRun(ctx context.Context, entries []entry.Entry) (report string, err error) {
+	p, err := m.plan(ctx, entries)
+	if err != nil {
+		return "", err
+	}
+	return p.String(), nil
+}
+
+// plan returns the changes the list of entries would apply on the machine.
+func (m *Manager) plan(ctx context.Context, entries []entry.Entry) (p plan, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't compute apt policy changes"))
+
+	var install, remove, allowlist, blocklist, repositories []string
+	var pins []pin
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		var lines []string
+		for _, l := range strings.Split(v, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+
+		switch e.Key {
+		case "apt/install", "apt/remove":
+			for _, n := range lines {
+				if !packageNameRe.MatchString(n) {
+					return p, errors.New(gotext.Get("invalid package name %q", n))
+				}
+			}
+			if e.Key == "apt/install" {
+				install = append(install, lines...)
+			} else {
+				remove = append(remove, lines...)
+			}
+		case "apt/pin":
+			for _, l := range lines {
+				fields := strings.Fields(l)
+				if len(fields) != 2 || !packageNameRe.MatchString(fields[0]) {
+					return p, errors.New(gotext.Get("invalid pin %q: expected <package> <version>", l))
+				}
+				pins = append(pins, pin{name: fields[0], version: fields[1]})
+			}
+		case "apt/allowlist", "apt/blocklist":
+			for _, n := range lines {
+				if !patternRe.MatchString(n) {
+					return p, errors.New(gotext.Get("invalid package pattern %q", n))
+				}
+				if _, err := path.Match(n, ""); err != nil {
+					return p, errors.New(gotext.Get("invalid package pattern %q: %v", n, err))
+				}
+			}
+			if e.Key == "apt/allowlist" {
+				allowlist = append(allowlist, lines...)
+			} else {
+				blocklist = append(blocklist, lines...)
+			}
+		case "apt/repositories":
+			repositories = append(repositories, lines...)
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing apt entries, skipping it", e.Key))
+		}
+	}
+
+	if p.repositories, err = parseRepositories(repositories); err != nil {
+		return p, err
+	}
+
+	for _, n := range install {
+		if slices.Contains(remove, n) {
+			return p, errors.New(gotext.Get("package %q is both requested to be installed and removed", n))
+		}
+	}
+
+	// isAllowed returns true if package n can be installed or pinned, recording the reason otherwise.
+	isAllowed := func(n string) bool {
+		if matchesAny(n, blocklist) {
+			if !slices.Contains(p.skippedBlocked, n) {
+				p.skippedBlocked = append(p.skippedBlocked, n)
+			}
+			return false
+		}
+		if len(allowlist) > 0 && !matchesAny(n, allowlist) {
+			if !slices.Contains(p.skippedNotAllowed, n) {
+				p.skippedNotAllowed = append(p.skippedNotAllowed, n)
+			}
+			return false
+		}
+		return true
+	}
+
+	for _, pi := range pins {
+		if !isAllowed(pi.name) || slices.ContainsFunc(p.pins, func(o pin) bool { return o.name == pi.name }) {
+			continue
+		}
+		p.pins = append(p.pins, pi)
+	}
+	for _, n := range blocklist {
+		if !slices.Contains(p.blocked, n) {
+			p.blocked = append(p.blocked, n)
+		}
+	}
+
+	if len(install) == 0 && len(remove) == 0 {
+		return p, nil
+	}
+
+	installed, err := m.installedPackages(ctx)
+	if err != nil {
+		return p, err
+	}
+	for _, n := range install {
+		if !isAllowed(n) || slices.Contains(installed, n) || slices.Contains(p.install, n) {
+			continue
+		}
+		p.install = append(p.install, n)
+	}
+	for _, n := range remove {
+		if !slices.Contains(installed, n) || slices.Contains(p.remove, n) {
+			continue
+		}
+		p.remove = append(p.remove, n)
+	}
+
+	return p, nil
+}
+
+// String returns a human readable report of the plan.
+func (p plan) String() string {
+	var out strings.Builder
+
+	list := func(title string, names []string) {
+		if len(names) == 0 {
+			return
+		}
+		fmt.Fprintf(&out, "%s\n", title)
+		for _, n := range names {
+			fmt.Fprintf(&out, "  - %s\n", n)
+		}
+	}
+
+	var repositories []string
+	for _, r := range p.repositories {
+		repositories = append(repositories, fmt.Sprintf("%s (%s)", r.name, r.uri))
+	}
+	list(gotext.Get("Repositories:"), repositories)
+	list(gotext.Get("Packages to install:"), p.install)
+	list(gotext.Get("Packages to remove:"), p.remove)
+	var pins []string
+	for _, pi := range p.pins {
+		pins = append(pins, fmt.Sprintf("%s %s", pi.name, pi.version))
+	}
+	list(gotext.Get("Pinned packages:"), pins)
+	list(gotext.Get("Blocked packages:"), p.blocked)
+	list(gotext.Get("Skipped packages, not part of the allowlist:"), p.skippedNotAllowed)
+	list(gotext.Get("Skipped packages, part of the blocklist:"), p.skippedBlocked)
+
+	if out.Len() == 0 {
+		return gotext.Get("No package changes.") + "\n"
+	}
+	return out.String()
+}
+
+// writePreferences writes the pins and blocked packages of the plan to the apt preferences file.
+// The file is removed if there is none.
+func (m *Manager) writePreferences(p plan) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write apt preferences"))
+
+	prefPath := filepath.Join(m.preferencesDir, preferencesFile)
+	if len(p.pins) == 0 && len(p.blocked) == 0 {
+		if err := os.Remove(prefPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	var out strings.Builder
+	out.WriteString(header)
+	for _, pi := range p.pins {
+		fmt.Fprintf(&out, "\nPackage: %s\nPin: version %s\nPin-Priority: %d\n", pi.name, pi.version, pinPriority)
+	}
+	for _, n := range p.blocked {
+		fmt.Fprintf(&out, "\nPackage: %s\nPin: release *\nPin-Priority: %d\n", n, blockedPriority)
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(m.preferencesDir, 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 apt preferences are world readable
+	if err := os.WriteFile(prefPath+".new", []byte(out.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(prefPath+".new", prefPath)
+}
+
+// installedPackages returns the list of installed packages.
+func (m *Manager) installedPackages(ctx context.Context) (installed []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't list installed packages"))
+
+	out, err := syshelpers.Run(ctx, 0, m.dpkgQueryCmd, "-W", "-f", `${Package}\t${db:Status-Status}\n`)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range strings.Split(out, "\n") {
+		name, status, found := strings.Cut(l, "\t")
+		if !found || status != "installed" {
+			continue
+		}
+		installed = append(installed, name)
+	}
+	return installed, nil
+}
+
+// matchesAny returns true if name matches any of the glob patterns.
+func matchesAny(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
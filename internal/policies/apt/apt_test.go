@@ -0,0 +1,213 @@
+package apt_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/apt"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+var allEntries = []entry.Entry{
+	{Key: "apt/install", Value: "htop\nvim\nfirefox-esr"},
+	{Key: "apt/remove", Value: "telnet\nnot-installed"},
+	{Key: "apt/pin", Value: "firefox-esr 115.*"},
+	{Key: "apt/allowlist", Value: "htop\nvim\nfirefox*"},
+	{Key: "apt/blocklist", Value: "games-*\nsteam*"},
+	{Key: "apt/repositories", Value: "name=internal, uri=https://mirror.example.com/ubuntu, suites=noble, components=main restricted, key=keys/internal.gpg"},
+}
+
+const internalRepository = "name=internal, uri=https://mirror.example.com/ubuntu, suites=noble, components=main restricted, key=keys/internal.gpg"
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		mockBehaviour string
+		assetsErr     bool
+
+		wantErr bool
+	}{
+		"Install packages":                            {entries: []entry.Entry{{Key: "apt/install", Value: "htop\n\n ncdu \nhtop"}}},
+		"Installed packages are not reinstalled":      {entries: []entry.Entry{{Key: "apt/install", Value: "vim\ntelnet\nhtop"}}},
+		"Remove packages":                             {entries: []entry.Entry{{Key: "apt/remove", Value: "telnet\nvim"}}},
+		"Packages not installed are not removed":      {entries: []entry.Entry{{Key: "apt/remove", Value: "not-installed\nconfig-files-only"}}},
+		"Pin packages":                                {entries: []entry.Entry{{Key: "apt/pin", Value: "firefox-esr 115.*\nlibreoffice 1:7.6.4-0ubuntu0.23.10.1"}}},
+		"Block packages":                              {entries: []entry.Entry{{Key: "apt/blocklist", Value: "games-*\nsteam"}}},
+		"Blocked packages are not installed":          {entries: []entry.Entry{{Key: "apt/install", Value: "htop\nsteam-installer"}, {Key: "apt/blocklist", Value: "steam*"}}},
+		"Only allowed packages are installed":         {entries: []entry.Entry{{Key: "apt/install", Value: "htop\nncdu"}, {Key: "apt/pin", Value: "ncdu 1.0"}, {Key: "apt/allowlist", Value: "h*"}}},
+		"Blocklist takes precedence over allowlist":   {entries: []entry.Entry{{Key: "apt/install", Value: "htop"}, {Key: "apt/allowlist", Value: "htop"}, {Key: "apt/blocklist", Value: "htop"}}},
+		"All entries":                                 {entries: allEntries},
+		"Failing to update indexes is not an error":   {entries: []entry.Entry{{Key: "apt/install", Value: "htop"}}, mockBehaviour: "fail-update"},
+		"Preferences are updated":                     {entries: []entry.Entry{{Key: "apt/pin", Value: "firefox-esr 116.*"}}, existingDirs: "preferences"},
+		"No pin nor blocklist removes preferences":    {entries: []entry.Entry{{Key: "apt/install", Value: "vim"}}, existingDirs: "preferences"},
+		"Disabled entries are ignored":                {entries: []entry.Entry{{Key: "apt/install", Value: "htop", Disabled: true}, {Key: "apt/remove", Value: "telnet"}}},
+		"Unsupported keys are ignored":                {entries: []entry.Entry{{Key: "apt/install", Value: "htop"}, {Key: "apt/upgrade", Value: "true"}}},
+		"No entries is a no-op":                       {},
+		"No entries removes preferences":              {existingDirs: "preferences"},
+		"Not a computer is a no-op":                   {entries: allEntries, isNotComputer: true},
+		"Listing packages is skipped if not required": {entries: []entry.Entry{{Key: "apt/pin", Value: "vim 2:9.*"}}, mockBehaviour: "fail"},
+
+		// Repositories
+		"Add repository":                  {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=partner, uri=http://archive.canonical.com/ubuntu, suites=noble noble-updates, components=partner, architectures=amd64 arm64"}}},
+		"Add repository with a key":       {entries: []entry.Entry{{Key: "apt/repositories", Value: internalRepository}}},
+		"Add repository with armored key": {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=tools.ppa, uri=https://ppa.launchpadcontent.net/team/tools/ubuntu, suites=noble, components=main, key=ppa.asc"}}},
+		"Add flat repository":             {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=flat, uri=file:///srv/debs, suites=./"}}},
+		"Add repositories and install packages": {entries: []entry.Entry{
+			{Key: "apt/repositories", Value: internalRepository + "\nname=partner, uri=http://archive.canonical.com/ubuntu, suites=noble, components=partner"},
+			{Key: "apt/install", Value: "htop"}}},
+		"Closest repository with the same name wins":                          {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=internal, uri=https://far.example.com/ubuntu, suites=jammy, components=main\n" + internalRepository}}},
+		"Unchanged repositories don't update indexes":                         {entries: []entry.Entry{{Key: "apt/repositories", Value: internalRepository + "\nname=old, uri=https://old.example.com/ubuntu, suites=noble, components=main, key=keys/old.gpg"}}, existingDirs: "repositories"},
+		"Repositories not configured anymore are removed":                     {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=partner, uri=http://archive.canonical.com/ubuntu, suites=noble, components=partner"}}, existingDirs: "repositories"},
+		"No entries removes repositories":                                     {existingDirs: "repositories"},
+		"Failing to update indexes after adding a repository is not an error": {entries: []entry.Entry{{Key: "apt/repositories", Value: internalRepository}}, mockBehaviour: "fail-update"},
+
+		// Error cases
+		"Error on invalid package name":              {entries: []entry.Entry{{Key: "apt/install", Value: "htop\nRm -rf"}}, wantErr: true},
+		"Error on invalid package to remove":         {entries: []entry.Entry{{Key: "apt/remove", Value: "-telnet"}}, wantErr: true},
+		"Error on invalid pin":                       {entries: []entry.Entry{{Key: "apt/pin", Value: "firefox-esr"}}, wantErr: true},
+		"Error on invalid pattern":                   {entries: []entry.Entry{{Key: "apt/blocklist", Value: "games-["}}, wantErr: true},
+		"Error on invalid pattern characters":        {entries: []entry.Entry{{Key: "apt/allowlist", Value: "games/*"}}, wantErr: true},
+		"Error on package installed and removed":     {entries: []entry.Entry{{Key: "apt/install", Value: "htop"}, {Key: "apt/remove", Value: "htop"}}, wantErr: true},
+		"Error on listing installed packages":        {entries: allEntries, mockBehaviour: "fail", wantErr: true},
+		"Error on installing packages":               {entries: []entry.Entry{{Key: "apt/install", Value: "htop"}}, mockBehaviour: "fail-install", wantErr: true},
+		"Error on removing packages":                 {entries: []entry.Entry{{Key: "apt/remove", Value: "telnet"}}, mockBehaviour: "fail-remove", wantErr: true},
+		"Error on unwritable preferences directory":  {entries: []entry.Entry{{Key: "apt/pin", Value: "vim 2:9.*"}}, existingDirs: "preferences-is-a-file", wantErr: true},
+		"Error on repository missing fields":         {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=internal, uri=https://mirror.example.com/ubuntu"}}, wantErr: true},
+		"Error on repository with unsupported field": {entries: []entry.Entry{{Key: "apt/repositories", Value: internalRepository + ", trusted=yes"}}, wantErr: true},
+		"Error on repository with duplicated field":  {entries: []entry.Entry{{Key: "apt/repositories", Value: internalRepository + ", name=other"}}, wantErr: true},
+		"Error on invalid repository name":           {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=../internal, uri=https://mirror.example.com/ubuntu, suites=noble, components=main"}}, wantErr: true},
+		"Error on invalid repository URI":            {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=internal, uri=mirror.example.com/ubuntu, suites=noble, components=main"}}, wantErr: true},
+		"Error on repository without components":     {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=internal, uri=https://mirror.example.com/ubuntu, suites=noble"}}, wantErr: true},
+		"Error on repository key outside of assets":  {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=internal, uri=https://mirror.example.com/ubuntu, suites=noble, components=main, key=../scripts/internal.gpg"}}, wantErr: true},
+		"Error on repository key with invalid type":  {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=internal, uri=https://mirror.example.com/ubuntu, suites=noble, components=main, key=keys/internal.txt"}}, wantErr: true},
+		"Error on missing repository key":            {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=internal, uri=https://mirror.example.com/ubuntu, suites=noble, components=main, key=keys/missing.gpg"}}, wantErr: true},
+		"Error on dumping assets":                    {entries: []entry.Entry{{Key: "apt/repositories", Value: internalRepository}}, assetsErr: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+
+			m := apt.New(
+				apt.WithPreferencesDir(filepath.Join(root, "etc", "apt", "preferences.d")),
+				apt.WithSourcesDir(filepath.Join(root, "etc", "apt", "sources.list.d")),
+				apt.WithKeyringsDir(filepath.Join(root, "etc", "apt", "keyrings")),
+				apt.WithStateDir(filepath.Join(root, "var", "lib", "adsys")),
+				apt.WithAptGetCmd(testutils.MockCommand(root, "apt-get", tc.mockBehaviour)),
+				apt.WithDpkgQueryCmd(testutils.MockCommand(root, "dpkg-query", tc.mockBehaviour)),
+			)
+			assetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.assetsErr, Path: "apt/"}
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries, assetsDumper.SaveAssetsTo)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"All entries":                   {entries: allEntries},
+		"Nothing to change":             {entries: []entry.Entry{{Key: "apt/install", Value: "vim"}, {Key: "apt/remove", Value: "not-installed"}}},
+		"No entries":                    {},
+		"Skipped packages are reported": {entries: []entry.Entry{{Key: "apt/install", Value: "htop\nncdu\nsteam"}, {Key: "apt/allowlist", Value: "h*\nsteam"}, {Key: "apt/blocklist", Value: "steam"}}},
+
+		"Error on invalid repository":         {entries: []entry.Entry{{Key: "apt/repositories", Value: "name=internal"}}, wantErr: true},
+		"Error on invalid entries":            {entries: []entry.Entry{{Key: "apt/install", Value: "htop "}, {Key: "apt/pin", Value: "htop"}}, wantErr: true},
+		"Error on listing installed packages": {entries: allEntries, mockBehaviour: "fail", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			m := apt.New(
+				apt.WithPreferencesDir(filepath.Join(root, "etc", "apt", "preferences.d")),
+				apt.WithSourcesDir(filepath.Join(root, "etc", "apt", "sources.list.d")),
+				apt.WithKeyringsDir(filepath.Join(root, "etc", "apt", "keyrings")),
+				apt.WithStateDir(filepath.Join(root, "var", "lib", "adsys")),
+				apt.WithAptGetCmd(testutils.MockCommand(root, "apt-get", tc.mockBehaviour)),
+				apt.WithDpkgQueryCmd(testutils.MockCommand(root, "dpkg-query", tc.mockBehaviour)),
+			)
+			got, err := m.DryRun(context.Background(), tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "DryRun should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "DryRun failed but shouldn't have")
+
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "DryRun returned an unexpected report")
+
+			_, err = os.Stat(filepath.Join(root, "etc"))
+			require.ErrorIs(t, err, os.ErrNotExist, "DryRun should not write any file")
+			// Only installed packages can be listed.
+			d, err := os.ReadFile(filepath.Join(root, "commands.log"))
+			if err == nil {
+				require.NotContains(t, string(d), "apt-get", "DryRun should not call apt-get")
+			}
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, root, behaviour, args := c.Name, c.Root, c.Behaviour, c.Args
+
+	// Log the call, replacing the temporary paths to get a stable output.
+	line := name
+	if name == "apt-get" {
+		line = "DEBIAN_FRONTEND=" + os.Getenv("DEBIAN_FRONTEND") + " " + line
+	}
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+	line = strings.ReplaceAll(line, root, "#ROOT#")
+
+	c.Log(line)
+
+	if behaviour == "fail" || behaviour == "fail-"+args[0] {
+		fmt.Fprintln(os.Stderr, "E: requested failure")
+		os.Exit(100)
+	}
+
+	if name == "dpkg-query" {
+		fmt.Print("vim\tinstalled\ntelnet\tinstalled\nconfig-files-only\tconfig-files\nlibc6\tinstalled\n")
+	}
+}
@@ -0,0 +1,263 @@
+package apt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	// assetsDir is the directory of the assets share the signing keys are copied from.
+	assetsDir = "apt"
+	// filePrefix is the prefix of the sources and keyring files created by adsys.
+	filePrefix = "adsys-"
+)
+
+// repositoryNameRe matches the names of the repositories, used to name their files.
+var repositoryNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// keyExtensions are the extensions of the signing keys supported by apt: binary and ASCII-armored keyrings.
+var keyExtensions = []string{".gpg", ".asc"}
+
+// repository is an apt repository to add to the sources.
+type repository struct {
+	name          string
+	uri           string
+	suites        []string
+	components    []string
+	architectures []string
+	// key is the path of the signing key, relative to the apt directory of the assets share.
+	key string
+}
+
+// keyring returns the name of the keyring file of the repository, or an empty string if it has no signing key.
+func (r repository) keyring() string {
+	if r.key == "" {
+		return ""
+	}
+	return filePrefix + r.name + path.Ext(r.key)
+}
+
+// deb822 returns the content of the sources file of the repository.
+func (r repository) deb822() string {
+	var out strings.Builder
+	out.WriteString(header)
+	fmt.Fprintf(&out, "\nTypes: deb\nURIs: %s\nSuites: %s\n", r.uri, strings.Join(r.suites, " "))
+	if len(r.components) > 0 {
+		fmt.Fprintf(&out, "Components: %s\n", strings.Join(r.components, " "))
+	}
+	if len(r.architectures) > 0 {
+		fmt.Fprintf(&out, "Architectures: %s\n", strings.Join(r.architectures, " "))
+	}
+	if k := r.keyring(); k != "" {
+		// The keyring is referenced with its path on the machine, even when the files are staged.
+		fmt.Fprintf(&out, "Signed-By: %s\n", filepath.Join(consts.DefaultAptKeyringsDir, k))
+	}
+	return out.String()
+}
+
+// parseRepositories parses the repositories of lines, of the form
+// name=<name>, uri=<uri>, suites=<suite> <suite>[, components=<component> <component>][, architectures=<arch> <arch>][, key=<path>].
+// Repositories are listed from the furthest to the closest GPO: the closest one wins.
+func parseRepositories(lines []string) (repositories []repository, err error) {
+	for _, l := range lines {
+		r, err := parseRepository(l)
+		if err != nil {
+			return nil, err
+		}
+		if i := slices.IndexFunc(repositories, func(o repository) bool { return o.name == r.name }); i != -1 {
+			repositories[i] = r
+			continue
+		}
+		repositories = append(repositories, r)
+	}
+	return repositories, nil
+}
+
+// parseRepository parses the repository line l.
+func parseRepository(l string) (r repository, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid repository %q", l))
+
+	usage := gotext.Get("expected name=<name>, uri=<uri>, suites=<suite> <suite>[, components=<component> <component>][, architectures=<arch> <arch>][, key=<path>]")
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(l, ",") {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return r, errors.New(usage)
+		}
+		if seen[k] {
+			return r, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		seen[k] = true
+
+		switch k {
+		case "name":
+			r.name = v
+		case "uri":
+			r.uri = v
+		case "suites":
+			r.suites = strings.Fields(v)
+		case "components":
+			r.components = strings.Fields(v)
+		case "architectures":
+			r.architectures = strings.Fields(v)
+		case "key":
+			r.key = v
+		default:
+			return r, errors.New(gotext.Get("unsupported field %q", k))
+		}
+	}
+
+	if r.name == "" || r.uri == "" || len(r.suites) == 0 {
+		return r, errors.New(usage)
+	}
+	if !repositoryNameRe.MatchString(r.name) {
+		return r, errors.New(gotext.Get("%q is not a valid repository name: only lowercase letters, digits and _.- are supported", r.name))
+	}
+	if u, err := url.Parse(r.uri); err != nil || u.Scheme == "" || strings.ContainsAny(r.uri, " \t") {
+		return r, errors.New(gotext.Get("%q is not a valid repository URI", r.uri))
+	}
+	// Repositories without components are flat repositories, whose suite is an exact path.
+	if len(r.components) == 0 && (len(r.suites) != 1 || !strings.HasSuffix(r.suites[0], "/")) {
+		return r, errors.New(gotext.Get("components are required, unless the suite is an exact path ending with /"))
+	}
+	if r.key != "" {
+		k := path.Clean(r.key)
+		if path.IsAbs(k) || k == ".." || strings.HasPrefix(k, "../") {
+			return r, errors.New(gotext.Get("key %q must be relative to the %s directory of the assets share", r.key, assetsDir))
+		}
+		if !slices.Contains(keyExtensions, path.Ext(k)) {
+			return r, errors.New(gotext.Get("key %q must be a .gpg or .asc keyring", r.key))
+		}
+		r.key = k
+	}
+
+	return r, nil
+}
+
+// applyRepositories writes the sources files of the repositories and their signing keys, and removes the
+// ones created by adsys which are not configured anymore.
+// It returns true if any sources or key file changed, so that the package indexes can be updated.
+func (m *Manager) applyRepositories(ctx context.Context, repositories []repository, assetsDumper AssetsDumper) (changed bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply apt repositories"))
+
+	keyrings := make(map[string][]byte)
+	if slices.ContainsFunc(repositories, func(r repository) bool { return r.key != "" }) {
+		if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+			return false, err
+		}
+		tmp, err := os.MkdirTemp(m.stateDir, "assets-")
+		if err != nil {
+			return false, err
+		}
+		defer func() {
+			if errRemove := os.RemoveAll(tmp); errRemove != nil {
+				err = errors.Join(err, errRemove)
+			}
+		}()
+		assets := filepath.Join(tmp, assetsDir)
+		if err := assetsDumper(ctx, assetsDir+"/", assets, -1, -1); err != nil {
+			return false, err
+		}
+
+		for _, r := range repositories {
+			if r.key == "" {
+				continue
+			}
+			d, err := os.ReadFile(filepath.Join(assets, filepath.FromSlash(r.key)))
+			if err != nil {
+				return false, errors.New(gotext.Get("can't read signing key of repository %s: %v", r.name, err))
+			}
+			keyrings[r.keyring()] = d
+		}
+	}
+
+	sources := make(map[string][]byte)
+	for _, r := range repositories {
+		sources[filePrefix+r.name+".sources"] = []byte(r.deb822())
+	}
+
+	// Keys are written before the sources referencing them, and removed after.
+	keyringFiles := maps.Keys(keyrings)
+	slices.Sort(keyringFiles)
+	for _, f := range keyringFiles {
+		written, err := writeIfChanged(filepath.Join(m.keyringsDir, f), keyrings[f])
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || written
+	}
+	sourceFiles := maps.Keys(sources)
+	slices.Sort(sourceFiles)
+	for _, f := range sourceFiles {
+		written, err := writeIfChanged(filepath.Join(m.sourcesDir, f), sources[f])
+		if err != nil {
+			return changed, err
+		}
+		if written {
+			log.Infof(ctx, "Configuring apt repository %s", strings.TrimSuffix(strings.TrimPrefix(f, filePrefix), ".sources"))
+		}
+		changed = changed || written
+	}
+
+	for _, dir := range []struct {
+		path    string
+		pattern string
+		want    map[string][]byte
+	}{
+		{path: m.sourcesDir, pattern: filePrefix + "*.sources", want: sources},
+		{path: m.keyringsDir, pattern: filePrefix + "*", want: keyrings},
+	} {
+		// Glob only fails on invalid patterns.
+		existing, _ := filepath.Glob(filepath.Join(dir.path, dir.pattern))
+		for _, p := range existing {
+			if _, ok := dir.want[filepath.Base(p)]; ok {
+				continue
+			}
+			log.Infof(ctx, "Removing %s", p)
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// writeIfChanged atomically writes data to the world readable file p, unless it already has this content.
+// It returns true if the file was written.
+func writeIfChanged(p string, data []byte) (bool, error) {
+	if cur, err := os.ReadFile(p); err == nil && bytes.Equal(cur, data) {
+		return false, nil
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	// nolint:gosec // G306 apt sources and keyrings are world readable
+	if err := os.WriteFile(p+".new", data, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
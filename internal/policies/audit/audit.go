@@ -0,0 +1,226 @@
+// Package audit provides a manager that deploys Linux audit rules on the machine.
+//
+// This manager only applies to computer objects.
+//
+// The following setting is supported:
+//   - audit/rules: audit rules, one per line, in the auditctl(8) syntax used by the audit.rules(7)
+//     files, for instance -w /etc/sudoers -p wa -k identity. Empty lines and lines starting with #
+//     are ignored.
+//
+// Only the options adding rules, watches and exclusions, or changing the configuration of the audit
+// system are supported: -a, -A, -w, -W, -e, -f, -b, -r, --backlog_wait_time and --loginuid-immutable.
+// Deleting all rules with -D is done by augenrules itself.
+//
+// The rules are written to an adsys.rules file in the rules.d directory of auditd, which is
+// loaded with augenrules --load whenever it changes. The file is removed, and the rules loaded again,
+// once the policy is not configured anymore. Nothing is done if auditd is not installed.
+package audit
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const rulesFile = "adsys.rules"
+
+// supportedOptions are the auditctl options a rule can start with.
+var supportedOptions = []string{"-a", "-A", "-w", "-W", "-e", "-f", "-b", "-r", "--backlog_wait_time", "--loginuid-immutable"}
+
+const header = `## This file is managed by adsys.
+## Do not edit this file manually.
+## Any changes will be overwritten.
+`
+
+// Manager applies the audit policy on the machine.
+type Manager struct {
+	rulesDir      string
+	augenrulesCmd []string
+	cmdTimeout    time.Duration
+}
+
+type options struct {
+	rulesDir      string
+	augenrulesCmd []string
+	cmdTimeout    time.Duration
+}
+
+// Option reprents an optional function to change the audit manager.
+type Option func(*options)
+
+// WithRulesDir overrides the default audit rules directory.
+func WithRulesDir(p string) func(*options) {
+	return func(a *options) {
+		a.rulesDir = p
+	}
+}
+
+// WithAugenrulesCmd overrides the default augenrules command.
+func WithAugenrulesCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.augenrulesCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the audit policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		rulesDir:      consts.DefaultAuditRulesDir,
+		augenrulesCmd: []string{"augenrules"},
+		cmdTimeout:    consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		rulesDir:      args.rulesDir,
+		augenrulesCmd: args.augenrulesCmd,
+		cmdTimeout:    args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy deploys the audit rules from the list of entries and loads them.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply audit policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Audit policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying audit policy to %s", objectName)
+
+	rules, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	// The configuration directory of auditd is shipped by its package.
+	if _, err := os.Stat(filepath.Dir(m.rulesDir)); errors.Is(err, fs.ErrNotExist) {
+		if len(rules) > 0 {
+			log.Warning(ctx, gotext.Get("auditd is not installed, skipping audit rules"))
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	changed, err := m.writeRules(rules)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Debug(ctx, "Audit rules are up to date")
+		return nil
+	}
+
+	log.Infof(ctx, "Loading %d audit rules", len(rules))
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.augenrulesCmd, "--load"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DumpState returns the audit rules written during the last refresh of the machine.
+// The state is empty for users or if no audit policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump audit state of %s", objectName))
+
+	// Audit policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.rulesDir, rulesFile))
+}
+
+// parseEntries validates the entries and returns the rules to deploy, in order and without duplicates.
+func parseEntries(ctx context.Context, entries []entry.Entry) (rules []string, err error) {
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		if e.Key != "audit/rules" {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing audit entries, skipping it", e.Key))
+			continue
+		}
+
+		for _, l := range strings.Split(e.Value, "\n") {
+			l = strings.Join(strings.Fields(l), " ")
+			if l == "" || strings.HasPrefix(l, "#") {
+				continue
+			}
+			option, _, _ := strings.Cut(l, " ")
+			// Long options can be set with an equal sign.
+			option, _, _ = strings.Cut(option, "=")
+			if !slices.Contains(supportedOptions, option) {
+				return nil, errors.New(gotext.Get("invalid audit rule %q: unsupported option %q", l, option))
+			}
+			if option != "--loginuid-immutable" && !strings.ContainsAny(l, " =") {
+				return nil, errors.New(gotext.Get("invalid audit rule %q: missing argument", l))
+			}
+			if slices.Contains(rules, l) {
+				continue
+			}
+			rules = append(rules, l)
+		}
+	}
+
+	return rules, nil
+}
+
+// writeRules writes the rules to the adsys rules file, removing it if there is none.
+// It returns true if the file changed.
+func (m *Manager) writeRules(rules []string) (changed bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write audit rules"))
+
+	p := filepath.Join(m.rulesDir, rulesFile)
+	if len(rules) == 0 {
+		if err := os.Remove(p); errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	content := header + strings.Join(rules, "\n") + "\n"
+	if old, err := os.ReadFile(p); err == nil && string(old) == content {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(m.rulesDir, 0750); err != nil {
+		return false, err
+	}
+	// Audit rules are only readable by root, like the ones shipped by auditd.
+	if err := os.WriteFile(p+".new", []byte(content), 0640); err != nil {
+		return false, err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
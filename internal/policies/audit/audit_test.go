@@ -0,0 +1,102 @@
+package audit_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/audit"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	rules := "-w /etc/sudoers -p wa -k identity\n-a always,exit -F arch=b64 -S execve -k exec"
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existing      string
+		noAuditd      bool
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Deploy rules":                         {entries: []entry.Entry{{Key: "audit/rules", Value: rules}}},
+		"Comments and empty lines are ignored": {entries: []entry.Entry{{Key: "audit/rules", Value: "# Identity\n\n  -w   /etc/sudoers -p wa -k identity  \n"}}},
+		"Configuration options are supported":  {entries: []entry.Entry{{Key: "audit/rules", Value: "-b 8192\n-f 1\n--backlog_wait_time=60000\n--loginuid-immutable\n" + rules + "\n-e 2"}}},
+		"Duplicated rules are deployed once":   {entries: []entry.Entry{{Key: "audit/rules", Value: rules}, {Key: "audit/rules", Value: "-w /etc/sudoers -p wa -k identity\n-w /etc/shadow -p wa -k identity"}}},
+		"Rules are updated":                    {existing: "states/applied", entries: []entry.Entry{{Key: "audit/rules", Value: rules}}},
+		"Unchanged rules are not loaded again": {existing: "states/unchanged", entries: []entry.Entry{{Key: "audit/rules", Value: rules}}, mockBehaviour: "fail"},
+		"No entries removes rules":             {existing: "states/applied"},
+		"Disabled entries remove rules":        {existing: "states/applied", entries: []entry.Entry{{Key: "audit/rules", Value: rules, Disabled: true}}},
+		"Disabled entries are ignored":         {entries: []entry.Entry{{Key: "audit/rules", Value: rules, Disabled: true}}, mockBehaviour: "fail"},
+		"Unsupported keys are ignored":         {entries: []entry.Entry{{Key: "audit/rules", Value: rules}, {Key: "audit/unsupported", Value: "-w /etc/shadow -p wa"}}},
+		"No entries is a no-op":                {mockBehaviour: "fail"},
+		"Auditd not installed is a no-op":      {entries: []entry.Entry{{Key: "audit/rules", Value: rules}}, noAuditd: true, mockBehaviour: "fail"},
+		"Not a computer is a no-op":            {entries: []entry.Entry{{Key: "audit/rules", Value: rules}}, isNotComputer: true, mockBehaviour: "fail"},
+		"Only comments removes rules":          {existing: "states/applied", entries: []entry.Entry{{Key: "audit/rules", Value: "# Nothing to audit"}}},
+
+		// Error cases
+		"Error on deleting all rules":         {entries: []entry.Entry{{Key: "audit/rules", Value: "-D\n" + rules}}, wantErr: true},
+		"Error on deleting a rule":            {entries: []entry.Entry{{Key: "audit/rules", Value: "-d always,exit -F arch=b64 -S execve"}}, wantErr: true},
+		"Error on unsupported option":         {entries: []entry.Entry{{Key: "audit/rules", Value: "-s"}}, wantErr: true},
+		"Error on rule not starting by flag":  {entries: []entry.Entry{{Key: "audit/rules", Value: "/etc/sudoers -p wa"}}, wantErr: true},
+		"Error on missing argument":           {entries: []entry.Entry{{Key: "audit/rules", Value: "-w"}}, wantErr: true},
+		"Error on unwritable rules directory": {existing: "states/rules-dir-is-a-file", entries: []entry.Entry{{Key: "audit/rules", Value: rules}}, wantErr: true},
+		"Error on loading rules":              {entries: []entry.Entry{{Key: "audit/rules", Value: rules}}, mockBehaviour: "fail", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			} else if !tc.noAuditd {
+				require.NoError(t, os.MkdirAll(filepath.Join(root, "etc", "audit"), 0750), "Setup: can't create auditd configuration directory")
+			}
+
+			m := audit.New(
+				audit.WithRulesDir(filepath.Join(root, "etc", "audit", "rules.d")),
+				audit.WithAugenrulesCmd(testutils.MockCommand(root, "augenrules", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	behaviour, args := c.Behaviour, c.Args
+
+	if behaviour == "fail" {
+		fmt.Fprintln(os.Stderr, "augenrules: requested failure")
+		os.Exit(1)
+	}
+
+	c.Log(fmt.Sprintf("augenrules %s", strings.Join(args, " ")))
+}
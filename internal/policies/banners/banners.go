@@ -0,0 +1,298 @@
+// Package banners provides a manager that sets the messages displayed to the users logging in to the machine.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported, each one replacing the content of a system file:
+//   - banners/issue: the message displayed before the login prompt of the consoles, in /etc/issue;
+//   - banners/issue-net: the message displayed before the login prompt of network services, in /etc/issue.net;
+//   - banners/motd: the message of the day, displayed after logging in, in /etc/motd.
+//
+// The messages are written as is: backslashes are escaped in /etc/issue, so that they are not interpreted as
+// escape sequences by getty.
+//
+// The content of each file before adsys first replaced it is saved in a state file. Once a message is not
+// configured anymore, the original file is restored, or removed if it didn't exist.
+package banners
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const stateFile = "state.json"
+
+// banner is a message set by the policy in a system file.
+type banner struct {
+	key  string
+	path string
+}
+
+// banners are the supported messages, in the order they are applied.
+var banners = []banner{
+	{key: "banners/issue", path: "/etc/issue"},
+	{key: "banners/issue-net", path: "/etc/issue.net"},
+	{key: "banners/motd", path: "/etc/motd"},
+}
+
+// state is the list of files replaced by adsys, with their content before adsys first replaced them.
+// The content is nil if the file didn't exist.
+type state struct {
+	Originals map[string]*string `json:"originals"`
+}
+
+// Manager applies the banners policy on the machine.
+type Manager struct {
+	stateDir string
+	rootDir  string
+}
+
+type options struct {
+	stateDir string
+	rootDir  string
+}
+
+// Option reprents an optional function to change the banners manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithRootDir writes the banners relative to p instead of the root of the filesystem.
+func WithRootDir(p string) func(*options) {
+	return func(a *options) {
+		a.rootDir = p
+	}
+}
+
+// New returns a new manager for the banners policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir: consts.DefaultStateDir,
+		rootDir:  "/",
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir: filepath.Join(args.stateDir, "banners"),
+		rootDir:  args.rootDir,
+	}
+}
+
+// ApplyPolicy writes the banners from the list of entries, and restores the files not configured anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply banners policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Banners policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying banners policy to %s", objectName)
+
+	messages := parseEntries(ctx, entries)
+
+	s, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to restore.
+	if len(messages) == 0 && len(s.Originals) == 0 {
+		return nil
+	}
+
+	for _, b := range banners {
+		msg, configured := messages[b.path]
+		original, replaced := s.Originals[b.path]
+
+		if !configured {
+			if !replaced {
+				continue
+			}
+			log.Infof(ctx, "Restoring %s, not configured anymore", b.path)
+			if err := m.write(b.path, original); err != nil {
+				return errors.Join(err, m.saveState(s))
+			}
+			delete(s.Originals, b.path)
+			continue
+		}
+
+		if !replaced {
+			original, err := m.read(b.path)
+			if err != nil {
+				return errors.Join(err, m.saveState(s))
+			}
+			s.Originals[b.path] = original
+			// Save the original content before replacing it, so that it can always be restored.
+			if err := m.saveState(s); err != nil {
+				return err
+			}
+		}
+		if err := m.write(b.path, &msg); err != nil {
+			return errors.Join(err, m.saveState(s))
+		}
+	}
+
+	return m.saveState(s)
+}
+
+// DumpState returns the banners written during the last refresh of the machine.
+// The state is empty for users or if no banners policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump banners state of %s", objectName))
+
+	// Banners policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	s, err := m.loadState()
+	if err != nil {
+		return "", err
+	}
+	var paths []string
+	for _, b := range banners {
+		// Only the files replaced by adsys are part of the state.
+		if _, replaced := s.Originals[b.path]; replaced {
+			paths = append(paths, m.path(b.path))
+		}
+	}
+	return syshelpers.DumpFiles(paths...)
+}
+
+// parseEntries returns the content of the files to write, by path.
+func parseEntries(ctx context.Context, entries []entry.Entry) map[string]string {
+	messages := make(map[string]string)
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		i := slices.IndexFunc(banners, func(b banner) bool { return b.key == e.Key })
+		if i < 0 {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing banners entries, skipping it", e.Key))
+			continue
+		}
+
+		msg := strings.TrimRight(e.Value, " \t\n")
+		if strings.TrimSpace(msg) == "" {
+			continue
+		}
+		if banners[i].path == "/etc/issue" {
+			// getty interprets backslashes as escape sequences, like \n for the hostname.
+			msg = strings.ReplaceAll(msg, `\`, `\\`)
+		}
+		messages[banners[i].path] = msg + "\n"
+	}
+	return messages
+}
+
+// path returns the path of p on the managed filesystem.
+func (m *Manager) path(p string) string {
+	return filepath.Join(m.rootDir, p)
+}
+
+// read returns the content of the file p, or nil if it doesn't exist.
+func (m *Manager) read(p string) (*string, error) {
+	d, err := os.ReadFile(m.path(p))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	content := string(d)
+	return &content, nil
+}
+
+// write writes content to the file p, removing it if content is nil.
+func (m *Manager) write(p string, content *string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write %s", p))
+
+	p = m.path(p)
+	if content == nil {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if old, err := os.ReadFile(p); err == nil && string(old) == *content {
+		return nil
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 banners are world readable
+	if err := os.WriteFile(p+".new", []byte(*content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// loadState returns the files previously replaced by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load banners state"))
+
+	s.Originals = make(map[string]*string)
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	if s.Originals == nil {
+		s.Originals = make(map[string]*string)
+	}
+	return s, nil
+}
+
+// saveState saves the files replaced by adsys.
+// The state file is removed if no file is replaced anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save banners state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Originals) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,78 @@
+package banners_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/banners"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "banners/issue", Value: "Authorized users only.\nAll activity is logged."},
+		{Key: "banners/issue-net", Value: "Authorized users only."},
+		{Key: "banners/motd", Value: "Welcome to example.com.\nSupport: https://support.example.com"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existing      string
+
+		wantErr bool
+	}{
+		"Set all banners":                       {existing: "system", entries: allEntries},
+		"Set banners without existing files":    {entries: allEntries},
+		"Set only the message of the day":       {existing: "system", entries: []entry.Entry{{Key: "banners/motd", Value: "Welcome to example.com."}}},
+		"Backslashes are escaped in issue only": {existing: "system", entries: []entry.Entry{{Key: "banners/issue", Value: `Use DOMAIN\user to log in.`}, {Key: "banners/issue-net", Value: `Use DOMAIN\user to log in.`}}},
+		"Trailing whitespaces are trimmed":      {existing: "system", entries: []entry.Entry{{Key: "banners/issue-net", Value: "  Authorized users only.  \n\n"}}},
+		"Original files are kept when updating": {existing: "states/applied", entries: []entry.Entry{{Key: "banners/issue", Value: "Authorized personnel only."}, {Key: "banners/issue-net", Value: "Authorized users only."}, {Key: "banners/motd", Value: "Welcome."}}},
+		"Banners not configured are restored":   {existing: "states/applied", entries: []entry.Entry{{Key: "banners/issue", Value: "Authorized users only."}}},
+		"No entries restores all files":         {existing: "states/applied"},
+		"Disabled entries restore all files":    {existing: "states/applied", entries: []entry.Entry{{Key: "banners/issue", Value: "Authorized users only.", Disabled: true}}},
+		"Empty entries restore files":           {existing: "states/applied", entries: []entry.Entry{{Key: "banners/issue", Value: "Authorized users only."}, {Key: "banners/motd", Value: " \n"}}},
+		"Disabled entries are ignored":          {existing: "system", entries: []entry.Entry{{Key: "banners/issue", Value: "Authorized users only.", Disabled: true}}},
+		"Unsupported keys are ignored":          {existing: "system", entries: []entry.Entry{{Key: "banners/issue", Value: "Authorized users only."}, {Key: "banners/legal-notice", Value: "Hello"}}},
+		"No entries and no state is a no-op":    {existing: "system"},
+		"Not a computer is a no-op":             {existing: "states/applied", isNotComputer: true},
+
+		// Error cases
+		"Error on corrupted state":  {existing: "states/corrupted", entries: allEntries, wantErr: true},
+		"Error on unwritable files": {existing: "states/etc-is-a-file", entries: allEntries, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+
+			m := banners.New(
+				banners.WithStateDir(filepath.Join(root, "state")),
+				banners.WithRootDir(root),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
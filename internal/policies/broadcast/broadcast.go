@@ -0,0 +1,327 @@
+// Package broadcast provides a manager that broadcasts a one-time message to the users of the machine, for
+// instance for emergency IT communications.
+//
+// The message is configured on computer objects, with the following settings:
+//   - broadcast/id: the identifier of the message. Changing it broadcasts the message again;
+//   - broadcast/message: the message to broadcast.
+//
+// A new message is sent with wall to the terminals of all logged-in users, and as a critical desktop notification
+// to each user with a session bus. Users without a session bus when the message is first broadcast, like users
+// logging in later, receive the desktop notification once their session bus is available, on the next refresh of
+// their policy or of the machine one.
+//
+// The users who received the current message are tracked in a state file, so that it is shown exactly once per user.
+package broadcast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/maps"
+)
+
+const stateFile = "state.json"
+
+// state is the message currently broadcast, with the users who received it.
+type state struct {
+	ID      string   `json:"id"`
+	Message string   `json:"message"`
+	ShownTo []string `json:"shownTo,omitempty"`
+}
+
+// Manager applies the broadcast message policy.
+type Manager struct {
+	stateDir       string
+	userRuntimeDir string
+	wallCmd        []string
+	loginctlCmd    []string
+	runuserCmd     []string
+	cmdTimeout     time.Duration
+	userLookup     func(string) (*user.User, error)
+
+	mu sync.Mutex // Prevents concurrent changes to the state
+}
+
+type options struct {
+	stateDir       string
+	userRuntimeDir string
+	wallCmd        []string
+	loginctlCmd    []string
+	runuserCmd     []string
+	cmdTimeout     time.Duration
+	userLookup     func(string) (*user.User, error)
+}
+
+// Option reprents an optional function to change the broadcast manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithUserRuntimeDir overrides the default directory of the runtime directories of the users.
+func WithUserRuntimeDir(p string) func(*options) {
+	return func(a *options) {
+		a.userRuntimeDir = p
+	}
+}
+
+// WithWallCmd overrides the default wall command.
+func WithWallCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.wallCmd = cmd
+	}
+}
+
+// WithLoginctlCmd overrides the default loginctl command.
+func WithLoginctlCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.loginctlCmd = cmd
+	}
+}
+
+// WithRunuserCmd overrides the default runuser command, used to send the desktop notifications.
+func WithRunuserCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.runuserCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time a command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the broadcast message policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:       consts.DefaultStateDir,
+		userRuntimeDir: "/run/user",
+		wallCmd:        []string{"wall"},
+		loginctlCmd:    []string{"loginctl"},
+		runuserCmd:     []string{"runuser"},
+		cmdTimeout:     consts.DefaultHelperExecTimeout,
+		userLookup:     user.Lookup,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:       filepath.Join(args.stateDir, "broadcast"),
+		userRuntimeDir: args.userRuntimeDir,
+		wallCmd:        args.wallCmd,
+		loginctlCmd:    args.loginctlCmd,
+		runuserCmd:     args.runuserCmd,
+		cmdTimeout:     args.cmdTimeout,
+		userLookup:     args.userLookup,
+	}
+}
+
+// ApplyPolicy broadcasts the message of the machine policy if it is new, and notifies the logged-in users who didn't
+// receive it yet.
+// For users, the current message of the machine is notified to the user if they didn't receive it yet.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply broadcast message policy to %s", objectName))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	if !isComputer {
+		if s.ID == "" || slices.Contains(s.ShownTo, objectName) {
+			return nil
+		}
+		u, err := m.userLookup(objectName)
+		if err != nil {
+			return err
+		}
+		if m.notify(ctx, s, objectName, u.Uid) {
+			s.ShownTo = append(s.ShownTo, objectName)
+		}
+		return m.saveState(s)
+	}
+
+	log.Debugf(ctx, "Applying broadcast message policy to %s", objectName)
+
+	id, message, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	// No message to broadcast anymore.
+	if message == "" {
+		return m.saveState(state{})
+	}
+
+	users, err := m.loggedInUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if id != s.ID {
+		log.Infof(ctx, "Broadcasting message %s", id)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.wallCmd, message); err != nil {
+			return err
+		}
+		s = state{ID: id}
+	}
+	s.Message = message
+
+	names := maps.Keys(users)
+	slices.Sort(names)
+	for _, name := range names {
+		if slices.Contains(s.ShownTo, name) {
+			continue
+		}
+		if m.notify(ctx, s, name, users[name]) {
+			s.ShownTo = append(s.ShownTo, name)
+		}
+	}
+
+	return m.saveState(s)
+}
+
+// DumpState returns the message broadcast during the last refresh of the machine, with the users who received it.
+// The state is empty for users or if no broadcast policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump broadcast state of %s", objectName))
+
+	// Broadcast policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// notify sends the message of s as a desktop notification to the user name with uid.
+// It returns true if the notification was sent. Failing to send it is not an error: it is sent again on the next
+// refresh.
+func (m *Manager) notify(ctx context.Context, s state, name, uid string) bool {
+	bus := filepath.Join(m.userRuntimeDir, uid, "bus")
+	if _, err := os.Stat(bus); err != nil {
+		log.Debugf(ctx, "No session bus for %s, the broadcast message %s will be notified on the next refresh", name, s.ID)
+		return false
+	}
+
+	log.Infof(ctx, "Notifying broadcast message %s to %s", s.ID, name)
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.runuserCmd, "-u", name, "--",
+		"env", "DBUS_SESSION_BUS_ADDRESS=unix:path="+bus,
+		"notify-send", "--urgency=critical", "--app-name=adsys", gotext.Get("Message from your administrator"), s.Message); err != nil {
+		log.Warning(ctx, gotext.Get("Can't notify broadcast message %s to %s, it will be notified on the next refresh: %v", s.ID, name, err))
+		return false
+	}
+	return true
+}
+
+// loggedInUsers returns the uid of the users logged in to the machine, indexed by user name.
+func (m *Manager) loggedInUsers(ctx context.Context) (users map[string]string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't list logged-in users"))
+
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.loginctlCmd, "list-users", "--no-legend")
+	if err != nil {
+		return nil, err
+	}
+
+	users = make(map[string]string)
+	for _, l := range strings.Split(out, "\n") {
+		// Lines start with the uid and name of the user, followed by their linger and state on recent versions.
+		fields := strings.Fields(l)
+		if len(fields) < 2 {
+			continue
+		}
+		users[fields[1]] = fields[0]
+	}
+	return users, nil
+}
+
+// parseEntries returns the identifier and the message to broadcast. The message is empty if there is none.
+func parseEntries(ctx context.Context, entries []entry.Entry) (id, message string, err error) {
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		switch e.Key {
+		case "broadcast/id":
+			id = strings.TrimSpace(e.Value)
+		case "broadcast/message":
+			message = strings.TrimSpace(e.Value)
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing broadcast message entries, skipping it", e.Key))
+		}
+	}
+
+	if message != "" && id == "" {
+		return "", "", errors.New(gotext.Get("the broadcast message needs an identifier"))
+	}
+	return id, message, nil
+}
+
+// loadState loads the message currently broadcast.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load broadcast message state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the message currently broadcast.
+// The state file is removed if there is no message anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save broadcast message state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if s.ID == "" {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,144 @@
+package broadcast_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/broadcast"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+const message = "The file server is down. Save your work locally."
+
+// users are the users known by the mocked user lookup, with their uid.
+var users = map[string]string{"alice": "1000", "bob@example.com": "1001"}
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		user          string
+		existingState string
+		sessionBuses  []string
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Broadcast new message":                               {entries: messageEntries("outage-2023-03", message)},
+		"Broadcast multi-line message":                        {entries: messageEntries("outage-2023-03", "  The file server is down.\nSave your work locally.\n")},
+		"Notify all users with a session bus":                 {entries: messageEntries("outage-2023-03", message), sessionBuses: []string{"1000", "1001"}},
+		"Users without session bus are notified later":        {entries: messageEntries("outage-2023-03", message), sessionBuses: []string{}},
+		"Failing notifications are sent again later":          {entries: messageEntries("outage-2023-03", message), mockBehaviour: "fail-runuser"},
+		"Message already broadcast is not sent again":         {entries: messageEntries("outage-2023-03", message), existingState: "shown"},
+		"Users who didn't receive the message are notified":   {entries: messageEntries("outage-2023-03", message), existingState: "shown", sessionBuses: []string{"1000", "1001"}},
+		"New identifier broadcasts the message again":         {entries: messageEntries("outage-2023-04", message), existingState: "shown"},
+		"Updated message with same identifier is not resent":  {entries: messageEntries("outage-2023-03", "The file server is back."), existingState: "shown", sessionBuses: []string{"1000", "1001"}},
+		"Disabled message removes the broadcast":              {entries: []entry.Entry{{Key: "broadcast/id", Value: "outage-2023-03"}, {Key: "broadcast/message", Value: message, Disabled: true}}, existingState: "shown"},
+		"Empty message removes the broadcast":                 {entries: messageEntries("outage-2023-03", " \n"), existingState: "shown"},
+		"No entries removes the broadcast":                    {existingState: "shown"},
+		"Unsupported keys are ignored":                        {entries: append(messageEntries("outage-2023-03", message), entry.Entry{Key: "broadcast/title", Value: "IT"})},
+		"No entries and no state is a no-op":                  {},
+		"User is notified of the current message":             {user: "bob@example.com", existingState: "shown", sessionBuses: []string{"1001"}},
+		"User who received the message is not notified again": {user: "alice", existingState: "shown"},
+		"User without session bus is notified later":          {user: "bob@example.com", existingState: "shown"},
+		"User failing notification is sent again later":       {user: "bob@example.com", existingState: "shown", sessionBuses: []string{"1001"}, mockBehaviour: "fail-runuser"},
+		"User without message is a no-op":                     {user: "alice", entries: messageEntries("outage-2023-03", message)},
+
+		// Error cases
+		"Error on message without identifier": {entries: messageEntries("", message), wantErr: true},
+		"Error on broadcasting message":       {entries: messageEntries("outage-2023-03", message), mockBehaviour: "fail-wall", wantErr: true},
+		"Error on listing logged-in users":    {entries: messageEntries("outage-2023-03", message), mockBehaviour: "fail-loginctl", wantErr: true},
+		"Error on unknown user":               {user: "carol", existingState: "shown", wantErr: true},
+		"Error on corrupted state":            {entries: messageEntries("outage-2023-03", message), existingState: "corrupted", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+			runtimeDir := t.TempDir()
+			if tc.sessionBuses == nil {
+				tc.sessionBuses = []string{"1000"}
+			}
+			for _, uid := range tc.sessionBuses {
+				require.NoError(t, os.MkdirAll(filepath.Join(runtimeDir, uid), 0700), "Setup: can't create user runtime directory")
+				require.NoError(t, os.WriteFile(filepath.Join(runtimeDir, uid, "bus"), nil, 0600), "Setup: can't create session bus")
+			}
+
+			objectName := "ubuntu"
+			if tc.user != "" {
+				objectName = tc.user
+			}
+
+			m := broadcast.New(
+				broadcast.WithStateDir(root),
+				broadcast.WithUserRuntimeDir(runtimeDir),
+				broadcast.WithWallCmd(testutils.MockCommand(root, "wall", tc.mockBehaviour, runtimeDir)),
+				broadcast.WithLoginctlCmd(testutils.MockCommand(root, "loginctl", tc.mockBehaviour, runtimeDir)),
+				broadcast.WithRunuserCmd(testutils.MockCommand(root, "runuser", tc.mockBehaviour, runtimeDir)),
+				broadcast.WithUserLookup(func(name string) (*user.User, error) {
+					uid, ok := users[name]
+					if !ok {
+						return nil, errors.New("unknown user")
+					}
+					return &user.User{Username: name, Uid: uid}, nil
+				}),
+			)
+			err := m.ApplyPolicy(context.Background(), objectName, tc.user == "", tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// messageEntries returns the entries of a broadcast message with id.
+func messageEntries(id, message string) []entry.Entry {
+	return []entry.Entry{{Key: "broadcast/id", Value: id}, {Key: "broadcast/message", Value: message}}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, runtimeDir, behaviour, args := c.Name, c.Args[0], c.Behaviour, c.Args[1:]
+
+	if behaviour == "fail-"+name {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+	for i, a := range args {
+		args[i] = strings.ReplaceAll(a, runtimeDir, "RUNTIME_DIR")
+	}
+
+	c.Log(fmt.Sprintf("%s %q", name, args))
+
+	if name == "loginctl" {
+		fmt.Println(` 1000 alice           no active
+ 1001 bob@example.com no online`)
+	}
+}
@@ -0,0 +1,272 @@
+package certificate
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/crypto/acme"
+)
+
+// acmeOrderTimeout is the maximum time an ACME order can take, including the challenge validation.
+const acmeOrderTimeout = 2 * time.Minute
+
+// applyACME requests the machine certificate from the ACME server of the certification authority,
+// if not already enrolled with it or if the certificate is due for renewal.
+// If the server configuration changed since the last enrollment, the machine is unenrolled first.
+// Failures to communicate with the server are only logged, as the request is retried on next refresh.
+func (e *enrollment) applyACME(ctx context.Context, ca certificationAuthority) error {
+	nickname := ca.name + "." + machineTemplate
+	certPath := filepath.Join(e.trustDir, nickname+".crt")
+
+	if old, ok := e.state[ca.name]; ok {
+		if old.Protocol == ca.protocol && old.URL == ca.url && !needsRenewal(certPath, time.Now()) {
+			log.Debugf(ctx, "Already enrolled with certification authority %q, skipping", ca.name)
+			return nil
+		}
+		if old.Protocol != ca.protocol || old.URL != ca.url {
+			log.Info(ctx, gotext.Get("Certification authority %q changed, renewing enrollment", ca.name))
+			if err := e.unapply(ctx, ca.name); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Info(ctx, gotext.Get("Requesting certificate %q from ACME server %q", nickname, ca.url))
+
+	s := caState{
+		Hostname: ca.hostname,
+		Protocol: ca.protocol,
+		URL:      ca.url,
+	}
+	if old, ok := e.state[ca.name]; ok {
+		s.Templates = old.Templates
+	}
+	// Store the state as soon as possible to allow a partial enrollment to be reverted.
+	defer func() { e.state[ca.name] = s }()
+
+	accountKey, err := e.acmeAccountKey(ca.name)
+	if err != nil {
+		return err
+	}
+
+	key, chain, err := e.requestACMECertificate(ctx, ca, accountKey)
+	if err != nil {
+		log.Warning(ctx, gotext.Get("Failed to request certificate %q from ACME server %q: %v", nickname, ca.url, err))
+		return nil
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(e.privateDir, nickname+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	var certs []byte
+	for _, der := range chain {
+		certs = append(certs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	// #nosec G306 - certificates are public
+	if err := writeFileAtomic(certPath, certs, 0644); err != nil {
+		return err
+	}
+	s.Templates = []string{machineTemplate}
+
+	return nil
+}
+
+// acmeAccountKeyPath returns the path of the ACME account key for the certification authority name.
+func (e *enrollment) acmeAccountKeyPath(name string) string {
+	return filepath.Join(e.privateDir, name+".account.key")
+}
+
+// acmeAccountKey loads the ACME account key for the certification authority name, or creates it.
+func (e *enrollment) acmeAccountKey(name string) (key crypto.Signer, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load ACME account key"))
+
+	p := e.acmeAccountKeyPath(name)
+	d, err := os.ReadFile(p)
+	if err == nil {
+		block, _ := pem.Decode(d)
+		if block == nil {
+			return nil, errors.New(gotext.Get("no PEM data found in %s", p))
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(p, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// requestACMECertificate registers the machine account with the ACME server of the certification
+// authority if needed, then orders a certificate for the machine FQDN, answering the http-01 challenges
+// if required. It returns the private key and the DER encoded certificate chain, starting with the leaf.
+func (e *enrollment) requestACMECertificate(ctx context.Context, ca certificationAuthority, accountKey crypto.Signer) (key crypto.Signer, chain [][]byte, err error) {
+	ctx, cancel := context.WithTimeout(ctx, acmeOrderTimeout)
+	defer cancel()
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: ca.url,
+		HTTPClient:   e.httpClient,
+		UserAgent:    "adsys",
+	}
+	account := &acme.Account{}
+	if ca.eabKID != "" {
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: ca.eabKID, Key: ca.eabKey}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, nil, errors.New(gotext.Get("can't register account: %v", err))
+	}
+
+	fqdn := e.fqdn()
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(fqdn))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The identifier may already be validated, for instance by the External Account Binding.
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		if err := e.solveHTTP01(ctx, client, z); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, err
+	}
+
+	bits, err := strconv.Atoi(defaultKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	k, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: fqdn},
+		DNSNames: []string{fqdn},
+	}, k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chain, _, err = client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, chain, nil
+}
+
+// solveHTTP01 answers the http-01 challenge of the authorization z, serving the key authorization
+// on the challenge address until the authorization is validated.
+func (e *enrollment) solveHTTP01(ctx context.Context, client *acme.Client, z *acme.Authorization) error {
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return errors.New(gotext.Get("no supported challenge for %q: only http-01 is supported", z.Identifier.Value))
+	}
+
+	response, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", e.acmeChallengeAddr)
+	if err != nil {
+		return errors.New(gotext.Get("can't listen for http-01 challenge: %v", err))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(client.HTTP01ChallengePath(chal.Token), func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, response)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	log.Debugf(ctx, "Answering http-01 challenge for %q on %s", z.Identifier.Value, l.Addr())
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// fqdn returns the fully qualified domain name of the machine being enrolled.
+func (e *enrollment) fqdn() string {
+	if strings.Contains(e.objectName, ".") {
+		return strings.ToLower(e.objectName)
+	}
+	return strings.ToLower(e.objectName + "." + e.domain)
+}
+
+// needsRenewal returns true if the certificate at p is missing, invalid, or if two thirds of its
+// lifetime have elapsed at now.
+func needsRenewal(p string, now time.Time) bool {
+	d, err := os.ReadFile(p)
+	if err != nil {
+		return true
+	}
+	block, _ := pem.Decode(d)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return now.After(cert.NotBefore.Add(lifetime * 2 / 3))
+}
+
+// writeFileAtomic writes data to p with perm, replacing any existing file only once fully written.
+func writeFileAtomic(p string, data []byte, perm os.FileMode) error {
+	if err := os.WriteFile(p+".new", data, perm); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,248 @@
+package certificate_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const acmeBaseURL = "https://acme.example.com"
+
+// acmeServer is a minimal ACME server, serving a single account and order.
+// JWS signatures are not verified.
+//
+// behaviour allows to change its responses:
+//   - http-01: the authorization requires an http-01 challenge, validated on challengeAddr;
+//   - require-eab: registering an account requires an External Account Binding;
+//   - fail: every request but the directory and nonce ones fails.
+//
+// Otherwise, the authorization is already valid.
+type acmeServer struct {
+	behaviour     string
+	challengeAddr string
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	mu         sync.Mutex
+	identifier string
+	authzValid bool
+	certPEM    []byte
+}
+
+// newACMEServer returns a new ACME server with its own certification authority.
+func newACMEServer(t *testing.T, behaviour, challengeAddr string) *acmeServer {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "Setup: can't generate ACME CA key")
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ACME Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err, "Setup: can't create ACME CA certificate")
+	caCert, err := x509.ParseCertificate(der)
+	require.NoError(t, err, "Setup: can't parse ACME CA certificate")
+
+	return &acmeServer{
+		behaviour:     behaviour,
+		challengeAddr: challengeAddr,
+		caCert:        caCert,
+		caKey:         caKey,
+		authzValid:    behaviour != "http-01",
+	}
+}
+
+func (s *acmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	if r.URL.Path == "/directory" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   acmeBaseURL + "/new-nonce",
+			"newAccount": acmeBaseURL + "/new-account",
+			"newOrder":   acmeBaseURL + "/new-order",
+		})
+		return
+	}
+	if r.URL.Path == "/new-nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	// Server errors are retried by the client, so fail with a client error instead.
+	if s.behaviour == "fail" {
+		writeProblem(w, http.StatusForbidden, "unauthorized", "requested failure")
+		return
+	}
+
+	var payload struct {
+		Identifiers            []map[string]string `json:"identifiers"`
+		ExternalAccountBinding json.RawMessage     `json:"externalAccountBinding"`
+		CSR                    string              `json:"csr"`
+	}
+	if err := decodeJWSPayload(r.Body, &payload); err != nil {
+		writeProblem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+
+	switch r.URL.Path {
+	case "/new-account":
+		if s.behaviour == "require-eab" && payload.ExternalAccountBinding == nil {
+			writeProblem(w, http.StatusBadRequest, "externalAccountRequired", "external account binding required")
+			return
+		}
+		w.Header().Set("Location", acmeBaseURL+"/account/1")
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case "/new-order":
+		s.identifier = payload.Identifiers[0]["value"]
+		w.Header().Set("Location", acmeBaseURL+"/order/1")
+		writeJSON(w, http.StatusCreated, s.order())
+	case "/order/1":
+		w.Header().Set("Location", acmeBaseURL+"/order/1")
+		writeJSON(w, http.StatusOK, s.order())
+	case "/authz/1":
+		writeJSON(w, http.StatusOK, s.authorization())
+	case "/challenge/1":
+		s.authzValid = s.validateHTTP01()
+		writeJSON(w, http.StatusOK, s.authorization()["challenges"].([]map[string]string)[0])
+	case "/finalize/1":
+		der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		if err := s.issue(der); err != nil {
+			writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		w.Header().Set("Location", acmeBaseURL+"/order/1")
+		writeJSON(w, http.StatusOK, s.order())
+	case "/certificate/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(s.certPEM)
+	default:
+		writeProblem(w, http.StatusNotFound, "malformed", "not found")
+	}
+}
+
+// order returns the current state of the order.
+func (s *acmeServer) order() map[string]any {
+	status := "pending"
+	if s.authzValid {
+		status = "ready"
+	}
+	o := map[string]any{
+		"identifiers":    []map[string]string{{"type": "dns", "value": s.identifier}},
+		"authorizations": []string{acmeBaseURL + "/authz/1"},
+		"finalize":       acmeBaseURL + "/finalize/1",
+	}
+	if s.certPEM != nil {
+		status = "valid"
+		o["certificate"] = acmeBaseURL + "/certificate/1"
+	}
+	o["status"] = status
+	return o
+}
+
+// authorization returns the current state of the authorization, with its http-01 challenge.
+func (s *acmeServer) authorization() map[string]any {
+	status := "pending"
+	if s.authzValid {
+		status = "valid"
+	}
+	return map[string]any{
+		"identifier": map[string]string{"type": "dns", "value": s.identifier},
+		"status":     status,
+		"challenges": []map[string]string{{"type": "http-01", "url": acmeBaseURL + "/challenge/1", "token": "token1", "status": status}},
+	}
+}
+
+// validateHTTP01 returns true if the key authorization is served on the challenge address.
+func (s *acmeServer) validateHTTP01() bool {
+	resp, err := http.Get(fmt.Sprintf("http://%s/.well-known/acme-challenge/token1", s.challengeAddr))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	d, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusOK && strings.HasPrefix(string(d), "token1.")
+}
+
+// issue signs the certificate request with the certification authority of the server.
+func (s *acmeServer) issue(csrDER []byte) error {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return err
+	}
+	s.certPEM = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	return nil
+}
+
+// decodeJWSPayload decodes the payload of the flattened JWS in r into v.
+// The payload is empty for POST-as-GET requests.
+func decodeJWSPayload(r io.Reader, v any) error {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r).Decode(&jws); err != nil {
+		return err
+	}
+	if jws.Payload == "" {
+		return nil
+	}
+	d, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, status int, errType, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + errType, "detail": detail})
+}
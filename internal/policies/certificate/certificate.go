@@ -4,86 +4,124 @@
 // This manager only applies to computer objects.
 //
 // Provided that the AD backend is online and AD CS is set up, the manager will
-// parse the relevant GPOs and delegate to an external Python script that will
-// request Samba to enroll or un-enroll the machine for certificates.
+// parse the relevant GPOs and enroll or un-enroll the machine for certificates,
+// following the autoenrollment process described in [MS-CAESO]:
+//   - the certification authorities and certificate templates are discovered
+//     from the directory over LDAPS, authenticating with the machine Kerberos
+//     ticket over SASL GSSAPI;
+//   - the root certificates of each certification authority are installed in
+//     the system trust store;
+//   - certificates are requested and then continuously monitored by certmonger,
+//     which relies on cepces to communicate with the enrollment services. Both
+//     remain required to enroll with the Microsoft enrollment web services.
+//
+// For organizations whose PKI doesn't expose the Microsoft enrollment web
+// services, the certificate/protocol setting allows to enroll the machine
+// certificate with another protocol instead:
+//   - scep: the certificate is requested and monitored by certmonger from the
+//     SCEP server set in certificate/scep-url, with the optional challenge
+//     password set in certificate/scep-challenge;
+//   - acme: the certificate is requested from the ACME server whose directory
+//     is set in certificate/acme-directory, with the External Account Binding
+//     credentials set in certificate/acme-eab-kid and certificate/acme-eab-hmac-key
+//     if the server requires them. The http-01 challenge is answered by the
+//     manager itself, and the certificate is renewed on refresh once two thirds
+//     of its lifetime have elapsed.
+//
+// The root certificates of the certification authorities are also propagated to the
+// applications which don't rely on the system trust store, as selected by the
+// certificate/trust-* settings: snapd, the Docker daemon for the listed registries,
+// pip, npm and git. The propagation is reverted once it isn't selected anymore or
+// the machine isn't enrolled with any certification authority.
 //
 // If the GPO is disabled/not configured, the policy manager will attempt to
-// unenroll the machine only if traces of Samba cache are found on the disk.
+// unenroll the machine only if a previous enrollment state is found on the disk.
 // If the enroll flag is unchecked, the machine will be unenrolled, namely the
 // certificates will be removed and monitoring will stop.
-// If any errors occur during the enrollment process, the manager will log them
-// prior to failing.
+// If certmonger or cepces are not installed when needed by the protocol, the enrollment
+// is skipped with a warning.
+// Any other error occurring during the enrollment process is logged, while
+// errors preventing the manager from querying the directory or from writing the
+// requested files on disk will fail the policy application.
 package certificate
 
 import (
 	"context"
-	_ "embed" // embed cert enroll python script
-	"encoding/json"
 	"errors"
-	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"slices"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/leonelquinteros/gotext"
 	"github.com/ubuntu/adsys/internal/consts"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/ldaphelpers"
 	"github.com/ubuntu/adsys/internal/policies/entry"
-	"github.com/ubuntu/adsys/internal/smbsafe"
 	"github.com/ubuntu/decorate"
 )
 
-// Manager prevents running multiple Python scripts in parallel while parsing
+// Manager prevents running multiple enrollments in parallel while parsing
 // the policy in ApplyPolicy.
 type Manager struct {
-	domain          string
-	stateDir        string
-	krb5CacheDir    string
-	vendorPythonDir string
-	globalTrustDir  string
-	certEnrollCmd   []string
+	domain         string
+	stateDir       string
+	trustDir       string
+	privateDir     string
+	krb5CacheDir   string
+	globalTrustDir string
+
+	ldapDial        ldaphelpers.Dialer
+	getcertCmd      []string
+	cepcesSubmitCmd []string
+	updateCACmd     []string
+	httpClient      *http.Client
+	cmdTimeout      time.Duration
+	ldapTimeout     time.Duration
+
+	acmeChallengeAddr string
+
+	snapCmd        []string
+	gitCmd         []string
+	dockerCertsDir string
+	pipConfPath    string
+	npmrcPath      string
+	systemCABundle string
 
 	mu sync.Mutex // Prevents multiple instances of the certificate manager from running in parallel
 }
 
-// gpoEntry is a single GPO registry entry to be serialised to JSON in a format
-// Samba expects.
-type gpoEntry struct {
-	KeyName   string `json:"keyname"`
-	ValueName string `json:"valuename"`
-	Data      any    `json:"data"`
-	Type      int    `json:"type"`
-}
-
-// integerGPOValues is a list of GPO registry values that contain integer data.
-var integerGPOValues = []string{"AuthFlags", "Cost", "Flags"}
-
 const (
-	gpoTypeString  int = 1 // REG_SZ
-	gpoTypeInteger int = 4 // REG_DWORD
-
 	// See [MS-CAESO] 4.4.5.1.
 	enrollFlag   int = 0x1
 	disabledFlag int = 0x8000
 )
 
-// CertEnrollCode is the embedded Python script which requests
-// Samba to autoenroll for certificates using the given GPOs.
-//
-//go:embed cert-autoenroll
-var CertEnrollCode string
-
 type options struct {
-	stateDir          string
-	runDir            string
-	shareDir          string
-	globalTrustDir    string
-	certAutoenrollCmd []string
+	stateDir        string
+	runDir          string
+	globalTrustDir  string
+	ldapDial        ldaphelpers.Dialer
+	getcertCmd      []string
+	cepcesSubmitCmd []string
+	updateCACmd     []string
+	httpClient      *http.Client
+	httpTimeout     time.Duration
+	cmdTimeout      time.Duration
+	ldapTimeout     time.Duration
+
+	acmeChallengeAddr string
+
+	snapCmd        []string
+	gitCmd         []string
+	dockerCertsDir string
+	pipConfPath    string
+	npmrcPath      string
+	systemCABundle string
 }
 
 // Option reprents an optional function to change the certificate manager.
@@ -103,24 +141,101 @@ func WithRunDir(p string) func(*options) {
 	}
 }
 
-// WithShareDir overrides the default share directory.
-func WithShareDir(p string) func(*options) {
+// WithGlobalTrustDir overrides the default global trust store directory.
+func WithGlobalTrustDir(p string) func(*options) {
 	return func(a *options) {
-		a.shareDir = p
+		a.globalTrustDir = p
 	}
 }
 
-// WithGlobalTrustDir overrides the default global trust store directory.
-func WithGlobalTrustDir(p string) func(*options) {
+// WithLdapDialer overrides the default connection to the directory, bound over SASL GSSAPI.
+func WithLdapDialer(dial ldaphelpers.Dialer) func(*options) {
 	return func(a *options) {
-		a.globalTrustDir = p
+		a.ldapDial = dial
+	}
+}
+
+// WithGetcertCmd overrides the default certmonger getcert command.
+func WithGetcertCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.getcertCmd = cmd
 	}
 }
 
-// WithCertAutoenrollCmd overrides the default certificate autoenroll command.
-func WithCertAutoenrollCmd(cmd []string) func(*options) {
+// WithCepcesSubmitCmd overrides the default cepces-submit command.
+func WithCepcesSubmitCmd(cmd []string) func(*options) {
 	return func(a *options) {
-		a.certAutoenrollCmd = cmd
+		a.cepcesSubmitCmd = cmd
+	}
+}
+
+// WithUpdateCACertificatesCmd overrides the default command updating the system trust store.
+func WithUpdateCACertificatesCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.updateCACmd = cmd
+	}
+}
+
+// WithHTTPTimeout overrides the default maximum time of each HTTP request during enrollment.
+func WithHTTPTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.httpTimeout = timeout
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take during enrollment.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// WithLdapTimeout overrides the default maximum time any LDAP request to the directory can take.
+func WithLdapTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.ldapTimeout = timeout
+	}
+}
+
+// WithSnapCmd overrides the default snap command.
+func WithSnapCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.snapCmd = cmd
+	}
+}
+
+// WithGitCmd overrides the default git command.
+func WithGitCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.gitCmd = cmd
+	}
+}
+
+// WithDockerCertsDir overrides the default directory of the certificates of the Docker registries.
+func WithDockerCertsDir(p string) func(*options) {
+	return func(a *options) {
+		a.dockerCertsDir = p
+	}
+}
+
+// WithPipConfPath overrides the default path of the system wide pip configuration.
+func WithPipConfPath(p string) func(*options) {
+	return func(a *options) {
+		a.pipConfPath = p
+	}
+}
+
+// WithNpmrcPath overrides the default path of the system wide npm configuration.
+func WithNpmrcPath(p string) func(*options) {
+	return func(a *options) {
+		a.npmrcPath = p
+	}
+}
+
+// WithSystemCABundle overrides the default path of the certificate bundle of the system trust store.
+func WithSystemCABundle(p string) func(*options) {
+	return func(a *options) {
+		a.systemCABundle = p
 	}
 }
 
@@ -128,33 +243,67 @@ func WithCertAutoenrollCmd(cmd []string) func(*options) {
 func New(domain string, opts ...Option) *Manager {
 	// defaults
 	args := options{
-		stateDir:          consts.DefaultStateDir,
-		runDir:            consts.DefaultRunDir,
-		shareDir:          consts.DefaultShareDir,
-		globalTrustDir:    consts.DefaultGlobalTrustDir,
-		certAutoenrollCmd: []string{"python3", "-c", CertEnrollCode},
+		stateDir:       consts.DefaultStateDir,
+		runDir:         consts.DefaultRunDir,
+		globalTrustDir: consts.DefaultGlobalTrustDir,
+		getcertCmd:     []string{"getcert"},
+		httpTimeout:    consts.DefaultEnrollmentHTTPTimeout,
+		cmdTimeout:     consts.DefaultHelperExecTimeout,
+		ldapTimeout:    consts.DefaultLdapTimeout,
+
+		acmeChallengeAddr: ":80",
+
+		snapCmd:        []string{"snap"},
+		gitCmd:         []string{"git"},
+		dockerCertsDir: "/etc/docker/certs.d",
+		pipConfPath:    "/etc/xdg/pip/pip.conf",
+		npmrcPath:      "/etc/npmrc",
+		systemCABundle: "/etc/ssl/certs/ca-certificates.crt",
 	}
 	// applied options
 	for _, o := range opts {
 		o(&args)
 	}
+	if args.httpClient == nil {
+		args.httpClient = &http.Client{Timeout: args.httpTimeout}
+	}
 
 	return &Manager{
-		domain:          domain,
-		stateDir:        args.stateDir,
-		krb5CacheDir:    filepath.Join(args.runDir, "krb5cc"),
-		vendorPythonDir: filepath.Join(args.shareDir, "python"),
-		globalTrustDir:  args.globalTrustDir,
-		certEnrollCmd:   args.certAutoenrollCmd,
+		domain:         domain,
+		stateDir:       args.stateDir,
+		trustDir:       filepath.Join(args.stateDir, "certs"),
+		privateDir:     filepath.Join(args.stateDir, "private", "certs"),
+		krb5CacheDir:   filepath.Join(args.runDir, "krb5cc"),
+		globalTrustDir: args.globalTrustDir,
+
+		ldapDial:        args.ldapDial,
+		getcertCmd:      args.getcertCmd,
+		cepcesSubmitCmd: args.cepcesSubmitCmd,
+		updateCACmd:     args.updateCACmd,
+		httpClient:      args.httpClient,
+		cmdTimeout:      args.cmdTimeout,
+		ldapTimeout:     args.ldapTimeout,
+
+		acmeChallengeAddr: args.acmeChallengeAddr,
+
+		snapCmd:        args.snapCmd,
+		gitCmd:         args.gitCmd,
+		dockerCertsDir: args.dockerCertsDir,
+		pipConfPath:    args.pipConfPath,
+		npmrcPath:      args.npmrcPath,
+		systemCABundle: args.systemCABundle,
 	}
 }
 
-// ApplyPolicy runs the certificate autoenrollment script to enroll or un-enroll the machine.
-func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer, isOnline bool, entries []entry.Entry) (err error) {
+// ApplyPolicy enrolls or un-enrolls the machine for certificates against the server serverFQDN.
+// The root certificates of the enrollment are then propagated to the selected applications.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer, isOnline bool, serverFQDN string, entries []entry.Entry) (err error) {
 	defer decorate.OnError(&err, gotext.Get("can't apply certificate policy"))
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	// Don't keep the connections to the enrollment servers open until the next refresh.
+	defer m.httpClient.CloseIdleConnections()
 
 	if !isComputer {
 		log.Debug(ctx, "Certificate policy is only supported for computers, skipping...")
@@ -166,19 +315,23 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		return nil
 	}
 
+	if err := m.applyEnrollment(ctx, objectName, serverFQDN, entries); err != nil {
+		return err
+	}
+	return m.propagateTrust(ctx, objectName, entries)
+}
+
+// applyEnrollment enrolls or un-enrolls objectName as configured in entries.
+func (m *Manager) applyEnrollment(ctx context.Context, objectName, serverFQDN string, entries []entry.Entry) error {
 	idx := slices.IndexFunc(entries, func(e entry.Entry) bool { return e.Key == "autoenroll" })
 	if idx == -1 {
-		// If the Samba cache directory doesn't exist, we don't have anything to unenroll
-		if _, err := os.Stat(filepath.Join(m.stateDir, "samba")); err != nil && os.IsNotExist(err) {
+		// If there is no enrollment state, we don't have anything to unenroll
+		if !m.hasState(objectName) {
 			return nil
 		}
 
 		log.Debug(ctx, "Certificate autoenrollment is not configured, unenrolling machine")
-		if err := m.runScript(ctx, "unenroll", objectName); err != nil {
-			return err
-		}
-
-		return nil
+		return m.unenroll(ctx, objectName)
 	}
 
 	log.Debug(ctx, "ApplyPolicy certificate policy")
@@ -194,84 +347,59 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		return nil
 	}
 
-	var polSrvRegistryEntries []gpoEntry
-	for _, entry := range entries {
-		// We already handled the autoenroll entry
-		if entry.Key == "autoenroll" {
-			continue
-		}
-
-		// Samba expects the key parts to be joined by backslashes
-		keyparts := strings.Split(entry.Key, "/")
-		keyname := strings.Join(keyparts[:len(keyparts)-1], `\`)
-		valuename := keyparts[len(keyparts)-1]
-		gpoData, err := gpoData(entry.Value, valuename)
-		if err != nil {
-			return errors.New(gotext.Get("failed to parse policy entry value: %v", err))
-		}
-		polSrvRegistryEntries = append(polSrvRegistryEntries, gpoEntry{keyname, valuename, gpoData, gpoType(valuename)})
-
-		log.Debugf(ctx, "Certificate policy entry: %#v", entry)
-	}
-
-	var action string
 	log.Debugf(ctx, "Certificate policy value: %d", value)
-	action = "unenroll"
-	if value&enrollFlag == enrollFlag {
-		action = "enroll"
+	if value&enrollFlag != enrollFlag {
+		return m.unenroll(ctx, objectName)
 	}
 
-	jsonGPOData, err := json.Marshal(polSrvRegistryEntries)
+	ca, err := parseProtocol(entries)
 	if err != nil {
-		return errors.New(gotext.Get("failed to marshal policy server registry entries: %v", err))
+		return errors.New(gotext.Get("failed to parse policy entry value: %v", err))
 	}
-
-	if err := m.runScript(ctx, action, objectName, "--policy_servers_json", string(jsonGPOData)); err != nil {
-		return err
+	if ca.protocol != protocolXCEP {
+		log.Debugf(ctx, "Enrolling with %s server %q", ca.protocol, ca.url)
+		return m.enroll(ctx, objectName, "", ca.protocol, func(*enrollment) ([]certificationAuthority, error) {
+			return []certificationAuthority{ca}, nil
+		})
 	}
 
-	return nil
-}
-
-// runScript runs the certificate autoenrollment script with the given arguments.
-func (m *Manager) runScript(ctx context.Context, action, objectName string, extraArgs ...string) error {
-	scriptArgs := []string{action, objectName, m.domain, "--state_dir", m.stateDir, "--global_trust_dir", m.globalTrustDir}
-	scriptArgs = append(scriptArgs, extraArgs...)
-	cmdArgs := append(m.certEnrollCmd, scriptArgs...)
-	cmdCtx, cancel := context.WithTimeout(ctx, time.Second*10)
-	defer cancel()
-	log.Debugf(ctx, "Running cert autoenroll script with arguments: %q", strings.Join(scriptArgs, " "))
-	// #nosec G204 - cmdArgs is under our control (python embedded script or mock for tests)
-	cmd := exec.CommandContext(cmdCtx, cmdArgs[0], cmdArgs[1:]...)
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("KRB5CCNAME=%s", filepath.Join(m.krb5CacheDir, objectName)),
-		fmt.Sprintf("PYTHONPATH=%s:%s", os.Getenv("PYTHONPATH"), m.vendorPythonDir),
-	)
-	smbsafe.WaitExec()
-	defer smbsafe.DoneExec()
-
-	output, err := cmd.CombinedOutput()
+	endpoints, err := parseEndpoints(ctx, entries)
 	if err != nil {
-		return errors.New(gotext.Get("failed to run certificate autoenrollment script (exited with %d): %v\n%s", cmd.ProcessState.ExitCode(), err, string(output)))
+		return errors.New(gotext.Get("failed to parse policy entry value: %v", err))
 	}
-	log.Info(ctx, gotext.Get("Certificate autoenrollment script ran successfully\n%s", string(output)))
-	return nil
-}
 
-// gpoData returns the data for a GPO entry.
-func gpoData(data, value string) (any, error) {
-	if slices.Contains(integerGPOValues, value) {
-		return strconv.Atoi(data)
+	if serverFQDN == "" {
+		log.Debugf(ctx, "No active server found, querying domain %q directly", m.domain)
+		serverFQDN = m.domain
 	}
-
-	return data, nil
+	return m.enroll(ctx, objectName, serverFQDN, protocolXCEP, func(e *enrollment) ([]certificationAuthority, error) {
+		if len(endpoints) > 0 {
+			return e.readCEPData(ctx, endpoints)
+		}
+		return e.fetchCertificationAuthorities(ctx)
+	})
 }
 
-// gpoType returns the type for a GPO entry.
-func gpoType(value string) int {
-	if slices.Contains(integerGPOValues, value) {
-		return gpoTypeInteger
+// lookPath returns the absolute path of the executable name, searched in PATH and then in extraDirs.
+// It returns an empty string if the executable can't be found.
+func lookPath(name string, extraDirs ...string) string {
+	if p, err := exec.LookPath(name); err == nil {
+		return p
+	}
+	for _, d := range extraDirs {
+		p := filepath.Join(d, name)
+		if info, err := os.Stat(p); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return p
+		}
 	}
+	return ""
+}
 
-	return gpoTypeString
+// isInstalled returns true if the command cmd can be executed.
+func isInstalled(cmd []string) bool {
+	if len(cmd) == 0 || cmd[0] == "" {
+		return false
+	}
+	_, err := exec.LookPath(cmd[0])
+	return err == nil
 }
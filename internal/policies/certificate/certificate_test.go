@@ -1,14 +1,27 @@
 package certificate_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/go-ldap/ldap/v3"
 	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
 	"github.com/ubuntu/adsys/internal/policies/certificate"
 	"github.com/ubuntu/adsys/internal/policies/entry"
 	"github.com/ubuntu/adsys/internal/testutils"
@@ -18,157 +31,441 @@ const (
 	enrollValue   = "7"     // string representation of 0b111
 	unenrollValue = "6"     // string representation of 0b110
 	disabledValue = "32768" // string representation of 0x8000
+
+	policyServersKey = "Software/Policies/Microsoft/Cryptography/PolicyServers/"
 )
 
 var enrollEntry = entry.Entry{Key: "autoenroll", Value: enrollValue}
 var advancedConfigurationEntries = []entry.Entry{
-	{Key: "Software/Policies/Microsoft/Cryptography/PolicyServers/37c9dc30f207f27f61a2f7c3aed598a6e2920b54/AuthFlags", Value: "2"},
-	{Key: "Software/Policies/Microsoft/Cryptography/PolicyServers/37c9dc30f207f27f61a2f7c3aed598a6e2920b54/Cost", Value: "2147483645"},
-	{Key: "Software/Policies/Microsoft/Cryptography/PolicyServers/37c9dc30f207f27f61a2f7c3aed598a6e2920b54/Flags", Value: "20"},
-	{Key: "Software/Policies/Microsoft/Cryptography/PolicyServers/37c9dc30f207f27f61a2f7c3aed598a6e2920b54/FriendlyName", Value: "ActiveDirectoryEnrollmentPolicy"},
-	{Key: "Software/Policies/Microsoft/Cryptography/PolicyServers/37c9dc30f207f27f61a2f7c3aed598a6e2920b54/PolicyID", Value: "{A5E9BF57-71C6-443A-B7FC-79EFA6F73EBD}"},
-	{Key: "Software/Policies/Microsoft/Cryptography/PolicyServers/37c9dc30f207f27f61a2f7c3aed598a6e2920b54/URL", Value: "LDAP:"},
-	{Key: "Software/Policies/Microsoft/Cryptography/PolicyServers/Flags", Value: "0"},
+	{Key: policyServersKey + "37c9dc30f207f27f61a2f7c3aed598a6e2920b54/AuthFlags", Value: "2"},
+	{Key: policyServersKey + "37c9dc30f207f27f61a2f7c3aed598a6e2920b54/Cost", Value: "2147483645"},
+	{Key: policyServersKey + "37c9dc30f207f27f61a2f7c3aed598a6e2920b54/Flags", Value: "20"},
+	{Key: policyServersKey + "37c9dc30f207f27f61a2f7c3aed598a6e2920b54/FriendlyName", Value: "ActiveDirectoryEnrollmentPolicy"},
+	{Key: policyServersKey + "37c9dc30f207f27f61a2f7c3aed598a6e2920b54/PolicyID", Value: "{A5E9BF57-71C6-443A-B7FC-79EFA6F73EBD}"},
+	{Key: policyServersKey + "37c9dc30f207f27f61a2f7c3aed598a6e2920b54/URL", Value: "LDAP:"},
+	{Key: policyServersKey + "Flags", Value: "0"},
+}
+
+var scepEntries = []entry.Entry{
+	enrollEntry,
+	{Key: "certificate/protocol", Value: "scep"},
+	{Key: "certificate/scep-url", Value: "https://scep.example.com/certsrv/mscep/mscep.dll"},
+	{Key: "certificate/scep-challenge", Value: "0123456789ABCDEF"},
+}
+var acmeEntries = []entry.Entry{
+	enrollEntry,
+	{Key: "certificate/protocol", Value: "acme"},
+	{Key: "certificate/acme-directory", Value: acmeBaseURL + "/directory"},
+	{Key: "certificate/acme-eab-kid", Value: "kid-1"},
+	{Key: "certificate/acme-eab-hmac-key", Value: "c2VjcmV0LWhtYWMta2V5"},
+}
+
+var trustEntries = []entry.Entry{
+	{Key: "certificate/trust-snapd", Value: "true"},
+	{Key: "certificate/trust-pip", Value: "true"},
+	{Key: "certificate/trust-npm", Value: "true"},
+	{Key: "certificate/trust-git", Value: "true"},
+	{Key: "certificate/trust-docker-registries", Value: "registry.example.com\nregistry.example.com:5000"},
+}
+
+// endpointEntries returns the entries of an advanced configuration with a single end point.
+func endpointEntries(url, policyID, flags string) []entry.Entry {
+	return []entry.Entry{
+		enrollEntry,
+		{Key: policyServersKey + "5fd3a9e5c4b0e8a1/AuthFlags", Value: "2"},
+		{Key: policyServersKey + "5fd3a9e5c4b0e8a1/Cost", Value: "1"},
+		{Key: policyServersKey + "5fd3a9e5c4b0e8a1/Flags", Value: flags},
+		{Key: policyServersKey + "5fd3a9e5c4b0e8a1/PolicyID", Value: policyID},
+		{Key: policyServersKey + "5fd3a9e5c4b0e8a1/URL", Value: url},
+	}
 }
 
 func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
 	tests := map[string]struct {
-		entries []entry.Entry
+		entries    []entry.Entry
+		serverFQDN string
 
 		isUser    bool
 		isOffline bool
 
-		autoenrollScriptError bool
-		runScript             bool
-		sambaDirExists        bool
+		existingState string
+		ldapFixture   string
+		ndesFixture   string
+		acmeBehaviour string
+		mockBehaviour string
+
+		getcertNotInstalled   bool
+		cepcesNotInstalled    bool
+		updateCANotFound      bool
+		trustCmdsNotInstalled bool
 
 		wantErr bool
 	}{
 		// No-op cases
-		"Computer, no entries":          {},
-		"Computer, autoenroll disabled": {entries: []entry.Entry{{Key: "autoenroll", Value: disabledValue}}},
-		"Computer, domain is offline":   {entries: []entry.Entry{enrollEntry}, isOffline: true},
+		"Computer, no entries":                       {},
+		"Computer, autoenroll disabled":              {entries: []entry.Entry{{Key: "autoenroll", Value: disabledValue}}, existingState: "enrolled"},
+		"Computer, domain is offline":                {entries: []entry.Entry{enrollEntry}, isOffline: true},
+		"User, autoenroll not supported":             {isUser: true, entries: []entry.Entry{enrollEntry}},
+		"Computer, configured to unenroll, no state": {entries: []entry.Entry{{Key: "autoenroll", Value: unenrollValue}}},
 
 		// Enroll cases
-		"Computer, configured to enroll":                         {entries: []entry.Entry{enrollEntry}, runScript: true},
-		"Computer, configured to enroll, advanced configuration": {entries: append(advancedConfigurationEntries, enrollEntry), runScript: true},
+		"Computer, configured to enroll":                                      {entries: []entry.Entry{enrollEntry}},
+		"Computer, configured to enroll, root certificate from NDES":          {entries: []entry.Entry{enrollEntry}, ndesFixture: "cert"},
+		"Computer, configured to enroll, root certificate chain from NDES":    {entries: []entry.Entry{enrollEntry}, ndesFixture: "chain"},
+		"Computer, configured to enroll, NDES returns an HTML page":           {entries: []entry.Entry{enrollEntry}, ndesFixture: "html"},
+		"Computer, configured to enroll, advanced configuration":              {entries: append(advancedConfigurationEntries, enrollEntry)},
+		"Computer, configured to enroll, multiple certification authorities":  {entries: []entry.Entry{enrollEntry}, ldapFixture: "two-cas"},
+		"Computer, configured to enroll, no certification authority":          {entries: []entry.Entry{enrollEntry}, ldapFixture: "no-ca"},
+		"Computer, configured to enroll, no server uses the domain":           {entries: []entry.Entry{enrollEntry}, serverFQDN: "-"},
+		"Computer, configured to enroll, getcert failures are only logged":    {entries: []entry.Entry{enrollEntry}, mockBehaviour: "getcert-fail"},
+		"Computer, configured to enroll, already known by certmonger":         {entries: []entry.Entry{enrollEntry}, mockBehaviour: "getcert-exists"},
+		"Computer, configured to enroll, templates failure is only logged":    {entries: []entry.Entry{enrollEntry}, mockBehaviour: "cepces-fail"},
+		"Computer, configured to enroll, trust store failure is only logged":  {entries: []entry.Entry{enrollEntry}, mockBehaviour: "update-ca-fail"},
+		"Computer, configured to enroll, no command to update trust store":    {entries: []entry.Entry{enrollEntry}, updateCANotFound: true},
+		"Computer, configured to enroll, certmonger not installed":            {entries: []entry.Entry{enrollEntry}, getcertNotInstalled: true},
+		"Computer, configured to enroll, cepces not installed":                {entries: []entry.Entry{enrollEntry}, cepcesNotInstalled: true},
+		"Computer, configured to enroll, https end point":                     {entries: endpointEntries("https://cepces.example.com/ADPolicyProvider_CEP_Kerberos/service.svc/CEP", "{0F2E5A6C-9D1B-4A8E-B3C7-2D4F6E8A0B1C}", "20")},
+		"Computer, configured to enroll, end point policy ID mismatch":        {entries: endpointEntries("LDAP:", "{00000000-0000-0000-0000-000000000000}", "20")},
+		"Computer, configured to enroll, end point autoenrollment disabled":   {entries: endpointEntries("LDAP:", "{A5E9BF57-71C6-443A-B7FC-79EFA6F73EBD}", "0")},
+		"Computer, configured to enroll, unparsable end point uses directory": {entries: endpointEntries("https://cepces.example.com/unknown", "{0F2E5A6C-9D1B-4A8E-B3C7-2D4F6E8A0B1C}", "20")},
+
+		// Other enrollment protocols cases
+		"Computer, configured to enroll with SCEP":                                   {entries: scepEntries, ndesFixture: "cert"},
+		"Computer, configured to enroll with SCEP, no challenge password":            {entries: []entry.Entry{enrollEntry, scepEntries[1], scepEntries[2]}, ndesFixture: "cert"},
+		"Computer, configured to enroll with SCEP, certmonger not installed":         {entries: scepEntries, getcertNotInstalled: true},
+		"Computer, configured to enroll with SCEP, cepces not needed":                {entries: scepEntries, ndesFixture: "cert", cepcesNotInstalled: true},
+		"Computer, configured to enroll with ACME":                                   {entries: acmeEntries, acmeBehaviour: "require-eab"},
+		"Computer, configured to enroll with ACME, http-01 challenge":                {entries: acmeEntries[:3], acmeBehaviour: "http-01"},
+		"Computer, configured to enroll with ACME, server failures are only logged":  {entries: acmeEntries, acmeBehaviour: "fail"},
+		"Computer, configured to enroll with ACME, missing EAB is only logged":       {entries: acmeEntries[:3], acmeBehaviour: "require-eab"},
+		"Computer, configured to enroll with ACME, certmonger and cepces not needed": {entries: acmeEntries, acmeBehaviour: "valid", getcertNotInstalled: true, cepcesNotInstalled: true},
+		"Computer, configured to enroll with explicit xcep protocol":                 {entries: []entry.Entry{enrollEntry, {Key: "certificate/protocol", Value: "xcep"}}},
+
+		// Existing enrollment cases
+		"Computer, already enrolled":                                      {entries: []entry.Entry{enrollEntry}, existingState: "enrolled"},
+		"Computer, already enrolled, templates changed":                   {entries: []entry.Entry{enrollEntry}, existingState: "enrolled", ldapFixture: "changed-templates"},
+		"Computer, already enrolled, certification authority removed":     {entries: []entry.Entry{enrollEntry}, existingState: "enrolled", ldapFixture: "no-ca"},
+		"Computer, already enrolled, Samba cache present":                 {entries: []entry.Entry{enrollEntry}, existingState: "legacy-samba"},
+		"Computer, already enrolled, certmonger not installed is a no-op": {entries: []entry.Entry{enrollEntry}, existingState: "enrolled", getcertNotInstalled: true},
+		"Computer, already enrolled, switching to SCEP":                   {entries: scepEntries, existingState: "enrolled", ndesFixture: "cert"},
+		"Computer, already enrolled, switching to ACME":                   {entries: acmeEntries, existingState: "enrolled", acmeBehaviour: "valid"},
+		"Computer, already enrolled with ACME":                            {entries: acmeEntries, existingState: "acme-enrolled", acmeBehaviour: "fail"},
+		"Computer, already enrolled with ACME, certificate renewed":       {entries: acmeEntries, existingState: "acme-renewal", acmeBehaviour: "valid"},
+		"Computer, already enrolled with ACME, renewal failure is logged": {entries: acmeEntries, existingState: "acme-renewal", acmeBehaviour: "fail"},
+		"Computer, already enrolled with ACME, switching to directory":    {entries: []entry.Entry{enrollEntry}, existingState: "acme-enrolled"},
 
 		// Unenroll cases
-		"Computer, configured to unenroll":          {entries: []entry.Entry{{Key: "autoenroll", Value: unenrollValue}}, runScript: true},
-		"Computer, no entries, Samba cache present": {sambaDirExists: true, runScript: true},
+		"Computer, configured to unenroll":                           {entries: []entry.Entry{{Key: "autoenroll", Value: unenrollValue}}, existingState: "enrolled"},
+		"Computer, configured to unenroll, certmonger not installed": {entries: []entry.Entry{{Key: "autoenroll", Value: unenrollValue}}, existingState: "enrolled", getcertNotInstalled: true},
+		"Computer, no entries, enrolled":                             {existingState: "enrolled"},
+		"Computer, no entries, Samba cache present":                  {existingState: "legacy-samba"},
+		"Computer, configured to unenroll, enrolled with ACME":       {entries: []entry.Entry{{Key: "autoenroll", Value: unenrollValue}}, existingState: "acme-enrolled"},
 
-		"User, autoenroll not supported": {isUser: true, entries: []entry.Entry{enrollEntry}},
+		// Root certificates propagation cases
+		"Computer, configured to enroll, root certificates propagated":             {entries: append([]entry.Entry{enrollEntry}, trustEntries...), ndesFixture: "cert"},
+		"Computer, already enrolled, root certificates propagated":                 {entries: append([]entry.Entry{enrollEntry}, trustEntries...), existingState: "enrolled"},
+		"Computer, already enrolled, propagation to some applications":             {entries: []entry.Entry{enrollEntry, trustEntries[0], trustEntries[4]}, existingState: "enrolled"},
+		"Computer, already enrolled, disabled and unchecked settings are ignored":  {entries: []entry.Entry{enrollEntry, {Key: "certificate/trust-snapd", Value: "true", Disabled: true}, {Key: "certificate/trust-git", Value: "false"}}, existingState: "enrolled"},
+		"Computer, already propagated, nothing changes":                            {entries: append([]entry.Entry{enrollEntry}, trustEntries...), existingState: "propagated"},
+		"Computer, already propagated, certificates changed":                       {entries: append([]entry.Entry{enrollEntry}, trustEntries...), existingState: "propagated", ldapFixture: "two-cas"},
+		"Computer, already propagated, propagation removed":                        {entries: []entry.Entry{enrollEntry}, existingState: "propagated"},
+		"Computer, already propagated, unenrolling reverts propagation":            {entries: append([]entry.Entry{{Key: "autoenroll", Value: unenrollValue}}, trustEntries...), existingState: "propagated"},
+		"Computer, already propagated, no entries reverts propagation":             {existingState: "propagated"},
+		"Computer, already propagated, git option already unset":                   {entries: []entry.Entry{enrollEntry}, existingState: "propagated", mockBehaviour: "git-not-set"},
+		"Computer, no root certificate, nothing is propagated":                     {entries: trustEntries},
+		"Computer, unmanaged configuration files are not modified":                 {entries: append([]entry.Entry{enrollEntry}, trustEntries...), existingState: "unmanaged-trust-files"},
+		"Computer, propagation command failures are only logged and retried":       {entries: append([]entry.Entry{enrollEntry}, trustEntries...), existingState: "enrolled", mockBehaviour: "trust-cmds-fail"},
+		"Computer, propagation with applications not installed only writes config": {entries: append([]entry.Entry{enrollEntry}, trustEntries...), existingState: "enrolled", trustCmdsNotInstalled: true},
 
 		// Error cases
-		"Error on autoenroll script failure": {autoenrollScriptError: true, entries: []entry.Entry{enrollEntry}, wantErr: true},
-		"Error on invalid autoenroll value":  {entries: []entry.Entry{{Key: "autoenroll", Value: "notanumber"}}, wantErr: true},
+		"Error on invalid autoenroll value": {entries: []entry.Entry{{Key: "autoenroll", Value: "notanumber"}}, wantErr: true},
 		"Error on invalid advanced configuration value": {
 			entries: []entry.Entry{
 				enrollEntry,
-				{Key: "Software/Policies/Microsoft/Cryptography/PolicyServers/37c9dc30f207f27f61a2f7c3aed598a6e2920b54/Flags", Value: "NotANumber"},
+				{Key: policyServersKey + "37c9dc30f207f27f61a2f7c3aed598a6e2920b54/Flags", Value: "NotANumber"},
 			}, wantErr: true},
+		"Error on directory query failure":     {entries: []entry.Entry{enrollEntry}, mockBehaviour: "ldap-search-fail", wantErr: true},
+		"Error on invalid directory response":  {entries: []entry.Entry{enrollEntry}, ldapFixture: "invalid-ldif", wantErr: true},
+		"Error on invalid root certificate":    {entries: []entry.Entry{enrollEntry}, ndesFixture: "invalid", wantErr: true},
+		"Error on invalid enrollment state":    {entries: []entry.Entry{enrollEntry}, existingState: "invalid-state", wantErr: true},
+		"Error on unwritable trust directory":  {entries: []entry.Entry{enrollEntry}, existingState: "trust-dir-is-file", wantErr: true},
+		"Error on unenroll with invalid state": {existingState: "invalid-state", wantErr: true},
+		"Error on unsupported protocol":        {entries: []entry.Entry{enrollEntry, {Key: "certificate/protocol", Value: "est"}}, wantErr: true},
+		"Error on missing SCEP URL":            {entries: []entry.Entry{enrollEntry, scepEntries[1]}, wantErr: true},
+		"Error on invalid SCEP URL":            {entries: []entry.Entry{enrollEntry, scepEntries[1], {Key: "certificate/scep-url", Value: "ftp://scep.example.com"}}, wantErr: true},
+		"Error on missing ACME directory":      {entries: []entry.Entry{enrollEntry, acmeEntries[1]}, wantErr: true},
+		"Error on EAB key ID without HMAC key": {entries: acmeEntries[:4], wantErr: true},
+		"Error on EAB HMAC key without key ID": {entries: append(acmeEntries[:3:3], acmeEntries[4]), wantErr: true},
+		"Error on invalid EAB HMAC key":        {entries: append(acmeEntries[:4:4], entry.Entry{Key: "certificate/acme-eab-hmac-key", Value: "not base64!"}), wantErr: true},
+		"Error on invalid Docker registry":     {entries: []entry.Entry{enrollEntry, {Key: "certificate/trust-docker-registries", Value: "https://registry.example.com"}}, existingState: "enrolled", wantErr: true},
+		"Error on invalid propagation state":   {entries: []entry.Entry{enrollEntry}, existingState: "invalid-trust-state", wantErr: true},
 	}
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			// Test with a clean PYTHONPATH to avoid differences in the golden file output
-			origPythonPath, existed := os.LookupEnv("PYTHONPATH")
-			err := os.Unsetenv("PYTHONPATH")
-			require.NoError(t, err, "Setup: Unable to unset PYTHONPATH")
-			defer func() {
-				if !existed {
-					return
-				}
-				err := os.Setenv("PYTHONPATH", origPythonPath)
-				require.NoError(t, err, "Teardown: Unable to restore PYTHONPATH")
-			}()
-
-			tmpdir := t.TempDir()
-			sambaCacheDir := filepath.Join(tmpdir, "statedir", "samba")
-			if tc.sambaDirExists {
-				require.NoError(t, os.MkdirAll(sambaCacheDir, 0750), "Setup: Samba cache dir should be created")
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
 			}
 
-			autoenrollCmdOutputFile := filepath.Join(tmpdir, "autoenroll-output")
-			autoenrollCmd := mockAutoenrollScript(t, autoenrollCmdOutputFile, tc.autoenrollScriptError)
+			if tc.ldapFixture == "" {
+				tc.ldapFixture = "basic"
+			}
+			if tc.mockBehaviour == "" {
+				tc.mockBehaviour = "none"
+			}
+			switch tc.serverFQDN {
+			case "":
+				tc.serverFQDN = "adc.example.com"
+			case "-":
+				tc.serverFQDN = ""
+			}
+
+			getcertCmd := testutils.MockCommand(root, "getcert", tc.mockBehaviour, tc.ldapFixture)
+			if tc.getcertNotInstalled {
+				getcertCmd = []string{"/nonexistent/getcert"}
+			}
+			cepcesCmd := testutils.MockCommand(root, "cepces-submit", tc.mockBehaviour, tc.ldapFixture)
+			if tc.cepcesNotInstalled {
+				cepcesCmd = []string{"/nonexistent/cepces-submit"}
+			}
+			updateCACmd := testutils.MockCommand(root, "update-ca-certificates", tc.mockBehaviour, tc.ldapFixture)
+			if tc.updateCANotFound {
+				updateCACmd = []string{""}
+			}
+
+			snapCmd := testutils.MockCommand(root, "snap", tc.mockBehaviour, tc.ldapFixture)
+			gitCmd := testutils.MockCommand(root, "git", tc.mockBehaviour, tc.ldapFixture)
+			if tc.trustCmdsNotInstalled {
+				snapCmd, gitCmd = []string{"/nonexistent/snap"}, []string{"/nonexistent/git"}
+			}
+
+			challengeAddr := freeAddr(t)
+			var acme http.Handler
+			if tc.acmeBehaviour != "" {
+				acme = newACMEServer(t, tc.acmeBehaviour, challengeAddr)
+			}
 
 			m := certificate.New(
 				"example.com",
-				certificate.WithStateDir(filepath.Join(tmpdir, "statedir")),
-				certificate.WithRunDir(filepath.Join(tmpdir, "rundir")),
-				certificate.WithShareDir(filepath.Join(tmpdir, "sharedir")),
-				certificate.WithCertAutoenrollCmd(autoenrollCmd),
+				certificate.WithStateDir(filepath.Join(root, "state")),
+				certificate.WithRunDir(filepath.Join(root, "run")),
+				certificate.WithGlobalTrustDir(filepath.Join(root, "globaltrust")),
+				certificate.WithLdapDialer(testutils.MockDirectory{
+					Root:       root,
+					LDIF:       ldapFixture(filepath.Join("testdata", "ldap", tc.ldapFixture)),
+					FailSearch: tc.mockBehaviour == "ldap-search-fail",
+				}.Dial),
+				certificate.WithGetcertCmd(getcertCmd),
+				certificate.WithCepcesSubmitCmd(cepcesCmd),
+				certificate.WithUpdateCACertificatesCmd(updateCACmd),
+				certificate.WithHTTPClient(&http.Client{Transport: ndesTransport{fixture: tc.ndesFixture, acme: acme}}),
+				certificate.WithACMEChallengeAddr(challengeAddr),
+				certificate.WithSnapCmd(snapCmd),
+				certificate.WithGitCmd(gitCmd),
+				certificate.WithDockerCertsDir(filepath.Join(root, "etc", "docker", "certs.d")),
+				certificate.WithPipConfPath(filepath.Join(root, "etc", "xdg", "pip", "pip.conf")),
+				certificate.WithNpmrcPath(filepath.Join(root, "etc", "npmrc")),
 			)
 
-			err = m.ApplyPolicy(context.Background(), "keypress", !tc.isUser, !tc.isOffline, tc.entries)
+			err := m.ApplyPolicy(context.Background(), "keypress", !tc.isUser, !tc.isOffline, tc.serverFQDN, tc.entries)
 			if tc.wantErr {
 				require.Error(t, err, "ApplyPolicy should fail")
 				return
 			}
 			require.NoError(t, err, "ApplyPolicy should succeed")
 
-			// Check that the autoenroll script was called with the expected arguments
-			// and that the output file was created
-			if !tc.runScript {
-				return
-			}
+			normalizeACMEFiles(t, root)
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
 
-			got, err := os.ReadFile(autoenrollCmdOutputFile)
-			require.NoError(t, err, "Setup: Autoenroll mock output should be readable")
+// ndesTransport serves the responses of the Network Device Enrollment Service from testdata/ndes/<fixture>.
+// The content type is derived from the extension of the file named after the requested host.
+// Requests to the ACME server are forwarded to acme, if set.
+type ndesTransport struct {
+	fixture string
+	acme    http.Handler
+}
 
-			want := testutils.LoadWithUpdateFromGolden(t, string(got))
-			require.Equal(t, want, string(got), "Unexpected output from autoenroll mock")
-		})
+func (tr ndesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Hostname() == "acme.example.com" && tr.acme != nil {
+		rec := httptest.NewRecorder()
+		tr.acme.ServeHTTP(rec, req)
+		resp := rec.Result()
+		resp.Request = req
+		return resp, nil
+	}
+	if tr.fixture == "" {
+		return nil, errors.New("connection refused")
 	}
+
+	contentTypes := map[string]string{
+		".der":  "application/x-x509-ca-cert",
+		".p7b":  "application/x-x509-ca-ra-cert",
+		".html": "text/html; charset=utf-8",
+	}
+	for ext, contentType := range contentTypes {
+		d, err := os.ReadFile(filepath.Join("testdata", "ndes", tr.fixture, req.URL.Hostname()+ext))
+		if err != nil {
+			continue
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header:     http.Header{"Content-Type": []string{contentType}},
+			Body:       io.NopCloser(bytes.NewReader(d)),
+			Request:    req,
+		}, nil
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusNotFound,
+		Status:     "404 Not Found",
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
 }
 
-func mockAutoenrollScript(t *testing.T, scriptOutputFile string, autoenrollScriptError bool) []string {
+// freeAddr returns a local address with a free port, to answer the ACME challenges on.
+func freeAddr(t *testing.T) string {
 	t.Helper()
 
-	cmdArgs := []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockAutoenrollScript", "--", scriptOutputFile}
-	if autoenrollScriptError {
-		cmdArgs = append(cmdArgs, "-Exit1-")
-	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Setup: can't reserve a local port")
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// normalizeACMEFiles replaces the keys and certificates generated during ACME enrollments under root
+// with a stable description, to be compared with the golden files.
+func normalizeACMEFiles(t *testing.T, root string) {
+	t.Helper()
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.Contains(d.Name(), "-ACME.") {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		var desc []string
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				desc = append(desc, block.Type)
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+			desc = append(desc, fmt.Sprintf("CERTIFICATE subject=%q issuer=%q dns=%v", cert.Subject, cert.Issuer, cert.DNSNames))
+		}
+		return os.WriteFile(p, []byte(strings.Join(desc, "\n")+"\n"), 0600)
+	})
+	require.NoError(t, err, "Setup: can't normalize ACME files")
+}
+
+var ldapFilterCNRe = regexp.MustCompile(`^\(cn=(.*)\)$`)
 
-	return cmdArgs
+// ldapFixture returns the LDIF of the directory entries stored in fixtureDir matching a search.
+func ldapFixture(fixtureDir string) func(*ldap.SearchRequest) (string, bool) {
+	return func(req *ldap.SearchRequest) (string, bool) {
+		var p string
+		switch {
+		case req.BaseDN == "":
+			p = filepath.Join(fixtureDir, "rootdse.ldif")
+		case strings.HasPrefix(req.BaseDN, "CN=Enrollment Services,"):
+			p = filepath.Join(fixtureDir, "enrollment-services.ldif")
+		case strings.HasPrefix(req.BaseDN, "CN=Certificate Templates,"):
+			m := ldapFilterCNRe.FindStringSubmatch(req.Filter)
+			if m == nil {
+				return "", false
+			}
+			p = filepath.Join(fixtureDir, "templates", m[1]+".ldif")
+		default:
+			p = filepath.Join(fixtureDir, "domain.ldif")
+		}
+		d, err := os.ReadFile(p)
+		if err != nil {
+			return "", false
+		}
+		return string(d), true
+	}
 }
 
-func TestMockAutoenrollScript(t *testing.T) {
-	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
 		return
 	}
 	defer os.Exit(0)
 
-	var outputFile string
+	name, root, fixture, behaviour, args := c.Name, c.Root, c.Args[0], c.Behaviour, c.Args[1:]
 
-	args := os.Args
-	for len(args) > 0 {
-		if args[0] == "--" {
-			outputFile = args[1]
-			args = args[2:]
-			break
+	// Log the call, replacing the temporary paths to get a stable output.
+	var env []string
+	for _, v := range []string{"CERTMONGER_OPERATION", "KRB5CCNAME"} {
+		if os.Getenv(v) != "" {
+			env = append(env, fmt.Sprintf("%s=%s", v, os.Getenv(v)))
 		}
-		args = args[1:]
 	}
-
-	if args[0] == "-Exit1-" {
-		fmt.Fprintf(os.Stderr, "EXIT 1 requested in mock")
-		os.Exit(1)
+	line := strings.Join(append(env, name), " ")
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
 	}
+	line = strings.ReplaceAll(line, os.Args[0], "#TESTBIN#")
+	line = strings.ReplaceAll(line, root, "#ROOT#")
+
+	c.Log(line)
 
-	dataToWrite := strings.Join(args, " ") + "\n"
-	dataToWrite += "KRB5CCNAME=" + os.Getenv("KRB5CCNAME") + "\n"
-	dataToWrite += "PYTHONPATH=" + os.Getenv("PYTHONPATH") + "\n"
+	fixtureDir := filepath.Join("testdata", "ldap", fixture)
+	switch name {
+	case "cepces-submit":
+		if behaviour == "cepces-fail" {
+			fmt.Fprintln(os.Stderr, "Failed to contact the enrollment server")
+			os.Exit(3)
+		}
+		d, err := os.ReadFile(filepath.Join(fixtureDir, "supported-templates"))
+		if err != nil {
+			os.Exit(0)
+		}
+		fmt.Print(string(d))
 
-	// Replace tmpdir with a placeholder to avoid non-deterministic test failures
-	tmpdir := filepath.Dir(outputFile)
-	dataToWrite = strings.ReplaceAll(dataToWrite, tmpdir, "#TMPDIR#")
+	case "getcert":
+		switch behaviour {
+		case "getcert-fail":
+			fmt.Fprintln(os.Stderr, "Error connecting to DBus.")
+			os.Exit(3)
+		case "getcert-exists":
+			fmt.Fprintln(os.Stderr, "Already exists.")
+			os.Exit(2)
+		}
 
-	err := os.WriteFile(outputFile, []byte(dataToWrite), 0600)
-	require.NoError(t, err, "Setup: Can't write script args to output file")
-}
+	case "update-ca-certificates":
+		if behaviour == "update-ca-fail" {
+			fmt.Fprintln(os.Stderr, "Failed to rehash certificates")
+			os.Exit(1)
+		}
 
-func TestMain(m *testing.M) {
-	m.Run()
-	testutils.MergeCoverages()
+	case "snap", "git":
+		if behaviour == "trust-cmds-fail" {
+			fmt.Fprintln(os.Stderr, "error: permission denied")
+			os.Exit(1)
+		}
+		// git exits with 5 when unsetting an option which isn't set.
+		if name == "git" && slices.Contains(args, "--unset") && behaviour == "git-not-set" {
+			os.Exit(5)
+		}
+	}
 }
@@ -0,0 +1,886 @@
+package certificate
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+)
+
+const (
+	policyServersKey = "Software/Policies/Microsoft/Cryptography/PolicyServers/"
+	ldapEndpointURL  = "LDAP:"
+
+	// See [MS-CAESO] 4.4.5.3.2.2.
+	autoEnrollmentEnabledFlag int = 0x10
+	authAnonymous             int = 0x1
+	authKerberos              int = 0x2
+
+	defaultAuth    = "Kerberos"
+	defaultKeySize = "2048"
+
+	protocolXCEP = "xcep"
+	protocolSCEP = "scep"
+	protocolACME = "acme"
+
+	// machineTemplate is the template name given to the machine certificate requested with SCEP or ACME,
+	// which don't rely on certificate templates.
+	machineTemplate = "Machine"
+
+	// legacySambaCacheDir is the state directory used by the previous Samba based implementation.
+	legacySambaCacheDir = "samba"
+)
+
+// endpointRe matches the URL of a certificate enrollment policy web service.
+var endpointRe = regexp.MustCompile(`^(https|HTTPS)://(?P<server>[a-zA-Z0-9.-]+)/ADPolicyProvider_CEP_(?P<auth>[a-zA-Z]+)/service.svc/CEP`)
+
+// certmongerHelpersDirs are the directories where cepces-submit can be installed, in addition to PATH.
+var certmongerHelpersDirs = []string{"/usr/lib/certmonger", "/usr/libexec/certmonger"}
+
+// endpoint is a certificate enrollment policy end point, as described in [MS-CAESO] 4.4.5.3.2.2.
+type endpoint struct {
+	url       string
+	policyID  string
+	cost      int
+	authFlags int
+	flags     int
+
+	// ca is only set for https end points.
+	ca certificationAuthority
+}
+
+// certificationAuthority is a certification authority the machine can enroll for certificates with.
+type certificationAuthority struct {
+	name     string
+	hostname string
+	auth     string
+	// caCertificate is the DER encoded certificate published in the directory, if any.
+	caCertificate []byte
+
+	// protocol is the enrollment protocol, empty for MS-XCEP, and url the address of the SCEP server
+	// or ACME directory.
+	protocol string
+	url      string
+	// scepChallenge is the optional SCEP challenge password.
+	scepChallenge string
+	// eabKID and eabKey are the optional ACME External Account Binding credentials.
+	eabKID string
+	eabKey []byte
+}
+
+// caState is the enrollment state of a certification authority, stored to be able to unenroll from it.
+type caState struct {
+	Hostname         string   `json:"hostname"`
+	Auth             string   `json:"auth"`
+	CACertificate    []byte   `json:"ca_certificate,omitempty"`
+	RootCertificates []string `json:"root_certificates,omitempty"`
+	Templates        []string `json:"templates,omitempty"`
+	Protocol         string   `json:"protocol,omitempty"`
+	URL              string   `json:"url,omitempty"`
+}
+
+// enrollment holds the context of a single enrollment or unenrollment for an object.
+type enrollment struct {
+	*Manager
+
+	objectName      string
+	server          string
+	cepcesSubmitCmd []string
+	updateCACmd     []string
+
+	state map[string]caState
+}
+
+// newEnrollment loads the current enrollment state of objectName and resolves the commands to use.
+func (m *Manager) newEnrollment(objectName, server string) (*enrollment, error) {
+	state, err := m.loadState(objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &enrollment{
+		Manager:         m,
+		objectName:      objectName,
+		server:          server,
+		cepcesSubmitCmd: m.cepcesSubmitCmd,
+		updateCACmd:     m.updateCACmd,
+		state:           state,
+	}
+	if e.cepcesSubmitCmd == nil {
+		e.cepcesSubmitCmd = []string{lookPath("cepces-submit", certmongerHelpersDirs...)}
+	}
+	if e.updateCACmd == nil {
+		e.updateCACmd = []string{lookPath("update-ca-certificates")}
+		if e.updateCACmd[0] == "" {
+			e.updateCACmd = []string{lookPath("update-ca-trust")}
+		}
+	}
+	return e, nil
+}
+
+// enroll enrolls objectName with the certification authorities returned by discover, using protocol.
+// Any certification authority previously enrolled with but not available anymore is unenrolled.
+func (m *Manager) enroll(ctx context.Context, objectName, server, protocol string, discover func(*enrollment) ([]certificationAuthority, error)) (err error) {
+	e, err := m.newEnrollment(objectName, server)
+	if err != nil {
+		return err
+	}
+
+	switch protocol {
+	case protocolXCEP:
+		if !isInstalled(e.getcertCmd) || !isInstalled(e.cepcesSubmitCmd) {
+			log.Warning(ctx, gotext.Get("certmonger and/or cepces not found, skipping certificate enrollment"))
+			return nil
+		}
+	case protocolSCEP:
+		if !isInstalled(e.getcertCmd) {
+			log.Warning(ctx, gotext.Get("certmonger not found, skipping certificate enrollment"))
+			return nil
+		}
+	}
+
+	// Create needed directories if they don't exist
+	for _, dir := range []string{e.trustDir, e.privateDir, e.globalTrustDir} {
+		perm := os.FileMode(0755)
+		if dir == e.privateDir {
+			perm = 0700
+		}
+		if err := os.MkdirAll(dir, perm); err != nil {
+			return err
+		}
+	}
+
+	// Always save the state, even partial, to be able to unenroll later on.
+	defer func() {
+		if errSave := e.saveState(); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+	}()
+
+	cas, err := discover(e)
+	if err != nil {
+		return err
+	}
+
+	var caNames []string
+	for _, ca := range cas {
+		if err := e.apply(ctx, ca); err != nil {
+			return err
+		}
+		caNames = append(caNames, ca.name)
+	}
+
+	// Cleanup any old certification authorities that have been removed
+	for _, name := range e.enrolledCAs() {
+		if slices.Contains(caNames, name) {
+			continue
+		}
+		if err := e.unapply(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unenroll removes every certificate and certification authority objectName is enrolled with.
+func (m *Manager) unenroll(ctx context.Context, objectName string) (err error) {
+	e, err := m.newEnrollment(objectName, "")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if errSave := e.saveState(); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+	}()
+
+	for _, name := range e.enrolledCAs() {
+		if err := e.unapply(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseProtocol returns the certification authority to enroll with if another protocol than MS-XCEP
+// is configured in entries. Its protocol is protocolXCEP otherwise, and the certification authorities
+// are discovered from the directory or the end points.
+func parseProtocol(entries []entry.Entry) (ca certificationAuthority, err error) {
+	settings := make(map[string]string)
+	for _, e := range entries {
+		name, found := strings.CutPrefix(e.Key, "certificate/")
+		if !found || e.Disabled {
+			continue
+		}
+		settings[name] = strings.TrimSpace(e.Value)
+	}
+
+	ca.protocol = strings.ToLower(settings["protocol"])
+	switch ca.protocol {
+	case "", protocolXCEP:
+		ca.protocol = protocolXCEP
+		return ca, nil
+	case protocolSCEP:
+		ca.url = settings["scep-url"]
+		ca.scepChallenge = settings["scep-challenge"]
+	case protocolACME:
+		ca.url = settings["acme-directory"]
+		ca.eabKID = settings["acme-eab-kid"]
+		if k := settings["acme-eab-hmac-key"]; k != "" {
+			if ca.eabKey, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(k, "=")); err != nil {
+				return ca, errors.New(gotext.Get("invalid ACME External Account Binding HMAC key: %v", err))
+			}
+		}
+		if (ca.eabKID == "") != (ca.eabKey == nil) {
+			return ca, errors.New(gotext.Get("both the ACME External Account Binding key ID and HMAC key are required"))
+		}
+	default:
+		return ca, errors.New(gotext.Get("unsupported enrollment protocol %q: only %s, %s and %s are supported", ca.protocol, protocolXCEP, protocolSCEP, protocolACME))
+	}
+
+	u, err := url.Parse(ca.url)
+	if ca.url == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ca, errors.New(gotext.Get("invalid %s server URL %q", ca.protocol, ca.url))
+	}
+	ca.hostname = u.Hostname()
+	ca.name = strings.ReplaceAll(ca.hostname, ".", "-") + "-" + strings.ToUpper(ca.protocol)
+
+	return ca, nil
+}
+
+// parseEndpoints returns the certificate enrollment policy end points configured in entries,
+// grouped and sorted as described in [MS-CAESO] 4.4.5.3.2.3.
+func parseEndpoints(ctx context.Context, entries []entry.Entry) ([][]endpoint, error) {
+	var ids []string
+	endpoints := make(map[string]*endpoint)
+	for _, e := range entries {
+		id, valueName, found := strings.Cut(strings.TrimPrefix(e.Key, policyServersKey), "/")
+		if !strings.HasPrefix(e.Key, policyServersKey) || !found {
+			// Not an end point setting or global setting of the policy servers.
+			continue
+		}
+
+		log.Debugf(ctx, "Certificate policy entry: %#v", e)
+
+		ep, ok := endpoints[id]
+		if !ok {
+			ep = &endpoint{}
+			endpoints[id] = ep
+			ids = append(ids, id)
+		}
+
+		var err error
+		switch valueName {
+		case "URL":
+			ep.url = e.Value
+		case "PolicyID":
+			ep.policyID = e.Value
+		case "Cost":
+			ep.cost, err = strconv.Atoi(e.Value)
+		case "AuthFlags":
+			ep.authFlags, err = strconv.Atoi(e.Value)
+		case "Flags":
+			ep.flags, err = strconv.Atoi(e.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, id := range ids {
+		ep := endpoints[id]
+		if strings.EqualFold(ep.url, ldapEndpointURL) {
+			continue
+		}
+		m := endpointRe.FindStringSubmatch(ep.url)
+		if m == nil {
+			log.Warning(ctx, gotext.Get("Failed to parse the certificate enrollment policy end point %q, ignoring advanced configuration", ep.url))
+			return nil, nil
+		}
+		server := m[endpointRe.SubexpIndex("server")]
+		ep.ca = certificationAuthority{
+			name:     strings.ReplaceAll(server, ".", "-") + "-CA",
+			hostname: server,
+			auth:     m[endpointRe.SubexpIndex("auth")],
+		}
+	}
+
+	// Group the end points by policy ID, in order of appearance.
+	var policyIDs []string
+	groups := make(map[string][]endpoint)
+	for _, id := range ids {
+		ep := endpoints[id]
+		if _, ok := groups[ep.policyID]; !ok {
+			policyIDs = append(policyIDs, ep.policyID)
+		}
+		groups[ep.policyID] = append(groups[ep.policyID], *ep)
+	}
+
+	var r [][]endpoint
+	for _, policyID := range policyIDs {
+		group := groups[policyID]
+		// Sort by cost, then Kerberos authentication first, followed by anonymous authentication.
+		slices.SortStableFunc(group, func(a, b endpoint) int {
+			if c := cmp.Compare(a.cost, b.cost); c != 0 {
+				return c
+			}
+			return cmp.Compare(authOrder(a.authFlags), authOrder(b.authFlags))
+		})
+		r = append(r, group)
+	}
+
+	return r, nil
+}
+
+// authOrder returns the sort order of an end point based on its authentication flags.
+func authOrder(authFlags int) int {
+	switch authFlags {
+	case authKerberos:
+		return 0
+	case authAnonymous:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// readCEPData returns the certification authorities to enroll with from the end point groups,
+// as described in [MS-CAESO] 4.4.5.3.2.4.
+func (e *enrollment) readCEPData(ctx context.Context, endpointGroups [][]endpoint) ([]certificationAuthority, error) {
+	var cas []certificationAuthority
+	for _, group := range endpointGroups {
+		// Any end point of the group can be used to check the group configuration.
+		ep := group[0]
+		if ep.flags&autoEnrollmentEnabledFlag != autoEnrollmentEnabledFlag {
+			log.Debugf(ctx, "Autoenrollment is not enabled for certificate enrollment policy %q, skipping", ep.policyID)
+			continue
+		}
+
+		if slices.ContainsFunc(group, func(ep endpoint) bool { return strings.EqualFold(ep.url, ldapEndpointURL) }) {
+			// The policy ID must match the forest root domain objectGUID.
+			guid, err := e.rootDomainGUID(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.EqualFold(guid, ep.policyID) {
+				log.Debugf(ctx, "Certificate enrollment policy %q does not match forest root domain %q, skipping", ep.policyID, guid)
+				continue
+			}
+		}
+
+		for _, ep := range group {
+			if !strings.EqualFold(ep.url, ldapEndpointURL) {
+				cas = append(cas, ep.ca)
+				continue
+			}
+			// This is a basic configuration.
+			ldapCAs, err := e.fetchCertificationAuthorities(ctx)
+			if err != nil {
+				return nil, err
+			}
+			cas = append(cas, ldapCAs...)
+		}
+	}
+
+	return cas, nil
+}
+
+// apply enrolls with the certification authority if not already enrolled with it.
+// If the certification authority changed since the last enrollment, the machine is unenrolled first.
+func (e *enrollment) apply(ctx context.Context, ca certificationAuthority) error {
+	if ca.protocol == protocolACME {
+		return e.applyACME(ctx, ca)
+	}
+
+	if old, ok := e.state[ca.name]; ok {
+		templates := []string{machineTemplate}
+		if ca.protocol != protocolSCEP {
+			templates = e.supportedTemplates(ctx, ca.hostname)
+		}
+		if old.Hostname == ca.hostname && old.Auth == ca.auth && old.URL == ca.url && old.Protocol == ca.protocol &&
+			bytes.Equal(old.CACertificate, ca.caCertificate) && slices.Equal(old.Templates, templates) {
+			log.Debugf(ctx, "Already enrolled with certification authority %q, skipping", ca.name)
+			return nil
+		}
+
+		log.Info(ctx, gotext.Get("Certification authority %q changed, renewing enrollment", ca.name))
+		if err := e.unapply(ctx, ca.name); err != nil {
+			return err
+		}
+	}
+
+	log.Info(ctx, gotext.Get("Enrolling with certification authority %q", ca.name))
+
+	s := caState{
+		Hostname:      ca.hostname,
+		Auth:          ca.auth,
+		CACertificate: ca.caCertificate,
+		Protocol:      ca.protocol,
+		URL:           ca.url,
+	}
+	// Store the state as soon as possible to allow a partial enrollment to be reverted.
+	defer func() { e.state[ca.name] = s }()
+
+	rootCerts, err := e.installRootCertificates(ctx, ca)
+	if err != nil {
+		return err
+	}
+	for _, p := range rootCerts {
+		s.RootCertificates = append(s.RootCertificates, filepath.Base(p))
+		e.linkToGlobalTrustDir(ctx, p)
+	}
+	if len(rootCerts) > 0 {
+		e.updateCATrust(ctx)
+	}
+
+	if ca.protocol == protocolSCEP {
+		if err := e.getcert(ctx, gotext.Get("add certification authority %q", ca.name), "add-scep-ca", "-c", ca.name, "-u", ca.url); err != nil {
+			return err
+		}
+		nickname := ca.name + "." + machineTemplate
+		args := []string{"request",
+			"-c", ca.name,
+			"-I", nickname,
+			"-k", filepath.Join(e.privateDir, nickname+".key"),
+			"-f", filepath.Join(e.trustDir, nickname+".crt"),
+			"-g", defaultKeySize}
+		if ca.scepChallenge != "" {
+			args = append(args, "-L", ca.scepChallenge)
+		}
+		if err := e.getcert(ctx, gotext.Get("request certificate %q", nickname), args...); err != nil {
+			return err
+		}
+		s.Templates = append(s.Templates, machineTemplate)
+		e.updateCATrust(ctx)
+		return nil
+	}
+
+	// Setup certificate autoenrollment
+	submitCmd := fmt.Sprintf("%s --server=%s --auth=%s", strings.Join(e.cepcesSubmitCmd, " "), ca.hostname, ca.auth)
+	if err := e.getcert(ctx, gotext.Get("add certification authority %q", ca.name), "add-ca", "-c", ca.name, "-e", submitCmd); err != nil {
+		return err
+	}
+
+	for _, template := range e.supportedTemplates(ctx, ca.hostname) {
+		keySize, err := e.templateKeySize(ctx, template)
+		if err != nil {
+			return err
+		}
+
+		nickname := ca.name + "." + template
+		if err := e.getcert(ctx, gotext.Get("request certificate %q", nickname), "request",
+			"-c", ca.name,
+			"-T", template,
+			"-I", nickname,
+			"-k", filepath.Join(e.privateDir, nickname+".key"),
+			"-f", filepath.Join(e.trustDir, nickname+".crt"),
+			"-g", keySize); err != nil {
+			return err
+		}
+		s.Templates = append(s.Templates, template)
+	}
+	e.updateCATrust(ctx)
+
+	return nil
+}
+
+// unapply stops monitoring the certificates of the certification authority and removes all related files.
+func (e *enrollment) unapply(ctx context.Context, name string) error {
+	log.Info(ctx, gotext.Get("Unenrolling from certification authority %q", name))
+
+	s := e.state[name]
+	// Certificates enrolled with ACME are not monitored by certmonger.
+	if s.Protocol != protocolACME && isInstalled(e.getcertCmd) {
+		if err := e.getcert(ctx, gotext.Get("remove certification authority %q", name), "remove-ca", "-c", name); err != nil {
+			return err
+		}
+		for _, template := range s.Templates {
+			nickname := name + "." + template
+			if err := e.getcert(ctx, gotext.Get("stop tracking certificate %q", nickname), "stop-tracking", "-i", nickname); err != nil {
+				return err
+			}
+		}
+	}
+
+	var files []string
+	for _, template := range s.Templates {
+		nickname := name + "." + template
+		files = append(files, filepath.Join(e.privateDir, nickname+".key"), filepath.Join(e.trustDir, nickname+".crt"))
+	}
+	for _, rootCert := range s.RootCertificates {
+		files = append(files, filepath.Join(e.trustDir, rootCert), filepath.Join(e.globalTrustDir, rootCert))
+	}
+	if s.Protocol == protocolACME {
+		files = append(files, e.acmeAccountKeyPath(name))
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	delete(e.state, name)
+
+	if len(s.RootCertificates) > 0 {
+		e.updateCATrust(ctx)
+	}
+	return nil
+}
+
+// getcert runs the certmonger getcert command with args.
+// Failures are only logged as certmonger will retry on its own, action being used to describe them.
+func (e *enrollment) getcert(ctx context.Context, action string, args ...string) error {
+	stdout, stderr, exitCode, err := syshelpers.RunWithStatus(ctx, e.cmdTimeout, e.getcertCmd, syshelpers.CmdOptions{}, args...)
+	if err != nil {
+		return errors.New(gotext.Get("failed to run getcert: %v", err))
+	}
+	log.Debugf(ctx, "getcert %s: %s", args[0], strings.TrimSpace(stdout))
+
+	switch exitCode {
+	case 0:
+	case 2:
+		// The certification authority or certificate is already known by certmonger.
+		log.Debugf(ctx, "Can't %s: already exists", action)
+	default:
+		log.Warning(ctx, gotext.Get("Failed to %s (exited with %d): %s", action, exitCode, stderr))
+	}
+	return nil
+}
+
+// supportedTemplates returns the certificate templates supported by the enrollment server hostname.
+func (e *enrollment) supportedTemplates(ctx context.Context, hostname string) []string {
+	stdout, stderr, exitCode, err := syshelpers.RunWithStatus(ctx, e.cmdTimeout, e.cepcesSubmitCmd,
+		syshelpers.CmdOptions{Env: []string{"CERTMONGER_OPERATION=GET-SUPPORTED-TEMPLATES", "KRB5CCNAME=" + e.krb5CCName()}},
+		"--server="+hostname, "--auth="+defaultAuth)
+	if err != nil || exitCode != 0 {
+		if err != nil {
+			stderr = err.Error()
+		}
+		log.Warning(ctx, gotext.Get("Failed to fetch the list of supported templates from %q: %s", hostname, stderr))
+	}
+	return strings.Fields(stdout)
+}
+
+// installRootCertificates fetches the root certificate chain of the certification authority
+// and writes it in the trust directory, returning the paths of the written certificates.
+// If the chain can't be fetched from the Network Device Enrollment Service (NDES), the
+// certificate published in the directory is installed instead.
+func (e *enrollment) installRootCertificates(ctx context.Context, ca certificationAuthority) ([]string, error) {
+	log.Debugf(ctx, "Fetching root certificates of %q", ca.name)
+
+	// NDES is the Microsoft implementation of SCEP.
+	getCACertURL := fmt.Sprintf("http://%s/CertSrv/mscep/mscep.dll/pkiclient.exe?operation=GetCACert&message=CAIdentifier", ca.hostname)
+	if ca.protocol == protocolSCEP {
+		getCACertURL = scepGetCACertURL(ca.url)
+	}
+	data, contentType, err := e.httpGet(ctx, getCACertURL)
+	if err != nil || len(data) == 0 || contentType == "text/html" {
+		if err != nil {
+			log.Debugf(ctx, "Could not connect to SCEP server: %v", err)
+		}
+		if ca.protocol == protocolSCEP {
+			log.Warning(ctx, gotext.Get("Unable to fetch root certificates of %q from the SCEP server", ca.name))
+		} else {
+			log.Warning(ctx, gotext.Get("Unable to fetch root certificates of %q (requires NDES)", ca.name))
+		}
+		if ca.caCertificate == nil {
+			return nil, nil
+		}
+		log.Warning(ctx, gotext.Get("Installing the server certificate only"))
+		data, contentType = ca.caCertificate, "application/x-x509-ca-cert"
+	}
+
+	var certs [][]byte
+	switch contentType {
+	case "application/x-x509-ca-cert":
+		certs = [][]byte{data}
+	case "application/x-x509-ca-ra-cert":
+		if certs, err = parsePKCS7Certificates(data); err != nil {
+			return nil, errors.New(gotext.Get("invalid certificate chain for %q: %v", ca.name, err))
+		}
+	default:
+		log.Warning(ctx, gotext.Get("Wrong or missing content type %q for root certificates of %q", contentType, ca.name))
+		return nil, nil
+	}
+
+	var paths []string
+	for i, der := range certs {
+		if _, err := x509.ParseCertificate(der); err != nil {
+			return nil, errors.New(gotext.Get("invalid root certificate for %q: %v", ca.name, err))
+		}
+
+		p := filepath.Join(e.trustDir, ca.name+".crt")
+		if contentType == "application/x-x509-ca-ra-cert" {
+			p = filepath.Join(e.trustDir, fmt.Sprintf("%s.%d.crt", ca.name, i))
+		}
+		// #nosec G306 - root certificates are public
+		if err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+
+	return paths, nil
+}
+
+// scepGetCACertURL returns the URL of the GetCACert operation of the SCEP server at serverURL.
+func scepGetCACertURL(serverURL string) string {
+	sep := "?"
+	if strings.Contains(serverURL, "?") {
+		sep = "&"
+	}
+	return serverURL + sep + "operation=GetCACert&message=CAIdentifier"
+}
+
+// httpGet returns the body and media type of the response to a GET request on url.
+func (e *enrollment) httpGet(ctx context.Context, url string) (data []byte, mediaType string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New(resp.Status)
+	}
+	if data, err = io.ReadAll(resp.Body); err != nil {
+		return nil, "", err
+	}
+	mediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return data, mediaType, nil
+}
+
+// linkToGlobalTrustDir symlinks the root certificate p to the global trust directory.
+// Failures are only logged, as the certificate is still available for applications
+// using the trust directory.
+func (e *enrollment) linkToGlobalTrustDir(ctx context.Context, p string) {
+	dst := filepath.Join(e.globalTrustDir, filepath.Base(p))
+	// Use a relative link so that it stays valid when both directories are relocated together.
+	target, err := filepath.Rel(e.globalTrustDir, p)
+	if err != nil {
+		target = p
+	}
+
+	err = os.Symlink(target, dst)
+	// If we're simply downloading a renewed certificate, the symlink already exists.
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		log.Warning(ctx, gotext.Get("Failed to symlink root certificate to the global trust directory: %v", err))
+		return
+	}
+	log.Debugf(ctx, "Created symlink: %s -> %s", dst, target)
+}
+
+// updateCATrust refreshes the system trust store, if the command to do it is available.
+func (e *enrollment) updateCATrust(ctx context.Context) {
+	if !isInstalled(e.updateCACmd) {
+		log.Debug(ctx, "No command to update the system trust store found, skipping")
+		return
+	}
+
+	log.Debugf(ctx, "Running %s", strings.Join(e.updateCACmd, " "))
+	_, stderr, exitCode, err := syshelpers.RunWithStatus(ctx, e.cmdTimeout, e.updateCACmd, syshelpers.CmdOptions{})
+	if err != nil {
+		stderr = err.Error()
+	}
+	if err != nil || exitCode != 0 {
+		log.Warning(ctx, gotext.Get("Failed to update the system trust store: %s", stderr))
+	}
+}
+
+// enrolledCAs returns the sorted names of the certification authorities the object is enrolled with.
+func (e *enrollment) enrolledCAs() []string {
+	var names []string
+	for name := range e.state {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// statePath returns the path of the enrollment state of objectName.
+func (m *Manager) statePath(objectName string) string {
+	return filepath.Join(m.stateDir, "certificate", objectName)
+}
+
+// hasState returns true if objectName was enrolled, including by the previous Samba based implementation.
+func (m *Manager) hasState(objectName string) bool {
+	for _, p := range []string{m.statePath(objectName), filepath.Join(m.stateDir, legacySambaCacheDir)} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// loadState returns the enrollment state of objectName.
+func (m *Manager) loadState(objectName string) (map[string]caState, error) {
+	state := make(map[string]caState)
+
+	d, err := os.ReadFile(m.statePath(objectName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m.legacyState()
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(d, &state); err != nil {
+		return nil, errors.New(gotext.Get("invalid certificate enrollment state: %v", err))
+	}
+	return state, nil
+}
+
+// legacyState rebuilds the enrollment state from the files created by the previous Samba
+// based implementation, if its cache is still present on the disk.
+// Certificates are named <ca>.<template>.crt while root certificates are named <ca>.crt,
+// or <ca>.<n>.crt when part of a chain.
+func (m *Manager) legacyState() (map[string]caState, error) {
+	state := make(map[string]caState)
+	if _, err := os.Stat(filepath.Join(m.stateDir, legacySambaCacheDir)); err != nil {
+		return state, nil
+	}
+
+	keys, err := filepath.Glob(filepath.Join(m.privateDir, "*.key"))
+	if err != nil {
+		return nil, err
+	}
+	var nicknames []string
+	for _, k := range keys {
+		nickname := strings.TrimSuffix(filepath.Base(k), ".key")
+		name, template, found := cutLast(nickname, ".")
+		if !found {
+			continue
+		}
+		s := state[name]
+		s.Templates = append(s.Templates, template)
+		state[name] = s
+		nicknames = append(nicknames, nickname)
+	}
+
+	certs, err := filepath.Glob(filepath.Join(m.trustDir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range certs {
+		base := filepath.Base(c)
+		name := strings.TrimSuffix(base, ".crt")
+		if slices.Contains(nicknames, name) {
+			continue
+		}
+		if n, suffix, found := cutLast(name, "."); found {
+			if _, err := strconv.Atoi(suffix); err == nil {
+				name = n
+			}
+		}
+		s := state[name]
+		s.RootCertificates = append(s.RootCertificates, base)
+		state[name] = s
+	}
+
+	return state, nil
+}
+
+// saveState stores the enrollment state, or removes it if the object is not enrolled anymore.
+// Any cache from the previous Samba based implementation is removed as it is now superseded.
+func (e *enrollment) saveState() error {
+	if err := os.RemoveAll(filepath.Join(e.stateDir, legacySambaCacheDir)); err != nil {
+		return err
+	}
+
+	p := e.statePath(e.objectName)
+	if len(e.state) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(e.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// krb5CCName returns the path of the Kerberos ticket of the object being enrolled.
+func (e *enrollment) krb5CCName() string {
+	return filepath.Join(e.krb5CacheDir, e.objectName)
+}
+
+// parsePKCS7Certificates returns the DER encoded certificates contained in a degenerate
+// PKCS#7 signed data structure, as returned by NDES for certificate chains.
+func parsePKCS7Certificates(data []byte) ([][]byte, error) {
+	var contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(data, &contentInfo); err != nil {
+		return nil, err
+	}
+
+	// Additional fields (CRLs and signer infos) are ignored.
+	var signedData struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return nil, err
+	}
+	if signedData.Certificates.Class != asn1.ClassContextSpecific || signedData.Certificates.Tag != 0 {
+		return nil, errors.New(gotext.Get("no certificate found"))
+	}
+
+	certs, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	var r [][]byte
+	for _, c := range certs {
+		r = append(r, c.Raw)
+	}
+	return r, nil
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i == -1 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
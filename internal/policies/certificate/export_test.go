@@ -0,0 +1,17 @@
+package certificate
+
+import "net/http"
+
+// WithHTTPClient overrides the default HTTP client used to fetch root certificates.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// WithACMEChallengeAddr overrides the address on which http-01 challenges are answered.
+func WithACMEChallengeAddr(addr string) Option {
+	return func(o *options) {
+		o.acmeChallengeAddr = addr
+	}
+}
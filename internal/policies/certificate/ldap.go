@@ -0,0 +1,103 @@
+package certificate
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/ldaphelpers"
+)
+
+const publicKeyServicesDN = "CN=Public Key Services,CN=Services,CN=Configuration"
+
+// ldapSearch searches the directory for entries matching filter under base, returning the requested attributes.
+// The search authenticates against the server with the Kerberos ticket of the object being enrolled.
+func (e *enrollment) ldapSearch(ctx context.Context, base, scope, filter string, attrs ...string) ([]ldaphelpers.Entry, error) {
+	c := ldaphelpers.Client{
+		URL:        "ldaps://" + e.server,
+		Krb5CCName: e.krb5CCName(),
+		Timeout:    e.ldapTimeout,
+		Dial:       e.ldapDial,
+	}
+	return c.Search(ctx, base, scope, filter, attrs...)
+}
+
+// fetchCertificationAuthorities returns the certification authorities published in the directory,
+// as described in [MS-CAESO] 4.4.5.3.1.2.
+func (e *enrollment) fetchCertificationAuthorities(ctx context.Context) ([]certificationAuthority, error) {
+	entries, err := e.ldapSearch(ctx, "CN=Enrollment Services,"+publicKeyServicesDN+","+ldaphelpers.DomainDN(e.domain), "sub",
+		"(objectClass=pKIEnrollmentService)", "cACertificate", "cn", "dNSHostName")
+	if err != nil {
+		return nil, err
+	}
+
+	var cas []certificationAuthority
+	for _, entry := range entries {
+		ca := certificationAuthority{
+			name:     entry.First("cn"),
+			hostname: entry.First("dNSHostName"),
+			auth:     defaultAuth,
+		}
+		if ca.name == "" || ca.hostname == "" {
+			log.Warning(ctx, gotext.Get("Ignoring enrollment service %q without name or host name", ca.name))
+			continue
+		}
+		if c := entry.First("cACertificate"); c != "" {
+			ca.caCertificate = []byte(c)
+		}
+		cas = append(cas, ca)
+	}
+
+	if len(cas) == 0 {
+		log.Info(ctx, gotext.Get("No certification authority found in the directory"))
+	}
+	return cas, nil
+}
+
+// templateKeySize returns the minimal key size of the certificate template name.
+func (e *enrollment) templateKeySize(ctx context.Context, name string) (string, error) {
+	entries, err := e.ldapSearch(ctx, "CN=Certificate Templates,"+publicKeyServicesDN+","+ldaphelpers.DomainDN(e.domain), "sub",
+		fmt.Sprintf("(cn=%s)", ldaphelpers.Escape(name)), "msPKI-Minimal-Key-Size")
+	if err != nil {
+		return "", err
+	}
+
+	if len(entries) != 1 || entries[0].First("msPKI-Minimal-Key-Size") == "" {
+		return defaultKeySize, nil
+	}
+	return entries[0].First("msPKI-Minimal-Key-Size"), nil
+}
+
+// rootDomainGUID returns the objectGUID of the forest root domain, formatted as a policy ID.
+func (e *enrollment) rootDomainGUID(ctx context.Context) (string, error) {
+	entries, err := e.ldapSearch(ctx, "", "base", "(objectClass=*)", "rootDomainNamingContext")
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 || entries[0].First("rootDomainNamingContext") == "" {
+		return "", nil
+	}
+
+	entries, err = e.ldapSearch(ctx, entries[0].First("rootDomainNamingContext"), "base", "(objectClass=*)", "objectGUID")
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 {
+		return "", nil
+	}
+
+	guid := []byte(entries[0].First("objectGUID"))
+	if len(guid) != 16 {
+		return "", errors.New(gotext.Get("invalid objectGUID for forest root domain: %x", guid))
+	}
+	// The first 3 parts of the GUID are stored in little endian.
+	return fmt.Sprintf("{%08X-%04X-%04X-%X-%X}",
+		binary.LittleEndian.Uint32(guid[0:4]),
+		binary.LittleEndian.Uint16(guid[4:6]),
+		binary.LittleEndian.Uint16(guid[6:8]),
+		guid[8:10],
+		guid[10:16]), nil
+}
@@ -0,0 +1,346 @@
+package certificate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+// Applications with their own trust store the root certificates can be propagated to.
+const (
+	trustSnapd  = "snapd"
+	trustDocker = "docker"
+	trustPip    = "pip"
+	trustNpm    = "npm"
+	trustGit    = "git"
+)
+
+const (
+	// snapdStoreCertsOption is the snapd system option holding the root certificates, used to reach the store.
+	snapdStoreCertsOption = "store-certs.adsys"
+	// dockerCAFile is the name of the file holding the root certificates in the directory of each registry.
+	dockerCAFile = "adsys-ca.crt"
+	// gitCAInfoOption is the git configuration option setting the certificates trusted over HTTPS.
+	gitCAInfoOption = "http.sslCAInfo"
+)
+
+const trustHeader = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// registryRe matches a registry host name or address, with an optional port.
+var registryRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?(:[0-9]{1,5})?$`)
+
+// trustSettings are the applications the root certificates are propagated to, as requested by the policy.
+type trustSettings struct {
+	targets    []string
+	registries []string
+}
+
+// trustState is the propagation of the root certificates to snapd and git, which are configured through
+// their commands.
+type trustState struct {
+	// Snapd is the digest of the root certificates set in the snapd store certificates.
+	Snapd string `json:"snapd,omitempty"`
+	// Git is true if the system git configuration trusts the system certificate bundle.
+	Git bool `json:"git,omitempty"`
+}
+
+// parseTrustSettings returns the applications the root certificates are propagated to from entries.
+func parseTrustSettings(entries []entry.Entry) (s trustSettings, err error) {
+	for _, e := range entries {
+		name, found := strings.CutPrefix(e.Key, "certificate/trust-")
+		if !found || e.Disabled {
+			continue
+		}
+
+		switch name {
+		case trustSnapd, trustPip, trustNpm, trustGit:
+			if strings.TrimSpace(e.Value) == "true" {
+				s.targets = append(s.targets, name)
+			}
+		case "docker-registries":
+			for _, r := range strings.Split(e.Value, "\n") {
+				if r = strings.TrimSpace(r); r == "" {
+					continue
+				}
+				if !registryRe.MatchString(r) {
+					return s, errors.New(gotext.Get("invalid Docker registry %q", r))
+				}
+				if !slices.Contains(s.registries, r) {
+					s.registries = append(s.registries, r)
+				}
+			}
+		}
+	}
+	if len(s.registries) > 0 {
+		s.targets = append(s.targets, trustDocker)
+	}
+
+	return s, nil
+}
+
+// propagateTrust propagates the root certificates objectName is enrolled with to the applications selected
+// in entries, which don't rely on the system trust store. The propagation to the applications which are
+// not selected anymore, or of the certificates which are not enrolled anymore, is reverted.
+func (m *Manager) propagateTrust(ctx context.Context, objectName string, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't propagate root certificates"))
+
+	s, err := parseTrustSettings(entries)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := m.rootCertificatesBundle(objectName)
+	if err != nil {
+		return err
+	}
+	// Without any root certificate, there is nothing to trust anymore.
+	if bundle == nil {
+		s = trustSettings{}
+	}
+	enabled := func(target string) bool { return slices.Contains(s.targets, target) }
+
+	state, err := m.loadTrustState(objectName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errSave := m.saveTrustState(objectName, state); errSave != nil {
+			err = errors.Join(err, errSave)
+		}
+	}()
+
+	if err := m.propagateToDocker(ctx, s.registries, bundle); err != nil {
+		return err
+	}
+
+	// pip and npm replace their bundled certificates with the trusted ones: use the system bundle,
+	// which includes both the public and the enrolled root certificates.
+	pipConf := trustHeader + "\n[global]\ncert = " + m.systemCABundle + "\n"
+	if !enabled(trustPip) {
+		pipConf = ""
+	}
+	if err := writeManagedFile(ctx, m.pipConfPath, pipConf); err != nil {
+		return err
+	}
+	npmrc := trustHeader + "\ncafile=" + m.systemCABundle + "\n"
+	if !enabled(trustNpm) {
+		npmrc = ""
+	}
+	if err := writeManagedFile(ctx, m.npmrcPath, npmrc); err != nil {
+		return err
+	}
+
+	// snapd and git are configured through their commands, which are only run on changes.
+	var digest string
+	if enabled(trustSnapd) {
+		sum := sha256.Sum256(bundle)
+		digest = hex.EncodeToString(sum[:])
+	}
+	if digest != state.Snapd {
+		args := []string{"unset", "system", snapdStoreCertsOption}
+		if digest != "" {
+			args = []string{"set", "system", snapdStoreCertsOption + "=" + string(bundle)}
+		}
+		if m.runTrustCmd(ctx, m.snapCmd, args...) {
+			state.Snapd = digest
+		}
+	}
+	if enabled(trustGit) != state.Git {
+		args := []string{"config", "--system", "--unset", gitCAInfoOption}
+		if enabled(trustGit) {
+			args = []string{"config", "--system", gitCAInfoOption, m.systemCABundle}
+		}
+		if m.runTrustCmd(ctx, m.gitCmd, args...) {
+			state.Git = enabled(trustGit)
+		}
+	}
+
+	return nil
+}
+
+// rootCertificatesBundle returns the concatenation of the root certificates objectName is enrolled with,
+// sorted by name. It is nil if objectName isn't enrolled with any root certificate.
+func (m *Manager) rootCertificatesBundle(objectName string) ([]byte, error) {
+	state, err := m.loadState(objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, s := range state {
+		names = append(names, s.RootCertificates...)
+	}
+	slices.Sort(names)
+
+	var bundle []byte
+	for _, name := range names {
+		d, err := os.ReadFile(filepath.Join(m.trustDir, name))
+		if err != nil {
+			return nil, err
+		}
+		bundle = append(bundle, bytes.TrimSpace(d)...)
+		bundle = append(bundle, '\n')
+	}
+	return bundle, nil
+}
+
+// propagateToDocker writes the root certificates in the certificates directory of each registry, so that the
+// Docker daemon trusts them when connecting to the registry. The certificates of the other registries are removed.
+func (m *Manager) propagateToDocker(ctx context.Context, registries []string, bundle []byte) error {
+	existing, err := filepath.Glob(filepath.Join(m.dockerCertsDir, "*", dockerCAFile))
+	if err != nil {
+		return err
+	}
+	for _, p := range existing {
+		if slices.Contains(registries, filepath.Base(filepath.Dir(p))) {
+			continue
+		}
+		log.Info(ctx, gotext.Get("Removing root certificates of Docker registry %s", filepath.Base(filepath.Dir(p))))
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		// Only remove the directory of the registry if nothing else is configured for it.
+		_ = os.Remove(filepath.Dir(p))
+	}
+
+	for _, r := range registries {
+		p := filepath.Join(m.dockerCertsDir, r, dockerCAFile)
+		if old, err := os.ReadFile(p); err == nil && bytes.Equal(old, bundle) {
+			continue
+		}
+		log.Info(ctx, gotext.Get("Trusting root certificates for Docker registry %s", r))
+		// #nosec G301 - the directories of the registries are world readable
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		// #nosec G306 - root certificates are public
+		if err := os.WriteFile(p+".new", bundle, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(p+".new", p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeManagedFile writes content to p, or removes p if content is empty.
+// Files which are not managed by adsys are left untouched, with a warning.
+func writeManagedFile(ctx context.Context, p, content string) error {
+	old, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		if content == "" {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	} else if !strings.HasPrefix(string(old), trustHeader) {
+		if content != "" {
+			log.Warning(ctx, gotext.Get("%s is not managed by adsys, not propagating the root certificates to it", p))
+		}
+		return nil
+	} else if string(old) == content {
+		return nil
+	}
+
+	if content == "" {
+		log.Info(ctx, gotext.Get("Removing %s", p))
+		return os.Remove(p)
+	}
+
+	log.Info(ctx, gotext.Get("Writing %s", p))
+	// #nosec G301 - the configuration directories are world readable
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// #nosec G306 - the configuration of the applications is world readable
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// runTrustCmd runs cmd with args to configure the trust store of an application, returning true on success.
+// The application not being installed is a success, as there is nothing to configure. Failures are only
+// logged, and retried on next refresh.
+func (m *Manager) runTrustCmd(ctx context.Context, cmd []string, args ...string) bool {
+	if !isInstalled(cmd) {
+		log.Debugf(ctx, "%s is not installed, skipping root certificates propagation", strings.Join(cmd, " "))
+		return true
+	}
+
+	log.Debugf(ctx, "Running %s %s", strings.Join(cmd, " "), args[0])
+	_, stderr, exitCode, err := syshelpers.RunWithStatus(ctx, m.cmdTimeout, cmd, syshelpers.CmdOptions{}, args...)
+	if err != nil {
+		stderr = err.Error()
+	}
+	// git exits with 5 when unsetting an option which isn't set.
+	if err == nil && (exitCode == 0 || (slices.Contains(args, "--unset") && exitCode == 5)) {
+		return true
+	}
+	log.Warning(ctx, gotext.Get("Failed to propagate the root certificates with %s: %s", filepath.Base(cmd[0]), stderr))
+	return false
+}
+
+// trustStatePath returns the path of the root certificates propagation state of objectName.
+func (m *Manager) trustStatePath(objectName string) string {
+	return m.statePath(objectName) + ".trust"
+}
+
+// loadTrustState returns the root certificates propagation state of objectName.
+func (m *Manager) loadTrustState(objectName string) (s trustState, err error) {
+	d, err := os.ReadFile(m.trustStatePath(objectName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, errors.New(gotext.Get("invalid root certificates propagation state: %v", err))
+	}
+	return s, nil
+}
+
+// saveTrustState stores the root certificates propagation state of objectName, or removes it if nothing
+// is propagated anymore.
+func (m *Manager) saveTrustState(objectName string, s trustState) error {
+	p := m.trustStatePath(objectName)
+	if s == (trustState{}) {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,303 @@
+// Package chrome provides a manager that writes the Google Chrome and Chromium policies.
+//
+// The policies are listed one per line, of the form <policy name>=<value>, where the value is
+// parsed as JSON, or kept as a string if it isn't valid JSON. For instance:
+//
+//	HomepageLocation=https://intranet.example.com
+//	HomepageIsNewTabPage=false
+//	ExtensionInstallForcelist=["cjpalhdlnbpafiamejdnhcphjbkeiagm;https://clients2.google.com/service/update2/crx"]
+//
+// Computer policies are set with the chrome/policies key and are written as managed policies,
+// which users can't change, in the adsys.json file of the managed policies directory of both
+// browsers.
+//
+// Chrome and Chromium don't support per-user policies on Linux. User policies are thus set with
+// the chrome/user-policies key and are written as recommended policies, which users can override,
+// in the adsys.json file of the recommended policies directory of both browsers. As this file
+// applies to every user of the machine, it only contains the policies of the last user whose
+// policies were applied. The owner of this file is saved in a state file, so that it is only
+// removed when its owner has no policy anymore.
+//
+// If a policy can't be parsed, the manager returns an error and authentication will be prevented.
+package chrome
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	policiesFile   = "adsys.json"
+	managedDir     = "managed"
+	recommendedDir = "recommended"
+
+	stateFile = "state.json"
+)
+
+// policyNameRe matches the names of the Chrome policies.
+var policyNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// state is the owner of the recommended policies applied by adsys.
+type state struct {
+	RecommendedOwner string `json:"recommended_owner,omitempty"`
+}
+
+// Manager writes the Chrome and Chromium policies on the machine.
+type Manager struct {
+	stateDir            string
+	chromePoliciesDir   string
+	chromiumPoliciesDir string
+
+	mu sync.Mutex // Prevents concurrent changes to the recommended policies and the state
+}
+
+type options struct {
+	stateDir            string
+	chromePoliciesDir   string
+	chromiumPoliciesDir string
+}
+
+// Option reprents an optional function to change the chrome manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithChromePoliciesDir overrides the default Google Chrome policies directory.
+func WithChromePoliciesDir(p string) func(*options) {
+	return func(a *options) {
+		a.chromePoliciesDir = p
+	}
+}
+
+// WithChromiumPoliciesDir overrides the default Chromium policies directory.
+func WithChromiumPoliciesDir(p string) func(*options) {
+	return func(a *options) {
+		a.chromiumPoliciesDir = p
+	}
+}
+
+// New returns a new manager for the chrome policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:            consts.DefaultStateDir,
+		chromePoliciesDir:   consts.DefaultChromePoliciesDir,
+		chromiumPoliciesDir: consts.DefaultChromiumPoliciesDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:            filepath.Join(args.stateDir, "chrome"),
+		chromePoliciesDir:   args.chromePoliciesDir,
+		chromiumPoliciesDir: args.chromiumPoliciesDir,
+	}
+}
+
+// ApplyPolicy writes the managed policies of the computer or the recommended policies of the user from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply chrome policy to %s", objectName))
+
+	log.Debugf(ctx, "Applying chrome policy to %s", objectName)
+
+	key, dir := "chrome/policies", managedDir
+	if !isComputer {
+		key, dir = "chrome/user-policies", recommendedDir
+	}
+
+	pols := make(map[string]any)
+	for _, e := range entries {
+		if e.Key != key {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing chrome entries, skipping it", e.Key))
+			continue
+		}
+		if e.Disabled {
+			continue
+		}
+		// Policies are listed from the furthest to the closest GPO: the closest one wins.
+		if err := parsePolicies(e.Value, pols); err != nil {
+			return err
+		}
+	}
+
+	if isComputer {
+		return m.write(dir, pols)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.loadState()
+	if err != nil {
+		return err
+	}
+	if len(pols) == 0 {
+		if s.RecommendedOwner != objectName {
+			log.Debugf(ctx, "Recommended chrome policies belong to %q, keeping them", s.RecommendedOwner)
+			return nil
+		}
+		if err := m.write(dir, nil); err != nil {
+			return err
+		}
+		return m.saveState(state{})
+	}
+
+	if s.RecommendedOwner != "" && s.RecommendedOwner != objectName {
+		log.Infof(ctx, "Replacing recommended chrome policies of %q with the ones of %q", s.RecommendedOwner, objectName)
+	}
+	// Save the new owner first, so that the policies can be removed by this user even if writing them partially failed.
+	if err := m.saveState(state{RecommendedOwner: objectName}); err != nil {
+		return err
+	}
+	return m.write(dir, pols)
+}
+
+// DumpState returns the Chrome and Chromium policies written during the last refresh: the managed policies
+// of the machine, or the recommended policies of the user if they belong to them.
+// The state is empty if no chrome policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump chrome state of %s", objectName))
+
+	dir := managedDir
+	if !isComputer {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		s, err := m.loadState()
+		if err != nil {
+			return "", err
+		}
+		// The recommended policies are only part of the state of the user they belong to.
+		if s.RecommendedOwner != objectName {
+			return "", nil
+		}
+		dir = recommendedDir
+	}
+
+	return syshelpers.DumpFiles(
+		filepath.Join(m.chromePoliciesDir, dir, policiesFile),
+		filepath.Join(m.chromiumPoliciesDir, dir, policiesFile),
+	)
+}
+
+// parsePolicies adds to pols the policies listed in v, one <name>=<value> per line.
+func parsePolicies(v string, pols map[string]any) error {
+	for _, l := range strings.Split(v, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(l, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !policyNameRe.MatchString(name) {
+			return errors.New(gotext.Get("invalid policy %q: <policy name>=<value> is expected", l))
+		}
+
+		var parsed any
+		if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+			// Allow strings without quotes, like URLs.
+			parsed = value
+		}
+		pols[name] = parsed
+	}
+	return nil
+}
+
+// write writes pols in the policies file of dir for both browsers.
+// The files are removed if pols is empty.
+func (m *Manager) write(dir string, pols map[string]any) error {
+	var d []byte
+	if len(pols) > 0 {
+		var err error
+		// JSON doesn't support comments: the file being managed by adsys is documented instead.
+		if d, err = json.MarshalIndent(pols, "", "  "); err != nil {
+			return err
+		}
+		d = append(d, '\n')
+	}
+
+	for _, policiesDir := range []string{m.chromePoliciesDir, m.chromiumPoliciesDir} {
+		p := filepath.Join(policiesDir, dir, policiesFile)
+		if d == nil {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		// nolint:gosec // G301 match distribution permission
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		// nolint:gosec // G306 policies are read by the browsers running as the users
+		if err := os.WriteFile(p+".new", d, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(p+".new", p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadState returns the owner of the recommended policies applied by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load chrome state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the owner of the recommended policies applied by adsys.
+// The state file is removed if there is no owner anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save chrome state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if s.RecommendedOwner == "" {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
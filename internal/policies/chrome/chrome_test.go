@@ -0,0 +1,92 @@
+package chrome_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/chrome"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	machinePolicies := `HomepageLocation=https://intranet.example.com
+HomepageIsNewTabPage=false
+ExtensionInstallForcelist=["cjpalhdlnbpafiamejdnhcphjbkeiagm;https://clients2.google.com/service/update2/crx"]
+ManagedBookmarks=[{"toplevel_name": "Intranet"}, {"name": "Wiki", "url": "https://wiki.example.com"}]`
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		objectName    string
+		isNotComputer bool
+		existingDirs  string
+
+		wantErr bool
+	}{
+		"Computer policies are managed":               {entries: []entry.Entry{{Key: "chrome/policies", Value: machinePolicies}}},
+		"Values which are not JSON are strings":       {entries: []entry.Entry{{Key: "chrome/policies", Value: "HomepageLocation=https://intranet.example.com\nDownloadDirectory=${home}/Downloads\nRestoreOnStartupURLs=[not json"}}},
+		"Closest GPO wins for the same policy":        {entries: []entry.Entry{{Key: "chrome/policies", Value: "HomepageLocation=https://far.example.com\nBookmarkBarEnabled=true\nHomepageLocation=https://close.example.com"}}},
+		"Spaces and empty lines are ignored":          {entries: []entry.Entry{{Key: "chrome/policies", Value: "\n  HomepageLocation = https://intranet.example.com  \n\n"}}},
+		"Disabled entries are ignored":                {entries: []entry.Entry{{Key: "chrome/policies", Value: "HomepageLocation=https://intranet.example.com", Disabled: true}}},
+		"Unsupported keys are ignored":                {entries: []entry.Entry{{Key: "chrome/policies", Value: "BookmarkBarEnabled=true"}, {Key: "chrome/user-policies", Value: "HomepageLocation=https://intranet.example.com"}}},
+		"Computer policies replace existing ones":     {existingDirs: "applied", entries: []entry.Entry{{Key: "chrome/policies", Value: machinePolicies}}},
+		"No computer policies removes existing ones":  {existingDirs: "applied"},
+		"No computer policies and no existing files":  {},
+		"Computer policies don't touch other files":   {existingDirs: "other-files", entries: []entry.Entry{{Key: "chrome/policies", Value: machinePolicies}}},
+		"User policies are recommended":               {isNotComputer: true, entries: []entry.Entry{{Key: "chrome/user-policies", Value: "HomepageLocation=https://intranet.example.com\nBookmarkBarEnabled=true"}}},
+		"User policies replace the ones of its owner": {isNotComputer: true, objectName: "bob@example.com", existingDirs: "applied", entries: []entry.Entry{{Key: "chrome/user-policies", Value: "HomepageLocation=https://intranet.example.com"}}},
+		"User policies replace the ones of another":   {isNotComputer: true, existingDirs: "applied", entries: []entry.Entry{{Key: "chrome/user-policies", Value: "HomepageLocation=https://intranet.example.com"}}},
+		"No user policies removes the ones of owner":  {isNotComputer: true, objectName: "bob@example.com", existingDirs: "applied"},
+		"No user policies keeps the ones of another":  {isNotComputer: true, existingDirs: "applied"},
+		"User policies don't touch other files":       {isNotComputer: true, existingDirs: "other-files", entries: []entry.Entry{{Key: "chrome/user-policies", Value: "BookmarkBarEnabled=true"}}},
+
+		// Error cases
+		"Error on policy without value":            {entries: []entry.Entry{{Key: "chrome/policies", Value: "HomepageLocation"}}, wantErr: true},
+		"Error on invalid policy name":             {entries: []entry.Entry{{Key: "chrome/policies", Value: "Homepage Location=https://intranet.example.com"}}, wantErr: true},
+		"Error on corrupted state":                 {isNotComputer: true, existingDirs: "corrupted-state", entries: []entry.Entry{{Key: "chrome/user-policies", Value: "BookmarkBarEnabled=true"}}, wantErr: true},
+		"Error on unwritable managed policies":     {existingDirs: "managed-is-file", entries: []entry.Entry{{Key: "chrome/policies", Value: "BookmarkBarEnabled=true"}}, wantErr: true},
+		"Error on unwritable recommended policies": {isNotComputer: true, existingDirs: "recommended-is-file", entries: []entry.Entry{{Key: "chrome/user-policies", Value: "BookmarkBarEnabled=true"}}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+
+			objectName := tc.objectName
+			if objectName == "" {
+				objectName = "ubuntu"
+				if tc.isNotComputer {
+					objectName = "alice@example.com"
+				}
+			}
+
+			m := chrome.New(
+				chrome.WithStateDir(filepath.Join(root, "var", "lib", "adsys")),
+				chrome.WithChromePoliciesDir(filepath.Join(root, "etc", "opt", "chrome", "policies")),
+				chrome.WithChromiumPoliciesDir(filepath.Join(root, "etc", "chromium", "policies")),
+			)
+			err := m.ApplyPolicy(context.Background(), objectName, !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Package compliance provides a manager that reports the security posture of the machine to the directory.
+//
+// This manager only applies to computer objects.
+//
+// The following setting is supported:
+//   - compliance/attribute: the name of the attribute of the computer object the compliance summary is
+//     written to, for instance info.
+//
+// On each refresh of the machine policy, the summary is written to the attribute over LDAPS, authenticated
+// with the Kerberos ticket of the machine, for instance:
+//
+//	firewall=active; chassis=laptop; tpm=yes; secure-boot=enabled; disk-encryption=yes; last-refresh=2024-05-01T08:00:00Z
+//
+// The firewall is active if ufw is enabled or if nftables filters the input traffic. The other facts are the
+// hardware facts collected on the refresh.
+//
+// The attribute is cleared once the policy is not configured anymore, or when another attribute is selected.
+// Nothing is written while the machine is offline: the summary is reported on the next online refresh.
+package compliance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/hardware"
+	"github.com/ubuntu/adsys/internal/ldaphelpers"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+// stateFile stores the name of the attribute the summary was last written to.
+const stateFile = "attribute"
+
+// attributeRe matches an LDAP attribute name.
+var attributeRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+// Manager reports the compliance of the machine to the directory.
+type Manager struct {
+	domain       string
+	stateDir     string
+	krb5CacheDir string
+
+	ldapDial    ldaphelpers.Dialer
+	ufwCmd      []string
+	nftCmd      []string
+	cmdTimeout  time.Duration
+	ldapTimeout time.Duration
+
+	now func() time.Time
+}
+
+type options struct {
+	stateDir    string
+	runDir      string
+	ldapDial    ldaphelpers.Dialer
+	ufwCmd      []string
+	nftCmd      []string
+	cmdTimeout  time.Duration
+	ldapTimeout time.Duration
+	now         func() time.Time
+}
+
+// Option reprents an optional function to change the compliance manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithRunDir overrides the default run directory.
+func WithRunDir(p string) func(*options) {
+	return func(a *options) {
+		a.runDir = p
+	}
+}
+
+// WithLdapDialer overrides the default connection to the directory, bound over SASL GSSAPI.
+func WithLdapDialer(dial ldaphelpers.Dialer) func(*options) {
+	return func(a *options) {
+		a.ldapDial = dial
+	}
+}
+
+// WithUfwCmd overrides the default ufw command.
+func WithUfwCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.ufwCmd = cmd
+	}
+}
+
+// WithNftCmd overrides the default nft command.
+func WithNftCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.nftCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// WithLdapTimeout overrides the default maximum time any LDAP request to the directory can take.
+func WithLdapTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.ldapTimeout = timeout
+	}
+}
+
+// New returns a new manager for the compliance policy.
+func New(domain string, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:    consts.DefaultStateDir,
+		runDir:      consts.DefaultRunDir,
+		ufwCmd:      []string{"ufw"},
+		nftCmd:      []string{"nft"},
+		cmdTimeout:  consts.DefaultHelperExecTimeout,
+		ldapTimeout: consts.DefaultLdapTimeout,
+		now:         time.Now,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		domain:       domain,
+		stateDir:     filepath.Join(args.stateDir, "compliance"),
+		krb5CacheDir: filepath.Join(args.runDir, "krb5cc"),
+
+		ldapDial:    args.ldapDial,
+		ufwCmd:      args.ufwCmd,
+		nftCmd:      args.nftCmd,
+		cmdTimeout:  args.cmdTimeout,
+		ldapTimeout: args.ldapTimeout,
+		now:         args.now,
+	}
+}
+
+// ApplyPolicy writes the compliance summary of the machine, including its hardware facts, to the attribute of its
+// computer object selected by the entries, against the server serverFQDN. The attribute previously written is
+// cleared if it changed.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer, isOnline bool, serverFQDN string, facts hardware.Facts, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply compliance policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Compliance policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying compliance policy to %s", objectName)
+
+	var attr string
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+		switch e.Key {
+		case "compliance/attribute":
+			if !attributeRe.MatchString(v) {
+				return errors.New(gotext.Get("invalid attribute name %q", v))
+			}
+			attr = v
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing compliance entries, skipping it", e.Key))
+		}
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+	if attr == "" && prev == "" {
+		return nil
+	}
+
+	if !isOnline {
+		log.Info(ctx, gotext.Get("Machine is offline, the compliance summary will be reported on the next refresh"))
+		return nil
+	}
+	if serverFQDN == "" {
+		log.Debugf(ctx, "No active server found, querying domain %q directly", m.domain)
+		serverFQDN = m.domain
+	}
+
+	c := m.ldapClient(objectName, serverFQDN)
+	dn, err := c.ComputerDN(ctx, m.domain, objectName)
+	if err != nil {
+		return err
+	}
+
+	if prev != "" && !strings.EqualFold(prev, attr) {
+		log.Infof(ctx, "Clearing compliance summary from attribute %s", prev)
+		if err := c.Delete(ctx, dn, prev); err != nil {
+			return err
+		}
+		if err := m.saveState(""); err != nil {
+			return err
+		}
+	}
+	if attr == "" {
+		return nil
+	}
+
+	summary := m.summary(ctx, facts)
+	log.Infof(ctx, "Reporting compliance summary to attribute %s: %s", attr, summary)
+	if err := c.Replace(ctx, dn, attr, summary); err != nil {
+		return err
+	}
+	return m.saveState(attr)
+}
+
+// DumpState returns the compliance attribute published to the directory during the last refresh of the machine.
+// The state is empty for users or if no compliance policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump compliance state of %s", objectName))
+
+	// Compliance policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// summary returns the compliance summary of the machine with its hardware facts.
+func (m *Manager) summary(ctx context.Context, facts hardware.Facts) string {
+	firewall := "inactive"
+	if m.firewallActive(ctx) {
+		firewall = "active"
+	}
+	return fmt.Sprintf("firewall=%s; %s; last-refresh=%s",
+		firewall, facts, m.now().UTC().Format(time.RFC3339))
+}
+
+// firewallActive returns true if ufw is enabled or if nftables filters the input traffic.
+func (m *Manager) firewallActive(ctx context.Context) bool {
+	if out, _, exitCode, err := syshelpers.RunWithStatus(ctx, m.cmdTimeout, m.ufwCmd, syshelpers.CmdOptions{}, "status"); err == nil && exitCode == 0 {
+		if slices.Contains(strings.Split(out, "\n"), "Status: active") {
+			return true
+		}
+	} else {
+		log.Debugf(ctx, "Can't get ufw status: %v", errorOrExitCode(err, exitCode))
+	}
+
+	out, _, exitCode, err := syshelpers.RunWithStatus(ctx, m.cmdTimeout, m.nftCmd, syshelpers.CmdOptions{}, "list", "ruleset")
+	if err != nil || exitCode != 0 {
+		log.Debugf(ctx, "Can't list nftables ruleset: %v", errorOrExitCode(err, exitCode))
+		return false
+	}
+	return strings.Contains(out, "hook input")
+}
+
+// ldapClient returns the client updating the directory of serverFQDN with the Kerberos ticket of the machine.
+func (m *Manager) ldapClient(objectName, serverFQDN string) ldaphelpers.Client {
+	return ldaphelpers.Client{
+		URL:        "ldaps://" + serverFQDN,
+		Krb5CCName: filepath.Join(m.krb5CacheDir, objectName),
+		Timeout:    m.ldapTimeout,
+		Dial:       m.ldapDial,
+	}
+}
+
+// loadState returns the name of the attribute the summary was last written to.
+func (m *Manager) loadState() (attr string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load compliance state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(d)), nil
+}
+
+// saveState saves the name of the attribute the summary is written to.
+// The state file is removed if attr is empty.
+func (m *Manager) saveState(attr string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save compliance state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if attr == "" {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", []byte(attr+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// errorOrExitCode returns err if not nil, or an error describing the exit code otherwise.
+func errorOrExitCode(err error, exitCode int) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("exit status %d", exitCode)
+}
@@ -0,0 +1,162 @@
+package compliance_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/hardware"
+	"github.com/ubuntu/adsys/internal/policies/compliance"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	attributeEntry := []entry.Entry{{Key: "compliance/attribute", Value: "info"}}
+	facts := hardware.Facts{hardware.Chassis: "laptop", hardware.TPM: "yes", hardware.SecureBoot: "enabled", hardware.DiskEncryption: "no"}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		facts         hardware.Facts
+		isUser        bool
+		isOffline     bool
+		serverFQDN    string
+		existingState string
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Report compliance summary":                     {entries: attributeEntry},
+		"Report with nftables firewall":                 {entries: attributeEntry, mockBehaviour: "ufw-inactive,nft-active"},
+		"Report inactive firewall":                      {entries: attributeEntry, mockBehaviour: "ufw-inactive"},
+		"Report inactive firewall if none is installed": {entries: attributeEntry, mockBehaviour: "fail-ufw,fail-nft"},
+		"Report encrypted disk":                         {entries: attributeEntry, facts: hardware.Facts{hardware.Chassis: "laptop", hardware.TPM: "yes", hardware.SecureBoot: "enabled", hardware.DiskEncryption: "yes"}},
+		"Report unknown hardware facts":                 {entries: attributeEntry, facts: hardware.Facts{}},
+		"Query the domain without active server":        {entries: attributeEntry, serverFQDN: "-"},
+		"Report again to the same attribute":            {entries: attributeEntry, existingState: "applied"},
+		"Clear previous attribute on change":            {entries: []entry.Entry{{Key: "compliance/attribute", Value: "description"}}, existingState: "applied"},
+		"No entries clears the attribute":               {existingState: "applied"},
+		"Offline machine is not reported":               {entries: attributeEntry, isOffline: true},
+		"Offline machine keeps the attribute to clear":  {existingState: "applied", isOffline: true},
+		"Disabled entries are ignored":                  {entries: []entry.Entry{{Key: "compliance/attribute", Value: "info", Disabled: true}}},
+		"Unsupported keys are ignored":                  {entries: append(slices.Clone(attributeEntry), entry.Entry{Key: "compliance/unsupported", Value: "yes"})},
+		"No entries is a no-op":                         {},
+		"Not a computer is a no-op":                     {entries: attributeEntry, isUser: true},
+
+		// Error cases
+		"Error on invalid attribute name":      {entries: []entry.Entry{{Key: "compliance/attribute", Value: "info; rm"}}, wantErr: true},
+		"Error on corrupted state":             {entries: attributeEntry, existingState: "corrupted", wantErr: true},
+		"Error on binding to the directory":    {entries: attributeEntry, mockBehaviour: "fail-ldap-bind", wantErr: true},
+		"Error on searching the directory":     {entries: attributeEntry, mockBehaviour: "fail-ldap-search", wantErr: true},
+		"Error on computer not found":          {entries: attributeEntry, mockBehaviour: "no-computer", wantErr: true},
+		"Error on writing the summary":         {entries: attributeEntry, mockBehaviour: "fail-ldap-modify", wantErr: true},
+		"Error on clearing previous attribute": {existingState: "applied", mockBehaviour: "fail-ldap-modify", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			switch tc.serverFQDN {
+			case "":
+				tc.serverFQDN = "dc1.example.com"
+			case "-":
+				tc.serverFQDN = ""
+			}
+
+			behaviours := strings.Split(tc.mockBehaviour, ",")
+			directory := testutils.MockDirectory{
+				Root:       root,
+				LDIF:       mockComputer(behaviours),
+				FailBind:   slices.Contains(behaviours, "fail-ldap-bind"),
+				FailSearch: slices.Contains(behaviours, "fail-ldap-search"),
+				FailModify: slices.Contains(behaviours, "fail-ldap-modify"),
+			}
+
+			m := compliance.New("example.com",
+				compliance.WithStateDir(root),
+				compliance.WithRunDir("/run/adsys"),
+				compliance.WithLdapDialer(directory.Dial),
+				compliance.WithUfwCmd(testutils.MockCommand(root, "ufw", tc.mockBehaviour)),
+				compliance.WithNftCmd(testutils.MockCommand(root, "nft", tc.mockBehaviour)),
+				compliance.WithNow(func() time.Time { return time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*60*60)) }),
+			)
+			if tc.facts == nil {
+				tc.facts = facts
+			}
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, !tc.isOffline, tc.serverFQDN, tc.facts, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockComputer returns the computer object of the machine, unless behaviours contains no-computer.
+func mockComputer(behaviours []string) func(*ldap.SearchRequest) (string, bool) {
+	return func(*ldap.SearchRequest) (string, bool) {
+		if slices.Contains(behaviours, "no-computer") {
+			return "", true
+		}
+		return "dn: CN=UBUNTU,CN=Computers,DC=example,DC=com\n", true
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, root, behaviours, args := c.Name, c.Root, strings.Split(c.Behaviour, ","), c.Args
+
+	// Log the call, replacing the temporary paths to get a stable output.
+	line := name
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+	line = strings.ReplaceAll(line, root, "#ROOT#")
+
+	c.Log(line)
+
+	if slices.Contains(behaviours, "fail-"+name) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+
+	switch name {
+	case "ufw":
+		if slices.Contains(behaviours, "ufw-inactive") {
+			fmt.Println("Status: inactive")
+			return
+		}
+		fmt.Print("Status: active\n\nTo                         Action      From\n--                         ------      ----\n22/tcp                     ALLOW       Anywhere\n")
+	case "nft":
+		if slices.Contains(behaviours, "nft-active") {
+			fmt.Print("table inet filter {\n\tchain input {\n\t\ttype filter hook input priority filter; policy drop;\n\t}\n}\n")
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package compliance
+
+import "time"
+
+// WithNow defines a custom clock for tests.
+func WithNow(now func() time.Time) func(*options) {
+	return func(o *options) {
+		o.now = now
+	}
+}
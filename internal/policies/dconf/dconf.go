@@ -6,11 +6,24 @@
 // moment it finds a lock.
 // Default values specified by the policy will be added to the profile database, along with locks to
 // their correspondent keys, in order to enforce the requested values.
+// Values the policy marks as unlocked are only added as default values, without any lock, so that
+// users can still override them.
+//
+// Values of lists can be merged with, or appended to, the default value of the system, as set by the schema of
+// the key and the vendor overrides for the Ubuntu desktop, instead of replacing it. Merging lists the values of
+// the policy first, while appending lists the default values first, without duplicates.
+//
+// Settings of relocatable schemas, like custom keyboard shortcuts, terminal profiles or application
+// folders, are only read by the applications under the paths listed in a parent key. The manager adds
+// the paths with a value to that list, merged with the list of the policy and, for users, the one of the
+// machine. The list is locked unless all the values under its paths are unlocked.
 //
 // The manager will parse the values and try to fix some formatting problems, but if something goes
 // wrong when applying the profile or updating dconf, an error is returned.
-// However, ADSys will not check for the correctness of the values being assigned and it's up to the
-// admin to ensure that the requested value is assignable to the key it is being assigned to.
+// Values are then checked against the type and the range of their key in the schemas installed on the
+// system. Keys which are unknown or whose value doesn't match are not applied and reported as warnings,
+// without failing the other keys. Keys without any installed schema, like relocatable ones, are applied
+// unchecked.
 //
 // Notes or common keys between user and machine:
 //
@@ -31,6 +44,7 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -45,6 +59,7 @@ import (
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
 	"github.com/ubuntu/adsys/internal/policies/entry"
 	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/adsys/internal/syshelpers"
 	"github.com/ubuntu/decorate"
 )
 
@@ -57,6 +72,12 @@ type Manager struct {
 	dconfUpdateMu sync.Mutex
 
 	dconfDir string
+	// gsettingsCmd is the command used to read the installed schemas.
+	gsettingsCmd []string
+
+	// warnings are the keys of each object which were not applied during the last refresh, with the reason why.
+	warnings   map[string]map[string]string
+	warningsMu sync.Mutex
 }
 
 // NewWithDconfDir creates a manager with a specific dconf directory.
@@ -88,6 +109,9 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 
 	log.Debugf(ctx, "Applying dconf policy to %s", objectName)
 
+	warnings := make(map[string]string)
+	defer m.setWarnings(objectName, warnings)
+
 	if isComputer {
 		objectName = "machine"
 	}
@@ -127,10 +151,22 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		}
 	}
 
+	// Applications only read the settings of relocatable schemas under the paths listed in their parent key.
+	var inherited map[string]string
+	if !isComputer {
+		if inherited, err = readRelocatableLists(filepath.Join(dbsPath, "machine.d", "adsys")); err != nil {
+			return err
+		}
+	}
+	if entries, err = withRelocatableLists(entries, inherited); err != nil {
+		return err
+	}
+
 	// Generate defaults and locks content from policy
 	dataWithGroups := make(map[string][]string)
 	var locks []string
 	var errMsgs []string
+	schemas := installedSchemas{gsettingsCmd: m.gsettingsCmd}
 	for _, e := range entries {
 		log.Debugf(ctx, "Analyzing entry %+v", e)
 
@@ -143,10 +179,27 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 				errMsgs = append(errMsgs, gotext.Get("- error on %s: %v", e.Key, err))
 				continue
 			}
+			// Lists can be combined with the default value of the system instead of replacing it.
+			v, err := schemas.combine(ctx, e)
+			if err != nil {
+				errMsgs = append(errMsgs, gotext.Get("- error on %s: %v", e.Key, err))
+				continue
+			}
+			e.Value = v
+			// Values which don't match the installed schema are ignored by the applications: skip them.
+			if w := schemas.validate(ctx, e.Key, e.Value); w != "" {
+				log.Warningf(ctx, "Ignoring dconf key %s: %s", e.Key, w)
+				warnings[e.Key] = w
+				continue
+			}
 
 			l := fmt.Sprintf("%s=%s", filepath.Base(e.Key), e.Value)
 			dataWithGroups[section] = append(dataWithGroups[section], l)
 		}
+		// Values which are only defaults are not locked, so that users can override them.
+		if e.Unlocked && !e.Disabled {
+			continue
+		}
 		locks = append(locks, "/"+e.Key)
 	}
 
@@ -214,6 +267,55 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 	return nil
 }
 
+// Warnings returns the dconf keys of objectName which were not applied during the last refresh, because they
+// don't match their installed schema, with the reason why.
+func (m *Manager) Warnings(objectName string) map[string]string {
+	m.warningsMu.Lock()
+	defer m.warningsMu.Unlock()
+
+	if len(m.warnings[objectName]) == 0 {
+		return nil
+	}
+	return maps.Clone(m.warnings[objectName])
+}
+
+// setWarnings records the warnings of the last refresh of objectName.
+func (m *Manager) setWarnings(objectName string, warnings map[string]string) {
+	m.warningsMu.Lock()
+	defer m.warningsMu.Unlock()
+
+	if m.warnings == nil {
+		m.warnings = make(map[string]map[string]string)
+	}
+	m.warnings[objectName] = warnings
+}
+
+// DumpState returns the dconf profile, and the keys and locks compiled into the database of objectName,
+// as applied during the last refresh. The state is empty if no dconf policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump dconf state of %s", objectName))
+
+	dconfDir := m.dconfDir
+	if dconfDir == "" {
+		dconfDir = consts.DefaultDconfDir
+	}
+
+	// Don't read the files while they are being written.
+	m.dconfMu.RLock()
+	defer m.dconfMu.RUnlock()
+
+	var paths []string
+	if isComputer {
+		objectName = "machine"
+	} else {
+		paths = append(paths, filepath.Join(dconfDir, "profile", objectName))
+	}
+	dbPath := filepath.Join(dconfDir, "db", objectName+".d")
+	paths = append(paths, filepath.Join(dbPath, "adsys"), filepath.Join(dbPath, "locks", "adsys"))
+
+	return syshelpers.DumpFiles(paths...)
+}
+
 // writeIfChanged will only write to path if content is different from current content.
 func writeIfChanged(path string, content string) (done bool, err error) {
 	defer decorate.OnError(&err, gotext.Get("can't save %s", path))
@@ -2,8 +2,11 @@ package dconf_test
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -20,8 +23,10 @@ func TestApplyPolicy(t *testing.T) {
 		isComputer       bool
 		entries          []entry.Entry
 		existingDconfDir string
+		gsettingsFails   bool
 
-		wantErr bool
+		wantWarnings []string
+		wantErr      bool
 	}{
 		// User cases
 		"New user": {entries: []entry.Entry{
@@ -76,6 +81,113 @@ func TestApplyPolicy(t *testing.T) {
 			{Key: "com/ubuntu/category2/key-s2", Value: "'onekey-s2'", Meta: "s"},
 			{Key: "com/ubuntu/category/key-as", Value: "['simple-as']", Meta: "as"},
 		}},
+		"Unlocked keys only set default values": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-s", Value: "'onekey-s-othervalue'", Meta: "s", Unlocked: true},
+			{Key: "com/ubuntu/category/key-as", Value: "['simple-as']", Meta: "as"},
+		}},
+		"Unlocked disabled keys are still locked": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-s", Disabled: true, Meta: "s", Unlocked: true},
+		}},
+		"Machine unlocked keys only set default values": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-s", Value: "'onekey-s-othervalue'", Meta: "s", Unlocked: true},
+			{Key: "com/ubuntu/category/key-as", Value: "['simple-as']", Meta: "as"},
+		}, isComputer: true},
+
+		// Relocatable schemas
+		"Relocatable keys are listed in their parent key": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s"},
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/command", Value: "gnome-terminal", Meta: "s"},
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom1/binding", Value: "<Super>e", Meta: "s"},
+		}},
+		"Relocatable keys of multiple profiles under a path": {entries: []entry.Entry{
+			{Key: "org/gnome/terminal/legacy/profiles:/:b1dcc9dd-5262-4d8d-a863-c897e6d979b9/visible-name", Value: "Default", Meta: "s"},
+			{Key: "org/gnome/terminal/legacy/profiles:/:ce4ee6f2-47b1-4bd1-b4fb-fc1b1c8e9b1d/visible-name", Value: "Admin", Meta: "s"},
+			{Key: "org/gnome/terminal/legacy/profiles:/default", Value: "b1dcc9dd-5262-4d8d-a863-c897e6d979b9", Meta: "s"},
+			{Key: "org/gnome/desktop/app-folders/folders/Office/name", Value: "Office", Meta: "s"},
+		}},
+		"Relocatable list of the policy is merged": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings", Value: "/org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom1/, /org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/existing/", Meta: "as", Unlocked: true},
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s", Unlocked: true},
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom1/name", Value: "Files", Meta: "s", Unlocked: true},
+		}},
+		"Relocatable list is unlocked when all its keys are unlocked": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s", Unlocked: true},
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/command", Value: "gnome-terminal", Meta: "s", Unlocked: true},
+		}},
+		"Relocatable list is locked when any of its keys is locked": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s", Unlocked: true},
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/command", Value: "gnome-terminal", Meta: "s"},
+		}},
+		"Disabled relocatable keys are not listed": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s"},
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom1/name", Disabled: true, Meta: "s"},
+		}},
+		"Disabled relocatable list is not generated": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings", Disabled: true, Meta: "as"},
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s"},
+		}},
+		"User relocatable list includes the machine one": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s"},
+		}, existingDconfDir: "machine-with-relocatable-list"},
+		"Machine relocatable list ignores the existing one": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s"},
+		}, isComputer: true, existingDconfDir: "machine-with-relocatable-list"},
+
+		// List modes
+		"Merge lists with the default value": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-as", Value: "['policy-as', 'simple-as']", Meta: "as", ListMode: entry.ListModeMerge},
+			{Key: "com/ubuntu/category/key-ai", Value: "[42, 3]", Meta: "ai", ListMode: entry.ListModeMerge},
+		}},
+		"Append lists to the default value": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-as", Value: "['policy-as', 'simple-as']", Meta: "as", ListMode: entry.ListModeAppend},
+			{Key: "com/ubuntu/category/key-ai", Value: "[42, 3]", Meta: "ai", ListMode: entry.ListModeAppend},
+		}},
+		"Merge list with an empty default value": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-empty", Value: "['policy-as']", Meta: "as", ListMode: entry.ListModeMerge},
+		}},
+		"Merge list with quotes in default value": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-quotes", Value: "['policy-as']", Meta: "as", ListMode: entry.ListModeAppend},
+		}},
+		"Replace list mode replaces the default value": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-as", Value: "['policy-as']", Meta: "as", ListMode: entry.ListModeReplace},
+		}, gsettingsFails: true},
+		"Unknown list mode replaces the default value": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-as", Value: "['policy-as']", Meta: "as", ListMode: "prepend"},
+		}, gsettingsFails: true},
+		"Disabled lists ignore their list mode": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-as", Disabled: true, Meta: "as", ListMode: entry.ListModeMerge},
+		}, gsettingsFails: true},
+
+		// Schema checks
+		"Values matching their schema are applied": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-enum", Value: "'second'", Meta: "s"},
+			{Key: "com/ubuntu/category/key-flags", Value: "['second', 'first']", Meta: "as"},
+			{Key: "com/ubuntu/category/key-range", Value: "10", Meta: "i"},
+			{Key: "com/ubuntu/category/key-range-double", Value: "0.5", Meta: "d"},
+			{Key: "com/ubuntu/category/key-maybe", Value: "'unchecked type'", Meta: "s"},
+		}},
+		"Values not matching their schema are skipped": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-s", Value: "'onekey-s-othervalue'", Meta: "s"},
+			{Key: "com/ubuntu/category/key-i", Value: "'not an integer'", Meta: "s"},
+			{Key: "com/ubuntu/category/key-unknown", Value: "'onekey-s'", Meta: "s"},
+			{Key: "com/ubuntu/category/key-enum", Value: "'third'", Meta: "s"},
+			{Key: "com/ubuntu/category/key-flags", Value: "['first', 'third']", Meta: "as"},
+			{Key: "com/ubuntu/category/key-range", Value: "11", Meta: "i"},
+			{Key: "com/ubuntu/category/key-range-double", Value: "0.4", Meta: "d"},
+		}, wantWarnings: []string{
+			"com/ubuntu/category/key-i",
+			"com/ubuntu/category/key-unknown",
+			"com/ubuntu/category/key-enum",
+			"com/ubuntu/category/key-flags",
+			"com/ubuntu/category/key-range",
+			"com/ubuntu/category/key-range-double",
+		}},
+		"Values of keys without schema are not checked": {entries: []entry.Entry{
+			{Key: "com/ubuntu/other/key-i", Value: "'not an integer'", Meta: "s"},
+		}},
+		"Values are not checked when gsettings fails": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-i", Value: "'not an integer'", Meta: "s"},
+		}, gsettingsFails: true},
 
 		// Update edge cases
 		"No update when no change": {entries: []entry.Entry{
@@ -183,6 +295,28 @@ func TestApplyPolicy(t *testing.T) {
 		"Error on invalid type": {entries: []entry.Entry{
 			{Key: "com/ubuntu/category/key-something", Value: "value", Meta: "sometype"},
 		}, wantErr: true},
+		"Error on invalid relocatable list": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings", Value: "[1]", Meta: "ai"},
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s"},
+		}, wantErr: true},
+		"Error on invalid relocatable list in machine database": {entries: []entry.Entry{
+			{Key: "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings/custom0/name", Value: "Terminal", Meta: "s"},
+		}, existingDconfDir: "machine-with-invalid-relocatable-list", wantErr: true},
+		"Error on list mode for non list key": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-s", Value: "'onekey-s'", Meta: "s", ListMode: entry.ListModeMerge},
+		}, wantErr: true},
+		"Error on list mode for key without schema": {entries: []entry.Entry{
+			{Key: "com/ubuntu/other/key-as", Value: "['policy-as']", Meta: "as", ListMode: entry.ListModeMerge},
+		}, wantErr: true},
+		"Error on list mode for unknown key": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-unknown", Value: "['policy-as']", Meta: "as", ListMode: entry.ListModeMerge},
+		}, wantErr: true},
+		"Error on list mode with invalid default value": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-invalid", Value: "['policy-as']", Meta: "as", ListMode: entry.ListModeMerge},
+		}, wantErr: true},
+		"Error on list mode when gsettings fails": {entries: []entry.Entry{
+			{Key: "com/ubuntu/category/key-as", Value: "['policy-as']", Meta: "as", ListMode: entry.ListModeMerge},
+		}, gsettingsFails: true, wantErr: true},
 		"Error on empty meta": {entries: []entry.Entry{
 			{Key: "com/ubuntu/category/key-something", Value: "value", Meta: ""},
 		}, wantErr: true},
@@ -211,6 +345,7 @@ func TestApplyPolicy(t *testing.T) {
 			}
 
 			m := dconf.NewWithDconfDir(dconfDir)
+			m.SetGsettingsCmd(mockGsettings(tc.gsettingsFails))
 			err := m.ApplyPolicy(context.Background(), "ubuntu", tc.isComputer, tc.entries)
 			if tc.wantErr {
 				require.NotNil(t, err, "ApplyPolicy should have failed but didn't")
@@ -218,7 +353,139 @@ func TestApplyPolicy(t *testing.T) {
 			}
 			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
 
+			var warned []string
+			for k, w := range m.Warnings("ubuntu") {
+				require.NotEmpty(t, w, "Warning of %s should have a reason", k)
+				warned = append(warned, k)
+			}
+			require.ElementsMatch(t, tc.wantWarnings, warned, "ApplyPolicy should warn about the keys not matching their schema")
+
 			testutils.CompareTreesWithFiltering(t, dconfDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
 		})
 	}
 }
+
+func TestDumpState(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		isComputer       bool
+		existingDconfDir string
+
+		wantErr bool
+	}{
+		"User state":                   {existingDconfDir: "existing-user"},
+		"Machine state":                {existingDconfDir: "existing-user", isComputer: true},
+		"No state for user without db": {existingDconfDir: "machine-base"},
+		"No state without dconf dir":   {existingDconfDir: "-", isComputer: true},
+
+		// Error cases
+		"Error on unreadable state": {existingDconfDir: "existing-user", isComputer: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dconfDir := filepath.Join(t.TempDir(), "dconf")
+			if tc.existingDconfDir != "-" {
+				require.NoError(t,
+					shutil.CopyTree(
+						filepath.Join("testdata", "TestApplyPolicy", "dconf", tc.existingDconfDir), dconfDir,
+						&shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial dconf directory")
+			}
+			if tc.wantErr {
+				// A directory in place of the file can't be read, even as root.
+				p := filepath.Join(dconfDir, "db", "machine.d", "adsys")
+				require.NoError(t, os.Remove(p), "Setup: can't remove dconf database")
+				require.NoError(t, os.Mkdir(p, 0750), "Setup: can't create directory in place of dconf database")
+			}
+
+			m := dconf.NewWithDconfDir(dconfDir)
+			got, err := m.DumpState(context.Background(), "ubuntu", tc.isComputer)
+			if tc.wantErr {
+				require.Error(t, err, "DumpState should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "DumpState failed but shouldn't have")
+
+			got = strings.ReplaceAll(got, dconfDir, "#DCONFDIR#")
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "DumpState returned unexpected state")
+		})
+	}
+}
+
+// mockGsettings returns the command mocking gsettings, failing if requested.
+func mockGsettings(fail bool) []string {
+	return []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockGsettings", "--", strconv.FormatBool(fail)}
+}
+
+func TestMockGsettings(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		args = args[1:]
+	}
+	fail, args := args[0] == "true", args[1:]
+
+	if fail {
+		fmt.Fprintln(os.Stderr, "requested failure")
+		os.Exit(1)
+	}
+	if os.Getenv("GSETTINGS_BACKEND") != "memory" {
+		fmt.Fprintln(os.Stderr, "gsettings should only read the default values")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list-schemas":
+		fmt.Println("org.gnome.shell /org/gnome/shell/")
+		fmt.Println("com.ubuntu.category /com/ubuntu/category/")
+	case "get":
+		defaults := map[string]string{
+			"key-as":      "['default-as', 'simple-as']",
+			"key-ai":      "[1, 42]",
+			"key-empty":   "@as []",
+			"key-quotes":  `["it's", 'back\\slash']`,
+			"key-invalid": "not a list",
+		}
+		v, ok := defaults[args[2]]
+		if args[1] != "com.ubuntu.category" || !ok {
+			fmt.Fprintln(os.Stderr, "No such key")
+			os.Exit(1)
+		}
+		fmt.Println(v)
+	case "range":
+		ranges := map[string]string{
+			"key-s":                  "type s",
+			"key-i":                  "type i",
+			"key-b":                  "type b",
+			"key-as":                 "type as",
+			"key-ai":                 "type ai",
+			"key-empty":              "type as",
+			"key-quotes":             "type as",
+			"key-returnedunmodified": "type aai",
+			"key-maybe":              "type ms",
+			"key-enum":               "enum\n'first'\n'second'",
+			"key-flags":              "flags\n'first'\n'second'",
+			"key-range":              "range i 1 10",
+			"key-range-double":       "range d 0.5 1.5",
+		}
+		v, ok := ranges[args[2]]
+		if args[1] != "com.ubuntu.category" || !ok {
+			fmt.Fprintln(os.Stderr, "No such key")
+			os.Exit(1)
+		}
+		fmt.Println(v)
+	}
+}
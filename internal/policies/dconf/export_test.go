@@ -0,0 +1,6 @@
+package dconf
+
+// SetGsettingsCmd sets the command used to get the default values of the keys.
+func (m *Manager) SetGsettingsCmd(cmd []string) {
+	m.gsettingsCmd = cmd
+}
@@ -0,0 +1,172 @@
+package dconf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+)
+
+// relocatableList is a key listing the paths where a relocatable schema is used. Applications only read the
+// settings of the paths which are listed, so that settings under other paths are ignored.
+type relocatableList struct {
+	// parent is the path under which the relocatable schema is used, one child path per element.
+	parent string
+	// key is the list of the child paths.
+	key string
+	// element returns the element of the list for the child path named child.
+	element func(parent, child string) string
+}
+
+// relocatableLists are the supported lists of relocatable schemas.
+var relocatableLists = []relocatableList{
+	// Custom keyboard shortcuts, listed by their absolute path.
+	{
+		parent:  "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings",
+		key:     "org/gnome/settings-daemon/plugins/media-keys/custom-keybindings",
+		element: func(parent, child string) string { return fmt.Sprintf("/%s/%s/", parent, child) },
+	},
+	// Terminal profiles, under a :<uuid> path and listed by their uuid.
+	{
+		parent:  "org/gnome/terminal/legacy/profiles:",
+		key:     "org/gnome/terminal/legacy/profiles:/list",
+		element: func(_, child string) string { return strings.TrimPrefix(child, ":") },
+	},
+	// Application folders, listed by their id.
+	{
+		parent:  "org/gnome/desktop/app-folders/folders",
+		key:     "org/gnome/desktop/app-folders/folder-children",
+		element: func(_, child string) string { return child },
+	},
+}
+
+// withRelocatableLists returns entries with the list keys of the relocatable schemas they set values for.
+// The child paths with an enabled value are added to the list, after the elements already set by the policy
+// for that list and the ones in inherited, which are the values of the machine database for a user.
+// The list is locked unless all values of its children are unlocked. A disabled list is left untouched.
+func withRelocatableLists(entries []entry.Entry, inherited map[string]string) (_ []entry.Entry, err error) {
+	entries = slices.Clone(entries)
+	for _, l := range relocatableLists {
+		var children []string
+		locked := false
+		for _, e := range entries {
+			if e.Disabled || filepath.Dir(filepath.Dir(e.Key)) != l.parent {
+				continue
+			}
+			child := filepath.Base(filepath.Dir(e.Key))
+			if !slices.Contains(children, child) {
+				children = append(children, child)
+			}
+			locked = locked || !e.Unlocked
+		}
+		if len(children) == 0 {
+			continue
+		}
+
+		i := slices.IndexFunc(entries, func(e entry.Entry) bool { return e.Key == l.key })
+		if i >= 0 && entries[i].Disabled {
+			continue
+		}
+
+		var elems []string
+		if v, ok := inherited[l.key]; ok {
+			if elems, err = parseStringArray(v); err != nil {
+				return nil, errors.New(gotext.Get("invalid value of %s in machine database: %v", l.key, err))
+			}
+		}
+		if i >= 0 {
+			explicit, err := parseStringArray(normalizeValue(entries[i].Meta, entries[i].Value))
+			if err != nil {
+				return nil, errors.New(gotext.Get("invalid value for %s: %v", l.key, err))
+			}
+			elems = slices.Concat(explicit, elems)
+			locked = locked || !entries[i].Unlocked
+		}
+		for _, c := range children {
+			elems = append(elems, l.element(l.parent, c))
+		}
+		elems = compact(elems)
+
+		var quoted []string
+		for _, e := range elems {
+			quoted = append(quoted, quoteValue(e))
+		}
+		list := entry.Entry{
+			Key:      l.key,
+			Value:    fmt.Sprintf("[%s]", strings.Join(quoted, ", ")),
+			Meta:     "as",
+			Unlocked: !locked,
+		}
+		if i >= 0 {
+			entries[i] = list
+			continue
+		}
+		entries = append(entries, list)
+	}
+
+	return entries, nil
+}
+
+// parseStringArray returns the elements of the array of strings v, in gvariant text format.
+func parseStringArray(v string) ([]string, error) {
+	variant, err := dbus.ParseVariant(v, dbus.SignatureOf([]string{}))
+	if err != nil {
+		return nil, err
+	}
+	var elems []string
+	if err := variant.Store(&elems); err != nil {
+		return nil, err
+	}
+	return elems, nil
+}
+
+// compact removes the duplicated elements of s, keeping the first occurrence.
+func compact(s []string) []string {
+	var r []string
+	for _, e := range s {
+		if !slices.Contains(r, e) {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+// readRelocatableLists returns the values of the relocatable lists set in the adsys database file p.
+// Missing file or lists are ignored.
+func readRelocatableLists(p string) (values map[string]string, err error) {
+	values = make(map[string]string)
+	d, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var section string
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+			continue
+		}
+		k, v, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		key := section + "/" + k
+		if slices.ContainsFunc(relocatableLists, func(l relocatableList) bool { return l.key == key }) {
+			values[key] = v
+		}
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,308 @@
+package dconf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/decorate"
+)
+
+// defaultsDesktop is the desktop whose vendor overrides are used for the default values of the keys, like the
+// defaults displayed in the administrative templates.
+const defaultsDesktop = "ubuntu:GNOME"
+
+// errUncheckedType is returned when a value is of a type the parser doesn't support, like maybe types.
+var errUncheckedType = errors.New("unsupported type")
+
+// installedSchemas reads the schemas installed on the system: the default values of their keys, from the schema
+// and the vendor overrides, and the values their keys accept.
+type installedSchemas struct {
+	gsettingsCmd []string
+
+	// schemas is the schema of each path, loaded on first use.
+	schemas map[string]string
+	loaded  bool
+	loadErr error
+	// uncheckedLogged is true once we logged that the values can't be checked.
+	uncheckedLogged bool
+}
+
+// combine returns the list value of e combined with the default value of its key, according to its list mode:
+//   - merge: the values of e, followed by the default values it doesn't list;
+//   - append: the default values, followed by the values of e which are not part of them.
+//
+// Other modes replace the default value with the one of e.
+func (s *installedSchemas) combine(ctx context.Context, e entry.Entry) (value string, err error) {
+	if e.ListMode != entry.ListModeMerge && e.ListMode != entry.ListModeAppend {
+		return e.Value, nil
+	}
+	if e.Meta != "as" && e.Meta != "ai" {
+		return "", errors.New(gotext.Get("%s mode is only supported for lists, not %q", e.ListMode, e.Meta))
+	}
+
+	defaultValue, err := s.defaultValue(ctx, e.Key)
+	if err != nil {
+		return "", err
+	}
+
+	values, err := listElements(e.Meta, e.Value)
+	if err != nil {
+		return "", err
+	}
+	defaults, err := listElements(e.Meta, defaultValue)
+	if err != nil {
+		return "", errors.New(gotext.Get("invalid default value %q: %v", defaultValue, err))
+	}
+
+	first, second := values, defaults
+	if e.ListMode == entry.ListModeAppend {
+		first, second = defaults, values
+	}
+	r := slices.Clone(first)
+	for _, v := range second {
+		if !slices.Contains(r, v) {
+			r = append(r, v)
+		}
+	}
+
+	return fmt.Sprintf("[%s]", strings.Join(r, ", ")), nil
+}
+
+// defaultValue returns the default value of key, in gvariant text format.
+func (s *installedSchemas) defaultValue(ctx context.Context, key string) (value string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't get default value of %s", key))
+
+	if err := s.load(ctx); err != nil {
+		return "", err
+	}
+	schema, ok := s.schemas[filepath.Dir(key)]
+	if !ok {
+		return "", errors.New(gotext.Get("no schema installed for /%s/", filepath.Dir(key)))
+	}
+	out, err := s.run(ctx, "get", schema, filepath.Base(key))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// validate checks that value matches the type and the range of key in its installed schema. It returns why it
+// doesn't, or an empty string if it does.
+// Keys are not checked if the schemas can't be read or if their path has no installed schema, like relocatable
+// ones.
+func (s *installedSchemas) validate(ctx context.Context, key, value string) (warning string) {
+	if err := s.load(ctx); err != nil {
+		if !s.uncheckedLogged {
+			log.Infof(ctx, "Can't check dconf values against the installed schemas: %v", err)
+			s.uncheckedLogged = true
+		}
+		return ""
+	}
+	schema, ok := s.schemas[filepath.Dir(key)]
+	if !ok {
+		return ""
+	}
+
+	name := filepath.Base(key)
+	out, err := s.run(ctx, "range", schema, name)
+	if err != nil {
+		log.Debugf(ctx, "Can't get range of %s: %v", key, err)
+		return gotext.Get("%s is not a key of schema %s", name, schema)
+	}
+	return checkRange(strings.TrimSpace(string(out)), value)
+}
+
+// load lists the installed schemas with a fixed path, once.
+func (s *installedSchemas) load(ctx context.Context) (err error) {
+	if s.loaded {
+		return s.loadErr
+	}
+	s.loaded = true
+	defer func() { s.loadErr = err }()
+
+	out, err := s.run(ctx, "list-schemas", "--print-paths")
+	if err != nil {
+		return err
+	}
+	s.schemas = make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		schema, path, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !found {
+			continue
+		}
+		s.schemas[strings.Trim(path, "/")] = schema
+	}
+	return scanner.Err()
+}
+
+// run runs gsettings with args, only reading the schemas and the default values of the keys.
+func (s *installedSchemas) run(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := s.gsettingsCmd
+	if len(cmd) == 0 {
+		cmd = []string{"gsettings"}
+	}
+
+	smbsafe.WaitExec()
+	defer smbsafe.DoneExec()
+	// #nosec G204 - we control the command and its arguments
+	c := exec.CommandContext(ctx, cmd[0], append(cmd[1:], args...)...)
+	// The memory backend ignores the values of the dconf databases.
+	c.Env = append(os.Environ(), "GSETTINGS_BACKEND=memory", "XDG_CURRENT_DESKTOP="+defaultsDesktop)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("gsettings %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// listElements returns the elements of the list v of type meta, in gvariant text format.
+func listElements(meta, v string) ([]string, error) {
+	variant, err := dbus.ParseVariant(v, dbus.ParseSignatureMust(meta))
+	if err != nil {
+		return nil, err
+	}
+
+	var elems []string
+	switch l := variant.Value().(type) {
+	case []string:
+		for _, e := range l {
+			elems = append(elems, "'"+strings.ReplaceAll(strings.ReplaceAll(e, `\`, `\\`), "'", `\'`)+"'")
+		}
+	case []int32:
+		for _, e := range l {
+			elems = append(elems, strconv.FormatInt(int64(e), 10))
+		}
+	}
+	return elems, nil
+}
+
+// checkRange checks value against r, the range of its key as printed by gsettings, and returns why it doesn't
+// match, or an empty string if it does. The range is either:
+//   - "type T": any value of type T;
+//   - "enum" followed by one allowed string per line;
+//   - "flags" followed by one allowed string per line, for a list of those strings;
+//   - "range T MIN MAX": a number of type T between MIN and MAX.
+func checkRange(r, value string) (warning string) {
+	lines := strings.Split(r, "\n")
+	fields := strings.Fields(lines[0])
+	if len(fields) == 0 {
+		return ""
+	}
+
+	var t string
+	switch fields[0] {
+	case "type", "range":
+		if len(fields) < 2 {
+			return ""
+		}
+		t = fields[1]
+	case "enum":
+		t = "s"
+	case "flags":
+		t = "as"
+	default:
+		return ""
+	}
+
+	v, err := parseValue(t, value)
+	if errors.Is(err, errUncheckedType) {
+		return ""
+	} else if err != nil {
+		return gotext.Get("%s is not of type %s", value, t)
+	}
+
+	switch fields[0] {
+	case "enum", "flags":
+		var allowed []string
+		for _, l := range lines[1:] {
+			a, err := parseValue("s", l)
+			if err != nil {
+				continue
+			}
+			allowed = append(allowed, a.Value().(string))
+		}
+		values, ok := v.Value().([]string)
+		if !ok {
+			values = []string{v.Value().(string)}
+		}
+		for _, e := range values {
+			if !slices.Contains(allowed, e) {
+				return gotext.Get("%q is not one of %s", e, strings.Join(lines[1:], ", "))
+			}
+		}
+	case "range":
+		if len(fields) != 4 {
+			return ""
+		}
+		n, okN := number(v)
+		minV, errMin := parseValue(t, fields[2])
+		maxV, errMax := parseValue(t, fields[3])
+		if !okN || errMin != nil || errMax != nil {
+			return ""
+		}
+		minN, okMin := number(minV)
+		maxN, okMax := number(maxV)
+		if !okMin || !okMax {
+			return ""
+		}
+		if n.Cmp(minN) < 0 || n.Cmp(maxN) > 0 {
+			return gotext.Get("%s is not between %s and %s", value, fields[2], fields[3])
+		}
+	}
+
+	return ""
+}
+
+// parseValue parses value, in gvariant text format, as a value of type t.
+// It returns errUncheckedType for the types the parser doesn't support.
+func parseValue(t, value string) (dbus.Variant, error) {
+	sig, err := dbus.ParseSignature(t)
+	if err != nil {
+		return dbus.Variant{}, errUncheckedType
+	}
+	return dbus.ParseVariant(value, sig)
+}
+
+// number returns the numeric value of v, if it is a number.
+func number(v dbus.Variant) (*big.Float, bool) {
+	n := new(big.Float)
+	switch x := v.Value().(type) {
+	case byte:
+		n.SetUint64(uint64(x))
+	case int16:
+		n.SetInt64(int64(x))
+	case uint16:
+		n.SetUint64(uint64(x))
+	case int32:
+		n.SetInt64(int64(x))
+	case uint32:
+		n.SetUint64(uint64(x))
+	case int64:
+		n.SetInt64(x)
+	case uint64:
+		n.SetUint64(x)
+	case float64:
+		n.SetFloat64(x)
+	default:
+		return nil, false
+	}
+	return n, true
+}
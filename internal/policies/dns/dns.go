@@ -0,0 +1,329 @@
+// Package dns provides a manager that configures the static host names and the DNS resolution of the machine.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - dns/hosts: static host entries, one per line, as an IP address followed by one or more host names, like in
+//     /etc/hosts. Empty lines and lines starting with # are ignored;
+//   - dns/servers: the DNS servers, separated by spaces, commas or one per line. A server is an IPv4 or IPv6
+//     address, optionally followed by # and the server name used for DNS-over-TLS;
+//   - dns/search-domains: the search domains, separated by spaces, commas or one per line. A domain prefixed with ~
+//     is only used to route the queries of this domain to the configured servers.
+//
+// The host entries are written to a block of /etc/hosts delimited by marker comments, leaving the rest of the file
+// untouched. The DNS servers and search domains are written to a drop-in file of the systemd-resolved
+// configuration directory, and systemd-resolved is then reloaded or restarted.
+//
+// The block and the drop-in file are removed once the policy is not configured anymore, restoring the
+// configuration of the system.
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	hostsFile    = "etc/hosts"
+	resolvedFile = "etc/systemd/resolved.conf.d/adsys.conf"
+	resolvedUnit = "systemd-resolved.service"
+)
+
+// Markers delimiting the host entries managed by adsys in the hosts file.
+const (
+	beginMarker = "# BEGIN adsys managed entries"
+	endMarker   = "# END adsys managed entries"
+)
+
+// hostnameRe matches a host name or a fully qualified domain name.
+var hostnameRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.?$`)
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// settings is the DNS configuration requested by the policy.
+type settings struct {
+	hosts   []string
+	servers []string
+	domains []string
+}
+
+// Manager applies the DNS policy on the machine.
+type Manager struct {
+	rootDir string
+
+	systemctlCmd []string
+	cmdTimeout   time.Duration
+}
+
+type options struct {
+	rootDir      string
+	systemctlCmd []string
+	cmdTimeout   time.Duration
+}
+
+// Option reprents an optional function to change the dns manager.
+type Option func(*options)
+
+// WithRootDir writes the hosts file and the systemd-resolved configuration relative to p instead of the root of
+// the filesystem.
+func WithRootDir(p string) func(*options) {
+	return func(a *options) {
+		a.rootDir = p
+	}
+}
+
+// WithSystemctlCmd overrides the default systemctl command.
+func WithSystemctlCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.systemctlCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the DNS policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		rootDir:      "/",
+		systemctlCmd: []string{"systemctl"},
+		cmdTimeout:   consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		rootDir:      args.rootDir,
+		systemctlCmd: args.systemctlCmd,
+		cmdTimeout:   args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy configures the hosts file and systemd-resolved from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply DNS policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "DNS policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying DNS policy to %s", objectName)
+
+	s, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	if err := updateHosts(filepath.Join(m.rootDir, hostsFile), s.hosts); err != nil {
+		return err
+	}
+
+	changed, err := syshelpers.WriteConfig(filepath.Join(m.rootDir, resolvedFile), s.resolvedConf())
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	log.Info(ctx, gotext.Get("Reloading %s to apply the DNS settings", resolvedUnit))
+	// try-reload-or-restart doesn't start systemd-resolved if it is not running.
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.systemctlCmd, "try-reload-or-restart", resolvedUnit); err != nil {
+		log.Warning(ctx, gotext.Get("Couldn't reload %s, the DNS settings will be applied once it is restarted: %v", resolvedUnit, err))
+	}
+	return nil
+}
+
+// DumpState returns the hosts file and systemd-resolved configuration written during the last refresh of the machine.
+// The state is empty for users or if no DNS policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump DNS state of %s", objectName))
+
+	// DNS policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(
+		filepath.Join(m.rootDir, resolvedFile),
+		filepath.Join(m.rootDir, hostsFile),
+	)
+}
+
+// parseEntries validates the entries and returns the requested configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry) (s settings, err error) {
+	for _, e := range entries {
+		if e.Disabled || strings.TrimSpace(e.Value) == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "dns/hosts":
+			for _, l := range strings.Split(e.Value, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" || strings.HasPrefix(l, "#") {
+					continue
+				}
+				h, err := parseHost(l)
+				if err != nil {
+					return s, err
+				}
+				s.hosts = append(s.hosts, h)
+			}
+		case "dns/servers":
+			for _, v := range splitList(e.Value) {
+				addr, name, _ := strings.Cut(v, "#")
+				if net.ParseIP(addr) == nil || (strings.Contains(v, "#") && !hostnameRe.MatchString(name)) {
+					return s, errors.New(gotext.Get("invalid DNS server %q: expected an IP address, optionally followed by #<server name>", v))
+				}
+				if !slices.Contains(s.servers, v) {
+					s.servers = append(s.servers, v)
+				}
+			}
+		case "dns/search-domains":
+			for _, v := range splitList(e.Value) {
+				if v != "~." && !hostnameRe.MatchString(strings.TrimPrefix(v, "~")) {
+					return s, errors.New(gotext.Get("invalid search domain %q", v))
+				}
+				if !slices.Contains(s.domains, v) {
+					s.domains = append(s.domains, v)
+				}
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing DNS entries, skipping it", e.Key))
+		}
+	}
+
+	return s, nil
+}
+
+// parseHost validates the host entry l and returns it normalized, with its fields separated by a single space.
+func parseHost(l string) (string, error) {
+	fields := strings.Fields(l)
+	if len(fields) < 2 {
+		return "", errors.New(gotext.Get("invalid host entry %q: expected an IP address followed by one or more host names", l))
+	}
+	if net.ParseIP(fields[0]) == nil {
+		return "", errors.New(gotext.Get("invalid IP address %q in host entry %q", fields[0], l))
+	}
+	for _, n := range fields[1:] {
+		if !hostnameRe.MatchString(n) {
+			return "", errors.New(gotext.Get("invalid host name %q in host entry %q", n, l))
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// splitList returns the values of v separated by spaces, commas or new lines.
+func splitList(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
+// resolvedConf returns the systemd-resolved configuration of the settings, or an empty string if nothing is
+// configured.
+func (s settings) resolvedConf() string {
+	if len(s.servers) == 0 && len(s.domains) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	out.WriteString(header)
+	out.WriteString("\n[Resolve]\n")
+	if len(s.servers) > 0 {
+		fmt.Fprintf(&out, "DNS=%s\n", strings.Join(s.servers, " "))
+	}
+	if len(s.domains) > 0 {
+		fmt.Fprintf(&out, "Domains=%s\n", strings.Join(s.domains, " "))
+	}
+	return out.String()
+}
+
+// updateHosts replaces the block managed by adsys in the hosts file p with hosts.
+// The block is appended to the file if it doesn't exist yet, and removed if there are no hosts.
+func updateHosts(p string, hosts []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't update hosts file %s", p))
+
+	// Keep the permissions of an existing file, the hosts file being world readable by default.
+	var mode fs.FileMode = 0644
+	old, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		mode = fi.Mode().Perm()
+	}
+
+	// Keep the lines of the file outside of our block.
+	var lines []string
+	var inBlock bool
+	for _, l := range strings.Split(strings.TrimSuffix(string(old), "\n"), "\n") {
+		switch {
+		case l == beginMarker:
+			inBlock = true
+		case l == endMarker && inBlock:
+			inBlock = false
+		case !inBlock:
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		lines = nil
+	}
+
+	if len(hosts) > 0 {
+		lines = append(lines, beginMarker)
+		lines = append(lines, hosts...)
+		lines = append(lines, endMarker)
+	}
+
+	var content string
+	if len(lines) > 0 {
+		content = strings.Join(lines, "\n") + "\n"
+	}
+	if content == string(old) {
+		return nil
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 the hosts file is world readable
+	if err := os.WriteFile(p+".new", []byte(content), mode); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
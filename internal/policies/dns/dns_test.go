@@ -0,0 +1,119 @@
+package dns_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/dns"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "dns/hosts", Value: "10.0.0.10 fileserver fileserver.example.com\n10.0.0.11 printer.example.com"},
+		{Key: "dns/servers", Value: "10.0.0.1, 10.0.0.2"},
+		{Key: "dns/search-domains", Value: "example.com corp.example.com"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		mockBehaviour string
+		makeReadOnly  string
+
+		wantErr bool
+	}{
+		"All entries":                                {entries: allEntries},
+		"Hosts only":                                 {entries: []entry.Entry{{Key: "dns/hosts", Value: "10.0.0.10 fileserver"}}},
+		"Servers only":                               {entries: []entry.Entry{{Key: "dns/servers", Value: "10.0.0.1"}}},
+		"Search domains only":                        {entries: []entry.Entry{{Key: "dns/search-domains", Value: "example.com"}}},
+		"IPv6 hosts and servers":                     {entries: []entry.Entry{{Key: "dns/hosts", Value: "fd00::10 fileserver"}, {Key: "dns/servers", Value: "fd00::1 2001:db8::53"}}},
+		"Server with DNS-over-TLS name":              {entries: []entry.Entry{{Key: "dns/servers", Value: "9.9.9.9#dns.quad9.net"}}},
+		"Routing domains":                            {entries: []entry.Entry{{Key: "dns/search-domains", Value: "~example.com\n~."}}},
+		"Host entries are normalized":                {entries: []entry.Entry{{Key: "dns/hosts", Value: "  10.0.0.10\tfileserver   fs\n\n# comment\n10.0.0.11 printer "}}},
+		"Duplicated servers and domains are ignored": {entries: []entry.Entry{{Key: "dns/servers", Value: "10.0.0.1 10.0.0.1"}, {Key: "dns/search-domains", Value: "example.com,example.com"}}},
+		"Existing hosts file is preserved":           {existingDirs: "existing-hosts", entries: allEntries},
+		"Existing block and file are updated":        {existingDirs: "existing-conf", entries: allEntries},
+		"Existing block and file are unchanged": {existingDirs: "existing-conf", entries: []entry.Entry{
+			{Key: "dns/hosts", Value: "10.0.0.10 fileserver fileserver.example.com"},
+			{Key: "dns/servers", Value: "10.0.0.1 10.0.0.2"},
+			{Key: "dns/search-domains", Value: "example.com"},
+		}},
+		"No entries removes block and file":       {existingDirs: "existing-conf"},
+		"Failing to reload resolved is a warning": {entries: allEntries, mockBehaviour: "fail-systemctl"},
+
+		"Disabled entries are ignored":     {entries: []entry.Entry{{Key: "dns/servers", Value: "10.0.0.1"}, {Key: "dns/hosts", Value: "10.0.0.10 fileserver", Disabled: true}}},
+		"Empty entries are ignored":        {entries: []entry.Entry{{Key: "dns/servers", Value: "10.0.0.1"}, {Key: "dns/search-domains", Value: " \n"}}},
+		"Unsupported keys are ignored":     {entries: []entry.Entry{{Key: "dns/servers", Value: "10.0.0.1"}, {Key: "dns/fallback-servers", Value: "1.1.1.1"}}},
+		"No entries and no existing files": {},
+		"Not a computer is a no-op":        {isNotComputer: true, existingDirs: "existing-conf"},
+
+		// Error cases
+		"Error on host entry without name":       {entries: []entry.Entry{{Key: "dns/hosts", Value: "10.0.0.10"}}, wantErr: true},
+		"Error on host entry with invalid IP":    {entries: []entry.Entry{{Key: "dns/hosts", Value: "10.0.0.300 fileserver"}}, wantErr: true},
+		"Error on host entry with invalid name":  {entries: []entry.Entry{{Key: "dns/hosts", Value: "10.0.0.10 file_server"}}, wantErr: true},
+		"Error on invalid server":                {entries: []entry.Entry{{Key: "dns/servers", Value: "dns.example.com"}}, wantErr: true},
+		"Error on invalid server name":           {entries: []entry.Entry{{Key: "dns/servers", Value: "9.9.9.9#"}}, wantErr: true},
+		"Error on invalid search domain":         {entries: []entry.Entry{{Key: "dns/search-domains", Value: "example..com"}}, wantErr: true},
+		"Error on unwritable hosts file":         {existingDirs: "existing-conf", makeReadOnly: "etc", entries: allEntries, wantErr: true},
+		"Error on unwritable resolved directory": {existingDirs: "existing-conf", makeReadOnly: "etc/systemd/resolved.conf.d", entries: allEntries, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.makeReadOnly != "" {
+				testutils.MakeReadOnly(t, filepath.Join(root, tc.makeReadOnly))
+			}
+
+			m := dns.New(
+				dns.WithRootDir(root),
+				dns.WithSystemctlCmd(testutils.MockCommand(root, "systemctl", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, behaviours, args := c.Name, strings.Split(c.Behaviour, ","), c.Args
+
+	c.Log(fmt.Sprintf("%s %s", name, strings.Join(args, " ")))
+
+	if slices.Contains(behaviours, "fail-"+name) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,526 @@
+// Package encryption provides a manager that checks the disk encryption of the machine, enrolls its TPM to
+// unlock the disk and escrows its recovery key.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - encryption/required: true to require the root filesystem to be on a LUKS encrypted device. The disk
+//     isn't encrypted by the policy: a machine which isn't encrypted is reported as not compliant.
+//   - encryption/tpm: true to enroll the TPM of the machine to unlock the encrypted root device at boot,
+//     bound to the secure boot state (PCR 7).
+//   - encryption/escrow-attribute: the name of the attribute of the computer object the recovery key is
+//     written to, over LDAPS, authenticated with the Kerberos ticket of the machine.
+//   - encryption/escrow-url: the HTTPS endpoint the recovery key is posted to, as JSON.
+//
+// When the TPM enrollment or an escrow is configured, a recovery key is enrolled on the encrypted device with
+// systemd-cryptenroll. The recovery key is then used to unlock the device for the next enrollments, and is kept
+// in the state directory, on the encrypted filesystem. The first enrollment is unlocked with the TPM token of the
+// device if it already has one or, failing that, with the key file provisioned at install time.
+//
+// The recovery key is escrowed on the next online refresh after it is enrolled, and again whenever the escrow
+// destinations change. The keys enrolled on the device are kept once the policy is not configured anymore.
+// The encryption status of the machine is reported on each refresh.
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/ldaphelpers"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// stateFile stores the recovery key enrolled by adsys and where it was escrowed.
+	stateFile = "state"
+	// unlockFile is the temporary file the recovery key is passed to systemd-cryptenroll with.
+	unlockFile = "unlock.key"
+)
+
+// attributeRe matches an LDAP attribute name.
+var attributeRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+// recoveryKeyRe matches a recovery key generated by systemd-cryptenroll, in modhex.
+var recoveryKeyRe = regexp.MustCompile(`[cbdefghijklnrtuv]{8}(-[cbdefghijklnrtuv]{8}){7}`)
+
+// settings is the disk encryption configuration requested by the policy.
+type settings struct {
+	required        bool
+	tpm             bool
+	escrowAttribute string
+	escrowURL       string
+}
+
+// escrows returns the destinations the recovery key is escrowed to.
+func (s settings) escrows() []string {
+	var destinations []string
+	if s.escrowAttribute != "" {
+		destinations = append(destinations, "attribute="+s.escrowAttribute)
+	}
+	if s.escrowURL != "" {
+		destinations = append(destinations, "url="+s.escrowURL)
+	}
+	return destinations
+}
+
+// state is the recovery key enrolled by adsys on the encrypted root device.
+type state struct {
+	Device      string   `json:"device"`
+	RecoveryKey string   `json:"recovery_key"`
+	Escrowed    []string `json:"escrowed,omitempty"`
+}
+
+// Manager applies the disk encryption policy on the machine.
+type Manager struct {
+	domain        string
+	stateDir      string
+	krb5CacheDir  string
+	unlockKeyFile string
+
+	findmntCmd     []string
+	lsblkCmd       []string
+	cryptsetupCmd  []string
+	cryptenrollCmd []string
+	ldapDial       ldaphelpers.Dialer
+	cmdTimeout     time.Duration
+	ldapTimeout    time.Duration
+
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+type options struct {
+	stateDir       string
+	runDir         string
+	unlockKeyFile  string
+	findmntCmd     []string
+	lsblkCmd       []string
+	cryptsetupCmd  []string
+	cryptenrollCmd []string
+	ldapDial       ldaphelpers.Dialer
+	cmdTimeout     time.Duration
+	ldapTimeout    time.Duration
+	httpClient     *http.Client
+	now            func() time.Time
+}
+
+// Option reprents an optional function to change the encryption manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithRunDir overrides the default run directory.
+func WithRunDir(p string) func(*options) {
+	return func(a *options) {
+		a.runDir = p
+	}
+}
+
+// WithUnlockKeyFile overrides the default path of the key file provisioned to unlock the encrypted device.
+func WithUnlockKeyFile(p string) func(*options) {
+	return func(a *options) {
+		a.unlockKeyFile = p
+	}
+}
+
+// WithFindmntCmd overrides the default findmnt command.
+func WithFindmntCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.findmntCmd = cmd
+	}
+}
+
+// WithLsblkCmd overrides the default lsblk command.
+func WithLsblkCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.lsblkCmd = cmd
+	}
+}
+
+// WithCryptsetupCmd overrides the default cryptsetup command.
+func WithCryptsetupCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.cryptsetupCmd = cmd
+	}
+}
+
+// WithCryptenrollCmd overrides the default systemd-cryptenroll command.
+func WithCryptenrollCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.cryptenrollCmd = cmd
+	}
+}
+
+// WithLdapDialer overrides the default connection to the directory, bound over SASL GSSAPI.
+func WithLdapDialer(dial ldaphelpers.Dialer) func(*options) {
+	return func(a *options) {
+		a.ldapDial = dial
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command or escrow request can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// WithLdapTimeout overrides the default maximum time any LDAP request to the directory can take.
+func WithLdapTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.ldapTimeout = timeout
+	}
+}
+
+// New returns a new manager for the disk encryption policy.
+func New(domain string, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:       consts.DefaultStateDir,
+		runDir:         consts.DefaultRunDir,
+		unlockKeyFile:  consts.DefaultEncryptionUnlockKeyFile,
+		findmntCmd:     []string{"findmnt"},
+		lsblkCmd:       []string{"lsblk"},
+		cryptsetupCmd:  []string{"cryptsetup"},
+		cryptenrollCmd: []string{"systemd-cryptenroll"},
+		cmdTimeout:     consts.DefaultHelperExecTimeout,
+		ldapTimeout:    consts.DefaultLdapTimeout,
+		now:            time.Now,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+	if args.httpClient == nil {
+		args.httpClient = &http.Client{Timeout: args.cmdTimeout}
+	}
+
+	return &Manager{
+		domain:        domain,
+		stateDir:      filepath.Join(args.stateDir, "encryption"),
+		krb5CacheDir:  filepath.Join(args.runDir, "krb5cc"),
+		unlockKeyFile: args.unlockKeyFile,
+
+		findmntCmd:     args.findmntCmd,
+		lsblkCmd:       args.lsblkCmd,
+		cryptsetupCmd:  args.cryptsetupCmd,
+		cryptenrollCmd: args.cryptenrollCmd,
+		ldapDial:       args.ldapDial,
+		cmdTimeout:     args.cmdTimeout,
+		ldapTimeout:    args.ldapTimeout,
+
+		httpClient: args.httpClient,
+		now:        args.now,
+	}
+}
+
+// ApplyPolicy checks the encryption of the root device, enrolls the TPM and escrows the recovery key of the
+// device as requested by the entries. The attribute escrow is written against the server serverFQDN.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer, isOnline bool, serverFQDN string, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply disk encryption policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Disk encryption policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying disk encryption policy to %s", objectName)
+
+	s, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	cur, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	if !s.required && !s.tpm && len(s.escrows()) == 0 {
+		if cur.RecoveryKey != "" {
+			// The keys enrolled on the device are kept: only forget the recovery key.
+			log.Info(ctx, gotext.Get("Disk encryption policy is not configured anymore, removing the recovery key from the machine"))
+			return m.saveState(state{})
+		}
+		return nil
+	}
+
+	dev, err := m.luksDevice(ctx)
+	if err != nil {
+		return err
+	}
+	if dev == "" {
+		report(ctx, s, false, false, false)
+		return m.saveState(state{})
+	}
+
+	tokens, err := m.tokens(ctx, dev)
+	if err != nil {
+		return err
+	}
+	hasTPM := slices.Contains(tokens, "systemd-tpm2")
+
+	if cur.Device != dev || !slices.Contains(tokens, "systemd-recovery") {
+		if cur.RecoveryKey != "" {
+			log.Warning(ctx, gotext.Get("The recovery key known by adsys is not enrolled on %s anymore, enrolling a new one", dev))
+		}
+		cur = state{Device: dev}
+	}
+
+	if cur.RecoveryKey == "" && ((s.tpm && !hasTPM) || len(s.escrows()) > 0) {
+		key, err := m.enrollRecoveryKey(ctx, dev, hasTPM)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			report(ctx, s, true, hasTPM, false)
+			return nil
+		}
+		// The key is saved right away, as it can't be retrieved from the device.
+		cur.RecoveryKey = key
+		if err := m.saveState(cur); err != nil {
+			return err
+		}
+	}
+
+	if s.tpm && !hasTPM {
+		if err := m.enrollTPM(ctx, dev, cur.RecoveryKey); err != nil {
+			return err
+		}
+		hasTPM = true
+	}
+
+	// Only keep the destinations still configured, so that the key is escrowed again if one is added back.
+	cur.Escrowed = slices.DeleteFunc(cur.Escrowed, func(d string) bool { return !slices.Contains(s.escrows(), d) })
+	var pending []string
+	for _, d := range s.escrows() {
+		if !slices.Contains(cur.Escrowed, d) {
+			pending = append(pending, d)
+		}
+	}
+	if len(pending) > 0 && !isOnline {
+		log.Info(ctx, gotext.Get("Machine is offline, the recovery key will be escrowed on the next refresh"))
+		pending = nil
+	}
+	for _, d := range pending {
+		if err := m.escrow(ctx, objectName, serverFQDN, d, cur); err != nil {
+			return errors.Join(err, m.saveState(cur))
+		}
+		cur.Escrowed = append(cur.Escrowed, d)
+	}
+
+	report(ctx, s, true, hasTPM, len(cur.Escrowed) == len(s.escrows()))
+	return m.saveState(cur)
+}
+
+// parseEntries validates the entries and returns the requested configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry) (s settings, err error) {
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "encryption/required", "encryption/tpm":
+			if v != "true" && v != "false" {
+				return s, errors.New(gotext.Get("invalid %s value %q: true or false is expected", e.Key, v))
+			}
+			if e.Key == "encryption/required" {
+				s.required = v == "true"
+			} else {
+				s.tpm = v == "true"
+			}
+		case "encryption/escrow-attribute":
+			if !attributeRe.MatchString(v) {
+				return s, errors.New(gotext.Get("invalid attribute name %q", v))
+			}
+			s.escrowAttribute = v
+		case "encryption/escrow-url":
+			if u, err := url.Parse(v); err != nil || u.Scheme != "https" || u.Host == "" {
+				return s, errors.New(gotext.Get("invalid escrow URL %q: an https URL is expected", v))
+			}
+			s.escrowURL = v
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing disk encryption entries, skipping it", e.Key))
+		}
+	}
+
+	return s, nil
+}
+
+// report logs the encryption status of the machine and whether it complies with the settings.
+func report(ctx context.Context, s settings, encrypted, tpm, escrowed bool) {
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	status := fmt.Sprintf("encrypted=%s; tpm=%s; recovery-key-escrowed=%s", yesNo(encrypted), yesNo(tpm), yesNo(escrowed))
+
+	if (s.required && !encrypted) || (s.tpm && !tpm) || (len(s.escrows()) > 0 && !escrowed) {
+		log.Warning(ctx, gotext.Get("Disk encryption of the machine doesn't comply with the policy: %s", status))
+		return
+	}
+	log.Infof(ctx, "Disk encryption of the machine complies with the policy: %s", status)
+}
+
+// luksDevice returns the LUKS device the root filesystem is on, or an empty string if it isn't encrypted.
+func (m *Manager) luksDevice(ctx context.Context) (string, error) {
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.findmntCmd, "-n", "-o", "SOURCE", "/")
+	if err != nil {
+		return "", err
+	}
+	source := strings.TrimSpace(out)
+	if source == "" {
+		return "", errors.New(gotext.Get("can't find the device of the root filesystem"))
+	}
+
+	// Lists the device and all the devices it is built on.
+	out, err = syshelpers.Run(ctx, m.cmdTimeout, m.lsblkCmd, "-n", "-s", "-r", "-o", "PATH,FSTYPE", source)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range strings.Split(out, "\n") {
+		if fields := strings.Fields(l); len(fields) == 2 && fields[1] == "crypto_LUKS" {
+			return fields[0], nil
+		}
+	}
+	return "", nil
+}
+
+// tokens returns the types of the LUKS tokens of dev, like systemd-tpm2 or systemd-recovery.
+func (m *Manager) tokens(ctx context.Context, dev string) (types []string, err error) {
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.cryptsetupCmd, "luksDump", "--dump-json-metadata", dev)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata struct {
+		Tokens map[string]struct {
+			Type string `json:"type"`
+		} `json:"tokens"`
+	}
+	if err := json.Unmarshal([]byte(out), &metadata); err != nil {
+		return nil, errors.New(gotext.Get("can't parse LUKS metadata of %s: %v", dev, err))
+	}
+	for _, t := range metadata.Tokens {
+		types = append(types, t.Type)
+	}
+	return types, nil
+}
+
+// enrollRecoveryKey enrolls a new recovery key on dev and returns it, unlocking the device with its TPM if
+// hasTPM is true, or with the provisioned key file otherwise.
+// An empty key is returned if the device can't be unlocked.
+func (m *Manager) enrollRecoveryKey(ctx context.Context, dev string, hasTPM bool) (key string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't enroll a recovery key on %s", dev))
+
+	unlock := "--unlock-tpm2-device=auto"
+	if !hasTPM {
+		if _, err := os.Stat(m.unlockKeyFile); errors.Is(err, fs.ErrNotExist) {
+			log.Warning(ctx, gotext.Get("Can't enroll a recovery key on %s: the device has no TPM token and no unlock key is provisioned at %s", dev, m.unlockKeyFile))
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		unlock = "--unlock-key-file=" + m.unlockKeyFile
+	}
+
+	log.Infof(ctx, "Enrolling a recovery key on %s", dev)
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.cryptenrollCmd, "--recovery-key", unlock, dev)
+	if err != nil {
+		return "", err
+	}
+	if key = recoveryKeyRe.FindString(out); key == "" {
+		return "", errors.New(gotext.Get("no recovery key returned by systemd-cryptenroll"))
+	}
+	return key, nil
+}
+
+// enrollTPM enrolls the TPM of the machine on dev, unlocking the device with the recovery key.
+func (m *Manager) enrollTPM(ctx context.Context, dev, recoveryKey string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't enroll the TPM on %s", dev))
+
+	// The recovery key is passed in a file only readable by root.
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	p := filepath.Join(m.stateDir, unlockFile)
+	if err := os.WriteFile(p, []byte(recoveryKey), 0600); err != nil {
+		return err
+	}
+	defer func() {
+		if errRemove := os.Remove(p); errRemove != nil {
+			err = errors.Join(err, errRemove)
+		}
+	}()
+
+	log.Infof(ctx, "Enrolling the TPM on %s", dev)
+	_, err = syshelpers.Run(ctx, m.cmdTimeout, m.cryptenrollCmd, "--tpm2-device=auto", "--tpm2-pcrs=7", "--unlock-key-file="+p, dev)
+	return err
+}
+
+// loadState returns the recovery key enrolled by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load disk encryption state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the recovery key enrolled by adsys, only readable by root.
+// The state file is removed if there is no recovery key.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save disk encryption state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if s.RecoveryKey == "" {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
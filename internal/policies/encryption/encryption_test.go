@@ -0,0 +1,267 @@
+package encryption_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/encryption"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	required := entry.Entry{Key: "encryption/required", Value: "true"}
+	tpm := entry.Entry{Key: "encryption/tpm", Value: "true"}
+	escrowAttribute := entry.Entry{Key: "encryption/escrow-attribute", Value: "adsysRecoveryKey"}
+	escrowURL := entry.Entry{Key: "encryption/escrow-url", Value: "https://escrow.example.com/keys"}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		isOffline     bool
+		serverFQDN    string
+		existingState string
+		unlockKey     bool
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Encrypted machine is compliant":                  {entries: []entry.Entry{required}},
+		"Encrypted machine on lvm is compliant":           {entries: []entry.Entry{required}, mockBehaviour: "lvm"},
+		"Machine not encrypted is reported":               {entries: []entry.Entry{required}, mockBehaviour: "not-encrypted"},
+		"Required set to false only reports":              {entries: []entry.Entry{{Key: "encryption/required", Value: "false"}}, mockBehaviour: "not-encrypted"},
+		"Enroll TPM with provisioned key":                 {entries: []entry.Entry{tpm}, unlockKey: true},
+		"Enroll TPM with recovery key of adsys":           {entries: []entry.Entry{tpm}, existingState: "enrolled", mockBehaviour: "has-recovery"},
+		"TPM already enrolled":                            {entries: []entry.Entry{tpm}, mockBehaviour: "has-tpm"},
+		"TPM not enrolled without unlock key":             {entries: []entry.Entry{tpm}},
+		"Escrow to attribute unlocking with TPM":          {entries: []entry.Entry{escrowAttribute}, mockBehaviour: "has-tpm"},
+		"Escrow to attribute unlocking with provisioned":  {entries: []entry.Entry{escrowAttribute}, unlockKey: true},
+		"Escrow to URL":                                   {entries: []entry.Entry{escrowURL}, mockBehaviour: "has-tpm"},
+		"All entries":                                     {entries: []entry.Entry{required, tpm, escrowAttribute, escrowURL}, unlockKey: true},
+		"Escrowed key is not escrowed again":              {entries: []entry.Entry{escrowAttribute}, existingState: "enrolled", mockBehaviour: "has-recovery"},
+		"Escrow again to new destination":                 {entries: []entry.Entry{escrowURL}, existingState: "enrolled", mockBehaviour: "has-recovery"},
+		"Enroll new recovery key if not enrolled anymore": {entries: []entry.Entry{escrowAttribute}, existingState: "enrolled", mockBehaviour: "has-tpm"},
+		"Query the domain without active server":          {entries: []entry.Entry{escrowAttribute}, serverFQDN: "-", mockBehaviour: "has-tpm"},
+		"Offline machine escrows on next refresh":         {entries: []entry.Entry{escrowAttribute}, isOffline: true, mockBehaviour: "has-tpm"},
+		"Machine not encrypted removes the recovery key":  {entries: []entry.Entry{escrowAttribute}, existingState: "enrolled", mockBehaviour: "not-encrypted"},
+		"No entries removes the recovery key":             {existingState: "enrolled"},
+		"Disabled entries are ignored":                    {entries: []entry.Entry{{Key: "encryption/tpm", Value: "true", Disabled: true}}},
+		"Unsupported keys are ignored":                    {entries: []entry.Entry{required, {Key: "encryption/cipher", Value: "aes"}}},
+		"No entries is a no-op":                           {},
+		"Not a computer is a no-op":                       {entries: []entry.Entry{tpm}, isUser: true, existingState: "enrolled"},
+
+		// Error cases
+		"Error on invalid boolean value":             {entries: []entry.Entry{{Key: "encryption/tpm", Value: "yes"}}, wantErr: true},
+		"Error on invalid attribute name":            {entries: []entry.Entry{{Key: "encryption/escrow-attribute", Value: "info; rm"}}, wantErr: true},
+		"Error on escrow URL not using https":        {entries: []entry.Entry{{Key: "encryption/escrow-url", Value: "http://escrow.example.com/keys"}}, wantErr: true},
+		"Error on corrupted state":                   {entries: []entry.Entry{required}, existingState: "corrupted", wantErr: true},
+		"Error on findmnt failure":                   {entries: []entry.Entry{required}, mockBehaviour: "fail-findmnt", wantErr: true},
+		"Error on lsblk failure":                     {entries: []entry.Entry{required}, mockBehaviour: "fail-lsblk", wantErr: true},
+		"Error on cryptsetup failure":                {entries: []entry.Entry{required}, mockBehaviour: "fail-cryptsetup", wantErr: true},
+		"Error on invalid LUKS metadata":             {entries: []entry.Entry{required}, mockBehaviour: "invalid-metadata", wantErr: true},
+		"Error on recovery key enrollment failure":   {entries: []entry.Entry{tpm}, unlockKey: true, mockBehaviour: "fail-systemd-cryptenroll", wantErr: true},
+		"Error on no recovery key returned":          {entries: []entry.Entry{tpm}, unlockKey: true, mockBehaviour: "no-recovery-key", wantErr: true},
+		"Error on TPM enrollment failure":            {entries: []entry.Entry{tpm}, existingState: "enrolled", mockBehaviour: "has-recovery,fail-tpm-enroll", wantErr: true},
+		"Error on searching the directory":           {entries: []entry.Entry{escrowAttribute}, mockBehaviour: "has-tpm,fail-ldap-search", wantErr: true},
+		"Error on computer not found":                {entries: []entry.Entry{escrowAttribute}, mockBehaviour: "has-tpm,no-computer", wantErr: true},
+		"Error on writing the recovery key":          {entries: []entry.Entry{escrowAttribute}, mockBehaviour: "has-tpm,fail-ldap-modify", wantErr: true},
+		"Error on escrow endpoint returning failure": {entries: []entry.Entry{escrowURL}, mockBehaviour: "has-tpm,fail-escrow", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+			unlockKeyFile := filepath.Join(root, "luks-unlock.key")
+			if tc.unlockKey {
+				require.NoError(t, os.WriteFile(unlockKeyFile, []byte("provisioned passphrase"), 0600), "Setup: can't create unlock key file")
+			}
+
+			switch tc.serverFQDN {
+			case "":
+				tc.serverFQDN = "dc1.example.com"
+			case "-":
+				tc.serverFQDN = ""
+			}
+
+			behaviours := strings.Split(tc.mockBehaviour, ",")
+			directory := testutils.MockDirectory{
+				Root:       root,
+				LDIF:       mockComputer(behaviours),
+				FailSearch: slices.Contains(behaviours, "fail-ldap-search"),
+				FailModify: slices.Contains(behaviours, "fail-ldap-modify"),
+			}
+
+			m := encryption.New("example.com",
+				encryption.WithStateDir(root),
+				encryption.WithRunDir("/run/adsys"),
+				encryption.WithUnlockKeyFile(unlockKeyFile),
+				encryption.WithFindmntCmd(testutils.MockCommand(root, "findmnt", tc.mockBehaviour)),
+				encryption.WithLsblkCmd(testutils.MockCommand(root, "lsblk", tc.mockBehaviour)),
+				encryption.WithCryptsetupCmd(testutils.MockCommand(root, "cryptsetup", tc.mockBehaviour)),
+				encryption.WithCryptenrollCmd(testutils.MockCommand(root, "systemd-cryptenroll", tc.mockBehaviour)),
+				encryption.WithLdapDialer(directory.Dial),
+				encryption.WithHTTPClient(&http.Client{Transport: &mockEscrow{root: root, fail: strings.Contains(tc.mockBehaviour, "fail-escrow")}}),
+				encryption.WithNow(func() time.Time { return time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*60*60)) }),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, !tc.isOffline, tc.serverFQDN, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockEscrow is an escrow endpoint logging the requests it receives in root/escrow.log.
+type mockEscrow struct {
+	root string
+	fail bool
+	mu   sync.Mutex
+}
+
+func (e *mockEscrow) RoundTrip(r *http.Request) (*http.Response, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// #nosec G302 - this is a test log file
+	f, err := os.OpenFile(filepath.Join(e.root, "escrow.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s %s\n%s\n", r.Method, r.URL, r.Header.Get("Content-Type"), body)
+
+	status := http.StatusCreated
+	if e.fail {
+		status = http.StatusForbidden
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       io.NopCloser(strings.NewReader("requested failure")),
+		Request:    r,
+	}, nil
+}
+
+// mockComputer returns the computer object of the machine, unless behaviours contains no-computer.
+func mockComputer(behaviours []string) func(*ldap.SearchRequest) (string, bool) {
+	return func(*ldap.SearchRequest) (string, bool) {
+		if slices.Contains(behaviours, "no-computer") {
+			return "", true
+		}
+		return "dn: CN=UBUNTU,CN=Computers,DC=example,DC=com\n", true
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, root, behaviours, args := c.Name, c.Root, strings.Split(c.Behaviour, ","), c.Args
+
+	// Log the call, replacing the temporary paths to get a stable output.
+	line := name
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+	// Log the key the device is unlocked with.
+	for _, a := range args {
+		if p, found := strings.CutPrefix(a, "--unlock-key-file="); found {
+			d, err := os.ReadFile(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Can't read unlock key file: %v", err)
+				os.Exit(1)
+			}
+			line += fmt.Sprintf("\nunlocked with %q", d)
+		}
+	}
+	line = strings.ReplaceAll(line, root, "#ROOT#")
+
+	c.Log(line)
+
+	if slices.Contains(behaviours, "fail-"+name) ||
+		(name == "systemd-cryptenroll" && slices.Contains(args, "--tpm2-device=auto") && slices.Contains(behaviours, "fail-tpm-enroll")) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+
+	switch name {
+	case "findmnt":
+		if slices.Contains(behaviours, "not-encrypted") {
+			fmt.Println("/dev/nvme0n1p2")
+			return
+		}
+		if slices.Contains(behaviours, "lvm") {
+			fmt.Println("/dev/mapper/vgubuntu-root")
+			return
+		}
+		fmt.Println("/dev/mapper/dm_crypt-0")
+	case "lsblk":
+		if slices.Contains(behaviours, "not-encrypted") {
+			fmt.Print("/dev/nvme0n1p2 ext4\n/dev/nvme0n1 \n")
+			return
+		}
+		if slices.Contains(behaviours, "lvm") {
+			fmt.Print("/dev/mapper/vgubuntu-root ext4\n/dev/mapper/dm_crypt-0 LVM2_member\n/dev/nvme0n1p3 crypto_LUKS\n/dev/nvme0n1 \n")
+			return
+		}
+		fmt.Print("/dev/mapper/dm_crypt-0 ext4\n/dev/nvme0n1p3 crypto_LUKS\n/dev/nvme0n1 \n")
+	case "cryptsetup":
+		if slices.Contains(behaviours, "invalid-metadata") {
+			fmt.Println("not json")
+			return
+		}
+		var tokens []string
+		if slices.Contains(behaviours, "has-tpm") {
+			tokens = append(tokens, fmt.Sprintf(`"%d": {"type": "systemd-tpm2", "keyslots": ["%d"]}`, len(tokens), len(tokens)+1))
+		}
+		if slices.Contains(behaviours, "has-recovery") {
+			tokens = append(tokens, fmt.Sprintf(`"%d": {"type": "systemd-recovery", "keyslots": ["%d"]}`, len(tokens), len(tokens)+1))
+		}
+		fmt.Printf(`{"keyslots": {}, "tokens": {%s}, "segments": {}}`+"\n", strings.Join(tokens, ", "))
+	case "systemd-cryptenroll":
+		if !slices.Contains(args, "--recovery-key") {
+			fmt.Fprintln(os.Stderr, "New TPM2 token enrolled as key slot 2.")
+			return
+		}
+		if slices.Contains(behaviours, "no-recovery-key") {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "A secret recovery key has been generated for this volume:")
+		fmt.Println("    vvdchcrl-rtcrgtfg-hncvhfdf-itkhrrnn-ikcneffj-rtutdkdj-ndkbubff-gjkfbbvc")
+		fmt.Fprintln(os.Stderr, "New recovery key enrolled as key slot 1.")
+	}
+}
@@ -0,0 +1,91 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/ldaphelpers"
+	"github.com/ubuntu/decorate"
+)
+
+// escrowRequest is the JSON document posted to the escrow URL.
+type escrowRequest struct {
+	Hostname    string `json:"hostname"`
+	Device      string `json:"device"`
+	RecoveryKey string `json:"recovery_key"`
+	Date        string `json:"date"`
+}
+
+// escrow writes the recovery key of s to the destination d, of the form attribute=<name> or url=<url>.
+func (m *Manager) escrow(ctx context.Context, objectName, serverFQDN, d string, s state) (err error) {
+	kind, dest, _ := strings.Cut(d, "=")
+	defer decorate.OnError(&err, gotext.Get("can't escrow the recovery key to %s %s", kind, dest))
+
+	log.Infof(ctx, "Escrowing the recovery key of %s to %s %s", s.Device, kind, dest)
+	date := m.now().UTC().Format(time.RFC3339)
+
+	switch kind {
+	case "attribute":
+		if serverFQDN == "" {
+			log.Debugf(ctx, "No active server found, querying domain %q directly", m.domain)
+			serverFQDN = m.domain
+		}
+		c := m.ldapClient(objectName, serverFQDN)
+		dn, err := c.ComputerDN(ctx, m.domain, objectName)
+		if err != nil {
+			return err
+		}
+		return c.Replace(ctx, dn, dest, fmt.Sprintf("device=%s; recovery-key=%s; escrowed=%s", s.Device, s.RecoveryKey, date))
+	case "url":
+		return m.post(ctx, dest, escrowRequest{Hostname: objectName, Device: s.Device, RecoveryKey: s.RecoveryKey, Date: date})
+	}
+	return errors.New(gotext.Get("unknown escrow destination"))
+}
+
+// post posts the escrow request r as JSON to the url u.
+func (m *Manager) post(ctx context.Context, u string, r escrowRequest) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.cmdTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New(gotext.Get("escrow endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(msg))))
+	}
+	return nil
+}
+
+// ldapClient returns the client updating the directory of serverFQDN with the Kerberos ticket of the machine.
+func (m *Manager) ldapClient(objectName, serverFQDN string) ldaphelpers.Client {
+	return ldaphelpers.Client{
+		URL:        "ldaps://" + serverFQDN,
+		Krb5CCName: filepath.Join(m.krb5CacheDir, objectName),
+		Timeout:    m.ldapTimeout,
+		Dial:       m.ldapDial,
+	}
+}
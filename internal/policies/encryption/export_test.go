@@ -0,0 +1,20 @@
+package encryption
+
+import (
+	"net/http"
+	"time"
+)
+
+// WithNow defines a custom clock for tests.
+func WithNow(now func() time.Time) func(*options) {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// WithHTTPClient defines a custom HTTP client for tests.
+func WithHTTPClient(c *http.Client) func(*options) {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
@@ -0,0 +1,466 @@
+// Package enrollment provides a manager that enrolls the machine to Ubuntu Pro and to Landscape, so that the
+// machines of the fleet are enrolled automatically on their first policy refresh.
+//
+// The enrollment is configured on computer objects, with the following settings:
+//   - enrollment/pro-token: the Ubuntu Pro contract token the machine is attached with;
+//   - enrollment/pro-token-file: the file containing the contract token, relative to the enrollment/ directory of
+//     the assets share, so that the token is not stored in the GPO. It can't be set along with
+//     enrollment/pro-token;
+//   - enrollment/pro-services: the services enabled when attaching the machine, instead of the default ones of the
+//     contract. Services are separated by spaces, commas or one per line;
+//   - enrollment/landscape-server: the host name of the Landscape server the machine is registered with, with an
+//     optional port;
+//   - enrollment/landscape-account: the Landscape account name. It defaults to "standalone", the account of
+//     self-hosted servers;
+//   - enrollment/landscape-registration-key: the registration key of the account, if any;
+//   - enrollment/landscape-tags: the tags of the machine in Landscape, separated by spaces, commas or one per line.
+//
+// The machine is attached to Ubuntu Pro with "pro attach" if it isn't attached yet, and registered to Landscape
+// with "landscape-config" whenever the Landscape settings change. The hash of the last applied Landscape
+// settings is kept in a state file.
+//
+// The enrollment is not reverted when the policy is removed: the machine stays attached and registered until it is
+// detached or unregistered manually.
+//
+// This policy doesn't require Ubuntu Pro, as it is the one attaching the machine to it. The policies which require
+// it are applied on the refresh following the attachment.
+package enrollment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// assetsDir is the directory of the assets share the token files are read from.
+	assetsDir = "enrollment"
+	// stateFile keeps the hash of the last applied Landscape settings.
+	stateFile = "state.json"
+	// defaultLandscapeAccount is the account of self-hosted Landscape servers.
+	defaultLandscapeAccount = "standalone"
+	// enrollTimeout is the maximum time attaching or registering the machine can take, as it contacts the servers
+	// and enables the services.
+	enrollTimeout = 5 * time.Minute
+)
+
+var (
+	tokenRegexp   = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+	serviceRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	accountRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	tagRegexp     = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+)
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// state is the enrollment last applied.
+type state struct {
+	// Landscape is the hash of the last applied Landscape settings.
+	Landscape string `json:"landscape,omitempty"`
+}
+
+// config is the enrollment configured by the policy.
+type config struct {
+	proToken     string
+	proTokenFile string
+	proServices  []string
+
+	landscapeServer          string
+	landscapeAccount         string
+	landscapeRegistrationKey string
+	landscapeTags            []string
+}
+
+// Manager applies the enrollment policy.
+type Manager struct {
+	stateDir           string
+	proCmd             []string
+	landscapeConfigCmd []string
+	cmdTimeout         time.Duration
+}
+
+type options struct {
+	stateDir           string
+	proCmd             []string
+	landscapeConfigCmd []string
+	cmdTimeout         time.Duration
+}
+
+// Option reprents an optional function to change the enrollment manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithProCmd overrides the default pro command.
+func WithProCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.proCmd = cmd
+	}
+}
+
+// WithLandscapeConfigCmd overrides the default landscape-config command.
+func WithLandscapeConfigCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.landscapeConfigCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time the status of the machine can take to be queried.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the enrollment policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:           consts.DefaultStateDir,
+		proCmd:             []string{"pro"},
+		landscapeConfigCmd: []string{"landscape-config"},
+		cmdTimeout:         consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:           filepath.Join(args.stateDir, "enrollment"),
+		proCmd:             args.proCmd,
+		landscapeConfigCmd: args.landscapeConfigCmd,
+		cmdTimeout:         args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy attaches the machine to Ubuntu Pro and registers it to Landscape, as configured by the entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply enrollment policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Enrollment policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying enrollment policy to %s", objectName)
+
+	cfg, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	if cfg.proToken != "" || cfg.proTokenFile != "" {
+		if err := m.attach(ctx, cfg, assetsDumper); err != nil {
+			return err
+		}
+	}
+
+	return m.register(ctx, objectName, cfg)
+}
+
+// DumpState returns the hash of the Landscape settings applied during the last refresh of the machine.
+// The state is empty for users or if no enrollment policy is applied. The attach configuration is not part of
+// the state, as it contains the Ubuntu Pro token.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump enrollment state of %s", objectName))
+
+	// Enrollment policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// attach attaches the machine to Ubuntu Pro with the configured token, unless it is already attached.
+func (m *Manager) attach(ctx context.Context, cfg config, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't attach machine to Ubuntu Pro"))
+
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.proCmd, "status", "--format", "json")
+	if err != nil {
+		return err
+	}
+	var status struct {
+		Attached bool `json:"attached"`
+	}
+	if err := json.Unmarshal([]byte(out), &status); err != nil {
+		return errors.New(gotext.Get("invalid status: %v", err))
+	}
+	if status.Attached {
+		log.Debug(ctx, "Machine is already attached to Ubuntu Pro")
+		return nil
+	}
+
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+
+	token := cfg.proToken
+	if cfg.proTokenFile != "" {
+		if token, err = m.readTokenFile(ctx, cfg.proTokenFile, assetsDumper); err != nil {
+			return err
+		}
+	}
+
+	// The token is passed in a configuration file only readable by root, to not expose it in the command line.
+	d, err := yaml.Marshal(struct {
+		Token          string   `yaml:"token"`
+		EnableServices []string `yaml:"enable_services,omitempty"`
+	}{Token: token, EnableServices: cfg.proServices})
+	if err != nil {
+		return err
+	}
+	attachConfig := filepath.Join(m.stateDir, "attach.yaml")
+	if err := os.WriteFile(attachConfig, d, 0600); err != nil {
+		return err
+	}
+	defer func() {
+		if errRemove := os.Remove(attachConfig); errRemove != nil {
+			err = errors.Join(err, errRemove)
+		}
+	}()
+
+	log.Info(ctx, gotext.Get("Attaching machine to Ubuntu Pro"))
+	if _, err := syshelpers.Run(ctx, enrollTimeout, m.proCmd, "attach", "--attach-config", attachConfig); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readTokenFile returns the token in the file p of the assets share.
+func (m *Manager) readTokenFile(ctx context.Context, p string, assetsDumper AssetsDumper) (token string, err error) {
+	tmp, err := os.MkdirTemp(m.stateDir, ".assets-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if errRemove := os.RemoveAll(tmp); errRemove != nil {
+			err = errors.Join(err, errRemove)
+		}
+	}()
+	// Only root can read the assets, as they contain secrets.
+	assets := filepath.Join(tmp, assetsDir)
+	if err := assetsDumper(ctx, assetsDir+"/", assets, -1, -1); err != nil {
+		return "", err
+	}
+
+	d, err := os.ReadFile(filepath.Join(assets, p))
+	if err != nil {
+		return "", err
+	}
+	token = strings.TrimSpace(string(d))
+	if !tokenRegexp.MatchString(token) {
+		return "", errors.New(gotext.Get("invalid Ubuntu Pro token in %s", p))
+	}
+	return token, nil
+}
+
+// register registers the machine to Landscape with the configured settings, if they changed since the last
+// registration.
+func (m *Manager) register(ctx context.Context, objectName string, cfg config) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't register machine to Landscape"))
+
+	s, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// The machine stays registered, but is registered again if the policy is set back.
+	if cfg.landscapeServer == "" {
+		return m.saveState(state{})
+	}
+
+	args := []string{
+		"--silent",
+		"--computer-title", objectName,
+		"--account-name", cfg.landscapeAccount,
+		"--url", fmt.Sprintf("https://%s/message-system", cfg.landscapeServer),
+		"--ping-url", fmt.Sprintf("http://%s/ping", cfg.landscapeServer),
+	}
+	if cfg.landscapeRegistrationKey != "" {
+		args = append(args, "--registration-key", cfg.landscapeRegistrationKey)
+	}
+	if len(cfg.landscapeTags) > 0 {
+		args = append(args, "--tags", strings.Join(cfg.landscapeTags, ","))
+	}
+
+	// Only the hash of the settings is kept, as they contain the registration key.
+	h := sha256.Sum256([]byte(strings.Join(args, "\x00")))
+	digest := hex.EncodeToString(h[:])
+	if s.Landscape == digest {
+		log.Debug(ctx, "Machine is already registered to Landscape with the same settings")
+		return nil
+	}
+
+	log.Info(ctx, gotext.Get("Registering machine to Landscape server %s", cfg.landscapeServer))
+	if _, err := syshelpers.Run(ctx, enrollTimeout, m.landscapeConfigCmd, args...); errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return errors.New(gotext.Get("landscape-client is not installed"))
+	} else if err != nil {
+		return err
+	}
+
+	return m.saveState(state{Landscape: digest})
+}
+
+// parseEntries returns the enrollment configured by the entries.
+func parseEntries(ctx context.Context, entries []entry.Entry) (cfg config, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid enrollment policy"))
+
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+		switch e.Key {
+		case "enrollment/pro-token":
+			if !tokenRegexp.MatchString(v) {
+				return cfg, errors.New(gotext.Get("invalid Ubuntu Pro token"))
+			}
+			cfg.proToken = v
+		case "enrollment/pro-token-file":
+			p := filepath.Clean(v)
+			if !filepath.IsLocal(p) {
+				return cfg, errors.New(gotext.Get("token file %q is not a path relative to the %s directory of the assets", v, assetsDir))
+			}
+			cfg.proTokenFile = p
+		case "enrollment/pro-services":
+			if cfg.proServices, err = parseList(v, serviceRegexp, gotext.Get("Ubuntu Pro service")); err != nil {
+				return cfg, err
+			}
+		case "enrollment/landscape-server":
+			if !validServer(v) {
+				return cfg, errors.New(gotext.Get("invalid Landscape server %q", v))
+			}
+			cfg.landscapeServer = v
+		case "enrollment/landscape-account":
+			if !accountRegexp.MatchString(v) {
+				return cfg, errors.New(gotext.Get("invalid Landscape account %q", v))
+			}
+			cfg.landscapeAccount = v
+		case "enrollment/landscape-registration-key":
+			if strings.ContainsAny(v, "\r\n") {
+				return cfg, errors.New(gotext.Get("Landscape registration key must be on a single line"))
+			}
+			cfg.landscapeRegistrationKey = v
+		case "enrollment/landscape-tags":
+			if cfg.landscapeTags, err = parseList(v, tagRegexp, gotext.Get("Landscape tag")); err != nil {
+				return cfg, err
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing enrollment entries, skipping it", e.Key))
+		}
+	}
+
+	if cfg.proToken != "" && cfg.proTokenFile != "" {
+		return cfg, errors.New(gotext.Get("Ubuntu Pro token and token file can't be both set"))
+	}
+	if cfg.landscapeAccount == "" {
+		cfg.landscapeAccount = defaultLandscapeAccount
+	}
+	return cfg, nil
+}
+
+// parseList returns the deduplicated elements of v, separated by spaces, commas or new lines, checking that they
+// match re. kind describes the elements in errors.
+func parseList(v string, re *regexp.Regexp, kind string) (elems []string, err error) {
+	for _, elem := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' }) {
+		if !re.MatchString(elem) {
+			return nil, errors.New(gotext.Get("invalid %s %q", kind, elem))
+		}
+		if slices.Contains(elems, elem) {
+			continue
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+// validServer returns true if server is a host name or an IP address, with an optional port.
+func validServer(server string) bool {
+	host := server
+	if h, port, err := net.SplitHostPort(server); err == nil {
+		if port == "" || strings.Trim(port, "0123456789") != "" {
+			return false
+		}
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") ||
+			strings.Trim(strings.ToLower(label), "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// loadState loads the last applied enrollment.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load enrollment state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the last applied enrollment.
+// The state file is removed if there is no enrollment to track anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save enrollment state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if s == (state{}) {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,154 @@
+package enrollment_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/enrollment"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	landscape := []entry.Entry{
+		{Key: "enrollment/landscape-server", Value: "landscape.example.com"},
+		{Key: "enrollment/landscape-account", Value: "example"},
+		{Key: "enrollment/landscape-registration-key", Value: "registration key"},
+		{Key: "enrollment/landscape-tags", Value: "desktop, finance"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		mockBehaviour string
+		assetsErr     bool
+
+		wantErr bool
+	}{
+		"Attach with token":                          {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}}},
+		"Attach with token file":                     {entries: []entry.Entry{{Key: "enrollment/pro-token-file", Value: "token"}}},
+		"Attach with services":                       {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}, {Key: "enrollment/pro-services", Value: "esm-infra, livepatch\nusg usg"}}},
+		"Already attached machine is not attached":   {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}}, mockBehaviour: "attached"},
+		"Register to Landscape":                      {entries: landscape},
+		"Register to self-hosted Landscape":          {entries: []entry.Entry{{Key: "enrollment/landscape-server", Value: "10.0.0.5:8443"}}},
+		"Attach and register":                        {entries: append([]entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}}, landscape...)},
+		"Registered machine is not registered again": {entries: landscape, existingDirs: "registered"},
+		"Changed settings register again": {existingDirs: "registered", entries: []entry.Entry{
+			{Key: "enrollment/landscape-server", Value: "landscape.example.com"},
+			{Key: "enrollment/landscape-account", Value: "example"},
+			{Key: "enrollment/landscape-tags", Value: "desktop"},
+		}},
+		"No entries forgets registration": {existingDirs: "registered"},
+
+		"Disabled entries are ignored":     {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}, {Key: "enrollment/landscape-server", Value: "landscape.example.com", Disabled: true}}},
+		"Empty entries are ignored":        {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}, {Key: "enrollment/landscape-server", Value: " "}}},
+		"Unsupported keys are ignored":     {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}, {Key: "enrollment/pro-detach", Value: "true"}}},
+		"No entries and no existing state": {},
+		"Not a computer is a no-op":        {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}}, isNotComputer: true},
+
+		// Error cases
+		"Error on invalid token":                          {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C123 4567"}}, wantErr: true},
+		"Error on token and token file":                   {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}, {Key: "enrollment/pro-token-file", Value: "token"}}, wantErr: true},
+		"Error on token file outside of assets":           {entries: []entry.Entry{{Key: "enrollment/pro-token-file", Value: "../scripts/token"}}, wantErr: true},
+		"Error on missing token file":                     {entries: []entry.Entry{{Key: "enrollment/pro-token-file", Value: "missing"}}, wantErr: true},
+		"Error on invalid token in token file":            {entries: []entry.Entry{{Key: "enrollment/pro-token-file", Value: "invalid-token"}}, wantErr: true},
+		"Error on assets dump failure":                    {entries: []entry.Entry{{Key: "enrollment/pro-token-file", Value: "token"}}, assetsErr: true, wantErr: true},
+		"Error on invalid service":                        {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}, {Key: "enrollment/pro-services", Value: "esm_infra"}}, wantErr: true},
+		"Error on invalid Landscape server":               {entries: []entry.Entry{{Key: "enrollment/landscape-server", Value: "https://landscape.example.com"}}, wantErr: true},
+		"Error on invalid Landscape account":              {entries: []entry.Entry{{Key: "enrollment/landscape-server", Value: "landscape.example.com"}, {Key: "enrollment/landscape-account", Value: "my account"}}, wantErr: true},
+		"Error on multi-lines registration key":           {entries: []entry.Entry{{Key: "enrollment/landscape-server", Value: "landscape.example.com"}, {Key: "enrollment/landscape-registration-key", Value: "key\nother"}}, wantErr: true},
+		"Error on invalid Landscape tag":                  {entries: []entry.Entry{{Key: "enrollment/landscape-server", Value: "landscape.example.com"}, {Key: "enrollment/landscape-tags", Value: "desktop;finance"}}, wantErr: true},
+		"Error on pro status failure":                     {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}}, mockBehaviour: "fail-pro", wantErr: true},
+		"Error on invalid pro status":                     {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}}, mockBehaviour: "invalid-status", wantErr: true},
+		"Error on pro attach failure":                     {entries: []entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}}, mockBehaviour: "fail-attach", wantErr: true},
+		"Error on landscape-config failure":               {entries: landscape, mockBehaviour: "fail-landscape-config", wantErr: true},
+		"Error on landscape-client not installed":         {entries: landscape, mockBehaviour: "no-landscape-config", wantErr: true},
+		"Error on attach failure with Landscape settings": {entries: append([]entry.Entry{{Key: "enrollment/pro-token", Value: "C1234567890"}}, landscape...), mockBehaviour: "fail-attach", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+
+			landscapeConfigCmd := testutils.MockCommand(root, "landscape-config", tc.mockBehaviour)
+			if tc.mockBehaviour == "no-landscape-config" {
+				landscapeConfigCmd = []string{"/nonexistent/landscape-config"}
+			}
+
+			m := enrollment.New(
+				enrollment.WithStateDir(filepath.Join(root, "var", "lib", "adsys")),
+				enrollment.WithProCmd(testutils.MockCommand(root, "pro", tc.mockBehaviour)),
+				enrollment.WithLandscapeConfigCmd(landscapeConfigCmd),
+			)
+			assetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.assetsErr, Path: "enrollment/"}
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries, assetsDumper.SaveAssetsTo)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, root, behaviours, args := c.Name, c.Root, strings.Split(c.Behaviour, ","), c.Args
+
+	line := name
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", strings.ReplaceAll(a, root, "ROOT"))
+	}
+	// Log the attach configuration, which is removed once the machine is attached.
+	if name == "pro" && args[0] == "attach" {
+		d, err := os.ReadFile(args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't read attach configuration: %v", err)
+			os.Exit(1)
+		}
+		line += "\n" + string(d)
+	}
+
+	c.Log(line)
+
+	if slices.Contains(behaviours, "fail-"+name) || (slices.Contains(behaviours, "fail-attach") && args[0] == "attach") {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+
+	if name == "pro" && args[0] == "status" {
+		switch {
+		case slices.Contains(behaviours, "invalid-status"):
+			fmt.Println("not json")
+		case slices.Contains(behaviours, "attached"):
+			fmt.Println(`{"attached": true, "services": []}`)
+		default:
+			fmt.Println(`{"attached": false, "services": []}`)
+		}
+	}
+}
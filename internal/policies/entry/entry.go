@@ -13,6 +13,21 @@ type Entry struct {
 	// Strategy are overlay rules for the same keys between multiple GPOs.
 	// Default (empty or unknown value) means "override".
 	Strategy string `yaml:",omitempty"`
+	// Flavors is the comma separated list of Ubuntu flavors the entry is restricted to, like kubuntu,xubuntu.
+	// Empty means the entry applies to every flavor.
+	Flavors string `yaml:",omitempty"`
+	// Desktops is the comma separated list of desktop environments the entry is restricted to, like KDE,XFCE.
+	// Empty means the entry applies to every desktop environment.
+	Desktops string `yaml:",omitempty"`
+	// Unlocked is set when the value is only the default one, which users can still override, instead of being
+	// enforced. It is only supported by dconf entries.
+	Unlocked bool `yaml:",omitempty"`
+	// Mode is the enforcement mode of the entry. In audit mode, the changes the entry would apply are only
+	// reported, without being applied. Default (empty or unknown value) means "enforce".
+	Mode string `yaml:",omitempty"`
+	// ListMode is how a list value is combined with the default value of the system. Default (empty or unknown
+	// value) means "replace". It is only supported by dconf entries.
+	ListMode string `yaml:",omitempty"`
 	// Err is set if there was an error parsing the entry. It is ignored if the
 	// underlying key is not supported by adsys.
 	Err error `yaml:"-"`
@@ -27,3 +42,20 @@ const (
 	StrategyAppend = "append"
 	// This can be extended to support prepend but it is implemented yet as there is no real world cases.
 )
+
+const (
+	// ModeEnforce is the default enforcement mode, applying the entry.
+	ModeEnforce = "enforce"
+	// ModeAudit is the enforcement mode only reporting the changes the entry would apply.
+	ModeAudit = "audit"
+)
+
+const (
+	// ListModeReplace is the default list mode, replacing the default value of the system.
+	ListModeReplace = "replace"
+	// ListModeMerge lists the values of the entry, followed by the default values of the system it doesn't list.
+	ListModeMerge = "merge"
+	// ListModeAppend lists the default values of the system, followed by the values of the entry which are not
+	// part of them.
+	ListModeAppend = "append"
+)
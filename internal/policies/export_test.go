@@ -1,6 +1,8 @@
 package policies
 
 import (
+	"time"
+
 	"github.com/ubuntu/adsys/internal/policies/gdm"
 )
 
@@ -17,6 +19,51 @@ func WithGDM(m *gdm.Manager) Option {
 	}
 }
 
+// WithSupportedRules specifies the rules the manager can apply, as in a restricted build.
+func WithSupportedRules(rules []string) Option {
+	return func(o *options) error {
+		o.supportedRules = rules
+		return nil
+	}
+}
+
 func (pols Policies) HasAssets() bool {
 	return pols.assets != nil
 }
+
+// FilterGPOsForRing exposes filterGPOsForRing for tests.
+var FilterGPOsForRing = filterGPOsForRing
+
+// FilterGPOsForHardware exposes filterGPOsForHardware for tests.
+var FilterGPOsForHardware = filterGPOsForHardware
+
+// FilterEntriesForTarget exposes filterEntriesForTarget for tests.
+var FilterEntriesForTarget = filterEntriesForTarget
+
+// WithNow specifies a personalized clock for tracking and filtering policy changes.
+func WithNow(now func() time.Time) Option {
+	return func(o *options) error {
+		o.now = now
+		return nil
+	}
+}
+
+// LazyManager exposes lazyManager for tests.
+type LazyManager[T any] struct {
+	l *lazyManager[T]
+}
+
+// NewLazyManager exposes newLazyManager for tests.
+func NewLazyManager[T any](build func() T) LazyManager[T] {
+	return LazyManager[T]{l: newLazyManager(build)}
+}
+
+// Acquire exposes lazyManager.acquire for tests.
+func (l LazyManager[T]) Acquire() T {
+	return l.l.acquire()
+}
+
+// Release exposes lazyManager.release for tests.
+func (l LazyManager[T]) Release() {
+	l.l.release()
+}
@@ -0,0 +1,17 @@
+package files
+
+import "os/user"
+
+// WithUserLookup defines a custom userLookup function for tests.
+func WithUserLookup(f func(string) (*user.User, error)) Option {
+	return func(o *options) {
+		o.userLookup = f
+	}
+}
+
+// WithGroupLookup defines a custom groupLookup function for tests.
+func WithGroupLookup(f func(string) (*user.Group, error)) Option {
+	return func(o *options) {
+		o.groupLookup = f
+	}
+}
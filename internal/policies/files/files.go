@@ -0,0 +1,510 @@
+// Package files provides a manager that deploys files from the assets share to the machine.
+//
+// This manager only applies to computer objects.
+//
+// The following setting is supported:
+//   - files/deploy: files to deploy, one per line, of the form
+//     source=<path>, target=<path>[, mode=<mode>][, owner=<user>][, group=<group>][, action=<action>]
+//     where source is relative to the files/ directory of the assets share, target is the absolute
+//     path of the deployed file and mode is its octal permissions (0644 by default). Files are
+//     owned by root by default, and by the primary group of their owner if no group is set.
+//
+// The action follows the apply modes of the Group Policy Preferences items:
+//   - update, the default, and replace deploy the file, overwriting any existing one;
+//   - create only deploys the file if the target doesn't exist yet;
+//   - delete removes the target, and doesn't need any source.
+//
+// Items of the Group Policy Preferences "Files" extension whose source is in the files/ directory
+// of the assets share are converted to this setting when the GPOs are parsed.
+//
+// A file is only rewritten when its content, permissions or ownership differ from the requested ones.
+// The deployed files are saved in a state file, so that they are removed once they are not configured
+// anymore.
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	stateFile = "state.json"
+	// assetsDir is the directory of the assets share the files are deployed from.
+	assetsDir = "files"
+
+	defaultMode  = 0644
+	defaultOwner = "root"
+)
+
+// Apply modes of the files.
+const (
+	actionCreate  = "create"
+	actionReplace = "replace"
+	actionUpdate  = "update"
+	actionDelete  = "delete"
+)
+
+// file is a file to deploy, with its requested permissions and ownership.
+type file struct {
+	source string
+	target string
+	mode   fs.FileMode
+	owner  string
+	group  string
+	action string
+}
+
+// state is the list of files deployed by adsys.
+type state struct {
+	// Targets are the paths of the deployed files.
+	Targets []string `json:"targets,omitempty"`
+}
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// Manager applies the files policy on the machine.
+type Manager struct {
+	stateDir string
+	rootDir  string
+
+	userLookup  func(string) (*user.User, error)
+	groupLookup func(string) (*user.Group, error)
+}
+
+type options struct {
+	stateDir string
+	rootDir  string
+
+	userLookup  func(string) (*user.User, error)
+	groupLookup func(string) (*user.Group, error)
+}
+
+// Option reprents an optional function to change the files manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithRootDir deploys the files relative to p instead of the root of the filesystem.
+func WithRootDir(p string) func(*options) {
+	return func(a *options) {
+		a.rootDir = p
+	}
+}
+
+// New returns a new manager for the files policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:    consts.DefaultStateDir,
+		rootDir:     "/",
+		userLookup:  user.Lookup,
+		groupLookup: user.LookupGroup,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:    filepath.Join(args.stateDir, "files"),
+		rootDir:     args.rootDir,
+		userLookup:  args.userLookup,
+		groupLookup: args.groupLookup,
+	}
+}
+
+// ApplyPolicy deploys the files from the list of entries, and removes the ones not configured anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply files policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Files policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying files policy to %s", objectName)
+
+	files, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to revert.
+	if len(files) == 0 && len(prev.Targets) == 0 {
+		return nil
+	}
+
+	var deployed []string
+	if slices.ContainsFunc(files, func(f file) bool { return f.action != actionDelete }) {
+		if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+			return err
+		}
+		assets, err := os.MkdirTemp(m.stateDir, "assets-")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if errRemove := os.RemoveAll(assets); errRemove != nil {
+				err = errors.Join(err, errRemove)
+			}
+		}()
+		// Only root can read the assets until they are deployed.
+		if err := assetsDumper(ctx, assetsDir+"/", filepath.Join(assets, assetsDir), -1, -1); err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if f.action == actionDelete {
+				continue
+			}
+			if _, err := os.Lstat(m.path(f.target)); f.action == actionCreate && err == nil {
+				log.Debugf(ctx, "File %s already exists, not creating it", f.target)
+				// Keep tracking the file if it was created by adsys, so that it is removed once not configured anymore.
+				if slices.Contains(prev.Targets, f.target) {
+					deployed = append(deployed, f.target)
+				}
+				continue
+			}
+			if err := m.deploy(ctx, filepath.Join(assets, assetsDir), f); err != nil {
+				// Still save the files deployed so far, so that they can be removed.
+				return errors.Join(err, m.saveState(state{Targets: mergeTargets(prev.Targets, deployed)}))
+			}
+			deployed = append(deployed, f.target)
+		}
+	}
+
+	for _, f := range files {
+		if f.action != actionDelete {
+			continue
+		}
+		if err := m.delete(ctx, f.target); err != nil {
+			return errors.Join(err, m.saveState(state{Targets: mergeTargets(prev.Targets, deployed)}))
+		}
+	}
+
+	for _, target := range prev.Targets {
+		if slices.Contains(deployed, target) {
+			continue
+		}
+		log.Infof(ctx, "Removing file %s, not configured anymore", target)
+		if err := os.Remove(m.path(target)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return errors.Join(err, m.saveState(state{Targets: mergeTargets(prev.Targets, deployed)}))
+		}
+	}
+
+	return m.saveState(state{Targets: deployed})
+}
+
+// DumpState returns the deployed files recorded during the last refresh of the machine.
+// The state is empty for users or if no files policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump files state of %s", objectName))
+
+	// Files policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// deploy writes the file f from the assets directory to its target, if its content, permissions
+// or ownership changed.
+func (m *Manager) deploy(ctx context.Context, assets string, f file) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't deploy %s to %s", f.source, f.target))
+
+	src := filepath.Join(assets, f.source)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return errors.New(gotext.Get("source not found in the assets share: %v", err))
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New(gotext.Get("source is not a regular file"))
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	uid, gid, err := m.ownership(f)
+	if err != nil {
+		return err
+	}
+
+	dest := m.path(f.target)
+	if unchanged(dest, content, f.mode, uid, gid) {
+		log.Debugf(ctx, "File %s is up to date", f.target)
+		return nil
+	}
+
+	log.Infof(ctx, "Deploying %s to %s", f.source, f.target)
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dest+".adsys.new", content, 0600); err != nil {
+		return err
+	}
+	if err := os.Chown(dest+".adsys.new", uid, gid); err != nil {
+		return errors.Join(err, os.Remove(dest+".adsys.new"))
+	}
+	// Change the mode once the file is owned by the right user, and after any umask is applied.
+	if err := os.Chmod(dest+".adsys.new", f.mode); err != nil {
+		return errors.Join(err, os.Remove(dest+".adsys.new"))
+	}
+	return os.Rename(dest+".adsys.new", dest)
+}
+
+// delete removes the file target, if it exists.
+func (m *Manager) delete(ctx context.Context, target string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't delete %s", target))
+
+	fi, err := os.Lstat(m.path(target))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errors.New(gotext.Get("target is a directory"))
+	}
+
+	log.Infof(ctx, "Deleting file %s", target)
+	return os.Remove(m.path(target))
+}
+
+// ownership returns the uid and gid the file f should be owned by.
+func (m *Manager) ownership(f file) (uid, gid int, err error) {
+	u, err := m.userLookup(f.owner)
+	if err != nil {
+		return 0, 0, errors.New(gotext.Get("unknown owner %q: %v", f.owner, err))
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, errors.New(gotext.Get("couldn't convert %q to a valid uid for %q", u.Uid, f.owner))
+	}
+
+	// The group defaults to the primary group of the owner.
+	gidStr := u.Gid
+	if f.group != "" {
+		g, err := m.groupLookup(f.group)
+		if err != nil {
+			return 0, 0, errors.New(gotext.Get("unknown group %q: %v", f.group, err))
+		}
+		gidStr = g.Gid
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return 0, 0, errors.New(gotext.Get("couldn't convert %q to a valid gid", gidStr))
+	}
+
+	return uid, gid, nil
+}
+
+// unchanged returns true if p exists with the given content, permissions and ownership.
+func unchanged(p string, content []byte, mode fs.FileMode, uid, gid int) bool {
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm() != mode {
+		return false
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid || int(st.Gid) != gid {
+		return false
+	}
+	d, err := os.ReadFile(p)
+	return err == nil && bytes.Equal(d, content)
+}
+
+// path returns the path of target on the managed filesystem.
+func (m *Manager) path(target string) string {
+	return filepath.Join(m.rootDir, target)
+}
+
+// parseEntries validates the entries and returns the files to deploy, in order.
+func parseEntries(ctx context.Context, entries []entry.Entry) (files []file, err error) {
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		if e.Key != "files/deploy" {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing files entries, skipping it", e.Key))
+			continue
+		}
+
+		for _, l := range strings.Split(v, "\n") {
+			l = strings.TrimSpace(l)
+			if l == "" {
+				continue
+			}
+			f, err := parseFile(l)
+			if err != nil {
+				return nil, err
+			}
+			// Files from the closest GPO are listed last: they override the ones from further GPOs.
+			if i := slices.IndexFunc(files, func(o file) bool { return o.target == f.target }); i >= 0 {
+				files = slices.Delete(files, i, i+1)
+			}
+			files = append(files, f)
+		}
+	}
+
+	return files, nil
+}
+
+// parseFile parses a file line of the form source=<path>, target=<path>[, mode=<mode>][, owner=<user>][, group=<group>][, action=<action>].
+func parseFile(l string) (f file, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid file %q", l))
+
+	f.mode = defaultMode
+	var mode string
+	for _, field := range strings.Split(l, ",") {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return f, errors.New(gotext.Get("expected source=<path>, target=<path>[, mode=<mode>][, owner=<user>][, group=<group>][, action=<action>]"))
+		}
+
+		var dest *string
+		switch k {
+		case "source":
+			dest = &f.source
+		case "target":
+			dest = &f.target
+		case "mode":
+			dest = &mode
+		case "owner":
+			dest = &f.owner
+		case "group":
+			dest = &f.group
+		case "action":
+			dest = &f.action
+		default:
+			return f, errors.New(gotext.Get("unsupported field %q", k))
+		}
+		if *dest != "" {
+			return f, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		*dest = v
+	}
+
+	switch f.action = strings.ToLower(f.action); f.action {
+	case "":
+		f.action = actionUpdate
+	case actionCreate, actionReplace, actionUpdate:
+	case actionDelete:
+		// Only the target is needed to delete a file.
+		if f.target == "" || f.source != "" || mode != "" || f.owner != "" || f.group != "" {
+			return f, errors.New(gotext.Get("expected target=<path>, action=delete"))
+		}
+		if !filepath.IsAbs(f.target) || filepath.Clean(f.target) != f.target || f.target == "/" {
+			return f, errors.New(gotext.Get("target %q must be an absolute file path", f.target))
+		}
+		return f, nil
+	default:
+		return f, errors.New(gotext.Get("action %q must be one of create, replace, update or delete", f.action))
+	}
+
+	if f.source == "" || f.target == "" {
+		return f, errors.New(gotext.Get("expected source=<path>, target=<path>[, mode=<mode>][, owner=<user>][, group=<group>][, action=<action>]"))
+	}
+	f.source = filepath.ToSlash(f.source)
+	if filepath.IsAbs(f.source) || !filepath.IsLocal(f.source) {
+		return f, errors.New(gotext.Get("source %q must be relative to the %s/ directory of the assets share", f.source, assetsDir))
+	}
+	if !filepath.IsAbs(f.target) || filepath.Clean(f.target) != f.target || f.target == "/" {
+		return f, errors.New(gotext.Get("target %q must be an absolute file path", f.target))
+	}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return f, errors.New(gotext.Get("mode %q must be octal permissions, between 0000 and 0777", mode))
+		}
+		f.mode = fs.FileMode(m)
+	}
+	if f.owner == "" {
+		f.owner = defaultOwner
+	}
+
+	return f, nil
+}
+
+// mergeTargets returns the targets of a and b, without duplicates.
+func mergeTargets(a, b []string) []string {
+	r := slices.Clone(a)
+	for _, t := range b {
+		if !slices.Contains(r, t) {
+			r = append(r, t)
+		}
+	}
+	return r
+}
+
+// loadState returns the files previously deployed by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load files state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the files deployed by adsys.
+// The state file is removed if nothing is deployed anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save files state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Targets) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
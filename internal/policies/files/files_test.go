@@ -0,0 +1,134 @@
+package files_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/files"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries         []entry.Entry
+		isNotComputer   bool
+		existingState   string
+		saveAssetsError bool
+
+		wantModes map[string]fs.FileMode
+		wantErr   bool
+	}{
+		"Deploy files": {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf\nsource=sub/banner.txt, target=/etc/issue.net"}},
+			wantModes: map[string]fs.FileMode{"/etc/app.conf": 0644, "/etc/issue.net": 0644}},
+		"Deploy files with mode, owner and group": {entries: []entry.Entry{{Key: "files/deploy", Value: "source=hello.sh, target=/usr/local/bin/hello, mode=0750, owner=alice, group=adm\nsource=app.conf, target=/etc/app.conf, mode=600"}},
+			wantModes: map[string]fs.FileMode{"/usr/local/bin/hello": 0750, "/etc/app.conf": 0600}},
+		"Fields are case insensitive and unordered":  {entries: []entry.Entry{{Key: "files/deploy", Value: " Target = /etc/app.conf ,  SOURCE = app.conf "}}},
+		"Empty lines are ignored":                    {entries: []entry.Entry{{Key: "files/deploy", Value: "\nsource=app.conf, target=/etc/app.conf\n\n"}}},
+		"Closest GPO overrides the same target":      {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf\nsource=sub/banner.txt, target=/etc/app.conf"}}},
+		"Changed files are updated":                  {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf"}}, existingState: "deployed"},
+		"Files not configured anymore are removed":   {entries: []entry.Entry{{Key: "files/deploy", Value: "source=sub/banner.txt, target=/etc/issue.net"}}, existingState: "deployed"},
+		"Mode changes are applied to unchanged file": {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, mode=0640"}}, existingState: "deployed", wantModes: map[string]fs.FileMode{"/etc/app.conf": 0640}},
+		"No entries removes files":                   {existingState: "deployed"},
+		"No entries removes files without assets":    {existingState: "deployed", saveAssetsError: true},
+		"Disabled entries are ignored":               {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf", Disabled: true}}},
+		"Unsupported keys are ignored":               {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf"}, {Key: "files/other", Value: "something"}}},
+		"No entries is a no-op":                      {},
+		"Users are ignored":                          {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf"}}, isNotComputer: true},
+		"Create action deploys missing files":        {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, action=create"}}},
+		"Create action keeps existing files":         {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, action=create"}}, existingState: "existing"},
+		"Create action keeps files created by adsys": {entries: []entry.Entry{{Key: "files/deploy", Value: "source=sub/banner.txt, target=/etc/app.conf, action=create"}}, existingState: "deployed"},
+		"Replace action overwrites existing files":   {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, action=replace"}}, existingState: "existing"},
+		"Update action overwrites existing files":    {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, action=UPDATE"}}, existingState: "existing"},
+		"Delete action removes files":                {entries: []entry.Entry{{Key: "files/deploy", Value: "target=/etc/obsolete.conf, action=delete"}}, existingState: "existing"},
+		"Delete action removes deployed files":       {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf\ntarget=/etc/old.conf, action=delete"}}, existingState: "deployed"},
+		"Delete action on missing files is a no-op":  {entries: []entry.Entry{{Key: "files/deploy", Value: "target=/etc/missing.conf, action=delete"}}},
+		"Delete action doesn't need assets":          {entries: []entry.Entry{{Key: "files/deploy", Value: "target=/etc/obsolete.conf, action=delete"}}, existingState: "existing", saveAssetsError: true},
+		"Closest GPO delete overrides deployment":    {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf"}, {Key: "files/deploy", Value: "target=/etc/app.conf, action=delete"}}, existingState: "existing"},
+
+		// Error cases
+		"Error on missing source":                   {entries: []entry.Entry{{Key: "files/deploy", Value: "target=/etc/app.conf"}}, wantErr: true},
+		"Error on missing target":                   {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf"}}, wantErr: true},
+		"Error on empty field":                      {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target="}}, wantErr: true},
+		"Error on field set twice":                  {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, target=/etc/other.conf"}}, wantErr: true},
+		"Error on unsupported field":                {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, backup=yes"}}, wantErr: true},
+		"Error on source outside the assets":        {entries: []entry.Entry{{Key: "files/deploy", Value: "source=../scripts/script.sh, target=/etc/app.conf"}}, wantErr: true},
+		"Error on absolute source":                  {entries: []entry.Entry{{Key: "files/deploy", Value: "source=/etc/shadow, target=/etc/app.conf"}}, wantErr: true},
+		"Error on relative target":                  {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=etc/app.conf"}}, wantErr: true},
+		"Error on unclean target":                   {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/../app.conf"}}, wantErr: true},
+		"Error on invalid mode":                     {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, mode=rw-r--r--"}}, wantErr: true},
+		"Error on special mode bits":                {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, mode=4755"}}, wantErr: true},
+		"Error on unknown owner":                    {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, owner=unknown"}}, wantErr: true},
+		"Error on unknown group":                    {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, group=unknown"}}, wantErr: true},
+		"Error on source not found":                 {entries: []entry.Entry{{Key: "files/deploy", Value: "source=missing.conf, target=/etc/app.conf"}}, wantErr: true},
+		"Error on source being a directory":         {entries: []entry.Entry{{Key: "files/deploy", Value: "source=sub, target=/etc/app.conf"}}, wantErr: true},
+		"Error on assets dump failure":              {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf"}}, saveAssetsError: true, wantErr: true},
+		"Error on corrupted state":                  {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf"}}, existingState: "corrupted", wantErr: true},
+		"Error on unknown action":                   {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, action=merge"}}, wantErr: true},
+		"Error on delete action with source":        {entries: []entry.Entry{{Key: "files/deploy", Value: "source=app.conf, target=/etc/app.conf, action=delete"}}, wantErr: true},
+		"Error on delete action of relative target": {entries: []entry.Entry{{Key: "files/deploy", Value: "target=etc/app.conf, action=delete"}}, wantErr: true},
+		"Error on delete action of a directory":     {entries: []entry.Entry{{Key: "files/deploy", Value: "target=/etc/app.d, action=delete"}}, existingState: "existing", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			m := files.New(
+				files.WithStateDir(filepath.Join(root, "state")),
+				files.WithRootDir(filepath.Join(root, "fs")),
+				files.WithUserLookup(mockUserLookup),
+				files.WithGroupLookup(mockGroupLookup),
+			)
+			mockAssetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.saveAssetsError, Path: "files/"}
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries, mockAssetsDumper.SaveAssetsTo)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			for p, want := range tc.wantModes {
+				fi, err := os.Stat(filepath.Join(root, "fs", p))
+				require.NoError(t, err, "Deployed file %s should exist", p)
+				require.Equal(t, want, fi.Mode().Perm(), "Deployed file %s should have the requested mode", p)
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockUserLookup returns the current user for any known user, as files can't be chowned to them in tests.
+func mockUserLookup(name string) (*user.User, error) {
+	if name != "root" && name != "alice" {
+		return nil, user.UnknownUserError(name)
+	}
+	return &user.User{Username: name, Uid: strconv.Itoa(os.Getuid()), Gid: strconv.Itoa(os.Getgid())}, nil
+}
+
+// mockGroupLookup returns the current group for any known group, as files can't be chowned to them in tests.
+func mockGroupLookup(name string) (*user.Group, error) {
+	if name != "adm" {
+		return nil, errors.New("unknown group")
+	}
+	return &user.Group{Name: name, Gid: strconv.Itoa(os.Getgid())}, nil
+}
@@ -0,0 +1,283 @@
+// Package firefox provides a manager that writes the Firefox enterprise policies.
+//
+// This manager only applies to computer objects.
+//
+// The policies are written in the policies.json file of the system-wide Firefox policies
+// directory, /etc/firefox/policies. This directory is read by the Firefox deb packages and by
+// the Firefox snap, through its etc-firefox-policies interface.
+// The deb package installed in /usr/lib/firefox reads the policies.json file from its
+// distribution directory first: the same file is then written there too, so that it takes
+// precedence over any other policies file.
+//
+// The following settings are supported:
+//   - homepage: the locked home page of every user;
+//   - extensions: the extensions to force install, one <id>=<install url> per line;
+//   - proxy: none, system, autodetect, a proxy URL or a proxy auto-config file URL;
+//   - proxy-bypass: a comma separated list of hosts to access without proxy;
+//   - certificates: certificate files to install, one per line;
+//   - enterprise-roots: whether certificates from the system trust store are trusted.
+//
+// Any existing policies.json file is overwritten as this file is fully managed by adsys. Every
+// file is removed once no setting is configured anymore. If a value can't be parsed, the manager
+// returns an error and authentication will be prevented.
+package firefox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	policiesFile    = "policies.json"
+	distributionDir = "distribution"
+
+	keyPrefix = "firefox/"
+)
+
+// Manager writes the Firefox enterprise policies on the machine.
+type Manager struct {
+	policiesDir string
+	installDir  string
+}
+
+type options struct {
+	policiesDir string
+	installDir  string
+}
+
+// Option reprents an optional function to change the firefox manager.
+type Option func(*options)
+
+// WithPoliciesDir overrides the default system-wide Firefox policies directory.
+func WithPoliciesDir(p string) func(*options) {
+	return func(a *options) {
+		a.policiesDir = p
+	}
+}
+
+// WithInstallDir overrides the default installation directory of the Firefox deb package.
+func WithInstallDir(p string) func(*options) {
+	return func(a *options) {
+		a.installDir = p
+	}
+}
+
+// New returns a new manager for the firefox policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		policiesDir: consts.DefaultFirefoxPoliciesDir,
+		installDir:  consts.DefaultFirefoxInstallDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		policiesDir: args.policiesDir,
+		installDir:  args.installDir,
+	}
+}
+
+// ApplyPolicy writes the Firefox enterprise policies from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply firefox policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Firefox policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying firefox policy to %s", objectName)
+
+	pols := make(map[string]any)
+	certificates := make(map[string]any)
+	var proxyBypass string
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch strings.TrimPrefix(e.Key, keyPrefix) {
+		case "homepage":
+			if !isWebURL(v) {
+				return errors.New(gotext.Get("invalid homepage %q: an http or https URL is expected", v))
+			}
+			pols["Homepage"] = map[string]any{"URL": v, "StartPage": "homepage", "Locked": true}
+		case "extensions":
+			extensions, err := parseExtensions(v)
+			if err != nil {
+				return err
+			}
+			pols["ExtensionSettings"] = extensions
+		case "proxy":
+			proxy, err := parseProxy(v)
+			if err != nil {
+				return err
+			}
+			pols["Proxy"] = proxy
+		case "proxy-bypass":
+			proxyBypass = v
+		case "certificates":
+			certificates["Install"] = splitLines(v)
+		case "enterprise-roots":
+			switch v {
+			case "true":
+				certificates["ImportEnterpriseRoots"] = true
+			case "false":
+				certificates["ImportEnterpriseRoots"] = false
+			default:
+				return errors.New(gotext.Get("invalid enterprise roots value %q: true or false is expected", v))
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing firefox entries, skipping it", e.Key))
+		}
+	}
+
+	if proxyBypass != "" {
+		proxy, ok := pols["Proxy"].(map[string]any)
+		if !ok {
+			log.Warning(ctx, gotext.Get("Firefox proxy bypass list is ignored as no proxy is configured"))
+		} else {
+			proxy["Passthrough"] = proxyBypass
+		}
+	}
+	if len(certificates) > 0 {
+		pols["Certificates"] = certificates
+	}
+
+	systemPolicies := filepath.Join(m.policiesDir, policiesFile)
+	debPolicies := filepath.Join(m.installDir, distributionDir, policiesFile)
+
+	if len(pols) == 0 {
+		// Always clean up the distribution directory, even if the deb package was removed since.
+		for _, p := range []string{systemPolicies, debPolicies} {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dests := []string{systemPolicies}
+	// The deb package reads its distribution directory first, which would shadow the system-wide policies.
+	if _, err := os.Stat(m.installDir); err == nil {
+		dests = append(dests, debPolicies)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// JSON doesn't support comments: the file being managed by adsys is documented instead.
+	d, err := json.MarshalIndent(map[string]any{"policies": pols}, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, p := range dests {
+		if err := writeFile(p, append(d, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DumpState returns the Firefox policies written during the last refresh of the machine.
+// The state is empty for users or if no firefox policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump firefox state of %s", objectName))
+
+	// Firefox policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(
+		filepath.Join(m.policiesDir, policiesFile),
+		filepath.Join(m.installDir, distributionDir, policiesFile),
+	)
+}
+
+// parseExtensions returns the ExtensionSettings policy forcing the installation of every
+// extension listed in v, one <id>=<install url> per line.
+// Extensions are listed from the furthest to the closest GPO: the closest one wins.
+func parseExtensions(v string) (map[string]any, error) {
+	extensions := make(map[string]any)
+	for _, l := range splitLines(v) {
+		id, u, ok := strings.Cut(l, "=")
+		id, u = strings.TrimSpace(id), strings.TrimSpace(u)
+		if !ok || id == "" || u == "" {
+			return nil, errors.New(gotext.Get("invalid extension %q: <id>=<install url> is expected", l))
+		}
+		if pu, err := url.Parse(u); err != nil || (!isWebURL(u) && pu.Scheme != "file") {
+			return nil, errors.New(gotext.Get("invalid extension %q: an http, https or file install URL is expected", l))
+		}
+		extensions[id] = map[string]any{"installation_mode": "force_installed", "install_url": u}
+	}
+	return extensions, nil
+}
+
+// parseProxy returns the Proxy policy for v.
+// An URL with a path is a proxy auto-config file while any other URL is a manual proxy.
+func parseProxy(v string) (map[string]any, error) {
+	switch v {
+	case "none":
+		return map[string]any{"Mode": "none", "Locked": true}, nil
+	case "system":
+		return map[string]any{"Mode": "system", "Locked": true}, nil
+	case "autodetect":
+		return map[string]any{"Mode": "autoDetect", "Locked": true}, nil
+	}
+
+	u, err := url.Parse(v)
+	if err != nil || !isWebURL(v) {
+		return nil, errors.New(gotext.Get("invalid proxy %q: none, system, autodetect or an http URL is expected", v))
+	}
+	if u.Path != "" && u.Path != "/" {
+		return map[string]any{"Mode": "autoConfig", "AutoConfigURL": v, "Locked": true}, nil
+	}
+	return map[string]any{"Mode": "manual", "HTTPProxy": u.Host, "UseHTTPProxyForAllProtocols": true, "Locked": true}, nil
+}
+
+// isWebURL returns true if v is an http or https URL with a host.
+func isWebURL(v string) bool {
+	u, err := url.Parse(v)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// splitLines returns the non empty lines of v, without surrounding spaces.
+func splitLines(v string) []string {
+	var lines []string
+	for _, l := range strings.Split(v, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// writeFile atomically writes data to p, creating the parent directories if needed.
+func writeFile(p string, data []byte) error {
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 those files are world readable configuration files
+	if err := os.WriteFile(p+".new", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,103 @@
+package firefox_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/firefox"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "firefox/homepage", Value: "https://intranet.example.com"},
+		{Key: "firefox/extensions", Value: "uBlock0@raymondhill.net=https://addons.mozilla.org/firefox/downloads/latest/ublock-origin/latest.xpi\nsso@example.com=file:///usr/share/example/sso.xpi"},
+		{Key: "firefox/proxy", Value: "http://proxy.example.com:3128"},
+		{Key: "firefox/proxy-bypass", Value: "localhost, .example.com"},
+		{Key: "firefox/certificates", Value: "/usr/local/share/ca-certificates/example-ca.crt"},
+		{Key: "firefox/enterprise-roots", Value: "true"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		makeReadOnly  string
+
+		wantErr bool
+	}{
+		"Homepage":                           {entries: []entry.Entry{{Key: "firefox/homepage", Value: "https://intranet.example.com"}}},
+		"Extensions":                         {entries: []entry.Entry{{Key: "firefox/extensions", Value: "uBlock0@raymondhill.net=https://addons.mozilla.org/firefox/downloads/latest/ublock-origin/latest.xpi\n\nsso@example.com = file:///usr/share/example/sso.xpi\n"}}},
+		"Manual proxy":                       {entries: []entry.Entry{{Key: "firefox/proxy", Value: "http://proxy.example.com:3128"}}},
+		"Manual proxy with bypass list":      {entries: []entry.Entry{{Key: "firefox/proxy", Value: "http://proxy.example.com:3128"}, {Key: "firefox/proxy-bypass", Value: "localhost, .example.com"}}},
+		"Proxy auto-config file":             {entries: []entry.Entry{{Key: "firefox/proxy", Value: "http://wpad.example.com/proxy.pac"}}},
+		"No proxy":                           {entries: []entry.Entry{{Key: "firefox/proxy", Value: "none"}}},
+		"System proxy":                       {entries: []entry.Entry{{Key: "firefox/proxy", Value: "system"}}},
+		"Autodetected proxy":                 {entries: []entry.Entry{{Key: "firefox/proxy", Value: "autodetect"}}},
+		"Proxy bypass list without proxy":    {entries: []entry.Entry{{Key: "firefox/homepage", Value: "https://intranet.example.com"}, {Key: "firefox/proxy-bypass", Value: "localhost"}}},
+		"Certificates":                       {entries: []entry.Entry{{Key: "firefox/certificates", Value: "/usr/local/share/ca-certificates/example-ca.crt\nother-ca.pem"}}},
+		"Enterprise roots":                   {entries: []entry.Entry{{Key: "firefox/enterprise-roots", Value: "true"}}},
+		"Enterprise roots not imported":      {entries: []entry.Entry{{Key: "firefox/enterprise-roots", Value: "false"}}},
+		"All entries":                        {entries: allEntries},
+		"All entries with deb layout":        {entries: allEntries, existingDirs: "deb-layout"},
+		"Values are trimmed":                 {entries: []entry.Entry{{Key: "firefox/homepage", Value: "  https://intranet.example.com\n"}}},
+		"Disabled entries are ignored":       {entries: []entry.Entry{{Key: "firefox/homepage", Value: "https://intranet.example.com"}, {Key: "firefox/proxy", Value: "none", Disabled: true}}},
+		"Empty entries are ignored":          {entries: []entry.Entry{{Key: "firefox/homepage", Value: "https://intranet.example.com"}, {Key: "firefox/proxy", Value: ""}}},
+		"Unsupported keys are ignored":       {entries: []entry.Entry{{Key: "firefox/homepage", Value: "https://intranet.example.com"}, {Key: "firefox/bookmarks", Value: "something"}}},
+		"No entries and no existing files":   {},
+		"No entries removes existing files":  {existingDirs: "all-files"},
+		"Overwrite existing files":           {existingDirs: "all-files", entries: []entry.Entry{{Key: "firefox/proxy", Value: "none"}}},
+		"Don't touch other files":            {existingDirs: "other-files", entries: allEntries},
+		"No entries don't touch other files": {existingDirs: "other-files"},
+		"Not a computer is a no-op":          {isNotComputer: true, existingDirs: "all-files"},
+
+		// Error cases
+		"Error on invalid homepage":            {entries: []entry.Entry{{Key: "firefox/homepage", Value: "intranet.example.com"}}, wantErr: true},
+		"Error on extension without URL":       {entries: []entry.Entry{{Key: "firefox/extensions", Value: "uBlock0@raymondhill.net"}}, wantErr: true},
+		"Error on extension without ID":        {entries: []entry.Entry{{Key: "firefox/extensions", Value: "=https://example.com/ext.xpi"}}, wantErr: true},
+		"Error on extension with invalid URL":  {entries: []entry.Entry{{Key: "firefox/extensions", Value: "ext@example.com=ftp://example.com/ext.xpi"}}, wantErr: true},
+		"Error on invalid proxy":               {entries: []entry.Entry{{Key: "firefox/proxy", Value: "proxy.example.com:3128"}}, wantErr: true},
+		"Error on invalid enterprise roots":    {entries: []entry.Entry{{Key: "firefox/enterprise-roots", Value: "yes"}}, wantErr: true},
+		"Error on unwritable policies dir":     {entries: allEntries, existingDirs: "all-files", makeReadOnly: "etc/firefox/policies", wantErr: true},
+		"Error on unwritable distribution dir": {entries: allEntries, existingDirs: "all-files", makeReadOnly: "usr/lib/firefox/distribution", wantErr: true},
+		"Error on unremovable policies file":   {existingDirs: "all-files", makeReadOnly: "etc/firefox/policies", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.makeReadOnly != "" {
+				testutils.MakeReadOnly(t, filepath.Join(root, tc.makeReadOnly))
+			}
+
+			m := firefox.New(
+				firefox.WithPoliciesDir(filepath.Join(root, "etc", "firefox", "policies")),
+				firefox.WithInstallDir(filepath.Join(root, "usr", "lib", "firefox")),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
@@ -0,0 +1,406 @@
+// Package firewall provides a manager that translates firewall policies into
+// ufw or nftables rules on the client.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - firewall/backend: the firewall backend to use, either ufw (default) or nftables;
+//   - firewall/default-incoming and firewall/default-outgoing: the default policy
+//     (allow, deny or reject) for incoming and outgoing traffic;
+//   - firewall/allowed-ports and firewall/blocked-ports: incoming ports to open or close, one per line,
+//     of the form <port>[:<port>][/tcp|udp] [from <address>[/<prefix>]].
+//
+// Blocked ports always take precedence over allowed ports.
+//
+// With ufw, rules are added to the ufw configuration with the ufw command,
+// which is enabled if it is not already. The rules and defaults applied by
+// adsys are saved in a state file, so that only the difference is applied on
+// the next refresh and everything can be reverted once the policy is not
+// configured anymore.
+//
+// With nftables, rules are written to a dedicated "inet adsys" table, which is
+// loaded again on every refresh and deleted once the policy is not configured
+// anymore.
+//
+// Switching from one backend to the other reverts the rules applied with the
+// previous one. If a value can't be parsed, the manager returns an error and
+// authentication will be prevented.
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	backendUfw      = "ufw"
+	backendNftables = "nftables"
+
+	stateFile    = "state.json"
+	nftablesFile = "adsys.nft"
+)
+
+// supportedDefaults are the supported default policies.
+var supportedDefaults = []string{"allow", "deny", "reject"}
+
+// rule is an incoming traffic rule.
+type rule struct {
+	// Action is either allow or deny.
+	Action string `json:"action"`
+	// Port is a single port or a range of the form first:last.
+	Port string `json:"port"`
+	// Proto is either tcp, udp or empty for both.
+	Proto string `json:"proto,omitempty"`
+	// From is the source address or network. Empty means any.
+	From string `json:"from,omitempty"`
+}
+
+// rules is the firewall configuration requested by the policy.
+type rules struct {
+	backend  string
+	defaults map[string]string
+	rules    []rule
+}
+
+// state is the firewall configuration applied by adsys.
+type state struct {
+	Backend string `json:"backend"`
+	// Defaults are the default policies, per direction, set by adsys.
+	Defaults map[string]string `json:"defaults,omitempty"`
+	Rules    []rule            `json:"rules,omitempty"`
+	// Enabled is true if the firewall was enabled by adsys.
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+// Manager applies the firewall policy on the machine.
+type Manager struct {
+	stateDir   string
+	ufwCmd     []string
+	nftCmd     []string
+	cmdTimeout time.Duration
+
+	mu sync.Mutex // Prevents multiple firewall commands from running concurrently
+}
+
+type options struct {
+	stateDir   string
+	ufwCmd     []string
+	nftCmd     []string
+	cmdTimeout time.Duration
+}
+
+// Option reprents an optional function to change the firewall manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithUfwCmd overrides the default ufw command.
+func WithUfwCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.ufwCmd = cmd
+	}
+}
+
+// WithNftCmd overrides the default nft command.
+func WithNftCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.nftCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time a firewall command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the firewall policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:   consts.DefaultStateDir,
+		ufwCmd:     []string{"ufw"},
+		nftCmd:     []string{"nft"},
+		cmdTimeout: consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:   filepath.Join(args.stateDir, "firewall"),
+		ufwCmd:     args.ufwCmd,
+		nftCmd:     args.nftCmd,
+		cmdTimeout: args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy translates the firewall policy into rules for the configured backend.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply firewall policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Firewall policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying firewall policy to %s", objectName)
+
+	want, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Revert what was applied with another backend first.
+	if prev.Backend != "" && prev.Backend != want.backend {
+		log.Infof(ctx, "Firewall backend changed from %s to %s, reverting previous rules", prev.Backend, want.backend)
+		if err := m.apply(ctx, prev, rules{backend: prev.Backend}); err != nil {
+			return err
+		}
+		prev = state{}
+	}
+
+	return m.apply(ctx, prev, want)
+}
+
+// DumpState returns the firewall configuration applied during the last refresh of the machine, with the
+// nftables ruleset if this backend is used.
+// The state is empty for users or if no firewall policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump firewall state of %s", objectName))
+
+	// Firewall policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(
+		filepath.Join(m.stateDir, stateFile),
+		filepath.Join(m.stateDir, nftablesFile),
+	)
+}
+
+// apply applies want with its backend, given what was previously applied, and saves the new state.
+func (m *Manager) apply(ctx context.Context, prev state, want rules) (err error) {
+	var s state
+	switch want.backend {
+	case backendUfw:
+		s, err = m.applyUfw(ctx, prev, want)
+	case backendNftables:
+		s, err = m.applyNftables(ctx, want)
+	}
+	if err != nil {
+		return err
+	}
+	return m.saveState(s)
+}
+
+// parseEntries validates the entries and returns the requested firewall configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry) (r rules, err error) {
+	r = rules{backend: backendUfw, defaults: make(map[string]string)}
+
+	var allowed, blocked []rule
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "firewall/backend":
+			r.backend = strings.ToLower(v)
+			if r.backend != backendUfw && r.backend != backendNftables {
+				return r, errors.New(gotext.Get("invalid firewall backend %q: only ufw and nftables are supported", v))
+			}
+		case "firewall/default-incoming", "firewall/default-outgoing":
+			d := strings.ToLower(v)
+			if !slices.Contains(supportedDefaults, d) {
+				return r, errors.New(gotext.Get("invalid default policy %q for %s: only %s are supported", v, e.Key, strings.Join(supportedDefaults, ", ")))
+			}
+			r.defaults[strings.TrimPrefix(e.Key, "firewall/default-")] = d
+		case "firewall/allowed-ports", "firewall/blocked-ports":
+			action := "allow"
+			if e.Key == "firewall/blocked-ports" {
+				action = "deny"
+			}
+			for _, l := range strings.Split(v, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" {
+					continue
+				}
+				ru, err := parseRule(action, l)
+				if err != nil {
+					return r, err
+				}
+				if action == "deny" {
+					blocked = append(blocked, ru)
+				} else {
+					allowed = append(allowed, ru)
+				}
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing firewall entries, skipping it", e.Key))
+		}
+	}
+
+	// Blocked ports take precedence over allowed ones.
+	for _, ru := range slices.Concat(blocked, allowed) {
+		if slices.Contains(r.rules, ru) {
+			continue
+		}
+		r.rules = append(r.rules, ru)
+	}
+	return r, nil
+}
+
+// parseRule parses a port rule of the form <port>[:<port>][/tcp|udp] [from <address>[/<prefix>]].
+func parseRule(action, l string) (r rule, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid port rule %q", l))
+
+	r.Action = action
+	fields := strings.Fields(l)
+	switch {
+	case len(fields) == 3 && strings.ToLower(fields[1]) == "from":
+		from := fields[2]
+		if p, err := netip.ParsePrefix(from); err == nil {
+			r.From = p.Masked().String()
+		} else if a, err := netip.ParseAddr(from); err == nil {
+			r.From = a.String()
+		} else {
+			return r, errors.New(gotext.Get("%q is not a valid address or network", from))
+		}
+	case len(fields) != 1:
+		return r, errors.New(gotext.Get("expected <port>[:<port>][/tcp|udp] [from <address>]"))
+	}
+
+	port, proto, found := strings.Cut(strings.ToLower(fields[0]), "/")
+	if found {
+		if proto != "tcp" && proto != "udp" {
+			return r, errors.New(gotext.Get("unsupported protocol %q: only tcp and udp are supported", proto))
+		}
+		r.Proto = proto
+	}
+
+	first, last, isRange := strings.Cut(port, ":")
+	if err := validatePort(first); err != nil {
+		return r, err
+	}
+	r.Port = first
+	if isRange {
+		if err := validatePort(last); err != nil {
+			return r, err
+		}
+		if f, l := atoi(first), atoi(last); f >= l {
+			return r, errors.New(gotext.Get("port range %q is not ordered", port))
+		}
+		if r.Proto == "" {
+			return r, errors.New(gotext.Get("port ranges require a protocol"))
+		}
+		r.Port = port
+	}
+
+	return r, nil
+}
+
+// validatePort returns an error if p is not a valid port number.
+func validatePort(p string) error {
+	if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+		return errors.New(gotext.Get("invalid port %q", p))
+	}
+	return nil
+}
+
+// atoi returns the integer value of an already validated port.
+func atoi(p string) int {
+	n, _ := strconv.Atoi(p)
+	return n
+}
+
+// loadState returns the firewall configuration previously applied by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load firewall state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the firewall configuration applied by adsys.
+// The state file is removed if nothing is applied anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save firewall state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Defaults) == 0 && len(s.Rules) == 0 && !s.Enabled {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(p, append(d, '\n'))
+}
+
+// isInstalled returns true if the command cmd can be executed.
+func isInstalled(cmd []string) bool {
+	if len(cmd) == 0 || cmd[0] == "" {
+		return false
+	}
+	_, err := exec.LookPath(cmd[0])
+	return err == nil
+}
+
+// writeFile atomically writes data to p, creating the parent directories if needed.
+func writeFile(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
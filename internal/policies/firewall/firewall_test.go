@@ -0,0 +1,161 @@
+package firewall_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/firewall"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	ufwEntries := []entry.Entry{
+		{Key: "firewall/default-incoming", Value: "deny"},
+		{Key: "firewall/default-outgoing", Value: "allow"},
+		{Key: "firewall/allowed-ports", Value: "22/tcp from 10.0.0.0/8\n443/tcp\n60000:61000/udp"},
+		{Key: "firewall/blocked-ports", Value: "23"},
+	}
+	nftablesEntries := append([]entry.Entry{{Key: "firewall/backend", Value: "nftables"}}, ufwEntries...)
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingState string
+		ufwBehaviour  string
+		nftBehaviour  string
+
+		ufwNotInstalled bool
+		nftNotInstalled bool
+
+		wantErr bool
+	}{
+		// ufw backend
+		"ufw, allow ports":                           {entries: []entry.Entry{{Key: "firewall/allowed-ports", Value: "22/tcp\n\n 80 \n8080:8090/tcp from 192.168.1.12/24\n53/udp from fe80::1"}}},
+		"ufw, block ports":                           {entries: []entry.Entry{{Key: "firewall/blocked-ports", Value: "23\n137:139/udp"}}},
+		"ufw, default policies":                      {entries: []entry.Entry{{Key: "firewall/default-incoming", Value: "Reject"}, {Key: "firewall/default-outgoing", Value: "deny"}}},
+		"ufw, all entries":                           {entries: ufwEntries},
+		"ufw, backend is case insensitive":           {entries: append([]entry.Entry{{Key: "firewall/backend", Value: "UFW"}}, ufwEntries...)},
+		"ufw, duplicated rules are applied once":     {entries: []entry.Entry{{Key: "firewall/allowed-ports", Value: "22/tcp\n22/TCP"}}},
+		"ufw, already active is not enabled":         {entries: ufwEntries, ufwBehaviour: "active"},
+		"ufw, already applied runs no command":       {entries: ufwEntries, existingState: "ufw-applied"},
+		"ufw, only changes are applied":              {entries: []entry.Entry{{Key: "firewall/default-incoming", Value: "reject"}, {Key: "firewall/allowed-ports", Value: "22/tcp from 10.0.0.0/8\n8443/tcp"}}, existingState: "ufw-applied"},
+		"ufw, no entries reverts everything":         {existingState: "ufw-applied"},
+		"ufw, no entries don't disable if not owned": {existingState: "ufw-applied-already-active"},
+		"ufw, not installed without state is no-op":  {ufwNotInstalled: true},
+		"ufw, not installed anymore drops state":     {existingState: "ufw-applied", ufwNotInstalled: true},
+
+		// nftables backend
+		"nftables, all entries":                        {entries: nftablesEntries},
+		"nftables, reject by default":                  {entries: []entry.Entry{{Key: "firewall/backend", Value: "nftables"}, {Key: "firewall/default-incoming", Value: "reject"}, {Key: "firewall/default-outgoing", Value: "reject"}, {Key: "firewall/allowed-ports", Value: "22/tcp"}}},
+		"nftables, already applied is reloaded":        {entries: nftablesEntries, existingState: "nftables-applied"},
+		"nftables, no entries deletes table":           {existingState: "nftables-applied"},
+		"nftables, failing to delete table is ignored": {existingState: "nftables-applied", nftBehaviour: "fail"},
+		"nftables, not installed anymore drops state":  {existingState: "nftables-applied", nftNotInstalled: true},
+
+		// Backend changes
+		"Switching from ufw to nftables reverts ufw rules": {entries: nftablesEntries, existingState: "ufw-applied"},
+		"Switching from nftables to ufw deletes the table": {entries: ufwEntries, existingState: "nftables-applied"},
+		"Disabled entries are ignored":                     {entries: []entry.Entry{{Key: "firewall/backend", Value: "nftables", Disabled: true}, {Key: "firewall/allowed-ports", Value: "22/tcp", Disabled: true}, {Key: "firewall/blocked-ports", Value: "23"}}},
+		"Unsupported keys are ignored":                     {entries: []entry.Entry{{Key: "firewall/allowed-ports", Value: "22/tcp"}, {Key: "firewall/logging", Value: "on"}}},
+		"No entries is a no-op":                            {},
+		"Not a computer is a no-op":                        {entries: ufwEntries, isNotComputer: true},
+		"Not a computer doesn't revert applied rules":      {existingState: "ufw-applied", isNotComputer: true},
+
+		// Error cases
+		"Error on invalid backend":                      {entries: []entry.Entry{{Key: "firewall/backend", Value: "iptables"}}, wantErr: true},
+		"Error on invalid default policy":               {entries: []entry.Entry{{Key: "firewall/default-incoming", Value: "block"}}, wantErr: true},
+		"Error on invalid port":                         {entries: []entry.Entry{{Key: "firewall/allowed-ports", Value: "22/tcp\n65536"}}, wantErr: true},
+		"Error on non numeric port":                     {entries: []entry.Entry{{Key: "firewall/allowed-ports", Value: "ssh"}}, wantErr: true},
+		"Error on unordered port range":                 {entries: []entry.Entry{{Key: "firewall/allowed-ports", Value: "90:80/tcp"}}, wantErr: true},
+		"Error on port range without protocol":          {entries: []entry.Entry{{Key: "firewall/blocked-ports", Value: "80:90"}}, wantErr: true},
+		"Error on unsupported protocol":                 {entries: []entry.Entry{{Key: "firewall/allowed-ports", Value: "22/sctp"}}, wantErr: true},
+		"Error on invalid source address":               {entries: []entry.Entry{{Key: "firewall/allowed-ports", Value: "22/tcp from example.com"}}, wantErr: true},
+		"Error on invalid rule syntax":                  {entries: []entry.Entry{{Key: "firewall/allowed-ports", Value: "22/tcp to 10.0.0.1"}}, wantErr: true},
+		"Error on ufw not installed":                    {entries: ufwEntries, ufwNotInstalled: true, wantErr: true},
+		"Error on nft not installed":                    {entries: nftablesEntries, nftNotInstalled: true, wantErr: true},
+		"Error on ufw command failing":                  {entries: ufwEntries, ufwBehaviour: "fail", wantErr: true},
+		"Error on ufw status failing":                   {entries: ufwEntries, ufwBehaviour: "fail-status", wantErr: true},
+		"Error on nft command failing":                  {entries: nftablesEntries, nftBehaviour: "fail", wantErr: true},
+		"Error on reverting ufw when switching backend": {entries: nftablesEntries, existingState: "ufw-applied", ufwBehaviour: "fail", wantErr: true},
+		"Error on corrupted state":                      {entries: ufwEntries, existingState: "corrupted", wantErr: true},
+		"Error on unreadable state":                     {entries: ufwEntries, existingState: "state-is-a-directory", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			ufwCmd := testutils.MockCommand(root, "ufw", tc.ufwBehaviour)
+			if tc.ufwNotInstalled {
+				ufwCmd = []string{"/nonexistent/ufw"}
+			}
+			nftCmd := testutils.MockCommand(root, "nft", tc.nftBehaviour)
+			if tc.nftNotInstalled {
+				nftCmd = []string{"/nonexistent/nft"}
+			}
+
+			m := firewall.New(
+				firewall.WithStateDir(root),
+				firewall.WithUfwCmd(ufwCmd),
+				firewall.WithNftCmd(nftCmd),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, root, behaviour, args := c.Name, c.Root, c.Behaviour, c.Args
+
+	// Log the call, replacing the temporary paths to get a stable output.
+	line := name
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+	line = strings.ReplaceAll(line, root, "#ROOT#")
+
+	c.Log(line)
+
+	if behaviour == "fail" || (behaviour == "fail-status" && args[0] == "status") {
+		fmt.Fprintln(os.Stderr, "ERROR: requested failure")
+		os.Exit(1)
+	}
+
+	if name == "ufw" && args[0] == "status" {
+		if behaviour == "active" {
+			fmt.Println("Status: active")
+			return
+		}
+		fmt.Println("Status: inactive")
+	}
+}
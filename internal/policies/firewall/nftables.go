@@ -0,0 +1,130 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+)
+
+const nftablesTable = "adsys"
+
+// applyNftables loads want in the adsys nftables table, or deletes the table if nothing is configured.
+func (m *Manager) applyNftables(ctx context.Context, want rules) (s state, err error) {
+	p := filepath.Join(m.stateDir, nftablesFile)
+
+	if len(want.rules) == 0 && len(want.defaults) == 0 {
+		if _, err := os.Stat(p); errors.Is(err, fs.ErrNotExist) {
+			return state{}, nil
+		}
+		if !isInstalled(m.nftCmd) {
+			log.Warning(ctx, gotext.Get("nft is not installed anymore, can't revert the previous firewall rules"))
+		} else if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.nftCmd, "delete", "table", "inet", nftablesTable); err != nil {
+			// The table may have been removed by the administrator.
+			log.Warning(ctx, gotext.Get("Couldn't delete nftables table: %v", err))
+		}
+		if err := os.Remove(p); err != nil {
+			return s, err
+		}
+		return state{}, nil
+	}
+
+	if !isInstalled(m.nftCmd) {
+		return s, errors.New(gotext.Get("nft is not installed"))
+	}
+
+	if err := writeFile(p, []byte(nftablesRuleset(want))); err != nil {
+		return s, err
+	}
+	// The ruleset is loaded on every refresh as it is not persisted by nftables across reboots.
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.nftCmd, "-f", p); err != nil {
+		return s, err
+	}
+
+	return state{Backend: backendNftables, Defaults: want.defaults, Rules: want.rules}, nil
+}
+
+// nftablesRuleset returns the nftables ruleset, replacing the adsys table atomically when loaded.
+func nftablesRuleset(want rules) string {
+	var out strings.Builder
+
+	fmt.Fprintf(&out, `#!/usr/sbin/nft -f
+# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+table inet %[1]s
+delete table inet %[1]s
+
+table inet %[1]s {
+`, nftablesTable)
+
+	var inputRules []string
+	for _, r := range want.rules {
+		inputRules = append(inputRules, nftablesRule(r))
+	}
+	writeNftablesChain(&out, "input", "iif", want.defaults["incoming"], inputRules)
+	if d := want.defaults["outgoing"]; d != "" {
+		writeNftablesChain(&out, "output", "oif", d, nil)
+	}
+
+	out.WriteString("}\n")
+	return out.String()
+}
+
+// writeNftablesChain writes a filter chain hooked on hook with the default policy d.
+// Established connections and loopback traffic are always accepted.
+func writeNftablesChain(out *strings.Builder, hook, ifKeyword, d string, rules []string) {
+	// reject is not a valid chain policy: it is a final rule instead.
+	policy := "accept"
+	if d == "deny" {
+		policy = "drop"
+	}
+
+	fmt.Fprintf(out, "\tchain %s {\n", hook)
+	fmt.Fprintf(out, "\t\ttype filter hook %s priority filter; policy %s;\n", hook, policy)
+	out.WriteString("\t\tct state established,related accept\n")
+	fmt.Fprintf(out, "\t\t%s \"lo\" accept\n", ifKeyword)
+	for _, r := range rules {
+		fmt.Fprintf(out, "\t\t%s\n", r)
+	}
+	if d == "reject" {
+		out.WriteString("\t\treject\n")
+	}
+	out.WriteString("\t}\n")
+}
+
+// nftablesRule returns the nftables statement for rule r.
+func nftablesRule(r rule) string {
+	var parts []string
+	if r.From != "" {
+		family := "ip"
+		if p, err := netip.ParsePrefix(r.From); err == nil && p.Addr().Is6() {
+			family = "ip6"
+		} else if a, err := netip.ParseAddr(r.From); err == nil && a.Is6() {
+			family = "ip6"
+		}
+		parts = append(parts, family, "saddr", r.From)
+	}
+
+	port := strings.Replace(r.Port, ":", "-", 1)
+	if r.Proto == "" {
+		parts = append(parts, "meta l4proto { tcp, udp } th dport", port)
+	} else {
+		parts = append(parts, r.Proto, "dport", port)
+	}
+
+	action := "accept"
+	if r.Action == "deny" {
+		action = "drop"
+	}
+	return strings.Join(append(parts, action), " ")
+}
@@ -0,0 +1,119 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+)
+
+// ufwStockDefaults are the default policies shipped with ufw, restored when a default is not configured anymore.
+var ufwStockDefaults = map[string]string{
+	"incoming": "deny",
+	"outgoing": "allow",
+}
+
+// applyUfw applies want with ufw, only running the commands needed to go from prev to want.
+func (m *Manager) applyUfw(ctx context.Context, prev state, want rules) (s state, err error) {
+	configured := len(want.rules) > 0 || len(want.defaults) > 0
+	if !configured && len(prev.Rules) == 0 && len(prev.Defaults) == 0 && !prev.Enabled {
+		return state{}, nil
+	}
+
+	if !isInstalled(m.ufwCmd) {
+		if configured {
+			return s, errors.New(gotext.Get("ufw is not installed"))
+		}
+		log.Warning(ctx, gotext.Get("ufw is not installed anymore, can't revert the previous firewall rules"))
+		return state{}, nil
+	}
+
+	s = state{Backend: backendUfw, Enabled: prev.Enabled}
+
+	// Remove old rules first, then add new ones.
+	for _, r := range prev.Rules {
+		if slices.Contains(want.rules, r) {
+			continue
+		}
+		log.Debugf(ctx, "Removing ufw rule %v", r)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.ufwCmd, append([]string{"delete"}, ufwRuleArgs(r)...)...); err != nil {
+			return s, err
+		}
+	}
+	for _, r := range want.rules {
+		if !slices.Contains(prev.Rules, r) {
+			log.Debugf(ctx, "Adding ufw rule %v", r)
+			args := ufwRuleArgs(r)
+			// Blocked ports take precedence over any other rule.
+			if r.Action == "deny" {
+				args = append([]string{"prepend"}, args...)
+			}
+			if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.ufwCmd, args...); err != nil {
+				return s, err
+			}
+		}
+		s.Rules = append(s.Rules, r)
+	}
+
+	for _, direction := range []string{"incoming", "outgoing"} {
+		d, prevD := want.defaults[direction], prev.Defaults[direction]
+		if d == "" {
+			if prevD == "" {
+				continue
+			}
+			d = ufwStockDefaults[direction]
+		} else {
+			if s.Defaults == nil {
+				s.Defaults = make(map[string]string)
+			}
+			s.Defaults[direction] = d
+			if d == prevD {
+				continue
+			}
+		}
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.ufwCmd, "default", d, direction); err != nil {
+			return s, err
+		}
+	}
+
+	switch {
+	case configured && !s.Enabled:
+		out, err := syshelpers.Run(ctx, m.cmdTimeout, m.ufwCmd, "status")
+		if err != nil {
+			return s, err
+		}
+		if !strings.Contains(out, "Status: inactive") {
+			break
+		}
+		log.Info(ctx, gotext.Get("Enabling ufw firewall"))
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.ufwCmd, "--force", "enable"); err != nil {
+			return s, err
+		}
+		s.Enabled = true
+	case !configured && s.Enabled:
+		log.Info(ctx, gotext.Get("Disabling ufw firewall, which was enabled by a policy"))
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.ufwCmd, "disable"); err != nil {
+			return s, err
+		}
+		s.Enabled = false
+	}
+
+	return s, nil
+}
+
+// ufwRuleArgs returns the ufw arguments for rule r.
+func ufwRuleArgs(r rule) []string {
+	args := []string{r.Action}
+	if r.Proto != "" {
+		args = append(args, "proto", r.Proto)
+	}
+	from := r.From
+	if from == "" {
+		from = "any"
+	}
+	return append(args, "from", from, "to", "any", "port", r.Port)
+}
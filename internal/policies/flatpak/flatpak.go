@@ -0,0 +1,431 @@
+// Package flatpak provides a manager that configures flatpak remotes, and installs and
+// removes flatpak applications.
+//
+// Machine policies apply to the system installation, while user policies apply to the
+// user installation, with commands run as the user.
+//
+// The following settings are supported for computers, and with a flatpak/user- prefix for users
+// (for instance flatpak/user-install):
+//   - flatpak/remotes: remotes to add, one per line, of the form <name> <url>. The url can
+//     either point to a .flatpakrepo file, like the flathub one, or to the repository itself;
+//   - flatpak/install: applications to install if they are not already, one per line, of
+//     the form <application ID> [<remote>];
+//   - flatpak/remove: applications to remove if they are installed, one application ID per line.
+//
+// Remotes added by adsys are saved in a state file, so that they can be deleted once they
+// are not configured anymore. Installed applications are not removed on revert:
+// flatpak/remove needs to be used explicitly for this.
+package flatpak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+// installTimeout is the maximum time installing or uninstalling applications can take, as it downloads them
+// with their runtimes.
+const installTimeout = 10 * time.Minute
+
+// appIDRe matches a flatpak application ID, in reverse DNS notation.
+var appIDRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*(\.[A-Za-z_][A-Za-z0-9_-]*)+$`)
+
+// remoteNameRe matches a flatpak remote name.
+var remoteNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// remote is a flatpak remote.
+type remote struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// app is an application requested to be installed, with an optional remote.
+type app struct {
+	id     string
+	remote string
+}
+
+// rules is the flatpak configuration requested by the policy.
+type rules struct {
+	remotes []remote
+	install []app
+	remove  []string
+}
+
+// state is the flatpak configuration applied by adsys.
+type state struct {
+	// Remotes are the remotes added by adsys.
+	Remotes []remote `json:"remotes,omitempty"`
+}
+
+// Manager applies the flatpak policy on the machine.
+type Manager struct {
+	stateDir   string
+	flatpakCmd []string
+	cmdTimeout time.Duration
+
+	userLookup func(string) (*user.User, error)
+}
+
+type options struct {
+	stateDir   string
+	flatpakCmd []string
+	cmdTimeout time.Duration
+	userLookup func(string) (*user.User, error)
+}
+
+// Option reprents an optional function to change the flatpak manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithFlatpakCmd overrides the default flatpak command.
+func WithFlatpakCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.flatpakCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the flatpak policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:   consts.DefaultStateDir,
+		flatpakCmd: []string{"flatpak"},
+		cmdTimeout: consts.DefaultHelperExecTimeout,
+		userLookup: user.Lookup,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:   filepath.Join(args.stateDir, "flatpak"),
+		flatpakCmd: args.flatpakCmd,
+		cmdTimeout: args.cmdTimeout,
+		userLookup: args.userLookup,
+	}
+}
+
+// ApplyPolicy configures the remotes and installs and removes the applications from the list of
+// entries, in the system installation for computers or in the user installation otherwise.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply flatpak policy to %s", objectName))
+
+	log.Debugf(ctx, "Applying flatpak policy to %s", objectName)
+
+	want, err := parseEntries(ctx, entries, isComputer)
+	if err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(m.stateDir, "machine.json")
+	if !isComputer {
+		statePath = filepath.Join(m.stateDir, "users", objectName+".json")
+	}
+	prev, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to revert.
+	if len(want.remotes) == 0 && len(want.install) == 0 && len(want.remove) == 0 && len(prev.Remotes) == 0 {
+		return nil
+	}
+
+	inst := installation{cmd: m.flatpakCmd, scope: "--system", cmdTimeout: m.cmdTimeout}
+	if !isComputer {
+		u, err := m.userLookup(objectName)
+		if err != nil {
+			return errors.New(gotext.Get("failed to retrieve user information: %v", err))
+		}
+		inst.scope = "--user"
+		inst.user = u
+	}
+
+	managed, err := inst.applyRemotes(ctx, prev.Remotes, want.remotes)
+	if err != nil {
+		return err
+	}
+	if err := saveState(statePath, state{Remotes: managed}); err != nil {
+		return err
+	}
+
+	if len(want.install) == 0 && len(want.remove) == 0 {
+		return nil
+	}
+	return inst.installAndRemove(ctx, want)
+}
+
+// DumpState returns the flatpak remotes added during the last refresh of the machine or of the user.
+// The state is empty if no flatpak policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump flatpak state of %s", objectName))
+
+	p := filepath.Join(m.stateDir, "machine.json")
+	if !isComputer {
+		p = filepath.Join(m.stateDir, "users", objectName+".json")
+	}
+	return syshelpers.DumpFiles(p)
+}
+
+// parseEntries validates the entries and returns the requested flatpak configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry, isComputer bool) (r rules, err error) {
+	prefix := "flatpak/"
+	if !isComputer {
+		prefix = "flatpak/user-"
+	}
+
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		var lines []string
+		for _, l := range strings.Split(v, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+
+		key, found := strings.CutPrefix(e.Key, prefix)
+		if !found {
+			key = ""
+		}
+		switch key {
+		case "remotes":
+			for _, l := range lines {
+				fields := strings.Fields(l)
+				if len(fields) != 2 || !remoteNameRe.MatchString(fields[0]) {
+					return r, errors.New(gotext.Get("invalid remote %q: expected <name> <url>", l))
+				}
+				u, err := url.Parse(fields[1])
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file") {
+					return r, errors.New(gotext.Get("invalid URL %q for remote %s", fields[1], fields[0]))
+				}
+				if slices.ContainsFunc(r.remotes, func(o remote) bool { return o.Name == fields[0] }) {
+					continue
+				}
+				r.remotes = append(r.remotes, remote{Name: fields[0], URL: fields[1]})
+			}
+		case "install":
+			for _, l := range lines {
+				fields := strings.Fields(l)
+				if len(fields) > 2 || !appIDRe.MatchString(fields[0]) {
+					return r, errors.New(gotext.Get("invalid application %q: expected <application ID> [<remote>]", l))
+				}
+				a := app{id: fields[0]}
+				if len(fields) == 2 {
+					if !remoteNameRe.MatchString(fields[1]) {
+						return r, errors.New(gotext.Get("invalid remote %q for application %s", fields[1], a.id))
+					}
+					a.remote = fields[1]
+				}
+				if slices.ContainsFunc(r.install, func(o app) bool { return o.id == a.id }) {
+					continue
+				}
+				r.install = append(r.install, a)
+			}
+		case "remove":
+			for _, id := range lines {
+				if !appIDRe.MatchString(id) {
+					return r, errors.New(gotext.Get("invalid application ID %q", id))
+				}
+				if !slices.Contains(r.remove, id) {
+					r.remove = append(r.remove, id)
+				}
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing flatpak entries, skipping it", e.Key))
+		}
+	}
+
+	for _, a := range r.install {
+		if slices.Contains(r.remove, a.id) {
+			return r, errors.New(gotext.Get("application %q is both requested to be installed and removed", a.id))
+		}
+	}
+
+	return r, nil
+}
+
+// installation is the system or a user flatpak installation.
+type installation struct {
+	cmd        []string
+	scope      string
+	cmdTimeout time.Duration
+	// user is the user to run the commands as, for user installations.
+	user *user.User
+}
+
+// applyRemotes deletes the remotes previously added by adsys which are not configured anymore,
+// and adds the missing ones.
+// It returns the remotes managed by adsys: the ones it added. Remotes which already existed
+// are left untouched.
+func (inst installation) applyRemotes(ctx context.Context, prev, want []remote) (managed []remote, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't configure flatpak remotes"))
+
+	var existing []string
+	if len(want) > 0 {
+		out, err := inst.run(ctx, inst.cmdTimeout, "remotes", inst.scope, "--columns=name")
+		if err != nil {
+			return nil, err
+		}
+		existing = strings.Fields(out)
+	}
+
+	for _, r := range prev {
+		i := slices.IndexFunc(want, func(o remote) bool { return o.Name == r.Name })
+		if i >= 0 && want[i].URL == r.URL {
+			if slices.Contains(existing, r.Name) {
+				managed = append(managed, r)
+			}
+			continue
+		}
+		log.Infof(ctx, "Deleting flatpak remote %s", r.Name)
+		// Remotes with installed applications can't be deleted: keep them, but stop managing them.
+		if _, err := inst.run(ctx, inst.cmdTimeout, "remote-delete", inst.scope, r.Name); err != nil {
+			log.Warning(ctx, gotext.Get("Couldn't delete flatpak remote %s: %v", r.Name, err))
+			continue
+		}
+		existing = slices.DeleteFunc(existing, func(n string) bool { return n == r.Name })
+	}
+
+	for _, r := range want {
+		if slices.Contains(existing, r.Name) {
+			continue
+		}
+		log.Infof(ctx, "Adding flatpak remote %s", r.Name)
+		args := []string{"remote-add", inst.scope, "--if-not-exists"}
+		if strings.HasSuffix(r.URL, ".flatpakrepo") {
+			args = append(args, "--from")
+		}
+		if _, err := inst.run(ctx, inst.cmdTimeout, append(args, r.Name, r.URL)...); err != nil {
+			return nil, err
+		}
+		managed = append(managed, r)
+	}
+
+	return managed, nil
+}
+
+// installAndRemove removes the installed applications requested to be removed, then installs the
+// missing ones.
+func (inst installation) installAndRemove(ctx context.Context, want rules) (err error) {
+	out, err := inst.run(ctx, inst.cmdTimeout, "list", inst.scope, "--app", "--columns=application")
+	if err != nil {
+		return errors.New(gotext.Get("can't list installed flatpak applications: %v", err))
+	}
+	installed := strings.Fields(out)
+
+	var remove []string
+	for _, id := range want.remove {
+		if slices.Contains(installed, id) {
+			remove = append(remove, id)
+		}
+	}
+	if len(remove) > 0 {
+		log.Infof(ctx, "Removing flatpak applications: %s", strings.Join(remove, ", "))
+		if _, err := inst.run(ctx, installTimeout, slices.Concat([]string{"uninstall", inst.scope, "--noninteractive", "-y"}, remove)...); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range want.install {
+		if slices.Contains(installed, a.id) {
+			continue
+		}
+		args := []string{"install", inst.scope, "--noninteractive", "-y"}
+		if a.remote != "" {
+			args = append(args, a.remote)
+		}
+		log.Infof(ctx, "Installing flatpak application %s", a.id)
+		if _, err := inst.run(ctx, installTimeout, append(args, a.id)...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run runs the flatpak command with args, as the installation user if any and for at most timeout, and returns its
+// standard output.
+// An error, containing the error output, is returned if the command failed.
+func (inst installation) run(ctx context.Context, timeout time.Duration, args ...string) (stdout string, err error) {
+	var opts syshelpers.CmdOptions
+	if inst.user != nil {
+		opts.Prepare = syshelpers.RunAs(inst.user)
+	}
+	return syshelpers.RunWithOptions(ctx, timeout, inst.cmd, opts, args...)
+}
+
+// loadState returns the flatpak configuration previously applied by adsys.
+func loadState(p string) (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load flatpak state"))
+
+	d, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the flatpak configuration applied by adsys.
+// The state file is removed if nothing is applied anymore.
+func saveState(p string, s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save flatpak state"))
+
+	if len(s.Remotes) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,154 @@
+package flatpak_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/flatpak"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+var allEntries = []entry.Entry{
+	{Key: "flatpak/remotes", Value: "flathub https://dl.flathub.org/repo/flathub.flatpakrepo\nmirror https://flatpak.example.com/repo"},
+	{Key: "flatpak/install", Value: "org.gnome.Calculator\norg.libreoffice.LibreOffice flathub\ncom.example.App mirror"},
+	{Key: "flatpak/remove", Value: "org.mozilla.firefox\norg.gnome.Maps"},
+}
+
+var allUserEntries = []entry.Entry{
+	{Key: "flatpak/user-remotes", Value: "flathub https://dl.flathub.org/repo/flathub.flatpakrepo\nmirror https://flatpak.example.com/repo"},
+	{Key: "flatpak/user-install", Value: "org.gnome.Calculator\norg.libreoffice.LibreOffice flathub\ncom.example.App mirror"},
+	{Key: "flatpak/user-remove", Value: "org.mozilla.firefox\norg.gnome.Maps"},
+}
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Add remotes":                                {entries: []entry.Entry{{Key: "flatpak/remotes", Value: "mirror https://flatpak.example.com/repo\n\n testing  https://flatpak.example.com/testing.flatpakrepo \nmirror https://flatpak.example.com/other"}}},
+		"Existing remotes are not added":             {entries: []entry.Entry{{Key: "flatpak/remotes", Value: "flathub https://dl.flathub.org/repo/flathub.flatpakrepo"}}},
+		"Install applications":                       {entries: []entry.Entry{{Key: "flatpak/install", Value: "org.libreoffice.LibreOffice flathub\ncom.example.App\ncom.example.App"}}},
+		"Installed applications are not reinstalled": {entries: []entry.Entry{{Key: "flatpak/install", Value: "org.gnome.Calculator\ncom.example.App"}}},
+		"Remove applications":                        {entries: []entry.Entry{{Key: "flatpak/remove", Value: "org.mozilla.firefox\norg.gnome.Calculator"}}},
+		"Applications not installed are not removed": {entries: []entry.Entry{{Key: "flatpak/remove", Value: "org.gnome.Maps"}}},
+		"All entries":                                {entries: allEntries},
+		"All entries for a user":                     {entries: allUserEntries, isUser: true},
+		"Machine keys are ignored for a user":        {entries: allEntries, isUser: true},
+		"User keys are ignored for a machine":        {entries: allUserEntries},
+		"Already applied remotes are kept":           {entries: allEntries[:1], existingState: "applied"},
+		"Remotes not configured anymore are deleted": {entries: []entry.Entry{{Key: "flatpak/remotes", Value: "flathub https://dl.flathub.org/repo/flathub.flatpakrepo"}}, existingState: "applied"},
+		"Remotes with a new URL are added again":     {entries: []entry.Entry{{Key: "flatpak/remotes", Value: "mirror https://mirror.example.com/repo"}}, existingState: "applied"},
+		"No entries deletes remotes":                 {existingState: "applied"},
+		"No entries deletes remotes for a user":      {existingState: "applied", isUser: true},
+		"Failing to delete a remote is not an error": {existingState: "applied", mockBehaviour: "fail-remote-delete"},
+		"Disabled entries are ignored":               {entries: []entry.Entry{{Key: "flatpak/install", Value: "com.example.App", Disabled: true}, {Key: "flatpak/remove", Value: "org.mozilla.firefox"}}},
+		"Unsupported keys are ignored":               {entries: []entry.Entry{{Key: "flatpak/install", Value: "com.example.App"}, {Key: "flatpak/update", Value: "true"}}},
+		"No entries is a no-op":                      {},
+		"Listing is skipped if not required":         {entries: []entry.Entry{{Key: "flatpak/remotes", Value: "flathub https://dl.flathub.org/repo/flathub.flatpakrepo"}}, mockBehaviour: "fail-list"},
+
+		// Error cases
+		"Error on invalid remote":                    {entries: []entry.Entry{{Key: "flatpak/remotes", Value: "flathub"}}, wantErr: true},
+		"Error on invalid remote name":               {entries: []entry.Entry{{Key: "flatpak/remotes", Value: "-flathub https://dl.flathub.org/repo/"}}, wantErr: true},
+		"Error on invalid remote URL":                {entries: []entry.Entry{{Key: "flatpak/remotes", Value: "flathub ftp://dl.flathub.org/repo/"}}, wantErr: true},
+		"Error on invalid application":               {entries: []entry.Entry{{Key: "flatpak/install", Value: "firefox"}}, wantErr: true},
+		"Error on invalid application remote":        {entries: []entry.Entry{{Key: "flatpak/install", Value: "org.mozilla.firefox -flathub"}}, wantErr: true},
+		"Error on too many fields":                   {entries: []entry.Entry{{Key: "flatpak/install", Value: "org.mozilla.firefox flathub stable"}}, wantErr: true},
+		"Error on invalid application to remove":     {entries: []entry.Entry{{Key: "flatpak/remove", Value: "org..firefox"}}, wantErr: true},
+		"Error on application installed and removed": {entries: []entry.Entry{{Key: "flatpak/install", Value: "com.example.App"}, {Key: "flatpak/remove", Value: "com.example.App"}}, wantErr: true},
+		"Error on unknown user":                      {entries: allUserEntries, isUser: true, mockBehaviour: "unknown-user", wantErr: true},
+		"Error on listing remotes":                   {entries: allEntries, mockBehaviour: "fail-remotes", wantErr: true},
+		"Error on adding remotes":                    {entries: allEntries, mockBehaviour: "fail-remote-add", wantErr: true},
+		"Error on listing applications":              {entries: allEntries, mockBehaviour: "fail-list", wantErr: true},
+		"Error on installing applications":           {entries: []entry.Entry{{Key: "flatpak/install", Value: "com.example.App"}}, mockBehaviour: "fail-install", wantErr: true},
+		"Error on removing applications":             {entries: []entry.Entry{{Key: "flatpak/remove", Value: "org.mozilla.firefox"}}, mockBehaviour: "fail-uninstall", wantErr: true},
+		"Error on corrupted state":                   {entries: allEntries, existingState: "corrupted", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			objectName := "ubuntu"
+			if tc.isUser {
+				objectName = "bob@example.com"
+			}
+
+			m := flatpak.New(
+				flatpak.WithStateDir(root),
+				flatpak.WithFlatpakCmd(testutils.MockCommand(root, "flatpak", tc.mockBehaviour)),
+				flatpak.WithUserLookup(func(name string) (*user.User, error) {
+					if tc.mockBehaviour == "unknown-user" {
+						return nil, errors.New("unknown user")
+					}
+					// Run as the current user to not drop privileges in tests.
+					return &user.User{Uid: fmt.Sprint(os.Getuid()), Gid: fmt.Sprint(os.Getgid()), Username: name, HomeDir: filepath.Join(root, "home", name)}, nil
+				}),
+			)
+			err := m.ApplyPolicy(context.Background(), objectName, !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	root, behaviour, args := c.Root, c.Behaviour, c.Args
+
+	// Log the call, replacing the temporary paths to get a stable output.
+	line := "flatpak"
+	if args[1] == "--user" {
+		line = fmt.Sprintf("HOME=%s USER=%s %s", os.Getenv("HOME"), os.Getenv("USER"), line)
+	}
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+	line = strings.ReplaceAll(line, root, "#ROOT#")
+
+	c.Log(line)
+
+	if behaviour == "fail" || behaviour == "fail-"+args[0] {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "remotes":
+		fmt.Println("flathub")
+	case "list":
+		fmt.Println("org.mozilla.firefox\norg.gnome.Calculator")
+	}
+}
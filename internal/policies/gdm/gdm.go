@@ -3,13 +3,35 @@
 // This policy manager applies dconf policies to the gdm user. It will create a system-db:gdm database
 // with the requested key=value pairs specified in the policy. For more information, refer to the
 // dconf manager documentation.
+//
+// The following settings are supported in addition:
+//   - autologin/user: the user logged in automatically when the login screen starts;
+//   - autologin/delay: the number of seconds the login screen is displayed before logging the user in,
+//     during which another user can be selected. 0 logs the user in immediately;
+//   - greeter/logo and greeter/background: images relative to the gdm/ directory of the assets share,
+//     displayed on the login screen. They are copied to /usr/local/share/adsys/gdm, and set in the
+//     org/gnome/login-screen/logo and com/ubuntu/login-screen/background-picture-uri keys of the gdm
+//     database, overriding the dconf policy of those keys.
+//
+// The automatic login keys are appended to the [daemon] section of the GDM custom configuration file, after
+// a marker comment, so that they can be reverted without touching any administrator setting. Images which
+// are not configured anymore are removed.
 package gdm
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
 	"github.com/ubuntu/adsys/internal/policies/dconf"
 	"github.com/ubuntu/adsys/internal/policies/entry"
@@ -17,15 +39,41 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	// gdmMarker precedes each automatic login key set by adsys in the GDM configuration file.
+	gdmMarker = "# Set by adsys. Do not edit: this automatic login is managed by a policy."
+
+	// assetsDir is the directory of the assets share the images are copied from.
+	assetsDir = "gdm"
+)
+
+// greeterKeys are the dconf keys of the gdm database set to the images deployed by the greeter settings.
+var greeterKeys = map[string]struct {
+	key    string
+	format string
+}{
+	"logo":       {key: "org/gnome/login-screen/logo", format: "%s"},
+	"background": {key: "com/ubuntu/login-screen/background-picture-uri", format: "file://%s"},
+}
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
 // Manager prevents running multiple gdm update process in parallel while parsing policy in ApplyPolicy.
 type Manager struct {
-	dconf *dconf.Manager
+	dconf     *dconf.Manager
+	gdmConf   string
+	assetsDir string
 }
 
 type options struct {
-	dconf *dconf.Manager
+	dconf     *dconf.Manager
+	gdmConf   string
+	assetsDir string
 }
-type option func(*options) error
+
+// Option represents an optional function to change the gdm manager.
+type Option func(*options) error
 
 // WithDconf specifies a personalized dconf manager.
 func WithDconf(m *dconf.Manager) func(o *options) error {
@@ -35,13 +83,31 @@ func WithDconf(m *dconf.Manager) func(o *options) error {
 	}
 }
 
+// WithGDMConf specifies a personalized GDM custom configuration file.
+func WithGDMConf(p string) func(o *options) error {
+	return func(o *options) error {
+		o.gdmConf = p
+		return nil
+	}
+}
+
+// WithAssetsDir specifies a personalized directory for the login screen images.
+func WithAssetsDir(p string) func(o *options) error {
+	return func(o *options) error {
+		o.assetsDir = p
+		return nil
+	}
+}
+
 // New returns a new manager for gdm policy handlers.
-func New(opts ...option) (m *Manager, err error) {
+func New(opts ...Option) (m *Manager, err error) {
 	defer decorate.OnError(&err, gotext.Get("can't create a new gdm handler manager"))
 
 	// defaults
 	args := options{
-		dconf: &dconf.Manager{},
+		dconf:     &dconf.Manager{},
+		gdmConf:   consts.DefaultGDMCustomConf,
+		assetsDir: consts.DefaultGreeterAssetsDir,
 	}
 	// applied options
 	for _, o := range opts {
@@ -51,12 +117,15 @@ func New(opts ...option) (m *Manager, err error) {
 	}
 
 	return &Manager{
-		dconf: args.dconf,
+		dconf:     args.dconf,
+		gdmConf:   args.gdmConf,
+		assetsDir: args.assetsDir,
 	}, nil
 }
 
 // ApplyPolicy generates a dconf computer or user policy based on a list of entries.
-func (m *Manager) ApplyPolicy(ctx context.Context, entries []entry.Entry) (err error) {
+// It also configures the automatic login and deploys the login screen images from the assets.
+func (m *Manager) ApplyPolicy(ctx context.Context, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
 	defer decorate.OnError(&err, gotext.Get("can't apply gdm policy"))
 
 	log.Debug(ctx, "ApplyPolicy gdm policy")
@@ -69,8 +138,15 @@ func (m *Manager) ApplyPolicy(ctx context.Context, entries []entry.Entry) (err e
 		sortedEntries[keyType] = append(sortedEntries[keyType], e)
 	}
 
+	// The images need to be deployed before being referenced in the database.
+	dconfEntries, err := m.applyGreeter(ctx, sortedEntries["greeter"], sortedEntries["dconf"], assetsDumper)
+	if err != nil {
+		return err
+	}
+
 	var g errgroup.Group
-	g.Go(func() error { return m.dconf.ApplyPolicy(ctx, "gdm", false, sortedEntries["dconf"]) })
+	g.Go(func() error { return m.dconf.ApplyPolicy(ctx, "gdm", false, dconfEntries) })
+	g.Go(func() error { return m.applyAutoLogin(ctx, sortedEntries["autologin"]) })
 
 	if err := g.Wait(); err != nil {
 		return err
@@ -78,3 +154,212 @@ func (m *Manager) ApplyPolicy(ctx context.Context, entries []entry.Entry) (err e
 
 	return nil
 }
+
+// applyAutoLogin sets the user logged in automatically by GDM, after an optional delay.
+// Without any user, it reverts to the GDM configuration set by the administrator.
+func (m *Manager) applyAutoLogin(ctx context.Context, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't configure automatic login"))
+
+	var user string
+	var delay int
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		v := strings.TrimSpace(e.Value)
+		switch e.Key {
+		case "user":
+			user = v
+		case "delay":
+			if v == "" {
+				continue
+			}
+			if delay, err = strconv.Atoi(v); err != nil || delay < 0 {
+				return errors.New(gotext.Get("delay %q must be a positive number of seconds", v))
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Unknown automatic login key %q, ignoring", e.Key))
+		}
+	}
+	if strings.ContainsAny(user, "\n=") {
+		return errors.New(gotext.Get("invalid user name %q", user))
+	}
+
+	var keys []string
+	switch {
+	case user == "":
+	case delay == 0:
+		keys = []string{"AutomaticLoginEnable=true", "AutomaticLogin=" + user}
+	default:
+		keys = []string{"TimedLoginEnable=true", "TimedLogin=" + user, fmt.Sprintf("TimedLoginDelay=%d", delay)}
+	}
+
+	d, err := os.ReadFile(m.gdmConf)
+	if errors.Is(err, fs.ErrNotExist) {
+		if keys == nil {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Dir(m.gdmConf)); err != nil {
+			log.Warning(ctx, gotext.Get("GDM is not installed, skipping automatic login"))
+			return nil
+		}
+		d = []byte("[daemon]\n")
+	} else if err != nil {
+		return err
+	}
+
+	// Remove any key we previously set, then append ours at the end of the [daemon] section, as the last
+	// occurrence of a key takes precedence.
+	var lines []string
+	daemonEnd := -1
+	inDaemon := false
+	srcLines := strings.Split(strings.TrimSuffix(string(d), "\n"), "\n")
+	for i := 0; i < len(srcLines); i++ {
+		l := srcLines[i]
+		if l == gdmMarker {
+			// Skip the marker and its key.
+			i++
+			continue
+		}
+		if trimmed := strings.TrimSpace(l); strings.HasPrefix(trimmed, "[") {
+			inDaemon = trimmed == "[daemon]"
+		}
+		lines = append(lines, l)
+		if inDaemon && strings.TrimSpace(l) != "" && !strings.HasPrefix(strings.TrimSpace(l), "#") {
+			daemonEnd = len(lines)
+		}
+	}
+
+	if keys != nil && daemonEnd == -1 {
+		lines = append(lines, "", "[daemon]")
+		daemonEnd = len(lines)
+	}
+	var managed []string
+	for _, k := range keys {
+		managed = append(managed, gdmMarker, k)
+	}
+	lines = slices.Insert(lines, max(daemonEnd, 0), managed...)
+
+	content := strings.Join(lines, "\n") + "\n"
+	if content == string(d) {
+		return nil
+	}
+	// nolint:gosec // G306 GDM configuration is world readable
+	if err := os.WriteFile(m.gdmConf+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(m.gdmConf+".new", m.gdmConf)
+}
+
+// applyGreeter deploys the login screen images from the assets and returns the dconf entries of the gdm
+// database referencing them, in place of the ones of the dconf policy.
+// The images which are not configured anymore are removed.
+func (m *Manager) applyGreeter(ctx context.Context, entries, dconfEntries []entry.Entry, assetsDumper AssetsDumper) (r []entry.Entry, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't deploy login screen images"))
+
+	images := make(map[string]string)
+	for _, e := range entries {
+		if _, ok := greeterKeys[e.Key]; !ok {
+			log.Warning(ctx, gotext.Get("Unknown login screen key %q, ignoring", e.Key))
+			continue
+		}
+		src := filepath.ToSlash(strings.TrimSpace(e.Value))
+		if e.Disabled || src == "" {
+			continue
+		}
+		if filepath.IsAbs(src) || !filepath.IsLocal(src) {
+			return nil, errors.New(gotext.Get("%s %q must be relative to the %s/ directory of the assets share", e.Key, src, assetsDir))
+		}
+		images[e.Key] = src
+	}
+
+	var deployed []string
+	r = dconfEntries
+	if len(images) > 0 {
+		tmp, err := os.MkdirTemp("", "adsys-gdm-assets-")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if errRemove := os.RemoveAll(tmp); errRemove != nil {
+				err = errors.Join(err, errRemove)
+			}
+		}()
+		// Only root can read the assets until the images are copied.
+		assets := filepath.Join(tmp, assetsDir)
+		if err := assetsDumper(ctx, assetsDir+"/", assets, -1, -1); err != nil {
+			return nil, err
+		}
+
+		//nolint:gosec // G301 - The images are read by the gdm user
+		if err := os.MkdirAll(m.assetsDir, 0755); err != nil {
+			return nil, err
+		}
+
+		keys := make([]string, 0, len(images))
+		for k := range images {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			src := images[k]
+			name := k + strings.ToLower(filepath.Ext(src))
+			dest := filepath.Join(m.assetsDir, name)
+			if err := copyIfChanged(filepath.Join(assets, src), dest); err != nil {
+				return nil, err
+			}
+			deployed = append(deployed, name)
+
+			gk := greeterKeys[k]
+			r = slices.DeleteFunc(slices.Clone(r), func(e entry.Entry) bool {
+				if e.Key != gk.key {
+					return false
+				}
+				log.Infof(ctx, "Login screen %s overrides the dconf policy of %s", k, gk.key)
+				return true
+			})
+			r = append(r, entry.Entry{Key: gk.key, Value: fmt.Sprintf(gk.format, dest), Meta: "s"})
+		}
+	}
+
+	// Remove the images which are not configured anymore.
+	files, err := os.ReadDir(m.assetsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, f := range files {
+		if slices.Contains(deployed, f.Name()) {
+			continue
+		}
+		log.Infof(ctx, "Removing login screen image %s, not configured anymore", f.Name())
+		if err := os.RemoveAll(filepath.Join(m.assetsDir, f.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// copyIfChanged copies the regular file src to dest, world readable, unless dest already has the same content.
+func copyIfChanged(src, dest string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New(gotext.Get("%s is not a regular file", filepath.Base(src)))
+	}
+	d, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if old, err := os.ReadFile(dest); err == nil && bytes.Equal(old, d) {
+		return nil
+	}
+
+	// nolint:gosec // G306 The images are read by the gdm user
+	if err := os.WriteFile(dest+".new", d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(dest+".new", dest)
+}
@@ -2,10 +2,13 @@ package gdm_test
 
 import (
 	"context"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
 	"github.com/ubuntu/adsys/internal/policies/dconf"
 	"github.com/ubuntu/adsys/internal/policies/entry"
 	"github.com/ubuntu/adsys/internal/policies/gdm"
@@ -15,38 +18,106 @@ import (
 func TestApplyPolicy(t *testing.T) {
 	t.Parallel()
 
+	images := []entry.Entry{
+		{Key: "greeter/logo", Value: "logo.png"},
+		{Key: "greeter/background", Value: "backgrounds/corp.JPG"},
+	}
+
 	tests := map[string]struct {
-		entries []entry.Entry
+		entries         []entry.Entry
+		existing        string
+		saveAssetsError bool
 
 		wantErr bool
 	}{
 		// user cases
 		"dconf policy": {entries: []entry.Entry{
 			{Key: "dconf/com/ubuntu/category/key-s", Value: "'onekey-s-othervalue'", Meta: "s"}}},
+
+		// automatic login
+		"Automatic login": {existing: "gdm-installed", entries: []entry.Entry{
+			{Key: "autologin/user", Value: "alice@example.com"}}},
+		"Timed login": {existing: "gdm-installed", entries: []entry.Entry{
+			{Key: "autologin/user", Value: "alice@example.com"},
+			{Key: "autologin/delay", Value: "10"}}},
+		"Automatic login replaces the previous one and keeps other settings": {existing: "previous-autologin", entries: []entry.Entry{
+			{Key: "autologin/user", Value: "alice@example.com"}}},
+		"Disabled automatic login reverts the previous one": {existing: "previous-autologin", entries: []entry.Entry{
+			{Key: "autologin/user", Disabled: true}}},
+		"Delay without user reverts the previous automatic login": {existing: "previous-autologin", entries: []entry.Entry{
+			{Key: "autologin/delay", Value: "10"}}},
+		"No entries reverts the previous automatic login": {existing: "previous-autologin"},
+		"Automatic login without GDM is a no-op": {entries: []entry.Entry{
+			{Key: "autologin/user", Value: "alice@example.com"}}},
+
+		// login screen images
+		"Login screen images": {existing: "gdm-installed", entries: images},
+		"Login screen images override the dconf policy": {existing: "gdm-installed", entries: append([]entry.Entry{
+			{Key: "dconf/org/gnome/login-screen/logo", Value: "/usr/share/pixmaps/other.png", Meta: "s"},
+			{Key: "dconf/org/gnome/login-screen/disable-user-list", Value: "true", Meta: "b"},
+		}, images...)},
+		"Login screen images not configured anymore are removed": {existing: "previous-images", entries: []entry.Entry{
+			{Key: "greeter/logo", Value: "logo.png"}}},
+		"Disabled login screen images are removed": {existing: "previous-images", entries: []entry.Entry{
+			{Key: "greeter/logo", Disabled: true},
+			{Key: "greeter/background", Value: ""}}},
+		"No assets needed without images": {existing: "gdm-installed", saveAssetsError: true, entries: []entry.Entry{
+			{Key: "autologin/user", Value: "alice@example.com"}}},
+		"Unknown keys are ignored": {existing: "gdm-installed", entries: []entry.Entry{
+			{Key: "autologin/password", Value: "secret"},
+			{Key: "greeter/icon", Value: "logo.png"}}},
+
+		// Error cases
+		"Error on invalid delay":               {entries: []entry.Entry{{Key: "autologin/user", Value: "alice@example.com"}, {Key: "autologin/delay", Value: "soon"}}, wantErr: true},
+		"Error on negative delay":              {entries: []entry.Entry{{Key: "autologin/user", Value: "alice@example.com"}, {Key: "autologin/delay", Value: "-1"}}, wantErr: true},
+		"Error on invalid user name":           {entries: []entry.Entry{{Key: "autologin/user", Value: "alice\nAutomaticLoginEnable=false"}}, wantErr: true},
+		"Error on image outside of the assets": {entries: []entry.Entry{{Key: "greeter/logo", Value: "../files/logo.png"}}, wantErr: true},
+		"Error on absolute image path":         {entries: []entry.Entry{{Key: "greeter/logo", Value: "/usr/share/pixmaps/logo.png"}}, wantErr: true},
+		"Error on missing image":               {entries: []entry.Entry{{Key: "greeter/logo", Value: "missing.png"}}, wantErr: true},
+		"Error on image which is a directory":  {entries: []entry.Entry{{Key: "greeter/logo", Value: "not-an-image"}}, wantErr: true},
+		"Error on assets dump failure":         {entries: images, saveAssetsError: true, wantErr: true},
 	}
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 
-			dconfDir := t.TempDir()
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			dconfDir := filepath.Join(root, "etc", "dconf")
 
 			// Apply machine configuration
 			dconfManager := dconf.NewWithDconfDir(dconfDir)
 			err := dconfManager.ApplyPolicy(context.Background(), "ubuntu", true, nil)
 			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
 
-			m, err := gdm.New(gdm.WithDconf(dconfManager))
+			m, err := gdm.New(
+				gdm.WithDconf(dconfManager),
+				gdm.WithGDMConf(filepath.Join(root, "etc", "gdm3", "custom.conf")),
+				gdm.WithAssetsDir(filepath.Join(root, "usr", "local", "share", "adsys", "gdm")),
+			)
 			require.NoError(t, err, "Setup: can't create gdm manager")
 
-			err = m.ApplyPolicy(context.Background(), tc.entries)
+			mockAssetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.saveAssetsError, Path: "gdm/"}
+			err = m.ApplyPolicy(context.Background(), tc.entries, mockAssetsDumper.SaveAssetsTo)
 			if tc.wantErr {
 				require.NotNil(t, err, "ApplyPolicy should have failed but didn't")
 				return
 			}
 			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
 
-			testutils.CompareTreesWithFiltering(t, dconfDir, filepath.Join(testutils.GoldenPath(t), "etc", "dconf"), testutils.UpdateEnabled())
+			// The images are referenced by their absolute path, which is not stable.
+			p := filepath.Join(dconfDir, "db", "gdm.d", "adsys")
+			if d, err := os.ReadFile(p); err == nil {
+				require.NoError(t, os.WriteFile(p, []byte(strings.ReplaceAll(string(d), root, "#ROOT#")), 0600), "Setup: can't normalize gdm database")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
 		})
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/ubuntu/adsys/internal/policies/entry"
 )
@@ -14,15 +15,53 @@ import (
 type GPO struct {
 	ID   string
 	Name string
+	// Link is the distinguished name of the container (domain, OU or site) the GPO is linked to.
+	Link string `yaml:",omitempty"`
 	// the string is the domain of rules (dconf, install…)
 	Rules map[string][]entry.Entry
 }
 
-// Format write to w a formatted GPO. overridden entries are prepended with -.
-func (g GPO) Format(w io.Writer, withRules, withOverridden bool, alreadyProcessedRules map[string]struct{}) map[string]struct{} {
-	fmt.Fprintf(w, "* %s (%s)\n", g.Name, g.ID)
+// rolloutRings returns the list of rings the GPO is restricted to.
+// restricted is false if the GPO does not declare any enabled ring restriction.
+func (g GPO) rolloutRings() (rings []string, restricted bool) {
+	for _, e := range g.Rules[RolloutRuleType] {
+		if e.Key != "ring" || e.Disabled {
+			continue
+		}
+		for _, r := range strings.FieldsFunc(e.Value, func(c rune) bool { return c == ',' || c == '\n' }) {
+			if r = strings.TrimSpace(r); r == "" {
+				continue
+			}
+			rings = append(rings, r)
+		}
+		return rings, len(rings) > 0
+	}
+	return nil, false
+}
 
+// hardwareTargets returns the hardware targeting expressions the GPO is restricted to, one per line.
+func (g GPO) hardwareTargets() (expressions []string) {
+	for _, e := range g.Rules[TargetingRuleType] {
+		if e.Key != "hardware" || e.Disabled {
+			continue
+		}
+		for _, expr := range strings.Split(e.Value, "\n") {
+			if expr = strings.TrimSpace(expr); expr != "" {
+				expressions = append(expressions, expr)
+			}
+		}
+	}
+	return expressions
+}
+
+// Format write to w a formatted GPO. overridden entries are prepended with -, entries in audit mode are
+// suffixed with (audit) and entries referenced in warnings, which were not applied, with the reason why.
+// The container the GPO is linked to, if known, is appended between brackets when rules are displayed.
+// If changes is not nil, only the rules it references are displayed, prefixed with the time of their last change,
+// and the GPO is skipped if none of its rules are referenced.
+func (g GPO) Format(w io.Writer, withRules, withOverridden bool, alreadyProcessedRules map[string]struct{}, changes map[string]time.Time, warnings map[string]string) map[string]struct{} {
 	if !withRules {
+		fmt.Fprintf(w, "* %s (%s)\n", g.Name, g.ID)
 		return nil
 	}
 
@@ -36,25 +75,38 @@ func (g GPO) Format(w io.Writer, withRules, withOverridden bool, alreadyProcesse
 	}
 	sort.Strings(domains)
 
+	var rules strings.Builder
 	for _, d := range domains {
-		fmt.Fprintf(w, "** %s:\n", d)
+		var domainRules strings.Builder
 		for _, r := range g.Rules[d] {
 			k := filepath.Join(d, r.Key)
 			_, overr := alreadyProcessedRules[k]
-			if !withOverridden && overr {
-				continue
-			}
-			prefix := "***"
-			if overr {
-				prefix += "-"
-			}
-			// Trim EOL \n and replace them all with \n in text to keep each value printed in one single line
-			v := strings.ReplaceAll(strings.TrimSpace(r.Value), "\n", `\n`)
-			if r.Disabled {
-				prefix += "+"
-				fmt.Fprintf(w, "%s %s\n", prefix, r.Key)
-			} else {
-				fmt.Fprintf(w, "%s %s: %s\n", prefix, r.Key, v)
+			lastChange, changed := changes[k]
+			if (withOverridden || !overr) && (changes == nil || changed) {
+				prefix := "***"
+				if overr {
+					prefix += "-"
+				}
+				if changed {
+					r.Key = fmt.Sprintf("[%s] %s", lastChange.Format(time.RFC3339), r.Key)
+				}
+				// Trim EOL \n and replace them all with \n in text to keep each value printed in one single line
+				v := strings.ReplaceAll(strings.TrimSpace(r.Value), "\n", `\n`)
+				// Rules in audit mode are only reported by the clients.
+				var suffix string
+				if r.Mode == entry.ModeAudit {
+					suffix = " (audit)"
+				}
+				// Only the effective rule was applied and could be rejected.
+				if w, ok := warnings[k]; ok && !overr {
+					suffix += fmt.Sprintf(" (warning: %s)", strings.ReplaceAll(w, "\n", `\n`))
+				}
+				if r.Disabled {
+					prefix += "+"
+					fmt.Fprintf(&domainRules, "%s %s%s\n", prefix, r.Key, suffix)
+				} else {
+					fmt.Fprintf(&domainRules, "%s %s: %s%s\n", prefix, r.Key, v, suffix)
+				}
 			}
 
 			// Do not add non overridable key to the alreadyProcessedRules override detection map.
@@ -63,7 +115,24 @@ func (g GPO) Format(w io.Writer, withRules, withOverridden bool, alreadyProcesse
 			}
 			alreadyProcessedRules[k] = struct{}{}
 		}
+
+		// Only list types with changed rules when filtering on changes.
+		if changes != nil && domainRules.Len() == 0 {
+			continue
+		}
+		fmt.Fprintf(&rules, "** %s:\n%s", d, domainRules.String())
+	}
+
+	if changes != nil && rules.Len() == 0 {
+		return alreadyProcessedRules
+	}
+
+	if g.Link != "" {
+		fmt.Fprintf(w, "* %s (%s) [%s]\n", g.Name, g.ID, g.Link)
+	} else {
+		fmt.Fprintf(w, "* %s (%s)\n", g.Name, g.ID)
 	}
+	fmt.Fprint(w, rules.String())
 
 	return alreadyProcessedRules
 }
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/ubuntu/adsys/internal/policies"
@@ -26,12 +27,27 @@ func TestFormat(t *testing.T) {
 		withRules             bool
 		withOverridden        bool
 		alreadyProcessedRules map[string]struct{}
+		changes               map[string]time.Time
+		warnings              map[string]string
 
 		wantAlreadyProcessedRules map[string]struct{}
 	}{
 		"GPO summary":    {},
 		"GPO with rules": {withRules: true, wantAlreadyProcessedRules: defaultProcessedRules},
 		"GPO with rules and overrides, no rules processed": {withRules: true, withOverridden: true, wantAlreadyProcessedRules: defaultProcessedRules},
+		"GPO summary with link is not displayed":           {cachedPoliciesSrc: "with_link"},
+		"GPO with rules and link":                          {cachedPoliciesSrc: "with_link", withRules: true, wantAlreadyProcessedRules: defaultProcessedRules},
+		"GPO with rules in audit mode":                     {cachedPoliciesSrc: "with_audit", withRules: true, wantAlreadyProcessedRules: defaultProcessedRules},
+		"GPO with rules with warnings": {
+			withRules:                 true,
+			warnings:                  map[string]string{"dconf/path/to/key1": "1 is not of type s", "dconf/other/key": "unrelated"},
+			wantAlreadyProcessedRules: defaultProcessedRules},
+		"GPO with rules with warnings, overridden rules have no warning": {
+			withRules:                 true,
+			withOverridden:            true,
+			alreadyProcessedRules:     map[string]struct{}{"dconf/path/to/key1": {}},
+			warnings:                  map[string]string{"dconf/path/to/key1": "1 is not of type s"},
+			wantAlreadyProcessedRules: defaultProcessedRules},
 		"GPO with rules, appending to existing treated key": {
 			withRules:             true,
 			alreadyProcessedRules: map[string]struct{}{"dconf/non/matching/override": {}},
@@ -79,6 +95,34 @@ func TestFormat(t *testing.T) {
 				"dconf/path/to/key2":   {},
 				"scripts/path/to/key3": {},
 			}},
+
+		// changes cases
+		"GPO with changed rules only": {
+			withRules: true,
+			changes: map[string]time.Time{
+				"dconf/path/to/key2":   time.Date(2023, time.March, 2, 10, 0, 0, 0, time.UTC),
+				"scripts/path/to/key3": time.Date(2023, time.March, 3, 10, 0, 0, 0, time.UTC),
+			},
+			wantAlreadyProcessedRules: defaultProcessedRules},
+		"GPO with changed rules, type without changes is not displayed": {
+			withRules:                 true,
+			changes:                   map[string]time.Time{"dconf/path/to/key1": time.Date(2023, time.March, 2, 10, 0, 0, 0, time.UTC)},
+			wantAlreadyProcessedRules: defaultProcessedRules},
+		"GPO with changed rules, override displayed": {
+			withRules:                 true,
+			withOverridden:            true,
+			alreadyProcessedRules:     map[string]struct{}{"dconf/path/to/key1": {}},
+			changes:                   map[string]time.Time{"dconf/path/to/key1": time.Date(2023, time.March, 2, 10, 0, 0, 0, time.UTC)},
+			wantAlreadyProcessedRules: defaultProcessedRules},
+		"GPO without changed rules is not displayed": {
+			withRules:                 true,
+			changes:                   map[string]time.Time{"dconf/other/key": time.Date(2023, time.March, 2, 10, 0, 0, 0, time.UTC)},
+			wantAlreadyProcessedRules: defaultProcessedRules},
+		"GPO with changed rules, override hidden is not displayed": {
+			withRules:                 true,
+			alreadyProcessedRules:     map[string]struct{}{"dconf/path/to/key1": {}},
+			changes:                   map[string]time.Time{"dconf/path/to/key1": time.Date(2023, time.March, 2, 10, 0, 0, 0, time.UTC)},
+			wantAlreadyProcessedRules: defaultProcessedRules},
 	}
 
 	for name, tc := range tests {
@@ -96,7 +140,7 @@ func TestFormat(t *testing.T) {
 
 			var out strings.Builder
 
-			got := pols.GPOs[0].Format(&out, tc.withRules, tc.withOverridden, tc.alreadyProcessedRules)
+			got := pols.GPOs[0].Format(&out, tc.withRules, tc.withOverridden, tc.alreadyProcessedRules, tc.changes, tc.warnings)
 			// check cache between Format calls
 			require.Equal(t, tc.wantAlreadyProcessedRules, got, "Format returns expected alreadyProcessedRules cache")
 
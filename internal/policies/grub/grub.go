@@ -0,0 +1,345 @@
+// Package grub provides a manager that protects the GRUB boot loader and configures the kernel command line.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - grub/superuser: the name of the GRUB superuser, root by default;
+//   - grub/password-hash: the PBKDF2 hash of the password of the superuser, as generated by
+//     grub-mkpasswd-pbkdf2. Once set, the superuser must authenticate to edit the boot entries or use the
+//     GRUB shell;
+//   - grub/kernel-parameters-add: kernel command line parameters, separated by spaces or one per line,
+//     appended to the command line of all boot entries;
+//   - grub/kernel-parameters-remove: kernel command line parameters, separated by spaces or one per line,
+//     removed from the command line configured on the system. A parameter name without value removes the
+//     parameter whatever its value.
+//
+// The kernel parameters are written to a drop-in file of /etc/default/grub.d and the superuser to a script of
+// /etc/grub.d. The GRUB configuration is then regenerated with update-grub: if it fails, the previous files are
+// restored and an error is returned. As update-grub only replaces the GRUB configuration on success, the boot
+// loader is left untouched.
+//
+// The files are removed once the policy is not configured anymore, restoring the configuration of the system.
+package grub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	defaultsFile = "etc/default/grub.d/99-adsys.cfg"
+	passwordFile = "etc/grub.d/01_adsys_password"
+)
+
+// defaultSuperuser is the GRUB superuser when none is configured.
+const defaultSuperuser = "root"
+
+// updateGrubTimeout is the default maximum time update-grub can take, as it probes all the installed systems.
+const updateGrubTimeout = 2 * time.Minute
+
+var (
+	// superuserRe matches a GRUB user name.
+	superuserRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]*$`)
+	// passwordHashRe matches a password hash generated by grub-mkpasswd-pbkdf2.
+	passwordHashRe = regexp.MustCompile(`^grub\.pbkdf2\.sha512\.[0-9]+\.[0-9A-Fa-f]+\.[0-9A-Fa-f]+$`)
+	// parameterRe matches a kernel parameter, with an optional value. Quotes, shell expansions and wildcards
+	// are not supported, as the parameters are written to a shell script.
+	parameterRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]+(=[^\s"'$\\` + "`" + `*?\[\]]+)?$`)
+)
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// settings is the GRUB configuration requested by the policy.
+type settings struct {
+	superuser    string
+	passwordHash string
+	addParams    []string
+	removeParams []string
+}
+
+// Manager applies the GRUB policy on the machine.
+type Manager struct {
+	rootDir string
+
+	updateGrubCmd []string
+	cmdTimeout    time.Duration
+}
+
+type options struct {
+	rootDir       string
+	updateGrubCmd []string
+	cmdTimeout    time.Duration
+}
+
+// Option reprents an optional function to change the grub manager.
+type Option func(*options)
+
+// WithRootDir writes the GRUB configuration files relative to p instead of the root of the filesystem.
+func WithRootDir(p string) func(*options) {
+	return func(a *options) {
+		a.rootDir = p
+	}
+}
+
+// WithUpdateGrubCmd overrides the default update-grub command.
+func WithUpdateGrubCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.updateGrubCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time update-grub can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the grub policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		rootDir:       "/",
+		updateGrubCmd: []string{"update-grub"},
+		cmdTimeout:    updateGrubTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		rootDir:       args.rootDir,
+		updateGrubCmd: args.updateGrubCmd,
+		cmdTimeout:    args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy configures GRUB from the list of entries and regenerates its configuration.
+// If the configuration can't be regenerated, the previous one is restored.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply grub policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Grub policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying grub policy to %s", objectName)
+
+	s, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	defaultsPath, passwordPath := filepath.Join(m.rootDir, defaultsFile), filepath.Join(m.rootDir, passwordFile)
+	defaults, password := s.defaults(), s.passwordScript()
+
+	// Keep the current files to restore them if the configuration can't be regenerated.
+	oldDefaults, err := readFile(defaultsPath)
+	if err != nil {
+		return err
+	}
+	oldPassword, err := readFile(passwordPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(oldDefaults, defaults) && bytes.Equal(oldPassword, password) {
+		return nil
+	}
+
+	if err := writeFile(passwordPath, password, 0700); err != nil {
+		return err
+	}
+	if err := writeFile(defaultsPath, defaults, 0644); err != nil {
+		return errors.Join(err, writeFile(passwordPath, oldPassword, 0700))
+	}
+
+	log.Info(ctx, gotext.Get("Regenerating the GRUB configuration"))
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.updateGrubCmd); err != nil {
+		log.Warning(ctx, gotext.Get("The GRUB configuration can't be regenerated, restoring the previous settings"))
+		if rErr := errors.Join(writeFile(defaultsPath, oldDefaults, 0644), writeFile(passwordPath, oldPassword, 0700)); rErr != nil {
+			return errors.Join(err, rErr)
+		}
+		return errors.New(gotext.Get("can't regenerate the GRUB configuration, the previous settings were restored: %v", err))
+	}
+
+	return nil
+}
+
+// DumpState returns the GRUB defaults written during the last refresh of the machine.
+// The state is empty for users or if no grub policy is applied.
+// The password file is not part of the state, as it contains the password hash.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump grub state of %s", objectName))
+
+	// Grub policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.rootDir, defaultsFile))
+}
+
+// parseEntries validates the entries and returns the requested configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry) (s settings, err error) {
+	for _, e := range entries {
+		if e.Disabled || strings.TrimSpace(e.Value) == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "grub/superuser":
+			v := strings.TrimSpace(e.Value)
+			if !superuserRe.MatchString(v) {
+				return s, errors.New(gotext.Get("invalid GRUB superuser name %q", v))
+			}
+			s.superuser = v
+		case "grub/password-hash":
+			v := strings.TrimSpace(e.Value)
+			if !passwordHashRe.MatchString(v) {
+				return s, errors.New(gotext.Get("invalid GRUB password hash: expected a hash generated by grub-mkpasswd-pbkdf2, starting with grub.pbkdf2.sha512"))
+			}
+			s.passwordHash = v
+		case "grub/kernel-parameters-add", "grub/kernel-parameters-remove":
+			params := &s.addParams
+			if e.Key == "grub/kernel-parameters-remove" {
+				params = &s.removeParams
+			}
+			for _, p := range strings.Fields(e.Value) {
+				if !parameterRe.MatchString(p) {
+					return s, errors.New(gotext.Get("invalid kernel parameter %q", p))
+				}
+				if !slices.Contains(*params, p) {
+					*params = append(*params, p)
+				}
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing grub entries, skipping it", e.Key))
+		}
+	}
+
+	if s.superuser != "" && s.passwordHash == "" {
+		log.Warning(ctx, gotext.Get("GRUB superuser %q is ignored as no password hash is configured", s.superuser))
+		s.superuser = ""
+	}
+	if s.passwordHash != "" && s.superuser == "" {
+		s.superuser = defaultSuperuser
+	}
+
+	return s, nil
+}
+
+// defaults returns the content of the drop-in file of /etc/default/grub.d, or nil if no kernel parameter
+// is configured.
+// The removed parameters are filtered out of the command line configured on the system before the added
+// ones are appended.
+func (s settings) defaults() []byte {
+	if len(s.addParams) == 0 && len(s.removeParams) == 0 {
+		return nil
+	}
+
+	var out bytes.Buffer
+	out.WriteString(header)
+	if len(s.removeParams) > 0 {
+		var patterns []string
+		for _, p := range s.removeParams {
+			patterns = append(patterns, p)
+			if !strings.Contains(p, "=") {
+				patterns = append(patterns, p+"=*")
+			}
+		}
+		fmt.Fprintf(&out, `
+adsys_remove_parameters() {
+	_adsys_kept=""
+	for _adsys_param in $1; do
+		case "$_adsys_param" in
+			%s) ;;
+			*) _adsys_kept="${_adsys_kept:+$_adsys_kept }$_adsys_param" ;;
+		esac
+	done
+	echo "$_adsys_kept"
+}
+GRUB_CMDLINE_LINUX="$(adsys_remove_parameters "$GRUB_CMDLINE_LINUX")"
+GRUB_CMDLINE_LINUX_DEFAULT="$(adsys_remove_parameters "$GRUB_CMDLINE_LINUX_DEFAULT")"
+unset -f adsys_remove_parameters
+`, strings.Join(patterns, "|"))
+	}
+	if len(s.addParams) > 0 {
+		fmt.Fprintf(&out, "\nGRUB_CMDLINE_LINUX=\"${GRUB_CMDLINE_LINUX:+$GRUB_CMDLINE_LINUX }%s\"\n", strings.Join(s.addParams, " "))
+	}
+	return out.Bytes()
+}
+
+// passwordScript returns the content of the script of /etc/grub.d declaring the superuser, or nil if no
+// password is configured.
+func (s settings) passwordScript() []byte {
+	if s.passwordHash == "" {
+		return nil
+	}
+
+	var out bytes.Buffer
+	out.WriteString("#!/bin/sh\n")
+	out.WriteString(header)
+	fmt.Fprintf(&out, `
+cat << 'EOF'
+set superusers="%s"
+password_pbkdf2 %s %s
+EOF
+`, s.superuser, s.superuser, s.passwordHash)
+	return out.Bytes()
+}
+
+// readFile returns the content of the file p, or nil if it doesn't exist.
+func readFile(p string) ([]byte, error) {
+	d, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return d, err
+}
+
+// writeFile writes content to the file p with mode perm, removing it if content is nil.
+// The temporary file is hidden so that it is neither sourced nor executed by update-grub.
+func writeFile(p string, content []byte, perm os.FileMode) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write GRUB configuration %s", p))
+
+	if content == nil {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".new")
+	if err := os.WriteFile(tmp, content, perm); err != nil {
+		return err
+	}
+	// Enforce the permissions of an existing temporary file.
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
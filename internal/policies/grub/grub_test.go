@@ -0,0 +1,157 @@
+package grub_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/grub"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+const passwordHash = "grub.pbkdf2.sha512.10000.0123456789ABCDEF.FEDCBA9876543210"
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "grub/superuser", Value: "admin"},
+		{Key: "grub/password-hash", Value: passwordHash},
+		{Key: "grub/kernel-parameters-add", Value: "audit=1 apparmor=1\nlockdown=integrity"},
+		{Key: "grub/kernel-parameters-remove", Value: "quiet splash\nmitigations=off"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		mockBehaviour string
+		makeReadOnly  bool
+
+		wantErr bool
+		// wantRestored compares the files after a failure, to check the previous configuration was restored.
+		wantRestored bool
+	}{
+		"Password with default superuser":       {entries: []entry.Entry{{Key: "grub/password-hash", Value: passwordHash}}},
+		"Password with superuser":               {entries: []entry.Entry{{Key: "grub/superuser", Value: "admin"}, {Key: "grub/password-hash", Value: passwordHash}}},
+		"Add kernel parameters":                 {entries: []entry.Entry{{Key: "grub/kernel-parameters-add", Value: "audit=1\napparmor=1 security=apparmor"}}},
+		"Remove kernel parameters":              {entries: []entry.Entry{{Key: "grub/kernel-parameters-remove", Value: "quiet splash mitigations=off"}}},
+		"Duplicated kernel parameters":          {entries: []entry.Entry{{Key: "grub/kernel-parameters-add", Value: "audit=1 audit=1"}, {Key: "grub/kernel-parameters-add", Value: "audit=1"}}},
+		"Kernel parameters with dots and lists": {entries: []entry.Entry{{Key: "grub/kernel-parameters-add", Value: "usbcore.authorized_default=0 lsm=landlock,lockdown,yama"}}},
+		"All entries":                           {entries: allEntries},
+		"Existing configuration is updated":     {existingDirs: "existing-config", entries: allEntries},
+		"Existing configuration is unchanged": {existingDirs: "existing-config", entries: []entry.Entry{
+			{Key: "grub/password-hash", Value: "grub.pbkdf2.sha512.10000.AABB.CCDD"},
+			{Key: "grub/kernel-parameters-add", Value: "audit=1"},
+		}},
+		"Removing password removes its file": {existingDirs: "existing-config", entries: []entry.Entry{{Key: "grub/kernel-parameters-add", Value: "audit=1"}}},
+		"No entries removes configuration":   {existingDirs: "existing-config"},
+
+		"Values are trimmed":                    {entries: []entry.Entry{{Key: "grub/superuser", Value: " admin\n"}, {Key: "grub/password-hash", Value: "  " + passwordHash + "\n"}}},
+		"Superuser without password is ignored": {entries: []entry.Entry{{Key: "grub/superuser", Value: "admin"}, {Key: "grub/kernel-parameters-add", Value: "audit=1"}}},
+		"Disabled entries are ignored":          {entries: []entry.Entry{{Key: "grub/kernel-parameters-add", Value: "audit=1"}, {Key: "grub/password-hash", Value: passwordHash, Disabled: true}}},
+		"Empty entries are ignored":             {entries: []entry.Entry{{Key: "grub/kernel-parameters-add", Value: "audit=1"}, {Key: "grub/kernel-parameters-remove", Value: " \n"}}},
+		"Unsupported keys are ignored":          {entries: []entry.Entry{{Key: "grub/kernel-parameters-add", Value: "audit=1"}, {Key: "grub/timeout", Value: "5"}}},
+		"No entries and no existing files":      {},
+		"Not a computer is a no-op":             {isNotComputer: true, existingDirs: "existing-config"},
+		"Failing update-grub without change is a no-op": {existingDirs: "existing-config", mockBehaviour: "fail-update-grub", entries: []entry.Entry{
+			{Key: "grub/password-hash", Value: "grub.pbkdf2.sha512.10000.AABB.CCDD"},
+			{Key: "grub/kernel-parameters-add", Value: "audit=1"},
+		}},
+
+		// Error cases
+		"Error on invalid superuser":                       {entries: []entry.Entry{{Key: "grub/superuser", Value: "my admin"}, {Key: "grub/password-hash", Value: passwordHash}}, wantErr: true},
+		"Error on plain text password":                     {entries: []entry.Entry{{Key: "grub/password-hash", Value: "secret"}}, wantErr: true},
+		"Error on invalid password hash":                   {entries: []entry.Entry{{Key: "grub/password-hash", Value: "grub.pbkdf2.sha512.10000.XYZ.CCDD"}}, wantErr: true},
+		"Error on kernel parameter with quotes":            {entries: []entry.Entry{{Key: "grub/kernel-parameters-add", Value: `audit=1 init="/bin/sh"`}}, wantErr: true},
+		"Error on kernel parameter with shell expansion":   {entries: []entry.Entry{{Key: "grub/kernel-parameters-remove", Value: "root=$(reboot)"}}, wantErr: true},
+		"Error on kernel parameter with wildcards":         {entries: []entry.Entry{{Key: "grub/kernel-parameters-remove", Value: "console=*"}}, wantErr: true},
+		"Error on failing update-grub restores previous":   {existingDirs: "existing-config", entries: allEntries, mockBehaviour: "fail-update-grub", wantErr: true, wantRestored: true},
+		"Error on failing update-grub removes new files":   {entries: allEntries, mockBehaviour: "fail-update-grub", wantErr: true, wantRestored: true},
+		"Error on unwritable grub configuration directory": {existingDirs: "existing-config", makeReadOnly: true, entries: allEntries, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.makeReadOnly {
+				testutils.MakeReadOnly(t, filepath.Join(root, "etc", "grub.d"))
+			}
+
+			m := grub.New(
+				grub.WithRootDir(root),
+				grub.WithUpdateGrubCmd(testutils.MockCommand(root, "update-grub", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				if !tc.wantRestored {
+					return
+				}
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestRemoveKernelParameters(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	m := grub.New(
+		grub.WithRootDir(root),
+		grub.WithUpdateGrubCmd(testutils.MockCommand(root, "update-grub", "")),
+	)
+	err := m.ApplyPolicy(context.Background(), "ubuntu", true, []entry.Entry{
+		{Key: "grub/kernel-parameters-remove", Value: "quiet splash mitigations=off"},
+		{Key: "grub/kernel-parameters-add", Value: "audit=1"},
+	})
+	require.NoError(t, err, "Setup: ApplyPolicy failed but shouldn't have")
+
+	// Source the drop-in file like update-grub does, on top of the configuration of the system.
+	script := `GRUB_CMDLINE_LINUX="console=tty0 mitigations=off mitigations=auto"
+GRUB_CMDLINE_LINUX_DEFAULT="quiet splash=verbose vt.handoff=7"
+. "$1"
+echo "$GRUB_CMDLINE_LINUX|$GRUB_CMDLINE_LINUX_DEFAULT"`
+	// #nosec G204 - this is a controlled command in tests
+	out, err := exec.Command("sh", "-c", script, "sh", filepath.Join(root, "etc", "default", "grub.d", "99-adsys.cfg")).CombinedOutput()
+	require.NoError(t, err, "Sourcing the drop-in file failed: %s", out)
+	require.Equal(t, "console=tty0 mitigations=auto audit=1|vt.handoff=7\n", string(out), "Kernel command line should have been updated")
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, behaviours, args := c.Name, strings.Split(c.Behaviour, ","), c.Args
+
+	c.Log(fmt.Sprintf("%s %s", name, strings.Join(args, " ")))
+
+	if slices.Contains(behaviours, "fail-"+name) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,264 @@
+// Package history keeps a local git repository of the policy artifacts rendered on the machine,
+// like the dconf keyfiles and profiles, the sudoers and polkit configuration or the apparmor profiles.
+//
+// After each refresh, the artifacts are copied into the history directory, replacing the previous
+// copy, and committed if they changed. Administrators can then use git log and git diff in this
+// directory to know what changed on the machine and when.
+//
+// Only the artifacts owned by adsys are recorded: the configuration of other packages in the same
+// directories is left out.
+package history
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/decorate"
+)
+
+// Source is a set of artifacts to record in the history.
+type Source struct {
+	// Name is the directory of the history the artifacts are copied to.
+	Name string
+	// Root is the directory containing the artifacts.
+	Root string
+	// Patterns are the glob patterns, relative to Root, matching the artifacts.
+	// Matching directories are copied recursively.
+	Patterns []string
+}
+
+// Manager records the artifacts into the history repository.
+type Manager struct {
+	dir        string
+	sources    []Source
+	gitCmd     []string
+	cmdTimeout time.Duration
+
+	mu sync.Mutex
+}
+
+type options struct {
+	gitCmd     []string
+	cmdTimeout time.Duration
+}
+
+// Option reprents an optional function to change the history manager.
+type Option func(*options)
+
+// WithGitCmd specifies a personalized git command.
+func WithGitCmd(cmd []string) Option {
+	return func(o *options) {
+		o.gitCmd = cmd
+	}
+}
+
+// WithCmdTimeout specifies a personalized maximum time for each git command to finish.
+func WithCmdTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager recording the artifacts of sources into the git repository in dir.
+func New(dir string, sources []Source, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		gitCmd:     []string{"git"},
+		cmdTimeout: consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		dir:        dir,
+		sources:    sources,
+		gitCmd:     args.gitCmd,
+		cmdTimeout: args.cmdTimeout,
+	}
+}
+
+// Record copies the current artifacts into the history and commits them with message.
+// Nothing is committed if they didn't change since the previous record.
+func (m *Manager) Record(ctx context.Context, message string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't record policy history"))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The history contains the sudoers and other sensitive configuration: only root can read it.
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(m.dir, ".git")); errors.Is(err, fs.ErrNotExist) {
+		log.Infof(ctx, "Creating policy history repository in %s", m.dir)
+		if _, err := m.git(ctx, "init", "--quiet"); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// Start from an empty tree, so that removed artifacts are recorded as such.
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == ".git" {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(m.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range m.sources {
+		if err := m.copySource(s); err != nil {
+			return err
+		}
+	}
+
+	if _, err := m.git(ctx, "add", "--all"); err != nil {
+		return err
+	}
+	status, err := m.git(ctx, "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(status) == "" {
+		log.Debugf(ctx, "No policy artifact changed, nothing to record in history")
+		return nil
+	}
+
+	if _, err := m.git(ctx,
+		"-c", "user.name=adsys", "-c", "user.email=adsys@localhost", "-c", "commit.gpgsign=false",
+		"commit", "--quiet", "--no-verify", "--message", message); err != nil {
+		return err
+	}
+	log.Debugf(ctx, "Recorded policy artifacts in history: %s", strings.SplitN(message, "\n", 2)[0])
+	return nil
+}
+
+// copySource copies the artifacts of s into the history.
+func (m *Manager) copySource(s Source) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't copy %s artifacts", s.Name))
+
+	for _, pattern := range s.Patterns {
+		matches, err := filepath.Glob(filepath.Join(s.Root, pattern))
+		if err != nil {
+			return err
+		}
+		for _, src := range matches {
+			rel, err := filepath.Rel(s.Root, src)
+			if err != nil {
+				return err
+			}
+			if err := copyTree(src, filepath.Join(m.dir, s.Name, rel)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyTree copies the file or directory src to dest, recreating the symlinks.
+func copyTree(src, dest string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !d.Type().IsRegular():
+			// Sockets, fifos and devices are not policy artifacts.
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return copyFile(p, target, info.Mode().Perm())
+	})
+}
+
+// copyFile copies the regular file src to dest with perm.
+func copyFile(src, dest string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// git runs git with args in the history repository and returns its standard output.
+// An error, containing the error output, is returned if the command failed.
+func (m *Manager) git(ctx context.Context, args ...string) (stdout string, err error) {
+	defer decorate.OnError(&err, gotext.Get("%s failed", filepath.Base(m.gitCmd[0])))
+
+	ctx, cancel := context.WithTimeout(ctx, m.cmdTimeout)
+	defer cancel()
+
+	cmdArgs := append(slices.Clone(m.gitCmd[1:]), args...)
+	// #nosec G204 - cmd is under our control (default system command or mock for tests)
+	c := exec.CommandContext(ctx, m.gitCmd[0], cmdArgs...)
+	c.Dir = m.dir
+	var outBuf, errBuf bytes.Buffer
+	c.Stdout = &outBuf
+	c.Stderr = &errBuf
+
+	smbsafe.WaitExec()
+	err = c.Run()
+	smbsafe.DoneExec()
+
+	if err != nil {
+		if stderr := strings.TrimSpace(errBuf.String()); stderr != "" {
+			return "", fmt.Errorf("%w: %s", err, stderr)
+		}
+		return "", err
+	}
+	return outBuf.String(), nil
+}
@@ -0,0 +1,122 @@
+package history_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/history"
+)
+
+func TestRecord(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		records       int
+		changeBetween func(t *testing.T, root string)
+		historyIsFile bool
+		gitCmd        []string
+
+		wantCommits []string
+		wantFiles   []string
+		wantErr     bool
+	}{
+		"Record artifacts": {
+			wantCommits: []string{"Record 1"},
+			wantFiles:   []string{"dconf/db/machine.d/adsys", "dconf/profile/machine", "sudoers/99-adsys", "apparmor/usr.bin.foo", "apparmor/abstractions/bar"},
+		},
+		"Unchanged artifacts are not committed again": {
+			records:     2,
+			wantCommits: []string{"Record 1"},
+			wantFiles:   []string{"dconf/db/machine.d/adsys", "dconf/profile/machine", "sudoers/99-adsys", "apparmor/usr.bin.foo", "apparmor/abstractions/bar"},
+		},
+		"Changed artifacts are committed": {
+			records: 2,
+			changeBetween: func(t *testing.T, root string) {
+				t.Helper()
+				require.NoError(t, os.WriteFile(filepath.Join(root, "sudoers.d", "99-adsys"), []byte("new rules"), 0600), "Setup: can't change artifact")
+			},
+			wantCommits: []string{"Record 2", "Record 1"},
+			wantFiles:   []string{"dconf/db/machine.d/adsys", "dconf/profile/machine", "sudoers/99-adsys", "apparmor/usr.bin.foo", "apparmor/abstractions/bar"},
+		},
+		"Removed artifacts are committed": {
+			records: 2,
+			changeBetween: func(t *testing.T, root string) {
+				t.Helper()
+				require.NoError(t, os.RemoveAll(filepath.Join(root, "apparmor.d")), "Setup: can't remove artifacts")
+			},
+			wantCommits: []string{"Record 2", "Record 1"},
+			wantFiles:   []string{"dconf/db/machine.d/adsys", "dconf/profile/machine", "sudoers/99-adsys"},
+		},
+
+		// Error cases
+		"Error when git fails":                {gitCmd: []string{"false"}, wantErr: true},
+		"Error when history can't be created": {historyIsFile: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			for path, content := range map[string]string{
+				"dconf/db/machine.d/adsys":    "[org/gnome/desktop]\nkey=value",
+				"dconf/db/machine.d/other":    "not ours",
+				"dconf/db/machine":            "compiled database",
+				"dconf/profile/machine":       "user-db:user",
+				"sudoers.d/99-adsys":          "rules",
+				"sudoers.d/README":            "not ours",
+				"apparmor.d/usr.bin.foo":      "profile foo {}",
+				"apparmor.d/abstractions/bar": "bar",
+			} {
+				p := filepath.Join(root, path)
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), 0700), "Setup: can't create artifact directory")
+				require.NoError(t, os.WriteFile(p, []byte(content), 0600), "Setup: can't create artifact")
+			}
+
+			dir := filepath.Join(t.TempDir(), "history")
+			if tc.historyIsFile {
+				require.NoError(t, os.WriteFile(dir, nil, 0600), "Setup: can't create history file")
+			}
+
+			var opts []history.Option
+			if tc.gitCmd != nil {
+				opts = append(opts, history.WithGitCmd(tc.gitCmd))
+			}
+			m := history.New(dir, []history.Source{
+				{Name: "dconf", Root: filepath.Join(root, "dconf"), Patterns: []string{"profile/*", "db/*.d/adsys"}},
+				{Name: "sudoers", Root: filepath.Join(root, "sudoers.d"), Patterns: []string{"99-adsys*"}},
+				{Name: "polkit", Root: filepath.Join(root, "policykit"), Patterns: []string{"localauthority.conf.d/99-adsys*"}},
+				{Name: "apparmor", Root: filepath.Join(root, "apparmor.d"), Patterns: []string{"*"}},
+			}, opts...)
+
+			records := max(tc.records, 1)
+			for i := 1; i <= records; i++ {
+				if i > 1 && tc.changeBetween != nil {
+					tc.changeBetween(t, root)
+				}
+				err := m.Record(context.Background(), fmt.Sprintf("Record %d", i))
+				if tc.wantErr {
+					require.Error(t, err, "Record should have failed but didn't")
+					return
+				}
+				require.NoError(t, err, "Record should not fail")
+			}
+
+			// #nosec G204 - this is only for tests, under controlled args
+			out, err := exec.Command("git", "-C", dir, "log", "--format=%s").Output()
+			require.NoError(t, err, "Setup: can't get history log")
+			require.Equal(t, tc.wantCommits, strings.Split(strings.TrimSpace(string(out)), "\n"), "Unexpected history commits")
+
+			// #nosec G204 - this is only for tests, under controlled args
+			out, err = exec.Command("git", "-C", dir, "ls-files").Output()
+			require.NoError(t, err, "Setup: can't list history files")
+			require.ElementsMatch(t, tc.wantFiles, strings.Fields(string(out)), "Unexpected files in history")
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package ini
+
+import (
+	"strings"
+)
+
+// editor edits the properties of an INI file line by line, preserving its comments and formatting.
+// Sections and properties are case insensitive, like on Windows. The global section, before any
+// section header, is the empty section.
+//
+// In TOML mode, tables and keys are case sensitive, new properties are written with spaces around
+// the equal sign and values can span multiple lines.
+type editor struct {
+	lines []string
+	toml  bool
+}
+
+// newEditor returns an editor of the INI content d, or of the TOML content if toml is true.
+func newEditor(d []byte, toml bool) *editor {
+	s := strings.ReplaceAll(string(d), "\r\n", "\n")
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return &editor{toml: toml}
+	}
+	return &editor{lines: strings.Split(s, "\n"), toml: toml}
+}
+
+// equal returns true if the section or property names a and b are the same.
+func (e *editor) equal(a, b string) bool {
+	if e.toml {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
+
+// bytes returns the edited content, with a final new line.
+func (e *editor) bytes() []byte {
+	if len(e.lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(e.lines, "\n") + "\n")
+}
+
+// sectionName returns the name of the section if l is a section header.
+func sectionName(l string) (string, bool) {
+	l = strings.TrimSpace(l)
+	if !strings.HasPrefix(l, "[") || !strings.HasSuffix(l, "]") {
+		return "", false
+	}
+	return strings.TrimSpace(l[1 : len(l)-1]), true
+}
+
+// propertyName returns the name of the property if l is a property line.
+func propertyName(l string) (string, bool) {
+	l = strings.TrimSpace(l)
+	if l == "" || strings.HasPrefix(l, ";") || strings.HasPrefix(l, "#") {
+		return "", false
+	}
+	k, _, found := strings.Cut(l, "=")
+	if !found {
+		return "", false
+	}
+	return strings.TrimSpace(k), true
+}
+
+// sections returns the ranges of lines [start, end) of every occurrence of section, header included.
+func (e *editor) sections(section string) (ranges [][2]int) {
+	start := -1
+	if section == "" {
+		start = 0
+	}
+	for i := 0; i < len(e.lines); i++ {
+		name, ok := sectionName(e.lines[i])
+		if !ok {
+			// Lines of multi-line values can look like section headers.
+			if _, ok := propertyName(e.lines[i]); ok {
+				i = e.valueEnd(i) - 1
+			}
+			continue
+		}
+		if start >= 0 {
+			ranges = append(ranges, [2]int{start, i})
+			start = -1
+		}
+		if section != "" && e.equal(name, section) {
+			start = i
+		}
+	}
+	if start >= 0 {
+		ranges = append(ranges, [2]int{start, len(e.lines)})
+	}
+	return ranges
+}
+
+// find returns the index of the first line of property in section.
+func (e *editor) find(section, property string) (int, bool) {
+	for _, r := range e.sections(section) {
+		for i := r[0]; i < r[1]; i++ {
+			name, ok := propertyName(e.lines[i])
+			if !ok {
+				continue
+			}
+			if e.equal(name, property) {
+				return i, true
+			}
+			i = e.valueEnd(i) - 1
+		}
+	}
+	return 0, false
+}
+
+// get returns the value of property in section.
+func (e *editor) get(section, property string) (string, bool) {
+	i, ok := e.find(section, property)
+	if !ok {
+		return "", false
+	}
+	_, v, _ := strings.Cut(strings.Join(e.lines[i:e.valueEnd(i)], "\n"), "=")
+	return strings.TrimSpace(v), true
+}
+
+// valueEnd returns the index following the last line of the value of the property on line i.
+// Only TOML values, like arrays, inline tables and multi-line strings, can span multiple lines.
+func (e *editor) valueEnd(i int) int {
+	if !e.toml {
+		return i + 1
+	}
+
+	_, v, _ := strings.Cut(e.lines[i], "=")
+	var depth int
+	var quote string
+	for j := i; j < len(e.lines); j++ {
+		l := e.lines[j]
+		if j == i {
+			l = v
+		}
+		for k := 0; k < len(l); k++ {
+			rest := l[k:]
+			switch {
+			case quote != "":
+				if rest[0] == '\\' && quote[0] == '"' {
+					k++
+				} else if strings.HasPrefix(rest, quote) {
+					k += len(quote) - 1
+					quote = ""
+				}
+			case strings.HasPrefix(rest, `"""`), strings.HasPrefix(rest, "'''"):
+				quote = rest[:3]
+				k += 2
+			case rest[0] == '"', rest[0] == '\'':
+				quote = rest[:1]
+			case rest[0] == '#':
+				k = len(l)
+			case rest[0] == '[', rest[0] == '{':
+				depth++
+			case rest[0] == ']', rest[0] == '}':
+				depth--
+			}
+		}
+		// Only multi-line strings can span multiple lines.
+		if len(quote) == 1 {
+			quote = ""
+		}
+		if depth <= 0 && quote == "" {
+			return j + 1
+		}
+	}
+	return len(e.lines)
+}
+
+// set sets property to value in section, adding the section if needed.
+func (e *editor) set(section, property, value string) {
+	if i, ok := e.find(section, property); ok {
+		// Keep the key as written and the spacing around the equal sign.
+		k, v, _ := strings.Cut(e.lines[i], "=")
+		sep := "="
+		if strings.HasPrefix(v, " ") {
+			sep = "= "
+		}
+		// Multi-line values replace all the lines of the previous value.
+		lines := strings.Split(k+sep+value, "\n")
+		e.lines = append(e.lines[:i], append(lines, e.lines[e.valueEnd(i):]...)...)
+		return
+	}
+
+	sep := "="
+	if e.toml {
+		sep = " = "
+	}
+	lines := strings.Split(property+sep+value, "\n")
+	if ranges := e.sections(section); len(ranges) > 0 {
+		// Add the property after the last non empty line of the section.
+		r := ranges[0]
+		i := r[1]
+		for i > r[0] && strings.TrimSpace(e.lines[i-1]) == "" {
+			i--
+		}
+		e.lines = append(e.lines[:i], append(lines, e.lines[i:]...)...)
+		return
+	}
+
+	if section == "" {
+		// No global section yet: add the property at the top of the file.
+		e.lines = append(lines, e.lines...)
+		return
+	}
+	if len(e.lines) > 0 && strings.TrimSpace(e.lines[len(e.lines)-1]) != "" {
+		e.lines = append(e.lines, "")
+	}
+	e.lines = append(append(e.lines, "["+section+"]"), lines...)
+}
+
+// unset removes property from section.
+func (e *editor) unset(section, property string) {
+	for {
+		i, ok := e.find(section, property)
+		if !ok {
+			return
+		}
+		e.lines = append(e.lines[:i], e.lines[e.valueEnd(i):]...)
+	}
+}
+
+// deleteSection removes section, with its header and its properties.
+func (e *editor) deleteSection(section string) {
+	for {
+		ranges := e.sections(section)
+		if len(ranges) == 0 || ranges[0][0] == ranges[0][1] {
+			return
+		}
+		r := ranges[0]
+		e.lines = append(e.lines[:r[0]], e.lines[r[1]:]...)
+	}
+}
@@ -0,0 +1,679 @@
+// Package ini provides a manager that edits the properties of INI and TOML configuration files, for
+// software without any dedicated manager.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - ini/settings: properties to edit, one per line, of the form
+//     path=<path>[, section=<section>][, property=<name>][, action=<action>][, format=<format>], value=<value>
+//     where path is the absolute path of the file on the machine, or a Windows path declared in
+//     ini/mappings. The value is the last field and extends to the end of the line, so it can
+//     contain commas. The global section, before any section header, is used if no section is set.
+//     The format is ini, or toml for files with the .toml extension. It can be set for TOML files
+//     with another extension.
+//   - ini/mappings: Windows paths of INI files mapped onto Linux configuration files, one per line,
+//     of the form <windows path>=<linux path>. Windows paths are case insensitive.
+//
+// Items of the Group Policy Preferences "Ini Files" extension are converted to ini/settings when the
+// GPOs are parsed, keeping their Windows path: only the paths declared in ini/mappings are edited.
+//
+// The action follows the apply modes of the Group Policy Preferences items:
+//   - update, the default, and replace set the property to the value;
+//   - create only sets the property if it doesn't exist yet;
+//   - delete removes the property, or the whole section if no property is set.
+//
+// In TOML files, the section is the name of the table, like server.tls, and tables and keys are case
+// sensitive. Values which are not valid TOML values, like strings without quotes, are written as
+// TOML strings.
+//
+// Comments, formatting and other properties of the files are preserved. The original value of each
+// property set by adsys is saved in a state file, so that it is restored once the property is not
+// configured anymore. Files created by adsys are removed once they have no property left. Deleted
+// properties and sections are not restored.
+package ini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const stateFile = "state.json"
+
+// Apply modes of the settings.
+const (
+	actionCreate  = "create"
+	actionReplace = "replace"
+	actionUpdate  = "update"
+	actionDelete  = "delete"
+)
+
+// Formats of the edited files.
+const (
+	formatINI  = "ini"
+	formatTOML = "toml"
+)
+
+// setting is a property to edit in an INI file.
+type setting struct {
+	path     string
+	section  string
+	property string
+	value    string
+	action   string
+	format   string
+}
+
+// key identifies the property of the setting in its file.
+func (s setting) key() string {
+	if s.format == formatTOML {
+		return s.section + "\x00" + s.property
+	}
+	return strings.ToLower(s.section) + "\x00" + strings.ToLower(s.property)
+}
+
+// property is a property set by adsys, with its value before adsys changed it.
+type property struct {
+	Section  string `json:"section,omitempty"`
+	Property string `json:"property"`
+	// Original is the value of the property before it was set by adsys, if it existed.
+	Original *string `json:"original,omitempty"`
+}
+
+// fileState is the list of properties set by adsys in a file.
+type fileState struct {
+	// Created is true if the file was created by adsys.
+	Created bool `json:"created,omitempty"`
+	// Format is the format of the file, if it is not INI.
+	Format     string     `json:"format,omitempty"`
+	Properties []property `json:"properties"`
+}
+
+// state is the list of files edited by adsys.
+type state struct {
+	Files map[string]fileState `json:"files,omitempty"`
+}
+
+// Manager applies the ini policy on the machine.
+type Manager struct {
+	stateDir string
+	rootDir  string
+}
+
+type options struct {
+	stateDir string
+	rootDir  string
+}
+
+// Option reprents an optional function to change the ini manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithRootDir edits the files relative to p instead of the root of the filesystem.
+func WithRootDir(p string) func(*options) {
+	return func(a *options) {
+		a.rootDir = p
+	}
+}
+
+// New returns a new manager for the ini policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir: consts.DefaultStateDir,
+		rootDir:  "/",
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir: filepath.Join(args.stateDir, "ini"),
+		rootDir:  args.rootDir,
+	}
+}
+
+// ApplyPolicy edits the INI and TOML files from the list of entries, and restores the properties not configured anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply ini policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Ini policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying ini policy to %s", objectName)
+
+	settings, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to restore.
+	if len(settings) == 0 && len(prev.Files) == 0 {
+		return nil
+	}
+
+	byFile := make(map[string][]setting)
+	for _, s := range settings {
+		byFile[s.path] = append(byFile[s.path], s)
+	}
+	var paths []string
+	for p := range byFile {
+		paths = append(paths, p)
+	}
+	for p := range prev.Files {
+		if _, ok := byFile[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	next := state{Files: make(map[string]fileState)}
+	for i, p := range paths {
+		edited, err := m.edit(ctx, p, byFile[p], prev.Files[p])
+		if len(edited.Properties) > 0 {
+			next.Files[p] = edited
+		}
+		if err != nil {
+			// Keep track of the properties set so far, so that they can still be restored.
+			for _, remaining := range paths[i+1:] {
+				if len(prev.Files[remaining].Properties) > 0 {
+					next.Files[remaining] = prev.Files[remaining]
+				}
+			}
+			return errors.Join(err, m.saveState(next))
+		}
+	}
+
+	return m.saveState(next)
+}
+
+// DumpState returns the keys edited in the configuration files during the last refresh of the machine.
+// The state is empty for users or if no ini policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump ini state of %s", objectName))
+
+	// Ini policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// edit applies settings to the file p, after restoring the properties of prev which are not configured anymore.
+// It returns the properties set by adsys in the file.
+func (m *Manager) edit(ctx context.Context, p string, settings []setting, prev fileState) (edited fileState, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't edit %s", p))
+
+	d, fi, err := m.read(p)
+	if err != nil {
+		// The properties previously set are still there.
+		return prev, err
+	}
+	exists := fi != nil
+
+	format := prev.Format
+	if len(settings) > 0 {
+		format = settings[0].format
+	}
+	e := newEditor(d, format == formatTOML)
+
+	configured := make(map[string]bool)
+	for _, s := range settings {
+		if s.action != actionDelete && s.property != "" {
+			configured[s.key()] = true
+		}
+	}
+
+	// Restore the properties not configured anymore.
+	var tracked []property
+	for _, prop := range prev.Properties {
+		if configured[setting{section: prop.Section, property: prop.Property, format: format}.key()] {
+			tracked = append(tracked, prop)
+			continue
+		}
+		if prop.Original == nil {
+			log.Infof(ctx, "Removing property %q of section %q in %s, not configured anymore", prop.Property, prop.Section, p)
+			e.unset(prop.Section, prop.Property)
+			continue
+		}
+		log.Infof(ctx, "Restoring property %q of section %q in %s, not configured anymore", prop.Property, prop.Section, p)
+		e.set(prop.Section, prop.Property, *prop.Original)
+	}
+
+	trackedIndex := func(s setting) int {
+		return slices.IndexFunc(tracked, func(prop property) bool {
+			return setting{section: prop.Section, property: prop.Property, format: format}.key() == s.key()
+		})
+	}
+
+	for _, s := range settings {
+		switch s.action {
+		case actionDelete:
+			if i := trackedIndex(s); i >= 0 {
+				tracked = slices.Delete(tracked, i, i+1)
+			}
+			if s.property == "" {
+				log.Infof(ctx, "Deleting section %q in %s", s.section, p)
+				e.deleteSection(s.section)
+				// The properties set by adsys in this section are gone too.
+				tracked = slices.DeleteFunc(tracked, func(prop property) bool { return e.equal(prop.Section, s.section) })
+				continue
+			}
+			log.Infof(ctx, "Deleting property %q of section %q in %s", s.property, s.section, p)
+			e.unset(s.section, s.property)
+		case actionCreate:
+			if _, ok := e.get(s.section, s.property); ok {
+				log.Debugf(ctx, "Property %q of section %q already exists in %s, not creating it", s.property, s.section, p)
+				continue
+			}
+			fallthrough
+		default:
+			if trackedIndex(s) < 0 {
+				prop := property{Section: s.section, Property: s.property}
+				if v, ok := e.get(s.section, s.property); ok {
+					prop.Original = &v
+				}
+				tracked = append(tracked, prop)
+			}
+			log.Debugf(ctx, "Setting property %q of section %q in %s", s.property, s.section, p)
+			v := s.value
+			if format == formatTOML {
+				v = tomlValue(v)
+			}
+			e.set(s.section, s.property, v)
+		}
+	}
+
+	if !exists && len(e.lines) == 0 {
+		return fileState{}, nil
+	}
+
+	created := prev.Created || (!exists && len(tracked) > 0)
+	if created && len(tracked) == 0 && strings.TrimSpace(stripSections(e)) == "" {
+		log.Infof(ctx, "Removing %s, created by adsys and without any property anymore", p)
+		if err := os.Remove(m.path(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return prev, err
+		}
+		return fileState{}, nil
+	}
+
+	if content := e.bytes(); !exists || string(content) != string(d) {
+		if err := m.write(ctx, p, content, fi); err != nil {
+			return prev, err
+		}
+	}
+	if len(tracked) == 0 {
+		return fileState{}, nil
+	}
+	edited = fileState{Created: created, Properties: tracked}
+	if format != formatINI {
+		edited.Format = format
+	}
+	return edited, nil
+}
+
+// read returns the content of the file p and its information, which is nil if the file doesn't exist.
+func (m *Manager) read(p string) ([]byte, fs.FileInfo, error) {
+	fi, err := os.Lstat(m.path(p))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, nil, errors.New(gotext.Get("not a regular file"))
+	}
+	d, err := os.ReadFile(m.path(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, fi, nil
+}
+
+// write writes content to the file p, keeping the permissions and ownership of the existing file fi.
+func (m *Manager) write(ctx context.Context, p string, content []byte, fi fs.FileInfo) error {
+	dest := m.path(p)
+
+	mode, uid, gid := fs.FileMode(0644), 0, 0
+	if fi != nil {
+		mode = fi.Mode().Perm()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	}
+
+	log.Infof(ctx, "Updating %s", p)
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dest+".adsys.new", content, 0600); err != nil {
+		return err
+	}
+	if fi != nil && (uid != os.Getuid() || gid != os.Getgid()) {
+		if err := os.Chown(dest+".adsys.new", uid, gid); err != nil {
+			return errors.Join(err, os.Remove(dest+".adsys.new"))
+		}
+	}
+	if err := os.Chmod(dest+".adsys.new", mode); err != nil {
+		return errors.Join(err, os.Remove(dest+".adsys.new"))
+	}
+	return os.Rename(dest+".adsys.new", dest)
+}
+
+// stripSections returns the content of e without its section headers.
+func stripSections(e *editor) string {
+	var b strings.Builder
+	for _, l := range e.lines {
+		if _, ok := sectionName(l); ok {
+			continue
+		}
+		b.WriteString(l)
+	}
+	return b.String()
+}
+
+// path returns the path of p on the managed filesystem.
+func (m *Manager) path(p string) string {
+	return filepath.Join(m.rootDir, p)
+}
+
+// parseEntries validates the entries and returns the settings to apply, in order, with their Linux path.
+func parseEntries(ctx context.Context, entries []entry.Entry) (settings []setting, err error) {
+	mappings := make(map[string]string)
+	var lines []string
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "ini/mappings":
+			for _, l := range strings.Split(v, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" {
+					continue
+				}
+				win, linux, err := parseMapping(l)
+				if err != nil {
+					return nil, err
+				}
+				mappings[win] = linux
+			}
+		case "ini/settings":
+			lines = append(lines, strings.Split(v, "\n")...)
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing ini entries, skipping it", e.Key))
+		}
+	}
+
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		s, err := parseSetting(l)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(s.path, "/") {
+			linux, ok := mappings[normalizeWindowsPath(s.path)]
+			if !ok {
+				log.Warning(ctx, gotext.Get("INI file %q is not mapped to a Linux path, skipping it", s.path))
+				continue
+			}
+			s.path = linux
+		}
+		if err := validateFormat(&s); err != nil {
+			return nil, err
+		}
+		if i := slices.IndexFunc(settings, func(o setting) bool { return o.path == s.path && o.format != s.format }); i >= 0 {
+			return nil, errors.New(gotext.Get("%s can't be edited both as %s and %s", s.path, settings[i].format, s.format))
+		}
+		// Settings from the closest GPO are listed last: they override the ones from further GPOs.
+		if i := slices.IndexFunc(settings, func(o setting) bool { return o.path == s.path && o.key() == s.key() }); i >= 0 {
+			settings = slices.Delete(settings, i, i+1)
+		}
+		settings = append(settings, s)
+	}
+
+	return settings, nil
+}
+
+// parseMapping parses a mapping line of the form <windows path>=<linux path>.
+func parseMapping(l string) (win, linux string, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid mapping %q", l))
+
+	win, linux, found := strings.Cut(l, "=")
+	win, linux = strings.TrimSpace(win), strings.TrimSpace(linux)
+	if !found || win == "" || linux == "" {
+		return "", "", errors.New(gotext.Get("expected <windows path>=<linux path>"))
+	}
+	if !filepath.IsAbs(linux) || filepath.Clean(linux) != linux || linux == "/" {
+		return "", "", errors.New(gotext.Get("linux path %q must be an absolute file path", linux))
+	}
+	return normalizeWindowsPath(win), linux, nil
+}
+
+// normalizeWindowsPath returns p in lower case, with backslashes as separators.
+func normalizeWindowsPath(p string) string {
+	return strings.ToLower(strings.ReplaceAll(p, "/", `\`))
+}
+
+// parseSetting parses a setting line of the form
+// path=<path>[, section=<section>][, property=<name>][, action=<action>][, format=<format>], value=<value>.
+// The value extends to the end of the line.
+func parseSetting(l string) (s setting, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid setting %q", l))
+
+	usage := gotext.Get("expected path=<path>[, section=<section>][, property=<name>][, action=<action>][, format=<format>], value=<value>")
+	var hasValue bool
+	rest := l
+	for rest != "" {
+		field := rest
+		if k, v, found := strings.Cut(rest, "="); found && strings.ToLower(strings.TrimSpace(k)) == "value" {
+			s.value, hasValue = strings.TrimSpace(v), true
+			break
+		}
+		field, rest, _ = strings.Cut(rest, ",")
+
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return s, errors.New(usage)
+		}
+
+		var dest *string
+		switch k {
+		case "path":
+			dest = &s.path
+		case "section":
+			dest = &s.section
+		case "property":
+			dest = &s.property
+		case "action":
+			dest = &s.action
+		case "format":
+			dest = &s.format
+		default:
+			return s, errors.New(gotext.Get("unsupported field %q", k))
+		}
+		if *dest != "" {
+			return s, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		*dest = v
+	}
+
+	if s.path == "" {
+		return s, errors.New(usage)
+	}
+	if strings.HasPrefix(s.path, "/") && (filepath.Clean(s.path) != s.path || s.path == "/") {
+		return s, errors.New(gotext.Get("path %q must be an absolute file path", s.path))
+	}
+	if strings.ContainsAny(s.section, "[]") {
+		return s, errors.New(gotext.Get("section %q can't contain brackets", s.section))
+	}
+
+	switch s.action = strings.ToLower(s.action); s.action {
+	case "":
+		s.action = actionUpdate
+		fallthrough
+	case actionCreate, actionReplace, actionUpdate:
+		if s.property == "" || !hasValue {
+			return s, errors.New(gotext.Get("property and value are required to %s a property", s.action))
+		}
+	case actionDelete:
+		if s.property == "" && s.section == "" {
+			return s, errors.New(gotext.Get("section or property is required to delete"))
+		}
+	default:
+		return s, errors.New(gotext.Get("action %q must be one of create, replace, update or delete", s.action))
+	}
+	if strings.ContainsAny(s.property, "=[") || strings.HasPrefix(s.property, ";") || strings.HasPrefix(s.property, "#") {
+		return s, errors.New(gotext.Get("invalid property name %q", s.property))
+	}
+
+	switch s.format = strings.ToLower(s.format); s.format {
+	case "", formatINI, formatTOML:
+	default:
+		return s, errors.New(gotext.Get("format %q must be one of ini or toml", s.format))
+	}
+
+	return s, nil
+}
+
+// tomlBareKey matches TOML bare and dotted keys.
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// validateFormat sets the format of s from the extension of its Linux path if it is not set, and
+// checks that its section and property are valid TOML keys for TOML files.
+func validateFormat(s *setting) (err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid setting for %s", s.path))
+
+	if s.format == "" {
+		s.format = formatINI
+		if strings.EqualFold(filepath.Ext(s.path), ".toml") {
+			s.format = formatTOML
+		}
+	}
+	if s.format != formatTOML {
+		return nil
+	}
+
+	if s.section != "" && !tomlBareKey.MatchString(s.section) {
+		return errors.New(gotext.Get("invalid TOML table name %q", s.section))
+	}
+	if s.property != "" && !tomlBareKey.MatchString(s.property) {
+		return errors.New(gotext.Get("invalid TOML key %q", s.property))
+	}
+	return nil
+}
+
+var (
+	tomlNumber   = regexp.MustCompile(`^([+-]?(\d[\d_]*(\.\d[\d_]*)?([eE][+-]?\d[\d_]*)?|inf|nan)|0x[0-9A-Fa-f_]+|0o[0-7_]+|0b[01_]+)$`)
+	tomlDateTime = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}:\d{2}\S*)?|\d{2}:\d{2}:\d{2}\S*)$`)
+)
+
+// tomlValue returns v if it is a TOML value, like a boolean, a number, a date, a quoted string, an
+// array or an inline table, or v as a TOML basic string otherwise.
+func tomlValue(v string) string {
+	if v == "true" || v == "false" || tomlNumber.MatchString(v) || tomlDateTime.MatchString(v) {
+		return v
+	}
+	if v != "" && strings.ContainsRune(`"'[{`, rune(v[0])) {
+		return v
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range v {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// loadState returns the properties previously set by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load ini state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the properties set by adsys.
+// The state file is removed if no property is set anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save ini state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Files) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,129 @@
+package ini_test
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/ini"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	mappings := `%ProgramFiles%\App\app.ini=/etc/app/app.conf`
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existing      string
+		existingMode  fs.FileMode
+
+		wantMode fs.FileMode
+		wantErr  bool
+	}{
+		"Update existing property":                     {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Network, property=Proxy, value=http://proxy.example.com:3128"}}},
+		"Replace existing property":                    {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Network, property=Port, action=replace, value=3128"}}},
+		"Update global property":                       {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, value=true"}}},
+		"Add missing property to section":              {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Network, property=Timeout, value=30"}}},
+		"Add missing section":                          {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Security, property=tls, value=required"}}},
+		"Create keeps existing property":               {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Display, property=theme, action=create, value=dark"}}},
+		"Create adds missing property":                 {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Display, property=scale, action=create, value=2"}}},
+		"Delete property":                              {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Network, property=port, action=delete"}}},
+		"Delete section":                               {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=network, action=delete"}}},
+		"Delete missing property is a no-op":           {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Network, property=Timeout, action=delete"}}},
+		"Sections and properties are case insensitive": {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=NETWORK, property=proxy, value=direct"}}},
+		"Create missing file":                          {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Main, property=enabled, value=true"}}, wantMode: 0644},
+		"Keep file permissions":                        {existing: "states/existing", existingMode: 0600, entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, value=true"}}, wantMode: 0600},
+		"Mapped Windows path":                          {existing: "states/existing", entries: []entry.Entry{{Key: "ini/mappings", Value: mappings}, {Key: "ini/settings", Value: `path=%ProgramFiles%\App\app.ini, section=Network, property=Proxy, value=direct`}}},
+		"Mapped Windows path is case insensitive":      {existing: "states/existing", entries: []entry.Entry{{Key: "ini/mappings", Value: mappings}, {Key: "ini/settings", Value: `path=%PROGRAMFILES%/app/APP.INI, section=Network, property=Proxy, value=direct`}}},
+		"Unmapped Windows path is skipped":             {existing: "states/existing", entries: []entry.Entry{{Key: "ini/mappings", Value: mappings}, {Key: "ini/settings", Value: `path=C:\Windows\win.ini, section=Network, property=Proxy, value=direct`}}},
+		"Value can contain commas and equal signs":     {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Display, property=font, value=Ubuntu, Sans=12"}}},
+		"Value can be empty":                           {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Display, property=theme, value="}}},
+		"Fields are case insensitive and unordered":    {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: " Property = Proxy , ACTION = Update , Section = Network , PATH = /etc/app/app.conf , Value = direct "}}},
+		"Empty lines are ignored":                      {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "\npath=/etc/app/app.conf, property=debug, value=true\n\n"}}},
+		"Closest GPO overrides the same property":      {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Network, property=Proxy, value=far"}, {Key: "ini/settings", Value: "path=/etc/app/app.conf, section=network, property=proxy, value=close"}}},
+		"Changed properties keep their original value": {existing: "states/edited", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Network, property=Proxy, value=direct\npath=/etc/app/created.ini, section=Main, property=enabled, value=false"}}},
+		"No entries restores properties":               {existing: "states/edited"},
+		"Delete property set by adsys":                 {existing: "states/edited", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, action=delete"}}},
+		"Disabled entries are ignored":                 {existing: "states/existing", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, value=true", Disabled: true}}},
+		"Unsupported keys are ignored":                 {existing: "states/existing", entries: []entry.Entry{{Key: "ini/unsupported", Value: "something"}, {Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, value=true"}}},
+		"User objects are skipped":                     {existing: "states/existing", isNotComputer: true, entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, value=true"}}},
+		"No entries is a no-op":                        {existing: "states/existing"},
+
+		// TOML files
+		"TOML: Update existing property":                     {existing: "states/toml", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, section=server, property=host, value=proxy.example.com"}}},
+		"TOML: Typed values are kept as is":                  {existing: "states/toml", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, section=server, property=port, value=8443\npath=/etc/app/app.toml, section=server.tls, property=enabled, value=true\npath=/etc/app/app.toml, property=title, value='My App'"}}},
+		"TOML: Strings are quoted and escaped":               {existing: "states/toml", entries: []entry.Entry{{Key: "ini/settings", Value: `path=/etc/app/app.toml, property=title, value=The "C:\App" app`}}},
+		"TOML: Add missing property to table":                {existing: "states/toml", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, section=server.tls, property=cert, value=/etc/ssl/app.pem"}}},
+		"TOML: Add missing table":                            {existing: "states/toml", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, section=client, property=timeout, value=30"}}},
+		"TOML: Replace multi-line value":                     {existing: "states/toml", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, section=server, property=ports, value=[443]"}}},
+		"TOML: Delete multi-line value":                      {existing: "states/toml", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, section=server, property=ports, action=delete"}}},
+		"TOML: Tables and keys are case sensitive":           {existing: "states/toml", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, section=Server, property=Host, value=proxy.example.com"}}},
+		"TOML: Format can be set for other extensions":       {existing: "states/toml", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/registries.conf, section=registries.search, property=registries, format=TOML, value=[\"registry.example.com\"]"}}},
+		"TOML: No entries restores properties":               {existing: "states/toml-edited"},
+		"TOML: Changed properties keep their original value": {existing: "states/toml-edited", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, section=server, property=ports, value=[8443]"}}},
+
+		// Error cases
+		"Error on missing path":                        {entries: []entry.Entry{{Key: "ini/settings", Value: "section=Network, property=Proxy, value=direct"}}, wantErr: true},
+		"Error on missing property":                    {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Network, value=direct"}}, wantErr: true},
+		"Error on missing value":                       {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=Network, property=Proxy"}}, wantErr: true},
+		"Error on delete without section nor property": {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, action=delete"}}, wantErr: true},
+		"Error on unsupported action":                  {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, action=append, value=true"}}, wantErr: true},
+		"Error on unsupported field":                   {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, comment=yes, value=true"}}, wantErr: true},
+		"Error on field set twice":                     {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, path=/etc/other.conf, property=debug, value=true"}}, wantErr: true},
+		"Error on non clean path":                      {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/../app.conf, property=debug, value=true"}}, wantErr: true},
+		"Error on invalid property name":               {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=[debug, value=true"}}, wantErr: true},
+		"Error on invalid section name":                {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, section=[Network], property=debug, value=true"}}, wantErr: true},
+		"Error on mapping without Linux path":          {entries: []entry.Entry{{Key: "ini/mappings", Value: `C:\app.ini`}}, wantErr: true},
+		"Error on mapping to relative Linux path":      {entries: []entry.Entry{{Key: "ini/mappings", Value: `C:\app.ini=etc/app.conf`}}, wantErr: true},
+		"Error on corrupted state":                     {existing: "states/corrupted", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, value=true"}}, wantErr: true},
+		"Error on unsupported format":                  {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, format=yaml, value=true"}}, wantErr: true},
+		"Error on invalid TOML key":                    {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, property=log level, value=debug"}}, wantErr: true},
+		"Error on invalid TOML table name":             {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.toml, section=server..tls, property=enabled, value=true"}}, wantErr: true},
+		"Error on file edited with different formats":  {entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app/app.conf, property=debug, value=true\npath=/etc/app/app.conf, property=port, format=toml, value=8080"}}, wantErr: true},
+		"Error on file being a directory":              {existing: "states/directory", entries: []entry.Entry{{Key: "ini/settings", Value: "path=/etc/app.conf, property=debug, value=true"}}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.existingMode != 0 {
+				require.NoError(t, os.Chmod(filepath.Join(root, "fs", "etc", "app", "app.conf"), tc.existingMode), "Setup: can't change file mode")
+			}
+
+			m := ini.New(
+				ini.WithStateDir(filepath.Join(root, "state")),
+				ini.WithRootDir(filepath.Join(root, "fs")),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			if tc.wantMode != 0 {
+				fi, err := os.Stat(filepath.Join(root, "fs", "etc", "app", "app.conf"))
+				require.NoError(t, err, "Edited file should exist")
+				require.Equal(t, tc.wantMode, fi.Mode().Perm(), "Edited file should have the expected mode")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
@@ -0,0 +1,217 @@
+// Package kmod provides a manager that prevents kernel modules from being loaded on the machine.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - kmod/blacklist: kernel modules, one per line, which are not loaded automatically when a matching device
+//     is detected. They can still be loaded explicitly or as a dependency of another module;
+//   - kmod/disable: kernel modules, one per line, which can't be loaded at all.
+//
+// Empty lines and lines starting with # are ignored. As with modprobe, dashes and underscores are equivalent in
+// module names. A module listed in both settings is disabled.
+//
+// The modules are written to a modprobe.d configuration file, which is removed once the policy is not configured
+// anymore. The modules already loaded are not unloaded: they are only blocked once unloaded or on next boot.
+package kmod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const configFile = "adsys.conf"
+
+// disableCmd is the install command replacing the loading of the disabled modules.
+const disableCmd = "/bin/false"
+
+// moduleRe matches a kernel module name.
+var moduleRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// module is a kernel module blocked by the policy.
+type module struct {
+	name     string
+	disabled bool
+}
+
+// Manager applies the kernel modules policy on the machine.
+type Manager struct {
+	modprobeDir  string
+	sysModuleDir string
+}
+
+type options struct {
+	modprobeDir  string
+	sysModuleDir string
+}
+
+// Option reprents an optional function to change the kmod manager.
+type Option func(*options)
+
+// WithModprobeDir overrides the default modprobe.d configuration directory.
+func WithModprobeDir(p string) func(*options) {
+	return func(a *options) {
+		a.modprobeDir = p
+	}
+}
+
+// WithSysModuleDir overrides the default directory listing the loaded kernel modules.
+func WithSysModuleDir(p string) func(*options) {
+	return func(a *options) {
+		a.sysModuleDir = p
+	}
+}
+
+// New returns a new manager for the kernel modules policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		modprobeDir:  consts.DefaultModprobeDir,
+		sysModuleDir: "/sys/module",
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		modprobeDir:  args.modprobeDir,
+		sysModuleDir: args.sysModuleDir,
+	}
+}
+
+// ApplyPolicy blocks the kernel modules from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply kernel modules policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Kernel modules policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying kernel modules policy to %s", objectName)
+
+	modules, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	changed, err := syshelpers.WriteConfig(filepath.Join(m.modprobeDir, configFile), modprobeConf(modules))
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	if len(modules) == 0 {
+		log.Info(ctx, "Kernel modules are not blocked anymore")
+		return nil
+	}
+
+	log.Infof(ctx, "Blocking %d kernel modules", len(modules))
+	for _, mod := range modules {
+		if m.isLoaded(mod.name) {
+			log.Warning(ctx, gotext.Get("Kernel module %q is currently loaded: it will only be blocked once unloaded or on next boot", mod.name))
+		}
+	}
+	return nil
+}
+
+// DumpState returns the modprobe configuration written during the last refresh of the machine.
+// The state is empty for users or if no kernel modules policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump kernel modules state of %s", objectName))
+
+	// Kernel modules policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.modprobeDir, configFile))
+}
+
+// parseEntries validates the entries and returns the modules to block, in order.
+func parseEntries(ctx context.Context, entries []entry.Entry) (modules []module, err error) {
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+
+		var disabled bool
+		switch e.Key {
+		case "kmod/blacklist":
+		case "kmod/disable":
+			disabled = true
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing kernel modules entries, skipping it", e.Key))
+			continue
+		}
+
+		for _, l := range strings.Split(e.Value, "\n") {
+			name := strings.TrimSpace(l)
+			if name == "" || strings.HasPrefix(name, "#") {
+				continue
+			}
+			if !moduleRe.MatchString(name) {
+				return nil, errors.New(gotext.Get("invalid kernel module name %q", name))
+			}
+
+			i := slices.IndexFunc(modules, func(mod module) bool { return normalize(mod.name) == normalize(name) })
+			if i == -1 {
+				modules = append(modules, module{name: name, disabled: disabled})
+				continue
+			}
+			// Disabling a module takes precedence over blacklisting it.
+			modules[i].disabled = modules[i].disabled || disabled
+		}
+	}
+
+	return modules, nil
+}
+
+// normalize returns the name of the module as known by the kernel, where dashes are replaced by underscores.
+func normalize(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// isLoaded returns true if the module name is currently loaded.
+func (m *Manager) isLoaded(name string) bool {
+	_, err := os.Stat(filepath.Join(m.sysModuleDir, normalize(name)))
+	return err == nil
+}
+
+// modprobeConf returns the modprobe configuration blocking the modules, or an empty string if there is none.
+func modprobeConf(modules []module) string {
+	if len(modules) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	out.WriteString(header)
+	out.WriteString("\n")
+	for _, mod := range modules {
+		fmt.Fprintf(&out, "blacklist %s\n", mod.name)
+		if mod.disabled {
+			fmt.Fprintf(&out, "install %s %s\n", mod.name, disableCmd)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,87 @@
+package kmod_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/kmod"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "kmod/blacklist", Value: "firewire-core\nthunderbolt"},
+		{Key: "kmod/disable", Value: "cramfs\nudf"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		makeReadOnly  bool
+
+		wantErr bool
+	}{
+		"All entries":                      {entries: allEntries},
+		"Blacklist only":                   {entries: []entry.Entry{{Key: "kmod/blacklist", Value: "firewire-core"}}},
+		"Disable only":                     {entries: []entry.Entry{{Key: "kmod/disable", Value: "udf"}}},
+		"Existing file is updated":         {existingDirs: "existing-conf", entries: allEntries},
+		"Existing file is unchanged":       {existingDirs: "existing-conf", entries: []entry.Entry{{Key: "kmod/blacklist", Value: "firewire-core"}}},
+		"No entries removes existing file": {existingDirs: "existing-conf"},
+		"Loaded modules are still blocked": {existingDirs: "loaded-modules", entries: allEntries},
+
+		"Disable takes precedence over blacklist": {entries: []entry.Entry{{Key: "kmod/disable", Value: "udf"}, {Key: "kmod/blacklist", Value: "udf\nfirewire-core"}}},
+		"Dashes and underscores are equivalent":   {entries: []entry.Entry{{Key: "kmod/blacklist", Value: "firewire-core\nfirewire_core"}, {Key: "kmod/disable", Value: "firewire_core"}}},
+		"Duplicated modules are written once":     {entries: []entry.Entry{{Key: "kmod/blacklist", Value: "udf\nudf"}, {Key: "kmod/blacklist", Value: "udf"}}},
+		"Empty lines and comments are ignored":    {entries: []entry.Entry{{Key: "kmod/blacklist", Value: "# storage\n\n  udf  \n"}}},
+		"Disabled entries are ignored":            {entries: []entry.Entry{{Key: "kmod/blacklist", Value: "udf"}, {Key: "kmod/disable", Value: "cramfs", Disabled: true}}},
+		"Unsupported keys are ignored":            {entries: []entry.Entry{{Key: "kmod/blacklist", Value: "udf"}, {Key: "kmod/unload", Value: "cramfs"}}},
+		"Only comments is a no-op":                {entries: []entry.Entry{{Key: "kmod/disable", Value: "# nothing to disable"}}},
+		"No entries and no existing files":        {},
+		"Not a computer is a no-op":               {isNotComputer: true, existingDirs: "existing-conf"},
+
+		// Error cases
+		"Error on invalid module name":                {entries: []entry.Entry{{Key: "kmod/disable", Value: "udf\nbad module"}}, wantErr: true},
+		"Error on module name with a path":            {entries: []entry.Entry{{Key: "kmod/blacklist", Value: "../udf"}}, wantErr: true},
+		"Error on unwritable configuration directory": {existingDirs: "existing-conf", makeReadOnly: true, entries: allEntries, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			modprobeDir := filepath.Join(root, "etc", "modprobe.d")
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.makeReadOnly {
+				testutils.MakeReadOnly(t, modprobeDir)
+			}
+
+			m := kmod.New(
+				kmod.WithModprobeDir(modprobeDir),
+				kmod.WithSysModuleDir(filepath.Join(root, "sys", "module")),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package locale
+
+// WithAccountsService defines a custom AccountsService for tests.
+func WithAccountsService(a accountsService) Option {
+	return func(o *options) {
+		o.accountsService = a
+	}
+}
+
+// WithUserGroups defines a custom lookup of the groups of the users for tests.
+func WithUserGroups(f func(string) ([]string, error)) Option {
+	return func(o *options) {
+		o.userGroups = f
+	}
+}
+
+// UserLocale is the language and the formats locale of a user, for tests.
+type UserLocale = userLocale
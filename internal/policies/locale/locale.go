@@ -0,0 +1,465 @@
+// Package locale provides a manager that sets the system locale, timezone and keyboard layout of the machine,
+// and the language and formats of the users.
+//
+// The following settings are supported for computer objects:
+//   - locale/language: the system locale, like fr_FR.UTF-8, set as the LANG variable. The other locale
+//     variables of the system, like LC_TIME, are kept;
+//   - locale/timezone: the timezone of the system, like Europe/Paris;
+//   - locale/keyboard-layout: the default keyboard layout, like fr, or a comma separated list of layouts;
+//   - locale/keyboard-variant: the variant of the keyboard layout, like oss. It is only applied along with
+//     a layout.
+//
+// The settings are applied through the D-Bus APIs of systemd-localed and systemd-timedated. If any of them is not
+// available, the corresponding settings are skipped with a warning. The keyboard
+// layout is set for the X11 and Wayland sessions, and converted to the closest console keymap.
+//
+// The value of each setting before adsys first changed it is saved in a state file, and restored once the
+// setting is not configured anymore.
+//
+// For user objects, the following settings are supported:
+//   - locale/user-language: the language of the user, like fr_FR.UTF-8;
+//   - locale/user-formats: the locale used for the dates, numbers and currencies of the user, like de_DE.UTF-8;
+//   - locale/user-groups: the language, and optionally the formats, of the members of some groups, one
+//     <group>=<language>[,<formats>] per line. The first listed group the user is a member of takes precedence
+//     over the default language and formats.
+//
+// They are set through AccountsService, which the display manager uses to start the sessions of the user. The
+// locale last set by adsys for each user is saved in a state file: if the user chose another language or
+// formats since then, their choice is kept.
+package locale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const stateFile = "state.json"
+
+// Caller is the interface to call methods and get properties of a D-Bus object.
+type Caller interface {
+	Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call
+	GetProperty(p string) (dbus.Variant, error)
+}
+
+// errDBusServiceUnknownName is the error name returned by D-Bus when systemd-localed, systemd-timedated or
+// AccountsService is not found.
+const errDBusServiceUnknownName = "org.freedesktop.DBus.Error.ServiceUnknown"
+
+const (
+	localedInterface   = "org.freedesktop.locale1"
+	timedatedInterface = "org.freedesktop.timedate1"
+)
+
+var (
+	// languageRe matches a locale name, like fr_FR.UTF-8 or sr_RS@latin.
+	languageRe = regexp.MustCompile(`^([a-z]{2,3}(_[A-Z]{2})?(\.[A-Za-z0-9-]+)?(@[a-z]+)?|C(\.[A-Za-z0-9-]+)?|POSIX)$`)
+	// timezoneRe matches a timezone name, like Europe/Paris or Etc/GMT+2.
+	timezoneRe = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+	// keyboardRe matches a comma separated list of keyboard layouts or variants. Variants can be empty.
+	keyboardRe = regexp.MustCompile(`^[a-z0-9_-]*(,[a-z0-9_-]*)*$`)
+)
+
+// settings are the locale settings requested by the policy.
+type settings struct {
+	language string
+	timezone string
+	layout   string
+	variant  string
+}
+
+// keyboard is the X11 keyboard configuration of the system.
+type keyboard struct {
+	Layout  string `json:"layout"`
+	Variant string `json:"variant"`
+}
+
+// state is the value of each setting before adsys first changed it. A nil value means the setting was not changed.
+type state struct {
+	Locale   *[]string `json:"locale,omitempty"`
+	Timezone *string   `json:"timezone,omitempty"`
+	Keyboard *keyboard `json:"keyboard,omitempty"`
+}
+
+// Manager applies the locale policy on the machine.
+type Manager struct {
+	stateDir  string
+	localed   Caller
+	timedated Caller
+
+	accountsService accountsService
+	userGroups      func(string) ([]string, error)
+}
+
+type options struct {
+	stateDir        string
+	localed         Caller
+	timedated       Caller
+	accountsService accountsService
+	userGroups      func(string) ([]string, error)
+}
+
+// Option reprents an optional function to change the locale manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithLocaled overrides the default systemd-localed D-Bus object.
+func WithLocaled(c Caller) func(*options) {
+	return func(a *options) {
+		a.localed = c
+	}
+}
+
+// WithTimedated overrides the default systemd-timedated D-Bus object.
+func WithTimedated(c Caller) func(*options) {
+	return func(a *options) {
+		a.timedated = c
+	}
+}
+
+// New returns a new manager for the locale policy.
+func New(bus *dbus.Conn, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:  consts.DefaultStateDir,
+		localed:   bus.Object("org.freedesktop.locale1", "/org/freedesktop/locale1"),
+		timedated: bus.Object("org.freedesktop.timedate1", "/org/freedesktop/timedate1"),
+
+		accountsService: dbusAccountsService{bus: bus},
+		userGroups:      userGroups,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:  filepath.Join(args.stateDir, "locale"),
+		localed:   args.localed,
+		timedated: args.timedated,
+
+		accountsService: args.accountsService,
+		userGroups:      args.userGroups,
+	}
+}
+
+// ApplyPolicy sets the locale, timezone and keyboard layout from the list of entries, and restores the settings
+// not configured anymore.
+// For users, it sets their language and formats instead.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply locale policy to %s", objectName))
+
+	if !isComputer {
+		return m.applyUserLocale(ctx, objectName, entries)
+	}
+
+	log.Debugf(ctx, "Applying locale policy to %s", objectName)
+
+	s, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	st, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to restore.
+	if s == (settings{}) && st == (state{}) {
+		return nil
+	}
+
+	// Save the state after each setting, so that the original values can always be restored.
+	for _, apply := range []func(context.Context, settings, *state) error{m.applyLanguage, m.applyTimezone, m.applyKeyboard} {
+		if err := apply(ctx, s, &st); err != nil {
+			var dbusErr dbus.Error
+			if errors.As(err, &dbusErr) && dbusErr.Name == errDBusServiceUnknownName {
+				log.Warning(ctx, gotext.Get("Not applying locale setting as the systemd service is not available: %s", dbusErr.Error()))
+				continue
+			}
+			return errors.Join(err, m.saveState(st))
+		}
+		if err := m.saveState(st); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DumpState returns the settings of the machine saved before the locale policy first changed them, or the
+// language and formats locale set for a user during their last refresh.
+// The state is empty if no locale policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump locale state of %s", objectName))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if !isComputer {
+		p = filepath.Join(m.stateDir, usersStateDir, objectName)
+	}
+	return syshelpers.DumpFiles(p)
+}
+
+// parseEntries validates the entries and returns the requested settings.
+func parseEntries(ctx context.Context, entries []entry.Entry) (s settings, err error) {
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "locale/language":
+			if !languageRe.MatchString(v) {
+				return s, errors.New(gotext.Get("invalid locale %q: expected a locale name like fr_FR.UTF-8", v))
+			}
+			s.language = v
+		case "locale/timezone":
+			if !timezoneRe.MatchString(v) || slices.Contains(strings.Split(v, "/"), "..") {
+				return s, errors.New(gotext.Get("invalid timezone %q: expected a timezone name like Europe/Paris", v))
+			}
+			s.timezone = v
+		case "locale/keyboard-layout":
+			v = strings.ReplaceAll(v, " ", "")
+			if !keyboardRe.MatchString(v) {
+				return s, errors.New(gotext.Get("invalid keyboard layout %q: expected a layout name like fr, or a comma separated list of layouts", v))
+			}
+			s.layout = v
+		case "locale/keyboard-variant":
+			v = strings.ReplaceAll(v, " ", "")
+			if !keyboardRe.MatchString(v) {
+				return s, errors.New(gotext.Get("invalid keyboard variant %q: expected a variant name like oss", v))
+			}
+			s.variant = v
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing locale entries, skipping it", e.Key))
+		}
+	}
+
+	if s.layout == "" && s.variant != "" {
+		log.Warning(ctx, gotext.Get("Keyboard variant %q is ignored as no keyboard layout is configured", s.variant))
+		s.variant = ""
+	}
+
+	return s, nil
+}
+
+// applyLanguage sets the LANG variable of the system locale, or restores the original locale.
+func (m *Manager) applyLanguage(ctx context.Context, s settings, st *state) error {
+	if s.language == "" {
+		if st.Locale == nil {
+			return nil
+		}
+		log.Infof(ctx, "Restoring system locale, not configured anymore")
+		if err := m.setLocale(*st.Locale); err != nil {
+			return err
+		}
+		st.Locale = nil
+		return nil
+	}
+
+	current, err := m.locale()
+	if err != nil {
+		return err
+	}
+	if st.Locale == nil {
+		st.Locale = &current
+	}
+
+	// Only replace LANG, keeping the other variables set on the system.
+	want := slices.DeleteFunc(slices.Clone(current), func(v string) bool { return strings.HasPrefix(v, "LANG=") })
+	want = append([]string{"LANG=" + s.language}, want...)
+	if slices.Equal(current, want) {
+		return nil
+	}
+
+	log.Infof(ctx, "Setting system locale to %s", s.language)
+	return m.setLocale(want)
+}
+
+// applyTimezone sets the timezone of the system, or restores the original timezone.
+func (m *Manager) applyTimezone(ctx context.Context, s settings, st *state) error {
+	if s.timezone == "" {
+		if st.Timezone == nil {
+			return nil
+		}
+		log.Infof(ctx, "Restoring timezone %s, not configured anymore", *st.Timezone)
+		if err := m.setTimezone(*st.Timezone); err != nil {
+			return err
+		}
+		st.Timezone = nil
+		return nil
+	}
+
+	current, err := stringProperty(m.timedated, timedatedInterface+".Timezone")
+	if err != nil {
+		return err
+	}
+	if st.Timezone == nil {
+		st.Timezone = &current
+	}
+	if current == s.timezone {
+		return nil
+	}
+
+	log.Infof(ctx, "Setting timezone to %s", s.timezone)
+	return m.setTimezone(s.timezone)
+}
+
+// applyKeyboard sets the keyboard layout of the system, or restores the original layout.
+func (m *Manager) applyKeyboard(ctx context.Context, s settings, st *state) error {
+	if s.layout == "" {
+		if st.Keyboard == nil {
+			return nil
+		}
+		log.Infof(ctx, "Restoring keyboard layout %q, not configured anymore", st.Keyboard.Layout)
+		if err := m.setKeyboard(*st.Keyboard); err != nil {
+			return err
+		}
+		st.Keyboard = nil
+		return nil
+	}
+
+	var current keyboard
+	var err error
+	if current.Layout, err = stringProperty(m.localed, localedInterface+".X11Layout"); err != nil {
+		return err
+	}
+	if current.Variant, err = stringProperty(m.localed, localedInterface+".X11Variant"); err != nil {
+		return err
+	}
+	if st.Keyboard == nil {
+		st.Keyboard = &current
+	}
+
+	want := keyboard{Layout: s.layout, Variant: s.variant}
+	if current == want {
+		return nil
+	}
+
+	log.Infof(ctx, "Setting keyboard layout to %q", s.layout)
+	return m.setKeyboard(want)
+}
+
+// locale returns the locale variables of the system.
+func (m *Manager) locale() ([]string, error) {
+	v, err := m.localed.GetProperty(localedInterface + ".Locale")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", gotext.Get("can't get system locale"), err)
+	}
+	l, ok := v.Value().([]string)
+	if !ok {
+		return nil, errors.New(gotext.Get("unexpected system locale %v", v.Value()))
+	}
+	return l, nil
+}
+
+// setLocale sets the locale variables of the system.
+func (m *Manager) setLocale(l []string) error {
+	if err := m.localed.Call(localedInterface+".SetLocale", 0, l, false).Err; err != nil {
+		return fmt.Errorf("%s: %w", gotext.Get("can't set system locale"), err)
+	}
+	return nil
+}
+
+// setTimezone sets the timezone of the system.
+func (m *Manager) setTimezone(tz string) error {
+	if err := m.timedated.Call(timedatedInterface+".SetTimezone", 0, tz, false).Err; err != nil {
+		return fmt.Errorf("%s: %w", gotext.Get("can't set timezone to %s", tz), err)
+	}
+	return nil
+}
+
+// setKeyboard sets the X11 keyboard layout of the system, keeping its model and options, and converts it to the
+// console keymap.
+func (m *Manager) setKeyboard(k keyboard) error {
+	model, err := stringProperty(m.localed, localedInterface+".X11Model")
+	if err != nil {
+		return err
+	}
+	options, err := stringProperty(m.localed, localedInterface+".X11Options")
+	if err != nil {
+		return err
+	}
+	if err := m.localed.Call(localedInterface+".SetX11Keyboard", 0, k.Layout, model, k.Variant, options, true, false).Err; err != nil {
+		return fmt.Errorf("%s: %w", gotext.Get("can't set keyboard layout to %q", k.Layout), err)
+	}
+	return nil
+}
+
+// stringProperty returns the string property p of the D-Bus object c.
+func stringProperty(c Caller, p string) (string, error) {
+	v, err := c.GetProperty(p)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", gotext.Get("can't get %s", p), err)
+	}
+	s, ok := v.Value().(string)
+	if !ok {
+		return "", errors.New(gotext.Get("unexpected value for %s: %v", p, v.Value()))
+	}
+	return s, nil
+}
+
+// loadState returns the original values of the settings changed by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load locale state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the original values of the settings changed by adsys.
+// The state file is removed if no setting is changed anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save locale state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if s == (state{}) {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
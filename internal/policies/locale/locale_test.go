@@ -0,0 +1,331 @@
+package locale_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/locale"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Cleanup(testutils.StartLocalSystemBus())
+	t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+
+	allEntries := []entry.Entry{
+		{Key: "locale/language", Value: "fr_FR.UTF-8"},
+		{Key: "locale/timezone", Value: "Europe/Paris"},
+		{Key: "locale/keyboard-layout", Value: "fr"},
+		{Key: "locale/keyboard-variant", Value: "oss"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existing      string
+
+		noLocaled         bool
+		noTimedated       bool
+		callError         bool
+		getPropertyError  bool
+		unexpectedLocale  bool
+		alreadyConfigured bool
+
+		wantErr bool
+	}{
+		"Set all settings":                         {entries: allEntries},
+		"Set only the timezone":                    {entries: []entry.Entry{{Key: "locale/timezone", Value: "America/Argentina/Buenos_Aires"}}},
+		"Set a language without territory":         {entries: []entry.Entry{{Key: "locale/language", Value: "C.UTF-8"}}},
+		"Set multiple keyboard layouts":            {entries: []entry.Entry{{Key: "locale/keyboard-layout", Value: "us, fr"}, {Key: "locale/keyboard-variant", Value: ",oss"}}},
+		"Keyboard variant without layout ignored":  {entries: []entry.Entry{{Key: "locale/keyboard-variant", Value: "oss"}}},
+		"Settings already set are not changed":     {entries: allEntries, alreadyConfigured: true},
+		"Original settings are kept when updating": {existing: "states/applied", entries: allEntries},
+		"Settings not configured are restored":     {existing: "states/applied", entries: []entry.Entry{{Key: "locale/timezone", Value: "Europe/Paris"}}},
+		"No entries restores all settings":         {existing: "states/applied"},
+		"Disabled entries restore all settings":    {existing: "states/applied", entries: []entry.Entry{{Key: "locale/timezone", Value: "Europe/Paris", Disabled: true}}},
+		"Empty entries restore settings":           {existing: "states/applied", entries: []entry.Entry{{Key: "locale/language", Value: "fr_FR.UTF-8"}, {Key: "locale/timezone", Value: " "}}},
+		"Unsupported keys are ignored":             {entries: []entry.Entry{{Key: "locale/timezone", Value: "Europe/Paris"}, {Key: "locale/currency", Value: "EUR"}}},
+		"Missing localed skips its settings":       {entries: allEntries, noLocaled: true},
+		"Missing timedated skips its settings":     {entries: allEntries, noTimedated: true},
+		"No entries and no state is a no-op":       {},
+		"Not a computer is a no-op":                {existing: "states/applied", isNotComputer: true},
+
+		// Error cases
+		"Error on invalid language":         {entries: []entry.Entry{{Key: "locale/language", Value: "fr_FR.UTF-8; rm -rf /"}}, wantErr: true},
+		"Error on invalid timezone":         {entries: []entry.Entry{{Key: "locale/timezone", Value: "../../etc/passwd"}}, wantErr: true},
+		"Error on invalid keyboard layout":  {entries: []entry.Entry{{Key: "locale/keyboard-layout", Value: "fr;us"}}, wantErr: true},
+		"Error on invalid keyboard variant": {entries: []entry.Entry{{Key: "locale/keyboard-layout", Value: "fr"}, {Key: "locale/keyboard-variant", Value: "o$s"}}, wantErr: true},
+		"Error on corrupted state":          {existing: "states/corrupted", entries: allEntries, wantErr: true},
+		"Error on D-Bus call failure":       {entries: allEntries, callError: true, wantErr: true},
+		"Error on D-Bus property failure":   {entries: allEntries, getPropertyError: true, wantErr: true},
+		"Error on unexpected system locale": {entries: allEntries, unexpectedLocale: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+
+			calls := &callsRecorder{}
+			localed := &mockCaller{
+				name:  "localed",
+				calls: calls,
+				properties: map[string]interface{}{
+					"org.freedesktop.locale1.Locale":     []string{"LANG=en_US.UTF-8", "LC_TIME=en_GB.UTF-8"},
+					"org.freedesktop.locale1.X11Layout":  "us",
+					"org.freedesktop.locale1.X11Variant": "",
+					"org.freedesktop.locale1.X11Model":   "pc105",
+					"org.freedesktop.locale1.X11Options": "terminate:ctrl_alt_bksp",
+				},
+				noService:        tc.noLocaled,
+				callError:        tc.callError,
+				getPropertyError: tc.getPropertyError,
+			}
+			timedated := &mockCaller{
+				name:             "timedated",
+				calls:            calls,
+				properties:       map[string]interface{}{"org.freedesktop.timedate1.Timezone": "Etc/UTC"},
+				noService:        tc.noTimedated,
+				callError:        tc.callError,
+				getPropertyError: tc.getPropertyError,
+			}
+			if tc.alreadyConfigured {
+				localed.properties["org.freedesktop.locale1.Locale"] = []string{"LANG=fr_FR.UTF-8", "LC_TIME=en_GB.UTF-8"}
+				localed.properties["org.freedesktop.locale1.X11Layout"] = "fr"
+				localed.properties["org.freedesktop.locale1.X11Variant"] = "oss"
+				timedated.properties["org.freedesktop.timedate1.Timezone"] = "Europe/Paris"
+			}
+			if tc.unexpectedLocale {
+				localed.properties["org.freedesktop.locale1.Locale"] = "LANG=en_US.UTF-8"
+			}
+
+			m := locale.New(bus,
+				locale.WithStateDir(root),
+				locale.WithLocaled(localed),
+				locale.WithTimedated(timedated),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			calls.write(t, filepath.Join(root, "calls.log"))
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestApplyUserPolicy(t *testing.T) {
+	t.Parallel()
+
+	groupLocales := "%developers@example.com=en_US.UTF-8\nsales-fr@example.com=fr_FR.UTF-8,fr_FR.UTF-8\n\nsales-de@example.com=de_DE.UTF-8"
+
+	tests := map[string]struct {
+		entries   []entry.Entry
+		groups    []string
+		current   string
+		lastState string
+
+		noAccountsService bool
+		groupsError       bool
+		getError          bool
+		setError          bool
+
+		wantLanguage string
+		wantFormats  string
+		wantState    string
+		wantErr      bool
+	}{
+		"Set default language":                           {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}}, wantLanguage: "fr_FR.UTF-8", wantState: `{"language":"fr_FR.UTF-8"}`},
+		"Set default language and formats":               {entries: []entry.Entry{{Key: "locale/user-language", Value: "en_US.UTF-8"}, {Key: "locale/user-formats", Value: "de_DE.UTF-8"}}, wantLanguage: "en_US.UTF-8", wantFormats: "de_DE.UTF-8", wantState: `{"language":"en_US.UTF-8","formats":"de_DE.UTF-8"}`},
+		"Set only formats":                               {entries: []entry.Entry{{Key: "locale/user-formats", Value: "de_DE.UTF-8"}}, wantFormats: "de_DE.UTF-8", wantState: `{"formats":"de_DE.UTF-8"}`},
+		"Set locale of group":                            {entries: []entry.Entry{{Key: "locale/user-language", Value: "en_US.UTF-8"}, {Key: "locale/user-groups", Value: groupLocales}}, groups: []string{"users", "sales-fr@example.com"}, wantLanguage: "fr_FR.UTF-8", wantFormats: "fr_FR.UTF-8", wantState: `{"language":"fr_FR.UTF-8","formats":"fr_FR.UTF-8"}`},
+		"Group without formats keeps default formats":    {entries: []entry.Entry{{Key: "locale/user-formats", Value: "en_GB.UTF-8"}, {Key: "locale/user-groups", Value: groupLocales}}, groups: []string{"Sales-DE@example.com"}, wantLanguage: "de_DE.UTF-8", wantFormats: "en_GB.UTF-8", wantState: `{"language":"de_DE.UTF-8","formats":"en_GB.UTF-8"}`},
+		"First matching group takes precedence":          {entries: []entry.Entry{{Key: "locale/user-groups", Value: groupLocales}}, groups: []string{"sales-de@example.com", "developers@example.com"}, wantLanguage: "en_US.UTF-8", wantState: `{"language":"en_US.UTF-8"}`},
+		"Default locale when not member of any group":    {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}, {Key: "locale/user-groups", Value: groupLocales}}, groups: []string{"users"}, wantLanguage: "fr_FR.UTF-8", wantState: `{"language":"fr_FR.UTF-8"}`},
+		"No locale when not member of any group":         {entries: []entry.Entry{{Key: "locale/user-groups", Value: groupLocales}}, groups: []string{"users"}},
+		"Replace locale previously set":                  {entries: []entry.Entry{{Key: "locale/user-language", Value: "de_DE.UTF-8"}}, current: "fr_FR.UTF-8", lastState: `{"language":"fr_FR.UTF-8"}`, wantLanguage: "de_DE.UTF-8", wantState: `{"language":"de_DE.UTF-8"}`},
+		"Replace locale of the user on first time":       {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}}, current: "en_US.UTF-8", wantLanguage: "fr_FR.UTF-8", wantState: `{"language":"fr_FR.UTF-8"}`},
+		"Keep locale chosen by the user":                 {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}, {Key: "locale/user-formats", Value: "fr_FR.UTF-8"}}, current: "en_US.UTF-8", lastState: `{"language":"fr_FR.UTF-8"}`, wantFormats: "fr_FR.UTF-8", wantState: `{"language":"fr_FR.UTF-8","formats":"fr_FR.UTF-8"}`},
+		"Locale already set only saves state":            {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}}, current: "fr_FR.UTF-8", wantState: `{"language":"fr_FR.UTF-8"}`},
+		"Settings not configured anymore are forgotten":  {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}}, current: "fr_FR.UTF-8", lastState: `{"language":"fr_FR.UTF-8","formats":"fr_FR.UTF-8"}`, wantState: `{"language":"fr_FR.UTF-8"}`},
+		"No entries forgets the locale previously set":   {current: "fr_FR.UTF-8", lastState: `{"language":"fr_FR.UTF-8"}`},
+		"Disabled entries are ignored":                   {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8", Disabled: true}}},
+		"Unsupported keys are ignored":                   {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}, {Key: "locale/timezone", Value: "Europe/Paris"}}, wantLanguage: "fr_FR.UTF-8", wantState: `{"language":"fr_FR.UTF-8"}`},
+		"AccountsService not installed is a no-op":       {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}}, noAccountsService: true, lastState: `{"language":"en_US.UTF-8"}`, wantState: `{"language":"en_US.UTF-8"}`},
+		"Groups are not looked up without group locales": {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}}, groupsError: true, wantLanguage: "fr_FR.UTF-8", wantState: `{"language":"fr_FR.UTF-8"}`},
+
+		// Error cases
+		"Error on invalid language":          {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8; rm -rf /"}}, wantErr: true},
+		"Error on invalid formats":           {entries: []entry.Entry{{Key: "locale/user-formats", Value: "../fr_FR"}}, wantErr: true},
+		"Error on group without locale":      {entries: []entry.Entry{{Key: "locale/user-groups", Value: "developers@example.com"}}, wantErr: true},
+		"Error on empty group":               {entries: []entry.Entry{{Key: "locale/user-groups", Value: "%=fr_FR.UTF-8"}}, wantErr: true},
+		"Error on invalid language of group": {entries: []entry.Entry{{Key: "locale/user-groups", Value: "developers@example.com=fr FR"}}, wantErr: true},
+		"Error on invalid formats of group":  {entries: []entry.Entry{{Key: "locale/user-groups", Value: "developers@example.com=fr_FR.UTF-8,fr$FR"}}, wantErr: true},
+		"Error on groups lookup failure":     {entries: []entry.Entry{{Key: "locale/user-groups", Value: groupLocales}}, groupsError: true, wantErr: true},
+		"Error on corrupted state":           {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}}, lastState: "{", wantErr: true},
+		"Error on reading current locale":    {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}}, getError: true, wantErr: true},
+		"Error on setting locale":            {entries: []entry.Entry{{Key: "locale/user-language", Value: "fr_FR.UTF-8"}}, setError: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			stateFile := filepath.Join(root, "locale", "users", "user@example.com")
+			if tc.lastState != "" {
+				require.NoError(t, os.MkdirAll(filepath.Dir(stateFile), 0750), "Setup: can't create state directory")
+				require.NoError(t, os.WriteFile(stateFile, []byte(tc.lastState+"\n"), 0600), "Setup: can't create state file")
+			}
+
+			accounts := &mockAccountsService{current: tc.current, serviceUnknown: tc.noAccountsService, getError: tc.getError, setError: tc.setError}
+			m := locale.New(nil,
+				locale.WithStateDir(root),
+				locale.WithAccountsService(accounts),
+				locale.WithUserGroups(func(string) ([]string, error) {
+					if tc.groupsError {
+						return nil, errors.New("groups lookup error")
+					}
+					return tc.groups, nil
+				}),
+			)
+			err := m.ApplyPolicy(context.Background(), "user@example.com", false, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			require.Equal(t, tc.wantLanguage, accounts.language, "ApplyPolicy should have set the expected language")
+			require.Equal(t, tc.wantFormats, accounts.formats, "ApplyPolicy should have set the expected formats")
+			if tc.wantState == "" {
+				require.NoFileExists(t, stateFile, "State file should not exist")
+				return
+			}
+			got, err := os.ReadFile(stateFile)
+			require.NoError(t, err, "State file should have been written")
+			require.Equal(t, tc.wantState+"\n", string(got), "State file should contain the last locale set")
+		})
+	}
+}
+
+// callsRecorder records the D-Bus methods called on the mocks, in order.
+type callsRecorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+// write writes the recorded calls to path, if any.
+func (r *callsRecorder) write(t *testing.T, path string) {
+	t.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.calls) == 0 {
+		return
+	}
+	err := os.WriteFile(path, []byte(strings.Join(r.calls, "\n")+"\n"), 0600)
+	require.NoError(t, err, "Setup: can't write calls log")
+}
+
+// mockCaller is a mock for the systemd-localed and systemd-timedated D-Bus objects.
+type mockCaller struct {
+	name       string
+	calls      *callsRecorder
+	properties map[string]interface{}
+
+	noService        bool
+	callError        bool
+	getPropertyError bool
+}
+
+// Call records the method call.
+func (m *mockCaller) Call(method string, _ dbus.Flags, args ...interface{}) *dbus.Call {
+	if m.noService {
+		return &dbus.Call{Err: dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown", Body: []interface{}{"The name is not activatable"}}}
+	}
+	if m.callError {
+		return &dbus.Call{Err: errors.New("call error")}
+	}
+
+	m.calls.mu.Lock()
+	defer m.calls.mu.Unlock()
+	m.calls.calls = append(m.calls.calls, fmt.Sprintf("%s: %s %#v", m.name, method, args))
+	return &dbus.Call{}
+}
+
+// GetProperty returns the mocked property.
+func (m *mockCaller) GetProperty(p string) (dbus.Variant, error) {
+	if m.noService {
+		return dbus.Variant{}, dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown", Body: []interface{}{"The name is not activatable"}}
+	}
+	if m.getPropertyError {
+		return dbus.Variant{}, errors.New("property error")
+	}
+
+	v, ok := m.properties[p]
+	if !ok {
+		return dbus.Variant{}, fmt.Errorf("unknown property %s", p)
+	}
+	return dbus.MakeVariant(v), nil
+}
+
+// mockAccountsService is a mock for AccountsService. The current language and formats of the user are the same.
+type mockAccountsService struct {
+	current        string
+	serviceUnknown bool
+	getError       bool
+	setError       bool
+
+	language string
+	formats  string
+}
+
+func (a *mockAccountsService) Locale(_ context.Context, _ string) (locale.UserLocale, error) {
+	if a.serviceUnknown {
+		return locale.UserLocale{}, dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}
+	}
+	if a.getError {
+		return locale.UserLocale{}, errors.New("failed to get locale")
+	}
+	return locale.UserLocale{Language: a.current, Formats: a.current}, nil
+}
+
+func (a *mockAccountsService) SetLanguage(_ context.Context, _, language string) error {
+	if a.setError {
+		return errors.New("failed to set language")
+	}
+	a.language = language
+	return nil
+}
+
+func (a *mockAccountsService) SetFormats(_ context.Context, _, formats string) error {
+	if a.setError {
+		return errors.New("failed to set formats")
+	}
+	a.formats = formats
+	return nil
+}
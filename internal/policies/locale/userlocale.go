@@ -0,0 +1,299 @@
+package locale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	accountsDbusRegisteredName = "org.freedesktop.Accounts"
+	accountsDbusObjectPath     = "/org/freedesktop/Accounts"
+	accountsDbusInterface      = "org.freedesktop.Accounts"
+	accountsDbusUserInterface  = "org.freedesktop.Accounts.User"
+
+	// usersStateDir is the directory, relative to the state directory, where the locale last set for each user is saved.
+	usersStateDir = "users"
+)
+
+// userLocale is the language and the formats locale of a user.
+type userLocale struct {
+	Language string `json:"language,omitempty"`
+	Formats  string `json:"formats,omitempty"`
+}
+
+// groupLocale is the locale set for the members of a group.
+type groupLocale struct {
+	group  string
+	locale userLocale
+}
+
+// accountsService reads and sets the locale of the users.
+type accountsService interface {
+	Locale(ctx context.Context, username string) (userLocale, error)
+	SetLanguage(ctx context.Context, username, language string) error
+	SetFormats(ctx context.Context, username, formats string) error
+}
+
+// applyUserLocale sets the language and formats of username through AccountsService: the ones of the first
+// listed group the user is a member of, or the default ones otherwise.
+// If the user chose another language or formats since we last set them, their choice is kept.
+func (m *Manager) applyUserLocale(ctx context.Context, username string, entries []entry.Entry) (err error) {
+	log.Debugf(ctx, "Applying user locale policy to %s", username)
+
+	var defaultLocale userLocale
+	var groupLocales []groupLocale
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "locale/user-language":
+			if !languageRe.MatchString(v) {
+				return errors.New(gotext.Get("invalid language %q: expected a locale name like fr_FR.UTF-8", v))
+			}
+			defaultLocale.Language = v
+		case "locale/user-formats":
+			if !languageRe.MatchString(v) {
+				return errors.New(gotext.Get("invalid formats %q: expected a locale name like fr_FR.UTF-8", v))
+			}
+			defaultLocale.Formats = v
+		case "locale/user-groups":
+			for _, l := range strings.Split(v, "\n") {
+				if l = strings.TrimSpace(l); l == "" {
+					continue
+				}
+				gl, err := parseGroupLocale(l)
+				if err != nil {
+					return err
+				}
+				groupLocales = append(groupLocales, gl)
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing user locale entries, skipping it", e.Key))
+		}
+	}
+
+	want := defaultLocale
+	if len(groupLocales) > 0 {
+		groups, err := m.userGroups(username)
+		if err != nil {
+			return err
+		}
+	out:
+		for _, gl := range groupLocales {
+			for _, g := range groups {
+				if strings.EqualFold(g, gl.group) {
+					want.Language = gl.locale.Language
+					if gl.locale.Formats != "" {
+						want.Formats = gl.locale.Formats
+					}
+					break out
+				}
+			}
+		}
+	}
+
+	last, err := m.loadUserState(username)
+	if err != nil {
+		return err
+	}
+
+	if want == (userLocale{}) {
+		// The locale we set stays the one of the user until they choose another one.
+		return m.saveUserState(username, userLocale{})
+	}
+
+	current, err := m.accountsService.Locale(ctx, username)
+	if err != nil {
+		var dbusErr dbus.Error
+		if errors.As(err, &dbusErr) && dbusErr.Name == errDBusServiceUnknownName {
+			log.Warning(ctx, gotext.Get("AccountsService is not installed, skipping user locale settings"))
+			return nil
+		}
+		return err
+	}
+
+	applied := last
+	defer func() { err = errors.Join(err, m.saveUserState(username, applied)) }()
+
+	for _, s := range []struct {
+		name    string
+		want    string
+		current string
+		last    *string
+		set     func(context.Context, string, string) error
+	}{
+		{name: "language", want: want.Language, current: current.Language, last: &applied.Language, set: m.accountsService.SetLanguage},
+		{name: "formats", want: want.Formats, current: current.Formats, last: &applied.Formats, set: m.accountsService.SetFormats},
+	} {
+		if s.want == "" {
+			*s.last = ""
+			continue
+		}
+		if s.current != s.want {
+			if *s.last != "" && s.current != "" && s.current != *s.last {
+				log.Debugf(ctx, "%s chose the %s %s, keeping it", username, s.current, s.name)
+				continue
+			}
+			log.Debugf(ctx, "Setting %s %s to %s", username, s.name, s.want)
+			if err := s.set(ctx, username, s.want); err != nil {
+				return err
+			}
+		}
+		*s.last = s.want
+	}
+
+	return nil
+}
+
+// parseGroupLocale parses a line of the form <group>=<language>[,<formats>].
+func parseGroupLocale(l string) (gl groupLocale, err error) {
+	group, v, ok := strings.Cut(l, "=")
+	group = strings.TrimPrefix(strings.TrimSpace(group), "%")
+	if !ok || group == "" {
+		return gl, errors.New(gotext.Get("invalid group locale %q: <group>=<language>[,<formats>] is expected", l))
+	}
+
+	language, formats, _ := strings.Cut(v, ",")
+	language, formats = strings.TrimSpace(language), strings.TrimSpace(formats)
+	if !languageRe.MatchString(language) {
+		return gl, errors.New(gotext.Get("invalid language %q of group %s: expected a locale name like fr_FR.UTF-8", language, group))
+	}
+	if formats != "" && !languageRe.MatchString(formats) {
+		return gl, errors.New(gotext.Get("invalid formats %q of group %s: expected a locale name like fr_FR.UTF-8", formats, group))
+	}
+
+	return groupLocale{group: group, locale: userLocale{Language: language, Formats: formats}}, nil
+}
+
+// loadUserState returns the locale last set by adsys for username.
+func (m *Manager) loadUserState(username string) (s userLocale, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load locale state of %s", username))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, usersStateDir, username))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveUserState saves the locale last set by adsys for username.
+// The state file is removed if no locale is set anymore.
+func (m *Manager) saveUserState(username string, s userLocale) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save locale state of %s", username))
+
+	dir := filepath.Join(m.stateDir, usersStateDir)
+	p := filepath.Join(dir, username)
+	if s == (userLocale{}) {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// userGroups returns the names of the groups username is a member of.
+func userGroups(username string) ([]string, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, gid := range gids {
+		g, err := user.LookupGroupId(gid)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+	return groups, nil
+}
+
+// dbusAccountsService sets the locale of the users through the AccountsService D-Bus API.
+type dbusAccountsService struct {
+	bus *dbus.Conn
+}
+
+// user returns the AccountsService object of username.
+func (a dbusAccountsService) user(ctx context.Context, username string) (dbus.BusObject, error) {
+	var p dbus.ObjectPath
+	if err := a.bus.Object(accountsDbusRegisteredName, accountsDbusObjectPath).CallWithContext(ctx,
+		accountsDbusInterface+".FindUserByName", 0, username).Store(&p); err != nil {
+		return nil, err
+	}
+	return a.bus.Object(accountsDbusRegisteredName, p), nil
+}
+
+// Locale returns the language and formats currently selected by username.
+// The formats are only supported by the AccountsService of Ubuntu: they are empty otherwise.
+func (a dbusAccountsService) Locale(ctx context.Context, username string) (l userLocale, err error) {
+	u, err := a.user(ctx, username)
+	if err != nil {
+		return l, err
+	}
+	if l.Language, err = stringProperty(u, accountsDbusUserInterface+".Language"); err != nil {
+		return l, err
+	}
+	if l.Formats, err = stringProperty(u, accountsDbusUserInterface+".FormatsLocale"); err != nil {
+		var dbusErr dbus.Error
+		if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.InvalidArgs" {
+			return l, nil
+		}
+		return l, err
+	}
+	return l, nil
+}
+
+// SetLanguage sets the language of username.
+func (a dbusAccountsService) SetLanguage(ctx context.Context, username, language string) error {
+	u, err := a.user(ctx, username)
+	if err != nil {
+		return err
+	}
+	return u.CallWithContext(ctx, accountsDbusUserInterface+".SetLanguage", 0, language).Err
+}
+
+// SetFormats sets the formats locale of username, used for dates, numbers and currencies.
+func (a dbusAccountsService) SetFormats(ctx context.Context, username, formats string) error {
+	u, err := a.user(ctx, username)
+	if err != nil {
+		return err
+	}
+	return u.CallWithContext(ctx, accountsDbusUserInterface+".SetFormatsLocale", 0, formats).Err
+}
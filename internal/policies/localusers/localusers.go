@@ -0,0 +1,877 @@
+// Package localusers provides a manager that creates local accounts and manages the members of local groups,
+// similarly to the Windows GPO Local Users and Groups preferences.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - localusers/users: local users, one per line, of the form
+//     name=<user>[, fullname=<text>][, disabled=yes][, action=<action>].
+//   - localusers/groups: local groups, one per line, of the form
+//     name=<group>[, add=<member>;<member>][, remove=<member>;<member>][, removeall=yes][, action=<action>].
+//     Members are local or domain users, or domain groups whose members are added or removed. With removeall,
+//     the members which are not listed in add are removed from the group.
+//
+// The action follows the Group Policy Preferences apply modes: create only creates missing accounts, update
+// (the default) and replace create missing accounts and update existing ones, and delete removes them.
+// System accounts are never deleted.
+//
+// Users and groups created by adsys, users locked by adsys and members added by adsys are saved in a state file,
+// so that they are removed, unlocked or removed from the group once they are not configured anymore.
+// The home directories of the removed users are kept.
+package localusers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const stateFile = "state.json"
+
+const (
+	// minAccountID is the first uid and gid of regular accounts: accounts below are system ones.
+	minAccountID = 1000
+
+	// getentNotFound is the exit code of getent when the key is not found.
+	getentNotFound = 2
+)
+
+// Apply modes of the users and groups.
+const (
+	actionCreate  = "create"
+	actionReplace = "replace"
+	actionUpdate  = "update"
+	actionDelete  = "delete"
+)
+
+var (
+	// accountNameRe matches the names of the local users and groups accepted by adsys.
+	accountNameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,31}\$?$`)
+	// invalidMemberChars are the characters members can't contain, as they are not supported in the group file.
+	invalidMemberChars = ":\n"
+)
+
+// localUser is a user requested by the policy.
+type localUser struct {
+	fullName string
+	disabled bool
+	action   string
+}
+
+// localGroup is a group requested by the policy.
+type localGroup struct {
+	add       []string
+	remove    []string
+	removeAll bool
+	action    string
+}
+
+// rules are the users and groups requested by the policy.
+type rules struct {
+	users      map[string]localUser
+	userNames  []string
+	groups     map[string]localGroup
+	groupNames []string
+}
+
+// state is the local accounts configuration applied by adsys.
+type state struct {
+	// Users are the users created by adsys.
+	Users []string `json:"users,omitempty"`
+	// Locked are the users locked by adsys.
+	Locked []string `json:"locked,omitempty"`
+	// Groups are the groups created by adsys.
+	Groups []string `json:"groups,omitempty"`
+	// Members are the users added by adsys to each group.
+	Members map[string][]string `json:"members,omitempty"`
+}
+
+// passwdEntry is a user of the machine.
+type passwdEntry struct {
+	uid   int
+	gecos string
+}
+
+// groupEntry is a group of the machine.
+type groupEntry struct {
+	gid     int
+	members []string
+}
+
+// Manager applies the local users and groups policy on the machine.
+type Manager struct {
+	stateDir    string
+	useraddCmd  []string
+	usermodCmd  []string
+	userdelCmd  []string
+	groupaddCmd []string
+	groupdelCmd []string
+	gpasswdCmd  []string
+	getentCmd   []string
+	cmdTimeout  time.Duration
+
+	mu sync.Mutex // Prevents concurrent changes to the accounts and the state
+}
+
+type options struct {
+	stateDir    string
+	useraddCmd  []string
+	usermodCmd  []string
+	userdelCmd  []string
+	groupaddCmd []string
+	groupdelCmd []string
+	gpasswdCmd  []string
+	getentCmd   []string
+	cmdTimeout  time.Duration
+}
+
+// Option reprents an optional function to change the local users manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithUseraddCmd overrides the default useradd command.
+func WithUseraddCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.useraddCmd = cmd
+	}
+}
+
+// WithUsermodCmd overrides the default usermod command.
+func WithUsermodCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.usermodCmd = cmd
+	}
+}
+
+// WithUserdelCmd overrides the default userdel command.
+func WithUserdelCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.userdelCmd = cmd
+	}
+}
+
+// WithGroupaddCmd overrides the default groupadd command.
+func WithGroupaddCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.groupaddCmd = cmd
+	}
+}
+
+// WithGroupdelCmd overrides the default groupdel command.
+func WithGroupdelCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.groupdelCmd = cmd
+	}
+}
+
+// WithGpasswdCmd overrides the default gpasswd command.
+func WithGpasswdCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.gpasswdCmd = cmd
+	}
+}
+
+// WithGetentCmd overrides the default getent command.
+func WithGetentCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.getentCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time a command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the local users and groups policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:    consts.DefaultStateDir,
+		useraddCmd:  []string{"useradd"},
+		usermodCmd:  []string{"usermod"},
+		userdelCmd:  []string{"userdel"},
+		groupaddCmd: []string{"groupadd"},
+		groupdelCmd: []string{"groupdel"},
+		gpasswdCmd:  []string{"gpasswd"},
+		getentCmd:   []string{"getent"},
+		cmdTimeout:  consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:    filepath.Join(args.stateDir, "localusers"),
+		useraddCmd:  args.useraddCmd,
+		usermodCmd:  args.usermodCmd,
+		userdelCmd:  args.userdelCmd,
+		groupaddCmd: args.groupaddCmd,
+		groupdelCmd: args.groupdelCmd,
+		gpasswdCmd:  args.gpasswdCmd,
+		getentCmd:   args.getentCmd,
+		cmdTimeout:  args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy creates, updates and deletes the local users and groups requested by the policy, and reverts
+// the changes which are not requested anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply local users and groups policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Local users and groups policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying local users and groups policy to %s", objectName)
+
+	want, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to revert.
+	if len(want.userNames) == 0 && len(want.groupNames) == 0 &&
+		len(prev.Users) == 0 && len(prev.Locked) == 0 && len(prev.Groups) == 0 && len(prev.Members) == 0 {
+		return nil
+	}
+
+	s, err := m.apply(ctx, prev, want)
+	if err != nil {
+		// Still save the changes made so far, so that they can be reverted.
+		return errors.Join(err, m.saveState(s))
+	}
+	return m.saveState(s)
+}
+
+// DumpState returns the local users and groups managed during the last refresh of the machine.
+// The state is empty for users or if no local users policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump local users state of %s", objectName))
+
+	// Local users policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// apply reverts the changes of the previous state prev which are not requested anymore, then applies the
+// requested users and groups. It returns the new state.
+func (m *Manager) apply(ctx context.Context, prev state, want rules) (s state, err error) {
+	s = state{
+		Users:   slices.Clone(prev.Users),
+		Locked:  slices.Clone(prev.Locked),
+		Groups:  slices.Clone(prev.Groups),
+		Members: make(map[string][]string),
+	}
+	for g, members := range prev.Members {
+		s.Members[g] = slices.Clone(members)
+	}
+
+	if err := m.revertGroups(ctx, &s, want); err != nil {
+		return s, err
+	}
+	if err := m.revertUsers(ctx, &s, want); err != nil {
+		return s, err
+	}
+
+	for _, name := range want.userNames {
+		if err := m.applyUser(ctx, &s, name, want.users[name]); err != nil {
+			return s, err
+		}
+	}
+	for _, name := range want.groupNames {
+		if err := m.applyGroup(ctx, &s, name, want.groups[name]); err != nil {
+			return s, err
+		}
+	}
+
+	return s, nil
+}
+
+// revertGroups removes the members added to groups which are not listed anymore, and deletes the groups
+// created by adsys which are not listed anymore.
+// Listed groups, including the deleted ones, are handled when applying them.
+func (m *Manager) revertGroups(ctx context.Context, s *state, want rules) error {
+	var groups []string
+	for g := range s.Members {
+		groups = append(groups, g)
+	}
+	slices.Sort(groups)
+
+	for _, name := range groups {
+		if _, ok := want.groups[name]; ok {
+			continue
+		}
+		g, exists, err := m.lookupGroup(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, u := range s.Members[name] {
+			if !exists || !slices.Contains(g.members, u) {
+				continue
+			}
+			log.Infof(ctx, "Removing %s from group %s", u, name)
+			if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.gpasswdCmd, "-d", u, name); err != nil {
+				return err
+			}
+		}
+		delete(s.Members, name)
+	}
+
+	for _, name := range slices.Clone(s.Groups) {
+		if _, ok := want.groups[name]; ok {
+			continue
+		}
+		if _, exists, err := m.lookupGroup(ctx, name); err != nil {
+			return err
+		} else if exists {
+			log.Infof(ctx, "Deleting group %s", name)
+			if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.groupdelCmd, name); err != nil {
+				return err
+			}
+		}
+		s.Groups = slices.DeleteFunc(s.Groups, func(g string) bool { return g == name })
+	}
+
+	return nil
+}
+
+// revertUsers deletes the users created by adsys and unlocks the users locked by adsys which are not
+// listed anymore.
+// Listed users, including the deleted ones, are handled when applying them.
+func (m *Manager) revertUsers(ctx context.Context, s *state, want rules) error {
+	for _, name := range slices.Clone(s.Users) {
+		if _, ok := want.users[name]; ok {
+			continue
+		}
+		if _, exists, err := m.lookupUser(ctx, name); err != nil {
+			return err
+		} else if exists {
+			log.Infof(ctx, "Deleting user %s", name)
+			if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.userdelCmd, name); err != nil {
+				return err
+			}
+		}
+		s.Users = slices.DeleteFunc(s.Users, func(u string) bool { return u == name })
+		s.Locked = slices.DeleteFunc(s.Locked, func(u string) bool { return u == name })
+	}
+
+	for _, name := range slices.Clone(s.Locked) {
+		// Users requested as disabled stay locked, and deleted users don't need to be unlocked. Existing
+		// users are left as is when they are only created if missing.
+		if u, ok := want.users[name]; ok && (u.disabled || u.action == actionCreate || u.action == actionDelete) {
+			continue
+		}
+		if _, exists, err := m.lookupUser(ctx, name); err != nil {
+			return err
+		} else if exists {
+			log.Infof(ctx, "Unlocking user %s", name)
+			if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.usermodCmd, "--unlock", "--expiredate", "", name); err != nil {
+				return err
+			}
+		}
+		s.Locked = slices.DeleteFunc(s.Locked, func(u string) bool { return u == name })
+	}
+
+	return nil
+}
+
+// applyUser creates, updates or deletes the user name.
+func (m *Manager) applyUser(ctx context.Context, s *state, name string, u localUser) error {
+	p, exists, err := m.lookupUser(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if u.action == actionDelete {
+		if exists && p.uid < minAccountID {
+			log.Warning(ctx, gotext.Get("%s is a system user, not deleting it", name))
+			return nil
+		}
+		if exists {
+			log.Infof(ctx, "Deleting user %s", name)
+			if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.userdelCmd, name); err != nil {
+				return err
+			}
+		}
+		s.Users = slices.DeleteFunc(s.Users, func(n string) bool { return n == name })
+		s.Locked = slices.DeleteFunc(s.Locked, func(n string) bool { return n == name })
+		return nil
+	}
+
+	switch {
+	case !exists:
+		log.Infof(ctx, "Creating user %s", name)
+		args := []string{"--create-home"}
+		if u.fullName != "" {
+			args = append(args, "--comment", u.fullName)
+		}
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.useraddCmd, append(args, name)...); err != nil {
+			return err
+		}
+		if !slices.Contains(s.Users, name) {
+			s.Users = append(s.Users, name)
+		}
+	case u.action == actionCreate:
+		// Existing users are left as is.
+		return nil
+	case u.fullName != "" && u.fullName != p.gecos:
+		log.Infof(ctx, "Updating full name of user %s", name)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.usermodCmd, "--comment", u.fullName, name); err != nil {
+			return err
+		}
+	}
+
+	if u.disabled && !slices.Contains(s.Locked, name) {
+		log.Infof(ctx, "Locking user %s", name)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.usermodCmd, "--lock", "--expiredate", "1", name); err != nil {
+			return err
+		}
+		s.Locked = append(s.Locked, name)
+	}
+	return nil
+}
+
+// applyGroup creates or deletes the group name, and updates its members.
+func (m *Manager) applyGroup(ctx context.Context, s *state, name string, g localGroup) error {
+	e, exists, err := m.lookupGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+	created := slices.Contains(s.Groups, name)
+
+	if g.action == actionDelete {
+		if exists && e.gid < minAccountID {
+			log.Warning(ctx, gotext.Get("%s is a system group, not deleting it", name))
+			return nil
+		}
+		if exists {
+			log.Infof(ctx, "Deleting group %s", name)
+			if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.groupdelCmd, name); err != nil {
+				return err
+			}
+		}
+		s.Groups = slices.DeleteFunc(s.Groups, func(n string) bool { return n == name })
+		delete(s.Members, name)
+		return nil
+	}
+
+	switch {
+	case !exists:
+		log.Infof(ctx, "Creating group %s", name)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.groupaddCmd, name); err != nil {
+			return err
+		}
+		if !created {
+			s.Groups = append(s.Groups, name)
+		}
+		e.members = nil
+	case g.action == actionCreate && !created:
+		// Existing groups are left as is.
+		return nil
+	}
+
+	add, err := m.resolveMembers(ctx, name, g.add)
+	if err != nil {
+		return err
+	}
+	remove, err := m.resolveMembers(ctx, name, g.remove)
+	if err != nil {
+		return err
+	}
+	add = slices.DeleteFunc(add, func(u string) bool { return slices.Contains(remove, u) })
+
+	// Members we added which are not requested anymore are removed too.
+	added := s.Members[name]
+	for _, u := range added {
+		if !slices.Contains(add, u) && !slices.Contains(remove, u) {
+			remove = append(remove, u)
+		}
+	}
+	if g.removeAll {
+		for _, u := range e.members {
+			if !slices.Contains(add, u) && !slices.Contains(remove, u) {
+				remove = append(remove, u)
+			}
+		}
+	}
+
+	for _, u := range remove {
+		if !slices.Contains(e.members, u) {
+			continue
+		}
+		log.Infof(ctx, "Removing %s from group %s", u, name)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.gpasswdCmd, "-d", u, name); err != nil {
+			return err
+		}
+	}
+
+	// Only keep track of the members we added ourself, so that other members are kept on revert.
+	var members []string
+	for _, u := range added {
+		if slices.Contains(add, u) {
+			members = append(members, u)
+		}
+	}
+	for _, u := range add {
+		if slices.Contains(e.members, u) {
+			continue
+		}
+		log.Infof(ctx, "Adding %s to group %s", u, name)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.gpasswdCmd, "-a", u, name); err != nil {
+			setMembers(s, name, members)
+			return err
+		}
+		if !slices.Contains(members, u) {
+			members = append(members, u)
+		}
+	}
+
+	setMembers(s, name, members)
+	return nil
+}
+
+// setMembers records members as the members added by adsys to the group name.
+func setMembers(s *state, name string, members []string) {
+	if len(members) == 0 {
+		delete(s.Members, name)
+		return
+	}
+	s.Members[name] = members
+}
+
+// resolveMembers returns the users listed in members of the group name. Groups are replaced by their members.
+// Unknown members are skipped.
+func (m *Manager) resolveMembers(ctx context.Context, name string, members []string) (users []string, err error) {
+	for _, member := range members {
+		if _, exists, err := m.lookupUser(ctx, member); err != nil {
+			return nil, err
+		} else if exists {
+			if !slices.Contains(users, member) {
+				users = append(users, member)
+			}
+			continue
+		}
+
+		g, exists, err := m.lookupGroup(ctx, member)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			log.Warning(ctx, gotext.Get("Unknown user or group %s in the members of group %s, skipping it", member, name))
+			continue
+		}
+		for _, u := range g.members {
+			if !slices.Contains(users, u) {
+				users = append(users, u)
+			}
+		}
+	}
+	return users, nil
+}
+
+// lookupUser returns the user name of the machine, including the domain users, if it exists.
+func (m *Manager) lookupUser(ctx context.Context, name string) (p passwdEntry, exists bool, err error) {
+	fields, exists, err := m.getent(ctx, "passwd", name)
+	if err != nil || !exists {
+		return p, exists, err
+	}
+	if len(fields) < 5 {
+		return p, false, errors.New(gotext.Get("invalid user entry for %s", name))
+	}
+	if p.uid, err = strconv.Atoi(fields[2]); err != nil {
+		return p, false, errors.New(gotext.Get("invalid uid %q for %s", fields[2], name))
+	}
+	p.gecos = fields[4]
+	return p, true, nil
+}
+
+// lookupGroup returns the group name of the machine, including the domain groups, if it exists.
+func (m *Manager) lookupGroup(ctx context.Context, name string) (g groupEntry, exists bool, err error) {
+	fields, exists, err := m.getent(ctx, "group", name)
+	if err != nil || !exists {
+		return g, exists, err
+	}
+	if len(fields) < 4 {
+		return g, false, errors.New(gotext.Get("invalid group entry for %s", name))
+	}
+	if g.gid, err = strconv.Atoi(fields[2]); err != nil {
+		return g, false, errors.New(gotext.Get("invalid gid %q for %s", fields[2], name))
+	}
+	if fields[3] != "" {
+		g.members = strings.Split(fields[3], ",")
+	}
+	return g, true, nil
+}
+
+// getent returns the fields of the key entry of the database, if it exists.
+func (m *Manager) getent(ctx context.Context, database, key string) (fields []string, exists bool, err error) {
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.getentCmd, database, key)
+	if exitErr := (&exec.ExitError{}); errors.As(err, &exitErr) && exitErr.ExitCode() == getentNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	l, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	return strings.Split(l, ":"), true, nil
+}
+
+// loadState loads the local accounts configuration applied by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load local users and groups state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the local accounts configuration applied by adsys.
+// The state file is removed if no change is to be reverted anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save local users and groups state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Users) == 0 && len(s.Locked) == 0 && len(s.Groups) == 0 && len(s.Members) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// parseEntries validates the entries and returns the requested users and groups.
+// Accounts are listed from the furthest to the closest GPO: the closest one wins.
+func parseEntries(ctx context.Context, entries []entry.Entry) (r rules, err error) {
+	r.users = make(map[string]localUser)
+	r.groups = make(map[string]localGroup)
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "localusers/users":
+			for _, l := range strings.Split(v, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" {
+					continue
+				}
+				name, u, err := parseUser(l)
+				if err != nil {
+					return r, err
+				}
+				if _, ok := r.users[name]; !ok {
+					r.userNames = append(r.userNames, name)
+				}
+				r.users[name] = u
+			}
+		case "localusers/groups":
+			for _, l := range strings.Split(v, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" {
+					continue
+				}
+				name, g, err := parseGroup(l)
+				if err != nil {
+					return r, err
+				}
+				if _, ok := r.groups[name]; !ok {
+					r.groupNames = append(r.groupNames, name)
+				}
+				r.groups[name] = g
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing local users and groups entries, skipping it", e.Key))
+		}
+	}
+	return r, nil
+}
+
+// parseUser parses a user line of the form name=<user>[, fullname=<text>][, disabled=yes][, action=<action>].
+func parseUser(l string) (name string, u localUser, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid local user %q", l))
+
+	u.action = actionUpdate
+	fields, err := splitFields(l, "name=<user>[, fullname=<text>][, disabled=yes][, action=<action>]")
+	if err != nil {
+		return "", u, err
+	}
+	for k, v := range fields {
+		switch k {
+		case "name":
+			name = v
+		case "fullname":
+			if strings.Contains(v, ":") {
+				return "", u, errors.New(gotext.Get("full name can't contain colons"))
+			}
+			u.fullName = v
+		case "disabled":
+			if u.disabled, err = parseYesNo(k, v); err != nil {
+				return "", u, err
+			}
+		case "action":
+			if u.action, err = parseAction(v); err != nil {
+				return "", u, err
+			}
+		default:
+			return "", u, errors.New(gotext.Get("unsupported field %q", k))
+		}
+	}
+
+	if !accountNameRe.MatchString(name) {
+		return "", u, errors.New(gotext.Get("%q is not a valid user name", name))
+	}
+	return name, u, nil
+}
+
+// parseGroup parses a group line of the form
+// name=<group>[, add=<member>;<member>][, remove=<member>;<member>][, removeall=yes][, action=<action>].
+func parseGroup(l string) (name string, g localGroup, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid local group %q", l))
+
+	g.action = actionUpdate
+	fields, err := splitFields(l, "name=<group>[, add=<member>;<member>][, remove=<member>;<member>][, removeall=yes][, action=<action>]")
+	if err != nil {
+		return "", g, err
+	}
+	for k, v := range fields {
+		switch k {
+		case "name":
+			name = v
+		case "add":
+			if g.add, err = parseMembers(v); err != nil {
+				return "", g, err
+			}
+		case "remove":
+			if g.remove, err = parseMembers(v); err != nil {
+				return "", g, err
+			}
+		case "removeall":
+			if g.removeAll, err = parseYesNo(k, v); err != nil {
+				return "", g, err
+			}
+		case "action":
+			if g.action, err = parseAction(v); err != nil {
+				return "", g, err
+			}
+		default:
+			return "", g, errors.New(gotext.Get("unsupported field %q", k))
+		}
+	}
+
+	if !accountNameRe.MatchString(name) {
+		return "", g, errors.New(gotext.Get("%q is not a valid group name", name))
+	}
+	return name, g, nil
+}
+
+// splitFields returns the fields of the comma separated line l, by lowercase name.
+// usage is returned in the error if a field is malformed.
+func splitFields(l, usage string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(l, ",") {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return nil, errors.New(gotext.Get("expected %s", usage))
+		}
+		if _, ok := fields[k]; ok {
+			return nil, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		fields[k] = v
+	}
+	return fields, nil
+}
+
+// parseMembers parses a semicolon separated list of members.
+func parseMembers(v string) (members []string, err error) {
+	for _, member := range strings.Split(v, ";") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		if strings.HasPrefix(member, "-") || strings.ContainsAny(member, invalidMemberChars) {
+			return nil, errors.New(gotext.Get("%q is not a valid member", member))
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// parseYesNo parses the value v of the boolean field k.
+func parseYesNo(k, v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New(gotext.Get("%s must be yes or no, got %q", k, v))
+}
+
+// parseAction parses the apply mode v.
+func parseAction(v string) (string, error) {
+	switch a := strings.ToLower(v); a {
+	case actionCreate, actionReplace, actionUpdate, actionDelete:
+		return a, nil
+	}
+	return "", errors.New(gotext.Get("unknown action %q: create, replace, update or delete is expected", v))
+}
@@ -0,0 +1,161 @@
+package localusers_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/localusers"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Create users":          {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave, fullname=Dave Jones\n\n  name=erin , action=create\nname=frank, disabled=yes"}}},
+		"Update existing users": {entries: []entry.Entry{{Key: "localusers/users", Value: "name=alice, fullname=Alice Smith\nname=kiosk, disabled=yes, action=replace"}}},
+		"Existing users with same full name are not updated": {entries: []entry.Entry{{Key: "localusers/users", Value: "name=alice, fullname=Alice"}}},
+		"Create action keeps existing users as is":           {entries: []entry.Entry{{Key: "localusers/users", Value: "name=alice, fullname=Alice Smith, disabled=yes, action=create"}}},
+		"Delete users":                                {entries: []entry.Entry{{Key: "localusers/users", Value: "name=alice, action=delete\nname=unknown, action=delete"}}},
+		"System users are not deleted":                {entries: []entry.Entry{{Key: "localusers/users", Value: "name=root, action=delete"}}},
+		"Closest user wins":                           {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave, fullname=Old\nname=dave, fullname=Dave Jones"}}},
+		"Add members to existing group":               {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=docker, add=alice;devs@example.com"}}},
+		"Members already in group are not tracked":    {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=lpadmin, add=alice;bob@example.com"}}},
+		"Remove members":                              {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=lpadmin, remove=alice"}}},
+		"Removed members win over added ones":         {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=lpadmin, add=devs@example.com, remove=carol@example.com"}}},
+		"Remove all other members":                    {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=lpadmin, add=bob@example.com, removeall=yes"}}},
+		"Create group with members":                   {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=developers, add=alice;devs@example.com, action=create"}}},
+		"Create action keeps existing groups as is":   {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=lpadmin, add=bob@example.com, action=create"}}},
+		"Delete groups":                               {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=legacy, action=delete\nname=unknown, action=delete"}}},
+		"System groups are not deleted":               {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=docker, action=delete"}}},
+		"Unknown members are skipped":                 {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=docker, add=unknown;alice"}}},
+		"Users are created before groups":             {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=developers, add=alice"}, {Key: "localusers/users", Value: "name=dave"}}},
+		"Already applied changes are kept":            {entries: []entry.Entry{{Key: "localusers/users", Value: "name=olduser\nname=kiosk, disabled=yes"}, {Key: "localusers/groups", Value: "name=oldgroup\nname=docker, add=olduser"}}, existingState: "applied"},
+		"Changes not configured anymore are reverted": {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave"}}, existingState: "applied"},
+		"No entries reverts everything":               {existingState: "applied"},
+		"Deleting applied accounts drops them":        {entries: []entry.Entry{{Key: "localusers/users", Value: "name=olduser, action=delete\nname=kiosk, action=delete"}, {Key: "localusers/groups", Value: "name=oldgroup, action=delete"}}, existingState: "applied"},
+		"Disabled entries are ignored":                {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave", Disabled: true}, {Key: "localusers/groups", Value: "name=docker, add=alice"}}},
+		"Unsupported keys are ignored":                {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave"}, {Key: "localusers/passwords", Value: "dave=secret"}}},
+		"Users are a no-op":                           {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave"}}, isUser: true},
+		"No entries is a no-op":                       {},
+
+		// Error cases
+		"Error on missing name":             {entries: []entry.Entry{{Key: "localusers/users", Value: "fullname=Dave Jones"}}, wantErr: true},
+		"Error on invalid user name":        {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave jones"}}, wantErr: true},
+		"Error on invalid group name":       {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=-developers"}}, wantErr: true},
+		"Error on invalid full name":        {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave, fullname=Dave:Jones"}}, wantErr: true},
+		"Error on invalid member":           {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=docker, add=-alice"}}, wantErr: true},
+		"Error on empty field":              {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave, fullname="}}, wantErr: true},
+		"Error on field set more than once": {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave, name=erin"}}, wantErr: true},
+		"Error on unsupported user field":   {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave, password=secret"}}, wantErr: true},
+		"Error on unsupported group field":  {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=docker, members=alice"}}, wantErr: true},
+		"Error on invalid disabled flag":    {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave, disabled=maybe"}}, wantErr: true},
+		"Error on invalid removeall flag":   {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=docker, removeall=maybe"}}, wantErr: true},
+		"Error on unknown action":           {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave, action=rename"}}, wantErr: true},
+		"Error on looking up accounts":      {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave"}}, mockBehaviour: "fail-getent", wantErr: true},
+		"Error on creating user":            {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave"}}, mockBehaviour: "fail-useradd", wantErr: true},
+		"Error on updating user":            {entries: []entry.Entry{{Key: "localusers/users", Value: "name=alice, fullname=Alice Smith"}}, mockBehaviour: "fail-usermod", wantErr: true},
+		"Error on deleting user":            {entries: []entry.Entry{{Key: "localusers/users", Value: "name=alice, action=delete"}}, mockBehaviour: "fail-userdel", wantErr: true},
+		"Error on creating group":           {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=developers"}}, mockBehaviour: "fail-groupadd", wantErr: true},
+		"Error on deleting group":           {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=legacy, action=delete"}}, mockBehaviour: "fail-groupdel", wantErr: true},
+		"Error on adding member":            {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=docker, add=alice"}}, mockBehaviour: "fail-gpasswd-a", wantErr: true},
+		"Error on removing member":          {entries: []entry.Entry{{Key: "localusers/groups", Value: "name=lpadmin, remove=alice"}}, mockBehaviour: "fail-gpasswd-d", wantErr: true},
+		"Error on reverting members":        {existingState: "applied", mockBehaviour: "fail-gpasswd-d", wantErr: true},
+		"Error on reverting groups":         {existingState: "applied", mockBehaviour: "fail-groupdel", wantErr: true},
+		"Error on reverting users":          {existingState: "applied", mockBehaviour: "fail-userdel", wantErr: true},
+		"Error on unlocking users":          {existingState: "applied", mockBehaviour: "fail-usermod", wantErr: true},
+		"Error on corrupted state":          {entries: []entry.Entry{{Key: "localusers/users", Value: "name=dave"}}, existingState: "corrupted", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			m := localusers.New(
+				localusers.WithStateDir(root),
+				localusers.WithUseraddCmd(testutils.MockCommand(root, "useradd", tc.mockBehaviour)),
+				localusers.WithUsermodCmd(testutils.MockCommand(root, "usermod", tc.mockBehaviour)),
+				localusers.WithUserdelCmd(testutils.MockCommand(root, "userdel", tc.mockBehaviour)),
+				localusers.WithGroupaddCmd(testutils.MockCommand(root, "groupadd", tc.mockBehaviour)),
+				localusers.WithGroupdelCmd(testutils.MockCommand(root, "groupdel", tc.mockBehaviour)),
+				localusers.WithGpasswdCmd(testutils.MockCommand(root, "gpasswd", tc.mockBehaviour)),
+				localusers.WithGetentCmd(testutils.MockCommand(root, "getent", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, root, behaviour, args := c.Name, c.Root, c.Behaviour, c.Args
+
+	if behaviour == "fail-"+name ||
+		(len(args) > 0 && behaviour == "fail-"+name+args[0]) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+
+	// Lookups are answered from the accounts of testdata/system.
+	if name == "getent" {
+		f, err := os.Open(filepath.Join("testdata", "system", args[0]))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't open database: %v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if n, _, _ := strings.Cut(s.Text(), ":"); n == args[1] {
+				fmt.Println(s.Text())
+				return
+			}
+		}
+		// Key not found.
+		os.Exit(2)
+	}
+
+	// Log the call, replacing the temporary paths to get a stable output.
+	line := name
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+	line = strings.ReplaceAll(line, root, "#ROOT#")
+
+	c.Log(line)
+}
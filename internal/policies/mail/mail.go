@@ -0,0 +1,307 @@
+// Package mail provides a manager that provisions corporate mail, calendar and
+// address book settings for Evolution and Thunderbird.
+//
+// This manager only applies to computer objects.
+//
+// Evolution settings are written as read-only system sources, which are picked
+// up by evolution-data-server for every user of the machine:
+//   - adsys-imap.source and adsys-smtp.source for the IMAP/SMTP mail account;
+//   - adsys-ews.source for the Exchange Web Services collection (mail, calendar and contacts);
+//   - adsys-ldap.source for the LDAP address book.
+//
+// Thunderbird settings are written in its enterprise policies.json file and
+// declare the LDAP address book and the outgoing SMTP server. Any existing
+// policies.json file is overwritten as this file is fully managed by adsys.
+//
+// Every file is removed once its corresponding setting is disabled or not
+// configured anymore. If a value can't be parsed, the manager returns an error
+// and authentication will be prevented.
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	evolutionSourcePrefix    = "adsys-"
+	thunderbirdPoliciesFile  = "policies.json"
+	thunderbirdLDAPServerKey = "ldap_2.servers.adsys"
+
+	defaultIMAPPort = 993
+	defaultSMTPPort = 587
+	defaultLDAPPort = 389
+)
+
+// supportedKeys are the entry keys supported by the mail manager.
+var supportedKeys = []string{"imap-server", "smtp-server", "ews-url", "ldap-addressbook"}
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+
+// Manager provisions the mail client settings on the machine.
+type Manager struct {
+	evolutionSourcesDir    string
+	thunderbirdPoliciesDir string
+}
+
+type options struct {
+	evolutionSourcesDir    string
+	thunderbirdPoliciesDir string
+}
+
+// Option reprents an optional function to change the mail manager.
+type Option func(*options)
+
+// WithEvolutionSourcesDir overrides the default evolution-data-server system sources directory.
+func WithEvolutionSourcesDir(p string) func(*options) {
+	return func(a *options) {
+		a.evolutionSourcesDir = p
+	}
+}
+
+// WithThunderbirdPoliciesDir overrides the default Thunderbird enterprise policies directory.
+func WithThunderbirdPoliciesDir(p string) func(*options) {
+	return func(a *options) {
+		a.thunderbirdPoliciesDir = p
+	}
+}
+
+// New returns a new manager for the mail policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		evolutionSourcesDir:    consts.DefaultEvolutionSourcesDir,
+		thunderbirdPoliciesDir: consts.DefaultThunderbirdPoliciesDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		evolutionSourcesDir:    args.evolutionSourcesDir,
+		thunderbirdPoliciesDir: args.thunderbirdPoliciesDir,
+	}
+}
+
+// ApplyPolicy provisions the mail, calendar and address book settings from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply mail policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Mail policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying mail policy to %s", objectName)
+
+	values := make(map[string]string)
+	for _, e := range entries {
+		if e.Disabled || strings.TrimSpace(e.Value) == "" {
+			continue
+		}
+		if !slices.Contains(supportedKeys, e.Key) {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing mail entries, skipping it", e.Key))
+			continue
+		}
+		values[e.Key] = strings.TrimSpace(e.Value)
+	}
+
+	sources := make(map[string]string)
+	tbPrefs := make(map[string]any)
+
+	if v, ok := values["imap-server"]; ok {
+		host, port, err := splitHostPort(v, defaultIMAPPort)
+		if err != nil {
+			return errors.New(gotext.Get("invalid IMAP server %q: %v", v, err))
+		}
+		sources["imap"] = fmt.Sprintf(`[Data Source]
+DisplayName=%s
+Enabled=true
+
+[Mail Account]
+BackendName=imapx
+
+[Authentication]
+Host=%s
+Port=%d
+`, host, host, port)
+	}
+
+	if v, ok := values["smtp-server"]; ok {
+		host, port, err := splitHostPort(v, defaultSMTPPort)
+		if err != nil {
+			return errors.New(gotext.Get("invalid SMTP server %q: %v", v, err))
+		}
+		sources["smtp"] = fmt.Sprintf(`[Data Source]
+DisplayName=%s
+Enabled=true
+
+[Mail Transport]
+BackendName=smtp
+
+[Authentication]
+Host=%s
+Port=%d
+`, host, host, port)
+		tbPrefs["mail.smtpservers"] = "adsys"
+		tbPrefs["mail.smtp.defaultserver"] = "adsys"
+		tbPrefs["mail.smtpserver.adsys.hostname"] = host
+		tbPrefs["mail.smtpserver.adsys.port"] = port
+	}
+
+	if v, ok := values["ews-url"]; ok {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New(gotext.Get("invalid EWS URL %q: an https URL is expected", v))
+		}
+		sources["ews"] = fmt.Sprintf(`[Data Source]
+DisplayName=%s
+Enabled=true
+
+[Collection]
+BackendName=ews
+CalendarEnabled=true
+ContactsEnabled=true
+MailEnabled=true
+
+[Ews Folder]
+HostUrl=%s
+`, u.Hostname(), u.String())
+	}
+
+	if v, ok := values["ldap-addressbook"]; ok {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return errors.New(gotext.Get("invalid LDAP address book %q: an ldap:// or ldaps:// URL is expected", v))
+		}
+		defaultPort, security := defaultLDAPPort, "none"
+		if u.Scheme == "ldaps" {
+			defaultPort, security = 636, "ldaps"
+		}
+		host, port, err := splitHostPort(u.Host, defaultPort)
+		if err != nil {
+			return errors.New(gotext.Get("invalid LDAP address book %q: %v", v, err))
+		}
+		baseDN := strings.TrimPrefix(u.Path, "/")
+		sources["ldap"] = fmt.Sprintf(`[Data Source]
+DisplayName=%s
+Enabled=true
+Parent=ldap-stub
+
+[Address Book]
+BackendName=ldap
+
+[Authentication]
+Host=%s
+Port=%d
+
+[Ldap Backend]
+RootDn=%s
+Scope=subtree
+SecurityMethod=%s
+`, host, host, port, baseDN, security)
+		tbPrefs[thunderbirdLDAPServerKey+".description"] = host
+		tbPrefs[thunderbirdLDAPServerKey+".uri"] = u.String()
+		tbPrefs["ldap_2.autoComplete.useDirectory"] = true
+		tbPrefs["ldap_2.autoComplete.directoryServer"] = thunderbirdLDAPServerKey
+	}
+
+	for _, name := range []string{"imap", "smtp", "ews", "ldap"} {
+		p := filepath.Join(m.evolutionSourcesDir, evolutionSourcePrefix+name+".source")
+		content, ok := sources[name]
+		if !ok {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if err := writeFile(p, []byte(header+content)); err != nil {
+			return err
+		}
+	}
+
+	p := filepath.Join(m.thunderbirdPoliciesDir, thunderbirdPoliciesFile)
+	if len(tbPrefs) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	// JSON doesn't support comments: the file being managed by adsys is documented instead.
+	d, err := json.MarshalIndent(map[string]any{"policies": map[string]any{"Preferences": tbPrefs}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(p, append(d, '\n'))
+}
+
+// DumpState returns the Evolution sources and Thunderbird policies written during the last refresh of the machine.
+// The state is empty for users or if no mail policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump mail state of %s", objectName))
+
+	// Mail policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	var paths []string
+	for _, name := range []string{"imap", "smtp", "ews", "ldap"} {
+		paths = append(paths, filepath.Join(m.evolutionSourcesDir, evolutionSourcePrefix+name+".source"))
+	}
+	return syshelpers.DumpFiles(append(paths, filepath.Join(m.thunderbirdPoliciesDir, thunderbirdPoliciesFile))...)
+}
+
+// splitHostPort returns the host and port of v, which is of the form host[:port].
+// defaultPort is used if v doesn't contain any port.
+func splitHostPort(v string, defaultPort int) (host string, port int, err error) {
+	if !strings.Contains(v, ":") {
+		return v, defaultPort, nil
+	}
+
+	host, p, err := net.SplitHostPort(v)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err = strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, errors.New(gotext.Get("invalid port %q", p))
+	}
+	return host, port, nil
+}
+
+// writeFile atomically writes data to p, creating the parent directories if needed.
+func writeFile(p string, data []byte) error {
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 those files are world readable configuration files
+	if err := os.WriteFile(p+".new", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
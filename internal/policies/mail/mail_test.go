@@ -0,0 +1,90 @@
+package mail_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/mail"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "imap-server", Value: "imap.example.com"},
+		{Key: "smtp-server", Value: "smtp.example.com:465"},
+		{Key: "ews-url", Value: "https://mail.example.com/EWS/Exchange.asmx"},
+		{Key: "ldap-addressbook", Value: "ldap://adc.example.com/dc=example,dc=com"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		makeReadOnly  string
+
+		wantErr bool
+	}{
+		"IMAP server":                        {entries: []entry.Entry{{Key: "imap-server", Value: "imap.example.com"}}},
+		"IMAP server with port":              {entries: []entry.Entry{{Key: "imap-server", Value: "imap.example.com:143"}}},
+		"SMTP server":                        {entries: []entry.Entry{{Key: "smtp-server", Value: "smtp.example.com"}}},
+		"EWS URL":                            {entries: []entry.Entry{{Key: "ews-url", Value: "https://mail.example.com/EWS/Exchange.asmx"}}},
+		"LDAP address book":                  {entries: []entry.Entry{{Key: "ldap-addressbook", Value: "ldap://adc.example.com/dc=example,dc=com"}}},
+		"LDAP address book with ldaps":       {entries: []entry.Entry{{Key: "ldap-addressbook", Value: "ldaps://adc.example.com:3269/dc=example,dc=com"}}},
+		"All entries":                        {entries: allEntries},
+		"Values are trimmed":                 {entries: []entry.Entry{{Key: "imap-server", Value: "  imap.example.com\n"}}},
+		"Disabled entries are ignored":       {entries: []entry.Entry{{Key: "imap-server", Value: "imap.example.com"}, {Key: "smtp-server", Value: "smtp.example.com", Disabled: true}}},
+		"Empty entries are ignored":          {entries: []entry.Entry{{Key: "imap-server", Value: "imap.example.com"}, {Key: "smtp-server", Value: ""}}},
+		"Unsupported keys are ignored":       {entries: []entry.Entry{{Key: "imap-server", Value: "imap.example.com"}, {Key: "pop-server", Value: "pop.example.com"}}},
+		"No entries and no existing files":   {},
+		"No entries removes existing files":  {existingDirs: "all-files"},
+		"Only update changed existing files": {existingDirs: "all-files", entries: []entry.Entry{{Key: "imap-server", Value: "imap.example.com"}}},
+		"Don't touch other files":            {existingDirs: "other-files", entries: allEntries},
+		"Not a computer is a no-op":          {isNotComputer: true, existingDirs: "all-files"},
+
+		// Error cases
+		"Error on invalid IMAP port":                {entries: []entry.Entry{{Key: "imap-server", Value: "imap.example.com:notaport"}}, wantErr: true},
+		"Error on out of range SMTP port":           {entries: []entry.Entry{{Key: "smtp-server", Value: "smtp.example.com:70000"}}, wantErr: true},
+		"Error on non https EWS URL":                {entries: []entry.Entry{{Key: "ews-url", Value: "http://mail.example.com/EWS/Exchange.asmx"}}, wantErr: true},
+		"Error on non ldap address book URL":        {entries: []entry.Entry{{Key: "ldap-addressbook", Value: "https://adc.example.com"}}, wantErr: true},
+		"Error on address book URL without host":    {entries: []entry.Entry{{Key: "ldap-addressbook", Value: "ldap:///dc=example,dc=com"}}, wantErr: true},
+		"Error on unwritable evolution directory":   {entries: allEntries, existingDirs: "all-files", makeReadOnly: "evolution", wantErr: true},
+		"Error on unwritable thunderbird directory": {entries: allEntries, existingDirs: "all-files", makeReadOnly: "thunderbird", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			evolutionDir := filepath.Join(root, "evolution")
+			thunderbirdDir := filepath.Join(root, "thunderbird")
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.makeReadOnly != "" {
+				testutils.MakeReadOnly(t, filepath.Join(root, tc.makeReadOnly))
+			}
+
+			m := mail.New(mail.WithEvolutionSourcesDir(evolutionDir), mail.WithThunderbirdPoliciesDir(thunderbirdDir))
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
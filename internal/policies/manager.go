@@ -27,6 +27,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"slices"
@@ -37,17 +39,61 @@ import (
 	"github.com/godbus/dbus/v5"
 	"github.com/leonelquinteros/gotext"
 	"github.com/ubuntu/adsys/internal/ad/backends"
+	adcommon "github.com/ubuntu/adsys/internal/ad/common"
 	"github.com/ubuntu/adsys/internal/consts"
+	"github.com/ubuntu/adsys/internal/faultinject"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/hardware"
+	"github.com/ubuntu/adsys/internal/pkglock"
+	"github.com/ubuntu/adsys/internal/policies/accounts"
 	"github.com/ubuntu/adsys/internal/policies/apparmor"
+	"github.com/ubuntu/adsys/internal/policies/apt"
+	"github.com/ubuntu/adsys/internal/policies/audit"
+	"github.com/ubuntu/adsys/internal/policies/banners"
+	"github.com/ubuntu/adsys/internal/policies/broadcast"
 	"github.com/ubuntu/adsys/internal/policies/certificate"
+	"github.com/ubuntu/adsys/internal/policies/chrome"
+	"github.com/ubuntu/adsys/internal/policies/compliance"
 	"github.com/ubuntu/adsys/internal/policies/dconf"
+	"github.com/ubuntu/adsys/internal/policies/dns"
+	"github.com/ubuntu/adsys/internal/policies/encryption"
+	"github.com/ubuntu/adsys/internal/policies/enrollment"
 	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/files"
+	"github.com/ubuntu/adsys/internal/policies/firefox"
+	"github.com/ubuntu/adsys/internal/policies/firewall"
+	"github.com/ubuntu/adsys/internal/policies/flatpak"
 	"github.com/ubuntu/adsys/internal/policies/gdm"
+	"github.com/ubuntu/adsys/internal/policies/grub"
+	"github.com/ubuntu/adsys/internal/policies/history"
+	"github.com/ubuntu/adsys/internal/policies/ini"
+	"github.com/ubuntu/adsys/internal/policies/kmod"
+	"github.com/ubuntu/adsys/internal/policies/locale"
+	"github.com/ubuntu/adsys/internal/policies/localusers"
+	"github.com/ubuntu/adsys/internal/policies/mail"
 	"github.com/ubuntu/adsys/internal/policies/mount"
+	"github.com/ubuntu/adsys/internal/policies/network"
+	"github.com/ubuntu/adsys/internal/policies/polkit"
+	"github.com/ubuntu/adsys/internal/policies/power"
+	"github.com/ubuntu/adsys/internal/policies/printers"
 	"github.com/ubuntu/adsys/internal/policies/privilege"
 	"github.com/ubuntu/adsys/internal/policies/proxy"
+	"github.com/ubuntu/adsys/internal/policies/quota"
+	"github.com/ubuntu/adsys/internal/policies/report"
 	"github.com/ubuntu/adsys/internal/policies/scripts"
+	"github.com/ubuntu/adsys/internal/policies/selinux"
+	"github.com/ubuntu/adsys/internal/policies/services"
+	"github.com/ubuntu/adsys/internal/policies/session"
+	"github.com/ubuntu/adsys/internal/policies/shortcuts"
+	"github.com/ubuntu/adsys/internal/policies/snap"
+	"github.com/ubuntu/adsys/internal/policies/sshd"
+	"github.com/ubuntu/adsys/internal/policies/sysctl"
+	"github.com/ubuntu/adsys/internal/policies/tasks"
+	"github.com/ubuntu/adsys/internal/policies/timesync"
+	"github.com/ubuntu/adsys/internal/policies/updates"
+	"github.com/ubuntu/adsys/internal/policies/usbguard"
+	"github.com/ubuntu/adsys/internal/policies/vpn"
+	"github.com/ubuntu/adsys/internal/runlock"
 	"github.com/ubuntu/adsys/internal/systemd"
 	"github.com/ubuntu/decorate"
 	"golang.org/x/sync/errgroup"
@@ -55,23 +101,129 @@ import (
 
 // ProOnlyRules are the rules that are only available for Pro subscribers. They
 // will be filtered otherwise.
-var ProOnlyRules = []string{"privilege", "scripts", "mount", "apparmor", "proxy", "certificate"}
+var ProOnlyRules = []string{"privilege", "scripts", "mount", "apparmor", "proxy", "certificate", "mail", "session", "firewall", "apt", "snap", "flatpak", "services", "tasks", "files", "printers", "firefox", "chrome", "shortcuts", "ini", "sysctl", "report", "audit", "usbguard", "accounts", "localusers", "compliance", "updates", "encryption", "network", "vpn", "timesync", "sshd", "banners", "locale", "polkit", "power", "kmod", "grub", "quota", "selinux", "broadcast", "dns"}
+
+// ReadOnlyUnsupportedRules are the rules that can't be applied in read-only mode, as they change the
+// running system with external tools instead of writing files which can be staged.
+// They will be filtered in that mode.
+var ReadOnlyUnsupportedRules = []string{"enrollment", "mount", "proxy", "firewall", "apt", "snap", "flatpak", "services", "tasks", "printers", "sysctl", "audit", "usbguard", "accounts", "session", "localusers", "compliance", "encryption", "network", "vpn", "timesync", "sshd", "locale", "power", "grub", "quota", "selinux", "dns"}
+
+// TattooingRules are the rules whose settings are intentionally kept on the system once they are not configured
+// anymore, indexed by type, like the packages installed or the enrollment of the machine. Unlinking or deleting
+// the GPO which configured them doesn't revert them. A type without any key tattoos all its rules.
+var TattooingRules = map[string][]string{
+	"apt":        {"apt/install", "apt/remove"},
+	"snap":       {"snap/install", "snap/remove"},
+	"flatpak":    {"flatpak/install", "flatpak/remove", "flatpak/user-install", "flatpak/user-remove"},
+	"services":   nil,
+	"scripts":    nil,
+	"enrollment": nil,
+	"encryption": {"encryption/tpm"},
+	"printers":   {"printers/default", "printers/user-default"},
+	"session":    {"default-session", "default-session-groups"},
+	"locale":     {"locale/user-language", "locale/user-formats", "locale/user-groups"},
+}
+
+// isTattooing returns true if the setting of the rule of type t and key is kept on the system once it is not
+// configured anymore.
+func isTattooing(t, key string) bool {
+	keys, ok := TattooingRules[t]
+	if !ok {
+		return false
+	}
+	return len(keys) == 0 || slices.Contains(keys, key)
+}
+
+// RolloutRuleType is the rule type under which GPOs declare their rollout rings.
+const RolloutRuleType = "rollout"
+
+// TargetingRuleType is the rule type under which GPOs declare their hardware targeting expressions.
+const TargetingRuleType = "targeting"
+
+// EnrollmentRuleType is the rule type of the enrollment to Ubuntu Pro, which doesn't require it.
+const EnrollmentRuleType = "enrollment"
+
+// RuleTypes are all the rule types known by the managers, including the ones only used to filter GPOs.
+var RuleTypes = append([]string{"dconf", "gdm", EnrollmentRuleType, RolloutRuleType, TargetingRuleType}, ProOnlyRules...)
+
+// Security modules the mandatory access control policy can be applied with.
+const (
+	// SecurityModuleAppArmor applies the apparmor policy. This is the default.
+	SecurityModuleAppArmor = "apparmor"
+	// SecurityModuleSELinux applies the selinux policy instead, on SELinux-enabled derivatives.
+	SecurityModuleSELinux = "selinux"
+)
 
 // Manager handles all managers for various policy handlers.
 type Manager struct {
 	policiesCacheDir string
+	downloadsDir     string
 	hostname         string
-
-	backend backends.Backend
-
-	dconf       *dconf.Manager
-	privilege   *privilege.Manager
-	scripts     *scripts.Manager
-	mount       *mount.Manager
-	gdm         *gdm.Manager
-	apparmor    *apparmor.Manager
-	proxy       *proxy.Manager
-	certificate *certificate.Manager
+	rolloutRing      string
+	securityModule   string
+	runDir           string
+	lockDir          string
+	readOnly         bool
+	supportedRules   []string
+	now              func() time.Time
+	onFailure        func(manager string)
+
+	backend       backends.Backend
+	systemdCaller systemdCaller
+	hardware      *hardware.Collector
+	// packageLock orders the managers installing packages or restarting services against the package managers.
+	packageLock *pkglock.Waiter
+
+	dconf   *dconf.Manager
+	scripts *scripts.Manager
+	mount   *mount.Manager
+	gdm     *gdm.Manager
+	history *history.Manager
+
+	// The other managers are only built while they have rules to apply or to revert, or a request needs them,
+	// and released afterwards, so that the idle daemon doesn't keep them and their dependencies around.
+	privilege   *lazyManager[*privilege.Manager]
+	apparmor    *lazyManager[*apparmor.Manager]
+	proxy       *lazyManager[*proxy.Manager]
+	certificate *lazyManager[*certificate.Manager]
+	mail        *lazyManager[*mail.Manager]
+	session     *lazyManager[*session.Manager]
+	firewall    *lazyManager[*firewall.Manager]
+	apt         *lazyManager[*apt.Manager]
+	snap        *lazyManager[*snap.Manager]
+	flatpak     *lazyManager[*flatpak.Manager]
+	services    *lazyManager[*services.Manager]
+	tasks       *lazyManager[*tasks.Manager]
+	files       *lazyManager[*files.Manager]
+	printers    *lazyManager[*printers.Manager]
+	firefox     *lazyManager[*firefox.Manager]
+	chrome      *lazyManager[*chrome.Manager]
+	shortcuts   *lazyManager[*shortcuts.Manager]
+	ini         *lazyManager[*ini.Manager]
+	sysctl      *lazyManager[*sysctl.Manager]
+	report      *lazyManager[*report.Manager]
+	audit       *lazyManager[*audit.Manager]
+	usbguard    *lazyManager[*usbguard.Manager]
+	accounts    *lazyManager[*accounts.Manager]
+	localusers  *lazyManager[*localusers.Manager]
+	compliance  *lazyManager[*compliance.Manager]
+	updates     *lazyManager[*updates.Manager]
+	encryption  *lazyManager[*encryption.Manager]
+	network     *lazyManager[*network.Manager]
+	vpn         *lazyManager[*vpn.Manager]
+	enrollment  *lazyManager[*enrollment.Manager]
+	timesync    *lazyManager[*timesync.Manager]
+	sshd        *lazyManager[*sshd.Manager]
+	banners     *lazyManager[*banners.Manager]
+	locale      *lazyManager[*locale.Manager]
+	polkit      *lazyManager[*polkit.Manager]
+	power       *lazyManager[*power.Manager]
+	kmod        *lazyManager[*kmod.Manager]
+	grub        *lazyManager[*grub.Manager]
+	quota       *lazyManager[*quota.Manager]
+	selinux     *lazyManager[*selinux.Manager]
+	broadcast   *lazyManager[*broadcast.Manager]
+	dns         *lazyManager[*dns.Manager]
 
 	subscriptionDbus dbus.BusObject
 
@@ -89,27 +241,97 @@ type systemdCaller interface {
 	EnableUnit(context.Context, string) error
 	DisableUnit(context.Context, string) error
 
+	MaskUnit(context.Context, string) error
+	UnmaskUnit(context.Context, string) error
+
 	DaemonReload(context.Context) error
 }
 
+// StateDumper is implemented by the policy managers able to dump the raw state they applied, for debugging.
+type StateDumper interface {
+	DumpState(ctx context.Context, objectName string, isComputer bool) (string, error)
+}
+
 type options struct {
-	cacheDir       string
-	stateDir       string
-	dconfDir       string
-	sudoersDir     string
-	policyKitDir   string
-	runDir         string
-	shareDir       string
-	apparmorDir    string
-	apparmorFsDir  string
-	systemUnitDir  string
-	globalTrustDir string
-	proxyApplier   proxy.Caller
-	systemdCaller  systemdCaller
-	gdm            *gdm.Manager
+	cacheDir           string
+	stateDir           string
+	dconfDir           string
+	sudoersDir         string
+	policyKitDir       string
+	runDir             string
+	apparmorDir        string
+	apparmorFsDir      string
+	systemUnitDir      string
+	globalTrustDir     string
+	filesRootDir       string
+	iniRootDir         string
+	accountsRootDir    string
+	bannersRootDir     string
+	grubRootDir        string
+	dnsRootDir         string
+	packageLockRootDir string
+	rolloutRing        string
+	securityModule     string
+	stagingDir         string
+	history            bool
+	supportedRules     []string
+	onFailure          func(manager string)
+	proxyApplier       proxy.Caller
+	systemdCaller      systemdCaller
+	gdm                *gdm.Manager
+
+	evolutionSourcesDir    string
+	thunderbirdPoliciesDir string
+
+	firefoxPoliciesDir string
+	firefoxInstallDir  string
+
+	chromePoliciesDir   string
+	chromiumPoliciesDir string
+
+	shortcutsApplicationsDir string
+	shortcutsIconsDir        string
+
+	gdmConf          string
+	greeterAssetsDir string
+	portalsConfDir   string
+	portalsDataDir   string
+	userUnitDir      string
+
+	aptPreferencesDir string
+	aptSourcesDir     string
+	aptKeyringsDir    string
+	aptConfDir        string
+	connectionsDir    string
+	sysctlDir         string
+	auditRulesDir     string
+	usbguardRulesDir  string
+	chronySourcesDir  string
+	timesyncdConfDir  string
+	logindConfDir     string
+	modprobeDir       string
+	sshdConfigDir     string
+	sysDir            string
 
 	apparmorParserCmd []string
-	certAutoenrollCmd []string
+	getcertCmd        []string
+	ufwCmd            []string
+	nftCmd            []string
+	aptGetCmd         []string
+	dpkgQueryCmd      []string
+	snapCmd           []string
+	flatpakCmd        []string
+	findmntCmd        []string
+	lsblkCmd          []string
+	systemctlCmd      []string
+
+	enrollmentHTTPTimeout      time.Duration
+	helperExecTimeout          time.Duration
+	helperExecTimeoutOverrides map[string]time.Duration
+	ldapTimeout                time.Duration
+	packageLockTimeout         time.Duration
+
+	now func() time.Time
 }
 
 // Option reprents an optional function to change Policies behavior.
@@ -163,14 +385,6 @@ func WithRunDir(p string) Option {
 	}
 }
 
-// WithShareDir specifies a personalized share directory.
-func WithShareDir(p string) Option {
-	return func(o *options) error {
-		o.shareDir = p
-		return nil
-	}
-}
-
 // WithApparmorDir specifies a personalized apparmor directory.
 func WithApparmorDir(p string) Option {
 	return func(o *options) error {
@@ -196,7 +410,7 @@ func WithApparmorFsDir(p string) Option {
 	}
 }
 
-// WithSystemUnitDir specifies a personalized unit directory for adsys mount units.
+// WithSystemUnitDir specifies a personalized unit directory for adsys mount units and drop-ins.
 func WithSystemUnitDir(p string) Option {
 	return func(o *options) error {
 		o.systemUnitDir = p
@@ -213,218 +427,1396 @@ func WithGlobalTrustDir(p string) Option {
 	}
 }
 
-// WithProxyApplier specifies a personalized proxy applier for the proxy policy manager.
-func WithProxyApplier(p proxy.Caller) Option {
+// WithFilesRootDir specifies a personalized root directory for the files deployed by the files manager.
+func WithFilesRootDir(p string) Option {
 	return func(o *options) error {
-		o.proxyApplier = p
+		o.filesRootDir = p
 		return nil
 	}
 }
 
-// WithSystemdCaller specifies a personalized systemd caller for the policy managers.
-func WithSystemdCaller(p systemdCaller) Option {
+// WithIniRootDir specifies a personalized root directory for the files edited by the ini manager.
+func WithIniRootDir(p string) Option {
 	return func(o *options) error {
-		o.systemdCaller = p
+		o.iniRootDir = p
 		return nil
 	}
 }
 
-// WithCertAutoenrollCmd specifies a personalized certificate autoenroll command.
-func WithCertAutoenrollCmd(cmd []string) Option {
+// WithAccountsRootDir specifies a personalized root directory for the PAM configuration written by the accounts manager.
+func WithAccountsRootDir(p string) Option {
 	return func(o *options) error {
-		o.certAutoenrollCmd = cmd
+		o.accountsRootDir = p
 		return nil
 	}
 }
 
-// NewManager returns a new manager with all default policy handlers.
-func NewManager(bus *dbus.Conn, hostname string, backend backends.Backend, opts ...Option) (m *Manager, err error) {
-	defer decorate.OnError(&err, gotext.Get("can't create a new policy handlers manager"))
+// WithEvolutionSourcesDir specifies a personalized evolution-data-server system sources directory
+// for use with the mail manager.
+func WithEvolutionSourcesDir(p string) Option {
+	return func(o *options) error {
+		o.evolutionSourcesDir = p
+		return nil
+	}
+}
 
-	defaultSystemdCaller, err := systemd.New(bus)
-	if err != nil {
-		return nil, err
+// WithThunderbirdPoliciesDir specifies a personalized Thunderbird policies directory
+// for use with the mail manager.
+func WithThunderbirdPoliciesDir(p string) Option {
+	return func(o *options) error {
+		o.thunderbirdPoliciesDir = p
+		return nil
 	}
+}
 
-	// defaults
-	args := options{
-		cacheDir:       consts.DefaultCacheDir,
-		stateDir:       consts.DefaultStateDir,
-		runDir:         consts.DefaultRunDir,
-		shareDir:       consts.DefaultShareDir,
-		apparmorDir:    consts.DefaultApparmorDir,
-		systemUnitDir:  consts.DefaultSystemUnitDir,
-		globalTrustDir: consts.DefaultGlobalTrustDir,
-		systemdCaller:  defaultSystemdCaller,
-		gdm:            nil,
+// WithFirefoxPoliciesDir specifies a personalized Firefox policies directory
+// for use with the firefox manager.
+func WithFirefoxPoliciesDir(p string) Option {
+	return func(o *options) error {
+		o.firefoxPoliciesDir = p
+		return nil
 	}
-	// applied options (including dconf manager used by gdm)
-	for _, o := range opts {
-		if err := o(&args); err != nil {
-			return nil, err
-		}
+}
+
+// WithFirefoxInstallDir specifies a personalized installation directory of the Firefox deb package
+// for use with the firefox manager.
+func WithFirefoxInstallDir(p string) Option {
+	return func(o *options) error {
+		o.firefoxInstallDir = p
+		return nil
 	}
-	// dconf manager
-	dconfManager := &dconf.Manager{}
-	if args.dconfDir != "" {
-		dconfManager = dconf.NewWithDconfDir(args.dconfDir)
+}
+
+// WithChromePoliciesDir specifies a personalized Google Chrome policies directory
+// for use with the chrome manager.
+func WithChromePoliciesDir(p string) Option {
+	return func(o *options) error {
+		o.chromePoliciesDir = p
+		return nil
 	}
+}
 
-	// privilege manager
-	privilegeManager := privilege.NewWithDirs(args.sudoersDir, args.policyKitDir)
+// WithChromiumPoliciesDir specifies a personalized Chromium policies directory
+// for use with the chrome manager.
+func WithChromiumPoliciesDir(p string) Option {
+	return func(o *options) error {
+		o.chromiumPoliciesDir = p
+		return nil
+	}
+}
 
-	// scripts manager
-	scriptsManager, err := scripts.New(args.runDir, args.systemdCaller)
-	if err != nil {
-		return nil, err
+// WithShortcutsApplicationsDir specifies a personalized directory for the machine shortcuts
+// for use with the shortcuts manager.
+func WithShortcutsApplicationsDir(p string) Option {
+	return func(o *options) error {
+		o.shortcutsApplicationsDir = p
+		return nil
 	}
+}
 
-	// mount manager
-	mountManager, err := mount.New(args.runDir, args.systemUnitDir, args.systemdCaller)
-	if err != nil {
-		return nil, err
+// WithShortcutsIconsDir specifies a personalized directory for the icons of the machine shortcuts
+// for use with the shortcuts manager.
+func WithShortcutsIconsDir(p string) Option {
+	return func(o *options) error {
+		o.shortcutsIconsDir = p
+		return nil
 	}
+}
 
-	// apparmor manager
-	var apparmorOptions []apparmor.Option
-	if args.apparmorParserCmd != nil {
-		apparmorOptions = append(apparmorOptions, apparmor.WithApparmorParserCmd(args.apparmorParserCmd))
+// WithGDMConf specifies a personalized GDM custom configuration file
+// for use with the session and gdm managers.
+func WithGDMConf(p string) Option {
+	return func(o *options) error {
+		o.gdmConf = p
+		return nil
 	}
-	if args.apparmorFsDir != "" {
-		apparmorOptions = append(apparmorOptions, apparmor.WithApparmorFsDir(args.apparmorFsDir))
+}
+
+// WithGreeterAssetsDir specifies a personalized directory for the login screen images
+// for use with the gdm manager.
+func WithGreeterAssetsDir(p string) Option {
+	return func(o *options) error {
+		o.greeterAssetsDir = p
+		return nil
 	}
-	apparmorManager := apparmor.New(args.apparmorDir, apparmorOptions...)
+}
 
-	// proxy manager
-	var proxyOptions []proxy.Option
-	if args.proxyApplier != nil {
-		proxyOptions = append(proxyOptions, proxy.WithProxyApplier(args.proxyApplier))
+// WithPortalsConfDir specifies a personalized xdg-desktop-portal system configuration directory
+// for use with the session manager.
+func WithPortalsConfDir(p string) Option {
+	return func(o *options) error {
+		o.portalsConfDir = p
+		return nil
 	}
-	proxyManager := proxy.New(bus, proxyOptions...)
+}
 
-	// certificate manager
-	certificateOpts := []certificate.Option{
-		certificate.WithStateDir(args.stateDir),
-		certificate.WithRunDir(args.runDir),
-		certificate.WithShareDir(args.shareDir),
-		certificate.WithGlobalTrustDir(args.globalTrustDir),
+// WithPortalsDataDir specifies a personalized directory for the xdg-desktop-portal configuration
+// shipped by the distribution, for use with the session manager.
+func WithPortalsDataDir(p string) Option {
+	return func(o *options) error {
+		o.portalsDataDir = p
+		return nil
 	}
-	if args.certAutoenrollCmd != nil {
-		certificateOpts = append(certificateOpts, certificate.WithCertAutoenrollCmd(args.certAutoenrollCmd))
+}
+
+// WithUserUnitDir specifies a personalized unit directory for systemd user units drop-ins
+// for use with the session manager.
+func WithUserUnitDir(p string) Option {
+	return func(o *options) error {
+		o.userUnitDir = p
+		return nil
 	}
-	certificateManager := certificate.New(backend.Domain(), certificateOpts...)
+}
 
-	// inject applied dconf mangager if we need to build a gdm manager
-	if args.gdm == nil {
-		if args.gdm, err = gdm.New(gdm.WithDconf(dconfManager)); err != nil {
-			return nil, err
+// WithRolloutRing specifies the rollout ring the machine is assigned to.
+func WithRolloutRing(ring string) Option {
+	return func(o *options) error {
+		o.rolloutRing = ring
+		return nil
+	}
+}
+
+// WithSecurityModule specifies the security module the mandatory access control policy is applied with:
+// SecurityModuleAppArmor or SecurityModuleSELinux.
+func WithSecurityModule(name string) Option {
+	return func(o *options) error {
+		if name != SecurityModuleAppArmor && name != SecurityModuleSELinux {
+			return errors.New(gotext.Get("unsupported security module %q: expected %s or %s", name, SecurityModuleAppArmor, SecurityModuleSELinux))
 		}
+		o.securityModule = name
+		return nil
 	}
+}
 
-	policiesCacheDir := filepath.Join(args.cacheDir, PoliciesCacheBaseName)
-	if err := os.MkdirAll(policiesCacheDir, 0700); err != nil {
-		return nil, err
+// WithReadOnly enables the read-only mode for immutable systems: files which would be written to
+// /etc or /usr are staged under stagingDir instead, and rules which can't be staged are not applied.
+func WithReadOnly(stagingDir string) Option {
+	return func(o *options) error {
+		o.stagingDir = stagingDir
+		return nil
 	}
+}
 
-	subscriptionDbus := bus.Object(consts.SubscriptionDbusRegisteredName,
-		dbus.ObjectPath(consts.SubscriptionDbusObjectPath))
+// WithHistory records the policy artifacts rendered on the machine after each refresh in a git
+// repository, under the history directory of the state directory.
+func WithHistory() Option {
+	return func(o *options) error {
+		o.history = true
+		return nil
+	}
+}
 
-	return &Manager{
-		backend:          backend,
-		policiesCacheDir: policiesCacheDir,
-		hostname:         hostname,
-		dconf:            dconfManager,
-		privilege:        privilegeManager,
-		scripts:          scriptsManager,
-		mount:            mountManager,
-		apparmor:         apparmorManager,
-		proxy:            proxyManager,
-		certificate:      certificateManager,
-		gdm:              args.gdm,
+// WithFailureHook calls onFailure with the name of each policy manager failing to apply its rules.
+func WithFailureHook(onFailure func(manager string)) Option {
+	return func(o *options) error {
+		o.onFailure = onFailure
+		return nil
+	}
+}
 
-		subscriptionDbus: subscriptionDbus,
+// WithProxyApplier specifies a personalized proxy applier for the proxy policy manager.
+func WithProxyApplier(p proxy.Caller) Option {
+	return func(o *options) error {
+		o.proxyApplier = p
+		return nil
+	}
+}
 
-		muMu:     &sync.Mutex{},
-		objectMu: make(map[string]*sync.Mutex),
-	}, nil
+// WithSystemdCaller specifies a personalized systemd caller for the policy managers.
+func WithSystemdCaller(p systemdCaller) Option {
+	return func(o *options) error {
+		o.systemdCaller = p
+		return nil
+	}
 }
 
-// ApplyPolicies generates a computer or user policy based on a list of entries
-// retrieved from a directory service.
-func (m *Manager) ApplyPolicies(ctx context.Context, objectName string, isComputer bool, pols *Policies) (err error) {
-	defer decorate.OnError(&err, gotext.Get("failed to apply policy to %q", objectName))
+// WithGetcertCmd specifies a personalized certmonger getcert command for use
+// with the certificate manager.
+func WithGetcertCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.getcertCmd = cmd
+		return nil
+	}
+}
 
-	// We have a lock per objectName to prevent multiple instances of ApplyPolicies for the same object.
-	m.muMu.Lock()
-	if _, ok := m.objectMu[objectName]; !ok {
-		m.objectMu[objectName] = &sync.Mutex{}
+// WithUfwCmd specifies a personalized ufw command for use with the firewall manager.
+func WithUfwCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.ufwCmd = cmd
+		return nil
 	}
-	m.objectMu[objectName].Lock()
-	defer m.objectMu[objectName].Unlock()
-	m.muMu.Unlock()
+}
 
-	rules := pols.GetUniqueRules()
-	action := gotext.Get("Applying")
-	if len(rules) == 0 {
-		action = gotext.Get("Unloading")
+// WithNftCmd specifies a personalized nft command for use with the firewall manager.
+func WithNftCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.nftCmd = cmd
+		return nil
 	}
-	log.Info(ctx, gotext.Get("%s policies for %s (machine: %v)", action, objectName, isComputer))
+}
 
-	var g errgroup.Group
-	// Applying dconf policies take a while to complete, so it's better to start applying them before
-	// querying dbus for the Pro subscription state, as it does not rely on that.
-	g.Go(func() error {
-		return m.dconf.ApplyPolicy(ctx, objectName, isComputer, rules["dconf"])
-	})
-	if !m.GetSubscriptionState(ctx) {
-		if filteredRules := filterRules(ctx, rules); len(filteredRules) > 0 {
-			log.Warning(ctx, gotext.Get("Rules from the following policy types will be filtered out as the machine is not enrolled to Ubuntu Pro: %s", strings.Join(filteredRules, ", ")))
-		}
+// WithAptPreferencesDir specifies a personalized apt preferences directory
+// for use with the apt manager.
+func WithAptPreferencesDir(p string) Option {
+	return func(o *options) error {
+		o.aptPreferencesDir = p
+		return nil
 	}
+}
 
-	g.Go(func() error {
-		return m.privilege.ApplyPolicy(ctx, objectName, isComputer, rules["privilege"])
-	})
-	g.Go(func() error {
-		return m.scripts.ApplyPolicy(ctx, objectName, isComputer, rules["scripts"], pols.SaveAssetsTo)
-	})
-	g.Go(func() error {
-		return m.mount.ApplyPolicy(ctx, objectName, isComputer, rules["mount"])
-	})
-	g.Go(func() error {
-		return m.apparmor.ApplyPolicy(ctx, objectName, isComputer, rules["apparmor"], pols.SaveAssetsTo)
-	})
-	g.Go(func() error {
-		return m.proxy.ApplyPolicy(ctx, objectName, isComputer, rules["proxy"])
-	})
-	g.Go(func() error {
-		// Ignore error as we don't want to fail because of online status this late in the process
-		isOnline, _ := m.backend.IsOnline()
-		return m.certificate.ApplyPolicy(ctx, objectName, isComputer, isOnline, rules["certificate"])
-	})
-	if err := g.Wait(); err != nil {
-		return err
+// WithAptSourcesDir specifies a personalized apt sources directory
+// for use with the apt manager.
+func WithAptSourcesDir(p string) Option {
+	return func(o *options) error {
+		o.aptSourcesDir = p
+		return nil
 	}
+}
 
-	if isComputer {
-		// Apply GDM policy only now as we need dconf machine database to be ready first
-		if err := m.gdm.ApplyPolicy(ctx, rules["gdm"]); err != nil {
-			return err
-		}
+// WithAptKeyringsDir specifies a personalized directory for the apt repositories signing keys
+// for use with the apt manager.
+func WithAptKeyringsDir(p string) Option {
+	return func(o *options) error {
+		o.aptKeyringsDir = p
+		return nil
 	}
+}
 
-	// Write cache Policies
-	return pols.Save(filepath.Join(m.policiesCacheDir, objectName))
+// WithNetworkConnectionsDir specifies a personalized NetworkManager system connections directory
+// for use with the network and vpn managers.
+func WithNetworkConnectionsDir(p string) Option {
+	return func(o *options) error {
+		o.connectionsDir = p
+		return nil
+	}
 }
 
-// DumpPolicies displays the currently applied policies and rules (since last update) for objectName.
-// It can in addition show the rules and overridden content.
-func (m *Manager) DumpPolicies(ctx context.Context, objectName string, computerOnly, withRules, withOverridden bool) (msg string, err error) {
-	defer decorate.OnError(&err, gotext.Get("failed to dump policies for %q", objectName))
+// WithAptConfDir specifies a personalized apt configuration directory
+// for use with the automatic updates manager.
+func WithAptConfDir(p string) Option {
+	return func(o *options) error {
+		o.aptConfDir = p
+		return nil
+	}
+}
 
-	log.Infof(ctx, "Dumping policies for %s", objectName)
+// WithSysctlDir specifies a personalized sysctl.d configuration directory
+// for use with the sysctl manager.
+func WithSysctlDir(p string) Option {
+	return func(o *options) error {
+		o.sysctlDir = p
+		return nil
+	}
+}
 
-	var out strings.Builder
+// WithAuditRulesDir specifies a personalized audit rules directory
+// for use with the audit manager.
+func WithAuditRulesDir(p string) Option {
+	return func(o *options) error {
+		o.auditRulesDir = p
+		return nil
+	}
+}
+
+// WithUSBGuardRulesDir specifies a personalized USBGuard rules directory
+// for use with the usbguard manager.
+func WithUSBGuardRulesDir(p string) Option {
+	return func(o *options) error {
+		o.usbguardRulesDir = p
+		return nil
+	}
+}
+
+// WithChronySourcesDir specifies a personalized chrony sources directory
+// for use with the time synchronization manager.
+func WithChronySourcesDir(p string) Option {
+	return func(o *options) error {
+		o.chronySourcesDir = p
+		return nil
+	}
+}
+
+// WithTimesyncdConfDir specifies a personalized systemd-timesyncd configuration directory
+// for use with the time synchronization manager.
+func WithTimesyncdConfDir(p string) Option {
+	return func(o *options) error {
+		o.timesyncdConfDir = p
+		return nil
+	}
+}
+
+// WithBannersRootDir specifies a personalized root directory for the files written by the banners manager.
+func WithBannersRootDir(p string) Option {
+	return func(o *options) error {
+		o.bannersRootDir = p
+		return nil
+	}
+}
+
+// WithGrubRootDir specifies a personalized root directory for the files written by the grub manager.
+func WithGrubRootDir(p string) Option {
+	return func(o *options) error {
+		o.grubRootDir = p
+		return nil
+	}
+}
+
+// WithDNSRootDir specifies a personalized root directory for the hosts file and the systemd-resolved
+// configuration written by the dns manager.
+func WithDNSRootDir(p string) Option {
+	return func(o *options) error {
+		o.dnsRootDir = p
+		return nil
+	}
+}
+
+// WithPackageLockRootDir specifies a personalized root directory for the dpkg and apt lock files and the snapd
+// socket, used to detect the package manager transactions.
+func WithPackageLockRootDir(p string) Option {
+	return func(o *options) error {
+		o.packageLockRootDir = p
+		return nil
+	}
+}
+
+// WithLogindConfDir specifies a personalized systemd-logind configuration directory
+// for use with the power management manager.
+func WithLogindConfDir(p string) Option {
+	return func(o *options) error {
+		o.logindConfDir = p
+		return nil
+	}
+}
+
+// WithModprobeDir specifies a personalized modprobe configuration directory
+// for use with the kernel modules manager.
+func WithModprobeDir(p string) Option {
+	return func(o *options) error {
+		o.modprobeDir = p
+		return nil
+	}
+}
+
+// WithSSHDConfigDir specifies a personalized sshd configuration directory
+// for use with the sshd manager.
+func WithSSHDConfigDir(p string) Option {
+	return func(o *options) error {
+		o.sshdConfigDir = p
+		return nil
+	}
+}
+
+// WithAptGetCmd specifies a personalized apt-get command for use with the apt manager.
+func WithAptGetCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.aptGetCmd = cmd
+		return nil
+	}
+}
+
+// WithDpkgQueryCmd specifies a personalized dpkg-query command for use with the apt manager.
+func WithDpkgQueryCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.dpkgQueryCmd = cmd
+		return nil
+	}
+}
+
+// WithSnapCmd specifies a personalized snap command for use with the snap manager.
+func WithSnapCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.snapCmd = cmd
+		return nil
+	}
+}
+
+// WithFlatpakCmd specifies a personalized flatpak command for use with the flatpak manager.
+func WithFlatpakCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.flatpakCmd = cmd
+		return nil
+	}
+}
+
+// WithSysDir specifies a personalized sysfs directory to collect the hardware facts from.
+func WithSysDir(p string) Option {
+	return func(o *options) error {
+		o.sysDir = p
+		return nil
+	}
+}
+
+// WithFindmntCmd specifies a personalized findmnt command to collect the hardware facts.
+func WithFindmntCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.findmntCmd = cmd
+		return nil
+	}
+}
+
+// WithLsblkCmd specifies a personalized lsblk command to collect the hardware facts.
+func WithLsblkCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.lsblkCmd = cmd
+		return nil
+	}
+}
+
+// WithSystemctlCmd specifies a personalized systemctl command to watch the user script units.
+func WithSystemctlCmd(cmd []string) Option {
+	return func(o *options) error {
+		o.systemctlCmd = cmd
+		return nil
+	}
+}
+
+// WithEnrollmentHTTPTimeout specifies a personalized maximum time of each HTTP request
+// during certificate enrollment.
+func WithEnrollmentHTTPTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		o.enrollmentHTTPTimeout = timeout
+		return nil
+	}
+}
+
+// WithHelperExecTimeout specifies a personalized maximum time of the external helper
+// commands run by the policy managers.
+func WithHelperExecTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		o.helperExecTimeout = timeout
+		return nil
+	}
+}
+
+// WithHelperExecTimeoutOverrides specifies personalized maximum times of the external helper commands
+// run by the policy managers, indexed by rule type. They take precedence over WithHelperExecTimeout.
+func WithHelperExecTimeoutOverrides(timeouts map[string]time.Duration) Option {
+	return func(o *options) error {
+		o.helperExecTimeoutOverrides = timeouts
+		return nil
+	}
+}
+
+// WithLdapTimeout specifies a personalized maximum time of each LDAP request of the policy managers
+// to the directory.
+func WithLdapTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		o.ldapTimeout = timeout
+		return nil
+	}
+}
+
+// WithPackageLockTimeout specifies a personalized maximum time to wait for the package manager transactions
+// to complete before installing packages or restarting services.
+func WithPackageLockTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		o.packageLockTimeout = timeout
+		return nil
+	}
+}
+
+// helperExecTimeoutFor returns the maximum time of the external helper commands of the policy manager
+// handling the rule type t. 0 keeps the default of the manager.
+func (o options) helperExecTimeoutFor(t string) time.Duration {
+	if timeout, ok := o.helperExecTimeoutOverrides[t]; ok {
+		return timeout
+	}
+	return o.helperExecTimeout
+}
+
+// NewManager returns a new manager with all default policy handlers.
+func NewManager(bus *dbus.Conn, hostname string, backend backends.Backend, opts ...Option) (m *Manager, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't create a new policy handlers manager"))
+
+	defaultSystemdCaller, err := systemd.New(bus)
+	if err != nil {
+		return nil, err
+	}
+
+	// defaults
+	args := options{
+		cacheDir:       consts.DefaultCacheDir,
+		stateDir:       consts.DefaultStateDir,
+		runDir:         consts.DefaultRunDir,
+		apparmorDir:    consts.DefaultApparmorDir,
+		systemUnitDir:  consts.DefaultSystemUnitDir,
+		globalTrustDir: consts.DefaultGlobalTrustDir,
+		securityModule: SecurityModuleAppArmor,
+		systemdCaller:  defaultSystemdCaller,
+		supportedRules: SupportedRules,
+		gdm:            nil,
+		now:            time.Now,
+	}
+	// applied options (including dconf manager used by gdm)
+	for _, o := range opts {
+		if err := o(&args); err != nil {
+			return nil, err
+		}
+	}
+	if args.stagingDir != "" {
+		stageSystemDirs(&args)
+		// The polkit rules are only deployed if the rules directory exists, which depends on the installed polkit
+		// version. They are always staged, for review before deploying them.
+		// nolint:gosec // G301 match distribution permission
+		if err := os.MkdirAll(filepath.Join(args.policyKitDir, "rules.d"), 0755); err != nil {
+			return nil, err
+		}
+	}
+	// dconf manager
+	dconfManager := &dconf.Manager{}
+	if args.dconfDir != "" {
+		dconfManager = dconf.NewWithDconfDir(args.dconfDir)
+	}
+
+	// privilege manager
+	var privilegeOptions []privilege.Option
+	if timeout := args.helperExecTimeoutFor("privilege"); timeout != 0 {
+		privilegeOptions = append(privilegeOptions, privilege.WithCmdTimeout(timeout))
+	}
+	privilegeManager := newLazyManager(func() *privilege.Manager {
+		return privilege.NewWithDirs(args.sudoersDir, args.policyKitDir, privilegeOptions...)
+	})
+
+	// scripts manager
+	scriptsOptions := []scripts.Option{scripts.WithDomain(backend.Domain())}
+	if args.systemctlCmd != nil {
+		scriptsOptions = append(scriptsOptions, scripts.WithSystemctlCmd(args.systemctlCmd))
+	}
+	scriptsManager, err := scripts.New(args.runDir, args.systemdCaller, scriptsOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	// mount manager
+	mountManager, err := mount.New(args.runDir, args.systemUnitDir, args.systemdCaller)
+	if err != nil {
+		return nil, err
+	}
+
+	// apparmor manager
+	var apparmorOptions []apparmor.Option
+	if args.apparmorParserCmd != nil {
+		apparmorOptions = append(apparmorOptions, apparmor.WithApparmorParserCmd(args.apparmorParserCmd))
+	}
+	if args.apparmorFsDir != "" {
+		apparmorOptions = append(apparmorOptions, apparmor.WithApparmorFsDir(args.apparmorFsDir))
+	}
+	apparmorManager := newLazyManager(func() *apparmor.Manager { return apparmor.New(args.apparmorDir, apparmorOptions...) })
+
+	// proxy manager
+	var proxyOptions []proxy.Option
+	if args.proxyApplier != nil {
+		proxyOptions = append(proxyOptions, proxy.WithProxyApplier(args.proxyApplier))
+	}
+	proxyManager := newLazyManager(func() *proxy.Manager { return proxy.New(bus, proxyOptions...) })
+
+	// certificate manager
+	certificateOpts := []certificate.Option{
+		certificate.WithStateDir(args.stateDir),
+		certificate.WithRunDir(args.runDir),
+		certificate.WithGlobalTrustDir(args.globalTrustDir),
+	}
+	if args.getcertCmd != nil {
+		certificateOpts = append(certificateOpts, certificate.WithGetcertCmd(args.getcertCmd))
+	}
+	if args.enrollmentHTTPTimeout != 0 {
+		certificateOpts = append(certificateOpts, certificate.WithHTTPTimeout(args.enrollmentHTTPTimeout))
+	}
+	if timeout := args.helperExecTimeoutFor("certificate"); timeout != 0 {
+		certificateOpts = append(certificateOpts, certificate.WithCmdTimeout(timeout))
+	}
+	if args.ldapTimeout != 0 {
+		certificateOpts = append(certificateOpts, certificate.WithLdapTimeout(args.ldapTimeout))
+	}
+	certificateManager := newLazyManager(func() *certificate.Manager { return certificate.New(backend.Domain(), certificateOpts...) })
+
+	// mail manager
+	var mailOptions []mail.Option
+	if args.evolutionSourcesDir != "" {
+		mailOptions = append(mailOptions, mail.WithEvolutionSourcesDir(args.evolutionSourcesDir))
+	}
+	if args.thunderbirdPoliciesDir != "" {
+		mailOptions = append(mailOptions, mail.WithThunderbirdPoliciesDir(args.thunderbirdPoliciesDir))
+	}
+	mailManager := newLazyManager(func() *mail.Manager { return mail.New(mailOptions...) })
+
+	// firefox manager
+	var firefoxOptions []firefox.Option
+	if args.firefoxPoliciesDir != "" {
+		firefoxOptions = append(firefoxOptions, firefox.WithPoliciesDir(args.firefoxPoliciesDir))
+	}
+	if args.firefoxInstallDir != "" {
+		firefoxOptions = append(firefoxOptions, firefox.WithInstallDir(args.firefoxInstallDir))
+	}
+	firefoxManager := newLazyManager(func() *firefox.Manager { return firefox.New(firefoxOptions...) })
+
+	// chrome manager
+	chromeOptions := []chrome.Option{chrome.WithStateDir(args.stateDir)}
+	if args.chromePoliciesDir != "" {
+		chromeOptions = append(chromeOptions, chrome.WithChromePoliciesDir(args.chromePoliciesDir))
+	}
+	if args.chromiumPoliciesDir != "" {
+		chromeOptions = append(chromeOptions, chrome.WithChromiumPoliciesDir(args.chromiumPoliciesDir))
+	}
+	chromeManager := newLazyManager(func() *chrome.Manager { return chrome.New(chromeOptions...) })
+
+	// shortcuts manager
+	shortcutsOptions := []shortcuts.Option{shortcuts.WithStateDir(args.stateDir)}
+	if args.shortcutsApplicationsDir != "" {
+		shortcutsOptions = append(shortcutsOptions, shortcuts.WithApplicationsDir(args.shortcutsApplicationsDir))
+	}
+	if args.shortcutsIconsDir != "" {
+		shortcutsOptions = append(shortcutsOptions, shortcuts.WithIconsDir(args.shortcutsIconsDir))
+	}
+	shortcutsManager := newLazyManager(func() *shortcuts.Manager { return shortcuts.New(shortcutsOptions...) })
+
+	// session manager
+	sessionOptions := []session.Option{session.WithSystemUnitDir(args.systemUnitDir), session.WithStateDir(args.stateDir)}
+	if args.gdmConf != "" {
+		sessionOptions = append(sessionOptions, session.WithGDMConf(args.gdmConf))
+	}
+	if args.portalsConfDir != "" {
+		sessionOptions = append(sessionOptions, session.WithPortalsConfDir(args.portalsConfDir))
+	}
+	if args.portalsDataDir != "" {
+		sessionOptions = append(sessionOptions, session.WithPortalsDataDir(args.portalsDataDir))
+	}
+	if args.userUnitDir != "" {
+		sessionOptions = append(sessionOptions, session.WithUserUnitDir(args.userUnitDir))
+	}
+	sessionManager := newLazyManager(func() *session.Manager { return session.New(bus, args.systemdCaller, sessionOptions...) })
+
+	// firewall manager
+	firewallOptions := []firewall.Option{firewall.WithStateDir(args.stateDir)}
+	if args.ufwCmd != nil {
+		firewallOptions = append(firewallOptions, firewall.WithUfwCmd(args.ufwCmd))
+	}
+	if args.nftCmd != nil {
+		firewallOptions = append(firewallOptions, firewall.WithNftCmd(args.nftCmd))
+	}
+	if timeout := args.helperExecTimeoutFor("firewall"); timeout != 0 {
+		firewallOptions = append(firewallOptions, firewall.WithCmdTimeout(timeout))
+	}
+	firewallManager := newLazyManager(func() *firewall.Manager { return firewall.New(firewallOptions...) })
+
+	// apt manager
+	aptOptions := []apt.Option{apt.WithStateDir(args.stateDir)}
+	if args.aptPreferencesDir != "" {
+		aptOptions = append(aptOptions, apt.WithPreferencesDir(args.aptPreferencesDir))
+	}
+	if args.aptSourcesDir != "" {
+		aptOptions = append(aptOptions, apt.WithSourcesDir(args.aptSourcesDir))
+	}
+	if args.aptKeyringsDir != "" {
+		aptOptions = append(aptOptions, apt.WithKeyringsDir(args.aptKeyringsDir))
+	}
+	if args.aptGetCmd != nil {
+		aptOptions = append(aptOptions, apt.WithAptGetCmd(args.aptGetCmd))
+	}
+	if args.dpkgQueryCmd != nil {
+		aptOptions = append(aptOptions, apt.WithDpkgQueryCmd(args.dpkgQueryCmd))
+	}
+	aptManager := newLazyManager(func() *apt.Manager { return apt.New(aptOptions...) })
+
+	// snap manager
+	snapOptions := []snap.Option{snap.WithStateDir(args.stateDir)}
+	if args.snapCmd != nil {
+		snapOptions = append(snapOptions, snap.WithSnapCmd(args.snapCmd))
+	}
+	if timeout := args.helperExecTimeoutFor("snap"); timeout != 0 {
+		snapOptions = append(snapOptions, snap.WithCmdTimeout(timeout))
+	}
+	snapManager := newLazyManager(func() *snap.Manager { return snap.New(snapOptions...) })
+
+	// flatpak manager
+	flatpakOptions := []flatpak.Option{flatpak.WithStateDir(args.stateDir)}
+	if args.flatpakCmd != nil {
+		flatpakOptions = append(flatpakOptions, flatpak.WithFlatpakCmd(args.flatpakCmd))
+	}
+	if timeout := args.helperExecTimeoutFor("flatpak"); timeout != 0 {
+		flatpakOptions = append(flatpakOptions, flatpak.WithCmdTimeout(timeout))
+	}
+	flatpakManager := newLazyManager(func() *flatpak.Manager { return flatpak.New(flatpakOptions...) })
+
+	// services manager
+	servicesManager := newLazyManager(func() *services.Manager {
+		return services.New(args.systemdCaller, services.WithStateDir(args.stateDir))
+	})
+
+	// scheduled tasks manager
+	tasksManager := newLazyManager(func() *tasks.Manager {
+		return tasks.New(args.systemdCaller, tasks.WithSystemUnitDir(args.systemUnitDir))
+	})
+
+	// files manager
+	filesOptions := []files.Option{files.WithStateDir(args.stateDir)}
+	if args.filesRootDir != "" {
+		filesOptions = append(filesOptions, files.WithRootDir(args.filesRootDir))
+	}
+	filesManager := newLazyManager(func() *files.Manager { return files.New(filesOptions...) })
+
+	// ini manager
+	iniOptions := []ini.Option{ini.WithStateDir(args.stateDir)}
+	if args.iniRootDir != "" {
+		iniOptions = append(iniOptions, ini.WithRootDir(args.iniRootDir))
+	}
+	iniManager := newLazyManager(func() *ini.Manager { return ini.New(iniOptions...) })
+
+	// sysctl manager
+	sysctlOptions := []sysctl.Option{sysctl.WithStateDir(args.stateDir)}
+	if args.sysctlDir != "" {
+		sysctlOptions = append(sysctlOptions, sysctl.WithSysctlDir(args.sysctlDir))
+	}
+	if timeout := args.helperExecTimeoutFor("sysctl"); timeout != 0 {
+		sysctlOptions = append(sysctlOptions, sysctl.WithCmdTimeout(timeout))
+	}
+	sysctlManager := newLazyManager(func() *sysctl.Manager { return sysctl.New(sysctlOptions...) })
+
+	// report manager
+	reportManager := newLazyManager(func() *report.Manager { return report.New(report.WithStateDir(args.stateDir)) })
+
+	// audit manager
+	var auditOptions []audit.Option
+	if args.auditRulesDir != "" {
+		auditOptions = append(auditOptions, audit.WithRulesDir(args.auditRulesDir))
+	}
+	if timeout := args.helperExecTimeoutFor("audit"); timeout != 0 {
+		auditOptions = append(auditOptions, audit.WithCmdTimeout(timeout))
+	}
+	auditManager := newLazyManager(func() *audit.Manager { return audit.New(auditOptions...) })
+
+	// usbguard manager
+	var usbguardOptions []usbguard.Option
+	if args.usbguardRulesDir != "" {
+		usbguardOptions = append(usbguardOptions, usbguard.WithRulesDir(args.usbguardRulesDir))
+	}
+	usbguardManager := newLazyManager(func() *usbguard.Manager { return usbguard.New(args.systemdCaller, usbguardOptions...) })
+
+	// accounts manager
+	var accountsOptions []accounts.Option
+	if args.accountsRootDir != "" {
+		accountsOptions = append(accountsOptions, accounts.WithRootDir(args.accountsRootDir))
+	}
+	if timeout := args.helperExecTimeoutFor("accounts"); timeout != 0 {
+		accountsOptions = append(accountsOptions, accounts.WithCmdTimeout(timeout))
+	}
+	accountsManager := newLazyManager(func() *accounts.Manager { return accounts.New(accountsOptions...) })
+
+	// local users and groups manager
+	localusersOptions := []localusers.Option{localusers.WithStateDir(args.stateDir)}
+	if timeout := args.helperExecTimeoutFor("localusers"); timeout != 0 {
+		localusersOptions = append(localusersOptions, localusers.WithCmdTimeout(timeout))
+	}
+	localusersManager := newLazyManager(func() *localusers.Manager { return localusers.New(localusersOptions...) })
+
+	// compliance manager
+	complianceOptions := []compliance.Option{
+		compliance.WithStateDir(args.stateDir),
+		compliance.WithRunDir(args.runDir),
+	}
+	if args.ufwCmd != nil {
+		complianceOptions = append(complianceOptions, compliance.WithUfwCmd(args.ufwCmd))
+	}
+	if args.nftCmd != nil {
+		complianceOptions = append(complianceOptions, compliance.WithNftCmd(args.nftCmd))
+	}
+	if timeout := args.helperExecTimeoutFor("compliance"); timeout != 0 {
+		complianceOptions = append(complianceOptions, compliance.WithCmdTimeout(timeout))
+	}
+	if args.ldapTimeout != 0 {
+		complianceOptions = append(complianceOptions, compliance.WithLdapTimeout(args.ldapTimeout))
+	}
+	complianceManager := newLazyManager(func() *compliance.Manager { return compliance.New(backend.Domain(), complianceOptions...) })
+
+	// automatic updates manager
+	var updatesOptions []updates.Option
+	if args.aptConfDir != "" {
+		updatesOptions = append(updatesOptions, updates.WithAptConfDir(args.aptConfDir))
+	}
+	updatesManager := newLazyManager(func() *updates.Manager { return updates.New(updatesOptions...) })
+
+	// disk encryption manager
+	encryptionOptions := []encryption.Option{
+		encryption.WithStateDir(args.stateDir),
+		encryption.WithRunDir(args.runDir),
+	}
+	if timeout := args.helperExecTimeoutFor("encryption"); timeout != 0 {
+		encryptionOptions = append(encryptionOptions, encryption.WithCmdTimeout(timeout))
+	}
+	if args.ldapTimeout != 0 {
+		encryptionOptions = append(encryptionOptions, encryption.WithLdapTimeout(args.ldapTimeout))
+	}
+	encryptionManager := newLazyManager(func() *encryption.Manager { return encryption.New(backend.Domain(), encryptionOptions...) })
+
+	// network manager
+	networkOptions := []network.Option{network.WithStateDir(args.stateDir)}
+	if args.connectionsDir != "" {
+		networkOptions = append(networkOptions, network.WithConnectionsDir(args.connectionsDir))
+	}
+	if timeout := args.helperExecTimeoutFor("network"); timeout != 0 {
+		networkOptions = append(networkOptions, network.WithCmdTimeout(timeout))
+	}
+	networkManager := newLazyManager(func() *network.Manager { return network.New(backend.Domain(), networkOptions...) })
+
+	// vpn manager
+	vpnOptions := []vpn.Option{vpn.WithStateDir(args.stateDir)}
+	if args.connectionsDir != "" {
+		vpnOptions = append(vpnOptions, vpn.WithConnectionsDir(args.connectionsDir))
+	}
+	if timeout := args.helperExecTimeoutFor("vpn"); timeout != 0 {
+		vpnOptions = append(vpnOptions, vpn.WithCmdTimeout(timeout))
+	}
+	vpnManager := newLazyManager(func() *vpn.Manager { return vpn.New(vpnOptions...) })
+
+	// enrollment manager
+	enrollmentOptions := []enrollment.Option{enrollment.WithStateDir(args.stateDir)}
+	if timeout := args.helperExecTimeoutFor("enrollment"); timeout != 0 {
+		enrollmentOptions = append(enrollmentOptions, enrollment.WithCmdTimeout(timeout))
+	}
+	enrollmentManager := newLazyManager(func() *enrollment.Manager { return enrollment.New(enrollmentOptions...) })
+
+	// time synchronization manager
+	var timesyncOptions []timesync.Option
+	if args.chronySourcesDir != "" {
+		timesyncOptions = append(timesyncOptions, timesync.WithChronySourcesDir(args.chronySourcesDir))
+	}
+	if args.timesyncdConfDir != "" {
+		timesyncOptions = append(timesyncOptions, timesync.WithTimesyncdConfDir(args.timesyncdConfDir))
+	}
+	if timeout := args.helperExecTimeoutFor("timesync"); timeout != 0 {
+		timesyncOptions = append(timesyncOptions, timesync.WithCmdTimeout(timeout))
+	}
+	timesyncManager := newLazyManager(func() *timesync.Manager { return timesync.New(timesyncOptions...) })
+
+	// sshd manager
+	var sshdOptions []sshd.Option
+	if args.sshdConfigDir != "" {
+		sshdOptions = append(sshdOptions, sshd.WithSSHDConfigDir(args.sshdConfigDir))
+	}
+	if timeout := args.helperExecTimeoutFor("sshd"); timeout != 0 {
+		sshdOptions = append(sshdOptions, sshd.WithCmdTimeout(timeout))
+	}
+	sshdManager := newLazyManager(func() *sshd.Manager { return sshd.New(sshdOptions...) })
+
+	// banners manager
+	bannersOptions := []banners.Option{banners.WithStateDir(args.stateDir)}
+	if args.bannersRootDir != "" {
+		bannersOptions = append(bannersOptions, banners.WithRootDir(args.bannersRootDir))
+	}
+	bannersManager := newLazyManager(func() *banners.Manager { return banners.New(bannersOptions...) })
+
+	// locale manager
+	localeManager := newLazyManager(func() *locale.Manager { return locale.New(bus, locale.WithStateDir(args.stateDir)) })
+
+	// polkit manager
+	var polkitOptions []polkit.Option
+	if args.policyKitDir != "" {
+		polkitOptions = append(polkitOptions, polkit.WithRulesDir(filepath.Join(args.policyKitDir, "rules.d")))
+	}
+	polkitManager := newLazyManager(func() *polkit.Manager { return polkit.New(polkitOptions...) })
+
+	// power manager
+	var powerOptions []power.Option
+	if args.logindConfDir != "" {
+		powerOptions = append(powerOptions, power.WithLogindConfDir(args.logindConfDir))
+	}
+	if timeout := args.helperExecTimeoutFor("power"); timeout != 0 {
+		powerOptions = append(powerOptions, power.WithCmdTimeout(timeout))
+	}
+	powerManager := newLazyManager(func() *power.Manager { return power.New(powerOptions...) })
+
+	// kernel modules manager
+	var kmodOptions []kmod.Option
+	if args.modprobeDir != "" {
+		kmodOptions = append(kmodOptions, kmod.WithModprobeDir(args.modprobeDir))
+	}
+	kmodManager := newLazyManager(func() *kmod.Manager { return kmod.New(kmodOptions...) })
+
+	// grub manager
+	var grubOptions []grub.Option
+	if args.grubRootDir != "" {
+		grubOptions = append(grubOptions, grub.WithRootDir(args.grubRootDir))
+	}
+	if timeout := args.helperExecTimeoutFor("grub"); timeout != 0 {
+		grubOptions = append(grubOptions, grub.WithCmdTimeout(timeout))
+	}
+	grubManager := newLazyManager(func() *grub.Manager { return grub.New(grubOptions...) })
+
+	// disk quota manager
+	quotaOptions := []quota.Option{quota.WithStateDir(args.stateDir)}
+	if timeout := args.helperExecTimeoutFor("quota"); timeout != 0 {
+		quotaOptions = append(quotaOptions, quota.WithCmdTimeout(timeout))
+	}
+	quotaManager := newLazyManager(func() *quota.Manager { return quota.New(quotaOptions...) })
+
+	// selinux manager
+	selinuxOptions := []selinux.Option{selinux.WithStateDir(args.stateDir)}
+	if timeout := args.helperExecTimeoutFor("selinux"); timeout != 0 {
+		selinuxOptions = append(selinuxOptions, selinux.WithCmdTimeout(timeout))
+	}
+	selinuxManager := newLazyManager(func() *selinux.Manager { return selinux.New(selinuxOptions...) })
+
+	// broadcast message manager
+	broadcastOptions := []broadcast.Option{broadcast.WithStateDir(args.stateDir)}
+	if timeout := args.helperExecTimeoutFor("broadcast"); timeout != 0 {
+		broadcastOptions = append(broadcastOptions, broadcast.WithCmdTimeout(timeout))
+	}
+	broadcastManager := newLazyManager(func() *broadcast.Manager { return broadcast.New(broadcastOptions...) })
+
+	// dns manager
+	var dnsOptions []dns.Option
+	if args.dnsRootDir != "" {
+		dnsOptions = append(dnsOptions, dns.WithRootDir(args.dnsRootDir))
+	}
+	if timeout := args.helperExecTimeoutFor("dns"); timeout != 0 {
+		dnsOptions = append(dnsOptions, dns.WithCmdTimeout(timeout))
+	}
+	dnsManager := newLazyManager(func() *dns.Manager { return dns.New(dnsOptions...) })
+
+	// printers manager
+	printersOptions := []printers.Option{printers.WithStateDir(args.stateDir)}
+	if timeout := args.helperExecTimeoutFor("printers"); timeout != 0 {
+		printersOptions = append(printersOptions, printers.WithCmdTimeout(timeout))
+	}
+	printersManager := newLazyManager(func() *printers.Manager { return printers.New(printersOptions...) })
+
+	policiesCacheDir := filepath.Join(args.cacheDir, PoliciesCacheBaseName)
+
+	// history manager
+	var historyManager *history.Manager
+	if args.history {
+		var historyOptions []history.Option
+		if args.helperExecTimeout != 0 {
+			historyOptions = append(historyOptions, history.WithCmdTimeout(args.helperExecTimeout))
+		}
+		historyManager = history.New(filepath.Join(args.stateDir, "history"), historySources(args, policiesCacheDir), historyOptions...)
+	}
+
+	// inject applied dconf mangager if we need to build a gdm manager
+	if args.gdm == nil {
+		gdmOptions := []gdm.Option{gdm.WithDconf(dconfManager)}
+		if args.gdmConf != "" {
+			gdmOptions = append(gdmOptions, gdm.WithGDMConf(args.gdmConf))
+		}
+		if args.greeterAssetsDir != "" {
+			gdmOptions = append(gdmOptions, gdm.WithAssetsDir(args.greeterAssetsDir))
+		}
+		if args.gdm, err = gdm.New(gdmOptions...); err != nil {
+			return nil, err
+		}
+	}
+
+	// hardware facts collector
+	hardwareOptions := []hardware.Option{hardware.WithCacheDir(args.cacheDir)}
+	if args.sysDir != "" {
+		hardwareOptions = append(hardwareOptions, hardware.WithSysDir(args.sysDir))
+	}
+	if args.findmntCmd != nil {
+		hardwareOptions = append(hardwareOptions, hardware.WithFindmntCmd(args.findmntCmd))
+	}
+	if args.lsblkCmd != nil {
+		hardwareOptions = append(hardwareOptions, hardware.WithLsblkCmd(args.lsblkCmd))
+	}
+	if args.helperExecTimeout != 0 {
+		hardwareOptions = append(hardwareOptions, hardware.WithCmdTimeout(args.helperExecTimeout))
+	}
+	hardwareCollector := hardware.New(hardwareOptions...)
+
+	// package manager transactions waiter
+	var packageLockOptions []pkglock.Option
+	if args.packageLockRootDir != "" {
+		packageLockOptions = append(packageLockOptions, pkglock.WithRootDir(args.packageLockRootDir))
+	}
+	if args.packageLockTimeout != 0 {
+		packageLockOptions = append(packageLockOptions, pkglock.WithTimeout(args.packageLockTimeout))
+	}
+
+	if err := os.MkdirAll(policiesCacheDir, 0700); err != nil {
+		return nil, err
+	}
+
+	subscriptionDbus := bus.Object(consts.SubscriptionDbusRegisteredName,
+		dbus.ObjectPath(consts.SubscriptionDbusObjectPath))
+
+	return &Manager{
+		backend:          backend,
+		policiesCacheDir: policiesCacheDir,
+		downloadsDir:     filepath.Join(args.cacheDir, DownloadedPoliciesCacheBaseName),
+		hostname:         hostname,
+		rolloutRing:      args.rolloutRing,
+		securityModule:   args.securityModule,
+		runDir:           args.runDir,
+		lockDir:          filepath.Join(args.stateDir, "locks"),
+		readOnly:         args.stagingDir != "",
+		supportedRules:   args.supportedRules,
+		now:              args.now,
+		onFailure:        args.onFailure,
+		systemdCaller:    args.systemdCaller,
+		hardware:         hardwareCollector,
+		packageLock:      pkglock.New(packageLockOptions...),
+		dconf:            dconfManager,
+		privilege:        privilegeManager,
+		scripts:          scriptsManager,
+		mount:            mountManager,
+		apparmor:         apparmorManager,
+		proxy:            proxyManager,
+		certificate:      certificateManager,
+		mail:             mailManager,
+		session:          sessionManager,
+		firewall:         firewallManager,
+		apt:              aptManager,
+		snap:             snapManager,
+		flatpak:          flatpakManager,
+		services:         servicesManager,
+		tasks:            tasksManager,
+		files:            filesManager,
+		printers:         printersManager,
+		firefox:          firefoxManager,
+		chrome:           chromeManager,
+		shortcuts:        shortcutsManager,
+		ini:              iniManager,
+		sysctl:           sysctlManager,
+		report:           reportManager,
+		audit:            auditManager,
+		usbguard:         usbguardManager,
+		accounts:         accountsManager,
+		localusers:       localusersManager,
+		compliance:       complianceManager,
+		updates:          updatesManager,
+		encryption:       encryptionManager,
+		network:          networkManager,
+		vpn:              vpnManager,
+		enrollment:       enrollmentManager,
+		timesync:         timesyncManager,
+		sshd:             sshdManager,
+		banners:          bannersManager,
+		locale:           localeManager,
+		polkit:           polkitManager,
+		power:            powerManager,
+		kmod:             kmodManager,
+		grub:             grubManager,
+		quota:            quotaManager,
+		selinux:          selinuxManager,
+		broadcast:        broadcastManager,
+		dns:              dnsManager,
+		history:          historyManager,
+		gdm:              args.gdm,
+
+		subscriptionDbus: subscriptionDbus,
+
+		muMu:     &sync.Mutex{},
+		objectMu: make(map[string]*sync.Mutex),
+	}, nil
+}
+
+// ApplyPolicies generates a computer or user policy based on a list of entries
+// retrieved from a directory service.
+// It returns the outcome of each policy manager, indexed by rule type, once they started applying their rules,
+// even if some of them failed.
+func (m *Manager) ApplyPolicies(ctx context.Context, objectName string, isComputer bool, pols *Policies) (results map[string]ManagerResult, err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to apply policy to %q", objectName))
+
+	// We have a lock per objectName to prevent multiple instances of ApplyPolicies for the same object.
+	m.muMu.Lock()
+	if _, ok := m.objectMu[objectName]; !ok {
+		m.objectMu[objectName] = &sync.Mutex{}
+	}
+	m.objectMu[objectName].Lock()
+	defer m.objectMu[objectName].Unlock()
+	m.muMu.Unlock()
+
+	// The lock file prevents other processes from applying policies to the same object concurrently.
+	// It is kept in the state directory, and taken over if left behind by a crash or a power loss.
+	// It is taken in read-only mode too, as the staging directory and the caches are still written.
+	l, err := runlock.Acquire(ctx, filepath.Join(m.lockDir, objectName+".lock"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := l.Release(); err != nil {
+			log.Warning(ctx, err)
+		}
+	}()
+
+	// The history is recorded even if the policies failed to apply, as some managers may have changed the system.
+	if m.history != nil {
+		defer func() { m.recordHistory(ctx, objectName, isComputer, err) }()
+	}
+
+	// An empty list of GPOs, like when purging, unloads the policies instead of applying them.
+	unloading := len(pols.GPOs) == 0
+	pols.GPOs = filterGPOsForRing(ctx, pols.GPOs, m.rolloutRing)
+	facts := m.hardwareFacts(ctx, isComputer)
+	pols.GPOs = filterGPOsForHardware(ctx, pols.GPOs, facts)
+	flavor, desktops := detectTarget(ctx)
+	pols.GPOs = filterEntriesForTarget(ctx, pols.GPOs, flavor, desktops)
+
+	// Rules in audit mode keep the rules previously applied in their place, and their changes are only logged.
+	previous, err := NewFromCache(ctx, filepath.Join(m.policiesCacheDir, objectName))
+	if err != nil {
+		log.Debugf(ctx, "No previous policies to compare against for %s: %v", objectName, err)
+		previous = Policies{}
+	}
+	if err := previous.Close(); err != nil {
+		return nil, err
+	}
+	rules := pols.AuditRules(ctx, pols.GetUniqueRules(), previous)
+	previousRules := previous.GetUniqueRules()
+	// Rules of GPOs not applied anymore are reverted by their managers, as they are not part of the rules anymore.
+	pols.TrackRemoved(ctx, previous)
+	action := gotext.Get("Applying")
+	if len(rules) == 0 {
+		action = gotext.Get("Unloading")
+	}
+	log.Info(ctx, gotext.Get("%s policies for %s (machine: %v)", action, objectName, isComputer))
+
+	skipped := make(map[string]SkipReason)
+	for _, rule := range managedRules(isComputer) {
+		if len(rules[rule]) == 0 {
+			skipped[rule] = SkipNoEntries
+		}
+	}
+
+	if len(m.supportedRules) > 0 {
+		if filteredRules := filterUnsupportedRules(ctx, rules, m.supportedRules); len(filteredRules) > 0 {
+			log.Warning(ctx, gotext.Get("Rules from the following policy types are not supported by this build of adsys and will be filtered out: %s", strings.Join(filteredRules, ", ")))
+			markSkipped(skipped, filteredRules, SkipUnsupported)
+		}
+	}
+
+	var g managersGroup
+	// Applying dconf policies take a while to complete, so it's better to start applying them before
+	// querying dbus for the Pro subscription state, as it does not rely on that.
+	m.goApplyManager(&g, "dconf", func() error {
+		return m.dconf.ApplyPolicy(ctx, objectName, isComputer, rules["dconf"])
+	})
+	if !m.GetSubscriptionState(ctx) {
+		if filteredRules := filterRules(ctx, rules); len(filteredRules) > 0 {
+			log.Warning(ctx, gotext.Get("Rules from the following policy types will be filtered out as the machine is not enrolled to Ubuntu Pro: %s", strings.Join(filteredRules, ", ")))
+			markSkipped(skipped, filteredRules, SkipNotEntitled)
+		}
+	}
+	if m.readOnly {
+		if filteredRules := filterReadOnlyRules(ctx, rules, isComputer); len(filteredRules) > 0 {
+			log.Warning(ctx, gotext.Get("Rules from the following policy types are not supported in read-only mode and will be filtered out: %s", strings.Join(filteredRules, ", ")))
+			markSkipped(skipped, filteredRules, SkipDisabled)
+		}
+	}
+
+	m.goApplyManager(&g, "scripts", func() error {
+		return m.scripts.ApplyPolicy(ctx, objectName, isComputer, rules["scripts"], pols.gpoNames(), pols.SaveAssetsTo)
+	})
+	m.goApplyManager(&g, "mount", func() error {
+		return m.mount.ApplyPolicy(ctx, objectName, isComputer, rules["mount"])
+	})
+	r := applyRequest{objectName: objectName, isComputer: isComputer, rules: rules, pols: pols, facts: facts}
+	for _, a := range m.onDemandAppliers() {
+		// Those managers are only built if they have rules to apply, or rules previously applied to revert.
+		if len(rules[a.ruleType]) == 0 && len(previousRules[a.ruleType]) == 0 {
+			continue
+		}
+		m.goApplyManager(&g, a.ruleType, func() error { return a.apply(ctx, r) })
+	}
+	if err := g.Wait(); err != nil {
+		return g.results(isComputer, skipped, true), err
+	}
+
+	if isComputer {
+		// Apply GDM policy only now as we need dconf machine database to be ready first
+		err := m.applyManager("gdm", func() error { return m.gdm.ApplyPolicy(ctx, rules["gdm"], pols.SaveAssetsTo) })
+		g.record("gdm", err)
+		if err != nil {
+			return g.results(isComputer, skipped, true), err
+		}
+	}
+	results = g.results(isComputer, skipped, false)
+
+	// Track when each effective rule last changed, compared to the previously applied policies.
+	now := m.now()
+	pols.TrackChanges(previous, now.Truncate(time.Second))
+	pols.Skipped = skipped
+	pols.Warnings = nil
+	for k, w := range m.dconf.Warnings(objectName) {
+		if pols.Warnings == nil {
+			pols.Warnings = make(map[string]string)
+		}
+		pols.Warnings[filepath.Join("dconf", k)] = w
+	}
+
+	// Write cache Policies
+	cachePath := filepath.Join(m.policiesCacheDir, objectName)
+	if err := pols.Save(cachePath); err != nil {
+		return results, err
+	}
+	// Rewriting the cache doesn't always change the modification time of its directory, the last update time.
+	if err := os.Chtimes(cachePath, now, now); err != nil {
+		return results, err
+	}
+
+	if !isComputer {
+		return results, nil
+	}
+	if unloading {
+		return results, m.unmarkMachinePolicyApplied()
+	}
+	return results, m.markMachinePolicyApplied(ctx)
+}
+
+// recordHistory commits the policy artifacts rendered on the machine once the policies of objectName are applied.
+// Failing to record the history doesn't fail the refresh.
+func (m *Manager) recordHistory(ctx context.Context, objectName string, isComputer bool, applyErr error) {
+	message := gotext.Get("Apply policies of user %s", objectName)
+	if isComputer {
+		message = gotext.Get("Apply policies of machine %s", objectName)
+	}
+	if applyErr != nil {
+		message = fmt.Sprintf("%s\n\n%s", message, gotext.Get("Some policies failed to apply: %v", applyErr))
+	}
+	if err := m.history.Record(ctx, message); err != nil {
+		log.Warning(ctx, err)
+	}
+}
+
+// goApplyManager runs applyManager for the manager name in g, recording its outcome.
+func (m *Manager) goApplyManager(g *managersGroup, name string, apply func() error) {
+	g.Go(func() error {
+		err := m.applyManager(name, apply)
+		g.record(name, err)
+		return err
+	})
+}
+
+// applyManager applies the rules of the manager name with apply, unless a failure is injected for it.
+// Its failures are reported to the failure hook, if any.
+func (m *Manager) applyManager(name string, apply func() error) error {
+	err := faultinject.ManagerError(name)
+	if err == nil {
+		err = apply()
+	}
+	if err != nil && m.onFailure != nil {
+		m.onFailure(name)
+	}
+	return err
+}
+
+// ManagerStatus is the outcome of a policy manager during a refresh.
+type ManagerStatus string
+
+const (
+	// ManagerOK is used when the manager applied its rules successfully.
+	ManagerOK ManagerStatus = "ok"
+	// ManagerFailed is used when the manager failed to apply its rules.
+	ManagerFailed ManagerStatus = "failed"
+	// ManagerSkipped is used when the manager had no rule to apply or wasn't applied.
+	ManagerSkipped ManagerStatus = "skipped"
+)
+
+// ManagerResult is the outcome of a policy manager during a refresh, with the reason why it failed or was skipped.
+type ManagerResult struct {
+	Status ManagerStatus
+	Reason string
+}
+
+// managersGroup applies the rules of the policy managers concurrently and records their outcome.
+type managersGroup struct {
+	errgroup.Group
+
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+// record records the outcome err of the manager name.
+func (g *managersGroup) record(name string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.errs == nil {
+		g.errs = make(map[string]error)
+	}
+	g.errs[name] = err
+}
+
+// results returns the outcome of the managers handling the rules of a computer or a user.
+// The managers which didn't run are skipped, either because the refresh was aborted after the failure of other
+// managers or because they are not applied on this system.
+func (g *managersGroup) results(isComputer bool, skipped map[string]SkipReason, aborted bool) map[string]ManagerResult {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	results := make(map[string]ManagerResult)
+	for _, rule := range managedRules(isComputer) {
+		err, ran := g.errs[rule]
+		switch {
+		case err != nil:
+			results[rule] = ManagerResult{Status: ManagerFailed, Reason: err.Error()}
+		case skipped[rule] != "":
+			results[rule] = ManagerResult{Status: ManagerSkipped, Reason: skipped[rule].String()}
+		case ran:
+			results[rule] = ManagerResult{Status: ManagerOK}
+		case aborted:
+			results[rule] = ManagerResult{Status: ManagerSkipped, Reason: gotext.Get("not applied after the failure of other policy types")}
+		default:
+			results[rule] = ManagerResult{Status: ManagerSkipped, Reason: SkipUnsupported.String()}
+		}
+	}
+	return results
+}
+
+// markMachinePolicyApplied creates the flag the machine policy applied target is waiting for and
+// starts the target, so that units ordered against it can proceed.
+// It also recovers the target from a previous degraded state (timeout on boot).
+func (m *Manager) markMachinePolicyApplied(ctx context.Context) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't mark machine policies as applied"))
+
+	machineDir := filepath.Join(m.runDir, "machine")
+	if err := os.MkdirAll(machineDir, 0750); err != nil {
+		return err
+	}
+	// #nosec G306. This flag is only used as a condition by systemd units.
+	if err := os.WriteFile(filepath.Join(machineDir, consts.MachinePolicyAppliedFlag), nil, 0644); err != nil {
+		return err
+	}
+
+	// Don't fail the refresh if the target can't be started: policies are already applied.
+	if err := m.systemdCaller.StartUnit(ctx, consts.AdsysMachinePolicyAppliedTargetName); err != nil {
+		log.Warning(ctx, gotext.Get("Couldn't start %s: %v", consts.AdsysMachinePolicyAppliedTargetName, err))
+	}
+	return nil
+}
+
+// unmarkMachinePolicyApplied removes the flag the machine policy applied target is waiting for, so that
+// units ordered against it wait again for policies to be applied.
+func (m *Manager) unmarkMachinePolicyApplied() (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't unmark machine policies as applied"))
+
+	if err := os.Remove(filepath.Join(m.runDir, "machine", consts.MachinePolicyAppliedFlag)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// DumpPolicies displays the currently applied policies and rules (since last update) for objectName.
+// It can in addition show the rules and overridden content.
+// If since is not 0, only the rules which changed within that duration are displayed, with the time of their last change.
+func (m *Manager) DumpPolicies(ctx context.Context, objectName string, computerOnly, withRules, withOverridden bool, since time.Duration) (msg string, err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to dump policies for %q", objectName))
+
+	log.Infof(ctx, "Dumping policies for %s", objectName)
+
+	// Changes are tracked per rule, so filtering on them implies displaying rules.
+	var cutoff time.Time
+	if since > 0 {
+		withRules = true
+		cutoff = m.now().Add(-since)
+	}
+	changes := func(pols Policies) map[string]time.Time {
+		if cutoff.IsZero() {
+			return nil
+		}
+		return pols.ChangedSince(cutoff)
+	}
+
+	var out strings.Builder
 
 	var alreadyProcessedRules map[string]struct{}
 	if !computerOnly {
@@ -433,8 +1825,16 @@ func (m *Manager) DumpPolicies(ctx context.Context, objectName string, computerO
 		if err != nil {
 			return "", errors.New(gotext.Get("no policy applied for %q: %v", m.hostname, err))
 		}
+		hostChanges := changes(policiesHost)
 		for _, g := range policiesHost.GPOs {
-			alreadyProcessedRules = g.Format(&out, withRules, withOverridden, alreadyProcessedRules)
+			alreadyProcessedRules = g.Format(&out, withRules, withOverridden, alreadyProcessedRules, hostChanges, policiesHost.Warnings)
+		}
+		if withOverridden {
+			formatSkipped(&out, policiesHost.Skipped)
+			formatRemoved(&out, policiesHost.Removed)
+		}
+		if withRules {
+			m.formatScriptsResults(ctx, &out, m.hostname, true)
 		}
 		fmt.Fprintln(&out, gotext.Get("Policies from user configuration:"))
 	}
@@ -445,13 +1845,278 @@ func (m *Manager) DumpPolicies(ctx context.Context, objectName string, computerO
 		log.Info(ctx, gotext.Get("User %q not found on cache.", objectName))
 		return "", errors.New(gotext.Get("no policy applied for %q: %v", objectName, err))
 	}
+	targetChanges := changes(policiesTarget)
 	for _, g := range policiesTarget.GPOs {
-		alreadyProcessedRules = g.Format(&out, withRules, withOverridden, alreadyProcessedRules)
+		alreadyProcessedRules = g.Format(&out, withRules, withOverridden, alreadyProcessedRules, targetChanges, policiesTarget.Warnings)
+	}
+	if withOverridden {
+		formatSkipped(&out, policiesTarget.Skipped)
+		formatRemoved(&out, policiesTarget.Removed)
+	}
+	if withRules {
+		m.formatScriptsResults(ctx, &out, objectName, computerOnly)
+	}
+
+	return out.String(), nil
+}
+
+// DumpState returns the raw state applied to objectName by the policy manager named manager, like the content
+// of the files it generated or what it loaded in the system.
+func (m *Manager) DumpState(ctx context.Context, manager, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to dump %s state for %q", manager, objectName))
+
+	log.Infof(ctx, "Dumping %s state for %s", manager, objectName)
+
+	dumpers := m.stateDumpers()
+	d, ok := dumpers[manager]
+	if !ok {
+		var names []string
+		for n := range dumpers {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return "", errors.New(gotext.Get("%q can't dump its state, supported policy managers are: %s", manager, strings.Join(names, ", ")))
+	}
+
+	state, err = d.DumpState(ctx, objectName, isComputer)
+	if err != nil {
+		return "", err
+	}
+	if state == "" {
+		return gotext.Get("No %s state applied to %s.", manager, objectName) + "\n", nil
+	}
+	return state, nil
+}
+
+// stateDumpers returns the policy managers able to dump their state, by name.
+//
+// The following managers are deliberately left out:
+//   - scripts and mount, which only prepare the scripts and mounts of the sessions in the run directory;
+//   - gdm and session, which edit the GDM configuration shared with the administrator and the dconf manager;
+//   - proxy, which delegates the configuration to the proxy applier;
+//   - certificate, encryption, network and vpn, whose state contains private keys, recovery keys or credentials;
+//   - history, which already is a record of what the other managers applied.
+func (m *Manager) stateDumpers() map[string]StateDumper {
+	return map[string]StateDumper{
+		"dconf":      m.dconf,
+		"privilege":  lazyStateDumper(m.privilege),
+		"apparmor":   lazyStateDumper(m.apparmor),
+		"mail":       lazyStateDumper(m.mail),
+		"firewall":   lazyStateDumper(m.firewall),
+		"apt":        lazyStateDumper(m.apt),
+		"snap":       lazyStateDumper(m.snap),
+		"flatpak":    lazyStateDumper(m.flatpak),
+		"services":   lazyStateDumper(m.services),
+		"tasks":      lazyStateDumper(m.tasks),
+		"files":      lazyStateDumper(m.files),
+		"printers":   lazyStateDumper(m.printers),
+		"firefox":    lazyStateDumper(m.firefox),
+		"chrome":     lazyStateDumper(m.chrome),
+		"shortcuts":  lazyStateDumper(m.shortcuts),
+		"ini":        lazyStateDumper(m.ini),
+		"sysctl":     lazyStateDumper(m.sysctl),
+		"report":     lazyStateDumper(m.report),
+		"audit":      lazyStateDumper(m.audit),
+		"usbguard":   lazyStateDumper(m.usbguard),
+		"accounts":   lazyStateDumper(m.accounts),
+		"localusers": lazyStateDumper(m.localusers),
+		"compliance": lazyStateDumper(m.compliance),
+		"updates":    lazyStateDumper(m.updates),
+		"enrollment": lazyStateDumper(m.enrollment),
+		"timesync":   lazyStateDumper(m.timesync),
+		"sshd":       lazyStateDumper(m.sshd),
+		"banners":    lazyStateDumper(m.banners),
+		"locale":     lazyStateDumper(m.locale),
+		"polkit":     lazyStateDumper(m.polkit),
+		"power":      lazyStateDumper(m.power),
+		"kmod":       lazyStateDumper(m.kmod),
+		"grub":       lazyStateDumper(m.grub),
+		"quota":      lazyStateDumper(m.quota),
+		"selinux":    lazyStateDumper(m.selinux),
+		"broadcast":  lazyStateDumper(m.broadcast),
+		"dns":        lazyStateDumper(m.dns),
+	}
+}
+
+// AptDryRun returns the apt package changes the last applied machine policies would
+// apply on the machine, without applying them.
+func (m *Manager) AptDryRun(ctx context.Context) (msg string, err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to compute apt package changes"))
+
+	log.Info(ctx, "Computing apt package changes")
+
+	pols, err := NewFromCache(ctx, filepath.Join(m.policiesCacheDir, m.hostname))
+	if err != nil {
+		return "", errors.New(gotext.Get("no policy applied for %q: %v", m.hostname, err))
+	}
+	defer pols.Close()
+
+	rules := pols.GetUniqueRules()
+	if len(m.supportedRules) > 0 {
+		filterUnsupportedRules(ctx, rules, m.supportedRules)
+	}
+	if !m.GetSubscriptionState(ctx) {
+		filterRules(ctx, rules)
+	}
+	aptManager := m.apt.acquire()
+	defer m.apt.release()
+	return aptManager.DryRun(ctx, rules["apt"])
+}
+
+// CompareSSSDGPOs returns the differences between the GPOs applied by adsys on the machine and the ones SSSD
+// evaluated for its GPO based access control.
+// Only the machine GPOs are compared: SSSD evaluates the GPOs applying to the computer object, and the user GPOs
+// applied by adsys have no equivalent in its cache.
+func (m *Manager) CompareSSSDGPOs(ctx context.Context) (msg string, err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to compare GPOs with SSSD"))
+
+	log.Info(ctx, "Comparing GPOs with SSSD")
+
+	evaluator, ok := m.backend.(backends.GPOEvaluator)
+	if !ok {
+		return "", errors.New(gotext.Get("the current backend doesn't evaluate GPOs on its own: only the sssd backend does"))
+	}
+	evaluated, err := evaluator.EvaluatedGPOs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	pols, err := NewFromCache(ctx, filepath.Join(m.policiesCacheDir, m.hostname))
+	if err != nil {
+		return "", errors.New(gotext.Get("no policy applied for %q: %v", m.hostname, err))
+	}
+	defer pols.Close()
+
+	// GUIDs are case insensitive.
+	sssdGPOs := make(map[string]backends.EvaluatedGPO)
+	for _, g := range evaluated {
+		sssdGPOs[strings.ToUpper(g.ID)] = g
+	}
+
+	var both, adsysOnly, sssdOnly []string
+	for _, g := range pols.GPOs {
+		id := strings.ToUpper(g.ID)
+		if _, ok := sssdGPOs[id]; !ok {
+			adsysOnly = append(adsysOnly, fmt.Sprintf("%s (%s)", g.Name, g.ID))
+			continue
+		}
+		both = append(both, fmt.Sprintf("%s (%s)", g.Name, g.ID))
+		delete(sssdGPOs, id)
+	}
+	for _, g := range evaluated {
+		if _, ok := sssdGPOs[strings.ToUpper(g.ID)]; ok {
+			sssdOnly = append(sssdOnly, gotext.Get("%s (version %d)", g.ID, g.Version))
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintln(&out, gotext.Get("Only the GPOs of the machine are compared: SSSD doesn't evaluate the GPOs of the users."))
+	for _, s := range []struct {
+		title string
+		hint  string
+		gpos  []string
+	}{
+		{title: gotext.Get("GPOs applied by adsys and evaluated by SSSD:"), gpos: both},
+		{
+			title: gotext.Get("GPOs only applied by adsys:"),
+			hint:  gotext.Get("SSSD only evaluates the GPOs defining logon rights in their security settings: other GPOs are expected here."),
+			gpos:  adsysOnly,
+		},
+		{
+			title: gotext.Get("GPOs only evaluated by SSSD:"),
+			hint:  gotext.Get("They may be filtered by adsys rollout rings or hardware targeting, or SSSD cache may be outdated until the next user logon."),
+			gpos:  sssdOnly,
+		},
+	} {
+		if len(s.gpos) == 0 {
+			continue
+		}
+		fmt.Fprintln(&out, s.title)
+		for _, g := range s.gpos {
+			fmt.Fprintf(&out, "** %s\n", g)
+		}
+		if s.hint != "" {
+			fmt.Fprintln(&out, s.hint)
+		}
+	}
+	if len(adsysOnly) == 0 && len(sssdOnly) == 0 {
+		fmt.Fprintln(&out, gotext.Get("adsys and SSSD agree on the GPOs of %s.", m.hostname))
 	}
 
 	return out.String(), nil
 }
 
+// RecordUserRefresh records the outcome of the policy refresh of user for the failure reports.
+// Failing to record it doesn't fail the refresh.
+func (m *Manager) RecordUserRefresh(ctx context.Context, user string, refreshErr error) {
+	reportManager := m.report.acquire()
+	defer m.report.release()
+	if err := reportManager.RecordRefresh(user, refreshErr); err != nil {
+		log.Warning(ctx, err)
+	}
+}
+
+// ReportUserFailures reports the users whose policies failed repeatedly to the administrators,
+// if configured by the machine policy. Failing to report them doesn't fail the refresh.
+func (m *Manager) ReportUserFailures(ctx context.Context) {
+	reportManager := m.report.acquire()
+	defer m.report.release()
+	if err := reportManager.Report(ctx, m.hostname); err != nil {
+		log.Warning(ctx, err)
+	}
+}
+
+// SaveDownloadedPolicies stores the policies downloaded for objectName, to apply them later on.
+// Any previously downloaded policies for this object are replaced.
+func (m *Manager) SaveDownloadedPolicies(ctx context.Context, objectName string, pols *Policies) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't store downloaded policies for %s", objectName))
+
+	log.Debugf(ctx, "Storing downloaded policies for %s", objectName)
+
+	p := filepath.Join(m.downloadsDir, objectName)
+	// Don't keep the assets of a previous download.
+	if err := os.RemoveAll(p); err != nil {
+		return err
+	}
+	return pols.Save(p)
+}
+
+// DownloadedPolicies returns the policies downloaded for objectName and not applied yet.
+func (m *Manager) DownloadedPolicies(ctx context.Context, objectName string) (pols Policies, err error) {
+	p := filepath.Join(m.downloadsDir, objectName)
+	if _, err := os.Stat(p); errors.Is(err, fs.ErrNotExist) {
+		return pols, errors.New(gotext.Get("no downloaded policies to apply for %s, they need to be downloaded first", objectName))
+	}
+	return NewFromCache(ctx, p)
+}
+
+// RemoveDownloadedPolicies removes the policies downloaded for objectName, once they are applied or superseded.
+func (m *Manager) RemoveDownloadedPolicies(objectName string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't remove downloaded policies for %s", objectName))
+
+	return os.RemoveAll(filepath.Join(m.downloadsDir, objectName))
+}
+
+// DownloadedUsers returns the users with downloaded policies not applied yet.
+func (m *Manager) DownloadedUsers() (users []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't list users with downloaded policies"))
+
+	// The directory is only created on first download.
+	entries, err := os.ReadDir(m.downloadsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.Contains(e.Name(), "@") {
+			continue
+		}
+		users = append(users, e.Name())
+	}
+	return users, nil
+}
+
 // LastUpdateFor returns the last update time for object or current machine.
 func (m *Manager) LastUpdateFor(ctx context.Context, objectName string, isMachine bool) (t time.Time, err error) {
 	defer decorate.OnError(&err, gotext.Get("failed to get policy last update time %q (machine: %v)", objectName, isMachine))
@@ -469,6 +2134,11 @@ func (m *Manager) LastUpdateFor(ctx context.Context, objectName string, isMachin
 	return info.ModTime(), nil
 }
 
+// UserScriptsUnitsStats returns the number of stuck or failed user script units cleaned up since the daemon started.
+func (m *Manager) UserScriptsUnitsStats() scripts.UnitsStats {
+	return m.scripts.UnitsStats()
+}
+
 // GetSubscriptionState returns the subscription status from Ubuntu Pro.
 func (m *Manager) GetSubscriptionState(ctx context.Context) (subscriptionEnabled bool) {
 	log.Debug(ctx, "Refresh subscription state")
@@ -501,6 +2171,240 @@ func (m *Manager) GetSubscriptionState(ctx context.Context) (subscriptionEnabled
 	return true
 }
 
+// formatSkipped writes to w the policy types which were skipped during the last refresh, with the reason why.
+func formatSkipped(w io.Writer, skipped map[string]SkipReason) {
+	if len(skipped) == 0 {
+		return
+	}
+
+	var rules []string
+	for rule := range skipped {
+		rules = append(rules, rule)
+	}
+	slices.Sort(rules)
+
+	fmt.Fprintln(w, gotext.Get("Skipped policy types:"))
+	for _, rule := range rules {
+		fmt.Fprintf(w, "** %s: %s\n", rule, skipped[rule])
+	}
+}
+
+// formatRemoved writes to w the rules of the GPOs which are not applied anymore, with whether they were reverted
+// or kept on the system.
+func formatRemoved(w io.Writer, removed map[string]RemovedRule) {
+	if len(removed) == 0 {
+		return
+	}
+
+	var rules []string
+	for rule := range removed {
+		rules = append(rules, rule)
+	}
+	slices.Sort(rules)
+
+	fmt.Fprintln(w, gotext.Get("Settings of GPOs not applied anymore:"))
+	for _, rule := range rules {
+		r := removed[rule]
+		if r.Tattooed {
+			fmt.Fprintf(w, "** %s: %s\n", rule, gotext.Get("kept on the system, from %q", r.GPO))
+			continue
+		}
+		fmt.Fprintf(w, "** %s: %s\n", rule, gotext.Get("reverted, from %q", r.GPO))
+	}
+}
+
+// formatScriptsResults writes the outcome of the scripts executed for objectName during the current session or
+// boot, by step in the order they were executed.
+// Results which can't be read are only logged, as the scripts may not have been executed by this machine.
+func (m *Manager) formatScriptsResults(ctx context.Context, w io.Writer, objectName string, isComputer bool) {
+	results, err := m.scripts.Results(ctx, objectName, isComputer)
+	if err != nil {
+		log.Debug(ctx, err)
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	var steps []string
+	for step, r := range results {
+		if len(r) == 0 {
+			continue
+		}
+		steps = append(steps, step)
+	}
+	slices.SortFunc(steps, func(a, b string) int {
+		return results[a][0].Start.Compare(results[b][0].Start)
+	})
+
+	fmt.Fprintln(w, gotext.Get("Scripts results:"))
+	for _, step := range steps {
+		fmt.Fprintf(w, "** %s:\n", step)
+		for _, r := range results[step] {
+			var status string
+			switch {
+			case r.TimedOut:
+				status = gotext.Get("stopped on timeout")
+			case r.Error != "":
+				status = gotext.Get("failed to start")
+			case r.ExitCode != 0:
+				status = gotext.Get("failed with exit code %d", r.ExitCode)
+			default:
+				status = gotext.Get("succeeded")
+			}
+			fmt.Fprintf(w, "*** %s: %s", r.Script, gotext.Get("%s after %s, started at %s", status, r.Duration.Round(time.Millisecond), r.Start.Format(time.RFC3339)))
+			// Keep each output printed in one single line, as the rules values.
+			for _, o := range []struct{ name, value string }{{"error", r.Error}, {"stdout", r.Stdout}, {"stderr", r.Stderr}} {
+				if v := strings.TrimSpace(o.value); v != "" {
+					fmt.Fprintf(w, " (%s: %s)", o.name, strings.ReplaceAll(v, "\n", `\n`))
+				}
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// managedRules returns the rule types handled by the managers for a computer or a user.
+// GDM rules are only applied to computers.
+func managedRules(isComputer bool) []string {
+	rules := []string{"dconf", EnrollmentRuleType}
+	if isComputer {
+		rules = append(rules, "gdm")
+	}
+	return append(rules, ProOnlyRules...)
+}
+
+// markSkipped records in skipped that the filtered rules are skipped for reason, unless they were already
+// skipped for another one.
+func markSkipped(skipped map[string]SkipReason, filteredRules []string, reason SkipReason) {
+	for _, rule := range filteredRules {
+		if _, ok := skipped[rule]; ok {
+			continue
+		}
+		skipped[rule] = reason
+	}
+}
+
+// filterGPOsForRing returns the GPOs that are applicable to the machine rollout ring.
+// A GPO restricted to one or more rings with its rollout/ring key is only kept if the
+// machine is assigned to one of them. GPOs without any ring restriction are always kept.
+func filterGPOsForRing(ctx context.Context, gpos []GPO, ring string) []GPO {
+	var filtered []GPO
+	for _, g := range gpos {
+		rings, restricted := g.rolloutRings()
+		if restricted && !slices.Contains(rings, ring) {
+			log.Info(ctx, gotext.Get("Skipping GPO %q as it is only rolled out to rings %s", g.Name, strings.Join(rings, ", ")))
+			continue
+		}
+		filtered = append(filtered, g)
+	}
+	return filtered
+}
+
+// hardwareFacts returns the hardware facts of the machine, collected on machine refreshes. User refreshes use the
+// facts collected on the last machine refresh.
+// Failing to cache the facts is only logged.
+func (m *Manager) hardwareFacts(ctx context.Context, isComputer bool) hardware.Facts {
+	collect := m.hardware.Cached
+	if isComputer {
+		collect = m.hardware.Collect
+	}
+	facts, err := collect(ctx)
+	if err != nil {
+		log.Warning(ctx, err)
+	}
+	return facts
+}
+
+// filterGPOsForHardware returns the GPOs whose hardware targeting expressions all match the hardware facts of
+// the machine. GPOs with an invalid expression are skipped, as they may target other machines. GPOs without
+// any expression are always kept.
+func filterGPOsForHardware(ctx context.Context, gpos []GPO, facts hardware.Facts) []GPO {
+	var filtered []GPO
+	for _, g := range gpos {
+		match := true
+		for _, expr := range g.hardwareTargets() {
+			ok, err := facts.Match(expr)
+			if err != nil {
+				log.Warning(ctx, gotext.Get("Skipping GPO %q: %v", g.Name, err))
+				match = false
+				break
+			}
+			if !ok {
+				log.Info(ctx, gotext.Get("Skipping GPO %q as it only targets machines with %s", g.Name, expr))
+				match = false
+				break
+			}
+		}
+		if match {
+			filtered = append(filtered, g)
+		}
+	}
+	return filtered
+}
+
+// detectTarget returns the Ubuntu flavor and the desktop environments installed on the machine.
+// Detection failures are logged, and considered as no flavor or desktop environment installed.
+func detectTarget(ctx context.Context) (flavor string, desktops []string) {
+	flavor, err := adcommon.GetFlavor("/")
+	if err != nil {
+		log.Warning(ctx, err)
+	}
+	desktops, err = adcommon.GetDesktops("/")
+	if err != nil {
+		log.Warning(ctx, err)
+	}
+	return flavor, desktops
+}
+
+// filterEntriesForTarget returns the GPOs without the entries restricted to other Ubuntu flavors or
+// desktop environments than the ones of the machine.
+// An entry restricted to some desktop environments is kept if any of them is installed. Desktop environments are
+// compared case insensitively. Entries without restriction are always kept.
+func filterEntriesForTarget(ctx context.Context, gpos []GPO, flavor string, desktops []string) []GPO {
+	applies := func(e entry.Entry) bool {
+		if e.Flavors != "" && !slices.Contains(splitTargets(e.Flavors), flavor) {
+			return false
+		}
+		if e.Desktops == "" {
+			return true
+		}
+		for _, d := range splitTargets(e.Desktops) {
+			if slices.ContainsFunc(desktops, func(installed string) bool { return strings.EqualFold(d, installed) }) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var filtered []GPO
+	for _, g := range gpos {
+		rules := make(map[string][]entry.Entry)
+		for t, entries := range g.Rules {
+			for _, e := range entries {
+				if !applies(e) {
+					log.Debugf(ctx, "Skipping %s/%s from GPO %q as it only targets flavors %q and desktops %q", t, e.Key, g.Name, e.Flavors, e.Desktops)
+					continue
+				}
+				rules[t] = append(rules[t], e)
+			}
+		}
+		g.Rules = rules
+		filtered = append(filtered, g)
+	}
+	return filtered
+}
+
+// splitTargets returns the trimmed elements of a comma separated list of flavors or desktop environments.
+func splitTargets(s string) (targets []string) {
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
 // filterRules allows to filter any rules that are not eligible for the current device,
 // and returns the sorted list of filtered rules.
 func filterRules(ctx context.Context, rules map[string][]entry.Entry) []string {
@@ -523,3 +2427,106 @@ func filterRules(ctx context.Context, rules map[string][]entry.Entry) []string {
 
 	return filteredRules
 }
+
+// filterReadOnlyRules removes the rules which are not supported in read-only mode and returns
+// the list of filtered rule types.
+// User mounts are kept, as they are only written to the run directory, and so are the computer session
+// restrictions, which are staged. Only the default session of the users is changed on the running system.
+func filterReadOnlyRules(ctx context.Context, rules map[string][]entry.Entry, isComputer bool) []string {
+	log.Debug(ctx, "Filtering Rules unsupported in read-only mode")
+
+	var filteredRules []string
+	for _, rule := range ReadOnlyUnsupportedRules {
+		if len(rules[rule]) == 0 || (rule == "mount" && !isComputer) || (rule == "session" && isComputer) {
+			continue
+		}
+		filteredRules = append(filteredRules, rule)
+		rules[rule] = nil
+	}
+
+	return filteredRules
+}
+
+// filterUnsupportedRules removes the rules which are not part of supportedRules and returns
+// the sorted list of filtered rule types.
+func filterUnsupportedRules(ctx context.Context, rules map[string][]entry.Entry, supportedRules []string) []string {
+	log.Debug(ctx, "Filtering Rules unsupported by this build")
+
+	var filteredRules []string
+	for rule, entries := range rules {
+		if len(entries) == 0 || slices.Contains(supportedRules, rule) {
+			continue
+		}
+		filteredRules = append(filteredRules, rule)
+		rules[rule] = nil
+	}
+	slices.Sort(filteredRules)
+
+	return filteredRules
+}
+
+// historySources returns the policy artifacts rendered on the machine which are recorded in the history:
+// the effective policies of each object and the configuration files of the main policy managers.
+func historySources(args options, policiesCacheDir string) []history.Source {
+	dir := func(p, defaultPath string) string {
+		if p == "" {
+			return defaultPath
+		}
+		return p
+	}
+
+	return []history.Source{
+		{Name: "policies", Root: policiesCacheDir, Patterns: []string{"*/policies"}},
+		{Name: "dconf", Root: dir(args.dconfDir, consts.DefaultDconfDir), Patterns: []string{"profile/*", "db/*.d/adsys", "db/*.d/locks/adsys"}},
+		{Name: "sudoers", Root: dir(args.sudoersDir, consts.DefaultSudoersDir), Patterns: []string{"99-adsys*"}},
+		{Name: "polkit", Root: dir(args.policyKitDir, consts.DefaultPolicyKitDir), Patterns: []string{"localauthority.conf.d/99-adsys*", "rules.d/*adsys*"}},
+		{Name: "apparmor", Root: args.apparmorDir, Patterns: []string{"*"}},
+	}
+}
+
+// stageSystemDirs redirects the system directories which were not personalized to the staging directory.
+func stageSystemDirs(args *options) {
+	stage := func(p *string, defaultPath string) {
+		if *p != "" && *p != defaultPath {
+			return
+		}
+		*p = filepath.Join(args.stagingDir, defaultPath)
+	}
+
+	stage(&args.dconfDir, consts.DefaultDconfDir)
+	stage(&args.sudoersDir, consts.DefaultSudoersDir)
+	stage(&args.policyKitDir, consts.DefaultPolicyKitDir)
+	stage(&args.apparmorDir, consts.DefaultApparmorDir)
+	stage(&args.systemUnitDir, consts.DefaultSystemUnitDir)
+	stage(&args.globalTrustDir, consts.DefaultGlobalTrustDir)
+	stage(&args.evolutionSourcesDir, consts.DefaultEvolutionSourcesDir)
+	stage(&args.thunderbirdPoliciesDir, consts.DefaultThunderbirdPoliciesDir)
+	stage(&args.firefoxPoliciesDir, consts.DefaultFirefoxPoliciesDir)
+	stage(&args.firefoxInstallDir, consts.DefaultFirefoxInstallDir)
+	stage(&args.chromePoliciesDir, consts.DefaultChromePoliciesDir)
+	stage(&args.chromiumPoliciesDir, consts.DefaultChromiumPoliciesDir)
+	stage(&args.shortcutsApplicationsDir, consts.DefaultShortcutsApplicationsDir)
+	stage(&args.shortcutsIconsDir, consts.DefaultShortcutsIconsDir)
+	stage(&args.gdmConf, consts.DefaultGDMCustomConf)
+	stage(&args.greeterAssetsDir, consts.DefaultGreeterAssetsDir)
+	stage(&args.portalsConfDir, consts.DefaultPortalsConfDir)
+	stage(&args.userUnitDir, consts.DefaultUserUnitDir)
+	stage(&args.aptPreferencesDir, consts.DefaultAptPreferencesDir)
+	stage(&args.aptSourcesDir, consts.DefaultAptSourcesDir)
+	stage(&args.aptKeyringsDir, consts.DefaultAptKeyringsDir)
+	stage(&args.aptConfDir, consts.DefaultAptConfDir)
+	stage(&args.sysctlDir, consts.DefaultSysctlDir)
+	stage(&args.auditRulesDir, consts.DefaultAuditRulesDir)
+	stage(&args.usbguardRulesDir, consts.DefaultUSBGuardRulesDir)
+	stage(&args.chronySourcesDir, consts.DefaultChronySourcesDir)
+	stage(&args.timesyncdConfDir, consts.DefaultTimesyncdConfDir)
+	stage(&args.logindConfDir, consts.DefaultLogindConfDir)
+	stage(&args.modprobeDir, consts.DefaultModprobeDir)
+	stage(&args.sshdConfigDir, consts.DefaultSSHDConfigDir)
+	stage(&args.filesRootDir, "/")
+	stage(&args.iniRootDir, "/")
+	stage(&args.accountsRootDir, "/")
+	stage(&args.bannersRootDir, "/")
+	stage(&args.grubRootDir, "/")
+	stage(&args.dnsRootDir, "/")
+}
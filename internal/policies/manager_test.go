@@ -8,7 +8,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,8 +19,12 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/ad/backends"
 	"github.com/ubuntu/adsys/internal/consts"
+	"github.com/ubuntu/adsys/internal/faultinject"
+	"github.com/ubuntu/adsys/internal/hardware"
 	"github.com/ubuntu/adsys/internal/policies"
+	"github.com/ubuntu/adsys/internal/policies/entry"
 	"github.com/ubuntu/adsys/internal/testutils"
 )
 
@@ -40,35 +46,58 @@ func TestApplyPolicies(t *testing.T) {
 		makeDirReadOnly                 string
 		isNotSubscribed                 bool
 		secondCallWithNoSubscription    bool
+		secondCallWithChangedRule       bool
+		secondCallWithAuditedRule       bool
 		noUbuntuProxyManager            bool
 		backendOfflineError             bool
+		injectFailure                   string
+		readOnly                        bool
+		securityModule                  string
+		supportedRules                  []string
 
 		wantErr bool
+		// wantFailures are the managers reported to the failure hook.
+		wantFailures []string
 	}{
 		"Succeed": {policiesDir: "all_entry_types"},
 		"Succeed if checking for backend online status returns an error":         {backendOfflineError: true, policiesDir: "all_entry_types"},
 		"Second call with no rules deletes everything":                           {policiesDir: "all_entry_types", secondCallWithNoRules: true, scriptSessionEndedForSecondCall: true},
 		"Second call with no rules don't remove scripts if session hasn’t ended": {policiesDir: "all_entry_types", secondCallWithNoRules: true, scriptSessionEndedForSecondCall: false},
+		"Second call only updates the last change time of changed rules":         {policiesDir: "all_entry_types", secondCallWithChangedRule: true},
+		"Second call with an audited rule keeps the previous rule applied":       {policiesDir: "all_entry_types", secondCallWithAuditedRule: true},
 
 		// no subscription filterings
 		"No subscription is only dconf content":                                         {policiesDir: "all_entry_types", isNotSubscribed: true},
 		"Second call with no subscription should remove everything but dconf content":   {policiesDir: "all_entry_types", secondCallWithNoSubscription: true, scriptSessionEndedForSecondCall: true},
 		"Second call with no subscription don't remove scripts if session hasn’t ended": {policiesDir: "all_entry_types", secondCallWithNoSubscription: true, scriptSessionEndedForSecondCall: false},
 
+		// read-only mode
+		"Read-only mode stages files and filters unsupported rules": {policiesDir: "all_entry_types", readOnly: true},
+
+		// security modules
+		"SELinux security module does not apply apparmor policy": {policiesDir: "all_entry_types", securityModule: policies.SecurityModuleSELinux},
+
+		// restricted builds
+		"Restricted build only applies supported rules": {policiesDir: "all_entry_types", supportedRules: []string{"dconf", "gdm", "scripts", "proxy"}},
+
 		// Error cases
-		"Error when applying dconf policy":       {policiesDir: "dconf_failing", wantErr: true},
-		"Error when applying privilege policy":   {makeDirReadOnly: "etc/sudoers.d", policiesDir: "all_entry_types", wantErr: true},
-		"Error when applying scripts policy":     {makeDirReadOnly: "run/adsys/machine", policiesDir: "all_entry_types", wantErr: true},
-		"Error when applying apparmor policy":    {makeDirReadOnly: "etc/apparmor.d/adsys", policiesDir: "all_entry_types", wantErr: true},
-		"Error when applying mount policy":       {makeDirReadOnly: "etc/systemd/system", policiesDir: "all_entry_types", wantErr: true},
-		"Error when applying proxy policy":       {noUbuntuProxyManager: true, policiesDir: "all_entry_types", wantErr: true},
-		"Error when applying certificate policy": {policiesDir: "certificate_failing", wantErr: true},
+		"Error when applying dconf policy":            {policiesDir: "dconf_failing", wantErr: true},
+		"Error when applying privilege policy":        {makeDirReadOnly: "etc/sudoers.d", policiesDir: "all_entry_types", wantErr: true},
+		"Error when applying scripts policy":          {makeDirReadOnly: "run/adsys/machine", policiesDir: "all_entry_types", wantErr: true},
+		"Error when applying apparmor policy":         {makeDirReadOnly: "etc/apparmor.d/adsys", policiesDir: "all_entry_types", wantErr: true},
+		"Error when applying mount policy":            {makeDirReadOnly: "etc/systemd/system", policiesDir: "all_entry_types", wantErr: true},
+		"Error when applying proxy policy":            {noUbuntuProxyManager: true, policiesDir: "all_entry_types", wantErr: true},
+		"Error when applying certificate policy":      {policiesDir: "certificate_failing", wantErr: true},
+		"Error when failure is injected in a manager": {injectFailure: "manager:privilege", policiesDir: "all_entry_types", wantErr: true, wantFailures: []string{"privilege"}},
+		"Error when failure is injected in gdm":       {injectFailure: "manager:gdm", policiesDir: "all_entry_types", wantErr: true, wantFailures: []string{"gdm"}},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
 			// We change the dbus returned values to simulate a subscription
 			//t.Parallel()
 
+			t.Setenv(faultinject.EnvVar, tc.injectFailure)
+
 			pols, err := policies.NewFromCache(context.Background(), filepath.Join("testdata", "cache", "policies", tc.policiesDir))
 			require.NoError(t, err, "Setup: can not load policies list")
 			defer pols.Close()
@@ -81,8 +110,33 @@ func TestApplyPolicies(t *testing.T) {
 			sudoersDir := filepath.Join(fakeRootDir, "etc", "sudoers.d")
 			apparmorDir := filepath.Join(fakeRootDir, "etc", "apparmor.d", "adsys")
 			systemUnitDir := filepath.Join(fakeRootDir, "etc", "systemd", "system")
+			evolutionSourcesDir := filepath.Join(fakeRootDir, "usr", "share", "evolution-data-server", "ro-sources")
+			thunderbirdPoliciesDir := filepath.Join(fakeRootDir, "etc", "thunderbird", "policies")
+			firefoxPoliciesDir := filepath.Join(fakeRootDir, "etc", "firefox", "policies")
+			firefoxInstallDir := filepath.Join(fakeRootDir, "usr", "lib", "firefox")
+			chromePoliciesDir := filepath.Join(fakeRootDir, "etc", "opt", "chrome", "policies")
+			chromiumPoliciesDir := filepath.Join(fakeRootDir, "etc", "chromium", "policies")
+			shortcutsApplicationsDir := filepath.Join(fakeRootDir, "usr", "local", "share", "applications")
+			shortcutsIconsDir := filepath.Join(fakeRootDir, "usr", "local", "share", "icons")
+			gdmConf := filepath.Join(fakeRootDir, "etc", "gdm3", "custom.conf")
+			greeterAssetsDir := filepath.Join(fakeRootDir, "usr", "local", "share", "adsys", "gdm")
+			portalsConfDir := filepath.Join(fakeRootDir, "etc", "xdg", "xdg-desktop-portal")
+			portalsDataDir := filepath.Join(fakeRootDir, "usr", "share", "xdg-desktop-portal")
+			userUnitDir := filepath.Join(fakeRootDir, "etc", "systemd", "user")
+			aptPreferencesDir := filepath.Join(fakeRootDir, "etc", "apt", "preferences.d")
+			aptSourcesDir := filepath.Join(fakeRootDir, "etc", "apt", "sources.list.d")
+			aptKeyringsDir := filepath.Join(fakeRootDir, "etc", "apt", "keyrings")
+			aptConfDir := filepath.Join(fakeRootDir, "etc", "apt", "apt.conf.d")
+			connectionsDir := filepath.Join(fakeRootDir, "etc", "NetworkManager", "system-connections")
+			sysctlDir := filepath.Join(fakeRootDir, "etc", "sysctl.d")
+			auditRulesDir := filepath.Join(fakeRootDir, "etc", "audit", "rules.d")
+			usbguardRulesDir := filepath.Join(fakeRootDir, "etc", "usbguard", "rules.d")
+			chronySourcesDir := filepath.Join(fakeRootDir, "etc", "chrony", "sources.d")
+			timesyncdConfDir := filepath.Join(fakeRootDir, "etc", "systemd", "timesyncd.conf.d")
+			logindConfDir := filepath.Join(fakeRootDir, "etc", "systemd", "logind.conf.d")
+			modprobeDir := filepath.Join(fakeRootDir, "etc", "modprobe.d")
+			sshdConfigDir := filepath.Join(fakeRootDir, "etc", "ssh", "sshd_config.d")
 			stateDir := filepath.Join(fakeRootDir, "var", "lib", "adsys")
-			shareDir := filepath.Join(fakeRootDir, "usr", "share", "adsys")
 			loadedPoliciesFile := filepath.Join(fakeRootDir, "sys", "kernel", "security", "apparmor", "profiles")
 
 			err = os.MkdirAll(filepath.Dir(loadedPoliciesFile), 0700)
@@ -99,24 +153,95 @@ func TestApplyPolicies(t *testing.T) {
 				require.NoError(t, subscriptionDbus.SetProperty(consts.SubscriptionDbusInterface+".Attached", false), "Teardown: can not restore subscription status")
 			}()
 
-			m, err := policies.NewManager(bus,
-				hostname,
-				mockBackend{},
+			// Each call to the clock is one hour later than the previous one.
+			now := time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC)
+			opts := []policies.Option{
+				policies.WithNow(func() time.Time {
+					now = now.Add(time.Hour)
+					return now
+				}),
 				policies.WithCacheDir(cacheDir),
 				policies.WithStateDir(stateDir),
 				policies.WithRunDir(runDir),
-				policies.WithShareDir(shareDir),
-				policies.WithDconfDir(dconfDir),
-				policies.WithPolicyKitDir(policyKitDir),
-				policies.WithSudoersDir(sudoersDir),
-				policies.WithApparmorDir(apparmorDir),
 				policies.WithApparmorFsDir(filepath.Dir(loadedPoliciesFile)),
 				policies.WithApparmorParserCmd([]string{"/bin/true"}),
-				policies.WithCertAutoenrollCmd([]string{"/bin/true"}),
-				policies.WithSystemUnitDir(systemUnitDir),
+				// certmonger is not installed: certificate enrollment is skipped
+				policies.WithGetcertCmd([]string{"/nonexistent/getcert"}),
+				policies.WithUfwCmd([]string{"/bin/true"}),
+				policies.WithNftCmd([]string{"/bin/true"}),
+				policies.WithAptGetCmd([]string{"/bin/true"}),
+				policies.WithDpkgQueryCmd([]string{"/bin/true"}),
+				policies.WithSnapCmd([]string{"/bin/true"}),
+				policies.WithFlatpakCmd([]string{"/bin/true"}),
+				policies.WithSysDir(filepath.Join(fakeRootDir, "sys")),
+				policies.WithFindmntCmd([]string{"/bin/true"}),
+				policies.WithLsblkCmd([]string{"/bin/true"}),
+				policies.WithSystemctlCmd([]string{"/bin/true"}),
+				policies.WithPortalsDataDir(portalsDataDir),
 				policies.WithProxyApplier(&mockProxyApplier{wantApplyError: tc.noUbuntuProxyManager}),
 				policies.WithSystemdCaller(&testutils.MockSystemdCaller{}),
-			)
+			}
+			if tc.readOnly {
+				// System directories are staged under the state directory.
+				opts = append(opts, policies.WithReadOnly(filepath.Join(stateDir, "staging")))
+			} else {
+				opts = append(opts,
+					policies.WithDconfDir(dconfDir),
+					policies.WithPolicyKitDir(policyKitDir),
+					policies.WithSudoersDir(sudoersDir),
+					policies.WithApparmorDir(apparmorDir),
+					policies.WithAptPreferencesDir(aptPreferencesDir),
+					policies.WithAptSourcesDir(aptSourcesDir),
+					policies.WithAptKeyringsDir(aptKeyringsDir),
+					policies.WithAptConfDir(aptConfDir),
+					policies.WithNetworkConnectionsDir(connectionsDir),
+					policies.WithSysctlDir(sysctlDir),
+					policies.WithAuditRulesDir(auditRulesDir),
+					policies.WithUSBGuardRulesDir(usbguardRulesDir),
+					policies.WithChronySourcesDir(chronySourcesDir),
+					policies.WithTimesyncdConfDir(timesyncdConfDir),
+					policies.WithLogindConfDir(logindConfDir),
+					policies.WithModprobeDir(modprobeDir),
+					policies.WithSSHDConfigDir(sshdConfigDir),
+					policies.WithSystemUnitDir(systemUnitDir),
+					policies.WithEvolutionSourcesDir(evolutionSourcesDir),
+					policies.WithThunderbirdPoliciesDir(thunderbirdPoliciesDir),
+					policies.WithFirefoxPoliciesDir(firefoxPoliciesDir),
+					policies.WithFirefoxInstallDir(firefoxInstallDir),
+					policies.WithChromePoliciesDir(chromePoliciesDir),
+					policies.WithChromiumPoliciesDir(chromiumPoliciesDir),
+					policies.WithShortcutsApplicationsDir(shortcutsApplicationsDir),
+					policies.WithShortcutsIconsDir(shortcutsIconsDir),
+					policies.WithGDMConf(gdmConf),
+					policies.WithGreeterAssetsDir(greeterAssetsDir),
+					policies.WithPortalsConfDir(portalsConfDir),
+					policies.WithUserUnitDir(userUnitDir),
+					policies.WithFilesRootDir(fakeRootDir),
+					policies.WithIniRootDir(fakeRootDir),
+					policies.WithAccountsRootDir(fakeRootDir),
+					policies.WithBannersRootDir(fakeRootDir),
+					policies.WithGrubRootDir(fakeRootDir),
+					policies.WithDNSRootDir(fakeRootDir),
+					policies.WithPackageLockRootDir(fakeRootDir),
+				)
+			}
+
+			if tc.securityModule != "" {
+				opts = append(opts, policies.WithSecurityModule(tc.securityModule))
+			}
+			if tc.supportedRules != nil {
+				opts = append(opts, policies.WithSupportedRules(tc.supportedRules))
+			}
+
+			var failuresMu sync.Mutex
+			var failures []string
+			opts = append(opts, policies.WithFailureHook(func(manager string) {
+				failuresMu.Lock()
+				defer failuresMu.Unlock()
+				failures = append(failures, manager)
+			}))
+
+			m, err := policies.NewManager(bus, hostname, mockBackend{}, opts...)
 			require.NoError(t, err, "Setup: couldn’t get a new policy manager")
 
 			err = os.MkdirAll(filepath.Join(cacheDir, policies.PoliciesCacheBaseName), 0750)
@@ -133,7 +258,7 @@ func TestApplyPolicies(t *testing.T) {
 			orig := logrus.StandardLogger().Out
 			logrus.StandardLogger().SetOutput(w)
 
-			err = m.ApplyPolicies(context.Background(), "hostname", true, &pols)
+			results, err := m.ApplyPolicies(context.Background(), "hostname", true, &pols)
 
 			logrus.StandardLogger().SetOutput(orig)
 			w.Close()
@@ -146,12 +271,37 @@ func TestApplyPolicies(t *testing.T) {
 				want := fmt.Sprintf("Rules from the following policy types will be filtered out as the machine is not enrolled to Ubuntu Pro: %s", strings.Join(policies.ProOnlyRules, ", "))
 				require.Contains(t, out.String(), want, "ApplyPolicy should have logged the filtered rules")
 			}
+			if tc.supportedRules != nil {
+				want := "Rules from the following policy types are not supported by this build of adsys and will be filtered out: accounts, apparmor, apt, audit, banners, broadcast, certificate, chrome, compliance, dns, encryption, enrollment, files, firefox, firewall, flatpak, grub, ini, kmod, locale, localusers, mail, mount, network, polkit, power, printers, privilege, quota, report, selinux, services, session, shortcuts, snap, sshd, sysctl, tasks, timesync, updates, usbguard, vpn"
+				require.Contains(t, out.String(), want, "ApplyPolicy should have logged the filtered rules")
+			}
+			if tc.readOnly {
+				// The session restrictions of the computer are staged.
+				rules := slices.DeleteFunc(slices.Clone(policies.ReadOnlyUnsupportedRules), func(r string) bool { return r == "session" })
+				want := fmt.Sprintf("Rules from the following policy types are not supported in read-only mode and will be filtered out: %s", strings.Join(rules, ", "))
+				require.Contains(t, out.String(), want, "ApplyPolicy should have logged the filtered rules")
+			}
 
 			if tc.wantErr {
 				require.Error(t, err, "ApplyPolicy should return an error but got none")
+				if tc.wantFailures != nil {
+					require.Equal(t, tc.wantFailures, failures, "ApplyPolicy should have reported the failing managers")
+					for _, manager := range tc.wantFailures {
+						require.Equal(t, policies.ManagerFailed, results[manager].Status, "ApplyPolicy should return the failing managers as failed")
+					}
+				}
 				return
 			}
 			require.NoError(t, err, "ApplyPolicy should return no error but got one")
+			require.Empty(t, failures, "ApplyPolicy should not have reported any failing manager")
+			for manager, res := range results {
+				require.NotEqual(t, policies.ManagerFailed, res.Status, "ApplyPolicy should not return %s as failed", manager)
+			}
+			require.Equal(t, policies.ManagerOK, results["dconf"].Status, "ApplyPolicy should return dconf as applied")
+			if tc.isNotSubscribed {
+				require.Equal(t, policies.ManagerResult{Status: policies.ManagerSkipped, Reason: policies.SkipNotEntitled.String()}, results["scripts"],
+					"ApplyPolicy should return the Pro only managers as skipped")
+			}
 
 			// Fake starting scripts session when we ran scripts
 			runningFlag := filepath.Join(runDir, "machine", "scripts", ".running")
@@ -171,9 +321,16 @@ func TestApplyPolicies(t *testing.T) {
 			} else if tc.secondCallWithNoSubscription {
 				runSecondCall = true
 				require.NoError(t, subscriptionDbus.SetProperty(consts.SubscriptionDbusInterface+".Attached", false), "Setup: can not set subscription status for second call to disabled")
+			} else if tc.secondCallWithChangedRule {
+				runSecondCall = true
+				pols.GPOs[0].Rules["dconf"][0].Value = "ChangedValueOfKey1"
+			} else if tc.secondCallWithAuditedRule {
+				runSecondCall = true
+				pols.GPOs[0].Rules["dconf"][0].Value = "ChangedValueOfKey1"
+				pols.GPOs[0].Rules["dconf"][0].Mode = entry.ModeAudit
 			}
 			if runSecondCall {
-				err = m.ApplyPolicies(context.Background(), "hostname", true, &pols)
+				_, err = m.ApplyPolicies(context.Background(), "hostname", true, &pols)
 				require.NoError(t, err, "ApplyPolicy should return no error but got one")
 			}
 
@@ -197,6 +354,8 @@ func TestDumpPolicies(t *testing.T) {
 		computerOnly       bool
 		withRules          bool
 		withOverridden     bool
+		since              time.Duration
+		runDir             string
 
 		wantErr bool
 	}{
@@ -271,6 +430,93 @@ func TestDumpPolicies(t *testing.T) {
 			withOverridden:     true,
 		},
 
+		// Filter on changes
+		"Rules changed since duration": {
+			cachePoliciesUser:  "one_gpo_with_changes",
+			cachePolicyMachine: "two_gpos_override_one_gpo_with_changes",
+			since:              24 * time.Hour,
+		},
+		"Rules changed since duration, override shown": {
+			cachePoliciesUser:  "one_gpo_with_changes",
+			cachePolicyMachine: "two_gpos_override_one_gpo_with_changes",
+			withOverridden:     true,
+			since:              24 * time.Hour,
+		},
+		"Rules changed since short duration": {
+			cachePoliciesUser:  "one_gpo_with_changes",
+			cachePolicyMachine: "two_gpos_override_one_gpo_with_changes",
+			since:              90 * time.Minute,
+		},
+		"Machine only rules changed since duration": {
+			cachePolicyMachine: "two_gpos_override_one_gpo_with_changes",
+			target:             hostname,
+			computerOnly:       true,
+			since:              24 * time.Hour,
+		},
+		"No rules changed since duration": {
+			cachePoliciesUser:  "one_gpo_with_changes",
+			cachePolicyMachine: "two_gpos_override_one_gpo_with_changes",
+			since:              30 * time.Minute,
+		},
+		"No rules changed since duration without recorded changes": {
+			cachePoliciesUser: "one_gpo",
+			since:             24 * time.Hour,
+		},
+
+		// Skipped policy types
+		"Skipped policy types shown with overrides": {
+			cachePoliciesUser:  "one_gpo_with_skipped",
+			cachePolicyMachine: "one_gpo_other_with_skipped",
+			withRules:          true,
+			withOverridden:     true,
+		},
+		"Skipped policy types hidden without overrides": {
+			cachePoliciesUser:  "one_gpo_with_skipped",
+			cachePolicyMachine: "one_gpo_other_with_skipped",
+			withRules:          true,
+		},
+		"Machine only skipped policy types": {
+			cachePolicyMachine: "one_gpo_other_with_skipped",
+			target:             hostname,
+			computerOnly:       true,
+			withRules:          true,
+			withOverridden:     true,
+		},
+
+		// Settings of GPOs not applied anymore
+		"Removed GPO settings shown with overrides": {
+			cachePoliciesUser:  "one_gpo_with_removed",
+			cachePolicyMachine: "one_gpo_other",
+			withRules:          true,
+			withOverridden:     true,
+		},
+		"Removed GPO settings hidden without overrides": {
+			cachePoliciesUser:  "one_gpo_with_removed",
+			cachePolicyMachine: "one_gpo_other",
+			withRules:          true,
+		},
+
+		// Scripts results
+		"Machine only scripts results with rules": {
+			cachePolicyMachine: "one_gpo",
+			target:             hostname,
+			computerOnly:       true,
+			withRules:          true,
+			runDir:             "scripts_results",
+		},
+		"Machine scripts results with user rules": {
+			cachePoliciesUser:  "one_gpo",
+			cachePolicyMachine: "one_gpo_other",
+			withRules:          true,
+			runDir:             "scripts_results",
+		},
+		"Scripts results hidden without rules": {
+			cachePolicyMachine: "one_gpo",
+			target:             hostname,
+			computerOnly:       true,
+			runDir:             "scripts_results",
+		},
+
 		// Error cases
 		"Error on missing target cache": {
 			wantErr: true,
@@ -287,7 +533,13 @@ func TestDumpPolicies(t *testing.T) {
 			t.Parallel()
 
 			cacheDir, runDir := t.TempDir(), t.TempDir()
-			m, err := policies.NewManager(bus, hostname, mockBackend{}, policies.WithCacheDir(cacheDir), policies.WithRunDir(runDir))
+			if tc.runDir != "" {
+				runDir = filepath.Join(runDir, "run")
+				err := shutil.CopyTree(filepath.Join("testdata", "run", tc.runDir), runDir, nil)
+				require.NoError(t, err, "Setup: couldn’t copy run directory")
+			}
+			m, err := policies.NewManager(bus, hostname, mockBackend{}, policies.WithCacheDir(cacheDir), policies.WithRunDir(runDir),
+				policies.WithNow(func() time.Time { return time.Date(2023, time.March, 10, 10, 0, 0, 0, time.UTC) }))
 			require.NoError(t, err, "Setup: couldn’t get a new policy manager")
 
 			err = os.MkdirAll(filepath.Join(cacheDir, policies.PoliciesCacheBaseName), 0750)
@@ -312,7 +564,7 @@ func TestDumpPolicies(t *testing.T) {
 			if tc.target == "" {
 				tc.target = "user"
 			}
-			got, err := m.DumpPolicies(context.Background(), tc.target, tc.computerOnly, tc.withRules, tc.withOverridden)
+			got, err := m.DumpPolicies(context.Background(), tc.target, tc.computerOnly, tc.withRules, tc.withOverridden, tc.since)
 			if tc.wantErr {
 				require.Error(t, err, "DumpPolicies should return an error but got none")
 				return
@@ -382,6 +634,273 @@ func TestLastUpdateFor(t *testing.T) {
 	}
 }
 
+func TestDownloadedPolicies(t *testing.T) {
+	t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err, "Setup: failed to get hostname")
+
+	tests := map[string]struct {
+		policies         string
+		previousDownload string
+		noDownload       bool
+
+		wantErr bool
+	}{
+		"Downloaded policies are stored and returned":          {policies: "one_gpo"},
+		"Downloaded policies with assets are stored":           {policies: "with_assets"},
+		"New download replaces the previous one":               {policies: "one_gpo", previousDownload: "with_assets"},
+		"New download replaces the previous one and its files": {policies: "with_assets", previousDownload: "one_gpo_other"},
+
+		// Error cases
+		"Error when nothing was downloaded": {noDownload: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cacheDir, runDir := t.TempDir(), t.TempDir()
+			m, err := policies.NewManager(bus, hostname, mockBackend{}, policies.WithCacheDir(cacheDir), policies.WithRunDir(runDir))
+			require.NoError(t, err, "Setup: couldn’t get a new policy manager")
+
+			const user = "user@example.com"
+			for _, p := range []string{tc.previousDownload, tc.policies} {
+				if p == "" || tc.noDownload {
+					continue
+				}
+				pols, err := policies.NewFromCache(context.Background(), filepath.Join("testdata", "cache", "policies", p))
+				require.NoError(t, err, "Setup: couldn’t load policies from cache")
+				err = m.SaveDownloadedPolicies(context.Background(), user, &pols)
+				require.NoError(t, err, "SaveDownloadedPolicies should return no error but got one")
+				require.NoError(t, pols.Close(), "Teardown: couldn’t close policies")
+			}
+
+			got, err := m.DownloadedPolicies(context.Background(), user)
+			if tc.wantErr {
+				require.Error(t, err, "DownloadedPolicies should return an error but got none")
+				return
+			}
+			require.NoError(t, err, "DownloadedPolicies should return no error but got one")
+			defer got.Close()
+
+			want, err := policies.NewFromCache(context.Background(), filepath.Join("testdata", "cache", "policies", tc.policies))
+			require.NoError(t, err, "Setup: couldn’t load policies from cache")
+			defer want.Close()
+			require.Equal(t, want.GPOs, got.GPOs, "DownloadedPolicies should return the downloaded GPOs")
+			_, err = os.Stat(filepath.Join(cacheDir, policies.DownloadedPoliciesCacheBaseName, user, "assets.db"))
+			require.Equal(t, tc.policies == "with_assets", err == nil, "Assets should only be stored along the downloaded policies with assets")
+
+			users, err := m.DownloadedUsers()
+			require.NoError(t, err, "DownloadedUsers should return no error but got one")
+			require.Equal(t, []string{user}, users, "DownloadedUsers should list the users with downloaded policies")
+
+			err = m.RemoveDownloadedPolicies(user)
+			require.NoError(t, err, "RemoveDownloadedPolicies should return no error but got one")
+			_, err = m.DownloadedPolicies(context.Background(), user)
+			require.Error(t, err, "DownloadedPolicies should return an error once the policies are removed")
+		})
+	}
+}
+
+func TestAptDryRun(t *testing.T) {
+	//t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+	subscriptionDbus := bus.Object(consts.SubscriptionDbusRegisteredName,
+		dbus.ObjectPath(consts.SubscriptionDbusObjectPath))
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err, "Setup: failed to get hostname for tests.")
+
+	tests := map[string]struct {
+		cachePolicyMachine string
+		isNotSubscribed    bool
+
+		wantErr bool
+	}{
+		"Report apt changes of machine policies":     {cachePolicyMachine: "all_entry_types"},
+		"No apt changes without apt policy":          {cachePolicyMachine: "one_gpo"},
+		"No apt changes if subscription is inactive": {cachePolicyMachine: "all_entry_types", isNotSubscribed: true},
+
+		// Error cases
+		"Error on missing machine cache": {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// We change the dbus returned values to simulate a subscription
+			//t.Parallel()
+
+			require.NoError(t, subscriptionDbus.SetProperty(consts.SubscriptionDbusInterface+".Attached", !tc.isNotSubscribed), "Setup: can not set subscription status")
+			defer func() {
+				require.NoError(t, subscriptionDbus.SetProperty(consts.SubscriptionDbusInterface+".Attached", false), "Teardown: can not restore subscription status")
+			}()
+
+			cacheDir, runDir := t.TempDir(), t.TempDir()
+			m, err := policies.NewManager(bus, hostname, mockBackend{},
+				policies.WithCacheDir(cacheDir),
+				policies.WithRunDir(runDir),
+				// Nothing is installed on the machine.
+				policies.WithDpkgQueryCmd([]string{"/bin/true"}),
+			)
+			require.NoError(t, err, "Setup: couldn’t get a new policy manager")
+
+			if tc.cachePolicyMachine != "" {
+				err := shutil.CopyTree(filepath.Join("testdata", "cache", "policies", tc.cachePolicyMachine), filepath.Join(cacheDir, policies.PoliciesCacheBaseName, hostname), nil)
+				require.NoError(t, err, "Setup: couldn’t copy machine policies cache")
+			}
+
+			got, err := m.AptDryRun(context.Background())
+			if tc.wantErr {
+				require.Error(t, err, "AptDryRun should return an error but got none")
+				return
+			}
+			require.NoError(t, err, "AptDryRun should return no error but got one")
+
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "AptDryRun returned expected output")
+		})
+	}
+}
+
+func TestCompareSSSDGPOs(t *testing.T) {
+	t.Parallel()
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err, "Setup: failed to get hostname for tests.")
+
+	tests := map[string]struct {
+		cachePolicyMachine string
+		sssdGPOs           []backends.EvaluatedGPO
+		sssdErr            bool
+		noGPOEvaluator     bool
+
+		wantErr bool
+	}{
+		"Same GPOs for adsys and SSSD": {cachePolicyMachine: "two_gpos_no_override", sssdGPOs: []backends.EvaluatedGPO{
+			{ID: "{GPOId}", Version: 1}, {ID: "{GPOId2}", Version: 4}}},
+		"GPO IDs are compared case insensitively": {cachePolicyMachine: "one_gpo", sssdGPOs: []backends.EvaluatedGPO{
+			{ID: "{gpoid}", Version: 1}}},
+		"GPOs only applied by adsys": {cachePolicyMachine: "two_gpos_no_override", sssdGPOs: []backends.EvaluatedGPO{
+			{ID: "{GPOId2}", Version: 4}}},
+		"GPOs only evaluated by SSSD": {cachePolicyMachine: "one_gpo", sssdGPOs: []backends.EvaluatedGPO{
+			{ID: "{GPOId}", Version: 1}, {ID: "{GPOFilteredOut}", Version: 2}}},
+		"No GPO evaluated by SSSD": {cachePolicyMachine: "two_gpos_no_override"},
+
+		// Error cases
+		"Error on backend not evaluating GPOs":   {cachePolicyMachine: "one_gpo", noGPOEvaluator: true, wantErr: true},
+		"Error on SSSD failing to list its GPOs": {cachePolicyMachine: "one_gpo", sssdErr: true, wantErr: true},
+		"Error on missing machine cache":         {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var backend backends.Backend = mockGPOEvaluator{gpos: tc.sssdGPOs, wantErr: tc.sssdErr}
+			if tc.noGPOEvaluator {
+				backend = mockBackend{}
+			}
+
+			cacheDir, runDir := t.TempDir(), t.TempDir()
+			m, err := policies.NewManager(testutils.NewDbusConn(t), hostname, backend,
+				policies.WithCacheDir(cacheDir),
+				policies.WithRunDir(runDir),
+			)
+			require.NoError(t, err, "Setup: couldn’t get a new policy manager")
+
+			if tc.cachePolicyMachine != "" {
+				err := shutil.CopyTree(filepath.Join("testdata", "cache", "policies", tc.cachePolicyMachine), filepath.Join(cacheDir, policies.PoliciesCacheBaseName, hostname), nil)
+				require.NoError(t, err, "Setup: couldn’t copy machine policies cache")
+			}
+
+			got, err := m.CompareSSSDGPOs(context.Background())
+			if tc.wantErr {
+				require.Error(t, err, "CompareSSSDGPOs should return an error but got none")
+				return
+			}
+			require.NoError(t, err, "CompareSSSDGPOs should return no error but got one")
+
+			// The hostname changes between machines.
+			got = strings.ReplaceAll(got, hostname, "<hostname>")
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "CompareSSSDGPOs returned expected output")
+		})
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	t.Parallel()
+
+	bus := testutils.NewDbusConn(t)
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err, "Setup: failed to get hostname for tests.")
+
+	tests := map[string]struct {
+		manager    string
+		objectName string
+		isComputer bool
+
+		wantErr bool
+	}{
+		"Dump dconf state of user":          {manager: "dconf"},
+		"Dump dconf state of machine":       {manager: "dconf", isComputer: true},
+		"Report when no state is applied":   {manager: "privilege", isComputer: true},
+		"Report when no user state applied": {manager: "dconf", objectName: "otheruser"},
+
+		// Error cases
+		"Error on manager without state dump": {manager: "proxy", wantErr: true},
+		"Error on unknown manager":            {manager: "doesnotexist", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dconfDir := t.TempDir()
+			if tc.objectName == "" {
+				tc.objectName = "ubuntu"
+			}
+			for path, content := range map[string]string{
+				"profile/ubuntu":            "user-db:user\nsystem-db:ubuntu\nsystem-db:machine\n",
+				"db/ubuntu.d/adsys":         "[com/ubuntu/category]\nkey-s='user-value'\n",
+				"db/ubuntu.d/locks/adsys":   "/com/ubuntu/category/key-s\n",
+				"db/machine.d/adsys":        "[com/ubuntu/category]\nkey-s='machine-value'\n",
+				"db/machine.d/locks/adsys":  "/com/ubuntu/category/key-s\n",
+				"db/machine.d/not-ours.txt": "not part of the state",
+			} {
+				p := filepath.Join(dconfDir, path)
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create dconf directory")
+				require.NoError(t, os.WriteFile(p, []byte(content), 0600), "Setup: can't create dconf file")
+			}
+
+			m, err := policies.NewManager(bus, hostname, mockBackend{},
+				policies.WithCacheDir(t.TempDir()),
+				policies.WithRunDir(t.TempDir()),
+				policies.WithDconfDir(dconfDir),
+				policies.WithSudoersDir(t.TempDir()),
+				policies.WithPolicyKitDir(t.TempDir()),
+			)
+			require.NoError(t, err, "Setup: couldn’t get a new policy manager")
+
+			got, err := m.DumpState(context.Background(), tc.manager, tc.objectName, tc.isComputer)
+			if tc.wantErr {
+				require.Error(t, err, "DumpState should return an error but got none")
+				return
+			}
+			require.NoError(t, err, "DumpState should return no error but got one")
+
+			got = strings.ReplaceAll(got, dconfDir, "#DCONFDIR#")
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "DumpState returned expected output")
+		})
+	}
+}
+
 func TestGetSubscriptionState(t *testing.T) {
 	//t.Parallel()
 
@@ -421,6 +940,136 @@ func TestGetSubscriptionState(t *testing.T) {
 	}
 }
 
+func TestFilterGPOsForRing(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		ring string
+
+		want []string
+	}{
+		"Machine in a ring keeps GPOs targeting it and unrestricted ones": {ring: "canary", want: []string{"GPOCanary", "GPODisabledRing", "GPONoRing"}},
+		"Ring can be one of multiple targeted rings":                      {ring: "broad", want: []string{"GPOPilotAndBroad", "GPODisabledRing", "GPONoRing"}},
+		"Machine in an untargeted ring only keeps unrestricted GPOs":      {ring: "other", want: []string{"GPODisabledRing", "GPONoRing"}},
+		"Machine without ring only keeps unrestricted GPOs":               {want: []string{"GPODisabledRing", "GPONoRing"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			pols, err := policies.NewFromCache(context.Background(), filepath.Join("testdata", "cache", "policies", "rollout_rings"))
+			require.NoError(t, err, "Setup: can not load policies list")
+			defer pols.Close()
+
+			var got []string
+			for _, g := range policies.FilterGPOsForRing(context.Background(), pols.GPOs, tc.ring) {
+				got = append(got, g.Name)
+			}
+			require.Equal(t, tc.want, got, "FilterGPOsForRing should keep expected GPOs")
+		})
+	}
+}
+
+func TestFilterGPOsForHardware(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		facts hardware.Facts
+
+		want []string
+	}{
+		"Laptop with TPM keeps GPOs targeting it and unrestricted ones": {facts: hardware.Facts{hardware.Chassis: "laptop", hardware.TPM: "yes", hardware.SecureBoot: "enabled"}, want: []string{"GPOLaptops", "GPOLaptopsWithTPM", "GPODisabledTargeting", "GPONoTargeting"}},
+		"All expressions have to match":                                 {facts: hardware.Facts{hardware.Chassis: "laptop", hardware.TPM: "no", hardware.SecureBoot: "enabled"}, want: []string{"GPOLaptops", "GPODisabledTargeting", "GPONoTargeting"}},
+		"Negated expressions match other values":                        {facts: hardware.Facts{hardware.Chassis: "desktop", hardware.SecureBoot: "disabled"}, want: []string{"GPOInsecureBoot", "GPODisabledTargeting", "GPONoTargeting"}},
+		"Unknown facts only keep unrestricted GPOs":                     {facts: hardware.Facts{}, want: []string{"GPOInsecureBoot", "GPODisabledTargeting", "GPONoTargeting"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			pols, err := policies.NewFromCache(context.Background(), filepath.Join("testdata", "cache", "policies", "hardware_targeting"))
+			require.NoError(t, err, "Setup: can not load policies list")
+			defer pols.Close()
+
+			var got []string
+			for _, g := range policies.FilterGPOsForHardware(context.Background(), pols.GPOs, tc.facts) {
+				got = append(got, g.Name)
+			}
+			require.Equal(t, tc.want, got, "FilterGPOsForHardware should keep expected GPOs")
+		})
+	}
+}
+
+func TestFilterEntriesForTarget(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		flavor   string
+		desktops []string
+
+		want map[string][]string
+	}{
+		"Kubuntu with KDE keeps entries targeting it and unrestricted ones": {flavor: "kubuntu", desktops: []string{"KDE"}, want: map[string][]string{
+			"dconf": {"path/to/kubuntu", "path/to/kubuntu-or-xubuntu", "path/to/kde", "path/to/kubuntu-with-kde", "path/to/everywhere"}}},
+		"Flavor can be one of multiple targeted flavors": {flavor: "xubuntu", desktops: []string{"XFCE"}, want: map[string][]string{
+			"dconf": {"path/to/kubuntu-or-xubuntu", "path/to/everywhere"}, "files": {"xubuntu-file"}}},
+		"Desktop is matched on any installed desktop": {flavor: "ubuntu", desktops: []string{"GNOME", "KDE", "ubuntu"}, want: map[string][]string{
+			"dconf": {"path/to/kde", "path/to/everywhere"}}},
+		"Flavor without desktop does not keep entries restricted to desktops": {flavor: "kubuntu", want: map[string][]string{
+			"dconf": {"path/to/kubuntu", "path/to/kubuntu-or-xubuntu", "path/to/everywhere"}}},
+		"Machine without flavor nor desktop only keeps unrestricted entries": {want: map[string][]string{
+			"dconf": {"path/to/everywhere"}}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			pols, err := policies.NewFromCache(context.Background(), filepath.Join("testdata", "cache", "policies", "flavors_and_desktops"))
+			require.NoError(t, err, "Setup: can not load policies list")
+			defer pols.Close()
+
+			got := make(map[string][]string)
+			for _, g := range policies.FilterEntriesForTarget(context.Background(), pols.GPOs, tc.flavor, tc.desktops) {
+				for t, entries := range g.Rules {
+					for _, e := range entries {
+						got[t] = append(got[t], e.Key)
+					}
+				}
+			}
+			require.Equal(t, tc.want, got, "FilterEntriesForTarget should keep expected entries")
+		})
+	}
+}
+
+func TestLazyManager(t *testing.T) {
+	t.Parallel()
+
+	var builds int
+	l := policies.NewLazyManager(func() *int {
+		builds++
+		n := builds
+		return &n
+	})
+	require.Equal(t, 0, builds, "Manager should not be built before being acquired")
+
+	first := l.Acquire()
+	second := l.Acquire()
+	require.Equal(t, 1, builds, "Manager should be built once while in use")
+	require.Same(t, first, second, "Manager should be shared while in use")
+
+	l.Release()
+	require.Same(t, first, l.Acquire(), "Manager should be kept while still in use")
+	l.Release()
+	l.Release()
+
+	require.NotSame(t, first, l.Acquire(), "Manager should be built again once released")
+	require.Equal(t, 2, builds, "Manager should be built again once released")
+	l.Release()
+}
+
 // mockProxyApplier is a mock for the proxy apply object.
 type mockProxyApplier struct {
 	wantApplyError bool
@@ -453,3 +1102,18 @@ func (m mockBackend) IsOnline() (bool, error) {
 	return true, nil
 }
 func (m mockBackend) Config() string { return "mock config" }
+
+// mockGPOEvaluator is a backend evaluating the GPOs of the machine on its own, like SSSD.
+type mockGPOEvaluator struct {
+	mockBackend
+
+	gpos    []backends.EvaluatedGPO
+	wantErr bool
+}
+
+func (m mockGPOEvaluator) EvaluatedGPOs(context.Context) ([]backends.EvaluatedGPO, error) {
+	if m.wantErr {
+		return nil, errors.New("mock error")
+	}
+	return m.gpos, nil
+}
@@ -83,6 +83,37 @@ protocol://domain.com/mountpath
 `,
 	},
 
+	"entry with nfs versions": {Value: `
+nfs://nfs.example.com/default
+nfs3://nfs.example.com/v3
+nfs4://nfs.example.com/v4
+`,
+	},
+
+	"entry with mount options": {Value: `
+nfs://nfs.example.com/share vers=4.2,ro
+[krb5]nfs4://nfs.example.com/secure   proto=tcp  timeo=600
+nfs3://nfs.example.com/legacy nfsvers=3,soft
+smb://smb.example.com/share ro
+`,
+	},
+
+	"entry with kerberos security flavor": {Value: "[krb5]nfs4://nfs.example.com/private sec=krb5p"},
+
+	"entry with nfs shares and other ones": {Value: `
+[krb5]nfs4://nfs.example.com/home sec=krb5p
+smb://smb.example.com/share ro
+nfs://nfs.example.com/public
+`,
+	},
+
+	"entry with nfs shares": {Value: `
+nfs://nfs.example.com/public
+`,
+	},
+
+	"entry with invalid mount option": {Value: "nfs://nfs.example.com/share vers=4.2,$(reboot)"},
+
 	"errored entry": {Value: "protocol://domain.com/mountpath", Err: fmt.Errorf("some error")},
 
 	"entry with badly formatted value": {Value: "protocol//domain.com/mountpath"},
@@ -32,10 +32,12 @@ func TestParseEntryValues(t *testing.T) {
 
 		// Special cases.
 		"Parse values from entry with kerberos auth tags": {entry: "entry with kerberos auth tags"},
+		"Parse values from entry with mount options":      {entry: "entry with mount options"},
 		"Returns empty slice if the entry is empty":       {entry: "entry with no value"},
 
 		// Error cases
 		"Error when parsing entry with badly formatted values": {entry: "entry with badly formatted value", wantErr: true},
+		"Error when parsing entry with invalid mount options":  {entry: "entry with invalid mount option", wantErr: true},
 	}
 
 	for name, tc := range tests {
@@ -132,11 +134,16 @@ func TestCreateUnits(t *testing.T) {
 	t.Parallel()
 
 	tests := map[string]struct {
-		entry string
+		entry   string
+		forUser bool
 	}{
-		"Write single unit":      {entry: "entry with one value"},
-		"Write multiple units":   {entry: "entry with multiple values"},
-		"Write krb5 tagged unit": {entry: "entry with kerberos auth tag"},
+		"Write single unit":                      {entry: "entry with one value"},
+		"Write multiple units":                   {entry: "entry with multiple values"},
+		"Write krb5 tagged unit":                 {entry: "entry with kerberos auth tag"},
+		"Write NFS units with versions":          {entry: "entry with nfs versions"},
+		"Write units with mount options":         {entry: "entry with mount options"},
+		"Write user units with forced options":   {entry: "entry with nfs versions", forUser: true},
+		"Write krb5 unit with overridden flavor": {entry: "entry with kerberos security flavor"},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -146,7 +153,12 @@ func TestCreateUnits(t *testing.T) {
 			require.NoError(t, err, "Setup: failed to parse entries for TestCreateUnits.")
 
 			unitPath := t.TempDir()
-			units := createUnits(parsedValues)
+			var units map[string]string
+			if tc.forUser {
+				units = createUnits(parsedValues, "/adsys/users/ubuntu", userNFSOptions...)
+			} else {
+				units = createUnits(parsedValues, "/adsys")
+			}
 
 			for name, content := range units {
 				err := os.WriteFile(filepath.Join(unitPath, name), []byte(content), 0600)
@@ -4,7 +4,9 @@
 //   - System mounts: Systemd mount units are created to handle the mount process of the
 //     requested shared locations;
 //   - User mounts:   The policy values are parsed into a mounts file that will handled by a
-//     helper binary that will mount the shared locations using gio.
+//     helper binary that will mount the shared locations using gio. NFS shares are mounted by the
+//     kernel instead, through systemd mount units under the directory of the user, as gvfs doesn't
+//     support Kerberos security nor NFSv4.
 //
 // Should the manager fail to write the required assets, an error will be returned.
 // However, if the manager setup all the required steps, it's up to the correctness of the specified
@@ -21,6 +23,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
@@ -46,6 +49,18 @@ var systemdUnitTemplate string
 const krbTag string = "[krb5]"
 const defaultMountTimeoutSec int = 30
 
+// usersMountsDir is the directory under which the NFS shares of the users are mounted, in a subdirectory per user.
+const usersMountsDir = "/adsys/users"
+
+// usersUnitsPrefix is the prefix of the names of the mount units of the users.
+const usersUnitsPrefix = "adsys-users-"
+
+// optionRe matches a single mount option, like vers=4.2 or ro.
+var optionRe = regexp.MustCompile(`^[A-Za-z0-9_.=:/@+-]+$`)
+
+// userNFSOptions are always set for the NFS shares of the users, as they are mounted by root.
+var userNFSOptions = []string{"nosuid", "nodev"}
+
 // Manager holds information needed for handling the mount policies.
 type Manager struct {
 	runDir        string
@@ -165,7 +180,25 @@ func (m *Manager) applyUserMountsPolicy(ctx context.Context, username string, en
 		return err
 	}
 
-	s := strings.Join(parsedValues, "\n")
+	// NFS shares are mounted by the kernel, the other ones by gvfs in the session of the user.
+	var gvfsValues, nfsValues []string
+	for _, v := range parsedValues {
+		if isNFS(parseMountPath(v).protocol) {
+			nfsValues = append(nfsValues, v)
+			continue
+		}
+		location, options := splitOptions(v)
+		if len(options) > 0 {
+			log.Warning(ctx, gotext.Get("Mount options of %q are only supported for NFS shares and will be ignored", location))
+		}
+		gvfsValues = append(gvfsValues, location)
+	}
+
+	if err := m.applyMountUnits(ctx, createUnits(nfsValues, filepath.Join(usersMountsDir, username), userNFSOptions...), m.currentUserMountUnits(username), false); err != nil {
+		return err
+	}
+
+	s := strings.Join(gvfsValues, "\n")
 	if s == "" {
 		if err = m.cleanupMountsFile(ctx, u.Uid); err != nil {
 			return err
@@ -189,13 +222,16 @@ func (m *Manager) applySystemMountsPolicy(ctx context.Context, machineName strin
 	if err != nil {
 		return err
 	}
-	newUnits := createUnits(parsedValues)
 
+	return m.applyMountUnits(ctx, createUnits(parsedValues, "/adsys"), m.currentSystemMountUnits(), true)
+}
+
+// applyMountUnits writes the new mount units, removes the previous ones which are not needed anymore and starts
+// the units which changed. Units are enabled, to be mounted on boot, if enable is true.
+func (m *Manager) applyMountUnits(ctx context.Context, newUnits map[string]string, prevUnits map[string]struct{}, enable bool) error {
 	// Marks shares to write as new units and removes from map units that shouldn't change
 	needsReload := false
-	var unitsToEnable []string
-
-	prevUnits := m.currentSystemMountUnits()
+	var unitsToStart []string
 
 	// Removes from the map all the units that are supposed to be written or updated.
 	for name := range newUnits {
@@ -217,7 +253,7 @@ func (m *Manager) applySystemMountsPolicy(ctx context.Context, machineName strin
 			return err
 		}
 		if written {
-			unitsToEnable = append(unitsToEnable, name)
+			unitsToStart = append(unitsToStart, name)
 		}
 		needsReload = needsReload || written
 	}
@@ -232,9 +268,11 @@ func (m *Manager) applySystemMountsPolicy(ctx context.Context, machineName strin
 	}
 
 	// Enables and starts new units.
-	for _, name := range unitsToEnable {
-		if err := m.systemdCaller.EnableUnit(ctx, name); err != nil {
-			return err
+	for _, name := range unitsToStart {
+		if enable {
+			if err := m.systemdCaller.EnableUnit(ctx, name); err != nil {
+				return err
+			}
 		}
 		if err := m.systemdCaller.StartUnit(ctx, name); err != nil {
 			log.Warning(ctx, gotext.Get("failed to start unit %q: %v", name, err))
@@ -252,16 +290,18 @@ type mountInfo struct {
 	options    []string
 }
 
-// createUnits formats the adsys-.mount template with the specified paths.
-func createUnits(mountPaths []string) map[string]string {
+// createUnits formats the adsys-.mount template with the specified paths, mounted under mountRoot.
+// The forced options are added to the ones of each path.
+func createUnits(mountPaths []string, mountRoot string, forcedOptions ...string) map[string]string {
 	units := make(map[string]string)
 
 	for _, mp := range mountPaths {
 		mi := parseMountPath(mp)
 
 		what := whatStringFromInfo(mi)
-		where := filepath.Join("/", "adsys", mi.protocol, mi.hostname, mi.sharedPath)
+		where := filepath.Join(mountRoot, mi.protocol, mi.hostname, mi.sharedPath)
 
+		mi.options = append(mi.options, forcedOptions...)
 		opts := "defaults"
 		if mi.options != nil {
 			opts = strings.Join(mi.options, ",")
@@ -283,18 +323,25 @@ func createUnits(mountPaths []string) map[string]string {
 	return units
 }
 
-// parseMountPath takes a mount path <protocol>://<hostname>/<shared_path> and parses it
+// parseMountPath takes a mount path <protocol>://<hostname>/<shared_path> [options] and parses it
 // into the richer type mountInfo.
 func parseMountPath(path string) mountInfo {
 	var info mountInfo
 
+	// path = [krb5]protocol://hostname/shared_path [options]
+	path, options := splitOptions(path)
+
 	// path = [krb5]protocol://hostname/shared_path
 	krb5 := strings.HasPrefix(path, krbTag)
 	if krb5 {
 		path = strings.TrimPrefix(path, krbTag)
 		// Using krb5i since it's supported by both cifs and nfs, while krb5p is only supported by nfs.
-		info.options = append(info.options, "sec=krb5i")
+		// The security flavor can be overridden in the options, like sec=krb5p.
+		if !slices.ContainsFunc(options, func(o string) bool { return strings.HasPrefix(o, "sec=") }) {
+			info.options = append(info.options, "sec=krb5i")
+		}
 	}
+	info.options = append(info.options, options...)
 
 	// path = protocol://hostname/shared_path
 	protocol, path, _ := strings.Cut(path, ":")
@@ -306,6 +353,12 @@ func parseMountPath(path string) mountInfo {
 		info.protocol = "cifs"
 	case "ftp":
 		info.protocol = "fuse"
+	case "nfs3":
+		// NFSv3 is selected through the options of the nfs type.
+		info.protocol = "nfs"
+		if !slices.ContainsFunc(info.options, func(o string) bool { return strings.HasPrefix(o, "vers=") || strings.HasPrefix(o, "nfsvers=") }) {
+			info.options = append(info.options, "vers=3")
+		}
 	default:
 		info.protocol = protocol
 	}
@@ -330,7 +383,7 @@ func whatStringFromInfo(mi mountInfo) string {
 	case "cifs":
 		// What=//hostname/shared_path e.g. //domain.com/cifs_share
 		what = fmt.Sprintf("//%s/%s", mi.hostname, mi.sharedPath)
-	case "nfs":
+	case "nfs", "nfs4":
 		// What=hostname:/shared_path e.g. domain.com:/nfs_share
 		what = fmt.Sprintf("%s:/%s", mi.hostname, mi.sharedPath)
 	case "fuse":
@@ -345,6 +398,28 @@ func whatStringFromInfo(mi mountInfo) string {
 	return what
 }
 
+// isNFS returns true if protocol is a NFS one, as recognized by the mount command.
+func isNFS(protocol string) bool {
+	return protocol == "nfs" || protocol == "nfs4"
+}
+
+// splitOptions splits the mount options from the location of the value <location> [options].
+// Options are separated by commas, or by spaces.
+func splitOptions(value string) (location string, options []string) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	for _, f := range fields[1:] {
+		for _, o := range strings.Split(f, ",") {
+			if o != "" {
+				options = append(options, o)
+			}
+		}
+	}
+	return fields[0], options
+}
+
 // parseEntryValues parses the entry value, trimming whitespaces and removing duplicates.
 func parseEntryValues(ctx context.Context, e entry.Entry) (p []string, err error) {
 	defer decorate.OnError(&err, gotext.Get("failed to parse entry values"))
@@ -360,8 +435,14 @@ func parseEntryValues(ctx context.Context, e entry.Entry) (p []string, err error
 			continue
 		}
 
-		// Compares "normal" and prefixed values the same way, since the unit name will be the same.
-		tmp := strings.TrimPrefix(v, krbTag)
+		// Normalizes the separator of the mount options.
+		location, options := splitOptions(v)
+		if len(options) > 0 {
+			v = location + " " + strings.Join(options, ",")
+		}
+
+		// Compares "normal" and prefixed values the same way, without their options, since the unit name will be the same.
+		tmp := strings.TrimPrefix(location, krbTag)
 		if prev, ok := seen[tmp]; ok {
 			if prev == v {
 				log.Debug(ctx, gotext.Get("Value %q is duplicated.", v))
@@ -382,10 +463,17 @@ func parseEntryValues(ctx context.Context, e entry.Entry) (p []string, err error
 	return p, nil
 }
 
-// checkValue checks if the entry value respects the defined formatting directive: <protocol>://<hostname-or-ip>/<shared-path>.
+// checkValue checks if the entry value respects the defined formatting directive: <protocol>://<hostname-or-ip>/<shared-path> [options].
 func checkValue(value string) error {
+	location, options := splitOptions(value)
+	for _, o := range options {
+		if !optionRe.MatchString(o) {
+			return errors.New(gotext.Get("entry %q has an invalid mount option %q", value, o))
+		}
+	}
+
 	// Removes the kerberos auth tag, if it exists
-	tmp := strings.TrimPrefix(value, krbTag)
+	tmp := strings.TrimPrefix(location, krbTag)
 
 	// Value left: protocol://<hostname-or-ip>/<shared-path>
 	if _, hostnameAndPath, found := strings.Cut(tmp, ":"); !found || !strings.HasPrefix(hostnameAndPath, "//") {
@@ -473,6 +561,13 @@ func (m *Manager) cleanup(ctx context.Context, objectName string, isComputer boo
 		if u, err = m.userLookup(objectName); err != nil {
 			return err
 		}
+		var units []string
+		for k := range m.currentUserMountUnits(objectName) {
+			units = append(units, k)
+		}
+		if err := m.cleanupMountUnits(ctx, units); err != nil {
+			return err
+		}
 		return m.cleanupMountsFile(ctx, u.Uid)
 	}
 
@@ -523,11 +618,32 @@ func (m *Manager) cleanupMountUnits(ctx context.Context, units []string) (err er
 }
 
 // currentSystemMountUnits reads the unit directory and returns a map containing the adsys mount units found.
+// The mount units of the users are excluded.
 func (m *Manager) currentSystemMountUnits() map[string]struct{} {
 	paths, _ := filepath.Glob(filepath.Join(m.systemUnitDir, "adsys-*.mount"))
 
 	units := make(map[string]struct{})
 	for _, path := range paths {
+		if strings.HasPrefix(filepath.Base(path), usersUnitsPrefix) {
+			continue
+		}
+		units[filepath.Base(path)] = struct{}{}
+	}
+
+	return units
+}
+
+// currentUserMountUnits reads the unit directory and returns a map containing the mount units of username.
+func (m *Manager) currentUserMountUnits(username string) map[string]struct{} {
+	// The escaped user name can contain glob characters: match the prefix instead.
+	prefix := usersUnitsPrefix + unit.UnitNameEscape(username) + "-"
+	paths, _ := filepath.Glob(filepath.Join(m.systemUnitDir, usersUnitsPrefix+"*.mount"))
+
+	units := make(map[string]struct{})
+	for _, path := range paths {
+		if !strings.HasPrefix(filepath.Base(path), prefix) {
+			continue
+		}
 		units[filepath.Base(path)] = struct{}{}
 	}
 
@@ -100,6 +100,8 @@ func TestApplyPolicy(t *testing.T) {
 		"User, successfully apply policy with kerberos auth tags":                             {entries: []string{"entry with kerberos auth tags"}},
 		"User, successfully apply policy prioritizing the first value found, despite the tag": {entries: []string{"entry with same values tagged and untagged"}},
 		"User, does nothing if the entry is disabled":                                         {isDisabled: true},
+		"User, NFS shares are mounted through units and other ones by gvfs":                   {entries: []string{"entry with nfs shares and other ones"}},
+		"User, mount options of other shares than NFS ones are ignored":                       {entries: []string{"entry with mount options"}},
 
 		// Badly formatted entries.
 		"User, successfully apply policy trimming whitespaces":           {entries: []string{"entry with spaces"}},
@@ -112,6 +114,9 @@ func TestApplyPolicy(t *testing.T) {
 		"User, mount file is removed on refreshing policy with an empty entry":                {secondCall: []string{"entry with no value"}},
 		"User, mount file is removed on refreshing policy with a disabled entry":              {secondCall: []string{"entry with one value"}, isDisabledSecondCall: true},
 		"User, mount file is updated on refreshing policy with an entry with multiple values": {secondCall: []string{"entry with multiple values"}},
+		"User, NFS units are updated on refreshing policy":                                    {entries: []string{"entry with nfs shares and other ones"}, secondCall: []string{"entry with nfs shares"}},
+		"User, NFS units are removed on refreshing policy with no entries":                    {entries: []string{"entry with nfs shares and other ones"}, secondCall: []string{"no entries"}},
+		"User, NFS units are removed on refreshing policy with a disabled entry":              {entries: []string{"entry with nfs shares and other ones"}, secondCall: []string{"entry with nfs shares"}, isDisabledSecondCall: true},
 
 		/**************************** SYSTEM ***************************/
 		// Success cases.
@@ -123,6 +128,8 @@ func TestApplyPolicy(t *testing.T) {
 
 		// Special cases.
 		"System, successfully apply policy with kerberos tagged values":                         {entries: []string{"entry with kerberos auth tags"}, isComputer: true},
+		"System, successfully apply policy with mount options":                                  {entries: []string{"entry with mount options"}, isComputer: true},
+		"System, successfully apply policy with NFS versions":                                   {entries: []string{"entry with nfs versions"}, isComputer: true},
 		"System, successfully apply policy prioritizing the first value found, despite the tag": {entries: []string{"entry with same values tagged and untagged"}, isComputer: true},
 		"System, only emit a warning when starting new units fails":                             {isComputer: true, firstMockSystemdCaller: mockSystemdCaller{failOn: start}},
 		"System, only emit a warning when stopping previous units fails":                        {isComputer: true, secondCall: []string{"entry with multiple values"}, secondMockSystemdCaller: mockSystemdCaller{failOn: stop}},
@@ -158,6 +165,9 @@ func TestApplyPolicy(t *testing.T) {
 		"Error when cleaning up user policy with no entries and path already exists as a directory":  {entries: []string{"no entries"}, pathAlreadyExists: true, wantErr: true},
 		"Error when cleaning up user policy with empty entry and path already exists as a directory": {entries: []string{"entry with no value"}, pathAlreadyExists: true, wantErr: true},
 		"Error when applying policy with entry containing badly formatted value":                     {entries: []string{"entry with badly formatted value"}, wantErr: true},
+		"Error when applying policy with entry containing invalid mount options":                     {entries: []string{"entry with invalid mount option"}, wantErr: true},
+		"Error when daemon-reload fails for user NFS shares":                                         {entries: []string{"entry with nfs shares"}, firstMockSystemdCaller: mockSystemdCaller{failOn: daemonReload}, wantErr: true},
+		"Error when disabling user NFS units for clean up fails":                                     {entries: []string{"entry with nfs shares"}, secondCall: []string{"no entries"}, secondMockSystemdCaller: mockSystemdCaller{failOn: disable}, wantErrSecondCall: true},
 
 		/**************************** SYSTEM ***************************/
 		// Error cases.
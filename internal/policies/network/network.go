@@ -0,0 +1,244 @@
+// Package network provides a manager that deploys the Wi-Fi and wired network profiles authenticated with
+// 802.1X to NetworkManager.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - network/wifi: WPA2-Enterprise Wi-Fi profiles, one per line, of the form
+//     name=<name>, ssid=<ssid>, eap=<method>, ca=<ca>[, phase2=<method>][, cert=<ca>][, domain=<domain>][, identity=<identity>][, hidden=yes];
+//   - network/wired: wired 802.1X profiles, one per line, of the form
+//     name=<name>, eap=<method>, ca=<ca>[, interface=<interface>][, phase2=<method>][, cert=<ca>][, domain=<domain>][, identity=<identity>].
+//
+// The EAP method is one of tls, peap and ttls. With tls, the machine authenticates with the machine certificate
+// enrolled by the certificate manager. With peap and ttls, the credentials of the user are asked when connecting.
+// The authentication server is validated with the root certificate of the certification authority ca, installed
+// by the certificate manager, or with the system trust store if ca is system.
+//
+// Each profile is written to an adsys-<name>.nmconnection file in the system connections directory, and
+// NetworkManager reloads its connections whenever one changes. Profiles not configured anymore are removed.
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+// filePrefix is the prefix of the connection files created by adsys.
+const filePrefix = "adsys-"
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// Manager deploys the network profiles to NetworkManager.
+type Manager struct {
+	domain         string
+	connectionsDir string
+	stateDir       string
+
+	nmcliCmd   []string
+	cmdTimeout time.Duration
+}
+
+type options struct {
+	connectionsDir string
+	stateDir       string
+	nmcliCmd       []string
+	cmdTimeout     time.Duration
+}
+
+// Option reprents an optional function to change the network manager.
+type Option func(*options)
+
+// WithConnectionsDir overrides the default NetworkManager system connections directory.
+func WithConnectionsDir(p string) func(*options) {
+	return func(a *options) {
+		a.connectionsDir = p
+	}
+}
+
+// WithStateDir overrides the default state directory, where the certificates are enrolled.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithNmcliCmd overrides the default nmcli command.
+func WithNmcliCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.nmcliCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the network policy.
+func New(domain string, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		connectionsDir: consts.DefaultNetworkConnectionsDir,
+		stateDir:       consts.DefaultStateDir,
+		nmcliCmd:       []string{"nmcli"},
+		cmdTimeout:     consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		domain:         domain,
+		connectionsDir: args.connectionsDir,
+		stateDir:       args.stateDir,
+		nmcliCmd:       args.nmcliCmd,
+		cmdTimeout:     args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy writes the network profiles from the list of entries, and removes the ones not configured anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply network policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Network policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying network policy to %s", objectName)
+
+	var profiles []profile
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		var lines []string
+		for _, l := range strings.Split(v, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+		switch e.Key {
+		case "network/wifi":
+			profiles, err = parseProfiles(lines, true, profiles)
+		case "network/wired":
+			profiles, err = parseProfiles(lines, false, profiles)
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing network entries, skipping it", e.Key))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	want := make(map[string][]byte)
+	for _, p := range profiles {
+		m.checkCertificates(ctx, p)
+		want[filePrefix+p.name+".nmconnection"] = []byte(p.keyfile(objectName, m.domain, m.stateDir))
+	}
+
+	changed, err := m.writeProfiles(ctx, want)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.nmcliCmd, "connection", "reload"); errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		log.Warning(ctx, gotext.Get("NetworkManager is not installed, the network profiles will be loaded once it is"))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkCertificates warns if the certificates referenced by the profile p are not enrolled yet.
+// The profile is still written, so that it works as soon as the certificate manager enrolls them.
+func (m *Manager) checkCertificates(ctx context.Context, p profile) {
+	var paths []string
+	if p.ca != systemCA {
+		paths = append(paths, caCertificate(m.stateDir, p.ca))
+	}
+	if p.eap == "tls" {
+		cert, key := machineCertificate(m.stateDir, p.cert)
+		paths = append(paths, cert, key)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			log.Warning(ctx, gotext.Get("Certificate %s of network profile %s is not available: %v", path, p.name, err))
+		}
+	}
+}
+
+// writeProfiles writes the connection files of want, and removes the ones created by adsys which are not wanted
+// anymore. It returns true if any file changed.
+func (m *Manager) writeProfiles(ctx context.Context, want map[string][]byte) (changed bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write network profiles"))
+
+	var names []string
+	for name := range want {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		p := filepath.Join(m.connectionsDir, name)
+		if cur, err := os.ReadFile(p); err == nil && bytes.Equal(cur, want[name]) {
+			continue
+		}
+
+		log.Infof(ctx, "Writing network profile %s", strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), ".nmconnection"))
+		// nolint:gosec // G301 match distribution permission
+		if err := os.MkdirAll(m.connectionsDir, 0755); err != nil {
+			return changed, err
+		}
+		// NetworkManager ignores connection files readable by other users than root.
+		if err := os.WriteFile(p+".new", want[name], 0600); err != nil {
+			return changed, err
+		}
+		if err := os.Rename(p+".new", p); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	// Glob only fails on invalid patterns.
+	existing, _ := filepath.Glob(filepath.Join(m.connectionsDir, filePrefix+"*.nmconnection"))
+	for _, p := range existing {
+		if _, ok := want[filepath.Base(p)]; ok {
+			continue
+		}
+		log.Infof(ctx, "Removing network profile %s", strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), filePrefix), ".nmconnection"))
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return changed, err
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,138 @@
+package network_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/network"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	wifiTLS := "name=corp-wifi, ssid=Corp, eap=tls, ca=example-CA, domain=radius.example.com"
+	wiredPEAP := "name=corp-wired, eap=peap, ca=example-CA"
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Wi-Fi profile with EAP-TLS":                  {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS}}},
+		"Wi-Fi profile with PEAP":                     {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp Users, eap=peap, ca=example-CA, phase2=gtc, identity=anonymous@example.com"}}},
+		"Wi-Fi profile with TTLS":                     {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, eap=ttls, ca=example-CA, phase2=pap"}}},
+		"Hidden Wi-Fi profile":                        {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, eap=peap, ca=example-CA, hidden=yes"}}},
+		"Wi-Fi profile validated with system CAs":     {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, eap=tls, ca=system, cert=example-CA, domain=radius.example.com"}}},
+		"Wi-Fi profile with machine identity":         {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, eap=tls, ca=example-CA, identity=host/ubuntu.corp.example.com"}}},
+		"Wi-Fi profile with other client certificate": {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, eap=tls, ca=Root CA, cert=Issuing CA"}}},
+		"Wired profile with PEAP":                     {entries: []entry.Entry{{Key: "network/wired", Value: wiredPEAP}}},
+		"Wired profile on interface":                  {entries: []entry.Entry{{Key: "network/wired", Value: "name=corp-wired, eap=tls, ca=example-CA, interface=enp0s31f6"}}},
+		"Multiple profiles": {entries: []entry.Entry{
+			{Key: "network/wifi", Value: wifiTLS + "\n\nname=guest-wifi, ssid=Guest, eap=peap, ca=system"},
+			{Key: "network/wired", Value: wiredPEAP}}},
+		"Last profile with the same name wins":      {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS + "\nname=corp-wifi, ssid=Corp2, eap=peap, ca=example-CA"}}},
+		"Fields are case insensitive and trimmed":   {entries: []entry.Entry{{Key: "network/wifi", Value: "  Name = corp-wifi ,SSID=Corp,  EAP=TLS, CA=example-CA  "}}},
+		"Disabled entries are ignored":              {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS}, {Key: "network/wired", Value: wiredPEAP, Disabled: true}}},
+		"Unsupported keys are ignored":              {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS}, {Key: "network/vpn", Value: "name=vpn"}}},
+		"Existing profiles are replaced":            {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS}}, existingDirs: "existing-profiles"},
+		"No entries removes existing profiles":      {existingDirs: "existing-profiles"},
+		"No entries and no existing profiles":       {},
+		"Unchanged profiles don't reload":           {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS}}, existingDirs: "unchanged-profiles"},
+		"NetworkManager not installed is a warning": {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS}}, mockBehaviour: "no-nmcli"},
+		"Not a computer is a no-op":                 {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS}}, isNotComputer: true, existingDirs: "existing-profiles"},
+
+		// Error cases
+		"Error on missing name":                     {entries: []entry.Entry{{Key: "network/wifi", Value: "ssid=Corp, eap=tls, ca=example-CA"}}, wantErr: true},
+		"Error on missing SSID":                     {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, eap=tls, ca=example-CA"}}, wantErr: true},
+		"Error on missing CA":                       {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, eap=tls"}}, wantErr: true},
+		"Error on invalid name":                     {entries: []entry.Entry{{Key: "network/wifi", Value: "name=../corp, ssid=Corp, eap=tls, ca=example-CA"}}, wantErr: true},
+		"Error on SSID too long":                    {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=" + strings.Repeat("a", 33) + ", eap=tls, ca=example-CA"}}, wantErr: true},
+		"Error on unsupported EAP method":           {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, eap=leap, ca=example-CA"}}, wantErr: true},
+		"Error on unsupported phase2 method":        {entries: []entry.Entry{{Key: "network/wired", Value: "name=corp-wired, eap=peap, ca=example-CA, phase2=otp"}}, wantErr: true},
+		"Error on phase2 with EAP-TLS":              {entries: []entry.Entry{{Key: "network/wired", Value: "name=corp-wired, eap=tls, ca=example-CA, phase2=mschapv2"}}, wantErr: true},
+		"Error on client certificate with PEAP":     {entries: []entry.Entry{{Key: "network/wired", Value: "name=corp-wired, eap=peap, ca=example-CA, cert=example-CA"}}, wantErr: true},
+		"Error on EAP-TLS with system CAs only":     {entries: []entry.Entry{{Key: "network/wired", Value: "name=corp-wired, eap=tls, ca=system"}}, wantErr: true},
+		"Error on invalid CA name":                  {entries: []entry.Entry{{Key: "network/wired", Value: "name=corp-wired, eap=tls, ca=../../etc/shadow"}}, wantErr: true},
+		"Error on invalid domain":                   {entries: []entry.Entry{{Key: "network/wired", Value: "name=corp-wired, eap=peap, ca=example-CA, domain=-example.com"}}, wantErr: true},
+		"Error on invalid interface":                {entries: []entry.Entry{{Key: "network/wired", Value: "name=corp-wired, eap=peap, ca=example-CA, interface=enp0s31f6:1"}}, wantErr: true},
+		"Error on interface for Wi-Fi profile":      {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, eap=tls, ca=example-CA, interface=wlan0"}}, wantErr: true},
+		"Error on SSID for wired profile":           {entries: []entry.Entry{{Key: "network/wired", Value: "name=corp-wired, ssid=Corp, eap=peap, ca=example-CA"}}, wantErr: true},
+		"Error on invalid hidden value":             {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, eap=peap, ca=example-CA, hidden=true"}}, wantErr: true},
+		"Error on control characters":               {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp\tGuest, eap=peap, ca=example-CA"}}, wantErr: true},
+		"Error on field set twice":                  {entries: []entry.Entry{{Key: "network/wifi", Value: "name=corp-wifi, ssid=Corp, ssid=Other, eap=peap, ca=example-CA"}}, wantErr: true},
+		"Error on reloading NetworkManager":         {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS}}, mockBehaviour: "fail-nmcli", wantErr: true},
+		"Error on unwritable connections directory": {entries: []entry.Entry{{Key: "network/wifi", Value: wifiTLS}}, existingDirs: "existing-profiles", mockBehaviour: "read-only", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			connectionsDir := filepath.Join(root, "etc", "NetworkManager", "system-connections")
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.mockBehaviour == "read-only" {
+				testutils.MakeReadOnly(t, connectionsDir)
+			}
+
+			nmcliCmd := testutils.MockCommand(root, "nmcli", tc.mockBehaviour)
+			if tc.mockBehaviour == "no-nmcli" {
+				nmcliCmd = []string{"/nonexistent/nmcli"}
+			}
+
+			m := network.New("example.com",
+				network.WithConnectionsDir(connectionsDir),
+				// The certificates are referenced with their path on the machine.
+				network.WithStateDir("/var/lib/adsys"),
+				network.WithNmcliCmd(nmcliCmd))
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, behaviours, args := c.Name, strings.Split(c.Behaviour, ","), c.Args
+
+	line := name
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+
+	c.Log(line)
+
+	if slices.Contains(behaviours, "fail-"+name) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,251 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// systemCA selects the system trust store to validate the authentication server.
+	systemCA = "system"
+	// machineTemplate is the certificate template of the machine certificate enrolled by the certificate manager.
+	machineTemplate = "Machine"
+)
+
+var (
+	// profileNameRe matches the names of the profiles, used to name their files.
+	profileNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+	// caNameRe matches the name of a certification authority enrolled by the certificate manager.
+	caNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._-]*$`)
+	// domainRe matches the domain the certificate of the authentication server must belong to.
+	domainRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+	// interfaceRe matches a network interface name.
+	interfaceRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+)
+
+// eapMethods are the supported 802.1X authentication methods.
+var eapMethods = []string{"tls", "peap", "ttls"}
+
+// phase2Methods are the supported inner authentication methods of peap and ttls.
+var phase2Methods = []string{"mschapv2", "mschap", "pap", "chap", "gtc", "md5"}
+
+// profile is a NetworkManager connection authenticated with 802.1X.
+type profile struct {
+	name string
+	// wifi is true for a Wi-Fi connection, and false for a wired one.
+	wifi   bool
+	ssid   string
+	hidden bool
+	// iface restricts a wired connection to a network interface.
+	iface    string
+	eap      string
+	phase2   string
+	ca       string
+	cert     string
+	domain   string
+	identity string
+}
+
+// keyfile returns the content of the NetworkManager connection file of the profile, for the machine
+// objectName of domain, whose certificates are enrolled in stateDir.
+func (p profile) keyfile(objectName, domain, stateDir string) string {
+	var out strings.Builder
+	out.WriteString(header)
+
+	connType := "ethernet"
+	if p.wifi {
+		connType = "wifi"
+	}
+	fmt.Fprintf(&out, "\n[connection]\nid=%s\ntype=%s\n", p.name, connType)
+	if p.iface != "" {
+		fmt.Fprintf(&out, "interface-name=%s\n", p.iface)
+	}
+	out.WriteString("autoconnect=true\n")
+
+	if p.wifi {
+		fmt.Fprintf(&out, "\n[wifi]\nmode=infrastructure\nssid=%s\n", p.ssid)
+		if p.hidden {
+			out.WriteString("hidden=true\n")
+		}
+		out.WriteString("\n[wifi-security]\nkey-mgmt=wpa-eap\n")
+	} else {
+		out.WriteString("\n[ethernet]\n")
+	}
+
+	fmt.Fprintf(&out, "\n[802-1x]\neap=%s;\n", p.eap)
+	identity := p.identity
+	if p.eap == "tls" {
+		// The machine authenticates with its certificate, as host/<fqdn> like Windows machines.
+		if identity == "" {
+			identity = fmt.Sprintf("host/%s.%s", strings.ToLower(objectName), domain)
+		}
+		fmt.Fprintf(&out, "identity=%s\n", identity)
+		cert, key := machineCertificate(stateDir, p.cert)
+		fmt.Fprintf(&out, "client-cert=%s\nprivate-key=%s\nprivate-key-password-flags=4\n", cert, key)
+	} else {
+		if identity != "" {
+			fmt.Fprintf(&out, "identity=%s\n", identity)
+		}
+		fmt.Fprintf(&out, "phase2-auth=%s\n", p.phase2)
+		// The credentials of the user are asked when connecting, and never saved.
+		out.WriteString("password-flags=2\n")
+	}
+	if p.ca == systemCA {
+		out.WriteString("system-ca-certs=true\n")
+	} else {
+		fmt.Fprintf(&out, "ca-cert=%s\n", caCertificate(stateDir, p.ca))
+	}
+	if p.domain != "" {
+		fmt.Fprintf(&out, "domain-suffix-match=%s\n", p.domain)
+	}
+
+	out.WriteString("\n[ipv4]\nmethod=auto\n\n[ipv6]\nmethod=auto\n")
+	return out.String()
+}
+
+// caCertificate returns the path of the root certificate of the certification authority ca, as installed by the
+// certificate manager in stateDir.
+func caCertificate(stateDir, ca string) string {
+	return filepath.Join(stateDir, "certs", ca+".crt")
+}
+
+// machineCertificate returns the paths of the machine certificate issued by the certification authority ca and
+// of its private key, as enrolled by the certificate manager in stateDir.
+func machineCertificate(stateDir, ca string) (cert, key string) {
+	nickname := ca + "." + machineTemplate
+	return filepath.Join(stateDir, "certs", nickname+".crt"), filepath.Join(stateDir, "private", "certs", nickname+".key")
+}
+
+// parseProfiles parses the profiles of lines, Wi-Fi ones if wifi is true and wired ones otherwise.
+// A profile defined more than once is replaced by the last definition.
+func parseProfiles(lines []string, wifi bool, profiles []profile) ([]profile, error) {
+	for _, l := range lines {
+		p, err := parseProfile(l, wifi)
+		if err != nil {
+			return nil, err
+		}
+		if i := slices.IndexFunc(profiles, func(o profile) bool { return o.name == p.name }); i != -1 {
+			profiles[i] = p
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// parseProfile parses the profile line l, of the form
+// name=<name>, ssid=<ssid>, eap=<method>, ca=<ca>[, phase2=<method>][, cert=<ca>][, domain=<domain>][, identity=<identity>][, hidden=yes]
+// for Wi-Fi profiles, and
+// name=<name>, eap=<method>, ca=<ca>[, interface=<interface>][, phase2=<method>][, cert=<ca>][, domain=<domain>][, identity=<identity>]
+// for wired ones.
+func parseProfile(l string, wifi bool) (p profile, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid network profile %q", l))
+
+	usage := gotext.Get("expected name=<name>, eap=<method>, ca=<ca>[, interface=<interface>][, phase2=<method>][, cert=<ca>][, domain=<domain>][, identity=<identity>]")
+	if wifi {
+		usage = gotext.Get("expected name=<name>, ssid=<ssid>, eap=<method>, ca=<ca>[, phase2=<method>][, cert=<ca>][, domain=<domain>][, identity=<identity>][, hidden=yes]")
+	}
+	p.wifi = wifi
+
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(l, ",") {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return p, errors.New(usage)
+		}
+		if seen[k] {
+			return p, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		seen[k] = true
+		if strings.ContainsFunc(v, func(r rune) bool { return r < ' ' || r == '\\' || r == 0x7f }) {
+			return p, errors.New(gotext.Get("%s contains unsupported characters", k))
+		}
+
+		switch {
+		case k == "name":
+			p.name = v
+		case k == "ssid" && wifi:
+			p.ssid = v
+		case k == "hidden" && wifi:
+			if v != "yes" && v != "no" {
+				return p, errors.New(gotext.Get("hidden must be yes or no"))
+			}
+			p.hidden = v == "yes"
+		case k == "interface" && !wifi:
+			p.iface = v
+		case k == "eap":
+			p.eap = strings.ToLower(v)
+		case k == "phase2":
+			p.phase2 = strings.ToLower(v)
+		case k == "ca":
+			p.ca = v
+		case k == "cert":
+			p.cert = v
+		case k == "domain":
+			p.domain = v
+		case k == "identity":
+			p.identity = v
+		default:
+			return p, errors.New(gotext.Get("unsupported field %q", k))
+		}
+	}
+
+	if p.name == "" || p.eap == "" || p.ca == "" || (wifi && p.ssid == "") {
+		return p, errors.New(usage)
+	}
+	if !profileNameRe.MatchString(p.name) {
+		return p, errors.New(gotext.Get("%q is not a valid profile name: only lowercase letters, digits and _.- are supported", p.name))
+	}
+	if len(p.ssid) > 32 {
+		return p, errors.New(gotext.Get("SSID %q is longer than 32 bytes", p.ssid))
+	}
+	if p.iface != "" && !interfaceRe.MatchString(p.iface) {
+		return p, errors.New(gotext.Get("%q is not a valid interface name", p.iface))
+	}
+	if !slices.Contains(eapMethods, p.eap) {
+		return p, errors.New(gotext.Get("unsupported EAP method %q: expected one of %s", p.eap, strings.Join(eapMethods, ", ")))
+	}
+	if p.ca != systemCA && !caNameRe.MatchString(p.ca) {
+		return p, errors.New(gotext.Get("%q is not a valid certification authority name", p.ca))
+	}
+	if p.domain != "" && !domainRe.MatchString(p.domain) {
+		return p, errors.New(gotext.Get("%q is not a valid domain", p.domain))
+	}
+
+	switch p.eap {
+	case "tls":
+		if p.phase2 != "" {
+			return p, errors.New(gotext.Get("phase2 is not supported with EAP-TLS"))
+		}
+		// The machine certificate is issued by the authority of the server, unless it is validated by the system.
+		if p.cert == "" && p.ca != systemCA {
+			p.cert = p.ca
+		}
+		if p.cert == "" {
+			return p, errors.New(gotext.Get("cert is required with EAP-TLS when the system certification authorities are used"))
+		}
+		if !caNameRe.MatchString(p.cert) {
+			return p, errors.New(gotext.Get("%q is not a valid certification authority name", p.cert))
+		}
+	default:
+		if p.cert != "" {
+			return p, errors.New(gotext.Get("cert is only supported with EAP-TLS"))
+		}
+		if p.phase2 == "" {
+			p.phase2 = "mschapv2"
+		}
+		if !slices.Contains(phase2Methods, p.phase2) {
+			return p, errors.New(gotext.Get("unsupported phase2 method %q: expected one of %s", p.phase2, strings.Join(phase2Methods, ", ")))
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,223 @@
+package policies
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ubuntu/adsys/internal/hardware"
+	"github.com/ubuntu/adsys/internal/policies/apparmor"
+	"github.com/ubuntu/adsys/internal/policies/apt"
+	"github.com/ubuntu/adsys/internal/policies/certificate"
+	"github.com/ubuntu/adsys/internal/policies/compliance"
+	"github.com/ubuntu/adsys/internal/policies/encryption"
+	"github.com/ubuntu/adsys/internal/policies/enrollment"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/files"
+	"github.com/ubuntu/adsys/internal/policies/privilege"
+	"github.com/ubuntu/adsys/internal/policies/selinux"
+	"github.com/ubuntu/adsys/internal/policies/shortcuts"
+	"github.com/ubuntu/adsys/internal/policies/vpn"
+)
+
+// lazyManager builds a policy manager when first needed, and releases it once nothing uses it anymore.
+// The manager is shared by the concurrent refreshes, so that it keeps serializing its changes to the system.
+type lazyManager[T any] struct {
+	build func() T
+
+	mu    sync.Mutex
+	m     T
+	users int
+}
+
+// newLazyManager returns a lazyManager building its manager with build.
+func newLazyManager[T any](build func() T) *lazyManager[T] {
+	return &lazyManager[T]{build: build}
+}
+
+// acquire returns the manager, building it if nothing uses it yet. It must be released once done.
+func (l *lazyManager[T]) acquire() T {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.users == 0 {
+		l.m = l.build()
+	}
+	l.users++
+	return l.m
+}
+
+// release releases the manager, which is dropped if nothing else uses it.
+func (l *lazyManager[T]) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.users--
+	if l.users == 0 {
+		var zero T
+		l.m = zero
+	}
+}
+
+// applyRequest is what the policy managers need to apply the rules of an object.
+type applyRequest struct {
+	objectName string
+	isComputer bool
+	rules      map[string][]entry.Entry
+	pols       *Policies
+	facts      hardware.Facts
+}
+
+// onDemandApplier applies the rules of its type with a policy manager built on demand.
+type onDemandApplier struct {
+	ruleType string
+	apply    func(ctx context.Context, r applyRequest) error
+}
+
+// onDemand returns the applier of the rules of type t, running apply with the manager of l built for the time
+// of the refresh.
+func onDemand[T any](t string, l *lazyManager[T], apply func(ctx context.Context, mgr T, r applyRequest) error) onDemandApplier {
+	return onDemandApplier{
+		ruleType: t,
+		apply: func(ctx context.Context, r applyRequest) error {
+			mgr := l.acquire()
+			defer l.release()
+			return apply(ctx, mgr, r)
+		},
+	}
+}
+
+// entriesApplier is a policy manager only needing the rules of its type to apply them.
+type entriesApplier interface {
+	ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) error
+}
+
+// onDemandEntries returns the applier of the rules of type t, applied by the manager of l with those rules only.
+func onDemandEntries[T entriesApplier](t string, l *lazyManager[T]) onDemandApplier {
+	return onDemand(t, l, func(ctx context.Context, mgr T, r applyRequest) error {
+		return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, r.rules[t])
+	})
+}
+
+// onDemandAppliers returns the appliers of the policy managers built on demand, in the order they start.
+func (m *Manager) onDemandAppliers() []onDemandApplier {
+	appliers := []onDemandApplier{
+		// The enrollment attaches the machine to Ubuntu Pro, so it is not filtered out without it.
+		onDemand(EnrollmentRuleType, m.enrollment, func(ctx context.Context, mgr *enrollment.Manager, r applyRequest) error {
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, r.rules[EnrollmentRuleType], r.pols.SaveAssetsTo)
+		}),
+		onDemand("privilege", m.privilege, func(ctx context.Context, mgr *privilege.Manager, r applyRequest) error {
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, r.rules["privilege"], r.pols.SaveAssetsTo)
+		}),
+	}
+
+	// Only the policy of the security module of the machine is applied.
+	switch m.securityModule {
+	case SecurityModuleSELinux:
+		appliers = append(appliers, onDemand("selinux", m.selinux, func(ctx context.Context, mgr *selinux.Manager, r applyRequest) error {
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, r.rules["selinux"], r.pols.SaveAssetsTo)
+		}))
+	default:
+		appliers = append(appliers, onDemand("apparmor", m.apparmor, func(ctx context.Context, mgr *apparmor.Manager, r applyRequest) error {
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, r.rules["apparmor"], r.pols.SaveAssetsTo)
+		}))
+	}
+
+	return append(appliers,
+		onDemandEntries("proxy", m.proxy),
+		onDemand("certificate", m.certificate, func(ctx context.Context, mgr *certificate.Manager, r applyRequest) error {
+			isOnline, serverFQDN := m.onlineStatus(ctx)
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, isOnline, serverFQDN, r.rules["certificate"])
+		}),
+		onDemandEntries("mail", m.mail),
+		onDemandEntries("session", m.session),
+		onDemandEntries("firewall", m.firewall),
+		m.withPackageLock(onDemand("apt", m.apt, func(ctx context.Context, mgr *apt.Manager, r applyRequest) error {
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, r.rules["apt"], r.pols.SaveAssetsTo)
+		})),
+		m.withPackageLock(onDemandEntries("snap", m.snap)),
+		m.withPackageLock(onDemandEntries("flatpak", m.flatpak)),
+		m.withPackageLock(onDemandEntries("services", m.services)),
+		onDemandEntries("tasks", m.tasks),
+		onDemand("files", m.files, func(ctx context.Context, mgr *files.Manager, r applyRequest) error {
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, r.rules["files"], r.pols.SaveAssetsTo)
+		}),
+		onDemandEntries("printers", m.printers),
+		onDemandEntries("firefox", m.firefox),
+		onDemandEntries("chrome", m.chrome),
+		onDemand("shortcuts", m.shortcuts, func(ctx context.Context, mgr *shortcuts.Manager, r applyRequest) error {
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, r.rules["shortcuts"], r.pols.SaveAssetsTo)
+		}),
+		onDemandEntries("ini", m.ini),
+		onDemandEntries("sysctl", m.sysctl),
+		onDemandEntries("report", m.report),
+		onDemandEntries("audit", m.audit),
+		onDemandEntries("usbguard", m.usbguard),
+		onDemandEntries("accounts", m.accounts),
+		onDemandEntries("localusers", m.localusers),
+		onDemand("compliance", m.compliance, func(ctx context.Context, mgr *compliance.Manager, r applyRequest) error {
+			isOnline, serverFQDN := m.onlineStatus(ctx)
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, isOnline, serverFQDN, r.facts, r.rules["compliance"])
+		}),
+		onDemandEntries("updates", m.updates),
+		onDemand("encryption", m.encryption, func(ctx context.Context, mgr *encryption.Manager, r applyRequest) error {
+			isOnline, serverFQDN := m.onlineStatus(ctx)
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, isOnline, serverFQDN, r.rules["encryption"])
+		}),
+		onDemandEntries("network", m.network),
+		onDemand("vpn", m.vpn, func(ctx context.Context, mgr *vpn.Manager, r applyRequest) error {
+			return mgr.ApplyPolicy(ctx, r.objectName, r.isComputer, r.rules["vpn"], r.pols.SaveAssetsTo)
+		}),
+		onDemandEntries("timesync", m.timesync),
+		onDemandEntries("sshd", m.sshd),
+		onDemandEntries("banners", m.banners),
+		onDemandEntries("locale", m.locale),
+		onDemandEntries("polkit", m.polkit),
+		onDemandEntries("power", m.power),
+		onDemandEntries("kmod", m.kmod),
+		onDemandEntries("grub", m.grub),
+		onDemandEntries("quota", m.quota),
+		onDemandEntries("broadcast", m.broadcast),
+		onDemandEntries("dns", m.dns),
+	)
+}
+
+// onlineStatus returns if the backend is online, with the FQDN of the server it is connected to.
+// Errors are ignored as we don't want to fail because of online status this late in the process.
+func (m *Manager) onlineStatus(ctx context.Context) (isOnline bool, serverFQDN string) {
+	isOnline, _ = m.backend.IsOnline()
+	if isOnline {
+		serverFQDN, _ = m.backend.ServerFQDN(ctx)
+	}
+	return isOnline, serverFQDN
+}
+
+// withPackageLock returns a, applying its rules once no package manager transaction is active, and one at a time
+// with the other managers installing packages or restarting services.
+// Only machine policies install packages or restart services: user logons are never delayed.
+func (m *Manager) withPackageLock(a onDemandApplier) onDemandApplier {
+	apply := a.apply
+	a.apply = func(ctx context.Context, r applyRequest) error {
+		if !r.isComputer {
+			return apply(ctx, r)
+		}
+		return m.packageLock.Run(ctx, func() error { return apply(ctx, r) })
+	}
+	return a
+}
+
+// stateDumperFunc is a StateDumper dumping the state with the function itself.
+type stateDumperFunc func(ctx context.Context, objectName string, isComputer bool) (string, error)
+
+// DumpState calls f.
+func (f stateDumperFunc) DumpState(ctx context.Context, objectName string, isComputer bool) (string, error) {
+	return f(ctx, objectName, isComputer)
+}
+
+// lazyStateDumper returns the StateDumper of the manager of l, built for the time of the dump if needed.
+func lazyStateDumper[T StateDumper](l *lazyManager[T]) StateDumper {
+	return stateDumperFunc(func(ctx context.Context, objectName string, isComputer bool) (string, error) {
+		d := l.acquire()
+		defer l.release()
+		return d.DumpState(ctx, objectName, isComputer)
+	})
+}
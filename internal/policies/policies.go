@@ -12,20 +12,27 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/leonelquinteros/gotext"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
 	"github.com/ubuntu/adsys/internal/policies/entry"
 	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/mmap"
 	"gopkg.in/yaml.v3"
 )
 
 const (
 	// PoliciesCacheBaseName is the base directory where we want to cache policies.
-	PoliciesCacheBaseName  = "policies"
+	PoliciesCacheBaseName = "policies"
+	// DownloadedPoliciesCacheBaseName is the base directory where we store downloaded policies not applied yet.
+	DownloadedPoliciesCacheBaseName = "downloaded-policies"
+
 	policiesFileName       = "policies"
 	policiesAssetsFileName = "assets.db"
 )
@@ -38,8 +45,59 @@ type assetsFromMMAP struct {
 
 // Policies is the list of GPOs applied to a particular object, with the global data cache.
 type Policies struct {
-	GPOs   []GPO
-	assets *assetsFromMMAP `yaml:"-"`
+	GPOs []GPO
+	// Changes is the time each effective rule, identified by its type/key, last changed.
+	Changes map[string]time.Time `yaml:",omitempty"`
+	// Skipped is the reason each manager didn't apply any rule during the last refresh, identified by its type.
+	Skipped map[string]SkipReason `yaml:",omitempty"`
+	// Audited are the rules in audit mode during the last refresh, identified by their type/key, with the rule
+	// applied in their place. It is nil if no rule was applied in their place.
+	Audited map[string]*entry.Entry `yaml:",omitempty"`
+	// Warnings are the rules which were not applied during the last refresh, identified by their type/key, with
+	// the reason why.
+	Warnings map[string]string `yaml:",omitempty"`
+	// Removed are the rules produced by GPOs which are not applied anymore, identified by their type/key.
+	// Reverted rules are only recorded for the refresh reverting them, and tattooed rules until they are
+	// configured again.
+	Removed map[string]RemovedRule `yaml:",omitempty"`
+	assets  *assetsFromMMAP        `yaml:"-"`
+}
+
+// RemovedRule is a rule produced by a GPO which is not applied anymore.
+type RemovedRule struct {
+	// GPO is the name of the closest GPO not applied anymore which produced the rule.
+	GPO string
+	// Tattooed is true if the setting of the rule is kept on the system, as its manager doesn't revert it.
+	Tattooed bool `yaml:",omitempty"`
+}
+
+// SkipReason is the reason why a manager didn't apply any rule.
+type SkipReason string
+
+const (
+	// SkipNoEntries is used when no rule of the manager type is defined for the object.
+	SkipNoEntries SkipReason = "no-entries"
+	// SkipNotEntitled is used when the rules are only available for Ubuntu Pro subscribers.
+	SkipNotEntitled SkipReason = "not-pro-entitled"
+	// SkipUnsupported is used when the rules are not supported on this system or by this build of adsys.
+	SkipUnsupported SkipReason = "unsupported"
+	// SkipDisabled is used when the rules are disabled by the configuration of adsys, like in read-only mode.
+	SkipDisabled SkipReason = "disabled-by-config"
+)
+
+// String returns the human readable description of the skip reason.
+func (r SkipReason) String() string {
+	switch r {
+	case SkipNoEntries:
+		return gotext.Get("no entries")
+	case SkipNotEntitled:
+		return gotext.Get("not entitled, requires an Ubuntu Pro subscription")
+	case SkipUnsupported:
+		return gotext.Get("not supported on this system")
+	case SkipDisabled:
+		return gotext.Get("disabled by configuration")
+	}
+	return string(r)
 }
 
 // New returns new policies with GPOs and assets loaded from DB.
@@ -392,8 +450,10 @@ func (pols Policies) GetUniqueRules() map[string][]entry.Entry {
 							continue
 						}
 						e.Value = e.Value + "\n" + dedup[t][e.Key].Value
-						// Keep closest meta value.
+						// Keep closest meta value, enforcement and list modes.
 						e.Meta = dedup[t][e.Key].Meta
+						e.Mode = dedup[t][e.Key].Mode
+						e.ListMode = dedup[t][e.Key].ListMode
 					}
 					dedup[t][e.Key] = e
 					if keyAlreadySeen {
@@ -427,6 +487,208 @@ func (pols Policies) GetUniqueRules() map[string][]entry.Entry {
 	return r
 }
 
+// TrackChanges records in pols the time each effective rule last changed.
+// Rules which are identical to the ones in previous keep their recorded time, any other rule is
+// marked as changed at now. Rules without any recorded time in previous are considered as changed.
+func (pols *Policies) TrackChanges(previous Policies, now time.Time) {
+	previousRules := make(map[string]entry.Entry)
+	for t, entries := range previous.GetUniqueRules() {
+		for _, e := range entries {
+			previousRules[filepath.Join(t, e.Key)] = e
+		}
+	}
+
+	changes := make(map[string]time.Time)
+	for t, entries := range pols.GetUniqueRules() {
+		for _, e := range entries {
+			k := filepath.Join(t, e.Key)
+			changes[k] = now
+
+			p, ok := previousRules[k]
+			if !ok || p.Value != e.Value || p.Disabled != e.Disabled || p.Meta != e.Meta {
+				continue
+			}
+			if lastChange, ok := previous.Changes[k]; ok {
+				changes[k] = lastChange
+			}
+		}
+	}
+
+	pols.Changes = changes
+}
+
+// gpoNames returns the names of the GPOs, from the highest priority.
+func (pols Policies) gpoNames() []string {
+	names := make([]string, 0, len(pols.GPOs))
+	for _, g := range pols.GPOs {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+// ruleOrigins returns the GPOs which produced each effective rule, identified by its type/key, closest first.
+// A rule appended from several GPOs has one origin per GPO, following the same precedence as GetUniqueRules.
+func (pols Policies) ruleOrigins() map[string][]GPO {
+	origins := make(map[string][]GPO)
+	strategies := make(map[string]string)
+	for _, gpo := range pols.GPOs {
+		for t, entries := range gpo.Rules {
+			for _, e := range entries {
+				k := filepath.Join(t, e.Key)
+				closest, seen := strategies[k]
+				switch {
+				case !seen:
+					// Disabled keys are never appended.
+					if e.Strategy == entry.StrategyAppend && e.Disabled {
+						continue
+					}
+					strategies[k] = e.Strategy
+					origins[k] = []GPO{gpo}
+				case closest == entry.StrategyAppend && e.Strategy == entry.StrategyAppend && !e.Disabled:
+					origins[k] = append(origins[k], gpo)
+				}
+			}
+		}
+	}
+	return origins
+}
+
+// TrackRemoved records in pols the rules produced during the previous refresh by GPOs which are not applied
+// anymore, like unlinked or deleted GPOs, and which no other GPO configures now.
+// Their managers revert them on this refresh, unless they are tattooing rules: those settings are kept on the
+// system, and stay recorded until they are configured again.
+func (pols *Policies) TrackRemoved(ctx context.Context, previous Policies) {
+	applied := make(map[string]struct{})
+	for _, g := range pols.GPOs {
+		applied[g.ID] = struct{}{}
+	}
+	current := pols.ruleOrigins()
+
+	removed := make(map[string]RemovedRule)
+	reverted := make(map[string][]string)
+	tattooed := make(map[string][]string)
+	for k, origins := range previous.ruleOrigins() {
+		if _, ok := current[k]; ok {
+			continue
+		}
+		i := slices.IndexFunc(origins, func(g GPO) bool {
+			_, ok := applied[g.ID]
+			return !ok
+		})
+		// The rule was removed from a GPO still applied: this is a regular change of the GPO.
+		if i == -1 {
+			continue
+		}
+
+		t, key, _ := strings.Cut(k, "/")
+		r := RemovedRule{GPO: origins[i].Name, Tattooed: isTattooing(t, key)}
+		removed[k] = r
+		if r.Tattooed {
+			tattooed[r.GPO] = append(tattooed[r.GPO], k)
+			continue
+		}
+		reverted[r.GPO] = append(reverted[r.GPO], k)
+	}
+
+	revertedGPOs := maps.Keys(reverted)
+	slices.Sort(revertedGPOs)
+	for _, gpo := range revertedGPOs {
+		slices.Sort(reverted[gpo])
+		log.Info(ctx, gotext.Get("GPO %q is not applied anymore, reverting its settings: %s", gpo, strings.Join(reverted[gpo], ", ")))
+	}
+	tattooedGPOs := maps.Keys(tattooed)
+	slices.Sort(tattooedGPOs)
+	for _, gpo := range tattooedGPOs {
+		slices.Sort(tattooed[gpo])
+		log.Warning(ctx, gotext.Get("GPO %q is not applied anymore, but the following settings are kept on the system as they are never reverted: %s", gpo, strings.Join(tattooed[gpo], ", ")))
+	}
+
+	// Tattooed settings stay on the system until they are configured again.
+	for k, r := range previous.Removed {
+		if _, ok := current[k]; ok || !r.Tattooed {
+			continue
+		}
+		if _, ok := removed[k]; !ok {
+			removed[k] = r
+		}
+	}
+
+	pols.Removed = nil
+	if len(removed) > 0 {
+		pols.Removed = removed
+	}
+}
+
+// AuditRules returns rules where the rules in audit mode are replaced by the rules applied in their place during
+// the previous refresh, so that their changes are only logged. The rules applied in their place are recorded in pols.
+func (pols *Policies) AuditRules(ctx context.Context, rules map[string][]entry.Entry, previous Policies) map[string][]entry.Entry {
+	previousRules := make(map[string]entry.Entry)
+	for t, entries := range previous.GetUniqueRules() {
+		for _, e := range entries {
+			previousRules[filepath.Join(t, e.Key)] = e
+		}
+	}
+	// Rules which were already audited are the ones applied in their place.
+	for k, e := range previous.Audited {
+		delete(previousRules, k)
+		if e != nil {
+			previousRules[k] = *e
+		}
+	}
+
+	pols.Audited = nil
+	r := make(map[string][]entry.Entry)
+	for t, entries := range rules {
+		for _, e := range entries {
+			if e.Mode != entry.ModeAudit {
+				r[t] = append(r[t], e)
+				continue
+			}
+
+			k := filepath.Join(t, e.Key)
+			if pols.Audited == nil {
+				pols.Audited = make(map[string]*entry.Entry)
+			}
+			p, ok := previousRules[k]
+			switch {
+			case !ok:
+				log.Info(ctx, gotext.Get("Audit mode: %s would be set to %s", k, formatAuditedValue(e)))
+				pols.Audited[k] = nil
+				continue
+			case p.Value != e.Value || p.Disabled != e.Disabled:
+				log.Info(ctx, gotext.Get("Audit mode: %s would change from %s to %s", k, formatAuditedValue(p), formatAuditedValue(e)))
+			default:
+				log.Debugf(ctx, "Audit mode: %s is already applied", k)
+			}
+			p.Mode = ""
+			pols.Audited[k] = &p
+			r[t] = append(r[t], p)
+		}
+	}
+	return r
+}
+
+// formatAuditedValue returns the value of e, on a single line, to be logged.
+func formatAuditedValue(e entry.Entry) string {
+	if e.Disabled {
+		return gotext.Get("disabled")
+	}
+	return strconv.Quote(strings.TrimSpace(e.Value))
+}
+
+// ChangedSince returns the effective rules of pols, identified by their type/key, which changed after t,
+// with the time of their last change.
+func (pols Policies) ChangedSince(t time.Time) map[string]time.Time {
+	r := make(map[string]time.Time)
+	for k, lastChange := range pols.Changes {
+		if lastChange.Before(t) {
+			continue
+		}
+		r[k] = lastChange
+	}
+	return r
+}
+
 // chown either chown the file descriptor attached, or the path if this one is null to uid and gid.
 // It will know if we should skip chown for tests.
 func chown(p string, f *os.File, uid, gid int) (err error) {
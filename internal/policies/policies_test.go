@@ -835,6 +835,22 @@ func TestGetUniqueRules(t *testing.T) {
 					{Key: "A", Value: "furthest value\nclosest value", Meta: "closest meta", Strategy: entry.StrategyAppend},
 				},
 			}},
+		"Append policy entry, closest enforcement mode wins": {
+			gpos: []policies.GPO{
+				{ID: "closest", Name: "closest-name", Rules: map[string][]entry.Entry{
+					"domain": {
+						{Key: "A", Value: "closest value", Strategy: entry.StrategyAppend, Mode: entry.ModeAudit},
+					}}},
+				{ID: "furthest", Name: "furthest-name", Rules: map[string][]entry.Entry{
+					"domain": {
+						{Key: "A", Value: "furthest value", Strategy: entry.StrategyAppend},
+					}}},
+			},
+			want: map[string][]entry.Entry{
+				"domain": {
+					{Key: "A", Value: "furthest value\nclosest value", Strategy: entry.StrategyAppend, Mode: entry.ModeAudit},
+				},
+			}},
 
 		// Mix append and override: closest win
 		"Mix meta on GPOs, furthest policy entry is append, closest is override": {
@@ -884,6 +900,171 @@ func TestGetUniqueRules(t *testing.T) {
 	}
 }
 
+func TestAuditRules(t *testing.T) {
+	t.Parallel()
+
+	previous := policies.Policies{GPOs: []policies.GPO{{ID: "previous", Name: "previous-name", Rules: map[string][]entry.Entry{
+		"dconf": {
+			{Key: "A", Value: "previousA"},
+			{Key: "B", Value: "previousB"},
+			{Key: "C", Value: "previousC", Mode: entry.ModeAudit},
+		}}}},
+		Audited: map[string]*entry.Entry{"dconf/C": {Key: "C", Value: "appliedC"}},
+	}
+
+	tests := map[string]struct {
+		rules    map[string][]entry.Entry
+		previous policies.Policies
+
+		want        map[string][]entry.Entry
+		wantAudited map[string]*entry.Entry
+	}{
+		"Enforced rules are kept": {
+			rules: map[string][]entry.Entry{"dconf": {{Key: "A", Value: "newA"}, {Key: "B", Value: "newB", Mode: entry.ModeEnforce}}},
+			want:  map[string][]entry.Entry{"dconf": {{Key: "A", Value: "newA"}, {Key: "B", Value: "newB", Mode: entry.ModeEnforce}}},
+		},
+		"Audited rules keep the previous rule": {
+			rules:       map[string][]entry.Entry{"dconf": {{Key: "A", Value: "newA", Mode: entry.ModeAudit}, {Key: "B", Value: "newB"}}},
+			want:        map[string][]entry.Entry{"dconf": {{Key: "A", Value: "previousA"}, {Key: "B", Value: "newB"}}},
+			wantAudited: map[string]*entry.Entry{"dconf/A": {Key: "A", Value: "previousA"}},
+		},
+		"Audited rules without previous rule are not applied": {
+			rules:       map[string][]entry.Entry{"dconf": {{Key: "D", Value: "newD", Mode: entry.ModeAudit}}, "other": {{Key: "A", Disabled: true, Mode: entry.ModeAudit}}},
+			want:        map[string][]entry.Entry{},
+			wantAudited: map[string]*entry.Entry{"dconf/D": nil, "other/A": nil},
+		},
+		"Audited rules keep the rule applied in place of a previously audited rule": {
+			rules:       map[string][]entry.Entry{"dconf": {{Key: "C", Value: "newC", Mode: entry.ModeAudit}}},
+			want:        map[string][]entry.Entry{"dconf": {{Key: "C", Value: "appliedC"}}},
+			wantAudited: map[string]*entry.Entry{"dconf/C": {Key: "C", Value: "appliedC"}},
+		},
+		"Audited rules are not applied when nothing was applied in place of a previously audited rule": {
+			rules: map[string][]entry.Entry{"dconf": {{Key: "A", Value: "newA", Mode: entry.ModeAudit}}},
+			previous: policies.Policies{GPOs: previous.GPOs,
+				Audited: map[string]*entry.Entry{"dconf/A": nil}},
+			want:        map[string][]entry.Entry{},
+			wantAudited: map[string]*entry.Entry{"dconf/A": nil},
+		},
+		"Enforced rules are applied in place of previously audited rules": {
+			rules: map[string][]entry.Entry{"dconf": {{Key: "C", Value: "newC"}}},
+			want:  map[string][]entry.Entry{"dconf": {{Key: "C", Value: "newC"}}},
+		},
+		"Unchanged audited rules keep the previous rule": {
+			rules:       map[string][]entry.Entry{"dconf": {{Key: "A", Value: "previousA", Mode: entry.ModeAudit}}},
+			want:        map[string][]entry.Entry{"dconf": {{Key: "A", Value: "previousA"}}},
+			wantAudited: map[string]*entry.Entry{"dconf/A": {Key: "A", Value: "previousA"}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.previous.GPOs == nil {
+				tc.previous = previous
+			}
+
+			var pols policies.Policies
+			got := pols.AuditRules(context.Background(), tc.rules, tc.previous)
+			require.Equal(t, tc.want, got, "AuditRules returns expected rules")
+			require.Equal(t, tc.wantAudited, pols.Audited, "AuditRules records the rules applied in place of the audited ones")
+		})
+	}
+}
+
+func TestTrackRemoved(t *testing.T) {
+	t.Parallel()
+
+	kept := policies.GPO{ID: "kept", Name: "kept-name", Rules: map[string][]entry.Entry{
+		"dconf": {{Key: "A", Value: "keptA"}},
+	}}
+	removed := policies.GPO{ID: "removed", Name: "removed-name", Rules: map[string][]entry.Entry{
+		"dconf":     {{Key: "A", Value: "removedA"}, {Key: "B", Value: "removedB"}},
+		"apt":       {{Key: "apt/install", Value: "vim"}, {Key: "apt/repositories", Value: "deb http://example.com/ubuntu noble main"}},
+		"privilege": {{Key: "allow-local-admins", Disabled: true}},
+	}}
+	appended := policies.GPO{ID: "appended", Name: "appended-name", Rules: map[string][]entry.Entry{
+		"dconf": {{Key: "C", Value: "appendedC", Strategy: entry.StrategyAppend}},
+	}}
+
+	tests := map[string]struct {
+		previous policies.Policies
+		gpos     []policies.GPO
+
+		want map[string]policies.RemovedRule
+	}{
+		"No previous policies": {
+			gpos: []policies.GPO{kept, removed},
+		},
+		"All GPOs still applied": {
+			previous: policies.Policies{GPOs: []policies.GPO{kept, removed}},
+			gpos:     []policies.GPO{kept, removed},
+		},
+		"Rules of removed GPO are reverted or tattooed": {
+			previous: policies.Policies{GPOs: []policies.GPO{kept, removed}},
+			gpos:     []policies.GPO{kept},
+			want: map[string]policies.RemovedRule{
+				"dconf/B":                      {GPO: "removed-name"},
+				"apt/apt/install":              {GPO: "removed-name", Tattooed: true},
+				"apt/apt/repositories":         {GPO: "removed-name"},
+				"privilege/allow-local-admins": {GPO: "removed-name"},
+			},
+		},
+		"Rules overridden by removed GPO are not removed": {
+			previous: policies.Policies{GPOs: []policies.GPO{removed, kept}},
+			gpos:     []policies.GPO{kept},
+			want: map[string]policies.RemovedRule{
+				"dconf/B":                      {GPO: "removed-name"},
+				"apt/apt/install":              {GPO: "removed-name", Tattooed: true},
+				"apt/apt/repositories":         {GPO: "removed-name"},
+				"privilege/allow-local-admins": {GPO: "removed-name"},
+			},
+		},
+		"Rules removed from a GPO still applied are not recorded": {
+			previous: policies.Policies{GPOs: []policies.GPO{kept, removed}},
+			gpos:     []policies.GPO{kept, {ID: "removed", Name: "removed-name"}},
+		},
+		"Appended rules are removed with their last GPO": {
+			previous: policies.Policies{GPOs: []policies.GPO{appended, {ID: "other", Name: "other-name", Rules: appended.Rules}}},
+			gpos:     []policies.GPO{kept},
+			want:     map[string]policies.RemovedRule{"dconf/C": {GPO: "appended-name"}},
+		},
+		"Appended rules still configured by another GPO are not removed": {
+			previous: policies.Policies{GPOs: []policies.GPO{appended, {ID: "other", Name: "other-name", Rules: appended.Rules}}},
+			gpos:     []policies.GPO{{ID: "other", Name: "other-name", Rules: appended.Rules}},
+		},
+		"Tattooed rules stay recorded until configured again": {
+			previous: policies.Policies{GPOs: []policies.GPO{kept}, Removed: map[string]policies.RemovedRule{
+				"snap/snap/install":  {GPO: "old-name", Tattooed: true},
+				"dconf/A":            {GPO: "old-name", Tattooed: true},
+				"sysctl/sysctl/keys": {GPO: "old-name"},
+			}},
+			gpos: []policies.GPO{kept},
+			want: map[string]policies.RemovedRule{"snap/snap/install": {GPO: "old-name", Tattooed: true}},
+		},
+		"Every rule type of tattooing managers is tattooed": {
+			previous: policies.Policies{GPOs: []policies.GPO{{ID: "removed", Name: "removed-name", Rules: map[string][]entry.Entry{
+				"scripts":    {{Key: "startup", Value: "script.sh"}},
+				"enrollment": {{Key: "enrollment/pro-token", Value: "token"}},
+			}}}},
+			want: map[string]policies.RemovedRule{
+				"scripts/startup":                 {GPO: "removed-name", Tattooed: true},
+				"enrollment/enrollment/pro-token": {GPO: "removed-name", Tattooed: true},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			pols := policies.Policies{GPOs: tc.gpos}
+			pols.TrackRemoved(context.Background(), tc.previous)
+			require.Equal(t, tc.want, pols.Removed, "TrackRemoved records the rules of the GPOs not applied anymore")
+		})
+	}
+}
+
 // equalPoliciesToGolden compares the policies to the given file.
 func equalPoliciesToGolden(t *testing.T, got policies.Policies, golden string, update bool) {
 	t.Helper()
@@ -0,0 +1,226 @@
+// Package polkit provides a manager that deploys polkit rules on the machine.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - polkit/allowed-actions: actions the members of a group are allowed to perform without authenticating,
+//     one per line, of the form <group> = <action>. The action is a polkit action identifier, like
+//     org.freedesktop.NetworkManager.settings.modify.system, or a prefix of identifiers ending with .*, like
+//     org.freedesktop.NetworkManager.*. Empty lines and lines starting with # are ignored;
+//   - polkit/rules: polkit rules, in the JavaScript syntax of polkit(8), deployed as is.
+//
+// The rules are written to a 49-adsys.rules file in the rules.d directory of polkit, so that they are evaluated
+// before the default rules of the system. polkitd reloads the rules by itself whenever the file changes.
+// The file is removed once the policy is not configured anymore.
+//
+// Nothing is done if the installed version of polkit does not support JavaScript rules. The administrator
+// privileges of the users are configured by the privilege manager.
+package polkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const rulesFile = "49-adsys.rules"
+
+// actionRe matches a polkit action identifier, optionally ending with .* to match all the actions with this prefix.
+var actionRe = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*(\.\*)?$`)
+
+const header = `// This file is managed by adsys.
+// Do not edit this file manually.
+// Any changes will be overwritten.
+`
+
+// allowedAction is an action the members of a group are allowed to perform.
+type allowedAction struct {
+	group  string
+	action string
+}
+
+// Manager applies the polkit policy on the machine.
+type Manager struct {
+	rulesDir string
+}
+
+type options struct {
+	rulesDir string
+}
+
+// Option reprents an optional function to change the polkit manager.
+type Option func(*options)
+
+// WithRulesDir overrides the default polkit rules directory.
+func WithRulesDir(p string) func(*options) {
+	return func(a *options) {
+		a.rulesDir = p
+	}
+}
+
+// New returns a new manager for the polkit policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		rulesDir: filepath.Join(consts.DefaultPolicyKitDir, "rules.d"),
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		rulesDir: args.rulesDir,
+	}
+}
+
+// ApplyPolicy deploys the polkit rules from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply polkit policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Polkit policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying polkit policy to %s", objectName)
+
+	actions, rules, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	// The rules directory is only shipped by the versions of polkit supporting JavaScript rules.
+	if _, err := os.Stat(m.rulesDir); errors.Is(err, fs.ErrNotExist) {
+		if len(actions) > 0 || len(rules) > 0 {
+			log.Warning(ctx, gotext.Get("The installed version of polkit does not support rules, skipping polkit policy"))
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return m.writeRules(ctx, actions, rules)
+}
+
+// DumpState returns the polkit rules written during the last refresh of the machine.
+// The state is empty for users or if no polkit policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump polkit state of %s", objectName))
+
+	// Polkit policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.rulesDir, rulesFile))
+}
+
+// parseEntries validates the entries and returns the allowed actions, in order and without duplicates,
+// and the rules to deploy as is.
+func parseEntries(ctx context.Context, entries []entry.Entry) (actions []allowedAction, rules []string, err error) {
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+
+		switch e.Key {
+		case "polkit/allowed-actions":
+			for _, l := range strings.Split(e.Value, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" || strings.HasPrefix(l, "#") {
+					continue
+				}
+				group, action, found := strings.Cut(l, "=")
+				a := allowedAction{group: strings.TrimSpace(group), action: strings.TrimSpace(action)}
+				if !found || a.group == "" {
+					return nil, nil, errors.New(gotext.Get("invalid allowed action %q: expected <group> = <action>", l))
+				}
+				if !actionRe.MatchString(a.action) {
+					return nil, nil, errors.New(gotext.Get("invalid allowed action %q: %q is not a polkit action identifier", l, a.action))
+				}
+				if slices.Contains(actions, a) {
+					continue
+				}
+				actions = append(actions, a)
+			}
+		case "polkit/rules":
+			if r := strings.TrimSpace(e.Value); r != "" {
+				rules = append(rules, r)
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing polkit entries, skipping it", e.Key))
+		}
+	}
+
+	return actions, rules, nil
+}
+
+// writeRules writes the allowed actions and the rules to the adsys rules file, removing it if there is none.
+func (m *Manager) writeRules(ctx context.Context, actions []allowedAction, rules []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write polkit rules"))
+
+	p := filepath.Join(m.rulesDir, rulesFile)
+	if len(actions) == 0 && len(rules) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	var content strings.Builder
+	content.WriteString(header)
+	for _, a := range actions {
+		// Quote the values as JSON strings, which are valid JavaScript strings.
+		group, err := json.Marshal(a.group)
+		if err != nil {
+			return err
+		}
+		condition := "action.id == %s"
+		id := a.action
+		if prefix, ok := strings.CutSuffix(a.action, "*"); ok {
+			condition = "action.id.indexOf(%s) == 0"
+			id = prefix
+		}
+		action, err := json.Marshal(id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&content, `
+polkit.addRule(function(action, subject) {
+    if (%s && subject.isInGroup(%s)) {
+        return polkit.Result.YES;
+    }
+});
+`, fmt.Sprintf(condition, action), group)
+	}
+	for _, r := range rules {
+		fmt.Fprintf(&content, "\n%s\n", r)
+	}
+
+	if old, err := os.ReadFile(p); err == nil && string(old) == content.String() {
+		log.Debug(ctx, "Polkit rules are up to date")
+		return nil
+	}
+
+	log.Infof(ctx, "Deploying %d polkit allowed actions and %d rules", len(actions), len(rules))
+	// polkitd drops its privileges and needs to read the rules.
+	if err := os.WriteFile(p+".new", []byte(content.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
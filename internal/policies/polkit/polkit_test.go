@@ -0,0 +1,84 @@
+package polkit_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/polkit"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	actions := "netadmins@example.com = org.freedesktop.NetworkManager.*\nprinteradmins = org.opensuse.cupspkhelper.mechanism.all-edit"
+	rules := `polkit.addRule(function(action, subject) {
+    if (action.id == "org.freedesktop.login1.reboot" && subject.isInGroup("operators")) {
+        return polkit.Result.AUTH_ADMIN;
+    }
+});`
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existing      string
+		noRulesDir    bool
+
+		wantErr bool
+	}{
+		"Deploy allowed actions":                   {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions}}},
+		"Deploy rules":                             {entries: []entry.Entry{{Key: "polkit/rules", Value: rules}}},
+		"Deploy allowed actions and rules":         {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions}, {Key: "polkit/rules", Value: rules}}},
+		"Comments and empty lines are ignored":     {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: "# Network\n\n  netadmins   =   org.freedesktop.NetworkManager.*  \n"}}},
+		"Duplicated actions are deployed once":     {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions}, {Key: "polkit/allowed-actions", Value: "netadmins@example.com = org.freedesktop.NetworkManager.*\nusers = org.freedesktop.udisks2.filesystem-mount"}}},
+		"Group names are quoted":                   {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: `it "admins" = org.freedesktop.packagekit.*`}}},
+		"Rules from multiple entries are kept":     {entries: []entry.Entry{{Key: "polkit/rules", Value: rules}, {Key: "polkit/rules", Value: "// Another rule\npolkit.addRule(function(action, subject) {});"}}},
+		"Rules are updated":                        {existing: "states/applied", entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions}}},
+		"Unchanged rules are kept":                 {existing: "states/unchanged", entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions}}},
+		"No entries removes rules":                 {existing: "states/applied"},
+		"Disabled entries remove rules":            {existing: "states/applied", entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions, Disabled: true}}},
+		"Only comments removes rules":              {existing: "states/applied", entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: "# Nothing allowed"}}},
+		"Unsupported keys are ignored":             {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions}, {Key: "polkit/denied-actions", Value: actions}}},
+		"No entries is a no-op":                    {},
+		"Rules not supported by polkit is a no-op": {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions}}, noRulesDir: true},
+		"Not a computer is a no-op":                {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions}}, isNotComputer: true},
+
+		// Error cases
+		"Error on allowed action without group":     {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: "= org.freedesktop.NetworkManager.*"}}, wantErr: true},
+		"Error on allowed action without separator": {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: "netadmins org.freedesktop.NetworkManager.*"}}, wantErr: true},
+		"Error on invalid action":                   {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: `netadmins = org.freedesktop"); polkit.Result.YES; ("`}}, wantErr: true},
+		"Error on action with inner wildcard":       {entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: "netadmins = org.*.NetworkManager"}}, wantErr: true},
+		"Error on unwritable rules directory":       {existing: "states/rules-dir-is-a-file", entries: []entry.Entry{{Key: "polkit/allowed-actions", Value: actions}}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			} else if !tc.noRulesDir {
+				require.NoError(t, os.MkdirAll(filepath.Join(root, "etc", "polkit-1", "rules.d"), 0750), "Setup: can't create polkit rules directory")
+			}
+
+			m := polkit.New(polkit.WithRulesDir(filepath.Join(root, "etc", "polkit-1", "rules.d")))
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
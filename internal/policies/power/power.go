@@ -0,0 +1,233 @@
+// Package power provides a manager that configures the power management of the machine through systemd-logind.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - power/lid-close-action: the action taken when the lid is closed, set as HandleLidSwitch;
+//   - power/lid-close-action-external-power: the action taken when the lid is closed while the machine is on
+//     external power, set as HandleLidSwitchExternalPower;
+//   - power/lid-close-action-docked: the action taken when the lid is closed while the machine is docked or
+//     connected to an external display, set as HandleLidSwitchDocked;
+//   - power/idle-action: the action taken when the system is idle, set as IdleAction;
+//   - power/idle-action-delay: the number of seconds the system must be idle before the idle action is taken,
+//     from 60 to 86400, set as IdleActionSec. It is only applied along with an idle action.
+//
+// The actions are one of ignore, poweroff, reboot, halt, kexec, suspend, hibernate, hybrid-sleep,
+// suspend-then-hibernate and lock.
+//
+// The settings are written to a drop-in file of the systemd-logind configuration directory, which is removed once
+// the policy is not configured anymore. systemd-logind is then reloaded: if it doesn't support reloading, the
+// settings are applied once it is restarted, at the latest on next boot.
+// Those system-level settings complement the GNOME power settings of the dconf policy, which only apply while a
+// user session is running.
+package power
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	configFile = "adsys.conf"
+	logindUnit = "systemd-logind.service"
+)
+
+// Bounds of the idle action delay, in seconds.
+const (
+	minIdleDelay = 60
+	maxIdleDelay = 86400
+)
+
+// actions are the values supported by the HandleLidSwitch* and IdleAction keywords of logind.
+var actions = []string{"ignore", "poweroff", "reboot", "halt", "kexec", "suspend", "hibernate", "hybrid-sleep", "suspend-then-hibernate", "lock"}
+
+// keywords maps the action keys of the policy to the logind keywords, in the order they are written.
+var keywords = []struct{ key, keyword string }{
+	{"power/lid-close-action", "HandleLidSwitch"},
+	{"power/lid-close-action-external-power", "HandleLidSwitchExternalPower"},
+	{"power/lid-close-action-docked", "HandleLidSwitchDocked"},
+	{"power/idle-action", "IdleAction"},
+}
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// settings is the power management configuration requested by the policy.
+type settings struct {
+	actions   map[string]string
+	idleDelay int
+}
+
+// Manager applies the power management policy on the machine.
+type Manager struct {
+	logindConfDir string
+
+	systemctlCmd []string
+	cmdTimeout   time.Duration
+}
+
+type options struct {
+	logindConfDir string
+	systemctlCmd  []string
+	cmdTimeout    time.Duration
+}
+
+// Option reprents an optional function to change the power manager.
+type Option func(*options)
+
+// WithLogindConfDir overrides the default systemd-logind configuration directory.
+func WithLogindConfDir(p string) func(*options) {
+	return func(a *options) {
+		a.logindConfDir = p
+	}
+}
+
+// WithSystemctlCmd overrides the default systemctl command.
+func WithSystemctlCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.systemctlCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the power management policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		logindConfDir: consts.DefaultLogindConfDir,
+		systemctlCmd:  []string{"systemctl"},
+		cmdTimeout:    consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		logindConfDir: args.logindConfDir,
+		systemctlCmd:  args.systemctlCmd,
+		cmdTimeout:    args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy configures systemd-logind from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply power management policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Power management policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying power management policy to %s", objectName)
+
+	s, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	changed, err := syshelpers.WriteConfig(filepath.Join(m.logindConfDir, configFile), s.logindConf())
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	log.Info(ctx, gotext.Get("Reloading %s to apply the power management settings", logindUnit))
+	// Restarting logind could end the running sessions: only reload it, which older versions don't support.
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.systemctlCmd, "reload", logindUnit); err != nil {
+		log.Warning(ctx, gotext.Get("Couldn't reload %s, the power management settings will be applied once it is restarted: %v", logindUnit, err))
+	}
+	return nil
+}
+
+// DumpState returns the logind configuration written during the last refresh of the machine.
+// The state is empty for users or if no power management policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump power management state of %s", objectName))
+
+	// Power management policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.logindConfDir, configFile))
+}
+
+// parseEntries validates the entries and returns the requested configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry) (s settings, err error) {
+	s.actions = make(map[string]string)
+
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "power/lid-close-action", "power/lid-close-action-external-power", "power/lid-close-action-docked", "power/idle-action":
+			if !slices.Contains(actions, v) {
+				return s, errors.New(gotext.Get("invalid power action %q for %s: expected one of %s", v, e.Key, strings.Join(actions, ", ")))
+			}
+			s.actions[e.Key] = v
+		case "power/idle-action-delay":
+			d, err := strconv.Atoi(v)
+			if err != nil || d < minIdleDelay || d > maxIdleDelay {
+				return s, errors.New(gotext.Get("invalid idle action delay %q: expected a number of seconds between %d and %d", v, minIdleDelay, maxIdleDelay))
+			}
+			s.idleDelay = d
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing power management entries, skipping it", e.Key))
+		}
+	}
+
+	if _, ok := s.actions["power/idle-action"]; !ok && s.idleDelay != 0 {
+		log.Warning(ctx, gotext.Get("Idle action delay %d is ignored as no idle action is configured", s.idleDelay))
+		s.idleDelay = 0
+	}
+
+	return s, nil
+}
+
+// logindConf returns the systemd-logind configuration of the settings, or an empty string if nothing is
+// configured.
+func (s settings) logindConf() string {
+	if len(s.actions) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	out.WriteString(header)
+	out.WriteString("\n[Login]\n")
+	for _, k := range keywords {
+		if v, ok := s.actions[k.key]; ok {
+			fmt.Fprintf(&out, "%s=%s\n", k.keyword, v)
+		}
+	}
+	if s.idleDelay != 0 {
+		fmt.Fprintf(&out, "IdleActionSec=%d\n", s.idleDelay)
+	}
+	return out.String()
+}
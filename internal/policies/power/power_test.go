@@ -0,0 +1,113 @@
+package power_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/power"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "power/lid-close-action", Value: "suspend"},
+		{Key: "power/lid-close-action-external-power", Value: "lock"},
+		{Key: "power/lid-close-action-docked", Value: "ignore"},
+		{Key: "power/idle-action", Value: "suspend-then-hibernate"},
+		{Key: "power/idle-action-delay", Value: "1800"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		mockBehaviour string
+		makeReadOnly  bool
+
+		wantErr bool
+	}{
+		"All entries":                           {entries: allEntries},
+		"Lid close action only":                 {entries: []entry.Entry{{Key: "power/lid-close-action", Value: "poweroff"}}},
+		"Idle action without delay":             {entries: []entry.Entry{{Key: "power/idle-action", Value: "lock"}}},
+		"Idle action delay without action":      {entries: []entry.Entry{{Key: "power/lid-close-action", Value: "lock"}, {Key: "power/idle-action-delay", Value: "600"}}},
+		"Only idle action delay is a no-op":     {entries: []entry.Entry{{Key: "power/idle-action-delay", Value: "600"}}},
+		"Existing file is updated":              {existingDirs: "existing-conf", entries: allEntries},
+		"Existing file is unchanged":            {existingDirs: "existing-conf", entries: []entry.Entry{{Key: "power/lid-close-action", Value: "suspend"}}},
+		"No entries removes existing file":      {existingDirs: "existing-conf"},
+		"Failing to reload logind is a warning": {entries: allEntries, mockBehaviour: "fail-systemctl"},
+
+		"Values are trimmed":               {entries: []entry.Entry{{Key: "power/idle-action", Value: "  hibernate\n"}, {Key: "power/idle-action-delay", Value: " 900 "}}},
+		"Disabled entries are ignored":     {entries: []entry.Entry{{Key: "power/lid-close-action", Value: "lock"}, {Key: "power/idle-action", Value: "suspend", Disabled: true}}},
+		"Empty entries are ignored":        {entries: []entry.Entry{{Key: "power/lid-close-action", Value: "lock"}, {Key: "power/idle-action", Value: ""}}},
+		"Unsupported keys are ignored":     {entries: []entry.Entry{{Key: "power/lid-close-action", Value: "lock"}, {Key: "power/power-key-action", Value: "ignore"}}},
+		"No entries and no existing files": {},
+		"Not a computer is a no-op":        {isNotComputer: true, existingDirs: "existing-conf"},
+
+		// Error cases
+		"Error on invalid lid close action":           {entries: []entry.Entry{{Key: "power/lid-close-action", Value: "explode"}}, wantErr: true},
+		"Error on invalid idle action":                {entries: []entry.Entry{{Key: "power/idle-action", Value: "Suspend"}}, wantErr: true},
+		"Error on invalid idle action delay":          {entries: []entry.Entry{{Key: "power/idle-action-delay", Value: "ten"}}, wantErr: true},
+		"Error on idle action delay below minimum":    {entries: []entry.Entry{{Key: "power/idle-action-delay", Value: "59"}}, wantErr: true},
+		"Error on idle action delay above maximum":    {entries: []entry.Entry{{Key: "power/idle-action-delay", Value: "86401"}}, wantErr: true},
+		"Error on unwritable configuration directory": {existingDirs: "existing-conf", makeReadOnly: true, entries: allEntries, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			logindConfDir := filepath.Join(root, "etc", "systemd", "logind.conf.d")
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.makeReadOnly {
+				testutils.MakeReadOnly(t, logindConfDir)
+			}
+
+			m := power.New(
+				power.WithLogindConfDir(logindConfDir),
+				power.WithSystemctlCmd(testutils.MockCommand(root, "systemctl", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, behaviours, args := c.Name, strings.Split(c.Behaviour, ","), c.Args
+
+	c.Log(fmt.Sprintf("%s %s", name, strings.Join(args, " ")))
+
+	if slices.Contains(behaviours, "fail-"+name) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+}
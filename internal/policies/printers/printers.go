@@ -0,0 +1,571 @@
+// Package printers provides a manager that creates CUPS print queues, selects the default printer and
+// restricts printing.
+//
+// Queues are created system-wide for both computers and users, while the default printer is set for
+// the whole machine with computer policies and for the user only with user policies.
+//
+// The following settings are supported for computers, and with a printers/user- prefix for users
+// (for instance printers/user-connections):
+//   - printers/connections: printers to add, one per line, of the form
+//     name=<queue>, uri=<uri>[, driver=<driver>][, location=<text>][, description=<text>][, default=yes].
+//     IPP printers are driverless by default (driver=everywhere), while other printers default to
+//     the generic PostScript driver. The last printer marked as default is selected as the default
+//     printer if printers/default is not set;
+//   - printers/default: the name of the default printer;
+//   - printers/disable-color: select monochrome printing by default.
+//
+// The following restrictions are supported for computers only, and apply to every queue of the machine:
+//   - printers/allowed: patterns of the queues users can print to. Other queues deny any job;
+//   - printers/duplex: the default sides of the jobs, among one-sided, two-sided-long-edge and
+//     two-sided-short-edge;
+//   - printers/quota: the CUPS quotas of each user on each queue, of the form
+//     pages=<n>[, kilobytes=<n>], days=<n>.
+//
+// Monochrome printing is set as a server default for computers, and in the CUPS options of the user
+// for users, on every refresh. Restrictions are saved in the state file and reverted once not
+// configured anymore.
+//
+// Queues created by adsys are saved in a state file along with the objects requesting them, so that
+// they are removed once no object requests them anymore. Queues are only created again if their
+// definition changed or if they were removed outside of adsys. The default printer is left as is on
+// revert.
+package printers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const stateFile = "state.json"
+
+const (
+	// driverEverywhere is the driver of driverless IPP printers.
+	driverEverywhere = "everywhere"
+	// driverGeneric is the driver of non IPP printers when none is set.
+	driverGeneric = "drv:///sample.drv/generic.ppd"
+)
+
+// queueNameRe matches the queue names accepted by adsys, which are a subset of the ones accepted by CUPS.
+var queueNameRe = regexp.MustCompile(`^[A-Za-z0-9_.@+-]{1,127}$`)
+
+// queue is the definition of a CUPS print queue.
+type queue struct {
+	URI         string `json:"uri"`
+	Driver      string `json:"driver"`
+	Location    string `json:"location,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Objects are the computer and users requesting the queue.
+	Objects []string `json:"objects,omitempty"`
+}
+
+// sameDefinition returns true if q and o define the same queue.
+func (q queue) sameDefinition(o queue) bool {
+	return q.URI == o.URI && q.Driver == o.Driver && q.Location == o.Location && q.Description == o.Description
+}
+
+// rules is the printers configuration requested by the policy.
+type rules struct {
+	// queues are the requested queues, by name.
+	queues map[string]queue
+	// names are the names of the requested queues, in order.
+	names []string
+	// def is the default printer.
+	def string
+
+	// allowed are the patterns of the queues users can print to. Any queue is allowed if empty.
+	allowed []string
+	// restriction is the restriction applied to every queue, besides their access.
+	restriction restriction
+	// disableColor selects monochrome printing by default for the user.
+	disableColor bool
+}
+
+// restricted returns true if any restriction applies to the queues of the machine.
+func (r rules) restricted() bool {
+	return len(r.allowed) > 0 || r.restriction != restriction{}
+}
+
+// state is the printers configuration applied by adsys.
+type state struct {
+	Queues map[string]queue `json:"queues,omitempty"`
+	// Restrictions are the restrictions applied to the queues by the computer policy, by queue name.
+	Restrictions map[string]restriction `json:"restrictions,omitempty"`
+	// Monochrome are the queues on which color printing is disabled for each user.
+	Monochrome map[string][]string `json:"monochrome,omitempty"`
+}
+
+// Manager applies the printers policy on the machine.
+type Manager struct {
+	stateDir     string
+	lpadminCmd   []string
+	lpstatCmd    []string
+	lpoptionsCmd []string
+	cmdTimeout   time.Duration
+
+	userLookup func(string) (*user.User, error)
+
+	mu sync.Mutex // Prevents concurrent changes to the queues and the state
+}
+
+type options struct {
+	stateDir     string
+	lpadminCmd   []string
+	lpstatCmd    []string
+	lpoptionsCmd []string
+	cmdTimeout   time.Duration
+	userLookup   func(string) (*user.User, error)
+}
+
+// Option reprents an optional function to change the printers manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithLpadminCmd overrides the default lpadmin command.
+func WithLpadminCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.lpadminCmd = cmd
+	}
+}
+
+// WithLpstatCmd overrides the default lpstat command.
+func WithLpstatCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.lpstatCmd = cmd
+	}
+}
+
+// WithLpoptionsCmd overrides the default lpoptions command.
+func WithLpoptionsCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.lpoptionsCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time a CUPS command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the printers policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:     consts.DefaultStateDir,
+		lpadminCmd:   []string{"lpadmin"},
+		lpstatCmd:    []string{"lpstat"},
+		lpoptionsCmd: []string{"lpoptions"},
+		cmdTimeout:   consts.DefaultHelperExecTimeout,
+		userLookup:   user.Lookup,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:     filepath.Join(args.stateDir, "printers"),
+		lpadminCmd:   args.lpadminCmd,
+		lpstatCmd:    args.lpstatCmd,
+		lpoptionsCmd: args.lpoptionsCmd,
+		cmdTimeout:   args.cmdTimeout,
+		userLookup:   args.userLookup,
+	}
+}
+
+// ApplyPolicy creates the print queues requested by the object and removes the ones it doesn't request anymore.
+// It then selects the default printer, for the whole machine if the object is a computer or for the user otherwise.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply printers policy to %s", objectName))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying printers policy to %s", objectName)
+
+	want, err := parseEntries(ctx, entries, isComputer)
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	configured := len(want.names) > 0 || want.def != "" || want.restricted() || want.disableColor
+	owned := (isComputer && len(prev.Restrictions) > 0) || (!isComputer && len(prev.Monochrome[objectName]) > 0)
+	for _, q := range prev.Queues {
+		if slices.Contains(q.Objects, objectName) {
+			owned = true
+			break
+		}
+	}
+
+	// Nothing to apply nor to revert.
+	if !configured && !owned {
+		return nil
+	}
+
+	if !isInstalled(m.lpadminCmd) {
+		if configured {
+			return errors.New(gotext.Get("CUPS is not installed"))
+		}
+		log.Warning(ctx, gotext.Get("CUPS is not installed anymore, can't remove the printers of %s", objectName))
+		return m.saveState(dropObject(prev, objectName, isComputer))
+	}
+
+	s, err := m.applyQueues(ctx, objectName, prev, want)
+	if err != nil {
+		// Still save the queues created so far, so that they can be removed.
+		return errors.Join(err, m.saveState(s))
+	}
+	if isComputer {
+		s, err = m.applyRestrictions(ctx, s, want)
+	} else {
+		s, err = m.applyUserColor(ctx, objectName, s, want.disableColor)
+	}
+	if err != nil {
+		// Still save the restrictions applied so far, so that they can be reverted.
+		return errors.Join(err, m.saveState(s))
+	}
+	if err := m.saveState(s); err != nil {
+		return err
+	}
+
+	if want.def == "" {
+		return nil
+	}
+	if isComputer {
+		log.Infof(ctx, "Setting default printer to %s", want.def)
+		_, err := syshelpers.Run(ctx, m.cmdTimeout, m.lpadminCmd, "-d", want.def)
+		return err
+	}
+	return m.setUserDefault(ctx, objectName, want.def)
+}
+
+// DumpState returns the printer queues configured during the last refresh of the machine.
+// The state is empty for users or if no printers policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump printers state of %s", objectName))
+
+	// Printers policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// applyQueues removes the queues objectName doesn't request anymore, if no other object requests them,
+// and creates the requested ones. It returns the new state.
+func (m *Manager) applyQueues(ctx context.Context, objectName string, prev state, want rules) (s state, err error) {
+	s = state{Queues: make(map[string]queue), Restrictions: prev.Restrictions, Monochrome: prev.Monochrome}
+	var names []string
+	for name, q := range prev.Queues {
+		s.Queues[name] = q
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		q := prev.Queues[name]
+		if _, ok := want.queues[name]; ok || !slices.Contains(q.Objects, objectName) {
+			continue
+		}
+		q.Objects = slices.DeleteFunc(slices.Clone(q.Objects), func(o string) bool { return o == objectName })
+		if len(q.Objects) > 0 {
+			s.Queues[name] = q
+			continue
+		}
+		log.Infof(ctx, "Removing printer %s", name)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.lpadminCmd, "-x", name); err != nil {
+			// The queue may have been removed outside of adsys: don't try again.
+			log.Warning(ctx, gotext.Get("Couldn't remove printer %s: %v", name, err))
+		}
+		delete(s.Queues, name)
+	}
+
+	if len(want.names) == 0 {
+		return s, nil
+	}
+
+	// Queues removed outside of adsys need to be created again.
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.lpstatCmd, "-e")
+	if err != nil {
+		return s, err
+	}
+	existing := strings.Fields(out)
+
+	for _, name := range want.names {
+		q, managed := s.Queues[name]
+		w := want.queues[name]
+		if !managed || !q.sameDefinition(w) || !slices.Contains(existing, name) {
+			log.Infof(ctx, "Configuring printer %s", name)
+			args := []string{"-p", name, "-E", "-v", w.URI, "-m", w.Driver, "-o", "printer-is-shared=false"}
+			if w.Location != "" {
+				args = append(args, "-L", w.Location)
+			}
+			if w.Description != "" {
+				args = append(args, "-D", w.Description)
+			}
+			if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.lpadminCmd, args...); err != nil {
+				return s, err
+			}
+			w.Objects = q.Objects
+			q = w
+		}
+		if !slices.Contains(q.Objects, objectName) {
+			q.Objects = append(slices.Clone(q.Objects), objectName)
+		}
+		s.Queues[name] = q
+	}
+
+	return s, nil
+}
+
+// setUserDefault sets the default printer of the user objectName.
+// The default printer is saved in the home directory of the user, so it is only set once this one exists.
+func (m *Manager) setUserDefault(ctx context.Context, objectName, def string) error {
+	u, err := m.userLookup(objectName)
+	if err != nil {
+		return errors.New(gotext.Get("failed to retrieve user information: %v", err))
+	}
+	if _, err := os.Stat(u.HomeDir); errors.Is(err, fs.ErrNotExist) {
+		log.Warning(ctx, gotext.Get("Home directory of %s doesn't exist yet, the default printer will be set on next refresh", objectName))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Infof(ctx, "Setting default printer of %s to %s", objectName, def)
+	_, err = syshelpers.RunWithOptions(ctx, m.cmdTimeout, m.lpoptionsCmd, syshelpers.CmdOptions{Prepare: syshelpers.RunAs(u)}, "-d", def)
+	return err
+}
+
+// dropObject returns the state s without any queue nor restriction requested by objectName.
+func dropObject(s state, objectName string, isComputer bool) state {
+	r := state{Queues: make(map[string]queue)}
+	if !isComputer {
+		r.Restrictions = s.Restrictions
+		r.Monochrome = maps.Clone(s.Monochrome)
+		delete(r.Monochrome, objectName)
+	}
+	for name, q := range s.Queues {
+		q.Objects = slices.DeleteFunc(slices.Clone(q.Objects), func(o string) bool { return o == objectName })
+		if len(q.Objects) == 0 {
+			continue
+		}
+		r.Queues[name] = q
+	}
+	return r
+}
+
+// parseEntries validates the entries and returns the requested printers configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry, isComputer bool) (r rules, err error) {
+	prefix := "printers/"
+	if !isComputer {
+		prefix = "printers/user-"
+	}
+
+	r.queues = make(map[string]queue)
+	var def, markedDefault string
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		// disable-color is a boolean setting, with no value.
+		if e.Disabled || (v == "" && e.Key != prefix+"disable-color") {
+			continue
+		}
+
+		switch e.Key {
+		case prefix + "connections":
+			for _, l := range strings.Split(v, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" {
+					continue
+				}
+				name, q, isDefault, err := parseConnection(l)
+				if err != nil {
+					return r, err
+				}
+				// Connections are listed from the furthest to the closest GPO: the closest one wins.
+				if _, ok := r.queues[name]; !ok {
+					r.names = append(r.names, name)
+				}
+				r.queues[name] = q
+				if isDefault {
+					markedDefault = name
+				}
+			}
+		case prefix + "default":
+			if !queueNameRe.MatchString(v) {
+				return r, errors.New(gotext.Get("invalid default printer %q", v))
+			}
+			def = v
+		case prefix + "disable-color":
+			if isComputer {
+				r.restriction.Monochrome = true
+			} else {
+				r.disableColor = true
+			}
+		case "printers/allowed", "printers/duplex", "printers/quota":
+			if !isComputer {
+				log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing printers entries, skipping it", e.Key))
+				continue
+			}
+			if err := parseRestriction(&r, e.Key, v); err != nil {
+				return r, err
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing printers entries, skipping it", e.Key))
+		}
+	}
+
+	r.def = def
+	if r.def == "" {
+		r.def = markedDefault
+	}
+	return r, nil
+}
+
+// parseConnection parses a connection line of the form
+// name=<queue>, uri=<uri>[, driver=<driver>][, location=<text>][, description=<text>][, default=yes].
+func parseConnection(l string) (name string, q queue, isDefault bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid printer connection %q", l))
+
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(l, ",") {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return "", q, false, errors.New(gotext.Get("expected name=<queue>, uri=<uri>[, driver=<driver>][, location=<text>][, description=<text>][, default=yes]"))
+		}
+		if seen[k] {
+			return "", q, false, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		seen[k] = true
+
+		switch k {
+		case "name":
+			name = v
+		case "uri":
+			q.URI = v
+		case "driver":
+			q.Driver = v
+		case "location":
+			q.Location = v
+		case "description":
+			q.Description = v
+		case "default":
+			switch strings.ToLower(v) {
+			case "yes":
+				isDefault = true
+			case "no":
+			default:
+				return "", q, false, errors.New(gotext.Get("default must be yes or no, got %q", v))
+			}
+		default:
+			return "", q, false, errors.New(gotext.Get("unsupported field %q", k))
+		}
+	}
+
+	if name == "" || q.URI == "" {
+		return "", q, false, errors.New(gotext.Get("expected name=<queue>, uri=<uri>[, driver=<driver>][, location=<text>][, description=<text>][, default=yes]"))
+	}
+	if !queueNameRe.MatchString(name) {
+		return "", q, false, errors.New(gotext.Get("%q is not a valid queue name: only letters, digits and _.@+- are supported", name))
+	}
+	u, err := url.Parse(q.URI)
+	if err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "" && u.Path == "") {
+		return "", q, false, errors.New(gotext.Get("%q is not a valid device URI", q.URI))
+	}
+	if q.Driver == "" {
+		q.Driver = driverGeneric
+		if u.Scheme == "ipp" || u.Scheme == "ipps" {
+			q.Driver = driverEverywhere
+		}
+	}
+	if strings.ContainsFunc(q.Driver, func(r rune) bool { return r == ' ' || r == '\t' }) {
+		return "", q, false, errors.New(gotext.Get("%q is not a valid driver", q.Driver))
+	}
+
+	return name, q, isDefault, nil
+}
+
+// loadState returns the printers configuration previously applied by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load printers state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the printers configuration applied by adsys.
+// The state file is removed if no queue nor restriction is managed anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save printers state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Queues) == 0 && len(s.Restrictions) == 0 && len(s.Monochrome) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// isInstalled returns true if the command cmd can be executed.
+func isInstalled(cmd []string) bool {
+	if len(cmd) == 0 || cmd[0] == "" {
+		return false
+	}
+	_, err := exec.LookPath(cmd[0])
+	return err == nil
+}
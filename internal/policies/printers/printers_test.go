@@ -0,0 +1,239 @@
+package printers_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/printers"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+var allEntries = []entry.Entry{
+	{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, description=Office printer\nname=Hall, uri=socket://10.0.0.12:9100, location=Hall, default=yes"},
+	{Key: "printers/default", Value: "Office"},
+}
+
+var restrictionEntries = []entry.Entry{
+	{Key: "printers/allowed", Value: "Office\nH*"},
+	{Key: "printers/duplex", Value: "two-sided-long-edge"},
+	{Key: "printers/quota", Value: "pages=100, days=30"},
+}
+
+var allUserEntries = []entry.Entry{
+	{Key: "printers/user-connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, description=Office printer\nname=Hall, uri=socket://10.0.0.12:9100, location=Hall, default=yes"},
+	{Key: "printers/user-default", Value: "Office"},
+}
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		objectName    string
+		existingState string
+		mockBehaviour string
+		noHome        bool
+		notInstalled  bool
+
+		wantErr bool
+	}{
+		"Add printers":                                      {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print\n\n  name=Hall , uri=socket://10.0.0.12:9100, location=Hall \nname=Lpr, uri=lpd://10.0.0.13/queue, driver=drv:///sample.drv/laserjet.ppd"}}},
+		"IPPS printers are driverless":                      {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Secure, uri=ipps://printer.example.com/ipp/print"}}},
+		"Driver can be overridden for IPP printers":         {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, driver=drv:///sample.drv/generic.ppd"}}},
+		"Closest connection wins":                           {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://old.example.com/ipp/print\nname=Office, uri=ipp://printer.example.com/ipp/print"}}},
+		"Set default printer":                               {entries: []entry.Entry{{Key: "printers/default", Value: "Office"}}},
+		"Last printer marked as default is selected":        {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, default=yes\nname=Hall, uri=socket://10.0.0.12:9100, default=YES\nname=Lpr, uri=lpd://10.0.0.13/queue, default=no"}}},
+		"Default key wins over printers marked as default":  {entries: allEntries},
+		"All entries for a user":                            {entries: allUserEntries, isUser: true},
+		"Machine keys are ignored for a user":               {entries: allEntries, isUser: true},
+		"User keys are ignored for a machine":               {entries: allUserEntries},
+		"Already applied printers are not added again":      {entries: allEntries[:1], existingState: "applied"},
+		"Printers removed outside of adsys are added again": {entries: allEntries[:1], existingState: "applied", mockBehaviour: "removed"},
+		"Printers with a new definition are added again":    {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, description=Main office printer\nname=Hall, uri=socket://10.0.0.12:9100, location=Hall"}}, existingState: "applied"},
+		"Printers not configured anymore are removed":       {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, description=Office printer"}}, existingState: "applied"},
+		"Printers requested by other objects are kept":      {existingState: "applied", isUser: true},
+		"No entries removes printers":                       {existingState: "applied"},
+		"Printers requested by a new object are tracked":    {entries: allUserEntries[:1], existingState: "applied", isUser: true, objectName: "alice@example.com"},
+		"Failing to remove a printer is not an error":       {existingState: "applied", mockBehaviour: "fail-lpadmin-x"},
+		"User default is not set without home directory":    {entries: allUserEntries, isUser: true, noHome: true},
+		"Disabled entries are ignored":                      {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print", Disabled: true}, {Key: "printers/default", Value: "Office"}}},
+		"Unsupported keys are ignored":                      {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print"}, {Key: "printers/share", Value: "true"}}},
+		"No entries is a no-op":                             {},
+		"Not installed without state is a no-op":            {notInstalled: true},
+		"Not installed anymore drops state":                 {existingState: "applied", notInstalled: true},
+
+		// Restrictions
+		"Restrict allowed printers":                          {entries: []entry.Entry{{Key: "printers/allowed", Value: "Off*\n\n Local "}}},
+		"Set default duplex":                                 {entries: []entry.Entry{{Key: "printers/duplex", Value: "two-sided-short-edge"}}},
+		"Disable color for the machine":                      {entries: []entry.Entry{{Key: "printers/disable-color"}}},
+		"Set quotas":                                         {entries: []entry.Entry{{Key: "printers/quota", Value: "pages=100, kilobytes=20480, days=7"}}},
+		"Restrictions apply to added printers":               {entries: append(slices.Clone(allEntries), restrictionEntries...), mockBehaviour: "removed"},
+		"Unchanged restrictions are not applied again":       {entries: restrictionEntries, existingState: "restricted"},
+		"Only changed restrictions are applied":              {entries: []entry.Entry{{Key: "printers/allowed", Value: "Office"}, {Key: "printers/duplex", Value: "one-sided"}, {Key: "printers/disable-color"}}, existingState: "restricted"},
+		"No entries reverts restrictions":                    {existingState: "restricted"},
+		"Restrictions of removed printers are dropped":       {entries: restrictionEntries, existingState: "restricted", mockBehaviour: "removed"},
+		"Restriction keys are ignored for a user":            {entries: append(slices.Clone(restrictionEntries), entry.Entry{Key: "printers/disable-color"}), isUser: true},
+		"Disable color for a user":                           {entries: []entry.Entry{{Key: "printers/user-disable-color"}}, isUser: true},
+		"Color is disabled again on every refresh":           {entries: []entry.Entry{{Key: "printers/user-disable-color"}}, isUser: true, existingState: "restricted"},
+		"No entries restores color for a user":               {isUser: true, existingState: "restricted"},
+		"Failing to restore color is not an error":           {isUser: true, existingState: "restricted", mockBehaviour: "fail-lpoptions"},
+		"Color is not restored for other users":              {isUser: true, existingState: "restricted", objectName: "alice@example.com"},
+		"Color is not disabled without home directory":       {entries: []entry.Entry{{Key: "printers/user-disable-color"}}, isUser: true, noHome: true},
+		"Restoring color without home directory drops state": {isUser: true, existingState: "restricted", noHome: true},
+		"Restoring color for an unknown user drops state":    {isUser: true, existingState: "restricted", mockBehaviour: "unknown-user"},
+		"Not installed anymore drops restrictions":           {existingState: "restricted", notInstalled: true},
+		"Not installed anymore drops color state for a user": {existingState: "restricted", notInstalled: true, isUser: true},
+
+		// Error cases
+		"Error on missing name":                 {entries: []entry.Entry{{Key: "printers/connections", Value: "uri=ipp://printer.example.com/ipp/print"}}, wantErr: true},
+		"Error on missing URI":                  {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office"}}, wantErr: true},
+		"Error on empty field":                  {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, location="}}, wantErr: true},
+		"Error on field set more than once":     {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, name=Hall"}}, wantErr: true},
+		"Error on unsupported field":            {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, color=yes"}}, wantErr: true},
+		"Error on invalid queue name":           {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office printer, uri=ipp://printer.example.com/ipp/print"}}, wantErr: true},
+		"Error on invalid URI":                  {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=printer.example.com"}}, wantErr: true},
+		"Error on invalid driver":               {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, driver=generic printer"}}, wantErr: true},
+		"Error on invalid default flag":         {entries: []entry.Entry{{Key: "printers/connections", Value: "name=Office, uri=ipp://printer.example.com/ipp/print, default=maybe"}}, wantErr: true},
+		"Error on invalid default printer":      {entries: []entry.Entry{{Key: "printers/default", Value: "Office/Hall"}}, wantErr: true},
+		"Error on CUPS not installed":           {entries: allEntries, notInstalled: true, wantErr: true},
+		"Error on unknown user":                 {entries: allUserEntries, isUser: true, mockBehaviour: "unknown-user", wantErr: true},
+		"Error on listing printers":             {entries: allEntries, mockBehaviour: "fail-lpstat", wantErr: true},
+		"Error on adding printers":              {entries: allEntries, mockBehaviour: "fail-lpadmin-p", wantErr: true},
+		"Error on setting default printer":      {entries: allEntries, mockBehaviour: "fail-lpadmin-d", wantErr: true},
+		"Error on setting user default printer": {entries: allUserEntries, isUser: true, mockBehaviour: "fail-lpoptions", wantErr: true},
+		"Error on corrupted state":              {entries: allEntries, existingState: "corrupted", wantErr: true},
+
+		"Error on invalid printer pattern":           {entries: []entry.Entry{{Key: "printers/allowed", Value: "Office printer"}}, wantErr: true},
+		"Error on malformed printer pattern":         {entries: []entry.Entry{{Key: "printers/allowed", Value: "Office["}}, wantErr: true},
+		"Error on invalid duplex mode":               {entries: []entry.Entry{{Key: "printers/duplex", Value: "two-sided"}}, wantErr: true},
+		"Error on quota without period":              {entries: []entry.Entry{{Key: "printers/quota", Value: "pages=100"}}, wantErr: true},
+		"Error on quota without limit":               {entries: []entry.Entry{{Key: "printers/quota", Value: "days=7"}}, wantErr: true},
+		"Error on quota with invalid value":          {entries: []entry.Entry{{Key: "printers/quota", Value: "pages=-1, days=7"}}, wantErr: true},
+		"Error on quota with unsupported field":      {entries: []entry.Entry{{Key: "printers/quota", Value: "pages=100, days=7, jobs=3"}}, wantErr: true},
+		"Error on quota with field set twice":        {entries: []entry.Entry{{Key: "printers/quota", Value: "pages=100, days=7, days=8"}}, wantErr: true},
+		"Error on listing printers to restrict":      {entries: restrictionEntries, mockBehaviour: "fail-lpstat", wantErr: true},
+		"Error on restricting printers":              {entries: restrictionEntries, mockBehaviour: "fail-lpadmin-p-Hall", wantErr: true},
+		"Error on unknown user to disable color":     {entries: []entry.Entry{{Key: "printers/user-disable-color"}}, isUser: true, mockBehaviour: "unknown-user", wantErr: true},
+		"Error on listing printers to disable color": {entries: []entry.Entry{{Key: "printers/user-disable-color"}}, isUser: true, mockBehaviour: "fail-lpstat", wantErr: true},
+		"Error on disabling color for a user":        {entries: []entry.Entry{{Key: "printers/user-disable-color"}}, isUser: true, mockBehaviour: "fail-lpoptions", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			if tc.objectName == "" {
+				tc.objectName = "ubuntu"
+				if tc.isUser {
+					tc.objectName = "bob@example.com"
+				}
+			}
+
+			lpadminCmd := testutils.MockCommand(root, "lpadmin", tc.mockBehaviour)
+			if tc.notInstalled {
+				lpadminCmd = []string{"/nonexistent/lpadmin"}
+			}
+
+			m := printers.New(
+				printers.WithStateDir(root),
+				printers.WithLpadminCmd(lpadminCmd),
+				printers.WithLpstatCmd(testutils.MockCommand(root, "lpstat", tc.mockBehaviour)),
+				printers.WithLpoptionsCmd(testutils.MockCommand(root, "lpoptions", tc.mockBehaviour)),
+				printers.WithUserLookup(func(name string) (*user.User, error) {
+					if tc.mockBehaviour == "unknown-user" {
+						return nil, errors.New("unknown user")
+					}
+					home := filepath.Join(root, "home", name)
+					if !tc.noHome {
+						require.NoError(t, os.MkdirAll(home, 0750), "Setup: can't create home directory")
+					}
+					// Run as the current user to not drop privileges in tests.
+					return &user.User{Uid: fmt.Sprint(os.Getuid()), Gid: fmt.Sprint(os.Getgid()), Username: name, HomeDir: home}, nil
+				}),
+			)
+			err := m.ApplyPolicy(context.Background(), tc.objectName, !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestApplyPolicyKeepsCreatedPrintersOnError(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	m := printers.New(
+		printers.WithStateDir(root),
+		printers.WithLpadminCmd(testutils.MockCommand(root, "lpadmin", "fail-lpadmin-p-Hall")),
+		printers.WithLpstatCmd(testutils.MockCommand(root, "lpstat", "")),
+	)
+	err := m.ApplyPolicy(context.Background(), "ubuntu", true, allEntries)
+	require.Error(t, err, "ApplyPolicy should have failed but didn't")
+
+	// The printer added before the failure is removed once not configured anymore.
+	err = m.ApplyPolicy(context.Background(), "ubuntu", true, nil)
+	require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+	testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, root, behaviour, args := c.Name, c.Root, c.Behaviour, c.Args
+
+	// Log the call, replacing the temporary paths to get a stable output.
+	line := name
+	if name == "lpoptions" {
+		line = fmt.Sprintf("HOME=%s USER=%s %s", os.Getenv("HOME"), os.Getenv("USER"), line)
+	}
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+	line = strings.ReplaceAll(line, root, "#ROOT#")
+
+	c.Log(line)
+
+	if behaviour == "fail-"+name ||
+		(len(args) > 0 && behaviour == "fail-"+name+args[0]) ||
+		(len(args) > 1 && behaviour == "fail-"+name+args[0]+"-"+args[1]) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+
+	if name == "lpstat" {
+		if behaviour == "removed" {
+			fmt.Println("Local")
+			return
+		}
+		fmt.Println("Local\nOffice\nHall")
+	}
+}
@@ -0,0 +1,268 @@
+package printers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+)
+
+// sides are the supported default sides of the jobs.
+var sides = []string{"one-sided", "two-sided-long-edge", "two-sided-short-edge"}
+
+// queuePatternRe matches a queue name which can contain glob characters.
+var queuePatternRe = regexp.MustCompile(`^[A-Za-z0-9_.@+*?\[\]-]{1,127}$`)
+
+// restriction is a restriction applied to a CUPS print queue.
+type restriction struct {
+	// Denied is true if no user can print to the queue.
+	Denied bool `json:"denied,omitempty"`
+	// Sides is the default sides of the jobs.
+	Sides string `json:"sides,omitempty"`
+	// Monochrome is true if jobs are printed in monochrome by default.
+	Monochrome bool `json:"monochrome,omitempty"`
+	// QuotaPeriod is the period of the quotas, in seconds.
+	QuotaPeriod int `json:"quota_period,omitempty"`
+	// PageLimit is the number of pages each user can print during the quota period.
+	PageLimit int `json:"page_limit,omitempty"`
+	// KLimit is the number of kilobytes each user can print during the quota period.
+	KLimit int `json:"k_limit,omitempty"`
+}
+
+// lpadminArgs returns the lpadmin arguments applying r to the queue name, on which prev is currently applied.
+// Only the settings which differ are changed, so that the ones not set by adsys are left as is.
+func (r restriction) lpadminArgs(name string, prev restriction) []string {
+	args := []string{"-p", name}
+	if r.Denied != prev.Denied {
+		access := "allow:all"
+		if r.Denied {
+			access = "deny:all"
+		}
+		args = append(args, "-u", access)
+	}
+	if r.Sides != prev.Sides {
+		if r.Sides != "" {
+			args = append(args, "-o", "sides-default="+r.Sides)
+		} else {
+			args = append(args, "-R", "sides-default")
+		}
+	}
+	if r.Monochrome != prev.Monochrome {
+		if r.Monochrome {
+			args = append(args, "-o", "print-color-mode-default=monochrome")
+		} else {
+			args = append(args, "-R", "print-color-mode-default")
+		}
+	}
+	// A limit of 0 disables the quotas.
+	if r.QuotaPeriod != prev.QuotaPeriod || r.PageLimit != prev.PageLimit || r.KLimit != prev.KLimit {
+		args = append(args,
+			"-o", fmt.Sprintf("job-quota-period=%d", r.QuotaPeriod),
+			"-o", fmt.Sprintf("job-page-limit=%d", r.PageLimit),
+			"-o", fmt.Sprintf("job-k-limit=%d", r.KLimit))
+	}
+	return args
+}
+
+// parseRestriction parses the value v of the restriction key into r.
+func parseRestriction(r *rules, key, v string) error {
+	switch key {
+	case "printers/allowed":
+		for _, l := range strings.Split(v, "\n") {
+			l = strings.TrimSpace(l)
+			if l == "" {
+				continue
+			}
+			if !queuePatternRe.MatchString(l) {
+				return errors.New(gotext.Get("invalid printer pattern %q", l))
+			}
+			if _, err := path.Match(l, ""); err != nil {
+				return errors.New(gotext.Get("invalid printer pattern %q: %v", l, err))
+			}
+			r.allowed = append(r.allowed, l)
+		}
+	case "printers/duplex":
+		if !slices.Contains(sides, v) {
+			return errors.New(gotext.Get("invalid duplex mode %q: expected one of %s", v, strings.Join(sides, ", ")))
+		}
+		r.restriction.Sides = v
+	case "printers/quota":
+		return parseQuota(&r.restriction, v)
+	}
+	return nil
+}
+
+// parseQuota parses a quota of the form pages=<n>[, kilobytes=<n>], days=<n> into r.
+func parseQuota(r *restriction, v string) (err error) {
+	usage := gotext.Get("invalid quota %q: expected pages=<n>[, kilobytes=<n>], days=<n>", v)
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(v, ",") {
+		k, n, found := strings.Cut(field, "=")
+		k = strings.ToLower(strings.TrimSpace(k))
+		value, err := strconv.Atoi(strings.TrimSpace(n))
+		if !found || err != nil || value <= 0 || seen[k] {
+			return errors.New(usage)
+		}
+		seen[k] = true
+
+		switch k {
+		case "pages":
+			r.PageLimit = value
+		case "kilobytes":
+			r.KLimit = value
+		case "days":
+			r.QuotaPeriod = value * 24 * 60 * 60
+		default:
+			return errors.New(usage)
+		}
+	}
+	if r.QuotaPeriod == 0 || (r.PageLimit == 0 && r.KLimit == 0) {
+		return errors.New(usage)
+	}
+	return nil
+}
+
+// applyRestrictions applies the restrictions of the computer policy to every queue of the machine, and reverts
+// the ones not configured anymore. It returns the new state.
+func (m *Manager) applyRestrictions(ctx context.Context, s state, want rules) (state, error) {
+	if !want.restricted() && len(s.Restrictions) == 0 {
+		return s, nil
+	}
+
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.lpstatCmd, "-e")
+	if err != nil {
+		return s, err
+	}
+	existing := strings.Fields(out)
+
+	restrictions := make(map[string]restriction)
+	// Queues removed since the restrictions were applied are not tracked anymore.
+	for name, r := range s.Restrictions {
+		if slices.Contains(existing, name) {
+			restrictions[name] = r
+		}
+	}
+	s.Restrictions = restrictions
+
+	for _, name := range existing {
+		var r restriction
+		if want.restricted() {
+			r = want.restriction
+			r.Denied = len(want.allowed) > 0 && !matchesAny(name, want.allowed)
+		}
+		prev := restrictions[name]
+		if r == prev {
+			continue
+		}
+
+		if r == (restriction{}) {
+			log.Infof(ctx, "Removing restrictions of printer %s", name)
+		} else {
+			log.Infof(ctx, "Restricting printer %s", name)
+		}
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.lpadminCmd, r.lpadminArgs(name, prev)...); err != nil {
+			return s, err
+		}
+		if r == (restriction{}) {
+			delete(restrictions, name)
+			continue
+		}
+		restrictions[name] = r
+	}
+
+	return s, nil
+}
+
+// applyUserColor selects monochrome printing by default on every queue for the user objectName if disable is true.
+// Otherwise, it reverts the queues previously set to monochrome for the user. It returns the new state.
+func (m *Manager) applyUserColor(ctx context.Context, objectName string, s state, disable bool) (state, error) {
+	applied := s.Monochrome[objectName]
+	if !disable && len(applied) == 0 {
+		return s, nil
+	}
+
+	monochrome := maps.Clone(s.Monochrome)
+	if monochrome == nil {
+		monochrome = make(map[string][]string)
+	}
+	s.Monochrome = monochrome
+
+	u, err := m.userLookup(objectName)
+	if err != nil {
+		if disable {
+			return s, errors.New(gotext.Get("failed to retrieve user information: %v", err))
+		}
+		log.Warning(ctx, gotext.Get("Couldn't retrieve user information of %s, can't restore color printing: %v", objectName, err))
+		delete(monochrome, objectName)
+		return s, nil
+	}
+	// The options of the user are saved in their home directory.
+	if _, err := os.Stat(u.HomeDir); errors.Is(err, fs.ErrNotExist) {
+		if disable {
+			log.Warning(ctx, gotext.Get("Home directory of %s doesn't exist yet, color printing will be disabled on next refresh", objectName))
+			return s, nil
+		}
+		delete(monochrome, objectName)
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+
+	if !disable {
+		log.Infof(ctx, "Restoring color printing for %s", objectName)
+		for _, name := range applied {
+			if _, err := syshelpers.RunWithOptions(ctx, m.cmdTimeout, m.lpoptionsCmd, syshelpers.CmdOptions{Prepare: syshelpers.RunAs(u)}, "-p", name, "-r", "print-color-mode"); err != nil {
+				// The queue may have been removed: don't try again.
+				log.Warning(ctx, gotext.Get("Couldn't restore color printing on %s for %s: %v", name, objectName, err))
+			}
+		}
+		delete(monochrome, objectName)
+		return s, nil
+	}
+
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.lpstatCmd, "-e")
+	if err != nil {
+		return s, err
+	}
+
+	// Options are set again on every refresh, in case the user changed them.
+	log.Infof(ctx, "Disabling color printing for %s", objectName)
+	var queues []string
+	for _, name := range strings.Fields(out) {
+		if _, err := syshelpers.RunWithOptions(ctx, m.cmdTimeout, m.lpoptionsCmd, syshelpers.CmdOptions{Prepare: syshelpers.RunAs(u)}, "-p", name, "-o", "print-color-mode=monochrome"); err != nil {
+			// Still track the queues set so far, so that they can be reverted.
+			for _, q := range queues {
+				if !slices.Contains(applied, q) {
+					applied = append(slices.Clone(applied), q)
+				}
+			}
+			monochrome[objectName] = applied
+			return s, err
+		}
+		queues = append(queues, name)
+	}
+	monochrome[objectName] = queues
+
+	return s, nil
+}
+
+// matchesAny returns true if name matches any of the glob patterns.
+func matchesAny(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package privilege
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+)
+
+// polkitAdminRulesName is the polkit rules file mapping actions to their administrators.
+// It is evaluated before the default administrator rule of the system, in 50-default.rules.
+const polkitAdminRulesName = "49-adsys-privilege-enforcement.rules"
+
+// polkitRulesHeader is the header of the polkit rules file, in JavaScript.
+const polkitRulesHeader = `// This file is managed by adsys.
+// Do not edit this file manually.
+// Any changes will be overwritten.
+
+`
+
+// localAdminsIdentities are the polkit identities of the local administrators when polkit doesn't configure any.
+var localAdminsIdentities = []string{"unix-group:sudo", "unix-group:admin"}
+
+// polkitActionRe matches a polkit action identifier, optionally ending with .* to match all the actions with this prefix.
+var polkitActionRe = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*(\.\*)?$`)
+
+// actionAdmins are the users and groups allowed to administer a polkit action.
+type actionAdmins struct {
+	action     string
+	identities []string
+}
+
+// parseActionAdmins parses the action administrators of v, one action per line.
+// The identities of the same action are merged, keeping the order of the first line of each action.
+func parseActionAdmins(ctx context.Context, v string) (admins []actionAdmins, err error) {
+	for _, l := range strings.Split(v, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		action, who, found := strings.Cut(l, "=")
+		action = strings.TrimSpace(action)
+		if !found || action == "" {
+			return nil, errors.New(gotext.Get("invalid polkit action administrators %q: expected <action> = <user or group>[, <user or group>…]", l))
+		}
+		if !polkitActionRe.MatchString(action) {
+			return nil, errors.New(gotext.Get("invalid polkit action administrators %q: %q is not a polkit action identifier", l, action))
+		}
+		var identities []string
+		for _, e := range splitAndNormalizeUsersAndGroups(ctx, who) {
+			identities = append(identities, polkitIdentity(e))
+		}
+		if len(identities) == 0 {
+			return nil, errors.New(gotext.Get("invalid polkit action administrators %q: no user or group", l))
+		}
+
+		i := slices.IndexFunc(admins, func(a actionAdmins) bool { return a.action == action })
+		if i < 0 {
+			admins = append(admins, actionAdmins{action: action})
+			i = len(admins) - 1
+		}
+		for _, id := range identities {
+			if !slices.Contains(admins[i].identities, id) {
+				admins[i].identities = append(admins[i].identities, id)
+			}
+		}
+	}
+	return admins, nil
+}
+
+// polkitIdentity returns the polkit identity of the user or group, prefixed with %, e.
+func polkitIdentity(e string) string {
+	if group, ok := strings.CutPrefix(e, "%"); ok {
+		return fmt.Sprintf("unix-group:%s", group)
+	}
+	return fmt.Sprintf("unix-user:%s", e)
+}
+
+// writePolkitAdminRules writes the polkit rules making the action administrators, along with the global
+// administrators, the only identities able to authorize each action. The rules file is removed if there is none.
+// Those rules are only supported by the versions of polkit shipping a rules directory.
+func writePolkitAdminRules(ctx context.Context, policyKitDir string, admins []actionAdmins, globalAdmins []string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write polkit action administrators"))
+
+	rulesDir := filepath.Join(policyKitDir, "rules.d")
+	p := filepath.Join(rulesDir, polkitAdminRulesName)
+	if len(admins) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(rulesDir); errors.Is(err, fs.ErrNotExist) {
+		log.Warning(ctx, gotext.Get("The installed version of polkit does not support rules, skipping polkit action administrators"))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	content.WriteString(polkitRulesHeader)
+	for _, a := range admins {
+		// Quote the values as JSON strings, which are valid JavaScript strings.
+		condition := "action.id == %s"
+		id := a.action
+		if prefix, ok := strings.CutSuffix(a.action, "*"); ok {
+			condition = "action.id.indexOf(%s) == 0"
+			id = prefix
+		}
+		action, err := json.Marshal(id)
+		if err != nil {
+			return err
+		}
+		identities := slices.Clone(a.identities)
+		for _, g := range globalAdmins {
+			if !slices.Contains(identities, g) {
+				identities = append(identities, g)
+			}
+		}
+		ids, err := json.Marshal(identities)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&content, `polkit.addAdminRule(function(action, subject) {
+    if (%s) {
+        return %s;
+    }
+});
+
+`, fmt.Sprintf(condition, action), strings.ReplaceAll(string(ids), ",", ", "))
+	}
+
+	// polkitd drops its privileges and needs to read the rules.
+	// nolint:gosec // G306 match distribution permission
+	if err := os.WriteFile(p+".new", []byte(content.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
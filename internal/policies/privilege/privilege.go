@@ -6,6 +6,19 @@
 //   - /etc/sudoers.d/99-adsys-privilege-enforcement
 //   - /etc/polkit-1/localauthority.conf.d/99-adsys-privilege-enforcement
 //
+// Fine-grained sudo rules, allowing users and groups to only run some commands, are written to
+// /etc/sudoers.d/99-adsys. This file is checked with visudo before being installed: an invalid file
+// is never installed and the previous rules are kept.
+//
+// Specific polkit actions, like the package installation, can be administered by their own users and
+// groups, in addition to the global administrators. Those rules are written to
+// /etc/polkit-1/rules.d/49-adsys-privilege-enforcement.rules, and require a version of polkit
+// supporting JavaScript rules.
+//
+// The sudoers and polkit files of the administrators can be rendered from text/template files of
+// the privilege/ directory of the assets share instead of the default layout, for organizations
+// with their own layout. A rendered sudoers file is checked with visudo before being installed.
+//
 // This is an all or nothing type of policy and, therefore, requires a lot of attention during setup.
 // If the policy is setup improperly, users could end up with too much (or too little) privilege,
 // which could compromise the safety and/or usability of the machine until the policy gets updated.
@@ -24,11 +37,13 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/leonelquinteros/gotext"
 	"github.com/ubuntu/adsys/internal/consts"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
 	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
 	"github.com/ubuntu/decorate"
 	"gopkg.in/ini.v1"
 )
@@ -50,22 +65,66 @@ import (
 
 const adsysBaseConfName = "99-adsys-privilege-enforcement"
 
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+
 // Manager prevents running multiple privilege update process in parallel while parsing policy in ApplyPolicy.
 type Manager struct {
 	sudoersDir   string
 	policyKitDir string
+
+	visudoCmd  []string
+	cmdTimeout time.Duration
+}
+
+type options struct {
+	visudoCmd  []string
+	cmdTimeout time.Duration
+}
+
+// Option reprents an optional function to change the privilege manager.
+type Option func(*options)
+
+// WithVisudoCmd overrides the default visudo command, used to check the sudo rules.
+func WithVisudoCmd(cmd []string) Option {
+	return func(o *options) {
+		o.visudoCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time a command can take.
+func WithCmdTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.cmdTimeout = timeout
+	}
 }
 
 // NewWithDirs creates a manager with a specific root directory.
-func NewWithDirs(sudoersDir, policyKitDir string) *Manager {
+func NewWithDirs(sudoersDir, policyKitDir string, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		visudoCmd:  []string{"visudo"},
+		cmdTimeout: consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
 	return &Manager{
 		sudoersDir:   sudoersDir,
 		policyKitDir: policyKitDir,
+
+		visudoCmd:  args.visudoCmd,
+		cmdTimeout: args.cmdTimeout,
 	}
 }
 
 // ApplyPolicy generates a privilege policy based on a list of entries.
-func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
 	defer decorate.OnError(&err, gotext.Get("can't apply privilege policy to %s", objectName))
 
 	// We only have privilege escalation on computers.
@@ -82,6 +141,7 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		policyKitDir = consts.DefaultPolicyKitDir
 	}
 	sudoersConf := filepath.Join(sudoersDir, adsysBaseConfName)
+	sudoRulesConf := filepath.Join(sudoersDir, sudoRulesConfName)
 	policyKitConf := filepath.Join(policyKitDir, "localauthority.conf.d", adsysBaseConfName+".conf")
 
 	log.Debugf(ctx, "Applying privilege policy to %s", objectName)
@@ -91,10 +151,18 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		if err := os.Remove(sudoersConf); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
+		if err := os.Remove(sudoRulesConf); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
 		if err := os.Remove(policyKitConf); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
-		return nil
+		return writePolkitAdminRules(ctx, policyKitDir, nil, nil)
+	}
+
+	sudoersTmpl, polkitTmpl, err := loadTemplates(ctx, entries, assetsDumper)
+	if err != nil {
+		return err
 	}
 
 	// Create our temp files and parent directories
@@ -126,14 +194,12 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 
 	// Parse our rules and write to temp files
 	var headerWritten bool
-	header := `# This file is managed by adsys.
-# Do not edit this file manually.
-# Any changes will be overwritten.
-
-`
 
 	allowLocalAdmins := true
+	var clientAdmins []string
 	var polkitAdditionalUsersGroups []string
+	var sudoRules []sudoRule
+	var polkitActionAdmins []actionAdmins
 
 	for _, entry := range entries {
 		var contentSudo string
@@ -156,18 +222,42 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 			}
 
 			var polkitElem []string
-			for _, e := range splitAndNormalizeUsersAndGroups(ctx, entry.Value) {
+			admins := splitAndNormalizeUsersAndGroups(ctx, entry.Value)
+			for _, e := range admins {
 				contentSudo += fmt.Sprintf("\"%s\"	ALL=(ALL:ALL) ALL\n", e)
-				polkitID := fmt.Sprintf("unix-user:%s", e)
-				if strings.HasPrefix(e, "%") {
-					polkitID = fmt.Sprintf("unix-group:%s", strings.TrimPrefix(e, "%"))
-				}
-				polkitElem = append(polkitElem, polkitID)
+				polkitElem = append(polkitElem, polkitIdentity(e))
 			}
 			if len(polkitElem) < 1 {
 				continue
 			}
+			clientAdmins = admins
 			polkitAdditionalUsersGroups = polkitElem
+		case "sudo-rules":
+			// Those rules are written to their own file, checked before being installed.
+			if entry.Disabled {
+				continue
+			}
+			if sudoRules, err = parseSudoRules(ctx, entry.Value); err != nil {
+				return err
+			}
+			continue
+		case "polkit-action-admins":
+			// Those rules are written to the polkit rules directory, once the global administrators are known.
+			if entry.Disabled {
+				continue
+			}
+			if polkitActionAdmins, err = parseActionAdmins(ctx, entry.Value); err != nil {
+				return err
+			}
+			continue
+		case "sudoers-template", "polkit-template":
+			// The templates were loaded beforehand.
+			continue
+		}
+
+		// The template replaces the generated sudoers content.
+		if sudoersTmpl != nil {
+			continue
 		}
 
 		// Write to our files
@@ -177,18 +267,72 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		headerWritten = true
 	}
 	// PolicyKitConf files depends on multiple keys, so we need to write it at the end
-	if !allowLocalAdmins || polkitAdditionalUsersGroups != nil {
-		users := strings.Join(polkitAdditionalUsersGroups, ";")
-		// We need to set system local admin here as we override the key from the previous file
-		// otherwise, they will be disabled.
-		if allowLocalAdmins {
-			if systemPolkitAdmins != "" {
-				systemPolkitAdmins += ";"
+	users := strings.Join(polkitAdditionalUsersGroups, ";")
+	// We need to set system local admin here as we override the key from the previous file
+	// otherwise, they will be disabled.
+	if allowLocalAdmins && systemPolkitAdmins != "" {
+		if users != "" {
+			users = ";" + users
+		}
+		users = systemPolkitAdmins + users
+	}
+	if polkitTmpl == nil && (!allowLocalAdmins || polkitAdditionalUsersGroups != nil) {
+		if _, err := policyKitConfF.WriteString(fmt.Sprintf("%s[Configuration]\nAdminIdentities=%s", header, users) + "\n"); err != nil {
+			return err
+		}
+	}
+
+	// The templates are rendered with the administrators collected from all the entries.
+	data := templateData{
+		Header:           header,
+		AllowLocalAdmins: allowLocalAdmins,
+		ClientAdmins:     clientAdmins,
+	}
+	if users != "" {
+		data.PolkitAdminIdentities = strings.Split(users, ";")
+	}
+	if sudoersTmpl != nil {
+		if err := renderTemplate(sudoersTmpl, data, sudoersF); err != nil {
+			return err
+		}
+		if err := m.checkSudoers(ctx, sudoersConf+".new"); err != nil {
+			if errRemove := os.Remove(sudoersConf + ".new"); errRemove != nil {
+				log.Warningf(ctx, "Can't remove invalid sudoers file: %v", errRemove)
 			}
-			users = systemPolkitAdmins + users
+			return err
+		}
+	}
+	if polkitTmpl != nil {
+		if err := renderTemplate(polkitTmpl, data, policyKitConfF); err != nil {
+			return err
 		}
+	}
 
-		if _, err := policyKitConfF.WriteString(fmt.Sprintf("%s[Configuration]\nAdminIdentities=%s", header, users) + "\n"); err != nil {
+	// The global administrators can still authorize the actions with their own administrators.
+	globalPolkitAdmins := polkitAdditionalUsersGroups
+	if allowLocalAdmins {
+		localAdmins := localAdminsIdentities
+		if systemPolkitAdmins != "" {
+			localAdmins = nil
+			for _, id := range strings.Split(systemPolkitAdmins, ";") {
+				if id = strings.TrimSpace(id); id != "" {
+					localAdmins = append(localAdmins, id)
+				}
+			}
+		}
+		globalPolkitAdmins = append(localAdmins, globalPolkitAdmins...)
+	}
+
+	// Sudo ignores the files containing a dot, like our temporary file, in its configuration directory.
+	if len(sudoRules) > 0 {
+		// nolint:gosec // G306 match distribution permission
+		if err := os.WriteFile(sudoRulesConf+".new", []byte(renderSudoRules(sudoRules)), 0440); err != nil {
+			return err
+		}
+		if err := m.checkSudoers(ctx, sudoRulesConf+".new"); err != nil {
+			if errRemove := os.Remove(sudoRulesConf + ".new"); errRemove != nil {
+				log.Warningf(ctx, "Can't remove invalid sudoers file: %v", errRemove)
+			}
 			return err
 		}
 	}
@@ -197,11 +341,45 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 	if err := os.Rename(sudoersConf+".new", sudoersConf); err != nil {
 		return err
 	}
+	if len(sudoRules) > 0 {
+		if err := os.Rename(sudoRulesConf+".new", sudoRulesConf); err != nil {
+			return err
+		}
+	} else if err := os.Remove(sudoRulesConf); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
 	if err := os.Rename(policyKitConf+".new", policyKitConf); err != nil {
 		return err
 	}
 
-	return nil
+	return writePolkitAdminRules(ctx, policyKitDir, polkitActionAdmins, globalPolkitAdmins)
+}
+
+// DumpState returns the sudoers and polkit files generated during the last refresh of the machine.
+// The state is empty for users or if no privilege policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump privilege state of %s", objectName))
+
+	// We only have privilege escalation on computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	sudoersDir := m.sudoersDir
+	if sudoersDir == "" {
+		sudoersDir = consts.DefaultSudoersDir
+	}
+	policyKitDir := m.policyKitDir
+	if policyKitDir == "" {
+		policyKitDir = consts.DefaultPolicyKitDir
+	}
+
+	return syshelpers.DumpFiles(
+		filepath.Join(sudoersDir, adsysBaseConfName),
+		filepath.Join(sudoersDir, sudoRulesConfName),
+		filepath.Join(policyKitDir, "localauthority.conf.d", adsysBaseConfName+".conf"),
+		filepath.Join(policyKitDir, "rules.d", polkitAdminRulesName),
+	)
 }
 
 // splitAndNormalizeUsersAndGroups allow splitting on lines and ,.
@@ -213,6 +391,7 @@ func splitAndNormalizeUsersAndGroups(ctx context.Context, v string) []string {
 	v = strings.Join(elems, ",")
 	elems = nil
 	for _, e := range strings.Split(v, ",") {
+		e = strings.TrimSpace(e)
 		initialValue := e
 		// Invalid chars in Windows user names: '/[]:|<>+=;,?*%"
 		isgroup := strings.HasPrefix(e, "%")
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -25,6 +26,8 @@ func TestApplyPolicy(t *testing.T) {
 		existingPolkitDir  string
 		makeReadOnly       string
 		destIsDir          string
+		visudoFails        bool
+		saveAssetsError    bool
 
 		wantErr bool
 	}{
@@ -68,6 +71,66 @@ func TestApplyPolicy(t *testing.T) {
 				{Key: "allow-local-admins", Disabled: false},
 				{Key: "client-admins", Value: "alice@domain.com"}}},
 
+		// sudo rules
+		"Set sudo rules": {entries: []entry.Entry{{Key: "sudo-rules", Value: `user=alice@domain.com; commands=/usr/bin/apt update, /usr/bin/apt upgrade
+user=%operators@domain.com; runas=www-data; nopasswd=yes; commands=/usr/bin/systemctl restart nginx
+user=domain\bob; nopasswd=no; commands=/usr/bin/journalctl --since=today --output=short:iso, /usr/local/bin/report`}}},
+		"Sudo rules with other privilege rules": {entries: []entry.Entry{
+			{Key: "allow-local-admins", Disabled: true},
+			{Key: "client-admins", Value: "alice@domain.com"},
+			{Key: "sudo-rules", Value: "user=%operators@domain.com; commands=/usr/bin/systemctl restart nginx"}}},
+		"Sudo rules only":                       {entries: []entry.Entry{{Key: "sudo-rules", Value: "user=%operators@domain.com; commands=/usr/bin/systemctl restart nginx"}}},
+		"Empty lines in sudo rules are ignored": {entries: []entry.Entry{{Key: "sudo-rules", Value: "\nuser=alice@domain.com; commands=/usr/bin/apt update\n\n"}}},
+		"Overwrite existing sudo rules": {existingSudoersDir: "existing-sudo-rules", entries: []entry.Entry{
+			{Key: "sudo-rules", Value: "user=%operators@domain.com; commands=/usr/bin/systemctl restart nginx"}}},
+		"Disabled sudo rules remove existing ones": {existingSudoersDir: "existing-sudo-rules", entries: []entry.Entry{
+			{Key: "allow-local-admins", Disabled: true},
+			{Key: "sudo-rules", Disabled: true}}},
+		"No rules remove existing sudo rules": {existingSudoersDir: "existing-sudo-rules"},
+
+		// polkit action admins
+		"Set polkit action admins": {existingPolkitDir: "polkit-rules-dir", entries: []entry.Entry{{Key: "polkit-action-admins", Value: `org.freedesktop.packagekit.package-install = %packagers@domain.com, alice@domain.com
+# NetworkManager changes
+org.freedesktop.NetworkManager.* = domain\bob
+
+org.freedesktop.packagekit.package-install = %packagers@domain.com, carole@domain.com`}}},
+		"Polkit action admins with client admins": {existingPolkitDir: "polkit-rules-dir", entries: []entry.Entry{
+			{Key: "client-admins", Value: "%admins@domain.com"},
+			{Key: "polkit-action-admins", Value: "org.freedesktop.packagekit.package-install = %packagers@domain.com"}}},
+		"Polkit action admins with local admins disallowed": {existingPolkitDir: "polkit-rules-dir", entries: []entry.Entry{
+			{Key: "allow-local-admins", Disabled: true},
+			{Key: "polkit-action-admins", Value: "org.freedesktop.packagekit.package-install = %packagers@domain.com"}}},
+		"Polkit action admins with previous local admin conf": {existingPolkitDir: "existing-previous-local-admins-with-rules-dir", entries: []entry.Entry{
+			{Key: "polkit-action-admins", Value: "org.freedesktop.packagekit.package-install = %packagers@domain.com"}}},
+		"Polkit action admins are skipped without polkit rules support": {entries: []entry.Entry{
+			{Key: "polkit-action-admins", Value: "org.freedesktop.packagekit.package-install = %packagers@domain.com"}}},
+		"Overwrite existing polkit action admins": {existingPolkitDir: "existing-polkit-action-admins", entries: []entry.Entry{
+			{Key: "polkit-action-admins", Value: "org.freedesktop.NetworkManager.settings.modify.system = %network@domain.com"}}},
+		"Disabled polkit action admins remove existing ones": {existingPolkitDir: "existing-polkit-action-admins", entries: []entry.Entry{
+			{Key: "allow-local-admins", Disabled: true},
+			{Key: "polkit-action-admins", Disabled: true}}},
+		"No rules remove existing polkit action admins": {existingPolkitDir: "existing-polkit-action-admins"},
+
+		// templates
+		"Sudoers template": {entries: []entry.Entry{
+			{Key: "allow-local-admins", Disabled: true},
+			{Key: "client-admins", Value: "alice@domain.com,%group@domain.com"},
+			{Key: "sudoers-template", Value: "sudoers.tmpl"}}},
+		"Polkit template": {existingPolkitDir: "existing-previous-local-admins-one", entries: []entry.Entry{
+			{Key: "client-admins", Value: "alice@domain.com,%group@domain.com"},
+			{Key: "polkit-template", Value: "polkit.tmpl"}}},
+		"Sudoers and polkit templates": {entries: []entry.Entry{
+			{Key: "client-admins", Value: "alice@domain.com"},
+			{Key: "sudoers-template", Value: "sudoers.tmpl"},
+			{Key: "polkit-template", Value: "polkit.tmpl"}}},
+		"Templates in a subdirectory of the assets": {entries: []entry.Entry{
+			{Key: "client-admins", Value: "alice@domain.com"},
+			{Key: "sudoers-template", Value: "site/sudoers.tmpl"}}},
+		"Disabled templates use the default layout": {saveAssetsError: true, entries: []entry.Entry{
+			{Key: "client-admins", Value: "alice@domain.com"},
+			{Key: "sudoers-template", Value: "sudoers.tmpl", Disabled: true},
+			{Key: "polkit-template", Value: "polkit.tmpl", Disabled: true}}},
+
 		// Overwrite existing files
 		"No rules and no existing history means no files": {},
 		"Overwrite existing sudoers file":                 {existingSudoersDir: "existing-files", entries: defaultLocalAdminDisabledRule},
@@ -76,9 +139,32 @@ func TestApplyPolicy(t *testing.T) {
 		"Don't overwrite other existing files":            {existingSudoersDir: "existing-other-files", existingPolkitDir: "existing-other-files", entries: defaultLocalAdminDisabledRule},
 
 		// Not a computer, don’t do anything (even not create new files)
+		"Not a computer with sudo rules": {notComputer: true, existingSudoersDir: "existing-sudo-rules", entries: []entry.Entry{
+			{Key: "sudo-rules", Value: "user=alice@domain.com; commands=/usr/bin/apt update"}}},
 		"Not a computer": {notComputer: true, existingSudoersDir: "existing-other-files", existingPolkitDir: "existing-other-files"},
 
 		// Error cases
+		"Error on sudo rule without user":                           {entries: []entry.Entry{{Key: "sudo-rules", Value: "commands=/usr/bin/apt update"}}, wantErr: true},
+		"Error on sudo rule without commands":                       {entries: []entry.Entry{{Key: "sudo-rules", Value: "user=alice@domain.com"}}, wantErr: true},
+		"Error on sudo rule with empty commands":                    {entries: []entry.Entry{{Key: "sudo-rules", Value: "user=alice@domain.com; commands=,"}}, wantErr: true},
+		"Error on sudo rule with relative command":                  {entries: []entry.Entry{{Key: "sudo-rules", Value: "user=alice@domain.com; commands=apt update"}}, wantErr: true},
+		"Error on sudo rule with multiple users":                    {entries: []entry.Entry{{Key: "sudo-rules", Value: "user=alice@domain.com,bob@domain.com; commands=/usr/bin/apt update"}}, wantErr: true},
+		"Error on sudo rule with invalid runas user":                {entries: []entry.Entry{{Key: "sudo-rules", Value: "user=alice@domain.com; runas=ALL, root; commands=/usr/bin/apt update"}}, wantErr: true},
+		"Error on sudo rule with invalid nopasswd":                  {entries: []entry.Entry{{Key: "sudo-rules", Value: "user=alice@domain.com; nopasswd=maybe; commands=/usr/bin/apt update"}}, wantErr: true},
+		"Error on sudo rule with unsupported field":                 {entries: []entry.Entry{{Key: "sudo-rules", Value: "user=alice@domain.com; host=all; commands=/usr/bin/apt update"}}, wantErr: true},
+		"Error on sudo rule with field set more than once":          {entries: []entry.Entry{{Key: "sudo-rules", Value: "user=alice@domain.com; user=bob@domain.com; commands=/usr/bin/apt update"}}, wantErr: true},
+		"Error on polkit action admins without action":              {entries: []entry.Entry{{Key: "polkit-action-admins", Value: "%packagers@domain.com"}}, wantErr: true},
+		"Error on polkit action admins with invalid action":         {entries: []entry.Entry{{Key: "polkit-action-admins", Value: "org.freedesktop.*.install = %packagers@domain.com"}}, wantErr: true},
+		"Error on polkit action admins without user or group":       {entries: []entry.Entry{{Key: "polkit-action-admins", Value: "org.freedesktop.packagekit.package-install = "}}, wantErr: true},
+		"Error on writing polkit action admins":                     {makeReadOnly: "polkit-1/rules.d", existingPolkitDir: "polkit-rules-dir", entries: []entry.Entry{{Key: "polkit-action-admins", Value: "org.freedesktop.packagekit.package-install = %packagers@domain.com"}}, wantErr: true},
+		"Error on template outside of the assets":                   {entries: []entry.Entry{{Key: "sudoers-template", Value: "../scripts/sudoers.tmpl"}}, wantErr: true},
+		"Error on absolute template path":                           {entries: []entry.Entry{{Key: "polkit-template", Value: "/etc/polkit.tmpl"}}, wantErr: true},
+		"Error on missing template":                                 {entries: []entry.Entry{{Key: "sudoers-template", Value: "missing.tmpl"}}, wantErr: true},
+		"Error on invalid template":                                 {entries: []entry.Entry{{Key: "polkit-template", Value: "invalid.tmpl"}}, wantErr: true},
+		"Error on template failing to render":                       {entries: []entry.Entry{{Key: "sudoers-template", Value: "unknown-field.tmpl"}}, wantErr: true},
+		"Error on assets dump failure":                              {saveAssetsError: true, entries: []entry.Entry{{Key: "sudoers-template", Value: "sudoers.tmpl"}}, wantErr: true},
+		"Error on sudoers template rejected by visudo":              {existingSudoersDir: "existing-sudo-rules", visudoFails: true, entries: []entry.Entry{{Key: "sudoers-template", Value: "sudoers.tmpl"}}, wantErr: true},
+		"Error on sudo rules rejected by visudo keeps previous":     {existingSudoersDir: "existing-sudo-rules", visudoFails: true, entries: []entry.Entry{{Key: "sudo-rules", Value: "user=alice@domain.com; commands=/usr/bin/apt update"}}, wantErr: true},
 		"Error on writing to sudoers file":                          {makeReadOnly: "sudoers.d/", existingSudoersDir: "existing-files", existingPolkitDir: "existing-files", entries: defaultLocalAdminDisabledRule, wantErr: true},
 		"Error on writing to polkit subdirectory creation":          {makeReadOnly: "polkit-1/", existingSudoersDir: "existing-files", existingPolkitDir: "only-base-polkit-dir", entries: defaultLocalAdminDisabledRule, wantErr: true},
 		"Error on writing to polkit conf file":                      {makeReadOnly: "polkit-1/localauthority.conf.d", existingSudoersDir: "existing-files", existingPolkitDir: "existing-files", entries: defaultLocalAdminDisabledRule, wantErr: true},
@@ -119,10 +205,20 @@ func TestApplyPolicy(t *testing.T) {
 				require.NoError(t, os.MkdirAll(filepath.Join(tempEtc, tc.destIsDir), 0750), "Setup: can't create fake unwritable file")
 			}
 
-			m := privilege.NewWithDirs(sudoersDir, policyKitDir)
-			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.notComputer, tc.entries)
+			visudoCmd := []string{"true"}
+			if tc.visudoFails {
+				visudoCmd = []string{"sh", "-c", "echo 'parse error in sudoers' >&2 && exit 1", "--"}
+			}
+
+			m := privilege.NewWithDirs(sudoersDir, policyKitDir, privilege.WithVisudoCmd(visudoCmd))
+			mockAssetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.saveAssetsError, Path: "privilege/"}
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.notComputer, tc.entries, mockAssetsDumper.SaveAssetsTo)
 			if tc.wantErr {
 				require.NotNil(t, err, "ApplyPolicy should have failed but didn't")
+				if tc.visudoFails {
+					require.FileExists(t, filepath.Join(sudoersDir, "99-adsys"), "Previous sudo rules should have been kept")
+					require.NoFileExists(t, filepath.Join(sudoersDir, "99-adsys.new"), "Rejected sudo rules should have been removed")
+				}
 				return
 			}
 			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
@@ -131,3 +227,65 @@ func TestApplyPolicy(t *testing.T) {
 		})
 	}
 }
+
+func TestDumpState(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		notComputer        bool
+		existingSudoersDir string
+		existingPolkitDir  string
+		destIsDir          string
+
+		wantErr bool
+	}{
+		"Computer state": {existingSudoersDir: "existing-files", existingPolkitDir: "existing-files"},
+		"Computer state with sudo rules and action admins": {existingSudoersDir: "existing-sudo-rules", existingPolkitDir: "existing-polkit-action-admins"},
+		"No state for user":                     {notComputer: true, existingSudoersDir: "existing-files", existingPolkitDir: "existing-files"},
+		"No state without privilege files":      {},
+		"Other files are not part of the state": {existingSudoersDir: "existing-other-files", existingPolkitDir: "existing-other-files"},
+
+		// Error cases
+		"Error on unreadable state": {destIsDir: "sudoers.d/99-adsys-privilege-enforcement", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tempEtc := t.TempDir()
+			sudoersDir := filepath.Join(tempEtc, "sudoers.d")
+			policyKitDir := filepath.Join(tempEtc, "polkit-1")
+
+			if tc.existingSudoersDir != "" {
+				require.NoError(t,
+					shutil.CopyTree(
+						filepath.Join("testdata", tc.existingSudoersDir, "sudoers.d"), sudoersDir,
+						&shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial sudoer directory")
+			}
+			if tc.existingPolkitDir != "" {
+				require.NoError(t,
+					shutil.CopyTree(
+						filepath.Join("testdata", tc.existingPolkitDir, "polkit-1"), policyKitDir,
+						&shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial polkit directory")
+			}
+			if tc.destIsDir != "" {
+				require.NoError(t, os.MkdirAll(filepath.Join(tempEtc, tc.destIsDir), 0750), "Setup: can't create fake unreadable file")
+			}
+
+			m := privilege.NewWithDirs(sudoersDir, policyKitDir)
+			got, err := m.DumpState(context.Background(), "ubuntu", !tc.notComputer)
+			if tc.wantErr {
+				require.Error(t, err, "DumpState should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "DumpState failed but shouldn't have")
+
+			got = strings.ReplaceAll(got, tempEtc, "#ETCDIR#")
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "DumpState returned unexpected state")
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package privilege
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/decorate"
+)
+
+// sudoRulesConfName is the sudoers file containing the fine-grained sudo rules.
+const sudoRulesConfName = "99-adsys"
+
+// runAsRe matches the local and directory user names a command can be run as.
+var runAsRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@-]*\$?$`)
+
+// sudoRule allows a user or group to run some commands with sudo.
+type sudoRule struct {
+	// who is the user, or the group prefixed with %, the rule applies to.
+	who      string
+	runAs    string
+	nopasswd bool
+	commands []string
+}
+
+// parseSudoRules parses the rules of v, one per line.
+func parseSudoRules(ctx context.Context, v string) (rules []sudoRule, err error) {
+	for _, l := range strings.Split(v, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		r, err := parseSudoRule(ctx, l)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseSudoRule parses a rule line of the form user=<user or %group>; [runas=<user>;] [nopasswd=yes;] commands=<command>[, <command>…].
+func parseSudoRule(ctx context.Context, l string) (r sudoRule, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid sudo rule %q", l))
+
+	usage := gotext.Get("expected user=<user or group>; [runas=<user>;] [nopasswd=yes;] commands=<command>[, <command>…]")
+
+	var who, nopasswd, commands string
+	rest := l
+	for rest != "" {
+		var field string
+		field, rest, _ = strings.Cut(rest, ";")
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if k == "commands" {
+			// The commands are the last field and are kept verbatim.
+			if rest != "" {
+				v = strings.TrimSpace(v + ";" + rest)
+			}
+			rest = ""
+		}
+		if !found || v == "" {
+			return r, errors.New(usage)
+		}
+
+		var dest *string
+		switch k {
+		case "user":
+			dest = &who
+		case "runas":
+			dest = &r.runAs
+		case "nopasswd":
+			dest = &nopasswd
+		case "commands":
+			dest = &commands
+		default:
+			return r, errors.New(gotext.Get("unsupported field %q", k))
+		}
+		if *dest != "" {
+			return r, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		*dest = v
+	}
+
+	if who == "" || commands == "" {
+		return r, errors.New(usage)
+	}
+
+	users := splitAndNormalizeUsersAndGroups(ctx, who)
+	if len(users) != 1 {
+		return r, errors.New(gotext.Get("%q is not a single user or group", who))
+	}
+	r.who = users[0]
+
+	if r.runAs == "" {
+		r.runAs = "root"
+	}
+	if !runAsRe.MatchString(r.runAs) {
+		return r, errors.New(gotext.Get("%q is not a valid user name", r.runAs))
+	}
+
+	switch strings.ToLower(nopasswd) {
+	case "", "no":
+	case "yes":
+		r.nopasswd = true
+	default:
+		return r, errors.New(gotext.Get("nopasswd must be yes or no, got %q", nopasswd))
+	}
+
+	for _, c := range strings.Split(commands, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		// sudo only matches commands by their full path.
+		if !filepath.IsAbs(c) {
+			return r, errors.New(gotext.Get("command %q must be an absolute path", c))
+		}
+		r.commands = append(r.commands, c)
+	}
+	if len(r.commands) == 0 {
+		return r, errors.New(usage)
+	}
+
+	return r, nil
+}
+
+// renderSudoRules returns the content of the sudoers file granting rules.
+func renderSudoRules(rules []sudoRule) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, r := range rules {
+		var tag string
+		if r.nopasswd {
+			tag = "NOPASSWD: "
+		}
+		commands := make([]string, 0, len(r.commands))
+		for _, c := range r.commands {
+			commands = append(commands, escapeSudoCommand(c))
+		}
+		fmt.Fprintf(&b, "\"%s\"	ALL=(%s) %s%s\n", r.who, r.runAs, tag, strings.Join(commands, ", "))
+	}
+	return b.String()
+}
+
+// escapeSudoCommand escapes the characters of the command arguments which are special in sudoers.
+func escapeSudoCommand(c string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`, `=`, `\=`).Replace(c)
+}
+
+// checkSudoers checks the syntax of the sudoers file at path with visudo.
+// An error, containing the visudo output, is returned if the file is invalid.
+func (m *Manager) checkSudoers(ctx context.Context, path string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid sudoers file generated"))
+
+	ctx, cancel := context.WithTimeout(ctx, m.cmdTimeout)
+	defer cancel()
+
+	args := append(slices.Clone(m.visudoCmd[1:]), "-c", "-q", "-f", path)
+	// #nosec G204 - cmd is under our control (default system command or mock for tests)
+	c := exec.CommandContext(ctx, m.visudoCmd[0], args...)
+	var out bytes.Buffer
+	c.Stdout = &out
+	c.Stderr = &out
+
+	smbsafe.WaitExec()
+	err = c.Run()
+	smbsafe.DoneExec()
+
+	if err != nil {
+		if output := strings.TrimSpace(out.String()); output != "" {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
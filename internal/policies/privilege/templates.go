@@ -0,0 +1,107 @@
+package privilege
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+// assetsDir is the directory of the assets share the templates are read from.
+const assetsDir = "privilege"
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// templateData is the data the sudoers and polkit templates are rendered with.
+type templateData struct {
+	// Header is the comment header of the files managed by adsys.
+	Header string
+	// AllowLocalAdmins is false when the members of the local sudo and admin groups are denied administrator privileges.
+	AllowLocalAdmins bool
+	// ClientAdmins are the users and the groups, prefixed with %, from AD allowed to administer the machine.
+	ClientAdmins []string
+	// PolkitAdminIdentities are the polkit identities of all the administrators of the machine.
+	PolkitAdminIdentities []string
+}
+
+// templateFuncs are the functions available in the templates, in addition to the text/template ones.
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// loadTemplates returns the sudoers and polkit templates configured in entries, read from the assets.
+// A template is nil if it is not configured.
+func loadTemplates(ctx context.Context, entries []entry.Entry, assetsDumper AssetsDumper) (sudoersTmpl, polkitTmpl *template.Template, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load privilege templates"))
+
+	sources := make(map[string]string)
+	for _, e := range entries {
+		if e.Key != "sudoers-template" && e.Key != "polkit-template" {
+			continue
+		}
+		src := filepath.ToSlash(strings.TrimSpace(e.Value))
+		if e.Disabled || src == "" {
+			continue
+		}
+		if filepath.IsAbs(src) || !filepath.IsLocal(src) {
+			return nil, nil, errors.New(gotext.Get("%s %q must be relative to the %s/ directory of the assets share", e.Key, src, assetsDir))
+		}
+		sources[e.Key] = src
+	}
+	if len(sources) == 0 {
+		return nil, nil, nil
+	}
+
+	tmp, err := os.MkdirTemp("", "adsys-privilege-assets-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if errRemove := os.RemoveAll(tmp); errRemove != nil {
+			err = errors.Join(err, errRemove)
+		}
+	}()
+	// Only root can read the assets until the templates are parsed.
+	assets := filepath.Join(tmp, assetsDir)
+	if err := assetsDumper(ctx, assetsDir+"/", assets, -1, -1); err != nil {
+		return nil, nil, err
+	}
+
+	parse := func(key string) (*template.Template, error) {
+		src, ok := sources[key]
+		if !ok {
+			return nil, nil
+		}
+		content, err := os.ReadFile(filepath.Join(assets, src))
+		if err != nil {
+			return nil, errors.New(gotext.Get("%s %q not found in the assets share: %v", key, src, err))
+		}
+		t, err := template.New(src).Funcs(templateFuncs).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return nil, errors.New(gotext.Get("invalid %s %q: %v", key, src, err))
+		}
+		return t, nil
+	}
+
+	if sudoersTmpl, err = parse("sudoers-template"); err != nil {
+		return nil, nil, err
+	}
+	if polkitTmpl, err = parse("polkit-template"); err != nil {
+		return nil, nil, err
+	}
+	return sudoersTmpl, polkitTmpl, nil
+}
+
+// renderTemplate renders t with data to the file f.
+func renderTemplate(t *template.Template, data templateData, f *os.File) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't render template %q", t.Name()))
+
+	return t.Execute(f, data)
+}
@@ -0,0 +1,397 @@
+// Package quota provides a manager that sets the disk quotas of users and groups on the filesystems of the machine,
+// for instance to limit the size of the home directories on labs and shared machines.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - quota/users: disk quotas of users, one per line, of the form
+//     name=<user>[, soft=<size>][, hard=<size>][, files-soft=<count>][, files-hard=<count>][, filesystem=<mount point>].
+//   - quota/groups: disk quotas of groups, one per line, of the same form with group names.
+//
+// Sizes are expressed in KiB, or with a K, M, G or T suffix. Counts limit the number of files. A limit of 0, or a
+// limit which is not set, means no limit. The quotas are set on /home unless another filesystem is given, which
+// needs to be mounted with quotas enabled.
+//
+// The quotas set by adsys are saved in a state file, so that they are removed once they are not configured anymore.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const stateFile = "state.json"
+
+// defaultFilesystem is the filesystem the quotas are set on if none is given.
+const defaultFilesystem = "/home"
+
+// Types of the accounts a quota is set for, as expected by setquota.
+const (
+	typeUser  = "user"
+	typeGroup = "group"
+)
+
+var (
+	// accountNameRe matches the names of the local and domain users and groups accepted by adsys.
+	accountNameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@-]*\$?$`)
+	// sizeRe matches a size in KiB, or with a unit suffix.
+	sizeRe = regexp.MustCompile(`^([0-9]+)([KMGTkmgt]?)$`)
+)
+
+// limits are the disk quota limits of an account on a filesystem. 0 means no limit.
+type limits struct {
+	blocksSoft uint64
+	blocksHard uint64
+	filesSoft  uint64
+	filesHard  uint64
+}
+
+// target is an account on a filesystem.
+type target struct {
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Filesystem string `json:"filesystem"`
+}
+
+// state is the disk quotas configuration applied by adsys.
+type state struct {
+	// Quotas are the accounts on each filesystem adsys set a quota for.
+	Quotas []target `json:"quotas,omitempty"`
+}
+
+// Manager applies the disk quota policy on the machine.
+type Manager struct {
+	stateDir    string
+	setquotaCmd []string
+	cmdTimeout  time.Duration
+
+	mu sync.Mutex // Prevents concurrent changes to the quotas and the state
+}
+
+type options struct {
+	stateDir    string
+	setquotaCmd []string
+	cmdTimeout  time.Duration
+}
+
+// Option reprents an optional function to change the disk quota manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithSetquotaCmd overrides the default setquota command.
+func WithSetquotaCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.setquotaCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time a command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the disk quota policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:    consts.DefaultStateDir,
+		setquotaCmd: []string{"setquota"},
+		cmdTimeout:  consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:    filepath.Join(args.stateDir, "quota"),
+		setquotaCmd: args.setquotaCmd,
+		cmdTimeout:  args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy sets the disk quotas requested by the policy, and removes the quotas which are not requested anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply disk quota policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Disk quota policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying disk quota policy to %s", objectName)
+
+	quotas, targets, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to revert.
+	if len(targets) == 0 && len(prev.Quotas) == 0 {
+		return nil
+	}
+
+	s, err := m.apply(ctx, prev, quotas, targets)
+	if err != nil {
+		// Still save the quotas set so far, so that they can be removed.
+		return errors.Join(err, m.saveState(s))
+	}
+	return m.saveState(s)
+}
+
+// DumpState returns the disk quotas set during the last refresh of the machine.
+// The state is empty for users or if no quota policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump quota state of %s", objectName))
+
+	// Quota policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// apply removes the quotas of the previous state prev which are not requested anymore, then sets the
+// requested quotas on targets. It returns the new state.
+func (m *Manager) apply(ctx context.Context, prev state, quotas map[target]limits, targets []target) (s state, err error) {
+	s.Quotas = slices.Clone(prev.Quotas)
+
+	for _, t := range prev.Quotas {
+		if _, ok := quotas[t]; ok {
+			continue
+		}
+		log.Infof(ctx, "Removing disk quota of %s %s on %s", t.Type, t.Name, t.Filesystem)
+		if err := m.setQuota(ctx, t, limits{}); err != nil {
+			return s, err
+		}
+		s.Quotas = slices.DeleteFunc(s.Quotas, func(q target) bool { return q == t })
+	}
+
+	for _, t := range targets {
+		log.Infof(ctx, "Setting disk quota of %s %s on %s", t.Type, t.Name, t.Filesystem)
+		if err := m.setQuota(ctx, t, quotas[t]); err != nil {
+			return s, err
+		}
+		if !slices.Contains(s.Quotas, t) {
+			s.Quotas = append(s.Quotas, t)
+		}
+	}
+
+	return s, nil
+}
+
+// setQuota sets the limits l of the account on the filesystem of t.
+func (m *Manager) setQuota(ctx context.Context, t target, l limits) error {
+	flag := "-u"
+	if t.Type == typeGroup {
+		flag = "-g"
+	}
+	_, err := syshelpers.Run(ctx, m.cmdTimeout, m.setquotaCmd, flag, t.Name,
+		strconv.FormatUint(l.blocksSoft, 10), strconv.FormatUint(l.blocksHard, 10),
+		strconv.FormatUint(l.filesSoft, 10), strconv.FormatUint(l.filesHard, 10),
+		t.Filesystem)
+	return err
+}
+
+// loadState loads the disk quotas configuration applied by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load disk quota state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the disk quotas configuration applied by adsys.
+// The state file is removed if no quota is to be removed anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save disk quota state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Quotas) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// parseEntries validates the entries and returns the requested quotas, with their targets in order.
+// Quotas are listed from the furthest to the closest GPO: the closest one wins.
+func parseEntries(ctx context.Context, entries []entry.Entry) (quotas map[target]limits, targets []target, err error) {
+	quotas = make(map[target]limits)
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		var accountType string
+		switch e.Key {
+		case "quota/users":
+			accountType = typeUser
+		case "quota/groups":
+			accountType = typeGroup
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing disk quota entries, skipping it", e.Key))
+			continue
+		}
+
+		for _, l := range strings.Split(v, "\n") {
+			l = strings.TrimSpace(l)
+			if l == "" {
+				continue
+			}
+			t, q, err := parseQuota(accountType, l)
+			if err != nil {
+				return nil, nil, err
+			}
+			if _, ok := quotas[t]; !ok {
+				targets = append(targets, t)
+			}
+			quotas[t] = q
+		}
+	}
+	return quotas, targets, nil
+}
+
+// parseQuota parses a quota line of the form
+// name=<account>[, soft=<size>][, hard=<size>][, files-soft=<count>][, files-hard=<count>][, filesystem=<mount point>].
+func parseQuota(accountType, l string) (t target, q limits, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid disk quota %q", l))
+
+	t = target{Type: accountType, Filesystem: defaultFilesystem}
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(l, ",") {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return t, q, errors.New(gotext.Get("expected name=<%s>[, soft=<size>][, hard=<size>][, files-soft=<count>][, files-hard=<count>][, filesystem=<mount point>]", accountType))
+		}
+		if seen[k] {
+			return t, q, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		seen[k] = true
+
+		switch k {
+		case "name":
+			t.Name = v
+		case "soft":
+			q.blocksSoft, err = parseSize(v)
+		case "hard":
+			q.blocksHard, err = parseSize(v)
+		case "files-soft":
+			q.filesSoft, err = parseCount(v)
+		case "files-hard":
+			q.filesHard, err = parseCount(v)
+		case "filesystem":
+			if !filepath.IsAbs(v) || strings.ContainsAny(v, " \t") {
+				return t, q, errors.New(gotext.Get("%q is not a valid mount point", v))
+			}
+			t.Filesystem = filepath.Clean(v)
+		default:
+			return t, q, errors.New(gotext.Get("unsupported field %q", k))
+		}
+		if err != nil {
+			return t, q, err
+		}
+	}
+
+	if !accountNameRe.MatchString(t.Name) {
+		return t, q, errors.New(gotext.Get("%q is not a valid %s name", t.Name, accountType))
+	}
+	if q.blocksHard != 0 && q.blocksSoft > q.blocksHard {
+		return t, q, errors.New(gotext.Get("soft size limit is above the hard one"))
+	}
+	if q.filesHard != 0 && q.filesSoft > q.filesHard {
+		return t, q, errors.New(gotext.Get("soft files limit is above the hard one"))
+	}
+	return t, q, nil
+}
+
+// parseSize parses a size in KiB, or with a K, M, G or T suffix, and returns it in KiB.
+func parseSize(v string) (uint64, error) {
+	m := sizeRe.FindStringSubmatch(v)
+	if m == nil {
+		return 0, errors.New(gotext.Get("%q is not a valid size", v))
+	}
+	n, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil {
+		return 0, errors.New(gotext.Get("%q is not a valid size", v))
+	}
+	var shift uint
+	switch strings.ToUpper(m[2]) {
+	case "M":
+		shift = 10
+	case "G":
+		shift = 20
+	case "T":
+		shift = 30
+	}
+	if n > (^uint64(0))>>shift {
+		return 0, errors.New(gotext.Get("%q is too large", v))
+	}
+	return n << shift, nil
+}
+
+// parseCount parses a number of files.
+func parseCount(v string) (uint64, error) {
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, errors.New(gotext.Get("%q is not a valid number of files", v))
+	}
+	return n, nil
+}
@@ -0,0 +1,120 @@
+package quota_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/quota"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isUser        bool
+		existingState string
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Set user quotas":                      {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, soft=5G, hard=6G\n\n  name=bob@example.com , hard=500M, files-hard=10000"}}},
+		"Set group quotas":                     {entries: []entry.Entry{{Key: "quota/groups", Value: "name=students, soft=20G, hard=25G, files-soft=50000, files-hard=60000"}}},
+		"Sizes without unit are in KiB":        {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, soft=1024, hard=2048k"}}},
+		"Sizes with lowercase units":           {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, soft=1m, hard=1t"}}},
+		"Set quotas on another filesystem":     {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G, filesystem=/srv/data/"}}},
+		"Same account on several filesystems":  {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G\nname=alice, hard=1G, filesystem=/srv"}}},
+		"Same name for user and group":         {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G"}, {Key: "quota/groups", Value: "name=alice, hard=10G"}}},
+		"Closest quota wins":                   {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=1G"}, {Key: "quota/users", Value: "name=alice, hard=5G"}}},
+		"Field names are case insensitive":     {entries: []entry.Entry{{Key: "quota/users", Value: "Name=alice, HARD=5G"}}},
+		"Quota without limits removes limits":  {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice"}}},
+		"Already applied quotas are updated":   {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=10G"}, {Key: "quota/groups", Value: "name=students, hard=30G"}}, existingState: "applied"},
+		"Quotas not configured are removed":    {entries: []entry.Entry{{Key: "quota/users", Value: "name=carol, hard=1G"}}, existingState: "applied"},
+		"No entries removes applied quotas":    {existingState: "applied"},
+		"Disabled entries are ignored":         {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G", Disabled: true}, {Key: "quota/groups", Value: "name=students, hard=30G"}}},
+		"Empty entries are ignored":            {entries: []entry.Entry{{Key: "quota/users", Value: " \n"}, {Key: "quota/groups", Value: "name=students, hard=30G"}}},
+		"Unsupported keys are ignored":         {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G"}, {Key: "quota/grace", Value: "7days"}}},
+		"Users are a no-op":                    {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G"}}, isUser: true},
+		"No entries and no state is a no-op":   {},
+		"Soft limits equal to hard ones":       {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, soft=5G, hard=5G, files-soft=10, files-hard=10"}}},
+		"Soft limits without hard ones":        {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, soft=5G, files-soft=10"}}},
+		"Machine accounts names are supported": {entries: []entry.Entry{{Key: "quota/users", Value: "name=kiosk$, hard=1G"}}},
+
+		// Error cases
+		"Error on missing name":                 {entries: []entry.Entry{{Key: "quota/users", Value: "hard=5G"}}, wantErr: true},
+		"Error on invalid user name":            {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice smith, hard=5G"}}, wantErr: true},
+		"Error on option as group name":         {entries: []entry.Entry{{Key: "quota/groups", Value: "name=-a, hard=5G"}}, wantErr: true},
+		"Error on invalid size":                 {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5GB"}}, wantErr: true},
+		"Error on negative size":                {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=-5G"}}, wantErr: true},
+		"Error on too large size":               {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=99999999999999999T"}}, wantErr: true},
+		"Error on invalid files count":          {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, files-hard=10k"}}, wantErr: true},
+		"Error on soft size above hard one":     {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, soft=6G, hard=5G"}}, wantErr: true},
+		"Error on soft files above hard ones":   {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, files-soft=11, files-hard=10"}}, wantErr: true},
+		"Error on relative filesystem":          {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G, filesystem=home"}}, wantErr: true},
+		"Error on filesystem with spaces":       {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G, filesystem=/my data"}}, wantErr: true},
+		"Error on empty field":                  {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard="}}, wantErr: true},
+		"Error on field set more than once":     {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G, hard=6G"}}, wantErr: true},
+		"Error on unsupported field":            {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, grace=7days"}}, wantErr: true},
+		"Error on setting quota":                {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G"}}, mockBehaviour: "fail-setquota", wantErr: true},
+		"Error on removing quota keeps state":   {existingState: "applied", mockBehaviour: "fail-setquota", wantErr: true},
+		"Error on setting quota keeps progress": {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G\nname=unknown, hard=5G"}}, mockBehaviour: "fail-setquota-unknown", wantErr: true},
+		"Error on corrupted state":              {entries: []entry.Entry{{Key: "quota/users", Value: "name=alice, hard=5G"}}, existingState: "corrupted", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			m := quota.New(
+				quota.WithStateDir(root),
+				quota.WithSetquotaCmd(testutils.MockCommand(root, "setquota", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				// Only failing commands leave changes to check.
+				if tc.mockBehaviour == "" {
+					return
+				}
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, behaviour, args := c.Name, c.Behaviour, c.Args
+
+	if behaviour == "fail-"+name ||
+		(len(args) > 1 && behaviour == "fail-"+name+"-"+args[1]) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+
+	c.Log(fmt.Sprintf("%s %s", name, strings.Join(args, " ")))
+}
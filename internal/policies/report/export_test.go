@@ -0,0 +1,20 @@
+package report
+
+import (
+	"net/smtp"
+	"time"
+)
+
+// WithNow overrides the function returning the current time.
+func WithNow(now func() time.Time) func(*options) {
+	return func(a *options) {
+		a.now = now
+	}
+}
+
+// WithSendMail overrides the function sending mails.
+func WithSendMail(f func(addr string, a smtp.Auth, from string, to []string, msg []byte) error) func(*options) {
+	return func(a *options) {
+		a.sendMail = f
+	}
+}
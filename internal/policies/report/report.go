@@ -0,0 +1,421 @@
+// Package report provides a manager that reports the users whose policies fail to be applied
+// repeatedly to the administrators.
+//
+// The reporting is configured by the machine policy. The following settings are supported:
+//   - report/threshold: the number of consecutive failed refreshes after which a user is
+//     reported (3 by default);
+//   - report/smtp-relay: the mail relay, of the form <host>[:<port>], to which the summary is sent,
+//     without authentication. The port defaults to 25;
+//   - report/sender: the sender address of the summary (adsys@<hostname> by default);
+//   - report/recipients: the addresses the summary is sent to, one per line;
+//   - report/directory: a directory, typically a share mounted on the machine, where the
+//     summary of the machine is written as adsys-report-<hostname>.txt.
+//
+// Once the reporting is configured, the outcome of each user refresh is recorded. A summary of the
+// failing users is sent as soon as a user reaches the threshold, listing all the users which are
+// still failing. A user is only reported once until one of its refreshes succeeds again, so that
+// persistent failures don't flood the administrators.
+//
+// Failing to send the summary doesn't fail the refreshes: it is reported in the logs and retried
+// on the next summary.
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	configFile   = "config.json"
+	failuresFile = "failures.json"
+
+	defaultThreshold = 3
+	defaultSMTPPort  = "25"
+)
+
+// config is the reporting configuration from the machine policy.
+type config struct {
+	Threshold  int      `json:"threshold"`
+	SMTPRelay  string   `json:"smtp_relay,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	Directory  string   `json:"directory,omitempty"`
+}
+
+// failure is the failure history of a user since its last successful refresh.
+type failure struct {
+	Count     int       `json:"count"`
+	Since     time.Time `json:"since"`
+	Last      time.Time `json:"last"`
+	LastError string    `json:"last_error"`
+	// Reported is true once the user has been part of a summary.
+	Reported bool `json:"reported,omitempty"`
+}
+
+// Manager records the user refreshes and reports the persistent failures.
+type Manager struct {
+	stateDir string
+	now      func() time.Time
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+	mu sync.Mutex
+}
+
+type options struct {
+	stateDir string
+	now      func() time.Time
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// Option reprents an optional function to change the report manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// New returns a new manager for the report policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir: consts.DefaultStateDir,
+		now:      time.Now,
+		sendMail: smtp.SendMail,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir: filepath.Join(args.stateDir, "report"),
+		now:      args.now,
+		sendMail: args.sendMail,
+	}
+}
+
+// ApplyPolicy saves the reporting configuration of the machine policy.
+// The failure history is dropped once the reporting is not configured anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply report policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Report policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying report policy to %s", objectName)
+
+	c, enabled, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !enabled {
+		for _, f := range []string{configFile, failuresFile} {
+			if err := os.Remove(filepath.Join(m.stateDir, f)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return m.save(configFile, c)
+}
+
+// DumpState returns the reporting configuration saved during the last refresh of the machine, with the
+// failures of the users since then.
+// The state is empty for users or if no report policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump report state of %s", objectName))
+
+	// Report policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(
+		filepath.Join(m.stateDir, configFile),
+		filepath.Join(m.stateDir, failuresFile),
+	)
+}
+
+// parseEntries returns the reporting configuration from the entries.
+// The reporting is enabled if at least a mail relay or a directory is configured.
+func parseEntries(ctx context.Context, entries []entry.Entry) (c config, enabled bool, err error) {
+	c.Threshold = defaultThreshold
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "report/threshold":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return c, false, errors.New(gotext.Get("invalid threshold %q: expected a positive number", v))
+			}
+			c.Threshold = n
+		case "report/smtp-relay":
+			if _, _, err := net.SplitHostPort(v); err != nil {
+				v = net.JoinHostPort(v, defaultSMTPPort)
+			}
+			host, port, err := net.SplitHostPort(v)
+			if err != nil || host == "" || strings.ContainsAny(host, "/ ") {
+				return c, false, errors.New(gotext.Get("invalid mail relay %q: expected <host>[:<port>]", v))
+			}
+			if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				return c, false, errors.New(gotext.Get("invalid mail relay %q: invalid port", v))
+			}
+			c.SMTPRelay = v
+		case "report/sender":
+			a, err := mail.ParseAddress(v)
+			if err != nil {
+				return c, false, errors.New(gotext.Get("invalid sender %q: %v", v, err))
+			}
+			c.Sender = a.Address
+		case "report/recipients":
+			for _, l := range strings.Split(v, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" {
+					continue
+				}
+				a, err := mail.ParseAddress(l)
+				if err != nil {
+					return c, false, errors.New(gotext.Get("invalid recipient %q: %v", l, err))
+				}
+				c.Recipients = append(c.Recipients, a.Address)
+			}
+		case "report/directory":
+			if !filepath.IsAbs(v) {
+				return c, false, errors.New(gotext.Get("report directory %q must be an absolute path", v))
+			}
+			c.Directory = filepath.Clean(v)
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing report entries, skipping it", e.Key))
+		}
+	}
+
+	if c.SMTPRelay != "" && len(c.Recipients) == 0 {
+		return c, false, errors.New(gotext.Get("a mail relay is configured without any recipient"))
+	}
+	if c.SMTPRelay == "" && len(c.Recipients) > 0 {
+		log.Warning(ctx, gotext.Get("Report recipients are configured without any mail relay, no mail will be sent"))
+		c.Recipients = nil
+	}
+
+	return c, c.SMTPRelay != "" || c.Directory != "", nil
+}
+
+// RecordRefresh records the outcome of the refresh of user, which failed with refreshErr if not nil.
+// Nothing is recorded if the reporting is not configured.
+func (m *Manager) RecordRefresh(user string, refreshErr error) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't record refresh of %s", user))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var c config
+	if ok, err := m.load(configFile, &c); err != nil || !ok {
+		return err
+	}
+
+	failures := make(map[string]failure)
+	if _, err := m.load(failuresFile, &failures); err != nil {
+		return err
+	}
+
+	if refreshErr == nil {
+		if _, ok := failures[user]; !ok {
+			return nil
+		}
+		delete(failures, user)
+		return m.saveFailures(failures)
+	}
+
+	now := m.now()
+	f, ok := failures[user]
+	if !ok {
+		f.Since = now
+	}
+	f.Count++
+	f.Last = now
+	f.LastError = refreshErr.Error()
+	failures[user] = f
+
+	return m.saveFailures(failures)
+}
+
+// Report sends the summary of the failing users if at least one user reached the threshold since
+// the last summary.
+func (m *Manager) Report(ctx context.Context, hostname string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't report policy failures"))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var c config
+	if ok, err := m.load(configFile, &c); err != nil || !ok {
+		return err
+	}
+
+	failures := make(map[string]failure)
+	if _, err := m.load(failuresFile, &failures); err != nil {
+		return err
+	}
+
+	var users, newUsers []string
+	for u, f := range failures {
+		if f.Count < c.Threshold {
+			continue
+		}
+		users = append(users, u)
+		if !f.Reported {
+			newUsers = append(newUsers, u)
+		}
+	}
+	if len(newUsers) == 0 {
+		return nil
+	}
+	sort.Strings(users)
+
+	log.Infof(ctx, "Reporting policy failures of %s", strings.Join(newUsers, ", "))
+	summary := formatSummary(hostname, c.Threshold, users, failures)
+
+	var errs []error
+	if c.Directory != "" {
+		errs = append(errs, writeSummary(c.Directory, hostname, summary))
+	}
+	if c.SMTPRelay != "" {
+		errs = append(errs, m.mail(c, hostname, summary))
+	}
+	if err := errors.Join(errs...); err != nil {
+		// Don't mark the users as reported, so that the summary is sent again on the next failure.
+		return err
+	}
+
+	for _, u := range newUsers {
+		f := failures[u]
+		f.Reported = true
+		failures[u] = f
+	}
+	return m.saveFailures(failures)
+}
+
+// formatSummary returns the summary of the users failing on hostname.
+func formatSummary(hostname string, threshold int, users []string, failures map[string]failure) string {
+	var out strings.Builder
+	fmt.Fprintln(&out, gotext.Get("The policies of the following users failed to be applied at least %d consecutive times on %s:", threshold, hostname))
+	for _, u := range users {
+		f := failures[u]
+		fmt.Fprintln(&out)
+		fmt.Fprintf(&out, "%s\n", u)
+		fmt.Fprintln(&out, gotext.Get("  Failed refreshes: %d", f.Count))
+		fmt.Fprintln(&out, gotext.Get("  Failing since: %s", f.Since.UTC().Format(time.RFC3339)))
+		fmt.Fprintln(&out, gotext.Get("  Last failure: %s", f.Last.UTC().Format(time.RFC3339)))
+		fmt.Fprintln(&out, gotext.Get("  Last error: %s", strings.ReplaceAll(f.LastError, "\n", "\n    ")))
+	}
+	return out.String()
+}
+
+// writeSummary writes the summary of hostname to dir.
+func writeSummary(dir, hostname, summary string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write report to %s", dir))
+
+	p := filepath.Join(dir, fmt.Sprintf("adsys-report-%s.txt", hostname))
+	// nolint:gosec // G306 the report is meant to be read by the administrators on the share.
+	if err := os.WriteFile(p+".new", []byte(summary), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// mail sends the summary of hostname to the recipients through the mail relay.
+func (m *Manager) mail(c config, hostname, summary string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't send report to %s", c.SMTPRelay))
+
+	from := c.Sender
+	if from == "" {
+		from = fmt.Sprintf("adsys@%s", hostname)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.Recipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", gotext.Get("[adsys] Policy failures on %s", hostname))
+	fmt.Fprintf(&msg, "Date: %s\r\n", m.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	msg.WriteString(strings.ReplaceAll(summary, "\n", "\r\n"))
+
+	return m.sendMail(c.SMTPRelay, nil, from, c.Recipients, []byte(msg.String()))
+}
+
+// saveFailures saves the failure history, removing the file if no user is failing.
+func (m *Manager) saveFailures(failures map[string]failure) error {
+	if len(failures) == 0 {
+		if err := os.Remove(filepath.Join(m.stateDir, failuresFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return m.save(failuresFile, failures)
+}
+
+// load decodes the state file name into v. It returns false if the file doesn't exist.
+func (m *Manager) load(name string, v any) (bool, error) {
+	d, err := os.ReadFile(filepath.Join(m.stateDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(d, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// save encodes v to the state file name.
+func (m *Manager) save(name string, v any) error {
+	d, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(m.stateDir, name)
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,196 @@
+package report_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/report"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existing      bool
+
+		wantErr bool
+	}{
+		"Mail relay":                     {entries: []entry.Entry{{Key: "report/smtp-relay", Value: "relay.example.com:587"}, {Key: "report/recipients", Value: "admins@example.com\n\nJohn Doe <john@example.com>"}, {Key: "report/sender", Value: "adsys@example.com"}}},
+		"Mail relay defaults to port 25": {entries: []entry.Entry{{Key: "report/smtp-relay", Value: "relay.example.com"}, {Key: "report/recipients", Value: "admins@example.com"}}},
+		"Directory":                      {entries: []entry.Entry{{Key: "report/directory", Value: "/mnt/reports/"}, {Key: "report/threshold", Value: "5"}}},
+		"Recipients without mail relay are ignored":      {entries: []entry.Entry{{Key: "report/directory", Value: "/mnt/reports"}, {Key: "report/recipients", Value: "admins@example.com"}}},
+		"Disabled entries are ignored":                   {entries: []entry.Entry{{Key: "report/directory", Value: "/mnt/reports"}, {Key: "report/threshold", Value: "5", Disabled: true}}},
+		"Unsupported keys are ignored":                   {entries: []entry.Entry{{Key: "report/directory", Value: "/mnt/reports"}, {Key: "report/unsupported", Value: "something"}}},
+		"Threshold alone does not enable the reporting":  {entries: []entry.Entry{{Key: "report/threshold", Value: "5"}}},
+		"No entries removes the configuration and state": {existing: true},
+		"Not a computer is a no-op":                      {entries: []entry.Entry{{Key: "report/directory", Value: "/mnt/reports"}}, existing: true, isNotComputer: true},
+
+		// Error cases
+		"Error on invalid threshold":            {entries: []entry.Entry{{Key: "report/directory", Value: "/mnt/reports"}, {Key: "report/threshold", Value: "three"}}, wantErr: true},
+		"Error on null threshold":               {entries: []entry.Entry{{Key: "report/directory", Value: "/mnt/reports"}, {Key: "report/threshold", Value: "0"}}, wantErr: true},
+		"Error on invalid mail relay port":      {entries: []entry.Entry{{Key: "report/smtp-relay", Value: "relay.example.com:smtp"}, {Key: "report/recipients", Value: "admins@example.com"}}, wantErr: true},
+		"Error on invalid mail relay":           {entries: []entry.Entry{{Key: "report/smtp-relay", Value: "smtp://relay.example.com"}, {Key: "report/recipients", Value: "admins@example.com"}}, wantErr: true},
+		"Error on mail relay without recipient": {entries: []entry.Entry{{Key: "report/smtp-relay", Value: "relay.example.com"}}, wantErr: true},
+		"Error on invalid recipient":            {entries: []entry.Entry{{Key: "report/smtp-relay", Value: "relay.example.com"}, {Key: "report/recipients", Value: "admins"}}, wantErr: true},
+		"Error on invalid sender":               {entries: []entry.Entry{{Key: "report/smtp-relay", Value: "relay.example.com"}, {Key: "report/recipients", Value: "admins@example.com"}, {Key: "report/sender", Value: "adsys@"}}, wantErr: true},
+		"Error on relative directory":           {entries: []entry.Entry{{Key: "report/directory", Value: "reports"}}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			m := report.New(
+				report.WithStateDir(root),
+				report.WithNow(func() time.Time { return time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC) }),
+			)
+			if tc.existing {
+				require.NoError(t, m.ApplyPolicy(context.Background(), "ubuntu", true, []entry.Entry{{Key: "report/directory", Value: "/mnt/previous"}}),
+					"Setup: can't apply initial policy")
+				require.NoError(t, m.RecordRefresh("alice@example.com", errors.New("previous failure")), "Setup: can't record initial failure")
+			}
+
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	t.Parallel()
+
+	mailRelay := []entry.Entry{{Key: "report/smtp-relay", Value: "relay.example.com"}, {Key: "report/recipients", Value: "admins@example.com\nhelpdesk@example.com"}}
+
+	// Each refresh round lists the users whose refresh failed (true) or succeeded (false).
+	tests := map[string]struct {
+		entries         []entry.Entry
+		rounds          []map[string]bool
+		sendMailFails   bool
+		noMailRelay     bool
+		noDirectory     bool
+		notConfigured   bool
+		directoryIsFile bool
+
+		wantErr bool
+	}{
+		"Report users reaching the threshold":                  {rounds: []map[string]bool{{"alice@example.com": true, "bob@example.com": true}, {"alice@example.com": true, "bob@example.com": false}, {"alice@example.com": true}}},
+		"Users below the threshold are not reported":           {rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}}},
+		"Users are reported only once":                         {rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}}},
+		"Summary lists users already reported":                 {rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true, "bob@example.com": true}, {"bob@example.com": true}, {"bob@example.com": true}}},
+		"Successful refresh resets the failures":               {rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": false}, {"alice@example.com": true}, {"alice@example.com": true}}},
+		"Users failing again after success are reported again": {rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": false}, {"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}}},
+		"Custom threshold":                                     {entries: []entry.Entry{{Key: "report/threshold", Value: "1"}}, rounds: []map[string]bool{{"alice@example.com": true}}},
+		"Custom sender":                                        {entries: []entry.Entry{{Key: "report/sender", Value: "Ubuntu clients <clients@example.com>"}}, noDirectory: true, rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}}},
+		"Only mail relay":                                      {noDirectory: true, rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}}},
+		"Only directory":                                       {noMailRelay: true, rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}}},
+		"Nothing is recorded if not configured":                {notConfigured: true, rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}}},
+
+		// Error cases
+		"Error on sending mail keeps users to report": {rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}}, sendMailFails: true, wantErr: true},
+		"Error on writing to directory":               {rounds: []map[string]bool{{"alice@example.com": true}, {"alice@example.com": true}, {"alice@example.com": true}}, directoryIsFile: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			reportsDir := filepath.Join(root, "reports")
+			if tc.directoryIsFile {
+				require.NoError(t, os.WriteFile(reportsDir, nil, 0600), "Setup: can't create reports file")
+			} else {
+				require.NoError(t, os.MkdirAll(reportsDir, 0750), "Setup: can't create reports directory")
+			}
+
+			entries := tc.entries
+			if !tc.noMailRelay {
+				entries = append(entries, mailRelay...)
+			}
+			if !tc.noDirectory {
+				entries = append(entries, entry.Entry{Key: "report/directory", Value: reportsDir})
+			}
+			if tc.notConfigured {
+				entries = nil
+			}
+
+			// Each call to now is one hour after the previous one.
+			var muNow sync.Mutex
+			now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+			var mails int
+			m := report.New(
+				report.WithStateDir(filepath.Join(root, "state")),
+				report.WithNow(func() time.Time {
+					muNow.Lock()
+					defer muNow.Unlock()
+					now = now.Add(time.Hour)
+					return now
+				}),
+				report.WithSendMail(func(addr string, _ smtp.Auth, from string, to []string, msg []byte) error {
+					if tc.sendMailFails {
+						return errors.New("mail relay error")
+					}
+					mails++
+					d := fmt.Sprintf("Relay: %s\nEnvelope from: %s\nEnvelope to: %s\n\n%s", addr, from, strings.Join(to, ", "), msg)
+					return os.WriteFile(filepath.Join(root, fmt.Sprintf("mail-%d.eml", mails)), []byte(d), 0600)
+				}),
+			)
+			require.NoError(t, m.ApplyPolicy(context.Background(), "ubuntu", true, entries), "Setup: can't apply report policy")
+
+			var err error
+			for i, round := range tc.rounds {
+				var users []string
+				for user := range round {
+					users = append(users, user)
+				}
+				sort.Strings(users)
+				for _, user := range users {
+					var refreshErr error
+					if round[user] {
+						refreshErr = fmt.Errorf("failed to apply policy to %q:\nround %d", user, i+1)
+					}
+					require.NoError(t, m.RecordRefresh(user, refreshErr), "RecordRefresh should not fail")
+				}
+				if err = m.Report(context.Background(), "ubuntu"); err != nil {
+					break
+				}
+			}
+			if tc.wantErr {
+				require.Error(t, err, "Report should have failed but didn't")
+			} else {
+				require.NoError(t, err, "Report failed but shouldn't have")
+			}
+
+			// The reports directory path is not stable.
+			for _, p := range []string{filepath.Join(root, "state", "report", "config.json")} {
+				d, err := os.ReadFile(p)
+				if err != nil {
+					continue
+				}
+				require.NoError(t, os.WriteFile(p, []byte(strings.ReplaceAll(string(d), root, "#ROOT#")), 0600), "Setup: can't normalize config")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package scripts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+)
+
+// environmentFile is the file, next to the order files, listing the environment variables set for the scripts.
+const environmentFile = ".environment"
+
+// environment returns the variables describing the context the scripts of objectName are executed in:
+//   - ADSYS_USER: the user the scripts are executed for, only set for user scripts;
+//   - ADSYS_DOMAIN: the Active Directory domain;
+//   - ADSYS_GPO_LIST: the names of the GPOs applied to the object, one per line, from the highest priority;
+//   - KRB5CCNAME: the Kerberos ticket of the machine or of the user, if any.
+func (m *Manager) environment(ctx context.Context, objectName string, isComputer bool, gpos []string) map[string]string {
+	env := map[string]string{
+		"ADSYS_GPO_LIST": strings.Join(gpos, "\n"),
+	}
+	if m.domain != "" {
+		env["ADSYS_DOMAIN"] = m.domain
+	}
+
+	krb5CacheDir := filepath.Join(m.runDir, "krb5cc")
+	if isComputer {
+		// Machine scripts are executed as root, who can read the ticket of the machine.
+		if p := filepath.Join(krb5CacheDir, objectName); fileExists(p) {
+			env["KRB5CCNAME"] = p
+		}
+		return env
+	}
+
+	env["ADSYS_USER"] = objectName
+	// The copy of the ticket of the user is only readable by root: refer to the ticket of the session instead.
+	p, err := os.Readlink(filepath.Join(krb5CacheDir, "tracking", objectName))
+	if err != nil {
+		log.Debugf(ctx, "No Kerberos ticket to pass to the scripts of %s: %v", objectName, err)
+		return env
+	}
+	env["KRB5CCNAME"] = p
+	return env
+}
+
+// saveEnvironment writes the environment variables of the scripts to the scripts directory.
+func saveEnvironment(scriptsPath string, env map[string]string, uid, gid int) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save scripts environment"))
+
+	d, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(scriptsPath, environmentFile)
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(d); err != nil {
+		return err
+	}
+	if err := chown(p, f, uid, gid); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// loadEnvironment returns the environment variables of the scripts of baseDir, of the form KEY=VALUE.
+// Scripts set up before the environment was recorded don't have any.
+func loadEnvironment(baseDir string) (env []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load scripts environment"))
+
+	d, err := os.ReadFile(filepath.Join(baseDir, environmentFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var vars map[string]string
+	if err := json.Unmarshal(d, &vars); err != nil {
+		return nil, err
+	}
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// fileExists returns true if p exists.
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
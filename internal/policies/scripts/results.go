@@ -0,0 +1,129 @@
+package scripts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// resultsSuffix is appended to the order file to get the file where the results of its scripts are saved.
+	resultsSuffix = ".results"
+	// maxResultOutput is the maximum size of the standard output and error recorded for each script.
+	// Only the end of the output is kept, as it usually explains why the script failed.
+	maxResultOutput = 4096
+)
+
+// Result is the outcome of a script executed by RunScripts.
+type Result struct {
+	// Script is the path of the script, relative to the SYSVOL scripts directory.
+	Script string `json:"script"`
+	// ExitCode is the exit code of the script, or -1 if it couldn't be started or was stopped.
+	ExitCode int `json:"exit_code"`
+	// TimedOut is true if the script was stopped after reaching its timeout.
+	TimedOut bool `json:"timed_out,omitempty"`
+	// Error is the reason why the script couldn't be started, if any.
+	Error string `json:"error,omitempty"`
+	// Start is the time at which the script was started.
+	Start time.Time `json:"start"`
+	// Duration is the running time of the script.
+	Duration time.Duration `json:"duration"`
+	// Stdout is the end of the standard output of the script.
+	Stdout string `json:"stdout,omitempty"`
+	// Stderr is the end of the standard error of the script.
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// Succeeded returns true if the script exited successfully.
+func (r Result) Succeeded() bool {
+	return r.ExitCode == 0 && !r.TimedOut && r.Error == ""
+}
+
+// Results returns the results of the scripts executed for objectName during the current session or boot,
+// indexed by the name of the step they were executed at, like logon or startup.
+// The results are empty if no script was executed yet.
+func (m *Manager) Results(ctx context.Context, objectName string, isComputer bool) (results map[string][]Result, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read scripts results of %s", objectName))
+
+	objectDir := "machine"
+	if !isComputer {
+		u, err := m.userLookup(objectName)
+		if err != nil {
+			return nil, errors.New(gotext.Get("couldn't retrieve user for %q: %v", objectName, err))
+		}
+		objectDir = filepath.Join("users", u.Uid)
+	}
+
+	results = make(map[string][]Result)
+	scriptsPath := filepath.Join(m.runDir, objectDir, executableDir)
+	paths, err := filepath.Glob(filepath.Join(scriptsPath, "*"+resultsSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		d, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var r []Result
+		if err := json.Unmarshal(d, &r); err != nil {
+			log.Warningf(ctx, "Ignoring invalid scripts results %q: %v", p, err)
+			continue
+		}
+		results[strings.TrimSuffix(filepath.Base(p), resultsSuffix)] = r
+	}
+
+	return results, nil
+}
+
+// saveResults saves the results of the scripts listed in the order file.
+// The file is replaced atomically, so that it is never read partially written.
+func saveResults(order string, results []Result) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save scripts results of %s", order))
+
+	d, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	p := order + resultsSuffix
+	tmp := fmt.Sprintf("%s.%d.new", p, os.Getpid())
+	defer os.Remove(tmp)
+	if err := os.WriteFile(tmp, d, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// tailWriter is a writer keeping only the last max bytes written to it.
+type tailWriter struct {
+	max int
+	buf []byte
+}
+
+// Write appends p to the content of the writer, dropping its beginning if it exceeds max bytes.
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if over := len(w.buf) - w.max; over > 0 {
+		w.buf = append(w.buf[:0], w.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// String returns the content of the writer.
+func (w *tailWriter) String() string {
+	return string(w.buf)
+}
@@ -11,19 +11,54 @@
 // authentication will be prevented. ADSys ensures that the scripts will be executed at the correct
 // time and in the correct order, but it does not account for the correctness of the scripts.
 // If a script returns an error, it will be logged, but authentication will not be prevented.
+// The exit code, duration and end of the output of each script are recorded next to its order file, so that
+// they can be reported with the applied policies.
+//
+// Each script can declare an order index and a timeout, as <script>; order=<index>; timeout=<duration>.
+// Scripts are executed by ascending order index, those without any having the index 0, and keep their listed
+// order for the same index. A script which doesn't finish within its timeout is stopped, so that a hung logon
+// script doesn't delay the session indefinitely, and the next scripts are executed.
+// A script can also be flagged as asynchronous, as <script>; async, to be started in the background: the next
+// scripts are executed right away, and the session startup doesn't wait for it. Its completion is logged.
+//
+// Scripts can be required to be trusted before being executed, with the scripts/require-signed key for machines and
+// scripts/user-require-signed for users. A trusted script is either:
+//   - listed with its SHA256 digest in the SHA256SUMS file of the SYSVOL scripts directory, in the format of sha256sum;
+//   - signed with a detached signature, <script>.sig, made with ssh-keygen -Y sign -n file by one of the signers
+//     listed in the scripts/allowed-signers (or scripts/user-allowed-signers) key, in the format of the ssh-keygen
+//     allowed signers file.
+//
+// Unsigned and altered scripts are then refused and not executed. A script can also be pinned to its digest, as
+// <script>; sha256=<digest>. The digest of each verified script is recorded in the order file and checked again right
+// before executing it.
+//
+// Scripts are executed with environment variables describing their context, so that they can be written
+// generically across organizational units: ADSYS_USER for user scripts, ADSYS_DOMAIN, ADSYS_GPO_LIST with the
+// names of the GPOs applied to the object, one per line, and KRB5CCNAME with the Kerberos ticket of the machine
+// or of the user. They are recorded next to the order files when the policy is applied.
+//
+// The user units running the scripts are watched on each refresh: a unit which failed or is still activating
+// after a while, for instance because a logon script never returned in a previous session, is stopped and its
+// failed state is reset, so that the scripts of the user can be updated again. This prevents stuck units from
+// piling up on long-lived machines, like terminal servers.
 package scripts
 
 import (
 	"bufio"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/leonelquinteros/gotext"
 	"github.com/ubuntu/adsys/internal/consts"
@@ -41,9 +76,17 @@ const (
 // Manager prevents running multiple scripts update process in parallel while parsing policy in ApplyPolicy.
 type Manager struct {
 	runDir      string
+	domain      string
 	unitStarter unitStarter
 
 	userLookup func(string) (*user.User, error)
+
+	systemctlCmd     []string
+	sshKeygenCmd     []string
+	stuckUnitTimeout time.Duration
+
+	unitsStatsMu sync.Mutex
+	unitsStats   UnitsStats
 }
 
 type unitStarter interface {
@@ -51,19 +94,54 @@ type unitStarter interface {
 }
 
 type options struct {
-	userLookup func(string) (*user.User, error)
+	domain           string
+	userLookup       func(string) (*user.User, error)
+	systemctlCmd     []string
+	sshKeygenCmd     []string
+	stuckUnitTimeout time.Duration
 }
 
 // Option reprents an optional function to change scripts manager.
 type Option func(*options)
 
+// WithDomain specifies the Active Directory domain passed to the scripts.
+func WithDomain(domain string) Option {
+	return func(o *options) {
+		o.domain = domain
+	}
+}
+
+// WithSystemctlCmd overrides the default systemctl command, used to watch the user script units.
+func WithSystemctlCmd(cmd []string) Option {
+	return func(o *options) {
+		o.systemctlCmd = cmd
+	}
+}
+
+// WithSSHKeygenCmd overrides the default ssh-keygen command, used to verify the signatures of the scripts.
+func WithSSHKeygenCmd(cmd []string) Option {
+	return func(o *options) {
+		o.sshKeygenCmd = cmd
+	}
+}
+
+// WithStuckUnitTimeout overrides the time after which a user script unit still activating is considered stuck.
+func WithStuckUnitTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.stuckUnitTimeout = timeout
+	}
+}
+
 // New creates a manager with a specific scripts directory.
 func New(runDir string, unitStarter unitStarter, opts ...Option) (m *Manager, err error) {
 	defer decorate.OnError(&err, gotext.Get("can't create scripts manager"))
 
 	// defaults
 	args := options{
-		userLookup: user.Lookup,
+		userLookup:       user.Lookup,
+		systemctlCmd:     []string{"systemctl"},
+		sshKeygenCmd:     []string{"ssh-keygen"},
+		stuckUnitTimeout: consts.DefaultStuckUserUnitTimeout,
 	}
 	// applied options
 	for _, o := range opts {
@@ -81,9 +159,14 @@ func New(runDir string, unitStarter unitStarter, opts ...Option) (m *Manager, er
 
 	return &Manager{
 		runDir:      runDir,
+		domain:      args.domain,
 		unitStarter: unitStarter,
 
 		userLookup: args.userLookup,
+
+		systemctlCmd:     args.systemctlCmd,
+		sshKeygenCmd:     args.sshKeygenCmd,
+		stuckUnitTimeout: args.stuckUnitTimeout,
 	}, nil
 }
 
@@ -91,14 +174,18 @@ func New(runDir string, unitStarter unitStarter, opts ...Option) (m *Manager, er
 type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
 
 // ApplyPolicy generates a privilege policy based on a list of entries.
-func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+// gpos are the names of the GPOs applied to the object, passed to the scripts.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, gpos []string, assetsDumper AssetsDumper) (err error) {
 	defer decorate.OnError(&err, gotext.Get("can't apply scripts policy to %s", objectName))
 
 	log.Debugf(ctx, "Applying scripts policy to %s", objectName)
 
 	objectDir := "machine"
 	uid, gid := -1, -1
-	if !isComputer {
+	if isComputer {
+		// Users may not log in again: clean up the units left behind by all of them.
+		m.watchUsersUnits(ctx)
+	} else {
 		user, err := m.userLookup(objectName)
 		if err != nil {
 			return errors.New(gotext.Get("couldn't retrieve user for %q: %v", objectName, err))
@@ -111,6 +198,7 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		}
 
 		objectDir = filepath.Join("users", user.Uid)
+		m.watchUserUnit(ctx, user.Uid)
 	}
 
 	objectPath := filepath.Join(m.runDir, objectDir)
@@ -129,7 +217,45 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		return err
 	}
 
-	if len(entries) == 0 {
+	prefix := "scripts/"
+	if !isComputer {
+		prefix = "scripts/user-"
+	}
+	var requireSigned bool
+	var allowedSigners []string
+	var scriptEntries []entry.Entry
+	for _, e := range entries {
+		switch e.Key {
+		case prefix + "require-signed":
+			if e.Disabled {
+				continue
+			}
+			switch strings.TrimSpace(e.Value) {
+			case "true":
+				requireSigned = true
+			case "false":
+			default:
+				return errors.New(gotext.Get("invalid value %q for %s: true or false is expected", e.Value, e.Key))
+			}
+		case prefix + "allowed-signers":
+			if e.Disabled {
+				continue
+			}
+			for _, l := range strings.Split(e.Value, "\n") {
+				if l = strings.TrimSpace(l); l != "" {
+					allowedSigners = append(allowedSigners, l)
+				}
+			}
+		default:
+			if strings.HasPrefix(e.Key, "scripts/") {
+				log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing scripts entries, skipping it", e.Key))
+				continue
+			}
+			scriptEntries = append(scriptEntries, e)
+		}
+	}
+
+	if len(scriptEntries) == 0 {
 		return nil
 	}
 
@@ -148,16 +274,27 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		return err
 	}
 
+	v, cleanup, err := newVerifier(ctx, dest, allowedSigners, m.sshKeygenCmd)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
 	// create order files, check that the scripts existings in the destination
 	log.Debugf(ctx, "Creating script order file for user %q", objectName)
-	orderFilesContent := make(map[string][]string)
-	for _, e := range entries {
+	orderFilesContent := make(map[string][]scriptLine)
+	for _, e := range scriptEntries {
 		lifecycle := filepath.Base(e.Key)
-		for _, script := range strings.Split(e.Value, "\n") {
-			script = strings.TrimSpace(script)
-			if script == "" {
+		for _, l := range strings.Split(e.Value, "\n") {
+			l = strings.TrimSpace(l)
+			if l == "" {
 				continue
 			}
+			sl, err := parseScriptLine(l)
+			if err != nil {
+				return err
+			}
+			script := sl.path
 
 			// check that the script exists and make it executable
 			scriptFilePath := filepath.Join(scriptsPath, executableDir, script)
@@ -174,14 +311,28 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 				return errors.New(gotext.Get("can't change mode of script %qto %o: %v", scriptFilePath, 0550, err))
 			}
 
+			// Refuse unsigned or altered scripts, without preventing the other ones to be executed.
+			if requireSigned || sl.digest != "" {
+				digest, err := v.verify(ctx, script, sl.digest)
+				if err != nil {
+					log.Warning(ctx, gotext.Get("Refusing to run script: %v", err))
+					continue
+				}
+				sl.digest = digest
+			}
+
 			// append it to the list of our scripts
-			orderFilesContent[lifecycle] = append(orderFilesContent[lifecycle], filepath.Join(executableDir, script))
+			sl.path = filepath.Join(executableDir, script)
+			orderFilesContent[lifecycle] = append(orderFilesContent[lifecycle], sl)
 		}
 	}
 
 	for lifecycle, scripts := range orderFilesContent {
 		orderFilePath := filepath.Join(scriptsPath, lifecycle)
 
+		// Scripts without an explicit order index keep their listed order, as the ones with the same index.
+		slices.SortStableFunc(scripts, func(a, b scriptLine) int { return cmp.Compare(a.order, b.order) })
+
 		log.Debugf(ctx, "Creating order file %q", orderFilePath)
 		f, err := os.Create(orderFilePath)
 		if err != nil {
@@ -190,7 +341,17 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		defer f.Close()
 
 		for _, script := range scripts {
-			if _, err := f.WriteString(script + "\n"); err != nil {
+			line := script.path
+			if script.timeout > 0 {
+				line = fmt.Sprintf("%s; timeout=%s", line, script.timeout)
+			}
+			if script.async {
+				line += "; async"
+			}
+			if script.digest != "" {
+				line = fmt.Sprintf("%s; sha256=%s", line, script.digest)
+			}
+			if _, err := f.WriteString(line + "\n"); err != nil {
 				return err
 			}
 		}
@@ -203,6 +364,10 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 		}
 	}
 
+	if err := saveEnvironment(scriptsPath, m.environment(ctx, objectName, isComputer, gpos), uid, gid); err != nil {
+		return err
+	}
+
 	// Create ready flag
 	if err := createFlagFile(ctx, filepath.Join(scriptsPath, readyFlag), uid, gid); err != nil {
 		return err
@@ -222,8 +387,10 @@ func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer
 }
 
 // RunScripts executes all scripts in directory if ready and not already executed.
+// Asynchronous scripts are started in the background, without waiting for them to complete before the next ones.
+// notifyReady, if not nil, is called once all other scripts completed, before waiting for the asynchronous ones.
 // allowOrderMissing will not require order to exists if we are ready to execute.
-func RunScripts(ctx context.Context, order string, allowOrderMissing bool) (err error) {
+func RunScripts(ctx context.Context, order string, allowOrderMissing bool, notifyReady func()) (err error) {
 	defer decorate.OnError(&err, gotext.Get("can't run scripts listed in %s", order))
 
 	log.Infof(ctx, "Calling RunScripts on %q", order)
@@ -262,6 +429,9 @@ func RunScripts(ctx context.Context, order string, allowOrderMissing bool) (err
 	f, err := os.Open(order)
 	if allowOrderMissing && errors.Is(err, os.ErrNotExist) {
 		log.Infof(ctx, "%q doesn't exist, but allowed to be missing, skipping", order)
+		if notifyReady != nil {
+			notifyReady()
+		}
 		return nil
 	} else if err != nil {
 		return err
@@ -275,28 +445,166 @@ func RunScripts(ctx context.Context, order string, allowOrderMissing bool) (err
 		return errors.New(gotext.Get("%q is a directory and not a file", order))
 	}
 
+	var scripts []scriptLine
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		scriptPath := strings.TrimSpace(scanner.Text())
-		if scriptPath == "" {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" {
 			continue
 		}
-		script := filepath.Join(baseDir, scriptPath)
-		log.Debugf(ctx, "Running script %q", script)
-		// #nosec G204 - this variable is coming from concatenation of an order file.
-		// Permissions are restricted to the owner of the order file, which is the one executing
-		// this script.
-		cmd := exec.CommandContext(ctx, script)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			log.Warningf(ctx, "%q failed to run\n%v", script, err)
+		sl, err := parseScriptLine(l)
+		if err != nil {
+			log.Warningf(ctx, "Skipping invalid line in %q: %v", order, err)
+			continue
 		}
+		scripts = append(scripts, sl)
+	}
+
+	env, err := loadEnvironment(baseDir)
+	if err != nil {
+		return err
+	}
+
+	// Results are kept in the listed order, whenever asynchronous scripts complete.
+	results := make([]Result, len(scripts))
+	var wg sync.WaitGroup
+	for i, sl := range scripts {
+		if !sl.async {
+			results[i] = runScript(ctx, baseDir, sl, env)
+			continue
+		}
+		log.Infof(ctx, "Starting %q in the background", filepath.Join(baseDir, sl.path))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runScript(ctx, baseDir, sl, env)
+		}()
+	}
+	if notifyReady != nil {
+		notifyReady()
+	}
+	wg.Wait()
+
+	// The scripts already ran: failing to record their results doesn't fail the run.
+	if err := saveResults(order, results); err != nil {
+		log.Warning(ctx, err)
 	}
 
 	return nil
 }
 
+// runScript runs the script sl relative to baseDir, with the additional environment variables env, stopping it once
+// its timeout is reached, if any.
+// Failures are only logged and recorded in the returned result, so that the next scripts are still executed.
+func runScript(ctx context.Context, baseDir string, sl scriptLine, env []string) Result {
+	script := filepath.Join(baseDir, sl.path)
+	log.Debugf(ctx, "Running script %q", script)
+	if sl.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sl.timeout)
+		defer cancel()
+	}
+
+	r := Result{
+		Script: strings.TrimPrefix(sl.path, executableDir+"/"),
+		Start:  time.Now(),
+	}
+
+	// The script was verified when the policy was applied: it must not have changed since then.
+	if sl.digest != "" {
+		digest, err := fileDigest(script)
+		if err == nil && !strings.EqualFold(digest, sl.digest) {
+			err = errors.New(gotext.Get("script was altered since it was verified"))
+		}
+		if err != nil {
+			r.ExitCode = -1
+			r.Error = err.Error()
+			log.Warningf(ctx, "Refusing to run %q: %v", script, err)
+			return r
+		}
+	}
+	stdout, stderr := &tailWriter{max: maxResultOutput}, &tailWriter{max: maxResultOutput}
+
+	// #nosec G204 - this variable is coming from concatenation of an order file.
+	// Permissions are restricted to the owner of the order file, which is the one executing
+	// this script.
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = io.MultiWriter(os.Stdout, stdout)
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	err := cmd.Run()
+	r.Duration = time.Since(r.Start)
+	r.ExitCode = cmd.ProcessState.ExitCode()
+	r.Stdout, r.Stderr = stdout.String(), stderr.String()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		r.TimedOut = true
+		log.Warningf(ctx, "%q did not finish within %s and was stopped", script, sl.timeout)
+		return r
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		r.Error = err.Error()
+	}
+	if err != nil {
+		log.Warningf(ctx, "%q failed to run with exit code %d after %s\n%v", script, r.ExitCode, r.Duration.Round(time.Millisecond), err)
+		return r
+	}
+	log.Infof(ctx, "%q exited successfully after %s", script, r.Duration.Round(time.Millisecond))
+	return r
+}
+
+// scriptLine is a script listed in a policy entry or in an order file.
+type scriptLine struct {
+	path    string
+	order   int
+	timeout time.Duration
+	async   bool
+	digest  string
+}
+
+// parseScriptLine parses a script, optionally followed by its order index, its timeout, whether it runs
+// in the background and its pinned digest, of the form:
+// <script>[; order=<index>][; timeout=<duration>][; async][; sha256=<digest>].
+func parseScriptLine(l string) (sl scriptLine, err error) {
+	fields := strings.Split(l, ";")
+	sl.path = strings.TrimSpace(fields[0])
+	if sl.path == "" {
+		return sl, errors.New(gotext.Get("invalid script %q: missing script path", l))
+	}
+	for _, field := range fields[1:] {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if k == "async" && !found {
+			sl.async = true
+			continue
+		}
+		if !found || v == "" {
+			return sl, errors.New(gotext.Get("invalid script %q: expected key=value, got %q", l, strings.TrimSpace(field)))
+		}
+		switch k {
+		case "order":
+			if sl.order, err = strconv.Atoi(v); err != nil {
+				return sl, errors.New(gotext.Get("invalid script %q: order %q is not an integer", l, v))
+			}
+		case "timeout":
+			if sl.timeout, err = time.ParseDuration(v); err != nil || sl.timeout <= 0 {
+				return sl, errors.New(gotext.Get("invalid script %q: timeout %q is not a positive duration", l, v))
+			}
+		case "async":
+			return sl, errors.New(gotext.Get("invalid script %q: async doesn't take any value", l))
+		case "sha256":
+			if !digestRe.MatchString(v) {
+				return sl, errors.New(gotext.Get("invalid script %q: %q is not a SHA256 digest", l, v))
+			}
+			sl.digest = strings.ToLower(v)
+		default:
+			return sl, errors.New(gotext.Get("invalid script %q: unknown option %q", l, k))
+		}
+	}
+	return sl, nil
+}
+
 func mkdirAllWithUIDGid(p string, uid, gid int) error {
 	if err := os.MkdirAll(p, 0750); err != nil {
 		return fmt.Errorf(gotext.Get("can't create scripts directory %q: %v", p, err))
@@ -2,12 +2,16 @@ package scripts_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/termie/go-shutil"
@@ -59,12 +63,19 @@ func TestApplyPolicy(t *testing.T) {
 	require.NoError(t, err, "Setup: failed to get current user")
 
 	defaultSingleScript := []entry.Entry{{Key: "s", Value: "script1.sh"}}
+	requireSigned := []entry.Entry{
+		{Key: "scripts/user-require-signed", Value: "true"},
+		{Key: "scripts/user-allowed-signers", Value: "admin@example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKqvKddQnx771peuzZrF3zEjwYUcFEZKw5RFEmjvBgP5\n\n"},
+	}
+	script1Digest := "72741b52432b9cc1e6b32be5d9f1d268ce24766b93bb4792136e9d6debec0ff8"
 
 	tests := map[string]struct {
 		entries  []entry.Entry
 		computer bool
 
 		saveAssetsError     bool
+		signedAssets        bool
+		userKrb5Ticket      string
 		userReturnedUID     string
 		userReturnedGID     string
 		systemctlShouldFail bool
@@ -84,6 +95,24 @@ func TestApplyPolicy(t *testing.T) {
 		"Subfolder with same script name":    {entries: []entry.Entry{{Key: "s", Value: "script1.sh\nsubfolder/script1.sh"}}},
 		"No entries is an empty folder":      {},
 		"Empty entries are discared":         {entries: []entry.Entry{{Key: "s", Value: "script3.sh\n\nscript1.sh"}}},
+		"Scripts are sorted by order index":  {entries: []entry.Entry{{Key: "s", Value: "script3.sh; order=2\nscript1.sh\nscript2.sh; order=-1\nscript93.sh; order=2"}}},
+		"Scripts with timeout":               {entries: []entry.Entry{{Key: "s", Value: "script3.sh; timeout=90s\nscript1.sh ; order=1 ; timeout=5m"}}},
+		"Asynchronous scripts":               {entries: []entry.Entry{{Key: "s", Value: "script3.sh; async\nscript1.sh\nscript2.sh; async; timeout=1h; order=-1"}}},
+
+		"Scripts environment refers to the Kerberos ticket of the user": {entries: defaultSingleScript, userKrb5Ticket: "/tmp/krb5cc_4242_session"},
+
+		// Signed scripts
+		"Signed and listed scripts are run when signatures are required": {signedAssets: true, entries: append([]entry.Entry{{Key: "s", Value: "script1.sh\nscript91.sh\nsubfolder/script1.sh"}}, requireSigned...)},
+		"Unsigned and altered scripts are refused":                       {signedAssets: true, entries: append([]entry.Entry{{Key: "s", Value: "script1.sh\nscript2.sh\nscript3.sh\nscript92.sh\nscript93.sh"}}, requireSigned...)},
+		"Signatures are not trusted without allowed signers":             {signedAssets: true, entries: []entry.Entry{{Key: "s", Value: "script1.sh\nscript91.sh"}, {Key: "scripts/user-require-signed", Value: "true"}}},
+		"Scripts are refused without any trust anchor":                   {entries: append([]entry.Entry{{Key: "s", Value: "script1.sh"}}, requireSigned...)},
+		"Scripts are not verified when signatures are not required":      {signedAssets: true, entries: []entry.Entry{{Key: "s", Value: "script2.sh\nscript3.sh"}, {Key: "scripts/user-require-signed", Value: "false"}}},
+		"Disabled signatures requirement is ignored":                     {signedAssets: true, entries: []entry.Entry{{Key: "s", Value: "script2.sh"}, {Key: "scripts/user-require-signed", Value: "true", Disabled: true}}},
+		"Pinned scripts are verified":                                    {entries: []entry.Entry{{Key: "s", Value: "script1.sh; sha256=" + strings.ToUpper(script1Digest) + "\nscript2.sh; sha256=" + script1Digest}}},
+		"Pinned scripts are trusted when signatures are required":        {entries: append([]entry.Entry{{Key: "s", Value: "script1.sh; sha256=" + script1Digest + "\nscript2.sh"}}, requireSigned...)},
+		"Machine signature keys are ignored for users":                   {signedAssets: true, entries: []entry.Entry{{Key: "s", Value: "script2.sh"}, {Key: "scripts/require-signed", Value: "true"}}},
+		"Computer requires signatures with machine keys":                 {computer: true, signedAssets: true, entries: []entry.Entry{{Key: "shutdown", Value: "script1.sh\nscript2.sh\nscript91.sh"}, {Key: "scripts/require-signed", Value: "true"}, {Key: "scripts/allowed-signers", Value: requireSigned[1].Value}}},
+		"Only signature keys is an empty folder":                         {signedAssets: true, entries: requireSigned},
 
 		// Computer cases -> no setuid/setgid (should be -1)
 		"Computer, no systemctl with other directory than startup":       {computer: true, systemctlShouldFail: true, entries: defaultSingleScript},
@@ -100,10 +129,19 @@ func TestApplyPolicy(t *testing.T) {
 		"Systemctl failing does not impact user scripts update": {computer: false, systemctlShouldFail: true, entries: []entry.Entry{{Key: "startup", Value: "script1.sh"}}, wantErr: false},
 
 		// Error cases
-		"Error on subfolder listed":              {entries: []entry.Entry{{Key: "s", Value: "subfolder"}}, wantErr: true},
-		"Error on script does not exist":         {entries: []entry.Entry{{Key: "s", Value: "doestnotexists"}}, wantErr: true},
-		"Error on users run directory Read Only": {makeReadOnly: true, entries: defaultSingleScript, wantErr: true},
-		"Error on save assets dumping failing":   {entries: defaultSingleScript, saveAssetsError: true, wantErr: true},
+		"Error on subfolder listed":               {entries: []entry.Entry{{Key: "s", Value: "subfolder"}}, wantErr: true},
+		"Error on script does not exist":          {entries: []entry.Entry{{Key: "s", Value: "doestnotexists"}}, wantErr: true},
+		"Error on invalid order index":            {entries: []entry.Entry{{Key: "s", Value: "script1.sh; order=first"}}, wantErr: true},
+		"Error on invalid timeout":                {entries: []entry.Entry{{Key: "s", Value: "script1.sh; timeout=5"}}, wantErr: true},
+		"Error on negative timeout":               {entries: []entry.Entry{{Key: "s", Value: "script1.sh; timeout=-5m"}}, wantErr: true},
+		"Error on unknown script option":          {entries: []entry.Entry{{Key: "s", Value: "script1.sh; user=root"}}, wantErr: true},
+		"Error on script option without value":    {entries: []entry.Entry{{Key: "s", Value: "script1.sh; order"}}, wantErr: true},
+		"Error on options without script":         {entries: []entry.Entry{{Key: "s", Value: "; order=1"}}, wantErr: true},
+		"Error on async with a value":             {entries: []entry.Entry{{Key: "s", Value: "script1.sh; async=true"}}, wantErr: true},
+		"Error on users run directory Read Only":  {makeReadOnly: true, entries: defaultSingleScript, wantErr: true},
+		"Error on save assets dumping failing":    {entries: defaultSingleScript, saveAssetsError: true, wantErr: true},
+		"Error on invalid signatures requirement": {entries: append(defaultSingleScript, entry.Entry{Key: "scripts/user-require-signed", Value: "yes"}), wantErr: true},
+		"Error on invalid pinned digest":          {entries: []entry.Entry{{Key: "s", Value: "script1.sh; sha256=1234"}}, wantErr: true},
 
 		// User error cases only
 		"Error on invalid UID":         {userReturnedUID: "invalid", entries: defaultSingleScript, wantErr: true},
@@ -144,10 +182,17 @@ func TestApplyPolicy(t *testing.T) {
 					"Setup: can't create initial run dir scripts content")
 			}
 
+			if tc.userKrb5Ticket != "" {
+				require.NoError(t, os.MkdirAll(filepath.Join(runDir, "krb5cc", "tracking"), 0700), "Setup: can't create Kerberos tickets directory")
+				require.NoError(t, os.Symlink(tc.userKrb5Ticket, filepath.Join(runDir, "krb5cc", "tracking", "ubuntu")), "Setup: can't create Kerberos ticket symlink")
+			}
+
 			mockAssetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.saveAssetsError, Path: "scripts/"}
 
 			m, err := scripts.New(runDir, &mockUnitStarter{StartFailed: tc.systemctlShouldFail},
+				scripts.WithDomain("example.com"),
 				scripts.WithUserLookup(userLookup),
+				scripts.WithSystemctlCmd(mockSystemctl("active")),
 			)
 			require.NoError(t, err, "Setup: can't create scripts manager")
 
@@ -155,7 +200,18 @@ func TestApplyPolicy(t *testing.T) {
 				testutils.MakeReadOnly(t, filepath.Join(runDir, "users"))
 			}
 
-			err = m.ApplyPolicy(context.Background(), "ubuntu", tc.computer, tc.entries, mockAssetsDumper.SaveAssetsTo)
+			assetsDumper := mockAssetsDumper.SaveAssetsTo
+			if tc.signedAssets {
+				assetsDumper = func(ctx context.Context, relSrc, dest string, uid, gid int) error {
+					if err := mockAssetsDumper.SaveAssetsTo(ctx, relSrc, dest, uid, gid); err != nil {
+						return err
+					}
+					overlayDir(t, filepath.Join(testutils.TestFamilyPath(t), "signed_assets"), dest)
+					return nil
+				}
+			}
+
+			err = m.ApplyPolicy(context.Background(), "ubuntu", tc.computer, tc.entries, []string{"GPO1", "GPO2"}, assetsDumper)
 			if tc.wantErr {
 				require.NotNil(t, err, "ApplyPolicy should have failed but didn't")
 				return
@@ -163,12 +219,149 @@ func TestApplyPolicy(t *testing.T) {
 			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
 
 			makeIndependentOfCurrentUID(t, runDir, u.Uid)
+			// The Kerberos tickets are not managed by the scripts manager.
+			require.NoError(t, os.RemoveAll(filepath.Join(runDir, "krb5cc")), "Teardown: can't remove Kerberos tickets directory")
 
 			testutils.CompareTreesWithFiltering(t, runDir, testutils.GoldenPath(t), testutils.UpdateEnabled())
 		})
 	}
 }
 
+// overlayDir copies the files of src into dest, replacing the existing ones.
+func overlayDir(t *testing.T, src, dest string) {
+	t.Helper()
+
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		d2, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dest, rel), d2, 0600)
+	})
+	require.NoError(t, err, "Setup: can't overlay signed assets")
+}
+
+func TestApplyPolicyWatchesUserUnits(t *testing.T) {
+	t.Parallel()
+
+	u, err := user.Current()
+	require.NoError(t, err, "Setup: failed to get current user")
+
+	tests := map[string]struct {
+		unitState string
+		computer  bool
+
+		wantStats       scripts.UnitsStats
+		wantSessionFlag bool
+	}{
+		"Stuck unit is stopped":                    {unitState: "stuck", wantStats: scripts.UnitsStats{Stuck: 1}},
+		"Failed unit is reset":                     {unitState: "failed", wantStats: scripts.UnitsStats{Failed: 1}},
+		"Stuck unit is stopped on machine refresh": {unitState: "stuck", computer: true, wantStats: scripts.UnitsStats{Stuck: 1}},
+		"Failed unit is reset on machine refresh":  {unitState: "failed", computer: true, wantStats: scripts.UnitsStats{Failed: 1}},
+
+		"Active unit is kept":                                  {unitState: "active", wantSessionFlag: true},
+		"Recently activating unit is kept":                     {unitState: "activating", wantSessionFlag: true},
+		"Activating unit without state change time is kept":    {unitState: "activating-no-timestamp", wantSessionFlag: true},
+		"Unit of user without user manager is kept":            {unitState: "fail-show", wantSessionFlag: true},
+		"Unit failing to stop is kept":                         {unitState: "fail-stop", wantSessionFlag: true},
+		"Unit with invalid state change time is kept":          {unitState: "invalid-timestamp", wantSessionFlag: true},
+		"Active unit is kept on machine refresh":               {unitState: "active", computer: true, wantSessionFlag: true},
+		"Unit of user without user manager is kept on machine": {unitState: "fail-show", computer: true, wantSessionFlag: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			runDir := t.TempDir()
+			scriptsDir := filepath.Join(runDir, "users", u.Uid, "scripts")
+			require.NoError(t, os.MkdirAll(scriptsDir, 0750), "Setup: can't create user scripts directory")
+			require.NoError(t, os.WriteFile(filepath.Join(scriptsDir, scripts.InSessionFlag), nil, 0600), "Setup: can't create session flag")
+
+			m, err := scripts.New(runDir, &mockUnitStarter{},
+				scripts.WithUserLookup(func(string) (*user.User, error) {
+					return &user.User{Uid: u.Uid, Gid: u.Gid}, nil
+				}),
+				scripts.WithSystemctlCmd(mockSystemctl(tc.unitState)),
+				scripts.WithStuckUnitTimeout(time.Minute),
+			)
+			require.NoError(t, err, "Setup: can't create scripts manager")
+
+			err = m.ApplyPolicy(context.Background(), "ubuntu", tc.computer, nil, nil, nil)
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			require.Equal(t, tc.wantStats, m.UnitsStats(), "UnitsStats should return the units cleaned up")
+			if tc.wantSessionFlag {
+				require.FileExists(t, filepath.Join(scriptsDir, scripts.InSessionFlag), "Session flag should have been kept")
+				return
+			}
+			require.NoFileExists(t, filepath.Join(scriptsDir, scripts.InSessionFlag), "Session flag should have been removed")
+		})
+	}
+}
+
+// mockSystemctl returns a systemctl command mocking the state of the user scripts unit.
+func mockSystemctl(unitState string) []string {
+	return []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockSystemctl", "--", unitState}
+}
+
+func TestMockSystemctl(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		args = args[1:]
+	}
+	unitState, args := args[0], args[1:]
+
+	if !strings.HasPrefix(args[1], "--machine=") || !strings.HasSuffix(args[1], "@.host") || args[0] != "--user" {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %v", args)
+		os.Exit(2)
+	}
+
+	switch args[2] {
+	case "show":
+		timestamp := fmt.Sprintf("@%d", time.Now().Add(-time.Hour).Unix())
+		switch unitState {
+		case "fail-show":
+			fmt.Fprintln(os.Stderr, "Failed to connect to bus: No medium found")
+			os.Exit(1)
+		case "stuck", "fail-stop":
+			unitState = "activating"
+		case "activating":
+			timestamp = fmt.Sprintf("@%d", time.Now().Unix())
+		case "activating-no-timestamp":
+			unitState, timestamp = "activating", ""
+		case "invalid-timestamp":
+			unitState, timestamp = "activating", "yesterday"
+		}
+		fmt.Printf("ActiveState=%s\nStateChangeTimestamp=%s\n", unitState, timestamp)
+	case "stop":
+		if unitState == "fail-stop" {
+			fmt.Fprintln(os.Stderr, "Job for adsys-user-scripts.service canceled.")
+			os.Exit(1)
+		}
+	case "reset-failed":
+	default:
+		fmt.Fprintf(os.Stderr, "Unexpected command: %v", args)
+		os.Exit(2)
+	}
+}
+
 // makeIndependentOfCurrentUID renames any file or directory which exactly match uid in path and replace it with 4242.
 func makeIndependentOfCurrentUID(t *testing.T, path string, uid string) {
 	t.Helper()
@@ -202,6 +395,8 @@ func TestRunScripts(t *testing.T) {
 		allowOrderMissing bool
 		scriptObjectName  string
 
+		// wantOnReady is the content of the golden file once the unit is notified as ready, if checked.
+		wantOnReady                string
 		wantSessionFlagFileRemoved bool
 		wantErr                    bool
 	}{
@@ -223,13 +418,20 @@ func TestRunScripts(t *testing.T) {
 		"script directory without shutdown order has no session running flag after machine shutdown": {stageDir: "shutdown", scriptObjectName: "machine", wantSessionFlagFileRemoved: true, allowOrderMissing: true},
 		"keeps running flag after non machine shutdown":                                              {stageDir: "shutdown", scriptObjectName: "users", wantSessionFlagFileRemoved: false},
 
-		"allow order file missing":           {allowOrderMissing: true},
-		"spaces and empty lines are skipped": {},
+		"allow order file missing":                    {allowOrderMissing: true},
+		"spaces and empty lines are skipped":          {},
+		"scripts exceeding their timeout are stopped": {},
+		"invalid lines are skipped":                   {},
+		"exit codes and outputs are recorded":         {},
+		"asynchronous scripts do not block readiness": {wantOnReady: "script1.sh\nscript2.sh\n"},
+		"altered scripts are not run":                 {},
+		"environment is passed to scripts":            {},
 
 		// Error cases
 		"error on order file not existing": {wantErr: true},
 		"error on not ready for execution": {wantErr: true},
 		"error on argument not a file":     {wantErr: true},
+		"error on invalid environment":     {wantErr: true},
 	}
 
 	for name, tc := range tests {
@@ -258,7 +460,17 @@ func TestRunScripts(t *testing.T) {
 					"Setup: can't create script dir")
 			}
 
-			err := scripts.RunScripts(context.Background(), scriptDir, tc.allowOrderMissing)
+			var ready bool
+			var onReady string
+			notifyReady := func() {
+				ready = true
+				d, err := os.ReadFile(filepath.Join(scriptRootParentDir, "golden"))
+				if err == nil {
+					onReady = string(d)
+				}
+			}
+
+			err := scripts.RunScripts(context.Background(), scriptDir, tc.allowOrderMissing, notifyReady)
 			if tc.wantErr {
 				require.NotNil(t, err, "RunScripts should have failed but didn't")
 				_, err = os.Stat(filepath.Dir(scriptDir))
@@ -266,6 +478,10 @@ func TestRunScripts(t *testing.T) {
 				return
 			}
 			require.NoError(t, err, "RunScripts failed but shouldn't have")
+			require.True(t, ready, "RunScripts should have notified readiness")
+			if tc.wantOnReady != "" {
+				require.Equal(t, tc.wantOnReady, onReady, "RunScripts should have notified readiness before the asynchronous scripts completed")
+			}
 
 			_, err = os.Stat(filepath.Join(filepath.Dir(scriptDir), scripts.InSessionFlag))
 			if tc.wantSessionFlagFileRemoved {
@@ -277,6 +493,75 @@ func TestRunScripts(t *testing.T) {
 			// Get and compare oracle file to check order
 			src := filepath.Join(scriptRootParentDir, "golden")
 			testutils.CompareTreesWithFiltering(t, src, testutils.GoldenPath(t), testutils.UpdateEnabled())
+
+			d, err := os.ReadFile(scriptDir + ".results")
+			if tc.allowOrderMissing && errors.Is(err, fs.ErrNotExist) {
+				return
+			}
+			require.NoError(t, err, "RunScripts should have saved the scripts results")
+			var results []scripts.Result
+			require.NoError(t, json.Unmarshal(d, &results), "Saved scripts results should be valid")
+			// Timings change on each run and errors reference the temporary scripts directory.
+			for i := range results {
+				results[i].Start = time.Time{}
+				results[i].Duration = 0
+				results[i].Error = strings.ReplaceAll(results[i].Error, scriptParentDir, "#SCRIPTSDIR#")
+			}
+			want := testutils.LoadWithUpdateFromGoldenYAML(t, results, testutils.WithGoldenPath(testutils.GoldenPath(t)+".results"))
+			require.Equal(t, want, results, "RunScripts should have saved the expected scripts results")
+		})
+	}
+}
+
+func TestResults(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		uid      string
+		computer bool
+
+		wantErr bool
+	}{
+		"Machine results":                   {computer: true},
+		"User results":                      {uid: "4242"},
+		"Invalid results are ignored":       {uid: "4243"},
+		"No results without scripts run":    {uid: "4244"},
+		"No results without user directory": {uid: "4245"},
+
+		// Error cases
+		"Error on user lookup failing": {uid: "userLookupError", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			userLookup := func(string) (*user.User, error) {
+				return &user.User{Uid: tc.uid}, nil
+			}
+			if tc.uid == "userLookupError" {
+				userLookup = func(string) (*user.User, error) {
+					return nil, errors.New("User error requested")
+				}
+			}
+
+			runDir := t.TempDir()
+			require.NoError(t,
+				shutil.CopyTree(filepath.Join(testutils.TestFamilyPath(t), "run_dir"), filepath.Join(runDir, "run"), nil),
+				"Setup: can't create initial run dir scripts content")
+
+			m, err := scripts.New(filepath.Join(runDir, "run"), &mockUnitStarter{}, scripts.WithUserLookup(userLookup))
+			require.NoError(t, err, "Setup: can't create scripts manager")
+
+			got, err := m.Results(context.Background(), "ubuntu", tc.computer)
+			if tc.wantErr {
+				require.Error(t, err, "Results should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Results failed but shouldn't have")
+
+			want := testutils.LoadWithUpdateFromGoldenYAML(t, got)
+			require.Equal(t, want, got, "Results should return the expected scripts results")
 		})
 	}
 }
@@ -0,0 +1 @@
+script 3
\ No newline at end of file
@@ -0,0 +1,12 @@
+#!/bin/sh
+
+script=$(realpath $0)
+# Our scripts are in: user/foo/scripts/scripts.
+# We want to write our golden file in user/foo/.
+path=$(dirname $(dirname $(dirname ${script})))
+
+echo $(basename $0) >> "${path}/golden"
+echo "ADSYS_USER=${ADSYS_USER}" >> "${path}/golden"
+echo "ADSYS_DOMAIN=${ADSYS_DOMAIN}" >> "${path}/golden"
+echo "ADSYS_GPO_LIST=${ADSYS_GPO_LIST}" >> "${path}/golden"
+echo "KRB5CCNAME=${KRB5CCNAME}" >> "${path}/golden"
@@ -0,0 +1,192 @@
+package scripts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// digestsFile is the allowlist of the SHA256 digests of the scripts, at the root of the SYSVOL scripts
+	// directory, in the format of sha256sum.
+	digestsFile = "SHA256SUMS"
+	// signatureSuffix is appended to a script to get its detached signature.
+	signatureSuffix = ".sig"
+	// signatureNamespace is the namespace of the signatures, as set with ssh-keygen -Y sign -n.
+	signatureNamespace = "file"
+)
+
+// digestRe matches a SHA256 digest, in hexadecimal.
+var digestRe = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// verifier checks that the scripts are trusted before they are executed.
+type verifier struct {
+	scriptsDir     string
+	digests        map[string]string
+	allowedSigners string
+	sshKeygenCmd   []string
+}
+
+// newVerifier returns a verifier for the scripts of scriptsDir, trusting the digests listed in its allowlist and
+// the signatures of allowedSigners, in the format of the ssh-keygen allowed signers file.
+// The returned cleanup function needs to be called once the scripts are verified.
+func newVerifier(ctx context.Context, scriptsDir string, allowedSigners []string, sshKeygenCmd []string) (v *verifier, cleanup func(), err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load scripts trust anchors"))
+
+	v = &verifier{
+		scriptsDir:   scriptsDir,
+		digests:      make(map[string]string),
+		sshKeygenCmd: sshKeygenCmd,
+	}
+	cleanup = func() {}
+
+	f, err := os.Open(filepath.Join(scriptsDir, digestsFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			l := strings.TrimSpace(scanner.Text())
+			if l == "" || strings.HasPrefix(l, "#") {
+				continue
+			}
+			// Binary mode is flagged with a * before the file name.
+			digest, script, found := strings.Cut(l, " ")
+			script = strings.TrimPrefix(strings.TrimSpace(script), "*")
+			if !found || script == "" || !digestRe.MatchString(digest) {
+				log.Warningf(ctx, "Skipping invalid line in %s: %q", digestsFile, l)
+				continue
+			}
+			v.digests[filepath.Clean(script)] = strings.ToLower(digest)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(allowedSigners) == 0 {
+		return v, cleanup, nil
+	}
+	signers, err := os.CreateTemp("", "adsys-allowed-signers-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() { _ = os.Remove(signers.Name()) }
+	defer signers.Close()
+	if _, err := signers.WriteString(strings.Join(allowedSigners, "\n") + "\n"); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := signers.Close(); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	v.allowedSigners = signers.Name()
+
+	return v, cleanup, nil
+}
+
+// verify checks that script, relative to the scripts directory, matches the digest it is pinned to, if any.
+// Otherwise, it needs to be listed in the allowlist of digests, or to be signed by one of the allowed signers.
+// It returns the digest of the verified script.
+func (v *verifier) verify(ctx context.Context, script, pinned string) (digest string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't verify script %q", script))
+
+	p := filepath.Join(v.scriptsDir, script)
+	if digest, err = fileDigest(p); err != nil {
+		return "", err
+	}
+
+	if pinned != "" {
+		if !strings.EqualFold(digest, pinned) {
+			return "", errors.New(gotext.Get("its SHA256 digest %s doesn't match the pinned one", digest))
+		}
+		return digest, nil
+	}
+
+	allowed, listed := v.digests[filepath.Clean(script)]
+	if listed && allowed == digest {
+		return digest, nil
+	}
+
+	if v.allowedSigners != "" {
+		err := v.verifySignature(ctx, p)
+		if err == nil {
+			return digest, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	if listed {
+		return "", errors.New(gotext.Get("its SHA256 digest %s doesn't match the one listed in %s, it may have been altered", digest, digestsFile))
+	}
+	return "", errors.New(gotext.Get("it is neither signed nor listed in %s", digestsFile))
+}
+
+// verifySignature checks the detached signature of the script at p with ssh-keygen.
+// It returns an error wrapping fs.ErrNotExist if the script is not signed.
+func (v *verifier) verifySignature(ctx context.Context, p string) error {
+	sig := p + signatureSuffix
+	if _, err := os.Stat(sig); err != nil {
+		return err
+	}
+
+	// The identity of the signer is needed to verify the signature.
+	// #nosec G204 - the command is set by the daemon and the paths are in its run directory.
+	cmd := exec.CommandContext(ctx, v.sshKeygenCmd[0], append(v.sshKeygenCmd[1:], "-Y", "find-principals", "-s", sig, "-f", v.allowedSigners)...)
+	out, err := cmd.Output()
+	if err != nil {
+		return errors.New(gotext.Get("its signature %s is not from any allowed signer", filepath.Base(sig)))
+	}
+	principal, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var stderr bytes.Buffer
+	// #nosec G204 - the command is set by the daemon and the paths are in its run directory.
+	cmd = exec.CommandContext(ctx, v.sshKeygenCmd[0], append(v.sshKeygenCmd[1:], "-Y", "verify", "-f", v.allowedSigners, "-I", principal, "-n", signatureNamespace, "-s", sig)...)
+	cmd.Stdin = f
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New(gotext.Get("its signature %s is invalid, it may have been altered: %s", filepath.Base(sig), strings.TrimSpace(stderr.String())))
+	}
+	log.Debugf(ctx, "Signature of %q verified for %s", p, principal)
+	return nil
+}
+
+// fileDigest returns the SHA256 digest of the file at p, in hexadecimal.
+func fileDigest(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("%s: %w", gotext.Get("can't compute digest of %s", p), err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,170 @@
+package scripts
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/decorate"
+)
+
+// UnitsStats are the number of user script units cleaned up since the manager was created.
+type UnitsStats struct {
+	// Stuck is the number of units stopped after activating for too long.
+	Stuck int
+	// Failed is the number of units whose failed state was reset.
+	Failed int
+}
+
+// UnitsStats returns the number of user script units cleaned up since the manager was created.
+func (m *Manager) UnitsStats() UnitsStats {
+	m.unitsStatsMu.Lock()
+	defer m.unitsStatsMu.Unlock()
+
+	return m.unitsStats
+}
+
+// watchUsersUnits cleans up the script unit of every user with scripts in the run directory.
+func (m *Manager) watchUsersUnits(ctx context.Context) {
+	entries, err := os.ReadDir(filepath.Join(m.runDir, "users"))
+	if err != nil {
+		log.Warning(ctx, gotext.Get("Can't list users with scripts to watch their units: %v", err))
+		return
+	}
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil || !e.IsDir() {
+			continue
+		}
+		m.watchUserUnit(ctx, e.Name())
+	}
+}
+
+// watchUserUnit stops the script unit of the user with uid if it is stuck activating, and resets it if it failed.
+// As the logoff scripts will not run for this unit, the session flag is removed so that the scripts can be
+// updated again.
+// Failing to watch or clean up the unit is not an error: this is tried again on the next refresh.
+func (m *Manager) watchUserUnit(ctx context.Context, uid string) {
+	unit := consts.AdsysUserScriptsServiceName
+
+	state, since, err := m.userUnitState(ctx, uid, unit)
+	if err != nil {
+		// The user manager is not running when the user has no session.
+		log.Debugf(ctx, "Can't get state of %s for user %s: %v", unit, uid, err)
+		return
+	}
+
+	var stuck bool
+	switch state {
+	case "failed":
+	case "activating":
+		if since.IsZero() || time.Since(since) < m.stuckUnitTimeout {
+			return
+		}
+		stuck = true
+	default:
+		return
+	}
+
+	if stuck {
+		log.Warningf(ctx, "%s of user %s is activating since %s, stopping it", unit, uid, since.Format(time.RFC3339))
+		if _, err := m.systemctl(ctx, uid, "stop", unit); err != nil {
+			log.Warning(ctx, gotext.Get("Can't stop stuck %s of user %s: %v", unit, uid, err))
+			return
+		}
+	} else {
+		log.Warningf(ctx, "%s of user %s failed, resetting it", unit, uid)
+	}
+	// Stopping a unit while activating can leave it failed too.
+	if _, err := m.systemctl(ctx, uid, "reset-failed", unit); err != nil {
+		log.Warning(ctx, gotext.Get("Can't reset failed %s of user %s: %v", unit, uid, err))
+		return
+	}
+
+	flag := filepath.Join(m.runDir, "users", uid, executableDir, inSessionFlag)
+	if err := os.Remove(flag); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warning(ctx, gotext.Get("Can't remove session flag %q: %v", flag, err))
+	}
+
+	m.unitsStatsMu.Lock()
+	defer m.unitsStatsMu.Unlock()
+	if stuck {
+		m.unitsStats.Stuck++
+	} else {
+		m.unitsStats.Failed++
+	}
+}
+
+// userUnitState returns the active state of unit in the manager of the user with uid, and when it entered it.
+// since is zero if systemd doesn't know when the unit changed of state.
+func (m *Manager) userUnitState(ctx context.Context, uid, unit string) (state string, since time.Time, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't get state of %s", unit))
+
+	out, err := m.systemctl(ctx, uid, "show", "--property=ActiveState", "--property=StateChangeTimestamp", "--timestamp=unix", unit)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	for _, l := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(l), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "ActiveState":
+			state = v
+		case "StateChangeTimestamp":
+			if v == "" {
+				continue
+			}
+			sec, err := strconv.ParseInt(strings.TrimPrefix(v, "@"), 10, 64)
+			if err != nil {
+				return "", time.Time{}, errors.New(gotext.Get("invalid state change timestamp %q", v))
+			}
+			since = time.Unix(sec, 0)
+		}
+	}
+
+	return state, since, nil
+}
+
+// systemctl runs systemctl with args against the manager of the user with uid and returns its standard output.
+// An error, containing the error output, is returned if the command failed.
+func (m *Manager) systemctl(ctx context.Context, uid string, args ...string) (stdout string, err error) {
+	defer decorate.OnError(&err, gotext.Get("%s failed", filepath.Base(m.systemctlCmd[0])))
+
+	ctx, cancel := context.WithTimeout(ctx, consts.DefaultHelperExecTimeout)
+	defer cancel()
+
+	cmdArgs := append(slices.Clone(m.systemctlCmd[1:]), "--user", fmt.Sprintf("--machine=%s@.host", uid))
+	cmdArgs = append(cmdArgs, args...)
+	// #nosec G204 - cmd is under our control (default system command or mock for tests)
+	c := exec.CommandContext(ctx, m.systemctlCmd[0], cmdArgs...)
+	var outBuf, errBuf bytes.Buffer
+	c.Stdout = &outBuf
+	c.Stderr = &errBuf
+
+	smbsafe.WaitExec()
+	err = c.Run()
+	smbsafe.DoneExec()
+
+	if err != nil {
+		if stderr := strings.TrimSpace(errBuf.String()); stderr != "" {
+			return "", fmt.Errorf("%w: %s", err, stderr)
+		}
+		return "", err
+	}
+	return outBuf.String(), nil
+}
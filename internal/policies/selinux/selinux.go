@@ -0,0 +1,530 @@
+// Package selinux provides a manager that deploys SELinux policy modules and sets SELinux booleans, as an
+// alternative to the apparmor manager on SELinux-enabled derivatives.
+//
+// This manager only applies to computer objects, and only runs when SELinux is selected as the security module
+// of the machine in the adsys configuration.
+//
+// The following settings are supported:
+//   - selinux/modules: policy modules to install, one per line, as paths of .pp or .cil files relative to the
+//     SYSVOL/ubuntu/selinux/ directory.
+//   - selinux/booleans: SELinux booleans to set, one per line, of the form <name>=<on|off>.
+//
+// Modules are installed with semodule at a dedicated priority, so that they never replace nor remove the modules
+// shipped by the distribution or installed locally. A module is only reinstalled when its content changed.
+// Booleans are set persistently with setsebool, and their previous value is restored once they are not configured
+// anymore.
+//
+// The modules installed and the booleans changed by adsys are saved in a state file, so that they are reverted
+// once they are not configured anymore.
+package selinux
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	stateFile = "state.json"
+
+	// assetsDir is the directory of the modules in the assets share.
+	assetsDir = "selinux"
+
+	// modulePriority is the priority of the modules installed by adsys. It is above the priority of the modules
+	// installed locally (400), so that adsys modules override them, and removing them leaves the others untouched.
+	modulePriority = "450"
+)
+
+var (
+	// moduleNameRe matches the names of SELinux modules.
+	moduleNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+	// booleanNameRe matches the names of SELinux booleans.
+	booleanNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+)
+
+// module is a policy module to install from the assets.
+type module struct {
+	name string
+	path string
+}
+
+// state is the SELinux configuration applied by adsys.
+type state struct {
+	// Modules are the checksums of the modules installed by adsys, indexed by module name.
+	Modules map[string]string `json:"modules,omitempty"`
+	// Booleans are the values of the booleans changed by adsys before they were first set, indexed by boolean name.
+	Booleans map[string]bool `json:"booleans,omitempty"`
+}
+
+// Manager applies the SELinux policy on the machine.
+type Manager struct {
+	stateDir     string
+	selinuxFsDir string
+	semoduleCmd  []string
+	getseboolCmd []string
+	setseboolCmd []string
+	cmdTimeout   time.Duration
+
+	mu sync.Mutex // Prevents concurrent changes to the SELinux policy and the state
+}
+
+type options struct {
+	stateDir     string
+	selinuxFsDir string
+	semoduleCmd  []string
+	getseboolCmd []string
+	setseboolCmd []string
+	cmdTimeout   time.Duration
+}
+
+// Option reprents an optional function to change the SELinux manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithSelinuxFsDir specifies a personalized directory for the SELinux filesystem.
+func WithSelinuxFsDir(p string) func(*options) {
+	return func(a *options) {
+		a.selinuxFsDir = p
+	}
+}
+
+// WithSemoduleCmd overrides the default semodule command.
+func WithSemoduleCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.semoduleCmd = cmd
+	}
+}
+
+// WithGetseboolCmd overrides the default getsebool command.
+func WithGetseboolCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.getseboolCmd = cmd
+	}
+}
+
+// WithSetseboolCmd overrides the default setsebool command.
+func WithSetseboolCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.setseboolCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time a command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the SELinux policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:     consts.DefaultStateDir,
+		selinuxFsDir: "/sys/fs/selinux",
+		semoduleCmd:  []string{"semodule"},
+		getseboolCmd: []string{"getsebool"},
+		setseboolCmd: []string{"setsebool"},
+		cmdTimeout:   consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:     filepath.Join(args.stateDir, "selinux"),
+		selinuxFsDir: args.selinuxFsDir,
+		semoduleCmd:  args.semoduleCmd,
+		getseboolCmd: args.getseboolCmd,
+		setseboolCmd: args.setseboolCmd,
+		cmdTimeout:   args.cmdTimeout,
+	}
+}
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// ApplyPolicy installs the modules and sets the booleans requested by the policy, and reverts the ones which are
+// not requested anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply SELinux policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "SELinux policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Debugf(ctx, "Applying SELinux policy to %s", objectName)
+
+	modules, booleans, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to revert.
+	if len(modules) == 0 && len(booleans) == 0 && len(prev.Modules) == 0 && len(prev.Booleans) == 0 {
+		return nil
+	}
+
+	// No point in continuing if SELinux isn't enabled.
+	if _, err := os.Stat(filepath.Join(m.selinuxFsDir, "enforce")); err != nil {
+		// If we do have entries to apply we should explicitly fail
+		if len(modules) > 0 || len(booleans) > 0 {
+			return errors.New(gotext.Get("SELinux is not enabled on this machine"))
+		}
+		// Otherwise, just let the user know
+		log.Warning(ctx, gotext.Get("SELinux is not enabled on this machine, the previous SELinux policy can't be reverted"))
+		return nil
+	}
+
+	s, err := m.apply(ctx, prev, modules, booleans, assetsDumper)
+	if err != nil {
+		// Still save the changes done so far, so that they can be reverted.
+		return errors.Join(err, m.saveState(s))
+	}
+	return m.saveState(s)
+}
+
+// DumpState returns the SELinux modules installed and booleans changed during the last refresh of the machine.
+// The state is empty for users or if no SELinux policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump SELinux state of %s", objectName))
+
+	// SELinux policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// apply reverts the changes of the previous state prev which are not requested anymore, then installs the
+// requested modules and sets the requested booleans. It returns the new state.
+func (m *Manager) apply(ctx context.Context, prev state, modules []module, booleans map[string]bool, assetsDumper AssetsDumper) (s state, err error) {
+	s = state{Modules: make(map[string]string), Booleans: make(map[string]bool)}
+	for n, sum := range prev.Modules {
+		s.Modules[n] = sum
+	}
+	for n, v := range prev.Booleans {
+		s.Booleans[n] = v
+	}
+
+	if err := m.applyModules(ctx, &s, modules, assetsDumper); err != nil {
+		return s, err
+	}
+	if err := m.applyBooleans(ctx, &s, booleans); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// applyModules removes the modules installed by adsys which are not requested anymore, then installs the
+// requested modules whose content changed, recording them in s.
+func (m *Manager) applyModules(ctx context.Context, s *state, modules []module, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply SELinux modules"))
+
+	installed := maps.Keys(s.Modules)
+	slices.Sort(installed)
+	for _, n := range installed {
+		if slices.ContainsFunc(modules, func(mod module) bool { return mod.name == n }) {
+			continue
+		}
+		log.Infof(ctx, "Removing SELinux module %s", n)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.semoduleCmd, "-X", modulePriority, "-r", n); err != nil {
+			return err
+		}
+		delete(s.Modules, n)
+	}
+
+	if len(modules) == 0 {
+		return nil
+	}
+
+	// The assets are dumped in a fixed directory, which is cleaned up from any previous interrupted run.
+	tmp := filepath.Join(m.stateDir, ".assets")
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if errRemove := os.RemoveAll(tmp); errRemove != nil {
+			err = errors.Join(err, errRemove)
+		}
+	}()
+	assets := filepath.Join(tmp, assetsDir)
+	if err := assetsDumper(ctx, assetsDir+"/", assets, -1, -1); err != nil {
+		return err
+	}
+
+	for _, mod := range modules {
+		p := filepath.Join(assets, mod.path)
+		d, err := os.ReadFile(p)
+		if err != nil {
+			return errors.New(gotext.Get("can't read SELinux module %s from the assets: %v", mod.path, err))
+		}
+		sum := sha256.Sum256(d)
+		checksum := hex.EncodeToString(sum[:])
+		if s.Modules[mod.name] == checksum {
+			log.Debugf(ctx, "SELinux module %s is already installed", mod.name)
+			continue
+		}
+
+		log.Infof(ctx, "Installing SELinux module %s", mod.name)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.semoduleCmd, "-X", modulePriority, "-i", p); err != nil {
+			return err
+		}
+		s.Modules[mod.name] = checksum
+	}
+	return nil
+}
+
+// applyBooleans restores the booleans changed by adsys which are not requested anymore, then sets the requested
+// booleans, recording their previous value in s.
+// All the booleans are changed at once, as each persistent change rebuilds the policy.
+func (m *Manager) applyBooleans(ctx context.Context, s *state, booleans map[string]bool) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply SELinux booleans"))
+
+	if len(booleans) == 0 && len(s.Booleans) == 0 {
+		return nil
+	}
+
+	current, err := m.currentBooleans(ctx)
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]bool)
+	for n, v := range s.Booleans {
+		if _, ok := booleans[n]; !ok {
+			want[n] = v
+		}
+	}
+	for n, v := range booleans {
+		if _, ok := current[n]; !ok {
+			return errors.New(gotext.Get("SELinux boolean %q doesn't exist", n))
+		}
+		want[n] = v
+	}
+
+	var changes []string
+	names := maps.Keys(want)
+	slices.Sort(names)
+	for _, n := range names {
+		v, ok := current[n]
+		if !ok {
+			// A boolean removed with its module can't be restored.
+			continue
+		}
+		if v == want[n] {
+			continue
+		}
+		log.Infof(ctx, "Setting SELinux boolean %s to %s", n, onOff(want[n]))
+		changes = append(changes, fmt.Sprintf("%s=%s", n, onOff(want[n])))
+	}
+	if len(changes) > 0 {
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.setseboolCmd, append([]string{"-P"}, changes...)...); err != nil {
+			return err
+		}
+	}
+
+	for n := range s.Booleans {
+		if _, ok := booleans[n]; !ok {
+			delete(s.Booleans, n)
+		}
+	}
+	for n := range booleans {
+		if _, ok := s.Booleans[n]; !ok {
+			s.Booleans[n] = current[n]
+		}
+	}
+	return nil
+}
+
+// currentBooleans returns the current value of all the SELinux booleans of the machine.
+func (m *Manager) currentBooleans(ctx context.Context) (booleans map[string]bool, err error) {
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.getseboolCmd, "-a")
+	if err != nil {
+		return nil, err
+	}
+
+	booleans = make(map[string]bool)
+	for _, l := range strings.Split(out, "\n") {
+		// Lines are of the form: <name> --> <on|off>
+		n, v, found := strings.Cut(l, "-->")
+		if !found {
+			continue
+		}
+		booleans[strings.TrimSpace(n)] = strings.TrimSpace(v) == "on"
+	}
+	return booleans, nil
+}
+
+// loadState loads the SELinux configuration applied by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load SELinux state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the SELinux configuration applied by adsys.
+// The state file is removed if nothing is to be reverted anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save SELinux state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Modules) == 0 && len(s.Booleans) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// parseEntries validates the entries and returns the requested modules, in order, and booleans.
+// Entries are listed from the furthest to the closest GPO: the closest one wins.
+func parseEntries(ctx context.Context, entries []entry.Entry) (modules []module, booleans map[string]bool, err error) {
+	booleans = make(map[string]bool)
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		for _, l := range strings.Split(v, "\n") {
+			l = strings.TrimSpace(l)
+			if l == "" {
+				continue
+			}
+
+			switch e.Key {
+			case "selinux/modules":
+				mod, err := parseModule(l)
+				if err != nil {
+					return nil, nil, err
+				}
+				if i := slices.IndexFunc(modules, func(o module) bool { return o.name == mod.name }); i != -1 {
+					if modules[i].path != mod.path {
+						return nil, nil, errors.New(gotext.Get("SELinux modules %s and %s have the same name", modules[i].path, mod.path))
+					}
+					continue
+				}
+				modules = append(modules, mod)
+			case "selinux/booleans":
+				n, b, err := parseBoolean(l)
+				if err != nil {
+					return nil, nil, err
+				}
+				booleans[n] = b
+			default:
+				log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing SELinux entries, skipping it", e.Key))
+			}
+		}
+	}
+	return modules, booleans, nil
+}
+
+// parseModule parses the path of a module, relative to the selinux assets directory.
+// The module name is the name of the file, without its extension.
+func parseModule(l string) (mod module, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid SELinux module %q", l))
+
+	p := filepath.Clean(l)
+	if !filepath.IsLocal(p) {
+		return mod, errors.New(gotext.Get("the module must be relative to the %s assets directory", assetsDir))
+	}
+	ext := filepath.Ext(p)
+	if ext != ".pp" && ext != ".cil" {
+		return mod, errors.New(gotext.Get("only .pp and .cil modules are supported"))
+	}
+	name := strings.TrimSuffix(filepath.Base(p), ext)
+	if !moduleNameRe.MatchString(name) {
+		return mod, errors.New(gotext.Get("%q is not a valid module name", name))
+	}
+	return module{name: name, path: p}, nil
+}
+
+// parseBoolean parses a boolean line of the form <name>=<on|off>.
+func parseBoolean(l string) (name string, value bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid SELinux boolean %q", l))
+
+	n, v, found := strings.Cut(l, "=")
+	n, v = strings.TrimSpace(n), strings.ToLower(strings.TrimSpace(v))
+	if !found {
+		return "", false, errors.New(gotext.Get("expected <name>=<on|off>"))
+	}
+	if !booleanNameRe.MatchString(n) {
+		return "", false, errors.New(gotext.Get("%q is not a valid boolean name", n))
+	}
+	switch v {
+	case "on", "true", "1":
+		return n, true, nil
+	case "off", "false", "0":
+		return n, false, nil
+	}
+	return "", false, errors.New(gotext.Get("%q is not one of on, off", v))
+}
+
+// onOff returns the value v as expected by setsebool.
+func onOff(v bool) string {
+	if v {
+		return "on"
+	}
+	return "off"
+}
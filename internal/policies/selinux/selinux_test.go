@@ -0,0 +1,143 @@
+package selinux_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/selinux"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries         []entry.Entry
+		isUser          bool
+		existingState   string
+		selinuxDisabled bool
+		mockBehaviour   string
+		saveAssetsError bool
+
+		wantErr bool
+	}{
+		"Install modules":                                  {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp\n\n  kiosk/kiosk.cil "}}},
+		"Set booleans":                                     {entries: []entry.Entry{{Key: "selinux/booleans", Value: "httpd_can_network_connect=on\n\n ssh_sysadm_login = on "}}},
+		"Install modules and set booleans":                 {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp"}, {Key: "selinux/booleans", Value: "httpd_can_network_connect=on"}}},
+		"Boolean values are case insensitive":              {entries: []entry.Entry{{Key: "selinux/booleans", Value: "httpd_can_network_connect=ON\nssh_sysadm_login=True\ndeny_ptrace=1"}}},
+		"Booleans already set are not changed":             {entries: []entry.Entry{{Key: "selinux/booleans", Value: "deny_ptrace=off"}}},
+		"Closest boolean wins":                             {entries: []entry.Entry{{Key: "selinux/booleans", Value: "ssh_sysadm_login=off"}, {Key: "selinux/booleans", Value: "ssh_sysadm_login=on"}}},
+		"Same module listed more than once":                {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp"}, {Key: "selinux/modules", Value: "adsys_lab.pp\nkiosk/kiosk.cil"}}},
+		"Unchanged modules are not reinstalled":            {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp"}}, existingState: "applied"},
+		"Changed modules are reinstalled":                  {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp\nkiosk/kiosk.cil"}, {Key: "selinux/booleans", Value: "httpd_can_network_connect=on\nuse_nfs_home_dirs=off"}}, existingState: "applied"},
+		"Modules and booleans not configured are reverted": {entries: []entry.Entry{{Key: "selinux/modules", Value: "kiosk/kiosk.cil"}, {Key: "selinux/booleans", Value: "httpd_can_network_connect=on"}}, existingState: "applied"},
+		"No entries reverts the applied policy":            {existingState: "applied"},
+		"Disabled entries are ignored":                     {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp", Disabled: true}, {Key: "selinux/booleans", Value: "deny_ptrace=on"}}},
+		"Empty entries are ignored":                        {entries: []entry.Entry{{Key: "selinux/modules", Value: " \n"}, {Key: "selinux/booleans", Value: "deny_ptrace=on"}}},
+		"Unsupported keys are ignored":                     {entries: []entry.Entry{{Key: "selinux/booleans", Value: "deny_ptrace=on"}, {Key: "selinux/ports", Value: "http_port_t tcp 8080"}}},
+		"Users are a no-op":                                {entries: []entry.Entry{{Key: "selinux/booleans", Value: "deny_ptrace=on"}}, isUser: true},
+		"No entries and no state is a no-op":               {},
+		"SELinux disabled without entries is a no-op":      {selinuxDisabled: true},
+		"SELinux disabled keeps the applied policy":        {existingState: "applied", selinuxDisabled: true},
+
+		// Error cases
+		"Error on SELinux disabled with entries":      {entries: []entry.Entry{{Key: "selinux/booleans", Value: "deny_ptrace=on"}}, selinuxDisabled: true, wantErr: true},
+		"Error on unsupported module extension":       {entries: []entry.Entry{{Key: "selinux/modules", Value: "README.txt"}}, wantErr: true},
+		"Error on absolute module path":               {entries: []entry.Entry{{Key: "selinux/modules", Value: "/usr/share/selinux/default/apache.pp"}}, wantErr: true},
+		"Error on module outside of assets":           {entries: []entry.Entry{{Key: "selinux/modules", Value: "../apparmor/adsys_lab.pp"}}, wantErr: true},
+		"Error on invalid module name":                {entries: []entry.Entry{{Key: "selinux/modules", Value: "lab module.pp"}}, wantErr: true},
+		"Error on modules with the same name":         {entries: []entry.Entry{{Key: "selinux/modules", Value: "kiosk/kiosk.cil\nkiosk.pp"}}, wantErr: true},
+		"Error on module missing from assets":         {entries: []entry.Entry{{Key: "selinux/modules", Value: "missing.pp"}}, wantErr: true},
+		"Error on dumping assets":                     {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp"}}, saveAssetsError: true, wantErr: true},
+		"Error on boolean without value":              {entries: []entry.Entry{{Key: "selinux/booleans", Value: "deny_ptrace"}}, wantErr: true},
+		"Error on invalid boolean value":              {entries: []entry.Entry{{Key: "selinux/booleans", Value: "deny_ptrace=enabled"}}, wantErr: true},
+		"Error on invalid boolean name":               {entries: []entry.Entry{{Key: "selinux/booleans", Value: "-P deny_ptrace=on"}}, wantErr: true},
+		"Error on unknown boolean":                    {entries: []entry.Entry{{Key: "selinux/booleans", Value: "unknown_boolean=on"}}, wantErr: true},
+		"Error on installing module":                  {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp"}}, mockBehaviour: "fail-semodule", wantErr: true},
+		"Error on installing module keeps progress":   {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp\nkiosk/kiosk.cil"}}, mockBehaviour: "fail-semodule-kiosk.cil", wantErr: true},
+		"Error on removing module keeps state":        {existingState: "applied", mockBehaviour: "fail-semodule-legacy", wantErr: true},
+		"Error on getting booleans":                   {entries: []entry.Entry{{Key: "selinux/booleans", Value: "deny_ptrace=on"}}, mockBehaviour: "fail-getsebool", wantErr: true},
+		"Error on setting booleans":                   {entries: []entry.Entry{{Key: "selinux/booleans", Value: "deny_ptrace=on"}}, mockBehaviour: "fail-setsebool", wantErr: true},
+		"Error on setting booleans keeps modules":     {entries: []entry.Entry{{Key: "selinux/modules", Value: "adsys_lab.pp"}, {Key: "selinux/booleans", Value: "deny_ptrace=on"}}, mockBehaviour: "fail-setsebool", wantErr: true},
+		"Error on restoring booleans keeps the state": {existingState: "applied", mockBehaviour: "fail-setsebool", wantErr: true},
+		"Error on corrupted state":                    {entries: []entry.Entry{{Key: "selinux/booleans", Value: "deny_ptrace=on"}}, existingState: "corrupted", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+			selinuxFsDir := t.TempDir()
+			if !tc.selinuxDisabled {
+				require.NoError(t, os.WriteFile(filepath.Join(selinuxFsDir, "enforce"), []byte("1"), 0600), "Setup: can't create SELinux enforce file")
+			}
+			mockAssetsDumper := testutils.MockAssetsDumper{Err: tc.saveAssetsError, Path: "selinux/", T: t}
+
+			m := selinux.New(
+				selinux.WithStateDir(root),
+				selinux.WithSelinuxFsDir(selinuxFsDir),
+				selinux.WithSemoduleCmd(testutils.MockCommand(root, "semodule", tc.mockBehaviour)),
+				selinux.WithGetseboolCmd(testutils.MockCommand(root, "getsebool", tc.mockBehaviour)),
+				selinux.WithSetseboolCmd(testutils.MockCommand(root, "setsebool", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isUser, tc.entries, mockAssetsDumper.SaveAssetsTo)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				// Only failing commands leave changes to check.
+				if tc.mockBehaviour == "" {
+					return
+				}
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, root, behaviour, args := c.Name, c.Root, c.Behaviour, c.Args
+
+	if behaviour == "fail-"+name {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+	for i, a := range args {
+		if behaviour == "fail-"+name+"-"+filepath.Base(a) {
+			fmt.Fprintln(os.Stderr, "error: requested failure")
+			os.Exit(1)
+		}
+		// The modules are dumped in the temporary state directory.
+		args[i] = strings.ReplaceAll(a, root, "ROOT")
+	}
+
+	c.Log(fmt.Sprintf("%s %s", name, strings.Join(args, " ")))
+
+	if name == "getsebool" {
+		fmt.Println(`deny_ptrace --> off
+httpd_can_network_connect --> on
+ssh_sysadm_login --> off
+use_nfs_home_dirs --> off`)
+	}
+}
@@ -0,0 +1,9 @@
+module adsys_lab 1.0;
+
+require {
+	type user_home_t;
+	type httpd_t;
+	class file { read getattr open };
+}
+
+allow httpd_t user_home_t:file { read getattr open };
@@ -0,0 +1,328 @@
+// Package services provides a manager that enables, disables and masks systemd units.
+//
+// This manager only applies to computer objects.
+//
+// The following setting is supported:
+//   - services/units: units to control, one per line, of the form service=<unit>, state=<state>
+//     where state is either enabled, disabled or masked. A unit without any type suffix is
+//     considered to be a service.
+//
+// Enabled units are started, while disabled and masked units are stopped. Failing to start or
+// stop a unit only emits a warning, as the unit state is applied on next boot anyway.
+//
+// Units masked by adsys are saved in a state file, so that they are unmasked once they are not
+// configured anymore. Enabled and disabled units are left as is on revert.
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const stateFile = "state.json"
+
+const (
+	stateEnabled  = "enabled"
+	stateDisabled = "disabled"
+	stateMasked   = "masked"
+)
+
+// unitNameRe matches a systemd unit name, with its type suffix.
+var unitNameRe = regexp.MustCompile(`^[A-Za-z0-9:_.\\@-]+\.(service|socket|timer|path|target|mount|automount|swap)$`)
+
+// unit is a systemd unit with its requested state.
+type unit struct {
+	name  string
+	state string
+}
+
+// state is the units configuration applied by adsys.
+type state struct {
+	// Masked are the units masked by adsys.
+	Masked []string `json:"masked,omitempty"`
+}
+
+// Manager applies the services policy on the machine.
+type Manager struct {
+	stateDir      string
+	systemdCaller systemdCaller
+}
+
+type systemdCaller interface {
+	StartUnit(context.Context, string) error
+	StopUnit(context.Context, string) error
+	EnableUnit(context.Context, string) error
+	DisableUnit(context.Context, string) error
+	MaskUnit(context.Context, string) error
+	UnmaskUnit(context.Context, string) error
+	DaemonReload(context.Context) error
+}
+
+type options struct {
+	stateDir string
+}
+
+// Option reprents an optional function to change the services manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// New returns a new manager for the services policy.
+func New(systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir: consts.DefaultStateDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:      filepath.Join(args.stateDir, "services"),
+		systemdCaller: systemdCaller,
+	}
+}
+
+// ApplyPolicy enables, disables and masks the units from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply services policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Services policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying services policy to %s", objectName)
+
+	want, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to revert.
+	if len(want) == 0 && len(prev.Masked) == 0 {
+		return nil
+	}
+
+	// Unmask first the units which are not requested to be masked anymore, so that they can be enabled.
+	var masked []string
+	for _, name := range prev.Masked {
+		if slices.Contains(want, unit{name: name, state: stateMasked}) {
+			masked = append(masked, name)
+			continue
+		}
+		log.Infof(ctx, "Unmasking unit %s", name)
+		if err := m.systemdCaller.UnmaskUnit(ctx, name); err != nil {
+			// Keep track of the unit to try again on next refresh.
+			log.Warning(ctx, gotext.Get("Couldn't unmask unit %s: %v", name, err))
+			masked = append(masked, name)
+		}
+	}
+
+	for _, u := range want {
+		if u.state != stateMasked || slices.Contains(masked, u.name) {
+			continue
+		}
+		log.Infof(ctx, "Masking unit %s", u.name)
+		if err := m.systemdCaller.MaskUnit(ctx, u.name); err != nil {
+			// Still save the units masked so far, so that they can be reverted.
+			return errors.Join(err, m.saveState(state{Masked: masked}))
+		}
+		masked = append(masked, u.name)
+	}
+
+	if err := m.saveState(state{Masked: masked}); err != nil {
+		return err
+	}
+
+	for _, u := range want {
+		switch u.state {
+		case stateEnabled:
+			log.Infof(ctx, "Enabling unit %s", u.name)
+			if err := m.systemdCaller.EnableUnit(ctx, u.name); err != nil {
+				return err
+			}
+		case stateDisabled:
+			log.Infof(ctx, "Disabling unit %s", u.name)
+			if err := m.systemdCaller.DisableUnit(ctx, u.name); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Unit files changes are only taken into account by systemd after a reload.
+	if err := m.systemdCaller.DaemonReload(ctx); err != nil {
+		return err
+	}
+
+	for _, u := range want {
+		if u.state == stateEnabled {
+			if err := m.systemdCaller.StartUnit(ctx, u.name); err != nil {
+				log.Warning(ctx, gotext.Get("Couldn't start unit %s: %v", u.name, err))
+			}
+			continue
+		}
+		if err := m.systemdCaller.StopUnit(ctx, u.name); err != nil {
+			log.Warning(ctx, gotext.Get("Couldn't stop unit %s: %v", u.name, err))
+		}
+	}
+
+	return nil
+}
+
+// DumpState returns the units masked during the last refresh of the machine.
+// The state is empty for users or if no services policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump services state of %s", objectName))
+
+	// Services policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// parseEntries validates the entries and returns the requested units, in order.
+func parseEntries(ctx context.Context, entries []entry.Entry) (units []unit, err error) {
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		if e.Key != "services/units" {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing services entries, skipping it", e.Key))
+			continue
+		}
+
+		for _, l := range strings.Split(v, "\n") {
+			l = strings.TrimSpace(l)
+			if l == "" {
+				continue
+			}
+			u, err := parseUnit(l)
+			if err != nil {
+				return nil, err
+			}
+			i := slices.IndexFunc(units, func(o unit) bool { return o.name == u.name })
+			if i >= 0 && units[i].state != u.state {
+				return nil, errors.New(gotext.Get("unit %s is requested to be both %s and %s", u.name, units[i].state, u.state))
+			} else if i >= 0 {
+				continue
+			}
+			units = append(units, u)
+		}
+	}
+
+	return units, nil
+}
+
+// parseUnit parses a unit line of the form service=<unit>, state=<state>.
+func parseUnit(l string) (u unit, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid unit %q", l))
+
+	for _, field := range strings.Split(l, ",") {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return u, errors.New(gotext.Get("expected service=<unit>, state=<state>"))
+		}
+		switch k {
+		case "service":
+			if u.name != "" {
+				return u, errors.New(gotext.Get("service is set more than once"))
+			}
+			u.name = v
+		case "state":
+			if u.state != "" {
+				return u, errors.New(gotext.Get("state is set more than once"))
+			}
+			u.state = strings.ToLower(v)
+		default:
+			return u, errors.New(gotext.Get("unsupported field %q", k))
+		}
+	}
+
+	if u.name == "" || u.state == "" {
+		return u, errors.New(gotext.Get("expected service=<unit>, state=<state>"))
+	}
+	if !strings.Contains(u.name, ".") {
+		u.name += ".service"
+	}
+	if !unitNameRe.MatchString(u.name) {
+		return u, errors.New(gotext.Get("%q is not a valid unit name", u.name))
+	}
+	if u.state != stateEnabled && u.state != stateDisabled && u.state != stateMasked {
+		return u, errors.New(gotext.Get("unsupported state %q: only %s, %s and %s are supported", u.state, stateEnabled, stateDisabled, stateMasked))
+	}
+
+	return u, nil
+}
+
+// loadState returns the units configuration previously applied by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load services state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the units configuration applied by adsys.
+// The state file is removed if nothing is applied anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save services state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Masked) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,139 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/services"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingState string
+		failOn        string
+
+		wantErr bool
+	}{
+		"Enable units":                     {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled\nservice=cups.socket,state=enabled"}}},
+		"Disable units":                    {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=disabled"}}},
+		"Mask units":                       {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=masked\nservice=bluetooth.service, state=masked"}}},
+		"All states":                       {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled\nservice=cups.service, state=disabled\nservice=bluetooth.service, state=masked"}}},
+		"Unit without suffix is a service": {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd, state=enabled"}}},
+		"Fields are case insensitive and unordered":    {entries: []entry.Entry{{Key: "services/units", Value: " State = Enabled ,  Service = sshd.service "}}},
+		"Empty lines and duplicated units are ignored": {entries: []entry.Entry{{Key: "services/units", Value: "\nservice=sshd.service, state=enabled\n\nservice=sshd, state=enabled\n"}}},
+		"Already masked units are not masked again":    {entries: []entry.Entry{{Key: "services/units", Value: "service=bluetooth.service, state=masked"}}, existingState: "masked"},
+		"Units not masked anymore are unmasked":        {entries: []entry.Entry{{Key: "services/units", Value: "service=bluetooth.service, state=enabled"}}, existingState: "masked"},
+		"No entries unmasks units":                     {existingState: "masked"},
+		"Failing to unmask is retried on next refresh": {existingState: "masked", failOn: "unmask"},
+		"Failing to start or stop is not an error":     {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled\nservice=cups.service, state=disabled"}}, failOn: "start-stop"},
+		"Disabled entries are ignored":                 {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=masked", Disabled: true}}},
+		"Unsupported keys are ignored":                 {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled"}, {Key: "services/timers", Value: "something"}}},
+		"No entries is a no-op":                        {},
+		"Users are ignored":                            {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=masked"}}, isNotComputer: true},
+
+		// Error cases
+		"Error on missing state":                {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service"}}, wantErr: true},
+		"Error on missing service":              {entries: []entry.Entry{{Key: "services/units", Value: "state=enabled"}}, wantErr: true},
+		"Error on empty field":                  {entries: []entry.Entry{{Key: "services/units", Value: "service=, state=enabled"}}, wantErr: true},
+		"Error on field set twice":              {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled, state=masked"}}, wantErr: true},
+		"Error on unsupported field":            {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled, now=true"}}, wantErr: true},
+		"Error on unsupported state":            {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=started"}}, wantErr: true},
+		"Error on invalid unit name":            {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd/other.service, state=enabled"}}, wantErr: true},
+		"Error on unsupported unit type":        {entries: []entry.Entry{{Key: "services/units", Value: "service=user.slice, state=enabled"}}, wantErr: true},
+		"Error on unit with conflicting states": {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled\nservice=sshd, state=masked"}}, wantErr: true},
+		"Error on enabling units":               {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled"}}, failOn: "enable", wantErr: true},
+		"Error on disabling units":              {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=disabled"}}, failOn: "disable", wantErr: true},
+		"Error on masking units":                {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=masked"}}, failOn: "mask", wantErr: true},
+		"Error on daemon reload":                {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled"}}, failOn: "daemon-reload", wantErr: true},
+		"Error on corrupted state":              {entries: []entry.Entry{{Key: "services/units", Value: "service=sshd.service, state=enabled"}}, existingState: "corrupted", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			m := services.New(&mockSystemdCaller{root: root, failOn: tc.failOn}, services.WithStateDir(root))
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockSystemdCaller logs its calls in root/systemd.log.
+// failOn allows to make some calls fail.
+type mockSystemdCaller struct {
+	root   string
+	failOn string
+}
+
+func (s mockSystemdCaller) StartUnit(_ context.Context, unit string) error {
+	return s.call("start-stop", "start", unit)
+}
+
+func (s mockSystemdCaller) StopUnit(_ context.Context, unit string) error {
+	return s.call("start-stop", "stop", unit)
+}
+
+func (s mockSystemdCaller) EnableUnit(_ context.Context, unit string) error {
+	return s.call("enable", "enable", unit)
+}
+
+func (s mockSystemdCaller) DisableUnit(_ context.Context, unit string) error {
+	return s.call("disable", "disable", unit)
+}
+
+func (s mockSystemdCaller) MaskUnit(_ context.Context, unit string) error {
+	return s.call("mask", "mask", unit)
+}
+
+func (s mockSystemdCaller) UnmaskUnit(_ context.Context, unit string) error {
+	return s.call("unmask", "unmask", unit)
+}
+
+func (s mockSystemdCaller) DaemonReload(_ context.Context) error {
+	return s.call("daemon-reload", "daemon-reload", "")
+}
+
+func (s mockSystemdCaller) call(step, action, unit string) error {
+	// #nosec G302 - this is a test log file
+	f, err := os.OpenFile(filepath.Join(s.root, "systemd.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, strings.TrimSpace(action+" "+unit)); err != nil {
+		return err
+	}
+
+	if s.failOn == step {
+		return errors.New("requested failure")
+	}
+	return nil
+}
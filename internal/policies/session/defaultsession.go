@@ -0,0 +1,219 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+)
+
+const (
+	accountsDbusRegisteredName = "org.freedesktop.Accounts"
+	accountsDbusObjectPath     = "/org/freedesktop/Accounts"
+	accountsDbusInterface      = "org.freedesktop.Accounts"
+	accountsDbusUserInterface  = "org.freedesktop.Accounts.User"
+
+	// errDBusServiceUnknownName is the error name returned by D-Bus when AccountsService is not installed.
+	errDBusServiceUnknownName = "org.freedesktop.DBus.Error.ServiceUnknown"
+)
+
+// validSessionName matches the name of the session desktop files.
+var validSessionName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// accountsService reads and selects the session of the users.
+type accountsService interface {
+	Session(ctx context.Context, username string) (string, error)
+	SetSession(ctx context.Context, username, session string) error
+}
+
+// groupSession is the session selected for the members of a group.
+type groupSession struct {
+	group   string
+	session string
+}
+
+// applyDefaultSession selects the session of username through AccountsService: the session of the first
+// listed group the user is a member of, or the default session otherwise.
+// If the user chose another session since we last selected one, their choice is kept.
+func (m *Manager) applyDefaultSession(ctx context.Context, username string, entries []entry.Entry) error {
+	log.Debugf(ctx, "Applying default session policy to %s", username)
+
+	var defaultSession string
+	var groupSessions []groupSession
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		switch e.Key {
+		case "default-session":
+			defaultSession = strings.TrimSpace(e.Value)
+			if !validSessionName.MatchString(defaultSession) {
+				return errors.New(gotext.Get("invalid session name %q", e.Value))
+			}
+		case "default-session-groups":
+			for _, l := range splitLines(e.Value) {
+				group, session, ok := strings.Cut(l, "=")
+				group = strings.TrimPrefix(strings.TrimSpace(group), "%")
+				session = strings.TrimSpace(session)
+				if !ok || group == "" {
+					return errors.New(gotext.Get("invalid group session %q: <group>=<session> is expected", l))
+				}
+				if !validSessionName.MatchString(session) {
+					return errors.New(gotext.Get("invalid session name %q", session))
+				}
+				groupSessions = append(groupSessions, groupSession{group: group, session: session})
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing session entries, skipping it", e.Key))
+		}
+	}
+
+	session := defaultSession
+	if len(groupSessions) > 0 {
+		groups, err := m.userGroups(username)
+		if err != nil {
+			return err
+		}
+	out:
+		for _, gs := range groupSessions {
+			for _, g := range groups {
+				if strings.EqualFold(g, gs.group) {
+					session = gs.session
+					break out
+				}
+			}
+		}
+	}
+
+	statePath := filepath.Join(m.stateDir, username)
+	last, err := os.ReadFile(statePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if session == "" {
+		// The session we selected stays the one of the user until they choose another one.
+		if err := os.Remove(statePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if !m.isSessionInstalled(session) {
+		log.Warning(ctx, gotext.Get("Session %q is not installed, not selecting it for %s", session, username))
+		return nil
+	}
+
+	current, err := m.accountsService.Session(ctx, username)
+	if err != nil {
+		var dbusErr dbus.Error
+		if errors.As(err, &dbusErr) && dbusErr.Name == errDBusServiceUnknownName {
+			log.Warning(ctx, gotext.Get("AccountsService is not installed, skipping default session selection"))
+			return nil
+		}
+		return err
+	}
+	if current != session {
+		if last != nil && current != "" && current != string(last) {
+			log.Debugf(ctx, "%s chose the %s session, keeping it", username, current)
+			return nil
+		}
+		log.Debugf(ctx, "Selecting the %s session for %s", session, username)
+		if err := m.accountsService.SetSession(ctx, username, session); err != nil {
+			return err
+		}
+	}
+
+	if string(last) == session {
+		return nil
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, []byte(session), 0600)
+}
+
+// isSessionInstalled returns true if session is a Wayland or Xorg session installed on the machine.
+func (m *Manager) isSessionInstalled(session string) bool {
+	for _, dir := range []string{"wayland-sessions", "xsessions"} {
+		if _, err := os.Stat(filepath.Join(m.sessionsDataDir, dir, session+".desktop")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// userGroups returns the names of the groups username is a member of.
+func userGroups(username string) ([]string, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, gid := range gids {
+		g, err := user.LookupGroupId(gid)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+	return groups, nil
+}
+
+// dbusAccountsService selects the session of the users through the AccountsService D-Bus API.
+type dbusAccountsService struct {
+	bus *dbus.Conn
+}
+
+// user returns the AccountsService object of username.
+func (a dbusAccountsService) user(ctx context.Context, username string) (dbus.BusObject, error) {
+	var p dbus.ObjectPath
+	if err := a.bus.Object(accountsDbusRegisteredName, accountsDbusObjectPath).CallWithContext(ctx,
+		accountsDbusInterface+".FindUserByName", 0, username).Store(&p); err != nil {
+		return nil, err
+	}
+	return a.bus.Object(accountsDbusRegisteredName, p), nil
+}
+
+// Session returns the session currently selected by username.
+func (a dbusAccountsService) Session(ctx context.Context, username string) (string, error) {
+	u, err := a.user(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	v, err := u.GetProperty(accountsDbusUserInterface + ".Session")
+	if err != nil {
+		return "", err
+	}
+	session, ok := v.Value().(string)
+	if !ok {
+		return "", errors.New(gotext.Get("invalid session of %s: %v", username, v.Value()))
+	}
+	return session, nil
+}
+
+// SetSession selects session for username, for both the Wayland and Xorg display managers.
+func (a dbusAccountsService) SetSession(ctx context.Context, username, session string) error {
+	u, err := a.user(ctx, username)
+	if err != nil {
+		return err
+	}
+	if err := u.CallWithContext(ctx, accountsDbusUserInterface+".SetSession", 0, session).Err; err != nil {
+		return err
+	}
+	return u.CallWithContext(ctx, accountsDbusUserInterface+".SetXSession", 0, session).Err
+}
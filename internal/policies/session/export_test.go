@@ -0,0 +1,15 @@
+package session
+
+// WithAccountsService defines a custom AccountsService for tests.
+func WithAccountsService(a accountsService) Option {
+	return func(o *options) {
+		o.accountsService = a
+	}
+}
+
+// WithUserGroups defines a custom lookup of the groups of the users for tests.
+func WithUserGroups(f func(string) ([]string, error)) Option {
+	return func(o *options) {
+		o.userGroups = f
+	}
+}
@@ -0,0 +1,480 @@
+// Package session provides a manager that restricts the graphical sessions
+// available on the machine and selects the default session of the users.
+//
+// The following restrictions are supported for computer objects:
+//   - the display server of the sessions: GDM can be configured to only offer
+//     Wayland sessions or to forbid them. The keys are appended to the [daemon]
+//     section of the GDM custom configuration file, after a marker comment, so
+//     that they can be reverted without touching any administrator setting;
+//   - screen sharing portals: xdg-desktop-portal is configured to not use any
+//     backend for the listed portal interfaces. The portal configuration files
+//     shipped by the distribution are copied to the system configuration
+//     directory with the disabled interfaces set to "none";
+//   - remote desktop: a drop-in for the gnome-remote-desktop user service only
+//     allows it to start for members of some groups, or prevents it from starting
+//     altogether along with the system service providing remote login.
+//
+// Restrictions only take effect for new sessions. Every file is removed once its
+// corresponding setting is disabled or not configured anymore.
+//
+// For user objects, the default session is selected through AccountsService, which
+// the display manager uses to preselect the session on the login screen. The session
+// of the first listed group the user is a member of is selected, or the default session
+// otherwise. The last session selected by adsys for each user is saved in a state file:
+// if the user chose another session since then, their choice is kept.
+//
+// If a value can't be parsed, the manager returns an error and authentication will
+// be prevented.
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// gdmMarker precedes each display server key set by adsys in the GDM configuration file.
+	gdmMarker = "# Set by adsys. Do not edit: this setting is managed by a policy."
+
+	portalInterfacePrefix = "org.freedesktop.impl.portal."
+	remoteDesktopUnit     = "gnome-remote-desktop.service"
+	dropInName            = "99-adsys-session.conf"
+)
+
+// supportedPortals maps the lower case short names of the portals which can be disabled to their interface name.
+var supportedPortals = map[string]string{
+	"screencast":    "ScreenCast",
+	"remotedesktop": "RemoteDesktop",
+	"screenshot":    "Screenshot",
+}
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+
+// Manager restricts the graphical sessions of the machine.
+type Manager struct {
+	gdmConf        string
+	portalsConfDir string
+	portalsDataDir string
+	systemUnitDir  string
+	userUnitDir    string
+	systemdCaller  systemdCaller
+
+	stateDir        string
+	sessionsDataDir string
+	accountsService accountsService
+	userGroups      func(string) ([]string, error)
+}
+
+type systemdCaller interface {
+	DaemonReload(context.Context) error
+}
+
+type options struct {
+	gdmConf        string
+	portalsConfDir string
+	portalsDataDir string
+	systemUnitDir  string
+	userUnitDir    string
+
+	stateDir        string
+	sessionsDataDir string
+	accountsService accountsService
+	userGroups      func(string) ([]string, error)
+}
+
+// Option reprents an optional function to change the session manager.
+type Option func(*options)
+
+// WithGDMConf overrides the default GDM custom configuration file.
+func WithGDMConf(p string) func(*options) {
+	return func(a *options) {
+		a.gdmConf = p
+	}
+}
+
+// WithPortalsConfDir overrides the default xdg-desktop-portal system configuration directory.
+func WithPortalsConfDir(p string) func(*options) {
+	return func(a *options) {
+		a.portalsConfDir = p
+	}
+}
+
+// WithPortalsDataDir overrides the default directory of the xdg-desktop-portal configuration shipped by the distribution.
+func WithPortalsDataDir(p string) func(*options) {
+	return func(a *options) {
+		a.portalsDataDir = p
+	}
+}
+
+// WithSystemUnitDir overrides the default systemd system units directory.
+func WithSystemUnitDir(p string) func(*options) {
+	return func(a *options) {
+		a.systemUnitDir = p
+	}
+}
+
+// WithUserUnitDir overrides the default systemd user units directory.
+func WithUserUnitDir(p string) func(*options) {
+	return func(a *options) {
+		a.userUnitDir = p
+	}
+}
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithSessionsDataDir overrides the default directory containing the wayland-sessions and xsessions directories.
+func WithSessionsDataDir(p string) func(*options) {
+	return func(a *options) {
+		a.sessionsDataDir = p
+	}
+}
+
+// New returns a new manager for the session policy.
+func New(bus *dbus.Conn, systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		gdmConf:         consts.DefaultGDMCustomConf,
+		portalsConfDir:  consts.DefaultPortalsConfDir,
+		portalsDataDir:  consts.DefaultPortalsDataDir,
+		systemUnitDir:   consts.DefaultSystemUnitDir,
+		userUnitDir:     consts.DefaultUserUnitDir,
+		stateDir:        consts.DefaultStateDir,
+		sessionsDataDir: consts.DefaultSessionsDataDir,
+		accountsService: dbusAccountsService{bus: bus},
+		userGroups:      userGroups,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		gdmConf:        args.gdmConf,
+		portalsConfDir: args.portalsConfDir,
+		portalsDataDir: args.portalsDataDir,
+		systemUnitDir:  args.systemUnitDir,
+		userUnitDir:    args.userUnitDir,
+		systemdCaller:  systemdCaller,
+
+		stateDir:        filepath.Join(args.stateDir, "session"),
+		sessionsDataDir: args.sessionsDataDir,
+		accountsService: args.accountsService,
+		userGroups:      args.userGroups,
+	}
+}
+
+// ApplyPolicy restricts the display server, the screen sharing portals and the remote desktop services from the list of entries.
+// For users, it selects their default session instead.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply session policy to %s", objectName))
+
+	if !isComputer {
+		return m.applyDefaultSession(ctx, objectName, entries)
+	}
+
+	log.Debugf(ctx, "Applying session policy to %s", objectName)
+
+	var displayServer string
+	var portals, groups []string
+	var disableRemoteDesktop bool
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		switch e.Key {
+		case "display-server":
+			displayServer = strings.ToLower(strings.TrimSpace(e.Value))
+			if displayServer != "" && displayServer != "wayland" && displayServer != "xorg" {
+				return errors.New(gotext.Get("invalid display server %q: wayland or xorg is expected", e.Value))
+			}
+		case "disabled-portals":
+			for _, p := range splitLines(e.Value) {
+				name, ok := supportedPortals[strings.ToLower(strings.TrimPrefix(p, portalInterfacePrefix))]
+				if !ok {
+					return errors.New(gotext.Get("unsupported portal %q", p))
+				}
+				if !slices.Contains(portals, name) {
+					portals = append(portals, name)
+				}
+			}
+		case "disable-remote-desktop":
+			disableRemoteDesktop = true
+		case "remote-desktop-groups":
+			for _, g := range splitLines(e.Value) {
+				groups = append(groups, strings.TrimPrefix(g, "%"))
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing session entries, skipping it", e.Key))
+		}
+	}
+
+	if err := m.applyDisplayServer(ctx, displayServer); err != nil {
+		return err
+	}
+	if err := m.applyPortals(portals); err != nil {
+		return err
+	}
+	return m.applyRemoteDesktop(ctx, disableRemoteDesktop, groups)
+}
+
+// applyDisplayServer sets the display servers GDM can start sessions with.
+// An empty displayServer reverts to the GDM configuration set by the administrator.
+func (m *Manager) applyDisplayServer(ctx context.Context, displayServer string) error {
+	var keys []string
+	switch displayServer {
+	case "wayland":
+		keys = []string{"WaylandEnable=true", "XorgEnable=false"}
+	case "xorg":
+		keys = []string{"WaylandEnable=false"}
+	}
+
+	d, err := os.ReadFile(m.gdmConf)
+	if errors.Is(err, fs.ErrNotExist) {
+		if keys == nil {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Dir(m.gdmConf)); err != nil {
+			log.Warning(ctx, gotext.Get("GDM is not installed, skipping display server restriction"))
+			return nil
+		}
+		d = []byte("[daemon]\n")
+	} else if err != nil {
+		return err
+	}
+
+	// Remove any key we previously set, then append ours at the end of the [daemon] section, as the last
+	// occurrence of a key takes precedence.
+	var lines []string
+	daemonEnd := -1
+	inDaemon := false
+	srcLines := strings.Split(strings.TrimSuffix(string(d), "\n"), "\n")
+	for i := 0; i < len(srcLines); i++ {
+		l := srcLines[i]
+		if l == gdmMarker {
+			// Skip the marker and its key.
+			i++
+			continue
+		}
+		if trimmed := strings.TrimSpace(l); strings.HasPrefix(trimmed, "[") {
+			inDaemon = trimmed == "[daemon]"
+		}
+		lines = append(lines, l)
+		if inDaemon && strings.TrimSpace(l) != "" && !strings.HasPrefix(strings.TrimSpace(l), "#") {
+			daemonEnd = len(lines)
+		}
+	}
+
+	if keys != nil && daemonEnd == -1 {
+		lines = append(lines, "", "[daemon]")
+		daemonEnd = len(lines)
+	}
+	var managed []string
+	for _, k := range keys {
+		managed = append(managed, gdmMarker, k)
+	}
+	lines = slices.Insert(lines, max(daemonEnd, 0), managed...)
+
+	content := strings.Join(lines, "\n") + "\n"
+	if content == string(d) {
+		return nil
+	}
+	// nolint:gosec // G306 GDM configuration is world readable
+	if err := os.WriteFile(m.gdmConf+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(m.gdmConf+".new", m.gdmConf)
+}
+
+// applyPortals configures xdg-desktop-portal to not use any backend for the disabled portals.
+func (m *Manager) applyPortals(portals []string) error {
+	want := make(map[string]string)
+	if len(portals) > 0 {
+		confs, err := filepath.Glob(filepath.Join(m.portalsDataDir, "*portals.conf"))
+		if err != nil {
+			return err
+		}
+		for _, p := range confs {
+			d, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			want[filepath.Base(p)] = header + disablePortals(string(d), portals)
+		}
+	}
+
+	// Remove the configuration files we previously wrote and that are not needed anymore.
+	existing, err := filepath.Glob(filepath.Join(m.portalsConfDir, "*portals.conf"))
+	if err != nil {
+		return err
+	}
+	for _, p := range existing {
+		if _, ok := want[filepath.Base(p)]; ok {
+			continue
+		}
+		d, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(string(d), header) {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+
+	for name, content := range want {
+		if err := writeFile(filepath.Join(m.portalsConfDir, name), content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// disablePortals returns the portal configuration conf with the portals using no backend.
+func disablePortals(conf string, portals []string) string {
+	var lines []string
+	inPreferred, hasPreferred := false, false
+	for _, l := range strings.Split(strings.TrimSuffix(conf, "\n"), "\n") {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "[") {
+			if inPreferred {
+				lines = appendDisabledPortals(lines, portals)
+			}
+			inPreferred = trimmed == "[preferred]"
+			hasPreferred = hasPreferred || inPreferred
+		}
+		if inPreferred {
+			key, _, _ := strings.Cut(trimmed, "=")
+			if slices.Contains(portals, strings.TrimPrefix(strings.TrimSpace(key), portalInterfacePrefix)) {
+				continue
+			}
+		}
+		lines = append(lines, l)
+	}
+	if inPreferred {
+		lines = appendDisabledPortals(lines, portals)
+	}
+	if !hasPreferred {
+		lines = append(lines, "", "[preferred]")
+		lines = appendDisabledPortals(lines, portals)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// appendDisabledPortals appends the keys disabling portals to lines, before any trailing empty line.
+func appendDisabledPortals(lines []string, portals []string) []string {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	var keys []string
+	for _, p := range portals {
+		keys = append(keys, fmt.Sprintf("%s%s=none", portalInterfacePrefix, p))
+	}
+	return slices.Insert(lines, end, keys...)
+}
+
+// applyRemoteDesktop restricts the gnome-remote-desktop services with drop-ins.
+// If disable is true, the services can't be started anymore. Otherwise, if groups is not empty,
+// the user service can only be started by members of those groups.
+func (m *Manager) applyRemoteDesktop(ctx context.Context, disable bool, groups []string) error {
+	var userDropIn, systemDropIn string
+	if disable {
+		userDropIn = header + "[Unit]\n# Remote desktop is disabled by policy\nConditionPathExists=!/\n"
+		systemDropIn = userDropIn
+	} else if len(groups) > 0 {
+		userDropIn = header + "[Unit]\n"
+		for _, g := range groups {
+			userDropIn += fmt.Sprintf("ConditionGroup=|%s\n", g)
+		}
+	}
+
+	if _, err := updateFile(filepath.Join(m.userUnitDir, remoteDesktopUnit+".d", dropInName), userDropIn); err != nil {
+		return err
+	}
+	changed, err := updateFile(filepath.Join(m.systemUnitDir, remoteDesktopUnit+".d", dropInName), systemDropIn)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	log.Debugf(ctx, "Remote desktop system service restriction changed, reloading systemd")
+	return m.systemdCaller.DaemonReload(ctx)
+}
+
+// splitLines returns the non empty trimmed lines of v.
+func splitLines(v string) []string {
+	var r []string
+	for _, l := range strings.Split(v, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			r = append(r, l)
+		}
+	}
+	return r
+}
+
+// updateFile writes content to p if it differs from its current content, or removes p, and then its parent
+// directory if empty, when content is empty.
+// It returns true if the file changed.
+func updateFile(p, content string) (changed bool, err error) {
+	d, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	exists := err == nil
+
+	if content == "" {
+		if !exists {
+			return false, nil
+		}
+		if err := os.Remove(p); err != nil {
+			return false, err
+		}
+		// Only remove the drop-in directory if we were the only one using it: ignore errors when it is not empty.
+		_ = os.Remove(filepath.Dir(p))
+		return true, nil
+	}
+
+	if exists && string(d) == content {
+		return false, nil
+	}
+	return true, writeFile(p, content)
+}
+
+// writeFile atomically writes content to p, creating the parent directories if needed.
+func writeFile(p, content string) error {
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 those files are world readable configuration files
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
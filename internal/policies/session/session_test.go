@@ -0,0 +1,246 @@
+package session_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/session"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "display-server", Value: "xorg"},
+		{Key: "disabled-portals", Value: "ScreenCast"},
+		{Key: "disable-remote-desktop"},
+	}
+
+	tests := map[string]struct {
+		entries         []entry.Entry
+		isNotComputer   bool
+		existingDirs    string
+		conflictingPath string
+
+		daemonReloadError bool
+
+		wantDaemonReload bool
+		wantErr          bool
+	}{
+		"Force Wayland sessions":                      {entries: []entry.Entry{{Key: "display-server", Value: "wayland"}}, existingDirs: "default"},
+		"Forbid Wayland sessions":                     {entries: []entry.Entry{{Key: "display-server", Value: "xorg"}}, existingDirs: "default"},
+		"Display server is case insensitive":          {entries: []entry.Entry{{Key: "display-server", Value: " Wayland\n"}}, existingDirs: "default"},
+		"Display server without daemon section":       {entries: []entry.Entry{{Key: "display-server", Value: "xorg"}}, existingDirs: "no-sections"},
+		"Display server without GDM is a no-op":       {entries: []entry.Entry{{Key: "display-server", Value: "xorg"}}},
+		"Disable one portal":                          {entries: []entry.Entry{{Key: "disabled-portals", Value: "ScreenCast"}}, existingDirs: "default"},
+		"Disable multiple portals":                    {entries: []entry.Entry{{Key: "disabled-portals", Value: "screencast\norg.freedesktop.impl.portal.RemoteDesktop\n\nScreenshot\nScreenCast"}}, existingDirs: "default"},
+		"Disable portal without preferred section":    {entries: []entry.Entry{{Key: "disabled-portals", Value: "ScreenCast"}}, existingDirs: "no-sections"},
+		"Disable portal without portal configuration": {entries: []entry.Entry{{Key: "disabled-portals", Value: "ScreenCast"}}},
+		"Disable remote desktop":                      {entries: []entry.Entry{{Key: "disable-remote-desktop"}}, existingDirs: "default", wantDaemonReload: true},
+		"Restrict remote desktop to groups":           {entries: []entry.Entry{{Key: "remote-desktop-groups", Value: "%rdp-users@example.com\nhelpdesk@example.com"}}, existingDirs: "default"},
+		"Disable remote desktop prevails over groups": {entries: []entry.Entry{{Key: "disable-remote-desktop"}, {Key: "remote-desktop-groups", Value: "rdp-users"}}, existingDirs: "default", wantDaemonReload: true},
+		"All entries":                                 {entries: allEntries, existingDirs: "default", wantDaemonReload: true},
+		"All entries already applied":                 {entries: allEntries, existingDirs: "all-applied"},
+		"Update applied entries":                      {entries: []entry.Entry{{Key: "display-server", Value: "wayland"}, {Key: "disabled-portals", Value: "RemoteDesktop"}, {Key: "remote-desktop-groups", Value: "rdp-users"}}, existingDirs: "all-applied", wantDaemonReload: true},
+		"Disabled entries are ignored":                {entries: []entry.Entry{{Key: "display-server", Value: "xorg", Disabled: true}, {Key: "disable-remote-desktop", Disabled: true}}, existingDirs: "default"},
+		"Unsupported keys are ignored":                {entries: []entry.Entry{{Key: "display-server", Value: "xorg"}, {Key: "screen-lock", Value: "true"}}, existingDirs: "default"},
+		"No entries":                                  {existingDirs: "default"},
+		"No entries reverts applied entries":          {existingDirs: "all-applied", wantDaemonReload: true},
+		"Restrictions are ignored for users":          {isNotComputer: true, entries: allEntries, existingDirs: "default"},
+
+		// Error cases
+		"Error on invalid display server":             {entries: []entry.Entry{{Key: "display-server", Value: "mir"}}, existingDirs: "default", wantErr: true},
+		"Error on unsupported portal":                 {entries: []entry.Entry{{Key: "disabled-portals", Value: "ScreenCast\nCamera"}}, existingDirs: "default", wantErr: true},
+		"Error on daemon reload failure":              {entries: []entry.Entry{{Key: "disable-remote-desktop"}}, existingDirs: "default", daemonReloadError: true, wantErr: true},
+		"Error on unwritable GDM configuration":       {entries: []entry.Entry{{Key: "display-server", Value: "xorg"}}, existingDirs: "default", conflictingPath: "etc/gdm3/custom.conf.new/", wantErr: true},
+		"Error on unwritable portals directory":       {entries: []entry.Entry{{Key: "disabled-portals", Value: "ScreenCast"}}, existingDirs: "default", conflictingPath: "etc/xdg", wantErr: true},
+		"Error on unwritable user units directory":    {entries: []entry.Entry{{Key: "remote-desktop-groups", Value: "rdp-users"}}, existingDirs: "default", conflictingPath: "etc/systemd/user", wantErr: true},
+		"Error on unwritable system units directory":  {entries: []entry.Entry{{Key: "disable-remote-desktop"}}, existingDirs: "default", conflictingPath: "etc/systemd/system", wantErr: true},
+		"Error on unreadable shipped portal settings": {entries: []entry.Entry{{Key: "disabled-portals", Value: "ScreenCast"}}, existingDirs: "default", conflictingPath: "usr/share/xdg-desktop-portal/other-portals.conf/", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.conflictingPath != "" {
+				p := filepath.Join(root, tc.conflictingPath)
+				if tc.conflictingPath[len(tc.conflictingPath)-1] == '/' {
+					// A directory where a file is expected.
+					require.NoError(t, os.MkdirAll(p, 0750), "Setup: can't create directory")
+				} else {
+					require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create parent directory")
+					require.NoError(t, os.RemoveAll(p), "Setup: can't remove existing directory")
+					// A file in place of a directory prevents creating anything under it.
+					require.NoError(t, os.WriteFile(p, []byte("not a directory"), 0600), "Setup: can't create file")
+				}
+			}
+
+			systemd := &mockSystemdCaller{wantError: tc.daemonReloadError}
+			m := session.New(nil, systemd,
+				session.WithStateDir(filepath.Join(root, "var", "lib", "adsys")),
+				session.WithGDMConf(filepath.Join(root, "etc", "gdm3", "custom.conf")),
+				session.WithPortalsConfDir(filepath.Join(root, "etc", "xdg", "xdg-desktop-portal")),
+				session.WithPortalsDataDir(filepath.Join(root, "usr", "share", "xdg-desktop-portal")),
+				session.WithSystemUnitDir(filepath.Join(root, "etc", "systemd", "system")),
+				session.WithUserUnitDir(filepath.Join(root, "etc", "systemd", "user")),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			require.Equal(t, tc.wantDaemonReload, systemd.daemonReloaded, "systemd daemon reload should be called only when the system drop-in changes")
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestApplyDefaultSession(t *testing.T) {
+	t.Parallel()
+
+	groupSessions := "%kiosk-users@example.com=ubuntu-kiosk\nDevelopers@example.com = ubuntu-xorg"
+
+	tests := map[string]struct {
+		entries      []entry.Entry
+		groups       []string
+		current      string
+		lastSelected string
+
+		noAccountsService bool
+		groupsError       bool
+		getError          bool
+		setError          bool
+
+		wantSelected string
+		wantState    string
+		wantErr      bool
+	}{
+		"Select default session":                              {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}}, wantSelected: "ubuntu", wantState: "ubuntu"},
+		"Select session of group":                             {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}, {Key: "default-session-groups", Value: groupSessions}}, groups: []string{"users", "developers@example.com"}, wantSelected: "ubuntu-xorg", wantState: "ubuntu-xorg"},
+		"First matching group takes precedence":               {entries: []entry.Entry{{Key: "default-session-groups", Value: groupSessions}}, groups: []string{"developers@example.com", "kiosk-users@example.com"}, wantSelected: "ubuntu-kiosk", wantState: "ubuntu-kiosk"},
+		"Default session when not member of any group":        {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}, {Key: "default-session-groups", Value: groupSessions}}, groups: []string{"users"}, wantSelected: "ubuntu", wantState: "ubuntu"},
+		"Replace session previously selected":                 {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu-xorg"}}, current: "ubuntu", lastSelected: "ubuntu", wantSelected: "ubuntu-xorg", wantState: "ubuntu-xorg"},
+		"Replace session of the user on first selection":      {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}}, current: "ubuntu-xorg", wantSelected: "ubuntu", wantState: "ubuntu"},
+		"Keep session chosen by the user":                     {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}}, current: "ubuntu-xorg", lastSelected: "ubuntu", wantState: "ubuntu"},
+		"Session already selected only saves state":           {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}}, current: "ubuntu", wantState: "ubuntu"},
+		"Session not installed is not selected":               {entries: []entry.Entry{{Key: "default-session", Value: "plasma"}}, lastSelected: "ubuntu", wantState: "ubuntu"},
+		"No entries forgets the session previously selected":  {current: "ubuntu", lastSelected: "ubuntu"},
+		"Disabled entries are ignored":                        {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu", Disabled: true}}},
+		"Unsupported keys are ignored":                        {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}, {Key: "display-server", Value: "xorg"}}, wantSelected: "ubuntu", wantState: "ubuntu"},
+		"AccountsService not installed is a no-op":            {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}}, noAccountsService: true},
+		"Groups are not looked up without sessions of groups": {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}}, groupsError: true, wantSelected: "ubuntu", wantState: "ubuntu"},
+
+		// Error cases
+		"Error on invalid session name":     {entries: []entry.Entry{{Key: "default-session", Value: "../ubuntu"}}, wantErr: true},
+		"Error on group without session":    {entries: []entry.Entry{{Key: "default-session-groups", Value: "developers@example.com"}}, wantErr: true},
+		"Error on invalid session of group": {entries: []entry.Entry{{Key: "default-session-groups", Value: "developers@example.com="}}, wantErr: true},
+		"Error on groups lookup failure":    {entries: []entry.Entry{{Key: "default-session-groups", Value: groupSessions}}, groupsError: true, wantErr: true},
+		"Error on reading current session":  {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}}, getError: true, wantErr: true},
+		"Error on selecting session":        {entries: []entry.Entry{{Key: "default-session", Value: "ubuntu"}}, setError: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			for _, p := range []string{"wayland-sessions/ubuntu.desktop", "wayland-sessions/ubuntu-kiosk.desktop", "xsessions/ubuntu-xorg.desktop"} {
+				p = filepath.Join(root, "usr", "share", p)
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create sessions directory")
+				require.NoError(t, os.WriteFile(p, []byte("[Desktop Entry]\n"), 0600), "Setup: can't create session")
+			}
+			stateFile := filepath.Join(root, "var", "lib", "adsys", "session", "user@example.com")
+			if tc.lastSelected != "" {
+				require.NoError(t, os.MkdirAll(filepath.Dir(stateFile), 0750), "Setup: can't create state directory")
+				require.NoError(t, os.WriteFile(stateFile, []byte(tc.lastSelected), 0600), "Setup: can't create state file")
+			}
+
+			accounts := &mockAccountsService{current: tc.current, serviceUnknown: tc.noAccountsService, getError: tc.getError, setError: tc.setError}
+			m := session.New(nil, &mockSystemdCaller{},
+				session.WithStateDir(filepath.Join(root, "var", "lib", "adsys")),
+				session.WithSessionsDataDir(filepath.Join(root, "usr", "share")),
+				session.WithAccountsService(accounts),
+				session.WithUserGroups(func(string) ([]string, error) {
+					if tc.groupsError {
+						return nil, errors.New("groups lookup error")
+					}
+					return tc.groups, nil
+				}),
+			)
+			err := m.ApplyPolicy(context.Background(), "user@example.com", false, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			require.Equal(t, tc.wantSelected, accounts.selected, "ApplyPolicy should have selected the expected session")
+			if tc.wantState == "" {
+				require.NoFileExists(t, stateFile, "State file should not exist")
+				return
+			}
+			got, err := os.ReadFile(stateFile)
+			require.NoError(t, err, "State file should have been written")
+			require.Equal(t, tc.wantState, string(got), "State file should contain the last selected session")
+		})
+	}
+}
+
+type mockAccountsService struct {
+	current        string
+	serviceUnknown bool
+	getError       bool
+	setError       bool
+
+	selected string
+}
+
+func (a *mockAccountsService) Session(_ context.Context, _ string) (string, error) {
+	if a.serviceUnknown {
+		return "", dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}
+	}
+	if a.getError {
+		return "", errors.New("failed to get session")
+	}
+	return a.current, nil
+}
+
+func (a *mockAccountsService) SetSession(_ context.Context, _, session string) error {
+	if a.setError {
+		return errors.New("failed to set session")
+	}
+	a.selected = session
+	return nil
+}
+
+type mockSystemdCaller struct {
+	wantError bool
+
+	daemonReloaded bool
+}
+
+func (s *mockSystemdCaller) DaemonReload(_ context.Context) error {
+	if s.wantError {
+		return errors.New("failed to reload systemd")
+	}
+	s.daemonReloaded = true
+	return nil
+}
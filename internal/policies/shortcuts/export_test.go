@@ -0,0 +1,10 @@
+package shortcuts
+
+import "os/user"
+
+// WithUserLookup defines a custom userLookup function for tests.
+func WithUserLookup(f func(string) (*user.User, error)) func(*options) {
+	return func(o *options) {
+		o.userLookup = f
+	}
+}
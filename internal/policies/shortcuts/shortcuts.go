@@ -0,0 +1,767 @@
+// Package shortcuts provides a manager that creates desktop and applications menu shortcuts.
+//
+// The following settings are supported:
+//   - shortcuts/deploy: shortcuts of the applications menu for all users of the machine;
+//   - shortcuts/user-deploy: shortcuts of the user, in the applications menu, on the desktop or started when the
+//     user logs in.
+//
+// Shortcuts are listed one per line, of the form
+// name=<name>, target=<target>[, type=application|link][, arguments=<args>][, workdir=<dir>][, icon=<icon>][, iconfile=<path>][, comment=<text>][, location=menu|desktop|autostart]
+// where an application target is the command to run and a link target is a URL or a path opened with the
+// default application. The type defaults to link for URLs and to application otherwise. icon is an icon
+// name or an absolute path, while iconfile is relative to the shortcuts/ directory of the assets share.
+//
+// Items of the Group Policy Preferences "Shortcuts" extension are converted to those settings when the
+// GPOs are parsed.
+//
+// Each shortcut is a .desktop file named after the shortcut name. Machine shortcuts and their icons are
+// written in /usr/local/share/applications and /usr/local/share/icons, while user shortcuts are written
+// in the home directory of the user, in ~/.local/share/applications, in the XDG desktop directory or in
+// ~/.config/autostart, with their icons in ~/.local/share/icons.
+// The created files are saved in a state file per object, so that they are removed once they are not
+// configured anymore.
+package shortcuts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// assetsDir is the directory of the assets share the icons are copied from.
+	assetsDir = "shortcuts"
+	// filePrefix is the prefix of the shortcuts and icons created by adsys.
+	filePrefix = "adsys-"
+
+	typeApplication = "application"
+	typeLink        = "link"
+
+	locationMenu      = "menu"
+	locationDesktop   = "desktop"
+	locationAutostart = "autostart"
+)
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+
+// iconExtensions are the extensions of the icon files supported by the icon themes.
+var iconExtensions = []string{".png", ".svg", ".xpm"}
+
+// slugRe matches the characters which are not kept in the shortcut file names.
+var slugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// shortcut is a shortcut to create.
+type shortcut struct {
+	name      string
+	target    string
+	typ       string
+	arguments string
+	workdir   string
+	icon      string
+	iconFile  string
+	comment   string
+	location  string
+}
+
+// id returns the identifier of the shortcut, used to name its files.
+func (s shortcut) id() string {
+	slug := strings.Trim(slugRe.ReplaceAllString(strings.ToLower(s.name), "-"), "-")
+	if slug == "" {
+		// Names without any latin letter nor digit.
+		slug = fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(s.name)))
+	}
+	return slug
+}
+
+// Kinds of directories the files are created in, as saved in the state.
+const (
+	dirApplications = "applications"
+	dirDesktop      = "desktop"
+	dirAutostart    = "autostart"
+	dirIcons        = "icons"
+)
+
+// state is the list of files created by adsys for an object.
+type state struct {
+	// Files are the shortcuts and icons created, of the form <directory kind>/<file name>.
+	Files []string `json:"files,omitempty"`
+}
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// Manager applies the shortcuts policy.
+type Manager struct {
+	stateDir        string
+	applicationsDir string
+	iconsDir        string
+
+	userLookup func(string) (*user.User, error)
+}
+
+type options struct {
+	stateDir        string
+	applicationsDir string
+	iconsDir        string
+
+	userLookup func(string) (*user.User, error)
+}
+
+// Option reprents an optional function to change the shortcuts manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithApplicationsDir overrides the default directory of the machine shortcuts.
+func WithApplicationsDir(p string) func(*options) {
+	return func(a *options) {
+		a.applicationsDir = p
+	}
+}
+
+// WithIconsDir overrides the default directory of the icons of the machine shortcuts.
+func WithIconsDir(p string) func(*options) {
+	return func(a *options) {
+		a.iconsDir = p
+	}
+}
+
+// New returns a new manager for the shortcuts policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:        consts.DefaultStateDir,
+		applicationsDir: consts.DefaultShortcutsApplicationsDir,
+		iconsDir:        consts.DefaultShortcutsIconsDir,
+		userLookup:      user.Lookup,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:        filepath.Join(args.stateDir, "shortcuts"),
+		applicationsDir: args.applicationsDir,
+		iconsDir:        args.iconsDir,
+		userLookup:      args.userLookup,
+	}
+}
+
+// destination is where the files of an object are created.
+type destination struct {
+	// home is the home directory of the user, which must exist, and is empty for the machine.
+	home         string
+	applications string
+	desktop      string
+	autostart    string
+	icons        string
+	// uid and gid own the created files of the user, and are -1 for the machine.
+	uid, gid int
+}
+
+// path returns the path of the file f, of the form <directory kind>/<file name>, in dest.
+// It returns false if the directory is not available.
+func (dest destination) path(f string) (string, bool) {
+	kind, name, _ := strings.Cut(f, "/")
+	var dir string
+	switch kind {
+	case dirApplications:
+		dir = dest.applications
+	case dirDesktop:
+		dir = dest.desktop
+	case dirAutostart:
+		dir = dest.autostart
+	case dirIcons:
+		dir = dest.icons
+	}
+	if dir == "" || name == "" || strings.ContainsRune(name, '/') || name == "." || name == ".." {
+		return "", false
+	}
+	return filepath.Join(dir, name), true
+}
+
+// ApplyPolicy creates the shortcuts of objectName from the list of entries, and removes the ones not configured anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply shortcuts policy to %s", objectName))
+
+	log.Debugf(ctx, "Applying shortcuts policy to %s", objectName)
+
+	shortcuts, err := parseEntries(ctx, entries, isComputer)
+	if err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(m.stateDir, objectName+".json")
+	prev, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to apply nor to revert.
+	if len(shortcuts) == 0 && len(prev.Files) == 0 {
+		return nil
+	}
+
+	dest := destination{
+		applications: m.applicationsDir,
+		icons:        m.iconsDir,
+		uid:          -1,
+		gid:          -1,
+	}
+	if !isComputer {
+		var ok bool
+		if dest, ok, err = m.userDestination(ctx, objectName); err != nil || !ok {
+			return err
+		}
+	}
+
+	var assets string
+	if slices.ContainsFunc(shortcuts, func(s shortcut) bool { return s.iconFile != "" }) {
+		if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+			return err
+		}
+		tmp, err := os.MkdirTemp(m.stateDir, "assets-")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if errRemove := os.RemoveAll(tmp); errRemove != nil {
+				err = errors.Join(err, errRemove)
+			}
+		}()
+		// Only root can read the assets until the icons are copied.
+		assets = filepath.Join(tmp, assetsDir)
+		if err := assetsDumper(ctx, assetsDir+"/", assets, -1, -1); err != nil {
+			return err
+		}
+	}
+
+	var created []string
+	for _, s := range shortcuts {
+		files, err := m.create(ctx, dest, assets, s)
+		created = mergeFiles(created, files)
+		if err != nil {
+			// Still save the files created so far, so that they can be removed.
+			return errors.Join(err, saveState(statePath, state{Files: mergeFiles(prev.Files, created)}))
+		}
+	}
+
+	for _, f := range prev.Files {
+		if slices.Contains(created, f) {
+			continue
+		}
+		p, ok := dest.path(f)
+		if !ok {
+			continue
+		}
+		log.Infof(ctx, "Removing shortcut file %s, not configured anymore", p)
+		if err := removeFile(dest, p); err != nil {
+			return errors.Join(err, saveState(statePath, state{Files: mergeFiles(prev.Files, created)}))
+		}
+	}
+
+	return saveState(statePath, state{Files: created})
+}
+
+// DumpState returns the shortcuts and icons created during the last refresh of the machine or of the user.
+// The state is empty if no shortcuts policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump shortcuts state of %s", objectName))
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, objectName+".json"))
+}
+
+// userDestination returns where the files of the user objectName are created.
+// It returns false if the home directory of the user doesn't exist yet.
+func (m *Manager) userDestination(ctx context.Context, objectName string) (dest destination, ok bool, err error) {
+	u, err := m.userLookup(objectName)
+	if err != nil {
+		return dest, false, errors.New(gotext.Get("failed to retrieve user information: %v", err))
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return dest, false, errors.New(gotext.Get("couldn't convert %q to a valid uid for %q", u.Uid, objectName))
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return dest, false, errors.New(gotext.Get("couldn't convert %q to a valid gid for %q", u.Gid, objectName))
+	}
+
+	home := filepath.Clean(u.HomeDir)
+	if _, err := os.Stat(home); errors.Is(err, fs.ErrNotExist) {
+		log.Warning(ctx, gotext.Get("Home directory of %s doesn't exist yet, the shortcuts will be created on next refresh", objectName))
+		return dest, false, nil
+	} else if err != nil {
+		return dest, false, err
+	}
+
+	return destination{
+		home:         home,
+		applications: filepath.Join(home, ".local", "share", "applications"),
+		desktop:      desktopDir(ctx, home),
+		autostart:    filepath.Join(home, ".config", "autostart"),
+		icons:        filepath.Join(home, ".local", "share", "icons"),
+		uid:          uid,
+		gid:          gid,
+	}, true, nil
+}
+
+// desktopDir returns the XDG desktop directory of the user whose home directory is home, or an empty
+// string if the user disabled it.
+// It defaults to ~/Desktop if the user didn't configure it.
+func desktopDir(ctx context.Context, home string) string {
+	dir := filepath.Join(home, "Desktop")
+
+	f, err := os.Open(filepath.Join(home, ".config", "user-dirs.dirs"))
+	if err != nil {
+		return dir
+	}
+	defer decorate.LogFuncOnErrorContext(ctx, f.Close)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found || k != "XDG_DESKTOP_DIR" {
+			continue
+		}
+		// The value is either an absolute path or relative to $HOME, in double quotes.
+		v = strings.Trim(v, `"`)
+		if rel, ok := strings.CutPrefix(v, "$HOME"); ok {
+			v = home + rel
+		}
+		v = filepath.Clean(v)
+		if v == home {
+			return ""
+		}
+		if !strings.HasPrefix(v, home+"/") {
+			log.Warning(ctx, gotext.Get("Desktop directory %q is not in the home directory, using %q instead", v, dir))
+			return dir
+		}
+		dir = v
+	}
+	return dir
+}
+
+// create creates the desktop file of the shortcut s and its icon, if any, in dest.
+// It returns the files it created, of the form <directory kind>/<file name>.
+func (m *Manager) create(ctx context.Context, dest destination, assets string, s shortcut) (files []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't create shortcut %q", s.name))
+
+	kind, mode := dirApplications, fs.FileMode(0644)
+	switch s.location {
+	case locationDesktop:
+		if dest.desktop == "" {
+			log.Warning(ctx, gotext.Get("Desktop directory is disabled, skipping shortcut %q", s.name))
+			return nil, nil
+		}
+		// Desktop icons of file managers are only launched if they are executable.
+		kind, mode = dirDesktop, 0755
+	case locationAutostart:
+		kind = dirAutostart
+	}
+
+	icon := s.icon
+	if s.iconFile != "" {
+		src := filepath.Join(assets, filepath.FromSlash(s.iconFile))
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, errors.New(gotext.Get("icon not found in the assets share: %v", err))
+		}
+		if !fi.Mode().IsRegular() {
+			return nil, errors.New(gotext.Get("icon %q is not a regular file", s.iconFile))
+		}
+		content, err := os.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		// The icons directory is an icon theme base directory: the icon is looked up by its name.
+		icon = filePrefix + s.id()
+		f := dirIcons + "/" + icon + strings.ToLower(filepath.Ext(s.iconFile))
+		p, _ := dest.path(f)
+		if err := writeFile(ctx, dest, p, content, 0644); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	f := kind + "/" + filePrefix + s.id() + ".desktop"
+	p, _ := dest.path(f)
+	if err := writeFile(ctx, dest, p, desktopEntry(s, icon), mode); err != nil {
+		return files, err
+	}
+	return append(files, f), nil
+}
+
+// desktopEntry returns the content of the desktop file of the shortcut s with icon.
+func desktopEntry(s shortcut, icon string) []byte {
+	exec := quoteExecArg(s.target)
+	if s.typ == typeLink {
+		exec = "xdg-open " + exec
+	} else if s.arguments != "" {
+		exec += " " + strings.ReplaceAll(s.arguments, "%", "%%")
+	}
+
+	var b bytes.Buffer
+	b.WriteString(header)
+	b.WriteString("[Desktop Entry]\n")
+	b.WriteString("Type=Application\n")
+	b.WriteString("Version=1.0\n")
+	fmt.Fprintf(&b, "Name=%s\n", escapeValue(s.name))
+	if s.comment != "" {
+		fmt.Fprintf(&b, "Comment=%s\n", escapeValue(s.comment))
+	}
+	fmt.Fprintf(&b, "Exec=%s\n", escapeValue(exec))
+	if s.workdir != "" {
+		fmt.Fprintf(&b, "Path=%s\n", escapeValue(s.workdir))
+	}
+	if icon != "" {
+		fmt.Fprintf(&b, "Icon=%s\n", escapeValue(icon))
+	}
+	return b.Bytes()
+}
+
+// quoteExecArg quotes arg for the Exec key of desktop files, if it contains reserved characters.
+func quoteExecArg(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	if !strings.ContainsAny(arg, " \t\n\"'\\><~|&;$*?#()`") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`"`, `\"`, "`", "\\`", `$`, `\$`, `\`, `\\`).Replace(arg) + `"`
+}
+
+// escapeValue escapes v as a string value of desktop files.
+func escapeValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\t", `\t`, "\r", `\r`).Replace(v)
+}
+
+// writeFile writes content to p with mode, owned by the user of dest, if it changed.
+// Missing parent directories in the home directory of the user are created and owned by the user.
+func writeFile(ctx context.Context, dest destination, p string, content []byte, mode fs.FileMode) (err error) {
+	if err := mkdirAll(dest, filepath.Dir(p)); err != nil {
+		return err
+	}
+
+	if unchanged(p, content, mode, dest.uid, dest.gid) {
+		log.Debugf(ctx, "Shortcut file %s is up to date", p)
+		return nil
+	}
+	log.Infof(ctx, "Writing shortcut file %s", p)
+
+	// Don't reuse nor follow any file or symlink the user may have created in their home directory.
+	if err := os.Remove(p + ".adsys.new"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(p+".adsys.new", os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		return errors.Join(err, f.Close(), os.Remove(p+".adsys.new"))
+	}
+	if dest.uid >= 0 {
+		if err := f.Chown(dest.uid, dest.gid); err != nil {
+			return errors.Join(err, f.Close(), os.Remove(p+".adsys.new"))
+		}
+	}
+	// Change the mode once the file is owned by the right user, and after any umask is applied.
+	if err := f.Chmod(mode); err != nil {
+		return errors.Join(err, f.Close(), os.Remove(p+".adsys.new"))
+	}
+	if err := f.Close(); err != nil {
+		return errors.Join(err, os.Remove(p+".adsys.new"))
+	}
+	return os.Rename(p+".adsys.new", p)
+}
+
+// mkdirAll creates the directory dir, and its parents, for dest.
+// In the home directory of a user, the directories are owned by the user and can't be symlinks.
+func mkdirAll(dest destination, dir string) error {
+	if dest.home == "" {
+		// nolint:gosec // G301 match distribution permission
+		return os.MkdirAll(dir, 0755)
+	}
+
+	rel, err := filepath.Rel(dest.home, dir)
+	if err != nil || !filepath.IsLocal(rel) {
+		return errors.New(gotext.Get("%q is not in the home directory %q", dir, dest.home))
+	}
+	cur := dest.home
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, c)
+		fi, err := os.Lstat(cur)
+		if errors.Is(err, fs.ErrNotExist) {
+			// nolint:gosec // G301 match distribution permission
+			if err := os.Mkdir(cur, 0755); err != nil {
+				return err
+			}
+			if err := os.Lchown(cur, dest.uid, dest.gid); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return errors.New(gotext.Get("%q is not a directory", cur))
+		}
+	}
+	return nil
+}
+
+// removeFile removes the file p created for dest.
+func removeFile(dest destination, p string) error {
+	if dest.home != "" {
+		// Only remove files which are still in the home directory of the user, without following symlinks.
+		rel, err := filepath.Rel(dest.home, p)
+		if err != nil || !filepath.IsLocal(rel) {
+			return errors.New(gotext.Get("%q is not in the home directory %q", p, dest.home))
+		}
+		cur := dest.home
+		for _, c := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+			cur = filepath.Join(cur, c)
+			if fi, err := os.Lstat(cur); errors.Is(err, fs.ErrNotExist) {
+				return nil
+			} else if err != nil {
+				return err
+			} else if !fi.IsDir() {
+				return nil
+			}
+		}
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// unchanged returns true if p exists with the given content, permissions and ownership.
+// The ownership is not checked if uid is negative.
+func unchanged(p string, content []byte, mode fs.FileMode, uid, gid int) bool {
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm() != mode {
+		return false
+	}
+	if uid >= 0 {
+		if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid || int(st.Gid) != gid {
+			return false
+		}
+	}
+	d, err := os.ReadFile(p)
+	return err == nil && bytes.Equal(d, content)
+}
+
+// parseEntries validates the entries and returns the shortcuts to create, in order.
+func parseEntries(ctx context.Context, entries []entry.Entry, isComputer bool) (shortcuts []shortcut, err error) {
+	key := "shortcuts/user-deploy"
+	if isComputer {
+		key = "shortcuts/deploy"
+	}
+
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		if e.Key != key {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing shortcuts entries, skipping it", e.Key))
+			continue
+		}
+
+		for _, l := range strings.Split(v, "\n") {
+			l = strings.TrimSpace(l)
+			if l == "" {
+				continue
+			}
+			s, err := parseShortcut(l, isComputer)
+			if err != nil {
+				return nil, err
+			}
+			// Shortcuts from the closest GPO are listed last: they override the ones from further GPOs.
+			if i := slices.IndexFunc(shortcuts, func(o shortcut) bool { return o.id() == s.id() && o.location == s.location }); i >= 0 {
+				shortcuts = slices.Delete(shortcuts, i, i+1)
+			}
+			shortcuts = append(shortcuts, s)
+		}
+	}
+
+	return shortcuts, nil
+}
+
+// parseShortcut parses a shortcut line of the form
+// name=<name>, target=<target>[, type=application|link][, arguments=<args>][, workdir=<dir>][, icon=<icon>][, iconfile=<path>][, comment=<text>][, location=menu|desktop|autostart].
+func parseShortcut(l string, isComputer bool) (s shortcut, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid shortcut %q", l))
+
+	usage := gotext.Get("expected name=<name>, target=<target>[, type=application|link][, arguments=<args>][, workdir=<dir>][, icon=<icon>][, iconfile=<path>][, comment=<text>][, location=menu|desktop|autostart]")
+	for _, field := range strings.Split(l, ",") {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return s, errors.New(usage)
+		}
+
+		var dest *string
+		switch k {
+		case "name":
+			dest = &s.name
+		case "target":
+			dest = &s.target
+		case "type":
+			dest = &s.typ
+		case "arguments":
+			dest = &s.arguments
+		case "workdir":
+			dest = &s.workdir
+		case "icon":
+			dest = &s.icon
+		case "iconfile":
+			dest = &s.iconFile
+		case "comment":
+			dest = &s.comment
+		case "location":
+			dest = &s.location
+		default:
+			return s, errors.New(gotext.Get("unsupported field %q", k))
+		}
+		if *dest != "" {
+			return s, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		*dest = v
+	}
+
+	if s.name == "" || s.target == "" {
+		return s, errors.New(usage)
+	}
+
+	switch strings.ToLower(s.typ) {
+	case "":
+		s.typ = typeApplication
+		if strings.Contains(s.target, "://") || strings.HasPrefix(s.target, "mailto:") {
+			s.typ = typeLink
+		}
+	case typeApplication, typeLink:
+		s.typ = strings.ToLower(s.typ)
+	default:
+		return s, errors.New(gotext.Get("type %q must be %s or %s", s.typ, typeApplication, typeLink))
+	}
+	if s.typ == typeLink && s.arguments != "" {
+		return s, errors.New(gotext.Get("arguments are only supported for applications"))
+	}
+
+	switch strings.ToLower(s.location) {
+	case "", locationMenu:
+		s.location = locationMenu
+	case locationDesktop, locationAutostart:
+		s.location = strings.ToLower(s.location)
+		if isComputer {
+			return s, errors.New(gotext.Get("%s shortcuts are only supported for users", s.location))
+		}
+	default:
+		return s, errors.New(gotext.Get("location %q must be %s, %s or %s", s.location, locationMenu, locationDesktop, locationAutostart))
+	}
+
+	if s.workdir != "" && !filepath.IsAbs(s.workdir) {
+		return s, errors.New(gotext.Get("working directory %q must be an absolute path", s.workdir))
+	}
+	if s.icon != "" && s.iconFile != "" {
+		return s, errors.New(gotext.Get("icon and iconfile can't be both set"))
+	}
+	if s.icon != "" && !filepath.IsAbs(s.icon) && strings.ContainsRune(s.icon, '/') {
+		return s, errors.New(gotext.Get("icon %q must be an icon name or an absolute path", s.icon))
+	}
+	if s.iconFile != "" {
+		s.iconFile = filepath.ToSlash(s.iconFile)
+		if filepath.IsAbs(s.iconFile) || !filepath.IsLocal(s.iconFile) {
+			return s, errors.New(gotext.Get("iconfile %q must be relative to the %s/ directory of the assets share", s.iconFile, assetsDir))
+		}
+		if !slices.Contains(iconExtensions, strings.ToLower(filepath.Ext(s.iconFile))) {
+			return s, errors.New(gotext.Get("iconfile %q must be a PNG, SVG or XPM image", s.iconFile))
+		}
+	}
+
+	return s, nil
+}
+
+// mergeFiles returns the files of a and b, without duplicates.
+func mergeFiles(a, b []string) []string {
+	r := slices.Clone(a)
+	for _, p := range b {
+		if !slices.Contains(r, p) {
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+// loadState returns the files previously created by adsys, saved in p.
+func loadState(p string) (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load shortcuts state"))
+
+	d, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the files created by adsys in p.
+// The state file is removed if nothing is created anymore.
+func saveState(p string, s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save shortcuts state"))
+
+	if len(s.Files) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
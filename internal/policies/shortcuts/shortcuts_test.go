@@ -0,0 +1,138 @@
+package shortcuts_test
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/shortcuts"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	machineShortcuts := "name=Intranet, target=https://intranet.example.com, iconfile=intranet.png, comment=Company intranet\n" +
+		"name=Terminal, target=/usr/bin/gnome-terminal, arguments=--maximize --title \"100% work\", workdir=/srv/projects, icon=utilities-terminal"
+	userShortcuts := "name=Wiki, target=https://wiki.example.com, iconfile=sub/wiki.svg, location=desktop\n" +
+		"name=Team documents, target=/srv/team docs, type=link\n" +
+		"name=Editor, target=/opt/My Editor/editor, icon=/opt/My Editor/editor.png"
+
+	tests := map[string]struct {
+		entries         []entry.Entry
+		objectName      string
+		isNotComputer   bool
+		existing        string
+		saveAssetsError bool
+
+		wantModes map[string]fs.FileMode
+		wantErr   bool
+	}{
+		"Machine shortcuts": {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: machineShortcuts}},
+			wantModes: map[string]fs.FileMode{"apps/adsys-intranet.desktop": 0644, "icons/adsys-intranet.png": 0644}},
+		"User shortcuts": {isNotComputer: true, entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: userShortcuts}},
+			wantModes: map[string]fs.FileMode{"home/alice/Desktop/adsys-wiki.desktop": 0755, "home/alice/.local/share/applications/adsys-editor.desktop": 0644}},
+		"User autostart shortcuts": {isNotComputer: true, entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: "name=Chat, target=/usr/bin/chat, arguments=--minimized, location=autostart\nname=Welcome, target=https://welcome.example.com, location=Autostart"}},
+			wantModes: map[string]fs.FileMode{"home/alice/.config/autostart/adsys-chat.desktop": 0644}},
+		"User shortcuts on custom desktop directory":  {isNotComputer: true, existing: "homes/custom-desktop", entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: userShortcuts}}},
+		"User shortcuts on desktop outside home":      {isNotComputer: true, existing: "homes/outside-desktop", entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: "name=Wiki, target=https://wiki.example.com, location=desktop"}}},
+		"User desktop shortcuts skipped if disabled":  {isNotComputer: true, existing: "homes/disabled-desktop", entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: userShortcuts}}},
+		"Fields are case insensitive and unordered":   {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: " Target = https://intranet.example.com ,  NAME = Intranet , TYPE = Link "}}},
+		"Empty lines are ignored":                     {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "\nname=Intranet, target=https://intranet.example.com\n\n"}}},
+		"Mail links are links":                        {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Support, target=mailto:support@example.com"}}},
+		"Names without latin letters are hashed":      {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=イントラネット, target=https://intranet.example.com"}}},
+		"Closest GPO overrides the same shortcut":     {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://far.example.com"}, {Key: "shortcuts/deploy", Value: "name=intranet, target=https://close.example.com"}}},
+		"Same name in menu and on desktop":            {isNotComputer: true, entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: "name=Wiki, target=https://wiki.example.com\nname=Wiki, target=https://wiki.example.com, location=desktop"}}},
+		"Changed shortcuts are updated":               {existing: "states/created", entries: []entry.Entry{{Key: "shortcuts/deploy", Value: machineShortcuts}}},
+		"Changed user shortcuts are updated":          {isNotComputer: true, existing: "states/created", entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: userShortcuts}}},
+		"No entries removes shortcuts":                {existing: "states/created"},
+		"No entries removes shortcuts without assets": {existing: "states/created", saveAssetsError: true},
+		"No entries removes user shortcuts":           {isNotComputer: true, existing: "states/created"},
+		"Disabled entries are ignored":                {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: machineShortcuts, Disabled: true}}},
+		"Unsupported keys are ignored":                {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com"}, {Key: "shortcuts/user-deploy", Value: "name=Wiki, target=https://wiki.example.com"}}},
+		"No assets needed without icon files":         {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com"}}, saveAssetsError: true},
+		"No entries is a no-op":                       {},
+		"User without home directory is a no-op":      {isNotComputer: true, objectName: "bob@example.com", entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: userShortcuts}}},
+
+		// Error cases
+		"Error on missing name":                     {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "target=https://intranet.example.com"}}, wantErr: true},
+		"Error on missing target":                   {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet"}}, wantErr: true},
+		"Error on empty field":                      {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target="}}, wantErr: true},
+		"Error on field set twice":                  {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://a.example.com, target=https://b.example.com"}}, wantErr: true},
+		"Error on unsupported field":                {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com, hotkey=F1"}}, wantErr: true},
+		"Error on unsupported type":                 {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com, type=shell"}}, wantErr: true},
+		"Error on arguments for a link":             {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com, arguments=--new-window"}}, wantErr: true},
+		"Error on unsupported location":             {isNotComputer: true, entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: "name=Wiki, target=https://wiki.example.com, location=startup"}}, wantErr: true},
+		"Error on desktop location for a machine":   {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com, location=desktop"}}, wantErr: true},
+		"Error on autostart location for a machine": {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Chat, target=/usr/bin/chat, location=autostart"}}, wantErr: true},
+		"Error on relative working directory":       {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Terminal, target=gnome-terminal, workdir=projects"}}, wantErr: true},
+		"Error on relative icon path":               {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Terminal, target=gnome-terminal, icon=icons/terminal.png"}}, wantErr: true},
+		"Error on both icon and icon file":          {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com, icon=web-browser, iconfile=intranet.png"}}, wantErr: true},
+		"Error on icon file outside the assets":     {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com, iconfile=../files/intranet.png"}}, wantErr: true},
+		"Error on icon file which is not an image":  {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com, iconfile=readme.txt"}}, wantErr: true},
+		"Error on icon file not found":              {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: "name=Intranet, target=https://intranet.example.com, iconfile=missing.png"}}, wantErr: true},
+		"Error on assets dump failure":              {entries: []entry.Entry{{Key: "shortcuts/deploy", Value: machineShortcuts}}, saveAssetsError: true, wantErr: true},
+		"Error on corrupted state":                  {existing: "states/corrupted", entries: []entry.Entry{{Key: "shortcuts/deploy", Value: machineShortcuts}}, wantErr: true},
+		"Error on unknown user":                     {isNotComputer: true, objectName: "unknown@example.com", entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: userShortcuts}}, wantErr: true},
+		"Error on symlinked directory in home":      {isNotComputer: true, existing: "homes/symlinked-dir", entries: []entry.Entry{{Key: "shortcuts/user-deploy", Value: userShortcuts}}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			require.NoError(t, os.MkdirAll(filepath.Join(root, "home", "alice"), 0700), "Setup: can't create home directory")
+
+			objectName := tc.objectName
+			if objectName == "" {
+				objectName = "ubuntu"
+				if tc.isNotComputer {
+					objectName = "alice@example.com"
+				}
+			}
+
+			m := shortcuts.New(
+				shortcuts.WithStateDir(filepath.Join(root, "state")),
+				shortcuts.WithApplicationsDir(filepath.Join(root, "apps")),
+				shortcuts.WithIconsDir(filepath.Join(root, "icons")),
+				shortcuts.WithUserLookup(func(name string) (*user.User, error) {
+					homes := map[string]string{"alice@example.com": "alice", "bob@example.com": "bob"}
+					if homes[name] == "" {
+						return nil, user.UnknownUserError(name)
+					}
+					// Files can't be chowned to other users in tests.
+					return &user.User{Username: name, Uid: strconv.Itoa(os.Getuid()), Gid: strconv.Itoa(os.Getgid()), HomeDir: filepath.Join(root, "home", homes[name])}, nil
+				}),
+			)
+			mockAssetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.saveAssetsError, Path: "shortcuts/"}
+			err := m.ApplyPolicy(context.Background(), objectName, !tc.isNotComputer, tc.entries, mockAssetsDumper.SaveAssetsTo)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			for p, want := range tc.wantModes {
+				fi, err := os.Stat(filepath.Join(root, p))
+				require.NoError(t, err, "Created file %s should exist", p)
+				require.Equal(t, want, fi.Mode().Perm(), "Created file %s should have the expected mode", p)
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
@@ -0,0 +1,425 @@
+// Package snap provides a manager that installs, refreshes, holds and removes snaps,
+// and configures the snapd refresh timer and proxies.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - snap/install: snaps to install, one per line, of the form <snap> [<channel>].
+//     Installed snaps tracking another channel are refreshed to the requested one;
+//   - snap/remove: snaps to remove if they are installed, one per line;
+//   - snap/hold: snaps whose automatic refreshes are held, one per line;
+//   - snap/refresh-timer: the snapd refresh timer, for instance mon,10:00-12:00;
+//   - snap/proxy-http and snap/proxy-https: the proxies snapd uses to reach the store.
+//
+// Holds and system settings applied by adsys are saved in a state file, so that
+// they can be reverted once the policy is not configured anymore. Installed snaps
+// are not removed on revert: snap/remove needs to be used explicitly for this.
+package snap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	stateFile = "state.json"
+	// installTimeout is the maximum time installing, refreshing or removing snaps can take, as it downloads them
+	// or saves their data.
+	installTimeout = 10 * time.Minute
+)
+
+// systemSettings maps the supported keys to the snapd system settings they configure.
+var systemSettings = map[string]string{
+	"snap/refresh-timer": "refresh.timer",
+	"snap/proxy-http":    "proxy.http",
+	"snap/proxy-https":   "proxy.https",
+}
+
+// snapNameRe matches a valid snap name.
+var snapNameRe = regexp.MustCompile(`^[a-z0-9](?:-?[a-z0-9])*$`)
+
+// channelRe matches a snap channel, of the form [<track>/]<risk>[/<branch>].
+var channelRe = regexp.MustCompile(`^[a-zA-Z0-9._-]+(?:/[a-zA-Z0-9._-]+){0,2}$`)
+
+// snapToInstall is a snap requested to be installed, with an optional channel.
+type snapToInstall struct {
+	name    string
+	channel string
+}
+
+// rules is the snap configuration requested by the policy.
+type rules struct {
+	install  []snapToInstall
+	remove   []string
+	hold     []string
+	settings map[string]string
+}
+
+// state is the snap configuration applied by adsys.
+type state struct {
+	// Held are the snaps held by adsys.
+	Held []string `json:"held,omitempty"`
+	// Settings are the snapd system settings set by adsys.
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// Manager applies the snap policy on the machine.
+type Manager struct {
+	stateDir   string
+	snapCmd    []string
+	cmdTimeout time.Duration
+}
+
+type options struct {
+	stateDir   string
+	snapCmd    []string
+	cmdTimeout time.Duration
+}
+
+// Option reprents an optional function to change the snap manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithSnapCmd overrides the default snap command.
+func WithSnapCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.snapCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the snap policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:   consts.DefaultStateDir,
+		snapCmd:    []string{"snap"},
+		cmdTimeout: consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:   filepath.Join(args.stateDir, "snap"),
+		snapCmd:    args.snapCmd,
+		cmdTimeout: args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy installs, refreshes, holds and removes the snaps from the list of entries,
+// and configures snapd.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply snap policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Snap policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying snap policy to %s", objectName)
+
+	want, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	prev, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	if len(want.install) > 0 || len(want.remove) > 0 {
+		if err := m.installAndRemove(ctx, want); err != nil {
+			return err
+		}
+	}
+
+	// Settings, only updating the changed ones.
+	prevKeys := maps.Keys(prev.Settings)
+	slices.Sort(prevKeys)
+	for _, k := range prevKeys {
+		if _, ok := want.settings[k]; ok {
+			continue
+		}
+		log.Infof(ctx, "Unsetting snap system setting %s", k)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.snapCmd, "unset", "system", k); err != nil {
+			return err
+		}
+	}
+	wantKeys := maps.Keys(want.settings)
+	slices.Sort(wantKeys)
+	for _, k := range wantKeys {
+		v := want.settings[k]
+		if prev.Settings[k] == v {
+			continue
+		}
+		log.Infof(ctx, "Setting snap system setting %s to %s", k, v)
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.snapCmd, "set", "system", fmt.Sprintf("%s=%s", k, v)); err != nil {
+			return err
+		}
+	}
+
+	// Holds, only updating the changed ones.
+	var unhold, hold []string
+	for _, n := range prev.Held {
+		if !slices.Contains(want.hold, n) {
+			unhold = append(unhold, n)
+		}
+	}
+	for _, n := range want.hold {
+		if !slices.Contains(prev.Held, n) {
+			hold = append(hold, n)
+		}
+	}
+	if len(unhold) > 0 {
+		log.Infof(ctx, "Releasing refresh hold of snaps: %s", strings.Join(unhold, ", "))
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.snapCmd, slices.Concat([]string{"refresh", "--unhold"}, unhold)...); err != nil {
+			return err
+		}
+	}
+	if len(hold) > 0 {
+		log.Infof(ctx, "Holding refreshes of snaps: %s", strings.Join(hold, ", "))
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.snapCmd, slices.Concat([]string{"refresh", "--hold"}, hold)...); err != nil {
+			return err
+		}
+	}
+
+	return m.saveState(state{Held: want.hold, Settings: want.settings})
+}
+
+// DumpState returns the snaps held and snapd settings set during the last refresh of the machine.
+// The state is empty for users or if no snap policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump snap state of %s", objectName))
+
+	// Snap policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.stateDir, stateFile))
+}
+
+// installAndRemove removes the installed snaps requested to be removed, then installs the
+// missing ones and refreshes the ones tracking another channel.
+func (m *Manager) installAndRemove(ctx context.Context, want rules) error {
+	installed, err := m.installedSnaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	var remove []string
+	for _, n := range want.remove {
+		if _, ok := installed[n]; ok {
+			remove = append(remove, n)
+		}
+	}
+	if len(remove) > 0 {
+		log.Infof(ctx, "Removing snaps: %s", strings.Join(remove, ", "))
+		if _, err := syshelpers.Run(ctx, installTimeout, m.snapCmd, slices.Concat([]string{"remove"}, remove)...); err != nil {
+			return err
+		}
+	}
+
+	for _, sn := range want.install {
+		tracking, ok := installed[sn.name]
+		action := "install"
+		if ok {
+			if sn.channel == "" || sameChannel(tracking, sn.channel) {
+				continue
+			}
+			action = "refresh"
+		}
+
+		args := []string{action, sn.name}
+		if sn.channel != "" {
+			args = append(args, "--channel="+sn.channel)
+		}
+		log.Infof(ctx, "Running snap %s for %s", action, sn.name)
+		if _, err := syshelpers.Run(ctx, installTimeout, m.snapCmd, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseEntries validates the entries and returns the requested snap configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry) (r rules, err error) {
+	r.settings = make(map[string]string)
+
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		var lines []string
+		for _, l := range strings.Split(v, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+
+		switch e.Key {
+		case "snap/install":
+			for _, l := range lines {
+				fields := strings.Fields(l)
+				if len(fields) > 2 || !snapNameRe.MatchString(fields[0]) {
+					return r, errors.New(gotext.Get("invalid snap %q: expected <snap> [<channel>]", l))
+				}
+				sn := snapToInstall{name: fields[0]}
+				if len(fields) == 2 {
+					if !channelRe.MatchString(fields[1]) {
+						return r, errors.New(gotext.Get("invalid channel %q for snap %s", fields[1], sn.name))
+					}
+					sn.channel = fields[1]
+				}
+				if slices.ContainsFunc(r.install, func(o snapToInstall) bool { return o.name == sn.name }) {
+					continue
+				}
+				r.install = append(r.install, sn)
+			}
+		case "snap/remove", "snap/hold":
+			for _, n := range lines {
+				if !snapNameRe.MatchString(n) {
+					return r, errors.New(gotext.Get("invalid snap name %q", n))
+				}
+				if e.Key == "snap/remove" && !slices.Contains(r.remove, n) {
+					r.remove = append(r.remove, n)
+				} else if e.Key == "snap/hold" && !slices.Contains(r.hold, n) {
+					r.hold = append(r.hold, n)
+				}
+			}
+		case "snap/refresh-timer":
+			if strings.ContainsAny(v, " \t\n") {
+				return r, errors.New(gotext.Get("invalid refresh timer %q", v))
+			}
+			r.settings[systemSettings[e.Key]] = v
+		case "snap/proxy-http", "snap/proxy-https":
+			u, err := url.Parse(v)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return r, errors.New(gotext.Get("invalid proxy URL %q for %s", v, e.Key))
+			}
+			r.settings[systemSettings[e.Key]] = v
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing snap entries, skipping it", e.Key))
+		}
+	}
+
+	for _, sn := range r.install {
+		if slices.Contains(r.remove, sn.name) {
+			return r, errors.New(gotext.Get("snap %q is both requested to be installed and removed", sn.name))
+		}
+	}
+	slices.Sort(r.hold)
+
+	return r, nil
+}
+
+// sameChannel returns true if the tracked channel is the requested one.
+// A channel without track, like "stable", tracks the latest track.
+func sameChannel(tracking, channel string) bool {
+	normalize := func(c string) string {
+		if !strings.Contains(c, "/") {
+			return "latest/" + c
+		}
+		return c
+	}
+	return normalize(tracking) == normalize(channel)
+}
+
+// installedSnaps returns the installed snaps with the channel they are tracking.
+func (m *Manager) installedSnaps(ctx context.Context) (installed map[string]string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't list installed snaps"))
+
+	out, err := syshelpers.Run(ctx, m.cmdTimeout, m.snapCmd, "list")
+	if err != nil {
+		return nil, err
+	}
+
+	installed = make(map[string]string)
+	// Skip header: Name  Version  Rev  Tracking  Publisher  Notes
+	for i, l := range strings.Split(out, "\n") {
+		fields := strings.Fields(l)
+		if i == 0 || len(fields) < 4 {
+			continue
+		}
+		installed[fields[0]] = fields[3]
+	}
+	return installed, nil
+}
+
+// loadState returns the snap configuration previously applied by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load snap state"))
+
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// saveState saves the snap configuration applied by adsys.
+// The state file is removed if nothing is applied anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save snap state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Held) == 0 && len(s.Settings) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
@@ -0,0 +1,135 @@
+package snap_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/snap"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+var allEntries = []entry.Entry{
+	{Key: "snap/install", Value: "htop\nfirefox esr/stable\nvlc"},
+	{Key: "snap/remove", Value: "chromium\nnot-installed"},
+	{Key: "snap/hold", Value: "firefox\nvlc"},
+	{Key: "snap/refresh-timer", Value: "mon,10:00-12:00"},
+	{Key: "snap/proxy-http", Value: "http://proxy.example.com:3128"},
+	{Key: "snap/proxy-https", Value: "http://proxy.example.com:3129"},
+}
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingState string
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Install snaps":                                  {entries: []entry.Entry{{Key: "snap/install", Value: "htop\n\n code beta \nhtop"}}},
+		"Installed snaps are not reinstalled":            {entries: []entry.Entry{{Key: "snap/install", Value: "vlc\nfirefox stable\nhtop"}}},
+		"Installed snaps are refreshed to a new channel": {entries: []entry.Entry{{Key: "snap/install", Value: "firefox esr/stable\nvlc latest/stable"}}},
+		"Remove snaps":                                   {entries: []entry.Entry{{Key: "snap/remove", Value: "chromium\nvlc"}}},
+		"Snaps not installed are not removed":            {entries: []entry.Entry{{Key: "snap/remove", Value: "not-installed"}}},
+		"Hold snaps":                                     {entries: []entry.Entry{{Key: "snap/hold", Value: "vlc\nfirefox\nvlc"}}},
+		"Configure snapd":                                {entries: []entry.Entry{{Key: "snap/refresh-timer", Value: "mon,10:00-12:00"}, {Key: "snap/proxy-https", Value: "https://proxy.example.com"}}},
+		"All entries":                                    {entries: allEntries},
+		"Already applied runs no command":                {entries: []entry.Entry{{Key: "snap/hold", Value: "firefox"}, {Key: "snap/refresh-timer", Value: "fri,23:00-01:00"}, {Key: "snap/proxy-http", Value: "http://proxy.example.com:3128"}}, existingState: "applied"},
+		"Only changes are applied":                       {entries: []entry.Entry{{Key: "snap/hold", Value: "vlc"}, {Key: "snap/refresh-timer", Value: "mon,10:00-12:00"}}, existingState: "applied"},
+		"No entries reverts holds and settings":          {existingState: "applied"},
+		"Disabled entries are ignored":                   {entries: []entry.Entry{{Key: "snap/install", Value: "htop", Disabled: true}, {Key: "snap/remove", Value: "chromium"}}},
+		"Unsupported keys are ignored":                   {entries: []entry.Entry{{Key: "snap/install", Value: "htop"}, {Key: "snap/cohort", Value: "true"}}},
+		"No entries is a no-op":                          {},
+		"Not a computer is a no-op":                      {entries: allEntries, isNotComputer: true},
+		"Not a computer doesn't revert applied state":    {existingState: "applied", isNotComputer: true},
+		"Listing snaps is skipped if not required":       {entries: []entry.Entry{{Key: "snap/hold", Value: "firefox"}}, mockBehaviour: "fail-list"},
+
+		// Error cases
+		"Error on invalid snap name":             {entries: []entry.Entry{{Key: "snap/install", Value: "htop\nFirefox"}}, wantErr: true},
+		"Error on too many fields":               {entries: []entry.Entry{{Key: "snap/install", Value: "firefox esr/stable classic"}}, wantErr: true},
+		"Error on invalid channel":               {entries: []entry.Entry{{Key: "snap/install", Value: "firefox latest/stable/hotfix/extra"}}, wantErr: true},
+		"Error on invalid snap to remove":        {entries: []entry.Entry{{Key: "snap/remove", Value: "-chromium"}}, wantErr: true},
+		"Error on invalid snap to hold":          {entries: []entry.Entry{{Key: "snap/hold", Value: "fire fox"}}, wantErr: true},
+		"Error on invalid refresh timer":         {entries: []entry.Entry{{Key: "snap/refresh-timer", Value: "mon 10:00"}}, wantErr: true},
+		"Error on invalid proxy":                 {entries: []entry.Entry{{Key: "snap/proxy-http", Value: "proxy.example.com:3128"}}, wantErr: true},
+		"Error on snap installed and removed":    {entries: []entry.Entry{{Key: "snap/install", Value: "htop"}, {Key: "snap/remove", Value: "htop"}}, wantErr: true},
+		"Error on listing installed snaps":       {entries: allEntries, mockBehaviour: "fail-list", wantErr: true},
+		"Error on installing snaps":              {entries: []entry.Entry{{Key: "snap/install", Value: "htop"}}, mockBehaviour: "fail-install", wantErr: true},
+		"Error on refreshing snaps":              {entries: []entry.Entry{{Key: "snap/install", Value: "firefox esr/stable"}}, mockBehaviour: "fail-refresh", wantErr: true},
+		"Error on removing snaps":                {entries: []entry.Entry{{Key: "snap/remove", Value: "vlc"}}, mockBehaviour: "fail-remove", wantErr: true},
+		"Error on setting snapd configuration":   {entries: []entry.Entry{{Key: "snap/refresh-timer", Value: "mon,10:00-12:00"}}, mockBehaviour: "fail-set", wantErr: true},
+		"Error on unsetting snapd configuration": {existingState: "applied", mockBehaviour: "fail-unset", wantErr: true},
+		"Error on holding snaps":                 {entries: []entry.Entry{{Key: "snap/hold", Value: "vlc"}}, mockBehaviour: "fail-refresh", wantErr: true},
+		"Error on corrupted state":               {entries: allEntries, existingState: "corrupted", wantErr: true},
+		"Error on unreadable state":              {entries: allEntries, existingState: "state-is-a-directory", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			m := snap.New(
+				snap.WithStateDir(root),
+				snap.WithSnapCmd(testutils.MockCommand(root, "snap", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	root, behaviour, args := c.Root, c.Behaviour, c.Args
+
+	// Log the call, replacing the temporary paths to get a stable output.
+	line := "snap"
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+	line = strings.ReplaceAll(line, root, "#ROOT#")
+
+	c.Log(line)
+
+	if behaviour == "fail" || behaviour == "fail-"+args[0] {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+
+	if args[0] == "list" {
+		fmt.Print(`Name      Version   Rev    Tracking       Publisher    Notes
+chromium  120.0     2695   latest/stable  canonical✓   -
+core22    20240111  1122   latest/stable  canonical✓   base
+firefox   121.0     3600   latest/stable  mozilla✓     -
+vlc       3.0.20    3777   latest/stable  videolan✓    -
+`)
+	}
+}
@@ -0,0 +1,337 @@
+// Package sshd provides a manager that configures the OpenSSH server of the machine.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - sshd/permit-root-login: whether root can log in, among yes, no, prohibit-password and
+//     forced-commands-only;
+//   - sshd/allow-groups: the groups whose members are allowed to log in, one per line. Group names can
+//     contain spaces and the * and ? wildcards;
+//   - sshd/banner: the message displayed before authentication;
+//   - sshd/ciphers: the ciphers allowed by the server, separated by commas, spaces or one per line.
+//
+// The settings are written to a drop-in file of the sshd configuration directory sorting before the
+// other ones, as sshd only considers the first value of each keyword, and the banner to a file next to it. The resulting configuration is checked with sshd -t before the server is reloaded: if
+// it is invalid, the previous configuration is restored and an error is returned.
+//
+// The files are removed once the policy is not configured anymore, restoring the configuration of the
+// system.
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// configFile sorts first, as sshd only considers the first value of each keyword it reads.
+	configFile = "00-adsys.conf"
+	// legacyConfigFile is the drop-in written by previous versions, which was overridden by the other drop-ins.
+	legacyConfigFile = "99-adsys.conf"
+	bannerFile       = "adsys-banner"
+	sshdUnit         = "ssh.service"
+)
+
+// permitRootLoginValues are the values supported by the PermitRootLogin keyword.
+var permitRootLoginValues = []string{"yes", "no", "prohibit-password", "forced-commands-only"}
+
+var (
+	// cipherRe matches the name of a cipher, like aes256-gcm@openssh.com.
+	cipherRe = regexp.MustCompile(`^[a-z0-9][a-z0-9.@-]*$`)
+	// groupRe matches a group pattern, which can contain spaces and wildcards but no quotes.
+	groupRe = regexp.MustCompile(`^[^"\s][^"\t\n]*$`)
+)
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// settings is the sshd configuration requested by the policy.
+type settings struct {
+	permitRootLogin string
+	allowGroups     []string
+	banner          string
+	ciphers         []string
+}
+
+// Manager applies the sshd policy on the machine.
+type Manager struct {
+	sshdConfigDir string
+	bannerPath    string
+
+	sshdCmd      []string
+	systemctlCmd []string
+	cmdTimeout   time.Duration
+}
+
+type options struct {
+	sshdConfigDir string
+	sshdCmd       []string
+	systemctlCmd  []string
+	cmdTimeout    time.Duration
+}
+
+// Option reprents an optional function to change the sshd manager.
+type Option func(*options)
+
+// WithSSHDConfigDir overrides the default sshd configuration directory.
+// The banner is written in its parent directory.
+func WithSSHDConfigDir(p string) func(*options) {
+	return func(a *options) {
+		a.sshdConfigDir = p
+	}
+}
+
+// WithSSHDCmd overrides the default sshd command.
+func WithSSHDCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.sshdCmd = cmd
+	}
+}
+
+// WithSystemctlCmd overrides the default systemctl command.
+func WithSystemctlCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.systemctlCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the sshd policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		sshdConfigDir: consts.DefaultSSHDConfigDir,
+		sshdCmd:       []string{"sshd"},
+		systemctlCmd:  []string{"systemctl"},
+		cmdTimeout:    consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		sshdConfigDir: args.sshdConfigDir,
+		bannerPath:    filepath.Join(filepath.Dir(args.sshdConfigDir), bannerFile),
+		sshdCmd:       args.sshdCmd,
+		systemctlCmd:  args.systemctlCmd,
+		cmdTimeout:    args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy configures the OpenSSH server from the list of entries.
+// If the resulting configuration is invalid, the previous one is restored.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply sshd policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Sshd policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying sshd policy to %s", objectName)
+
+	s, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	configPath := filepath.Join(m.sshdConfigDir, configFile)
+	legacyConfigPath := filepath.Join(m.sshdConfigDir, legacyConfigFile)
+	config, banner := s.config(m.bannerPath), s.bannerContent()
+
+	// Keep the current files to restore them if the new configuration is invalid.
+	oldConfig, err := readFile(configPath)
+	if err != nil {
+		return err
+	}
+	oldLegacyConfig, err := readFile(legacyConfigPath)
+	if err != nil {
+		return err
+	}
+	oldBanner, err := readFile(m.bannerPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(oldConfig, config) && oldLegacyConfig == nil && bytes.Equal(oldBanner, banner) {
+		return nil
+	}
+
+	if err := writeFile(m.bannerPath, banner); err != nil {
+		return err
+	}
+	if err := writeFile(configPath, config); err != nil {
+		return errors.Join(err, writeFile(m.bannerPath, oldBanner))
+	}
+	if err := writeFile(legacyConfigPath, nil); err != nil {
+		return errors.Join(err, writeFile(configPath, oldConfig), writeFile(m.bannerPath, oldBanner))
+	}
+
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.sshdCmd, "-t"); err != nil {
+		log.Warning(ctx, gotext.Get("The sshd configuration is invalid, restoring the previous one"))
+		if rErr := errors.Join(writeFile(configPath, oldConfig), writeFile(legacyConfigPath, oldLegacyConfig), writeFile(m.bannerPath, oldBanner)); rErr != nil {
+			return errors.Join(err, rErr)
+		}
+		return errors.New(gotext.Get("invalid sshd configuration, the previous one was restored: %v", err))
+	}
+
+	log.Info(ctx, gotext.Get("Reloading %s to apply the sshd configuration", sshdUnit))
+	_, err = syshelpers.Run(ctx, m.cmdTimeout, m.systemctlCmd, "try-reload-or-restart", sshdUnit)
+	return err
+}
+
+// DumpState returns the SSH server configuration and banner written during the last refresh of the machine.
+// The state is empty for users or if no sshd policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump sshd state of %s", objectName))
+
+	// Sshd policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(
+		filepath.Join(m.sshdConfigDir, configFile),
+		m.bannerPath,
+	)
+}
+
+// parseEntries validates the entries and returns the requested configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry) (s settings, err error) {
+	for _, e := range entries {
+		if e.Disabled || strings.TrimSpace(e.Value) == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "sshd/permit-root-login":
+			v := strings.TrimSpace(e.Value)
+			if !slices.Contains(permitRootLoginValues, v) {
+				return s, errors.New(gotext.Get("invalid value %q for root login: expected one of %s", v, strings.Join(permitRootLoginValues, ", ")))
+			}
+			s.permitRootLogin = v
+		case "sshd/allow-groups":
+			for _, g := range strings.Split(e.Value, "\n") {
+				g = strings.TrimSpace(g)
+				if g == "" {
+					continue
+				}
+				if !groupRe.MatchString(g) {
+					return s, errors.New(gotext.Get("invalid group %q", g))
+				}
+				if !slices.Contains(s.allowGroups, g) {
+					s.allowGroups = append(s.allowGroups, g)
+				}
+			}
+		case "sshd/banner":
+			s.banner = strings.TrimSpace(e.Value)
+		case "sshd/ciphers":
+			for _, c := range strings.FieldsFunc(e.Value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+				if !cipherRe.MatchString(c) {
+					return s, errors.New(gotext.Get("invalid cipher %q", c))
+				}
+				if !slices.Contains(s.ciphers, c) {
+					s.ciphers = append(s.ciphers, c)
+				}
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing sshd entries, skipping it", e.Key))
+		}
+	}
+
+	return s, nil
+}
+
+// config returns the sshd configuration of the settings, or nil if nothing is configured.
+// bannerPath is the path the banner is written to.
+func (s settings) config(bannerPath string) []byte {
+	if s.permitRootLogin == "" && len(s.allowGroups) == 0 && s.banner == "" && len(s.ciphers) == 0 {
+		return nil
+	}
+
+	var out bytes.Buffer
+	out.WriteString(header)
+	if s.permitRootLogin != "" {
+		fmt.Fprintf(&out, "PermitRootLogin %s\n", s.permitRootLogin)
+	}
+	if len(s.allowGroups) > 0 {
+		var groups []string
+		for _, g := range s.allowGroups {
+			if strings.Contains(g, " ") {
+				g = `"` + g + `"`
+			}
+			groups = append(groups, g)
+		}
+		fmt.Fprintf(&out, "AllowGroups %s\n", strings.Join(groups, " "))
+	}
+	if s.banner != "" {
+		fmt.Fprintf(&out, "Banner %s\n", bannerPath)
+	}
+	if len(s.ciphers) > 0 {
+		fmt.Fprintf(&out, "Ciphers %s\n", strings.Join(s.ciphers, ","))
+	}
+	return out.Bytes()
+}
+
+// bannerContent returns the content of the banner file, or nil if no banner is configured.
+func (s settings) bannerContent() []byte {
+	if s.banner == "" {
+		return nil
+	}
+	return []byte(s.banner + "\n")
+}
+
+// readFile returns the content of the file p, or nil if it doesn't exist.
+func readFile(p string) ([]byte, error) {
+	d, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return d, err
+}
+
+// writeFile writes content to the file p, removing it if content is nil.
+func writeFile(p string, content []byte) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write sshd configuration %s", p))
+
+	if content == nil {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 sshd configuration is world readable
+	if err := os.WriteFile(p+".new", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
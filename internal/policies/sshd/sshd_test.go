@@ -0,0 +1,133 @@
+package sshd_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/sshd"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "sshd/permit-root-login", Value: "prohibit-password"},
+		{Key: "sshd/allow-groups", Value: "sshusers\ndomain admins@example.com"},
+		{Key: "sshd/banner", Value: "Authorized users only.\nAll activity is logged."},
+		{Key: "sshd/ciphers", Value: "aes256-gcm@openssh.com,chacha20-poly1305@openssh.com"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		mockBehaviour string
+		makeReadOnly  bool
+
+		wantErr bool
+		// wantRestored compares the files after a failure, to check the previous configuration was restored.
+		wantRestored bool
+	}{
+		"Permit root login":                       {entries: []entry.Entry{{Key: "sshd/permit-root-login", Value: "no"}}},
+		"Allow groups":                            {entries: []entry.Entry{{Key: "sshd/allow-groups", Value: "sshusers\nadmins"}}},
+		"Allow groups with spaces":                {entries: []entry.Entry{{Key: "sshd/allow-groups", Value: "domain users\nsshusers"}}},
+		"Allow groups with wildcards":             {entries: []entry.Entry{{Key: "sshd/allow-groups", Value: "ssh-*\nadmin?"}}},
+		"Duplicated groups":                       {entries: []entry.Entry{{Key: "sshd/allow-groups", Value: "sshusers\nadmins\nsshusers"}}},
+		"Banner":                                  {entries: []entry.Entry{{Key: "sshd/banner", Value: "Authorized users only."}}},
+		"Ciphers separated by commas":             {entries: []entry.Entry{{Key: "sshd/ciphers", Value: "aes256-gcm@openssh.com,aes128-ctr"}}},
+		"Ciphers one per line":                    {entries: []entry.Entry{{Key: "sshd/ciphers", Value: "aes256-gcm@openssh.com\naes128-ctr\naes128-ctr"}}},
+		"All entries":                             {entries: allEntries},
+		"Existing configuration is updated":       {existingDirs: "existing-config", entries: allEntries},
+		"Existing configuration is unchanged":     {existingDirs: "existing-config-without-banner", entries: []entry.Entry{{Key: "sshd/permit-root-login", Value: "no"}}},
+		"Removing banner removes its file":        {existingDirs: "existing-config", entries: []entry.Entry{{Key: "sshd/permit-root-login", Value: "no"}}},
+		"No entries removes configuration":        {existingDirs: "existing-config"},
+		"Other configuration is kept":             {existingDirs: "only-sshd-config", entries: []entry.Entry{{Key: "sshd/permit-root-login", Value: "no"}}},
+		"Legacy configuration is replaced":        {existingDirs: "legacy-config", entries: allEntries},
+		"No entries removes legacy configuration": {existingDirs: "legacy-config"},
+
+		"Values are trimmed":               {entries: []entry.Entry{{Key: "sshd/permit-root-login", Value: "  no\n"}}},
+		"Disabled entries are ignored":     {entries: []entry.Entry{{Key: "sshd/permit-root-login", Value: "no"}, {Key: "sshd/banner", Value: "Hello", Disabled: true}}},
+		"Empty entries are ignored":        {entries: []entry.Entry{{Key: "sshd/permit-root-login", Value: "no"}, {Key: "sshd/ciphers", Value: "  "}}},
+		"Unsupported keys are ignored":     {entries: []entry.Entry{{Key: "sshd/permit-root-login", Value: "no"}, {Key: "sshd/port", Value: "2222"}}},
+		"No entries and no existing files": {},
+		"Not a computer is a no-op":        {isNotComputer: true, existingDirs: "existing-config"},
+
+		// Error cases
+		"Error on invalid root login value":                {entries: []entry.Entry{{Key: "sshd/permit-root-login", Value: "maybe"}}, wantErr: true},
+		"Error on invalid group":                           {entries: []entry.Entry{{Key: "sshd/allow-groups", Value: "sshusers\n\"admins\""}}, wantErr: true},
+		"Error on invalid cipher":                          {entries: []entry.Entry{{Key: "sshd/ciphers", Value: "aes256-gcm@openssh.com,AES 128"}}, wantErr: true},
+		"Error on invalid configuration restores previous": {existingDirs: "existing-config", entries: allEntries, mockBehaviour: "fail-sshd", wantErr: true, wantRestored: true},
+		"Error on invalid configuration removes new files": {entries: allEntries, mockBehaviour: "fail-sshd", wantErr: true, wantRestored: true},
+		"Error on invalid configuration restores legacy":   {existingDirs: "legacy-config", entries: allEntries, mockBehaviour: "fail-sshd", wantErr: true, wantRestored: true},
+		"Error on reloading sshd":                          {entries: allEntries, mockBehaviour: "fail-systemctl", wantErr: true},
+		"Error on unwritable sshd configuration directory": {existingDirs: "existing-config", makeReadOnly: true, entries: allEntries, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			sshdConfigDir := filepath.Join(root, "etc", "ssh", "sshd_config.d")
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.makeReadOnly {
+				testutils.MakeReadOnly(t, sshdConfigDir)
+			}
+
+			m := sshd.New(
+				sshd.WithSSHDConfigDir(sshdConfigDir),
+				sshd.WithSSHDCmd(testutils.MockCommand(root, "sshd", tc.mockBehaviour)),
+				sshd.WithSystemctlCmd(testutils.MockCommand(root, "systemctl", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				if !tc.wantRestored {
+					return
+				}
+			} else {
+				require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+			}
+
+			// The banner path references the temporary directory.
+			p := filepath.Join(sshdConfigDir, "00-adsys.conf")
+			if d, err := os.ReadFile(p); err == nil {
+				require.NoError(t, os.WriteFile(p, []byte(strings.ReplaceAll(string(d), root, "#ROOT#")), 0600), "Setup: can't rewrite configuration")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, behaviours, args := c.Name, strings.Split(c.Behaviour, ","), c.Args
+
+	c.Log(fmt.Sprintf("%s %s", name, strings.Join(args, " ")))
+
+	if slices.Contains(behaviours, "fail-"+name) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+}
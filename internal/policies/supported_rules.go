@@ -0,0 +1,7 @@
+//go:build !snapconfined
+
+package policies
+
+// SupportedRules are the rules this build of adsys can apply. Rules not part of it are filtered.
+// An empty list means that all rules are supported.
+var SupportedRules []string
@@ -0,0 +1,9 @@
+//go:build snapconfined
+
+package policies
+
+// SupportedRules are the rules this build of adsys can apply. Rules not part of it are filtered.
+//
+// The snap confined build can only access the system through its snap interfaces, which restricts
+// it to the managers writing to the dconf database, running scripts and configuring the proxy.
+var SupportedRules = []string{"dconf", "gdm", "scripts", "proxy"}
@@ -0,0 +1,377 @@
+// Package sysctl provides a manager that sets kernel parameters on the machine.
+//
+// This manager only applies to computer objects.
+//
+// The following setting is supported:
+//   - sysctl/parameters: kernel parameters, one per line, of the form <parameter> = <value>,
+//     like in sysctl.conf(5). Empty lines and lines starting with # or ; are ignored.
+//
+// The parameters are written to a sysctl.d configuration file, so that they persist across
+// reboots, and are applied immediately with sysctl --system. Parameters which are not available
+// on the running kernel are skipped.
+//
+// The value of each parameter before adsys first set it is saved in a state file. Once a parameter
+// is not configured anymore, it is removed from the configuration file and its original value is
+// restored, before the other configuration files of the system are applied again.
+package sysctl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	configFile = "99-adsys.conf"
+	stateFile  = "state.json"
+)
+
+// parameterRe matches a kernel parameter name, with dots as separators.
+var parameterRe = regexp.MustCompile(`^[a-z0-9_]+(\.[a-zA-Z0-9_:-]+)+$`)
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// parameter is a kernel parameter set to a value.
+type parameter struct {
+	name  string
+	value string
+}
+
+// state is the list of parameters set by adsys, with their value before adsys first set them.
+type state struct {
+	Originals map[string]string `json:"originals"`
+}
+
+// Manager applies the sysctl policy on the machine.
+type Manager struct {
+	stateDir   string
+	sysctlDir  string
+	procSysDir string
+	sysctlCmd  []string
+	cmdTimeout time.Duration
+}
+
+type options struct {
+	stateDir   string
+	sysctlDir  string
+	procSysDir string
+	sysctlCmd  []string
+	cmdTimeout time.Duration
+}
+
+// Option reprents an optional function to change the sysctl manager.
+type Option func(*options)
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithSysctlDir overrides the default sysctl.d configuration directory.
+func WithSysctlDir(p string) func(*options) {
+	return func(a *options) {
+		a.sysctlDir = p
+	}
+}
+
+// WithProcSysDir overrides the default directory exposing the kernel parameters.
+func WithProcSysDir(p string) func(*options) {
+	return func(a *options) {
+		a.procSysDir = p
+	}
+}
+
+// WithSysctlCmd overrides the default sysctl command.
+func WithSysctlCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.sysctlCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the sysctl policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		stateDir:   consts.DefaultStateDir,
+		sysctlDir:  consts.DefaultSysctlDir,
+		procSysDir: "/proc/sys",
+		sysctlCmd:  []string{"sysctl"},
+		cmdTimeout: consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		stateDir:   filepath.Join(args.stateDir, "sysctl"),
+		sysctlDir:  args.sysctlDir,
+		procSysDir: args.procSysDir,
+		sysctlCmd:  args.sysctlCmd,
+		cmdTimeout: args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy sets the kernel parameters from the list of entries, and restores the ones not configured anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply sysctl policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Sysctl policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying sysctl policy to %s", objectName)
+
+	params, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	s, err := m.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Save the original values of the new parameters, skipping the ones unknown to the kernel.
+	var applied []parameter
+	for _, p := range params {
+		if _, ok := s.Originals[p.name]; !ok {
+			v, err := m.read(p.name)
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Warning(ctx, gotext.Get("Kernel parameter %q is not available on this machine, skipping it", p.name))
+				continue
+			} else if err != nil {
+				return err
+			}
+			s.Originals[p.name] = v
+		}
+		applied = append(applied, p)
+	}
+
+	// Restore the parameters not configured anymore.
+	var restored []string
+	for name := range s.Originals {
+		if !slices.ContainsFunc(applied, func(p parameter) bool { return p.name == name }) {
+			restored = append(restored, name)
+		}
+	}
+	sort.Strings(restored)
+
+	// Nothing to apply nor to restore.
+	if len(applied) == 0 && len(restored) == 0 {
+		return m.writeConfig(nil)
+	}
+
+	// The parameters not configured anymore must not be applied again by sysctl --system.
+	if err := m.writeConfig(applied); err != nil {
+		return err
+	}
+	if err := m.saveState(s); err != nil {
+		return err
+	}
+
+	for _, name := range restored {
+		log.Infof(ctx, "Restoring kernel parameter %q, not configured anymore", name)
+		if err := m.write(name, s.Originals[name]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		delete(s.Originals, name)
+		if err := m.saveState(s); err != nil {
+			return err
+		}
+	}
+
+	// Apply all configuration files, so that the ones from the system take precedence over the restored values.
+	log.Infof(ctx, "Applying %d kernel parameters", len(applied))
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.sysctlCmd, "--system"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DumpState returns the kernel parameters configuration written during the last refresh of the machine, with
+// the original values to restore.
+// The state is empty for users or if no sysctl policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump sysctl state of %s", objectName))
+
+	// Sysctl policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(
+		filepath.Join(m.sysctlDir, configFile),
+		filepath.Join(m.stateDir, stateFile),
+	)
+}
+
+// parseEntries validates the entries and returns the parameters to set, in order.
+func parseEntries(ctx context.Context, entries []entry.Entry) (params []parameter, err error) {
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+		if e.Key != "sysctl/parameters" {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing sysctl entries, skipping it", e.Key))
+			continue
+		}
+
+		for _, l := range strings.Split(e.Value, "\n") {
+			l = strings.TrimSpace(l)
+			if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, ";") {
+				continue
+			}
+			name, value, found := strings.Cut(l, "=")
+			name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+			if !found || value == "" {
+				return nil, errors.New(gotext.Get("invalid kernel parameter %q: expected <parameter> = <value>", l))
+			}
+			if !parameterRe.MatchString(name) {
+				return nil, errors.New(gotext.Get("invalid kernel parameter name %q", name))
+			}
+
+			// Parameters from the closest GPO are listed last: they override the ones from further GPOs.
+			if i := slices.IndexFunc(params, func(p parameter) bool { return p.name == name }); i >= 0 {
+				params = slices.Delete(params, i, i+1)
+			}
+			params = append(params, parameter{name: name, value: value})
+		}
+	}
+
+	return params, nil
+}
+
+// path returns the path of the kernel parameter name under the proc sys directory.
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.procSysDir, filepath.Join(strings.Split(name, ".")...))
+}
+
+// read returns the current value of the kernel parameter name.
+func (m *Manager) read(name string) (string, error) {
+	d, err := os.ReadFile(m.path(name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(d)), nil
+}
+
+// write sets the kernel parameter name to value.
+func (m *Manager) write(name, value string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't restore kernel parameter %q", name))
+
+	f, err := os.OpenFile(m.path(name), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(value + "\n"); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	return f.Close()
+}
+
+// writeConfig writes the parameters to the sysctl.d configuration file.
+// The file is removed if there is none.
+func (m *Manager) writeConfig(params []parameter) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write sysctl configuration"))
+
+	p := filepath.Join(m.sysctlDir, configFile)
+	if len(params) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	var out strings.Builder
+	out.WriteString(header)
+	for _, param := range params {
+		fmt.Fprintf(&out, "%s = %s\n", param.name, param.value)
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(m.sysctlDir, 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 sysctl configuration files are world readable
+	if err := os.WriteFile(p+".new", []byte(out.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// loadState returns the parameters previously set by adsys.
+func (m *Manager) loadState() (s state, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't load sysctl state"))
+
+	s.Originals = make(map[string]string)
+	d, err := os.ReadFile(filepath.Join(m.stateDir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(d, &s); err != nil {
+		return s, err
+	}
+	if s.Originals == nil {
+		s.Originals = make(map[string]string)
+	}
+	return s, nil
+}
+
+// saveState saves the parameters set by adsys.
+// The state file is removed if no parameter is set anymore.
+func (m *Manager) saveState(s state) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save sysctl state"))
+
+	p := filepath.Join(m.stateDir, stateFile)
+	if len(s.Originals) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".new", append(d, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
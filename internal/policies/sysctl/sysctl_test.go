@@ -0,0 +1,104 @@
+package sysctl_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/sysctl"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	hardening := "kernel.kptr_restrict = 2\nkernel.dmesg_restrict=1\nnet.ipv4.ip_local_port_range = 1024 65000"
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existing      string
+		mockBehaviour string
+
+		wantErr bool
+	}{
+		"Set parameters":                           {entries: []entry.Entry{{Key: "sysctl/parameters", Value: hardening}}},
+		"Comments and empty lines are ignored":     {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "# Hardening\n\n; Pointers\n  kernel.kptr_restrict = 2  \n"}}},
+		"Closest GPO overrides the same parameter": {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 1\nkernel.dmesg_restrict = 1"}, {Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 2"}}},
+		"Unavailable parameters are skipped":       {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 2\nnet.ipv6.conf.all.forwarding = 0"}}},
+		"Only unavailable parameters is a no-op":   {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "net.ipv6.conf.all.forwarding = 0"}}},
+		"Original values are kept when updating":   {existing: "states/applied", entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 1\nnet.ipv4.ip_forward = 0\nkernel.dmesg_restrict = 1"}}},
+		"Parameters not configured are restored":   {existing: "states/applied", entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 2"}}},
+		"No entries restores all parameters":       {existing: "states/applied"},
+		"Disabled entries restore all parameters":  {existing: "states/applied", entries: []entry.Entry{{Key: "sysctl/parameters", Value: hardening, Disabled: true}}},
+		"Disabled entries are ignored":             {entries: []entry.Entry{{Key: "sysctl/parameters", Value: hardening, Disabled: true}}},
+		"Unsupported keys are ignored":             {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict = 2"}, {Key: "sysctl/unsupported", Value: "kernel.dmesg_restrict = 1"}}},
+		"No entries is a no-op":                    {mockBehaviour: "fail"},
+		"Not a computer is a no-op":                {entries: []entry.Entry{{Key: "sysctl/parameters", Value: hardening}}, isNotComputer: true},
+
+		// Error cases
+		"Error on missing value":             {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict ="}}, wantErr: true},
+		"Error on missing equal sign":        {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel.kptr_restrict 2"}}, wantErr: true},
+		"Error on invalid parameter name":    {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel/kptr_restrict = 2"}}, wantErr: true},
+		"Error on parameter name with dots":  {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kernel..kptr_restrict = 2"}}, wantErr: true},
+		"Error on parameter without section": {entries: []entry.Entry{{Key: "sysctl/parameters", Value: "kptr_restrict = 2"}}, wantErr: true},
+		"Error on corrupted state":           {existing: "states/corrupted", entries: []entry.Entry{{Key: "sysctl/parameters", Value: hardening}}, wantErr: true},
+		"Error on unwritable config dir":     {existing: "states/config-dir-is-a-file", entries: []entry.Entry{{Key: "sysctl/parameters", Value: hardening}}, wantErr: true},
+		"Error on applying parameters":       {entries: []entry.Entry{{Key: "sysctl/parameters", Value: hardening}}, mockBehaviour: "fail", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			require.NoError(t,
+				shutil.CopyTree(filepath.Join("testdata", "proc"), filepath.Join(root, "proc"), &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+				"Setup: can't create kernel parameters")
+
+			m := sysctl.New(
+				sysctl.WithStateDir(filepath.Join(root, "state")),
+				sysctl.WithSysctlDir(filepath.Join(root, "etc", "sysctl.d")),
+				sysctl.WithProcSysDir(filepath.Join(root, "proc", "sys")),
+				sysctl.WithSysctlCmd(testutils.MockCommand(root, "sysctl", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	behaviour, args := c.Behaviour, c.Args
+
+	c.Log(fmt.Sprintf("sysctl %s", strings.Join(args, " ")))
+
+	if behaviour == "fail" {
+		fmt.Fprintln(os.Stderr, "sysctl: requested failure")
+		os.Exit(1)
+	}
+}
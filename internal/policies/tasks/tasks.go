@@ -0,0 +1,378 @@
+// Package tasks provides a manager that runs scheduled tasks with systemd timers.
+//
+// This manager only applies to computer objects.
+//
+// The following setting is supported:
+//   - tasks/scheduled: tasks to run, one per line, of the form
+//     name=<name>; schedule=<calendar>; [user=<user>;] command=<command>
+//     where calendar is a systemd calendar expression (for instance daily or Mon..Fri *-*-* 09:00),
+//     user is the user the command runs as (root by default) and command is the command line to run.
+//     The command must be the last field, and can thus contain semicolons.
+//
+// Each task is rendered as a pair of adsys-task-<name>.timer and adsys-task-<name>.service units in
+// the systemd system units directory. Timers are enabled and started once written. The units of tasks
+// which are not configured anymore are stopped, disabled and removed.
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+// unitPrefix is the prefix of every unit generated by the manager.
+const unitPrefix = "adsys-task-"
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+
+`
+
+var (
+	// taskNameRe matches the names which can be used in a unit name.
+	taskNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	// calendarRe matches the characters allowed in a systemd calendar expression.
+	calendarRe = regexp.MustCompile(`^[A-Za-z0-9 *:.,/~+-]+$`)
+	// userRe matches local and directory user names.
+	userRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@-]*\$?$`)
+)
+
+// task is a command scheduled with a systemd timer.
+type task struct {
+	name     string
+	schedule string
+	user     string
+	command  string
+}
+
+// Manager applies the scheduled tasks policy on the machine.
+type Manager struct {
+	systemUnitDir string
+	systemdCaller systemdCaller
+}
+
+type systemdCaller interface {
+	StartUnit(context.Context, string) error
+	StopUnit(context.Context, string) error
+	EnableUnit(context.Context, string) error
+	DisableUnit(context.Context, string) error
+	DaemonReload(context.Context) error
+}
+
+type options struct {
+	systemUnitDir string
+}
+
+// Option reprents an optional function to change the scheduled tasks manager.
+type Option func(*options)
+
+// WithSystemUnitDir overrides the default systemd system units directory.
+func WithSystemUnitDir(p string) func(*options) {
+	return func(a *options) {
+		a.systemUnitDir = p
+	}
+}
+
+// New returns a new manager for the scheduled tasks policy.
+func New(systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		systemUnitDir: consts.DefaultSystemUnitDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		systemUnitDir: args.systemUnitDir,
+		systemdCaller: systemdCaller,
+	}
+}
+
+// ApplyPolicy renders the scheduled tasks from the list of entries as systemd timers,
+// and removes the ones not configured anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply scheduled tasks policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Scheduled tasks policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying scheduled tasks policy to %s", objectName)
+
+	tasks, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	units := make(map[string]string)
+	for _, t := range tasks {
+		units[unitPrefix+t.name+".service"] = renderService(t)
+		units[unitPrefix+t.name+".timer"] = renderTimer(t)
+	}
+
+	prev, err := m.currentUnits()
+	if err != nil {
+		return err
+	}
+
+	var needsReload bool
+
+	// Stop and remove the tasks which are not configured anymore.
+	for _, name := range prev {
+		if _, ok := units[name]; ok {
+			continue
+		}
+		if err := m.removeUnit(ctx, name); err != nil {
+			return err
+		}
+		needsReload = true
+	}
+
+	var changedTimers []string
+	for _, t := range tasks {
+		var changed bool
+		for _, name := range []string{unitPrefix + t.name + ".service", unitPrefix + t.name + ".timer"} {
+			written, err := writeIfChanged(filepath.Join(m.systemUnitDir, name), units[name])
+			if err != nil {
+				return err
+			}
+			changed = changed || written
+		}
+		if changed {
+			changedTimers = append(changedTimers, unitPrefix+t.name+".timer")
+		}
+		needsReload = needsReload || changed
+	}
+
+	if !needsReload {
+		return nil
+	}
+
+	// Unit files changes are only taken into account by systemd after a reload.
+	if err := m.systemdCaller.DaemonReload(ctx); err != nil {
+		return err
+	}
+
+	for _, name := range changedTimers {
+		log.Infof(ctx, "Enabling timer %s", name)
+		if err := m.systemdCaller.EnableUnit(ctx, name); err != nil {
+			return err
+		}
+		if err := m.systemdCaller.StartUnit(ctx, name); err != nil {
+			log.Warning(ctx, gotext.Get("Couldn't start timer %s: %v", name, err))
+		}
+	}
+
+	return nil
+}
+
+// DumpState returns the units of the scheduled tasks written during the last refresh of the machine.
+// The state is empty for users or if no tasks policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump tasks state of %s", objectName))
+
+	// Tasks policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	// Glob only fails on invalid patterns.
+	units, _ := filepath.Glob(filepath.Join(m.systemUnitDir, unitPrefix+"*"))
+	return syshelpers.DumpFiles(units...)
+}
+
+// parseEntries validates the entries and returns the requested tasks, in order.
+func parseEntries(ctx context.Context, entries []entry.Entry) (tasks []task, err error) {
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		if e.Key != "tasks/scheduled" {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing scheduled tasks entries, skipping it", e.Key))
+			continue
+		}
+
+		for _, l := range strings.Split(v, "\n") {
+			l = strings.TrimSpace(l)
+			if l == "" {
+				continue
+			}
+			t, err := parseTask(l)
+			if err != nil {
+				return nil, err
+			}
+			if slices.ContainsFunc(tasks, func(o task) bool { return o.name == t.name }) {
+				return nil, errors.New(gotext.Get("task %q is defined more than once", t.name))
+			}
+			tasks = append(tasks, t)
+		}
+	}
+
+	return tasks, nil
+}
+
+// parseTask parses a task line of the form name=<name>; schedule=<calendar>; [user=<user>;] command=<command>.
+func parseTask(l string) (t task, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid task %q", l))
+
+	rest := l
+	for rest != "" {
+		var field string
+		field, rest, _ = strings.Cut(rest, ";")
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if k == "command" {
+			// The command is the last field and is kept verbatim.
+			if rest != "" {
+				v = strings.TrimSpace(v + ";" + rest)
+			}
+			rest = ""
+		}
+		if !found || v == "" {
+			return t, errors.New(gotext.Get("expected name=<name>; schedule=<calendar>; [user=<user>;] command=<command>"))
+		}
+
+		var dest *string
+		switch k {
+		case "name":
+			dest = &t.name
+		case "schedule":
+			dest = &t.schedule
+		case "user":
+			dest = &t.user
+		case "command":
+			dest = &t.command
+		default:
+			return t, errors.New(gotext.Get("unsupported field %q", k))
+		}
+		if *dest != "" {
+			return t, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		*dest = v
+	}
+
+	if t.name == "" || t.schedule == "" || t.command == "" {
+		return t, errors.New(gotext.Get("expected name=<name>; schedule=<calendar>; [user=<user>;] command=<command>"))
+	}
+	if !taskNameRe.MatchString(t.name) {
+		return t, errors.New(gotext.Get("%q is not a valid task name: only letters, digits, - and _ are allowed", t.name))
+	}
+	if !calendarRe.MatchString(t.schedule) {
+		return t, errors.New(gotext.Get("%q is not a valid calendar expression", t.schedule))
+	}
+	if t.user == "" {
+		t.user = "root"
+	}
+	if !userRe.MatchString(t.user) {
+		return t, errors.New(gotext.Get("%q is not a valid user name", t.user))
+	}
+
+	return t, nil
+}
+
+// renderService returns the content of the service unit running the command of t.
+func renderService(t task) string {
+	// % introduces specifiers in systemd unit files.
+	command := strings.ReplaceAll(t.command, "%", "%%")
+	return header + fmt.Sprintf(`[Unit]
+Description=ADSys scheduled task %s
+
+[Service]
+Type=oneshot
+User=%s
+ExecStart=%s
+`, t.name, t.user, command)
+}
+
+// renderTimer returns the content of the timer unit scheduling t.
+func renderTimer(t task) string {
+	return header + fmt.Sprintf(`[Unit]
+Description=ADSys timer for scheduled task %s
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`, t.name, t.schedule)
+}
+
+// currentUnits returns the names of the units previously generated by the manager, timers first.
+func (m *Manager) currentUnits() (units []string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't list scheduled tasks units"))
+
+	for _, ext := range []string{".timer", ".service"} {
+		paths, err := filepath.Glob(filepath.Join(m.systemUnitDir, unitPrefix+"*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			units = append(units, filepath.Base(p))
+		}
+	}
+	return units, nil
+}
+
+// removeUnit stops, disables and removes the unit name.
+func (m *Manager) removeUnit(ctx context.Context, name string) error {
+	log.Infof(ctx, "Removing scheduled task unit %s", name)
+
+	if err := m.systemdCaller.StopUnit(ctx, name); err != nil {
+		log.Warning(ctx, gotext.Get("Couldn't stop unit %s: %v", name, err))
+	}
+	if strings.HasSuffix(name, ".timer") {
+		if err := m.systemdCaller.DisableUnit(ctx, name); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(m.systemUnitDir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeIfChanged writes content to p only if it differs from its current content.
+// It returns true if the file was written.
+func writeIfChanged(p, content string) (written bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't save %s", p))
+
+	if old, err := os.ReadFile(p); err == nil && string(old) == content {
+		return false, nil
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	// nolint:gosec // G306 unit files are world readable
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,130 @@
+package tasks_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/tasks"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingState string
+		failOn        string
+
+		wantErr bool
+	}{
+		"Schedule tasks":                            {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; command=/usr/local/bin/backup --full\nname=report; schedule=Mon..Fri *-*-* 09:00:00; command=/usr/bin/report"}}},
+		"Run task as user":                          {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=sync; schedule=hourly; user=alice@example.com; command=/usr/bin/sync-docs"}}},
+		"Command keeps semicolons and specifiers":   {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=cleanup; schedule=weekly; command=/bin/sh -c 'rm -rf /tmp/cache; date +%s > /var/log/cleanup'"}}},
+		"Fields are case insensitive and unordered": {entries: []entry.Entry{{Key: "tasks/scheduled", Value: " Schedule = daily ; USER = root ; Name = backup ; Command = /usr/local/bin/backup "}}},
+		"Empty lines and fields are ignored":        {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "\nname=backup;; schedule=daily; command=/usr/local/bin/backup\n\n"}}},
+		"Unchanged tasks are not enabled again":     {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; command=/usr/local/bin/backup"}}, existingState: "scheduled"},
+		"Changed tasks are updated":                 {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=weekly; command=/usr/local/bin/backup"}}, existingState: "scheduled"},
+		"Tasks not configured anymore are removed":  {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=report; schedule=daily; command=/usr/bin/report"}}, existingState: "scheduled"},
+		"No entries removes tasks":                  {existingState: "scheduled"},
+		"Other units are left untouched":            {existingState: "other-units"},
+		"Failing to start or stop is not an error":  {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=report; schedule=daily; command=/usr/bin/report"}}, existingState: "scheduled", failOn: "start-stop"},
+		"Disabled entries are ignored":              {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; command=/usr/local/bin/backup", Disabled: true}}},
+		"Unsupported keys are ignored":              {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; command=/usr/local/bin/backup"}, {Key: "tasks/other", Value: "something"}}},
+		"No entries is a no-op":                     {},
+		"Users are ignored":                         {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; command=/usr/local/bin/backup"}}, isNotComputer: true},
+
+		// Error cases
+		"Error on missing name":                {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "schedule=daily; command=/usr/local/bin/backup"}}, wantErr: true},
+		"Error on missing schedule":            {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; command=/usr/local/bin/backup"}}, wantErr: true},
+		"Error on missing command":             {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily"}}, wantErr: true},
+		"Error on empty field":                 {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=; schedule=daily; command=/usr/local/bin/backup"}}, wantErr: true},
+		"Error on field set twice":             {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; schedule=weekly; command=/usr/local/bin/backup"}}, wantErr: true},
+		"Error on unsupported field":           {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; group=adm; command=/usr/local/bin/backup"}}, wantErr: true},
+		"Error on invalid task name":           {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=../backup; schedule=daily; command=/usr/local/bin/backup"}}, wantErr: true},
+		"Error on invalid calendar expression": {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily\\nExecStartPre=/bin/true; command=/usr/local/bin/backup"}}, wantErr: true},
+		"Error on invalid user name":           {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; user=root admin; command=/usr/local/bin/backup"}}, wantErr: true},
+		"Error on task defined more than once": {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; command=/usr/local/bin/backup\nname=backup; schedule=weekly; command=/usr/local/bin/backup"}}, wantErr: true},
+		"Error on daemon reload":               {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; command=/usr/local/bin/backup"}}, failOn: "daemon-reload", wantErr: true},
+		"Error on enabling timers":             {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; command=/usr/local/bin/backup"}}, failOn: "enable", wantErr: true},
+		"Error on disabling timers":            {existingState: "scheduled", failOn: "disable", wantErr: true},
+		"Error on unwritable unit directory":   {entries: []entry.Entry{{Key: "tasks/scheduled", Value: "name=backup; schedule=daily; command=/usr/local/bin/backup"}}, existingState: "unit-dir-is-file", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existingState != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", "states", tc.existingState), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial state")
+			}
+
+			m := tasks.New(&mockSystemdCaller{root: root, failOn: tc.failOn}, tasks.WithSystemUnitDir(filepath.Join(root, "system")))
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockSystemdCaller logs its calls in root/systemd.log.
+// failOn allows to make some calls fail.
+type mockSystemdCaller struct {
+	root   string
+	failOn string
+}
+
+func (s mockSystemdCaller) StartUnit(_ context.Context, unit string) error {
+	return s.call("start-stop", "start", unit)
+}
+
+func (s mockSystemdCaller) StopUnit(_ context.Context, unit string) error {
+	return s.call("start-stop", "stop", unit)
+}
+
+func (s mockSystemdCaller) EnableUnit(_ context.Context, unit string) error {
+	return s.call("enable", "enable", unit)
+}
+
+func (s mockSystemdCaller) DisableUnit(_ context.Context, unit string) error {
+	return s.call("disable", "disable", unit)
+}
+
+func (s mockSystemdCaller) DaemonReload(_ context.Context) error {
+	return s.call("daemon-reload", "daemon-reload", "")
+}
+
+func (s mockSystemdCaller) call(step, action, unit string) error {
+	// #nosec G302 - this is a test log file
+	f, err := os.OpenFile(filepath.Join(s.root, "systemd.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, strings.TrimSpace(action+" "+unit)); err != nil {
+		return err
+	}
+
+	if s.failOn == step {
+		return errors.New("requested failure")
+	}
+	return nil
+}
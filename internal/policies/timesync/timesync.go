@@ -0,0 +1,318 @@
+// Package timesync provides a manager that configures the time sources of the machine, with chrony or
+// systemd-timesyncd.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported, mirroring the Windows Time service (W32Time) policies:
+//   - timesync/servers: the NTP servers the machine synchronizes its clock with, separated by spaces or one
+//     per line. The W32Time flags which can follow a server, like in dc.example.com,0x9, are ignored;
+//   - timesync/min-poll: the minimum polling interval, in log2 seconds, from 4 (16 seconds) to 17 (36 hours);
+//   - timesync/max-poll: the maximum polling interval, in log2 seconds, from 4 (16 seconds) to 17 (36 hours).
+//
+// If chrony is installed, the servers are written to a sources file of chrony, with the polling intervals of the
+// policy, and preferred over the ones of its configuration file. chrony reloads its sources right away. Otherwise,
+// the settings are written to a configuration file of systemd-timesyncd, replacing the servers of the system, and
+// the service is restarted if it is running.
+//
+// The configuration files are removed once the policy is not configured anymore, restoring the time sources of
+// the system.
+package timesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	chronySourcesFile = "adsys.sources"
+	timesyncdConfFile = "adsys.conf"
+	timesyncdUnit     = "systemd-timesyncd.service"
+)
+
+// Bounds of the polling intervals, in log2 seconds. 16 seconds is the minimum supported by systemd-timesyncd.
+const (
+	minPollBound = 4
+	maxPollBound = 17
+)
+
+// hostnameRe matches the hostname of an NTP server.
+var hostnameRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*\.?$`)
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// settings is the time synchronization configuration requested by the policy.
+type settings struct {
+	servers []string
+	minPoll int
+	maxPoll int
+}
+
+// Manager applies the time synchronization policy on the machine.
+type Manager struct {
+	chronySourcesDir string
+	timesyncdConfDir string
+
+	chronycCmd   []string
+	systemctlCmd []string
+	cmdTimeout   time.Duration
+}
+
+type options struct {
+	chronySourcesDir string
+	timesyncdConfDir string
+	chronycCmd       []string
+	systemctlCmd     []string
+	cmdTimeout       time.Duration
+}
+
+// Option reprents an optional function to change the timesync manager.
+type Option func(*options)
+
+// WithChronySourcesDir overrides the default chrony sources directory.
+func WithChronySourcesDir(p string) func(*options) {
+	return func(a *options) {
+		a.chronySourcesDir = p
+	}
+}
+
+// WithTimesyncdConfDir overrides the default systemd-timesyncd configuration directory.
+func WithTimesyncdConfDir(p string) func(*options) {
+	return func(a *options) {
+		a.timesyncdConfDir = p
+	}
+}
+
+// WithChronycCmd overrides the default chronyc command.
+func WithChronycCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.chronycCmd = cmd
+	}
+}
+
+// WithSystemctlCmd overrides the default systemctl command.
+func WithSystemctlCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.systemctlCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the time synchronization policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		chronySourcesDir: consts.DefaultChronySourcesDir,
+		timesyncdConfDir: consts.DefaultTimesyncdConfDir,
+		chronycCmd:       []string{"chronyc"},
+		systemctlCmd:     []string{"systemctl"},
+		cmdTimeout:       consts.DefaultHelperExecTimeout,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		chronySourcesDir: args.chronySourcesDir,
+		timesyncdConfDir: args.timesyncdConfDir,
+		chronycCmd:       args.chronycCmd,
+		systemctlCmd:     args.systemctlCmd,
+		cmdTimeout:       args.cmdTimeout,
+	}
+}
+
+// ApplyPolicy configures the time sources of the machine from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply time synchronization policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Time synchronization policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying time synchronization policy to %s", objectName)
+
+	s, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	// chrony conflicts with systemd-timesyncd: only one of them is installed.
+	useChrony := true
+	if _, err := os.Stat(filepath.Dir(m.chronySourcesDir)); errors.Is(err, fs.ErrNotExist) {
+		useChrony = false
+	} else if err != nil {
+		return err
+	}
+
+	chronySources, timesyncdConf := s.chronySources(), s.timesyncdConf()
+	if useChrony {
+		timesyncdConf = ""
+	} else {
+		chronySources = ""
+	}
+
+	chronyChanged, err := syshelpers.WriteConfig(filepath.Join(m.chronySourcesDir, chronySourcesFile), chronySources)
+	if err != nil {
+		return err
+	}
+	timesyncdChanged, err := syshelpers.WriteConfig(filepath.Join(m.timesyncdConfDir, timesyncdConfFile), timesyncdConf)
+	if err != nil {
+		return err
+	}
+
+	if useChrony {
+		if !chronyChanged {
+			return nil
+		}
+		log.Info(ctx, gotext.Get("Reloading chrony time sources"))
+		// chrony reads its sources when it starts: don't fail if it is not running.
+		if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.chronycCmd, "reload", "sources"); err != nil {
+			log.Warning(ctx, gotext.Get("Couldn't reload chrony time sources, they will be used once chrony is started: %v", err))
+		}
+		return nil
+	}
+
+	if !timesyncdChanged {
+		return nil
+	}
+	log.Info(ctx, gotext.Get("Restarting %s to apply the time sources", timesyncdUnit))
+	_, err = syshelpers.Run(ctx, m.cmdTimeout, m.systemctlCmd, "try-restart", timesyncdUnit)
+	return err
+}
+
+// DumpState returns the chrony sources and timesyncd configuration written during the last refresh of the machine.
+// The state is empty for users or if no time synchronization policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump time synchronization state of %s", objectName))
+
+	// Time synchronization policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(
+		filepath.Join(m.chronySourcesDir, chronySourcesFile),
+		filepath.Join(m.timesyncdConfDir, timesyncdConfFile),
+	)
+}
+
+// parseEntries validates the entries and returns the requested configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry) (s settings, err error) {
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "timesync/servers":
+			for _, server := range strings.Fields(v) {
+				// W32Time servers can be followed by their flags, like dc.example.com,0x9.
+				server, _, _ = strings.Cut(server, ",")
+				if !validServer(server) {
+					return s, errors.New(gotext.Get("invalid NTP server %q: expected a hostname or an IP address", server))
+				}
+				if !slices.Contains(s.servers, server) {
+					s.servers = append(s.servers, server)
+				}
+			}
+		case "timesync/min-poll", "timesync/max-poll":
+			p, err := strconv.Atoi(v)
+			if err != nil || p < minPollBound || p > maxPollBound {
+				return s, errors.New(gotext.Get("invalid polling interval %q: expected a number between %d and %d", v, minPollBound, maxPollBound))
+			}
+			if e.Key == "timesync/min-poll" {
+				s.minPoll = p
+			} else {
+				s.maxPoll = p
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing time synchronization entries, skipping it", e.Key))
+		}
+	}
+
+	if s.minPoll != 0 && s.maxPoll != 0 && s.minPoll > s.maxPoll {
+		return s, errors.New(gotext.Get("minimum polling interval %d is greater than the maximum polling interval %d", s.minPoll, s.maxPoll))
+	}
+
+	return s, nil
+}
+
+// validServer returns true if server is a hostname or an IP address.
+func validServer(server string) bool {
+	if _, err := netip.ParseAddr(server); err == nil {
+		return true
+	}
+	return len(server) <= 253 && hostnameRe.MatchString(server)
+}
+
+// chronySources returns the chrony sources of the settings, or an empty string if no server is configured.
+// The polling intervals are options of the servers in chrony.
+func (s settings) chronySources() string {
+	if len(s.servers) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	out.WriteString(header)
+	for _, server := range s.servers {
+		fmt.Fprintf(&out, "server %s iburst prefer", server)
+		if s.minPoll != 0 {
+			fmt.Fprintf(&out, " minpoll %d", s.minPoll)
+		}
+		if s.maxPoll != 0 {
+			fmt.Fprintf(&out, " maxpoll %d", s.maxPoll)
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// timesyncdConf returns the systemd-timesyncd configuration of the settings, or an empty string if nothing is
+// configured.
+func (s settings) timesyncdConf() string {
+	if len(s.servers) == 0 && s.minPoll == 0 && s.maxPoll == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	out.WriteString(header)
+	out.WriteString("\n[Time]\n")
+	if len(s.servers) > 0 {
+		fmt.Fprintf(&out, "NTP=%s\n", strings.Join(s.servers, " "))
+	}
+	if s.minPoll != 0 {
+		fmt.Fprintf(&out, "PollIntervalMinSec=%d\n", 1<<s.minPoll)
+	}
+	if s.maxPoll != 0 {
+		fmt.Fprintf(&out, "PollIntervalMaxSec=%d\n", 1<<s.maxPoll)
+	}
+	return out.String()
+}
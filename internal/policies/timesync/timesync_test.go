@@ -0,0 +1,127 @@
+package timesync_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/timesync"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "timesync/servers", Value: "dc1.example.com\ndc2.example.com"},
+		{Key: "timesync/min-poll", Value: "6"},
+		{Key: "timesync/max-poll", Value: "10"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		mockBehaviour string
+		makeReadOnly  bool
+
+		wantErr bool
+	}{
+		// systemd-timesyncd
+		"Servers with timesyncd":                {entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com\ndc2.example.com"}}},
+		"Servers separated by spaces":           {entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com dc2.example.com  10.0.0.1"}}},
+		"Servers with W32Time flags":            {entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com,0x9 dc2.example.com,0x1"}}},
+		"IPv6 servers":                          {entries: []entry.Entry{{Key: "timesync/servers", Value: "2001:db8::1\nfe80::1"}}},
+		"Duplicated servers":                    {entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com\ndc1.example.com,0x9"}}},
+		"Polling intervals only with timesyncd": {entries: []entry.Entry{{Key: "timesync/min-poll", Value: "4"}, {Key: "timesync/max-poll", Value: "17"}}},
+		"All entries with timesyncd":            {entries: allEntries},
+		"Existing timesyncd file is updated":    {existingDirs: "existing-timesyncd-conf", entries: allEntries},
+		"Existing timesyncd file is unchanged":  {existingDirs: "existing-timesyncd-conf", entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com"}}},
+		"No entries removes timesyncd file":     {existingDirs: "existing-timesyncd-conf"},
+
+		// chrony
+		"Servers with chrony":                   {existingDirs: "chrony-installed", entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com\ndc2.example.com"}}},
+		"All entries with chrony":               {existingDirs: "chrony-installed", entries: allEntries},
+		"Polling intervals only with chrony":    {existingDirs: "chrony-installed", entries: []entry.Entry{{Key: "timesync/min-poll", Value: "4"}}},
+		"Existing chrony file is updated":       {existingDirs: "existing-chrony-sources", entries: allEntries},
+		"Existing chrony file is unchanged":     {existingDirs: "existing-chrony-sources", entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com"}}},
+		"No entries removes chrony file":        {existingDirs: "existing-chrony-sources"},
+		"Chrony removes stale timesyncd file":   {existingDirs: "both-existing", entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com"}}},
+		"Failing to reload chrony is a warning": {existingDirs: "chrony-installed", entries: allEntries, mockBehaviour: "fail-chronyc"},
+
+		"Values are trimmed":               {entries: []entry.Entry{{Key: "timesync/min-poll", Value: "  6\n"}}},
+		"Disabled entries are ignored":     {entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com"}, {Key: "timesync/min-poll", Value: "6", Disabled: true}}},
+		"Empty entries are ignored":        {entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com"}, {Key: "timesync/max-poll", Value: ""}}},
+		"Unsupported keys are ignored":     {entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com"}, {Key: "timesync/special-poll-interval", Value: "3600"}}},
+		"No entries and no existing files": {},
+		"Not a computer is a no-op":        {isNotComputer: true, existingDirs: "existing-timesyncd-conf"},
+
+		// Error cases
+		"Error on invalid server":                               {entries: []entry.Entry{{Key: "timesync/servers", Value: "dc1.example.com\n-invalid"}}, wantErr: true},
+		"Error on invalid polling interval":                     {entries: []entry.Entry{{Key: "timesync/min-poll", Value: "six"}}, wantErr: true},
+		"Error on polling interval below minimum":               {entries: []entry.Entry{{Key: "timesync/min-poll", Value: "3"}}, wantErr: true},
+		"Error on polling interval above maximum":               {entries: []entry.Entry{{Key: "timesync/max-poll", Value: "18"}}, wantErr: true},
+		"Error on minimum polling interval above maximum":       {entries: []entry.Entry{{Key: "timesync/min-poll", Value: "10"}, {Key: "timesync/max-poll", Value: "6"}}, wantErr: true},
+		"Error on restarting timesyncd":                         {entries: allEntries, mockBehaviour: "fail-systemctl", wantErr: true},
+		"Error on unwritable timesyncd configuration directory": {existingDirs: "existing-timesyncd-conf", makeReadOnly: true, entries: allEntries, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			chronySourcesDir := filepath.Join(root, "etc", "chrony", "sources.d")
+			timesyncdConfDir := filepath.Join(root, "etc", "systemd", "timesyncd.conf.d")
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.makeReadOnly {
+				testutils.MakeReadOnly(t, timesyncdConfDir)
+			}
+
+			m := timesync.New(
+				timesync.WithChronySourcesDir(chronySourcesDir),
+				timesync.WithTimesyncdConfDir(timesyncdConfDir),
+				timesync.WithChronycCmd(testutils.MockCommand(root, "chronyc", tc.mockBehaviour)),
+				timesync.WithSystemctlCmd(testutils.MockCommand(root, "systemctl", tc.mockBehaviour)),
+			)
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, behaviours, args := c.Name, strings.Split(c.Behaviour, ","), c.Args
+
+	c.Log(fmt.Sprintf("%s %s", name, strings.Join(args, " ")))
+
+	if slices.Contains(behaviours, "fail-"+name) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,262 @@
+// Package updates provides a manager that configures the automatic updates of the machine with
+// unattended-upgrades.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported, mirroring the Windows Update policies:
+//   - updates/automatic: the automatic updates behavior, among disabled (no automatic update),
+//     download (updates are downloaded but not installed) and install (updates are downloaded and
+//     installed);
+//   - updates/allowed-origins: the origins of the packages which are upgraded automatically, one per
+//     line, of the form <origin>:<archive>, for instance ${distro_id}:${distro_codename}-security.
+//     They replace the origins configured by the unattended-upgrades package;
+//   - updates/reboot-time: the time, of the form HH:MM or now, at which the machine reboots
+//     automatically if an update requires it;
+//   - updates/no-reboot-with-users: true to not reboot automatically while users are logged in.
+//
+// The settings are written to an apt configuration file, read after the ones shipped by the
+// unattended-upgrades package, so that they take precedence. This file is removed once the policy
+// is not configured anymore, restoring the configuration of the system.
+package updates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+// configFile is named to be read after 20auto-upgrades and 50unattended-upgrades.
+const configFile = "99adsys-updates"
+
+// automaticModes are the supported automatic updates behaviors.
+var automaticModes = []string{"disabled", "download", "install"}
+
+// originRe matches an allowed origin of unattended-upgrades, of the form <origin>:<archive>.
+var originRe = regexp.MustCompile(`^[^":;\\\s][^":;\\]*:[^":;\\\s]+$`)
+
+// rebootTimeRe matches a reboot time of unattended-upgrades.
+var rebootTimeRe = regexp.MustCompile(`^(now|([01][0-9]|2[0-3]):[0-5][0-9])$`)
+
+const header = `// This file is managed by adsys.
+// Do not edit this file manually.
+// Any changes will be overwritten.
+`
+
+// settings is the automatic updates configuration requested by the policy.
+type settings struct {
+	automatic         string
+	allowedOrigins    []string
+	rebootTime        string
+	noRebootWithUsers bool
+}
+
+// Manager applies the automatic updates policy on the machine.
+type Manager struct {
+	aptConfDir string
+}
+
+type options struct {
+	aptConfDir string
+}
+
+// Option reprents an optional function to change the updates manager.
+type Option func(*options)
+
+// WithAptConfDir overrides the default apt configuration directory.
+func WithAptConfDir(p string) func(*options) {
+	return func(a *options) {
+		a.aptConfDir = p
+	}
+}
+
+// New returns a new manager for the automatic updates policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		aptConfDir: consts.DefaultAptConfDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		aptConfDir: args.aptConfDir,
+	}
+}
+
+// ApplyPolicy writes the automatic updates configuration from the list of entries.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply automatic updates policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "Automatic updates policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying automatic updates policy to %s", objectName)
+
+	s, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	changed, err := m.writeConfig(s.String())
+	if err != nil {
+		return err
+	}
+	if changed {
+		log.Info(ctx, gotext.Get("Automatic updates configuration updated"))
+	}
+	return nil
+}
+
+// DumpState returns the apt configuration of the automatic updates written during the last refresh of the machine.
+// The state is empty for users or if no automatic updates policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump automatic updates state of %s", objectName))
+
+	// Automatic updates policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.aptConfDir, configFile))
+}
+
+// parseEntries validates the entries and returns the requested configuration.
+func parseEntries(ctx context.Context, entries []entry.Entry) (s settings, err error) {
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+
+		switch e.Key {
+		case "updates/automatic":
+			if !slices.Contains(automaticModes, v) {
+				return s, errors.New(gotext.Get("invalid automatic updates behavior %q: expected one of %s", v, strings.Join(automaticModes, ", ")))
+			}
+			s.automatic = v
+		case "updates/allowed-origins":
+			for _, l := range strings.Split(v, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" {
+					continue
+				}
+				if !originRe.MatchString(l) {
+					return s, errors.New(gotext.Get("invalid allowed origin %q: expected <origin>:<archive>", l))
+				}
+				if !slices.Contains(s.allowedOrigins, l) {
+					s.allowedOrigins = append(s.allowedOrigins, l)
+				}
+			}
+		case "updates/reboot-time":
+			if !rebootTimeRe.MatchString(v) {
+				return s, errors.New(gotext.Get("invalid reboot time %q: expected HH:MM or now", v))
+			}
+			s.rebootTime = v
+		case "updates/no-reboot-with-users":
+			switch v {
+			case "true":
+				s.noRebootWithUsers = true
+			case "false":
+			default:
+				return s, errors.New(gotext.Get("invalid no reboot with users value %q: true or false is expected", v))
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing automatic updates entries, skipping it", e.Key))
+		}
+	}
+
+	return s, nil
+}
+
+// String returns the apt configuration of the settings, or an empty string if nothing is configured.
+func (s settings) String() string {
+	var out strings.Builder
+
+	if s.automatic != "" {
+		download, install := "0", "0"
+		if s.automatic != "disabled" {
+			download = "1"
+		}
+		if s.automatic == "install" {
+			install = "1"
+		}
+		fmt.Fprintf(&out, "\nAPT::Periodic::Update-Package-Lists %q;\n", download)
+		fmt.Fprintf(&out, "APT::Periodic::Download-Upgradeable-Packages %q;\n", download)
+		fmt.Fprintf(&out, "APT::Periodic::Unattended-Upgrade %q;\n", install)
+	}
+
+	if len(s.allowedOrigins) > 0 {
+		// Lists are merged across configuration files: clear the ones of the system first.
+		out.WriteString("\n#clear Unattended-Upgrade::Allowed-Origins;\n#clear Unattended-Upgrade::Origins-Pattern;\n")
+		out.WriteString("Unattended-Upgrade::Allowed-Origins {\n")
+		for _, o := range s.allowedOrigins {
+			fmt.Fprintf(&out, "\t%q;\n", o)
+		}
+		out.WriteString("};\n")
+	}
+
+	if s.rebootTime != "" || s.noRebootWithUsers {
+		out.WriteString("\n")
+	}
+	if s.rebootTime != "" {
+		fmt.Fprintf(&out, "Unattended-Upgrade::Automatic-Reboot \"true\";\nUnattended-Upgrade::Automatic-Reboot-Time %q;\n", s.rebootTime)
+	}
+	if s.noRebootWithUsers {
+		out.WriteString("Unattended-Upgrade::Automatic-Reboot-WithUsers \"false\";\n")
+	}
+
+	if out.Len() == 0 {
+		return ""
+	}
+	return header + out.String()
+}
+
+// writeConfig writes content to the apt configuration file, removing it if content is empty.
+// It returns true if the file changed.
+func (m *Manager) writeConfig(content string) (changed bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write automatic updates configuration"))
+
+	p := filepath.Join(m.aptConfDir, configFile)
+	if content == "" {
+		if err := os.Remove(p); errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if old, err := os.ReadFile(p); err == nil && string(old) == content {
+		return false, nil
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(m.aptConfDir, 0755); err != nil {
+		return false, err
+	}
+	// nolint:gosec // G306 apt configuration is world readable
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
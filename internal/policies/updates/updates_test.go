@@ -0,0 +1,91 @@
+package updates_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/updates"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	allEntries := []entry.Entry{
+		{Key: "updates/automatic", Value: "install"},
+		{Key: "updates/allowed-origins", Value: "${distro_id}:${distro_codename}\n${distro_id}:${distro_codename}-security"},
+		{Key: "updates/reboot-time", Value: "02:30"},
+		{Key: "updates/no-reboot-with-users", Value: "true"},
+	}
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		makeReadOnly  bool
+
+		wantErr bool
+	}{
+		"Automatic updates disabled":       {entries: []entry.Entry{{Key: "updates/automatic", Value: "disabled"}}},
+		"Automatic updates download only":  {entries: []entry.Entry{{Key: "updates/automatic", Value: "download"}}},
+		"Automatic updates installed":      {entries: []entry.Entry{{Key: "updates/automatic", Value: "install"}}},
+		"Allowed origins":                  {entries: []entry.Entry{{Key: "updates/allowed-origins", Value: "${distro_id}:${distro_codename}-security\nGoogle LLC:stable"}}},
+		"Duplicated allowed origins":       {entries: []entry.Entry{{Key: "updates/allowed-origins", Value: "${distro_id}:${distro_codename}-security\n\n${distro_id}:${distro_codename}-security"}}},
+		"Reboot time":                      {entries: []entry.Entry{{Key: "updates/reboot-time", Value: "02:30"}}},
+		"Reboot with users":                {entries: []entry.Entry{{Key: "updates/reboot-time", Value: "02:30"}, {Key: "updates/no-reboot-with-users", Value: "false"}}},
+		"Reboot now":                       {entries: []entry.Entry{{Key: "updates/reboot-time", Value: "now"}}},
+		"No reboot with users":             {entries: []entry.Entry{{Key: "updates/no-reboot-with-users", Value: "true"}}},
+		"All entries":                      {entries: allEntries},
+		"Values are trimmed":               {entries: []entry.Entry{{Key: "updates/automatic", Value: "  download\n"}}},
+		"Disabled entries are ignored":     {entries: []entry.Entry{{Key: "updates/automatic", Value: "install"}, {Key: "updates/no-reboot-with-users", Value: "true", Disabled: true}}},
+		"Empty entries are ignored":        {entries: []entry.Entry{{Key: "updates/automatic", Value: "install"}, {Key: "updates/reboot-time", Value: ""}}},
+		"Unsupported keys are ignored":     {entries: []entry.Entry{{Key: "updates/automatic", Value: "install"}, {Key: "updates/deadline", Value: "3"}}},
+		"No entries and no existing file":  {},
+		"No entries removes existing file": {existingDirs: "existing-config"},
+		"Existing file is updated":         {existingDirs: "existing-config", entries: []entry.Entry{{Key: "updates/automatic", Value: "download"}}},
+		"Existing file is unchanged":       {existingDirs: "existing-config", entries: []entry.Entry{{Key: "updates/automatic", Value: "install"}}},
+		"Not a computer is a no-op":        {isNotComputer: true, existingDirs: "existing-config"},
+
+		// Error cases
+		"Error on invalid automatic updates behavior": {entries: []entry.Entry{{Key: "updates/automatic", Value: "notify"}}, wantErr: true},
+		"Error on allowed origin without archive":     {entries: []entry.Entry{{Key: "updates/allowed-origins", Value: "${distro_id}"}}, wantErr: true},
+		"Error on allowed origin with quotes":         {entries: []entry.Entry{{Key: "updates/allowed-origins", Value: `Ubuntu:"jammy"`}}, wantErr: true},
+		"Error on invalid no reboot with users value": {entries: []entry.Entry{{Key: "updates/no-reboot-with-users", Value: "yes"}}, wantErr: true},
+		"Error on invalid reboot time":                {entries: []entry.Entry{{Key: "updates/reboot-time", Value: "25:00"}}, wantErr: true},
+		"Error on unwritable directory":               {existingDirs: "existing-config", makeReadOnly: true, entries: allEntries, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			aptConfDir := filepath.Join(root, "etc", "apt", "apt.conf.d")
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.makeReadOnly {
+				testutils.MakeReadOnly(t, aptConfDir)
+			}
+
+			m := updates.New(updates.WithAptConfDir(aptConfDir))
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
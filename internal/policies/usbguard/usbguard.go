@@ -0,0 +1,225 @@
+// Package usbguard provides a manager that deploys USBGuard device rules on the machine.
+//
+// This manager only applies to computer objects.
+//
+// The following settings are supported:
+//   - usbguard/block-mass-storage: true to block all USB devices with a mass storage interface,
+//     like USB keys and external drives.
+//   - usbguard/rules: USBGuard rules, one per line, in the usbguard-rules.conf(5) syntax, for
+//     instance allow id 1050:0407. Empty lines and lines starting with # are ignored.
+//
+// The custom rules, followed by the mass storage blocking rule, are written to a 70-adsys.conf file in
+// the rules directory of USBGuard, and the USBGuard daemon is restarted to load them whenever the file
+// changes. The file is removed once the policy is not configured anymore.
+// Nothing is done if USBGuard is not installed.
+package usbguard
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	rulesFile   = "70-adsys.conf"
+	serviceName = "usbguard.service"
+
+	// blockMassStorageRule blocks devices exposing at least one mass storage interface (class 08).
+	blockMassStorageRule = "block with-interface one-of { 08:*:* }"
+)
+
+// targets are the keywords a USBGuard rule can start with.
+var targets = []string{"allow", "block", "reject"}
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// Manager applies the usbguard policy on the machine.
+type Manager struct {
+	rulesDir      string
+	systemdCaller systemdCaller
+}
+
+type systemdCaller interface {
+	StartUnit(context.Context, string) error
+	StopUnit(context.Context, string) error
+}
+
+type options struct {
+	rulesDir string
+}
+
+// Option reprents an optional function to change the usbguard manager.
+type Option func(*options)
+
+// WithRulesDir overrides the default USBGuard rules directory.
+func WithRulesDir(p string) func(*options) {
+	return func(a *options) {
+		a.rulesDir = p
+	}
+}
+
+// New returns a new manager for the usbguard policy.
+func New(systemdCaller systemdCaller, opts ...Option) *Manager {
+	// defaults
+	args := options{
+		rulesDir: consts.DefaultUSBGuardRulesDir,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		rulesDir:      args.rulesDir,
+		systemdCaller: systemdCaller,
+	}
+}
+
+// ApplyPolicy deploys the USBGuard rules from the list of entries and restarts USBGuard to load them.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply usbguard policy to %s", objectName))
+
+	if !isComputer {
+		log.Debug(ctx, "USBGuard policy is only supported for computers, skipping...")
+		return nil
+	}
+
+	log.Debugf(ctx, "Applying usbguard policy to %s", objectName)
+
+	rules, err := parseEntries(ctx, entries)
+	if err != nil {
+		return err
+	}
+
+	// The configuration directory of USBGuard is shipped by its package.
+	if _, err := os.Stat(filepath.Dir(m.rulesDir)); errors.Is(err, fs.ErrNotExist) {
+		if len(rules) > 0 {
+			log.Warning(ctx, gotext.Get("USBGuard is not installed, skipping USB device rules"))
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	changed, err := m.writeRules(rules)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Debug(ctx, "USBGuard rules are up to date")
+		return nil
+	}
+
+	// USBGuard only reads its rules files on startup.
+	log.Infof(ctx, "Restarting USBGuard to load %d device rules", len(rules))
+	if err := m.systemdCaller.StopUnit(ctx, serviceName); err != nil {
+		return err
+	}
+	return m.systemdCaller.StartUnit(ctx, serviceName)
+}
+
+// DumpState returns the USBGuard rules written during the last refresh of the machine.
+// The state is empty for users or if no usbguard policy is applied.
+func (m *Manager) DumpState(_ context.Context, objectName string, isComputer bool) (state string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't dump usbguard state of %s", objectName))
+
+	// USBGuard policy is only supported for computers.
+	if !isComputer {
+		return "", nil
+	}
+
+	return syshelpers.DumpFiles(filepath.Join(m.rulesDir, rulesFile))
+}
+
+// parseEntries validates the entries and returns the rules to deploy, in order and without duplicates.
+func parseEntries(ctx context.Context, entries []entry.Entry) (rules []string, err error) {
+	var blockMassStorage bool
+	for _, e := range entries {
+		if e.Disabled {
+			continue
+		}
+
+		switch e.Key {
+		case "usbguard/block-mass-storage":
+			switch e.Value {
+			case "true":
+				blockMassStorage = true
+			case "false":
+				blockMassStorage = false
+			default:
+				return nil, errors.New(gotext.Get("invalid block mass storage value %q: true or false is expected", e.Value))
+			}
+		case "usbguard/rules":
+			for _, l := range strings.Split(e.Value, "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" || strings.HasPrefix(l, "#") {
+					continue
+				}
+				target, _, _ := strings.Cut(l, " ")
+				if !slices.Contains(targets, target) {
+					return nil, errors.New(gotext.Get("invalid USBGuard rule %q: it should start with allow, block or reject", l))
+				}
+				if slices.Contains(rules, l) {
+					continue
+				}
+				rules = append(rules, l)
+			}
+		default:
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing usbguard entries, skipping it", e.Key))
+		}
+	}
+
+	// The first matching rule applies: explicit rules, like allowing some approved devices, take precedence.
+	if blockMassStorage && !slices.Contains(rules, blockMassStorageRule) {
+		rules = append(rules, blockMassStorageRule)
+	}
+
+	return rules, nil
+}
+
+// writeRules writes the rules to the adsys rules file, removing it if there is none.
+// It returns true if the file changed.
+func (m *Manager) writeRules(rules []string) (changed bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write USBGuard rules"))
+
+	p := filepath.Join(m.rulesDir, rulesFile)
+	if len(rules) == 0 {
+		if err := os.Remove(p); errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	content := header + strings.Join(rules, "\n") + "\n"
+	if old, err := os.ReadFile(p); err == nil && string(old) == content {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(m.rulesDir, 0700); err != nil {
+		return false, err
+	}
+	// Like the rules file shipped by USBGuard, only root can read the rules.
+	if err := os.WriteFile(p+".new", []byte(content), 0600); err != nil {
+		return false, err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,113 @@
+package usbguard_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/usbguard"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	rules := "allow id 1050:0407\nreject with-interface equals { 03:*:* 08:*:* }"
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existing      string
+		noUSBGuard    bool
+		failOn        string
+
+		wantErr bool
+	}{
+		"Deploy rules":                          {entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}}},
+		"Block mass storage":                    {entries: []entry.Entry{{Key: "usbguard/block-mass-storage", Value: "true"}}},
+		"Rules take precedence on mass storage": {entries: []entry.Entry{{Key: "usbguard/block-mass-storage", Value: "true"}, {Key: "usbguard/rules", Value: rules}}},
+		"Mass storage not blocked is a no-op":   {entries: []entry.Entry{{Key: "usbguard/block-mass-storage", Value: "false"}}, failOn: "stop"},
+		"Comments and empty lines are ignored":  {entries: []entry.Entry{{Key: "usbguard/rules", Value: "# Approved keys\n\n  allow id 1050:0407  \n"}}},
+		"Duplicated rules are deployed once":    {entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}, {Key: "usbguard/rules", Value: "allow id 1050:0407\nblock id 0781:5581"}}},
+		"Rules are updated":                     {existing: "states/applied", entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}}},
+		"Unchanged rules are not loaded again":  {existing: "states/unchanged", entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}}, failOn: "stop"},
+		"No entries removes rules":              {existing: "states/applied"},
+		"Disabled entries remove rules":         {existing: "states/applied", entries: []entry.Entry{{Key: "usbguard/rules", Value: rules, Disabled: true}}},
+		"Disabled entries are ignored":          {entries: []entry.Entry{{Key: "usbguard/block-mass-storage", Value: "true", Disabled: true}}, failOn: "stop"},
+		"Unsupported keys are ignored":          {entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}, {Key: "usbguard/unsupported", Value: "block"}}},
+		"No entries is a no-op":                 {failOn: "stop"},
+		"USBGuard not installed is a no-op":     {entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}}, noUSBGuard: true, failOn: "stop"},
+		"Not a computer is a no-op":             {entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}}, isNotComputer: true, failOn: "stop"},
+
+		// Error cases
+		"Error on invalid block mass storage value": {entries: []entry.Entry{{Key: "usbguard/block-mass-storage", Value: "yes"}}, wantErr: true},
+		"Error on rule with unknown target":         {entries: []entry.Entry{{Key: "usbguard/rules", Value: "deny id 1050:0407"}}, wantErr: true},
+		"Error on rule without target":              {entries: []entry.Entry{{Key: "usbguard/rules", Value: "id 1050:0407"}}, wantErr: true},
+		"Error on unwritable rules directory":       {existing: "states/rules-dir-is-a-file", entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}}, wantErr: true},
+		"Error on stopping USBGuard":                {entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}}, failOn: "stop", wantErr: true},
+		"Error on starting USBGuard":                {entries: []entry.Entry{{Key: "usbguard/rules", Value: rules}}, failOn: "start", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			if tc.existing != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existing), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			} else if !tc.noUSBGuard {
+				require.NoError(t, os.MkdirAll(filepath.Join(root, "etc", "usbguard"), 0750), "Setup: can't create USBGuard configuration directory")
+			}
+
+			m := usbguard.New(&mockSystemdCaller{root: root, failOn: tc.failOn},
+				usbguard.WithRulesDir(filepath.Join(root, "etc", "usbguard", "rules.d")))
+			err := m.ApplyPolicy(context.Background(), "ubuntu", !tc.isNotComputer, tc.entries)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+// mockSystemdCaller logs its calls in root/systemd.log.
+// failOn allows to make the start or stop calls fail.
+type mockSystemdCaller struct {
+	root   string
+	failOn string
+}
+
+func (s mockSystemdCaller) StartUnit(_ context.Context, unit string) error {
+	return s.call("start", unit)
+}
+
+func (s mockSystemdCaller) StopUnit(_ context.Context, unit string) error {
+	return s.call("stop", unit)
+}
+
+func (s mockSystemdCaller) call(action, unit string) error {
+	if s.failOn == action {
+		return errors.New("requested failure")
+	}
+
+	// #nosec G302 - this is a test log file
+	f, err := os.OpenFile(filepath.Join(s.root, "systemd.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, action, unit)
+	return err
+}
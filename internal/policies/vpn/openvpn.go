@@ -0,0 +1,322 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+)
+
+// openVPNServiceType is the NetworkManager VPN plugin handling the OpenVPN connections.
+const openVPNServiceType = "org.freedesktop.NetworkManager.openvpn"
+
+// openVPNFiles are the directives of an OpenVPN configuration referencing a file, or embedding it inline, along
+// with the name of the secret file they are deployed to.
+var openVPNFiles = map[string]string{
+	"ca":        "ca.crt",
+	"cert":      "client.crt",
+	"key":       "client.key",
+	"tls-auth":  "tls-auth.key",
+	"tls-crypt": "tls-crypt.key",
+}
+
+// openVPNIgnored are the directives of an OpenVPN client configuration which don't have any NetworkManager
+// equivalent, as NetworkManager handles them itself.
+var openVPNIgnored = []string{
+	"client", "nobind", "persist-key", "persist-tun", "resolv-retry", "pull", "verb", "mute", "mute-replay-warnings",
+	"explicit-exit-notify", "auth-nocache", "remote-random", "float",
+}
+
+// openVPNRemote is a server of an OpenVPN connection.
+type openVPNRemote struct {
+	host  string
+	port  string
+	proto string
+}
+
+// openVPNConfig is the subset of an OpenVPN client configuration which is converted to a NetworkManager connection.
+type openVPNConfig struct {
+	remotes  []openVPNRemote
+	port     string
+	proto    string
+	devType  string
+	cipher   string
+	auth     string
+	userPass bool
+	// keyDirection is the direction of the tls-auth key, if any.
+	keyDirection  string
+	remoteCertTLS string
+
+	// files maps the file directives to the files they reference, relative to the configuration.
+	files map[string]string
+	// inline maps the file directives to their inline content.
+	inline map[string]string
+	// secrets maps the file directives to the name of the secret files they are deployed to.
+	secrets map[string]string
+
+	// unsupported are the directives not converted to the NetworkManager connection.
+	unsupported []string
+}
+
+// parseOpenVPN parses the OpenVPN client configuration config.
+func parseOpenVPN(config string) (c openVPNConfig, err error) {
+	c.files = make(map[string]string)
+	c.inline = make(map[string]string)
+	c.secrets = make(map[string]string)
+
+	lines := strings.Split(config, "\n")
+	for i := 0; i < len(lines); i++ {
+		l := strings.TrimSpace(lines[i])
+		if l == "" || l[0] == '#' || l[0] == ';' {
+			continue
+		}
+
+		// Inline files: <ca> ... </ca>
+		if strings.HasPrefix(l, "<") && strings.HasSuffix(l, ">") && !strings.HasPrefix(l, "</") {
+			tag := l[1 : len(l)-1]
+			if _, ok := openVPNFiles[tag]; !ok {
+				return c, errors.New(gotext.Get("unsupported inline file <%s>", tag))
+			}
+			var content strings.Builder
+			closed := false
+			for i++; i < len(lines); i++ {
+				if strings.TrimSpace(lines[i]) == "</"+tag+">" {
+					closed = true
+					break
+				}
+				content.WriteString(lines[i] + "\n")
+			}
+			if !closed {
+				return c, errors.New(gotext.Get("inline file <%s> is not closed", tag))
+			}
+			c.inline[tag] = content.String()
+			continue
+		}
+
+		fields := strings.Fields(l)
+		directive, args := fields[0], fields[1:]
+		switch directive {
+		case "remote":
+			if len(args) < 1 || len(args) > 3 {
+				return c, errors.New(gotext.Get("invalid remote %q: expected remote <host> [port] [proto]", l))
+			}
+			r := openVPNRemote{host: args[0]}
+			if len(args) > 1 {
+				r.port = args[1]
+			}
+			if len(args) > 2 {
+				r.proto = args[2]
+			}
+			c.remotes = append(c.remotes, r)
+		case "port":
+			if len(args) != 1 {
+				return c, errors.New(gotext.Get("invalid port %q", l))
+			}
+			c.port = args[0]
+		case "proto":
+			if len(args) != 1 {
+				return c, errors.New(gotext.Get("invalid proto %q", l))
+			}
+			c.proto = args[0]
+		case "dev":
+			if len(args) != 1 {
+				return c, errors.New(gotext.Get("invalid dev %q", l))
+			}
+			switch {
+			case strings.HasPrefix(args[0], "tun"):
+				c.devType = "tun"
+			case strings.HasPrefix(args[0], "tap"):
+				c.devType = "tap"
+			default:
+				return c, errors.New(gotext.Get("unsupported device %q: expected tun or tap", args[0]))
+			}
+		case "ca", "cert", "key", "tls-crypt":
+			if len(args) != 1 {
+				return c, errors.New(gotext.Get("invalid %s %q", directive, l))
+			}
+			c.files[directive] = args[0]
+		case "tls-auth":
+			if len(args) < 1 || len(args) > 2 {
+				return c, errors.New(gotext.Get("invalid tls-auth %q", l))
+			}
+			c.files[directive] = args[0]
+			if len(args) == 2 {
+				c.keyDirection = args[1]
+			}
+		case "key-direction":
+			if len(args) != 1 {
+				return c, errors.New(gotext.Get("invalid key-direction %q", l))
+			}
+			c.keyDirection = args[0]
+		case "cipher":
+			if len(args) != 1 {
+				return c, errors.New(gotext.Get("invalid cipher %q", l))
+			}
+			c.cipher = args[0]
+		case "auth":
+			if len(args) != 1 {
+				return c, errors.New(gotext.Get("invalid auth %q", l))
+			}
+			c.auth = args[0]
+		case "auth-user-pass":
+			// The credentials are asked to the user when connecting, and never read from a file.
+			c.userPass = true
+		case "remote-cert-tls":
+			if len(args) != 1 {
+				return c, errors.New(gotext.Get("invalid remote-cert-tls %q", l))
+			}
+			c.remoteCertTLS = args[0]
+		case "secret":
+			return c, errors.New(gotext.Get("static key OpenVPN configurations are not supported"))
+		default:
+			if !slices.Contains(openVPNIgnored, directive) {
+				c.unsupported = append(c.unsupported, directive)
+			}
+		}
+	}
+
+	if len(c.remotes) == 0 {
+		return c, errors.New(gotext.Get("OpenVPN configuration has no remote"))
+	}
+	for _, r := range append(c.remotes, openVPNRemote{port: c.port, proto: c.proto}) {
+		if r.port != "" {
+			if p, err := strconv.Atoi(r.port); err != nil || p < 1 || p > 65535 {
+				return c, errors.New(gotext.Get("invalid port %q", r.port))
+			}
+		}
+		if r.proto != "" && protoName(r.proto) == "" {
+			return c, errors.New(gotext.Get("unsupported proto %q: expected udp or tcp", r.proto))
+		}
+	}
+	if c.keyDirection != "" && c.keyDirection != "0" && c.keyDirection != "1" {
+		return c, errors.New(gotext.Get("invalid key direction %q: expected 0 or 1", c.keyDirection))
+	}
+	if !c.hasFile("ca") {
+		return c, errors.New(gotext.Get("OpenVPN configuration has no ca"))
+	}
+	if c.hasFile("cert") != c.hasFile("key") {
+		return c, errors.New(gotext.Get("OpenVPN configuration must have both a cert and a key"))
+	}
+	if !c.hasFile("cert") && !c.userPass {
+		return c, errors.New(gotext.Get("OpenVPN configuration must authenticate with a certificate or auth-user-pass"))
+	}
+
+	return c, nil
+}
+
+// hasFile returns true if the file directive is set, either inline or referencing a file.
+func (c openVPNConfig) hasFile(directive string) bool {
+	_, inline := c.inline[directive]
+	_, file := c.files[directive]
+	return inline || file
+}
+
+// loadFiles adds the files of the configuration to secrets, reading the referenced ones from the assets directory,
+// relative to the directory dir of the configuration.
+func (c openVPNConfig) loadFiles(assets, dir string, secrets map[string][]byte) error {
+	for directive, name := range openVPNFiles {
+		if content, ok := c.inline[directive]; ok {
+			secrets[name] = []byte(content)
+			c.secrets[directive] = name
+			continue
+		}
+		f, ok := c.files[directive]
+		if !ok {
+			continue
+		}
+		p := path.Join(dir, f)
+		if path.IsAbs(f) || !validRelPath(p) {
+			return errors.New(gotext.Get("%s %q must be relative to the configuration in the assets share", directive, f))
+		}
+		d, err := readAsset(assets, p)
+		if err != nil {
+			return err
+		}
+		secrets[name] = d
+		c.secrets[directive] = name
+	}
+	return nil
+}
+
+// writeKeyfile writes the VPN and IP sections of the NetworkManager connection, whose secret files are in the
+// secrets directory.
+func (c openVPNConfig) writeKeyfile(out *strings.Builder, secrets string) {
+	fmt.Fprintf(out, "\n[vpn]\nservice-type=%s\n", openVPNServiceType)
+
+	connType := "password"
+	if c.hasFile("cert") {
+		connType = "tls"
+		if c.userPass {
+			connType = "password-tls"
+		}
+	}
+	fmt.Fprintf(out, "connection-type=%s\n", connType)
+
+	var remotes []string
+	for _, r := range c.remotes {
+		port, proto := r.port, r.proto
+		if port == "" {
+			port = c.port
+		}
+		if port == "" {
+			port = "1194"
+		}
+		if proto == "" {
+			proto = c.proto
+		}
+		if proto == "" {
+			proto = "udp"
+		}
+		remotes = append(remotes, fmt.Sprintf("%s:%s:%s", r.host, port, protoName(proto)))
+	}
+	fmt.Fprintf(out, "remote=%s\n", strings.Join(remotes, ", "))
+
+	if c.devType != "" {
+		fmt.Fprintf(out, "dev-type=%s\n", c.devType)
+	}
+	for _, directive := range []string{"ca", "cert", "key"} {
+		if name, ok := c.secrets[directive]; ok {
+			fmt.Fprintf(out, "%s=%s\n", directive, path.Join(secrets, name))
+		}
+	}
+	if name, ok := c.secrets["tls-auth"]; ok {
+		fmt.Fprintf(out, "ta=%s\n", path.Join(secrets, name))
+		if c.keyDirection != "" {
+			fmt.Fprintf(out, "ta-dir=%s\n", c.keyDirection)
+		}
+	}
+	if name, ok := c.secrets["tls-crypt"]; ok {
+		fmt.Fprintf(out, "tls-crypt=%s\n", path.Join(secrets, name))
+	}
+	if c.cipher != "" {
+		fmt.Fprintf(out, "cipher=%s\n", c.cipher)
+	}
+	if c.auth != "" {
+		fmt.Fprintf(out, "auth=%s\n", c.auth)
+	}
+	if c.remoteCertTLS != "" {
+		fmt.Fprintf(out, "remote-cert-tls=%s\n", c.remoteCertTLS)
+	}
+	if c.userPass {
+		// The credentials of the user are asked when connecting, and never saved.
+		out.WriteString("password-flags=2\n")
+	}
+
+	out.WriteString("\n[ipv4]\nmethod=auto\n\n[ipv6]\nmethod=auto\n")
+}
+
+// protoName returns the protocol name of proto in NetworkManager connections, or an empty string if proto is not
+// supported.
+func protoName(proto string) string {
+	switch proto {
+	case "udp", "udp4", "udp6":
+		return "udp"
+	case "tcp", "tcp4", "tcp6", "tcp-client":
+		return "tcp"
+	}
+	return ""
+}
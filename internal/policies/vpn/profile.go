@@ -0,0 +1,283 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+)
+
+// Types of the VPN profiles.
+const (
+	typeOpenVPN   = "openvpn"
+	typeWireGuard = "wireguard"
+	typeNative    = "nm"
+)
+
+// profileTypes are the supported types of VPN profiles.
+var profileTypes = []string{typeOpenVPN, typeWireGuard, typeNative}
+
+var (
+	// profileNameRe matches the names of the profiles, used to name their files.
+	profileNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+	// secretRe matches the references to the secret files in a NetworkManager connection file.
+	secretRe = regexp.MustCompile(`\$\{secrets\}/([^\s;,]+)`)
+)
+
+// maxWireGuardNameLen is the maximum length of the name of a WireGuard profile, as its interface is named after
+// it with a wg- prefix and interface names are limited to 15 characters.
+const maxWireGuardNameLen = 12
+
+// profile is a VPN connection deployed from the assets share.
+type profile struct {
+	name string
+	typ  string
+	// config is the path of the configuration of the profile, relative to the vpn/ directory of the assets share.
+	config      string
+	keytab      string
+	autoconnect bool
+}
+
+// connection is a NetworkManager connection file along with the secret files it references.
+type connection struct {
+	keyfile []byte
+	// secrets maps the names of the secret files to their content.
+	secrets map[string][]byte
+}
+
+// id returns the identifier of the profile files: its name for the machine, and its name followed by the uid of
+// the user for users.
+func (p profile) id(uid string) string {
+	if uid == "" {
+		return p.name
+	}
+	return p.name + "@" + uid
+}
+
+// secretsPath returns the path of the secrets directory of the profile with identifier id on the machine.
+// The secrets are referenced with their path on the machine, even when the files are written elsewhere.
+func secretsPath(id string) string {
+	return filepath.Join(consts.DefaultStateDir, "vpn", id)
+}
+
+// connection returns the NetworkManager connection of the profile from its configuration, read from the assets
+// directory. user is the user allowed to use the connection, or empty for the machine.
+func (p profile) connection(ctx context.Context, assets, user, id string) (c connection, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't convert VPN profile %s", p.name))
+
+	d, err := readAsset(assets, p.config)
+	if err != nil {
+		return c, err
+	}
+	// Configurations edited on Windows end their lines with CRLF.
+	config := strings.ReplaceAll(string(d), "\r\n", "\n")
+
+	c.secrets = make(map[string][]byte)
+	var out strings.Builder
+	out.WriteString(header)
+
+	switch p.typ {
+	case typeOpenVPN:
+		ovpn, err := parseOpenVPN(config)
+		if err != nil {
+			return c, err
+		}
+		if len(ovpn.unsupported) > 0 {
+			log.Warning(ctx, gotext.Get("Unsupported directives of OpenVPN configuration %s are ignored: %s", p.config, strings.Join(ovpn.unsupported, ", ")))
+		}
+		if err := ovpn.loadFiles(assets, path.Dir(p.config), c.secrets); err != nil {
+			return c, err
+		}
+		p.writeConnection(&out, "vpn", user)
+		ovpn.writeKeyfile(&out, secretsPath(id))
+	case typeWireGuard:
+		wg, err := parseWireGuard(config)
+		if err != nil {
+			return c, err
+		}
+		p.writeConnection(&out, "wireguard", user)
+		fmt.Fprintf(&out, "interface-name=wg-%s\n", p.name)
+		wg.writeKeyfile(&out)
+	case typeNative:
+		keyfile, err := p.native(config, assets, user, id, c.secrets)
+		if err != nil {
+			return c, err
+		}
+		out.WriteString(keyfile)
+	}
+
+	c.keyfile = []byte(out.String())
+	return c, nil
+}
+
+// writeConnection writes the connection section of the keyfile of type typ.
+func (p profile) writeConnection(out *strings.Builder, typ, user string) {
+	fmt.Fprintf(out, "\n[connection]\nid=%s\ntype=%s\nautoconnect=%t\n", p.name, typ, p.autoconnect)
+	if user != "" {
+		fmt.Fprintf(out, "permissions=user:%s;\n", user)
+	}
+}
+
+// native returns the NetworkManager connection file config, with its references to the secret files and to the
+// keytab replaced by their paths on the machine, and restricted to user if set. The secret files are loaded from
+// the assets directory next to the configuration.
+func (p profile) native(config, assets, user, id string, secrets map[string][]byte) (string, error) {
+	if strings.Contains(config, "${keytab}") {
+		if p.keytab == "" {
+			return "", errors.New(gotext.Get("configuration references ${keytab} but no keytab is set"))
+		}
+		config = strings.ReplaceAll(config, "${keytab}", p.keytab)
+	}
+
+	for _, m := range secretRe.FindAllStringSubmatch(config, -1) {
+		name := m[1]
+		if _, ok := secrets[name]; ok {
+			continue
+		}
+		if !validRelPath(name) || strings.Contains(name, "/") {
+			return "", errors.New(gotext.Get("secret %q must be a file next to the configuration", name))
+		}
+		d, err := readAsset(assets, path.Join(path.Dir(p.config), name))
+		if err != nil {
+			return "", err
+		}
+		secrets[name] = d
+	}
+	config = strings.ReplaceAll(config, "${secrets}", secretsPath(id))
+
+	// Rewrite the connection section, so that the connection is only available to the user.
+	var out strings.Builder
+	var inConnection, foundConnection bool
+	for _, l := range strings.Split(strings.TrimRight(config, "\n"), "\n") {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, "[") {
+			inConnection = t == "[connection]"
+			if inConnection {
+				foundConnection = true
+				out.WriteString(l + "\n")
+				if user != "" {
+					fmt.Fprintf(&out, "permissions=user:%s;\n", user)
+				}
+				continue
+			}
+		}
+		if inConnection && strings.HasPrefix(strings.ReplaceAll(t, " ", ""), "permissions=") {
+			continue
+		}
+		out.WriteString(l + "\n")
+	}
+	if !foundConnection {
+		return "", errors.New(gotext.Get("configuration is not a NetworkManager connection file: missing [connection] section"))
+	}
+
+	return "\n" + out.String(), nil
+}
+
+// readAsset reads the file at path p, relative to the vpn/ directory of the assets share.
+func readAsset(assets, p string) ([]byte, error) {
+	src := filepath.Join(assets, filepath.FromSlash(p))
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, errors.New(gotext.Get("%s not found in the assets share: %v", p, err))
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errors.New(gotext.Get("%s is not a regular file", p))
+	}
+	return os.ReadFile(src)
+}
+
+// validRelPath returns true if p is a clean path relative to the vpn/ directory of the assets share.
+func validRelPath(p string) bool {
+	return p != "" && !path.IsAbs(p) && path.Clean(p) == p && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// parseProfiles parses the profiles of lines. A profile defined more than once is replaced by the last definition.
+func parseProfiles(lines []string, profiles []profile) ([]profile, error) {
+	for _, l := range lines {
+		p, err := parseProfile(l)
+		if err != nil {
+			return nil, err
+		}
+		if i := slices.IndexFunc(profiles, func(o profile) bool { return o.name == p.name }); i != -1 {
+			profiles[i] = p
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// parseProfile parses the profile line l, of the form
+// name=<name>, type=<type>, config=<path>[, keytab=<path>][, autoconnect=yes].
+func parseProfile(l string) (p profile, err error) {
+	defer decorate.OnError(&err, gotext.Get("invalid VPN profile %q", l))
+
+	usage := gotext.Get("expected name=<name>, type=<type>, config=<path>[, keytab=<path>][, autoconnect=yes]")
+
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(l, ",") {
+		k, v, found := strings.Cut(field, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !found || v == "" {
+			return p, errors.New(usage)
+		}
+		if seen[k] {
+			return p, errors.New(gotext.Get("%s is set more than once", k))
+		}
+		seen[k] = true
+
+		switch k {
+		case "name":
+			p.name = v
+		case "type":
+			p.typ = strings.ToLower(v)
+		case "config":
+			p.config = v
+		case "keytab":
+			p.keytab = v
+		case "autoconnect":
+			if v != "yes" && v != "no" {
+				return p, errors.New(gotext.Get("autoconnect must be yes or no"))
+			}
+			p.autoconnect = v == "yes"
+		default:
+			return p, errors.New(gotext.Get("unsupported field %q", k))
+		}
+	}
+
+	if p.name == "" || p.typ == "" || p.config == "" {
+		return p, errors.New(usage)
+	}
+	if !profileNameRe.MatchString(p.name) {
+		return p, errors.New(gotext.Get("%q is not a valid profile name: only lowercase letters, digits and _.- are supported", p.name))
+	}
+	if !slices.Contains(profileTypes, p.typ) {
+		return p, errors.New(gotext.Get("unsupported profile type %q: expected one of %s", p.typ, strings.Join(profileTypes, ", ")))
+	}
+	if !validRelPath(p.config) {
+		return p, errors.New(gotext.Get("config %q must be relative to the %s/ directory of the assets share", p.config, assetsDir))
+	}
+	if p.typ == typeWireGuard && len(p.name) > maxWireGuardNameLen {
+		return p, errors.New(gotext.Get("the name of a WireGuard profile is limited to %d characters", maxWireGuardNameLen))
+	}
+	if p.keytab != "" {
+		if p.typ != typeNative {
+			return p, errors.New(gotext.Get("keytab is only supported with NetworkManager profiles"))
+		}
+		if !filepath.IsAbs(p.keytab) || filepath.Clean(p.keytab) != p.keytab {
+			return p, errors.New(gotext.Get("keytab %q must be an absolute path", p.keytab))
+		}
+	}
+
+	return p, nil
+}
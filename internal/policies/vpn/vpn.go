@@ -0,0 +1,364 @@
+// Package vpn provides a manager that deploys VPN connections to NetworkManager, for the machine or for users.
+//
+// The following settings are supported for computers, and with a vpn/user- prefix for users
+// (vpn/user-connections):
+//   - vpn/connections: VPN profiles, one per line, of the form
+//     name=<name>, type=<type>, config=<path>[, keytab=<path>][, autoconnect=yes]
+//     where config is relative to the vpn/ directory of the assets share.
+//
+// The type of the profile is one of:
+//   - openvpn: config is an OpenVPN client configuration. The files it references, relative to it, or embeds
+//     inline (ca, cert, key, tls-auth and tls-crypt) are deployed as secrets of the connection;
+//   - wireguard: config is a wg-quick configuration, whose keys are stored in the connection;
+//   - nm: config is a NetworkManager connection file. ${secrets}/<file> references a file next to the
+//     configuration, deployed as a secret of the connection, and ${keytab} the keytab of the profile, for VPN
+//     plugins authenticating with Kerberos.
+//
+// Connections of the machine are available to every user, while the connections of a user are restricted to them.
+// The credentials of the OpenVPN connections authenticating with auth-user-pass are asked when connecting.
+//
+// Each profile is written to an adsys_vpn-<name>.nmconnection file in the system connections directory, suffixed
+// with the uid of the user for users, and its secrets in the vpn directory of the state directory, only readable
+// by root. NetworkManager reloads its connections whenever one changes. Profiles not configured anymore are removed.
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	// filePrefix is the prefix of the connection files created by adsys. It differs from the one of the network
+	// manager, so that each manager only handles its own connections.
+	filePrefix = "adsys_vpn-"
+	// assetsDir is the directory of the assets share the configurations are read from.
+	assetsDir = "vpn"
+)
+
+const header = `# This file is managed by adsys.
+# Do not edit this file manually.
+# Any changes will be overwritten.
+`
+
+// AssetsDumper is a function which uncompress policies assets to a directory.
+type AssetsDumper func(ctx context.Context, relSrc, dest string, uid int, gid int) (err error)
+
+// Manager deploys the VPN profiles to NetworkManager.
+type Manager struct {
+	connectionsDir string
+	stateDir       string
+
+	nmcliCmd   []string
+	cmdTimeout time.Duration
+	userLookup func(string) (*user.User, error)
+}
+
+type options struct {
+	connectionsDir string
+	stateDir       string
+	nmcliCmd       []string
+	cmdTimeout     time.Duration
+	userLookup     func(string) (*user.User, error)
+}
+
+// Option reprents an optional function to change the vpn manager.
+type Option func(*options)
+
+// WithConnectionsDir overrides the default NetworkManager system connections directory.
+func WithConnectionsDir(p string) func(*options) {
+	return func(a *options) {
+		a.connectionsDir = p
+	}
+}
+
+// WithStateDir overrides the default state directory.
+func WithStateDir(p string) func(*options) {
+	return func(a *options) {
+		a.stateDir = p
+	}
+}
+
+// WithNmcliCmd overrides the default nmcli command.
+func WithNmcliCmd(cmd []string) func(*options) {
+	return func(a *options) {
+		a.nmcliCmd = cmd
+	}
+}
+
+// WithCmdTimeout overrides the default maximum time any external command can take.
+func WithCmdTimeout(timeout time.Duration) func(*options) {
+	return func(a *options) {
+		a.cmdTimeout = timeout
+	}
+}
+
+// New returns a new manager for the vpn policy.
+func New(opts ...Option) *Manager {
+	// defaults
+	args := options{
+		connectionsDir: consts.DefaultNetworkConnectionsDir,
+		stateDir:       consts.DefaultStateDir,
+		nmcliCmd:       []string{"nmcli"},
+		cmdTimeout:     consts.DefaultHelperExecTimeout,
+		userLookup:     user.Lookup,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Manager{
+		connectionsDir: args.connectionsDir,
+		stateDir:       filepath.Join(args.stateDir, "vpn"),
+		nmcliCmd:       args.nmcliCmd,
+		cmdTimeout:     args.cmdTimeout,
+		userLookup:     args.userLookup,
+	}
+}
+
+// ApplyPolicy deploys the VPN profiles of objectName from the list of entries, and removes the ones not configured
+// anymore.
+func (m *Manager) ApplyPolicy(ctx context.Context, objectName string, isComputer bool, entries []entry.Entry, assetsDumper AssetsDumper) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't apply vpn policy to %s", objectName))
+
+	log.Debugf(ctx, "Applying vpn policy to %s", objectName)
+
+	key := "vpn/connections"
+	if !isComputer {
+		key = "vpn/user-connections"
+	}
+
+	var profiles []profile
+	for _, e := range entries {
+		v := strings.TrimSpace(e.Value)
+		if e.Disabled || v == "" {
+			continue
+		}
+		if e.Key != key {
+			log.Warning(ctx, gotext.Get("Encountered unsupported key '%s' while parsing vpn entries, skipping it", e.Key))
+			continue
+		}
+
+		var lines []string
+		for _, l := range strings.Split(v, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+		if profiles, err = parseProfiles(lines, profiles); err != nil {
+			return err
+		}
+	}
+
+	// The files of a user are suffixed with their uid, which never contains the @ separator.
+	var uid, username string
+	if !isComputer {
+		u, err := m.userLookup(objectName)
+		if err != nil {
+			return errors.New(gotext.Get("failed to retrieve user information: %v", err))
+		}
+		uid, username = u.Uid, u.Username
+	}
+
+	want := make(map[string]connection)
+	if len(profiles) > 0 {
+		if want, err = m.connections(ctx, profiles, assetsDumper, uid, username); err != nil {
+			return err
+		}
+	}
+
+	if err := m.writeSecrets(ctx, want, uid); err != nil {
+		return err
+	}
+	changed, err := m.writeProfiles(ctx, want, uid)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	if _, err := syshelpers.Run(ctx, m.cmdTimeout, m.nmcliCmd, "connection", "reload"); errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		log.Warning(ctx, gotext.Get("NetworkManager is not installed, the VPN profiles will be loaded once it is"))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// connections returns the NetworkManager connections of the profiles, indexed by their identifier, converted from
+// their configurations in the assets share.
+func (m *Manager) connections(ctx context.Context, profiles []profile, assetsDumper AssetsDumper, uid, username string) (conns map[string]connection, err error) {
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(m.stateDir, ".assets-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errRemove := os.RemoveAll(tmp); errRemove != nil {
+			err = errors.Join(err, errRemove)
+		}
+	}()
+	// Only root can read the assets, as they contain secrets.
+	assets := filepath.Join(tmp, assetsDir)
+	if err := assetsDumper(ctx, assetsDir+"/", assets, -1, -1); err != nil {
+		return nil, err
+	}
+
+	conns = make(map[string]connection)
+	for _, p := range profiles {
+		id := p.id(uid)
+		c, err := p.connection(ctx, assets, username, id)
+		if err != nil {
+			return nil, err
+		}
+		if p.keytab != "" {
+			if _, err := os.Stat(p.keytab); err != nil {
+				log.Warning(ctx, gotext.Get("Keytab %s of VPN profile %s is not available: %v", p.keytab, p.name, err))
+			}
+		}
+		conns[id] = c
+	}
+	return conns, nil
+}
+
+// owned returns true if the profile identifier id belongs to the user with uid, or to the machine if uid is empty.
+func owned(id, uid string) bool {
+	_, idUID, isUser := strings.Cut(id, "@")
+	if uid == "" {
+		return !isUser
+	}
+	return idUID == uid
+}
+
+// writeSecrets writes the secret files of the connections in want, and removes the secrets of the object with uid
+// which are not wanted anymore.
+func (m *Manager) writeSecrets(ctx context.Context, want map[string]connection, uid string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write VPN secrets"))
+
+	ids := maps.Keys(want)
+	slices.Sort(ids)
+	for _, id := range ids {
+		dir := filepath.Join(m.stateDir, id)
+		secrets := want[id].secrets
+		if len(secrets) == 0 {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		names := maps.Keys(secrets)
+		slices.Sort(names)
+		for _, name := range names {
+			p := filepath.Join(dir, name)
+			if cur, err := os.ReadFile(p); err == nil && bytes.Equal(cur, secrets[name]) {
+				continue
+			}
+			log.Debugf(ctx, "Writing secret %s of VPN profile %s", name, id)
+			if err := os.WriteFile(p+".new", secrets[name], 0600); err != nil {
+				return err
+			}
+			if err := os.Rename(p+".new", p); err != nil {
+				return err
+			}
+		}
+		// Remove the secrets not referenced anymore by the profile.
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if _, ok := secrets[e.Name()]; ok {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(m.stateDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id := e.Name()
+		if !e.IsDir() || strings.HasPrefix(id, ".") || !owned(id, uid) {
+			continue
+		}
+		if c, ok := want[id]; ok && len(c.secrets) > 0 {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(m.stateDir, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeProfiles writes the connection files of want, and removes the ones created by adsys for the object with uid
+// which are not wanted anymore. It returns true if any file changed.
+func (m *Manager) writeProfiles(ctx context.Context, want map[string]connection, uid string) (changed bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write VPN profiles"))
+
+	ids := maps.Keys(want)
+	slices.Sort(ids)
+	for _, id := range ids {
+		p := filepath.Join(m.connectionsDir, filePrefix+id+".nmconnection")
+		if cur, err := os.ReadFile(p); err == nil && bytes.Equal(cur, want[id].keyfile) {
+			continue
+		}
+
+		log.Infof(ctx, "Writing VPN profile %s", id)
+		// nolint:gosec // G301 match distribution permission
+		if err := os.MkdirAll(m.connectionsDir, 0755); err != nil {
+			return changed, err
+		}
+		// NetworkManager ignores connection files readable by other users than root.
+		if err := os.WriteFile(p+".new", want[id].keyfile, 0600); err != nil {
+			return changed, err
+		}
+		if err := os.Rename(p+".new", p); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	// Glob only fails on invalid patterns.
+	existing, _ := filepath.Glob(filepath.Join(m.connectionsDir, filePrefix+"*.nmconnection"))
+	for _, p := range existing {
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), filePrefix), ".nmconnection")
+		if _, ok := want[id]; ok || !owned(id, uid) {
+			continue
+		}
+		log.Infof(ctx, "Removing VPN profile %s", id)
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return changed, err
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,168 @@
+package vpn_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/termie/go-shutil"
+	"github.com/ubuntu/adsys/internal/policies/entry"
+	"github.com/ubuntu/adsys/internal/policies/vpn"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	t.Parallel()
+
+	openVPN := "name=corp, type=openvpn, config=openvpn/corp.ovpn"
+	wireGuard := "name=corp-wg, type=wireguard, config=wireguard/corp.conf"
+
+	tests := map[string]struct {
+		entries       []entry.Entry
+		isNotComputer bool
+		existingDirs  string
+		mockBehaviour string
+		assetsErr     bool
+
+		wantErr bool
+	}{
+		"OpenVPN profile with referenced files":      {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}}},
+		"OpenVPN profile with inline files":          {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=openvpn/inline.ovpn"}}},
+		"OpenVPN profile with unsupported directive": {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=openvpn/unsupported.ovpn"}}},
+		"WireGuard profile":                          {entries: []entry.Entry{{Key: "vpn/connections", Value: wireGuard}}},
+		"NetworkManager profile with secrets":        {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=ipsec, type=nm, config=nm/ipsec.nmconnection"}}},
+		"NetworkManager profile with keytab":         {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=kerberos, type=nm, config=nm/kerberos.nmconnection, keytab=/etc/krb5.keytab"}}},
+		"Profile connecting automatically":           {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN + ", autoconnect=yes"}}},
+		"Multiple profiles": {entries: []entry.Entry{
+			{Key: "vpn/connections", Value: openVPN + "\n\n" + wireGuard},
+			{Key: "vpn/connections", Value: "name=ipsec, type=nm, config=nm/ipsec.nmconnection"}}},
+		"Last profile with the same name wins":      {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN + "\nname=corp, type=openvpn, config=openvpn/inline.ovpn"}}},
+		"Fields are case insensitive and trimmed":   {entries: []entry.Entry{{Key: "vpn/connections", Value: "  Name = corp ,TYPE=OpenVPN,  Config=openvpn/corp.ovpn  "}}},
+		"Disabled entries are ignored":              {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}, {Key: "vpn/connections", Value: wireGuard, Disabled: true}}},
+		"User keys are ignored for computers":       {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}, {Key: "vpn/user-connections", Value: wireGuard}}},
+		"Existing profiles are replaced":            {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}}, existingDirs: "existing-profiles"},
+		"No entries removes existing profiles":      {existingDirs: "existing-profiles"},
+		"No entries and no existing profiles":       {},
+		"Unchanged profiles don't reload":           {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}}, existingDirs: "unchanged-profiles"},
+		"NetworkManager not installed is a warning": {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}}, mockBehaviour: "no-nmcli"},
+
+		// User profiles
+		"User profile":                              {entries: []entry.Entry{{Key: "vpn/user-connections", Value: openVPN}}, isNotComputer: true},
+		"User NetworkManager profile":               {entries: []entry.Entry{{Key: "vpn/user-connections", Value: "name=ipsec, type=nm, config=nm/ipsec.nmconnection"}}, isNotComputer: true},
+		"Computer keys are ignored for users":       {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}, {Key: "vpn/user-connections", Value: wireGuard}}, isNotComputer: true},
+		"Existing user profiles are replaced":       {entries: []entry.Entry{{Key: "vpn/user-connections", Value: wireGuard}}, isNotComputer: true, existingDirs: "existing-profiles"},
+		"No entries removes existing user profiles": {isNotComputer: true, existingDirs: "existing-profiles"},
+
+		// Error cases
+		"Error on missing name":                        {entries: []entry.Entry{{Key: "vpn/connections", Value: "type=openvpn, config=openvpn/corp.ovpn"}}, wantErr: true},
+		"Error on missing type":                        {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, config=openvpn/corp.ovpn"}}, wantErr: true},
+		"Error on missing config":                      {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn"}}, wantErr: true},
+		"Error on invalid name":                        {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=../corp, type=openvpn, config=openvpn/corp.ovpn"}}, wantErr: true},
+		"Error on unsupported type":                    {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=ipsec, config=openvpn/corp.ovpn"}}, wantErr: true},
+		"Error on unsupported field":                   {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN + ", password=secret"}}, wantErr: true},
+		"Error on field set twice":                     {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN + ", name=other"}}, wantErr: true},
+		"Error on invalid autoconnect value":           {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN + ", autoconnect=true"}}, wantErr: true},
+		"Error on config outside of assets":            {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=../scripts/corp.ovpn"}}, wantErr: true},
+		"Error on absolute config":                     {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=/etc/openvpn/corp.ovpn"}}, wantErr: true},
+		"Error on missing config in assets":            {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=openvpn/missing.ovpn"}}, wantErr: true},
+		"Error on config being a directory":            {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=openvpn"}}, wantErr: true},
+		"Error on keytab with OpenVPN profile":         {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN + ", keytab=/etc/krb5.keytab"}}, wantErr: true},
+		"Error on relative keytab":                     {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=kerberos, type=nm, config=nm/kerberos.nmconnection, keytab=krb5.keytab"}}, wantErr: true},
+		"Error on OpenVPN file missing in assets":      {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=openvpn/missing-file.ovpn"}}, wantErr: true},
+		"Error on OpenVPN file outside of assets":      {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=openvpn/escape.ovpn"}}, wantErr: true},
+		"Error on OpenVPN static key":                  {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=openvpn/static.ovpn"}}, wantErr: true},
+		"Error on OpenVPN without remote":              {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=openvpn/no-remote.ovpn"}}, wantErr: true},
+		"Error on OpenVPN unclosed inline file":        {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=openvpn/unclosed.ovpn"}}, wantErr: true},
+		"Error on OpenVPN configuration of other type": {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=openvpn, config=wireguard/corp.conf"}}, wantErr: true},
+		"Error on invalid WireGuard key":               {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp-wg, type=wireguard, config=wireguard/invalid.conf"}}, wantErr: true},
+		"Error on unsupported WireGuard setting":       {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp-wg, type=wireguard, config=wireguard/postup.conf"}}, wantErr: true},
+		"Error on WireGuard name too long":             {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corporate-wireguard, type=wireguard, config=wireguard/corp.conf"}}, wantErr: true},
+		"Error on invalid NetworkManager profile":      {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=nm, config=nm/invalid.nmconnection"}}, wantErr: true},
+		"Error on NetworkManager secret missing":       {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=nm, config=nm/missing-secret.nmconnection"}}, wantErr: true},
+		"Error on NetworkManager secret outside":       {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=corp, type=nm, config=nm/escape.nmconnection"}}, wantErr: true},
+		"Error on NetworkManager keytab not set":       {entries: []entry.Entry{{Key: "vpn/connections", Value: "name=kerberos, type=nm, config=nm/kerberos.nmconnection"}}, wantErr: true},
+		"Error on dumping assets":                      {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}}, assetsErr: true, wantErr: true},
+		"Error on unknown user":                        {entries: []entry.Entry{{Key: "vpn/user-connections", Value: openVPN}}, isNotComputer: true, mockBehaviour: "unknown-user", wantErr: true},
+		"Error on reloading NetworkManager":            {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}}, mockBehaviour: "fail-nmcli", wantErr: true},
+		"Error on unwritable connections directory":    {entries: []entry.Entry{{Key: "vpn/connections", Value: openVPN}}, existingDirs: "existing-profiles", mockBehaviour: "read-only", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			connectionsDir := filepath.Join(root, "etc", "NetworkManager", "system-connections")
+
+			if tc.existingDirs != "" {
+				require.NoError(t, os.Remove(root), "Setup: can't remove temporary directory")
+				require.NoError(t,
+					shutil.CopyTree(filepath.Join("testdata", tc.existingDirs), root, &shutil.CopyTreeOptions{Symlinks: true, CopyFunction: shutil.Copy}),
+					"Setup: can't create initial directories")
+			}
+			if tc.mockBehaviour == "read-only" {
+				testutils.MakeReadOnly(t, connectionsDir)
+			}
+
+			nmcliCmd := testutils.MockCommand(root, "nmcli", tc.mockBehaviour)
+			if tc.mockBehaviour == "no-nmcli" {
+				nmcliCmd = []string{"/nonexistent/nmcli"}
+			}
+
+			objectName := "ubuntu"
+			if tc.isNotComputer {
+				objectName = "bob@example.com"
+			}
+
+			m := vpn.New(
+				vpn.WithConnectionsDir(connectionsDir),
+				vpn.WithStateDir(filepath.Join(root, "var", "lib", "adsys")),
+				vpn.WithNmcliCmd(nmcliCmd),
+				vpn.WithUserLookup(func(name string) (*user.User, error) {
+					if tc.mockBehaviour == "unknown-user" {
+						return nil, errors.New("unknown user")
+					}
+					return &user.User{Username: name, Uid: "4242", Gid: "4242", HomeDir: "/home/" + name}, nil
+				}),
+			)
+			assetsDumper := testutils.MockAssetsDumper{T: t, Err: tc.assetsErr, Path: "vpn/"}
+			err := m.ApplyPolicy(context.Background(), objectName, !tc.isNotComputer, tc.entries, assetsDumper.SaveAssetsTo)
+			if tc.wantErr {
+				require.Error(t, err, "ApplyPolicy should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "ApplyPolicy failed but shouldn't have")
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
+
+func TestMockCommand(t *testing.T) {
+	c, ok := testutils.MockCommandCall()
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+
+	name, behaviours, args := c.Name, strings.Split(c.Behaviour, ","), c.Args
+
+	line := name
+	for _, a := range args {
+		line += fmt.Sprintf(" %q", a)
+	}
+
+	c.Log(line)
+
+	if slices.Contains(behaviours, "fail-"+name) {
+		fmt.Fprintln(os.Stderr, "error: requested failure")
+		os.Exit(1)
+	}
+}
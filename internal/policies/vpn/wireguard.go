@@ -0,0 +1,229 @@
+package vpn
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+)
+
+// wireGuardPeer is a peer of a WireGuard connection.
+type wireGuardPeer struct {
+	publicKey    string
+	presharedKey string
+	endpoint     string
+	allowedIPs   []string
+	keepalive    string
+}
+
+// wireGuardConfig is a WireGuard configuration, in the wg-quick format.
+type wireGuardConfig struct {
+	privateKey string
+	listenPort string
+	mtu        string
+	addresses  []netip.Prefix
+	dns        []netip.Addr
+	dnsSearch  []string
+	peers      []wireGuardPeer
+}
+
+// parseWireGuard parses the wg-quick configuration config.
+func parseWireGuard(config string) (c wireGuardConfig, err error) {
+	var section string
+	for _, l := range strings.Split(config, "\n") {
+		if i := strings.IndexByte(l, '#'); i != -1 {
+			l = l[:i]
+		}
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+
+		if strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]") {
+			section = strings.ToLower(l[1 : len(l)-1])
+			switch section {
+			case "interface":
+			case "peer":
+				c.peers = append(c.peers, wireGuardPeer{})
+			default:
+				return c, errors.New(gotext.Get("unsupported WireGuard section %q", l))
+			}
+			continue
+		}
+
+		k, v, found := strings.Cut(l, "=")
+		if !found {
+			return c, errors.New(gotext.Get("invalid WireGuard line %q", l))
+		}
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+
+		switch section {
+		case "interface":
+			switch k {
+			case "privatekey":
+				c.privateKey = v
+			case "listenport":
+				c.listenPort = v
+			case "mtu":
+				c.mtu = v
+			case "address":
+				for _, a := range splitList(v) {
+					p, err := netip.ParsePrefix(a)
+					if err != nil {
+						return c, errors.New(gotext.Get("invalid WireGuard address %q: %v", a, err))
+					}
+					c.addresses = append(c.addresses, p)
+				}
+			case "dns":
+				// wg-quick accepts both DNS servers and search domains.
+				for _, a := range splitList(v) {
+					if ip, err := netip.ParseAddr(a); err == nil {
+						c.dns = append(c.dns, ip)
+						continue
+					}
+					c.dnsSearch = append(c.dnsSearch, a)
+				}
+			default:
+				return c, errors.New(gotext.Get("unsupported WireGuard interface setting %q", k))
+			}
+		case "peer":
+			peer := &c.peers[len(c.peers)-1]
+			switch k {
+			case "publickey":
+				peer.publicKey = v
+			case "presharedkey":
+				peer.presharedKey = v
+			case "endpoint":
+				peer.endpoint = v
+			case "allowedips":
+				peer.allowedIPs = append(peer.allowedIPs, splitList(v)...)
+			case "persistentkeepalive":
+				peer.keepalive = v
+			default:
+				return c, errors.New(gotext.Get("unsupported WireGuard peer setting %q", k))
+			}
+		default:
+			return c, errors.New(gotext.Get("WireGuard setting %q is outside of any section", k))
+		}
+	}
+
+	if !validKey(c.privateKey) {
+		return c, errors.New(gotext.Get("WireGuard configuration has no valid private key"))
+	}
+	if len(c.addresses) == 0 {
+		return c, errors.New(gotext.Get("WireGuard configuration has no address"))
+	}
+	if len(c.peers) == 0 {
+		return c, errors.New(gotext.Get("WireGuard configuration has no peer"))
+	}
+	for _, n := range []string{c.listenPort, c.mtu} {
+		if n == "" {
+			continue
+		}
+		if v, err := strconv.Atoi(n); err != nil || v < 1 || v > 65535 {
+			return c, errors.New(gotext.Get("invalid WireGuard number %q", n))
+		}
+	}
+	for _, p := range c.peers {
+		if !validKey(p.publicKey) {
+			return c, errors.New(gotext.Get("WireGuard peer has no valid public key"))
+		}
+		if p.presharedKey != "" && !validKey(p.presharedKey) {
+			return c, errors.New(gotext.Get("invalid preshared key of WireGuard peer %s", p.publicKey))
+		}
+		for _, a := range p.allowedIPs {
+			if _, err := netip.ParsePrefix(a); err != nil {
+				return c, errors.New(gotext.Get("invalid allowed IPs %q of WireGuard peer %s: %v", a, p.publicKey, err))
+			}
+		}
+		if p.keepalive != "" {
+			if v, err := strconv.Atoi(p.keepalive); err != nil || v < 0 || v > 65535 {
+				return c, errors.New(gotext.Get("invalid persistent keepalive %q of WireGuard peer %s", p.keepalive, p.publicKey))
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// writeKeyfile writes the WireGuard and IP sections of the NetworkManager connection.
+// The keys are stored in the connection file, only readable by root.
+func (c wireGuardConfig) writeKeyfile(out *strings.Builder) {
+	fmt.Fprintf(out, "\n[wireguard]\nprivate-key=%s\nprivate-key-flags=0\n", c.privateKey)
+	if c.listenPort != "" {
+		fmt.Fprintf(out, "listen-port=%s\n", c.listenPort)
+	}
+	if c.mtu != "" {
+		fmt.Fprintf(out, "mtu=%s\n", c.mtu)
+	}
+
+	for _, p := range c.peers {
+		fmt.Fprintf(out, "\n[wireguard-peer.%s]\n", p.publicKey)
+		if p.endpoint != "" {
+			fmt.Fprintf(out, "endpoint=%s\n", p.endpoint)
+		}
+		if p.presharedKey != "" {
+			fmt.Fprintf(out, "preshared-key=%s\npreshared-key-flags=0\n", p.presharedKey)
+		}
+		if p.keepalive != "" {
+			fmt.Fprintf(out, "persistent-keepalive=%s\n", p.keepalive)
+		}
+		fmt.Fprintf(out, "allowed-ips=%s;\n", strings.Join(p.allowedIPs, ";"))
+	}
+
+	for _, family := range []string{"ipv4", "ipv6"} {
+		is4 := family == "ipv4"
+		var addresses, dns []string
+		for _, a := range c.addresses {
+			if a.Addr().Is4() == is4 {
+				addresses = append(addresses, a.String())
+			}
+		}
+		for _, a := range c.dns {
+			if a.Is4() == is4 {
+				dns = append(dns, a.String())
+			}
+		}
+
+		fmt.Fprintf(out, "\n[%s]\n", family)
+		if len(addresses) == 0 {
+			if is4 {
+				out.WriteString("method=disabled\n")
+			} else {
+				out.WriteString("method=ignore\n")
+			}
+			continue
+		}
+		for i, a := range addresses {
+			fmt.Fprintf(out, "address%d=%s\n", i+1, a)
+		}
+		if len(dns) > 0 {
+			fmt.Fprintf(out, "dns=%s;\n", strings.Join(dns, ";"))
+			if len(c.dnsSearch) > 0 {
+				fmt.Fprintf(out, "dns-search=%s;\n", strings.Join(c.dnsSearch, ";"))
+			}
+		}
+		out.WriteString("method=manual\n")
+	}
+}
+
+// validKey returns true if k is a base64 encoded WireGuard key.
+func validKey(k string) bool {
+	d, err := base64.StdEncoding.DecodeString(k)
+	return err == nil && len(d) == 32
+}
+
+// splitList splits the comma separated list v.
+func splitList(v string) []string {
+	var r []string
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			r = append(r, e)
+		}
+	}
+	return r
+}
@@ -0,0 +1,283 @@
+// Package runlock provides a lock file preventing several processes from running the same operation at once.
+//
+// The lock file records its owner: the process identifier, the start time of the process and the boot identifier
+// of the machine. As the lock is kept in a persistent directory, a process crashing, or the machine losing power,
+// while holding the lock leaves it behind. Such a lock is detected as stale and taken over when:
+//   - the machine rebooted since it was acquired;
+//   - its owner process is not running anymore, or its identifier has been reused by another process;
+//   - its content is corrupted.
+package runlock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+	"golang.org/x/sys/unix"
+)
+
+// Lock is a lock file held by the current process.
+type Lock struct {
+	path  string
+	owner owner
+}
+
+// owner identifies the process holding a lock.
+type owner struct {
+	PID       int       `json:"pid"`
+	StartTime uint64    `json:"start_time"`
+	BootID    string    `json:"boot_id"`
+	Acquired  time.Time `json:"acquired"`
+}
+
+type options struct {
+	procDir      string
+	pollInterval time.Duration
+}
+
+// Option reprents an optional function to change the lock behavior.
+type Option func(*options)
+
+// WithProcDir overrides the default proc file system directory, used to identify the processes and the boot.
+func WithProcDir(p string) func(*options) {
+	return func(a *options) {
+		a.procDir = p
+	}
+}
+
+// WithPollInterval overrides the default interval between two attempts to acquire a lock held by another process.
+func WithPollInterval(d time.Duration) func(*options) {
+	return func(a *options) {
+		a.pollInterval = d
+	}
+}
+
+// Acquire takes the lock file at path, creating its directory if needed.
+// If another running process holds the lock, Acquire waits for it to be released until ctx is cancelled.
+// A stale lock is taken over.
+func Acquire(ctx context.Context, path string, opts ...Option) (l *Lock, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't acquire lock %s", path))
+
+	// defaults
+	args := options{
+		procDir:      "/proc",
+		pollInterval: time.Second,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	self, err := currentOwner(args.procDir, os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	self.Acquired = time.Now()
+	d, err := json.Marshal(self)
+	if err != nil {
+		return nil, err
+	}
+
+	// nolint:gosec // G301 the lock directory is only writable by root
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	var waiting bool
+	for {
+		err := create(path, d)
+		if err == nil {
+			return &Lock{path: path, owner: self}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		holder, stale, err := takeOverIfStale(ctx, path, self, args.procDir)
+		if err != nil {
+			return nil, err
+		}
+		if stale {
+			continue
+		}
+
+		if !waiting {
+			log.Infof(ctx, "Waiting for process %d, running since %s, to release %s", holder.PID, holder.Acquired.Format(time.RFC3339), path)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.New(gotext.Get("lock is held by process %d since %s: %v", holder.PID, holder.Acquired.Format(time.RFC3339), ctx.Err()))
+		case <-time.After(args.pollInterval):
+		}
+	}
+}
+
+// Release removes the lock file, unless it was taken over by another process.
+func (l *Lock) Release() (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't release lock %s", l.path))
+
+	cur, err := readOwner(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err == nil && !sameProcess(cur, l.owner) {
+		return nil
+	}
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// create atomically creates the lock file at path with content d.
+// The content is fully written before the lock file appears, so that a lock file is never seen partially written.
+// It returns an error wrapping fs.ErrExist if the lock file already exists.
+func create(path string, d []byte) (err error) {
+	tmp := fmt.Sprintf("%s.%d.new", path, os.Getpid())
+	defer os.Remove(tmp)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(d); err != nil {
+		_ = f.Close()
+		return err
+	}
+	// Survive power losses right after acquiring the lock.
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Contrary to a rename, a link fails if the lock file already exists.
+	return os.Link(tmp, path)
+}
+
+// takeOverIfStale removes the lock file at path if it is stale, and returns true in this case.
+// Otherwise, it returns the owner of the lock.
+func takeOverIfStale(ctx context.Context, path string, self owner, procDir string) (holder owner, stale bool, err error) {
+	// Serialize the takeovers on the lock directory, so that a process never removes a lock acquired by another
+	// process right after a takeover.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return owner{}, false, err
+	}
+	defer dir.Close()
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		return owner{}, false, err
+	}
+	// Closing the directory releases the lock.
+
+	holder, err = readOwner(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Released in the meantime.
+		return owner{}, true, nil
+	}
+
+	var reason string
+	switch {
+	case err != nil:
+		reason = gotext.Get("its content is corrupted: %v", err)
+	case holder.BootID != self.BootID:
+		reason = gotext.Get("the machine rebooted since process %d acquired it", holder.PID)
+	case holder.PID == self.PID:
+		// The callers serialize their accesses to a lock in the current process.
+		reason = gotext.Get("it was not released by the current process")
+	default:
+		cur, err := currentOwner(procDir, holder.PID)
+		if err != nil || !sameProcess(cur, holder) {
+			reason = gotext.Get("process %d is not running anymore", holder.PID)
+		}
+	}
+	if reason == "" {
+		return holder, false, nil
+	}
+
+	log.Warning(ctx, gotext.Get("Taking over stale lock %s: %s", path, reason))
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return owner{}, false, err
+	}
+	return owner{}, true, nil
+}
+
+// readOwner returns the owner recorded in the lock file at path.
+func readOwner(path string) (o owner, err error) {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return owner{}, err
+	}
+	if err := json.Unmarshal(d, &o); err != nil {
+		return owner{}, err
+	}
+	if o.PID <= 0 || o.BootID == "" {
+		return owner{}, errors.New(gotext.Get("missing owner"))
+	}
+	return o, nil
+}
+
+// sameProcess returns true if a and b identify the same process of the same boot.
+func sameProcess(a, b owner) bool {
+	return a.PID == b.PID && a.StartTime == b.StartTime && a.BootID == b.BootID
+}
+
+// currentOwner returns the owner identifying the running process pid.
+func currentOwner(procDir string, pid int) (o owner, err error) {
+	d, err := os.ReadFile(filepath.Join(procDir, "sys", "kernel", "random", "boot_id"))
+	if err != nil {
+		return owner{}, err
+	}
+	bootID := strings.TrimSpace(string(d))
+	if bootID == "" {
+		return owner{}, errors.New(gotext.Get("empty boot identifier"))
+	}
+
+	startTime, err := startTime(procDir, pid)
+	if err != nil {
+		return owner{}, err
+	}
+
+	return owner{PID: pid, StartTime: startTime, BootID: bootID}, nil
+}
+
+// startTime returns the start time of the process pid, in clock ticks since the boot.
+// The process identifier can be reused once the process exits, but not with the same start time.
+func startTime(procDir string, pid int) (t uint64, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't determine start time of process %d", pid))
+
+	d, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	contents := string(d)
+
+	// The start time is the token at index 19 after the '(process name)' entry, which is the only one which can
+	// contain ')'. See proc(5).
+	idx := strings.LastIndexByte(contents, ')')
+	if idx < 0 || idx+2 > len(contents) {
+		return 0, errors.New(gotext.Get("parsing error: missing )"))
+	}
+	tokens := strings.Fields(contents[idx+2:])
+	if len(tokens) < 20 {
+		return 0, errors.New(gotext.Get("parsing error: less fields than required"))
+	}
+	v, err := strconv.ParseUint(tokens[19], 10, 64)
+	if err != nil {
+		return 0, errors.New(gotext.Get("parsing error: %v", err))
+	}
+	return v, nil
+}
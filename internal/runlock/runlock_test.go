@@ -0,0 +1,208 @@
+package runlock_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/runlock"
+)
+
+const (
+	bootID      = "7d5f6e2c-3b1a-4c8e-9f0d-2a6b8c4e1f30"
+	otherBootID = "0b8e4f21-9c6d-4a7e-8b3f-5d1c2e6a9f47"
+	// otherPID is a running process in the fake proc directory.
+	otherPID = 4242
+	// startTime is the start time of every running process in the fake proc directory.
+	startTime = 1234
+)
+
+func TestAcquire(t *testing.T) {
+	t.Parallel()
+
+	self := os.Getpid()
+
+	tests := map[string]struct {
+		// existingOwner is the content of the lock file before acquiring it, if any.
+		existingOwner string
+		noBootID      bool
+		dirIsFile     bool
+
+		wantErr bool
+	}{
+		"Acquire free lock": {},
+
+		// Stale locks
+		"Take over lock from previous boot":               {existingOwner: owner(otherPID, startTime, otherBootID)},
+		"Take over lock from previous boot with same pid": {existingOwner: owner(self, startTime, otherBootID)},
+		"Take over lock of exited process":                {existingOwner: owner(otherPID+1, startTime, bootID)},
+		"Take over lock of process with reused pid":       {existingOwner: owner(otherPID, startTime+1, bootID)},
+		"Take over lock not released by current process":  {existingOwner: owner(self, startTime, bootID)},
+		"Take over empty lock":                            {existingOwner: "-"},
+		"Take over corrupted lock":                        {existingOwner: `{"pid": 42`},
+		"Take over lock without owner":                    {existingOwner: `{}`},
+
+		// Error cases
+		"Error on lock held by running process": {existingOwner: owner(otherPID, startTime, bootID), wantErr: true},
+		"Error on missing boot identifier":      {noBootID: true, wantErr: true},
+		"Error on lock directory being a file":  {dirIsFile: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			procDir := fakeProcDir(t, !tc.noBootID, self, otherPID)
+			path := filepath.Join(t.TempDir(), "locks", "ubuntu.lock")
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750), "Setup: can't create lock directory")
+			if tc.existingOwner != "" {
+				content := tc.existingOwner
+				if content == "-" {
+					content = ""
+				}
+				require.NoError(t, os.WriteFile(path, []byte(content), 0600), "Setup: can't write existing lock")
+			}
+			if tc.dirIsFile {
+				require.NoError(t, os.Remove(filepath.Dir(path)), "Setup: can't remove lock directory")
+				require.NoError(t, os.WriteFile(filepath.Dir(path), nil, 0600), "Setup: can't replace lock directory with a file")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			l, err := runlock.Acquire(ctx, path, runlock.WithProcDir(procDir), runlock.WithPollInterval(10*time.Millisecond))
+			if tc.wantErr {
+				require.Error(t, err, "Acquire should have failed but didn't")
+				if tc.existingOwner != "" {
+					got, err := os.ReadFile(path)
+					require.NoError(t, err, "Lock held by another process should be left untouched")
+					require.Equal(t, tc.existingOwner, string(got), "Lock held by another process should be left untouched")
+				}
+				return
+			}
+			require.NoError(t, err, "Acquire should not have failed but did")
+
+			got := readOwner(t, path)
+			require.Equal(t, self, got.PID, "Lock should be owned by the current process")
+			require.Equal(t, uint64(startTime), got.StartTime, "Lock should record the start time of the current process")
+			require.Equal(t, bootID, got.BootID, "Lock should record the current boot")
+			require.NoFileExists(t, fmt.Sprintf("%s.%d.new", path, self), "Temporary lock file should be removed")
+
+			require.NoError(t, l.Release(), "Release should not have failed but did")
+			require.NoFileExists(t, path, "Lock file should be removed on release")
+		})
+	}
+}
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+	t.Parallel()
+
+	procDir := fakeProcDir(t, true, os.Getpid(), otherPID)
+	path := filepath.Join(t.TempDir(), "ubuntu.lock")
+	require.NoError(t, os.WriteFile(path, []byte(owner(otherPID, startTime, bootID)), 0600), "Setup: can't write existing lock")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		//nolint:errcheck // The test fails on acquiring the lock if the other process doesn't release it
+		os.Remove(path)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err := runlock.Acquire(ctx, path, runlock.WithProcDir(procDir), runlock.WithPollInterval(10*time.Millisecond))
+	require.NoError(t, err, "Acquire should wait for the lock to be released")
+	require.Equal(t, os.Getpid(), readOwner(t, path).PID, "Lock should be owned by the current process")
+	require.NoError(t, l.Release(), "Release should not have failed but did")
+}
+
+func TestRelease(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		takenOver  bool
+		removed    bool
+		corrupted  bool
+		wantRemove bool
+	}{
+		"Release owned lock":                         {wantRemove: true},
+		"Release corrupted lock":                     {corrupted: true, wantRemove: true},
+		"Release already removed lock":               {removed: true},
+		"Lock taken over by another process is kept": {takenOver: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			procDir := fakeProcDir(t, true, os.Getpid(), otherPID)
+			path := filepath.Join(t.TempDir(), "ubuntu.lock")
+			l, err := runlock.Acquire(context.Background(), path, runlock.WithProcDir(procDir))
+			require.NoError(t, err, "Setup: can't acquire lock")
+
+			switch {
+			case tc.takenOver:
+				require.NoError(t, os.WriteFile(path, []byte(owner(otherPID, startTime, bootID)), 0600), "Setup: can't take over lock")
+			case tc.corrupted:
+				require.NoError(t, os.WriteFile(path, []byte("corrupted"), 0600), "Setup: can't corrupt lock")
+			case tc.removed:
+				require.NoError(t, os.Remove(path), "Setup: can't remove lock")
+			}
+
+			require.NoError(t, l.Release(), "Release should not have failed but did")
+			if tc.wantRemove {
+				require.NoFileExists(t, path, "Lock file should be removed on release")
+				return
+			}
+			if tc.takenOver {
+				require.Equal(t, otherPID, readOwner(t, path).PID, "Lock taken over by another process should be kept")
+			}
+		})
+	}
+}
+
+// fakeProcDir creates a proc directory for the current boot, where the processes pids are running.
+func fakeProcDir(t *testing.T, withBootID bool, pids ...int) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if withBootID {
+		p := filepath.Join(dir, "sys", "kernel", "random", "boot_id")
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create boot_id directory")
+		require.NoError(t, os.WriteFile(p, []byte(bootID+"\n"), 0600), "Setup: can't write boot_id")
+	}
+	for _, pid := range pids {
+		p := filepath.Join(dir, strconv.Itoa(pid), "stat")
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create process directory")
+		// The process name can contain spaces and parenthesis.
+		stat := fmt.Sprintf("%d (adsysd (test) x) S 1 %d %d 0 -1 4194560 1234 0 0 0 10 5 0 0 20 0 8 0 %d 1274994688 4096\n", pid, pid, pid, startTime)
+		require.NoError(t, os.WriteFile(p, []byte(stat), 0600), "Setup: can't write process stat")
+	}
+	return dir
+}
+
+// owner returns the content of a lock file owned by the process pid.
+func owner(pid int, startTime uint64, bootID string) string {
+	return fmt.Sprintf(`{"pid":%d,"start_time":%d,"boot_id":%q,"acquired":"2024-03-01T10:00:00Z"}`, pid, startTime, bootID)
+}
+
+type lockOwner struct {
+	PID       int    `json:"pid"`
+	StartTime uint64 `json:"start_time"`
+	BootID    string `json:"boot_id"`
+}
+
+// readOwner returns the owner recorded in the lock file at path.
+func readOwner(t *testing.T, path string) lockOwner {
+	t.Helper()
+
+	d, err := os.ReadFile(path)
+	require.NoError(t, err, "Lock file should exist")
+	var o lockOwner
+	require.NoError(t, json.Unmarshal(d, &o), "Lock file should be valid")
+	return o
+}
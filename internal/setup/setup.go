@@ -0,0 +1,373 @@
+// Package setup detects how the machine is joined to Active Directory, proposes the matching adsys
+// configuration and validates that the machine is ready to apply policies.
+//
+// It backs the adsysctl init first-run wizard.
+package setup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported backends.
+const (
+	BackendSSSD    = "sssd"
+	BackendWinbind = "winbind"
+)
+
+// ldapPort is the port used to check the connectivity to the Active Directory server.
+const ldapPort = "389"
+
+// polkitActionsFile is the polkit actions definitions file shipped by adsys.
+const polkitActionsFile = "com.ubuntu.adsys.policy"
+
+// JoinState is how the machine is joined to Active Directory.
+type JoinState struct {
+	// Joined is true if the machine is joined to a domain.
+	Joined bool
+	// Backend is the backend authenticating against the domain: sssd or winbind.
+	Backend string
+	// Domain is the Active Directory domain.
+	Domain string
+	// Server is the Active Directory server statically configured, if any.
+	Server string
+	// SSSDConf is the path of the sssd configuration file the state was read from, if any.
+	SSSDConf string
+}
+
+type options struct {
+	sssdConf         string
+	smbConf          string
+	realmCmd         []string
+	polkitActionsDir string
+	dialTimeout      time.Duration
+}
+
+// Option reprents an optional function to change the setup behavior.
+type Option func(*options)
+
+// WithSSSDConf overrides the default sssd configuration file.
+func WithSSSDConf(p string) func(*options) {
+	return func(o *options) {
+		o.sssdConf = p
+	}
+}
+
+// WithSmbConf overrides the default samba configuration file, used by winbind.
+func WithSmbConf(p string) func(*options) {
+	return func(o *options) {
+		o.smbConf = p
+	}
+}
+
+// WithRealmCmd overrides the default command listing the realms the machine is joined to.
+func WithRealmCmd(cmd []string) func(*options) {
+	return func(o *options) {
+		o.realmCmd = cmd
+	}
+}
+
+// WithPolkitActionsDir overrides the default polkit actions directory.
+func WithPolkitActionsDir(p string) func(*options) {
+	return func(o *options) {
+		o.polkitActionsDir = p
+	}
+}
+
+// WithDialTimeout overrides the default timeout to connect to the Active Directory server.
+func WithDialTimeout(timeout time.Duration) func(*options) {
+	return func(o *options) {
+		o.dialTimeout = timeout
+	}
+}
+
+func newOptions(opts ...Option) options {
+	// defaults
+	args := options{
+		sssdConf:         consts.DefaultSSSConf,
+		smbConf:          consts.DefaultSmbConf,
+		realmCmd:         []string{"realm", "list"},
+		polkitActionsDir: consts.DefaultPolkitActionsDir,
+		dialTimeout:      5 * time.Second,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+	return args
+}
+
+// Detect returns how the machine is joined to Active Directory.
+// The realms listed by realmd take precedence, then the sssd and winbind configurations are read.
+// A machine which isn't joined returns a zero JoinState without any error.
+func Detect(ctx context.Context, opts ...Option) (s JoinState, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't detect Active Directory join state"))
+
+	args := newOptions(opts...)
+
+	realmDomain, realmBackend := detectRealm(ctx, args.realmCmd)
+
+	sssd, err := readSSSDConf(args.sssdConf)
+	if err != nil {
+		return s, err
+	}
+	winbind, err := readSmbConf(args.smbConf)
+	if err != nil {
+		return s, err
+	}
+
+	switch {
+	case realmBackend == BackendWinbind && winbind.Joined:
+		s = winbind
+	case realmBackend == BackendWinbind:
+		s = JoinState{Joined: true, Backend: BackendWinbind, Domain: realmDomain}
+	case sssd.Joined:
+		s = sssd
+	case winbind.Joined:
+		s = winbind
+	case realmDomain != "":
+		s = JoinState{Joined: true, Backend: BackendSSSD, Domain: realmDomain, SSSDConf: args.sssdConf}
+	}
+
+	return s, nil
+}
+
+// detectRealm returns the domain and backend of the first Active Directory realm listed by realmd.
+// It returns empty strings if realmd isn't available or if the machine isn't joined.
+func detectRealm(ctx context.Context, realmCmd []string) (domain, backend string) {
+	if len(realmCmd) == 0 {
+		return "", ""
+	}
+	if _, err := exec.LookPath(realmCmd[0]); err != nil {
+		log.Debugf(ctx, "realmd is not available: %v", err)
+		return "", ""
+	}
+
+	// #nosec G204 - the command is controlled by the caller
+	out, err := exec.CommandContext(ctx, realmCmd[0], realmCmd[1:]...).Output()
+	if err != nil {
+		log.Debugf(ctx, "Can't list realms: %v", err)
+		return "", ""
+	}
+
+	type realm struct{ domain, configured, server, client string }
+	var realms []realm
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		l := scanner.Text()
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		// A new realm starts on each line which is not indented.
+		if !strings.HasPrefix(l, " ") && !strings.HasPrefix(l, "\t") {
+			realms = append(realms, realm{domain: strings.TrimSpace(l)})
+			continue
+		}
+		if len(realms) == 0 {
+			continue
+		}
+		r := &realms[len(realms)-1]
+		k, v, _ := strings.Cut(strings.TrimSpace(l), ":")
+		v = strings.TrimSpace(v)
+		switch strings.TrimSpace(k) {
+		case "domain-name":
+			r.domain = v
+		case "configured":
+			r.configured = v
+		case "server-software":
+			r.server = v
+		case "client-software":
+			r.client = v
+		}
+	}
+
+	for _, r := range realms {
+		if r.configured == "" || r.configured == "no" || r.server != "active-directory" {
+			continue
+		}
+		backend = BackendSSSD
+		if r.client == BackendWinbind {
+			backend = BackendWinbind
+		}
+		return strings.ToLower(r.domain), backend
+	}
+	return "", ""
+}
+
+// readSSSDConf returns the join state from the first domain of the sssd configuration file p.
+func readSSSDConf(p string) (s JoinState, err error) {
+	cfg, err := ini.Load(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, errors.New(gotext.Get("invalid sssd configuration %s: %v", p, err))
+	}
+
+	sssdDomain := strings.TrimSpace(strings.Split(cfg.Section("sssd").Key("domains").String(), ",")[0])
+	if sssdDomain == "" {
+		return s, nil
+	}
+	domainSection := cfg.Section(fmt.Sprintf("domain/%s", sssdDomain))
+	if domainSection.Key("id_provider").String() != "ad" {
+		return s, nil
+	}
+
+	domain := domainSection.Key("ad_domain").String()
+	if domain == "" {
+		domain = sssdDomain
+	}
+	server := strings.TrimPrefix(domainSection.Key("ad_server").String(), "ldap://")
+	// Only a single static server is supported.
+	server = strings.TrimSpace(strings.Split(server, ",")[0])
+	if server == "_srv_" {
+		server = ""
+	}
+
+	return JoinState{Joined: true, Backend: BackendSSSD, Domain: strings.ToLower(domain), Server: server, SSSDConf: p}, nil
+}
+
+// readSmbConf returns the join state from the samba configuration file p, if samba is a member of an Active Directory domain.
+func readSmbConf(p string) (s JoinState, err error) {
+	cfg, err := ini.LoadSources(ini.LoadOptions{Insensitive: true, AllowBooleanKeys: true, AllowShadows: true}, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, errors.New(gotext.Get("invalid samba configuration %s: %v", p, err))
+	}
+
+	global := cfg.Section("global")
+	if !strings.EqualFold(global.Key("security").String(), "ads") {
+		return s, nil
+	}
+	realm := global.Key("realm").String()
+	if realm == "" {
+		return s, nil
+	}
+	// Only a single static server is supported.
+	var server string
+	servers := strings.FieldsFunc(global.Key("password server").String(), func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	if len(servers) > 0 && servers[0] != "*" {
+		server = servers[0]
+	}
+
+	return JoinState{Joined: true, Backend: BackendWinbind, Domain: strings.ToLower(realm), Server: server}, nil
+}
+
+// Config is the adsys configuration proposed for a join state.
+type Config struct {
+	ADBackend string         `yaml:"ad_backend"`
+	SSSD      *SSSDConfig    `yaml:"sssd,omitempty"`
+	Winbind   *WinbindConfig `yaml:"winbind,omitempty"`
+}
+
+// SSSDConfig is the configuration of the sssd backend.
+type SSSDConfig struct {
+	Config string `yaml:"config,omitempty"`
+}
+
+// WinbindConfig is the configuration of the winbind backend.
+type WinbindConfig struct {
+	ADDomain string `yaml:"ad_domain,omitempty"`
+	ADServer string `yaml:"ad_server,omitempty"`
+}
+
+// Propose returns the adsys configuration matching the join state s.
+// Settings which match the adsys defaults are omitted.
+func Propose(s JoinState) Config {
+	if s.Backend == BackendWinbind {
+		return Config{
+			ADBackend: BackendWinbind,
+			Winbind:   &WinbindConfig{ADDomain: s.Domain, ADServer: s.Server},
+		}
+	}
+
+	c := Config{ADBackend: BackendSSSD}
+	if s.SSSDConf != "" && s.SSSDConf != consts.DefaultSSSConf {
+		c.SSSD = &SSSDConfig{Config: s.SSSDConf}
+	}
+	return c
+}
+
+// Marshal returns the configuration file content for c.
+func (c Config) Marshal() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(gotext.Get("# Generated by adsysctl init.") + "\n")
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Write writes the configuration c to p, replacing any existing file atomically.
+func (c Config) Write(p string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write configuration to %s", p))
+
+	d, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	// #nosec G306 - the configuration file is world readable, like other files in /etc.
+	if err := os.WriteFile(p+".new", d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+// CheckConnectivity checks that the Active Directory server, or a controller of domain if no server is set,
+// accepts LDAP connections.
+func CheckConnectivity(ctx context.Context, domain, server string, opts ...Option) (err error) {
+	args := newOptions(opts...)
+
+	host := server
+	if host == "" {
+		host = domain
+	}
+	if host == "" {
+		return errors.New(gotext.Get("no Active Directory domain nor server to connect to"))
+	}
+	defer decorate.OnError(&err, gotext.Get("can't connect to %s", host))
+
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, ldapPort)
+	}
+	d := net.Dialer{Timeout: args.dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// CheckPolkit checks that the adsys polkit actions are installed, so that users can be authorized by the daemon.
+func CheckPolkit(opts ...Option) (err error) {
+	args := newOptions(opts...)
+
+	p := filepath.Join(args.polkitActionsDir, polkitActionsFile)
+	if _, err := os.Stat(p); err != nil {
+		return errors.New(gotext.Get("adsys polkit actions are not installed: %v", err))
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package setup_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/setup"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestDetect(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		sssdConf string
+		smbConf  string
+		realm    string
+
+		want    setup.JoinState
+		wantErr bool
+	}{
+		"Joined with sssd":                                  {sssdConf: "joined.conf", want: setup.JoinState{Joined: true, Backend: "sssd", Domain: "example.com", SSSDConf: "joined.conf"}},
+		"Joined with sssd and a static server":              {sssdConf: "with-server.conf", want: setup.JoinState{Joined: true, Backend: "sssd", Domain: "example.com", Server: "dc1.example.com", SSSDConf: "with-server.conf"}},
+		"Joined with sssd and servers from DNS":             {sssdConf: "srv-server.conf", want: setup.JoinState{Joined: true, Backend: "sssd", Domain: "example.com", SSSDConf: "srv-server.conf"}},
+		"Joined with sssd without ad_domain":                {sssdConf: "without-ad-domain.conf", want: setup.JoinState{Joined: true, Backend: "sssd", Domain: "example.com", SSSDConf: "without-ad-domain.conf"}},
+		"Joined with winbind":                               {smbConf: "ads.conf", want: setup.JoinState{Joined: true, Backend: "winbind", Domain: "example.com"}},
+		"Joined with winbind and a password server":         {smbConf: "with-server.conf", want: setup.JoinState{Joined: true, Backend: "winbind", Domain: "example.com", Server: "dc1.example.com"}},
+		"Joined with winbind and any password server":       {smbConf: "any-server.conf", want: setup.JoinState{Joined: true, Backend: "winbind", Domain: "example.com"}},
+		"Sssd takes precedence over winbind":                {sssdConf: "joined.conf", smbConf: "ads.conf", want: setup.JoinState{Joined: true, Backend: "sssd", Domain: "example.com", SSSDConf: "joined.conf"}},
+		"Realm client software selects the backend":         {sssdConf: "joined.conf", smbConf: "with-server.conf", realm: "winbind", want: setup.JoinState{Joined: true, Backend: "winbind", Domain: "example.com", Server: "dc1.example.com"}},
+		"Realm with winbind and no samba configuration":     {sssdConf: "joined.conf", realm: "winbind", want: setup.JoinState{Joined: true, Backend: "winbind", Domain: "realm.example.com"}},
+		"Realm with sssd and no sssd configuration":         {realm: "sssd", want: setup.JoinState{Joined: true, Backend: "sssd", Domain: "realm.example.com", SSSDConf: "missing.conf"}},
+		"Realm not configured is ignored":                   {realm: "not-configured"},
+		"Realm not from Active Directory is ignored":        {realm: "not-ad"},
+		"Realm failing is ignored":                          {sssdConf: "joined.conf", realm: "fail", want: setup.JoinState{Joined: true, Backend: "sssd", Domain: "example.com", SSSDConf: "joined.conf"}},
+		"Sssd domain not using Active Directory is ignored": {sssdConf: "not-ad.conf"},
+		"Sssd without domain is ignored":                    {sssdConf: "no-domain.conf"},
+		"Samba not member of a domain is ignored":           {smbConf: "not-ads.conf"},
+		"Not joined": {},
+
+		// Error cases
+		"Error on invalid sssd configuration":  {sssdConf: "invalid.conf", wantErr: true},
+		"Error on invalid samba configuration": {smbConf: "invalid.conf", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			sssdConf := filepath.Join("testdata", "sssd", "missing.conf")
+			if tc.sssdConf != "" {
+				sssdConf = filepath.Join("testdata", "sssd", tc.sssdConf)
+			}
+			smbConf := filepath.Join("testdata", "smb", "missing.conf")
+			if tc.smbConf != "" {
+				smbConf = filepath.Join("testdata", "smb", tc.smbConf)
+			}
+			realmCmd := []string{"/nonexistent/realm"}
+			if tc.realm != "" {
+				realmCmd = mockRealmCmd(t, tc.realm)
+			}
+
+			got, err := setup.Detect(context.Background(), setup.WithSSSDConf(sssdConf), setup.WithSmbConf(smbConf), setup.WithRealmCmd(realmCmd))
+			if tc.wantErr {
+				require.Error(t, err, "Detect should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Detect failed but shouldn't have")
+
+			if tc.want.SSSDConf != "" {
+				tc.want.SSSDConf = filepath.Join("testdata", "sssd", tc.want.SSSDConf)
+			}
+			require.Equal(t, tc.want, got, "Detect returned an unexpected join state")
+		})
+	}
+}
+
+func TestProposeAndWrite(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		state setup.JoinState
+
+		wantErr bool
+	}{
+		"Sssd with the default configuration": {state: setup.JoinState{Joined: true, Backend: "sssd", Domain: "example.com", SSSDConf: "/etc/sssd/sssd.conf"}},
+		"Sssd with a custom configuration":    {state: setup.JoinState{Joined: true, Backend: "sssd", Domain: "example.com", SSSDConf: "/etc/sssd/custom.conf"}},
+		"Winbind with a static server":        {state: setup.JoinState{Joined: true, Backend: "winbind", Domain: "example.com", Server: "dc1.example.com"}},
+		"Winbind without a static server":     {state: setup.JoinState{Joined: true, Backend: "winbind", Domain: "example.com"}},
+		"Not joined proposes sssd":            {},
+
+		// Error cases
+		"Error on unwritable destination": {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dest := filepath.Join(t.TempDir(), "adsys.yaml")
+			if tc.wantErr {
+				dest = filepath.Join(t.TempDir(), "nonexistent", "adsys.yaml")
+			}
+
+			err := setup.Propose(tc.state).Write(dest)
+			if tc.wantErr {
+				require.Error(t, err, "Write should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Write failed but shouldn't have")
+
+			got, err := os.ReadFile(dest)
+			require.NoError(t, err, "Configuration should have been written")
+			want := testutils.LoadWithUpdateFromGolden(t, string(got))
+			require.Equal(t, want, string(got), "Written configuration doesn't match golden file")
+		})
+	}
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Setup: can't listen")
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Setup: can't listen")
+	closedAddr := closed.Addr().String()
+	require.NoError(t, closed.Close(), "Setup: can't close listener")
+
+	tests := map[string]struct {
+		domain string
+		server string
+
+		wantErr bool
+	}{
+		"Server accepting connections":    {domain: "example.com", server: l.Addr().String()},
+		"Domain is used if no server set": {domain: l.Addr().String()},
+
+		// Error cases
+		"Error on server refusing connections": {domain: "example.com", server: closedAddr, wantErr: true},
+		"Error on unresolvable server":         {server: "nonexistent.invalid", wantErr: true},
+		"Error on no domain nor server":        {wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			err := setup.CheckConnectivity(context.Background(), tc.domain, tc.server)
+			if tc.wantErr {
+				require.Error(t, err, "CheckConnectivity should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "CheckConnectivity failed but shouldn't have")
+		})
+	}
+}
+
+func TestCheckPolkit(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		noActions bool
+
+		wantErr bool
+	}{
+		"Polkit actions are installed": {},
+
+		// Error cases
+		"Error on missing polkit actions": {noActions: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			if !tc.noActions {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "com.ubuntu.adsys.policy"), nil, 0600), "Setup: can't create polkit actions")
+			}
+
+			err := setup.CheckPolkit(setup.WithPolkitActionsDir(dir))
+			if tc.wantErr {
+				require.Error(t, err, "CheckPolkit should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "CheckPolkit failed but shouldn't have")
+		})
+	}
+}
+
+func TestMockRealm(_ *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] != "--" {
+			args = args[1:]
+			continue
+		}
+		args = args[1:]
+		break
+	}
+
+	switch args[0] {
+	case "fail":
+		fmt.Fprintln(os.Stderr, "realm: couldn't connect to realm service")
+		os.Exit(1)
+	case "not-configured":
+		fmt.Println(`realm.example.com
+  type: kerberos
+  realm-name: REALM.EXAMPLE.COM
+  domain-name: realm.example.com
+  configured: no
+  server-software: active-directory
+  client-software: sssd`)
+	case "not-ad":
+		fmt.Println(`realm.example.com
+  type: kerberos
+  realm-name: REALM.EXAMPLE.COM
+  domain-name: realm.example.com
+  configured: kerberos-member
+  server-software: ipa
+  client-software: sssd`)
+	default:
+		fmt.Printf(`other.example.com
+  type: kerberos
+  domain-name: other.example.com
+  configured: no
+  server-software: active-directory
+  client-software: sssd
+Realm.Example.COM
+  type: kerberos
+  realm-name: REALM.EXAMPLE.COM
+  domain-name: Realm.Example.COM
+  configured: kerberos-member
+  server-software: active-directory
+  client-software: %s
+  required-package: sssd-tools
+  login-formats: %%U@realm.example.com
+  login-policy: allow-realm-logins
+`, args[0])
+	}
+}
+
+// mockRealmCmd returns the command simulating realm list with the given behaviour.
+func mockRealmCmd(t *testing.T, behaviour string) []string {
+	t.Helper()
+
+	return []string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockRealm", "--", behaviour}
+}
@@ -0,0 +1,262 @@
+package setup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/consts"
+)
+
+// Wizard interactively proposes, validates and writes the adsys configuration.
+type Wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	// AssumeYes accepts the proposed settings and the default answers without prompting.
+	AssumeYes bool
+	// Force writes the configuration even if some checks failed, and overwrites an existing configuration file.
+	Force bool
+	// RefreshNow is the default answer when proposing a first refresh of the machine policies.
+	RefreshNow bool
+	// Refresh triggers a refresh of the machine policies. No refresh is proposed if nil.
+	Refresh func(context.Context) error
+}
+
+// NewWizard returns a wizard prompting on out and reading the answers from in.
+func NewWizard(in io.Reader, out io.Writer) *Wizard {
+	return &Wizard{
+		in:  bufio.NewReader(in),
+		out: out,
+	}
+}
+
+// Run detects the join state of the machine, asks to confirm the proposed settings, validates the machine
+// and writes the configuration to dest. It then proposes a first refresh of the machine policies.
+func (w *Wizard) Run(ctx context.Context, dest string, opts ...Option) (err error) {
+	w.println(gotext.Get("Detecting Active Directory join state…"))
+	s, err := Detect(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	if s.Joined {
+		w.println(gotext.Get("Machine is joined to %s using %s.", s.Domain, s.Backend))
+	} else {
+		w.println(gotext.Get("This machine doesn't seem to be joined to an Active Directory domain. Join it first, for instance with realm join, or enter the settings manually."))
+	}
+	w.println()
+
+	c, domain, server, err := w.askSettings(s)
+	if err != nil {
+		return err
+	}
+
+	w.println()
+	var failed bool
+	w.print(gotext.Get("Checking connectivity to Active Directory… "))
+	if err := CheckConnectivity(ctx, domain, server, opts...); err != nil {
+		failed = true
+		w.println(gotext.Get("FAILED: %v", err))
+	} else {
+		w.println(gotext.Get("OK"))
+	}
+	w.print(gotext.Get("Checking polkit actions… "))
+	if err := CheckPolkit(opts...); err != nil {
+		failed = true
+		w.println(gotext.Get("FAILED: %v", err))
+	} else {
+		w.println(gotext.Get("OK"))
+	}
+
+	d, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	w.println()
+	w.println(gotext.Get("Proposed configuration:"))
+	w.print(string(d))
+
+	if failed && !w.Force {
+		ok, err := w.confirm(gotext.Get("Some checks failed. Write the configuration anyway?"), false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New(gotext.Get("configuration not written as some checks failed: use --force to write it anyway"))
+		}
+	}
+
+	question, def := gotext.Get("Write the configuration to %s?", dest), true
+	if _, err := os.Stat(dest); err == nil && !w.Force {
+		if w.AssumeYes {
+			return errors.New(gotext.Get("%s already exists: use --force to overwrite it", dest))
+		}
+		question, def = gotext.Get("%s already exists. Overwrite it?", dest), false
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	write, err := w.confirm(question, def)
+	if err != nil {
+		return err
+	}
+	if !write {
+		w.println(gotext.Get("Configuration not written."))
+		return nil
+	}
+	if err := c.Write(dest); err != nil {
+		return err
+	}
+	w.println(gotext.Get("Configuration written to %s.", dest))
+
+	if w.Refresh == nil {
+		return nil
+	}
+	refresh, err := w.confirm(gotext.Get("Update the machine policies now?"), w.RefreshNow)
+	if err != nil || !refresh {
+		return err
+	}
+	return w.Refresh(ctx)
+}
+
+// askSettings asks to confirm or change the settings proposed for s.
+// It returns the configuration along with the domain and server to check the connectivity against.
+func (w *Wizard) askSettings(s JoinState) (c Config, domain, server string, err error) {
+	proposed := Propose(s)
+
+	backend, err := w.ask(gotext.Get("Backend (sssd or winbind)"), proposed.ADBackend, func(v string) error {
+		if !slices.Contains([]string{BackendSSSD, BackendWinbind}, v) {
+			return errors.New(gotext.Get("backend must be sssd or winbind"))
+		}
+		return nil
+	})
+	if err != nil {
+		return c, "", "", err
+	}
+
+	// Only propose the detected values for the detected backend.
+	if backend != s.Backend {
+		s = JoinState{Backend: backend}
+	}
+
+	if backend == BackendSSSD {
+		sssdConf := s.SSSDConf
+		if sssdConf == "" {
+			sssdConf = consts.DefaultSSSConf
+		}
+		if sssdConf, err = w.ask(gotext.Get("SSSD configuration file"), sssdConf, nil); err != nil {
+			return c, "", "", err
+		}
+		if sssdConf != s.SSSDConf {
+			// Read the domain and server from the newly selected configuration.
+			if s, err = readSSSDConf(sssdConf); err != nil {
+				return c, "", "", err
+			}
+		}
+		s.Backend, s.SSSDConf = BackendSSSD, sssdConf
+		return Propose(s), s.Domain, s.Server, nil
+	}
+
+	if s.Domain, err = w.ask(gotext.Get("Active Directory domain"), s.Domain, func(v string) error {
+		if v == "" {
+			return errors.New(gotext.Get("the domain is required with winbind"))
+		}
+		return nil
+	}); err != nil {
+		return c, "", "", err
+	}
+	if s.Server, err = w.ask(gotext.Get("Active Directory server (empty to let winbind find it)"), s.Server, nil); err != nil {
+		return c, "", "", err
+	}
+	return Propose(s), s.Domain, s.Server, nil
+}
+
+// ask prompts for label and returns the answer, or def if the answer is empty.
+// The answer is asked again while validate returns an error.
+func (w *Wizard) ask(label, def string, validate func(string) error) (string, error) {
+	for {
+		w.printf("%s [%s]: ", label, def)
+		v := def
+		if w.AssumeYes {
+			w.printf("\n")
+		} else {
+			l, err := w.readLine()
+			if err != nil {
+				return "", err
+			}
+			if l != "" {
+				v = l
+			}
+		}
+
+		if validate == nil {
+			return v, nil
+		}
+		err := validate(v)
+		if err == nil {
+			return v, nil
+		}
+		if w.AssumeYes {
+			return "", err
+		}
+		w.printf("%v\n", err)
+	}
+}
+
+// confirm asks the yes/no question and returns the answer, or def if the answer is empty.
+func (w *Wizard) confirm(question string, def bool) (bool, error) {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	for {
+		w.printf("%s [%s] ", question, choices)
+		if w.AssumeYes {
+			w.printf("\n")
+			return def, nil
+		}
+		l, err := w.readLine()
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(l) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// readLine returns the next answer, without surrounding spaces.
+// An exhausted input is an error, as no answer can be read anymore.
+func (w *Wizard) readLine() (string, error) {
+	l, err := w.in.ReadString('\n')
+	if errors.Is(err, io.EOF) && l != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", errors.New(gotext.Get("no answer: %v", err))
+	}
+	return strings.TrimSpace(l), nil
+}
+
+func (w *Wizard) printf(format string, a ...any) {
+	fmt.Fprintf(w.out, format, a...)
+}
+
+func (w *Wizard) print(a ...any) {
+	fmt.Fprint(w.out, a...)
+}
+
+func (w *Wizard) println(a ...any) {
+	fmt.Fprintln(w.out, a...)
+}
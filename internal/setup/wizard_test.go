@@ -0,0 +1,142 @@
+package setup_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/setup"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+func TestWizard(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Setup: can't listen")
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	tests := map[string]struct {
+		input       string
+		notJoined   bool
+		invalidSSSD bool
+		noPolkit    bool
+		existing    bool
+		assumeYes   bool
+		force       bool
+		refreshNow  bool
+		noRefresh   bool
+		refreshErr  bool
+
+		wantRefresh bool
+		wantErr     bool
+	}{
+		"Accept proposed settings":                   {input: "\n\n\n\n"},
+		"Accept proposed settings and refresh":       {input: "\n\n\ny\n", wantRefresh: true},
+		"Refresh is not proposed without refresher":  {input: "\n\n\n", noRefresh: true},
+		"Non interactive":                            {assumeYes: true},
+		"Non interactive with refresh":               {assumeYes: true, refreshNow: true, wantRefresh: true},
+		"Switch to winbind":                          {input: "winbind\nexample.com\n127.0.0.1:1\ny\n\n\n"},
+		"Invalid backend is asked again":             {input: "other\nsssd\n\n\n\n"},
+		"Winbind asks again for a missing domain":    {input: "winbind\n\nexample.com\n127.0.0.1:1\ny\n\n\n", notJoined: true},
+		"Not joined machine proposes sssd":           {input: "\n#CONFDIR#/sssd.conf\ny\n\n\n", notJoined: true},
+		"Existing configuration is kept by default":  {input: "\n\n\n", existing: true},
+		"Existing configuration is overwritten":      {input: "\n\ny\n\n", existing: true},
+		"Force overwrites existing configuration":    {assumeYes: true, force: true, existing: true},
+		"Failed checks are written when confirmed":   {input: "\n\ny\n\n\n", noPolkit: true},
+		"Force writes despite failed checks":         {assumeYes: true, force: true, noPolkit: true},
+		"Configuration is not written when declined": {input: "\n\nn\n"},
+
+		// Error cases
+		"Error on failed checks when declined":                    {input: "\n\n\n", noPolkit: true, wantErr: true},
+		"Error on failed checks in non interactive mode":          {assumeYes: true, noPolkit: true, wantErr: true},
+		"Error on existing configuration in non interactive mode": {assumeYes: true, existing: true, wantErr: true},
+		"Error on refresh failure":                                {input: "\n\n\ny\n", refreshErr: true, wantRefresh: true, wantErr: true},
+		"Error on missing answers":                                {input: "\n", wantErr: true},
+		"Error on invalid detected configuration":                 {input: "\n\n\n\n", invalidSSSD: true, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			root, confDir := t.TempDir(), t.TempDir()
+			dest := filepath.Join(root, "adsys.yaml")
+
+			sssdConf := filepath.Join(confDir, "sssd.conf")
+			switch {
+			case tc.invalidSSSD:
+				require.NoError(t, os.WriteFile(sssdConf, []byte("[sssd\n"), 0600), "Setup: can't write sssd configuration")
+			case !tc.notJoined:
+				conf := "[sssd]\ndomains = example.com\n\n[domain/example.com]\nid_provider = ad\nad_server = " + l.Addr().String() + "\n"
+				require.NoError(t, os.WriteFile(sssdConf, []byte(conf), 0600), "Setup: can't write sssd configuration")
+			}
+			polkitDir := filepath.Join(confDir, "actions")
+			if !tc.noPolkit {
+				require.NoError(t, os.MkdirAll(polkitDir, 0750), "Setup: can't create polkit actions directory")
+				require.NoError(t, os.WriteFile(filepath.Join(polkitDir, "com.ubuntu.adsys.policy"), nil, 0600), "Setup: can't create polkit actions")
+			}
+			if tc.existing {
+				require.NoError(t, os.WriteFile(dest, []byte("verbose: 2\n"), 0600), "Setup: can't create existing configuration")
+			}
+
+			var out strings.Builder
+			w := setup.NewWizard(strings.NewReader(strings.ReplaceAll(tc.input, "#CONFDIR#", confDir)), &out)
+			w.AssumeYes = tc.assumeYes
+			w.Force = tc.force
+			w.RefreshNow = tc.refreshNow
+			var refreshed bool
+			if !tc.noRefresh {
+				w.Refresh = func(context.Context) error {
+					refreshed = true
+					if tc.refreshErr {
+						return errors.New("refresh error")
+					}
+					return nil
+				}
+			}
+
+			err := w.Run(context.Background(), dest,
+				setup.WithSSSDConf(sssdConf),
+				setup.WithSmbConf(filepath.Join(confDir, "smb.conf")),
+				setup.WithRealmCmd(nil),
+				setup.WithPolkitActionsDir(polkitDir),
+				setup.WithDialTimeout(time.Second))
+			require.Equal(t, tc.wantRefresh, refreshed, "Refresh should only be called when accepted")
+			if tc.wantErr {
+				require.Error(t, err, "Run should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Run failed but shouldn't have")
+
+			// Make the output and the written configuration independent of the test environment.
+			normalize := func(s string) string {
+				s = strings.ReplaceAll(s, root, "#ROOT#")
+				s = strings.ReplaceAll(s, confDir, "#CONFDIR#")
+				return regexp.MustCompile(`FAILED: .*`).ReplaceAllString(s, "FAILED")
+			}
+			require.NoError(t, os.WriteFile(filepath.Join(root, "output"), []byte(normalize(out.String())), 0600), "Setup: can't save output")
+			if d, err := os.ReadFile(dest); err == nil {
+				require.NoError(t, os.WriteFile(dest, []byte(normalize(string(d))), 0600), "Setup: can't normalize configuration")
+			}
+
+			testutils.CompareTreesWithFiltering(t, root, testutils.GoldenPath(t), testutils.UpdateEnabled())
+		})
+	}
+}
@@ -0,0 +1,188 @@
+// Package syshelpers provides the helpers shared by the policy managers and collectors acting on the system:
+// running system commands safely alongside libsmbclient, and writing and dumping configuration files.
+package syshelpers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys/internal/smbsafe"
+	"github.com/ubuntu/decorate"
+)
+
+// CmdOptions are the optional settings of a command run.
+type CmdOptions struct {
+	// Env is appended to the environment of the daemon.
+	Env []string
+	// Stdin is passed on the standard input of the command.
+	Stdin string
+	// Prepare is called on the command before running it, like to run it as another user.
+	Prepare func(*exec.Cmd) error
+}
+
+// Run runs the command cmd with args, for at most timeout if not 0, and returns its standard output.
+// An error, containing the error output, is returned if the command failed.
+func Run(ctx context.Context, timeout time.Duration, cmd []string, args ...string) (stdout string, err error) {
+	return RunWithOptions(ctx, timeout, cmd, CmdOptions{}, args...)
+}
+
+// RunWithOptions runs the command cmd with args and opts, for at most timeout if not 0, and returns its standard
+// output.
+// An error, containing the error output, is returned if the command failed.
+func RunWithOptions(ctx context.Context, timeout time.Duration, cmd []string, opts CmdOptions, args ...string) (stdout string, err error) {
+	name := filepath.Base(cmd[0])
+	if len(args) > 0 {
+		// Only the first argument is reported, as the other ones can be long lists or secrets.
+		name = fmt.Sprintf("%s %s", name, args[0])
+	}
+	defer decorate.OnError(&err, gotext.Get("%s failed", name))
+
+	stdout, stderr, err := run(ctx, timeout, cmd, opts, args...)
+	if err != nil {
+		if stderr != "" {
+			return "", fmt.Errorf("%w: %s", err, stderr)
+		}
+		return "", err
+	}
+	return stdout, nil
+}
+
+// RunWithStatus runs the command cmd with args and opts, for at most timeout if not 0, and returns its standard
+// and error outputs with its exit code.
+// An error is only returned if the command could not be run.
+func RunWithStatus(ctx context.Context, timeout time.Duration, cmd []string, opts CmdOptions, args ...string) (stdout, stderr string, exitCode int, err error) {
+	stdout, stderr, err = run(ctx, timeout, cmd, opts, args...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout, stderr, exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return stdout, stderr, -1, err
+	}
+	return stdout, stderr, 0, nil
+}
+
+// run runs the command cmd with args and opts, for at most timeout if not 0, and returns its standard and
+// trimmed error outputs.
+func run(ctx context.Context, timeout time.Duration, cmd []string, opts CmdOptions, args ...string) (stdout, stderr string, err error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmdArgs := append(slices.Clone(cmd[1:]), args...)
+	// #nosec G204 - cmd is under our control (default system commands or mocks for tests)
+	c := exec.CommandContext(ctx, cmd[0], cmdArgs...)
+	if opts.Prepare != nil {
+		if err := opts.Prepare(c); err != nil {
+			return "", "", err
+		}
+	}
+	if opts.Env != nil {
+		if c.Env == nil {
+			c.Env = os.Environ()
+		}
+		c.Env = append(c.Env, opts.Env...)
+	}
+	if opts.Stdin != "" {
+		c.Stdin = strings.NewReader(opts.Stdin)
+	}
+	var outBuf, errBuf bytes.Buffer
+	c.Stdout = &outBuf
+	c.Stderr = &errBuf
+
+	smbsafe.WaitExec()
+	err = c.Run()
+	smbsafe.DoneExec()
+
+	return outBuf.String(), strings.TrimSpace(errBuf.String()), err
+}
+
+// RunAs returns the preparation of a command to run it as user u, with its home directory.
+// Privileges are only dropped if u is not the current user.
+func RunAs(u *user.User) func(*exec.Cmd) error {
+	return func(c *exec.Cmd) error {
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return errors.New(gotext.Get("invalid uid %q for %s", u.Uid, u.Username))
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return errors.New(gotext.Get("invalid gid %q for %s", u.Gid, u.Username))
+		}
+
+		c.Env = append(os.Environ(), "HOME="+u.HomeDir, "USER="+u.Username)
+		if int(uid) == os.Getuid() {
+			return nil
+		}
+		c.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		}
+		return nil
+	}
+}
+
+// WriteConfig writes content to the configuration file p, removing it if content is empty.
+// The file is world readable and written atomically. It returns true if the file changed.
+func WriteConfig(p, content string) (changed bool, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't write configuration %s", p))
+
+	if content == "" {
+		if err := os.Remove(p); errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if old, err := os.ReadFile(p); err == nil && string(old) == content {
+		return false, nil
+	}
+
+	// nolint:gosec // G301 match distribution permission
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	// nolint:gosec // G306 system configuration files are world readable
+	if err := os.WriteFile(p+".new", []byte(content), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(p+".new", p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DumpFiles returns the content of the existing files among paths, each one preceded by its path.
+// Missing files are skipped.
+func DumpFiles(paths ...string) (dump string, err error) {
+	var out strings.Builder
+	for _, p := range paths {
+		content, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if out.Len() > 0 {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "==> %s <==\n%s\n", p, strings.TrimRight(string(content), "\n"))
+	}
+	return out.String(), nil
+}
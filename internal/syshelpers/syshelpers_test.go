@@ -0,0 +1,234 @@
+package syshelpers_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/syshelpers"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		script  string
+		timeout time.Duration
+		opts    syshelpers.CmdOptions
+
+		want       string
+		wantErrMsg string
+	}{
+		"Returns standard output":     {script: `echo "out"; echo "err" >&2`, want: "out\n"},
+		"Passes arguments":            {script: `echo "$1"`, want: "arg\n"},
+		"Appends environment":         {script: `echo "$ADSYS_TEST_VAR"`, opts: syshelpers.CmdOptions{Env: []string{"ADSYS_TEST_VAR=value"}}, want: "value\n"},
+		"Passes standard input":       {script: `cat`, opts: syshelpers.CmdOptions{Stdin: "input"}, want: "input"},
+		"Prepares command":            {script: `echo "$ADSYS_TEST_VAR"`, opts: syshelpers.CmdOptions{Prepare: prepareEnv("ADSYS_TEST_VAR=prepared")}, want: "prepared\n"},
+		"Environment after prepare":   {script: `echo "$ADSYS_TEST_VAR"`, opts: syshelpers.CmdOptions{Env: []string{"ADSYS_TEST_VAR=value"}, Prepare: prepareEnv("ADSYS_TEST_VAR=prepared")}, want: "value\n"},
+		"No timeout when set to zero": {script: `sleep 0.1; echo "out"`, want: "out\n"},
+
+		// Error cases
+		"Error with error output": {script: `echo "out"; echo "failure" >&2; exit 2`, wantErrMsg: "sh -c failed: exit status 2: failure"},
+		"Error without output":    {script: `exit 1`, wantErrMsg: "sh -c failed: exit status 1"},
+		"Error on timeout":        {script: `exec sleep 10`, timeout: 100 * time.Millisecond, wantErrMsg: "sh -c failed: signal: killed"},
+		"Error on prepare":        {script: `echo "out"`, opts: syshelpers.CmdOptions{Prepare: func(*exec.Cmd) error { return errors.New("prepare error") }}, wantErrMsg: "sh -c failed: prepare error"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := syshelpers.RunWithOptions(context.Background(), tc.timeout, []string{"sh"}, tc.opts, "-c", tc.script, "sh", "arg")
+			if tc.wantErrMsg != "" {
+				require.EqualError(t, err, tc.wantErrMsg, "RunWithOptions should return the expected error")
+				return
+			}
+			require.NoError(t, err, "RunWithOptions should not return an error")
+			require.Equal(t, tc.want, got, "RunWithOptions should return the standard output")
+		})
+	}
+}
+
+func TestRunWithStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		cmd []string
+
+		wantStdout   string
+		wantStderr   string
+		wantExitCode int
+		wantErr      bool
+	}{
+		"Returns outputs and exit code":   {cmd: []string{"sh", "-c", `echo "out"; echo " err " >&2`}, wantStdout: "out\n", wantStderr: "err"},
+		"Failing command is not an error": {cmd: []string{"sh", "-c", `echo "failure" >&2; exit 3`}, wantStderr: "failure", wantExitCode: 3},
+
+		// Error cases
+		"Error on command not found": {cmd: []string{"/nonexistent"}, wantExitCode: -1, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			stdout, stderr, exitCode, err := syshelpers.RunWithStatus(context.Background(), time.Minute, tc.cmd, syshelpers.CmdOptions{})
+			if tc.wantErr {
+				require.Error(t, err, "RunWithStatus should return an error")
+			} else {
+				require.NoError(t, err, "RunWithStatus should not return an error")
+			}
+			require.Equal(t, tc.wantStdout, stdout, "RunWithStatus should return the standard output")
+			require.Equal(t, tc.wantStderr, stderr, "RunWithStatus should return the trimmed error output")
+			require.Equal(t, tc.wantExitCode, exitCode, "RunWithStatus should return the exit code")
+		})
+	}
+}
+
+func TestRunAs(t *testing.T) {
+	t.Parallel()
+
+	current, err := user.Current()
+	require.NoError(t, err, "Setup: can't get current user")
+
+	tests := map[string]struct {
+		uid string
+		gid string
+
+		wantErr bool
+	}{
+		"Runs as current user with its home directory": {},
+
+		// Error cases
+		"Error on invalid uid": {uid: "invalid", wantErr: true},
+		"Error on invalid gid": {gid: "invalid", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			u := &user.User{Uid: current.Uid, Gid: current.Gid, Username: "adsysuser", HomeDir: "/home/adsysuser"}
+			if tc.uid != "" {
+				u.Uid = tc.uid
+			}
+			if tc.gid != "" {
+				u.Gid = tc.gid
+			}
+
+			got, err := syshelpers.RunWithOptions(context.Background(), time.Minute, []string{"sh", "-c", `echo "$HOME $USER"`},
+				syshelpers.CmdOptions{Prepare: syshelpers.RunAs(u)})
+			if tc.wantErr {
+				require.Error(t, err, "RunAs should fail the command")
+				return
+			}
+			require.NoError(t, err, "RunAs should not fail the command")
+			require.Equal(t, "/home/adsysuser adsysuser\n", got, "Command should run with the user environment")
+		})
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		existing     string
+		content      string
+		parentIsFile bool
+
+		wantChanged bool
+		wantErr     bool
+	}{
+		"Creates file":                 {content: "new", wantChanged: true},
+		"Updates file":                 {existing: "old", content: "new", wantChanged: true},
+		"Unchanged file":               {existing: "same", content: "same"},
+		"Removes file on empty":        {existing: "old", wantChanged: true},
+		"No file to remove is a no-op": {},
+
+		// Error cases
+		"Error on parent directory being a file": {content: "new", parentIsFile: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			p := filepath.Join(dir, "conf.d", "adsys.conf")
+			if tc.existing != "" {
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create configuration directory")
+				require.NoError(t, os.WriteFile(p, []byte(tc.existing), 0600), "Setup: can't write existing configuration")
+			}
+			if tc.parentIsFile {
+				require.NoError(t, os.WriteFile(filepath.Dir(p), nil, 0600), "Setup: can't replace configuration directory by a file")
+			}
+
+			changed, err := syshelpers.WriteConfig(p, tc.content)
+			if tc.wantErr {
+				require.Error(t, err, "WriteConfig should return an error")
+				return
+			}
+			require.NoError(t, err, "WriteConfig should not return an error")
+			require.Equal(t, tc.wantChanged, changed, "WriteConfig should report whether the file changed")
+
+			got, err := os.ReadFile(p)
+			if tc.content == "" {
+				require.ErrorIs(t, err, fs.ErrNotExist, "Configuration file should not exist")
+				return
+			}
+			require.NoError(t, err, "Configuration file should exist")
+			require.Equal(t, tc.content, string(got), "Configuration file should have the expected content")
+		})
+	}
+}
+
+func TestDumpFiles(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		files      map[string]string
+		unreadable bool
+
+		want    string
+		wantErr bool
+	}{
+		"Dumps files in order":     {files: map[string]string{"b.conf": "b content\n", "a.conf": "a content"}, want: "==> #DIR#/b.conf <==\nb content\n\n==> #DIR#/a.conf <==\na content\n"},
+		"Skips missing files":      {files: map[string]string{"a.conf": "a content\n\n"}, want: "==> #DIR#/a.conf <==\na content\n"},
+		"Empty dump without files": {},
+
+		// Error cases
+		"Error on unreadable file": {unreadable: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			for name, content := range tc.files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600), "Setup: can't write file")
+			}
+			if tc.unreadable {
+				require.NoError(t, os.Mkdir(filepath.Join(dir, "a.conf"), 0750), "Setup: can't create directory instead of file")
+			}
+
+			got, err := syshelpers.DumpFiles(filepath.Join(dir, "b.conf"), filepath.Join(dir, "a.conf"))
+			if tc.wantErr {
+				require.Error(t, err, "DumpFiles should return an error")
+				return
+			}
+			require.NoError(t, err, "DumpFiles should not return an error")
+			require.Equal(t, tc.want, strings.ReplaceAll(got, dir, "#DIR#"), "DumpFiles should return the content of the files")
+		})
+	}
+}
+
+// prepareEnv returns a command preparation setting the environment to the daemon one with env.
+func prepareEnv(env ...string) func(*exec.Cmd) error {
+	return func(c *exec.Cmd) error {
+		c.Env = append(os.Environ(), env...)
+		return nil
+	}
+}
@@ -66,6 +66,30 @@ func (s *systemdBus) DisableUnitFiles(names []string, _ bool) ([][]string, *dbus
 	return [][]string{{"symlink", "/from/path", "/to/path"}}, nil
 }
 
+func (s *systemdBus) MaskUnitFiles(names []string, _ bool, _ bool) ([][]string, *dbus.Error) {
+	if len(names) != 1 {
+		panic("method is only expected to be called with a single name")
+	}
+
+	if name := names[0]; name == absentUnit {
+		return nil, errNoSuchUnit
+	}
+
+	return [][]string{{"symlink", "/from/path", "/dev/null"}}, nil
+}
+
+func (s *systemdBus) UnmaskUnitFiles(names []string, _ bool) ([][]string, *dbus.Error) {
+	if len(names) != 1 {
+		panic("method is only expected to be called with a single name")
+	}
+
+	if name := names[0]; name == absentUnit {
+		return nil, errNoSuchUnit
+	}
+
+	return [][]string{{"unlink", "/from/path", ""}}, nil
+}
+
 func (s *systemdBus) Reload() *dbus.Error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -80,6 +80,26 @@ func (s DefaultCaller) DisableUnit(ctx context.Context, unit string) (err error)
 	return nil
 }
 
+// MaskUnit masks the given unit, so that it can't be started anymore.
+func (s DefaultCaller) MaskUnit(ctx context.Context, unit string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to mask unit %s", unit))
+
+	if _, err := s.conn.MaskUnitFilesContext(ctx, []string{unit}, false, true); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmaskUnit unmasks the given unit.
+func (s DefaultCaller) UnmaskUnit(ctx context.Context, unit string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("failed to unmask unit %s", unit))
+
+	if _, err := s.conn.UnmaskUnitFilesContext(ctx, []string{unit}, false); err != nil {
+		return err
+	}
+	return nil
+}
+
 // DaemonReload scans and reloads unit files. This is an equivalent to systemctl daemon-reload.
 func (s DefaultCaller) DaemonReload(ctx context.Context) (err error) {
 	defer decorate.OnError(&err, gotext.Get("failed to reload units"))
@@ -36,6 +36,8 @@ func TestManageUnit(t *testing.T) {
 		"Stop unit that exists":    {action: "stop"},
 		"Enable unit that exists":  {action: "enable"},
 		"Disable unit that exists": {action: "disable"},
+		"Mask unit that exists":    {action: "mask"},
+		"Unmask unit that exists":  {action: "unmask"},
 
 		// Error cases
 		"Error when starting unit that doesn't exist": {unitName: absentUnit, action: "start", wantErr: true},
@@ -46,6 +48,8 @@ func TestManageUnit(t *testing.T) {
 
 		"Error when enabling unit that doesn't exist":  {unitName: absentUnit, action: "enable", wantErr: true},
 		"Error when disabling unit that doesn't exist": {unitName: absentUnit, action: "disable", wantErr: true},
+		"Error when masking unit that doesn't exist":   {unitName: absentUnit, action: "mask", wantErr: true},
+		"Error when unmasking unit that doesn't exist": {unitName: absentUnit, action: "unmask", wantErr: true},
 	}
 
 	for name, tc := range tests {
@@ -66,6 +70,10 @@ func TestManageUnit(t *testing.T) {
 				err = systemdCaller.EnableUnit(ctx, tc.unitName)
 			case "disable":
 				err = systemdCaller.DisableUnit(ctx, tc.unitName)
+			case "mask":
+				err = systemdCaller.MaskUnit(ctx, tc.unitName)
+			case "unmask":
+				err = systemdCaller.UnmaskUnit(ctx, tc.unitName)
 			default:
 				panic("unknown systemd action")
 			}
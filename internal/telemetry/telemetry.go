@@ -0,0 +1,335 @@
+// Package telemetry aggregates locally the opt-in usage telemetry of adsys, and submits it
+// periodically to the ubuntu-report metrics server.
+//
+// Only counters are collected: the number of calls of each command, the number of failures of each
+// policy manager, and the size of the domain as a coarse bucket. No name, identifier or policy
+// content ever leaves the machine.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/decorate"
+)
+
+const (
+	// DefaultServerURL is the ubuntu-report metrics server the reports are submitted to.
+	DefaultServerURL = "https://metrics.ubuntu.com"
+
+	// DefaultSubmitInterval is the minimum duration between two submissions.
+	DefaultSubmitInterval = 7 * 24 * time.Hour
+
+	// submitTimeout is the maximum time to submit a report.
+	submitTimeout = 30 * time.Second
+)
+
+// domainSizeBuckets are the upper bounds of the domain size buckets, the last one being unbounded.
+var domainSizeBuckets = []int{10, 50, 200, 1000}
+
+// Report is the usage data aggregated since the last submission.
+type Report struct {
+	// Since is when the aggregation started.
+	Since time.Time `json:"since"`
+	// Commands is the number of calls of each command.
+	Commands map[string]int `json:"commands,omitempty"`
+	// ManagerFailures is the number of failures of each policy manager.
+	ManagerFailures map[string]int `json:"managerFailures,omitempty"`
+	// DomainSize is the bucket of the number of GPOs applying to the machine.
+	DomainSize string `json:"domainSize,omitempty"`
+}
+
+// state is the content of the local store.
+type state struct {
+	Report        Report    `json:"report"`
+	LastSubmitted time.Time `json:"lastSubmitted,omitempty"`
+}
+
+// Store aggregates the usage data of the machine in a local file until it is submitted.
+type Store struct {
+	path           string
+	enabled        bool
+	serverURL      string
+	submitInterval time.Duration
+	client         *http.Client
+	now            func() time.Time
+
+	mu sync.Mutex
+}
+
+type options struct {
+	serverURL      string
+	submitInterval time.Duration
+	now            func() time.Time
+}
+
+// Option reprents an optional function to change the telemetry store.
+type Option func(*options)
+
+// WithServerURL overrides the default ubuntu-report metrics server.
+func WithServerURL(url string) func(*options) {
+	return func(o *options) {
+		o.serverURL = url
+	}
+}
+
+// WithSubmitInterval overrides the default minimum duration between two submissions.
+func WithSubmitInterval(d time.Duration) func(*options) {
+	return func(o *options) {
+		o.submitInterval = d
+	}
+}
+
+// WithNow overrides the clock used to timestamp the reports.
+func WithNow(now func() time.Time) func(*options) {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// New returns a telemetry store aggregating the usage data in path.
+// Nothing is collected nor submitted unless enabled is true.
+func New(path string, enabled bool, opts ...Option) *Store {
+	// defaults
+	args := options{
+		serverURL:      DefaultServerURL,
+		submitInterval: DefaultSubmitInterval,
+		now:            time.Now,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+
+	return &Store{
+		path:           path,
+		enabled:        enabled,
+		serverURL:      strings.TrimSuffix(args.serverURL, "/"),
+		submitInterval: args.submitInterval,
+		client:         &http.Client{Timeout: submitTimeout},
+		now:            args.now,
+	}
+}
+
+// Enabled returns true if the administrator opted in the telemetry.
+func (s *Store) Enabled() bool {
+	return s.enabled
+}
+
+// RecordCommand counts a call of the command name.
+func (s *Store) RecordCommand(name string) error {
+	return s.update(func(r *Report) { r.Commands = increment(r.Commands, name) })
+}
+
+// RecordManagerFailure counts a failure of the policy manager name.
+func (s *Store) RecordManagerFailure(name string) error {
+	return s.update(func(r *Report) { r.ManagerFailures = increment(r.ManagerFailures, name) })
+}
+
+// SetDomainSize records the bucket of gpos, the number of GPOs applying to the machine.
+// The exact number is never stored.
+func (s *Store) SetDomainSize(gpos int) error {
+	return s.update(func(r *Report) { r.DomainSize = domainSizeBucket(gpos) })
+}
+
+// Report returns the usage data aggregated since the last submission.
+func (s *Store) Report() (r Report, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't read usage telemetry"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.load()
+	if err != nil {
+		return Report{}, err
+	}
+	return st.Report, nil
+}
+
+// Submit sends the aggregated usage data of the machine for version to the ubuntu-report metrics server,
+// unless the last submission is more recent than the submit interval or there is nothing to report.
+// The counters are reset once submitted.
+func (s *Store) Submit(ctx context.Context, version string) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't submit usage telemetry"))
+
+	if !s.enabled {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.load()
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	if !st.LastSubmitted.IsZero() && now.Sub(st.LastSubmitted) < s.submitInterval {
+		return nil
+	}
+	if len(st.Report.Commands) == 0 && len(st.Report.ManagerFailures) == 0 {
+		return nil
+	}
+
+	d, err := json.Marshal(st.Report)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, submitTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/ubuntu/adsys/%s", s.serverURL, version), bytes.NewReader(d))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(gotext.Get("metrics server answered with status %q", resp.Status))
+	}
+
+	return s.save(state{Report: Report{Since: now}, LastSubmitted: now})
+}
+
+// Purge removes all the usage data collected on the machine.
+func (s *Store) Purge() (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't remove usage telemetry"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// update applies change to the stored report, if the telemetry is enabled.
+func (s *Store) update(change func(*Report)) (err error) {
+	defer decorate.OnError(&err, gotext.Get("can't record usage telemetry"))
+
+	if !s.enabled {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.load()
+	if err != nil {
+		// Telemetry is not worth blocking anything: start a new aggregation instead.
+		st = state{}
+	}
+	if st.Report.Since.IsZero() {
+		st.Report.Since = s.now()
+	}
+	change(&st.Report)
+	return s.save(st)
+}
+
+// load returns the content of the store. A missing store is empty.
+func (s *Store) load() (st state, err error) {
+	d, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state{}, nil
+	} else if err != nil {
+		return state{}, err
+	}
+	if err := json.Unmarshal(d, &st); err != nil {
+		return state{}, fmt.Errorf("%s is corrupted: %w", s.path, err)
+	}
+	return st, nil
+}
+
+// save atomically replaces the content of the store with st.
+func (s *Store) save(st state) error {
+	d, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	// nolint:gosec // G301 the usage data is not sensitive and is readable by all users.
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	// nolint:gosec // G306 the usage data is not sensitive and is readable by all users.
+	if err := os.WriteFile(s.path+".new", d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".new", s.path)
+}
+
+// Format returns the report as displayed to the administrator.
+func Format(r Report, enabled bool) string {
+	if !enabled {
+		return gotext.Get("Usage telemetry is disabled.")
+	}
+	if r.Since.IsZero() {
+		return gotext.Get("Usage telemetry is enabled. No usage data was collected yet.")
+	}
+
+	var out strings.Builder
+	out.WriteString(gotext.Get("Usage telemetry is enabled. Data collected since %s:", r.Since.Format(time.DateTime)))
+	out.WriteString("\n" + gotext.Get("Commands:"))
+	out.WriteString(formatCounters(r.Commands))
+	out.WriteString("\n" + gotext.Get("Policy manager failures:"))
+	out.WriteString(formatCounters(r.ManagerFailures))
+	domainSize := r.DomainSize
+	if domainSize == "" {
+		domainSize = gotext.Get("unknown")
+	}
+	out.WriteString("\n" + gotext.Get("GPOs applying to the machine: %s", domainSize))
+	return out.String()
+}
+
+// formatCounters returns the counters, sorted by name, one per line.
+func formatCounters(counters map[string]int) string {
+	if len(counters) == 0 {
+		return " " + gotext.Get("none")
+	}
+	names := make([]string, 0, len(counters))
+	for n := range counters {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var out strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&out, "\n  %s: %d", n, counters[n])
+	}
+	return out.String()
+}
+
+// domainSizeBucket returns the bucket n falls into.
+func domainSizeBucket(n int) string {
+	low := 0
+	for _, high := range domainSizeBuckets {
+		if n <= high {
+			return fmt.Sprintf("%d-%d", low, high)
+		}
+		low = high + 1
+	}
+	return fmt.Sprintf("%d+", low)
+}
+
+// increment returns counters with the counter of name incremented, creating the map if needed.
+func increment(counters map[string]int, name string) map[string]int {
+	if counters == nil {
+		counters = make(map[string]int)
+	}
+	counters[name]++
+	return counters
+}
@@ -0,0 +1,278 @@
+package telemetry_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys/internal/telemetry"
+	"github.com/ubuntu/adsys/internal/testutils"
+)
+
+var now = time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+func TestRecord(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		existing   string
+		disabled   bool
+		commands   []string
+		failures   []string
+		domainSize int
+		dirIsFile  bool
+
+		want    telemetry.Report
+		wantErr bool
+	}{
+		"Record commands": {commands: []string{"UpdatePolicy", "Status", "UpdatePolicy"}, want: telemetry.Report{
+			Since: now, Commands: map[string]int{"UpdatePolicy": 2, "Status": 1},
+		}},
+		"Record manager failures": {failures: []string{"dconf", "apt", "dconf"}, want: telemetry.Report{
+			Since: now, ManagerFailures: map[string]int{"dconf": 2, "apt": 1},
+		}},
+		"Record domain size":                   {domainSize: 12, want: telemetry.Report{Since: now, DomainSize: "11-50"}},
+		"Add to existing report":               {existing: "report.json", commands: []string{"Status"}, failures: []string{"apt"}, want: existingReport(1, 1)},
+		"Corrupted store starts a new report":  {existing: "corrupted.json", commands: []string{"Status"}, want: telemetry.Report{Since: now, Commands: map[string]int{"Status": 1}}},
+		"Disabled telemetry records nothing":   {disabled: true, commands: []string{"Status"}, failures: []string{"apt"}, domainSize: 3},
+		"Disabled telemetry keeps the store":   {existing: "report.json", disabled: true, commands: []string{"Status"}, want: existingReport(0, 0)},
+		"Nothing recorded leaves an empty one": {},
+
+		// Error cases
+		"Error when the store directory is a file": {commands: []string{"Status"}, dirIsFile: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := filepath.Join(t.TempDir(), "telemetry", "usage.json")
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0750), "Setup: can't create store directory")
+			if tc.existing != "" {
+				testutils.Copy(t, filepath.Join("testdata", tc.existing), p)
+			}
+			if tc.dirIsFile {
+				require.NoError(t, os.RemoveAll(filepath.Dir(p)), "Setup: can't remove store directory")
+				require.NoError(t, os.WriteFile(filepath.Dir(p), nil, 0600), "Setup: can't create file in place of the store directory")
+			}
+
+			s := telemetry.New(p, !tc.disabled, telemetry.WithNow(func() time.Time { return now }))
+			var err error
+			for _, c := range tc.commands {
+				err = s.RecordCommand(c)
+			}
+			if tc.wantErr {
+				require.Error(t, err, "RecordCommand should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "RecordCommand should not have failed")
+			for _, f := range tc.failures {
+				require.NoError(t, s.RecordManagerFailure(f), "RecordManagerFailure should not have failed")
+			}
+			if tc.domainSize != 0 {
+				require.NoError(t, s.SetDomainSize(tc.domainSize), "SetDomainSize should not have failed")
+			}
+
+			// The store can be reopened.
+			got, err := telemetry.New(p, true).Report()
+			require.NoError(t, err, "Report should not have failed")
+			require.Equal(t, tc.want, got, "Report should return the recorded usage")
+		})
+	}
+}
+
+func TestDomainSize(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		gpos int
+
+		want string
+	}{
+		"No GPO":                {gpos: 0, want: "0-10"},
+		"Upper bound of bucket": {gpos: 10, want: "0-10"},
+		"Lower bound of bucket": {gpos: 11, want: "11-50"},
+		"Large domain":          {gpos: 500, want: "201-1000"},
+		"Unbounded last bucket": {gpos: 1001, want: "1001+"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := filepath.Join(t.TempDir(), "usage.json")
+			s := telemetry.New(p, true)
+			require.NoError(t, s.SetDomainSize(tc.gpos), "SetDomainSize should not have failed")
+
+			got, err := s.Report()
+			require.NoError(t, err, "Report should not have failed")
+			require.Equal(t, tc.want, got.DomainSize, "SetDomainSize should only store the bucket")
+		})
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		existing      string
+		disabled      bool
+		lastSubmitted time.Duration
+		serverStatus  int
+		noServer      bool
+
+		wantSubmitted bool
+		wantReset     bool
+		wantErr       bool
+	}{
+		"Submit and reset the report":                   {existing: "report.json", wantSubmitted: true, wantReset: true},
+		"Submit once the interval elapsed":              {existing: "report.json", lastSubmitted: 8 * 24 * time.Hour, wantSubmitted: true, wantReset: true},
+		"Skip when submitted during the interval":       {existing: "report.json", lastSubmitted: 24 * time.Hour},
+		"Skip when there is nothing to report":          {},
+		"Skip when telemetry is disabled":               {existing: "report.json", disabled: true},
+		"Error when the server refuses the report":      {existing: "report.json", serverStatus: http.StatusBadRequest, wantSubmitted: true, wantErr: true},
+		"Error when the server can't be reached":        {existing: "report.json", noServer: true, wantErr: true},
+		"Error when the store is corrupted":             {existing: "corrupted.json", wantErr: true},
+		"Skip on corrupted store if telemetry disabled": {existing: "corrupted.json", disabled: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var mu sync.Mutex
+			var submitted []byte
+			var submittedPath string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				submittedPath = r.URL.Path
+				var err error
+				submitted, err = io.ReadAll(r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if tc.serverStatus != 0 {
+					w.WriteHeader(tc.serverStatus)
+				}
+			}))
+			defer srv.Close()
+			url := srv.URL
+			if tc.noServer {
+				url = "http://127.0.0.1:1"
+			}
+
+			p := filepath.Join(t.TempDir(), "usage.json")
+			if tc.existing != "" {
+				testutils.Copy(t, filepath.Join("testdata", tc.existing), p)
+			}
+			if tc.lastSubmitted != 0 {
+				d, err := os.ReadFile(p)
+				require.NoError(t, err, "Setup: can't read store")
+				var st map[string]any
+				require.NoError(t, json.Unmarshal(d, &st), "Setup: can't parse store")
+				st["lastSubmitted"] = now.Add(-tc.lastSubmitted)
+				d, err = json.Marshal(st)
+				require.NoError(t, err, "Setup: can't serialize store")
+				require.NoError(t, os.WriteFile(p, d, 0600), "Setup: can't write store")
+			}
+
+			s := telemetry.New(p, !tc.disabled, telemetry.WithServerURL(url+"/"), telemetry.WithNow(func() time.Time { return now }))
+			err := s.Submit(context.Background(), "0.15")
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tc.wantSubmitted {
+				require.Equal(t, "/ubuntu/adsys/0.15", submittedPath, "Submit should have posted to the adsys report of the version")
+				var got telemetry.Report
+				require.NoError(t, json.Unmarshal(submitted, &got), "Submit should have posted a valid report")
+				require.Equal(t, existingReport(0, 0), got, "Submit should have posted the stored report")
+			} else {
+				require.Nil(t, submitted, "Submit should not have posted anything")
+			}
+			if tc.wantErr {
+				require.Error(t, err, "Submit should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Submit should not have failed")
+
+			if tc.existing != "report.json" {
+				return
+			}
+			got, err := telemetry.New(p, true).Report()
+			require.NoError(t, err, "Report should not have failed")
+			want := existingReport(0, 0)
+			if tc.wantReset {
+				want = telemetry.Report{Since: now}
+			}
+			require.Equal(t, want, got, "Submit should only reset the report once submitted")
+		})
+	}
+}
+
+func TestPurge(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		existing string
+	}{
+		"Purge existing store":         {existing: "report.json"},
+		"Purge without existing store": {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			p := filepath.Join(t.TempDir(), "usage.json")
+			if tc.existing != "" {
+				testutils.Copy(t, filepath.Join("testdata", tc.existing), p)
+			}
+
+			err := telemetry.New(p, false).Purge()
+			require.NoError(t, err, "Purge should not have failed")
+			require.NoFileExists(t, p, "Purge should have removed the store")
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		report   telemetry.Report
+		disabled bool
+	}{
+		"Report":                            {report: existingReport(0, 0)},
+		"Report without counters":           {report: telemetry.Report{Since: now}},
+		"Nothing collected yet":             {},
+		"Disabled telemetry":                {disabled: true, report: existingReport(0, 0)},
+		"Report with unknown domain size":   {report: telemetry.Report{Since: now, Commands: map[string]int{"Status": 1}}},
+		"Report with only manager failures": {report: telemetry.Report{Since: now, ManagerFailures: map[string]int{"apt": 3}, DomainSize: "0-10"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got := telemetry.Format(tc.report, !tc.disabled)
+			want := testutils.LoadWithUpdateFromGolden(t, got)
+			require.Equal(t, want, got, "Format should return the expected report")
+		})
+	}
+}
+
+// existingReport is the report stored in testdata/report.json, with additional calls of the Status
+// command and failures of the apt manager.
+func existingReport(status, apt int) telemetry.Report {
+	return telemetry.Report{
+		Since:           time.Date(2023, time.February, 1, 10, 0, 0, 0, time.UTC),
+		Commands:        map[string]int{"UpdatePolicy": 42, "Status": 3 + status},
+		ManagerFailures: map[string]int{"dconf": 1, "apt": 2 + apt},
+		DomainSize:      "11-50",
+	}
+}
@@ -105,6 +105,13 @@ class OU:
             return None
         return OUs[ppath]
 
+    def __str__(self):
+        # /example/RnD/RnDDep1 -> OU=RnDDep1,OU=RnD,DC=example
+        elems = self.strdn.strip("/").split("/")
+        dn = ["OU=%s" % e for e in reversed(elems[1:])]
+        dn.append("DC=%s" % elems[0])
+        return ",".join(dn)
+
     def addGPO(self, gpo):
         self.gpos.append(gpo)
         gPLink = ""
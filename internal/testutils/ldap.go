@@ -0,0 +1,164 @@
+// TiCS: disabled // Test helpers.
+
+package testutils
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ubuntu/adsys/internal/ldaphelpers"
+)
+
+// MockDirectory is a directory serving the connections of ldaphelpers.Client from LDIF data.
+// Each bind, search and update is logged in the commands.log file of Root, with Root replaced by #ROOT#.
+type MockDirectory struct {
+	Root string
+	// LDIF returns the entries matching the search req in LDIF, and false if the search base doesn't exist.
+	LDIF func(req *ldap.SearchRequest) (string, bool)
+
+	FailBind   bool
+	FailSearch bool
+	FailModify bool
+}
+
+// Dial opens a connection to the mocked directory. It is a ldaphelpers.Dialer.
+func (d MockDirectory) Dial(_ context.Context, addr, krb5CCName string, _ time.Duration) (ldaphelpers.Conn, error) {
+	if err := d.log(fmt.Sprintf("KRB5CCNAME=%s ldap bind %q", krb5CCName, addr)); err != nil {
+		return nil, err
+	}
+	if d.FailBind {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("requested bind failure"))
+	}
+	return mockDirectoryConn{d}, nil
+}
+
+// mockDirectoryConn is an open connection to a MockDirectory.
+type mockDirectoryConn struct {
+	MockDirectory
+}
+
+// Search returns the entries of the LDIF data of the directory for req.
+func (c mockDirectoryConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	line := fmt.Sprintf("ldap search %q %s %q", req.BaseDN, []string{"base", "one", "sub"}[req.Scope], req.Filter)
+	for _, a := range req.Attributes {
+		line += fmt.Sprintf(" %q", a)
+	}
+	if err := c.log(line); err != nil {
+		return nil, err
+	}
+	if c.FailSearch {
+		return nil, ldap.NewError(ldap.LDAPResultUnavailable, errors.New("requested search failure"))
+	}
+
+	var data string
+	if c.LDIF != nil {
+		var found bool
+		if data, found = c.LDIF(req); !found {
+			return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+		}
+	}
+	entries, err := parseLDIF(data)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorUnexpectedResponse, err)
+	}
+	return &ldap.SearchResult{Entries: entries}, nil
+}
+
+// Modify logs the changes of req.
+func (c mockDirectoryConn) Modify(req *ldap.ModifyRequest) error {
+	line := fmt.Sprintf("ldap modify %q", req.DN)
+	for _, ch := range req.Changes {
+		op := map[uint]string{ldap.AddAttribute: "add", ldap.DeleteAttribute: "delete", ldap.ReplaceAttribute: "replace"}[ch.Operation]
+		line += fmt.Sprintf("\n%s: %s", op, ch.Modification.Type)
+		for _, v := range ch.Modification.Vals {
+			line += fmt.Sprintf("\n%s: %s", ch.Modification.Type, v)
+		}
+		line += "\n-"
+	}
+	if err := c.log(line); err != nil {
+		return err
+	}
+	if c.FailModify {
+		return ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("requested update failure"))
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (c mockDirectoryConn) Close() error {
+	return nil
+}
+
+// log appends line to the commands.log file of the root directory of the mocked directory.
+func (d MockDirectory) log(line string) error {
+	// #nosec G302 - this is a test log file
+	f, err := os.OpenFile(filepath.Join(d.Root, "commands.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, strings.ReplaceAll(line, d.Root, "#ROOT#"))
+	return err
+}
+
+// parseLDIF parses LDIF data and returns the entries it contains. Values encoded in base64 are decoded.
+func parseLDIF(data string) ([]*ldap.Entry, error) {
+	// Unfold lines first: continuation lines start with a single space.
+	var lines []string
+	for _, l := range strings.Split(data, "\n") {
+		if strings.HasPrefix(l, " ") && len(lines) > 0 && lines[len(lines)-1] != "" {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		lines = append(lines, l)
+	}
+	lines = append(lines, "")
+
+	var entries []*ldap.Entry
+	var dn string
+	var attrs map[string][]string
+	for _, l := range lines {
+		if l == "" {
+			if attrs != nil {
+				entries = append(entries, ldap.NewEntry(dn, attrs))
+				dn, attrs = "", nil
+			}
+			continue
+		}
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		attr, value, found := strings.Cut(l, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid LDIF line %q", l)
+		}
+		if v, isBase64 := strings.CutPrefix(value, ":"); isBase64 {
+			d, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for %q: %w", attr, err)
+			}
+			value = string(d)
+		} else {
+			value = strings.TrimPrefix(value, " ")
+		}
+
+		if attrs == nil {
+			attrs = make(map[string][]string)
+		}
+		if strings.EqualFold(attr, "dn") {
+			dn = value
+			continue
+		}
+		attrs[attr] = append(attrs[attr], value)
+	}
+
+	return entries, nil
+}
@@ -68,4 +68,6 @@ func (s MockSystemdCaller) StartUnit(_ context.Context, _ string) error   { retu
 func (s MockSystemdCaller) StopUnit(_ context.Context, _ string) error    { return nil } //nolint:revive
 func (s MockSystemdCaller) EnableUnit(_ context.Context, _ string) error  { return nil } //nolint:revive
 func (s MockSystemdCaller) DisableUnit(_ context.Context, _ string) error { return nil } //nolint:revive
+func (s MockSystemdCaller) MaskUnit(_ context.Context, _ string) error    { return nil } //nolint:revive
+func (s MockSystemdCaller) UnmaskUnit(_ context.Context, _ string) error  { return nil } //nolint:revive
 func (s MockSystemdCaller) DaemonReload(_ context.Context) error          { return nil } //nolint:revive
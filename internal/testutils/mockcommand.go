@@ -0,0 +1,55 @@
+// TiCS: disabled // Test helpers.
+
+package testutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// MockCommand returns the command mocking name with the TestMockCommand function of the test binary.
+// root, where the calls are logged, and behaviour are passed to the mock, followed by the optional mockArgs.
+func MockCommand(root, name, behaviour string, mockArgs ...string) []string {
+	return append([]string{"env", "GO_WANT_HELPER_PROCESS=1", os.Args[0], "-test.run=TestMockCommand", "--", name, root, behaviour}, mockArgs...)
+}
+
+// MockedCommand is a call of a command mocked with MockCommand.
+type MockedCommand struct {
+	Name      string
+	Root      string
+	Behaviour string
+	// Args are the optional mock arguments, followed by the arguments of the call.
+	Args []string
+}
+
+// MockCommandCall returns the call of the mocked command when the test binary runs as a command mocked with
+// MockCommand. It returns false otherwise, and the calling test should then return.
+func MockCommandCall() (c MockedCommand, ok bool) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return c, false
+	}
+
+	args := os.Args
+	for len(args) > 0 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		args = args[1:]
+	}
+	return MockedCommand{Name: args[0], Root: args[1], Behaviour: args[2], Args: args[3:]}, true
+}
+
+// Log appends line to the commands.log file of the root directory of the mocked command.
+// The mocked command exits with an error if it can't.
+func (c MockedCommand) Log(line string) {
+	// #nosec G302 - this is a test log file
+	f, err := os.OpenFile(filepath.Join(c.Root, "commands.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't open log file: %v", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
@@ -0,0 +1,145 @@
+// Package adsysclient is the Go client of the adsys daemon, for tools embedding its operations.
+//
+// It wraps the gRPC API of the daemon, as used by adsysctl, and returns typed results:
+//   - Refresh updates the policies of the machine or of a user, and returns the outcome of each policy manager;
+//   - AppliedPolicies returns the GPOs and rules applied to the machine or to a user;
+//   - Status returns the version of the daemon, its last machine refresh and its status report.
+//
+// The daemon authorizes the requests like for adsysctl, based on the user running the client.
+package adsysclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/sirupsen/logrus"
+	"github.com/ubuntu/adsys"
+	"github.com/ubuntu/adsys/internal/consts"
+	"github.com/ubuntu/adsys/internal/grpc/contextidler"
+	"github.com/ubuntu/adsys/internal/grpc/interceptorschain"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/decorate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Client is a connection to the adsys daemon.
+type Client struct {
+	conn    *grpc.ClientConn
+	service adsys.ServiceClient
+}
+
+type options struct {
+	socket  string
+	timeout time.Duration
+	logger  *logrus.Logger
+}
+
+// Option represents an optional function to change the client connection.
+type Option func(*options)
+
+// WithSocket overrides the default socket the daemon listens on.
+func WithSocket(socket string) func(*options) {
+	return func(o *options) {
+		o.socket = socket
+	}
+}
+
+// WithTimeout overrides the default maximum time between 2 activities of the daemon before a request is
+// aborted. A 0 timeout means no timeout.
+func WithTimeout(timeout time.Duration) func(*options) {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithLogger sets the logger the daemon logs of the requests are forwarded to, at its level.
+// They are discarded by default.
+func WithLogger(logger *logrus.Logger) func(*options) {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// Connect returns a client connected to the adsys daemon.
+// The daemon is only reached on the first request.
+func Connect(opts ...Option) (c *Client, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't connect to adsys daemon"))
+
+	// defaults
+	args := options{
+		socket:  consts.DefaultSocket,
+		timeout: consts.DefaultClientTimeout * time.Second,
+	}
+	// applied options
+	for _, o := range opts {
+		o(&args)
+	}
+	if args.logger == nil {
+		args.logger = logrus.New()
+		args.logger.SetOutput(io.Discard)
+	}
+
+	conn, err := grpc.Dial(fmt.Sprintf("unix:%s", args.socket), grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStreamInterceptor(interceptorschain.StreamClient(
+			log.StreamClientInterceptor(args.logger),
+			// This is the last element which will be the first interceptor to execute to get all pings.
+			contextidler.StreamClientInterceptor(args.timeout),
+		)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		conn:    conn,
+		service: adsys.NewServiceClient(conn),
+	}, nil
+}
+
+// Close ends the connection to the daemon.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Version returns the version of the daemon.
+func (c *Client) Version(ctx context.Context) (version string, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't get daemon version"))
+
+	stream, err := c.service.Version(ctx, &adsys.Empty{})
+	if err != nil {
+		return "", err
+	}
+	return singleMsg(stream)
+}
+
+type recver interface {
+	Recv() (*adsys.StringResponse, error)
+}
+
+// singleMsg returns the single message streamed by the daemon.
+func singleMsg(stream recver) (msg string, err error) {
+	var received bool
+	for {
+		r, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if received {
+			return "", errors.New(gotext.Get("daemon streamed multiple answers while only one was expected"))
+		}
+		msg, received = r.GetMsg(), true
+	}
+	if !received {
+		return "", errors.New(gotext.Get("daemon didn't send any answer"))
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,342 @@
+package adsysclient_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/adsys"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/pkg/adsysclient"
+	"google.golang.org/grpc"
+)
+
+func TestRefresh(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		req        adsysclient.RefreshRequest
+		serverFail bool
+
+		wantTarget  string
+		wantResults []adsysclient.ManagerResult
+		wantErr     bool
+	}{
+		"Refresh user": {req: adsysclient.RefreshRequest{User: "bob@example.com", Krb5CC: "/tmp/krb5cc_bob", MaxAge: time.Hour},
+			wantTarget: "bob@example.com",
+			wantResults: []adsysclient.ManagerResult{
+				{Target: "bob@example.com", Manager: "dconf", Status: adsysclient.ManagerOK},
+				{Target: "bob@example.com", Manager: "scripts", Status: adsysclient.ManagerSkipped, Reason: "no rule"},
+			}},
+		"Refresh all":     {req: adsysclient.RefreshRequest{All: true}, wantResults: []adsysclient.ManagerResult{{Manager: "dconf", Status: adsysclient.ManagerOK}}},
+		"Refresh machine": {req: adsysclient.RefreshRequest{Machine: true}, wantResults: []adsysclient.ManagerResult{{Manager: "dconf", Status: adsysclient.ManagerOK}}},
+
+		"Results are returned on partial failure": {req: adsysclient.RefreshRequest{User: "bob@example.com"}, serverFail: true,
+			wantTarget: "bob@example.com",
+			wantResults: []adsysclient.ManagerResult{
+				{Target: "bob@example.com", Manager: "dconf", Status: adsysclient.ManagerFailed, Reason: "invalid value"},
+			},
+			wantErr: true},
+
+		// Error cases
+		"Error on all with user":         {req: adsysclient.RefreshRequest{All: true, User: "bob@example.com"}, wantErr: true},
+		"Error on machine with user":     {req: adsysclient.RefreshRequest{Machine: true, Krb5CC: "/tmp/krb5cc_bob"}, wantErr: true},
+		"Error on negative max age":      {req: adsysclient.RefreshRequest{User: "bob@example.com", MaxAge: -time.Hour}, wantErr: true},
+		"Error on max age for machine":   {req: adsysclient.RefreshRequest{Machine: true, MaxAge: time.Hour}, wantErr: true},
+		"Error on max age for all users": {req: adsysclient.RefreshRequest{All: true, MaxAge: time.Hour}, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &mockServer{fail: tc.serverFail}
+			c := newClient(t, s)
+
+			results, err := c.Refresh(context.Background(), tc.req)
+			if tc.wantErr {
+				require.Error(t, err, "Refresh should have failed but didn't")
+			} else {
+				require.NoError(t, err, "Refresh failed but shouldn't have")
+			}
+			if tc.wantResults == nil {
+				require.Nil(t, s.updateRequest, "Refresh should not have contacted the daemon")
+				return
+			}
+			require.Equal(t, tc.wantResults, results, "Refresh should return the outcome of the managers")
+
+			require.Equal(t, tc.req.Machine, s.updateRequest.GetIsComputer(), "Refresh should request the machine policies")
+			require.Equal(t, tc.req.All, s.updateRequest.GetAll(), "Refresh should request the policies of all objects")
+			require.Equal(t, int64(tc.req.MaxAge.Seconds()), s.updateRequest.GetMaxAge(), "Refresh should send the max age")
+			if tc.wantTarget != "" {
+				require.Equal(t, tc.wantTarget, s.updateRequest.GetTarget(), "Refresh should request the policies of the target")
+				require.Equal(t, tc.req.Krb5CC, s.updateRequest.GetKrb5Cc(), "Refresh should send the ticket of the user")
+			}
+			if tc.req.Machine {
+				require.NotEmpty(t, s.updateRequest.GetTarget(), "Refresh should request the policies of the machine")
+			}
+		})
+	}
+}
+
+func TestAppliedPolicies(t *testing.T) {
+	t.Parallel()
+
+	userDump := `Policies from machine configuration:
+* Default Domain Policy ({31B2F340-016D-11D2-945F-00C04FB984F9}) [example.com]
+** dconf:
+*** org/gnome/desktop/background/picture-uri: file:///usr/share/backgrounds/corp.png
+***+ org/gnome/desktop/screensaver/lock-enabled
+** scripts:
+*** startup: script.sh\nother.sh
+Policies from user configuration:
+* Users (Policy) ({75545F76-DEC2-4ADA-B7B8-D5209FD48727})
+** dconf:
+*** org/gnome/shell/favorite-apps: firefox.desktop (audit)
+*** org/gnome/desktop/interface/clock-format:
+*** org/gnome/desktop/interface/text-scaling-factor: big (warning: 'big' is not of type d)
+`
+	machineDump := `* Default Domain Policy ({31B2F340-016D-11D2-945F-00C04FB984F9})
+** dconf:
+*** org/gnome/desktop/background/picture-uri: file:///usr/share/backgrounds/corp.png
+`
+	machinePolicies := []adsysclient.GPO{{
+		ID:   "{31B2F340-016D-11D2-945F-00C04FB984F9}",
+		Name: "Default Domain Policy",
+		Rules: map[string][]adsysclient.Rule{
+			"dconf": {{Key: "org/gnome/desktop/background/picture-uri", Value: "file:///usr/share/backgrounds/corp.png"}},
+		},
+	}}
+
+	userPolicies := adsysclient.AppliedPolicies{
+		Machine: []adsysclient.GPO{{
+			ID:   "{31B2F340-016D-11D2-945F-00C04FB984F9}",
+			Name: "Default Domain Policy",
+			Link: "example.com",
+			Rules: map[string][]adsysclient.Rule{
+				"dconf": {
+					{Key: "org/gnome/desktop/background/picture-uri", Value: "file:///usr/share/backgrounds/corp.png"},
+					{Key: "org/gnome/desktop/screensaver/lock-enabled", Disabled: true},
+				},
+				"scripts": {{Key: "startup", Value: "script.sh\nother.sh"}},
+			},
+		}},
+		User: []adsysclient.GPO{{
+			ID:   "{75545F76-DEC2-4ADA-B7B8-D5209FD48727}",
+			Name: "Users (Policy)",
+			Rules: map[string][]adsysclient.Rule{
+				"dconf": {
+					{Key: "org/gnome/shell/favorite-apps", Value: "firefox.desktop", Audit: true},
+					{Key: "org/gnome/desktop/interface/clock-format"},
+					{Key: "org/gnome/desktop/interface/text-scaling-factor", Value: "big", Warning: "'big' is not of type d"},
+				},
+			},
+		}},
+	}
+
+	tests := map[string]struct {
+		machine    bool
+		user       string
+		dump       string
+		serverFail bool
+
+		want    adsysclient.AppliedPolicies
+		wantErr bool
+	}{
+		"User policies":         {user: "bob@example.com", dump: userDump, want: userPolicies},
+		"Current user policies": {dump: userDump, want: userPolicies},
+		"Machine policies":      {machine: true, dump: machineDump, want: adsysclient.AppliedPolicies{Machine: machinePolicies}},
+		"No GPO applied":        {machine: true},
+
+		// Error cases
+		"Error on machine with user":        {machine: true, user: "bob@example.com", wantErr: true},
+		"Error on daemon failure":           {machine: true, serverFail: true, wantErr: true},
+		"Error on header for machine":       {machine: true, dump: "Policies from machine configuration:\n" + machineDump, wantErr: true},
+		"Error on rule outside of any GPO":  {machine: true, dump: "*** key: value\n", wantErr: true},
+		"Error on type outside of any GPO":  {machine: true, dump: "** dconf:\n", wantErr: true},
+		"Error on invalid GPO":              {machine: true, dump: "* Default Domain Policy\n", wantErr: true},
+		"Error on more than 2 user headers": {user: "bob@example.com", dump: "Machine:\nUser:\nOther:\n", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &mockServer{dump: tc.dump, fail: tc.serverFail}
+			c := newClient(t, s)
+
+			got, err := c.AppliedPolicies(context.Background(), tc.machine, tc.user)
+			if tc.wantErr {
+				require.Error(t, err, "AppliedPolicies should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "AppliedPolicies failed but shouldn't have")
+			require.Equal(t, tc.want, got, "AppliedPolicies should return the parsed policies")
+
+			require.Equal(t, tc.machine, s.dumpRequest.GetIsComputer(), "AppliedPolicies should request the machine policies")
+			require.True(t, s.dumpRequest.GetDetails(), "AppliedPolicies should request the rules")
+			require.NotEmpty(t, s.dumpRequest.GetTarget(), "AppliedPolicies should request the policies of a target")
+			if tc.user != "" {
+				require.Equal(t, tc.user, s.dumpRequest.GetTarget(), "AppliedPolicies should request the policies of the user")
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		metrics    string
+		serverFail bool
+
+		wantLastRefresh *adsysclient.Refresh
+		wantErr         bool
+	}{
+		"Status with last refresh": {
+			metrics: `{"summary": {"runs": 2, "last": {"time": "2024-03-01T10:00:00Z", "duration_seconds": 1.5, "failures": 1}}}`,
+			wantLastRefresh: &adsysclient.Refresh{
+				Time:     time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+				Duration: 1500 * time.Millisecond,
+				Failures: 1,
+			},
+		},
+		"Status without any refresh": {metrics: `{"summary": {"runs": 0}}`},
+
+		// Error cases
+		"Error on invalid metrics": {metrics: "not json", wantErr: true},
+		"Error on daemon failure":  {serverFail: true, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			c := newClient(t, &mockServer{metrics: tc.metrics, fail: tc.serverFail})
+
+			got, err := c.Status(context.Background())
+			if tc.wantErr {
+				require.Error(t, err, "Status should have failed but didn't")
+				return
+			}
+			require.NoError(t, err, "Status failed but shouldn't have")
+
+			require.Equal(t, adsysclient.Status{Version: "1.0", LastRefresh: tc.wantLastRefresh, Report: "Daemon status"}, got,
+				"Status should return the status of the daemon")
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	t.Parallel()
+
+	c := newClient(t, &mockServer{})
+	v, err := c.Version(context.Background())
+	require.NoError(t, err, "Version failed but shouldn't have")
+	require.Equal(t, "1.0", v, "Version should return the version of the daemon")
+
+	c = newClient(t, &mockServer{multipleAnswers: true})
+	_, err = c.Version(context.Background())
+	require.Error(t, err, "Version should fail on multiple answers")
+}
+
+func TestConnectWithoutDaemon(t *testing.T) {
+	t.Parallel()
+
+	c, err := adsysclient.Connect(adsysclient.WithSocket(filepath.Join(t.TempDir(), "nonexistent.sock")), adsysclient.WithTimeout(time.Second))
+	require.NoError(t, err, "Connect should only reach the daemon on the first request")
+	defer c.Close()
+
+	_, err = c.Version(context.Background())
+	require.Error(t, err, "Version should fail without daemon")
+}
+
+// newClient starts a daemon serving s and returns a client connected to it.
+func newClient(t *testing.T, s adsys.ServiceServer) *adsysclient.Client {
+	t.Helper()
+
+	// Socket paths are limited in length, so don't nest it in the test name.
+	dir, err := os.MkdirTemp("", "adsysclient")
+	require.NoError(t, err, "Setup: can't create socket directory")
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "adsysd.sock")
+
+	srv := grpc.NewServer(grpc.StreamInterceptor(log.StreamServerInterceptor(logrus.StandardLogger())))
+	adsys.RegisterServiceServer(srv, s)
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err, "Setup: Listen on unix socket failed")
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	c, err := adsysclient.Connect(adsysclient.WithSocket(socket), adsysclient.WithLogger(logrus.StandardLogger()))
+	require.NoError(t, err, "Setup: can't connect to daemon")
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// mockServer is a daemon answering with canned responses, and recording the requests.
+type mockServer struct {
+	adsys.UnimplementedServiceServer
+
+	dump            string
+	metrics         string
+	fail            bool
+	multipleAnswers bool
+
+	updateRequest *adsys.UpdatePolicyRequest
+	dumpRequest   *adsys.DumpPoliciesRequest
+}
+
+func (s *mockServer) Version(_ *adsys.Empty, stream adsys.Service_VersionServer) error {
+	if err := stream.Send(&adsys.StringResponse{Msg: "1.0"}); err != nil {
+		return err
+	}
+	if s.multipleAnswers {
+		return stream.Send(&adsys.StringResponse{Msg: "2.0"})
+	}
+	return nil
+}
+
+func (s *mockServer) Status(_ *adsys.Empty, stream adsys.Service_StatusServer) error {
+	return stream.Send(&adsys.StringResponse{Msg: "Daemon status"})
+}
+
+func (s *mockServer) Metrics(_ *adsys.MetricsRequest, stream adsys.Service_MetricsServer) error {
+	if s.fail {
+		return errors.New("requested failure")
+	}
+	return stream.Send(&adsys.StringResponse{Msg: s.metrics})
+}
+
+func (s *mockServer) UpdatePolicy(r *adsys.UpdatePolicyRequest, stream adsys.Service_UpdatePolicyServer) error {
+	s.updateRequest = r
+
+	if s.fail {
+		if err := stream.Send(&adsys.PolicyReport{Managers: []*adsys.ManagerResult{
+			{Target: r.GetTarget(), Manager: "dconf", Status: "failed", Reason: "invalid value"},
+		}}); err != nil {
+			return err
+		}
+		return errors.New("requested failure")
+	}
+
+	if r.GetTarget() != "" && !r.GetIsComputer() {
+		return stream.Send(&adsys.PolicyReport{Managers: []*adsys.ManagerResult{
+			{Target: r.GetTarget(), Manager: "dconf", Status: "ok"},
+			{Target: r.GetTarget(), Manager: "scripts", Status: "skipped", Reason: "no rule"},
+		}})
+	}
+	return stream.Send(&adsys.PolicyReport{Managers: []*adsys.ManagerResult{{Manager: "dconf", Status: "ok"}}})
+}
+
+func (s *mockServer) DumpPolicies(r *adsys.DumpPoliciesRequest, stream adsys.Service_DumpPoliciesServer) error {
+	s.dumpRequest = r
+
+	if s.fail {
+		return errors.New("requested failure")
+	}
+	return stream.Send(&adsys.StringResponse{Msg: s.dump})
+}
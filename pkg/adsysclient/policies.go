@@ -0,0 +1,173 @@
+package adsysclient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys"
+	"github.com/ubuntu/decorate"
+)
+
+// GPO is a GPO applied to the machine or to a user, with the rules it enforces.
+type GPO struct {
+	ID   string
+	Name string
+	// Link is the organizational unit or site the GPO is linked to, if known.
+	Link string
+	// Rules are the rules of the GPO, indexed by rule type. Rules overridden by a GPO of higher
+	// precedence are not part of them.
+	Rules map[string][]Rule
+}
+
+// Rule is a rule enforced by a GPO.
+type Rule struct {
+	Key   string
+	Value string
+	// Disabled is true if the rule enforces the default value of the system.
+	Disabled bool
+	// Audit is true if the changes of the rule are only reported, without being applied.
+	Audit bool
+	// Warning is why the rule was not applied during the last refresh, if it was rejected by the machine.
+	Warning string
+}
+
+// AppliedPolicies are the policies applied to the machine or to a user, by order of precedence.
+type AppliedPolicies struct {
+	// Machine are the GPOs of the machine. They have precedence over the user ones.
+	Machine []GPO
+	// User are the GPOs of the user. They are empty for the machine.
+	User []GPO
+}
+
+// AppliedPolicies returns the policies last applied to the machine, or to user if machine is false.
+// An empty user is the current user.
+func (c *Client) AppliedPolicies(ctx context.Context, machine bool, user string) (pols AppliedPolicies, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't get applied policies"))
+
+	if machine && user != "" {
+		return pols, errors.New(gotext.Get("user arguments cannot be used with machine policies"))
+	}
+	target := user
+	if machine {
+		if target, err = os.Hostname(); err != nil {
+			return pols, err
+		}
+	} else if target == "" {
+		if target, err = currentUser(); err != nil {
+			return pols, err
+		}
+	}
+
+	stream, err := c.service.DumpPolicies(ctx, &adsys.DumpPoliciesRequest{
+		Target:     target,
+		IsComputer: machine,
+		Details:    true,
+	})
+	if err != nil {
+		return pols, err
+	}
+	msg, err := singleMsg(stream)
+	if err != nil {
+		return pols, err
+	}
+
+	return parsePolicies(msg, machine)
+}
+
+// currentUser returns the name of the user running the client.
+func currentUser() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+// parsePolicies parses the detailed policies dump of the daemon.
+//
+// The GPOs are listed as "* name (id)", optionally followed by " [link]", and their rules, grouped by type under
+// "** type:", as "*** key: value" or "***+ key" for disabled ones, suffixed by " (audit)" in audit mode and by
+// " (warning: reason)" if they were not applied. The newlines of the values are escaped. For users, the machine and user GPOs are listed under a header line each.
+func parsePolicies(msg string, machine bool) (pols AppliedPolicies, err error) {
+	gpos := &pols.Machine
+	var headers int
+	var gpo *GPO
+	var ruleType string
+	for _, l := range strings.Split(msg, "\n") {
+		switch {
+		case l == "":
+			continue
+		case strings.HasPrefix(l, "*** ") || strings.HasPrefix(l, "***+ "):
+			if gpo == nil || ruleType == "" {
+				return pols, errors.New(gotext.Get("rule outside of any GPO: %q", l))
+			}
+			gpo.Rules[ruleType] = append(gpo.Rules[ruleType], parseRule(l))
+		case strings.HasPrefix(l, "** "):
+			if gpo == nil {
+				return pols, errors.New(gotext.Get("rule type outside of any GPO: %q", l))
+			}
+			ruleType = strings.TrimSuffix(strings.TrimPrefix(l, "** "), ":")
+		case strings.HasPrefix(l, "* "):
+			g, err := parseGPO(l)
+			if err != nil {
+				return pols, err
+			}
+			*gpos = append(*gpos, g)
+			gpo, ruleType = &(*gpos)[len(*gpos)-1], ""
+		default:
+			// The machine GPOs are listed first, under their header, for users.
+			if machine || headers >= 2 {
+				return pols, errors.New(gotext.Get("unexpected line in policies: %q", l))
+			}
+			headers++
+			if headers == 2 {
+				gpos = &pols.User
+			}
+			gpo, ruleType = nil, ""
+		}
+	}
+
+	return pols, nil
+}
+
+// parseGPO parses the GPO line l.
+func parseGPO(l string) (GPO, error) {
+	g := GPO{Rules: make(map[string][]Rule)}
+	l = strings.TrimPrefix(l, "* ")
+	if strings.HasSuffix(l, "]") {
+		if i := strings.LastIndex(l, " ["); i >= 0 {
+			l, g.Link = l[:i], l[i+2:len(l)-1]
+		}
+	}
+	i := strings.LastIndex(l, " (")
+	if i < 0 || !strings.HasSuffix(l, ")") {
+		return g, errors.New(gotext.Get("invalid GPO in policies: %q", l))
+	}
+	g.Name, g.ID = l[:i], l[i+2:len(l)-1]
+	return g, nil
+}
+
+// parseRule parses the rule line l.
+func parseRule(l string) Rule {
+	var r Rule
+	prefix, l, _ := strings.Cut(l, " ")
+	r.Disabled = strings.HasSuffix(prefix, "+")
+	if i := strings.LastIndex(l, " (warning: "); i >= 0 && strings.HasSuffix(l, ")") {
+		l, r.Warning = l[:i], strings.ReplaceAll(l[i+len(" (warning: "):len(l)-1], `\n`, "\n")
+	}
+	if l, r.Audit = strings.CutSuffix(l, " (audit)"); r.Disabled {
+		r.Key = l
+		return r
+	}
+	// Empty values may have their trailing space trimmed.
+	var found bool
+	if r.Key, r.Value, found = strings.Cut(l, ": "); !found {
+		r.Key = strings.TrimSuffix(l, ":")
+	}
+	r.Value = strings.ReplaceAll(r.Value, `\n`, "\n")
+	return r
+}
@@ -0,0 +1,125 @@
+package adsysclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys"
+	"github.com/ubuntu/decorate"
+)
+
+// ManagerStatus is the outcome of a policy manager during a refresh.
+type ManagerStatus string
+
+const (
+	// ManagerOK is used when the manager applied its rules successfully.
+	ManagerOK ManagerStatus = "ok"
+	// ManagerFailed is used when the manager failed to apply its rules.
+	ManagerFailed ManagerStatus = "failed"
+	// ManagerSkipped is used when the manager had no rule to apply or wasn't applied.
+	ManagerSkipped ManagerStatus = "skipped"
+)
+
+// ManagerResult is the outcome of a policy manager for a refreshed object.
+type ManagerResult struct {
+	// Target is the machine or user whose policies were applied.
+	Target  string
+	Manager string
+	Status  ManagerStatus
+	// Reason is why the manager failed or was skipped.
+	Reason string
+}
+
+// RefreshRequest selects the objects whose policies are refreshed.
+// Without Machine, All or User, the policies of the current user are refreshed.
+type RefreshRequest struct {
+	// Machine refreshes the policies of the machine.
+	Machine bool
+	// All refreshes the policies of the machine and of all the connected users.
+	All bool
+	// User is the user whose policies are refreshed.
+	User string
+	// Krb5CC is the Kerberos ticket cache of User. It defaults to KRB5CCNAME for the current user.
+	Krb5CC string
+	// MaxAge only refreshes the policies of a single user if they were not updated within this duration.
+	MaxAge time.Duration
+}
+
+// Refresh downloads and applies the policies selected by r, and returns the outcome of each policy manager.
+// If only some managers failed, the results are returned with the error, and the other policies are applied.
+func (c *Client) Refresh(ctx context.Context, r RefreshRequest) (results []ManagerResult, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't refresh policies"))
+
+	// incompatible options
+	if r.All && (r.Machine || r.User != "" || r.Krb5CC != "") {
+		return nil, errors.New(gotext.Get("machine or user arguments cannot be used with update all"))
+	}
+	if r.Machine && (r.User != "" || r.Krb5CC != "") {
+		return nil, errors.New(gotext.Get("user arguments cannot be used with machine update"))
+	}
+	if r.MaxAge < 0 {
+		return nil, errors.New(gotext.Get("max age must be positive, got %v", r.MaxAge))
+	}
+	if r.MaxAge > 0 && (r.Machine || r.All) {
+		return nil, errors.New(gotext.Get("max age can only be used with user update"))
+	}
+
+	target := r.User
+	krb5cc := r.Krb5CC
+	switch {
+	case r.Machine:
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		// for malconfigured machines where /proc/sys/kernel/hostname returns the fqdn and not only the machine name, strip it
+		target, _, _ = strings.Cut(hostname, ".")
+	case !r.All && target == "":
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		target = u.Username
+		if krb5cc == "" {
+			krb5cc = strings.TrimPrefix(os.Getenv("KRB5CCNAME"), "FILE:")
+		}
+	}
+
+	stream, err := c.service.UpdatePolicy(ctx, &adsys.UpdatePolicyRequest{
+		IsComputer: r.Machine,
+		All:        r.All,
+		Target:     target,
+		Krb5Cc:     krb5cc,
+		MaxAge:     int64(r.MaxAge.Seconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The outcome of the policy managers is sent before the refresh status, even if it failed.
+	for {
+		report, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return results, err
+		}
+		for _, m := range report.GetManagers() {
+			results = append(results, ManagerResult{
+				Target:  m.GetTarget(),
+				Manager: m.GetManager(),
+				Status:  ManagerStatus(m.GetStatus()),
+				Reason:  m.GetReason(),
+			})
+		}
+	}
+
+	return results, nil
+}
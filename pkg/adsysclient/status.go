@@ -0,0 +1,72 @@
+package adsysclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/leonelquinteros/gotext"
+	"github.com/ubuntu/adsys"
+	"github.com/ubuntu/adsys/internal/metrics"
+	"github.com/ubuntu/decorate"
+)
+
+// Refresh describes a refresh of the machine policies.
+type Refresh struct {
+	// Time is when the refresh started.
+	Time time.Time
+	// Duration is the time taken by the whole refresh.
+	Duration time.Duration
+	// Failures is the number of objects, the machine or its users, whose policies failed to be applied.
+	Failures int
+}
+
+// Status is the status of the daemon.
+type Status struct {
+	// Version is the version of the daemon.
+	Version string
+	// LastRefresh is the last refresh of the machine policies recorded by the daemon, if any.
+	LastRefresh *Refresh
+	// Report is the human readable status of the daemon, as printed by adsysctl.
+	Report string
+}
+
+// Status returns the status of the daemon.
+func (c *Client) Status(ctx context.Context) (s Status, err error) {
+	defer decorate.OnError(&err, gotext.Get("can't get daemon status"))
+
+	if s.Version, err = c.Version(ctx); err != nil {
+		return s, err
+	}
+
+	stream, err := c.service.Status(ctx, &adsys.Empty{})
+	if err != nil {
+		return s, err
+	}
+	if s.Report, err = singleMsg(stream); err != nil {
+		return s, err
+	}
+
+	metricsStream, err := c.service.Metrics(ctx, &adsys.MetricsRequest{Json: true})
+	if err != nil {
+		return s, err
+	}
+	msg, err := singleMsg(metricsStream)
+	if err != nil {
+		return s, err
+	}
+	var report struct {
+		Summary struct {
+			Last *metrics.Run `json:"last"`
+		} `json:"summary"`
+	}
+	if err := json.Unmarshal([]byte(msg), &report); err != nil {
+		return s, errors.New(gotext.Get("invalid refresh metrics: %v", err))
+	}
+	if last := report.Summary.Last; last != nil {
+		s.LastRefresh = &Refresh{Time: last.Time, Duration: last.Duration, Failures: last.Failures}
+	}
+
+	return s, nil
+}